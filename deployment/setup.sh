@@ -32,7 +32,7 @@ for i in 1 2 3 4; do
     KEY_FILE="keys/validator${i}.key"
     if [ ! -f "$KEY_FILE" ]; then
         echo "Generating key for validator $i..."
-        $BACH_NODE_BIN gen-key --output "$KEY_FILE" 2>/dev/null
+        $BACH_NODE_BIN gen-key --key-file "$KEY_FILE" 2>/dev/null
         echo "  Created: $KEY_FILE"
     else
         echo "  Key already exists: $KEY_FILE"
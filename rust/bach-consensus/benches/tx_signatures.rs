@@ -0,0 +1,60 @@
+//! Sequential vs parallel transaction signature checks on large blocks
+//!
+//! Run with `cargo bench -p bach-consensus --bench tx_signatures`.
+
+use bach_consensus::TxSignatureVerifier;
+use bach_crypto::{keccak256, PrivateKey};
+use bach_primitives::{H256, U256};
+use bach_types::{Block, Transaction};
+use std::time::{Duration, Instant};
+
+const ROUNDS: u32 = 5;
+
+fn block(size: usize) -> Block {
+    let keys: Vec<PrivateKey> = (0..16u64)
+        .map(|i| PrivateKey::from_bytes(keccak256(&i.to_be_bytes()).as_bytes()).unwrap())
+        .collect();
+    let txs = (0..size as u64)
+        .map(|nonce| {
+            let key = &keys[nonce as usize % keys.len()];
+            let unsigned =
+                Transaction::new(nonce, None, U256::ZERO, vec![], key.sign(&H256::zero()));
+            let signature = key.sign(&unsigned.signing_hash());
+            Transaction::new(nonce, None, U256::ZERO, vec![], signature)
+        })
+        .collect();
+    Block::new(1, H256::zero(), txs, 0)
+}
+
+/// Returns the fastest of `ROUNDS` runs.
+fn time(verifier: &TxSignatureVerifier, block: &Block) -> Duration {
+    (0..ROUNDS)
+        .map(|_| {
+            let start = Instant::now();
+            verifier.verify_block(block).unwrap();
+            start.elapsed()
+        })
+        .min()
+        .unwrap()
+}
+
+fn main() {
+    let sequential = TxSignatureVerifier::sequential();
+    let parallel = TxSignatureVerifier::parallel(None);
+    println!(
+        "{:>8} {:>14} {:>14} {:>8}",
+        "txs", "sequential", "parallel", "speedup"
+    );
+    for size in [100, 1_000, 5_000, 20_000] {
+        let block = block(size);
+        let seq = time(&sequential, &block);
+        let par = time(&parallel, &block);
+        println!(
+            "{:>8} {:>14?} {:>14?} {:>7.2}x",
+            size,
+            seq,
+            par,
+            seq.as_secs_f64() / par.as_secs_f64()
+        );
+    }
+}
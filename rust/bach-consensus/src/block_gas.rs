@@ -0,0 +1,83 @@
+//! Block gas limit
+//!
+//! Chain config caps the gas the transactions of a block may declare in
+//! total. The cap is checked on declared gas limits rather than gas used,
+//! so validators can check a proposal before executing it and every node
+//! counts the same way. Proposers take transactions in pool order until
+//! the next one would go over the cap and leave the rest for later blocks;
+//! validators refuse to pre-vote for a block that declares more. System
+//! transactions at the end of the block don't count. A limit of 0 disables
+//! the rule.
+
+use crate::ConsensusError;
+use bach_types::Transaction;
+
+/// Removes the transactions from the first one that would take the total
+/// declared gas over `limit` onwards and returns them, in their original
+/// order.
+pub fn cap_block_gas(transactions: &mut Vec<Transaction>, limit: u64) -> Vec<Transaction> {
+    if limit == 0 {
+        return Vec::new();
+    }
+    let mut gas = 0u64;
+    let within = transactions
+        .iter()
+        .take_while(|tx| {
+            gas = gas.saturating_add(tx.gas);
+            gas <= limit
+        })
+        .count();
+    transactions.split_off(within)
+}
+
+/// Checks that `transactions` declare at most `limit` gas in total.
+pub fn check_block_gas(transactions: &[Transaction], limit: u64) -> Result<(), ConsensusError> {
+    if limit == 0 {
+        return Ok(());
+    }
+    let gas = transactions
+        .iter()
+        .fold(0u64, |gas, tx| gas.saturating_add(tx.gas));
+    if gas > limit {
+        return Err(ConsensusError::InvalidProposal(format!(
+            "Transactions declare {} gas, over the block gas limit of {}",
+            gas, limit
+        )));
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_crypto::PrivateKey;
+    use bach_primitives::{H256, U256};
+
+    fn tx(key: &PrivateKey, nonce: u64, gas: u64) -> Transaction {
+        let mut tx = Transaction::new(nonce, None, U256::ZERO, Vec::new(), key.sign(&H256::zero()))
+            .with_gas(gas);
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    #[test]
+    fn test_cap_and_check() {
+        let key = PrivateKey::random();
+        let pool = vec![tx(&key, 0, 21_000), tx(&key, 1, 21_000), tx(&key, 2, 21_000)];
+        assert!(check_block_gas(&pool, 50_000).is_err());
+        assert!(check_block_gas(&pool, 63_000).is_ok());
+        assert!(check_block_gas(&pool, 0).is_ok());
+
+        // Later transactions wait even if a smaller one would still fit
+        let mut block = vec![tx(&key, 0, 21_000), tx(&key, 1, 40_000), tx(&key, 2, 1_000)];
+        let deferred = cap_block_gas(&mut block, 50_000);
+        assert_eq!(block.len(), 1);
+        assert_eq!(deferred.len(), 2);
+        assert_eq!(deferred[0].nonce, 1);
+        assert!(check_block_gas(&block, 50_000).is_ok());
+
+        let mut uncapped = pool.clone();
+        assert!(cap_block_gas(&mut uncapped, 0).is_empty());
+        assert_eq!(uncapped.len(), pool.len());
+    }
+}
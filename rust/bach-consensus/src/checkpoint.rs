@@ -0,0 +1,382 @@
+//! Finality checkpoints
+//!
+//! Every `interval` blocks the validators co-sign a `Checkpoint` (height,
+//! block hash, state root) of the committed block. Signatures are gathered
+//! by a `CheckpointCollector`; once validators holding a quorum of voting
+//! power have signed, the `SignedCheckpoint` is a finality anchor anyone
+//! with the validator set can check with `verify_checkpoint`.
+//!
+//! Validators exchange their signatures as `CheckpointVote` consensus
+//! messages. `CheckpointVotes` collects them per height: votes arriving
+//! before this node committed the height are held until it does, and only
+//! votes for the checkpoint this node computed count toward its quorum.
+
+use crate::{ConsensusError, ValidatorSet};
+use bach_types::{Checkpoint, CheckpointSignature, SignedCheckpoint};
+use std::collections::BTreeMap;
+
+/// Most heights whose checkpoint votes are held before this node commits
+/// them
+pub const MAX_EARLY_CHECKPOINT_HEIGHTS: usize = 16;
+
+/// Returns true if a checkpoint is due at `height`. An interval of 0
+/// disables checkpoints; genesis is never a checkpoint.
+pub fn is_checkpoint_height(height: u64, interval: u64) -> bool {
+    interval > 0 && height > 0 && height % interval == 0
+}
+
+/// Gathers validator signatures for one checkpoint.
+#[derive(Debug, Clone)]
+pub struct CheckpointCollector {
+    signed: SignedCheckpoint,
+    power: u64,
+}
+
+impl CheckpointCollector {
+    /// Starts collecting signatures for `checkpoint`.
+    pub fn new(checkpoint: Checkpoint) -> Self {
+        Self {
+            signed: SignedCheckpoint::new(checkpoint),
+            power: 0,
+        }
+    }
+
+    /// Returns the checkpoint being signed.
+    pub fn checkpoint(&self) -> &Checkpoint {
+        &self.signed.checkpoint
+    }
+
+    /// Adds a validator's signature, returning true once the signers hold
+    /// a quorum.
+    pub fn add(
+        &mut self,
+        signature: CheckpointSignature,
+        validator_set: &ValidatorSet,
+    ) -> Result<bool, ConsensusError> {
+        let validator = validator_set
+            .get(&signature.validator)
+            .ok_or(ConsensusError::UnknownValidator(signature.validator))?;
+        if self.signed.signers().contains(&signature.validator) {
+            return Err(ConsensusError::DuplicateVote(signature.validator));
+        }
+        let hash = self.signed.checkpoint.signing_hash();
+        if !signature.signature.verify(&validator.public_key, &hash) {
+            return Err(ConsensusError::InvalidSignature);
+        }
+        self.power += validator.voting_power;
+        self.signed.signatures.push(signature);
+        Ok(self.has_quorum(validator_set))
+    }
+
+    /// Returns the voting power of the signers so far.
+    pub fn power(&self) -> u64 {
+        self.power
+    }
+
+    /// Returns true if the signers hold a quorum of `validator_set`.
+    pub fn has_quorum(&self, validator_set: &ValidatorSet) -> bool {
+        validator_set.has_quorum(self.power)
+    }
+
+    /// Returns the signed checkpoint if the signers hold a quorum.
+    pub fn finish(self, validator_set: &ValidatorSet) -> Option<SignedCheckpoint> {
+        self.has_quorum(validator_set).then_some(self.signed)
+    }
+}
+
+/// A validator's signature over the checkpoint it computed for a height.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CheckpointVote {
+    /// The checkpoint the validator computed
+    pub checkpoint: Checkpoint,
+    /// The validator's signature over it
+    pub signature: CheckpointSignature,
+}
+
+/// Collects checkpoint votes until each checkpoint this node committed
+/// gathers a quorum.
+#[derive(Debug, Default)]
+pub struct CheckpointVotes {
+    /// Collectors for the checkpoints this node committed, by height
+    collecting: BTreeMap<u64, CheckpointCollector>,
+    /// Votes for heights this node hasn't committed yet
+    early: BTreeMap<u64, Vec<CheckpointVote>>,
+    /// Highest height whose checkpoint reached a quorum
+    finalized: u64,
+    /// Checkpoints that reached a quorum, oldest first
+    finished: Vec<SignedCheckpoint>,
+}
+
+impl CheckpointVotes {
+    /// Creates an empty pool.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Starts collecting votes for `checkpoint`, which this node computed
+    /// for a block it committed, counting the votes already held for it.
+    pub fn start(&mut self, checkpoint: Checkpoint, validator_set: &ValidatorSet) {
+        let height = checkpoint.height;
+        if height <= self.finalized || self.collecting.contains_key(&height) {
+            return;
+        }
+        let mut collector = CheckpointCollector::new(checkpoint);
+        for vote in self.early.remove(&height).unwrap_or_default() {
+            if vote.checkpoint == checkpoint {
+                // Held votes were checked on arrival; repeats are dropped
+                let _ = collector.add(vote.signature, validator_set);
+            }
+        }
+        self.collecting.insert(height, collector);
+        self.try_finish(height, validator_set);
+    }
+
+    /// Adds a validator's vote. Votes for heights that already reached a
+    /// quorum are ignored; votes for heights this node hasn't committed are
+    /// held, up to `MAX_EARLY_CHECKPOINT_HEIGHTS` heights.
+    pub fn add(
+        &mut self,
+        vote: CheckpointVote,
+        validator_set: &ValidatorSet,
+    ) -> Result<(), ConsensusError> {
+        let height = vote.checkpoint.height;
+        if height <= self.finalized {
+            return Ok(());
+        }
+        if let Some(collector) = self.collecting.get_mut(&height) {
+            if *collector.checkpoint() != vote.checkpoint {
+                return Err(ConsensusError::CheckpointMismatch {
+                    height,
+                    validator: vote.signature.validator,
+                });
+            }
+            collector.add(vote.signature, validator_set)?;
+            self.try_finish(height, validator_set);
+            return Ok(());
+        }
+
+        if validator_set.get(&vote.signature.validator).is_none() {
+            return Err(ConsensusError::UnknownValidator(vote.signature.validator));
+        }
+        if !vote.signature.verify(&vote.checkpoint) {
+            return Err(ConsensusError::InvalidSignature);
+        }
+        if !self.early.contains_key(&height) && self.early.len() >= MAX_EARLY_CHECKPOINT_HEIGHTS {
+            // Keep the lowest heights, which this node commits first
+            match self.early.keys().next_back() {
+                Some(&highest) if highest > height => {
+                    self.early.remove(&highest);
+                }
+                _ => return Ok(()),
+            }
+        }
+        let votes = self.early.entry(height).or_default();
+        if votes
+            .iter()
+            .any(|held| held.signature.validator == vote.signature.validator)
+        {
+            return Err(ConsensusError::DuplicateVote(vote.signature.validator));
+        }
+        votes.push(vote);
+        Ok(())
+    }
+
+    /// Returns the checkpoints that reached a quorum since the last call.
+    pub fn take_finished(&mut self) -> Vec<SignedCheckpoint> {
+        std::mem::take(&mut self.finished)
+    }
+
+    /// Returns the highest height whose checkpoint reached a quorum.
+    pub fn finalized(&self) -> u64 {
+        self.finalized
+    }
+
+    /// Finishes the checkpoint at `height` if its signers hold a quorum,
+    /// dropping everything held for lower heights.
+    fn try_finish(&mut self, height: u64, validator_set: &ValidatorSet) {
+        let quorum = self
+            .collecting
+            .get(&height)
+            .is_some_and(|collector| collector.has_quorum(validator_set));
+        if !quorum {
+            return;
+        }
+        let collector = self.collecting.remove(&height).expect("checked above");
+        self.finished.extend(collector.finish(validator_set));
+        self.finalized = height;
+        self.collecting = self.collecting.split_off(&(height + 1));
+        self.early = self.early.split_off(&(height + 1));
+    }
+}
+
+/// Checks that a checkpoint is signed by validators of `validator_set`
+/// holding a quorum of voting power.
+pub fn verify_checkpoint(
+    signed: &SignedCheckpoint,
+    validator_set: &ValidatorSet,
+) -> Result<(), ConsensusError> {
+    let mut collector = CheckpointCollector::new(signed.checkpoint);
+    for signature in &signed.signatures {
+        collector.add(signature.clone(), validator_set)?;
+    }
+    if !collector.has_quorum(validator_set) {
+        return Err(ConsensusError::NoCheckpointQuorum {
+            height: signed.height(),
+        });
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::Validator;
+    use bach_crypto::PrivateKey;
+    use bach_primitives::H256;
+
+    fn keys() -> Vec<PrivateKey> {
+        (1..=4u8)
+            .map(|n| PrivateKey::from_bytes(&[n; 32]).unwrap())
+            .collect()
+    }
+
+    fn validator_set(keys: &[PrivateKey]) -> ValidatorSet {
+        ValidatorSet::new(
+            keys.iter()
+                .map(|key| Validator::new(key.public_key(), 100))
+                .collect(),
+        )
+    }
+
+    fn checkpoint() -> Checkpoint {
+        Checkpoint::new(10, H256::from([1u8; 32]), H256::from([2u8; 32]))
+    }
+
+    #[test]
+    fn test_checkpoint_heights() {
+        assert!(!is_checkpoint_height(0, 10));
+        assert!(!is_checkpoint_height(5, 10));
+        assert!(is_checkpoint_height(10, 10));
+        assert!(is_checkpoint_height(20, 10));
+        assert!(!is_checkpoint_height(10, 0));
+    }
+
+    #[test]
+    fn test_collects_until_quorum() {
+        let keys = keys();
+        let set = validator_set(&keys);
+        let mut collector = CheckpointCollector::new(checkpoint());
+
+        assert!(!collector.add(checkpoint().sign(&keys[0]), &set).unwrap());
+        assert!(!collector.add(checkpoint().sign(&keys[1]), &set).unwrap());
+        assert_eq!(
+            collector.add(checkpoint().sign(&keys[1]), &set),
+            Err(ConsensusError::DuplicateVote(
+                keys[1].public_key().to_address()
+            ))
+        );
+        assert!(collector.clone().finish(&set).is_none());
+        assert!(collector.add(checkpoint().sign(&keys[2]), &set).unwrap());
+        assert_eq!(collector.power(), 300);
+
+        let signed = collector.finish(&set).unwrap();
+        assert_eq!(signed.signatures.len(), 3);
+        assert_eq!(verify_checkpoint(&signed, &set), Ok(()));
+    }
+
+    #[test]
+    fn test_rejects_outsiders_and_other_checkpoints() {
+        let keys = keys();
+        let set = validator_set(&keys[..3]);
+        let mut collector = CheckpointCollector::new(checkpoint());
+
+        let outsider = keys[3].public_key().to_address();
+        assert_eq!(
+            collector.add(checkpoint().sign(&keys[3]), &set),
+            Err(ConsensusError::UnknownValidator(outsider))
+        );
+        let other = Checkpoint::new(10, H256::from([1u8; 32]), H256::zero());
+        assert_eq!(
+            collector.add(other.sign(&keys[0]), &set),
+            Err(ConsensusError::InvalidSignature)
+        );
+    }
+
+    fn vote(checkpoint: Checkpoint, key: &PrivateKey) -> CheckpointVote {
+        CheckpointVote {
+            checkpoint,
+            signature: checkpoint.sign(key),
+        }
+    }
+
+    #[test]
+    fn test_votes_reach_quorum_on_the_local_checkpoint() {
+        let keys = keys();
+        let set = validator_set(&keys);
+        let mut votes = CheckpointVotes::new();
+
+        // Votes arriving before the local commit are held
+        votes.add(vote(checkpoint(), &keys[1]), &set).unwrap();
+        assert_eq!(
+            votes.add(vote(checkpoint(), &keys[1]), &set),
+            Err(ConsensusError::DuplicateVote(keys[1].public_key().to_address()))
+        );
+        let other = Checkpoint::new(10, H256::from([1u8; 32]), H256::zero());
+        votes.add(vote(other, &keys[2]), &set).unwrap();
+
+        votes.start(checkpoint(), &set);
+        votes.add(vote(checkpoint(), &keys[0]), &set).unwrap();
+        assert!(votes.take_finished().is_empty());
+        // A vote for another checkpoint doesn't count toward the quorum
+        assert_eq!(
+            votes.add(vote(other, &keys[3]), &set),
+            Err(ConsensusError::CheckpointMismatch {
+                height: 10,
+                validator: keys[3].public_key().to_address(),
+            })
+        );
+        votes.add(vote(checkpoint(), &keys[2]), &set).unwrap();
+
+        let finished = votes.take_finished();
+        assert_eq!(finished.len(), 1);
+        assert_eq!(finished[0].signatures.len(), 3);
+        assert_eq!(verify_checkpoint(&finished[0], &set), Ok(()));
+        assert_eq!(votes.finalized(), 10);
+
+        // Late votes are ignored
+        votes.add(vote(checkpoint(), &keys[3]), &set).unwrap();
+        assert!(votes.take_finished().is_empty());
+    }
+
+    #[test]
+    fn test_early_votes_are_bounded() {
+        let keys = keys();
+        let set = validator_set(&keys);
+        let mut votes = CheckpointVotes::new();
+        let at = |height: u64| Checkpoint::new(height, H256::from([1u8; 32]), H256::zero());
+
+        for height in 1..=MAX_EARLY_CHECKPOINT_HEIGHTS as u64 + 1 {
+            votes.add(vote(at(height + 1), &keys[0]), &set).unwrap();
+        }
+        assert_eq!(votes.early.len(), MAX_EARLY_CHECKPOINT_HEIGHTS);
+        // A lower height displaces the highest held
+        votes.add(vote(at(1), &keys[0]), &set).unwrap();
+        assert!(votes.early.contains_key(&1));
+        assert_eq!(votes.early.len(), MAX_EARLY_CHECKPOINT_HEIGHTS);
+
+        let outsider = PrivateKey::from_bytes(&[9u8; 32]).unwrap();
+        assert!(votes.add(vote(at(1), &outsider), &set).is_err());
+    }
+
+    #[test]
+    fn test_verify_requires_quorum() {
+        let keys = keys();
+        let set = validator_set(&keys);
+        let mut signed = SignedCheckpoint::new(checkpoint());
+        signed.signatures = keys[..2].iter().map(|key| checkpoint().sign(key)).collect();
+        assert_eq!(
+            verify_checkpoint(&signed, &set),
+            Err(ConsensusError::NoCheckpointQuorum { height: 10 })
+        );
+    }
+}
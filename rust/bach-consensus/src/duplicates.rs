@@ -0,0 +1,102 @@
+//! Duplicate transaction checks
+//!
+//! A block may not repeat a transaction, neither one earlier in the same
+//! block nor one committed in an earlier block. Proposers leave repeated
+//! transactions out; validators refuse to pre-vote for a block holding
+//! one. Committed transactions are looked up through `CommittedTxs`, which
+//! must answer exactly: a false positive would make validators disagree on
+//! a valid block. System transactions at the end of the block aren't
+//! checked.
+
+use crate::ConsensusError;
+use bach_primitives::H256;
+use bach_types::Transaction;
+use std::collections::HashSet;
+
+/// Answers whether a transaction was committed in an earlier block.
+pub trait CommittedTxs: Send + Sync {
+    /// Returns true if the transaction with `hash` was committed.
+    fn is_committed(&self, hash: &H256) -> bool;
+}
+
+impl<F> CommittedTxs for F
+where
+    F: Fn(&H256) -> bool + Send + Sync,
+{
+    fn is_committed(&self, hash: &H256) -> bool {
+        self(hash)
+    }
+}
+
+/// Removes the transactions repeating an earlier one in `transactions` or
+/// a committed one and returns them, in their original order.
+pub fn drop_duplicate_txs(
+    transactions: &mut Vec<Transaction>,
+    committed: Option<&dyn CommittedTxs>,
+) -> Vec<Transaction> {
+    let mut seen = HashSet::with_capacity(transactions.len());
+    let mut dropped = Vec::new();
+    transactions.retain(|tx| {
+        let hash = tx.hash();
+        let fresh = seen.insert(hash) && !committed.is_some_and(|c| c.is_committed(&hash));
+        if !fresh {
+            dropped.push(tx.clone());
+        }
+        fresh
+    });
+    dropped
+}
+
+/// Checks that `transactions` repeat neither each other nor a committed
+/// transaction.
+pub fn check_duplicate_txs(
+    transactions: &[Transaction],
+    committed: Option<&dyn CommittedTxs>,
+) -> Result<(), ConsensusError> {
+    let mut seen = HashSet::with_capacity(transactions.len());
+    for (index, tx) in transactions.iter().enumerate() {
+        let hash = tx.hash();
+        if !seen.insert(hash) || committed.is_some_and(|c| c.is_committed(&hash)) {
+            return Err(ConsensusError::DuplicateTx { index, hash });
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_crypto::PrivateKey;
+    use bach_primitives::U256;
+
+    fn tx(key: &PrivateKey, nonce: u64) -> Transaction {
+        let mut tx = Transaction::new(nonce, None, U256::ZERO, Vec::new(), key.sign(&H256::zero()));
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    #[test]
+    fn test_drop_and_check() {
+        let key = PrivateKey::random();
+        let old = tx(&key, 0);
+        let old_hash = old.hash();
+        let committed = move |hash: &H256| *hash == old_hash;
+        let (first, second) = (tx(&key, 1), tx(&key, 2));
+
+        let mut block = vec![first.clone(), old.clone(), second.clone(), first.clone()];
+        assert!(check_duplicate_txs(&block, None).is_err());
+        assert_eq!(
+            check_duplicate_txs(&block[..3], Some(&committed)),
+            Err(ConsensusError::DuplicateTx {
+                index: 1,
+                hash: old.hash(),
+            })
+        );
+        assert!(check_duplicate_txs(&block[..3], None).is_ok());
+
+        let dropped = drop_duplicate_txs(&mut block, Some(&committed));
+        assert_eq!(block, vec![first.clone(), second]);
+        assert_eq!(dropped, vec![old, first]);
+        assert!(check_duplicate_txs(&block, Some(&committed)).is_ok());
+    }
+}
@@ -0,0 +1,486 @@
+//! Equivocation evidence
+//!
+//! A validator equivocates when it signs two different values for the same
+//! height, round and message type. Evidence carries both signatures so any
+//! node can verify it against the validator set, and is submitted as a
+//! transaction to the [`EvidenceRegistry`] native contract.
+//!
+//! Recorded evidence becomes active at the height after the block that
+//! included it. Penalties are derived from the active records only, so
+//! every node applies the same penalties from the same height. Each
+//! recorded entry emits an [`EvidenceEvent`], which nodes return as an
+//! `EvidenceRecorded` log in the transaction's receipt.
+
+use bach_crypto::{keccak256, HashSchedule, Signature, SIGNATURE_LENGTH};
+use bach_primitives::{Address, H256, SystemContract};
+use std::collections::BTreeMap;
+
+use crate::{ConsensusError, Penalty, PenaltyHook, PreCommit, PreVote, Proposal, ValidatorSet};
+
+/// Returns the address of the evidence registry native contract (0x…0101).
+pub fn evidence_registry_address() -> Address {
+    SystemContract::EvidenceRegistry.address()
+}
+
+/// Message type an equivocation was detected on.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum EvidenceKind {
+    /// Two proposals for different blocks
+    Proposal = 0,
+    /// Two pre-votes for different values
+    PreVote = 1,
+    /// Two pre-commits for different values
+    PreCommit = 2,
+}
+
+impl EvidenceKind {
+    fn from_u8(b: u8) -> Option<Self> {
+        match b {
+            0 => Some(Self::Proposal),
+            1 => Some(Self::PreVote),
+            2 => Some(Self::PreCommit),
+            _ => None,
+        }
+    }
+}
+
+/// One of the two conflicting signed values.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SignedValue {
+    /// Block hash (None for a nil vote)
+    pub block_hash: Option<H256>,
+    /// Validator signature over the message
+    pub signature: Signature,
+}
+
+/// Proof that a validator signed two conflicting messages.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Evidence {
+    /// Message type
+    pub kind: EvidenceKind,
+    /// Height of both messages
+    pub height: u64,
+    /// Round of both messages
+    pub round: u32,
+    /// The equivocating validator
+    pub validator: Address,
+    /// First signed value
+    pub first: SignedValue,
+    /// Second signed value
+    pub second: SignedValue,
+}
+
+impl Evidence {
+    /// Builds evidence from two proposals, naming their blocks by their
+    /// hashes under `schedule`. Returns None if they don't conflict.
+    pub fn from_proposals(a: &Proposal, b: &Proposal, schedule: &HashSchedule) -> Option<Self> {
+        if a.proposer != b.proposer || a.height != b.height || a.round != b.round {
+            return None;
+        }
+        Self::conflicting(
+            EvidenceKind::Proposal,
+            a.height,
+            a.round,
+            a.proposer,
+            (Some(a.block.digests(schedule).hash), &a.signature),
+            (Some(b.block.digests(schedule).hash), &b.signature),
+        )
+    }
+
+    /// Builds evidence from two pre-votes. Returns None if they don't conflict.
+    pub fn from_prevotes(a: &PreVote, b: &PreVote) -> Option<Self> {
+        if a.validator != b.validator || a.height != b.height || a.round != b.round {
+            return None;
+        }
+        Self::conflicting(
+            EvidenceKind::PreVote,
+            a.height,
+            a.round,
+            a.validator,
+            (a.block_hash, &a.signature),
+            (b.block_hash, &b.signature),
+        )
+    }
+
+    /// Builds evidence from two pre-commits. Returns None if they don't conflict.
+    pub fn from_precommits(a: &PreCommit, b: &PreCommit) -> Option<Self> {
+        if a.validator != b.validator || a.height != b.height || a.round != b.round {
+            return None;
+        }
+        Self::conflicting(
+            EvidenceKind::PreCommit,
+            a.height,
+            a.round,
+            a.validator,
+            (a.block_hash, &a.signature),
+            (b.block_hash, &b.signature),
+        )
+    }
+
+    fn conflicting(
+        kind: EvidenceKind,
+        height: u64,
+        round: u32,
+        validator: Address,
+        first: (Option<H256>, &Signature),
+        second: (Option<H256>, &Signature),
+    ) -> Option<Self> {
+        if first.0 == second.0 {
+            return None;
+        }
+        Some(Self {
+            kind,
+            height,
+            round,
+            validator,
+            first: SignedValue {
+                block_hash: first.0,
+                signature: first.1.clone(),
+            },
+            second: SignedValue {
+                block_hash: second.0,
+                signature: second.1.clone(),
+            },
+        })
+    }
+
+    /// Checks that both messages are signed by a known validator and conflict.
+    pub fn verify(&self, validator_set: &ValidatorSet) -> Result<(), ConsensusError> {
+        let validator = validator_set
+            .get(&self.validator)
+            .ok_or(ConsensusError::UnknownValidator(self.validator))?;
+
+        if self.first.block_hash == self.second.block_hash {
+            return Err(ConsensusError::InvalidEvidence(
+                "values do not conflict".to_string(),
+            ));
+        }
+
+        for value in [&self.first, &self.second] {
+            let hash = self.signing_hash(value)?;
+            if !value.signature.verify(&validator.public_key, &hash) {
+                return Err(ConsensusError::InvalidSignature);
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Recomputes the hash the validator signed for one of the values.
+    fn signing_hash(&self, value: &SignedValue) -> Result<H256, ConsensusError> {
+        let mut data = Vec::new();
+        data.push(self.kind as u8);
+        data.extend_from_slice(&self.height.to_be_bytes());
+        data.extend_from_slice(&self.round.to_be_bytes());
+        match (self.kind, &value.block_hash) {
+            (EvidenceKind::Proposal, Some(hash)) => data.extend_from_slice(hash.as_bytes()),
+            (EvidenceKind::Proposal, None) => {
+                return Err(ConsensusError::InvalidEvidence(
+                    "proposal without block hash".to_string(),
+                ))
+            }
+            (_, Some(hash)) => {
+                data.push(1);
+                data.extend_from_slice(hash.as_bytes());
+            }
+            (_, None) => data.push(0),
+        }
+        data.extend_from_slice(self.validator.as_bytes());
+        Ok(keccak256(&data))
+    }
+
+    /// Returns the hash identifying this evidence. The order of the two
+    /// values does not matter.
+    pub fn hash(&self) -> H256 {
+        let (a, b) = if self.first.block_hash <= self.second.block_hash {
+            (&self.first, &self.second)
+        } else {
+            (&self.second, &self.first)
+        };
+        let mut data = Vec::new();
+        data.push(self.kind as u8);
+        data.extend_from_slice(&self.height.to_be_bytes());
+        data.extend_from_slice(&self.round.to_be_bytes());
+        data.extend_from_slice(self.validator.as_bytes());
+        for value in [a, b] {
+            encode_hash(&mut data, &value.block_hash);
+        }
+        keccak256(&data)
+    }
+
+    /// Encodes the evidence as transaction input data.
+    pub fn encode(&self) -> Vec<u8> {
+        let mut data = Vec::new();
+        data.push(self.kind as u8);
+        data.extend_from_slice(&self.height.to_be_bytes());
+        data.extend_from_slice(&self.round.to_be_bytes());
+        data.extend_from_slice(self.validator.as_bytes());
+        for value in [&self.first, &self.second] {
+            encode_hash(&mut data, &value.block_hash);
+            data.extend_from_slice(&value.signature.to_bytes());
+        }
+        data
+    }
+
+    /// Decodes evidence from transaction input data.
+    pub fn decode(data: &[u8]) -> Result<Self, ConsensusError> {
+        let mut reader = Reader { data };
+        let kind = EvidenceKind::from_u8(reader.take(1)?[0])
+            .ok_or_else(|| ConsensusError::InvalidEvidence("unknown kind".to_string()))?;
+        let height = u64::from_be_bytes(reader.take(8)?.try_into().unwrap());
+        let round = u32::from_be_bytes(reader.take(4)?.try_into().unwrap());
+        let validator = Address::from_slice(reader.take(20)?).unwrap();
+        let first = reader.signed_value()?;
+        let second = reader.signed_value()?;
+        if !reader.data.is_empty() {
+            return Err(ConsensusError::InvalidEvidence("trailing bytes".to_string()));
+        }
+
+        Ok(Self {
+            kind,
+            height,
+            round,
+            validator,
+            first,
+            second,
+        })
+    }
+}
+
+fn encode_hash(data: &mut Vec<u8>, hash: &Option<H256>) {
+    match hash {
+        Some(hash) => {
+            data.push(1);
+            data.extend_from_slice(hash.as_bytes());
+        }
+        None => data.push(0),
+    }
+}
+
+struct Reader<'a> {
+    data: &'a [u8],
+}
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, n: usize) -> Result<&'a [u8], ConsensusError> {
+        if self.data.len() < n {
+            return Err(ConsensusError::InvalidEvidence("truncated".to_string()));
+        }
+        let (head, tail) = self.data.split_at(n);
+        self.data = tail;
+        Ok(head)
+    }
+
+    fn signed_value(&mut self) -> Result<SignedValue, ConsensusError> {
+        let block_hash = match self.take(1)?[0] {
+            0 => None,
+            1 => Some(H256::from_slice(self.take(32)?).unwrap()),
+            _ => return Err(ConsensusError::InvalidEvidence("bad hash flag".to_string())),
+        };
+        let bytes: [u8; SIGNATURE_LENGTH] = self.take(SIGNATURE_LENGTH)?.try_into().unwrap();
+        let signature = Signature::from_bytes(&bytes)
+            .map_err(|_| ConsensusError::InvalidEvidence("bad signature encoding".to_string()))?;
+        Ok(SignedValue {
+            block_hash,
+            signature,
+        })
+    }
+}
+
+/// A recorded misbehavior.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct EvidenceRecord {
+    /// The verified evidence
+    pub evidence: Evidence,
+    /// Who submitted it
+    pub submitter: Address,
+    /// Block height the evidence was included at
+    pub included_at: u64,
+}
+
+impl EvidenceRecord {
+    /// Returns the first height penalties may take the record into account.
+    pub fn active_from(&self) -> u64 {
+        self.included_at.saturating_add(1)
+    }
+
+    /// Encodes the record for storage.
+    pub fn encode(&self) -> Vec<u8> {
+        let mut data = Vec::new();
+        data.extend_from_slice(&self.included_at.to_be_bytes());
+        data.extend_from_slice(self.submitter.as_bytes());
+        data.extend_from_slice(&self.evidence.encode());
+        data
+    }
+
+    /// Decodes a record encoded by [`EvidenceRecord::encode`].
+    pub fn decode(data: &[u8]) -> Result<Self, ConsensusError> {
+        let mut reader = Reader { data };
+        let included_at = u64::from_be_bytes(reader.take(8)?.try_into().unwrap());
+        let submitter = Address::from_slice(reader.take(20)?).unwrap();
+        Ok(Self {
+            evidence: Evidence::decode(reader.data)?,
+            submitter,
+            included_at,
+        })
+    }
+}
+
+/// Event emitted when new evidence is recorded, for governance to act on.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct EvidenceEvent {
+    /// Hash of the evidence
+    pub evidence_hash: H256,
+    /// The equivocating validator
+    pub validator: Address,
+    /// Message type
+    pub kind: EvidenceKind,
+    /// Height the equivocation happened at
+    pub height: u64,
+}
+
+/// Native contract that validates and records equivocation evidence.
+///
+/// Records are kept in hash order so queries return the same result on
+/// every node.
+#[derive(Debug, Clone, Default)]
+pub struct EvidenceRegistry {
+    records: BTreeMap<H256, EvidenceRecord>,
+    events: Vec<EvidenceEvent>,
+}
+
+impl EvidenceEvent {
+    /// Signature of the log the event is returned as.
+    pub const SIGNATURE: &'static str = "EvidenceRecorded(bytes32,address,uint8,uint64)";
+
+    /// Returns the log topic identifying the event.
+    pub fn topic() -> H256 {
+        keccak256(Self::SIGNATURE.as_bytes())
+    }
+
+    /// Returns the log topics: the event topic, the evidence hash and the
+    /// validator left-padded to 32 bytes.
+    pub fn log_topics(&self) -> Vec<H256> {
+        let mut validator = [0u8; 32];
+        validator[12..].copy_from_slice(self.validator.as_bytes());
+        vec![Self::topic(), self.evidence_hash, H256::from(validator)]
+    }
+
+    /// Returns the log data: the kind and height as 32-byte words.
+    pub fn log_data(&self) -> Vec<u8> {
+        let mut data = vec![0u8; 64];
+        data[31] = self.kind as u8;
+        data[56..].copy_from_slice(&self.height.to_be_bytes());
+        data
+    }
+
+    /// Returns the event an `EvidenceRecorded` log records, if it is one.
+    pub fn from_log(topics: &[H256], data: &[u8]) -> Option<Self> {
+        let [topic, evidence_hash, validator] = topics else {
+            return None;
+        };
+        if *topic != Self::topic() || data.len() != 64 {
+            return None;
+        }
+        Some(Self {
+            evidence_hash: *evidence_hash,
+            validator: Address::from_slice(&validator.as_bytes()[12..]).ok()?,
+            kind: EvidenceKind::from_u8(data[31])?,
+            height: u64::from_be_bytes(data[56..].try_into().ok()?),
+        })
+    }
+}
+
+impl EvidenceRegistry {
+    /// Creates an empty registry.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Adds a record read back from storage, without verifying it again
+    /// or emitting an event.
+    pub fn restore(&mut self, record: EvidenceRecord) {
+        self.records.insert(record.evidence.hash(), record);
+    }
+
+    /// Returns every record, ordered by evidence hash.
+    pub fn records(&self) -> impl Iterator<Item = &EvidenceRecord> {
+        self.records.values()
+    }
+
+    /// Executes an evidence transaction.
+    ///
+    /// `data` is the transaction input produced by [`Evidence::encode`].
+    /// Duplicate submissions are rejected.
+    pub fn submit(
+        &mut self,
+        submitter: Address,
+        data: &[u8],
+        validator_set: &ValidatorSet,
+        block_height: u64,
+    ) -> Result<EvidenceEvent, ConsensusError> {
+        let evidence = Evidence::decode(data)?;
+        if evidence.height > block_height {
+            return Err(ConsensusError::InvalidEvidence(
+                "evidence from a future height".to_string(),
+            ));
+        }
+        evidence.verify(validator_set)?;
+
+        let evidence_hash = evidence.hash();
+        if self.records.contains_key(&evidence_hash) {
+            return Err(ConsensusError::InvalidEvidence("already recorded".to_string()));
+        }
+
+        let event = EvidenceEvent {
+            evidence_hash,
+            validator: evidence.validator,
+            kind: evidence.kind,
+            height: evidence.height,
+        };
+        self.records.insert(
+            evidence_hash,
+            EvidenceRecord {
+                evidence,
+                submitter,
+                included_at: block_height,
+            },
+        );
+        self.events.push(event.clone());
+        Ok(event)
+    }
+
+    /// Returns a recorded evidence entry.
+    pub fn get(&self, evidence_hash: &H256) -> Option<&EvidenceRecord> {
+        self.records.get(evidence_hash)
+    }
+
+    /// Returns all records against a validator, ordered by evidence hash.
+    pub fn records_for(&self, validator: &Address) -> Vec<&EvidenceRecord> {
+        self.records
+            .values()
+            .filter(|r| r.evidence.validator == *validator)
+            .collect()
+    }
+
+    /// Returns the penalties `hook` decides from the records active at
+    /// `height`, ordered by validator address.
+    pub fn penalties(&self, hook: &dyn PenaltyHook, height: u64) -> Vec<(Address, Penalty)> {
+        let mut active: BTreeMap<Address, Vec<&EvidenceRecord>> = BTreeMap::new();
+        for record in self.records.values().filter(|r| r.active_from() <= height) {
+            active.entry(record.evidence.validator).or_default().push(record);
+        }
+        active
+            .into_iter()
+            .filter_map(|(validator, records)| {
+                hook.evaluate(&validator, &records)
+                    .map(|penalty| (validator, penalty))
+            })
+            .collect()
+    }
+
+    /// Drains events emitted since the last call.
+    pub fn take_events(&mut self) -> Vec<EvidenceEvent> {
+        std::mem::take(&mut self.events)
+    }
+}
@@ -0,0 +1,144 @@
+//! Proposer performance tracking and penalty hooks
+//!
+//! The tracker records what this node observed of each proposer: committed,
+//! missed and invalid proposals. Observations differ between nodes, so they
+//! are statistics only and never penalize. Penalties come from equivocation
+//! evidence recorded on chain, through a `PenaltyHook`.
+
+use crate::EvidenceRecord;
+use bach_primitives::Address;
+use std::collections::BTreeMap;
+
+/// Per-validator proposer statistics.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct ProposerStats {
+    /// Proposals that were committed
+    pub proposed: u64,
+    /// Rounds where the validator was proposer but no proposal arrived
+    pub missed: u64,
+    /// Correctly signed proposals that failed validation
+    pub invalid: u64,
+    /// Height of the last recorded event
+    pub last_height: u64,
+}
+
+/// A penalty to apply to a validator.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Penalty {
+    /// Reduce voting power by the given amount (never below 1)
+    Slash(u64),
+    /// Remove the validator from the set
+    Exclude,
+}
+
+/// Decides the penalty for a validator from the equivocation evidence
+/// recorded against it on chain.
+///
+/// Governance logic plugs in here. It sees only on-chain records, so every
+/// node derives the same penalties; see `EvidenceRegistry::penalties`.
+pub trait PenaltyHook: Send + Sync {
+    /// Returns the penalty for `validator` given its active evidence
+    /// records, ordered by evidence hash.
+    fn evaluate(&self, validator: &Address, records: &[&EvidenceRecord]) -> Option<Penalty>;
+}
+
+/// Excludes validators with more evidence records than a fixed limit.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct ThresholdPenaltyHook {
+    /// Evidence records tolerated before exclusion
+    pub max_evidence: usize,
+}
+
+impl PenaltyHook for ThresholdPenaltyHook {
+    fn evaluate(&self, _validator: &Address, records: &[&EvidenceRecord]) -> Option<Penalty> {
+        (records.len() > self.max_evidence).then_some(Penalty::Exclude)
+    }
+}
+
+/// Accumulates proposer statistics for all validators.
+#[derive(Debug, Clone, Default)]
+pub struct ProposerTracker {
+    stats: BTreeMap<Address, ProposerStats>,
+}
+
+impl ProposerTracker {
+    /// Creates an empty tracker.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Records a committed proposal.
+    pub fn record_proposed(&mut self, proposer: &Address, height: u64) -> ProposerStats {
+        self.update(proposer, height, |s| s.proposed += 1)
+    }
+
+    /// Records a round in which the proposer did not propose.
+    pub fn record_missed(&mut self, proposer: &Address, height: u64) -> ProposerStats {
+        self.update(proposer, height, |s| s.missed += 1)
+    }
+
+    /// Records an invalid proposal.
+    pub fn record_invalid(&mut self, proposer: &Address, height: u64) -> ProposerStats {
+        self.update(proposer, height, |s| s.invalid += 1)
+    }
+
+    /// Returns stats for a validator.
+    pub fn get(&self, validator: &Address) -> Option<&ProposerStats> {
+        self.stats.get(validator)
+    }
+
+    /// Returns stats for all tracked validators, ordered by address.
+    pub fn all(&self) -> &BTreeMap<Address, ProposerStats> {
+        &self.stats
+    }
+
+    /// Clears a validator's stats.
+    pub fn reset(&mut self, validator: &Address) {
+        self.stats.remove(validator);
+    }
+
+    fn update(
+        &mut self,
+        validator: &Address,
+        height: u64,
+        f: impl FnOnce(&mut ProposerStats),
+    ) -> ProposerStats {
+        let stats = self.stats.entry(*validator).or_default();
+        f(stats);
+        stats.last_height = height;
+        *stats
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_tracker_accumulates() {
+        let a = Address::from_slice(&[1u8; 20]).unwrap();
+        let mut tracker = ProposerTracker::new();
+
+        tracker.record_proposed(&a, 1);
+        tracker.record_missed(&a, 2);
+        let stats = tracker.record_invalid(&a, 3);
+
+        assert_eq!(stats.proposed, 1);
+        assert_eq!(stats.missed, 1);
+        assert_eq!(stats.invalid, 1);
+        assert_eq!(stats.last_height, 3);
+
+        tracker.reset(&a);
+        assert!(tracker.get(&a).is_none());
+    }
+
+    #[test]
+    fn test_threshold_hook() {
+        let a = Address::from_slice(&[1u8; 20]).unwrap();
+        let hook = ThresholdPenaltyHook::default();
+        assert_eq!(hook.evaluate(&a, &[]), None);
+
+        let hook = ThresholdPenaltyHook { max_evidence: 1 };
+        assert_eq!(hook.evaluate(&a, &[]), None);
+    }
+}
@@ -10,13 +10,109 @@
 //!
 //! # Byzantine Fault Tolerance
 //! Tolerates up to f faulty validators where n > 3f + 1
+//!
+//! # Finality Checkpoints
+//! Every N blocks validators co-sign the committed block's hash and state
+//! root; a quorum of signatures makes a `SignedCheckpoint`. After
+//! committing a checkpoint block a validator calls `sign_checkpoint_vote`
+//! and broadcasts the vote it returns; votes from others arrive through
+//! `handle_message`, and checkpoints that reached a quorum are taken with
+//! `take_checkpoints`.
+//!
+//! # Block Timestamps
+//! A proposal's timestamp must not precede its parent's. With a
+//! `TimestampValidator` it must also be at most the configured drift ahead
+//! of the validator's clock, or the validator refuses to pre-vote for it.
+//!
+//! # System Transactions
+//! Registered `SystemTxGenerator`s append transactions at the end of each
+//! proposed block; validators regenerate them and refuse to pre-vote for a
+//! block whose trailing system transactions differ.
+//!
+//! # Per-Sender Cap
+//! With `set_max_txs_per_sender`, proposals hold at most that many
+//! transactions from one sender and validators refuse to pre-vote for
+//! blocks that hold more.
+//!
+//! # Block Gas Limit
+//! With `set_block_gas_limit`, proposals hold transactions declaring at
+//! most that much gas in total and validators refuse to pre-vote for
+//! blocks that declare more.
+//!
+//! # Duplicate Transactions
+//! Proposals repeat no transaction, and with `with_committed_txs` none
+//! committed in an earlier block either; validators refuse to pre-vote for
+//! blocks that do.
+//!
+//! # Block Hashes
+//! Proposals, votes and cached verification results name a block by its
+//! hash under the chain's hash schedule, set with `set_hash_schedule`
+//! before each height, so a height after a hash migration is voted on by
+//! the same hash it is committed and served under.
+//!
+//! # Penalties
+//! The `ProposerTracker` records missed and invalid proposals this node
+//! observed, as statistics only. Validators are penalized only through
+//! `set_penalties`, from equivocation evidence recorded on chain once it
+//! is active, so every node rebuilds the same validator set per height.
+//!
+//! # Revoked Keys
+//! With `set_revoked_tx_signers`, validators refuse to pre-vote for blocks
+//! holding a transaction signed by a revoked member key.
 
 #![forbid(unsafe_code)]
 
-use bach_crypto::{keccak256, keccak256_concat, PrivateKey, PublicKey, Signature};
-use bach_primitives::{Address, H256};
-use bach_types::{Block, Transaction};
+use bach_crypto::{
+    keccak256, keccak256_concat, HashSchedule, KeyAlgorithm, PrivateKey, PublicKey, Signature,
+    SignatureScheme,
+};
+use bach_primitives::{Address, ErrorCode, ErrorCoded, H256};
+use bach_types::{Block, Checkpoint, CheckpointSignature, SignedCheckpoint, Transaction};
 use std::collections::HashMap;
+use std::sync::Arc;
+
+mod block_gas;
+mod checkpoint;
+mod duplicates;
+mod evidence;
+mod fairness;
+mod sender_cap;
+mod signatures;
+mod speculation;
+mod system_txs;
+mod timestamps;
+mod timing;
+mod verification;
+
+pub use block_gas::{cap_block_gas, check_block_gas};
+pub use checkpoint::{
+    is_checkpoint_height, verify_checkpoint, CheckpointCollector, CheckpointVote, CheckpointVotes,
+    MAX_EARLY_CHECKPOINT_HEIGHTS,
+};
+pub use duplicates::{check_duplicate_txs, drop_duplicate_txs, CommittedTxs};
+pub use evidence::{
+    evidence_registry_address, Evidence, EvidenceEvent, EvidenceKind, EvidenceRecord,
+    EvidenceRegistry, SignedValue,
+};
+pub use fairness::{Penalty, PenaltyHook, ProposerStats, ProposerTracker, ThresholdPenaltyHook};
+pub use sender_cap::{cap_txs_per_sender, check_txs_per_sender};
+pub use signatures::{SignatureCheckMode, TxSignatureVerifier, DEFAULT_MIN_PARALLEL_TXS};
+pub use speculation::{
+    SpeculationConfig, SpeculationStats, SpeculativeExecution, DEFAULT_SPECULATIVE_BATCH_SIZE,
+    DEFAULT_SPECULATIVE_PENDING, DEFAULT_SPECULATIVE_RESULTS,
+};
+pub use system_txs::{
+    gas_settlement_address, GasSettlement, SystemTxGenerator, SystemTxs, MAX_SYSTEM_TXS,
+};
+pub use timestamps::{TimestampValidator, DEFAULT_MAX_CLOCK_DRIFT};
+pub use timing::{
+    AdaptiveTimer, BackoffTimer, EmptyBlockSuppression, FixedTimer, HeartbeatTimer,
+    ProposalAction, ProposalStrategy, ProposalTimer, ProposalTimerConfig, ProposerBackoff,
+    DEFAULT_BACKOFF_AFTER, DEFAULT_MAX_BACKOFF, DEFAULT_PROPOSAL_INTERVAL,
+};
+pub use verification::{
+    BlockVerifier, Verdict, VerificationCache, VerificationResult, DEFAULT_VERIFICATION_CACHE_SIZE,
+};
 
 /// Consensus errors
 #[derive(Debug, Clone, PartialEq, Eq)]
@@ -35,8 +131,67 @@ pub enum ConsensusError {
     DuplicateVote(Address),
     /// Invalid proposal
     InvalidProposal(String),
+    /// Proposal carries a transaction with an unrecoverable signature
+    InvalidTxSignature { index: usize, hash: H256 },
+    /// Proposal carries a transaction signed with a key algorithm the
+    /// chain doesn't allow
+    DisallowedTxSignature {
+        index: usize,
+        hash: H256,
+        algorithm: KeyAlgorithm,
+    },
+    /// Proposal carries a transaction signed with an allowed key algorithm
+    /// over a hash algorithm the chain doesn't allow with it
+    DisallowedTxSigningHash {
+        index: usize,
+        hash: H256,
+        scheme: SignatureScheme,
+    },
+    /// Proposal carries a transaction signed by a revoked member key
+    RevokedTxSigner {
+        index: usize,
+        hash: H256,
+        signer: Address,
+    },
+    /// Proposal repeats a transaction of the same block or a committed one
+    DuplicateTx { index: usize, hash: H256 },
     /// No proposal to vote on
     NoProposal,
+    /// Validator signed two conflicting messages
+    Equivocation(Address),
+    /// Malformed or unverifiable evidence
+    InvalidEvidence(String),
+    /// Checkpoint signers don't hold a quorum of voting power
+    NoCheckpointQuorum { height: u64 },
+    /// Validator signed another checkpoint than this node computed
+    CheckpointMismatch { height: u64, validator: Address },
+    /// Proposed block's timestamp is outside the accepted `min..=max`
+    InvalidTimestamp { timestamp: u64, min: u64, max: u64 },
+}
+
+impl ErrorCoded for ConsensusError {
+    fn error_code(&self) -> ErrorCode {
+        match self {
+            ConsensusError::UnknownValidator(_)
+            | ConsensusError::InvalidSignature
+            | ConsensusError::WrongHeight { .. }
+            | ConsensusError::WrongRound { .. }
+            | ConsensusError::NotProposer
+            | ConsensusError::DuplicateVote(_)
+            | ConsensusError::NoProposal
+            | ConsensusError::NoCheckpointQuorum { .. }
+            | ConsensusError::CheckpointMismatch { .. } => ErrorCode::InvalidConsensusMessage,
+            ConsensusError::InvalidProposal(_) => ErrorCode::InvalidProposal,
+            ConsensusError::InvalidTimestamp { .. } => ErrorCode::InvalidBlockTimestamp,
+            ConsensusError::InvalidTxSignature { .. }
+            | ConsensusError::DisallowedTxSignature { .. }
+            | ConsensusError::DisallowedTxSigningHash { .. }
+            | ConsensusError::RevokedTxSigner { .. } => ErrorCode::InvalidTxSignature,
+            ConsensusError::DuplicateTx { .. } => ErrorCode::DuplicateTx,
+            ConsensusError::Equivocation(_) => ErrorCode::Equivocation,
+            ConsensusError::InvalidEvidence(_) => ErrorCode::InvalidArgument,
+        }
+    }
 }
 
 /// A validator in the consensus set.
@@ -135,6 +290,32 @@ impl ValidatorSet {
     pub fn contains(&self, address: &Address) -> bool {
         self.address_to_index.contains_key(address)
     }
+
+    /// Applies a penalty to a validator.
+    ///
+    /// Returns false if the validator is unknown or if excluding it would
+    /// leave the set empty.
+    pub fn apply_penalty(&mut self, address: &Address, penalty: Penalty) -> bool {
+        let Some(&index) = self.address_to_index.get(address) else {
+            return false;
+        };
+
+        match penalty {
+            Penalty::Slash(amount) => {
+                let validator = &mut self.validators[index];
+                validator.voting_power = validator.voting_power.saturating_sub(amount).max(1);
+            }
+            Penalty::Exclude => {
+                if self.validators.len() == 1 {
+                    return false;
+                }
+                self.validators.remove(index);
+            }
+        }
+
+        *self = Self::new(std::mem::take(&mut self.validators));
+        true
+    }
 }
 
 /// Current phase of the consensus protocol.
@@ -233,9 +414,16 @@ pub struct Proposal {
 }
 
 impl Proposal {
-    /// Computes the signing hash for this proposal.
+    /// Computes the signing hash for this proposal on a chain that never
+    /// migrated its block hash algorithm.
     pub fn signing_hash(&self) -> H256 {
-        let block_hash = self.block.hash();
+        self.signing_hash_with(&HashSchedule::default())
+    }
+
+    /// Computes the signing hash for this proposal, hashing the block as
+    /// `schedule` puts in force at its height.
+    pub fn signing_hash_with(&self, schedule: &HashSchedule) -> H256 {
+        let block_hash = self.block.digests(schedule).hash;
         keccak256_concat(&[
             &[0x00], // message type: proposal
             &self.height.to_be_bytes(),
@@ -247,7 +435,12 @@ impl Proposal {
 
     /// Verifies the signature.
     pub fn verify(&self, public_key: &PublicKey) -> bool {
-        let hash = self.signing_hash();
+        self.verify_with(public_key, &HashSchedule::default())
+    }
+
+    /// Verifies the signature over the block hashed under `schedule`.
+    pub fn verify_with(&self, public_key: &PublicKey, schedule: &HashSchedule) -> bool {
+        let hash = self.signing_hash_with(schedule);
         self.signature.verify(public_key, &hash)
     }
 }
@@ -261,6 +454,8 @@ pub enum ConsensusMessage {
     PreVote(PreVote),
     /// Pre-commit for a block
     PreCommit(PreCommit),
+    /// Signature over a committed block's finality checkpoint
+    Checkpoint(CheckpointVote),
 }
 
 impl ConsensusMessage {
@@ -270,6 +465,7 @@ impl ConsensusMessage {
             ConsensusMessage::Proposal(p) => p.height,
             ConsensusMessage::PreVote(v) => v.height,
             ConsensusMessage::PreCommit(c) => c.height,
+            ConsensusMessage::Checkpoint(v) => v.checkpoint.height,
         }
     }
 
@@ -279,6 +475,8 @@ impl ConsensusMessage {
             ConsensusMessage::Proposal(p) => p.round,
             ConsensusMessage::PreVote(v) => v.round,
             ConsensusMessage::PreCommit(c) => c.round,
+            // Checkpoints are signed after the commit, outside any round
+            ConsensusMessage::Checkpoint(_) => 0,
         }
     }
 }
@@ -386,6 +584,38 @@ pub struct TbftConsensus {
     our_address: Address,
     /// Current consensus state
     state: ConsensusState,
+    /// The validator set before penalties
+    unpenalized: ValidatorSet,
+    /// Proposer performance stats
+    tracker: ProposerTracker,
+    /// Penalties in effect for the current height
+    penalties: Vec<(Address, Penalty)>,
+    /// Equivocation evidence waiting to be submitted
+    evidence: Vec<Evidence>,
+    /// Checks transaction signatures of proposed blocks
+    signature_verifier: Option<TxSignatureVerifier>,
+    /// Executes proposed blocks before pre-voting
+    verifier: Option<Box<dyn BlockVerifier>>,
+    /// Verification results for the current height
+    verification_cache: VerificationCache,
+    /// Gossip and pre-executed batches (speculation enabled only)
+    speculation: Option<SpeculativeExecution>,
+    /// Checks proposed block timestamps against the local clock
+    timestamp_validator: Option<TimestampValidator>,
+    /// Timestamp of the block the current height builds on, once known
+    parent_timestamp: Option<u64>,
+    /// Generators of the system transactions ending each block
+    system_txs: SystemTxs,
+    /// Most transactions per sender in a block; 0 for no cap
+    max_txs_per_sender: u64,
+    /// Most gas the transactions of a block may declare; 0 for no cap
+    block_gas_limit: u64,
+    /// Transactions committed in earlier blocks, which blocks may not repeat
+    committed_txs: Option<Arc<dyn CommittedTxs>>,
+    /// Block hash algorithms by height, which identify blocks in votes
+    hash_schedule: HashSchedule,
+    /// Votes on the finality checkpoints of committed blocks
+    checkpoints: CheckpointVotes,
 }
 
 impl TbftConsensus {
@@ -393,18 +623,285 @@ impl TbftConsensus {
     pub fn new(validator_set: ValidatorSet, private_key: PrivateKey) -> Self {
         let our_address = private_key.public_key().to_address();
         Self {
+            unpenalized: validator_set.clone(),
             validator_set,
             private_key,
             our_address,
             state: ConsensusState::new(0),
+            tracker: ProposerTracker::new(),
+            penalties: Vec::new(),
+            evidence: Vec::new(),
+            signature_verifier: None,
+            verifier: None,
+            verification_cache: VerificationCache::default(),
+            speculation: None,
+            timestamp_validator: None,
+            parent_timestamp: None,
+            system_txs: SystemTxs::new(),
+            hash_schedule: HashSchedule::default(),
+            max_txs_per_sender: 0,
+            block_gas_limit: 0,
+            committed_txs: None,
+            checkpoints: CheckpointVotes::new(),
         }
     }
 
+    /// Sets the verifier used to check transaction signatures of proposed
+    /// blocks before they are simulated.
+    pub fn with_tx_signature_verifier(mut self, verifier: TxSignatureVerifier) -> Self {
+        self.signature_verifier = Some(verifier);
+        self
+    }
+
+    /// Sets the lookup of committed transactions. Proposals leave out
+    /// transactions it reports and validators don't pre-vote for blocks
+    /// holding one.
+    pub fn with_committed_txs(mut self, committed: Arc<dyn CommittedTxs>) -> Self {
+        self.committed_txs = Some(committed);
+        self
+    }
+
+    /// Sets the verifier used to simulate proposed blocks.
+    pub fn with_block_verifier(mut self, verifier: Box<dyn BlockVerifier>) -> Self {
+        self.verifier = Some(verifier);
+        self.verification_cache.clear();
+        self
+    }
+
+    /// Sets the validator checking proposed block timestamps against the
+    /// local clock.
+    pub fn with_timestamp_validator(mut self, validator: TimestampValidator) -> Self {
+        self.timestamp_validator = Some(validator);
+        self
+    }
+
+    /// Returns the block timestamp validator, if set.
+    pub fn timestamp_validator(&self) -> Option<&TimestampValidator> {
+        self.timestamp_validator.as_ref()
+    }
+
+    /// Sets the generators of the system transactions appended to
+    /// proposed blocks and expected at the end of received ones.
+    pub fn with_system_txs(mut self, system_txs: SystemTxs) -> Self {
+        self.system_txs = system_txs;
+        self
+    }
+
+    /// Returns the system transaction generators.
+    pub fn system_txs(&self) -> &SystemTxs {
+        &self.system_txs
+    }
+
+    /// Replaces pooled transactions to reserved addresses in `transactions`
+    /// with the system transactions of the block at `height`, signed with
+    /// our key.
+    pub fn append_system_txs(
+        &self,
+        height: u64,
+        parent_hash: &H256,
+        transactions: &mut Vec<Transaction>,
+    ) {
+        self.system_txs.append(height, parent_hash, transactions, &self.private_key);
+    }
+
+    /// Sets how many transactions from one sender a block may hold, 0 for
+    /// no cap. Callers set it from chain config before each height.
+    pub fn set_max_txs_per_sender(&mut self, limit: u64) {
+        self.max_txs_per_sender = limit;
+    }
+
+    /// Returns the per-sender transaction cap, 0 if there is none.
+    pub fn max_txs_per_sender(&self) -> u64 {
+        self.max_txs_per_sender
+    }
+
+    /// Sets the signature schemes transactions of proposed blocks may be
+    /// signed with. Callers set it from chain config before each height;
+    /// does nothing without a signature verifier.
+    pub fn set_tx_signature_schemes(&mut self, schemes: Vec<SignatureScheme>) {
+        if let Some(verifier) = &mut self.signature_verifier {
+            verifier.set_schemes(schemes);
+        }
+    }
+
+    /// Sets the member keys whose transactions proposed blocks may not
+    /// hold. Callers set it from the revocation registry before each
+    /// height; does nothing without a signature verifier.
+    pub fn set_revoked_tx_signers(&mut self, revoked: impl IntoIterator<Item = Address>) {
+        if let Some(verifier) = &mut self.signature_verifier {
+            verifier.set_revoked(revoked);
+        }
+    }
+
+    /// Sets the most gas the transactions of a block may declare, 0 for no
+    /// cap. Callers set it from chain config before each height.
+    pub fn set_block_gas_limit(&mut self, limit: u64) {
+        self.block_gas_limit = limit;
+    }
+
+    /// Returns the block gas limit, 0 if there is none.
+    pub fn block_gas_limit(&self) -> u64 {
+        self.block_gas_limit
+    }
+
+    /// Sets the block hash schedule. Callers set it from chain config
+    /// before each height, so proposals, votes and cached verification
+    /// results name blocks by the hash they are committed under.
+    pub fn set_hash_schedule(&mut self, schedule: HashSchedule) {
+        self.hash_schedule = schedule;
+    }
+
+    /// Returns the hash identifying `block`: its digest under the hash
+    /// schedule.
+    pub fn block_hash(&self, block: &Block) -> H256 {
+        block.digests(&self.hash_schedule).hash
+    }
+
+    /// Records the timestamp of the block the current height builds on.
+    ///
+    /// `advance_height` records it from the committed block; callers that
+    /// start a height themselves, e.g. after sync, set it here.
+    pub fn set_parent_timestamp(&mut self, timestamp: u64) {
+        self.parent_timestamp = Some(timestamp);
+    }
+
+    /// Enables speculative pre-execution: transactions passed to
+    /// `observe_transaction` are batched and simulated by `pre_execute`
+    /// before the proposal arrives. Needs a block verifier.
+    pub fn with_speculation(mut self, config: SpeculationConfig) -> Self {
+        self.speculation = Some(SpeculativeExecution::new(config));
+        self
+    }
+
+    /// Returns the speculation state, if enabled.
+    pub fn speculation(&self) -> Option<&SpeculativeExecution> {
+        self.speculation.as_ref()
+    }
+
+    /// Records a transaction seen on gossip for speculative pre-execution.
+    /// Does nothing unless speculation is enabled.
+    pub fn observe_transaction(&mut self, tx: Transaction) {
+        if let Some(speculation) = &mut self.speculation {
+            speculation.observe(tx);
+        }
+    }
+
+    /// Simulates the block the proposer of the current round is likely to
+    /// propose on `parent_hash` at `timestamp`, so the proposal can reuse
+    /// the result. The block is built as `create_proposal` would build it
+    /// from the pending batch.
+    ///
+    /// Only followers still waiting for the round's proposal speculate.
+    /// Returns true if a block was simulated.
+    pub fn pre_execute(&mut self, parent_hash: H256, timestamp: u64) -> bool {
+        let proposer = self.validator_set.get_proposer(self.state.height, self.state.round);
+        if proposer.address == self.our_address
+            || self.state.proposal.is_some()
+            || self.verifier.is_none()
+        {
+            return false;
+        }
+        let Some(batch) = self.speculation.as_ref().and_then(|s| s.next_batch()) else {
+            return false;
+        };
+        let block = self.build_block(batch, parent_hash, timestamp);
+        let (Some(speculation), Some(verifier)) = (&mut self.speculation, &self.verifier) else {
+            return false;
+        };
+        if speculation.is_speculated(&block) {
+            return false;
+        }
+        let result = verifier.verify(&block);
+        speculation.insert(&block, result);
+        true
+    }
+
+    /// Returns the verification result cache.
+    pub fn verification_cache(&self) -> &VerificationCache {
+        &self.verification_cache
+    }
+
+    /// Returns the cached verification result for a block, if any.
+    ///
+    /// Lets the executor reuse the simulated read/write sets on commit.
+    pub fn verification_result(&self, block_hash: &H256) -> Option<Arc<VerificationResult>> {
+        self.verification_cache.peek(block_hash).cloned()
+    }
+
+    /// Drops cached verification results.
+    ///
+    /// Must be called when state changes outside of `advance_height`,
+    /// e.g. when the chain configuration is updated.
+    pub fn invalidate_verification_cache(&mut self) {
+        self.verification_cache.clear();
+        if let Some(speculation) = &mut self.speculation {
+            speculation.clear_results();
+        }
+    }
+
+    /// Returns the proposer performance tracker.
+    pub fn proposer_tracker(&self) -> &ProposerTracker {
+        &self.tracker
+    }
+
+    /// Sets the penalties in effect for the current height, as derived
+    /// from on-chain evidence (see `EvidenceRegistry::penalties`), and
+    /// rebuilds the validator set from the unpenalized one. Call it before
+    /// the height's first round so every node agrees on its quorum.
+    pub fn set_penalties(&mut self, penalties: Vec<(Address, Penalty)>) {
+        if penalties == self.penalties {
+            return;
+        }
+        let mut validator_set = self.unpenalized.clone();
+        for (validator, penalty) in &penalties {
+            validator_set.apply_penalty(validator, *penalty);
+        }
+        self.validator_set = validator_set;
+        self.penalties = penalties;
+    }
+
+    /// Returns the penalties in effect for the current height.
+    pub fn penalties(&self) -> &[(Address, Penalty)] {
+        &self.penalties
+    }
+
+    /// Drains detected equivocation evidence.
+    ///
+    /// The caller submits each entry as a transaction to the evidence
+    /// registry (see [`evidence_registry_address`]).
+    pub fn take_evidence(&mut self) -> Vec<Evidence> {
+        std::mem::take(&mut self.evidence)
+    }
+
     /// Returns our validator address.
     pub fn our_address(&self) -> &Address {
         &self.our_address
     }
 
+    /// Signs a finality checkpoint with our validator key.
+    pub fn sign_checkpoint(&self, checkpoint: &Checkpoint) -> CheckpointSignature {
+        checkpoint.sign(&self.private_key)
+    }
+
+    /// Starts collecting votes for `checkpoint`, computed from a block this
+    /// node committed, and returns our vote to broadcast.
+    pub fn sign_checkpoint_vote(&mut self, checkpoint: Checkpoint) -> ConsensusMessage {
+        let vote = CheckpointVote {
+            checkpoint,
+            signature: self.sign_checkpoint(&checkpoint),
+        };
+        self.checkpoints.start(checkpoint, &self.validator_set);
+        // Fails only if we aren't in the set or already signed
+        let _ = self.checkpoints.add(vote.clone(), &self.validator_set);
+        ConsensusMessage::Checkpoint(vote)
+    }
+
+    /// Returns the checkpoints that gathered a quorum of votes since the
+    /// last call, oldest first.
+    pub fn take_checkpoints(&mut self) -> Vec<SignedCheckpoint> {
+        self.checkpoints.take_finished()
+    }
+
     /// Returns the current consensus state.
     pub fn state(&self) -> &ConsensusState {
         &self.state
@@ -423,14 +920,35 @@ impl TbftConsensus {
 
     /// Starts consensus at a new height.
     pub fn start_height(&mut self, height: u64) -> Vec<ConsensusMessage> {
+        self.reset_speculation();
         self.state = ConsensusState::new(height);
         self.state.step = ConsensusStep::Propose;
+        self.verification_cache.clear();
         Vec::new()
     }
 
+    /// Builds the block this node would propose at the current height:
+    /// a `timestamp` before the parent's is raised to it, repeated and
+    /// capped transactions are left out and system transactions appended.
+    fn build_block(
+        &self,
+        mut transactions: Vec<Transaction>,
+        parent_hash: H256,
+        timestamp: u64,
+    ) -> Block {
+        let timestamp = timestamp.max(self.parent_timestamp.unwrap_or(0));
+        drop_duplicate_txs(&mut transactions, self.committed_txs.as_deref());
+        cap_txs_per_sender(&mut transactions, self.max_txs_per_sender);
+        cap_block_gas(&mut transactions, self.block_gas_limit);
+        self.append_system_txs(self.state.height, &parent_hash, &mut transactions);
+        Block::new(self.state.height, parent_hash, transactions, timestamp)
+    }
+
     /// Creates a proposal if we are the proposer for this round.
     ///
-    /// Returns None if we are not the proposer.
+    /// A `timestamp` before the parent's is raised to it and transactions
+    /// over the per-sender cap are left out. Returns None if we are not the
+    /// proposer.
     pub fn create_proposal(
         &mut self,
         transactions: Vec<Transaction>,
@@ -444,14 +962,13 @@ impl TbftConsensus {
         }
 
         // If we're locked on a block, propose that block
-        let block = if let Some(locked) = &self.state.locked_block {
-            locked.clone()
-        } else {
-            Block::new(self.state.height, parent_hash, transactions, timestamp)
+        let block = match &self.state.locked_block {
+            Some(locked) => locked.clone(),
+            None => self.build_block(transactions, parent_hash, timestamp),
         };
 
         // Compute signing hash for the proposal
-        let block_hash = block.hash();
+        let block_hash = self.block_hash(&block);
         let signing_hash = keccak256_concat(&[
             &[0x00], // message type: proposal
             &self.state.height.to_be_bytes(),
@@ -487,6 +1004,10 @@ impl TbftConsensus {
             ConsensusMessage::Proposal(proposal) => self.handle_proposal(proposal),
             ConsensusMessage::PreVote(prevote) => self.handle_prevote(prevote),
             ConsensusMessage::PreCommit(precommit) => self.handle_precommit(precommit),
+            ConsensusMessage::Checkpoint(vote) => {
+                self.checkpoints.add(vote, &self.validator_set)?;
+                Ok(Vec::new())
+            }
         }
     }
 
@@ -520,17 +1041,104 @@ impl TbftConsensus {
             .get(&proposal.proposer)
             .ok_or(ConsensusError::UnknownValidator(proposal.proposer))?;
 
-        if !proposal.verify(&validator.public_key) {
+        if !proposal.verify_with(&validator.public_key, &self.hash_schedule) {
             return Err(ConsensusError::InvalidSignature);
         }
 
+        // A second, different proposal for the same round is equivocation
+        if let Some(existing) = &self.state.proposal {
+            let schedule = &self.hash_schedule;
+            if let Some(evidence) = Evidence::from_proposals(existing, &proposal, schedule) {
+                self.evidence.push(evidence);
+                return Err(ConsensusError::Equivocation(proposal.proposer));
+            }
+        }
+
         // Verify block height matches
         if proposal.block.height != proposal.height {
+            self.tracker.record_invalid(&proposal.proposer, proposal.height);
             return Err(ConsensusError::InvalidProposal(
                 "Block height mismatch".to_string(),
             ));
         }
 
+        // Check the timestamp, unless this is the block we locked on, which
+        // was checked when it was first proposed and may since have fallen
+        // behind our clock
+        let locked = self
+            .state
+            .locked_block
+            .as_ref()
+            .is_some_and(|block| self.block_hash(block) == self.block_hash(&proposal.block));
+        if !locked {
+            self.check_timestamp(&proposal.block)?;
+        }
+
+        // The block must end with the system transactions we derive from it,
+        // call no reserved address before them, repeat no transaction and
+        // hold no more user transactions per sender, nor declared gas, than
+        // the caps
+        let user_txs = proposal.block.transactions.len() - self.system_txs.count(&proposal.block);
+        let checked = self
+            .system_txs
+            .verify(&proposal.block, &proposal.proposer)
+            .and_then(|()| {
+                check_duplicate_txs(
+                    &proposal.block.transactions[..user_txs],
+                    self.committed_txs.as_deref(),
+                )
+            })
+            .and_then(|()| {
+                check_txs_per_sender(
+                    &proposal.block.transactions[..user_txs],
+                    self.max_txs_per_sender,
+                )
+            })
+            .and_then(|()| {
+                check_block_gas(&proposal.block.transactions[..user_txs], self.block_gas_limit)
+            });
+        if let Err(e) = checked {
+            self.tracker.record_invalid(&proposal.proposer, proposal.height);
+            return Err(e);
+        }
+
+        // Check transaction signatures unless the block was verified before
+        if let Some(signature_verifier) = &self.signature_verifier {
+            let block_hash = self.block_hash(&proposal.block);
+            if self.verification_cache.peek(&block_hash).is_none() {
+                if let Err(e) = signature_verifier.verify_block(&proposal.block) {
+                    self.tracker.record_invalid(&proposal.proposer, proposal.height);
+                    return Err(e);
+                }
+            }
+        }
+
+        // Simulate the block; re-deliveries of the same block hit the cache
+        // and a batch pre-executed on the same parent is reused
+        if let Some(verifier) = &self.verifier {
+            let block_hash = self.block_hash(&proposal.block);
+            let result = match self.verification_cache.get(&block_hash) {
+                Some(result) => result,
+                None => {
+                    let speculated = self
+                        .speculation
+                        .as_mut()
+                        .and_then(|speculation| speculation.lookup(&proposal.block));
+                    let result = match speculated {
+                        Some(result) => result.as_ref().clone(),
+                        None => verifier.verify(&proposal.block),
+                    };
+                    if !result.verdict.is_valid() {
+                        self.tracker.record_invalid(&proposal.proposer, proposal.height);
+                    }
+                    self.verification_cache.insert(block_hash, result)
+                }
+            };
+            if let Verdict::Invalid(reason) = &result.verdict {
+                return Err(ConsensusError::InvalidProposal(reason.clone()));
+            }
+        }
+
         // Store the proposal
         self.state.proposal = Some(proposal.clone());
 
@@ -552,12 +1160,27 @@ impl TbftConsensus {
         Ok(messages)
     }
 
+    /// Checks a proposed block's timestamp against its parent's and, with a
+    /// timestamp validator, against our clock.
+    fn check_timestamp(&self, block: &Block) -> Result<(), ConsensusError> {
+        let parent_timestamp = self.parent_timestamp.unwrap_or(0);
+        match &self.timestamp_validator {
+            Some(validator) => validator.check(block.timestamp, parent_timestamp).map(|_| ()),
+            None if block.timestamp < parent_timestamp => Err(ConsensusError::InvalidTimestamp {
+                timestamp: block.timestamp,
+                min: parent_timestamp,
+                max: u64::MAX,
+            }),
+            None => Ok(()),
+        }
+    }
+
     /// Decides what block hash to pre-vote for.
     fn decide_prevote(&self, proposal: &Proposal) -> Option<H256> {
         // If we're locked on a different block, vote nil
         if let Some(locked) = &self.state.locked_block {
-            let locked_hash = locked.hash();
-            let proposal_hash = proposal.block.hash();
+            let locked_hash = self.block_hash(locked);
+            let proposal_hash = self.block_hash(&proposal.block);
             if locked_hash != proposal_hash {
                 // Locked on different block - vote nil unless proposal is for higher round
                 if let Some(locked_round) = self.state.locked_round {
@@ -569,7 +1192,7 @@ impl TbftConsensus {
         }
 
         // Vote for the proposed block
-        Some(proposal.block.hash())
+        Some(self.block_hash(&proposal.block))
     }
 
     /// Creates and signs a pre-vote message.
@@ -629,8 +1252,14 @@ impl TbftConsensus {
             .get(&prevote.validator)
             .ok_or(ConsensusError::UnknownValidator(prevote.validator))?;
 
-        // Check for duplicate
-        if self.state.prevotes.contains_key(&prevote.validator) {
+        // Check for duplicate; a conflicting signed vote is equivocation
+        if let Some(existing) = self.state.prevotes.get(&prevote.validator) {
+            if existing.block_hash != prevote.block_hash && prevote.verify(&validator.public_key) {
+                if let Some(evidence) = Evidence::from_prevotes(existing, &prevote) {
+                    self.evidence.push(evidence);
+                }
+                return Err(ConsensusError::Equivocation(prevote.validator));
+            }
             return Err(ConsensusError::DuplicateVote(prevote.validator));
         }
 
@@ -696,7 +1325,7 @@ impl TbftConsensus {
         // If quorum is for a block (not nil), lock on it
         if let Some(Some(block_hash)) = quorum_hash {
             if let Some(proposal) = &self.state.proposal {
-                if proposal.block.hash() == block_hash {
+                if self.block_hash(&proposal.block) == block_hash {
                     self.state.locked_block = Some(proposal.block.clone());
                     self.state.locked_round = Some(self.state.round);
                 }
@@ -773,8 +1402,14 @@ impl TbftConsensus {
             .get(&precommit.validator)
             .ok_or(ConsensusError::UnknownValidator(precommit.validator))?;
 
-        // Check for duplicate
-        if self.state.precommits.contains_key(&precommit.validator) {
+        // Check for duplicate; a conflicting signed vote is equivocation
+        if let Some(existing) = self.state.precommits.get(&precommit.validator) {
+            if existing.block_hash != precommit.block_hash && precommit.verify(&validator.public_key) {
+                if let Some(evidence) = Evidence::from_precommits(existing, &precommit) {
+                    self.evidence.push(evidence);
+                }
+                return Err(ConsensusError::Equivocation(precommit.validator));
+            }
             return Err(ConsensusError::DuplicateVote(precommit.validator));
         }
 
@@ -832,9 +1467,10 @@ impl TbftConsensus {
         // If quorum is for a block (not nil), commit it
         if let Some(Some(block_hash)) = quorum_hash {
             if let Some(proposal) = &self.state.proposal {
-                if proposal.block.hash() == block_hash {
+                if self.block_hash(&proposal.block) == block_hash {
                     self.state.committed_block = Some(proposal.block.clone());
                     self.state.step = ConsensusStep::Commit;
+                    self.tracker.record_proposed(&proposal.proposer, proposal.height);
                 }
             }
         }
@@ -846,6 +1482,15 @@ impl TbftConsensus {
     ///
     /// Returns messages to broadcast (may include a proposal for the new round).
     pub fn handle_timeout(&mut self) -> Vec<ConsensusMessage> {
+        // The proposer skipped its turn
+        if self.state.proposal.is_none() && !self.validator_set.is_empty() {
+            let proposer = self
+                .validator_set
+                .get_proposer(self.state.height, self.state.round)
+                .address;
+            self.tracker.record_missed(&proposer, self.state.height);
+        }
+
         // Move to the next round
         self.state.next_round();
 
@@ -858,9 +1503,25 @@ impl TbftConsensus {
     ///
     /// Should be called after the committed block has been applied to state.
     pub fn advance_height(&mut self) {
+        if let Some(block) = &self.state.committed_block {
+            self.parent_timestamp = Some(block.timestamp);
+        }
+        self.verification_cache.clear();
+        self.reset_speculation();
         self.state.next_height();
     }
 
+    /// Drops speculated results and the committed block's transactions
+    /// before moving to another height.
+    fn reset_speculation(&mut self) {
+        if let Some(speculation) = &mut self.speculation {
+            speculation.clear_results();
+            if let Some(block) = &self.state.committed_block {
+                speculation.remove_committed(block);
+            }
+        }
+    }
+
     /// Returns true if a block has been committed for this height.
     pub fn is_committed(&self) -> bool {
         self.state.committed_block.is_some()
@@ -1024,6 +1685,163 @@ mod tests {
         assert!(matches!(messages[0], ConsensusMessage::PreVote(_)));
     }
 
+    #[test]
+    fn test_votes_use_scheduled_block_hash() {
+        use bach_crypto::HashAlgorithm;
+
+        let (private_keys, validator_set) = create_test_validators(4);
+        let schedule = HashSchedule::default().with_migration(0, HashAlgorithm::Sha256);
+        let mut proposer = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+        proposer.set_hash_schedule(schedule.clone());
+        proposer.start_height(0);
+        let proposal_msg = proposer.create_proposal(vec![], H256::zero(), 1000).unwrap();
+        let ConsensusMessage::Proposal(proposal) = &proposal_msg else {
+            panic!("expected a proposal");
+        };
+        let hash = proposal.block.digests(&schedule).hash;
+        assert_ne!(hash, proposal.block.hash());
+        assert!(proposal.verify_with(&private_keys[0].public_key(), &schedule));
+        assert!(!proposal.verify(&private_keys[0].public_key()));
+
+        // A receiver on the same schedule pre-votes for the scheduled hash
+        let mut receiver = TbftConsensus::new(validator_set.clone(), private_keys[1].clone());
+        receiver.set_hash_schedule(schedule);
+        receiver.start_height(0);
+        let messages = receiver.handle_message(proposal_msg.clone()).unwrap();
+        assert!(matches!(
+            &messages[0],
+            ConsensusMessage::PreVote(prevote) if prevote.block_hash == Some(hash)
+        ));
+
+        // One still hashing with Keccak-256 can't verify the proposal
+        let mut stale = TbftConsensus::new(validator_set, private_keys[2].clone());
+        stale.start_height(0);
+        assert_eq!(
+            stale.handle_message(proposal_msg).unwrap_err(),
+            ConsensusError::InvalidSignature
+        );
+    }
+
+    #[test]
+    fn test_reject_out_of_range_timestamp() {
+        let (private_keys, validator_set) = create_test_validators(4);
+        let clock = bach_primitives::FakeClock::new();
+        clock.advance(std::time::Duration::from_secs(1000));
+
+        let mut proposer = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+        proposer.start_height(0);
+        let mut receiver = TbftConsensus::new(validator_set, private_keys[1].clone())
+            .with_timestamp_validator(TimestampValidator::new(
+                Arc::new(clock),
+                std::time::Duration::from_secs(10),
+            ));
+        receiver.start_height(0);
+        receiver.set_parent_timestamp(1008);
+
+        // Too far ahead of the receiver's clock
+        let proposal_msg = proposer.create_proposal(vec![], H256::zero(), 2000).unwrap();
+        let err = receiver.handle_message(proposal_msg).unwrap_err();
+        assert_eq!(
+            err,
+            ConsensusError::InvalidTimestamp {
+                timestamp: 2000,
+                min: 1008,
+                max: 1010,
+            }
+        );
+        assert_eq!(err.error_code(), ErrorCode::InvalidBlockTimestamp);
+        assert!(receiver.state().proposal().is_none());
+
+        // Behind the parent
+        let proposal_msg = proposer.create_proposal(vec![], H256::zero(), 1005).unwrap();
+        assert!(receiver.handle_message(proposal_msg).is_err());
+        let validator = receiver.timestamp_validator().unwrap();
+        assert_eq!(validator.rejections(), 2);
+        assert_eq!(validator.last_drift(), 5);
+
+        // A proposer that knows the parent stamps at least its timestamp
+        proposer.set_parent_timestamp(1008);
+        let proposal_msg = proposer.create_proposal(vec![], H256::zero(), 1005).unwrap();
+        assert!(receiver.handle_message(proposal_msg).is_ok());
+        assert_eq!(receiver.state().proposal().unwrap().block.timestamp, 1008);
+    }
+
+    #[test]
+    fn test_reject_txs_over_sender_cap() {
+        let (private_keys, validator_set) = create_test_validators(4);
+        let sender = PrivateKey::random();
+        let transactions: Vec<Transaction> = (0..3)
+            .map(|nonce| {
+                let mut tx = Transaction::new(
+                    nonce,
+                    None,
+                    bach_primitives::U256::ZERO,
+                    Vec::new(),
+                    sender.sign(&H256::zero()),
+                );
+                tx.signature = sender.sign(&tx.signing_hash()).into();
+                tx
+            })
+            .collect();
+
+        let mut proposer = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+        proposer.start_height(0);
+        let mut receiver = TbftConsensus::new(validator_set, private_keys[1].clone());
+        receiver.start_height(0);
+        receiver.set_max_txs_per_sender(2);
+
+        // An uncapped proposer's block holds too many of the sender's txs
+        let proposal_msg = proposer
+            .create_proposal(transactions.clone(), H256::zero(), 1000)
+            .unwrap();
+        let err = receiver.handle_message(proposal_msg).unwrap_err();
+        assert!(matches!(err, ConsensusError::InvalidProposal(_)));
+
+        // A capped proposer leaves the last one out
+        proposer.set_max_txs_per_sender(2);
+        let proposal_msg = proposer.create_proposal(transactions, H256::zero(), 1000).unwrap();
+        assert!(receiver.handle_message(proposal_msg).is_ok());
+        assert_eq!(receiver.state().proposal().unwrap().block.transactions.len(), 2);
+    }
+
+    #[test]
+    fn test_reject_txs_over_block_gas_limit() {
+        let (private_keys, validator_set) = create_test_validators(4);
+        let sender = PrivateKey::random();
+        let transactions: Vec<Transaction> = (0..3)
+            .map(|nonce| {
+                let mut tx = Transaction::new(
+                    nonce,
+                    None,
+                    bach_primitives::U256::ZERO,
+                    Vec::new(),
+                    sender.sign(&H256::zero()),
+                );
+                tx.signature = sender.sign(&tx.signing_hash()).into();
+                tx
+            })
+            .collect();
+
+        let mut proposer = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+        proposer.start_height(0);
+        let mut receiver = TbftConsensus::new(validator_set, private_keys[1].clone());
+        receiver.start_height(0);
+        receiver.set_block_gas_limit(50_000);
+
+        // Three transfers declare 63000 gas
+        let proposal_msg = proposer
+            .create_proposal(transactions.clone(), H256::zero(), 1000)
+            .unwrap();
+        let err = receiver.handle_message(proposal_msg).unwrap_err();
+        assert!(matches!(err, ConsensusError::InvalidProposal(_)));
+
+        // A capped proposer leaves the last one out
+        proposer.set_block_gas_limit(50_000);
+        let proposal_msg = proposer.create_proposal(transactions, H256::zero(), 1000).unwrap();
+        assert!(receiver.handle_message(proposal_msg).is_ok());
+        assert_eq!(receiver.state().proposal().unwrap().block.transactions.len(), 2);
+    }
+
     #[test]
     fn test_full_consensus_round() {
         let (private_keys, validator_set) = create_test_validators(4);
@@ -1181,6 +1999,55 @@ mod tests {
         assert_eq!(consensus.state().step(), ConsensusStep::Propose);
     }
 
+    #[test]
+    fn test_missed_proposals_only_tracked() {
+        let (private_keys, validator_set) = create_test_validators(4);
+        let mut consensus = TbftConsensus::new(validator_set.clone(), private_keys[1].clone());
+        let absent = validator_set.get_proposer(0, 0).address;
+
+        // Proposer for round 0 misses twice (rounds 0 and 4)
+        consensus.start_height(0);
+        for _ in 0..5 {
+            consensus.handle_timeout();
+        }
+        assert_eq!(consensus.proposer_tracker().get(&absent).unwrap().missed, 2);
+
+        // Local observations never change the validator set
+        consensus.advance_height();
+        assert!(consensus.validator_set().contains(&absent));
+    }
+
+    #[test]
+    fn test_penalties_rebuild_validator_set() {
+        let (private_keys, validator_set) = create_test_validators(4);
+        let mut consensus = TbftConsensus::new(validator_set.clone(), private_keys[1].clone());
+        let excluded = validator_set.validators()[0].address;
+
+        consensus.set_penalties(vec![(excluded, Penalty::Exclude)]);
+        assert!(!consensus.validator_set().contains(&excluded));
+        assert_eq!(consensus.validator_set().len(), 3);
+
+        // Penalties are not cumulative: lifting them restores the set
+        consensus.set_penalties(vec![(excluded, Penalty::Exclude)]);
+        assert_eq!(consensus.validator_set().len(), 3);
+        consensus.set_penalties(Vec::new());
+        assert_eq!(consensus.validator_set().len(), 4);
+    }
+
+    #[test]
+    fn test_slash_keeps_minimum_power() {
+        let (_, mut validator_set) = create_test_validators(2);
+        let address = validator_set.validators()[0].address;
+
+        assert!(validator_set.apply_penalty(&address, Penalty::Slash(5)));
+        assert_eq!(validator_set.get(&address).unwrap().voting_power, 1);
+        assert_eq!(validator_set.total_voting_power(), 2);
+
+        assert!(validator_set.apply_penalty(&address, Penalty::Exclude));
+        let last = validator_set.validators()[0].address;
+        assert!(!validator_set.apply_penalty(&last, Penalty::Exclude));
+    }
+
     #[test]
     fn test_locked_block_persists_across_rounds() {
         let (private_keys, validator_set) = create_test_validators(4);
@@ -0,0 +1,109 @@
+//! Per-sender transaction cap
+//!
+//! Chain config can cap how many transactions from one sender a block may
+//! hold, so a single bursty sender can't fill the blocks other senders are
+//! waiting on. Proposers keep each sender's first transactions in pool
+//! order and leave the rest for later blocks; validators refuse to
+//! pre-vote for a block that holds more. Both sides count the same way:
+//! system transactions at the end of the block and transactions whose
+//! sender can't be recovered don't count. A cap of 0 disables the rule.
+
+use crate::ConsensusError;
+use bach_primitives::Address;
+use bach_types::Transaction;
+use std::collections::HashMap;
+
+/// Removes the transactions over `limit` per sender from `transactions`
+/// and returns them, in their original order.
+pub fn cap_txs_per_sender(transactions: &mut Vec<Transaction>, limit: u64) -> Vec<Transaction> {
+    if limit == 0 {
+        return Vec::new();
+    }
+    let mut counts = SenderCounts::default();
+    let mut deferred = Vec::new();
+    transactions.retain(|tx| {
+        let within = counts.add(tx) <= limit;
+        if !within {
+            deferred.push(tx.clone());
+        }
+        within
+    });
+    deferred
+}
+
+/// Checks that no sender has more than `limit` of `transactions`.
+pub fn check_txs_per_sender(
+    transactions: &[Transaction],
+    limit: u64,
+) -> Result<(), ConsensusError> {
+    if limit == 0 {
+        return Ok(());
+    }
+    let mut counts = SenderCounts::default();
+    for tx in transactions {
+        if counts.add(tx) > limit {
+            return Err(ConsensusError::InvalidProposal(format!(
+                "Sender {} has more than {} transactions",
+                tx.sender().expect("counted senders are recovered"),
+                limit
+            )));
+        }
+    }
+    Ok(())
+}
+
+/// Transactions seen per sender
+#[derive(Default)]
+struct SenderCounts(HashMap<Address, u64>);
+
+impl SenderCounts {
+    /// Counts `tx` and returns its sender's count so far, 0 if the sender
+    /// can't be recovered.
+    fn add(&mut self, tx: &Transaction) -> u64 {
+        let Ok(sender) = tx.sender() else {
+            return 0;
+        };
+        let count = self.0.entry(sender).or_insert(0);
+        *count += 1;
+        *count
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_crypto::PrivateKey;
+    use bach_primitives::{H256, U256};
+
+    fn tx(key: &PrivateKey, nonce: u64) -> Transaction {
+        let mut tx = Transaction::new(nonce, None, U256::ZERO, Vec::new(), key.sign(&H256::zero()));
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    #[test]
+    fn test_cap_and_check() {
+        let (alice, bob) = (PrivateKey::random(), PrivateKey::random());
+        let pool = vec![
+            tx(&alice, 0),
+            tx(&alice, 1),
+            tx(&bob, 0),
+            tx(&alice, 2),
+            tx(&bob, 1),
+        ];
+        assert!(check_txs_per_sender(&pool, 2).is_err());
+        assert!(check_txs_per_sender(&pool, 3).is_ok());
+        assert!(check_txs_per_sender(&pool, 0).is_ok());
+
+        let mut block = pool.clone();
+        let deferred = cap_txs_per_sender(&mut block, 2);
+        assert_eq!(block.len(), 4);
+        assert_eq!(deferred.len(), 1);
+        assert_eq!(deferred[0].hash(), pool[3].hash());
+        assert!(check_txs_per_sender(&block, 2).is_ok());
+
+        let mut uncapped = pool.clone();
+        assert!(cap_txs_per_sender(&mut uncapped, 0).is_empty());
+        assert_eq!(uncapped.len(), pool.len());
+    }
+}
@@ -0,0 +1,351 @@
+//! Transaction signature checks for proposed blocks
+//!
+//! Every transaction in a proposal must carry a recoverable signature.
+//! Checked one by one, recovery dominates verification time on large
+//! blocks, so `TxSignatureVerifier` can spread a block over a pool of
+//! scoped worker threads. secp256k1 recovery has no batch form, so each
+//! worker still recovers its transactions individually; small blocks stay
+//! on the calling thread where spawning workers would cost more than it
+//! saves.
+//!
+//! Ed25519 and SM2 signatures are verified against the public key they
+//! carry instead of recovered. Only the signature schemes the chain config
+//! allows (secp256k1 over Keccak-256 unless configured otherwise) are
+//! accepted: a signature records the hash algorithm its transaction was
+//! digested with, and both its key and hash algorithm must be allowed
+//! together.
+//! Transactions signed by a key on the revocation registry's lists in force
+//! at the block's height are refused as well.
+
+use crate::ConsensusError;
+use bach_crypto::{KeyAlgorithm, SignatureScheme};
+use bach_primitives::Address;
+use bach_types::{Block, Transaction};
+use std::collections::HashSet;
+use std::num::NonZeroUsize;
+use std::thread;
+
+/// Default number of transactions below which a block is checked on the
+/// calling thread.
+pub const DEFAULT_MIN_PARALLEL_TXS: usize = 64;
+
+/// How transaction signatures are checked.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SignatureCheckMode {
+    /// One transaction after another on the calling thread
+    Sequential,
+    /// Split across the given number of worker threads
+    Parallel { workers: usize },
+}
+
+/// Recovers the senders of a block's transactions, rejecting the block on
+/// the first unrecoverable, disallowed or revoked signature.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TxSignatureVerifier {
+    mode: SignatureCheckMode,
+    min_parallel_txs: usize,
+    schemes: Vec<SignatureScheme>,
+    revoked: HashSet<Address>,
+}
+
+impl TxSignatureVerifier {
+    /// Creates a verifier checking transactions one by one.
+    pub fn sequential() -> Self {
+        Self {
+            mode: SignatureCheckMode::Sequential,
+            min_parallel_txs: DEFAULT_MIN_PARALLEL_TXS,
+            schemes: vec![KeyAlgorithm::Secp256k1.into()],
+            revoked: HashSet::new(),
+        }
+    }
+
+    /// Creates a verifier spreading blocks over `workers` threads, or over
+    /// all available cores if None.
+    pub fn parallel(workers: Option<usize>) -> Self {
+        let workers = workers.unwrap_or_else(|| {
+            thread::available_parallelism()
+                .map(NonZeroUsize::get)
+                .unwrap_or(1)
+        });
+        Self {
+            mode: SignatureCheckMode::Parallel {
+                workers: workers.max(1),
+            },
+            min_parallel_txs: DEFAULT_MIN_PARALLEL_TXS,
+            schemes: vec![KeyAlgorithm::Secp256k1.into()],
+            revoked: HashSet::new(),
+        }
+    }
+
+    /// Sets the key algorithms transactions may be signed with over
+    /// Keccak-256 (default: secp256k1 only).
+    pub fn with_algorithms(self, algorithms: Vec<KeyAlgorithm>) -> Self {
+        self.with_schemes(algorithms.into_iter().map(Into::into).collect())
+    }
+
+    /// Sets the signature schemes transactions may be signed with.
+    pub fn with_schemes(mut self, schemes: Vec<SignatureScheme>) -> Self {
+        self.schemes = schemes;
+        self
+    }
+
+    /// Replaces the allowed signature schemes, e.g. when chain config
+    /// changes them from the next height.
+    pub fn set_schemes(&mut self, schemes: Vec<SignatureScheme>) {
+        self.schemes = schemes;
+    }
+
+    /// Returns the signature schemes transactions may be signed with.
+    pub fn schemes(&self) -> &[SignatureScheme] {
+        &self.schemes
+    }
+
+    /// Replaces the revoked member keys, e.g. when a revocation list
+    /// takes effect at the next height.
+    pub fn set_revoked(&mut self, revoked: impl IntoIterator<Item = Address>) {
+        self.revoked = revoked.into_iter().collect();
+    }
+
+    /// Sets the block size below which checks stay on the calling thread.
+    pub fn with_min_parallel_txs(mut self, min_parallel_txs: usize) -> Self {
+        self.min_parallel_txs = min_parallel_txs;
+        self
+    }
+
+    /// Returns the check mode.
+    pub fn mode(&self) -> SignatureCheckMode {
+        self.mode
+    }
+
+    /// Returns the senders of the block's transactions in block order.
+    pub fn verify_block(&self, block: &Block) -> Result<Vec<Address>, ConsensusError> {
+        self.verify(&block.transactions)
+    }
+
+    /// Returns the senders of `transactions` in order.
+    pub fn verify(&self, transactions: &[Transaction]) -> Result<Vec<Address>, ConsensusError> {
+        match self.mode {
+            SignatureCheckMode::Parallel { workers }
+                if workers > 1 && transactions.len() >= self.min_parallel_txs =>
+            {
+                let chunk_size = transactions.len().div_ceil(workers);
+                thread::scope(|scope| {
+                    let handles: Vec<_> = transactions
+                        .chunks(chunk_size)
+                        .enumerate()
+                        .map(|(i, chunk)| {
+                            scope.spawn(move || self.recover(chunk, i * chunk_size))
+                        })
+                        .collect();
+                    let mut senders = Vec::with_capacity(transactions.len());
+                    for handle in handles {
+                        senders.extend(handle.join().expect("signature worker panicked")?);
+                    }
+                    Ok(senders)
+                })
+            }
+            _ => self.recover(transactions, 0),
+        }
+    }
+
+    /// Recovers the senders of `transactions`, which start at block index
+    /// `offset`.
+    fn recover(
+        &self,
+        transactions: &[Transaction],
+        offset: usize,
+    ) -> Result<Vec<Address>, ConsensusError> {
+        transactions
+            .iter()
+            .enumerate()
+            .map(|(i, tx)| {
+                let scheme = tx.signature.scheme();
+                if !self.schemes.contains(&scheme) {
+                    if !self.schemes.iter().any(|allowed| allowed.key == scheme.key) {
+                        return Err(ConsensusError::DisallowedTxSignature {
+                            index: offset + i,
+                            hash: tx.hash(),
+                            algorithm: scheme.key,
+                        });
+                    }
+                    return Err(ConsensusError::DisallowedTxSigningHash {
+                        index: offset + i,
+                        hash: tx.hash(),
+                        scheme,
+                    });
+                }
+                let sender = tx.sender().map_err(|_| ConsensusError::InvalidTxSignature {
+                    index: offset + i,
+                    hash: tx.hash(),
+                })?;
+                if self.revoked.contains(&sender) {
+                    return Err(ConsensusError::RevokedTxSigner {
+                        index: offset + i,
+                        hash: tx.hash(),
+                        signer: sender,
+                    });
+                }
+                Ok(sender)
+            })
+            .collect()
+    }
+}
+
+impl Default for TxSignatureVerifier {
+    fn default() -> Self {
+        Self::sequential()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_crypto::{
+        keccak256, Ed25519PrivateKey, HashAlgorithm, PrivateKey, Signature, SigningMember,
+        Sm2PrivateKey,
+    };
+    use bach_primitives::{ErrorCode, ErrorCoded, H256, U256};
+
+    fn signed(key: &PrivateKey, nonce: u64) -> Transaction {
+        let unsigned =
+            Transaction::new(nonce, None, U256::ZERO, Vec::new(), key.sign(&H256::zero()));
+        let signature = key.sign(&unsigned.signing_hash());
+        Transaction::new(nonce, None, U256::ZERO, Vec::new(), signature)
+    }
+
+    /// A well-formed signature from which no key can be recovered.
+    fn unrecoverable(tx: &Transaction) -> Signature {
+        (1u8..)
+            .find_map(|b| {
+                let mut bytes = [b; 65];
+                bytes[64] = 27;
+                Signature::from_bytes(&bytes)
+                    .ok()
+                    .filter(|sig| sig.recover(&tx.signing_hash()).is_err())
+            })
+            .unwrap()
+    }
+
+    #[test]
+    fn test_parallel_matches_sequential() {
+        let keys: Vec<PrivateKey> = (1..=5u8)
+            .map(|i| PrivateKey::from_bytes(keccak256(&[i]).as_bytes()).unwrap())
+            .collect();
+        let txs: Vec<Transaction> = (0..100)
+            .map(|n| signed(&keys[n as usize % keys.len()], n))
+            .collect();
+        let block = Block::new(1, H256::zero(), txs, 1);
+
+        let expected = TxSignatureVerifier::sequential()
+            .verify_block(&block)
+            .unwrap();
+        assert_eq!(expected[7], keys[2].public_key().to_address());
+        for workers in [1, 3, 8, 200] {
+            let verifier = TxSignatureVerifier::parallel(Some(workers)).with_min_parallel_txs(1);
+            assert_eq!(verifier.verify_block(&block).unwrap(), expected);
+        }
+    }
+
+    #[test]
+    fn test_invalid_signature_reports_index() {
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let mut txs: Vec<Transaction> = (0..10).map(|n| signed(&key, n)).collect();
+        txs[6].signature = unrecoverable(&txs[6]).into();
+        let hash = txs[6].hash();
+
+        for verifier in [
+            TxSignatureVerifier::sequential(),
+            TxSignatureVerifier::parallel(Some(4)).with_min_parallel_txs(1),
+        ] {
+            assert_eq!(
+                verifier.verify(&txs),
+                Err(ConsensusError::InvalidTxSignature { index: 6, hash })
+            );
+        }
+        assert_eq!(
+            ConsensusError::InvalidTxSignature { index: 6, hash }.error_code(),
+            ErrorCode::InvalidTxSignature
+        );
+    }
+
+    #[test]
+    fn test_ed25519_requires_allowed_algorithm() {
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let ed_key = Ed25519PrivateKey::from_bytes(&[0x22; 32]);
+        let mut txs: Vec<Transaction> = (0..4).map(|n| signed(&key, n)).collect();
+        txs[2].signature = ed_key.sign_member(&txs[2].signing_hash());
+        let hash = txs[2].hash();
+
+        assert_eq!(
+            TxSignatureVerifier::sequential().verify(&txs),
+            Err(ConsensusError::DisallowedTxSignature {
+                index: 2,
+                hash,
+                algorithm: KeyAlgorithm::Ed25519,
+            })
+        );
+        let verifier = TxSignatureVerifier::parallel(Some(2))
+            .with_min_parallel_txs(1)
+            .with_algorithms(KeyAlgorithm::ALL.to_vec());
+        let senders = verifier.verify(&txs).unwrap();
+        assert_eq!(senders[2], ed_key.public_key().to_address());
+        assert_eq!(senders[3], key.public_key().to_address());
+    }
+
+    #[test]
+    fn test_signing_hash_must_be_allowed() {
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let sm2_key = Sm2PrivateKey::from_bytes(&[0x22; 32]).unwrap();
+        let sha256 = SignatureScheme::new(KeyAlgorithm::Secp256k1, HashAlgorithm::Sha256);
+        let chain = [sha256, KeyAlgorithm::Sm2.into()];
+
+        // Signers on a chain of ECDSA over SHA-256 and SM2 over SM3
+        let mut txs: Vec<Transaction> = (0..3).map(|n| signed(&key, n)).collect();
+        txs[1].sign(&key, &chain);
+        txs[2].sign(&sm2_key, &chain);
+        assert_eq!(txs[2].signature.hash_algorithm(), HashAlgorithm::Sm3);
+
+        // Keccak-256 signatures aren't allowed once the chain moves
+        // secp256k1 to SHA-256
+        let verifier = TxSignatureVerifier::sequential().with_schemes(chain.to_vec());
+        assert_eq!(
+            verifier.verify(&txs),
+            Err(ConsensusError::DisallowedTxSigningHash {
+                index: 0,
+                hash: txs[0].hash(),
+                scheme: KeyAlgorithm::Secp256k1.into(),
+            })
+        );
+
+        txs[0].sign(&key, &chain);
+        let verifier = TxSignatureVerifier::parallel(Some(3))
+            .with_min_parallel_txs(1)
+            .with_schemes(chain.to_vec());
+        let senders = verifier.verify(&txs).unwrap();
+        assert_eq!(senders[1], key.public_key().to_address());
+        assert_eq!(senders[2], sm2_key.public_key().to_address());
+    }
+
+    #[test]
+    fn test_revoked_signer_rejected() {
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let revoked = PrivateKey::from_bytes(&[0x33; 32]).unwrap();
+        let mut txs: Vec<Transaction> = (0..4).map(|n| signed(&key, n)).collect();
+        txs[3] = signed(&revoked, 0);
+        let signer = revoked.public_key().to_address();
+
+        let mut verifier = TxSignatureVerifier::parallel(Some(2)).with_min_parallel_txs(1);
+        assert!(verifier.verify(&txs).is_ok());
+        verifier.set_revoked([signer]);
+        assert_eq!(
+            verifier.verify(&txs),
+            Err(ConsensusError::RevokedTxSigner {
+                index: 3,
+                hash: txs[3].hash(),
+                signer,
+            })
+        );
+        verifier.set_revoked([]);
+        assert!(verifier.verify(&txs).is_ok());
+    }
+}
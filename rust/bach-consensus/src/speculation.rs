@@ -0,0 +1,296 @@
+//! Speculative pre-execution of likely batches on followers
+//!
+//! Followers normally simulate a block only once its proposal arrives. With
+//! speculation enabled they record transactions seen on gossip and, while
+//! waiting for the proposal, simulate the block the proposer is likely to
+//! build (the oldest pending transactions, up to the batch size, at the
+//! expected timestamp) against the current state. Results are keyed on the
+//! whole header, so only a proposal with the same height, parent,
+//! transactions and timestamp reuses one; any other proposal is simulated
+//! in full. At most `max_pending` gossiped transactions are held; later
+//! ones are ignored until committed blocks make room.
+
+use crate::verification::VerificationResult;
+use bach_primitives::H256;
+use bach_types::{Block, Transaction};
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::sync::Arc;
+
+/// Default number of transactions in a speculated batch
+pub const DEFAULT_SPECULATIVE_BATCH_SIZE: usize = 1000;
+
+/// Default number of speculated results kept per height
+pub const DEFAULT_SPECULATIVE_RESULTS: usize = 4;
+
+/// Default number of gossiped transactions held for speculation
+pub const DEFAULT_SPECULATIVE_PENDING: usize = 10 * DEFAULT_SPECULATIVE_BATCH_SIZE;
+
+/// Speculative pre-execution settings.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct SpeculationConfig {
+    /// Transactions in a speculated batch; should match the proposers'
+    /// block size
+    pub batch_size: usize,
+    /// Speculated results kept per height; the oldest is dropped first
+    pub max_results: usize,
+    /// Gossiped transactions held at most
+    pub max_pending: usize,
+}
+
+impl Default for SpeculationConfig {
+    fn default() -> Self {
+        Self {
+            batch_size: DEFAULT_SPECULATIVE_BATCH_SIZE,
+            max_results: DEFAULT_SPECULATIVE_RESULTS,
+            max_pending: DEFAULT_SPECULATIVE_PENDING,
+        }
+    }
+}
+
+/// Speculation counters.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct SpeculationStats {
+    /// Batches simulated ahead of their proposal
+    pub executed: u64,
+    /// Proposals served from a speculated result
+    pub hits: u64,
+    /// Proposals that matched no speculated result
+    pub misses: u64,
+}
+
+/// The header fields a speculated result was computed for.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+struct HeaderKey {
+    height: u64,
+    parent_hash: H256,
+    transactions_hash: H256,
+    timestamp: u64,
+}
+
+impl HeaderKey {
+    fn of(block: &Block) -> Self {
+        Self {
+            height: block.height,
+            parent_hash: block.parent_hash,
+            transactions_hash: block.transactions_hash(),
+            timestamp: block.timestamp,
+        }
+    }
+}
+
+/// Pending gossip and speculated results for the current height.
+#[derive(Debug, Clone)]
+pub struct SpeculativeExecution {
+    config: SpeculationConfig,
+    /// Transactions seen on gossip, oldest first
+    pending: Vec<Transaction>,
+    seen: HashSet<H256>,
+    /// Results keyed by the header of the block they were computed for
+    results: HashMap<HeaderKey, Arc<VerificationResult>>,
+    order: VecDeque<HeaderKey>,
+    stats: SpeculationStats,
+}
+
+impl SpeculativeExecution {
+    /// Creates an empty speculation state.
+    pub fn new(config: SpeculationConfig) -> Self {
+        Self {
+            config: SpeculationConfig {
+                batch_size: config.batch_size.max(1),
+                max_results: config.max_results.max(1),
+                max_pending: config.max_pending,
+            },
+            pending: Vec::new(),
+            seen: HashSet::new(),
+            results: HashMap::new(),
+            order: VecDeque::new(),
+            stats: SpeculationStats::default(),
+        }
+    }
+
+    /// Returns the settings.
+    pub fn config(&self) -> &SpeculationConfig {
+        &self.config
+    }
+
+    /// Records a transaction seen on gossip. Returns false if it was
+    /// already pending or `max_pending` transactions are.
+    pub fn observe(&mut self, tx: Transaction) -> bool {
+        if self.pending.len() >= self.config.max_pending || !self.seen.insert(tx.hash()) {
+            return false;
+        }
+        self.pending.push(tx);
+        true
+    }
+
+    /// Returns the number of pending transactions.
+    pub fn pending_len(&self) -> usize {
+        self.pending.len()
+    }
+
+    /// Returns the batch the proposer is likely to take next: the oldest
+    /// pending transactions, up to the batch size. None if nothing is
+    /// pending.
+    pub fn next_batch(&self) -> Option<Vec<Transaction>> {
+        if self.pending.is_empty() {
+            return None;
+        }
+        Some(self.pending[..self.pending.len().min(self.config.batch_size)].to_vec())
+    }
+
+    /// Returns true if a result was stored for a block with `block`'s
+    /// header.
+    pub fn is_speculated(&self, block: &Block) -> bool {
+        self.results.contains_key(&HeaderKey::of(block))
+    }
+
+    /// Stores the result of simulating a speculated block, evicting the
+    /// oldest result when full.
+    pub fn insert(&mut self, block: &Block, result: VerificationResult) {
+        let key = HeaderKey::of(block);
+        if self.results.insert(key, Arc::new(result)).is_none() {
+            if self.order.len() == self.config.max_results {
+                if let Some(oldest) = self.order.pop_front() {
+                    self.results.remove(&oldest);
+                }
+            }
+            self.order.push_back(key);
+        }
+        self.stats.executed += 1;
+    }
+
+    /// Returns the speculated result for a proposed block if one was
+    /// computed for the same header, counting a hit or miss.
+    pub fn lookup(&mut self, block: &Block) -> Option<Arc<VerificationResult>> {
+        let result = self.results.get(&HeaderKey::of(block)).cloned();
+        match result {
+            Some(_) => self.stats.hits += 1,
+            None => self.stats.misses += 1,
+        }
+        result
+    }
+
+    /// Drops speculated results, e.g. when the state they were computed on
+    /// changes.
+    pub fn clear_results(&mut self) {
+        self.results.clear();
+        self.order.clear();
+    }
+
+    /// Drops the transactions of a committed block from the pending list.
+    pub fn remove_committed(&mut self, block: &Block) {
+        let committed: HashSet<H256> = block.transactions.iter().map(|tx| tx.hash()).collect();
+        if committed.is_empty() {
+            return;
+        }
+        self.pending.retain(|tx| !committed.contains(&tx.hash()));
+        self.seen.retain(|hash| !committed.contains(hash));
+    }
+
+    /// Returns the speculation counters.
+    pub fn stats(&self) -> SpeculationStats {
+        self.stats
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::verification::Verdict;
+    use bach_crypto::PrivateKey;
+    use bach_primitives::U256;
+
+    fn tx(nonce: u64) -> Transaction {
+        let key = PrivateKey::from_bytes(&[0x22; 32]).unwrap();
+        Transaction::new(nonce, None, U256::ZERO, vec![], key.sign(&H256::zero()))
+    }
+
+    fn valid() -> VerificationResult {
+        VerificationResult {
+            rwsets: Vec::new(),
+            state_root: H256::zero(),
+            verdict: Verdict::Valid,
+        }
+    }
+
+    fn block(speculation: &SpeculativeExecution, parent_hash: H256) -> Block {
+        Block::new(1, parent_hash, speculation.next_batch().unwrap(), 1000)
+    }
+
+    #[test]
+    fn test_next_batch_takes_oldest_pending() {
+        let mut speculation = SpeculativeExecution::new(SpeculationConfig {
+            batch_size: 2,
+            max_results: 4,
+            max_pending: 3,
+        });
+        assert!(speculation.next_batch().is_none());
+        for nonce in 0..3 {
+            assert!(speculation.observe(tx(nonce)));
+        }
+        assert!(!speculation.observe(tx(0)));
+        // Full
+        assert!(!speculation.observe(tx(3)));
+
+        let first = block(&speculation, H256::zero());
+        assert_eq!(first.transactions, vec![tx(0), tx(1)]);
+        speculation.insert(&first, valid());
+        assert!(speculation.is_speculated(&first));
+        assert!(!speculation.is_speculated(&block(&speculation, H256::from([1u8; 32]))));
+
+        speculation.remove_committed(&first);
+        assert_eq!(speculation.pending_len(), 1);
+        assert_eq!(speculation.next_batch().unwrap(), vec![tx(2)]);
+        assert!(speculation.observe(tx(3)));
+    }
+
+    #[test]
+    fn test_lookup_requires_same_header() {
+        let mut speculation = SpeculativeExecution::new(SpeculationConfig::default());
+        speculation.observe(tx(0));
+        speculation.observe(tx(1));
+        let speculated = block(&speculation, H256::zero());
+        speculation.insert(&speculated, valid());
+
+        let proposed = Block::new(1, H256::zero(), speculated.transactions.clone(), 1000);
+        assert!(speculation.lookup(&proposed).is_some());
+        let reordered = Block::new(1, H256::zero(), vec![tx(1), tx(0)], 1000);
+        assert!(speculation.lookup(&reordered).is_none());
+        let other_parent =
+            Block::new(1, H256::from([1u8; 32]), speculated.transactions.clone(), 1000);
+        assert!(speculation.lookup(&other_parent).is_none());
+        let later = Block::new(1, H256::zero(), speculated.transactions.clone(), 1001);
+        assert!(speculation.lookup(&later).is_none());
+        let next_height = Block::new(2, H256::zero(), speculated.transactions, 1000);
+        assert!(speculation.lookup(&next_height).is_none());
+        assert_eq!(
+            speculation.stats(),
+            SpeculationStats {
+                executed: 1,
+                hits: 1,
+                misses: 4,
+            }
+        );
+
+        speculation.clear_results();
+        assert!(speculation.lookup(&proposed).is_none());
+    }
+
+    #[test]
+    fn test_results_evict_oldest() {
+        let mut speculation = SpeculativeExecution::new(SpeculationConfig {
+            batch_size: 10,
+            max_results: 1,
+            max_pending: 10,
+        });
+        speculation.observe(tx(0));
+        let first = block(&speculation, H256::zero());
+        speculation.insert(&first, valid());
+        speculation.observe(tx(1));
+        let second = block(&speculation, H256::zero());
+        speculation.insert(&second, valid());
+
+        assert!(speculation.lookup(&first).is_none());
+        assert!(speculation.lookup(&second).is_some());
+    }
+}
@@ -0,0 +1,350 @@
+//! Reserved system transactions
+//!
+//! Protocol duties such as gas settlement, checkpoints or epoch rotation can
+//! be recorded as system transactions appended at the end of a block, after
+//! the pooled ones. Each `SystemTxGenerator` reserves the address its
+//! transactions call and derives their calldata deterministically from the
+//! block's height, parent and user transactions; the proposer signs them
+//! with its validator key. Pooled transactions calling a reserved address
+//! are dropped from proposals.
+//!
+//! Followers run the same generators on a proposed block's user
+//! transactions and reject the block unless its trailing system
+//! transactions match the result in order and content and were signed by
+//! the proposer, and no transaction before them calls a reserved address. System transactions run after the rest of the block:
+//! `TxDag::append_system_tx` makes each depend on every transaction before
+//! it.
+//!
+//! `GasSettlement` is the generator the node ships: it settles the gas
+//! each block's user transactions declared in one trailing transaction.
+
+use crate::ConsensusError;
+use bach_crypto::PrivateKey;
+use bach_primitives::{Address, SystemContract, H256, U256};
+use bach_types::{Block, Transaction};
+use std::sync::Arc;
+
+/// Most system transactions appended to one block.
+pub const MAX_SYSTEM_TXS: usize = 256;
+
+/// Derives the system transactions appended to a block.
+pub trait SystemTxGenerator: Send + Sync {
+    /// Generator name, used in rejection reasons.
+    fn name(&self) -> &str;
+
+    /// Reserved address the generated transactions call.
+    fn address(&self) -> Address;
+
+    /// Returns the calldata of the transactions to append to the block at
+    /// `height` on `parent_hash` holding the user `transactions`. Must
+    /// return the same result on every node.
+    fn generate(
+        &self,
+        height: u64,
+        parent_hash: &H256,
+        transactions: &[Transaction],
+    ) -> Vec<Vec<u8>>;
+}
+
+/// Registered system transaction generators, run in registration order.
+#[derive(Clone, Default)]
+pub struct SystemTxs {
+    generators: Vec<Arc<dyn SystemTxGenerator>>,
+}
+
+impl std::fmt::Debug for SystemTxs {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_list()
+            .entries(self.generators.iter().map(|generator| generator.name()))
+            .finish()
+    }
+}
+
+impl SystemTxs {
+    /// Creates an empty registry.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Registers a generator, whose transactions follow those of the
+    /// generators registered before it.
+    pub fn register(&mut self, generator: Arc<dyn SystemTxGenerator>) {
+        self.generators.push(generator);
+    }
+
+    /// Registers the generators of `other` after these.
+    pub fn extend(&mut self, other: &SystemTxs) {
+        self.generators.extend(other.generators.iter().cloned());
+    }
+
+    /// Returns true if no generator is registered.
+    pub fn is_empty(&self) -> bool {
+        self.generators.is_empty()
+    }
+
+    /// Returns true if `tx` calls a reserved address.
+    pub fn is_system_tx(&self, tx: &Transaction) -> bool {
+        tx.to
+            .is_some_and(|to| self.generators.iter().any(|g| g.address() == to))
+    }
+
+    /// Returns the number of system transactions at the end of `block`.
+    pub fn count(&self, block: &Block) -> usize {
+        block
+            .transactions
+            .iter()
+            .rev()
+            .take_while(|tx| self.is_system_tx(tx))
+            .count()
+    }
+
+    /// Drops the pooled transactions calling a reserved address from
+    /// `transactions` and appends the system transactions of the block at
+    /// `height`, signed by `key`.
+    pub fn append(
+        &self,
+        height: u64,
+        parent_hash: &H256,
+        transactions: &mut Vec<Transaction>,
+        key: &PrivateKey,
+    ) {
+        if self.is_empty() {
+            return;
+        }
+        transactions.retain(|tx| !self.is_system_tx(tx));
+        let expected = self.expected(height, parent_hash, transactions);
+        for (index, (to, data)) in expected.into_iter().enumerate().take(MAX_SYSTEM_TXS) {
+            let mut tx = Transaction::new(
+                system_tx_nonce(height, index),
+                Some(to),
+                U256::ZERO,
+                data,
+                key.sign(&H256::zero()),
+            );
+            tx.signature = key.sign(&tx.signing_hash()).into();
+            transactions.push(tx);
+        }
+    }
+
+    /// Checks that the system transactions at the end of `block` are the
+    /// ones the generators derive from its user transactions, signed by
+    /// `proposer`, and that no user transaction calls a reserved address.
+    pub fn verify(&self, block: &Block, proposer: &Address) -> Result<(), ConsensusError> {
+        let invalid = |reason: String| Err(ConsensusError::InvalidProposal(reason));
+
+        let user_txs = block.transactions.len() - self.count(block);
+        let (user, system) = block.transactions.split_at(user_txs);
+        if let Some(index) = user.iter().position(|tx| self.is_system_tx(tx)) {
+            let name = user[index].to.as_ref().map_or("unknown", |to| self.name_of(to));
+            return invalid(format!(
+                "User transaction {} calls a reserved address ({})",
+                index, name
+            ));
+        }
+        let expected = self.expected(block.height, &block.parent_hash, user);
+        if expected.len().min(MAX_SYSTEM_TXS) != system.len() {
+            return invalid(format!(
+                "Expected {} system transactions, found {}",
+                expected.len().min(MAX_SYSTEM_TXS),
+                system.len()
+            ));
+        }
+        for (index, (tx, (to, data))) in system.iter().zip(expected).enumerate() {
+            let matches = tx.to == Some(to)
+                && tx.data == data
+                && tx.value.is_zero()
+                && tx.nonce == system_tx_nonce(block.height, index);
+            if !matches {
+                let name = self.name_of(&to);
+                return invalid(format!("System transaction {} ({}) differs", index, name));
+            }
+            if tx.sender().ok() != Some(*proposer) {
+                return invalid(format!(
+                    "System transaction {} not signed by proposer",
+                    index
+                ));
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns the (address, calldata) of every generated transaction.
+    fn expected(
+        &self,
+        height: u64,
+        parent_hash: &H256,
+        transactions: &[Transaction],
+    ) -> Vec<(Address, Vec<u8>)> {
+        self.generators
+            .iter()
+            .flat_map(|generator| {
+                let address = generator.address();
+                generator
+                    .generate(height, parent_hash, transactions)
+                    .into_iter()
+                    .map(move |data| (address, data))
+            })
+            .collect()
+    }
+
+    fn name_of(&self, address: &Address) -> &str {
+        self.generators
+            .iter()
+            .find(|generator| generator.address() == *address)
+            .map_or("unknown", |generator| generator.name())
+    }
+}
+
+/// Returns the address gas settlement transactions call (0x…010E).
+pub fn gas_settlement_address() -> Address {
+    SystemContract::GasSettlement.address()
+}
+
+/// Settles the gas a block's user transactions declared.
+///
+/// Appends one transaction to every block holding user transactions, with
+/// the calldata `count (u32) ‖ total gas (u64)`, big-endian. The total
+/// saturates rather than wrapping.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct GasSettlement;
+
+impl GasSettlement {
+    /// Decodes the (transaction count, total gas) of settlement calldata.
+    pub fn decode(data: &[u8]) -> Option<(u32, u64)> {
+        let count = u32::from_be_bytes(data.get(..4)?.try_into().ok()?);
+        let gas = u64::from_be_bytes(data.get(4..)?.try_into().ok()?);
+        Some((count, gas))
+    }
+}
+
+impl SystemTxGenerator for GasSettlement {
+    fn name(&self) -> &str {
+        "gas-settlement"
+    }
+
+    fn address(&self) -> Address {
+        gas_settlement_address()
+    }
+
+    fn generate(&self, _: u64, _: &H256, transactions: &[Transaction]) -> Vec<Vec<u8>> {
+        if transactions.is_empty() {
+            return Vec::new();
+        }
+        let count = u32::try_from(transactions.len()).unwrap_or(u32::MAX);
+        let gas = transactions
+            .iter()
+            .fold(0u64, |total, tx| total.saturating_add(tx.gas));
+        let mut data = count.to_be_bytes().to_vec();
+        data.extend_from_slice(&gas.to_be_bytes());
+        vec![data]
+    }
+}
+
+/// Returns the nonce of the `index`th system transaction of the block at
+/// `height`, unique across the chain.
+fn system_tx_nonce(height: u64, index: usize) -> u64 {
+    height
+        .wrapping_mul(MAX_SYSTEM_TXS as u64)
+        .wrapping_add(index as u64)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Appends one transaction carrying the number of user transactions.
+    struct Counter;
+
+    impl SystemTxGenerator for Counter {
+        fn name(&self) -> &str {
+            "counter"
+        }
+
+        fn address(&self) -> Address {
+            Address::from([0x0c; 20])
+        }
+
+        fn generate(&self, _: u64, _: &H256, transactions: &[Transaction]) -> Vec<Vec<u8>> {
+            vec![(transactions.len() as u64).to_be_bytes().to_vec()]
+        }
+    }
+
+    fn tx(key: &PrivateKey, nonce: u64, to: Address) -> Transaction {
+        let mut tx = Transaction::new(
+            nonce,
+            Some(to),
+            U256::ZERO,
+            Vec::new(),
+            key.sign(&H256::zero()),
+        );
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    #[test]
+    fn test_append_and_verify() {
+        let (proposer, user) = (PrivateKey::random(), PrivateKey::random());
+        let proposer_address = proposer.public_key().to_address();
+        let mut system_txs = SystemTxs::new();
+        system_txs.register(Arc::new(Counter));
+
+        // A pooled transaction to the reserved address is dropped
+        let mut transactions = vec![
+            tx(&user, 0, Address::from([1; 20])),
+            tx(&user, 1, Counter.address()),
+            tx(&user, 2, Address::from([1; 20])),
+        ];
+        system_txs.append(5, &H256::zero(), &mut transactions, &proposer);
+        assert_eq!(transactions.len(), 3);
+        assert_eq!(transactions[2].data, 2u64.to_be_bytes());
+        assert_eq!(transactions[2].sender().unwrap(), proposer_address);
+
+        let block = Block::new(5, H256::zero(), transactions, 1000);
+        assert_eq!(system_txs.count(&block), 1);
+        assert!(system_txs.verify(&block, &proposer_address).is_ok());
+
+        // Signed by someone else, missing or altered
+        let other = PrivateKey::random().public_key().to_address();
+        assert!(system_txs.verify(&block, &other).is_err());
+        let mut missing = block.clone();
+        missing.transactions.pop();
+        assert!(system_txs.verify(&missing, &proposer_address).is_err());
+        let mut altered = block.clone();
+        altered.transactions.remove(0);
+        assert!(system_txs.verify(&altered, &proposer_address).is_err());
+
+        // A reserved address called before the trailing system transactions
+        let mut settled = vec![
+            tx(&user, 0, Address::from([1; 20])),
+            tx(&user, 1, Address::from([1; 20])),
+        ];
+        system_txs.append(5, &H256::zero(), &mut settled, &proposer);
+        settled[0] = tx(&user, 0, Counter.address());
+        let smuggled = Block::new(5, H256::zero(), settled, 1000);
+        assert_eq!(system_txs.count(&smuggled), 1);
+        assert!(system_txs.verify(&smuggled, &proposer_address).is_err());
+
+        // Without generators no block carries system transactions
+        assert!(SystemTxs::new().verify(&missing, &proposer_address).is_ok());
+    }
+
+    #[test]
+    fn test_gas_settlement() {
+        let (proposer, user) = (PrivateKey::random(), PrivateKey::random());
+        let mut system_txs = SystemTxs::new();
+        system_txs.register(Arc::new(GasSettlement));
+
+        let mut transactions = Vec::new();
+        system_txs.append(1, &H256::zero(), &mut transactions, &proposer);
+        assert!(transactions.is_empty());
+
+        let mut transactions: Vec<Transaction> =
+            (0..2).map(|nonce| tx(&user, nonce, Address::from([1; 20]))).collect();
+        transactions[1].gas = u64::MAX;
+        system_txs.append(2, &H256::zero(), &mut transactions, &proposer);
+        let settlement = &transactions[2];
+        assert_eq!(settlement.to, Some(gas_settlement_address()));
+        assert_eq!(GasSettlement::decode(&settlement.data), Some((2, u64::MAX)));
+        assert_eq!(GasSettlement::decode(&settlement.data[1..]), None);
+    }
+}
@@ -0,0 +1,134 @@
+//! Block timestamp validation
+//!
+//! Proposers stamp blocks with their own clock. Before pre-voting for a
+//! proposal, a validator checks that the block's timestamp does not go back
+//! before its parent's and is at most `max_drift` ahead of its own clock.
+//! Timestamps behind the clock aren't bounded: a block re-proposed in a
+//! later round keeps its timestamp, and rejecting it once it got old would
+//! stall the height. The drift of the last checked proposal and the number
+//! of rejected ones are kept so a skewed proposer or local clock shows up
+//! in the node's metrics.
+
+use crate::ConsensusError;
+use bach_primitives::Clock;
+use std::sync::atomic::{AtomicI64, AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+/// Largest distance a proposed block's timestamp may be ahead of the local
+/// clock when chain config doesn't set one.
+pub const DEFAULT_MAX_CLOCK_DRIFT: Duration = Duration::from_secs(15);
+
+/// Checks proposed block timestamps against their parent and the local
+/// clock.
+#[derive(Debug)]
+pub struct TimestampValidator {
+    clock: Arc<dyn Clock>,
+    max_drift_secs: AtomicU64,
+    last_drift: AtomicI64,
+    rejections: AtomicU64,
+}
+
+impl TimestampValidator {
+    /// Creates a validator reading the local time from `clock`.
+    pub fn new(clock: Arc<dyn Clock>, max_drift: Duration) -> Self {
+        Self {
+            clock,
+            max_drift_secs: AtomicU64::new(max_drift.as_secs()),
+            last_drift: AtomicI64::new(0),
+            rejections: AtomicU64::new(0),
+        }
+    }
+
+    /// Returns the largest accepted drift.
+    pub fn max_drift(&self) -> Duration {
+        Duration::from_secs(self.max_drift_secs.load(Ordering::Relaxed))
+    }
+
+    /// Sets the largest accepted drift, e.g. when chain config changes it.
+    pub fn set_max_drift(&self, max_drift: Duration) {
+        self.max_drift_secs.store(max_drift.as_secs(), Ordering::Relaxed);
+    }
+
+    /// Returns how many seconds `timestamp` is ahead of the local clock,
+    /// negative if it is behind.
+    pub fn drift(&self, timestamp: u64) -> i64 {
+        let drift = i128::from(timestamp) - i128::from(self.clock.unix_timestamp());
+        drift.clamp(i64::MIN.into(), i64::MAX.into()) as i64
+    }
+
+    /// Returns the range of timestamps accepted for a block whose parent
+    /// was stamped `parent_timestamp`.
+    pub fn bounds(&self, parent_timestamp: u64) -> (u64, u64) {
+        let local = self.clock.unix_timestamp();
+        let max_drift = self.max_drift_secs.load(Ordering::Relaxed);
+        (parent_timestamp, local.saturating_add(max_drift))
+    }
+
+    /// Checks the timestamp of a block whose parent was stamped
+    /// `parent_timestamp`, and returns its drift.
+    pub fn check(&self, timestamp: u64, parent_timestamp: u64) -> Result<i64, ConsensusError> {
+        let drift = self.drift(timestamp);
+        self.last_drift.store(drift, Ordering::Relaxed);
+        let (min, max) = self.bounds(parent_timestamp);
+        if timestamp < min || timestamp > max {
+            self.rejections.fetch_add(1, Ordering::Relaxed);
+            return Err(ConsensusError::InvalidTimestamp {
+                timestamp,
+                min,
+                max,
+            });
+        }
+        Ok(drift)
+    }
+
+    /// Returns the drift of the last checked proposal in seconds.
+    pub fn last_drift(&self) -> i64 {
+        self.last_drift.load(Ordering::Relaxed)
+    }
+
+    /// Returns the number of proposals rejected for their timestamp.
+    pub fn rejections(&self) -> u64 {
+        self.rejections.load(Ordering::Relaxed)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_primitives::FakeClock;
+
+    #[test]
+    fn test_timestamp_bounds() {
+        let clock = FakeClock::new();
+        clock.advance(Duration::from_secs(1000));
+        let validator = TimestampValidator::new(Arc::new(clock), Duration::from_secs(10));
+
+        assert_eq!(validator.bounds(0), (0, 1010));
+        assert_eq!(validator.check(1005, 990), Ok(5));
+        assert_eq!(validator.check(990, 990), Ok(-10));
+        // An old block, e.g. re-proposed in a later round, is still valid
+        assert_eq!(validator.check(900, 890), Ok(-100));
+        assert_eq!(validator.last_drift(), -100);
+        assert_eq!(validator.rejections(), 0);
+
+        // Before the parent, even within the drift bound
+        assert_eq!(
+            validator.check(995, 996),
+            Err(ConsensusError::InvalidTimestamp {
+                timestamp: 995,
+                min: 996,
+                max: 1010,
+            })
+        );
+        // Too far ahead of the local clock
+        assert!(validator.check(1011, 990).is_err());
+        assert_eq!(validator.last_drift(), 11);
+        assert_eq!(validator.rejections(), 2);
+
+        // A config change applies to the next check
+        validator.set_max_drift(Duration::from_secs(20));
+        assert_eq!(validator.max_drift(), Duration::from_secs(20));
+        assert_eq!(validator.check(1011, 990), Ok(11));
+    }
+}
@@ -0,0 +1,457 @@
+//! Block proposal timing strategies
+//!
+//! A proposer asks its `ProposalTimer` whether to propose now, given the
+//! number of pending transactions and the time since the last block.
+//! A `ProposerBackoff` stretches the timer's intervals while the proposer's
+//! own blocks keep failing to gather a signature quorum.
+//!
+//! A `HeartbeatTimer` bounds the time without a block for any strategy and
+//! consensus engine: once the pool has been empty for its interval, an
+//! empty block is proposed. Empty blocks need nothing special from
+//! verification; they commit like any other block.
+
+use std::sync::atomic::{AtomicU32, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+/// Interval used when no strategy is configured.
+pub const DEFAULT_PROPOSAL_INTERVAL: Duration = Duration::from_secs(3);
+
+/// Quorum failures of its own blocks in a row after which a proposer
+/// backs off.
+pub const DEFAULT_BACKOFF_AFTER: u32 = 3;
+
+/// Largest factor by which backoff stretches the proposal interval.
+pub const DEFAULT_MAX_BACKOFF: u32 = 8;
+
+/// What a proposer should do next.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ProposalAction {
+    /// Propose a block now
+    Propose,
+    /// Check again after the given duration
+    Wait(Duration),
+}
+
+/// Decides when the local proposer should propose the next block.
+pub trait ProposalTimer: Send + Sync {
+    /// Strategy name as used in chain config.
+    fn name(&self) -> &'static str;
+
+    /// Returns the next action for a pool of `pending` transactions when
+    /// `idle` has passed since the last block.
+    fn next(&self, pending: usize, idle: Duration) -> ProposalAction;
+}
+
+fn after(interval: Duration, idle: Duration) -> ProposalAction {
+    if idle >= interval {
+        ProposalAction::Propose
+    } else {
+        ProposalAction::Wait(interval - idle)
+    }
+}
+
+/// Proposes at a fixed interval regardless of load.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct FixedTimer {
+    /// Interval between proposals
+    pub interval: Duration,
+}
+
+impl Default for FixedTimer {
+    fn default() -> Self {
+        Self {
+            interval: DEFAULT_PROPOSAL_INTERVAL,
+        }
+    }
+}
+
+impl ProposalTimer for FixedTimer {
+    fn name(&self) -> &'static str {
+        "fixed"
+    }
+
+    fn next(&self, _pending: usize, idle: Duration) -> ProposalAction {
+        after(self.interval, idle)
+    }
+}
+
+/// Shortens the interval linearly as the pool fills, reaching
+/// `min_interval` at `deep_pool` pending transactions.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct AdaptiveTimer {
+    /// Interval with an empty pool
+    pub interval: Duration,
+    /// Interval with a deep pool
+    pub min_interval: Duration,
+    /// Pending transactions considered a deep pool
+    pub deep_pool: usize,
+}
+
+impl AdaptiveTimer {
+    /// Returns the interval for a pool of `pending` transactions.
+    pub fn interval_for(&self, pending: usize) -> Duration {
+        if self.deep_pool == 0 || pending >= self.deep_pool {
+            return self.min_interval;
+        }
+        let span = self.interval.saturating_sub(self.min_interval);
+        let cut = span.as_millis() * pending as u128 / self.deep_pool as u128;
+        self.interval - Duration::from_millis(cut as u64)
+    }
+}
+
+impl ProposalTimer for AdaptiveTimer {
+    fn name(&self) -> &'static str {
+        "adaptive"
+    }
+
+    fn next(&self, pending: usize, idle: Duration) -> ProposalAction {
+        after(self.interval_for(pending), idle)
+    }
+}
+
+/// Proposes at a fixed interval while there is work, and otherwise only
+/// once `max_idle` has passed so the chain keeps advancing.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct EmptyBlockSuppression {
+    /// Interval between proposals with pending transactions
+    pub interval: Duration,
+    /// Longest time without a block
+    pub max_idle: Duration,
+}
+
+impl ProposalTimer for EmptyBlockSuppression {
+    fn name(&self) -> &'static str {
+        "suppress-empty"
+    }
+
+    fn next(&self, pending: usize, idle: Duration) -> ProposalAction {
+        if pending > 0 {
+            return after(self.interval, idle);
+        }
+        match after(self.max_idle, idle) {
+            // Poll at the regular interval so new transactions are picked up
+            ProposalAction::Wait(left) => ProposalAction::Wait(left.min(self.interval)),
+            propose => propose,
+        }
+    }
+}
+
+/// Wraps another timer so that an empty block is proposed once `interval`
+/// has passed without a block, whatever the inner timer would do.
+pub struct HeartbeatTimer {
+    inner: Box<dyn ProposalTimer>,
+    interval: Duration,
+}
+
+impl HeartbeatTimer {
+    /// Wraps `inner` with a heartbeat every `interval`.
+    pub fn new(inner: Box<dyn ProposalTimer>, interval: Duration) -> Self {
+        Self { inner, interval }
+    }
+}
+
+impl ProposalTimer for HeartbeatTimer {
+    fn name(&self) -> &'static str {
+        self.inner.name()
+    }
+
+    fn next(&self, pending: usize, idle: Duration) -> ProposalAction {
+        let action = self.inner.next(pending, idle);
+        if pending > 0 {
+            return action;
+        }
+        match (action, after(self.interval, idle)) {
+            (ProposalAction::Wait(left), ProposalAction::Wait(beat)) => {
+                ProposalAction::Wait(left.min(beat))
+            }
+            _ => ProposalAction::Propose,
+        }
+    }
+}
+
+/// Selectable proposal timing strategies.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum ProposalStrategy {
+    /// See `FixedTimer`
+    #[default]
+    Fixed,
+    /// See `AdaptiveTimer`
+    Adaptive,
+    /// See `EmptyBlockSuppression`
+    SuppressEmpty,
+}
+
+impl ProposalStrategy {
+    /// Parses a strategy name as used in chain config.
+    pub fn from_name(name: &str) -> Option<Self> {
+        match name {
+            "fixed" => Some(Self::Fixed),
+            "adaptive" => Some(Self::Adaptive),
+            "suppress-empty" => Some(Self::SuppressEmpty),
+            _ => None,
+        }
+    }
+}
+
+/// Tunables for building a `ProposalTimer`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ProposalTimerConfig {
+    /// Strategy to build
+    pub strategy: ProposalStrategy,
+    /// Interval between proposals
+    pub interval: Duration,
+    /// Shortest interval of the adaptive strategy
+    pub min_interval: Duration,
+    /// Pending transactions at which the adaptive strategy bottoms out
+    pub deep_pool: usize,
+    /// Longest idle time when empty blocks are suppressed
+    pub max_idle: Duration,
+    /// Time without a block after which an empty block is proposed under
+    /// any strategy, if set
+    pub empty_block_interval: Option<Duration>,
+}
+
+impl Default for ProposalTimerConfig {
+    fn default() -> Self {
+        Self {
+            strategy: ProposalStrategy::Fixed,
+            interval: DEFAULT_PROPOSAL_INTERVAL,
+            min_interval: Duration::from_millis(500),
+            deep_pool: 1000,
+            max_idle: Duration::from_secs(30),
+            empty_block_interval: None,
+        }
+    }
+}
+
+impl ProposalTimerConfig {
+    /// Builds the configured timer.
+    pub fn build(&self) -> Box<dyn ProposalTimer> {
+        let timer: Box<dyn ProposalTimer> = match self.strategy {
+            ProposalStrategy::Fixed => Box::new(FixedTimer {
+                interval: self.interval,
+            }),
+            ProposalStrategy::Adaptive => Box::new(AdaptiveTimer {
+                interval: self.interval,
+                min_interval: self.min_interval.min(self.interval),
+                deep_pool: self.deep_pool,
+            }),
+            ProposalStrategy::SuppressEmpty => Box::new(EmptyBlockSuppression {
+                interval: self.interval,
+                max_idle: self.max_idle.max(self.interval),
+            }),
+        };
+        match self.empty_block_interval {
+            Some(interval) if !interval.is_zero() => Box::new(HeartbeatTimer::new(timer, interval)),
+            _ => timer,
+        }
+    }
+}
+
+/// Slows down a proposer whose own blocks keep failing to gather a
+/// signature quorum.
+///
+/// After `after` failures in a row the proposal interval is doubled, and
+/// doubled again on every further failure up to `max_factor`. The next
+/// commit of one of the proposer's blocks restores the full rate. An
+/// `after` of zero disables backoff.
+#[derive(Debug)]
+pub struct ProposerBackoff {
+    after: u32,
+    max_factor: u32,
+    failures: AtomicU32,
+}
+
+impl Default for ProposerBackoff {
+    fn default() -> Self {
+        Self::new(DEFAULT_BACKOFF_AFTER, DEFAULT_MAX_BACKOFF)
+    }
+}
+
+impl ProposerBackoff {
+    /// Creates a governor backing off after `after` failures, by at most
+    /// `max_factor`.
+    pub fn new(after: u32, max_factor: u32) -> Self {
+        Self {
+            after,
+            max_factor: max_factor.max(1),
+            failures: AtomicU32::new(0),
+        }
+    }
+
+    /// Records that one of our blocks failed to gather a quorum, and
+    /// returns the new backoff factor.
+    pub fn record_failure(&self) -> u32 {
+        self.failures.fetch_add(1, Ordering::Relaxed);
+        self.factor()
+    }
+
+    /// Records that one of our blocks was committed, ending any backoff.
+    pub fn record_commit(&self) {
+        self.failures.store(0, Ordering::Relaxed);
+    }
+
+    /// Returns our blocks in a row that failed to gather a quorum.
+    pub fn failures(&self) -> u32 {
+        self.failures.load(Ordering::Relaxed)
+    }
+
+    /// Returns the factor the proposal interval is stretched by, 1 when
+    /// proposing at full rate.
+    pub fn factor(&self) -> u32 {
+        let failures = self.failures();
+        if self.after == 0 || failures < self.after {
+            return 1;
+        }
+        let doublings = (failures - self.after + 1).min(31);
+        (1u32 << doublings).min(self.max_factor)
+    }
+
+    /// Returns true if proposals are currently slowed down.
+    pub fn is_backing_off(&self) -> bool {
+        self.factor() > 1
+    }
+
+    /// Returns `timer`'s next action with its interval stretched by the
+    /// backoff factor.
+    pub fn next(
+        &self,
+        timer: &dyn ProposalTimer,
+        pending: usize,
+        idle: Duration,
+    ) -> ProposalAction {
+        let factor = self.factor();
+        match timer.next(pending, idle / factor) {
+            ProposalAction::Wait(left) => ProposalAction::Wait(left * factor),
+            propose => propose,
+        }
+    }
+}
+
+/// A `ProposalTimer` governed by a shared `ProposerBackoff`.
+pub struct BackoffTimer {
+    inner: Box<dyn ProposalTimer>,
+    backoff: Arc<ProposerBackoff>,
+}
+
+impl BackoffTimer {
+    /// Wraps `inner` so its intervals follow `backoff`.
+    pub fn new(inner: Box<dyn ProposalTimer>, backoff: Arc<ProposerBackoff>) -> Self {
+        Self { inner, backoff }
+    }
+}
+
+impl ProposalTimer for BackoffTimer {
+    fn name(&self) -> &'static str {
+        self.inner.name()
+    }
+
+    fn next(&self, pending: usize, idle: Duration) -> ProposalAction {
+        self.backoff.next(self.inner.as_ref(), pending, idle)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ms(n: u64) -> Duration {
+        Duration::from_millis(n)
+    }
+
+    #[test]
+    fn test_fixed_timer() {
+        let timer = FixedTimer { interval: ms(1000) };
+        assert_eq!(timer.next(0, ms(400)), ProposalAction::Wait(ms(600)));
+        assert_eq!(timer.next(5000, ms(400)), ProposalAction::Wait(ms(600)));
+        assert_eq!(timer.next(0, ms(1000)), ProposalAction::Propose);
+    }
+
+    #[test]
+    fn test_adaptive_timer() {
+        let timer = AdaptiveTimer {
+            interval: ms(1000),
+            min_interval: ms(200),
+            deep_pool: 100,
+        };
+        assert_eq!(timer.interval_for(0), ms(1000));
+        assert_eq!(timer.interval_for(50), ms(600));
+        assert_eq!(timer.interval_for(100), ms(200));
+        assert_eq!(timer.interval_for(10_000), ms(200));
+
+        assert_eq!(timer.next(0, ms(700)), ProposalAction::Wait(ms(300)));
+        assert_eq!(timer.next(50, ms(700)), ProposalAction::Propose);
+    }
+
+    #[test]
+    fn test_empty_block_suppression() {
+        let timer = EmptyBlockSuppression {
+            interval: ms(1000),
+            max_idle: ms(5000),
+        };
+        assert_eq!(timer.next(1, ms(1000)), ProposalAction::Propose);
+        assert_eq!(timer.next(0, ms(1000)), ProposalAction::Wait(ms(1000)));
+        assert_eq!(timer.next(0, ms(4500)), ProposalAction::Wait(ms(500)));
+        assert_eq!(timer.next(0, ms(5000)), ProposalAction::Propose);
+    }
+
+    #[test]
+    fn test_build_from_config() {
+        assert_eq!(ProposalStrategy::from_name("bogus"), None);
+        for name in ["fixed", "adaptive", "suppress-empty"] {
+            let config = ProposalTimerConfig {
+                strategy: ProposalStrategy::from_name(name).unwrap(),
+                ..Default::default()
+            };
+            assert_eq!(config.build().name(), name);
+        }
+    }
+
+    #[test]
+    fn test_heartbeat_timer() {
+        let config = ProposalTimerConfig {
+            strategy: ProposalStrategy::SuppressEmpty,
+            interval: ms(1000),
+            max_idle: ms(30_000),
+            empty_block_interval: Some(ms(5000)),
+            ..Default::default()
+        };
+        let timer = config.build();
+        assert_eq!(timer.name(), "suppress-empty");
+        assert_eq!(timer.next(0, ms(1000)), ProposalAction::Wait(ms(1000)));
+        assert_eq!(timer.next(0, ms(4500)), ProposalAction::Wait(ms(500)));
+        assert_eq!(timer.next(0, ms(5000)), ProposalAction::Propose);
+        assert_eq!(timer.next(3, ms(500)), ProposalAction::Wait(ms(500)));
+
+        // A longer heartbeat leaves a faster strategy alone
+        let timer = HeartbeatTimer::new(Box::new(FixedTimer { interval: ms(1000) }), ms(5000));
+        assert_eq!(timer.next(0, ms(400)), ProposalAction::Wait(ms(600)));
+        assert_eq!(timer.next(0, ms(1000)), ProposalAction::Propose);
+    }
+    #[test]
+    fn test_proposer_backoff() {
+        let backoff = Arc::new(ProposerBackoff::new(2, 4));
+        let timer = BackoffTimer::new(Box::new(FixedTimer { interval: ms(1000) }), backoff.clone());
+        assert_eq!(timer.name(), "fixed");
+
+        assert_eq!(backoff.record_failure(), 1);
+        assert_eq!(timer.next(0, ms(1000)), ProposalAction::Propose);
+        assert_eq!(backoff.record_failure(), 2);
+        assert!(backoff.is_backing_off());
+        assert_eq!(timer.next(0, ms(1000)), ProposalAction::Wait(ms(1000)));
+        assert_eq!(timer.next(0, ms(2000)), ProposalAction::Propose);
+        assert_eq!(backoff.record_failure(), 4);
+        assert_eq!(backoff.record_failure(), 4);
+        assert_eq!(timer.next(0, ms(2000)), ProposalAction::Wait(ms(2000)));
+
+        backoff.record_commit();
+        assert_eq!(backoff.failures(), 0);
+        assert_eq!(timer.next(0, ms(1000)), ProposalAction::Propose);
+
+        let disabled = ProposerBackoff::new(0, 8);
+        for _ in 0..10 {
+            assert_eq!(disabled.record_failure(), 1);
+        }
+    }
+}
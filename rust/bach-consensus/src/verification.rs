@@ -0,0 +1,178 @@
+//! Proposed block verification and result caching
+
+use bach_primitives::H256;
+use bach_types::{Block, ReadWriteSet};
+use std::collections::{HashMap, VecDeque};
+use std::sync::Arc;
+
+/// Default number of verified blocks kept per height
+pub const DEFAULT_VERIFICATION_CACHE_SIZE: usize = 16;
+
+/// Whether a proposed block passed verification.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Verdict {
+    /// The block executed and matched its header
+    Valid,
+    /// The block was rejected with a reason
+    Invalid(String),
+}
+
+impl Verdict {
+    /// Returns true if the block is valid.
+    pub fn is_valid(&self) -> bool {
+        matches!(self, Verdict::Valid)
+    }
+}
+
+/// Result of simulating a proposed block.
+#[derive(Debug, Clone)]
+pub struct VerificationResult {
+    /// Read/write sets of the block's transactions in block order
+    pub rwsets: Vec<ReadWriteSet>,
+    /// State root after executing the block
+    pub state_root: H256,
+    /// Verdict on the block
+    pub verdict: Verdict,
+}
+
+/// Executes a proposed block before the engine pre-votes for it.
+///
+/// The VM lives outside consensus; the node plugs it in here.
+pub trait BlockVerifier: Send + Sync {
+    /// Simulates the block against the current state.
+    fn verify(&self, block: &Block) -> VerificationResult;
+}
+
+/// Verification results keyed by block hash.
+///
+/// Consensus re-delivers the same proposal on retransmission and re-proposes
+/// the locked block in later rounds; both are served from here instead of
+/// simulating the block again. Results are only valid against the state
+/// they were computed on, so the cache must be cleared on commit and when
+/// the validator set or chain configuration changes.
+#[derive(Debug, Clone)]
+pub struct VerificationCache {
+    entries: HashMap<H256, Arc<VerificationResult>>,
+    order: VecDeque<H256>,
+    capacity: usize,
+    hits: u64,
+    misses: u64,
+}
+
+impl VerificationCache {
+    /// Creates a cache holding at most `capacity` results.
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            entries: HashMap::new(),
+            order: VecDeque::new(),
+            capacity: capacity.max(1),
+            hits: 0,
+            misses: 0,
+        }
+    }
+
+    /// Returns the cached result for a block, counting a hit or miss.
+    pub fn get(&mut self, block_hash: &H256) -> Option<Arc<VerificationResult>> {
+        match self.entries.get(block_hash) {
+            Some(result) => {
+                self.hits += 1;
+                Some(result.clone())
+            }
+            None => {
+                self.misses += 1;
+                None
+            }
+        }
+    }
+
+    /// Returns the cached result for a block without touching the counters.
+    pub fn peek(&self, block_hash: &H256) -> Option<&Arc<VerificationResult>> {
+        self.entries.get(block_hash)
+    }
+
+    /// Stores a result, evicting the oldest entry when full.
+    pub fn insert(
+        &mut self,
+        block_hash: H256,
+        result: VerificationResult,
+    ) -> Arc<VerificationResult> {
+        let result = Arc::new(result);
+        if self.entries.insert(block_hash, result.clone()).is_none() {
+            if self.order.len() == self.capacity {
+                if let Some(oldest) = self.order.pop_front() {
+                    self.entries.remove(&oldest);
+                }
+            }
+            self.order.push_back(block_hash);
+        }
+        result
+    }
+
+    /// Drops all cached results.
+    pub fn clear(&mut self) {
+        self.entries.clear();
+        self.order.clear();
+    }
+
+    /// Returns the number of cached results.
+    pub fn len(&self) -> usize {
+        self.entries.len()
+    }
+
+    /// Returns true if nothing is cached.
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+
+    /// Returns the number of lookups served from the cache.
+    pub fn hits(&self) -> u64 {
+        self.hits
+    }
+
+    /// Returns the number of lookups that required verification.
+    pub fn misses(&self) -> u64 {
+        self.misses
+    }
+}
+
+impl Default for VerificationCache {
+    fn default() -> Self {
+        Self::new(DEFAULT_VERIFICATION_CACHE_SIZE)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn result(verdict: Verdict) -> VerificationResult {
+        VerificationResult {
+            rwsets: Vec::new(),
+            state_root: H256::zero(),
+            verdict,
+        }
+    }
+
+    #[test]
+    fn test_cache_evicts_oldest() {
+        let mut cache = VerificationCache::new(2);
+        let a = H256::from([1u8; 32]);
+        let b = H256::from([2u8; 32]);
+        let c = H256::from([3u8; 32]);
+
+        cache.insert(a, result(Verdict::Valid));
+        cache.insert(b, result(Verdict::Invalid("bad root".to_string())));
+        cache.insert(b, result(Verdict::Valid));
+        cache.insert(c, result(Verdict::Valid));
+
+        assert_eq!(cache.len(), 2);
+        assert!(cache.get(&a).is_none());
+        assert!(cache.get(&b).unwrap().verdict.is_valid());
+        assert_eq!(cache.hits(), 1);
+        assert_eq!(cache.misses(), 1);
+
+        cache.clear();
+        assert!(cache.is_empty());
+        assert!(cache.peek(&c).is_none());
+    }
+}
@@ -1,11 +1,15 @@
 //! Integration tests for bach-consensus TBFT implementation
 
 use bach_consensus::{
-    ConsensusError, ConsensusMessage, ConsensusStep, TbftConsensus, Validator, ValidatorSet,
+    BlockVerifier, ConsensusError, ConsensusMessage, ConsensusStep, Evidence, EvidenceEvent,
+    EvidenceKind, EvidenceRecord, EvidenceRegistry, Penalty, SpeculationConfig, TbftConsensus, ThresholdPenaltyHook,
+    TxSignatureVerifier, Validator, ValidatorSet, Verdict, VerificationResult,
 };
-use bach_crypto::PrivateKey;
-use bach_primitives::H256;
-use bach_types::Block;
+use bach_crypto::{PrivateKey, Signature};
+use bach_primitives::{Address, H256, U256};
+use bach_types::{Block, Transaction};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
 
 /// Helper to create a test validator set with the given count
 fn create_test_validators(count: usize) -> (Vec<PrivateKey>, ValidatorSet) {
@@ -767,3 +771,400 @@ fn test_state_reset_on_new_height() {
     assert!(consensus.state().proposal().is_none());
     assert!(!consensus.is_committed());
 }
+
+// =============================================================================
+// Equivocation Evidence Tests
+// =============================================================================
+
+#[test]
+fn test_conflicting_prevote_produces_evidence() {
+    let (private_keys, validator_set) = create_test_validators(4);
+
+    let mut node = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+    node.start_height(0);
+
+    let mut byzantine = TbftConsensus::new(validator_set.clone(), private_keys[1].clone());
+    let first = byzantine.create_prevote(Some(H256::zero()));
+    let second = byzantine.create_prevote(Some(H256::from([1u8; 32])));
+
+    assert!(node.handle_message(ConsensusMessage::PreVote(first)).is_ok());
+    let result = node.handle_message(ConsensusMessage::PreVote(second));
+    assert!(matches!(result, Err(ConsensusError::Equivocation(_))));
+
+    let evidence = node.take_evidence();
+    assert_eq!(evidence.len(), 1);
+    assert_eq!(evidence[0].kind, EvidenceKind::PreVote);
+    assert_eq!(evidence[0].validator, *byzantine.our_address());
+    assert!(evidence[0].verify(&validator_set).is_ok());
+    assert!(node.take_evidence().is_empty());
+}
+
+#[test]
+fn test_conflicting_proposal_produces_evidence() {
+    let (private_keys, validator_set) = create_test_validators(4);
+
+    let mut proposer = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+    proposer.start_height(0);
+    let first = proposer.create_proposal(vec![], H256::zero(), 1000).unwrap();
+    let second = proposer.create_proposal(vec![], H256::zero(), 2000).unwrap();
+
+    let mut node = TbftConsensus::new(validator_set.clone(), private_keys[1].clone());
+    node.start_height(0);
+    assert!(node.handle_message(first).is_ok());
+    let result = node.handle_message(second);
+    assert!(matches!(result, Err(ConsensusError::Equivocation(_))));
+
+    let evidence = node.take_evidence();
+    assert_eq!(evidence.len(), 1);
+    assert_eq!(evidence[0].kind, EvidenceKind::Proposal);
+    assert!(evidence[0].verify(&validator_set).is_ok());
+}
+
+#[test]
+fn test_evidence_registry_records_once() {
+    let (private_keys, validator_set) = create_test_validators(4);
+
+    let mut byzantine = TbftConsensus::new(validator_set.clone(), private_keys[2].clone());
+    byzantine.start_height(0);
+    let first = byzantine.create_precommit(Some(H256::zero()));
+    let second = byzantine.create_precommit(None);
+    let evidence = Evidence::from_precommits(&first, &second).unwrap();
+
+    let data = evidence.encode();
+    assert_eq!(Evidence::decode(&data).unwrap(), evidence);
+
+    let reporter = *TbftConsensus::new(validator_set.clone(), private_keys[0].clone()).our_address();
+    let mut registry = EvidenceRegistry::new();
+    let event = registry.submit(reporter, &data, &validator_set, 5).unwrap();
+    assert_eq!(event.validator, *byzantine.our_address());
+    assert_eq!(event.kind, EvidenceKind::PreCommit);
+    assert_eq!(registry.records_for(byzantine.our_address()).len(), 1);
+    assert_eq!(
+        EvidenceEvent::from_log(&event.log_topics(), &event.log_data()),
+        Some(event.clone())
+    );
+    assert_eq!(registry.take_events(), vec![event]);
+
+    // The penalty takes effect from the height after inclusion
+    let hook = ThresholdPenaltyHook::default();
+    assert!(registry.penalties(&hook, 5).is_empty());
+    assert_eq!(
+        registry.penalties(&hook, 6),
+        vec![(*byzantine.our_address(), Penalty::Exclude)]
+    );
+
+    // Stored records restore the same penalties
+    let mut restored = EvidenceRegistry::new();
+    for record in registry.records() {
+        restored.restore(EvidenceRecord::decode(&record.encode()).unwrap());
+    }
+    assert_eq!(restored.penalties(&hook, 6), registry.penalties(&hook, 6));
+    assert!(registry
+        .penalties(&ThresholdPenaltyHook { max_evidence: 1 }, 6)
+        .is_empty());
+
+    // Same evidence with the values swapped is a duplicate
+    let swapped = Evidence::from_precommits(&second, &first).unwrap();
+    assert!(matches!(
+        registry.submit(reporter, &swapped.encode(), &validator_set, 5),
+        Err(ConsensusError::InvalidEvidence(_))
+    ));
+}
+
+#[test]
+fn test_forged_evidence_rejected() {
+    let (private_keys, validator_set) = create_test_validators(4);
+
+    let mut honest = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+    let first = honest.create_prevote(Some(H256::zero()));
+    let mut forged = first.clone();
+    forged.block_hash = None;
+    let evidence = Evidence::from_prevotes(&first, &forged).unwrap();
+
+    assert!(matches!(
+        evidence.verify(&validator_set),
+        Err(ConsensusError::InvalidSignature)
+    ));
+
+    let mut registry = EvidenceRegistry::new();
+    assert!(registry
+        .submit(*honest.our_address(), &evidence.encode(), &validator_set, 0)
+        .is_err());
+    assert!(matches!(
+        Evidence::decode(&evidence.encode()[..10]),
+        Err(ConsensusError::InvalidEvidence(_))
+    ));
+}
+
+#[test]
+fn test_evidence_registry_deterministic_order() {
+    let (private_keys, validator_set) = create_test_validators(4);
+
+    let mut byzantine = TbftConsensus::new(validator_set.clone(), private_keys[3].clone());
+    let submissions: Vec<Vec<u8>> = (0..4u8)
+        .map(|i| {
+            byzantine.start_height(i as u64);
+            let first = byzantine.create_prevote(Some(H256::from([i; 32])));
+            let second = byzantine.create_prevote(None);
+            Evidence::from_prevotes(&first, &second).unwrap().encode()
+        })
+        .collect();
+
+    // Run the same submissions in different orders; queries must agree
+    let run = |order: &[usize]| {
+        let mut registry = EvidenceRegistry::new();
+        for &i in order {
+            registry
+                .submit(Address::zero(), &submissions[i], &validator_set, 10)
+                .unwrap();
+        }
+        registry
+            .records_for(byzantine.our_address())
+            .into_iter()
+            .map(|r| r.evidence.hash())
+            .collect::<Vec<_>>()
+    };
+
+    let forward = run(&[0, 1, 2, 3]);
+    assert_eq!(forward.len(), 4);
+    assert_eq!(forward, run(&[3, 1, 0, 2]));
+    assert!(forward.windows(2).all(|w| w[0] < w[1]));
+}
+
+// =============================================================================
+// Block Verification Cache Tests
+// =============================================================================
+
+/// Verifier that counts simulations and rejects blocks with a given timestamp
+struct CountingVerifier {
+    calls: Arc<AtomicUsize>,
+    reject_timestamp: u64,
+}
+
+impl BlockVerifier for CountingVerifier {
+    fn verify(&self, block: &Block) -> VerificationResult {
+        self.calls.fetch_add(1, Ordering::SeqCst);
+        let verdict = if block.timestamp == self.reject_timestamp {
+            Verdict::Invalid("state root mismatch".to_string())
+        } else {
+            Verdict::Valid
+        };
+        VerificationResult {
+            rwsets: Vec::new(),
+            state_root: H256::zero(),
+            verdict,
+        }
+    }
+}
+
+fn node_with_verifier(
+    key: PrivateKey,
+    validator_set: ValidatorSet,
+    reject_timestamp: u64,
+) -> (TbftConsensus, Arc<AtomicUsize>) {
+    let calls = Arc::new(AtomicUsize::new(0));
+    let verifier = CountingVerifier {
+        calls: calls.clone(),
+        reject_timestamp,
+    };
+    let node = TbftConsensus::new(validator_set, key).with_block_verifier(Box::new(verifier));
+    (node, calls)
+}
+
+#[test]
+fn test_redelivered_proposal_served_from_cache() {
+    let (private_keys, validator_set) = create_test_validators(4);
+
+    let mut proposer = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+    proposer.start_height(0);
+    let proposal = proposer.create_proposal(vec![], H256::zero(), 1000).unwrap();
+
+    let (mut node, calls) = node_with_verifier(private_keys[1].clone(), validator_set, 0);
+    node.start_height(0);
+    assert!(node.handle_message(proposal.clone()).is_ok());
+    assert!(node.handle_message(proposal).is_ok());
+
+    assert_eq!(calls.load(Ordering::SeqCst), 1);
+    assert_eq!(node.verification_cache().hits(), 1);
+    assert_eq!(node.verification_cache().misses(), 1);
+    let block_hash = node.state().proposal().unwrap().block.hash();
+    assert!(node.verification_result(&block_hash).unwrap().verdict.is_valid());
+
+    // Committing moves to new state, so cached results are dropped
+    node.advance_height();
+    assert!(node.verification_cache().is_empty());
+}
+
+#[test]
+fn test_invalid_verdict_cached_and_rejected() {
+    let (private_keys, validator_set) = create_test_validators(4);
+
+    let mut proposer = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+    proposer.start_height(0);
+    let proposal = proposer.create_proposal(vec![], H256::zero(), 1000).unwrap();
+
+    let (mut node, calls) = node_with_verifier(private_keys[1].clone(), validator_set, 1000);
+    node.start_height(0);
+    for _ in 0..2 {
+        let result = node.handle_message(proposal.clone());
+        assert!(matches!(result, Err(ConsensusError::InvalidProposal(_))));
+    }
+
+    assert_eq!(calls.load(Ordering::SeqCst), 1);
+    assert!(node.state().proposal().is_none());
+    let proposer_address = *proposer.our_address();
+    assert_eq!(node.proposer_tracker().get(&proposer_address).unwrap().invalid, 1);
+
+    node.invalidate_verification_cache();
+    assert!(node.verification_cache().is_empty());
+}
+
+// =============================================================================
+// Speculative Pre-execution Tests
+// =============================================================================
+
+fn signed_txs(count: u64) -> Vec<Transaction> {
+    let sender = PrivateKey::from_bytes(&[0x33; 32]).unwrap();
+    (0..count)
+        .map(|nonce| Transaction::new(nonce, None, U256::ZERO, vec![], sender.sign(&H256::zero())))
+        .collect()
+}
+
+#[test]
+fn test_speculated_batch_reused_by_matching_proposal() {
+    let (private_keys, validator_set) = create_test_validators(4);
+    let txs = signed_txs(3);
+
+    let (node, calls) =
+        node_with_verifier(private_keys[1].clone(), validator_set.clone(), u64::MAX);
+    let mut node = node.with_speculation(SpeculationConfig::default());
+    node.start_height(0);
+    for tx in &txs {
+        node.observe_transaction(tx.clone());
+    }
+    assert!(node.pre_execute(H256::zero(), 1000));
+    // Nothing new was gossiped, so there is nothing more to speculate
+    assert!(!node.pre_execute(H256::zero(), 1000));
+    assert_eq!(calls.load(Ordering::SeqCst), 1);
+
+    let mut proposer = TbftConsensus::new(validator_set, private_keys[0].clone());
+    proposer.start_height(0);
+    let proposal = proposer.create_proposal(txs, H256::zero(), 1000).unwrap();
+    assert!(node.handle_message(proposal).is_ok());
+
+    assert_eq!(calls.load(Ordering::SeqCst), 1);
+    let stats = node.speculation().unwrap().stats();
+    assert_eq!((stats.executed, stats.hits, stats.misses), (1, 1, 0));
+    // The proposal arrived, so the follower stops speculating
+    node.observe_transaction(signed_txs(4).pop().unwrap());
+    assert!(!node.pre_execute(H256::zero(), 1000));
+}
+
+#[test]
+fn test_unmatched_proposal_falls_back_to_full_execution() {
+    let (private_keys, validator_set) = create_test_validators(4);
+    let txs = signed_txs(3);
+
+    let (node, calls) =
+        node_with_verifier(private_keys[1].clone(), validator_set.clone(), u64::MAX);
+    let mut node = node.with_speculation(SpeculationConfig::default());
+    node.start_height(0);
+    for tx in &txs {
+        node.observe_transaction(tx.clone());
+    }
+    assert!(node.pre_execute(H256::zero(), 1000));
+
+    // The proposer took a different batch
+    let mut proposer = TbftConsensus::new(validator_set, private_keys[0].clone());
+    proposer.start_height(0);
+    let proposal = proposer.create_proposal(txs[..2].to_vec(), H256::zero(), 1000).unwrap();
+    assert!(node.handle_message(proposal).is_ok());
+
+    assert_eq!(calls.load(Ordering::SeqCst), 2);
+    let stats = node.speculation().unwrap().stats();
+    assert_eq!((stats.hits, stats.misses), (0, 1));
+}
+
+#[test]
+fn test_proposal_at_another_timestamp_misses() {
+    let (private_keys, validator_set) = create_test_validators(4);
+    let txs = signed_txs(3);
+
+    let (node, calls) =
+        node_with_verifier(private_keys[1].clone(), validator_set.clone(), u64::MAX);
+    let mut node = node.with_speculation(SpeculationConfig::default());
+    node.start_height(0);
+    for tx in &txs {
+        node.observe_transaction(tx.clone());
+    }
+    assert!(node.pre_execute(H256::zero(), 1000));
+    // A different expected timestamp is a different block
+    assert!(node.pre_execute(H256::zero(), 1001));
+
+    let mut proposer = TbftConsensus::new(validator_set, private_keys[0].clone());
+    proposer.start_height(0);
+    let proposal = proposer.create_proposal(txs, H256::zero(), 1002).unwrap();
+    assert!(node.handle_message(proposal).is_ok());
+
+    assert_eq!(calls.load(Ordering::SeqCst), 3);
+    let stats = node.speculation().unwrap().stats();
+    assert_eq!((stats.executed, stats.hits, stats.misses), (2, 0, 1));
+}
+
+#[test]
+fn test_proposer_does_not_speculate() {
+    let (private_keys, validator_set) = create_test_validators(4);
+    let (node, calls) = node_with_verifier(private_keys[0].clone(), validator_set, u64::MAX);
+    let mut node = node.with_speculation(SpeculationConfig::default());
+    node.start_height(0);
+    node.observe_transaction(signed_txs(1).pop().unwrap());
+
+    assert!(!node.pre_execute(H256::zero(), 1000));
+    assert_eq!(calls.load(Ordering::SeqCst), 0);
+}
+
+// =============================================================================
+// Transaction Signature Tests
+// =============================================================================
+
+#[test]
+fn test_unrecoverable_tx_signature_rejects_proposal() {
+    let (private_keys, validator_set) = create_test_validators(4);
+    let sender = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+    let mut txs: Vec<Transaction> = (0..8)
+        .map(|nonce| {
+            let unsigned =
+                Transaction::new(nonce, None, U256::ZERO, vec![], sender.sign(&H256::zero()));
+            let signature = sender.sign(&unsigned.signing_hash());
+            Transaction::new(nonce, None, U256::ZERO, vec![], signature)
+        })
+        .collect();
+    let signing_hash = txs[5].signing_hash();
+    txs[5].signature = (1u8..)
+        .find_map(|b| {
+            let mut bytes = [b; 65];
+            bytes[64] = 27;
+            Signature::from_bytes(&bytes)
+                .ok()
+                .filter(|sig| sig.recover(&signing_hash).is_err())
+        })
+        .unwrap()
+        .into();
+
+    let mut proposer = TbftConsensus::new(validator_set.clone(), private_keys[0].clone());
+    proposer.start_height(0);
+    let proposal = proposer.create_proposal(txs, H256::zero(), 1000).unwrap();
+
+    let (node, calls) = node_with_verifier(private_keys[1].clone(), validator_set, 0);
+    let verifier = TxSignatureVerifier::parallel(Some(4)).with_min_parallel_txs(1);
+    let mut node = node.with_tx_signature_verifier(verifier);
+    node.start_height(0);
+    let result = node.handle_message(proposal);
+    assert!(matches!(result, Err(ConsensusError::InvalidTxSignature { index: 5, .. })));
+
+    // The block is never simulated, and the proposer is charged
+    assert_eq!(calls.load(Ordering::SeqCst), 0);
+    assert!(node.state().proposal().is_none());
+    let proposer_address = *proposer.our_address();
+    assert_eq!(node.proposer_tracker().get(&proposer_address).unwrap().invalid, 1);
+}
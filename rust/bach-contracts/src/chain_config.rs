@@ -0,0 +1,2389 @@
+//! Chain configuration system contract
+//!
+//! Chain-wide parameters change through update transactions sent to the
+//! config contract. Every applied update creates a new version that takes
+//! effect at a block height; earlier versions are kept so the parameters
+//! in force at any height can be queried with `GET_CHAIN_CONFIG_AT`, two
+//! versions can be diffed, and a parameter can be reverted by preparing an
+//! update that restores an older value.
+//!
+//! Each org may register an admin key (`admin.<org>`) in the genesis config
+//! or before any admin is registered. Once any admin is registered, only
+//! admin keys can change the config and `admin.<org>` can't be updated. An
+//! org's admin key is replaced without downtime by a rotation: the org's
+//! admin stages the new key with a future activation height, a majority of
+//! orgs endorse it before that height, each once whichever of its keys
+//! signs, and from activation both keys are honored for
+//! `key_rotation_window` blocks, after which only the new key is.
+//!
+//! The `proposal_*` parameters select how proposers time blocks:
+//! `fixed` proposes every `proposal_interval_ms`, `adaptive` shortens the
+//! interval towards `proposal_min_interval_ms` as the pool fills up to
+//! `proposal_deep_pool` transactions, and `suppress-empty` skips empty
+//! blocks until `proposal_max_idle_ms` has passed.
+//!
+//! `empty_block_interval_ms` makes proposers propose an empty block once
+//! that long has passed without a block, under any timer and consensus
+//! type, so the chain keeps a heartbeat; 0 disables it.
+//!
+//! `max_clock_drift_secs` bounds how far a proposed block's timestamp may be
+//! ahead of a validator's clock. Validators don't pre-vote for blocks past
+//! it, nor for blocks stamped before their parent.
+//!
+//! `signature_algorithms` lists the member key algorithms (`secp256k1`,
+//! `ed25519`, `sm2`) transactions and RPC tokens may be signed with. An
+//! entry may name the hash algorithm transactions with that key are
+//! digested with before signing as `<key>/<hash>` (e.g. `ed25519/sm3`); a
+//! bare key algorithm means its default hash, SM3 for SM2 and Keccak-256
+//! otherwise. Each key algorithm gets one hash, so signers derive it from
+//! their key rather than choose it. Transactions signed by any other scheme
+//! are refused at pool admission, and validators don't pre-vote for blocks
+//! holding one.
+//!
+//! `hash_migrations` schedules block hash algorithm changes as
+//! `<algorithm>@<height>` entries (e.g. `sha256@1000,sm3@5000`). Blocks are
+//! hashed with Keccak-256 until the first activation height and with the
+//! algorithm in force at their height afterwards. A migration must activate
+//! after the update's height and can't be changed once it has activated.
+//!
+//! `checkpoint_interval` makes validators co-sign a finality checkpoint
+//! (height, block hash, state root) every that many blocks; 0 disables
+//! checkpoints.
+//!
+//! `max_txs_per_sender` caps how many transactions from one sender a block
+//! may hold, so a bursty sender can't crowd out the others; proposers leave
+//! the excess in the pool and validators don't pre-vote for blocks over the
+//! cap. 0 disables the cap.
+//!
+//! `max_evidence` is how many equivocation evidence records the evidence
+//! registry may hold against a validator before it is excluded from the
+//! validator set; 0 excludes it on its first record.
+//!
+//! `isolated_contracts` lists contracts whose storage is namespaced by the
+//! org of the submitting member, for multi-tenant deployments. Members
+//! other than admin keys join an org through `members.<org>`, a
+//! comma-separated list of accounts; an account belongs to at most one org.
+//! Cross-org reads need a grant in the org grants system contract.
+//!
+//! `revocation_issuers` lists the accounts whose signed revocation lists
+//! the revocation registry accepts; lists of issuers removed from it stop
+//! counting.
+//!
+//! `multi_sign_signers` lists the accounts voting on multi-sign proposals;
+//! a majority of them approves a proposal.
+//!
+//! `nodes.<org>` lists the network nodes an org runs as `<node id>@<ip:port>`
+//! entries. Once any org lists nodes, the network runs in static topology:
+//! nodes dial only listed nodes, refuse connections from any other node ID
+//! and follow updates to the lists. Removing every list restores discovery.
+//!
+//! Contracts installed through the contract ACL system contract carry a
+//! manifest restricting methods to a role (member or admin) and set of
+//! orgs, resolved from the same `admin.<org>` and `members.<org>`
+//! parameters. The org of the account that installed a contract owns it.
+//! Changing its manifest is guarded by the `acl.<contract>` policy, which
+//! takes the installer itself or an admin of the owning org. Operators can
+//! also pause a contract, rejecting transactions to it while read-only
+//! calls keep working; pausing and resuming are guarded by the
+//! `pause.<contract>` policy, which takes the owning org's admin.
+//!
+//! `feature_activations` schedules protocol features as `<feature>@<height>`
+//! entries. Nodes advertise the features they support to their peers, and
+//! each org's admin signals on chain which features its nodes support with
+//! `CONFIG_SIGNAL_FEATURES`. A feature can only be scheduled once a majority
+//! of orgs signaled support; like hash migrations, it must activate after the
+//! update's height and can't be changed once it has activated. Code gated on
+//! a feature checks `is_feature_active` at the block's height.
+//!
+//! Before submitting a governance transaction, `SIMULATE_ENDORSEMENT`
+//! evaluates the policy guarding a resource (`config`, `rotation.<org>`,
+//! `acl.<contract>` or `pause.<contract>`, given its owning org) against a
+//! set of endorsers and reports the rule, whether it passes and which orgs
+//! are still missing.
+//!
+//! Calldata is `CONFIG_UPDATE || json([[name, value], ...])`,
+//! `GET_CHAIN_CONFIG_AT || height (u64 BE)`,
+//! `CONFIG_STAGE_ROTATION || json(rotation request)`,
+//! `CONFIG_ENDORSE_ROTATION || org (utf-8)`,
+//! `SIMULATE_ENDORSEMENT || json(simulation request)`,
+//! `CONFIG_SIGNAL_FEATURES || json([feature, ...])` or
+//! `LIST_CHAIN_CONFIG_VERSIONS || json(page request)`, which pages through
+//! the versions in the order they took effect.
+
+use crate::ordered::OrderedKv;
+use crate::page::PageRequest;
+use bach_crypto::{HashAlgorithm, HashSchedule, KeyAlgorithm, SignatureScheme};
+use bach_evm::{FeatureGates, OrgIsolation, OrgMembers, EVM_FEATURES};
+use bach_primitives::{Address, SystemContract};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::net::SocketAddr;
+
+/// Config call: apply parameter changes.
+pub const CONFIG_UPDATE: u8 = 0x01;
+/// Config call: return the version in force at a height.
+pub const GET_CHAIN_CONFIG_AT: u8 = 0x02;
+/// Config call: stage an org admin key rotation.
+pub const CONFIG_STAGE_ROTATION: u8 = 0x03;
+/// Config call: endorse an org's staged admin key rotation.
+pub const CONFIG_ENDORSE_ROTATION: u8 = 0x04;
+/// Config call: evaluate a resource's endorsement policy without changes.
+pub const SIMULATE_ENDORSEMENT: u8 = 0x05;
+/// Config call: record the protocol features the sender's org supports.
+pub const CONFIG_SIGNAL_FEATURES: u8 = 0x06;
+/// Config call: list a page of config versions.
+pub const LIST_CHAIN_CONFIG_VERSIONS: u8 = 0x07;
+
+/// Policy resource guarding parameter updates.
+pub const CONFIG_RESOURCE: &str = "config";
+/// Prefix of the policy resources guarding admin key rotations
+/// (`rotation.<org>`).
+pub const ROTATION_RESOURCE_PREFIX: &str = "rotation.";
+/// Prefix of the policy resources guarding contract method permission
+/// changes (`acl.<contract>`).
+pub const ACL_RESOURCE_PREFIX: &str = "acl.";
+/// Prefix of the policy resources guarding contract pauses
+/// (`pause.<contract>`).
+pub const PAUSE_RESOURCE_PREFIX: &str = "pause.";
+
+/// Names of the configurable parameters, in display order.
+pub const CONFIG_PARAMS: &[&str] = &[
+    "block_gas_limit",
+    "max_tx_data_size",
+    "storage_quota",
+    "key_rotation_window",
+    "proposal_timer",
+    "proposal_interval_ms",
+    "proposal_min_interval_ms",
+    "proposal_deep_pool",
+    "proposal_max_idle_ms",
+    "empty_block_interval_ms",
+    "max_clock_drift_secs",
+    "faucet_enabled",
+    "faucet_amount",
+    "faucet_window_secs",
+    "signature_algorithms",
+    "hash_migrations",
+    "checkpoint_interval",
+    "max_txs_per_sender",
+    "max_evidence",
+    "isolated_contracts",
+    "revocation_issuers",
+    "multi_sign_signers",
+    "feature_activations",
+];
+
+/// Protocol features this build implements. A change that needs every node
+/// to agree on when it starts adds its name here and checks
+/// `is_feature_active` before changing behavior; the EVM's own features are
+/// checked through the gates from [`ChainConfig::feature_gates`].
+pub const PROTOCOL_FEATURES: &[&str] = EVM_FEATURES;
+
+/// Longest accepted protocol feature name.
+pub const MAX_FEATURE_NAME_LEN: usize = 64;
+
+/// Block proposal timing strategies accepted by `proposal_timer`.
+pub const PROPOSAL_TIMERS: &[&str] = &["fixed", "adaptive", "suppress-empty"];
+
+/// Prefix of the parameters holding org admin keys (`admin.<org>`).
+pub const ADMIN_PARAM_PREFIX: &str = "admin.";
+
+/// Prefix of the parameters listing org member accounts (`members.<org>`).
+pub const MEMBERS_PARAM_PREFIX: &str = "members.";
+
+/// Prefix of the parameters listing org network nodes (`nodes.<org>`).
+pub const NODES_PARAM_PREFIX: &str = "nodes.";
+
+/// Returns the address of the chain config system contract (0x…0104).
+pub fn chain_config_address() -> Address {
+    SystemContract::ChainConfig.address()
+}
+
+/// Errors returned by the chain config contract.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ChainConfigError {
+    /// No parameter with this name
+    UnknownParameter(String),
+    /// Value cannot be parsed for the parameter
+    InvalidValue { name: String, value: String },
+    /// Update takes effect before the latest version
+    InvalidHeight { latest: u64, height: u64 },
+    /// No version with this number
+    UnknownVersion(u64),
+    /// Sender holds no admin key in force
+    NotAdmin(Address),
+    /// No admin key is registered for the org
+    UnknownOrg(String),
+    /// Admin keys can only change through rotations once any is registered
+    RotationRequired(String),
+    /// Rotation cannot be staged or endorsed
+    InvalidRotation(String),
+    /// No endorsement policy guards this resource
+    UnknownResource(String),
+    /// Too few orgs signaled support for a feature to schedule it
+    UnsupportedFeature(String),
+    /// Calldata or a stored version could not be decoded
+    Malformed(String),
+}
+
+impl std::fmt::Display for ChainConfigError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::UnknownParameter(name) => write!(f, "unknown config parameter: {}", name),
+            Self::InvalidValue { name, value } => {
+                write!(f, "invalid value for {}: {}", name, value)
+            }
+            Self::InvalidHeight { latest, height } => write!(
+                f,
+                "update at height {} precedes latest version at height {}",
+                height, latest
+            ),
+            Self::UnknownVersion(version) => write!(f, "unknown config version: {}", version),
+            Self::NotAdmin(sender) => write!(f, "{} holds no admin key", sender),
+            Self::UnknownOrg(org) => write!(f, "no admin key registered for org {}", org),
+            Self::RotationRequired(org) => {
+                write!(f, "admin key of {} can only be changed by a rotation", org)
+            }
+            Self::InvalidRotation(msg) => write!(f, "invalid admin key rotation: {}", msg),
+            Self::UnknownResource(resource) => write!(f, "unknown policy resource: {}", resource),
+            Self::UnsupportedFeature(feature) => {
+                write!(
+                    f,
+                    "feature {} lacks support from a majority of orgs",
+                    feature
+                )
+            }
+            Self::Malformed(msg) => write!(f, "malformed config data: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for ChainConfigError {}
+
+/// Chain-wide parameters.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ChainConfig {
+    /// Maximum gas the transactions of a block may declare in total.
+    /// Proposers leave the transactions over it in the pool, and validators
+    /// refuse to pre-vote for proposals declaring more.
+    pub block_gas_limit: u64,
+    /// Maximum transaction input size in bytes
+    pub max_tx_data_size: u64,
+    /// Storage bytes each contract may use (None for unlimited)
+    pub storage_quota: Option<u64>,
+    /// Blocks after a rotation's activation during which both keys are
+    /// honored
+    #[serde(default = "default_key_rotation_window")]
+    pub key_rotation_window: u64,
+    /// Admin key of each org
+    #[serde(default)]
+    pub admins: BTreeMap<String, [u8; 20]>,
+    /// Staged admin key rotations by org
+    #[serde(default)]
+    pub rotations: BTreeMap<String, KeyRotation>,
+    /// Block proposal timing strategy, one of `PROPOSAL_TIMERS`
+    #[serde(default = "default_proposal_timer")]
+    pub proposal_timer: String,
+    /// Interval between proposals in milliseconds
+    #[serde(default = "default_proposal_interval_ms")]
+    pub proposal_interval_ms: u64,
+    /// Shortest interval of the adaptive timer in milliseconds
+    #[serde(default = "default_proposal_min_interval_ms")]
+    pub proposal_min_interval_ms: u64,
+    /// Pending transactions at which the adaptive timer reaches its
+    /// shortest interval
+    #[serde(default = "default_proposal_deep_pool")]
+    pub proposal_deep_pool: u64,
+    /// Longest time without a block when empty blocks are suppressed, in
+    /// milliseconds
+    #[serde(default = "default_proposal_max_idle_ms")]
+    pub proposal_max_idle_ms: u64,
+    /// Milliseconds without a block after which an empty block is
+    /// proposed; 0 disables the heartbeat
+    #[serde(default)]
+    pub empty_block_interval_ms: u64,
+    /// Seconds a proposed block's timestamp may be from a validator's clock
+    #[serde(default = "default_max_clock_drift_secs")]
+    pub max_clock_drift_secs: u64,
+    /// Whether the faucet system contract grants gas (test networks only)
+    #[serde(default)]
+    pub faucet_enabled: bool,
+    /// Gas the faucet grants per request, in wei
+    #[serde(default = "default_faucet_amount")]
+    pub faucet_amount: u64,
+    /// Seconds an address waits between faucet grants
+    #[serde(default = "default_faucet_window_secs")]
+    pub faucet_window_secs: u64,
+    /// Names of the key algorithms members may sign with
+    #[serde(default = "default_signature_algorithms")]
+    pub signature_algorithms: Vec<String>,
+    /// Block hash algorithm changes, ordered by activation height
+    #[serde(default)]
+    pub hash_migrations: Vec<HashMigration>,
+    /// Blocks between finality checkpoints; 0 disables checkpoints
+    #[serde(default)]
+    pub checkpoint_interval: u64,
+    /// Most transactions from one sender per block; 0 disables the cap
+    #[serde(default)]
+    pub max_txs_per_sender: u64,
+    /// Evidence records tolerated per validator before it is excluded
+    #[serde(default)]
+    pub max_evidence: u64,
+    /// Contracts whose storage is namespaced per org, sorted
+    #[serde(default)]
+    pub isolated_contracts: Vec<[u8; 20]>,
+    /// Issuers trusted by the revocation registry, sorted
+    #[serde(default)]
+    pub revocation_issuers: Vec<[u8; 20]>,
+    /// Accounts voting on multi-sign proposals, sorted
+    #[serde(default)]
+    pub multi_sign_signers: Vec<[u8; 20]>,
+    /// Member accounts of each org besides its admin key, sorted
+    #[serde(default)]
+    pub members: BTreeMap<String, Vec<[u8; 20]>>,
+    /// Network nodes of each org for static topology, sorted by node ID
+    #[serde(default)]
+    pub nodes: BTreeMap<String, Vec<OrgNode>>,
+    /// Protocol features each org's admin signaled support for, sorted
+    #[serde(default)]
+    pub feature_support: BTreeMap<String, Vec<String>>,
+    /// Protocol feature activations, ordered by activation height
+    #[serde(default)]
+    pub feature_activations: Vec<FeatureActivation>,
+}
+
+/// A block hash algorithm change scheduled in the config.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HashMigration {
+    /// Name of the algorithm blocks are hashed with from activation
+    pub algorithm: String,
+    /// First height hashed with the algorithm (the transition block)
+    pub activation_height: u64,
+}
+
+impl std::fmt::Display for HashMigration {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}@{}", self.algorithm, self.activation_height)
+    }
+}
+
+/// A network node an org runs, allowed to connect in static topology.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct OrgNode {
+    /// Network node ID
+    pub node_id: [u8; 32],
+    /// Address the node listens on
+    pub address: SocketAddr,
+}
+
+impl std::fmt::Display for OrgNode {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "0x{}@{}", hex::encode(self.node_id), self.address)
+    }
+}
+
+/// A protocol feature scheduled in the config.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct FeatureActivation {
+    /// Feature name
+    pub feature: String,
+    /// First height the feature is active
+    pub activation_height: u64,
+}
+
+impl std::fmt::Display for FeatureActivation {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}@{}", self.feature, self.activation_height)
+    }
+}
+
+/// Returns true if `name` is a valid protocol feature name: lowercase
+/// letters, digits and `-`, at most `MAX_FEATURE_NAME_LEN` bytes.
+pub fn is_feature_name(name: &str) -> bool {
+    !name.is_empty()
+        && name.len() <= MAX_FEATURE_NAME_LEN
+        && name
+            .bytes()
+            .all(|b| b.is_ascii_lowercase() || b.is_ascii_digit() || b == b'-')
+}
+
+fn default_key_rotation_window() -> u64 {
+    100
+}
+
+fn default_proposal_timer() -> String {
+    PROPOSAL_TIMERS[0].to_string()
+}
+
+fn default_proposal_interval_ms() -> u64 {
+    3000
+}
+
+fn default_proposal_min_interval_ms() -> u64 {
+    500
+}
+
+fn default_proposal_deep_pool() -> u64 {
+    1000
+}
+
+fn default_proposal_max_idle_ms() -> u64 {
+    30_000
+}
+
+fn default_max_clock_drift_secs() -> u64 {
+    15
+}
+
+fn default_faucet_amount() -> u64 {
+    1_000_000_000_000_000_000
+}
+
+fn default_faucet_window_secs() -> u64 {
+    86_400
+}
+
+fn default_signature_algorithms() -> Vec<String> {
+    vec![KeyAlgorithm::Secp256k1.to_string()]
+}
+
+impl Default for ChainConfig {
+    fn default() -> Self {
+        Self {
+            block_gas_limit: 30_000_000,
+            max_tx_data_size: 64 * 1024,
+            storage_quota: None,
+            key_rotation_window: default_key_rotation_window(),
+            admins: BTreeMap::new(),
+            rotations: BTreeMap::new(),
+            proposal_timer: default_proposal_timer(),
+            proposal_interval_ms: default_proposal_interval_ms(),
+            proposal_min_interval_ms: default_proposal_min_interval_ms(),
+            proposal_deep_pool: default_proposal_deep_pool(),
+            proposal_max_idle_ms: default_proposal_max_idle_ms(),
+            empty_block_interval_ms: 0,
+            max_clock_drift_secs: default_max_clock_drift_secs(),
+            faucet_enabled: false,
+            faucet_amount: default_faucet_amount(),
+            faucet_window_secs: default_faucet_window_secs(),
+            signature_algorithms: default_signature_algorithms(),
+            hash_migrations: Vec::new(),
+            checkpoint_interval: 0,
+            max_txs_per_sender: 0,
+            max_evidence: 0,
+            isolated_contracts: Vec::new(),
+            revocation_issuers: Vec::new(),
+            multi_sign_signers: Vec::new(),
+            members: BTreeMap::new(),
+            nodes: BTreeMap::new(),
+            feature_support: BTreeMap::new(),
+            feature_activations: Vec::new(),
+        }
+    }
+}
+
+/// An org admin key rotation staged in the config.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct KeyRotation {
+    /// Admin key being replaced
+    pub old_key: [u8; 20],
+    /// Admin key taking over
+    pub new_key: [u8; 20],
+    /// Height the rotation was staged at
+    pub staged_at: u64,
+    /// First height the new key is honored
+    pub activation_height: u64,
+    /// Endorsements needed before activation (a majority of orgs)
+    pub required_endorsements: u64,
+    /// Orgs whose admins endorsed the rotation
+    pub endorsements: BTreeSet<String>,
+}
+
+impl KeyRotation {
+    /// Returns the admin key being replaced.
+    pub fn old_key_addr(&self) -> Address {
+        Address::from(self.old_key)
+    }
+
+    /// Returns the admin key taking over.
+    pub fn new_key_addr(&self) -> Address {
+        Address::from(self.new_key)
+    }
+
+    /// Returns true once enough distinct orgs endorsed the rotation.
+    pub fn is_endorsed(&self) -> bool {
+        self.endorsements.len() as u64 >= self.required_endorsements
+    }
+}
+
+/// Parameters of a `SIMULATE_ENDORSEMENT` call.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SimulationRequest {
+    /// Policy resource, e.g. `config` or `rotation.<org>`
+    pub resource: String,
+    /// Keys whose endorsements are assumed
+    pub endorsers: Vec<[u8; 20]>,
+    /// Org owning the contract of an `acl.<contract>` or `pause.<contract>`
+    /// resource
+    #[serde(default)]
+    pub owner: Option<String>,
+}
+
+/// Outcome of evaluating a resource's endorsement policy.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct PolicyEvaluation {
+    /// Policy resource evaluated
+    pub resource: String,
+    /// The rule applied, e.g. `MAJORITY 2 of 3 org admins`
+    pub rule: String,
+    /// Whether the endorsements satisfy the rule
+    pub satisfied: bool,
+    /// Org endorsements the rule requires
+    pub required: u64,
+    /// Orgs whose admins endorsed, including endorsements already recorded
+    pub endorsed_orgs: Vec<String>,
+    /// Orgs that have not endorsed yet; empty once the rule is satisfied
+    pub missing_orgs: Vec<String>,
+    /// Endorsers holding no admin key at the evaluated height
+    pub ignored: Vec<String>,
+}
+
+/// Parameters of a `CONFIG_STAGE_ROTATION` call.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RotationRequest {
+    /// Org whose admin key is rotated
+    pub org: String,
+    /// Admin key taking over
+    pub new_key: [u8; 20],
+    /// First height the new key is honored
+    pub activation_height: u64,
+}
+
+impl ChainConfig {
+    /// Returns a parameter value as text.
+    pub fn get(&self, name: &str) -> Result<String, ChainConfigError> {
+        match name {
+            "block_gas_limit" => Ok(self.block_gas_limit.to_string()),
+            "max_tx_data_size" => Ok(self.max_tx_data_size.to_string()),
+            "storage_quota" => Ok(self
+                .storage_quota
+                .map_or_else(|| "none".to_string(), |quota| quota.to_string())),
+            "key_rotation_window" => Ok(self.key_rotation_window.to_string()),
+            "proposal_timer" => Ok(self.proposal_timer.clone()),
+            "proposal_interval_ms" => Ok(self.proposal_interval_ms.to_string()),
+            "proposal_min_interval_ms" => Ok(self.proposal_min_interval_ms.to_string()),
+            "proposal_deep_pool" => Ok(self.proposal_deep_pool.to_string()),
+            "proposal_max_idle_ms" => Ok(self.proposal_max_idle_ms.to_string()),
+            "empty_block_interval_ms" => Ok(self.empty_block_interval_ms.to_string()),
+            "max_clock_drift_secs" => Ok(self.max_clock_drift_secs.to_string()),
+            "faucet_enabled" => Ok(self.faucet_enabled.to_string()),
+            "faucet_amount" => Ok(self.faucet_amount.to_string()),
+            "faucet_window_secs" => Ok(self.faucet_window_secs.to_string()),
+            "signature_algorithms" => Ok(self.signature_algorithms.join(",")),
+            "hash_migrations" if self.hash_migrations.is_empty() => Ok("none".to_string()),
+            "hash_migrations" => Ok(self
+                .hash_migrations
+                .iter()
+                .map(|m| m.to_string())
+                .collect::<Vec<_>>()
+                .join(",")),
+            "checkpoint_interval" => Ok(self.checkpoint_interval.to_string()),
+            "max_txs_per_sender" => Ok(self.max_txs_per_sender.to_string()),
+            "max_evidence" => Ok(self.max_evidence.to_string()),
+            "isolated_contracts" => Ok(join_addrs(&self.isolated_contracts)),
+            "revocation_issuers" => Ok(join_addrs(&self.revocation_issuers)),
+            "multi_sign_signers" => Ok(join_addrs(&self.multi_sign_signers)),
+            "feature_activations" if self.feature_activations.is_empty() => Ok("none".to_string()),
+            "feature_activations" => Ok(self
+                .feature_activations
+                .iter()
+                .map(|a| a.to_string())
+                .collect::<Vec<_>>()
+                .join(",")),
+            _ if name.starts_with(MEMBERS_PARAM_PREFIX) => {
+                let org = &name[MEMBERS_PARAM_PREFIX.len()..];
+                Ok(join_addrs(self.members.get(org).map_or(&[], Vec::as_slice)))
+            }
+            _ if name.starts_with(NODES_PARAM_PREFIX) => {
+                let org = &name[NODES_PARAM_PREFIX.len()..];
+                Ok(match self.nodes.get(org) {
+                    Some(nodes) => {
+                        nodes.iter().map(|n| n.to_string()).collect::<Vec<_>>().join(",")
+                    }
+                    None => "none".to_string(),
+                })
+            }
+            _ => match name.strip_prefix(ADMIN_PARAM_PREFIX) {
+                Some(org) => Ok(self
+                    .admins
+                    .get(org)
+                    .map_or_else(|| "none".to_string(), |key| Address::from(*key).to_string())),
+                None => Err(ChainConfigError::UnknownParameter(name.to_string())),
+            },
+        }
+    }
+
+    /// Sets a parameter from text. `storage_quota` accepts "none",
+    /// `signature_algorithms` a comma-separated list of key algorithm names
+    /// or `<key>/<hash>` schemes and
+    /// `hash_migrations` "none" or a comma-separated list of
+    /// `<algorithm>@<height>` with increasing heights.
+    /// `feature_activations` takes "none" or a comma-separated list of
+    /// `<feature>@<height>`, each feature at most once.
+    /// `isolated_contracts`, `revocation_issuers`, `multi_sign_signers` and
+    /// `members.<org>` take "none" or a comma-separated list of addresses.
+    /// `nodes.<org>` takes "none" or a comma-separated list of
+    /// `<node id>@<ip:port>`, each node ID listed by one org only.
+    /// `admin.<org>` registers an org's first admin key or, with "none",
+    /// removes the org; replacing a key requires a rotation.
+    pub fn set(&mut self, name: &str, value: &str) -> Result<(), ChainConfigError> {
+        let invalid = || ChainConfigError::InvalidValue {
+            name: name.to_string(),
+            value: value.to_string(),
+        };
+        let number = || value.parse::<u64>().map_err(|_| invalid());
+        let positive = || number().and_then(|n| if n == 0 { Err(invalid()) } else { Ok(n) });
+        match name {
+            "block_gas_limit" => self.block_gas_limit = positive()?,
+            "max_tx_data_size" => self.max_tx_data_size = number()?,
+            "storage_quota" if value == "none" => self.storage_quota = None,
+            "storage_quota" => self.storage_quota = Some(number()?),
+            "key_rotation_window" => self.key_rotation_window = number()?,
+            "proposal_timer" if PROPOSAL_TIMERS.contains(&value) => {
+                self.proposal_timer = value.to_string()
+            }
+            "proposal_timer" => return Err(invalid()),
+            "proposal_interval_ms" => self.proposal_interval_ms = positive()?,
+            "proposal_min_interval_ms" => self.proposal_min_interval_ms = positive()?,
+            "proposal_deep_pool" => self.proposal_deep_pool = positive()?,
+            "proposal_max_idle_ms" => self.proposal_max_idle_ms = positive()?,
+            "empty_block_interval_ms" => self.empty_block_interval_ms = number()?,
+            "max_clock_drift_secs" => self.max_clock_drift_secs = positive()?,
+            "faucet_enabled" => self.faucet_enabled = value.parse().map_err(|_| invalid())?,
+            "faucet_amount" => self.faucet_amount = number()?,
+            "faucet_window_secs" => self.faucet_window_secs = positive()?,
+            "signature_algorithms" => {
+                let mut schemes: Vec<SignatureScheme> = Vec::new();
+                for name in value.split(',') {
+                    let scheme = SignatureScheme::from_name(name).ok_or_else(invalid)?;
+                    match schemes.iter().find(|listed| listed.key == scheme.key) {
+                        Some(listed) if *listed != scheme => return Err(invalid()),
+                        Some(_) => {}
+                        None => schemes.push(scheme),
+                    }
+                }
+                self.signature_algorithms = schemes.iter().map(|s| s.to_string()).collect();
+            }
+            "hash_migrations" if value == "none" => self.hash_migrations.clear(),
+            "hash_migrations" => {
+                let mut migrations = Vec::new();
+                let mut previous = (0, HashAlgorithm::default());
+                for entry in value.split(',') {
+                    let (algorithm, height) = entry.split_once('@').ok_or_else(invalid)?;
+                    let algorithm = HashAlgorithm::from_name(algorithm).ok_or_else(invalid)?;
+                    let height = height.trim().parse::<u64>().map_err(|_| invalid())?;
+                    if height <= previous.0 || algorithm == previous.1 {
+                        return Err(invalid());
+                    }
+                    previous = (height, algorithm);
+                    migrations.push(HashMigration {
+                        algorithm: algorithm.to_string(),
+                        activation_height: height,
+                    });
+                }
+                self.hash_migrations = migrations;
+            }
+            "checkpoint_interval" => self.checkpoint_interval = number()?,
+            "max_txs_per_sender" => self.max_txs_per_sender = number()?,
+            "max_evidence" => self.max_evidence = number()?,
+            "isolated_contracts" => {
+                self.isolated_contracts = parse_addrs(value).ok_or_else(invalid)?
+            }
+            "revocation_issuers" => {
+                self.revocation_issuers = parse_addrs(value).ok_or_else(invalid)?
+            }
+            "multi_sign_signers" => {
+                self.multi_sign_signers = parse_addrs(value).ok_or_else(invalid)?
+            }
+            "feature_activations" if value == "none" => self.feature_activations.clear(),
+            "feature_activations" => {
+                let mut activations: Vec<FeatureActivation> = Vec::new();
+                for entry in value.split(',') {
+                    let (feature, height) = entry.split_once('@').ok_or_else(invalid)?;
+                    let feature = feature.trim();
+                    let height = height.trim().parse::<u64>().map_err(|_| invalid())?;
+                    let duplicate = activations.iter().any(|a| a.feature == feature);
+                    if duplicate || !is_feature_name(feature) {
+                        return Err(invalid());
+                    }
+                    activations.push(FeatureActivation {
+                        feature: feature.to_string(),
+                        activation_height: height,
+                    });
+                }
+                activations.sort_by(|a, b| {
+                    (a.activation_height, &a.feature).cmp(&(b.activation_height, &b.feature))
+                });
+                self.feature_activations = activations;
+            }
+            _ if name.starts_with(MEMBERS_PARAM_PREFIX) => {
+                let org = &name[MEMBERS_PARAM_PREFIX.len()..];
+                let members = parse_addrs(value).filter(|_| !org.is_empty()).ok_or_else(invalid)?;
+                let taken = members.iter().any(|member| {
+                    self.org_of(&Address::from(*member)).is_some_and(|other| other != org)
+                });
+                if taken {
+                    return Err(invalid());
+                }
+                if members.is_empty() {
+                    self.members.remove(org);
+                } else {
+                    self.members.insert(org.to_string(), members);
+                }
+            }
+            _ if name.starts_with(NODES_PARAM_PREFIX) => {
+                let org = &name[NODES_PARAM_PREFIX.len()..];
+                let nodes = parse_nodes(value).filter(|_| !org.is_empty()).ok_or_else(invalid)?;
+                let taken = self.nodes.iter().any(|(other, listed)| {
+                    other != org
+                        && listed.iter().any(|n| nodes.iter().any(|m| m.node_id == n.node_id))
+                });
+                if taken {
+                    return Err(invalid());
+                }
+                if nodes.is_empty() {
+                    self.nodes.remove(org);
+                } else {
+                    self.nodes.insert(org.to_string(), nodes);
+                }
+            }
+            _ => {
+                let org = name
+                    .strip_prefix(ADMIN_PARAM_PREFIX)
+                    .filter(|org| !org.is_empty())
+                    .ok_or_else(|| ChainConfigError::UnknownParameter(name.to_string()))?;
+                if value == "none" {
+                    self.admins.remove(org);
+                    self.rotations.remove(org);
+                    self.feature_support.remove(org);
+                } else if self.admins.contains_key(org) {
+                    return Err(ChainConfigError::RotationRequired(org.to_string()));
+                } else {
+                    let key = Address::from_hex(value).map_err(|_| invalid())?;
+                    if self.admin_org_of(&key).is_some() {
+                        return Err(invalid());
+                    }
+                    self.admins.insert(org.to_string(), *key.as_bytes());
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns the key algorithms members may sign with, whatever the hash
+    /// algorithm. Unknown names in a stored config are skipped.
+    pub fn signature_algorithms(&self) -> Vec<KeyAlgorithm> {
+        let mut algorithms = Vec::new();
+        for scheme in self.signature_schemes() {
+            if !algorithms.contains(&scheme.key) {
+                algorithms.push(scheme.key);
+            }
+        }
+        algorithms
+    }
+
+    /// Returns the signature schemes transactions may be signed with, one
+    /// per key algorithm. Unknown names in a stored config are skipped.
+    pub fn signature_schemes(&self) -> Vec<SignatureScheme> {
+        self.signature_algorithms
+            .iter()
+            .filter_map(|name| SignatureScheme::from_name(name))
+            .collect()
+    }
+
+    /// Returns true if transactions may be signed with `scheme`.
+    pub fn allows_signature_scheme(&self, scheme: SignatureScheme) -> bool {
+        self.signature_schemes().contains(&scheme)
+    }
+
+    /// Returns true if members may sign with `algorithm`.
+    pub fn allows_signature_algorithm(&self, algorithm: KeyAlgorithm) -> bool {
+        self.signature_algorithms().contains(&algorithm)
+    }
+
+    /// Returns the block hash algorithm schedule. Unknown algorithm names
+    /// in a stored config are skipped.
+    pub fn hash_schedule(&self) -> HashSchedule {
+        self.hash_migrations
+            .iter()
+            .filter_map(|m| Some((m.activation_height, HashAlgorithm::from_name(&m.algorithm)?)))
+            .fold(HashSchedule::default(), |schedule, (height, algorithm)| {
+                schedule.with_migration(height, algorithm)
+            })
+    }
+
+    /// Returns the hash migrations activated at or before `height`.
+    fn activated_hash_migrations(&self, height: u64) -> &[HashMigration] {
+        let activated = self
+            .hash_migrations
+            .partition_point(|m| m.activation_height <= height);
+        &self.hash_migrations[..activated]
+    }
+
+    /// Returns true if `feature` is active at `height`.
+    pub fn is_feature_active(&self, feature: &str, height: u64) -> bool {
+        self.feature_activations
+            .iter()
+            .any(|a| a.feature == feature && a.activation_height <= height)
+    }
+
+    /// Returns the scheduled activations as gates for the EVM.
+    pub fn feature_gates(&self) -> FeatureGates {
+        FeatureGates::new(
+            self.feature_activations
+                .iter()
+                .map(|a| (a.feature.clone(), a.activation_height)),
+        )
+    }
+
+    /// Returns the feature activations at or before `height`.
+    fn activated_features(&self, height: u64) -> Vec<FeatureActivation> {
+        self.feature_activations
+            .iter()
+            .filter(|a| a.activation_height <= height)
+            .cloned()
+            .collect()
+    }
+
+    /// Returns the orgs whose admin signaled support for `feature`.
+    pub fn feature_supporters(&self, feature: &str) -> Vec<&str> {
+        self.feature_support
+            .iter()
+            .filter(|(org, features)| {
+                self.admins.contains_key(*org) && features.iter().any(|f| f == feature)
+            })
+            .map(|(org, _)| org.as_str())
+            .collect()
+    }
+
+    /// Returns true if a majority of orgs signaled support for `feature`,
+    /// or no admin keys are registered.
+    pub fn has_feature_quorum(&self, feature: &str) -> bool {
+        let admins = self.admins.len();
+        admins == 0 || self.feature_supporters(feature).len() > admins / 2
+    }
+
+    /// Returns the org `account` belongs to, as admin key or member.
+    pub fn org_of(&self, account: &Address) -> Option<&str> {
+        self.admin_org_of(account).or_else(|| {
+            self.members
+                .iter()
+                .find(|(_, members)| members.contains(account.as_bytes()))
+                .map(|(org, _)| org.as_str())
+        })
+    }
+
+    /// Returns the issuers trusted by the revocation registry.
+    pub fn revocation_issuers(&self) -> Vec<Address> {
+        self.revocation_issuers.iter().map(|a| Address::from(*a)).collect()
+    }
+
+    /// Returns the accounts voting on multi-sign proposals.
+    pub fn multi_sign_signers(&self) -> Vec<Address> {
+        self.multi_sign_signers.iter().map(|a| Address::from(*a)).collect()
+    }
+
+    /// Returns every org's network nodes as (org, node), or nothing if the
+    /// network discovers peers dynamically.
+    pub fn org_nodes(&self) -> Vec<(&str, &OrgNode)> {
+        self.nodes
+            .iter()
+            .flat_map(|(org, nodes)| nodes.iter().map(move |node| (org.as_str(), node)))
+            .collect()
+    }
+
+    /// Returns the per-org storage isolation settings for the EVM, or None
+    /// if no contract is isolated.
+    pub fn org_isolation(&self) -> Option<OrgIsolation> {
+        if self.isolated_contracts.is_empty() {
+            return None;
+        }
+        let OrgMembers { members, admins } = self.org_members();
+        Some(OrgIsolation {
+            contracts: self.isolated_contracts.iter().map(|c| Address::from(*c)).collect(),
+            members,
+            admins,
+        })
+    }
+
+    /// Returns the org of every member account and admin key, for method
+    /// permission checks in the EVM.
+    pub fn org_members(&self) -> OrgMembers {
+        OrgMembers {
+            members: self
+                .members
+                .iter()
+                .flat_map(|(org, keys)| keys.iter().map(|key| (Address::from(*key), org.clone())))
+                .collect(),
+            admins: self
+                .admins
+                .iter()
+                .map(|(org, key)| (Address::from(*key), org.clone()))
+                .collect(),
+        }
+    }
+
+    fn admin_org_of(&self, key: &Address) -> Option<&str> {
+        let key = key.as_bytes();
+        self.admins
+            .iter()
+            .find(|(org, admin)| {
+                *admin == key || self.rotations.get(*org).is_some_and(|r| r.new_key == *key)
+            })
+            .map(|(org, _)| org.as_str())
+    }
+
+    /// Returns the admin keys of `org` honored at `height`: the registered
+    /// key until an endorsed rotation activates, both keys during the
+    /// transition window, then the new key.
+    pub fn admin_keys(&self, org: &str, height: u64) -> Vec<Address> {
+        let Some(admin) = self.admins.get(org) else {
+            return Vec::new();
+        };
+        let rotation = self
+            .rotations
+            .get(org)
+            .filter(|r| r.is_endorsed() && height >= r.activation_height);
+        match rotation {
+            None => vec![Address::from(*admin)],
+            Some(r) if height < r.activation_height.saturating_add(self.key_rotation_window) => {
+                vec![r.old_key_addr(), r.new_key_addr()]
+            }
+            Some(r) => vec![r.new_key_addr()],
+        }
+    }
+
+    /// Returns the org `key` is an admin of at `height`.
+    pub fn admin_org(&self, key: &Address, height: u64) -> Option<&str> {
+        self.admins
+            .keys()
+            .find(|org| self.admin_keys(org, height).contains(key))
+            .map(String::as_str)
+    }
+
+    /// Folds rotations whose transition window ended at `height` into the
+    /// admin keys and drops rotations that were not endorsed in time.
+    fn settle_rotations(&mut self, height: u64) {
+        let window = self.key_rotation_window;
+        let mut rotated = Vec::new();
+        self.rotations.retain(|org, r| {
+            if !r.is_endorsed() {
+                return height < r.activation_height;
+            }
+            if height >= r.activation_height.saturating_add(window) {
+                rotated.push((org.clone(), r.new_key));
+                return false;
+            }
+            true
+        });
+        self.admins.extend(rotated);
+    }
+
+    /// Evaluates the endorsement policy guarding `resource` at `height`,
+    /// as if `endorsers` had endorsed. `owner` is the org owning the
+    /// contract of an `acl.<contract>` or `pause.<contract>` resource and
+    /// is ignored otherwise.
+    pub fn evaluate_policy(
+        &self,
+        resource: &str,
+        owner: Option<&str>,
+        endorsers: &[Address],
+        height: u64,
+    ) -> Result<PolicyEvaluation, ChainConfigError> {
+        let mut config = self.clone();
+        config.settle_rotations(height);
+
+        let mut endorsed = BTreeSet::new();
+        let mut ignored = Vec::new();
+        for endorser in endorsers {
+            match config.admin_org(endorser, height) {
+                Some(org) => {
+                    endorsed.insert(org.to_string());
+                }
+                None => ignored.push(endorser.to_string()),
+            }
+        }
+
+        let admins = config.admins.len() as u64;
+        let contract_of = |prefix: &str| {
+            resource
+                .strip_prefix(prefix)
+                .is_some_and(|contract| Address::from_hex(contract).is_ok())
+        };
+        let (rule, required, required_org) = if resource == CONFIG_RESOURCE {
+            if admins == 0 {
+                ("OPEN (no admin keys registered)".to_string(), 0, None)
+            } else {
+                (format!("ANY 1 of {} org admins", admins), 1, None)
+            }
+        } else if contract_of(ACL_RESOURCE_PREFIX) || contract_of(PAUSE_RESOURCE_PREFIX) {
+            let owner = owner.ok_or_else(|| {
+                ChainConfigError::UnknownResource(format!("{} (owning org unknown)", resource))
+            })?;
+            if !config.admins.contains_key(owner) {
+                return Err(ChainConfigError::UnknownOrg(owner.to_string()));
+            }
+            (format!("ADMIN of {} (owning org)", owner), 1, Some(owner))
+        } else if let Some(org) = resource.strip_prefix(ROTATION_RESOURCE_PREFIX) {
+            if !config.admins.contains_key(org) {
+                return Err(ChainConfigError::UnknownOrg(org.to_string()));
+            }
+            let required = admins / 2 + 1;
+            match config.rotations.get(org) {
+                Some(rotation) => {
+                    endorsed.extend(rotation.endorsements.iter().cloned());
+                    let rule = format!(
+                        "MAJORITY {} of {} org admins before height {}",
+                        rotation.required_endorsements, admins, rotation.activation_height
+                    );
+                    (rule, rotation.required_endorsements, None)
+                }
+                None => {
+                    let rule = format!(
+                        "MAJORITY {} of {} org admins, including {} (stager)",
+                        required, admins, org
+                    );
+                    (rule, required, Some(org))
+                }
+            }
+        } else {
+            return Err(ChainConfigError::UnknownResource(resource.to_string()));
+        };
+
+        let satisfied = endorsed.len() as u64 >= required
+            && required_org.map_or(true, |org| endorsed.contains(org));
+        let missing_orgs = if satisfied {
+            Vec::new()
+        } else {
+            config
+                .admins
+                .keys()
+                .filter(|org| !endorsed.contains(*org))
+                .cloned()
+                .collect()
+        };
+        Ok(PolicyEvaluation {
+            resource: resource.to_string(),
+            rule,
+            satisfied,
+            required,
+            endorsed_orgs: endorsed.into_iter().collect(),
+            missing_orgs,
+            ignored,
+        })
+    }
+
+    /// Checks that every staged rotation replaces its org's registered key
+    /// with a key no other org uses.
+    pub fn validate(&self) -> Result<(), ChainConfigError> {
+        let admins = self.admins.len() as u64;
+        for (org, rotation) in &self.rotations {
+            let invalid =
+                |msg: &str| ChainConfigError::InvalidRotation(format!("{}: {}", org, msg));
+            if self.admins.get(org) != Some(&rotation.old_key) {
+                return Err(invalid("old key is not the registered admin key"));
+            }
+            let reused = self.admins.values().any(|key| *key == rotation.new_key)
+                || self
+                    .rotations
+                    .iter()
+                    .any(|(other, r)| other != org && r.new_key == rotation.new_key);
+            if reused {
+                return Err(invalid("new key is already an admin key"));
+            }
+            if rotation.required_endorsements == 0 || rotation.required_endorsements > admins {
+                return Err(invalid("endorsement threshold out of range"));
+            }
+        }
+
+        // Proposal timer bounds must be ordered
+        let unordered = |name: &str, value: u64| ChainConfigError::InvalidValue {
+            name: name.to_string(),
+            value: value.to_string(),
+        };
+        if self.proposal_min_interval_ms > self.proposal_interval_ms {
+            return Err(unordered(
+                "proposal_min_interval_ms",
+                self.proposal_min_interval_ms,
+            ));
+        }
+        if self.proposal_max_idle_ms < self.proposal_interval_ms {
+            return Err(unordered("proposal_max_idle_ms", self.proposal_max_idle_ms));
+        }
+        Ok(())
+    }
+
+    /// Returns every parameter as (name, value) in display order.
+    pub fn params(&self) -> Vec<(&'static str, String)> {
+        CONFIG_PARAMS
+            .iter()
+            .map(|name| (*name, self.get(name).expect("listed parameter")))
+            .collect()
+    }
+}
+
+/// A parameter that differs between two configs.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ConfigChange {
+    /// Parameter name
+    pub name: &'static str,
+    /// Value in the older config
+    pub from: String,
+    /// Value in the newer config
+    pub to: String,
+}
+
+/// Parses "none" or a comma-separated list of addresses, sorted and
+/// without duplicates.
+fn parse_addrs(value: &str) -> Option<Vec<[u8; 20]>> {
+    if value == "none" {
+        return Some(Vec::new());
+    }
+    let addrs: BTreeSet<[u8; 20]> = value
+        .split(',')
+        .map(|a| Address::from_hex(a.trim()).ok().map(|a| *a.as_bytes()))
+        .collect::<Option<_>>()?;
+    Some(addrs.into_iter().collect())
+}
+
+/// Parses "none" or a comma-separated list of `<node id>@<ip:port>`,
+/// sorted by node ID. A node ID listed twice keeps its last address.
+fn parse_nodes(value: &str) -> Option<Vec<OrgNode>> {
+    if value == "none" {
+        return Some(Vec::new());
+    }
+    let mut nodes = BTreeMap::new();
+    for entry in value.split(',') {
+        let (node_id, address) = entry.trim().split_once('@')?;
+        let node_id = hex::decode(node_id.trim_start_matches("0x")).ok()?.try_into().ok()?;
+        nodes.insert(node_id, address.parse().ok()?);
+    }
+    Some(
+        nodes
+            .into_iter()
+            .map(|(node_id, address)| OrgNode { node_id, address })
+            .collect(),
+    )
+}
+
+/// Formats an address list as `parse_addrs` reads it.
+fn join_addrs(addrs: &[[u8; 20]]) -> String {
+    if addrs.is_empty() {
+        return "none".to_string();
+    }
+    addrs
+        .iter()
+        .map(|a| Address::from(*a).to_string())
+        .collect::<Vec<_>>()
+        .join(",")
+}
+
+/// Returns the parameters that differ from `from` to `to`.
+pub fn diff(from: &ChainConfig, to: &ChainConfig) -> Vec<ConfigChange> {
+    from.params()
+        .into_iter()
+        .zip(to.params())
+        .filter(|((_, a), (_, b))| a != b)
+        .map(|((name, from), (_, to))| ConfigChange { name, from, to })
+        .collect()
+}
+
+/// A config version and the height it took effect.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ChainConfigVersion {
+    /// Sequential version number (0 is the genesis config)
+    pub version: u64,
+    /// Height the version took effect
+    pub height: u64,
+    /// Sender of the update (zero for genesis)
+    pub updated_by: [u8; 20],
+    /// Parameters in force
+    pub config: ChainConfig,
+}
+
+impl ChainConfigVersion {
+    /// Returns the sender of the update.
+    pub fn updated_by_addr(&self) -> Address {
+        Address::from(self.updated_by)
+    }
+
+    /// Encodes the version for storage or as a call result.
+    pub fn encode(&self) -> Vec<u8> {
+        serde_json::to_vec(self).expect("config version serializes")
+    }
+
+    /// Decodes a version produced by `encode`.
+    pub fn decode(data: &[u8]) -> Result<Self, ChainConfigError> {
+        serde_json::from_slice(data).map_err(|e| ChainConfigError::Malformed(e.to_string()))
+    }
+}
+
+/// Encodes update calldata setting each (name, value).
+pub fn encode_update(changes: &[(String, String)]) -> Vec<u8> {
+    let mut data = vec![CONFIG_UPDATE];
+    data.extend(serde_json::to_vec(changes).expect("changes serialize"));
+    data
+}
+
+/// Encodes `GET_CHAIN_CONFIG_AT` calldata.
+pub fn encode_get_config_at(height: u64) -> Vec<u8> {
+    let mut data = vec![GET_CHAIN_CONFIG_AT];
+    data.extend_from_slice(&height.to_be_bytes());
+    data
+}
+
+/// Encodes `CONFIG_STAGE_ROTATION` calldata.
+pub fn encode_stage_rotation(org: &str, new_key: &Address, activation_height: u64) -> Vec<u8> {
+    let request = RotationRequest {
+        org: org.to_string(),
+        new_key: *new_key.as_bytes(),
+        activation_height,
+    };
+    let mut data = vec![CONFIG_STAGE_ROTATION];
+    data.extend(serde_json::to_vec(&request).expect("rotation request serializes"));
+    data
+}
+
+/// Encodes `SIMULATE_ENDORSEMENT` calldata.
+pub fn encode_simulate_endorsement(
+    resource: &str,
+    owner: Option<&str>,
+    endorsers: &[Address],
+) -> Vec<u8> {
+    let request = SimulationRequest {
+        resource: resource.to_string(),
+        endorsers: endorsers.iter().map(|e| *e.as_bytes()).collect(),
+        owner: owner.map(str::to_string),
+    };
+    let mut data = vec![SIMULATE_ENDORSEMENT];
+    data.extend(serde_json::to_vec(&request).expect("simulation request serializes"));
+    data
+}
+
+/// Encodes `CONFIG_SIGNAL_FEATURES` calldata.
+pub fn encode_signal_features(features: &[&str]) -> Vec<u8> {
+    let mut data = vec![CONFIG_SIGNAL_FEATURES];
+    data.extend(serde_json::to_vec(features).expect("features serialize"));
+    data
+}
+
+/// Encodes `LIST_CHAIN_CONFIG_VERSIONS` calldata.
+pub fn encode_list_versions(request: &PageRequest) -> Vec<u8> {
+    let mut data = vec![LIST_CHAIN_CONFIG_VERSIONS];
+    data.extend(request.encode());
+    data
+}
+
+/// Encodes `CONFIG_ENDORSE_ROTATION` calldata.
+pub fn encode_endorse_rotation(org: &str) -> Vec<u8> {
+    let mut data = vec![CONFIG_ENDORSE_ROTATION];
+    data.extend_from_slice(org.as_bytes());
+    data
+}
+
+/// Prepares update calldata restoring `param` in `current` to its value in
+/// `target`. Returns None if the value is already the same.
+pub fn revert_update(
+    current: &ChainConfig,
+    target: &ChainConfig,
+    param: &str,
+) -> Result<Option<Vec<u8>>, ChainConfigError> {
+    let value = target.get(param)?;
+    if current.get(param)? == value {
+        return Ok(None);
+    }
+    Ok(Some(encode_update(&[(param.to_string(), value)])))
+}
+
+/// Native chain config contract state: every version by effective height.
+#[derive(Debug, Clone)]
+pub struct ChainConfigContract {
+    versions: OrderedKv<u64, ChainConfigVersion>,
+}
+
+impl ChainConfigContract {
+    /// Creates the contract with `genesis` as version 0 at height 0.
+    pub fn new(genesis: ChainConfig) -> Self {
+        let version = ChainConfigVersion {
+            version: 0,
+            height: 0,
+            updated_by: [0u8; 20],
+            config: genesis,
+        };
+        Self {
+            versions: [(0, version)].into_iter().collect(),
+        }
+    }
+
+    /// Rebuilds the contract from stored versions. Returns None if there is
+    /// no version at height 0.
+    pub fn from_versions(versions: impl IntoIterator<Item = ChainConfigVersion>) -> Option<Self> {
+        let versions: OrderedKv<u64, ChainConfigVersion> =
+            versions.into_iter().map(|v| (v.height, v)).collect();
+        versions.contains_key(&0).then_some(Self { versions })
+    }
+
+    /// Returns the latest version.
+    pub fn current(&self) -> &ChainConfigVersion {
+        self.versions.last().map(|(_, version)| version).expect("genesis version")
+    }
+
+    /// Returns the version in force at `height`.
+    pub fn config_at(&self, height: u64) -> &ChainConfigVersion {
+        self.versions
+            .range(..=height)
+            .next_back()
+            .map(|(_, version)| version)
+            .expect("genesis version")
+    }
+
+    /// Returns a version by number.
+    pub fn version(&self, version: u64) -> Result<&ChainConfigVersion, ChainConfigError> {
+        self.versions
+            .values()
+            .find(|v| v.version == version)
+            .ok_or(ChainConfigError::UnknownVersion(version))
+    }
+
+    /// Returns all versions, oldest first.
+    pub fn versions(&self) -> impl Iterator<Item = &ChainConfigVersion> {
+        self.versions.values()
+    }
+
+    /// Returns the admin keys of `org` honored at `height`.
+    pub fn admin_keys_at(&self, org: &str, height: u64) -> Vec<Address> {
+        self.config_at(height).config.admin_keys(org, height)
+    }
+
+    /// Returns the org `key` is an admin of at `height`.
+    pub fn admin_org_at(&self, key: &Address, height: u64) -> Option<&str> {
+        self.config_at(height).config.admin_org(key, height)
+    }
+
+    /// Evaluates the endorsement policy guarding `resource` for a call at
+    /// `height`, without changing the contract.
+    pub fn simulate_endorsement(
+        &self,
+        resource: &str,
+        owner: Option<&str>,
+        endorsers: &[Address],
+        height: u64,
+    ) -> Result<PolicyEvaluation, ChainConfigError> {
+        self.config_at(height)
+            .config
+            .evaluate_policy(resource, owner, endorsers, height)
+    }
+
+    /// Applies `changes` on top of the latest version as a new version
+    /// taking effect at `height`. A second update at the same height
+    /// replaces the version created by the first. Hash migrations and
+    /// feature activations at or before `height` can't be changed, and a
+    /// feature can only be scheduled with support from a majority of orgs.
+    /// Once any admin key is registered, `admin.<org>` parameters can't be
+    /// updated: keys change only through rotations.
+    pub fn update(
+        &mut self,
+        changes: &[(String, String)],
+        sender: Address,
+        height: u64,
+    ) -> Result<&ChainConfigVersion, ChainConfigError> {
+        self.apply(sender, height, |config| {
+            let activated = config.activated_hash_migrations(height).to_vec();
+            let activated_features = config.activated_features(height);
+            let scheduled = config.feature_activations.clone();
+            let governed = !config.admins.is_empty();
+            for (name, value) in changes {
+                if let Some(org) = name.strip_prefix(ADMIN_PARAM_PREFIX) {
+                    if governed {
+                        return Err(ChainConfigError::RotationRequired(org.to_string()));
+                    }
+                }
+                config.set(name, value)?;
+            }
+            if config.activated_hash_migrations(height) != activated.as_slice() {
+                return Err(ChainConfigError::InvalidValue {
+                    name: "hash_migrations".to_string(),
+                    value: config.get("hash_migrations")?,
+                });
+            }
+            if config.activated_features(height) != activated_features {
+                return Err(ChainConfigError::InvalidValue {
+                    name: "feature_activations".to_string(),
+                    value: config.get("feature_activations")?,
+                });
+            }
+            let unsupported = config
+                .feature_activations
+                .iter()
+                .find(|a| !scheduled.contains(a) && !config.has_feature_quorum(&a.feature));
+            if let Some(activation) = unsupported {
+                return Err(ChainConfigError::UnsupportedFeature(
+                    activation.feature.clone(),
+                ));
+            }
+            Ok(())
+        })
+    }
+
+    /// Records the protocol features the nodes of `sender`'s org support,
+    /// replacing the org's previous signal. Only admin keys can signal.
+    pub fn signal_features(
+        &mut self,
+        features: &[String],
+        sender: Address,
+        height: u64,
+    ) -> Result<&ChainConfigVersion, ChainConfigError> {
+        self.apply(sender, height, |config| {
+            let org = config
+                .admin_org(&sender, height)
+                .ok_or(ChainConfigError::NotAdmin(sender))?
+                .to_string();
+            if let Some(name) = features.iter().find(|f| !is_feature_name(f)) {
+                return Err(ChainConfigError::InvalidValue {
+                    name: "features".to_string(),
+                    value: name.clone(),
+                });
+            }
+            let features: BTreeSet<String> = features.iter().cloned().collect();
+            if features.is_empty() {
+                config.feature_support.remove(&org);
+            } else {
+                config
+                    .feature_support
+                    .insert(org, features.into_iter().collect());
+            }
+            Ok(())
+        })
+    }
+
+    /// Returns true if `feature` is active at `height`.
+    pub fn is_feature_active(&self, feature: &str, height: u64) -> bool {
+        self.config_at(height)
+            .config
+            .is_feature_active(feature, height)
+    }
+
+    /// Stages a rotation of `org`'s admin key to `new_key`, activating at
+    /// `activation_height`. Only the org's admin can stage it; the staging
+    /// counts as its endorsement.
+    pub fn stage_rotation(
+        &mut self,
+        org: &str,
+        new_key: Address,
+        activation_height: u64,
+        sender: Address,
+        height: u64,
+    ) -> Result<&ChainConfigVersion, ChainConfigError> {
+        self.apply(sender, height, |config| {
+            let old_key = *config
+                .admins
+                .get(org)
+                .ok_or_else(|| ChainConfigError::UnknownOrg(org.to_string()))?;
+            if !config.admin_keys(org, height).contains(&sender) {
+                return Err(ChainConfigError::NotAdmin(sender));
+            }
+            let invalid = |msg: &str| ChainConfigError::InvalidRotation(msg.to_string());
+            if config.rotations.contains_key(org) {
+                return Err(invalid("a rotation is already staged"));
+            }
+            if activation_height <= height {
+                return Err(invalid("activation height must be in the future"));
+            }
+            if new_key.is_zero() || config.admin_org_of(&new_key).is_some() {
+                return Err(invalid("new key is already an admin key"));
+            }
+            let rotation = KeyRotation {
+                old_key,
+                new_key: *new_key.as_bytes(),
+                staged_at: height,
+                activation_height,
+                required_endorsements: config.admins.len() as u64 / 2 + 1,
+                endorsements: BTreeSet::from([org.to_string()]),
+            };
+            config.rotations.insert(org.to_string(), rotation);
+            Ok(())
+        })
+    }
+
+    /// Records the endorsement of `org`'s staged rotation by `sender`'s
+    /// org. Each org endorses once, whichever of its admin keys signs;
+    /// endorsements are accepted until the activation height.
+    pub fn endorse_rotation(
+        &mut self,
+        org: &str,
+        sender: Address,
+        height: u64,
+    ) -> Result<&ChainConfigVersion, ChainConfigError> {
+        self.apply(sender, height, |config| {
+            let invalid = |msg: &str| ChainConfigError::InvalidRotation(msg.to_string());
+            let endorser = config
+                .admin_org(&sender, height)
+                .ok_or(ChainConfigError::NotAdmin(sender))?
+                .to_string();
+            let rotation = config
+                .rotations
+                .get_mut(org)
+                .ok_or_else(|| invalid("no rotation staged"))?;
+            if height >= rotation.activation_height {
+                return Err(invalid("activation height has passed"));
+            }
+            if !rotation.endorsements.insert(endorser) {
+                return Err(invalid("org already endorsed"));
+            }
+            Ok(())
+        })
+    }
+
+    /// Creates a new version at `height` by applying `change` to the latest
+    /// config, after checking `sender` holds an admin key if any exist.
+    fn apply(
+        &mut self,
+        sender: Address,
+        height: u64,
+        change: impl FnOnce(&mut ChainConfig) -> Result<(), ChainConfigError>,
+    ) -> Result<&ChainConfigVersion, ChainConfigError> {
+        let latest = self.current();
+        if height < latest.height || height == 0 {
+            return Err(ChainConfigError::InvalidHeight {
+                latest: latest.height,
+                height,
+            });
+        }
+        let mut config = latest.config.clone();
+        if !config.admins.is_empty() && config.admin_org(&sender, height).is_none() {
+            return Err(ChainConfigError::NotAdmin(sender));
+        }
+        config.settle_rotations(height);
+        change(&mut config)?;
+        config.validate()?;
+        let version = ChainConfigVersion {
+            version: latest.version + 1,
+            height,
+            updated_by: *sender.as_bytes(),
+            config,
+        };
+        self.versions.insert(height, version);
+        Ok(self.current())
+    }
+
+    /// Executes a call to the contract and returns the encoded version it
+    /// produced (for updates) or looked up.
+    pub fn execute(
+        &mut self,
+        data: &[u8],
+        sender: Address,
+        height: u64,
+    ) -> Result<Vec<u8>, ChainConfigError> {
+        let (&call, payload) = data
+            .split_first()
+            .ok_or_else(|| ChainConfigError::Malformed("empty calldata".to_string()))?;
+        match call {
+            CONFIG_UPDATE => {
+                let changes: Vec<(String, String)> = serde_json::from_slice(payload)
+                    .map_err(|e| ChainConfigError::Malformed(e.to_string()))?;
+                self.update(&changes, sender, height)
+                    .map(ChainConfigVersion::encode)
+            }
+            GET_CHAIN_CONFIG_AT => {
+                let at: [u8; 8] = payload
+                    .try_into()
+                    .map_err(|_| ChainConfigError::Malformed("invalid height".to_string()))?;
+                Ok(self.config_at(u64::from_be_bytes(at)).encode())
+            }
+            CONFIG_STAGE_ROTATION => {
+                let request: RotationRequest = serde_json::from_slice(payload)
+                    .map_err(|e| ChainConfigError::Malformed(e.to_string()))?;
+                let new_key = Address::from(request.new_key);
+                self.stage_rotation(
+                    &request.org,
+                    new_key,
+                    request.activation_height,
+                    sender,
+                    height,
+                )
+                .map(ChainConfigVersion::encode)
+            }
+            CONFIG_ENDORSE_ROTATION => {
+                let org = std::str::from_utf8(payload)
+                    .map_err(|_| ChainConfigError::Malformed("org is not utf-8".to_string()))?;
+                self.endorse_rotation(org, sender, height)
+                    .map(ChainConfigVersion::encode)
+            }
+            SIMULATE_ENDORSEMENT => {
+                let request: SimulationRequest = serde_json::from_slice(payload)
+                    .map_err(|e| ChainConfigError::Malformed(e.to_string()))?;
+                let endorsers: Vec<Address> = request
+                    .endorsers
+                    .iter()
+                    .map(|e| Address::from(*e))
+                    .collect();
+                let evaluation =
+                    self.simulate_endorsement(
+                        &request.resource,
+                        request.owner.as_deref(),
+                        &endorsers,
+                        height,
+                    )?;
+                Ok(serde_json::to_vec(&evaluation).expect("evaluation serializes"))
+            }
+            CONFIG_SIGNAL_FEATURES => {
+                let features: Vec<String> = serde_json::from_slice(payload)
+                    .map_err(|e| ChainConfigError::Malformed(e.to_string()))?;
+                self.signal_features(&features, sender, height)
+                    .map(ChainConfigVersion::encode)
+            }
+            LIST_CHAIN_CONFIG_VERSIONS => {
+                let versions = self
+                    .versions
+                    .iter()
+                    .map(|(height, version)| (height.to_be_bytes(), version));
+                PageRequest::decode(payload)
+                    .and_then(|request| request.paginate(versions))
+                    .map(|page| page.encode())
+                    .map_err(ChainConfigError::Malformed)
+            }
+            _ => Err(ChainConfigError::Malformed(format!(
+                "unknown call 0x{:02x}",
+                call
+            ))),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::page::Page;
+
+    fn change(name: &str, value: &str) -> (String, String) {
+        (name.to_string(), value.to_string())
+    }
+
+    #[test]
+    fn test_versions_by_height() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        contract
+            .update(&[change("block_gas_limit", "40000000")], admin, 10)
+            .unwrap();
+        contract
+            .update(&[change("storage_quota", "4096")], admin, 20)
+            .unwrap();
+
+        assert_eq!(contract.config_at(9).version, 0);
+        assert_eq!(contract.config_at(10).config.block_gas_limit, 40_000_000);
+        assert_eq!(contract.config_at(15).version, 1);
+        assert_eq!(contract.config_at(500).config.storage_quota, Some(4096));
+        assert_eq!(contract.current().updated_by_addr(), admin);
+
+        assert_eq!(
+            contract.update(&[change("block_gas_limit", "1")], admin, 19),
+            Err(ChainConfigError::InvalidHeight {
+                latest: 20,
+                height: 19
+            })
+        );
+        assert_eq!(
+            contract.update(&[change("gas_price", "1")], admin, 30),
+            Err(ChainConfigError::UnknownParameter("gas_price".to_string()))
+        );
+        // A zero ceiling would leave room for no transaction
+        assert!(contract
+            .update(&[change("block_gas_limit", "0")], admin, 30)
+            .is_err());
+        assert_eq!(contract.current().version, 2);
+    }
+
+    #[test]
+    fn test_list_versions() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        for (height, limit) in [(10, "40000000"), (300, "50000000")] {
+            contract
+                .update(&[change("block_gas_limit", limit)], admin, height)
+                .unwrap();
+        }
+
+        let mut list = |request: &PageRequest| {
+            let page = contract
+                .execute(&encode_list_versions(request), admin, 400)
+                .unwrap();
+            Page::<ChainConfigVersion>::decode(&page).unwrap()
+        };
+        let request = PageRequest::first(2);
+        let page = list(&request);
+        let heights: Vec<u64> = page.items.iter().map(|v| v.height).collect();
+        assert_eq!(heights, vec![0, 10]);
+        let page = list(&request.after(&page).unwrap());
+        assert_eq!(page.items.len(), 1);
+        assert_eq!(page.items[0].height, 300);
+        assert_eq!(page.items[0].config.block_gas_limit, 50_000_000);
+        assert_eq!(page.next_page_token, None);
+    }
+
+    #[test]
+    fn test_execute_calls() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        let update = encode_update(&[change("max_tx_data_size", "1024")]);
+        contract.execute(&update, admin, 5).unwrap();
+
+        let at = |contract: &mut ChainConfigContract, height| {
+            let result = contract
+                .execute(&encode_get_config_at(height), admin, 6)
+                .unwrap();
+            ChainConfigVersion::decode(&result).unwrap()
+        };
+        assert_eq!(at(&mut contract, 4).config.max_tx_data_size, 64 * 1024);
+        assert_eq!(at(&mut contract, 5).config.max_tx_data_size, 1024);
+        assert!(contract.execute(&[0x09], admin, 6).is_err());
+    }
+
+    #[test]
+    fn test_execute_fixture_config_txs() {
+        use bach_testutil::TestBlockBuilder;
+
+        let fixture = TestBlockBuilder::new(3)
+            .with_txs(2)
+            .with_config_tx(encode_update(&[change("max_tx_data_size", "1024")]))
+            .with_config_tx(encode_update(&[change("proposal_deep_pool", "50")]))
+            .build();
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        for tx in &fixture.block.transactions {
+            if tx.to == Some(chain_config_address()) {
+                let sender = tx.sender().unwrap();
+                contract.execute(&tx.data, sender, fixture.height()).unwrap();
+            }
+        }
+
+        let current = contract.current();
+        assert_eq!(current.version, 2);
+        assert_eq!(current.config.max_tx_data_size, 1024);
+        assert_eq!(current.config.proposal_deep_pool, 50);
+    }
+
+    #[test]
+    fn test_proposal_timer_params() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        contract
+            .update(
+                &[
+                    change("proposal_timer", "suppress-empty"),
+                    change("proposal_max_idle_ms", "60000"),
+                    change("empty_block_interval_ms", "15000"),
+                ],
+                admin,
+                1,
+            )
+            .unwrap();
+        let config = &contract.current().config;
+        assert_eq!(config.get("proposal_timer").unwrap(), "suppress-empty");
+        assert_eq!(config.proposal_max_idle_ms, 60_000);
+        assert_eq!(config.get("empty_block_interval_ms").unwrap(), "15000");
+        assert_eq!(config.max_clock_drift_secs, 15);
+
+        assert!(contract
+            .update(&[change("proposal_timer", "eager")], admin, 2)
+            .is_err());
+        assert!(contract
+            .update(&[change("proposal_interval_ms", "0")], admin, 2)
+            .is_err());
+        assert!(contract
+            .update(&[change("max_clock_drift_secs", "0")], admin, 2)
+            .is_err());
+        // The adaptive floor can't exceed the interval, nor the idle bound
+        // fall below it
+        assert_eq!(
+            contract.update(&[change("proposal_min_interval_ms", "5000")], admin, 2),
+            Err(ChainConfigError::InvalidValue {
+                name: "proposal_min_interval_ms".to_string(),
+                value: "5000".to_string(),
+            })
+        );
+        assert!(contract
+            .update(&[change("proposal_interval_ms", "90000")], admin, 2)
+            .is_err());
+        assert_eq!(contract.current().version, 1);
+    }
+
+    #[test]
+    fn test_faucet_params() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        assert!(!contract.current().config.faucet_enabled);
+        contract
+            .update(
+                &[
+                    change("faucet_enabled", "true"),
+                    change("faucet_amount", "5000"),
+                    change("faucet_window_secs", "3600"),
+                ],
+                admin,
+                1,
+            )
+            .unwrap();
+        let config = &contract.current().config;
+        assert_eq!(config.get("faucet_enabled").unwrap(), "true");
+        assert_eq!(config.faucet_amount, 5000);
+        assert_eq!(config.faucet_window_secs, 3600);
+
+        assert!(contract
+            .update(&[change("faucet_enabled", "yes")], admin, 2)
+            .is_err());
+        assert!(contract
+            .update(&[change("faucet_window_secs", "0")], admin, 2)
+            .is_err());
+    }
+
+    #[test]
+    fn test_signature_algorithms_param() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        let config = &contract.current().config;
+        assert_eq!(config.signature_algorithms(), vec![KeyAlgorithm::Secp256k1]);
+        assert!(!config.allows_signature_algorithm(KeyAlgorithm::Ed25519));
+
+        contract
+            .update(
+                &[change("signature_algorithms", "secp256k1, Ed25519,ed25519")],
+                admin,
+                1,
+            )
+            .unwrap();
+        let config = &contract.current().config;
+        assert_eq!(config.get("signature_algorithms").unwrap(), "secp256k1,ed25519");
+        assert!(config.allows_signature_algorithm(KeyAlgorithm::Ed25519));
+
+        contract
+            .update(
+                &[change("signature_algorithms", "secp256k1/SHA256,ed25519/sm3,SM2,sm2/sm3")],
+                admin,
+                2,
+            )
+            .unwrap();
+        let config = &contract.current().config;
+        assert_eq!(
+            config.get("signature_algorithms").unwrap(),
+            "secp256k1/sha256,ed25519/sm3,sm2"
+        );
+        assert_eq!(config.signature_algorithms(), KeyAlgorithm::ALL.to_vec());
+        let scheme = |key, hash| SignatureScheme::new(key, hash);
+        assert!(config.allows_signature_scheme(scheme(KeyAlgorithm::Ed25519, HashAlgorithm::Sm3)));
+        assert!(config.allows_signature_scheme(scheme(KeyAlgorithm::Sm2, HashAlgorithm::Sm3)));
+        assert!(!config.allows_signature_scheme(KeyAlgorithm::Ed25519.into()));
+        assert!(!config.allows_signature_scheme(KeyAlgorithm::Secp256k1.into()));
+
+        // One hash per key algorithm, so signers can derive it
+        let schemes = config.signature_schemes();
+        assert_eq!(
+            SignatureScheme::for_key(KeyAlgorithm::Secp256k1, &schemes).hash,
+            HashAlgorithm::Sha256
+        );
+        let invalid = ["", "ed25519,", "ed25519/", "ed25519/md5", "sm3", "secp256k1,secp256k1/sm3"];
+        for value in invalid {
+            assert!(contract
+                .update(&[change("signature_algorithms", value)], admin, 3)
+                .is_err());
+        }
+    }
+
+    #[test]
+    fn test_checkpoint_interval_param() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        assert_eq!(contract.current().config.checkpoint_interval, 0);
+
+        contract
+            .update(&[change("checkpoint_interval", "100")], admin, 1)
+            .unwrap();
+        assert_eq!(contract.current().config.get("checkpoint_interval").unwrap(), "100");
+        assert_eq!(contract.config_at(0).config.checkpoint_interval, 0);
+        assert!(contract
+            .update(&[change("checkpoint_interval", "-1")], admin, 2)
+            .is_err());
+    }
+
+    #[test]
+    fn test_max_evidence_param() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        assert_eq!(contract.current().config.max_evidence, 0);
+
+        contract.update(&[change("max_evidence", "2")], admin, 1).unwrap();
+        assert_eq!(contract.current().config.get("max_evidence").unwrap(), "2");
+        assert_eq!(contract.config_at(0).config.max_evidence, 0);
+    }
+
+    #[test]
+    fn test_max_txs_per_sender_param() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        assert_eq!(contract.current().config.max_txs_per_sender, 0);
+
+        contract
+            .update(&[change("max_txs_per_sender", "16")], admin, 1)
+            .unwrap();
+        assert_eq!(contract.config_at(1).config.max_txs_per_sender, 16);
+        assert_eq!(contract.config_at(0).config.max_txs_per_sender, 0);
+        assert!(contract
+            .update(&[change("max_txs_per_sender", "many")], admin, 2)
+            .is_err());
+    }
+
+    #[test]
+    fn test_org_isolation_params() {
+        let admin = Address::from([7u8; 20]);
+        let contract = Address::from([0x42; 20]);
+        let (alice, bob) = (Address::from([0xa1; 20]), Address::from([0xb1; 20]));
+        let mut config = ChainConfig::default();
+        assert!(config.org_isolation().is_none());
+
+        config.set("admin.a", &admin.to_string()).unwrap();
+        config.set("isolated_contracts", &contract.to_string()).unwrap();
+        config.set("members.a", &alice.to_string()).unwrap();
+        config.set("members.b", &format!("{}, {}", bob, bob)).unwrap();
+        assert_eq!(config.get("members.b").unwrap(), bob.to_string());
+        assert_eq!(config.get("members.c").unwrap(), "none");
+        assert_eq!(config.org_of(&admin), Some("a"));
+        assert_eq!(config.org_of(&bob), Some("b"));
+
+        // An account belongs to at most one org
+        assert!(config.set("members.b", &alice.to_string()).is_err());
+        assert!(config.set("members.", &bob.to_string()).is_err());
+        assert!(config.set("isolated_contracts", "0x12").is_err());
+
+        let isolation = config.org_isolation().unwrap();
+        assert!(isolation.is_isolated(&contract));
+        assert_eq!(isolation.org_of(&alice), Some("a"));
+        assert_eq!(isolation.org_of(&admin), Some("a"));
+        assert_eq!(isolation.admins.len(), 1);
+        assert_eq!(config.org_members().org_of(&bob), Some("b"));
+
+        config.set("members.b", "none").unwrap();
+        config.set("isolated_contracts", "none").unwrap();
+        assert_eq!(config.org_of(&bob), None);
+        assert!(config.org_isolation().is_none());
+
+        config.set("revocation_issuers", &admin.to_string()).unwrap();
+        assert_eq!(config.revocation_issuers(), vec![admin]);
+        config.set("revocation_issuers", "none").unwrap();
+        assert!(config.revocation_issuers().is_empty());
+        config.set("multi_sign_signers", &admin.to_string()).unwrap();
+        assert_eq!(config.multi_sign_signers(), vec![admin]);
+        assert!(config.org_isolation().is_none());
+    }
+
+    #[test]
+    fn test_org_nodes_param() {
+        let mut config = ChainConfig::default();
+        assert!(config.org_nodes().is_empty());
+        assert_eq!(config.get("nodes.a").unwrap(), "none");
+
+        let first = format!("0x{}@10.0.0.2:30303", hex::encode([2u8; 32]));
+        let second = format!("{}@10.0.0.1:30303", hex::encode([1u8; 32]));
+        config.set("nodes.a", &format!("{},{}", first, second)).unwrap();
+        let nodes = config.org_nodes();
+        assert_eq!(nodes.len(), 2);
+        assert_eq!(nodes[0].0, "a");
+        assert_eq!(nodes[0].1.node_id, [1u8; 32]);
+        assert_eq!(nodes[0].1.address, "10.0.0.1:30303".parse().unwrap());
+        assert_eq!(
+            config.get("nodes.a").unwrap(),
+            format!("0x{},{}", second, first)
+        );
+
+        // A node belongs to one org, and entries must be well formed
+        assert!(config.set("nodes.b", &second).is_err());
+        assert!(config.set("nodes.b", "0x12@10.0.0.1:30303").is_err());
+        assert!(config.set("nodes.b", &hex::encode([3u8; 32])).is_err());
+        assert!(config.set("nodes.", &format!("{}@10.0.0.3:1", hex::encode([3u8; 32]))).is_err());
+
+        config.set("nodes.a", "none").unwrap();
+        assert!(config.org_nodes().is_empty());
+    }
+
+    #[test]
+    fn test_hash_migrations_param() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        assert_eq!(contract.current().config.get("hash_migrations").unwrap(), "none");
+        assert_eq!(contract.current().config.hash_schedule(), HashSchedule::default());
+
+        contract
+            .update(&[change("hash_migrations", "SHA256@10, sm3@20")], admin, 5)
+            .unwrap();
+        let config = &contract.current().config;
+        assert_eq!(config.get("hash_migrations").unwrap(), "sha256@10,sm3@20");
+        let schedule = config.hash_schedule();
+        assert_eq!(schedule.algorithm_at(9), HashAlgorithm::Keccak256);
+        assert_eq!(schedule.algorithm_at(10), HashAlgorithm::Sha256);
+        assert_eq!(schedule.legacy_algorithm_at(20), Some(HashAlgorithm::Sha256));
+
+        for value in ["", "sha256", "sha256@x", "md5@30", "sha256@30,sm3@30", "keccak256@30"] {
+            assert!(contract
+                .update(&[change("hash_migrations", value)], admin, 6)
+                .is_err());
+        }
+
+        // Activated migrations are fixed, later ones can still change
+        assert!(contract
+            .update(&[change("hash_migrations", "sm3@10")], admin, 12)
+            .is_err());
+        assert!(contract
+            .update(&[change("hash_migrations", "none")], admin, 12)
+            .is_err());
+        contract
+            .update(&[change("hash_migrations", "sha256@10,sm3@40")], admin, 12)
+            .unwrap();
+        assert_eq!(
+            contract.config_at(12).config.hash_schedule().algorithm_at(30),
+            HashAlgorithm::Sha256
+        );
+        // A migration can't activate at or before the update
+        assert!(contract
+            .update(&[change("hash_migrations", "sha256@10,sm3@13")], admin, 13)
+            .is_err());
+    }
+
+    #[test]
+    fn test_feature_activations() {
+        let admins: Vec<Address> = (1..=3).map(|i| Address::from([i; 20])).collect();
+        let mut genesis = ChainConfig::default();
+        for (org, admin) in ["org1", "org2", "org3"].iter().zip(&admins) {
+            genesis.admins.insert(org.to_string(), *admin.as_bytes());
+        }
+        let mut contract = ChainConfigContract::new(genesis);
+        let schedule = |value: &str| vec![change("feature_activations", value)];
+        let signal = |features: &[&str]| encode_signal_features(features);
+
+        // A single org's support is not a majority
+        contract
+            .execute(&signal(&["fast-sync"]), admins[0], 2)
+            .unwrap();
+        assert_eq!(
+            contract.update(&schedule("fast-sync@20"), admins[0], 3),
+            Err(ChainConfigError::UnsupportedFeature("fast-sync".to_string()))
+        );
+        assert!(contract
+            .execute(&signal(&["fast-sync"]), Address::from([9u8; 20]), 3)
+            .is_err());
+        assert!(contract.execute(&signal(&["Fast Sync"]), admins[1], 3).is_err());
+
+        contract
+            .execute(&signal(&["fast-sync", "fast-sync"]), admins[1], 3)
+            .unwrap();
+        let config = &contract.current().config;
+        assert_eq!(config.feature_supporters("fast-sync"), vec!["org1", "org2"]);
+        assert_eq!(config.feature_support["org2"], vec!["fast-sync".to_string()]);
+        contract
+            .update(&schedule("fast-sync@20"), admins[0], 4)
+            .unwrap();
+        assert_eq!(
+            contract.current().config.get("feature_activations").unwrap(),
+            "fast-sync@20"
+        );
+        assert!(!contract.is_feature_active("fast-sync", 19));
+        assert!(contract.is_feature_active("fast-sync", 20));
+        assert!(!contract.is_feature_active("other", 20));
+        let gates = contract.current().config.feature_gates();
+        assert!(!gates.is_active("fast-sync", 19));
+        assert!(gates.is_active("fast-sync", 20));
+
+        // Activated features are fixed and new ones must activate later
+        for value in ["none", "fast-sync@30", "fast-sync@20,fast-sync@30", "x@y"] {
+            assert!(contract.update(&schedule(value), admins[0], 21).is_err());
+        }
+        contract.execute(&signal(&["fast-sync", "dag-v2"]), admins[1], 21).unwrap();
+        contract.execute(&signal(&["dag-v2"]), admins[2], 22).unwrap();
+        assert!(contract
+            .update(&schedule("fast-sync@20,dag-v2@22"), admins[0], 22)
+            .is_err());
+        contract
+            .update(&schedule("fast-sync@20,dag-v2@40"), admins[0], 22)
+            .unwrap();
+        assert_eq!(
+            contract.current().config.get("feature_activations").unwrap(),
+            "fast-sync@20,dag-v2@40"
+        );
+    }
+
+    #[test]
+    fn test_diff_and_revert() {
+        let admin = Address::from([7u8; 20]);
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        let changes = [
+            change("block_gas_limit", "1000"),
+            change("storage_quota", "64"),
+        ];
+        contract.update(&changes, admin, 3).unwrap();
+
+        let genesis = contract.version(0).unwrap().config.clone();
+        let current = contract.current().config.clone();
+        let changes = diff(&genesis, &current);
+        assert_eq!(
+            changes,
+            vec![
+                ConfigChange {
+                    name: "block_gas_limit",
+                    from: "30000000".to_string(),
+                    to: "1000".to_string(),
+                },
+                ConfigChange {
+                    name: "storage_quota",
+                    from: "none".to_string(),
+                    to: "64".to_string(),
+                },
+            ]
+        );
+
+        let revert = revert_update(&current, &genesis, "storage_quota")
+            .unwrap()
+            .unwrap();
+        contract.execute(&revert, admin, 4).unwrap();
+        assert_eq!(contract.current().config.storage_quota, None);
+        assert_eq!(contract.current().config.block_gas_limit, 1000);
+        assert_eq!(
+            revert_update(&genesis, &genesis, "storage_quota").unwrap(),
+            None
+        );
+
+        let rebuilt = ChainConfigContract::from_versions(contract.versions().cloned()).unwrap();
+        assert_eq!(rebuilt.current(), contract.current());
+    }
+
+    fn admin_contract(orgs: &[(&str, Address)]) -> ChainConfigContract {
+        let mut contract = ChainConfigContract::new(ChainConfig::default());
+        let changes: Vec<_> = orgs
+            .iter()
+            .map(|(org, key)| change(&format!("admin.{}", org), &key.to_string()))
+            .collect();
+        contract.update(&changes, Address::zero(), 1).unwrap();
+        contract
+    }
+
+    #[test]
+    fn test_admins_gate_updates() {
+        let a = Address::from([1u8; 20]);
+        let b = Address::from([2u8; 20]);
+        let mut contract = admin_contract(&[("org-a", a)]);
+
+        let outsider = Address::from([9u8; 20]);
+        assert_eq!(
+            contract.update(&[change("block_gas_limit", "1")], outsider, 2),
+            Err(ChainConfigError::NotAdmin(outsider))
+        );
+
+        // Once governed, admin keys are neither added, replaced nor removed
+        // outside a rotation
+        for (name, value) in [
+            ("admin.org-b", b.to_string()),
+            ("admin.org-a", b.to_string()),
+            ("admin.org-a", "none".to_string()),
+        ] {
+            let org = name.strip_prefix(ADMIN_PARAM_PREFIX).unwrap().to_string();
+            assert_eq!(
+                contract.update(&[change(name, &value)], a, 2),
+                Err(ChainConfigError::RotationRequired(org))
+            );
+        }
+        assert_eq!(contract.admin_org_at(&b, 2), None);
+        assert_eq!(contract.current().config.get("admin.org-a").unwrap(), a.to_string());
+    }
+
+    #[test]
+    fn test_admin_key_rotation() {
+        let (a, b, c) = (
+            Address::from([1u8; 20]),
+            Address::from([2u8; 20]),
+            Address::from([3u8; 20]),
+        );
+        let new_a = Address::from([4u8; 20]);
+        let mut contract = admin_contract(&[("org-a", a), ("org-b", b), ("org-c", c)]);
+        contract
+            .update(&[change("key_rotation_window", "10")], a, 2)
+            .unwrap();
+
+        assert!(matches!(
+            contract.stage_rotation("org-a", new_a, 20, b, 5),
+            Err(ChainConfigError::NotAdmin(_))
+        ));
+        assert!(matches!(
+            contract.stage_rotation("org-a", new_a, 5, a, 5),
+            Err(ChainConfigError::InvalidRotation(_))
+        ));
+        assert!(matches!(
+            contract.stage_rotation("org-a", c, 20, a, 5),
+            Err(ChainConfigError::InvalidRotation(_))
+        ));
+        contract.stage_rotation("org-a", new_a, 20, a, 5).unwrap();
+        let rotation = &contract.current().config.rotations["org-a"];
+        assert_eq!(rotation.required_endorsements, 2);
+        assert!(!rotation.is_endorsed());
+
+        // The new key can't act before the rotation is endorsed and active
+        assert!(contract.endorse_rotation("org-a", new_a, 6).is_err());
+        assert!(contract.endorse_rotation("org-a", a, 6).is_err());
+        contract.endorse_rotation("org-a", b, 6).unwrap();
+        assert!(contract.endorse_rotation("org-a", b, 7).is_err());
+        assert_eq!(contract.admin_keys_at("org-a", 19), vec![a]);
+        assert_eq!(contract.admin_keys_at("org-a", 20), vec![a, new_a]);
+        assert_eq!(contract.admin_keys_at("org-a", 29), vec![a, new_a]);
+        assert_eq!(contract.admin_keys_at("org-a", 30), vec![new_a]);
+
+        // Both keys work in the window; afterwards the rotation is settled
+        contract
+            .update(&[change("block_gas_limit", "1")], a, 25)
+            .unwrap();
+        contract
+            .update(&[change("block_gas_limit", "2")], new_a, 26)
+            .unwrap();
+
+        // Both of org-a's keys count as one org towards another rotation
+        let new_b = Address::from([5u8; 20]);
+        contract.stage_rotation("org-b", new_b, 40, b, 26).unwrap();
+        contract.endorse_rotation("org-b", a, 27).unwrap();
+        assert_eq!(
+            contract.endorse_rotation("org-b", new_a, 27),
+            Err(ChainConfigError::InvalidRotation(
+                "org already endorsed".to_string()
+            ))
+        );
+        assert_eq!(
+            contract.current().config.rotations["org-b"].endorsements,
+            BTreeSet::from(["org-a".to_string(), "org-b".to_string()])
+        );
+        assert_eq!(
+            contract.update(&[change("block_gas_limit", "3")], a, 30),
+            Err(ChainConfigError::NotAdmin(a))
+        );
+        contract
+            .update(&[change("block_gas_limit", "3")], new_a, 30)
+            .unwrap();
+        let config = &contract.current().config;
+        assert!(!config.rotations.contains_key("org-a"));
+        assert_eq!(config.get("admin.org-a").unwrap(), new_a.to_string());
+    }
+
+    #[test]
+    fn test_simulate_endorsement() {
+        let (a, b, c) = (
+            Address::from([1u8; 20]),
+            Address::from([2u8; 20]),
+            Address::from([3u8; 20]),
+        );
+        let outsider = Address::from([9u8; 20]);
+        let open = ChainConfigContract::new(ChainConfig::default());
+        assert!(
+            open.simulate_endorsement("config", None, &[], 1)
+                .unwrap()
+                .satisfied
+        );
+
+        let mut contract = admin_contract(&[("org-a", a), ("org-b", b), ("org-c", c)]);
+        let eval = contract
+            .simulate_endorsement("config", None, &[outsider], 2)
+            .unwrap();
+        assert!(!eval.satisfied);
+        assert_eq!(eval.rule, "ANY 1 of 3 org admins");
+        assert_eq!(eval.ignored, vec![outsider.to_string()]);
+        assert_eq!(eval.missing_orgs.len(), 3);
+
+        // Method permission changes and pauses take the owning org's admin
+        let acl = format!("acl.{}", Address::from([0x42; 20]));
+        let eval = contract
+            .simulate_endorsement(&acl, Some("org-b"), &[b], 2)
+            .unwrap();
+        assert!(eval.satisfied);
+        assert_eq!(eval.rule, "ADMIN of org-b (owning org)");
+        assert!(contract.simulate_endorsement("acl.0x12", Some("org-b"), &[b], 2).is_err());
+        let pause = format!("pause.{}", Address::from([0x42; 20]));
+        let eval = contract
+            .simulate_endorsement(&pause, Some("org-b"), &[a, c], 2)
+            .unwrap();
+        assert!(!eval.satisfied);
+        assert!(eval.missing_orgs.contains(&"org-b".to_string()));
+        assert!(contract.simulate_endorsement(&pause, None, &[b], 2).is_err());
+        assert_eq!(
+            contract.simulate_endorsement(&pause, Some("org-x"), &[b], 2),
+            Err(ChainConfigError::UnknownOrg("org-x".to_string()))
+        );
+
+        // Without a staged rotation the org's own admin must take part
+        let eval = contract
+            .simulate_endorsement("rotation.org-a", None, &[b, c], 2)
+            .unwrap();
+        assert!(!eval.satisfied);
+        assert_eq!(eval.required, 2);
+        assert_eq!(eval.missing_orgs, vec!["org-a".to_string()]);
+        assert!(eval.rule.contains("including org-a"));
+
+        // Recorded endorsements count towards a staged rotation
+        let new_a = Address::from([4u8; 20]);
+        contract.stage_rotation("org-a", new_a, 20, a, 5).unwrap();
+        let eval = contract
+            .simulate_endorsement("rotation.org-a", None, &[], 6)
+            .unwrap();
+        assert_eq!(eval.endorsed_orgs, vec!["org-a".to_string()]);
+        assert_eq!(
+            eval.missing_orgs,
+            vec!["org-b".to_string(), "org-c".to_string()]
+        );
+        let data = encode_simulate_endorsement("rotation.org-a", None, &[c]);
+        let eval: PolicyEvaluation =
+            serde_json::from_slice(&contract.execute(&data, outsider, 6).unwrap()).unwrap();
+        assert!(eval.satisfied);
+        assert!(eval.missing_orgs.is_empty());
+        assert_eq!(
+            contract.current().config.rotations["org-a"]
+                .endorsements
+                .len(),
+            1
+        );
+
+        assert_eq!(
+            contract.simulate_endorsement("treasury", None, &[a], 6),
+            Err(ChainConfigError::UnknownResource("treasury".to_string()))
+        );
+    }
+
+    #[test]
+    fn test_unendorsed_rotation_expires() {
+        let (a, b, c) = (
+            Address::from([1u8; 20]),
+            Address::from([2u8; 20]),
+            Address::from([3u8; 20]),
+        );
+        let new_a = Address::from([4u8; 20]);
+        let mut contract = admin_contract(&[("org-a", a), ("org-b", b), ("org-c", c)]);
+        let stage = encode_stage_rotation("org-a", &new_a, 10);
+        contract.execute(&stage, a, 5).unwrap();
+        assert!(contract
+            .execute(&encode_endorse_rotation("org-a"), b, 10)
+            .is_err());
+        assert_eq!(contract.admin_keys_at("org-a", 50), vec![a]);
+
+        // An expired rotation doesn't block staging a new one
+        contract
+            .execute(&encode_stage_rotation("org-a", &new_a, 60), a, 50)
+            .unwrap();
+        contract
+            .execute(&encode_endorse_rotation("org-a"), c, 51)
+            .unwrap();
+        assert_eq!(contract.admin_keys_at("org-a", 60), vec![a, new_a]);
+
+        let rebuilt = ChainConfigContract::from_versions(contract.versions().cloned()).unwrap();
+        assert_eq!(rebuilt.admin_keys_at("org-a", 60), vec![a, new_a]);
+    }
+}
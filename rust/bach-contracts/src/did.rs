@@ -0,0 +1,670 @@
+//! DID registry system contract
+//!
+//! Members can be identified by a decentralized identifier (`did:bach:…`)
+//! instead of a raw account key. The registry maps each DID to a document
+//! listing the keys that act for it, its service endpoints and the roles it
+//! holds, so access control can resolve a DID member to key material when
+//! it is checked.
+//!
+//! Documents are changed by their controllers. A document without explicit
+//! controllers is controlled by its own keys. A DID is created by a document
+//! signed by one of its controllers; later versions, including the final
+//! deactivation, must be signed by a controller of the current document,
+//! which lets a member rotate keys without changing its identity. A
+//! deactivated DID no longer resolves and cannot be reused.
+//!
+//! Registrations are transactions to the registry address. The RPC server
+//! runs them on submission for the receipt's logs, and every node runs
+//! them again when their block commits, which records the document.
+//!
+//! Every change emits a log from the registry address: topic 0 is the event
+//! signature (`DidCreated`, `DidUpdated` or `DidDeactivated`), topic 1 the
+//! keccak hash of the DID, and the data is the new version as a 32-byte word
+//! followed by the DID.
+//!
+//! Calldata is `DID_REGISTER || json(signed document)`,
+//! `DID_RESOLVE || did (utf-8)`, `DID_LOOKUP_KEY || address (20 bytes)` or
+//! `DID_LIST || json(page request)`, which pages through the active DIDs in
+//! ascending order.
+
+use crate::ordered::OrderedKv;
+use crate::page::PageRequest;
+use bach_crypto::{keccak256, keccak256_concat, PrivateKey, Signature, SIGNATURE_LENGTH};
+use bach_evm::Log;
+use bach_primitives::{Address, H256, SystemContract};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+
+/// Registry call: create, update or deactivate a DID document.
+pub const DID_REGISTER: u8 = 0x01;
+/// Registry call: resolve a DID to its document.
+pub const DID_RESOLVE: u8 = 0x02;
+/// Registry call: find the DID a key acts for.
+pub const DID_LOOKUP_KEY: u8 = 0x03;
+/// Registry call: list a page of active DIDs.
+pub const DID_LIST: u8 = 0x04;
+
+/// Method prefix of DIDs managed by the registry.
+pub const DID_PREFIX: &str = "did:bach:";
+
+/// Domain separator for DID document signatures.
+const DID_DOMAIN: &[u8] = b"bach-did-document";
+
+/// Returns the address of the DID registry system contract (0x…0106).
+pub fn did_registry_address() -> Address {
+    SystemContract::DidRegistry.address()
+}
+
+/// Returns true if `s` looks like a DID rather than a hex address.
+pub fn is_did(s: &str) -> bool {
+    s.starts_with("did:")
+}
+
+/// Checks that `did` is a well-formed `did:bach:` identifier.
+pub fn validate_did(did: &str) -> Result<(), DidError> {
+    let id = did
+        .strip_prefix(DID_PREFIX)
+        .ok_or_else(|| DidError::InvalidDid(did.to_string()))?;
+    let valid = !id.is_empty()
+        && id
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '-' | '_' | ':'));
+    if valid {
+        Ok(())
+    } else {
+        Err(DidError::InvalidDid(did.to_string()))
+    }
+}
+
+/// Errors returned by the DID registry.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum DidError {
+    /// Identifier is not a `did:bach:` DID
+    InvalidDid(String),
+    /// DID is not registered
+    NotFound(String),
+    /// DID has been deactivated
+    Deactivated(String),
+    /// Document is not signed by a controller of the DID
+    Unauthorized(Address),
+    /// Version is not newer than the current document
+    StaleVersion { latest: u64, version: u64 },
+    /// Signature is missing or invalid
+    BadSignature,
+    /// Calldata or a stored document could not be decoded
+    Malformed(String),
+}
+
+impl std::fmt::Display for DidError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::InvalidDid(did) => write!(f, "invalid DID: {}", did),
+            Self::NotFound(did) => write!(f, "DID not registered: {}", did),
+            Self::Deactivated(did) => write!(f, "DID deactivated: {}", did),
+            Self::Unauthorized(signer) => write!(f, "{} is not a controller of this DID", signer),
+            Self::StaleVersion { latest, version } => write!(
+                f,
+                "DID document version {} is not newer than {}",
+                version, latest
+            ),
+            Self::BadSignature => write!(f, "invalid DID document signature"),
+            Self::Malformed(msg) => write!(f, "malformed DID data: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for DidError {}
+
+/// Changes recorded by the registry's logs.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DidEvent {
+    /// A DID was registered
+    Created,
+    /// A DID's document was replaced
+    Updated,
+    /// A DID was deactivated
+    Deactivated,
+}
+
+impl DidEvent {
+    /// Returns the event signature.
+    pub fn signature(&self) -> &'static str {
+        match self {
+            Self::Created => "DidCreated(string,uint64)",
+            Self::Updated => "DidUpdated(string,uint64)",
+            Self::Deactivated => "DidDeactivated(string,uint64)",
+        }
+    }
+
+    /// Returns the log topic identifying the event.
+    pub fn topic(&self) -> H256 {
+        keccak256(self.signature().as_bytes())
+    }
+
+    /// Returns the event a registry log records, if any.
+    pub fn from_log(log: &Log) -> Option<Self> {
+        let topic = log.topics.first()?;
+        [Self::Created, Self::Updated, Self::Deactivated]
+            .into_iter()
+            .find(|event| event.topic() == *topic)
+    }
+
+    fn log(&self, did: &str, version: u64) -> Log {
+        let mut data = vec![0u8; 24];
+        data.extend_from_slice(&version.to_be_bytes());
+        data.extend_from_slice(did.as_bytes());
+        Log {
+            address: did_registry_address(),
+            topics: vec![self.topic(), keccak256(did.as_bytes())],
+            data,
+        }
+    }
+}
+
+/// A service reachable on behalf of a DID, e.g. a messaging endpoint.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ServiceEndpoint {
+    /// Identifier of the service within the document
+    pub id: String,
+    /// Service type, e.g. `messaging`
+    #[serde(rename = "type")]
+    pub kind: String,
+    /// Where the service is reached
+    pub endpoint: String,
+}
+
+impl ServiceEndpoint {
+    /// Creates a service entry.
+    pub fn new(id: &str, kind: &str, endpoint: &str) -> Self {
+        Self {
+            id: id.to_string(),
+            kind: kind.to_string(),
+            endpoint: endpoint.to_string(),
+        }
+    }
+}
+
+/// Keys, services and roles of a DID member.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DidDocument {
+    /// The DID, e.g. `did:bach:hospital-a`
+    pub id: String,
+    /// Increases with every update of the document
+    pub version: u64,
+    /// Accounts allowed to change the document, sorted and without
+    /// duplicates; when empty, the DID's keys control it
+    #[serde(default)]
+    pub controllers: Vec<[u8; 20]>,
+    /// Account keys that act for the DID, sorted and without duplicates
+    pub keys: Vec<[u8; 20]>,
+    /// Service endpoints of the DID
+    #[serde(default)]
+    pub services: Vec<ServiceEndpoint>,
+    /// Roles the DID member claims; nodes grant admin roles from their own
+    /// config only
+    pub roles: Vec<String>,
+    /// Set on the final version of a deactivated DID
+    #[serde(default)]
+    pub deactivated: bool,
+}
+
+fn sorted_addrs(addrs: impl IntoIterator<Item = Address>) -> Vec<[u8; 20]> {
+    let addrs: BTreeSet<[u8; 20]> = addrs.into_iter().map(|a| *a.as_bytes()).collect();
+    addrs.into_iter().collect()
+}
+
+impl DidDocument {
+    /// Creates a document for `id` backed by `keys`.
+    pub fn new(
+        id: &str,
+        version: u64,
+        keys: impl IntoIterator<Item = Address>,
+        roles: Vec<String>,
+    ) -> Self {
+        Self {
+            id: id.to_string(),
+            version,
+            controllers: Vec::new(),
+            keys: sorted_addrs(keys),
+            services: Vec::new(),
+            roles,
+            deactivated: false,
+        }
+    }
+
+    /// Creates the final version of `id`, deactivating it.
+    pub fn deactivation(id: &str, version: u64) -> Self {
+        Self {
+            deactivated: true,
+            ..Self::new(id, version, [], Vec::new())
+        }
+    }
+
+    /// Sets the accounts allowed to change the document.
+    pub fn with_controllers(mut self, controllers: impl IntoIterator<Item = Address>) -> Self {
+        self.controllers = sorted_addrs(controllers);
+        self
+    }
+
+    /// Adds a service endpoint.
+    pub fn with_service(mut self, service: ServiceEndpoint) -> Self {
+        self.services.push(service);
+        self
+    }
+
+    /// Returns the accounts allowed to change the document.
+    pub fn controller_addrs(&self) -> impl Iterator<Item = Address> + '_ {
+        let controllers = if self.controllers.is_empty() {
+            &self.keys
+        } else {
+            &self.controllers
+        };
+        controllers.iter().map(|bytes| Address::from(*bytes))
+    }
+
+    /// Returns true if `address` may change the document.
+    pub fn is_controller(&self, address: &Address) -> bool {
+        self.controller_addrs().any(|c| c == *address)
+    }
+
+    /// Returns the keys acting for the DID.
+    pub fn key_addrs(&self) -> impl Iterator<Item = Address> + '_ {
+        self.keys.iter().map(|bytes| Address::from(*bytes))
+    }
+
+    /// Returns true if `address` is one of the DID's keys.
+    pub fn has_key(&self, address: &Address) -> bool {
+        self.keys.binary_search(address.as_bytes()).is_ok()
+    }
+
+    /// Returns the hash the controller signs.
+    pub fn signing_hash(&self) -> H256 {
+        let encoded = serde_json::to_vec(self).expect("DID document serializes");
+        keccak256_concat(&[DID_DOMAIN, &encoded])
+    }
+
+    /// Signs the document with a controller's key.
+    pub fn sign(self, key: &PrivateKey) -> SignedDidDocument {
+        let signature = key.sign(&self.signing_hash()).to_bytes().to_vec();
+        SignedDidDocument {
+            document: self,
+            signature,
+        }
+    }
+}
+
+/// A DID document with the signature of a controller.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SignedDidDocument {
+    /// The signed document
+    pub document: DidDocument,
+    /// 65-byte signature over `document.signing_hash()`
+    pub signature: Vec<u8>,
+}
+
+impl SignedDidDocument {
+    /// Recovers the address of the key that signed the document.
+    pub fn signer(&self) -> Result<Address, DidError> {
+        let bytes: [u8; SIGNATURE_LENGTH] = self
+            .signature
+            .as_slice()
+            .try_into()
+            .map_err(|_| DidError::BadSignature)?;
+        let signature = Signature::from_bytes(&bytes).map_err(|_| DidError::BadSignature)?;
+        signature
+            .recover(&self.document.signing_hash())
+            .map(|key| key.to_address())
+            .map_err(|_| DidError::BadSignature)
+    }
+
+    /// Encodes the document for storage or as calldata.
+    pub fn encode(&self) -> Vec<u8> {
+        serde_json::to_vec(self).expect("DID document serializes")
+    }
+
+    /// Decodes a document produced by `encode`.
+    pub fn decode(data: &[u8]) -> Result<Self, DidError> {
+        serde_json::from_slice(data).map_err(|e| DidError::Malformed(e.to_string()))
+    }
+}
+
+/// Encodes `DID_REGISTER` calldata.
+pub fn encode_register(document: &SignedDidDocument) -> Vec<u8> {
+    let mut data = vec![DID_REGISTER];
+    data.extend(document.encode());
+    data
+}
+
+/// Encodes `DID_RESOLVE` calldata.
+pub fn encode_resolve(did: &str) -> Vec<u8> {
+    let mut data = vec![DID_RESOLVE];
+    data.extend_from_slice(did.as_bytes());
+    data
+}
+
+/// Encodes `DID_LOOKUP_KEY` calldata.
+pub fn encode_lookup_key(address: &Address) -> Vec<u8> {
+    let mut data = vec![DID_LOOKUP_KEY];
+    data.extend_from_slice(address.as_bytes());
+    data
+}
+
+/// Encodes `DID_LIST` calldata.
+pub fn encode_list(request: &PageRequest) -> Vec<u8> {
+    let mut data = vec![DID_LIST];
+    data.extend(request.encode());
+    data
+}
+
+/// Native DID registry state: the current document of each DID.
+#[derive(Debug, Clone, Default)]
+pub struct DidRegistry {
+    documents: OrderedKv<String, SignedDidDocument>,
+    logs: Vec<Log>,
+}
+
+impl DidRegistry {
+    /// Creates an empty registry.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Returns the current document of each DID, including deactivated
+    /// ones.
+    pub fn documents(&self) -> impl Iterator<Item = &SignedDidDocument> {
+        self.documents.values()
+    }
+
+    /// Returns the logs emitted since the last call, oldest first.
+    pub fn take_logs(&mut self) -> Vec<Log> {
+        std::mem::take(&mut self.logs)
+    }
+
+    /// Verifies `signed` and makes it the DID's current document. A
+    /// document with `deactivated` set deactivates the DID. Returns the DID.
+    pub fn register(&mut self, signed: SignedDidDocument) -> Result<String, DidError> {
+        let document = &signed.document;
+        validate_did(&document.id)?;
+        if !document.deactivated && document.keys.is_empty() {
+            return Err(DidError::Malformed("document has no keys".to_string()));
+        }
+
+        let signer = signed.signer()?;
+        let event = match self.documents.get(&document.id) {
+            Some(current) => {
+                if current.document.deactivated {
+                    return Err(DidError::Deactivated(document.id.clone()));
+                }
+                if !current.document.is_controller(&signer) {
+                    return Err(DidError::Unauthorized(signer));
+                }
+                if document.version <= current.document.version {
+                    return Err(DidError::StaleVersion {
+                        latest: current.document.version,
+                        version: document.version,
+                    });
+                }
+                if document.deactivated {
+                    DidEvent::Deactivated
+                } else {
+                    DidEvent::Updated
+                }
+            }
+            None if document.deactivated => return Err(DidError::NotFound(document.id.clone())),
+            None if !document.is_controller(&signer) => return Err(DidError::Unauthorized(signer)),
+            None => DidEvent::Created,
+        };
+
+        let did = document.id.clone();
+        self.logs.push(event.log(&did, document.version));
+        self.documents.insert(did.clone(), signed);
+        Ok(did)
+    }
+
+    /// Restores a document previously accepted by `register`, e.g. from
+    /// storage. The signer is not checked against the document's
+    /// controllers, since an update is signed by a controller it may have
+    /// replaced. No log is emitted.
+    pub fn restore(&mut self, signed: SignedDidDocument) -> Result<String, DidError> {
+        validate_did(&signed.document.id)?;
+        signed.signer()?;
+        let did = signed.document.id.clone();
+        self.documents.insert(did.clone(), signed);
+        Ok(did)
+    }
+
+    /// Returns the current document of an active `did`.
+    pub fn resolve(&self, did: &str) -> Result<&DidDocument, DidError> {
+        validate_did(did)?;
+        let document = self
+            .documents
+            .get(did)
+            .map(|signed| &signed.document)
+            .ok_or_else(|| DidError::NotFound(did.to_string()))?;
+        if document.deactivated {
+            return Err(DidError::Deactivated(did.to_string()));
+        }
+        Ok(document)
+    }
+
+    /// Returns the active DID `address` acts for, if any.
+    pub fn did_of(&self, address: &Address) -> Option<&str> {
+        self.documents
+            .values()
+            .find(|signed| !signed.document.deactivated && signed.document.has_key(address))
+            .map(|signed| signed.document.id.as_str())
+    }
+
+    /// Executes a call to the registry. Registrations return the DID,
+    /// resolutions the JSON document, key lookups the DID (empty if the
+    /// key acts for none) and listings a JSON page of DIDs.
+    pub fn execute(&mut self, data: &[u8]) -> Result<Vec<u8>, DidError> {
+        let (&call, payload) = data
+            .split_first()
+            .ok_or_else(|| DidError::Malformed("empty calldata".to_string()))?;
+        match call {
+            DID_REGISTER => {
+                let signed = SignedDidDocument::decode(payload)?;
+                self.register(signed).map(String::into_bytes)
+            }
+            DID_RESOLVE => {
+                let did = std::str::from_utf8(payload)
+                    .map_err(|_| DidError::Malformed("DID is not utf-8".to_string()))?;
+                let document = self.resolve(did)?;
+                Ok(serde_json::to_vec(document).expect("DID document serializes"))
+            }
+            DID_LOOKUP_KEY => {
+                let address = Address::from_slice(payload)
+                    .map_err(|_| DidError::Malformed("invalid address".to_string()))?;
+                Ok(self
+                    .did_of(&address)
+                    .unwrap_or_default()
+                    .as_bytes()
+                    .to_vec())
+            }
+            DID_LIST => {
+                let active = self
+                    .documents
+                    .iter()
+                    .filter(|(_, signed)| !signed.document.deactivated)
+                    .map(|(did, _)| (did.as_bytes(), did.clone()));
+                PageRequest::decode(payload)
+                    .and_then(|request| request.paginate(active))
+                    .map(|page| page.encode())
+                    .map_err(DidError::Malformed)
+            }
+            _ => Err(DidError::Malformed(format!("unknown call 0x{:02x}", call))),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::page::Page;
+
+    const DID: &str = "did:bach:hospital-a";
+
+    #[test]
+    fn test_validate_did() {
+        assert!(validate_did(DID).is_ok());
+        assert!(validate_did("did:bach:org:ward-3").is_ok());
+        assert!(validate_did("did:bach:").is_err());
+        assert!(validate_did("did:web:example.com").is_err());
+        assert!(validate_did("did:bach:a b").is_err());
+        assert!(is_did(DID));
+        assert!(!is_did("0x0101010101010101010101010101010101010101"));
+    }
+
+    #[test]
+    fn test_register_and_rotate_keys() {
+        let first = PrivateKey::random();
+        let second = PrivateKey::random();
+        let stranger = PrivateKey::random();
+        let mut registry = DidRegistry::new();
+
+        let doc = DidDocument::new(DID, 1, [first.public_key().to_address()], vec![]);
+        assert_eq!(
+            registry.register(doc.clone().sign(&stranger)),
+            Err(DidError::Unauthorized(stranger.public_key().to_address()))
+        );
+        registry.register(doc.sign(&first)).unwrap();
+        assert_eq!(registry.did_of(&first.public_key().to_address()), Some(DID));
+
+        // The new key can't take over the DID; the current one can hand over
+        let rotated = DidDocument::new(
+            DID,
+            2,
+            [second.public_key().to_address()],
+            vec!["operator".to_string()],
+        );
+        assert!(registry.register(rotated.clone().sign(&second)).is_err());
+        registry.register(rotated.clone().sign(&first)).unwrap();
+
+        let resolved = registry.resolve(DID).unwrap();
+        assert!(resolved.has_key(&second.public_key().to_address()));
+        assert!(!resolved.has_key(&first.public_key().to_address()));
+        assert_eq!(resolved.roles, vec!["operator".to_string()]);
+
+        assert_eq!(
+            registry.register(rotated.sign(&second)),
+            Err(DidError::StaleVersion {
+                latest: 2,
+                version: 2
+            })
+        );
+
+        let mut restored = DidRegistry::new();
+        let current = registry.documents().next().unwrap().clone();
+        restored.restore(current).unwrap();
+        assert_eq!(restored.resolve(DID), registry.resolve(DID));
+    }
+
+    #[test]
+    fn test_controllers_services_and_deactivation() {
+        let admin = PrivateKey::random();
+        let device = PrivateKey::random();
+        let mut registry = DidRegistry::new();
+
+        // A device key acts for the DID but only the admin may change it
+        let doc = DidDocument::new(DID, 1, [device.public_key().to_address()], vec![])
+            .with_controllers([admin.public_key().to_address()])
+            .with_service(ServiceEndpoint::new(
+                "inbox",
+                "messaging",
+                "https://a.example/inbox",
+            ));
+        assert!(registry.register(doc.clone().sign(&device)).is_err());
+        registry.register(doc.sign(&admin)).unwrap();
+        let resolved = registry.resolve(DID).unwrap();
+        assert_eq!(resolved.services[0].endpoint, "https://a.example/inbox");
+        assert!(!resolved.is_controller(&device.public_key().to_address()));
+
+        let update = DidDocument::new(DID, 2, [device.public_key().to_address()], vec![])
+            .with_controllers([admin.public_key().to_address()]);
+        assert_eq!(
+            registry.register(update.clone().sign(&device)),
+            Err(DidError::Unauthorized(device.public_key().to_address()))
+        );
+        registry.register(update.sign(&admin)).unwrap();
+
+        let deactivation = DidDocument::deactivation(DID, 3);
+        registry.register(deactivation.sign(&admin)).unwrap();
+        assert_eq!(
+            registry.resolve(DID),
+            Err(DidError::Deactivated(DID.to_string()))
+        );
+        assert_eq!(registry.did_of(&device.public_key().to_address()), None);
+        let revived = DidDocument::new(DID, 4, [admin.public_key().to_address()], vec![]);
+        assert_eq!(
+            registry.register(revived.sign(&admin)),
+            Err(DidError::Deactivated(DID.to_string()))
+        );
+
+        let events: Vec<DidEvent> = registry
+            .take_logs()
+            .iter()
+            .map(|log| {
+                assert_eq!(log.address, did_registry_address());
+                assert_eq!(log.topics[1], keccak256(DID.as_bytes()));
+                DidEvent::from_log(log).unwrap()
+            })
+            .collect();
+        assert_eq!(
+            events,
+            vec![DidEvent::Created, DidEvent::Updated, DidEvent::Deactivated]
+        );
+        assert!(registry.take_logs().is_empty());
+    }
+
+    #[test]
+    fn test_execute_calls() {
+        let key = PrivateKey::random();
+        let mut registry = DidRegistry::new();
+        let doc = DidDocument::new(DID, 1, [key.public_key().to_address()], vec![]);
+
+        let result = registry.execute(&encode_register(&doc.clone().sign(&key)));
+        assert_eq!(result.unwrap(), DID.as_bytes().to_vec());
+        let resolved = registry.execute(&encode_resolve(DID)).unwrap();
+        assert_eq!(
+            serde_json::from_slice::<DidDocument>(&resolved).unwrap(),
+            doc
+        );
+        assert_eq!(
+            registry.execute(&encode_lookup_key(&key.public_key().to_address())),
+            Ok(DID.as_bytes().to_vec())
+        );
+        assert_eq!(
+            registry.execute(&encode_lookup_key(&Address::from([9u8; 20]))),
+            Ok(Vec::new())
+        );
+        assert_eq!(
+            registry.execute(&encode_resolve("did:bach:unknown")),
+            Err(DidError::NotFound("did:bach:unknown".to_string()))
+        );
+        assert!(registry.execute(&[0x09]).is_err());
+    }
+
+    #[test]
+    fn test_list_active_dids() {
+        let key = PrivateKey::random();
+        let mut registry = DidRegistry::new();
+        for id in ["did:bach:c", "did:bach:a", "did:bach:b"] {
+            let doc = DidDocument::new(id, 1, [key.public_key().to_address()], vec![]);
+            registry.register(doc.sign(&key)).unwrap();
+        }
+        registry
+            .register(DidDocument::deactivation("did:bach:b", 2).sign(&key))
+            .unwrap();
+
+        let mut list = |request: &PageRequest| {
+            Page::<String>::decode(&registry.execute(&encode_list(request)).unwrap()).unwrap()
+        };
+        let page = list(&PageRequest::first(1));
+        assert_eq!(page.items, vec!["did:bach:a"]);
+        let page = list(&PageRequest::first(1).after(&page).unwrap());
+        assert_eq!(page.items, vec!["did:bach:c"]);
+        assert_eq!(page.next_page_token, None);
+        assert_eq!(list(&PageRequest::default()).items.len(), 2);
+    }
+}
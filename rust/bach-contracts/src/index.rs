@@ -0,0 +1,509 @@
+//! State index registry system contract
+//!
+//! Key-value contracts that store JSON records can declare secondary
+//! indexes over fields of those records, e.g. an index on `age` or on
+//! (`ward`, `admitted`). The commit pipeline keeps each declared index up to
+//! date as the contract's slots are written, so applications can run range
+//! queries over a field instead of scanning every record.
+//!
+//! An index orders records by an index key built from the listed fields, in
+//! order. Numbers and strings are encoded so that comparing keys bytewise
+//! gives the natural order of the values; a record missing a field, or
+//! holding a value of the wrong kind, is left out of the index. Only writes
+//! committed after an index is declared are indexed.
+//!
+//! A contract manages its own indexes: the caller of the registry is the
+//! contract the index belongs to. Contracts call the registry from the
+//! EVM, which records each call as a log naming the calling contract
+//! (`bach_evm::index_call_topic`); nodes run the calls logged in committed
+//! receipts. Calldata is `INDEX_DECLARE || json(spec)` or
+//! `INDEX_DROP || name (utf-8)`.
+
+use crate::ordered::OrderedKv;
+use bach_primitives::{Address, SystemContract};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+/// Registry call: declare an index on the caller's records.
+pub const INDEX_DECLARE: u8 = 0x01;
+/// Registry call: drop one of the caller's indexes.
+pub const INDEX_DROP: u8 = 0x02;
+
+/// Maximum indexes a contract can declare, bounding the work per write.
+pub const MAX_INDEXES_PER_CONTRACT: usize = 8;
+/// Maximum fields in one index.
+pub const MAX_INDEX_FIELDS: usize = 4;
+/// Maximum length of an index name.
+pub const MAX_INDEX_NAME_LEN: usize = 64;
+
+/// Returns the address of the state index registry system contract
+/// (0x…0108).
+pub fn index_registry_address() -> Address {
+    SystemContract::IndexRegistry.address()
+}
+
+/// Errors returned by the index registry.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum IndexError {
+    /// Spec has a bad name or fields
+    InvalidSpec(String),
+    /// Contract already has an index with this name
+    Exists(String),
+    /// Contract has no index with this name
+    NotFound(String),
+    /// Contract already has `MAX_INDEXES_PER_CONTRACT` indexes
+    TooManyIndexes,
+    /// Query bound doesn't match the index fields
+    InvalidBound(String),
+    /// Calldata or a stored spec could not be decoded
+    Malformed(String),
+}
+
+impl std::fmt::Display for IndexError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::InvalidSpec(msg) => write!(f, "invalid index spec: {}", msg),
+            Self::Exists(name) => write!(f, "index already declared: {}", name),
+            Self::NotFound(name) => write!(f, "index not declared: {}", name),
+            Self::TooManyIndexes => write!(
+                f,
+                "contract already has {} indexes",
+                MAX_INDEXES_PER_CONTRACT
+            ),
+            Self::InvalidBound(msg) => write!(f, "invalid index bound: {}", msg),
+            Self::Malformed(msg) => write!(f, "malformed index data: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for IndexError {}
+
+/// Kind of value an index field holds.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum IndexFieldKind {
+    /// JSON number, ordered numerically
+    Number,
+    /// JSON string, ordered bytewise
+    Text,
+}
+
+/// A field of an index.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct IndexField {
+    /// Dotted path of the field in the record, e.g. `patient.age`
+    pub path: String,
+    pub kind: IndexFieldKind,
+}
+
+impl IndexField {
+    /// Creates a number field.
+    pub fn number(path: impl Into<String>) -> Self {
+        Self {
+            path: path.into(),
+            kind: IndexFieldKind::Number,
+        }
+    }
+
+    /// Creates a text field.
+    pub fn text(path: impl Into<String>) -> Self {
+        Self {
+            path: path.into(),
+            kind: IndexFieldKind::Text,
+        }
+    }
+
+    /// Returns the field's value in `record`, if present.
+    fn lookup<'a>(&self, record: &'a Value) -> Option<&'a Value> {
+        self.path
+            .split('.')
+            .try_fold(record, |value, segment| value.get(segment))
+    }
+
+    /// Appends the ordered encoding of `value`, or returns false if it isn't
+    /// of the field's kind.
+    fn encode(&self, value: &Value, key: &mut Vec<u8>) -> bool {
+        match (self.kind, value) {
+            (IndexFieldKind::Number, Value::Number(number)) => match number.as_f64() {
+                Some(number) => {
+                    key.extend_from_slice(&encode_number(number));
+                    true
+                }
+                None => false,
+            },
+            (IndexFieldKind::Text, Value::String(text)) => {
+                encode_text(text, key);
+                true
+            }
+            _ => false,
+        }
+    }
+}
+
+/// Encodes a number so that bytewise order is numeric order.
+fn encode_number(number: f64) -> [u8; 8] {
+    // Adding zero folds -0.0 into 0.0
+    let bits = (number + 0.0).to_bits();
+    let ordered = if bits >> 63 == 1 {
+        !bits
+    } else {
+        bits | 1 << 63
+    };
+    ordered.to_be_bytes()
+}
+
+/// Appends a string so that bytewise order is string order, even when
+/// another field follows: 0x00 bytes are escaped as 0x00 0xff and the
+/// string ends with 0x00 0x01.
+fn encode_text(text: &str, key: &mut Vec<u8>) {
+    for &byte in text.as_bytes() {
+        key.push(byte);
+        if byte == 0x00 {
+            key.push(0xff);
+        }
+    }
+    key.extend_from_slice(&[0x00, 0x01]);
+}
+
+/// A secondary index over a contract's JSON records.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct IndexSpec {
+    /// Name, unique within the contract
+    pub name: String,
+    /// Fields the index orders records by, most significant first
+    pub fields: Vec<IndexField>,
+}
+
+impl IndexSpec {
+    /// Creates a spec.
+    pub fn new(name: impl Into<String>, fields: Vec<IndexField>) -> Self {
+        Self {
+            name: name.into(),
+            fields,
+        }
+    }
+
+    /// Checks the name and fields.
+    pub fn validate(&self) -> Result<(), IndexError> {
+        let valid_name = !self.name.is_empty()
+            && self.name.len() <= MAX_INDEX_NAME_LEN
+            && self
+                .name
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-'));
+        if !valid_name {
+            return Err(IndexError::InvalidSpec(format!("bad name {:?}", self.name)));
+        }
+        if self.fields.is_empty() || self.fields.len() > MAX_INDEX_FIELDS {
+            return Err(IndexError::InvalidSpec(format!(
+                "{} fields, expected 1 to {}",
+                self.fields.len(),
+                MAX_INDEX_FIELDS
+            )));
+        }
+        if let Some(field) = self
+            .fields
+            .iter()
+            .find(|field| field.path.split('.').any(str::is_empty))
+        {
+            return Err(IndexError::InvalidSpec(format!(
+                "bad field path {:?}",
+                field.path
+            )));
+        }
+        Ok(())
+    }
+
+    /// Returns the index key of a record, or None if the record isn't JSON
+    /// or lacks one of the fields.
+    pub fn index_key(&self, record: &[u8]) -> Option<Vec<u8>> {
+        let record: Value = serde_json::from_slice(record).ok()?;
+        let mut key = Vec::new();
+        for field in &self.fields {
+            if !field.encode(field.lookup(&record)?, &mut key) {
+                return None;
+            }
+        }
+        Some(key)
+    }
+
+    /// Encodes a query bound given as values of the leading fields. A bound
+    /// with fewer values than fields covers every key starting with them.
+    pub fn encode_bound(&self, values: &[Value]) -> Result<Vec<u8>, IndexError> {
+        if values.len() > self.fields.len() {
+            return Err(IndexError::InvalidBound(format!(
+                "{} values for {} fields",
+                values.len(),
+                self.fields.len()
+            )));
+        }
+        let mut key = Vec::new();
+        for (field, value) in self.fields.iter().zip(values) {
+            if !field.encode(value, &mut key) {
+                return Err(IndexError::InvalidBound(format!(
+                    "{} is not a {:?} value for {}",
+                    value, field.kind, field.path
+                )));
+            }
+        }
+        Ok(key)
+    }
+
+    /// Encodes the spec for storage or as calldata.
+    pub fn encode(&self) -> Vec<u8> {
+        serde_json::to_vec(self).expect("index spec serializes")
+    }
+
+    /// Decodes a spec produced by `encode`.
+    pub fn decode(data: &[u8]) -> Result<Self, IndexError> {
+        serde_json::from_slice(data).map_err(|e| IndexError::Malformed(e.to_string()))
+    }
+}
+
+/// Encodes `INDEX_DECLARE` calldata.
+pub fn encode_declare(spec: &IndexSpec) -> Vec<u8> {
+    let mut data = vec![INDEX_DECLARE];
+    data.extend(spec.encode());
+    data
+}
+
+/// Encodes `INDEX_DROP` calldata.
+pub fn encode_drop(name: &str) -> Vec<u8> {
+    let mut data = vec![INDEX_DROP];
+    data.extend_from_slice(name.as_bytes());
+    data
+}
+
+/// A change made by a registry call.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum IndexChange {
+    /// The contract declared an index
+    Declared(IndexSpec),
+    /// The contract dropped the named index
+    Dropped(String),
+}
+
+/// Native index registry state: the indexes each contract declared.
+#[derive(Debug, Clone, Default)]
+pub struct IndexRegistry {
+    specs: OrderedKv<Address, OrderedKv<String, IndexSpec>>,
+}
+
+impl IndexRegistry {
+    /// Creates an empty registry.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Declares an index on `contract`'s records.
+    pub fn declare(&mut self, contract: Address, spec: IndexSpec) -> Result<(), IndexError> {
+        spec.validate()?;
+        let specs = self.specs.get_or_insert_default(contract);
+        if specs.contains_key(&spec.name) {
+            return Err(IndexError::Exists(spec.name));
+        }
+        if specs.len() >= MAX_INDEXES_PER_CONTRACT {
+            return Err(IndexError::TooManyIndexes);
+        }
+        specs.insert(spec.name.clone(), spec);
+        Ok(())
+    }
+
+    /// Drops one of `contract`'s indexes, returning its spec.
+    pub fn remove(&mut self, contract: &Address, name: &str) -> Result<IndexSpec, IndexError> {
+        let specs = self
+            .specs
+            .get_mut(contract)
+            .ok_or_else(|| IndexError::NotFound(name.to_string()))?;
+        let spec = specs
+            .remove(name)
+            .ok_or_else(|| IndexError::NotFound(name.to_string()))?;
+        if specs.is_empty() {
+            self.specs.remove(contract);
+        }
+        Ok(spec)
+    }
+
+    /// Returns one of `contract`'s indexes.
+    pub fn get(&self, contract: &Address, name: &str) -> Option<&IndexSpec> {
+        self.specs.get(contract)?.get(name)
+    }
+
+    /// Returns the indexes `contract` declared.
+    pub fn specs(&self, contract: &Address) -> impl Iterator<Item = &IndexSpec> {
+        self.specs
+            .get(contract)
+            .into_iter()
+            .flat_map(|specs| specs.values())
+    }
+
+    /// Returns true if no contract declared an index.
+    pub fn is_empty(&self) -> bool {
+        self.specs.is_empty()
+    }
+
+    /// Executes a call to the registry on behalf of `caller`, returning the
+    /// change to persist.
+    pub fn execute(&mut self, caller: Address, data: &[u8]) -> Result<IndexChange, IndexError> {
+        let (&call, payload) = data
+            .split_first()
+            .ok_or_else(|| IndexError::Malformed("empty calldata".to_string()))?;
+        match call {
+            INDEX_DECLARE => {
+                let spec = IndexSpec::decode(payload)?;
+                self.declare(caller, spec.clone())?;
+                Ok(IndexChange::Declared(spec))
+            }
+            INDEX_DROP => {
+                let name = std::str::from_utf8(payload)
+                    .map_err(|_| IndexError::Malformed("name is not utf-8".to_string()))?;
+                self.remove(&caller, name)?;
+                Ok(IndexChange::Dropped(name.to_string()))
+            }
+            _ => Err(IndexError::Malformed(format!(
+                "unknown call 0x{:02x}",
+                call
+            ))),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn contract(n: u8) -> Address {
+        Address::from([n; 20])
+    }
+
+    fn by_age() -> IndexSpec {
+        IndexSpec::new("by_age", vec![IndexField::number("age")])
+    }
+
+    fn key(spec: &IndexSpec, record: Value) -> Option<Vec<u8>> {
+        spec.index_key(&serde_json::to_vec(&record).unwrap())
+    }
+
+    #[test]
+    fn test_number_keys_sort_numerically() {
+        let spec = by_age();
+        let ages = [-12.5, -1.0, 0.0, 0.25, 3.0, 42.0, 1e9];
+        let keys: Vec<Vec<u8>> = ages
+            .iter()
+            .map(|age| key(&spec, json!({ "age": age })).unwrap())
+            .collect();
+        assert!(keys.windows(2).all(|pair| pair[0] < pair[1]));
+        assert_eq!(
+            key(&spec, json!({ "age": -0.0 })),
+            key(&spec, json!({ "age": 0 }))
+        );
+    }
+
+    #[test]
+    fn test_composite_keys_sort_field_by_field() {
+        let spec = IndexSpec::new(
+            "by_ward",
+            vec![IndexField::text("ward.name"), IndexField::number("bed")],
+        );
+        let records = [
+            json!({ "ward": { "name": "a" }, "bed": 9 }),
+            json!({ "ward": { "name": "a\u{0}" }, "bed": 1 }),
+            json!({ "ward": { "name": "ab" }, "bed": 1 }),
+            json!({ "ward": { "name": "ab" }, "bed": 2 }),
+            json!({ "ward": { "name": "b" }, "bed": 0 }),
+        ];
+        let keys: Vec<Vec<u8>> = records
+            .into_iter()
+            .map(|record| key(&spec, record).unwrap())
+            .collect();
+        assert!(keys.windows(2).all(|pair| pair[0] < pair[1]));
+
+        // A bound on the leading field prefixes every key under it
+        let bound = spec.encode_bound(&[json!("ab")]).unwrap();
+        assert!(keys[2].starts_with(&bound) && keys[3].starts_with(&bound));
+        assert!(!keys[0].starts_with(&bound));
+        assert!(spec.encode_bound(&[json!(1)]).is_err());
+        assert!(spec
+            .encode_bound(&[json!("a"), json!(1), json!(2)])
+            .is_err());
+    }
+
+    #[test]
+    fn test_unindexable_records() {
+        let spec = by_age();
+        assert!(key(&spec, json!({ "name": "x" })).is_none());
+        assert!(key(&spec, json!({ "age": "42" })).is_none());
+        assert!(spec.index_key(b"not json").is_none());
+        assert!(spec.index_key(&[]).is_none());
+    }
+
+    #[test]
+    fn test_declare_and_drop() {
+        let mut registry = IndexRegistry::new();
+        registry.declare(contract(1), by_age()).unwrap();
+        assert_eq!(
+            registry.declare(contract(1), by_age()),
+            Err(IndexError::Exists("by_age".to_string()))
+        );
+        registry.declare(contract(2), by_age()).unwrap();
+        assert!(registry
+            .declare(
+                contract(1),
+                IndexSpec::new("bad name", vec![IndexField::number("a")])
+            )
+            .is_err());
+        assert!(registry
+            .declare(contract(1), IndexSpec::new("empty", Vec::new()))
+            .is_err());
+        assert!(registry
+            .declare(
+                contract(1),
+                IndexSpec::new("path", vec![IndexField::text("a..b")])
+            )
+            .is_err());
+
+        for n in 1..MAX_INDEXES_PER_CONTRACT {
+            let spec = IndexSpec::new(format!("i{}", n), vec![IndexField::number("a")]);
+            registry.declare(contract(1), spec).unwrap();
+        }
+        let spec = IndexSpec::new("one_more", vec![IndexField::number("a")]);
+        assert_eq!(
+            registry.declare(contract(1), spec),
+            Err(IndexError::TooManyIndexes)
+        );
+
+        assert_eq!(registry.remove(&contract(2), "by_age"), Ok(by_age()));
+        assert!(registry.get(&contract(2), "by_age").is_none());
+        assert_eq!(registry.specs(&contract(2)).count(), 0);
+        assert_eq!(
+            registry.remove(&contract(2), "by_age"),
+            Err(IndexError::NotFound("by_age".to_string()))
+        );
+        assert!(registry.get(&contract(1), "by_age").is_some());
+    }
+
+    #[test]
+    fn test_execute_calls() {
+        let mut registry = IndexRegistry::new();
+        assert_eq!(
+            registry.execute(contract(1), &encode_declare(&by_age())),
+            Ok(IndexChange::Declared(by_age()))
+        );
+        assert_eq!(registry.specs(&contract(1)).count(), 1);
+
+        // Callers only drop their own indexes
+        assert!(registry
+            .execute(contract(2), &encode_drop("by_age"))
+            .is_err());
+        assert_eq!(
+            registry.execute(contract(1), &encode_drop("by_age")),
+            Ok(IndexChange::Dropped("by_age".to_string()))
+        );
+        assert!(registry.is_empty());
+        assert!(registry
+            .execute(contract(1), &[INDEX_DECLARE, b'{'])
+            .is_err());
+        assert!(registry.execute(contract(1), &[0x09]).is_err());
+    }
+}
@@ -4,6 +4,19 @@
 //! - Simple storage contract for testing
 //! - Medical record management patterns
 //! - Access control utilities
+//! - Multi-sign system contract with deadlines, vetoes and expiry, voted
+//!   on by the chain config's signers
+//! - Chain config system contract with versioned history, org admin key
+//!   rotation, per-org storage isolation settings and protocol feature
+//!   activation
+//! - Member key revocation registry system contract
+//! - DID registry system contract for DID-based members, with controller
+//!   ACL, service endpoints, deactivation and change events
+//! - State index registry system contract for secondary indexes over JSON
+//!   records of key-value contracts
+//! - Paged list queries shared by the system contracts
+//! - Ordered key-value state for the system contracts, so every node
+//!   iterates it in the same order
 //!
 //! # Usage
 //!
@@ -25,6 +38,54 @@
 use bach_primitives::{Address, H256, U256};
 use bach_crypto::keccak256;
 
+pub mod chain_config;
+pub mod did;
+pub mod index;
+pub mod multisign;
+pub mod ordered;
+pub mod page;
+pub mod revocation;
+
+pub use chain_config::{
+    chain_config_address, diff as diff_chain_config, encode_endorse_rotation,
+    encode_get_config_at, encode_list_versions as encode_list_chain_config_versions,
+    encode_signal_features, encode_simulate_endorsement, encode_stage_rotation, encode_update,
+    is_feature_name, revert_update, ChainConfig, ChainConfigContract, ChainConfigError,
+    ChainConfigVersion, ConfigChange, FeatureActivation, KeyRotation, PolicyEvaluation,
+    RotationRequest, SimulationRequest, ACL_RESOURCE_PREFIX, ADMIN_PARAM_PREFIX,
+    CONFIG_ENDORSE_ROTATION, CONFIG_PARAMS, CONFIG_RESOURCE, CONFIG_SIGNAL_FEATURES,
+    CONFIG_STAGE_ROTATION, CONFIG_UPDATE, GET_CHAIN_CONFIG_AT, LIST_CHAIN_CONFIG_VERSIONS,
+    MAX_FEATURE_NAME_LEN, MEMBERS_PARAM_PREFIX, NODES_PARAM_PREFIX, OrgNode,
+    PAUSE_RESOURCE_PREFIX, PROTOCOL_FEATURES, ROTATION_RESOURCE_PREFIX, SIMULATE_ENDORSEMENT,
+};
+pub use did::{
+    did_registry_address, encode_list as encode_did_list,
+    encode_lookup_key as encode_did_lookup_key, encode_register as encode_did_register,
+    encode_resolve as encode_did_resolve, is_did, validate_did, DidDocument, DidError, DidEvent,
+    DidRegistry, ServiceEndpoint, SignedDidDocument, DID_LIST, DID_LOOKUP_KEY, DID_PREFIX,
+    DID_REGISTER, DID_RESOLVE,
+};
+pub use index::{
+    encode_declare as encode_index_declare, encode_drop as encode_index_drop,
+    index_registry_address, IndexChange, IndexError, IndexField, IndexFieldKind, IndexRegistry,
+    IndexSpec, INDEX_DECLARE, INDEX_DROP, MAX_INDEXES_PER_CONTRACT, MAX_INDEX_FIELDS,
+    MAX_INDEX_NAME_LEN,
+};
+pub use multisign::{
+    encode_approve as encode_multi_sign_approve, encode_get as encode_multi_sign_get,
+    encode_list as encode_multi_sign_list, encode_propose as encode_multi_sign_propose,
+    encode_reject as encode_multi_sign_reject, multi_sign_address, MultiSign, MultiSignError,
+    MultiSignProposal, ProposalStatus, CLOSED_PROPOSAL_RETENTION, MULTI_SIGN_APPROVE,
+    MULTI_SIGN_GET, MULTI_SIGN_LIST, MULTI_SIGN_PROPOSE, MULTI_SIGN_REJECT,
+};
+pub use page::{Page, PageRequest, DEFAULT_PAGE_LIMIT, MAX_PAGE_LIMIT};
+pub use revocation::{
+    encode_list as encode_revocation_list, encode_query as encode_revocation_query,
+    encode_upload as encode_revocation_upload, revocation_registry_address,
+    ActiveRevocationList, RevocationError, RevocationList, RevocationRegistry, SignedRevocationList,
+    REVOCATION_LIST, REVOCATION_QUERY, REVOCATION_UPLOAD,
+};
+
 // =============================================================================
 // Simple Storage Contract
 // =============================================================================
@@ -0,0 +1,617 @@
+//! Multi-sign native contract
+//!
+//! The accounts in the chain config `multi_sign_signers` parameter vote on
+//! proposals. A proposal is approved once a majority of them approve it,
+//! vetoed once enough reject it that a majority can no longer approve, and
+//! expires if neither happens by its deadline height. The payload is
+//! opaque: the contract records the decision and leaves acting on an
+//! approved payload to whoever reads it.
+//!
+//! Nodes run the calls in committed blocks and then call
+//! [`MultiSign::expire`] for the next height, so every node expires the
+//! same proposals. Decided and expired proposals stay queryable for
+//! [`CLOSED_PROPOSAL_RETENTION`] blocks before they're pruned.
+//!
+//! Calldata is `MULTI_SIGN_PROPOSE || deadline (8 bytes) || payload`,
+//! `MULTI_SIGN_APPROVE || id (8 bytes)`, `MULTI_SIGN_REJECT || id (8 bytes)`,
+//! `MULTI_SIGN_GET || id (8 bytes)` or `MULTI_SIGN_LIST || json(page
+//! request)`, which pages through the open proposals by id. Numbers are
+//! big-endian.
+
+use crate::ordered::OrderedKv;
+use crate::page::PageRequest;
+use bach_primitives::{Address, SystemContract};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+
+/// Contract call: create a proposal.
+pub const MULTI_SIGN_PROPOSE: u8 = 0x01;
+/// Contract call: approve a proposal.
+pub const MULTI_SIGN_APPROVE: u8 = 0x02;
+/// Contract call: reject a proposal.
+pub const MULTI_SIGN_REJECT: u8 = 0x03;
+/// Contract call: read a proposal.
+pub const MULTI_SIGN_GET: u8 = 0x04;
+/// Contract call: list a page of open proposals.
+pub const MULTI_SIGN_LIST: u8 = 0x05;
+
+/// Blocks a closed proposal stays queryable before it's pruned.
+pub const CLOSED_PROPOSAL_RETENTION: u64 = 1024;
+
+/// Returns the address of the multi-sign native contract (0x…0103).
+pub fn multi_sign_address() -> Address {
+    SystemContract::MultiSign.address()
+}
+
+/// Errors returned by the multi-sign contract.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum MultiSignError {
+    /// Caller is not one of the signers
+    NotSigner(Address),
+    /// Thresholds are zero or larger than the signer set
+    InvalidThreshold,
+    /// Deadline is not after the current height
+    InvalidDeadline { height: u64, deadline: u64 },
+    /// No proposal with this id
+    UnknownProposal(u64),
+    /// Proposal is no longer open
+    NotOpen(u64),
+    /// Signer already voted on this proposal
+    AlreadyVoted(Address),
+    /// Calldata or stored state could not be decoded
+    Malformed(String),
+}
+
+impl std::fmt::Display for MultiSignError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::NotSigner(address) => write!(f, "{} is not a multi-sign signer", address),
+            Self::InvalidThreshold => write!(f, "invalid multi-sign threshold"),
+            Self::InvalidDeadline { height, deadline } => write!(
+                f,
+                "deadline {} is not after height {}",
+                deadline, height
+            ),
+            Self::UnknownProposal(id) => write!(f, "unknown proposal {}", id),
+            Self::NotOpen(id) => write!(f, "proposal {} is not open", id),
+            Self::AlreadyVoted(signer) => write!(f, "{} already voted", signer),
+            Self::Malformed(msg) => write!(f, "malformed multi-sign data: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for MultiSignError {}
+
+/// Lifecycle state of a proposal.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum ProposalStatus {
+    /// Accepting votes
+    Open,
+    /// Reached the approval threshold
+    Approved,
+    /// Reached the veto threshold
+    Vetoed,
+    /// Deadline passed without a decision
+    Expired,
+}
+
+/// A multi-sign proposal.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MultiSignProposal {
+    /// Proposal id
+    pub id: u64,
+    /// Signer that created the proposal
+    pub proposer: Address,
+    /// Opaque payload to execute once approved
+    pub payload: Vec<u8>,
+    /// Height the proposal was created at
+    pub created_at: u64,
+    /// Last height at which votes are accepted
+    pub deadline: u64,
+    /// Signers that approved
+    pub approvals: BTreeSet<Address>,
+    /// Signers that rejected
+    pub rejections: BTreeSet<Address>,
+    /// Current status
+    pub status: ProposalStatus,
+    /// Height the proposal was decided or expired at, None while open
+    pub closed_at: Option<u64>,
+}
+
+impl MultiSignProposal {
+    /// Encodes the proposal as a query result.
+    pub fn encode(&self) -> Vec<u8> {
+        serde_json::to_vec(&EncodedProposal::from(self)).expect("proposal serializes")
+    }
+
+    /// Decodes a proposal produced by `encode`.
+    pub fn decode(data: &[u8]) -> Result<Self, MultiSignError> {
+        serde_json::from_slice::<EncodedProposal>(data)
+            .map(Self::from)
+            .map_err(|e| MultiSignError::Malformed(e.to_string()))
+    }
+}
+
+/// Serialized form of a proposal, with raw addresses.
+#[derive(Debug, Serialize, Deserialize)]
+struct EncodedProposal {
+    id: u64,
+    proposer: [u8; 20],
+    payload: Vec<u8>,
+    created_at: u64,
+    deadline: u64,
+    approvals: Vec<[u8; 20]>,
+    rejections: Vec<[u8; 20]>,
+    status: ProposalStatus,
+    #[serde(default)]
+    closed_at: Option<u64>,
+}
+
+impl From<&MultiSignProposal> for EncodedProposal {
+    fn from(p: &MultiSignProposal) -> Self {
+        Self {
+            id: p.id,
+            proposer: *p.proposer.as_bytes(),
+            payload: p.payload.clone(),
+            created_at: p.created_at,
+            deadline: p.deadline,
+            approvals: p.approvals.iter().map(|a| *a.as_bytes()).collect(),
+            rejections: p.rejections.iter().map(|a| *a.as_bytes()).collect(),
+            status: p.status,
+            closed_at: p.closed_at,
+        }
+    }
+}
+
+impl From<EncodedProposal> for MultiSignProposal {
+    fn from(p: EncodedProposal) -> Self {
+        Self {
+            id: p.id,
+            proposer: Address::from(p.proposer),
+            payload: p.payload,
+            created_at: p.created_at,
+            deadline: p.deadline,
+            approvals: p.approvals.into_iter().map(Address::from).collect(),
+            rejections: p.rejections.into_iter().map(Address::from).collect(),
+            status: p.status,
+            closed_at: p.closed_at,
+        }
+    }
+}
+
+/// Proposals and the next proposal id, as nodes store them.
+#[derive(Debug, Serialize, Deserialize)]
+struct StoredProposals {
+    next_id: u64,
+    proposals: Vec<EncodedProposal>,
+}
+
+/// Encodes `MULTI_SIGN_PROPOSE` calldata.
+pub fn encode_propose(deadline: u64, payload: &[u8]) -> Vec<u8> {
+    let mut data = vec![MULTI_SIGN_PROPOSE];
+    data.extend_from_slice(&deadline.to_be_bytes());
+    data.extend_from_slice(payload);
+    data
+}
+
+/// Encodes `MULTI_SIGN_APPROVE` calldata.
+pub fn encode_approve(id: u64) -> Vec<u8> {
+    [&[MULTI_SIGN_APPROVE][..], &id.to_be_bytes()].concat()
+}
+
+/// Encodes `MULTI_SIGN_REJECT` calldata.
+pub fn encode_reject(id: u64) -> Vec<u8> {
+    [&[MULTI_SIGN_REJECT][..], &id.to_be_bytes()].concat()
+}
+
+/// Encodes `MULTI_SIGN_GET` calldata.
+pub fn encode_get(id: u64) -> Vec<u8> {
+    [&[MULTI_SIGN_GET][..], &id.to_be_bytes()].concat()
+}
+
+/// Encodes `MULTI_SIGN_LIST` calldata.
+pub fn encode_list(request: &PageRequest) -> Vec<u8> {
+    let mut data = vec![MULTI_SIGN_LIST];
+    data.extend(request.encode());
+    data
+}
+
+/// Native multi-sign contract state.
+#[derive(Debug, Clone, Default)]
+pub struct MultiSign {
+    signers: BTreeSet<Address>,
+    approve_threshold: usize,
+    veto_threshold: usize,
+    proposals: OrderedKv<u64, MultiSignProposal>,
+    next_id: u64,
+}
+
+impl MultiSign {
+    /// Creates the contract with signers deciding by majority, as
+    /// [`MultiSign::set_signers`] sets them.
+    pub fn with_signers(signers: impl IntoIterator<Item = Address>) -> Self {
+        let mut contract = Self::default();
+        contract.set_signers(signers);
+        contract
+    }
+
+    /// Replaces the signers, e.g. when chain config changes them. A
+    /// majority approves and enough rejections that a majority can no
+    /// longer approve veto. Votes already cast are kept.
+    pub fn set_signers(&mut self, signers: impl IntoIterator<Item = Address>) {
+        self.signers = signers.into_iter().collect();
+        self.approve_threshold = self.signers.len() / 2 + 1;
+        self.veto_threshold = self.signers.len() + 1 - self.approve_threshold;
+    }
+
+    /// Creates the contract with a signer set and approval/veto thresholds.
+    pub fn new(
+        signers: impl IntoIterator<Item = Address>,
+        approve_threshold: usize,
+        veto_threshold: usize,
+    ) -> Result<Self, MultiSignError> {
+        let signers: BTreeSet<Address> = signers.into_iter().collect();
+        for threshold in [approve_threshold, veto_threshold] {
+            if threshold == 0 || threshold > signers.len() {
+                return Err(MultiSignError::InvalidThreshold);
+            }
+        }
+        Ok(Self {
+            signers,
+            approve_threshold,
+            veto_threshold,
+            proposals: OrderedKv::new(),
+            next_id: 0,
+        })
+    }
+
+    /// Creates a proposal that accepts votes until `deadline` (inclusive).
+    pub fn propose(
+        &mut self,
+        proposer: Address,
+        payload: Vec<u8>,
+        height: u64,
+        deadline: u64,
+    ) -> Result<u64, MultiSignError> {
+        self.check_signer(&proposer)?;
+        if deadline <= height {
+            return Err(MultiSignError::InvalidDeadline { height, deadline });
+        }
+
+        let id = self.next_id;
+        self.next_id += 1;
+        self.proposals.insert(
+            id,
+            MultiSignProposal {
+                id,
+                proposer,
+                payload,
+                created_at: height,
+                deadline,
+                approvals: BTreeSet::new(),
+                rejections: BTreeSet::new(),
+                status: ProposalStatus::Open,
+                closed_at: None,
+            },
+        );
+        Ok(id)
+    }
+
+    /// Records an approval and returns the resulting status.
+    pub fn approve(
+        &mut self,
+        id: u64,
+        signer: Address,
+        height: u64,
+    ) -> Result<ProposalStatus, MultiSignError> {
+        self.vote(id, signer, height, true)
+    }
+
+    /// Records a rejection and returns the resulting status.
+    pub fn reject(
+        &mut self,
+        id: u64,
+        signer: Address,
+        height: u64,
+    ) -> Result<ProposalStatus, MultiSignError> {
+        self.vote(id, signer, height, false)
+    }
+
+    fn vote(
+        &mut self,
+        id: u64,
+        signer: Address,
+        height: u64,
+        approve: bool,
+    ) -> Result<ProposalStatus, MultiSignError> {
+        self.check_signer(&signer)?;
+        let proposal = self
+            .proposals
+            .get_mut(&id)
+            .ok_or(MultiSignError::UnknownProposal(id))?;
+        if proposal.status != ProposalStatus::Open || height > proposal.deadline {
+            return Err(MultiSignError::NotOpen(id));
+        }
+        if proposal.approvals.contains(&signer) || proposal.rejections.contains(&signer) {
+            return Err(MultiSignError::AlreadyVoted(signer));
+        }
+
+        if approve {
+            proposal.approvals.insert(signer);
+            if proposal.approvals.len() >= self.approve_threshold {
+                proposal.status = ProposalStatus::Approved;
+            }
+        } else {
+            proposal.rejections.insert(signer);
+            if proposal.rejections.len() >= self.veto_threshold {
+                proposal.status = ProposalStatus::Vetoed;
+            }
+        }
+        if proposal.status != ProposalStatus::Open {
+            proposal.closed_at = Some(height);
+        }
+        Ok(proposal.status)
+    }
+
+    /// Expires open proposals whose deadline is before `height` and prunes
+    /// proposals closed more than [`CLOSED_PROPOSAL_RETENTION`] blocks
+    /// before it. Returns the ids of the proposals that expired.
+    ///
+    /// Nodes call it for the next height after running a committed
+    /// block's calls.
+    pub fn expire(&mut self, height: u64) -> Vec<u64> {
+        let mut expired = Vec::new();
+        for proposal in self.proposals.values_mut() {
+            if proposal.status == ProposalStatus::Open && height > proposal.deadline {
+                proposal.status = ProposalStatus::Expired;
+                proposal.closed_at = Some(height);
+                expired.push(proposal.id);
+            }
+        }
+        self.proposals.retain(|_, proposal| match proposal.closed_at {
+            Some(closed) => height.saturating_sub(closed) <= CLOSED_PROPOSAL_RETENTION,
+            None => true,
+        });
+        expired
+    }
+
+    /// Executes a call from `sender` at `height`. Proposing returns the new
+    /// id (8 bytes), voting the resulting status as one byte (0 open,
+    /// 1 approved, 2 vetoed), reading a JSON proposal and listing a JSON
+    /// page of open proposals.
+    pub fn execute(
+        &mut self,
+        data: &[u8],
+        sender: Address,
+        height: u64,
+    ) -> Result<Vec<u8>, MultiSignError> {
+        let (&call, payload) = data
+            .split_first()
+            .ok_or_else(|| MultiSignError::Malformed("empty calldata".to_string()))?;
+        let number = |bytes: &[u8]| {
+            bytes
+                .try_into()
+                .map(u64::from_be_bytes)
+                .map_err(|_| MultiSignError::Malformed("expected 8 bytes".to_string()))
+        };
+        let status_byte = |status: ProposalStatus| vec![status as u8];
+        match call {
+            MULTI_SIGN_PROPOSE if payload.len() >= 8 => {
+                let deadline = number(&payload[..8])?;
+                self.propose(sender, payload[8..].to_vec(), height, deadline)
+                    .map(|id| id.to_be_bytes().to_vec())
+            }
+            MULTI_SIGN_APPROVE => self.approve(number(payload)?, sender, height).map(status_byte),
+            MULTI_SIGN_REJECT => self.reject(number(payload)?, sender, height).map(status_byte),
+            MULTI_SIGN_GET => {
+                let id = number(payload)?;
+                self.get(id)
+                    .map(MultiSignProposal::encode)
+                    .ok_or(MultiSignError::UnknownProposal(id))
+            }
+            MULTI_SIGN_LIST => {
+                let open = self
+                    .open_proposals(height)
+                    .into_iter()
+                    .map(|p| (p.id.to_be_bytes(), EncodedProposal::from(p)));
+                PageRequest::decode(payload)
+                    .and_then(|request| request.paginate(open))
+                    .map(|page| page.encode())
+                    .map_err(MultiSignError::Malformed)
+            }
+            _ => Err(MultiSignError::Malformed(format!(
+                "unknown call 0x{:02x}",
+                call
+            ))),
+        }
+    }
+
+    /// Encodes the proposals for storage. Signers come from chain config
+    /// and aren't included.
+    pub fn encode(&self) -> Vec<u8> {
+        let stored = StoredProposals {
+            next_id: self.next_id,
+            proposals: self.proposals.values().map(EncodedProposal::from).collect(),
+        };
+        serde_json::to_vec(&stored).expect("proposals serialize")
+    }
+
+    /// Restores proposals produced by `encode`.
+    pub fn restore(&mut self, data: &[u8]) -> Result<(), MultiSignError> {
+        let stored: StoredProposals =
+            serde_json::from_slice(data).map_err(|e| MultiSignError::Malformed(e.to_string()))?;
+        self.next_id = stored.next_id;
+        self.proposals = stored
+            .proposals
+            .into_iter()
+            .map(|p| (p.id, MultiSignProposal::from(p)))
+            .collect();
+        Ok(())
+    }
+
+    /// Returns a proposal by id.
+    pub fn get(&self, id: u64) -> Option<&MultiSignProposal> {
+        self.proposals.get(&id)
+    }
+
+    /// Returns open proposals that still accept votes at `height`, ordered by id.
+    pub fn open_proposals(&self, height: u64) -> Vec<&MultiSignProposal> {
+        self.proposals
+            .values()
+            .filter(|p| p.status == ProposalStatus::Open && height <= p.deadline)
+            .collect()
+    }
+
+    /// Returns the signer set.
+    pub fn signers(&self) -> &BTreeSet<Address> {
+        &self.signers
+    }
+
+    fn check_signer(&self, address: &Address) -> Result<(), MultiSignError> {
+        if self.signers.contains(address) {
+            Ok(())
+        } else {
+            Err(MultiSignError::NotSigner(*address))
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn signers() -> Vec<Address> {
+        (1..=3u8).map(|i| Address::from([i; 20])).collect()
+    }
+
+    #[test]
+    fn test_approve_and_veto() {
+        let s = signers();
+        let mut ms = MultiSign::new(s.clone(), 2, 2).unwrap();
+
+        let a = ms.propose(s[0], b"a".to_vec(), 1, 10).unwrap();
+        assert_eq!(ms.approve(a, s[0], 2).unwrap(), ProposalStatus::Open);
+        assert_eq!(ms.approve(a, s[0], 2), Err(MultiSignError::AlreadyVoted(s[0])));
+        assert_eq!(ms.approve(a, s[1], 2).unwrap(), ProposalStatus::Approved);
+        assert_eq!(ms.reject(a, s[2], 3), Err(MultiSignError::NotOpen(a)));
+
+        let b = ms.propose(s[1], b"b".to_vec(), 1, 10).unwrap();
+        ms.approve(b, s[0], 2).unwrap();
+        ms.reject(b, s[1], 2).unwrap();
+        assert_eq!(ms.reject(b, s[2], 2).unwrap(), ProposalStatus::Vetoed);
+
+        let outsider = Address::from([9u8; 20]);
+        assert_eq!(
+            ms.propose(outsider, vec![], 1, 10),
+            Err(MultiSignError::NotSigner(outsider))
+        );
+    }
+
+    #[test]
+    fn test_deadline_and_expiry() {
+        let s = signers();
+        let mut ms = MultiSign::new(s.clone(), 2, 2).unwrap();
+        assert!(matches!(
+            ms.propose(s[0], vec![], 5, 5),
+            Err(MultiSignError::InvalidDeadline { .. })
+        ));
+
+        let early = ms.propose(s[0], vec![], 1, 3).unwrap();
+        let late = ms.propose(s[0], vec![], 1, 8).unwrap();
+        let done = ms.propose(s[0], vec![], 1, 8).unwrap();
+        ms.approve(done, s[0], 2).unwrap();
+        ms.approve(done, s[1], 2).unwrap();
+
+        let open: Vec<u64> = ms.open_proposals(3).iter().map(|p| p.id).collect();
+        assert_eq!(open, vec![early, late]);
+
+        // Votes after the deadline are refused even before cleanup runs
+        assert_eq!(ms.approve(early, s[1], 4), Err(MultiSignError::NotOpen(early)));
+
+        assert_eq!(ms.expire(4), vec![early]);
+        assert_eq!(ms.get(early).unwrap().status, ProposalStatus::Expired);
+        assert_eq!(ms.get(done).unwrap().status, ProposalStatus::Approved);
+        assert_eq!(ms.get(late).unwrap().status, ProposalStatus::Open);
+
+        // Closed proposals stay queryable for the retention window
+        assert_eq!(ms.expire(2 + CLOSED_PROPOSAL_RETENTION), vec![late]);
+        assert!(ms.get(done).is_some());
+        ms.expire(3 + CLOSED_PROPOSAL_RETENTION);
+        assert!(ms.get(done).is_none());
+        assert_eq!(ms.get(early).unwrap().status, ProposalStatus::Expired);
+        ms.expire(5 + CLOSED_PROPOSAL_RETENTION);
+        assert!(ms.get(early).is_none());
+        assert_eq!(ms.get(late).unwrap().status, ProposalStatus::Expired);
+    }
+
+    #[test]
+    fn test_execute_calls_and_restore() {
+        let s = signers();
+        let mut ms = MultiSign::with_signers(s.clone());
+
+        let id = ms.execute(&encode_propose(10, b"pay"), s[0], 1).unwrap();
+        let id = u64::from_be_bytes(id.try_into().unwrap());
+        assert_eq!(ms.execute(&encode_approve(id), s[0], 2).unwrap(), vec![0]);
+        // Two of three signers are a majority
+        assert_eq!(ms.execute(&encode_approve(id), s[1], 2).unwrap(), vec![1]);
+        let proposal = MultiSignProposal::decode(&ms.execute(&encode_get(id), s[2], 3).unwrap());
+        assert_eq!(proposal.unwrap().payload, b"pay".to_vec());
+
+        // Two rejections leave no majority to approve
+        let vetoed = ms.propose(s[0], vec![], 3, 10).unwrap();
+        ms.execute(&encode_reject(vetoed), s[1], 4).unwrap();
+        assert_eq!(ms.execute(&encode_reject(vetoed), s[2], 4).unwrap(), vec![2]);
+
+        let open = ms.propose(s[2], vec![], 4, 10).unwrap();
+        let page = ms.execute(&encode_list(&PageRequest::default()), s[0], 5).unwrap();
+        let page: crate::page::Page<serde_json::Value> = serde_json::from_slice(&page).unwrap();
+        assert_eq!(page.items.len(), 1);
+        assert_eq!(page.items[0]["id"], open);
+
+        assert!(matches!(
+            ms.execute(&[MULTI_SIGN_APPROVE, 1], s[0], 5),
+            Err(MultiSignError::Malformed(_))
+        ));
+        assert!(matches!(ms.execute(&[0xff], s[0], 5), Err(MultiSignError::Malformed(_))));
+
+        // Restored state keeps proposals and continues the ids
+        let mut restored = MultiSign::with_signers(s.clone());
+        restored.restore(&ms.encode()).unwrap();
+        assert_eq!(restored.get(id), ms.get(id));
+        assert_eq!(restored.propose(s[0], vec![], 5, 10).unwrap(), open + 1);
+    }
+
+    #[test]
+    fn test_set_signers_majority() {
+        let mut ms = MultiSign::default();
+        let outsider = Address::from([9u8; 20]);
+        assert_eq!(
+            ms.propose(outsider, vec![], 1, 10),
+            Err(MultiSignError::NotSigner(outsider))
+        );
+
+        let mut four: Vec<Address> = signers();
+        four.push(outsider);
+        ms.set_signers(four.clone());
+        let id = ms.propose(four[0], vec![], 1, 10).unwrap();
+        ms.approve(id, four[0], 2).unwrap();
+        ms.approve(id, four[1], 2).unwrap();
+        assert_eq!(ms.approve(id, four[2], 2).unwrap(), ProposalStatus::Approved);
+
+        let id = ms.propose(four[0], vec![], 1, 10).unwrap();
+        ms.reject(id, four[0], 2).unwrap();
+        assert_eq!(ms.reject(id, four[1], 2).unwrap(), ProposalStatus::Vetoed);
+    }
+
+    #[test]
+    fn test_invalid_threshold() {
+        assert_eq!(
+            MultiSign::new(signers(), 4, 1).unwrap_err(),
+            MultiSignError::InvalidThreshold
+        );
+        assert_eq!(
+            MultiSign::new(signers(), 2, 0).unwrap_err(),
+            MultiSignError::InvalidThreshold
+        );
+    }
+}
@@ -0,0 +1,171 @@
+//! Ordered key-value state for native contracts
+//!
+//! Every node must derive the same outputs and the same stored state from
+//! the same calls, so native contract state never lives in hash maps,
+//! whose iteration order differs between processes. `OrderedKv` keeps
+//! entries sorted by key: lookups that scan, listings, paging and encoding
+//! all follow key order on every node. The crate's `clippy.toml` rejects
+//! `HashMap` and `HashSet`.
+
+use std::borrow::Borrow;
+use std::collections::btree_map::{self, BTreeMap};
+use std::ops::RangeBounds;
+
+/// Native contract state map, iterated in key order.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct OrderedKv<K, V> {
+    entries: BTreeMap<K, V>,
+}
+
+impl<K, V> Default for OrderedKv<K, V> {
+    fn default() -> Self {
+        Self {
+            entries: BTreeMap::new(),
+        }
+    }
+}
+
+impl<K: Ord, V> OrderedKv<K, V> {
+    /// Creates an empty map.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Returns the number of entries.
+    pub fn len(&self) -> usize {
+        self.entries.len()
+    }
+
+    /// Returns true if there are no entries.
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+
+    /// Returns the value stored under `key`.
+    pub fn get<Q: Ord + ?Sized>(&self, key: &Q) -> Option<&V>
+    where
+        K: Borrow<Q>,
+    {
+        self.entries.get(key)
+    }
+
+    /// Returns the value stored under `key` for changing in place.
+    pub fn get_mut<Q: Ord + ?Sized>(&mut self, key: &Q) -> Option<&mut V>
+    where
+        K: Borrow<Q>,
+    {
+        self.entries.get_mut(key)
+    }
+
+    /// Returns the value stored under `key`, inserting the default first
+    /// if there is none.
+    pub fn get_or_insert_default(&mut self, key: K) -> &mut V
+    where
+        V: Default,
+    {
+        self.entries.entry(key).or_default()
+    }
+
+    /// Returns true if `key` has a value.
+    pub fn contains_key<Q: Ord + ?Sized>(&self, key: &Q) -> bool
+    where
+        K: Borrow<Q>,
+    {
+        self.entries.contains_key(key)
+    }
+
+    /// Stores `value` under `key`, returning the value it replaced.
+    pub fn insert(&mut self, key: K, value: V) -> Option<V> {
+        self.entries.insert(key, value)
+    }
+
+    /// Removes and returns the value stored under `key`.
+    pub fn remove<Q: Ord + ?Sized>(&mut self, key: &Q) -> Option<V>
+    where
+        K: Borrow<Q>,
+    {
+        self.entries.remove(key)
+    }
+
+    /// Keeps only the entries `keep` returns true for, visiting them in
+    /// key order.
+    pub fn retain(&mut self, keep: impl FnMut(&K, &mut V) -> bool) {
+        self.entries.retain(keep);
+    }
+
+    /// Returns the entries in key order.
+    pub fn iter(&self) -> btree_map::Iter<'_, K, V> {
+        self.entries.iter()
+    }
+
+    /// Returns the keys in order.
+    pub fn keys(&self) -> btree_map::Keys<'_, K, V> {
+        self.entries.keys()
+    }
+
+    /// Returns the values in key order.
+    pub fn values(&self) -> btree_map::Values<'_, K, V> {
+        self.entries.values()
+    }
+
+    /// Returns the values in key order for changing in place.
+    pub fn values_mut(&mut self) -> btree_map::ValuesMut<'_, K, V> {
+        self.entries.values_mut()
+    }
+
+    /// Returns the entries with keys in `range`, in key order.
+    pub fn range(&self, range: impl RangeBounds<K>) -> btree_map::Range<'_, K, V> {
+        self.entries.range(range)
+    }
+
+    /// Returns the entry with the greatest key.
+    pub fn last(&self) -> Option<(&K, &V)> {
+        self.entries.iter().next_back()
+    }
+}
+
+impl<K: Ord, V> FromIterator<(K, V)> for OrderedKv<K, V> {
+    fn from_iter<I: IntoIterator<Item = (K, V)>>(iter: I) -> Self {
+        Self {
+            entries: iter.into_iter().collect(),
+        }
+    }
+}
+
+impl<'a, K, V> IntoIterator for &'a OrderedKv<K, V> {
+    type Item = (&'a K, &'a V);
+    type IntoIter = btree_map::Iter<'a, K, V>;
+
+    fn into_iter(self) -> Self::IntoIter {
+        self.entries.iter()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_iterates_in_key_order() {
+        let forward: OrderedKv<u64, &str> = [(3, "c"), (1, "a"), (2, "b")].into_iter().collect();
+        let backward: OrderedKv<u64, &str> = [(2, "b"), (1, "a"), (3, "c")].into_iter().collect();
+        assert_eq!(forward, backward);
+        assert_eq!(forward.keys().copied().collect::<Vec<_>>(), vec![1, 2, 3]);
+        assert_eq!(forward.range(..=2).next_back(), Some((&2, &"b")));
+        assert_eq!(forward.last(), Some((&3, &"c")));
+    }
+
+    #[test]
+    fn test_updates() {
+        let mut kv: OrderedKv<&str, Vec<u8>> = OrderedKv::new();
+        kv.get_or_insert_default("b").push(1);
+        kv.get_or_insert_default("b").push(2);
+        kv.insert("a", vec![0]);
+        assert_eq!(kv.get(&"b"), Some(&vec![1, 2]));
+
+        kv.retain(|_, value| value.len() > 1);
+        assert_eq!(kv.len(), 1);
+        assert_eq!(kv.remove(&"b"), Some(vec![1, 2]));
+        assert!(kv.is_empty());
+    }
+}
@@ -0,0 +1,209 @@
+//! Paged system contract queries
+//!
+//! List-style registry calls take a JSON `PageRequest` and return a JSON
+//! `Page` instead of every entry at once. Entries are listed in ascending
+//! order of a per-registry key (an address, a DID, a version number), which
+//! every node holds the same, so a page is the same wherever it's read. The
+//! page token is the hex key of the last entry returned; the next page
+//! starts after it, so entries added or removed between calls neither
+//! shift nor repeat the rest of the listing.
+
+use serde::{Deserialize, Serialize};
+
+/// Entries returned per page when a request sets no limit.
+pub const DEFAULT_PAGE_LIMIT: usize = 100;
+
+/// Most entries returned per page.
+pub const MAX_PAGE_LIMIT: usize = 1000;
+
+/// Which page of a listing to return
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct PageRequest {
+    /// Token of the previous page, None for the first page
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub page_token: Option<String>,
+    /// Most entries to return (default `DEFAULT_PAGE_LIMIT`)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub limit: Option<usize>,
+}
+
+impl PageRequest {
+    /// Requests the first page of up to `limit` entries.
+    pub fn first(limit: usize) -> Self {
+        Self {
+            page_token: None,
+            limit: Some(limit),
+        }
+    }
+
+    /// Requests the page after `page`, or None if `page` is the last one.
+    pub fn after<T>(&self, page: &Page<T>) -> Option<Self> {
+        Some(Self {
+            page_token: Some(page.next_page_token.clone()?),
+            limit: self.limit,
+        })
+    }
+
+    /// Decodes a request from calldata; empty calldata asks for the first
+    /// page.
+    pub fn decode(data: &[u8]) -> Result<Self, String> {
+        if data.is_empty() {
+            return Ok(Self::default());
+        }
+        serde_json::from_slice(data).map_err(|e| e.to_string())
+    }
+
+    /// Encodes the request as calldata.
+    pub fn encode(&self) -> Vec<u8> {
+        serde_json::to_vec(self).expect("page request serializes")
+    }
+
+    /// Returns the requested page of `entries`, which must be sorted by
+    /// ascending key without duplicates.
+    pub fn paginate<K, T>(
+        &self,
+        entries: impl IntoIterator<Item = (K, T)>,
+    ) -> Result<Page<T>, String>
+    where
+        K: AsRef<[u8]>,
+    {
+        let limit = self.limit.unwrap_or(DEFAULT_PAGE_LIMIT);
+        if limit == 0 || limit > MAX_PAGE_LIMIT {
+            return Err(format!(
+                "page limit {} is outside 1..={}",
+                limit, MAX_PAGE_LIMIT
+            ));
+        }
+        let after = match &self.page_token {
+            Some(token) => Some(hex::decode(token).map_err(|_| "invalid page token".to_string())?),
+            None => None,
+        };
+
+        let mut entries = entries
+            .into_iter()
+            .filter(|(key, _)| after.as_deref().map_or(true, |after| key.as_ref() > after));
+        let mut items = Vec::new();
+        let mut last_key = None;
+        for (key, item) in entries.by_ref().take(limit) {
+            items.push(item);
+            last_key = Some(key);
+        }
+        let next_page_token = match entries.next() {
+            Some(_) => last_key.map(|key| hex::encode(key.as_ref())),
+            None => None,
+        };
+        Ok(Page {
+            items,
+            next_page_token,
+        })
+    }
+}
+
+/// One page of a listing
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct Page<T> {
+    /// Entries in key order
+    pub items: Vec<T>,
+    /// Token of the next page, None on the last page
+    pub next_page_token: Option<String>,
+}
+
+impl<T: Serialize> Page<T> {
+    /// Encodes the page as a call result.
+    pub fn encode(&self) -> Vec<u8> {
+        serde_json::to_vec(self).expect("page serializes")
+    }
+}
+
+impl<T: for<'de> Deserialize<'de>> Page<T> {
+    /// Decodes a page produced by `encode`.
+    pub fn decode(data: &[u8]) -> Result<Self, String> {
+        serde_json::from_slice(data).map_err(|e| e.to_string())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn entries(n: u8) -> Vec<([u8; 1], u8)> {
+        (0..n).map(|i| ([i * 2], i * 2)).collect()
+    }
+
+    /// Walks every page of `entries` with `limit` entries per page.
+    fn collect(entries: &[([u8; 1], u8)], limit: usize) -> (Vec<u8>, usize) {
+        let mut request = PageRequest::first(limit);
+        let mut items = Vec::new();
+        let mut pages = 0;
+        loop {
+            let page = request.paginate(entries.iter().copied()).unwrap();
+            assert!(page.items.len() <= limit);
+            items.extend(&page.items);
+            pages += 1;
+            match request.after(&page) {
+                Some(next) => request = next,
+                None => return (items, pages),
+            }
+        }
+    }
+
+    #[test]
+    fn test_page_boundaries() {
+        let all: Vec<u8> = entries(10).iter().map(|(_, item)| *item).collect();
+        // Exact multiples of the limit end without an empty trailing page
+        assert_eq!(collect(&entries(10), 5), (all.clone(), 2));
+        assert_eq!(collect(&entries(10), 3), (all.clone(), 4));
+        assert_eq!(collect(&entries(10), 10), (all.clone(), 1));
+        assert_eq!(collect(&entries(10), 11), (all, 1));
+        assert_eq!(collect(&entries(0), 5), (vec![], 1));
+
+        let page = PageRequest::first(1).paginate(entries(1)).unwrap();
+        assert_eq!(page.items, vec![0]);
+        assert_eq!(page.next_page_token, None);
+    }
+
+    #[test]
+    fn test_token_resumes_after_key() {
+        let page = PageRequest::first(2).paginate(entries(5)).unwrap();
+        assert_eq!(page.items, vec![0, 2]);
+        assert_eq!(page.next_page_token.as_deref(), Some("02"));
+
+        // The next page starts after the token even if that key is gone
+        // or a key was added before it
+        let request = PageRequest::first(2).after(&page).unwrap();
+        let changed = [([1u8], 1), ([4], 4), ([6], 6), ([8], 8)];
+        let page = request.paginate(changed).unwrap();
+        assert_eq!(page.items, vec![4, 6]);
+
+        // A token past the last key gives an empty last page
+        let request = PageRequest {
+            page_token: Some("ff".to_string()),
+            limit: None,
+        };
+        let page = request.paginate(entries(5)).unwrap();
+        assert!(page.items.is_empty());
+        assert_eq!(page.next_page_token, None);
+    }
+
+    #[test]
+    fn test_invalid_requests() {
+        for limit in [0, MAX_PAGE_LIMIT + 1] {
+            assert!(PageRequest::first(limit).paginate(entries(3)).is_err());
+        }
+        assert!(PageRequest::first(MAX_PAGE_LIMIT)
+            .paginate(entries(3))
+            .is_ok());
+        let request = PageRequest {
+            page_token: Some("not hex".to_string()),
+            limit: None,
+        };
+        assert!(request.paginate(entries(3)).is_err());
+
+        assert_eq!(PageRequest::decode(b"").unwrap(), PageRequest::default());
+        let request = PageRequest::first(7);
+        assert_eq!(PageRequest::decode(&request.encode()).unwrap(), request);
+        assert!(PageRequest::decode(b"{").is_err());
+    }
+}
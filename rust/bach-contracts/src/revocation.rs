@@ -0,0 +1,442 @@
+//! Member key revocation system contract
+//!
+//! A trusted issuer revokes member keys by publishing a signed revocation
+//! list to the registry in a transaction. Each list replaces the issuer's
+//! previous one and must carry a higher sequence number, so a stale list
+//! cannot be replayed to un-revoke a key. Issuers are trusted through the
+//! chain config `revocation_issuers` parameter, and a list applies from
+//! the block after the one including it, so every node agrees on when a
+//! key stops being accepted. Transactions signed by a revoked key are
+//! refused at pool admission and validators don't pre-vote for blocks
+//! holding one.
+//!
+//! Calldata is `REVOCATION_UPLOAD || json(signed list)`,
+//! `REVOCATION_QUERY || address (20 bytes)` or
+//! `REVOCATION_LIST || json(page request)`, which pages through the revoked
+//! addresses in ascending order.
+
+use crate::ordered::OrderedKv;
+use crate::page::PageRequest;
+use bach_crypto::{keccak256_concat, PrivateKey, Signature, SIGNATURE_LENGTH};
+use bach_primitives::{Address, H256, SystemContract};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+
+/// Registry call: publish a signed revocation list.
+pub const REVOCATION_UPLOAD: u8 = 0x01;
+/// Registry call: check whether an address is revoked.
+pub const REVOCATION_QUERY: u8 = 0x02;
+/// Registry call: list a page of revoked addresses.
+pub const REVOCATION_LIST: u8 = 0x03;
+
+/// Domain separator for revocation list signatures.
+const REVOCATION_DOMAIN: &[u8] = b"bach-revocation-list";
+
+/// Returns the address of the revocation registry system contract (0x…0105).
+pub fn revocation_registry_address() -> Address {
+    SystemContract::RevocationRegistry.address()
+}
+
+/// Errors returned by the revocation registry.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum RevocationError {
+    /// List is not signed by a trusted issuer
+    UntrustedIssuer(Address),
+    /// Sequence is not newer than the issuer's current list
+    StaleSequence { latest: u64, sequence: u64 },
+    /// Signature is missing or invalid
+    BadSignature,
+    /// Calldata or a stored list could not be decoded
+    Malformed(String),
+}
+
+impl std::fmt::Display for RevocationError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::UntrustedIssuer(issuer) => write!(f, "untrusted revocation issuer: {}", issuer),
+            Self::StaleSequence { latest, sequence } => write!(
+                f,
+                "revocation list sequence {} is not newer than {}",
+                sequence, latest
+            ),
+            Self::BadSignature => write!(f, "invalid revocation list signature"),
+            Self::Malformed(msg) => write!(f, "malformed revocation data: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for RevocationError {}
+
+/// Revoked member addresses published by one issuer.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RevocationList {
+    /// Increases with every list the issuer publishes
+    pub sequence: u64,
+    /// Unix timestamp the list was issued
+    pub issued_at: u64,
+    /// Revoked addresses, sorted and without duplicates
+    pub revoked: Vec<[u8; 20]>,
+}
+
+impl RevocationList {
+    /// Creates a list revoking `revoked`.
+    pub fn new(sequence: u64, issued_at: u64, revoked: impl IntoIterator<Item = Address>) -> Self {
+        let revoked: BTreeSet<[u8; 20]> = revoked.into_iter().map(|a| *a.as_bytes()).collect();
+        Self {
+            sequence,
+            issued_at,
+            revoked: revoked.into_iter().collect(),
+        }
+    }
+
+    /// Returns the revoked addresses.
+    pub fn revoked_addrs(&self) -> impl Iterator<Item = Address> + '_ {
+        self.revoked.iter().map(|bytes| Address::from(*bytes))
+    }
+
+    /// Returns true if `address` is on the list.
+    pub fn contains(&self, address: &Address) -> bool {
+        self.revoked.binary_search(address.as_bytes()).is_ok()
+    }
+
+    /// Returns the hash the issuer signs.
+    pub fn signing_hash(&self) -> H256 {
+        let mut parts: Vec<&[u8]> = Vec::with_capacity(self.revoked.len() + 2);
+        let sequence = self.sequence.to_be_bytes();
+        let issued_at = self.issued_at.to_be_bytes();
+        parts.push(REVOCATION_DOMAIN);
+        parts.push(&sequence);
+        parts.push(&issued_at);
+        parts.extend(self.revoked.iter().map(|a| a.as_slice()));
+        keccak256_concat(&parts)
+    }
+
+    /// Signs the list with the issuer's key.
+    pub fn sign(self, issuer: &PrivateKey) -> SignedRevocationList {
+        let signature = issuer.sign(&self.signing_hash()).to_bytes().to_vec();
+        SignedRevocationList {
+            list: self,
+            signature,
+        }
+    }
+}
+
+/// A revocation list with its issuer's signature.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SignedRevocationList {
+    /// The signed list
+    pub list: RevocationList,
+    /// 65-byte signature over `list.signing_hash()`
+    pub signature: Vec<u8>,
+}
+
+impl SignedRevocationList {
+    /// Recovers the address of the key that signed the list.
+    pub fn issuer(&self) -> Result<Address, RevocationError> {
+        let bytes: [u8; SIGNATURE_LENGTH] = self
+            .signature
+            .as_slice()
+            .try_into()
+            .map_err(|_| RevocationError::BadSignature)?;
+        let signature = Signature::from_bytes(&bytes).map_err(|_| RevocationError::BadSignature)?;
+        signature
+            .recover(&self.list.signing_hash())
+            .map(|key| key.to_address())
+            .map_err(|_| RevocationError::BadSignature)
+    }
+
+    /// Encodes the list for storage or as calldata.
+    pub fn encode(&self) -> Vec<u8> {
+        serde_json::to_vec(self).expect("revocation list serializes")
+    }
+
+    /// Decodes a list produced by `encode`.
+    pub fn decode(data: &[u8]) -> Result<Self, RevocationError> {
+        serde_json::from_slice(data).map_err(|e| RevocationError::Malformed(e.to_string()))
+    }
+}
+
+/// An issuer's list with the first height it applies to.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ActiveRevocationList {
+    /// The signed list
+    pub list: SignedRevocationList,
+    /// First height the list applies to
+    pub activation_height: u64,
+}
+
+impl ActiveRevocationList {
+    /// Encodes the entry for storage.
+    pub fn encode(&self) -> Vec<u8> {
+        serde_json::to_vec(self).expect("revocation list serializes")
+    }
+
+    /// Decodes an entry produced by `encode`.
+    pub fn decode(data: &[u8]) -> Result<Self, RevocationError> {
+        serde_json::from_slice(data).map_err(|e| RevocationError::Malformed(e.to_string()))
+    }
+}
+
+/// Encodes `REVOCATION_UPLOAD` calldata.
+pub fn encode_upload(list: &SignedRevocationList) -> Vec<u8> {
+    let mut data = vec![REVOCATION_UPLOAD];
+    data.extend(list.encode());
+    data
+}
+
+/// Encodes `REVOCATION_QUERY` calldata.
+pub fn encode_query(address: &Address) -> Vec<u8> {
+    let mut data = vec![REVOCATION_QUERY];
+    data.extend_from_slice(address.as_bytes());
+    data
+}
+
+/// Encodes `REVOCATION_LIST` calldata.
+pub fn encode_list(request: &PageRequest) -> Vec<u8> {
+    let mut data = vec![REVOCATION_LIST];
+    data.extend(request.encode());
+    data
+}
+
+/// Native revocation registry state: the latest list of each issuer.
+/// Only lists of currently trusted issuers count.
+#[derive(Debug, Clone, Default)]
+pub struct RevocationRegistry {
+    issuers: BTreeSet<Address>,
+    lists: OrderedKv<Address, ActiveRevocationList>,
+}
+
+impl RevocationRegistry {
+    /// Creates a registry accepting lists signed by `issuers`.
+    pub fn new(issuers: impl IntoIterator<Item = Address>) -> Self {
+        Self {
+            issuers: issuers.into_iter().collect(),
+            lists: OrderedKv::new(),
+        }
+    }
+
+    /// Returns the trusted issuers.
+    pub fn issuers(&self) -> impl Iterator<Item = &Address> {
+        self.issuers.iter()
+    }
+
+    /// Replaces the trusted issuers, e.g. when chain config changes them.
+    /// Lists of issuers no longer trusted are kept but don't count.
+    pub fn set_issuers(&mut self, issuers: impl IntoIterator<Item = Address>) {
+        self.issuers = issuers.into_iter().collect();
+    }
+
+    /// Returns the current list of each trusted issuer.
+    pub fn lists(&self) -> impl Iterator<Item = (&Address, &ActiveRevocationList)> {
+        self.lists
+            .iter()
+            .filter(|(issuer, _)| self.issuers.contains(issuer))
+    }
+
+    /// Verifies `list` and makes it the issuer's current list from
+    /// `activation_height`. Returns the issuer.
+    pub fn upload(
+        &mut self,
+        list: SignedRevocationList,
+        activation_height: u64,
+    ) -> Result<Address, RevocationError> {
+        let issuer = list.issuer()?;
+        if !self.issuers.contains(&issuer) {
+            return Err(RevocationError::UntrustedIssuer(issuer));
+        }
+        if let Some(current) = self.lists.get(&issuer) {
+            if list.list.sequence <= current.list.list.sequence {
+                return Err(RevocationError::StaleSequence {
+                    latest: current.list.list.sequence,
+                    sequence: list.list.sequence,
+                });
+            }
+        }
+        self.lists.insert(
+            issuer,
+            ActiveRevocationList {
+                list,
+                activation_height,
+            },
+        );
+        Ok(issuer)
+    }
+
+    /// Restores a recorded entry without checking the issuer is trusted.
+    /// Returns the issuer.
+    pub fn restore(&mut self, entry: ActiveRevocationList) -> Result<Address, RevocationError> {
+        let issuer = entry.list.issuer()?;
+        self.lists.insert(issuer, entry);
+        Ok(issuer)
+    }
+
+    /// Returns true if a trusted issuer's list active at `height` revokes
+    /// `address`.
+    pub fn is_revoked(&self, address: &Address, height: u64) -> bool {
+        self.active_lists(height)
+            .any(|signed| signed.list.contains(address))
+    }
+
+    /// Returns every address revoked at `height` across issuers.
+    pub fn revoked(&self, height: u64) -> BTreeSet<Address> {
+        self.active_lists(height)
+            .flat_map(|signed| signed.list.revoked_addrs())
+            .collect()
+    }
+
+    /// Returns the trusted issuers' lists active at `height`.
+    fn active_lists(&self, height: u64) -> impl Iterator<Item = &SignedRevocationList> {
+        self.lists()
+            .filter(move |(_, entry)| entry.activation_height <= height)
+            .map(|(_, entry)| &entry.list)
+    }
+
+    /// Executes a call to the registry at `height`. Uploads apply from
+    /// `height` and return the issuer address; queries return a single
+    /// byte, 1 if revoked; listings a JSON page of addresses.
+    pub fn execute(&mut self, data: &[u8], height: u64) -> Result<Vec<u8>, RevocationError> {
+        let (&call, payload) = data
+            .split_first()
+            .ok_or_else(|| RevocationError::Malformed("empty calldata".to_string()))?;
+        match call {
+            REVOCATION_UPLOAD => {
+                let list = SignedRevocationList::decode(payload)?;
+                self.upload(list, height).map(|issuer| issuer.as_bytes().to_vec())
+            }
+            REVOCATION_QUERY => {
+                let address = Address::from_slice(payload)
+                    .map_err(|_| RevocationError::Malformed("invalid address".to_string()))?;
+                Ok(vec![self.is_revoked(&address, height) as u8])
+            }
+            REVOCATION_LIST => {
+                let revoked = self.revoked(height).into_iter().map(|a| (*a.as_bytes(), *a.as_bytes()));
+                PageRequest::decode(payload)
+                    .and_then(|request| request.paginate(revoked))
+                    .map(|page| page.encode())
+                    .map_err(RevocationError::Malformed)
+            }
+            _ => Err(RevocationError::Malformed(format!(
+                "unknown call 0x{:02x}",
+                call
+            ))),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::page::Page;
+
+    fn member(n: u8) -> Address {
+        Address::from([n; 20])
+    }
+
+    #[test]
+    fn test_upload_requires_trusted_issuer() {
+        let issuer = PrivateKey::random();
+        let stranger = PrivateKey::random();
+        let mut registry = RevocationRegistry::new([issuer.public_key().to_address()]);
+
+        let list = RevocationList::new(1, 100, [member(2), member(1), member(2)]);
+        assert_eq!(list.revoked.len(), 2);
+        let forged = list.clone().sign(&stranger);
+        assert_eq!(
+            registry.upload(forged, 1),
+            Err(RevocationError::UntrustedIssuer(
+                stranger.public_key().to_address()
+            ))
+        );
+
+        let mut tampered = list.clone().sign(&issuer);
+        tampered.list.revoked.pop();
+        assert!(registry.upload(tampered, 1).is_err());
+        assert!(!registry.is_revoked(&member(1), 1));
+
+        registry.upload(list.sign(&issuer), 5).unwrap();
+        assert!(!registry.is_revoked(&member(1), 4));
+        assert!(registry.is_revoked(&member(1), 5));
+        assert!(registry.is_revoked(&member(2), 5));
+        assert!(!registry.is_revoked(&member(3), 5));
+
+        // Dropping the issuer from the trusted set drops its list
+        registry.set_issuers([]);
+        assert!(!registry.is_revoked(&member(1), 5));
+    }
+
+    #[test]
+    fn test_newer_list_replaces_older() {
+        let issuer = PrivateKey::random();
+        let mut registry = RevocationRegistry::new([issuer.public_key().to_address()]);
+        registry
+            .upload(RevocationList::new(2, 100, [member(1)]).sign(&issuer), 1)
+            .unwrap();
+
+        let stale = RevocationList::new(2, 200, []).sign(&issuer);
+        assert_eq!(
+            registry.upload(stale, 2),
+            Err(RevocationError::StaleSequence {
+                latest: 2,
+                sequence: 2
+            })
+        );
+        assert!(registry.is_revoked(&member(1), 2));
+
+        registry
+            .upload(RevocationList::new(3, 300, [member(4)]).sign(&issuer), 3)
+            .unwrap();
+        assert_eq!(registry.revoked(3), BTreeSet::from([member(4)]));
+    }
+
+    #[test]
+    fn test_execute_calls() {
+        let issuer = PrivateKey::random();
+        let mut registry = RevocationRegistry::new([issuer.public_key().to_address()]);
+        let signed = RevocationList::new(1, 100, [member(5)]).sign(&issuer);
+
+        let result = registry.execute(&encode_upload(&signed), 10).unwrap();
+        assert_eq!(result, issuer.public_key().to_address().as_bytes().to_vec());
+        assert_eq!(
+            registry.execute(&encode_query(&member(5)), 10).unwrap(),
+            vec![1]
+        );
+        assert_eq!(
+            registry.execute(&encode_query(&member(5)), 9).unwrap(),
+            vec![0]
+        );
+        assert_eq!(
+            registry.execute(&encode_query(&member(6)), 10).unwrap(),
+            vec![0]
+        );
+        assert!(registry.execute(&[REVOCATION_QUERY, 1, 2], 10).is_err());
+        assert!(registry.execute(&[0x09], 10).is_err());
+    }
+
+    #[test]
+    fn test_list_revoked() {
+        let (first, second) = (PrivateKey::random(), PrivateKey::random());
+        let issuers = [first.public_key().to_address(), second.public_key().to_address()];
+        let mut registry = RevocationRegistry::new(issuers);
+        registry
+            .upload(RevocationList::new(1, 100, [member(3), member(1)]).sign(&first), 1)
+            .unwrap();
+        registry
+            .upload(RevocationList::new(1, 100, [member(2), member(3)]).sign(&second), 1)
+            .unwrap();
+
+        // Revoked by either issuer, once each, in address order
+        let mut list = |request: &PageRequest| {
+            Page::<[u8; 20]>::decode(&registry.execute(&encode_list(request), 1).unwrap()).unwrap()
+        };
+        let request = PageRequest::first(2);
+        let page = list(&request);
+        assert_eq!(page.items, vec![[1; 20], [2; 20]]);
+        let request = request.after(&page).unwrap();
+        let page = list(&request);
+        assert_eq!(page.items, vec![[3; 20]]);
+        assert!(request.after(&page).is_none());
+
+        assert!(registry.execute(&encode_list(&PageRequest::first(0)), 1).is_err());
+        assert!(registry.execute(&[REVOCATION_LIST, b'{'], 1).is_err());
+    }
+}
@@ -0,0 +1,189 @@
+//! Runs every native contract method twice from scratch and checks that
+//! each call returns the same output and leaves the same stored state.
+
+use bach_contracts::{
+    encode_did_list, encode_did_lookup_key, encode_did_register, encode_did_resolve,
+    encode_endorse_rotation, encode_get_config_at, encode_index_declare, encode_index_drop,
+    encode_list_chain_config_versions, encode_multi_sign_approve, encode_multi_sign_get,
+    encode_multi_sign_list, encode_multi_sign_propose, encode_multi_sign_reject,
+    encode_revocation_list, encode_revocation_query, encode_revocation_upload,
+    encode_signal_features, encode_simulate_endorsement, encode_stage_rotation, encode_update,
+    ChainConfig, ChainConfigContract, DidDocument, DidRegistry, IndexField, IndexRegistry,
+    IndexSpec, MultiSign, PageRequest, RevocationList, RevocationRegistry,
+};
+use bach_primitives::Address;
+use bach_testutil::{assert_deterministic, test_address, test_key, CallTrace};
+
+/// Concatenates encoded records into one state snapshot.
+fn concat<'a>(records: impl Iterator<Item = Vec<u8>> + 'a) -> Vec<u8> {
+    records.flatten().collect()
+}
+
+#[test]
+fn test_chain_config_is_deterministic() {
+    let orgs = ["org-c", "org-a", "org-b"];
+    let admins: Vec<Address> = (0..3).map(test_address).collect();
+    let changes = |pairs: &[(&str, &str)]| {
+        let pairs: Vec<(String, String)> =
+            pairs.iter().map(|(n, v)| (n.to_string(), v.to_string())).collect();
+        encode_update(&pairs)
+    };
+    let node = |n: u8| format!("{}@10.0.0.{}:30303", hex::encode([n; 32]), n);
+
+    assert_deterministic(|| {
+        let mut genesis = ChainConfig::default();
+        for (org, admin) in orgs.iter().zip(&admins) {
+            genesis.admins.insert(org.to_string(), *admin.as_bytes());
+        }
+        let mut contract = ChainConfigContract::new(genesis);
+        let members = admins.iter().map(|a| a.to_string()).collect::<Vec<_>>().join(",");
+        let calls: Vec<(&str, Vec<u8>, Address)> = vec![
+            ("update", changes(&[("block_gas_limit", "40000000")]), admins[0]),
+            ("nodes", changes(&[("nodes.org-b", &node(2)), ("nodes.org-a", &node(1))]), admins[1]),
+            ("signers", changes(&[("multi_sign_signers", &members)]), admins[2]),
+            ("signal", encode_signal_features(&["fast-sync", "batch"]), admins[0]),
+            ("signal", encode_signal_features(&["batch"]), admins[1]),
+            ("stage", encode_stage_rotation("org-a", &test_address(9), 40), admins[1]),
+            ("endorse", encode_endorse_rotation("org-a"), admins[2]),
+            ("simulate", encode_simulate_endorsement("config", None, &admins[..2]), admins[0]),
+            ("list", encode_list_chain_config_versions(&PageRequest::first(10)), admins[0]),
+            ("get", encode_get_config_at(15), admins[0]),
+        ];
+
+        let mut trace = CallTrace::new();
+        for (height, (name, data, sender)) in (10..).zip(calls) {
+            let output = contract.execute(&data, sender, height);
+            let state = concat(contract.versions().map(|version| version.encode()));
+            trace.record(name, output, state);
+        }
+        trace
+    });
+}
+
+#[test]
+fn test_did_registry_is_deterministic() {
+    let keys: Vec<_> = (0..4).map(test_key).collect();
+    let documents: Vec<_> = ["did:bach:c", "did:bach:a", "did:bach:b"]
+        .iter()
+        .zip(&keys)
+        .map(|(did, key)| {
+            let roles = vec!["doctor".to_string(), "auditor".to_string()];
+            DidDocument::new(did, 1, [key.public_key().to_address()], roles).sign(key)
+        })
+        .collect();
+    let update = DidDocument::new("did:bach:a", 2, [test_address(3)], vec![]).sign(&keys[1]);
+
+    assert_deterministic(|| {
+        let mut registry = DidRegistry::new();
+        let mut calls: Vec<(&str, Vec<u8>)> =
+            documents.iter().map(|d| ("register", encode_did_register(d))).collect();
+        calls.extend([
+            ("update", encode_did_register(&update)),
+            ("resolve", encode_did_resolve("did:bach:a")),
+            ("lookup", encode_did_lookup_key(&test_address(3))),
+            ("list", encode_did_list(&PageRequest::first(2))),
+        ]);
+
+        let mut trace = CallTrace::new();
+        for (name, data) in calls {
+            let output = registry.execute(&data);
+            let mut state = concat(registry.documents().map(|d| d.encode()));
+            state.extend(format!("{:?}", registry.take_logs()).into_bytes());
+            trace.record(name, output, state);
+        }
+        trace
+    });
+}
+
+#[test]
+fn test_index_registry_is_deterministic() {
+    let contracts: Vec<Address> = (0..2).map(test_address).collect();
+    let spec = |name: &str| {
+        IndexSpec::new(name, vec![IndexField::number("age"), IndexField::text("ward")])
+    };
+
+    assert_deterministic(|| {
+        let mut registry = IndexRegistry::new();
+        let calls = [
+            ("declare", contracts[1], encode_index_declare(&spec("by_ward"))),
+            ("declare", contracts[0], encode_index_declare(&spec("by_age"))),
+            ("declare", contracts[0], encode_index_declare(&spec("by_ward"))),
+            ("drop", contracts[0], encode_index_drop("by_age")),
+            ("drop", contracts[1], encode_index_drop("missing")),
+        ];
+
+        let mut trace = CallTrace::new();
+        for (name, caller, data) in calls {
+            let output = registry
+                .execute(caller, &data)
+                .map(|change| format!("{:?}", change).into_bytes());
+            let state = concat(
+                contracts
+                    .iter()
+                    .flat_map(|contract| registry.specs(contract).map(|spec| spec.encode())),
+            );
+            trace.record(name, output, state);
+        }
+        trace
+    });
+}
+
+#[test]
+fn test_multi_sign_is_deterministic() {
+    let signers: Vec<Address> = (0..5).map(test_address).collect();
+
+    assert_deterministic(|| {
+        let mut contract = MultiSign::with_signers(signers.iter().rev().copied());
+        let calls = [
+            ("propose", signers[0], encode_multi_sign_propose(30, b"raise limit")),
+            ("propose", signers[3], encode_multi_sign_propose(12, b"add org")),
+            ("propose", signers[4], encode_multi_sign_propose(40, b"pause")),
+            ("approve", signers[1], encode_multi_sign_approve(0)),
+            ("reject", signers[2], encode_multi_sign_reject(0)),
+            ("approve", signers[3], encode_multi_sign_approve(0)),
+            ("approve", signers[4], encode_multi_sign_approve(0)),
+            ("reject", signers[0], encode_multi_sign_reject(2)),
+            ("get", signers[0], encode_multi_sign_get(0)),
+            ("list", signers[0], encode_multi_sign_list(&PageRequest::first(10))),
+        ];
+
+        let mut trace = CallTrace::new();
+        for (height, (name, sender, data)) in (10..).zip(calls) {
+            let output = contract.execute(&data, sender, height);
+            contract.expire(height + 1);
+            trace.record(name, output, contract.encode());
+        }
+        trace
+    });
+}
+
+#[test]
+fn test_revocation_registry_is_deterministic() {
+    let issuers: Vec<_> = (0..3).map(test_key).collect();
+    let revoked = |ids: &[u64]| ids.iter().map(|&i| test_address(100 + i)).collect::<Vec<_>>();
+    let lists = [
+        RevocationList::new(1, 100, revoked(&[3, 1, 2])).sign(&issuers[2]),
+        RevocationList::new(1, 100, revoked(&[2, 4])).sign(&issuers[0]),
+        RevocationList::new(2, 200, revoked(&[5])).sign(&issuers[2]),
+        RevocationList::new(1, 100, revoked(&[6])).sign(&test_key(9)),
+    ];
+
+    assert_deterministic(|| {
+        let trusted = issuers.iter().rev().map(|key| key.public_key().to_address());
+        let mut registry = RevocationRegistry::new(trusted);
+        let mut calls: Vec<(&str, Vec<u8>)> =
+            lists.iter().map(|list| ("upload", encode_revocation_upload(list))).collect();
+        calls.extend([
+            ("query", encode_revocation_query(&test_address(102))),
+            ("list", encode_revocation_list(&PageRequest::first(3))),
+        ]);
+
+        let mut trace = CallTrace::new();
+        for (height, (name, data)) in (10..).zip(calls) {
+            let output = registry.execute(&data, height);
+            let state = concat(registry.lists().map(|(_, entry)| entry.encode()));
+            trace.record(name, output, state);
+        }
+        trace
+    });
+}
@@ -0,0 +1,147 @@
+//! Ed25519 keys and signatures
+//!
+//! Members can hold Ed25519 keys instead of secp256k1 ones. Ed25519
+//! signatures can't be recovered to a public key, so wherever one
+//! authorizes something the signer's public key is carried next to it
+//! (see `MemberSignature`). Addresses are derived like secp256k1 ones: the
+//! last 20 bytes of the Keccak-256 hash of the public key.
+//!
+//! Messages are 32-byte hashes signed as-is with pure Ed25519, and
+//! verification is strict: non-canonical and small-order keys and
+//! signatures are rejected, so a valid signature can't be re-encoded.
+
+use crate::{hex_encode, keccak256, CryptoError};
+use bach_primitives::{Address, ADDRESS_LENGTH, H256};
+use ed25519_dalek::{Signer, SigningKey, VerifyingKey};
+use rand_core::RngCore;
+
+/// Length of an Ed25519 public key in bytes
+pub const ED25519_PUBLIC_KEY_LENGTH: usize = 32;
+
+/// Length of an Ed25519 signature in bytes (R=32 + S=32)
+pub const ED25519_SIGNATURE_LENGTH: usize = 64;
+
+/// An Ed25519 private key (32-byte seed).
+#[derive(Clone)]
+pub struct Ed25519PrivateKey {
+    inner: SigningKey,
+}
+
+impl Ed25519PrivateKey {
+    /// Generates a random private key using OS entropy.
+    pub fn random() -> Self {
+        let mut seed = [0u8; 32];
+        rand_core::OsRng.fill_bytes(&mut seed);
+        Self::from_bytes(&seed)
+    }
+
+    /// Creates a private key from its seed. Every 32-byte seed is valid.
+    pub fn from_bytes(bytes: &[u8; 32]) -> Self {
+        Self {
+            inner: SigningKey::from_bytes(bytes),
+        }
+    }
+
+    /// Returns the seed.
+    pub fn to_bytes(&self) -> [u8; 32] {
+        self.inner.to_bytes()
+    }
+
+    /// Derives the corresponding public key.
+    pub fn public_key(&self) -> Ed25519PublicKey {
+        Ed25519PublicKey {
+            inner: self.inner.verifying_key(),
+        }
+    }
+
+    /// Signs a message hash.
+    pub fn sign(&self, message: &H256) -> Ed25519Signature {
+        Ed25519Signature {
+            bytes: self.inner.sign(message.as_bytes()).to_bytes(),
+        }
+    }
+}
+
+impl std::fmt::Debug for Ed25519PrivateKey {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Ed25519PrivateKey")
+            .field("bytes", &"[REDACTED]")
+            .finish()
+    }
+}
+
+/// An Ed25519 public key (compressed, 32 bytes).
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub struct Ed25519PublicKey {
+    inner: VerifyingKey,
+}
+
+impl Ed25519PublicKey {
+    /// Creates from compressed bytes, rejecting encodings that are not a
+    /// curve point.
+    pub fn from_bytes(bytes: &[u8; ED25519_PUBLIC_KEY_LENGTH]) -> Result<Self, CryptoError> {
+        let inner = VerifyingKey::from_bytes(bytes).map_err(|_| CryptoError::InvalidPublicKey)?;
+        Ok(Self { inner })
+    }
+
+    /// Returns the compressed bytes.
+    pub fn to_bytes(&self) -> [u8; ED25519_PUBLIC_KEY_LENGTH] {
+        self.inner.to_bytes()
+    }
+
+    /// Derives the address.
+    /// Address = keccak256(public_key)[12..32]
+    pub fn to_address(&self) -> Address {
+        let hash = keccak256(self.inner.as_bytes());
+        let mut addr_bytes = [0u8; ADDRESS_LENGTH];
+        addr_bytes.copy_from_slice(&hash.as_bytes()[12..32]);
+        Address::from(addr_bytes)
+    }
+
+    /// Verifies a signature against this public key.
+    pub fn verify(&self, signature: &Ed25519Signature, message: &H256) -> bool {
+        let signature = ed25519_dalek::Signature::from_bytes(&signature.bytes);
+        self.inner
+            .verify_strict(message.as_bytes(), &signature)
+            .is_ok()
+    }
+}
+
+impl std::fmt::Debug for Ed25519PublicKey {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Ed25519PublicKey")
+            .field("bytes", &hex_encode(self.inner.as_bytes()))
+            .finish()
+    }
+}
+
+/// An Ed25519 signature (64 bytes: R + S).
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub struct Ed25519Signature {
+    bytes: [u8; ED25519_SIGNATURE_LENGTH],
+}
+
+impl Ed25519Signature {
+    /// Creates a signature from raw bytes.
+    /// Rejects S components with any of their top four bits set, which
+    /// are never below the group order; verification checks the rest.
+    pub fn from_bytes(bytes: &[u8; ED25519_SIGNATURE_LENGTH]) -> Result<Self, CryptoError> {
+        if bytes[63] & 0xf0 != 0 {
+            return Err(CryptoError::InvalidSignature);
+        }
+        Ok(Self { bytes: *bytes })
+    }
+
+    /// Returns the raw bytes (R + S).
+    pub fn to_bytes(&self) -> [u8; ED25519_SIGNATURE_LENGTH] {
+        self.bytes
+    }
+}
+
+impl std::fmt::Debug for Ed25519Signature {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Ed25519Signature")
+            .field("bytes", &hex_encode(&self.bytes))
+            .finish()
+    }
+}
@@ -0,0 +1,153 @@
+//! Hash algorithms and their migration schedule
+//!
+//! Blocks are hashed with Keccak-256 from genesis. A chain can move to
+//! another algorithm (SHA-256 or SM3) at an activation height; blocks keep
+//! the algorithm in force at their own height, so old blocks still verify
+//! after a migration. `HashSchedule` records the activation heights.
+//!
+//! The block at an activation height is a transition block: it is hashed
+//! with the new algorithm, and its digest under the previous algorithm is
+//! kept as well so it can still be found by its old hash.
+
+use bach_primitives::H256;
+use sha2::Sha256;
+use sha3::{Digest, Keccak256};
+use sm3::Sm3;
+use std::fmt;
+
+/// Hash algorithm used for block and transaction digests
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Default)]
+pub enum HashAlgorithm {
+    /// Keccak-256 (the genesis algorithm)
+    #[default]
+    Keccak256,
+    /// SHA-256
+    Sha256,
+    /// SM3 (GB/T 32905-2016)
+    Sm3,
+}
+
+impl HashAlgorithm {
+    /// Every supported algorithm
+    pub const ALL: [HashAlgorithm; 3] = [
+        HashAlgorithm::Keccak256,
+        HashAlgorithm::Sha256,
+        HashAlgorithm::Sm3,
+    ];
+
+    /// Returns the algorithm name used in configs.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            HashAlgorithm::Keccak256 => "keccak256",
+            HashAlgorithm::Sha256 => "sha256",
+            HashAlgorithm::Sm3 => "sm3",
+        }
+    }
+
+    /// Parses an algorithm name (case-insensitive).
+    pub fn from_name(name: &str) -> Option<Self> {
+        Self::ALL
+            .into_iter()
+            .find(|algorithm| algorithm.as_str().eq_ignore_ascii_case(name.trim()))
+    }
+
+    /// Returns the algorithm's one-byte identifier used in encodings.
+    pub fn id(&self) -> u8 {
+        match self {
+            HashAlgorithm::Keccak256 => 0,
+            HashAlgorithm::Sha256 => 1,
+            HashAlgorithm::Sm3 => 2,
+        }
+    }
+
+    /// Returns the algorithm with the given identifier.
+    pub fn from_id(id: u8) -> Option<Self> {
+        Self::ALL.into_iter().find(|algorithm| algorithm.id() == id)
+    }
+
+    /// Hashes the input.
+    pub fn digest(&self, data: &[u8]) -> H256 {
+        self.digest_concat(&[data])
+    }
+
+    /// Hashes the concatenated inputs.
+    pub fn digest_concat(&self, data: &[&[u8]]) -> H256 {
+        match self {
+            HashAlgorithm::Keccak256 => finalize::<Keccak256>(data),
+            HashAlgorithm::Sha256 => finalize::<Sha256>(data),
+            HashAlgorithm::Sm3 => finalize::<Sm3>(data),
+        }
+    }
+}
+
+fn finalize<D: Digest>(data: &[&[u8]]) -> H256 {
+    let mut hasher = D::new();
+    for slice in data {
+        hasher.update(slice);
+    }
+    let mut bytes = [0u8; 32];
+    bytes.copy_from_slice(&hasher.finalize());
+    H256::from(bytes)
+}
+
+impl fmt::Display for HashAlgorithm {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// Hash algorithm in force at each block height.
+#[derive(Debug, Clone, PartialEq, Eq, Default)]
+pub struct HashSchedule {
+    /// Algorithm from genesis
+    genesis: HashAlgorithm,
+    /// (activation height, algorithm), ordered by height
+    migrations: Vec<(u64, HashAlgorithm)>,
+}
+
+impl HashSchedule {
+    /// Creates a schedule using `genesis` at every height.
+    pub fn new(genesis: HashAlgorithm) -> Self {
+        Self {
+            genesis,
+            migrations: Vec::new(),
+        }
+    }
+
+    /// Switches to `algorithm` from `activation_height` on. A later
+    /// migration at the same height replaces the earlier one.
+    pub fn with_migration(mut self, activation_height: u64, algorithm: HashAlgorithm) -> Self {
+        self.migrations
+            .retain(|(height, _)| *height != activation_height);
+        let index = self
+            .migrations
+            .partition_point(|(height, _)| *height < activation_height);
+        self.migrations
+            .insert(index, (activation_height, algorithm));
+        self
+    }
+
+    /// Returns the algorithm blocks at `height` are hashed with.
+    pub fn algorithm_at(&self, height: u64) -> HashAlgorithm {
+        self.migrations
+            .iter()
+            .take_while(|(activation, _)| *activation <= height)
+            .last()
+            .map_or(self.genesis, |(_, algorithm)| *algorithm)
+    }
+
+    /// Returns the previous algorithm if `height` is a transition block,
+    /// i.e. a migration to a different algorithm activates there.
+    pub fn legacy_algorithm_at(&self, height: u64) -> Option<HashAlgorithm> {
+        if height == 0 {
+            return None;
+        }
+        let previous = self.algorithm_at(height - 1);
+        (previous != self.algorithm_at(height)).then_some(previous)
+    }
+
+    /// Returns the migrations as (activation height, algorithm).
+    pub fn migrations(&self) -> &[(u64, HashAlgorithm)] {
+        &self.migrations
+    }
+}
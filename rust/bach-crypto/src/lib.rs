@@ -5,6 +5,32 @@
 //! - `PrivateKey`: secp256k1 private key
 //! - `PublicKey`: secp256k1 public key
 //! - `Signature`: ECDSA signature with recovery ID
+//! - `Ed25519PrivateKey`, `Ed25519PublicKey`, `Ed25519Signature`: Ed25519
+//!   keys and signatures
+//! - `Sm2PrivateKey`, `Sm2PublicKey`, `Sm2Signature`: SM2 keys and
+//!   signatures
+//! - `MemberKey`, `MemberSignature`: member keys and signatures of any
+//!   algorithm, over a message digested per the member's `SignatureScheme`
+//! - `HashAlgorithm`, `HashSchedule`: block hash algorithms and migrations
+
+mod ed25519;
+mod hash;
+mod member;
+mod sm2;
+
+pub use ed25519::{
+    Ed25519PrivateKey, Ed25519PublicKey, Ed25519Signature, ED25519_PUBLIC_KEY_LENGTH,
+    ED25519_SIGNATURE_LENGTH,
+};
+pub use hash::{HashAlgorithm, HashSchedule};
+pub use member::{
+    KeyAlgorithm, MemberKey, MemberSignature, SignatureScheme, SigningMember,
+    ED25519_MEMBER_SIGNATURE_LENGTH, SM2_MEMBER_SIGNATURE_LENGTH,
+};
+pub use self::sm2::{
+    Sm2PrivateKey, Sm2PublicKey, Sm2Signature, SM2_DISTID, SM2_PUBLIC_KEY_LENGTH,
+    SM2_SIGNATURE_LENGTH,
+};
 
 use bach_primitives::{Address, H256, ADDRESS_LENGTH};
 use k256::ecdsa::{RecoveryId, Signature as K256Signature, SigningKey, VerifyingKey};
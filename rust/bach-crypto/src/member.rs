@@ -0,0 +1,478 @@
+//! Member keys and signatures
+//!
+//! A member (an account sending transactions or an RPC client) signs with
+//! a secp256k1, Ed25519 or SM2 key. `MemberSignature` holds any kind and
+//! resolves the signer's address: secp256k1 signatures recover the public
+//! key, Ed25519 and SM2 signatures carry it and are verified against it.
+//!
+//! A signature also records the hash algorithm its message was digested
+//! with. Together the key and hash algorithm make the member's
+//! `SignatureScheme`. The signer doesn't pick the hash: chain config
+//! assigns one to each key algorithm it allows, defaulting to the
+//! algorithm's own (Keccak-256, or SM3 for SM2), and `sign_member_with`
+//! digests with it. Verifiers recompute the message with the recorded hash
+//! and reject schemes chain config doesn't allow.
+//!
+//! Encoded signatures are told apart by length: 65 bytes (r + s + v) for
+//! secp256k1, 96 bytes (public key + R + S) for Ed25519 and 129 bytes
+//! (public key + r + s) for SM2. Signatures over a hash other than
+//! Keccak-256 append its one-byte id.
+
+use crate::ed25519::{
+    Ed25519PrivateKey, Ed25519PublicKey, Ed25519Signature, ED25519_PUBLIC_KEY_LENGTH,
+    ED25519_SIGNATURE_LENGTH,
+};
+use crate::sm2::{
+    Sm2PrivateKey, Sm2PublicKey, Sm2Signature, SM2_PUBLIC_KEY_LENGTH, SM2_SIGNATURE_LENGTH,
+};
+use crate::{CryptoError, HashAlgorithm, PrivateKey, Signature, SIGNATURE_LENGTH};
+use bach_primitives::{Address, H256};
+use std::fmt;
+
+/// Length of an encoded Ed25519 member signature (public key + signature)
+pub const ED25519_MEMBER_SIGNATURE_LENGTH: usize =
+    ED25519_PUBLIC_KEY_LENGTH + ED25519_SIGNATURE_LENGTH;
+
+/// Length of an encoded SM2 member signature (public key + signature)
+pub const SM2_MEMBER_SIGNATURE_LENGTH: usize = SM2_PUBLIC_KEY_LENGTH + SM2_SIGNATURE_LENGTH;
+
+/// Signature algorithm of a member key
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum KeyAlgorithm {
+    /// ECDSA over secp256k1 with public key recovery
+    Secp256k1,
+    /// Ed25519
+    Ed25519,
+    /// SM2 (GB/T 32918)
+    Sm2,
+}
+
+impl KeyAlgorithm {
+    /// Every supported algorithm
+    pub const ALL: [KeyAlgorithm; 3] =
+        [KeyAlgorithm::Secp256k1, KeyAlgorithm::Ed25519, KeyAlgorithm::Sm2];
+
+    /// Returns the algorithm name used in configs and key files.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            KeyAlgorithm::Secp256k1 => "secp256k1",
+            KeyAlgorithm::Ed25519 => "ed25519",
+            KeyAlgorithm::Sm2 => "sm2",
+        }
+    }
+
+    /// Returns the hash messages are digested with for keys of this
+    /// algorithm unless chain config assigns another: SM3 for SM2,
+    /// Keccak-256 otherwise.
+    pub fn default_hash(&self) -> HashAlgorithm {
+        match self {
+            KeyAlgorithm::Secp256k1 | KeyAlgorithm::Ed25519 => HashAlgorithm::Keccak256,
+            KeyAlgorithm::Sm2 => HashAlgorithm::Sm3,
+        }
+    }
+
+    /// Parses an algorithm name (case-insensitive).
+    pub fn from_name(name: &str) -> Option<Self> {
+        Self::ALL
+            .into_iter()
+            .find(|algorithm| algorithm.as_str().eq_ignore_ascii_case(name.trim()))
+    }
+}
+
+impl fmt::Display for KeyAlgorithm {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// A key algorithm and the hash algorithm messages are digested with
+/// before signing
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct SignatureScheme {
+    /// Key algorithm
+    pub key: KeyAlgorithm,
+    /// Message hash algorithm
+    pub hash: HashAlgorithm,
+}
+
+impl SignatureScheme {
+    /// Creates a scheme.
+    pub fn new(key: KeyAlgorithm, hash: HashAlgorithm) -> Self {
+        Self { key, hash }
+    }
+
+    /// Parses a scheme name: a key algorithm alone (hashing with its
+    /// default hash) or `<key>/<hash>`, e.g. `ed25519/sm3`.
+    pub fn from_name(name: &str) -> Option<Self> {
+        match name.split_once('/') {
+            Some((key, hash)) => Some(Self::new(
+                KeyAlgorithm::from_name(key)?,
+                HashAlgorithm::from_name(hash)?,
+            )),
+            None => KeyAlgorithm::from_name(name).map(Self::from),
+        }
+    }
+
+    /// Returns the scheme keys of algorithm `key` sign with on a chain
+    /// allowing `schemes`: the one they list for `key`, or its default
+    /// hash if they list none.
+    pub fn for_key(key: KeyAlgorithm, schemes: &[SignatureScheme]) -> Self {
+        schemes
+            .iter()
+            .find(|scheme| scheme.key == key)
+            .copied()
+            .unwrap_or_else(|| key.into())
+    }
+}
+
+impl From<KeyAlgorithm> for SignatureScheme {
+    fn from(key: KeyAlgorithm) -> Self {
+        Self::new(key, key.default_hash())
+    }
+}
+
+impl fmt::Display for SignatureScheme {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.hash == self.key.default_hash() {
+            return write!(f, "{}", self.key);
+        }
+        write!(f, "{}/{}", self.key, self.hash)
+    }
+}
+
+/// A signature by a secp256k1, Ed25519 or SM2 member key.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum MemberSignature {
+    /// Recoverable ECDSA signature
+    Secp256k1 {
+        /// Signature over the message
+        signature: Signature,
+        /// Hash the message was digested with
+        hash: HashAlgorithm,
+    },
+    /// Ed25519 signature with the signer's public key
+    Ed25519 {
+        /// Signer's public key
+        public_key: Ed25519PublicKey,
+        /// Signature by `public_key`
+        signature: Ed25519Signature,
+        /// Hash the message was digested with
+        hash: HashAlgorithm,
+    },
+    /// SM2 signature with the signer's public key
+    Sm2 {
+        /// Signer's public key
+        public_key: Sm2PublicKey,
+        /// Signature by `public_key`
+        signature: Sm2Signature,
+        /// Hash the message was digested with
+        hash: HashAlgorithm,
+    },
+}
+
+impl MemberSignature {
+    /// Returns the algorithm of the signing key.
+    pub fn algorithm(&self) -> KeyAlgorithm {
+        match self {
+            MemberSignature::Secp256k1 { .. } => KeyAlgorithm::Secp256k1,
+            MemberSignature::Ed25519 { .. } => KeyAlgorithm::Ed25519,
+            MemberSignature::Sm2 { .. } => KeyAlgorithm::Sm2,
+        }
+    }
+
+    /// Returns the hash algorithm the signed message was digested with.
+    pub fn hash_algorithm(&self) -> HashAlgorithm {
+        match self {
+            MemberSignature::Secp256k1 { hash, .. }
+            | MemberSignature::Ed25519 { hash, .. }
+            | MemberSignature::Sm2 { hash, .. } => *hash,
+        }
+    }
+
+    /// Returns the key and hash algorithm of the signature.
+    pub fn scheme(&self) -> SignatureScheme {
+        SignatureScheme::new(self.algorithm(), self.hash_algorithm())
+    }
+
+    /// Records that the signed message was digested with `algorithm`.
+    fn with_hash(mut self, algorithm: HashAlgorithm) -> Self {
+        match &mut self {
+            MemberSignature::Secp256k1 { hash, .. }
+            | MemberSignature::Ed25519 { hash, .. }
+            | MemberSignature::Sm2 { hash, .. } => *hash = algorithm,
+        }
+        self
+    }
+
+    /// Encodes the signature: r + s + v for secp256k1, public key + R + S
+    /// for Ed25519 and public key + r + s for SM2, followed by the hash id
+    /// unless it is Keccak-256.
+    pub fn to_bytes(&self) -> Vec<u8> {
+        let mut bytes = match self {
+            MemberSignature::Secp256k1 { signature, .. } => signature.to_bytes().to_vec(),
+            MemberSignature::Ed25519 {
+                public_key,
+                signature,
+                ..
+            } => [
+                public_key.to_bytes().as_slice(),
+                signature.to_bytes().as_slice(),
+            ]
+            .concat(),
+            MemberSignature::Sm2 {
+                public_key,
+                signature,
+                ..
+            } => [
+                public_key.to_bytes().as_slice(),
+                signature.to_bytes().as_slice(),
+            ]
+            .concat(),
+        };
+        let hash = self.hash_algorithm();
+        if hash != HashAlgorithm::Keccak256 {
+            bytes.push(hash.id());
+        }
+        bytes
+    }
+
+    /// Decodes a signature, picking the algorithm from its length.
+    pub fn from_bytes(bytes: &[u8]) -> Result<Self, CryptoError> {
+        let (bytes, hash) = match bytes.len() {
+            SIGNATURE_LENGTH | ED25519_MEMBER_SIGNATURE_LENGTH | SM2_MEMBER_SIGNATURE_LENGTH => {
+                (bytes, HashAlgorithm::Keccak256)
+            }
+            _ => {
+                // Keccak-256 is never tagged, so each signature has one
+                // encoding
+                let (id, bytes) = bytes.split_last().ok_or(CryptoError::InvalidSignature)?;
+                match HashAlgorithm::from_id(*id) {
+                    Some(hash) if hash != HashAlgorithm::Keccak256 => (bytes, hash),
+                    _ => return Err(CryptoError::InvalidSignature),
+                }
+            }
+        };
+        match bytes.len() {
+            SIGNATURE_LENGTH => {
+                let bytes: &[u8; SIGNATURE_LENGTH] = bytes.try_into().unwrap();
+                Ok(MemberSignature::Secp256k1 {
+                    signature: Signature::from_bytes(bytes)?,
+                    hash,
+                })
+            }
+            ED25519_MEMBER_SIGNATURE_LENGTH => {
+                let (public_key, signature) = bytes.split_at(ED25519_PUBLIC_KEY_LENGTH);
+                Ok(MemberSignature::Ed25519 {
+                    public_key: Ed25519PublicKey::from_bytes(public_key.try_into().unwrap())?,
+                    signature: Ed25519Signature::from_bytes(signature.try_into().unwrap())?,
+                    hash,
+                })
+            }
+            SM2_MEMBER_SIGNATURE_LENGTH => {
+                let (public_key, signature) = bytes.split_at(SM2_PUBLIC_KEY_LENGTH);
+                Ok(MemberSignature::Sm2 {
+                    public_key: Sm2PublicKey::from_bytes(public_key.try_into().unwrap())?,
+                    signature: Sm2Signature::from_bytes(signature.try_into().unwrap())?,
+                    hash,
+                })
+            }
+            _ => Err(CryptoError::InvalidSignature),
+        }
+    }
+
+    /// Returns the address that signed `message`.
+    ///
+    /// Fails if the secp256k1 public key can't be recovered or the Ed25519
+    /// or SM2 signature doesn't verify against the carried public key.
+    pub fn signer(&self, message: &H256) -> Result<Address, CryptoError> {
+        match self {
+            MemberSignature::Secp256k1 { signature, .. } => {
+                Ok(signature.recover(message)?.to_address())
+            }
+            MemberSignature::Ed25519 {
+                public_key,
+                signature,
+                ..
+            } => {
+                if !public_key.verify(signature, message) {
+                    return Err(CryptoError::InvalidSignature);
+                }
+                Ok(public_key.to_address())
+            }
+            MemberSignature::Sm2 {
+                public_key,
+                signature,
+                ..
+            } => {
+                if !public_key.verify(signature, message) {
+                    return Err(CryptoError::InvalidSignature);
+                }
+                Ok(public_key.to_address())
+            }
+        }
+    }
+}
+
+impl From<Signature> for MemberSignature {
+    fn from(signature: Signature) -> Self {
+        MemberSignature::Secp256k1 {
+            signature,
+            hash: HashAlgorithm::Keccak256,
+        }
+    }
+}
+
+/// A key a member signs with.
+pub trait SigningMember {
+    /// Returns the key's algorithm.
+    fn algorithm(&self) -> KeyAlgorithm;
+
+    /// Returns the member's address.
+    fn address(&self) -> Address;
+
+    /// Signs a message hash digested with the key algorithm's default
+    /// hash.
+    fn sign_member(&self, message: &H256) -> MemberSignature;
+
+    /// Returns the scheme the member signs with on a chain allowing
+    /// `schemes`.
+    fn signature_scheme(&self, schemes: &[SignatureScheme]) -> SignatureScheme {
+        SignatureScheme::for_key(self.algorithm(), schemes)
+    }
+
+    /// Digests `data` with the hash the member's scheme on a chain allowing
+    /// `schemes` names and signs it, recording the hash in the signature.
+    fn sign_member_with(&self, data: &[u8], schemes: &[SignatureScheme]) -> MemberSignature {
+        let hash = self.signature_scheme(schemes).hash;
+        self.sign_member(&hash.digest(data)).with_hash(hash)
+    }
+}
+
+impl SigningMember for PrivateKey {
+    fn algorithm(&self) -> KeyAlgorithm {
+        KeyAlgorithm::Secp256k1
+    }
+
+    fn address(&self) -> Address {
+        self.public_key().to_address()
+    }
+
+    fn sign_member(&self, message: &H256) -> MemberSignature {
+        MemberSignature::Secp256k1 {
+            signature: self.sign(message),
+            hash: HashAlgorithm::Keccak256,
+        }
+    }
+}
+
+impl SigningMember for Ed25519PrivateKey {
+    fn algorithm(&self) -> KeyAlgorithm {
+        KeyAlgorithm::Ed25519
+    }
+
+    fn address(&self) -> Address {
+        self.public_key().to_address()
+    }
+
+    fn sign_member(&self, message: &H256) -> MemberSignature {
+        MemberSignature::Ed25519 {
+            public_key: self.public_key(),
+            signature: self.sign(message),
+            hash: HashAlgorithm::Keccak256,
+        }
+    }
+}
+
+impl SigningMember for Sm2PrivateKey {
+    fn algorithm(&self) -> KeyAlgorithm {
+        KeyAlgorithm::Sm2
+    }
+
+    fn address(&self) -> Address {
+        self.public_key().to_address()
+    }
+
+    fn sign_member(&self, message: &H256) -> MemberSignature {
+        MemberSignature::Sm2 {
+            public_key: self.public_key(),
+            signature: self.sign(message),
+            hash: HashAlgorithm::Sm3,
+        }
+    }
+}
+
+/// A member private key of any algorithm.
+#[derive(Debug, Clone)]
+pub enum MemberKey {
+    /// secp256k1 key
+    Secp256k1(PrivateKey),
+    /// Ed25519 key
+    Ed25519(Ed25519PrivateKey),
+    /// SM2 key
+    Sm2(Sm2PrivateKey),
+}
+
+impl MemberKey {
+    /// Generates a random key of the given algorithm.
+    pub fn generate(algorithm: KeyAlgorithm) -> Self {
+        match algorithm {
+            KeyAlgorithm::Secp256k1 => MemberKey::Secp256k1(PrivateKey::random()),
+            KeyAlgorithm::Ed25519 => MemberKey::Ed25519(Ed25519PrivateKey::random()),
+            KeyAlgorithm::Sm2 => MemberKey::Sm2(Sm2PrivateKey::random()),
+        }
+    }
+
+    /// Creates a key of the given algorithm from its raw bytes.
+    pub fn from_bytes(algorithm: KeyAlgorithm, bytes: &[u8; 32]) -> Result<Self, CryptoError> {
+        match algorithm {
+            KeyAlgorithm::Secp256k1 => PrivateKey::from_bytes(bytes).map(MemberKey::Secp256k1),
+            KeyAlgorithm::Ed25519 => Ok(MemberKey::Ed25519(Ed25519PrivateKey::from_bytes(bytes))),
+            KeyAlgorithm::Sm2 => Sm2PrivateKey::from_bytes(bytes).map(MemberKey::Sm2),
+        }
+    }
+
+    /// Returns the raw bytes.
+    pub fn to_bytes(&self) -> [u8; 32] {
+        match self {
+            MemberKey::Secp256k1(key) => key.to_bytes(),
+            MemberKey::Ed25519(key) => key.to_bytes(),
+            MemberKey::Sm2(key) => key.to_bytes(),
+        }
+    }
+
+    /// Returns the encoded public key: 64 bytes for secp256k1, 32 for
+    /// Ed25519 and 65 (uncompressed SEC1) for SM2.
+    pub fn public_key_bytes(&self) -> Vec<u8> {
+        match self {
+            MemberKey::Secp256k1(key) => key.public_key().to_bytes().to_vec(),
+            MemberKey::Ed25519(key) => key.public_key().to_bytes().to_vec(),
+            MemberKey::Sm2(key) => key.public_key().to_bytes().to_vec(),
+        }
+    }
+}
+
+impl SigningMember for MemberKey {
+    fn algorithm(&self) -> KeyAlgorithm {
+        match self {
+            MemberKey::Secp256k1(key) => key.algorithm(),
+            MemberKey::Ed25519(key) => key.algorithm(),
+            MemberKey::Sm2(key) => key.algorithm(),
+        }
+    }
+
+    fn address(&self) -> Address {
+        match self {
+            MemberKey::Secp256k1(key) => key.address(),
+            MemberKey::Ed25519(key) => key.address(),
+            MemberKey::Sm2(key) => key.address(),
+        }
+    }
+
+    fn sign_member(&self, message: &H256) -> MemberSignature {
+        match self {
+            MemberKey::Secp256k1(key) => key.sign_member(message),
+            MemberKey::Ed25519(key) => key.sign_member(message),
+            MemberKey::Sm2(key) => key.sign_member(message),
+        }
+    }
+}
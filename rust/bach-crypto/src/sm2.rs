@@ -0,0 +1,162 @@
+//! SM2 keys and signatures
+//!
+//! Members can hold SM2 keys (GB/T 32918) instead of secp256k1 or Ed25519
+//! ones. SM2 signatures aren't recovered to a public key either, so the
+//! signer's public key is carried next to them (see `MemberSignature`).
+//! Addresses are derived like secp256k1 ones: the last 20 bytes of the
+//! Keccak-256 hash of the public key without its SEC1 tag.
+//!
+//! Messages are 32-byte hashes, SM3 unless chain config says otherwise,
+//! signed as-is under the default distinguishing identifier.
+
+use crate::{hex_encode, keccak256, CryptoError};
+use bach_primitives::{Address, ADDRESS_LENGTH, H256};
+use rand_core::RngCore;
+use signature::hazmat::{PrehashSigner, PrehashVerifier};
+use ::sm2::dsa::{Signature, SigningKey, VerifyingKey};
+
+/// Length of an SM2 public key in bytes (uncompressed SEC1: 0x04 + x + y)
+pub const SM2_PUBLIC_KEY_LENGTH: usize = 65;
+
+/// Length of an SM2 signature in bytes (r=32 + s=32)
+pub const SM2_SIGNATURE_LENGTH: usize = 64;
+
+/// Distinguishing identifier hashed into SM2 signatures (the GB/T 35276
+/// default)
+pub const SM2_DISTID: &str = "1234567812345678";
+
+/// An SM2 private key (32 bytes).
+#[derive(Clone)]
+pub struct Sm2PrivateKey {
+    inner: SigningKey,
+}
+
+impl Sm2PrivateKey {
+    /// Generates a random private key using OS entropy.
+    pub fn random() -> Self {
+        loop {
+            let mut bytes = [0u8; 32];
+            rand_core::OsRng.fill_bytes(&mut bytes);
+            if let Ok(key) = Self::from_bytes(&bytes) {
+                return key;
+            }
+        }
+    }
+
+    /// Creates a private key from raw bytes, rejecting zero and values not
+    /// below the curve order.
+    pub fn from_bytes(bytes: &[u8; 32]) -> Result<Self, CryptoError> {
+        let inner = SigningKey::from_bytes(SM2_DISTID, &(*bytes).into())
+            .map_err(|_| CryptoError::InvalidPrivateKey)?;
+        Ok(Self { inner })
+    }
+
+    /// Returns the raw bytes.
+    pub fn to_bytes(&self) -> [u8; 32] {
+        self.inner.to_bytes().into()
+    }
+
+    /// Derives the corresponding public key.
+    pub fn public_key(&self) -> Sm2PublicKey {
+        let point = self.inner.verifying_key().to_encoded_point(false);
+        Sm2PublicKey {
+            bytes: point.as_bytes().try_into().expect("uncompressed point"),
+        }
+    }
+
+    /// Signs a message hash.
+    pub fn sign(&self, message: &H256) -> Sm2Signature {
+        let signature: Signature = self
+            .inner
+            .sign_prehash(message.as_bytes())
+            .expect("signing a 32-byte hash");
+        Sm2Signature {
+            bytes: signature.to_bytes(),
+        }
+    }
+}
+
+impl std::fmt::Debug for Sm2PrivateKey {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Sm2PrivateKey")
+            .field("bytes", &"[REDACTED]")
+            .finish()
+    }
+}
+
+/// An SM2 public key (uncompressed SEC1, 65 bytes).
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub struct Sm2PublicKey {
+    bytes: [u8; SM2_PUBLIC_KEY_LENGTH],
+}
+
+impl Sm2PublicKey {
+    /// Creates from uncompressed SEC1 bytes, rejecting encodings that are
+    /// not a curve point.
+    pub fn from_bytes(bytes: &[u8; SM2_PUBLIC_KEY_LENGTH]) -> Result<Self, CryptoError> {
+        VerifyingKey::from_sec1_bytes(SM2_DISTID, bytes)
+            .map_err(|_| CryptoError::InvalidPublicKey)?;
+        Ok(Self { bytes: *bytes })
+    }
+
+    /// Returns the uncompressed SEC1 bytes.
+    pub fn to_bytes(&self) -> [u8; SM2_PUBLIC_KEY_LENGTH] {
+        self.bytes
+    }
+
+    /// Derives the address.
+    /// Address = keccak256(x + y)[12..32]
+    pub fn to_address(&self) -> Address {
+        let hash = keccak256(&self.bytes[1..]);
+        let mut addr_bytes = [0u8; ADDRESS_LENGTH];
+        addr_bytes.copy_from_slice(&hash.as_bytes()[12..32]);
+        Address::from(addr_bytes)
+    }
+
+    /// Verifies a signature against this public key.
+    pub fn verify(&self, signature: &Sm2Signature, message: &H256) -> bool {
+        let Ok(key) = VerifyingKey::from_sec1_bytes(SM2_DISTID, &self.bytes) else {
+            return false;
+        };
+        let Ok(signature) = Signature::from_bytes(&signature.bytes) else {
+            return false;
+        };
+        key.verify_prehash(message.as_bytes(), &signature).is_ok()
+    }
+}
+
+impl std::fmt::Debug for Sm2PublicKey {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Sm2PublicKey")
+            .field("bytes", &hex_encode(&self.bytes))
+            .finish()
+    }
+}
+
+/// An SM2 signature (64 bytes: r + s).
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub struct Sm2Signature {
+    bytes: [u8; SM2_SIGNATURE_LENGTH],
+}
+
+impl Sm2Signature {
+    /// Creates a signature from raw bytes, rejecting zero or out of range
+    /// components.
+    pub fn from_bytes(bytes: &[u8; SM2_SIGNATURE_LENGTH]) -> Result<Self, CryptoError> {
+        Signature::from_bytes(bytes).map_err(|_| CryptoError::InvalidSignature)?;
+        Ok(Self { bytes: *bytes })
+    }
+
+    /// Returns the raw bytes (r + s).
+    pub fn to_bytes(&self) -> [u8; SM2_SIGNATURE_LENGTH] {
+        self.bytes
+    }
+}
+
+impl std::fmt::Debug for Sm2Signature {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Sm2Signature")
+            .field("bytes", &hex_encode(&self.bytes))
+            .finish()
+    }
+}
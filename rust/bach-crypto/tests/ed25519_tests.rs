@@ -0,0 +1,203 @@
+//! Tests for Ed25519 keys and member signatures
+
+use bach_crypto::{
+    keccak256, CryptoError, Ed25519PrivateKey, Ed25519PublicKey, Ed25519Signature, HashAlgorithm,
+    KeyAlgorithm, MemberKey, MemberSignature, SignatureScheme, SigningMember,
+    ED25519_MEMBER_SIGNATURE_LENGTH,
+};
+use bach_primitives::H256;
+
+// =============================================================================
+// Ed25519 keys
+// =============================================================================
+
+mod ed25519 {
+    use super::*;
+
+    #[test]
+    fn sign_and_verify() {
+        let key = Ed25519PrivateKey::random();
+        let message = keccak256(b"hello");
+        let signature = key.sign(&message);
+        assert!(key.public_key().verify(&signature, &message));
+        assert!(!key.public_key().verify(&signature, &keccak256(b"other")));
+        assert!(!Ed25519PrivateKey::random()
+            .public_key()
+            .verify(&signature, &message));
+    }
+
+    #[test]
+    fn signing_is_deterministic() {
+        let key = Ed25519PrivateKey::from_bytes(&[7u8; 32]);
+        let message = H256::from([1u8; 32]);
+        assert_eq!(key.sign(&message), key.sign(&message));
+        assert_eq!(key.to_bytes(), [7u8; 32]);
+    }
+
+    #[test]
+    fn rfc8032_public_key() {
+        // RFC 8032, section 7.1, test 1
+        let seed: [u8; 32] =
+            hex::decode("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+                .unwrap()
+                .try_into()
+                .unwrap();
+        let expected =
+            hex::decode("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+                .unwrap();
+        let public_key = Ed25519PrivateKey::from_bytes(&seed).public_key();
+        assert_eq!(public_key.to_bytes().to_vec(), expected);
+    }
+
+    #[test]
+    fn public_key_roundtrip() {
+        let public_key = Ed25519PrivateKey::random().public_key();
+        let decoded = Ed25519PublicKey::from_bytes(&public_key.to_bytes()).unwrap();
+        assert_eq!(decoded, public_key);
+        assert_eq!(decoded.to_address(), public_key.to_address());
+    }
+
+    #[test]
+    fn rejects_unreduced_s() {
+        let mut bytes = Ed25519PrivateKey::random().sign(&H256::zero()).to_bytes();
+        bytes[63] |= 0x80;
+        assert_eq!(
+            Ed25519Signature::from_bytes(&bytes),
+            Err(CryptoError::InvalidSignature)
+        );
+    }
+
+    #[test]
+    fn debug_redacts_private_key() {
+        let debug = format!("{:?}", Ed25519PrivateKey::from_bytes(&[0xab; 32]));
+        assert!(debug.contains("REDACTED"));
+        assert!(!debug.contains("abab"));
+    }
+}
+
+// =============================================================================
+// Member signatures
+// =============================================================================
+
+mod member {
+    use super::*;
+
+    #[test]
+    fn algorithm_names() {
+        for algorithm in KeyAlgorithm::ALL {
+            assert_eq!(KeyAlgorithm::from_name(algorithm.as_str()), Some(algorithm));
+        }
+        assert_eq!(
+            KeyAlgorithm::from_name(" Ed25519 "),
+            Some(KeyAlgorithm::Ed25519)
+        );
+        assert_eq!(KeyAlgorithm::from_name("SM2"), Some(KeyAlgorithm::Sm2));
+        assert_eq!(KeyAlgorithm::from_name("sm9"), None);
+    }
+
+    #[test]
+    fn signer_matches_address() {
+        let message = keccak256(b"transfer");
+        for algorithm in KeyAlgorithm::ALL {
+            let key = MemberKey::generate(algorithm);
+            let signature = key.sign_member(&message);
+            assert_eq!(signature.algorithm(), algorithm);
+            assert_eq!(signature.signer(&message).unwrap(), key.address());
+        }
+    }
+
+    #[test]
+    fn encoding_roundtrip() {
+        let message = keccak256(b"roundtrip");
+        for (algorithm, length) in [
+            (KeyAlgorithm::Secp256k1, 65),
+            (KeyAlgorithm::Ed25519, ED25519_MEMBER_SIGNATURE_LENGTH),
+        ] {
+            let signature = MemberKey::generate(algorithm).sign_member(&message);
+            let bytes = signature.to_bytes();
+            assert_eq!(bytes.len(), length);
+            assert_eq!(MemberSignature::from_bytes(&bytes).unwrap(), signature);
+        }
+        assert_eq!(
+            MemberSignature::from_bytes(&[0u8; 64]),
+            Err(CryptoError::InvalidSignature)
+        );
+    }
+
+    #[test]
+    fn signing_hash_follows_chain_schemes() {
+        let data = b"tagged";
+        let sm3 = |key| SignatureScheme::new(key, HashAlgorithm::Sm3);
+        let keccak = |key| SignatureScheme::new(key, HashAlgorithm::Keccak256);
+        let schemes: Vec<SignatureScheme> = KeyAlgorithm::ALL.into_iter().map(sm3).collect();
+        for algorithm in KeyAlgorithm::ALL {
+            let key = MemberKey::generate(algorithm);
+            // The chain's scheme for the key picks the hash, its default
+            // hash if the chain lists none
+            assert_eq!(key.sign_member_with(data, &[]).scheme(), algorithm.into());
+            let signature = key.sign_member_with(data, &schemes);
+            assert_eq!(signature.scheme(), sm3(algorithm));
+            let message = HashAlgorithm::Sm3.digest(data);
+            assert_eq!(signature.signer(&message).unwrap(), key.address());
+
+            // One extra byte for the hash id; Keccak-256 is never tagged
+            let bytes = signature.to_bytes();
+            let untagged = key.sign_member_with(data, &[keccak(algorithm)]).to_bytes();
+            assert_eq!(bytes.len(), untagged.len() + 1);
+            assert_eq!(MemberSignature::from_bytes(&bytes).unwrap(), signature);
+            let mut keccak_tagged = bytes.clone();
+            *keccak_tagged.last_mut().unwrap() = HashAlgorithm::Keccak256.id();
+            assert!(MemberSignature::from_bytes(&keccak_tagged).is_err());
+        }
+
+        assert_eq!(
+            SignatureScheme::from_name("Ed25519/SM3"),
+            Some(SignatureScheme::new(KeyAlgorithm::Ed25519, HashAlgorithm::Sm3))
+        );
+        let secp256k1 = SignatureScheme::from_name("secp256k1").unwrap();
+        assert_eq!(secp256k1, KeyAlgorithm::Secp256k1.into());
+        assert_eq!(secp256k1.to_string(), "secp256k1");
+        assert_eq!(
+            SignatureScheme::new(KeyAlgorithm::Secp256k1, HashAlgorithm::Sha256).to_string(),
+            "secp256k1/sha256"
+        );
+        let sm2 = SignatureScheme::from_name("sm2/sm3").unwrap();
+        assert_eq!(sm2, KeyAlgorithm::Sm2.into());
+        assert_eq!(sm2.to_string(), "sm2");
+        assert_eq!(
+            SignatureScheme::new(KeyAlgorithm::Sm2, HashAlgorithm::Keccak256).to_string(),
+            "sm2/keccak256"
+        );
+        assert_eq!(SignatureScheme::from_name("ed25519/md5"), None);
+    }
+
+    #[test]
+    fn ed25519_signature_for_other_message_is_rejected() {
+        let key = MemberKey::generate(KeyAlgorithm::Ed25519);
+        let signature = key.sign_member(&keccak256(b"signed"));
+        assert_eq!(
+            signature.signer(&keccak256(b"claimed")),
+            Err(CryptoError::InvalidSignature)
+        );
+    }
+
+    #[test]
+    fn ed25519_public_key_swap_is_rejected() {
+        let message = keccak256(b"swap");
+        let signature = Ed25519PrivateKey::random().sign(&message);
+        let forged = MemberSignature::Ed25519 {
+            public_key: Ed25519PrivateKey::random().public_key(),
+            signature,
+            hash: HashAlgorithm::Keccak256,
+        };
+        assert!(forged.signer(&message).is_err());
+    }
+
+    #[test]
+    fn member_key_from_bytes() {
+        let key = MemberKey::from_bytes(KeyAlgorithm::Ed25519, &[9u8; 32]).unwrap();
+        assert_eq!(key.to_bytes(), [9u8; 32]);
+        assert_eq!(key.public_key_bytes().len(), 32);
+        assert!(MemberKey::from_bytes(KeyAlgorithm::Secp256k1, &[0u8; 32]).is_err());
+    }
+}
@@ -0,0 +1,115 @@
+//! Tests for hash algorithms and hash migration schedules
+
+use bach_crypto::{keccak256, HashAlgorithm, HashSchedule};
+use bach_primitives::H256;
+
+// =============================================================================
+// Hash algorithms
+// =============================================================================
+
+mod algorithm {
+    use super::*;
+
+    #[test]
+    fn keccak256_matches_keccak256_fn() {
+        assert_eq!(HashAlgorithm::Keccak256.digest(b"abc"), keccak256(b"abc"));
+    }
+
+    #[test]
+    fn sha256_abc() {
+        let expected =
+            H256::from_hex("0xba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+                .unwrap();
+        assert_eq!(HashAlgorithm::Sha256.digest(b"abc"), expected);
+    }
+
+    #[test]
+    fn sm3_abc() {
+        // GB/T 32905-2016, appendix A.1
+        let expected =
+            H256::from_hex("0x66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0")
+                .unwrap();
+        assert_eq!(HashAlgorithm::Sm3.digest(b"abc"), expected);
+    }
+
+    #[test]
+    fn digest_concat_equals_digest_of_concatenation() {
+        for algorithm in HashAlgorithm::ALL {
+            assert_eq!(
+                algorithm.digest_concat(&[b"hello", b" ", b"world"]),
+                algorithm.digest(b"hello world")
+            );
+        }
+    }
+
+    #[test]
+    fn algorithm_names() {
+        for algorithm in HashAlgorithm::ALL {
+            assert_eq!(
+                HashAlgorithm::from_name(algorithm.as_str()),
+                Some(algorithm)
+            );
+        }
+        assert_eq!(HashAlgorithm::from_name(" SM3 "), Some(HashAlgorithm::Sm3));
+        assert_eq!(HashAlgorithm::from_name("md5"), None);
+    }
+}
+
+// =============================================================================
+// Hash schedules
+// =============================================================================
+
+mod schedule {
+    use super::*;
+
+    #[test]
+    fn default_is_keccak256_everywhere() {
+        let schedule = HashSchedule::default();
+        assert_eq!(schedule.algorithm_at(0), HashAlgorithm::Keccak256);
+        assert_eq!(schedule.algorithm_at(u64::MAX), HashAlgorithm::Keccak256);
+        assert_eq!(schedule.legacy_algorithm_at(1), None);
+    }
+
+    #[test]
+    fn algorithm_by_height() {
+        let schedule = HashSchedule::default()
+            .with_migration(20, HashAlgorithm::Sm3)
+            .with_migration(10, HashAlgorithm::Sha256);
+        assert_eq!(schedule.algorithm_at(9), HashAlgorithm::Keccak256);
+        assert_eq!(schedule.algorithm_at(10), HashAlgorithm::Sha256);
+        assert_eq!(schedule.algorithm_at(19), HashAlgorithm::Sha256);
+        assert_eq!(schedule.algorithm_at(20), HashAlgorithm::Sm3);
+        assert_eq!(schedule.algorithm_at(1_000), HashAlgorithm::Sm3);
+    }
+
+    #[test]
+    fn transition_blocks() {
+        let schedule = HashSchedule::default()
+            .with_migration(10, HashAlgorithm::Sha256)
+            .with_migration(20, HashAlgorithm::Sm3);
+        assert_eq!(schedule.legacy_algorithm_at(9), None);
+        assert_eq!(
+            schedule.legacy_algorithm_at(10),
+            Some(HashAlgorithm::Keccak256)
+        );
+        assert_eq!(schedule.legacy_algorithm_at(11), None);
+        assert_eq!(
+            schedule.legacy_algorithm_at(20),
+            Some(HashAlgorithm::Sha256)
+        );
+    }
+
+    #[test]
+    fn migration_to_same_algorithm_is_not_a_transition() {
+        let schedule = HashSchedule::default().with_migration(5, HashAlgorithm::Keccak256);
+        assert_eq!(schedule.legacy_algorithm_at(5), None);
+    }
+
+    #[test]
+    fn later_migration_at_same_height_replaces_earlier() {
+        let schedule = HashSchedule::default()
+            .with_migration(5, HashAlgorithm::Sha256)
+            .with_migration(5, HashAlgorithm::Sm3);
+        assert_eq!(schedule.migrations(), &[(5, HashAlgorithm::Sm3)]);
+    }
+}
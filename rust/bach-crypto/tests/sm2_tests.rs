@@ -0,0 +1,143 @@
+//! Tests for SM2 keys and member signatures
+
+use bach_crypto::{
+    keccak256, CryptoError, HashAlgorithm, KeyAlgorithm, MemberKey, MemberSignature,
+    SignatureScheme, SigningMember, Sm2PrivateKey, Sm2PublicKey, Sm2Signature,
+    SM2_MEMBER_SIGNATURE_LENGTH, SM2_PUBLIC_KEY_LENGTH,
+};
+use bach_primitives::H256;
+
+// =============================================================================
+// SM2 keys
+// =============================================================================
+
+mod sm2 {
+    use super::*;
+
+    #[test]
+    fn sign_and_verify() {
+        let key = Sm2PrivateKey::random();
+        let message = HashAlgorithm::Sm3.digest(b"hello");
+        let signature = key.sign(&message);
+        assert!(key.public_key().verify(&signature, &message));
+        assert!(!key.public_key().verify(&signature, &HashAlgorithm::Sm3.digest(b"other")));
+        assert!(!Sm2PrivateKey::random().public_key().verify(&signature, &message));
+    }
+
+    #[test]
+    fn private_key_roundtrip() {
+        let key = Sm2PrivateKey::from_bytes(&[7u8; 32]).unwrap();
+        assert_eq!(key.to_bytes(), [7u8; 32]);
+        assert_eq!(
+            Sm2PrivateKey::from_bytes(&key.to_bytes()).unwrap().public_key(),
+            key.public_key()
+        );
+        assert_eq!(
+            Sm2PrivateKey::from_bytes(&[0u8; 32]).err(),
+            Some(CryptoError::InvalidPrivateKey)
+        );
+    }
+
+    #[test]
+    fn public_key_roundtrip() {
+        let public_key = Sm2PrivateKey::random().public_key();
+        let bytes = public_key.to_bytes();
+        assert_eq!(bytes.len(), SM2_PUBLIC_KEY_LENGTH);
+        assert_eq!(bytes[0], 0x04);
+        let decoded = Sm2PublicKey::from_bytes(&bytes).unwrap();
+        assert_eq!(decoded, public_key);
+
+        // The address hashes the point without its SEC1 tag
+        let hash = keccak256(&bytes[1..]);
+        assert_eq!(decoded.to_address().as_bytes(), &hash.as_bytes()[12..]);
+
+        assert_eq!(
+            Sm2PublicKey::from_bytes(&[0u8; SM2_PUBLIC_KEY_LENGTH]),
+            Err(CryptoError::InvalidPublicKey)
+        );
+    }
+
+    #[test]
+    fn rejects_zero_signature() {
+        assert_eq!(
+            Sm2Signature::from_bytes(&[0u8; 64]),
+            Err(CryptoError::InvalidSignature)
+        );
+    }
+
+    #[test]
+    fn debug_redacts_private_key() {
+        let debug = format!("{:?}", Sm2PrivateKey::from_bytes(&[0xab; 32]).unwrap());
+        assert!(debug.contains("REDACTED"));
+        assert!(!debug.contains("abab"));
+    }
+}
+
+// =============================================================================
+// SM2 member signatures
+// =============================================================================
+
+mod member {
+    use super::*;
+
+    #[test]
+    fn signs_over_sm3_by_default() {
+        let key = MemberKey::generate(KeyAlgorithm::Sm2);
+        assert_eq!(key.public_key_bytes().len(), SM2_PUBLIC_KEY_LENGTH);
+        assert_eq!(KeyAlgorithm::Sm2.default_hash(), HashAlgorithm::Sm3);
+
+        let signature = key.sign_member_with(b"transfer", &[]);
+        assert_eq!(signature.scheme(), KeyAlgorithm::Sm2.into());
+        let message = HashAlgorithm::Sm3.digest(b"transfer");
+        assert_eq!(signature.signer(&message).unwrap(), key.address());
+        assert!(signature.signer(&keccak256(b"transfer")).is_err());
+    }
+
+    #[test]
+    fn encoding_roundtrip() {
+        let key = MemberKey::generate(KeyAlgorithm::Sm2);
+
+        // SM3 is tagged; Keccak-256, if a chain assigns it, is not
+        let signature = key.sign_member_with(b"roundtrip", &[]);
+        let bytes = signature.to_bytes();
+        assert_eq!(bytes.len(), SM2_MEMBER_SIGNATURE_LENGTH + 1);
+        assert_eq!(MemberSignature::from_bytes(&bytes).unwrap(), signature);
+
+        let keccak = SignatureScheme::new(KeyAlgorithm::Sm2, HashAlgorithm::Keccak256);
+        let signature = key.sign_member_with(b"roundtrip", &[keccak]);
+        let bytes = signature.to_bytes();
+        assert_eq!(bytes.len(), SM2_MEMBER_SIGNATURE_LENGTH);
+        assert_eq!(MemberSignature::from_bytes(&bytes).unwrap().algorithm(), KeyAlgorithm::Sm2);
+    }
+
+    #[test]
+    fn public_key_swap_is_rejected() {
+        let message = H256::from([3u8; 32]);
+        let signature = Sm2PrivateKey::random().sign(&message);
+        let forged = MemberSignature::Sm2 {
+            public_key: Sm2PrivateKey::random().public_key(),
+            signature,
+            hash: HashAlgorithm::Sm3,
+        };
+        assert!(forged.signer(&message).is_err());
+    }
+
+    #[test]
+    fn mixed_schemes_on_one_chain() {
+        // ECDSA over SHA-256 next to SM2 over SM3
+        let schemes = [
+            SignatureScheme::new(KeyAlgorithm::Secp256k1, HashAlgorithm::Sha256),
+            KeyAlgorithm::Sm2.into(),
+        ];
+        for (algorithm, hash) in [
+            (KeyAlgorithm::Secp256k1, HashAlgorithm::Sha256),
+            (KeyAlgorithm::Sm2, HashAlgorithm::Sm3),
+        ] {
+            let key = MemberKey::generate(algorithm);
+            assert_eq!(key.signature_scheme(&schemes), SignatureScheme::new(algorithm, hash));
+            let signature = key.sign_member_with(b"mixed", &schemes);
+            assert_eq!(signature.hash_algorithm(), hash);
+            assert_eq!(signature.signer(&hash.digest(b"mixed")).unwrap(), key.address());
+        }
+    }
+}
@@ -5,8 +5,10 @@
 #![forbid(unsafe_code)]
 
 use bach_crypto::keccak256;
-use bach_primitives::{Address, H256, U256};
-use std::collections::HashMap;
+use bach_primitives::{Address, H256, SystemContract, U256};
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::ops::Bound;
+use std::sync::{Arc, Mutex};
 
 // =============================================================================
 // Constants
@@ -21,6 +23,34 @@ pub const MAX_CODE_SIZE: usize = 24576;
 /// Maximum call depth
 pub const MAX_CALL_DEPTH: usize = 1024;
 
+/// Bytes a non-zero storage slot counts towards the storage quota (key and
+/// value), as accounted by the state store
+pub const STORAGE_SLOT_BYTES: u64 = 64;
+
+// Protocol features changing execution, scheduled through chain config
+/// Contract debug logs through the 0x…0109 host call
+pub const FEATURE_CONTRACT_LOG: &str = "contract-log";
+/// Org read grants (0x…010A) and cross-org reads through its host call
+pub const FEATURE_ORG_GRANTS: &str = "org-grants";
+/// Paged storage scans through the 0x…010C host call
+pub const FEATURE_STORAGE_SCAN: &str = "storage-scan";
+/// Per-contract storage quota checked at SSTORE
+pub const FEATURE_STORAGE_QUOTA: &str = "storage-quota";
+/// Chunked init code uploads through 0x…0102
+pub const FEATURE_BYTECODE_STAGING: &str = "bytecode-staging";
+/// Index registry calls (0x…0108) from contracts
+pub const FEATURE_INDEX_CALLS: &str = "index-calls";
+
+/// Protocol features the EVM implements
+pub const EVM_FEATURES: &[&str] = &[
+    FEATURE_CONTRACT_LOG,
+    FEATURE_ORG_GRANTS,
+    FEATURE_STORAGE_SCAN,
+    FEATURE_STORAGE_QUOTA,
+    FEATURE_BYTECODE_STAGING,
+    FEATURE_INDEX_CALLS,
+];
+
 // Gas costs
 pub const GAS_ZERO: u64 = 0;
 pub const GAS_BASE: u64 = 2;
@@ -197,6 +227,31 @@ pub enum EvmError {
     ReturnDataOutOfBounds,
     /// Code size limit exceeded
     CodeSizeExceeded,
+    /// Bytecode staging call rejected
+    StagingFailed(String),
+    /// Contract upgrade rejected
+    UpgradeFailed(String),
+    /// Faucet call rejected
+    FaucetFailed(String),
+    /// The recipient already received, or the caller already requested, a
+    /// faucet grant in the current window
+    FaucetRateLimited { next_grant_at: u64 },
+    /// An isolated contract was used by an account outside every org
+    NotOrgMember(Address),
+    /// Org grants call rejected
+    OrgGrantFailed(String),
+    /// The caller lacks the role or org a contract method requires
+    MethodNotPermitted { contract: Address, selector: [u8; 4] },
+    /// Contract ACL call rejected
+    AclFailed(String),
+    /// A transaction called a paused contract
+    ContractPaused(Address),
+    /// Storage scan host call rejected
+    StorageScanFailed(String),
+    /// An SSTORE would push the contract's storage over the quota
+    StorageQuotaExceeded { address: Address, quota: u64 },
+    /// A system contract was called before its feature activated
+    FeatureInactive(String),
     /// Invalid code (starts with 0xEF)
     InvalidCode,
     /// Revert with data
@@ -220,6 +275,43 @@ pub struct ExecutionResult {
     pub error: Option<EvmError>,
     /// Logs emitted
     pub logs: Vec<Log>,
+    /// Nested calls and creates made during execution, in call order
+    pub call_trace: Vec<CallFrame>,
+    /// Debug logs written through the contract log host call; kept on
+    /// revert and never part of consensus state
+    pub contract_logs: ContractLogs,
+}
+
+/// Kind of a nested call frame
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum CallKind {
+    Call,
+    CallCode,
+    DelegateCall,
+    StaticCall,
+    Create,
+    Create2,
+}
+
+/// One nested call or create, recorded for debugging
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CallFrame {
+    /// Call depth (the top-level execution is depth 0)
+    pub depth: usize,
+    /// How the frame was entered
+    pub kind: CallKind,
+    /// Calling contract
+    pub from: Address,
+    /// Called (or created) address
+    pub to: Address,
+    /// First four bytes of the input (the method selector), if present
+    pub selector: Option<[u8; 4]>,
+    /// Gas used by the frame
+    pub gas_used: u64,
+    /// Whether the frame succeeded
+    pub success: bool,
+    /// Failure reason
+    pub error: Option<EvmError>,
 }
 
 /// A log entry emitted by LOG opcodes
@@ -297,6 +389,96 @@ impl Default for EvmContext {
     }
 }
 
+// =============================================================================
+// Balance Events
+// =============================================================================
+
+/// Signature of the event logged for every balance change.
+pub const BALANCE_CHANGED_EVENT: &str = "BalanceChanged(address,uint8,int256,bytes32)";
+
+/// Returns the topic of [`BALANCE_CHANGED_EVENT`].
+pub fn balance_changed_topic() -> H256 {
+    keccak256(BALANCE_CHANGED_EVENT.as_bytes())
+}
+
+/// Most balance changes [`EvmState`] keeps until they're taken; later
+/// changes are counted as dropped.
+pub const MAX_BALANCE_EVENTS: usize = 4096;
+
+/// Returns the address balance change logs are attributed to (0x…010D).
+pub fn account_manager_address() -> Address {
+    SystemContract::AccountManager.address()
+}
+
+/// Why a balance changed
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum BalanceChangeReason {
+    /// Value moved by a transaction, CALL or CREATE
+    Transfer,
+    /// Balance moved to the beneficiary of SELFDESTRUCT
+    SelfDestruct,
+    /// Balance overwritten directly (genesis, admin tooling)
+    Set,
+    /// Gas granted by the test network faucet
+    Faucet,
+}
+
+impl BalanceChangeReason {
+    /// Returns the reason code used in event logs.
+    pub fn code(self) -> u8 {
+        match self {
+            BalanceChangeReason::Transfer => 1,
+            BalanceChangeReason::SelfDestruct => 2,
+            BalanceChangeReason::Set => 3,
+            BalanceChangeReason::Faucet => 4,
+        }
+    }
+}
+
+/// Amount a balance went up or down by
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum BalanceDelta {
+    Credit(U256),
+    Debit(U256),
+}
+
+/// A balance change recorded by [`EvmState`]
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BalanceEvent {
+    /// Account whose balance changed
+    pub address: Address,
+    /// Signed change
+    pub delta: BalanceDelta,
+    /// Cause of the change
+    pub reason: BalanceChangeReason,
+}
+
+impl BalanceEvent {
+    /// Encodes the event as a [`BALANCE_CHANGED_EVENT`] log for transaction `tx_hash`.
+    ///
+    /// Topics are the event topic and the account; data is the reason code,
+    /// the delta as a two's complement int256 and the transaction hash, each
+    /// in a 32-byte word.
+    pub fn to_log(&self, tx_hash: H256) -> Log {
+        let mut reason = [0u8; 32];
+        reason[31] = self.reason.code();
+        let delta = match self.delta {
+            BalanceDelta::Credit(amount) => amount,
+            BalanceDelta::Debit(amount) => U256::ZERO.wrapping_sub(&amount),
+        };
+
+        let mut data = Vec::with_capacity(96);
+        data.extend_from_slice(&reason);
+        data.extend_from_slice(&delta.to_be_bytes());
+        data.extend_from_slice(tx_hash.as_bytes());
+        Log {
+            address: account_manager_address(),
+            topics: vec![balance_changed_topic(), H256::from(address_to_u256(&self.address).to_be_bytes())],
+            data,
+        }
+    }
+}
+
 // =============================================================================
 // Account and State
 // =============================================================================
@@ -310,8 +492,33 @@ pub struct Account {
     pub nonce: u64,
     /// Contract code
     pub code: Vec<u8>,
-    /// Storage
-    pub storage: HashMap<H256, H256>,
+    /// Keccak-256 of `code`, kept by `EvmState::set_code` (zero without
+    /// code)
+    pub code_hash: H256,
+    /// Non-zero storage slots, ordered so scans can start at a cursor
+    pub storage: BTreeMap<H256, H256>,
+}
+
+/// A sender's balance against what a transaction can cost it up front
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Affordability {
+    /// Sender balance
+    pub balance: U256,
+    /// Gas limit times gas price plus the transferred value, `U256::MAX`
+    /// if that overflows
+    pub required: U256,
+}
+
+impl Affordability {
+    /// Returns true if the balance covers the required amount.
+    pub fn is_affordable(&self) -> bool {
+        self.balance >= self.required
+    }
+
+    /// Returns how much the balance falls short, zero if affordable.
+    pub fn shortfall(&self) -> U256 {
+        self.required.checked_sub(&self.balance).unwrap_or(U256::ZERO)
+    }
 }
 
 /// EVM state
@@ -321,6 +528,41 @@ pub struct EvmState {
     accounts: HashMap<Address, Account>,
     /// Block hashes (block_number -> hash)
     block_hashes: HashMap<u64, H256>,
+    /// Shared analysis cache (clones of the state share it)
+    code_cache: Option<Arc<CodeCache>>,
+    /// Balance changes not yet taken by the caller
+    balance_events: Vec<BalanceEvent>,
+    /// Balance changes not kept once `MAX_BALANCE_EVENTS` were pending
+    balance_events_dropped: usize,
+    /// Per-org namespacing of designated contracts (off if None)
+    org_isolation: Option<Arc<OrgIsolation>>,
+    /// Org of each account, for method permission checks
+    org_members: Option<Arc<OrgMembers>>,
+    /// Method permission manifests of contracts installed with one
+    method_permissions: HashMap<Address, MethodPermissions>,
+    /// Account that installed each contract through the ACL contract
+    contract_installers: HashMap<Address, Address>,
+    /// Contracts that only serve read-only calls
+    paused_contracts: HashSet<Address>,
+    /// Bytes of non-zero storage slots held by each account
+    storage_usage: HashMap<Address, u64>,
+    /// Per-contract storage limit in bytes (unlimited if None)
+    storage_quota: Option<u64>,
+    /// Activation heights of protocol features (none active by default)
+    feature_gates: Arc<FeatureGates>,
+    /// Faucet grants (faucet disabled if None)
+    faucet: Option<FaucetConfig>,
+    /// Prior values of accounts changed since `begin_undo` (off if None)
+    undo: Option<UndoLog>,
+}
+
+/// Accounts as they were before a step that may be rolled back.
+#[derive(Debug, Clone, Default)]
+struct UndoLog {
+    /// Each changed account and its storage usage, before the first change
+    accounts: HashMap<Address, (Option<Account>, Option<u64>)>,
+    /// Pending balance changes when the step began
+    balance_events: usize,
 }
 
 impl EvmState {
@@ -329,6 +571,112 @@ impl EvmState {
         Self::default()
     }
 
+    /// Uses a code analysis cache for every execution against this state
+    pub fn with_code_cache(mut self, cache: Arc<CodeCache>) -> Self {
+        self.code_cache = Some(cache);
+        self
+    }
+
+    /// Returns the code analysis cache, if any
+    pub fn code_cache(&self) -> Option<&Arc<CodeCache>> {
+        self.code_cache.as_ref()
+    }
+
+    /// Namespaces the storage of designated contracts per org (off if None)
+    pub fn with_org_isolation(mut self, isolation: Option<Arc<OrgIsolation>>) -> Self {
+        self.org_isolation = isolation;
+        self
+    }
+
+    /// Replaces the org isolation settings, e.g. after a config change
+    pub fn set_org_isolation(&mut self, isolation: Option<Arc<OrgIsolation>>) {
+        self.org_isolation = isolation;
+    }
+
+    /// Returns the org isolation settings, if enabled
+    pub fn org_isolation(&self) -> Option<&Arc<OrgIsolation>> {
+        self.org_isolation.as_ref()
+    }
+
+    /// Resolves the orgs and roles of method callers from `members`
+    pub fn with_org_members(mut self, members: Option<Arc<OrgMembers>>) -> Self {
+        self.org_members = members;
+        self
+    }
+
+    /// Replaces the org members, e.g. after a config change
+    pub fn set_org_members(&mut self, members: Option<Arc<OrgMembers>>) {
+        self.org_members = members;
+    }
+
+    /// Returns the org members, if set
+    pub fn org_members(&self) -> Option<&Arc<OrgMembers>> {
+        self.org_members.as_ref()
+    }
+
+    /// Activates protocol features from the heights in `gates`
+    pub fn with_feature_gates(mut self, gates: Arc<FeatureGates>) -> Self {
+        self.feature_gates = gates;
+        self
+    }
+
+    /// Replaces the feature activation heights, e.g. after a config change
+    pub fn set_feature_gates(&mut self, gates: Arc<FeatureGates>) {
+        self.feature_gates = gates;
+    }
+
+    /// Returns true if `feature` is active at `height`
+    pub fn is_feature_active(&self, feature: &str, height: u64) -> bool {
+        self.feature_gates.is_active(feature, height)
+    }
+
+    /// Fails with `FeatureInactive` unless `feature` is active at `height`
+    fn require_feature(&self, feature: &str, height: u64) -> Result<(), EvmError> {
+        match self.is_feature_active(feature, height) {
+            true => Ok(()),
+            false => Err(EvmError::FeatureInactive(feature.to_string())),
+        }
+    }
+
+    /// Limits the storage each contract may hold (unlimited if None)
+    pub fn set_storage_quota(&mut self, quota: Option<u64>) {
+        self.storage_quota = quota;
+    }
+
+    /// Returns the per-contract storage quota in bytes, if any
+    pub fn storage_quota(&self) -> Option<u64> {
+        self.storage_quota
+    }
+
+    /// Replaces the faucet grants, e.g. after a config change (disabled
+    /// if None)
+    pub fn set_faucet(&mut self, faucet: Option<FaucetConfig>) {
+        self.faucet = faucet;
+    }
+
+    /// Returns the faucet grants, if the faucet is enabled
+    pub fn faucet(&self) -> Option<FaucetConfig> {
+        self.faucet
+    }
+
+    /// Returns the bytes of non-zero storage slots `address` holds
+    pub fn storage_usage(&self, address: &Address) -> u64 {
+        self.storage_usage.get(address).copied().unwrap_or(0)
+    }
+
+    /// Checks that `address` can fill one more storage slot
+    pub fn check_storage_quota(&self, address: &Address) -> Result<(), EvmError> {
+        match self.storage_quota {
+            Some(quota) if self.storage_usage(address) + STORAGE_SLOT_BYTES > quota => {
+                Err(EvmError::StorageQuotaExceeded {
+                    address: *address,
+                    quota,
+                })
+            }
+            _ => Ok(()),
+        }
+    }
+
     /// Gets an account (creates empty one if doesn't exist)
     pub fn get_account(&self, address: &Address) -> Account {
         self.accounts.get(address).cloned().unwrap_or_default()
@@ -336,12 +684,97 @@ impl EvmState {
 
     /// Gets mutable account reference
     pub fn get_account_mut(&mut self, address: &Address) -> &mut Account {
+        self.record_undo(address);
         self.accounts.entry(*address).or_default()
     }
 
+    /// Starts recording the prior value of every account changed from now
+    /// on, so `rollback_undo` can restore them without copying the state.
+    fn begin_undo(&mut self) {
+        self.undo = Some(UndoLog {
+            accounts: HashMap::new(),
+            balance_events: self.balance_events.len(),
+        });
+    }
+
+    /// Keeps the changes since `begin_undo`.
+    fn commit_undo(&mut self) {
+        self.undo = None;
+    }
+
+    /// Restores every account changed since `begin_undo`.
+    fn rollback_undo(&mut self) {
+        let Some(undo) = self.undo.take() else {
+            return;
+        };
+        for (address, (account, usage)) in undo.accounts {
+            match account {
+                Some(account) => self.accounts.insert(address, account),
+                None => self.accounts.remove(&address),
+            };
+            match usage {
+                Some(usage) => self.storage_usage.insert(address, usage),
+                None => self.storage_usage.remove(&address),
+            };
+        }
+        self.balance_events.truncate(undo.balance_events);
+    }
+
+    /// Saves `address` as it is now if it hasn't changed since
+    /// `begin_undo`.
+    fn record_undo(&mut self, address: &Address) {
+        if let Some(undo) = &mut self.undo {
+            undo.accounts.entry(*address).or_insert_with(|| {
+                (
+                    self.accounts.get(address).cloned(),
+                    self.storage_usage.get(address).copied(),
+                )
+            });
+        }
+    }
+
     /// Sets account balance
     pub fn set_balance(&mut self, address: &Address, balance: U256) {
-        self.get_account_mut(address).balance = balance;
+        self.update_balance(address, balance, BalanceChangeReason::Set);
+    }
+
+    /// Sets a balance and records the change
+    fn update_balance(&mut self, address: &Address, balance: U256, reason: BalanceChangeReason) {
+        let account = self.get_account_mut(address);
+        let old = std::mem::replace(&mut account.balance, balance);
+        let delta = if balance > old {
+            BalanceDelta::Credit(balance.checked_sub(&old).unwrap())
+        } else if balance < old {
+            BalanceDelta::Debit(old.checked_sub(&balance).unwrap())
+        } else {
+            return;
+        };
+        if self.balance_events.len() >= MAX_BALANCE_EVENTS {
+            self.balance_events_dropped += 1;
+            return;
+        }
+        self.balance_events.push(BalanceEvent {
+            address: *address,
+            delta,
+            reason,
+        });
+    }
+
+    /// Returns balance changes recorded so far, oldest first
+    pub fn balance_events(&self) -> &[BalanceEvent] {
+        &self.balance_events
+    }
+
+    /// Returns how many balance changes were dropped since the last take
+    /// because `MAX_BALANCE_EVENTS` were pending.
+    pub fn balance_events_dropped(&self) -> usize {
+        self.balance_events_dropped
+    }
+
+    /// Drains the recorded balance changes and resets the dropped count
+    pub fn take_balance_events(&mut self) -> Vec<BalanceEvent> {
+        self.balance_events_dropped = 0;
+        std::mem::take(&mut self.balance_events)
     }
 
     /// Gets account balance
@@ -354,9 +787,20 @@ impl EvmState {
         self.accounts.get(address).map(|a| a.code.clone()).unwrap_or_default()
     }
 
+    /// Returns the hash of an account's code (zero without code).
+    pub fn get_code_hash(&self, address: &Address) -> H256 {
+        self.accounts
+            .get(address)
+            .map(|a| a.code_hash)
+            .unwrap_or_default()
+    }
+
     /// Sets account code
     pub fn set_code(&mut self, address: &Address, code: Vec<u8>) {
-        self.get_account_mut(address).code = code;
+        let code_hash = if code.is_empty() { H256::zero() } else { keccak256(&code) };
+        let account = self.get_account_mut(address);
+        account.code = code;
+        account.code_hash = code_hash;
     }
 
     /// Gets storage value
@@ -368,9 +812,25 @@ impl EvmState {
             .unwrap_or(H256::zero())
     }
 
-    /// Sets storage value
+    /// Sets storage value; zero clears the slot
     pub fn set_storage(&mut self, address: &Address, key: H256, value: H256) {
-        self.get_account_mut(address).storage.insert(key, value);
+        let storage = &mut self.get_account_mut(address).storage;
+        let previous = match value.is_zero() {
+            true => storage.remove(&key),
+            false => storage.insert(key, value),
+        };
+        let was_set = previous.is_some_and(|v| !v.is_zero());
+        match (was_set, value.is_zero()) {
+            (false, false) => {
+                *self.storage_usage.entry(*address).or_insert(0) += STORAGE_SLOT_BYTES;
+            }
+            (true, true) => {
+                if let Some(usage) = self.storage_usage.get_mut(address) {
+                    *usage = usage.saturating_sub(STORAGE_SLOT_BYTES);
+                }
+            }
+            _ => {}
+        }
     }
 
     /// Gets account nonce
@@ -400,21 +860,42 @@ impl EvmState {
 
     /// Removes an account
     pub fn remove_account(&mut self, address: &Address) {
+        self.record_undo(address);
         self.accounts.remove(address);
+        self.storage_usage.remove(address);
+    }
+
+    /// Checks whether `sender` can pay up front for a transaction with
+    /// `gas_limit` at `gas_price` transferring `value`.
+    pub fn check_affordability(
+        &self,
+        sender: &Address,
+        gas_limit: u64,
+        gas_price: U256,
+        value: U256,
+    ) -> Affordability {
+        let required = U256::from_u64(gas_limit)
+            .checked_mul(&gas_price)
+            .and_then(|gas_cost| gas_cost.checked_add(&value))
+            .unwrap_or(U256::MAX);
+        Affordability {
+            balance: self.get_balance(sender),
+            required,
+        }
     }
 
     /// Transfers value between accounts
     pub fn transfer(&mut self, from: &Address, to: &Address, value: U256) -> Result<(), EvmError> {
         let from_balance = self.get_balance(from);
-        if from_balance < value {
+        if !self.check_affordability(from, 0, U256::ZERO, value).is_affordable() {
             return Err(EvmError::InsufficientBalance);
         }
 
         let to_balance = self.get_balance(to);
 
         // Perform transfer
-        self.set_balance(from, from_balance.checked_sub(&value).unwrap());
-        self.set_balance(to, to_balance.checked_add(&value).unwrap_or(U256::MAX));
+        self.update_balance(from, from_balance.checked_sub(&value).unwrap(), BalanceChangeReason::Transfer);
+        self.update_balance(to, to_balance.checked_add(&value).unwrap_or(U256::MAX), BalanceChangeReason::Transfer);
 
         Ok(())
     }
@@ -439,7 +920,17 @@ pub struct Evm {
     /// Emitted logs
     logs: Vec<Log>,
     /// Valid jump destinations
-    jumpdests: Vec<bool>,
+    jumpdests: Arc<Vec<bool>>,
+    /// Nested call frames
+    trace: Vec<CallFrame>,
+    /// Debug logs written through the contract log host call
+    contract_logs: ContractLogs,
+    /// Storage scan pages read so far by the transaction, in this frame
+    /// and the frames before it
+    scan_pages: usize,
+    /// Hash of the stored code the next frame runs, under which its
+    /// analysis is cached (init code has none and isn't cached)
+    code_hash: Option<H256>,
 }
 
 impl Evm {
@@ -452,10 +943,20 @@ impl Evm {
             gas_remaining: 0,
             returndata: Vec::new(),
             logs: Vec::new(),
-            jumpdests: Vec::new(),
+            jumpdests: Arc::default(),
+            trace: Vec::new(),
+            contract_logs: ContractLogs::default(),
+            scan_pages: 0,
+            code_hash: None,
         }
     }
 
+    /// Runs the code stored under `code_hash`, caching its analysis.
+    fn with_code_hash(mut self, code_hash: H256) -> Self {
+        self.code_hash = (!code_hash.is_zero()).then_some(code_hash);
+        self
+    }
+
     /// Resets the EVM state for a new execution
     fn reset(&mut self, gas_limit: u64) {
         self.stack.clear();
@@ -464,25 +965,41 @@ impl Evm {
         self.gas_remaining = gas_limit;
         self.returndata.clear();
         self.logs.clear();
-        self.jumpdests.clear();
+        self.jumpdests = Arc::default();
+        self.trace.clear();
+        self.contract_logs = ContractLogs::default();
+        self.scan_pages = 0;
+    }
+
+    /// Records a finished nested frame followed by its own nested frames.
+    fn record_frame(
+        &mut self,
+        kind: CallKind,
+        from: Address,
+        to: Address,
+        context: &EvmContext,
+        result: &mut ExecutionResult,
+    ) {
+        self.trace.push(CallFrame {
+            depth: context.depth,
+            kind,
+            from,
+            to,
+            selector: context.data.get(..4).map(|s| s.try_into().unwrap()),
+            gas_used: result.gas_used,
+            success: result.success,
+            error: result.error.clone(),
+        });
+        self.trace.append(&mut result.call_trace);
+        self.contract_logs.append(&mut result.contract_logs);
     }
 
     /// Analyzes code to find valid jump destinations
-    fn analyze_jumpdests(&mut self, code: &[u8]) {
-        self.jumpdests = vec![false; code.len()];
-        let mut i = 0;
-        while i < code.len() {
-            let op = code[i];
-            if op == opcode::JUMPDEST {
-                self.jumpdests[i] = true;
-            }
-            // Skip PUSH data
-            if op >= opcode::PUSH1 && op <= opcode::PUSH32 {
-                let push_size = (op - opcode::PUSH1 + 1) as usize;
-                i += push_size;
-            }
-            i += 1;
-        }
+    fn analyze_jumpdests(&mut self, code: &[u8], state: &EvmState) {
+        self.jumpdests = match (state.code_cache(), self.code_hash.take()) {
+            (Some(cache), Some(code_hash)) => cache.get_or_analyze(code_hash, code),
+            _ => Arc::new(analyze_jumpdests(code)),
+        };
     }
 
     // Stack operations
@@ -598,14 +1115,30 @@ impl Evm {
         code: &[u8],
         context: &EvmContext,
         state: &mut EvmState,
+    ) -> ExecutionResult {
+        self.execute_frame(code, context, state, 0)
+    }
+
+    /// Executes a frame of a transaction whose earlier frames read
+    /// `scan_pages` storage scan pages.
+    fn execute_frame(
+        &mut self,
+        code: &[u8],
+        context: &EvmContext,
+        state: &mut EvmState,
+        scan_pages: usize,
     ) -> ExecutionResult {
         self.reset(context.gas_limit);
-        self.analyze_jumpdests(code);
+        self.scan_pages = scan_pages;
+        self.analyze_jumpdests(code, state);
 
         let result = self.run(code, context, state);
 
         let gas_used = context.gas_limit.saturating_sub(self.gas_remaining);
 
+        let call_trace = std::mem::take(&mut self.trace);
+        let contract_logs = std::mem::take(&mut self.contract_logs);
+
         match result {
             Ok(output) => ExecutionResult {
                 success: true,
@@ -613,6 +1146,8 @@ impl Evm {
                 output,
                 error: None,
                 logs: std::mem::take(&mut self.logs),
+                call_trace,
+                contract_logs,
             },
             Err(EvmError::Revert(data)) => ExecutionResult {
                 success: false,
@@ -620,6 +1155,8 @@ impl Evm {
                 output: data.clone(),
                 error: Some(EvmError::Revert(data)),
                 logs: Vec::new(),
+                call_trace,
+                contract_logs,
             },
             Err(e) => ExecutionResult {
                 success: false,
@@ -627,6 +1164,8 @@ impl Evm {
                 output: Vec::new(),
                 error: Some(e),
                 logs: Vec::new(),
+                call_trace,
+                contract_logs,
             },
         }
     }
@@ -1069,7 +1608,7 @@ impl Evm {
                 opcode::SLOAD => {
                     self.use_gas(GAS_SLOAD)?;
                     let key = self.pop()?;
-                    let key_h256 = H256::from(key.to_be_bytes());
+                    let key_h256 = isolated_slot(state, context, H256::from(key.to_be_bytes()))?;
                     let value = state.get_storage(&context.address, &key_h256);
                     self.push(U256::from_be_bytes(*value.as_bytes()))?;
                 }
@@ -1080,7 +1619,7 @@ impl Evm {
 
                     let key = self.pop()?;
                     let value = self.pop()?;
-                    let key_h256 = H256::from(key.to_be_bytes());
+                    let key_h256 = isolated_slot(state, context, H256::from(key.to_be_bytes()))?;
                     let value_h256 = H256::from(value.to_be_bytes());
 
                     let current = state.get_storage(&context.address, &key_h256);
@@ -1093,6 +1632,15 @@ impl Evm {
                     };
                     self.use_gas(gas)?;
 
+                    // Filling a slot fails the transaction once the contract
+                    // is at its quota; clearing and overwriting always work
+                    if current.is_zero()
+                        && !value_h256.is_zero()
+                        && state.is_feature_active(FEATURE_STORAGE_QUOTA, context.block_number)
+                    {
+                        state.check_storage_quota(&context.address)?;
+                    }
+
                     state.set_storage(&context.address, key_h256, value_h256);
                 }
                 opcode::JUMP => {
@@ -1260,7 +1808,15 @@ impl Evm {
                     create_context.gas_limit = self.gas_remaining - self.gas_remaining / 64;
 
                     let mut create_evm = Evm::new();
-                    let result = create_evm.execute(&init_code, &create_context, state);
+                    let mut result = create_evm.execute_frame(
+                        &init_code,
+                        &create_context,
+                        state,
+                        self.scan_pages,
+                    );
+                    self.scan_pages = create_evm.scan_pages;
+                    let kind = if op == opcode::CREATE { CallKind::Create } else { CallKind::Create2 };
+                    self.record_frame(kind, context.address, new_address, &create_context, &mut result);
 
                     self.gas_remaining -= result.gas_used;
                     self.returndata = result.output.clone();
@@ -1324,6 +1880,107 @@ impl Evm {
 
                     let input = self.memory[args_offset..args_offset + args_size].to_vec();
 
+                    // Host calls are served from the height their feature
+                    // activates; before that the address is a plain account
+                    let host_call = |feature| state.is_feature_active(feature, context.block_number);
+
+                    // Debug logs are host calls: no frame, no state change,
+                    // so they are allowed in static context too
+                    if to == contract_log_address() && host_call(FEATURE_CONTRACT_LOG) {
+                        self.use_gas(GAS_LOG + GAS_LOG_DATA * input.len() as u64)?;
+                        self.returndata.clear();
+                        let log = ContractLog::decode(context.address, &input);
+                        match log {
+                            Some(log) if value.is_zero() => {
+                                self.contract_logs.push(log);
+                                self.push(U256::ONE)?;
+                            }
+                            _ => self.push(U256::ZERO)?,
+                        }
+                        continue;
+                    }
+
+                    // Cross-org reads of isolated storage are host calls too
+                    if to == org_grants_address() && host_call(FEATURE_ORG_GRANTS) {
+                        self.use_gas(GAS_SLOAD)?;
+                        let read = match value.is_zero() {
+                            true => read_org_storage(&input, context, state),
+                            false => Err(EvmError::OrgGrantFailed("value sent".to_string())),
+                        };
+                        match read {
+                            Ok(word) => {
+                                self.returndata = word.as_bytes().to_vec();
+                                for i in 0..ret_size.min(32) {
+                                    self.memory[ret_offset + i] = self.returndata[i];
+                                }
+                                self.push(U256::ONE)?;
+                            }
+                            Err(_) => {
+                                self.returndata.clear();
+                                self.push(U256::ZERO)?;
+                            }
+                        }
+                        continue;
+                    }
+
+                    // So are range scans of the calling contract's storage
+                    if to == storage_scan_address() && host_call(FEATURE_STORAGE_SCAN) {
+                        self.use_gas(GAS_STORAGE_SCAN_PAGE)?;
+                        let scan = match value.is_zero() {
+                            true => serve_storage_scan(&input, context, state, self.scan_pages),
+                            false => Err(EvmError::StorageScanFailed("value sent".to_string())),
+                        };
+                        match scan {
+                            Ok(page) => {
+                                self.scan_pages += 1;
+                                self.use_gas(GAS_SLOAD * page.entries.len() as u64)?;
+                                self.returndata = page.encode();
+                                let copy_size = ret_size.min(self.returndata.len());
+                                self.memory[ret_offset..ret_offset + copy_size]
+                                    .copy_from_slice(&self.returndata[..copy_size]);
+                                self.push(U256::ONE)?;
+                            }
+                            Err(_) => {
+                                self.returndata.clear();
+                                self.push(U256::ZERO)?;
+                            }
+                        }
+                        continue;
+                    }
+
+                    // Index registry calls are logged for nodes to apply; they
+                    // change state, so static calls are refused
+                    if to == SystemContract::IndexRegistry.address()
+                        && host_call(FEATURE_INDEX_CALLS)
+                    {
+                        self.returndata.clear();
+                        if context.is_static || op == opcode::STATICCALL || !value.is_zero() {
+                            self.push(U256::ZERO)?;
+                            continue;
+                        }
+                        self.use_gas(GAS_INDEX_CALL + GAS_LOG_DATA * input.len() as u64)?;
+                        self.logs.push(index_call_log(context.address, input));
+                        self.push(U256::ONE)?;
+                        continue;
+                    }
+
+                    // Restricted methods are checked against the origin in
+                    // nested calls too, so a proxy contract can't bypass them
+                    if matches!(op, opcode::CALL | opcode::STATICCALL)
+                        && state.check_method_permission(&to, &context.origin, &input).is_err()
+                    {
+                        self.returndata.clear();
+                        self.push(U256::ZERO)?;
+                        continue;
+                    }
+
+                    // Paused contracts only serve read-only calls
+                    if op == opcode::CALL && !context.is_static && state.is_paused(&to) {
+                        self.returndata.clear();
+                        self.push(U256::ZERO)?;
+                        continue;
+                    }
+
                     // Transfer value for CALL
                     if op == opcode::CALL && !value.is_zero() {
                         if state.get_balance(&context.address) < value {
@@ -1370,8 +2027,20 @@ impl Evm {
                     call_context.gas_limit = gas_limit.min(available_gas) + stipend;
 
                     // Execute call
-                    let mut call_evm = Evm::new();
-                    let result = call_evm.execute(&target_code, &call_context, state);
+                    let mut call_evm = Evm::new().with_code_hash(state.get_code_hash(&to));
+                    let mut result =
+                        call_evm.execute_frame(&target_code, &call_context, state, self.scan_pages);
+                    self.scan_pages = call_evm.scan_pages;
+                    let kind = match op {
+                        opcode::CALL => CallKind::Call,
+                        opcode::CALLCODE => CallKind::CallCode,
+                        opcode::DELEGATECALL => CallKind::DelegateCall,
+                        _ => CallKind::StaticCall,
+                    };
+                    self.record_frame(kind, context.address, to, &call_context, &mut result);
+                    if result.success {
+                        self.logs.append(&mut result.logs);
+                    }
 
                     self.gas_remaining -= result.gas_used.saturating_sub(stipend);
                     self.returndata = result.output.clone();
@@ -1425,11 +2094,15 @@ impl Evm {
                     // Transfer remaining balance
                     if !balance.is_zero() {
                         let ben_balance = state.get_balance(&beneficiary);
-                        state.set_balance(&beneficiary, ben_balance.checked_add(&balance).unwrap_or(U256::MAX));
+                        state.update_balance(
+                            &beneficiary,
+                            ben_balance.checked_add(&balance).unwrap_or(U256::MAX),
+                            BalanceChangeReason::SelfDestruct,
+                        );
                     }
 
                     // Clear account
-                    state.set_balance(&context.address, U256::ZERO);
+                    state.update_balance(&context.address, U256::ZERO, BalanceChangeReason::SelfDestruct);
 
                     return Ok(Vec::new());
                 }
@@ -1469,8 +2142,8 @@ fn u256_to_address(val: U256) -> Address {
     Address::from(addr_bytes)
 }
 
-/// Create contract address (CREATE)
-fn create_address(sender: &Address, nonce: u64) -> Address {
+/// Returns the address a CREATE by `sender` at `nonce` deploys to.
+pub fn create_address(sender: &Address, nonce: u64) -> Address {
     // RLP encode [sender, nonce]
     let mut data = Vec::new();
 
@@ -1871,83 +2544,1648 @@ fn sar(shift: U256, value: U256) -> U256 {
 }
 
 // =============================================================================
-// Public API
+// Code Cache
 // =============================================================================
 
-/// Execute EVM bytecode
-pub fn execute(code: &[u8], context: EvmContext, state: &mut EvmState) -> ExecutionResult {
-    let mut evm = Evm::new();
-    evm.execute(code, &context, state)
+/// Finds valid jump destinations in code.
+fn analyze_jumpdests(code: &[u8]) -> Vec<bool> {
+    let mut jumpdests = vec![false; code.len()];
+    let mut i = 0;
+    while i < code.len() {
+        let op = code[i];
+        if op == opcode::JUMPDEST {
+            jumpdests[i] = true;
+        }
+        // Skip PUSH data
+        if (opcode::PUSH1..=opcode::PUSH32).contains(&op) {
+            let push_size = (op - opcode::PUSH1 + 1) as usize;
+            i += push_size;
+        }
+        i += 1;
+    }
+    jumpdests
 }
 
-/// Deploy a contract
-pub fn deploy_contract(
-    code: &[u8],
-    context: EvmContext,
-    state: &mut EvmState,
-) -> Result<Address, EvmError> {
-    let sender = context.caller;
-    let nonce = state.get_nonce(&sender);
-    let contract_address = create_address(&sender, nonce);
+/// Counters for a [`CodeCache`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct CodeCacheStats {
+    /// Lookups served from the cache
+    pub hits: u64,
+    /// Lookups that required analysis
+    pub misses: u64,
+    /// Entries dropped to stay within capacity
+    pub evictions: u64,
+    /// Entries currently cached
+    pub entries: usize,
+}
 
-    // Increment sender nonce
-    state.increment_nonce(&sender);
+#[derive(Debug)]
+struct CachedCode {
+    jumpdests: Arc<Vec<bool>>,
+    last_used: u64,
+}
 
-    // Transfer value if any
-    if !context.value.is_zero() {
-        state.transfer(&sender, &contract_address, context.value)?;
+#[derive(Debug, Default)]
+struct CodeCacheInner {
+    entries: HashMap<H256, CachedCode>,
+    /// Code hashes by the tick they were last used at, oldest first
+    recency: BTreeMap<u64, H256>,
+    tick: u64,
+    stats: CodeCacheStats,
+}
+
+/// Cache of analyzed bytecode keyed by code hash.
+///
+/// Analysis results depend only on the code, so the cache is shared across
+/// executions and blocks. Callers pass the hash stored with the code, so a
+/// lookup doesn't rehash it. The least recently used entry is evicted when
+/// the cache is full.
+#[derive(Debug)]
+pub struct CodeCache {
+    capacity: usize,
+    inner: Mutex<CodeCacheInner>,
+}
+
+impl CodeCache {
+    /// Creates a cache holding at most `capacity` analyzed contracts.
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            inner: Mutex::new(CodeCacheInner::default()),
+        }
     }
 
-    // Execute init code
-    let mut deploy_context = context;
-    deploy_context.address = contract_address;
+    /// Returns the jump destination table for `code`, whose Keccak-256
+    /// hash is `code_hash`, analyzing it on a miss.
+    pub fn get_or_analyze(&self, code_hash: H256, code: &[u8]) -> Arc<Vec<bool>> {
+        let mut guard = self.inner.lock().unwrap();
+        let inner = &mut *guard;
+        inner.tick += 1;
+        let tick = inner.tick;
+
+        if let Some(entry) = inner.entries.get_mut(&code_hash) {
+            inner.recency.remove(&entry.last_used);
+            inner.recency.insert(tick, code_hash);
+            entry.last_used = tick;
+            inner.stats.hits += 1;
+            return Arc::clone(&entry.jumpdests);
+        }
 
-    let mut evm = Evm::new();
-    let result = evm.execute(code, &deploy_context, state);
+        inner.stats.misses += 1;
+        let jumpdests = Arc::new(analyze_jumpdests(code));
+        if self.capacity == 0 {
+            return jumpdests;
+        }
 
-    if !result.success {
-        return Err(result.error.unwrap_or(EvmError::CreateFailed));
+        if inner.entries.len() >= self.capacity {
+            if let Some((_, oldest)) = inner.recency.pop_first() {
+                inner.entries.remove(&oldest);
+                inner.stats.evictions += 1;
+            }
+        }
+        inner.recency.insert(tick, code_hash);
+        inner.entries.insert(
+            code_hash,
+            CachedCode {
+                jumpdests: Arc::clone(&jumpdests),
+                last_used: tick,
+            },
+        );
+        jumpdests
     }
 
-    // Check code size limit
-    if result.output.len() > MAX_CODE_SIZE {
-        return Err(EvmError::CodeSizeExceeded);
+    /// Returns hit/miss counters and the current size.
+    pub fn stats(&self) -> CodeCacheStats {
+        let inner = self.inner.lock().unwrap();
+        CodeCacheStats {
+            entries: inner.entries.len(),
+            ..inner.stats
+        }
     }
 
-    // Check for EIP-3541 (reject code starting with 0xEF)
-    if !result.output.is_empty() && result.output[0] == 0xEF {
-        return Err(EvmError::InvalidCode);
+    /// Returns the maximum number of entries.
+    pub fn capacity(&self) -> usize {
+        self.capacity
     }
 
-    // Store the deployed code
-    state.set_code(&contract_address, result.output);
+    /// Drops all entries. Counters are kept.
+    pub fn clear(&self) {
+        let mut inner = self.inner.lock().unwrap();
+        inner.entries.clear();
+        inner.recency.clear();
+    }
+}
 
-    Ok(contract_address)
+impl Default for CodeCache {
+    fn default() -> Self {
+        Self::new(1024)
+    }
 }
 
-/// Call a contract
-pub fn call_contract(
-    address: Address,
-    data: &[u8],
-    context: EvmContext,
-    state: &mut EvmState,
-) -> ExecutionResult {
-    let code = state.get_code(&address);
+// =============================================================================
+// Feature Gates
+// =============================================================================
 
-    let mut call_context = context;
-    call_context.address = address;
-    call_context.data = data.to_vec();
+/// Heights from which protocol features are active, as scheduled by chain
+/// config. Every node executes a block with the same gates, so behavior
+/// only changes at the scheduled height.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct FeatureGates {
+    activations: HashMap<String, u64>,
+}
 
-    let mut evm = Evm::new();
-    evm.execute(&code, &call_context, state)
+impl FeatureGates {
+    /// Creates gates from `(feature, activation height)` pairs.
+    pub fn new(activations: impl IntoIterator<Item = (String, u64)>) -> Self {
+        Self {
+            activations: activations.into_iter().collect(),
+        }
+    }
+
+    /// Activates every EVM feature from genesis (devnets and tests).
+    pub fn all() -> Self {
+        Self::new(EVM_FEATURES.iter().map(|f| (f.to_string(), 0)))
+    }
+
+    /// Returns true if `feature` is active at `height`.
+    pub fn is_active(&self, feature: &str, height: u64) -> bool {
+        self.activations
+            .get(feature)
+            .is_some_and(|&activation| activation <= height)
+    }
 }
 
 // =============================================================================
-// Tests
+// Bytecode Staging
 // =============================================================================
 
-#[cfg(test)]
-mod tests {
+/// Largest init code that can be assembled through staging (same as CREATE).
+pub const MAX_STAGED_CODE_SIZE: usize = MAX_CODE_SIZE * 2;
+
+/// Most uploads a sender can have in progress at once.
+pub const MAX_STAGED_UPLOADS: u64 = 4;
+
+/// Gas charged per uploaded byte, the cost of setting a fresh slot spread
+/// over its 32 bytes.
+pub const GAS_STAGING_BYTE: u64 = GAS_SSTORE_SET / 32;
+
+/// Staging call: start an upload. Calldata: `0x01 || hash(32) || size(u64 BE)`.
+pub const STAGING_BEGIN: u8 = 0x01;
+/// Staging call: append a chunk. Calldata: `0x02 || hash(32) || chunk`.
+pub const STAGING_CHUNK: u8 = 0x02;
+/// Staging call: deploy the assembled code. Calldata: `0x03 || hash(32)`.
+pub const STAGING_INSTALL: u8 = 0x03;
+
+/// Returns the address of the bytecode staging system contract (0x…0102).
+pub fn bytecode_staging_address() -> Address {
+    SystemContract::BytecodeStaging.address()
+}
+
+/// Init code being uploaded in chunks.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct StagedCode {
+    /// Total size announced by the uploader
+    pub size: usize,
+    /// Bytes received so far
+    pub data: Vec<u8>,
+}
+
+/// Outcome of a staging call.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct StagingResult {
+    /// Address deployed by an install call
+    pub deployed: Option<Address>,
+    /// Gas charged for the upload itself; an install's deployment is
+    /// charged by the deployment
+    pub gas_used: u64,
+}
+
+/// Storage slot of the staging contract holding word `index` of an upload;
+/// index 0 holds the announced size and the bytes received.
+fn staging_slot(owner: &Address, hash: &H256, index: u64) -> H256 {
+    bach_crypto::keccak256_concat(&[owner.as_bytes(), hash.as_bytes(), &index.to_be_bytes()])
+}
+
+/// Storage slot of the staging contract counting a sender's uploads.
+fn staging_uploads_slot(owner: &Address) -> H256 {
+    bach_crypto::keccak256_concat(&[b"uploads", owner.as_bytes()])
+}
+
+fn word_u64(word: H256, at: usize) -> u64 {
+    u64::from_be_bytes(word.as_bytes()[at..at + 8].try_into().unwrap())
+}
+
+impl EvmState {
+    /// Returns an upload in progress.
+    pub fn staged_code(&self, owner: &Address, hash: &H256) -> Option<StagedCode> {
+        let staging = bytecode_staging_address();
+        let header = self.get_storage(&staging, &staging_slot(owner, hash, 0));
+        if header.is_zero() {
+            return None;
+        }
+        let (size, received) = (word_u64(header, 16) as usize, word_u64(header, 24) as usize);
+        let mut data = Vec::with_capacity(received);
+        for index in 0..received.div_ceil(32) {
+            let word = self.get_storage(&staging, &staging_slot(owner, hash, index as u64 + 1));
+            data.extend_from_slice(word.as_bytes());
+        }
+        data.truncate(received);
+        Some(StagedCode { size, data })
+    }
+
+    fn put_staged_header(&mut self, owner: &Address, hash: &H256, size: usize, received: usize) {
+        let mut header = [0u8; 32];
+        header[16..24].copy_from_slice(&(size as u64).to_be_bytes());
+        header[24..].copy_from_slice(&(received as u64).to_be_bytes());
+        let slot = staging_slot(owner, hash, 0);
+        self.set_storage(&bytecode_staging_address(), slot, H256::from(header));
+    }
+
+    /// Appends bytes to an upload, filling its partly used last word first.
+    fn append_staged(&mut self, owner: &Address, hash: &H256, received: usize, bytes: &[u8]) {
+        let staging = bytecode_staging_address();
+        let (mut position, mut remaining) = (received, bytes);
+        while !remaining.is_empty() {
+            let slot = staging_slot(owner, hash, (position / 32) as u64 + 1);
+            let mut word = *self.get_storage(&staging, &slot).as_bytes();
+            let offset = position % 32;
+            let take = remaining.len().min(32 - offset);
+            word[offset..offset + take].copy_from_slice(&remaining[..take]);
+            self.set_storage(&staging, slot, H256::from(word));
+            position += take;
+            remaining = &remaining[take..];
+        }
+    }
+
+    /// Clears an upload's slots, returning whether one was in progress.
+    fn clear_staged(&mut self, owner: &Address, hash: &H256) -> bool {
+        let Some(staged) = self.staged_code(owner, hash) else {
+            return false;
+        };
+        let staging = bytecode_staging_address();
+        for index in 0..=staged.data.len().div_ceil(32) as u64 {
+            self.set_storage(&staging, staging_slot(owner, hash, index), H256::zero());
+        }
+        let slot = staging_uploads_slot(owner);
+        let uploads = word_u64(self.get_storage(&staging, &slot), 24).saturating_sub(1);
+        self.set_storage(&staging, slot, H256::from(U256::from_u64(uploads).to_be_bytes()));
+        true
+    }
+}
+
+/// Executes a call to the bytecode staging contract.
+///
+/// Large init code is uploaded as a sequence of bounded transactions:
+/// a begin call announcing the keccak256 hash and size, chunk calls that
+/// append data in order, and an install call that checks the hash and
+/// deploys the assembled code as if it had been sent in a creation
+/// transaction. Uploads are private to the sender, kept in the staging
+/// contract's storage so they are part of chain state, and each sender
+/// has at most `MAX_STAGED_UPLOADS` in progress. Begin calls are charged
+/// like setting a slot and chunks `GAS_STAGING_BYTE` per byte, within the
+/// call's gas limit.
+pub fn execute_staging(
+    data: &[u8],
+    context: EvmContext,
+    state: &mut EvmState,
+) -> Result<StagingResult, EvmError> {
+    let fail = |msg: &str| EvmError::StagingFailed(msg.to_string());
+
+    state.require_feature(FEATURE_BYTECODE_STAGING, context.block_number)?;
+    if data.len() < 33 {
+        return Err(fail("calldata too short"));
+    }
+    let hash = H256::from_slice(&data[1..33]).unwrap();
+    let owner = context.caller;
+    let payload = &data[33..];
+    let charge = |gas: u64| match gas <= context.gas_limit {
+        true => Ok(gas),
+        false => Err(EvmError::OutOfGas),
+    };
+
+    match data[0] {
+        STAGING_BEGIN => {
+            let size: [u8; 8] = payload.try_into().map_err(|_| fail("invalid size"))?;
+            let size = u64::from_be_bytes(size) as usize;
+            if size == 0 || size > MAX_STAGED_CODE_SIZE {
+                return Err(EvmError::CodeSizeExceeded);
+            }
+            let gas_used = charge(GAS_SSTORE_SET)?;
+
+            // Beginning again restarts the upload
+            state.clear_staged(&owner, &hash);
+            let staging = bytecode_staging_address();
+            let slot = staging_uploads_slot(&owner);
+            let uploads = word_u64(state.get_storage(&staging, &slot), 24);
+            if uploads >= MAX_STAGED_UPLOADS {
+                return Err(fail("too many uploads in progress"));
+            }
+            state.set_storage(&staging, slot, H256::from(U256::from_u64(uploads + 1).to_be_bytes()));
+            state.put_staged_header(&owner, &hash, size, 0);
+            Ok(StagingResult {
+                deployed: None,
+                gas_used,
+            })
+        }
+        STAGING_CHUNK => {
+            let staged = state
+                .staged_code(&owner, &hash)
+                .ok_or_else(|| fail("no upload in progress"))?;
+            if staged.data.len() + payload.len() > staged.size {
+                return Err(fail("chunk exceeds announced size"));
+            }
+            let gas_used = charge(GAS_STAGING_BYTE.saturating_mul(payload.len() as u64))?;
+            state.append_staged(&owner, &hash, staged.data.len(), payload);
+            state.put_staged_header(&owner, &hash, staged.size, staged.data.len() + payload.len());
+            Ok(StagingResult {
+                deployed: None,
+                gas_used,
+            })
+        }
+        STAGING_INSTALL => {
+            if !payload.is_empty() {
+                return Err(fail("unexpected install data"));
+            }
+            let staged = state
+                .staged_code(&owner, &hash)
+                .ok_or_else(|| fail("no upload in progress"))?;
+            state.clear_staged(&owner, &hash);
+            if staged.data.len() != staged.size || keccak256(&staged.data) != hash {
+                return Err(fail("assembled code does not match hash"));
+            }
+            let deployed = deploy_contract(&staged.data, context, state)?;
+            Ok(StagingResult {
+                deployed: Some(deployed),
+                gas_used: 0,
+            })
+        }
+        _ => Err(fail("unknown staging call")),
+    }
+}
+
+// =============================================================================
+// Test Network Faucet
+// =============================================================================
+
+/// Faucet call: grant gas. Calldata: `0x01` grants the caller,
+/// `0x01 || recipient(20)` grants another address.
+pub const FAUCET_REQUEST: u8 = 0x01;
+
+/// Returns the address of the test network faucet system contract (0x…0107).
+pub fn faucet_address() -> Address {
+    SystemContract::Faucet.address()
+}
+
+/// How much the faucet grants and how often.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct FaucetConfig {
+    /// Gas granted per request, in wei
+    pub amount: U256,
+    /// Seconds a recipient, and a caller, waits between grants
+    pub window_secs: u64,
+}
+
+/// A gas grant made by the faucet.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct FaucetGrant {
+    /// Address credited
+    pub recipient: Address,
+    /// Amount credited, in wei
+    pub amount: U256,
+    /// Earliest unix time the recipient can be granted again
+    pub next_grant_at: u64,
+}
+
+/// Storage slot of the faucet holding a recipient's last grant time.
+fn faucet_slot(recipient: &Address) -> H256 {
+    keccak256(recipient.as_bytes())
+}
+
+/// Storage slot of the faucet holding the time a caller last requested a
+/// grant, for anyone.
+fn faucet_caller_slot(caller: &Address) -> H256 {
+    bach_crypto::keccak256_concat(&[b"caller", caller.as_bytes()])
+}
+
+impl EvmState {
+    /// Returns the unix time `recipient` last received a faucet grant.
+    pub fn faucet_last_grant(&self, recipient: &Address) -> Option<u64> {
+        self.faucet_time(&faucet_slot(recipient))
+    }
+
+    /// Returns the unix time `caller` last requested a faucet grant.
+    pub fn faucet_last_request(&self, caller: &Address) -> Option<u64> {
+        self.faucet_time(&faucet_caller_slot(caller))
+    }
+
+    fn faucet_time(&self, slot: &H256) -> Option<u64> {
+        let value = self.get_storage(&faucet_address(), slot);
+        let time = u64::from_be_bytes(value.as_bytes()[24..].try_into().unwrap());
+        (!value.is_zero()).then_some(time)
+    }
+}
+
+/// Executes a call to the faucet.
+///
+/// Grants are minted, so the faucet needs no funding; it only exists on
+/// chains whose config enables it. Each recipient is granted at most once
+/// per window, and each caller may request at most one grant per window,
+/// so one account can't drain grants into a stream of fresh addresses. The
+/// times are kept in the faucet's storage, so the limits are part of chain
+/// state and hold on every node executing the call.
+pub fn execute_faucet(
+    data: &[u8],
+    context: &EvmContext,
+    state: &mut EvmState,
+    config: &FaucetConfig,
+) -> Result<FaucetGrant, EvmError> {
+    let fail = |msg: &str| EvmError::FaucetFailed(msg.to_string());
+
+    let (&call, payload) = data.split_first().ok_or_else(|| fail("empty calldata"))?;
+    if call != FAUCET_REQUEST {
+        return Err(fail("unknown faucet call"));
+    }
+    let recipient = match payload.len() {
+        0 => context.caller,
+        20 => Address::from_slice(payload).unwrap(),
+        _ => return Err(fail("invalid recipient")),
+    };
+
+    let now = context.timestamp;
+    let last = [
+        state.faucet_last_grant(&recipient),
+        state.faucet_last_request(&context.caller),
+    ];
+    if let Some(last) = last.into_iter().flatten().max() {
+        let next_grant_at = last.saturating_add(config.window_secs);
+        if now < next_grant_at {
+            return Err(EvmError::FaucetRateLimited { next_grant_at });
+        }
+    }
+
+    let balance = state.get_balance(&recipient);
+    state.update_balance(
+        &recipient,
+        balance.checked_add(&config.amount).unwrap_or(U256::MAX),
+        BalanceChangeReason::Faucet,
+    );
+    let mut time = [0u8; 32];
+    time[24..].copy_from_slice(&now.to_be_bytes());
+    let faucet = faucet_address();
+    state.set_storage(&faucet, faucet_slot(&recipient), H256::from(time));
+    state.set_storage(&faucet, faucet_caller_slot(&context.caller), H256::from(time));
+
+    Ok(FaucetGrant {
+        recipient,
+        amount: config.amount,
+        next_grant_at: now.saturating_add(config.window_secs),
+    })
+}
+
+// =============================================================================
+// Index Registry Calls
+// =============================================================================
+
+/// Signature of the event recording a contract's index registry call.
+pub const INDEX_CALL_EVENT: &str = "IndexCall(address,bytes)";
+
+/// Gas charged for an index registry call, on top of `GAS_LOG_DATA` per
+/// calldata byte
+pub const GAS_INDEX_CALL: u64 = GAS_SSTORE_SET;
+
+/// Returns the topic of [`INDEX_CALL_EVENT`].
+///
+/// Contracts declare and drop indexes over their records by calling the
+/// index registry (0x…0108). The registry isn't run by the EVM: a call is
+/// recorded as an `IndexCall` log from the registry address, naming the
+/// calling contract, and nodes apply the calls logged in committed
+/// receipts. Only the EVM emits logs from the registry address, so an
+/// index always belongs to the contract that called.
+pub fn index_call_topic() -> H256 {
+    keccak256(INDEX_CALL_EVENT.as_bytes())
+}
+
+/// Builds the log recording `contract`'s index registry call with `data`,
+/// as the EVM emits it.
+pub fn index_call_log(contract: Address, data: Vec<u8>) -> Log {
+    Log {
+        address: SystemContract::IndexRegistry.address(),
+        topics: vec![index_call_topic(), H256::from(address_to_u256(&contract).to_be_bytes())],
+        data,
+    }
+}
+
+/// Returns the calling contract and calldata of the index registry call
+/// `log` records, or None if it records none.
+pub fn decode_index_call(log: &Log) -> Option<(Address, &[u8])> {
+    if log.address != SystemContract::IndexRegistry.address() {
+        return None;
+    }
+    match log.topics.as_slice() {
+        [topic, contract] if *topic == index_call_topic() => {
+            Some((Address::from_slice(&contract.as_bytes()[12..]).ok()?, &log.data))
+        }
+        _ => None,
+    }
+}
+
+// =============================================================================
+// Contract Debug Logs
+// =============================================================================
+
+/// Most message bytes kept per transaction; later logs are counted as
+/// dropped.
+pub const MAX_CONTRACT_LOG_BYTES: usize = 16 * 1024;
+
+/// Returns the address of the contract log host call (0x…0109).
+///
+/// A call to it with calldata `level(1) || message` records a debug log
+/// for the calling contract. Unlike LOG0-LOG4 events, these logs don't go
+/// into receipts or any other consensus state; they are only returned to
+/// the caller of a dry run and kept locally by nodes that opt in.
+///
+/// The host call is served from the height `FEATURE_CONTRACT_LOG`
+/// activates; before that a call to the address is an ordinary call to an
+/// empty account, with the same result and gas.
+pub fn contract_log_address() -> Address {
+    SystemContract::ContractLog.address()
+}
+
+/// Severity of a contract debug log.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum ContractLogLevel {
+    Debug,
+    Info,
+    Warn,
+    Error,
+}
+
+impl ContractLogLevel {
+    /// Decodes the level byte of a log call.
+    pub fn from_u8(level: u8) -> Option<Self> {
+        match level {
+            0 => Some(Self::Debug),
+            1 => Some(Self::Info),
+            2 => Some(Self::Warn),
+            3 => Some(Self::Error),
+            _ => None,
+        }
+    }
+
+    /// Returns the level byte of a log call.
+    pub fn as_u8(self) -> u8 {
+        self as u8
+    }
+
+    /// Returns the level's name.
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Self::Debug => "debug",
+            Self::Info => "info",
+            Self::Warn => "warn",
+            Self::Error => "error",
+        }
+    }
+}
+
+/// A debug log written by a contract.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ContractLog {
+    /// Contract that wrote the log
+    pub address: Address,
+    /// Severity
+    pub level: ContractLogLevel,
+    /// Message, usually UTF-8 text
+    pub message: Vec<u8>,
+}
+
+impl ContractLog {
+    /// Decodes a log call's calldata; None if the level is missing or
+    /// unknown.
+    pub fn decode(address: Address, data: &[u8]) -> Option<Self> {
+        let (&level, message) = data.split_first()?;
+        Some(Self {
+            address,
+            level: ContractLogLevel::from_u8(level)?,
+            message: message.to_vec(),
+        })
+    }
+
+    /// Encodes the calldata of a log call.
+    pub fn encode_call(level: ContractLogLevel, message: &[u8]) -> Vec<u8> {
+        let mut data = Vec::with_capacity(1 + message.len());
+        data.push(level.as_u8());
+        data.extend_from_slice(message);
+        data
+    }
+}
+
+/// Debug logs of one transaction, capped at `MAX_CONTRACT_LOG_BYTES` of
+/// messages.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ContractLogs {
+    /// Logs kept, in the order they were written
+    pub entries: Vec<ContractLog>,
+    /// Logs dropped once the cap was reached
+    pub dropped: usize,
+    /// Message bytes kept
+    bytes: usize,
+}
+
+impl ContractLogs {
+    /// Keeps `log` if it fits under the cap, otherwise counts it as dropped.
+    pub fn push(&mut self, log: ContractLog) {
+        if self.dropped > 0 || self.bytes + log.message.len() > MAX_CONTRACT_LOG_BYTES {
+            self.dropped += 1;
+            return;
+        }
+        self.bytes += log.message.len();
+        self.entries.push(log);
+    }
+
+    /// Moves the logs of a nested frame after these, leaving `other` empty.
+    pub fn append(&mut self, other: &mut ContractLogs) {
+        let other = std::mem::take(other);
+        for log in other.entries {
+            self.push(log);
+        }
+        self.dropped += other.dropped;
+    }
+
+    /// Returns true if no log was written.
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty() && self.dropped == 0
+    }
+}
+
+// =============================================================================
+// Storage Range Scans
+// =============================================================================
+
+/// Most entries a storage scan host call returns per page.
+pub const MAX_STORAGE_SCAN_PAGE: usize = 256;
+
+/// Most storage scan pages one transaction may read, over all its frames.
+pub const MAX_STORAGE_SCAN_PAGES: usize = 64;
+
+/// Gas charged per storage scan page, on top of `GAS_SLOAD` per entry
+/// returned.
+pub const GAS_STORAGE_SCAN_PAGE: u64 = 700;
+
+/// Returns the address of the storage scan host call (0x…010C).
+///
+/// A call to it returns a page of the calling contract's storage in
+/// ascending slot order, so contracts can walk large ranges a page at a
+/// time instead of loading them at once. Calldata is a `StorageScan`;
+/// the result is a `StoragePage`. Pages are read from the transaction's
+/// own view of state, its earlier writes included, and the cursor is the
+/// last slot returned, so slots written between pages neither shift nor
+/// repeat the rest of the scan.
+pub fn storage_scan_address() -> Address {
+    SystemContract::StorageScan.address()
+}
+
+/// Page request of a storage scan call.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct StorageScan {
+    /// Most entries to return, at most `MAX_STORAGE_SCAN_PAGE`
+    pub limit: u16,
+    /// Last slot of the previous page, None for the first page
+    pub cursor: Option<H256>,
+}
+
+impl StorageScan {
+    /// Requests the first page of up to `limit` entries.
+    pub fn first(limit: u16) -> Self {
+        Self {
+            limit,
+            cursor: None,
+        }
+    }
+
+    /// Requests the page after `page`, or None if `page` is the last one.
+    pub fn after(&self, page: &StoragePage) -> Option<Self> {
+        Some(Self {
+            limit: self.limit,
+            cursor: Some(page.next_cursor()?),
+        })
+    }
+
+    /// Decodes a scan call's calldata: `limit (u16 BE) || cursor (32)`,
+    /// without the cursor for the first page.
+    pub fn decode(data: &[u8]) -> Option<Self> {
+        let limit = u16::from_be_bytes(data.get(..2)?.try_into().unwrap());
+        let cursor = match data.len() {
+            2 => None,
+            34 => Some(H256::from_slice(&data[2..]).unwrap()),
+            _ => return None,
+        };
+        Some(Self { limit, cursor })
+    }
+
+    /// Encodes the calldata of a scan call.
+    pub fn encode_call(&self) -> Vec<u8> {
+        let mut data = self.limit.to_be_bytes().to_vec();
+        if let Some(cursor) = &self.cursor {
+            data.extend_from_slice(cursor.as_bytes());
+        }
+        data
+    }
+}
+
+/// One page of a storage scan.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct StoragePage {
+    /// Non-zero slots and their values, in ascending slot order
+    pub entries: Vec<(H256, H256)>,
+    /// True if more slots follow the last entry
+    pub more: bool,
+}
+
+impl StoragePage {
+    /// Returns the cursor of the next page, None on the last page.
+    pub fn next_cursor(&self) -> Option<H256> {
+        match self.more {
+            true => self.entries.last().map(|(slot, _)| *slot),
+            false => None,
+        }
+    }
+
+    /// Encodes the page as a call result: a word set to 1 if more slots
+    /// follow, then each entry's slot and value.
+    pub fn encode(&self) -> Vec<u8> {
+        let mut data = Vec::with_capacity(32 + 64 * self.entries.len());
+        let mut more = [0u8; 32];
+        more[31] = self.more as u8;
+        data.extend_from_slice(&more);
+        for (slot, value) in &self.entries {
+            data.extend_from_slice(slot.as_bytes());
+            data.extend_from_slice(value.as_bytes());
+        }
+        data
+    }
+
+    /// Decodes a call result; None if it is malformed.
+    pub fn decode(data: &[u8]) -> Option<Self> {
+        if data.len() < 32 || (data.len() - 32) % 64 != 0 {
+            return None;
+        }
+        if data[..31].iter().any(|&b| b != 0) || data[31] > 1 {
+            return None;
+        }
+        let more = data[31] == 1;
+        let entries = data[32..]
+            .chunks_exact(64)
+            .map(|entry| {
+                let slot = H256::from_slice(&entry[..32]).unwrap();
+                (slot, H256::from_slice(&entry[32..]).unwrap())
+            })
+            .collect();
+        Some(Self { entries, more })
+    }
+}
+
+impl EvmState {
+    /// Returns up to `limit` non-zero storage slots of `address` after
+    /// `cursor`, in ascending slot order.
+    ///
+    /// Slots are kept ordered, so a page visits only its own entries and
+    /// the one telling whether more follow, however many slots the account
+    /// has.
+    pub fn scan_storage(
+        &self,
+        address: &Address,
+        cursor: Option<&H256>,
+        limit: usize,
+    ) -> StoragePage {
+        let Some(account) = self.accounts.get(address) else {
+            return StoragePage::default();
+        };
+        let start = cursor.map_or(Bound::Unbounded, |cursor| Bound::Excluded(*cursor));
+        let mut slots = account.storage.range((start, Bound::Unbounded));
+        let entries = slots
+            .by_ref()
+            .take(limit)
+            .map(|(slot, value)| (*slot, *value))
+            .collect();
+        let more = slots.next().is_some();
+        StoragePage { entries, more }
+    }
+}
+
+/// Serves a storage scan host call made by `context.address` in a
+/// transaction that already read `pages` pages.
+fn serve_storage_scan(
+    data: &[u8],
+    context: &EvmContext,
+    state: &EvmState,
+    pages: usize,
+) -> Result<StoragePage, EvmError> {
+    let fail = |msg: &str| EvmError::StorageScanFailed(msg.to_string());
+
+    let scan = StorageScan::decode(data).ok_or_else(|| fail("invalid scan call"))?;
+    let limit = scan.limit as usize;
+    if limit == 0 || limit > MAX_STORAGE_SCAN_PAGE {
+        return Err(fail("page limit out of range"));
+    }
+    if pages >= MAX_STORAGE_SCAN_PAGES {
+        return Err(fail("transaction read too many pages"));
+    }
+    // Raw slots of an isolated contract span every org's namespace
+    let isolated = state.org_isolation().map_or(false, |i| i.is_isolated(&context.address));
+    if isolated {
+        return Err(fail("contract is isolated"));
+    }
+    Ok(state.scan_storage(&context.address, scan.cursor.as_ref(), limit))
+}
+
+// =============================================================================
+// Org Data Isolation
+// =============================================================================
+
+/// Org grants call: let another org read the caller's org namespace of an
+/// isolated contract. Calldata: `0x01 || contract(20) || grantee org`.
+pub const ORG_GRANT: u8 = 0x01;
+/// Org grants call: withdraw a grant. Calldata as for `ORG_GRANT`.
+pub const ORG_REVOKE: u8 = 0x02;
+/// Org grants host call, made by an isolated contract: read a slot of
+/// another org's namespace. Calldata: `0x03 || slot(32) || owner org`.
+pub const ORG_READ: u8 = 0x03;
+
+/// Returns the address of the org grants system contract (0x…010A).
+pub fn org_grants_address() -> Address {
+    SystemContract::OrgGrants.address()
+}
+
+/// Which contracts keep a separate storage namespace per org, and which
+/// org each account belongs to.
+///
+/// Storage slots of an isolated contract are namespaced by the org of the
+/// transaction's origin, so members of different orgs using the same
+/// contract never see each other's data. An org's namespace can only be
+/// read by another org it has granted access to through the org grants
+/// contract.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct OrgIsolation {
+    /// Contracts whose storage is namespaced per org
+    pub contracts: HashSet<Address>,
+    /// Org of each member account
+    pub members: HashMap<Address, String>,
+    /// Org of each admin key; admins manage their org's grants
+    pub admins: HashMap<Address, String>,
+}
+
+impl OrgIsolation {
+    /// Returns true if `contract`'s storage is namespaced per org.
+    pub fn is_isolated(&self, contract: &Address) -> bool {
+        self.contracts.contains(contract)
+    }
+
+    /// Returns the org `account` belongs to, as admin or member.
+    pub fn org_of(&self, account: &Address) -> Option<&str> {
+        self.admins
+            .get(account)
+            .or_else(|| self.members.get(account))
+            .map(String::as_str)
+    }
+}
+
+/// Returns the slot `key` of `org`'s namespace is stored at.
+pub fn org_slot(org: &str, key: &H256) -> H256 {
+    let mut data = keccak256(org.as_bytes()).as_bytes().to_vec();
+    data.extend_from_slice(key.as_bytes());
+    keccak256(&data)
+}
+
+/// Returns the slot the executing contract's `key` is stored at: in the
+/// origin's org namespace if the contract is isolated.
+fn isolated_slot(state: &EvmState, context: &EvmContext, key: H256) -> Result<H256, EvmError> {
+    match state.org_isolation() {
+        Some(isolation) if isolation.is_isolated(&context.address) => {
+            let org = isolation
+                .org_of(&context.origin)
+                .ok_or(EvmError::NotOrgMember(context.origin))?;
+            Ok(org_slot(org, &key))
+        }
+        _ => Ok(key),
+    }
+}
+
+/// Storage slot of the org grants contract recording that `grantee` may
+/// read `owner`'s namespace of `contract`.
+fn org_grant_slot(contract: &Address, owner: &str, grantee: &str) -> H256 {
+    let mut data = contract.as_bytes().to_vec();
+    data.extend_from_slice(keccak256(owner.as_bytes()).as_bytes());
+    data.extend_from_slice(keccak256(grantee.as_bytes()).as_bytes());
+    keccak256(&data)
+}
+
+impl EvmState {
+    /// Returns true if `grantee` may read `owner`'s namespace of `contract`.
+    pub fn has_org_grant(&self, contract: &Address, owner: &str, grantee: &str) -> bool {
+        owner == grantee
+            || !self
+                .get_storage(&org_grants_address(), &org_grant_slot(contract, owner, grantee))
+                .is_zero()
+    }
+}
+
+/// A grant made or withdrawn through the org grants contract.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct OrgGrant {
+    /// Isolated contract the grant covers
+    pub contract: Address,
+    /// Org whose namespace is shared
+    pub owner: String,
+    /// Org allowed to read it
+    pub grantee: String,
+    /// False if the grant was withdrawn
+    pub granted: bool,
+}
+
+/// Executes a call to the org grants contract.
+///
+/// Only an org's admin key can grant or withdraw access to its namespace.
+/// Grants are kept in the contract's storage, so they are part of chain
+/// state.
+pub fn execute_org_grants(
+    data: &[u8],
+    context: &EvmContext,
+    state: &mut EvmState,
+) -> Result<OrgGrant, EvmError> {
+    let fail = |msg: &str| EvmError::OrgGrantFailed(msg.to_string());
+
+    state.require_feature(FEATURE_ORG_GRANTS, context.block_number)?;
+    let isolation = state
+        .org_isolation()
+        .cloned()
+        .ok_or_else(|| fail("org isolation is disabled"))?;
+    let (&call, payload) = data.split_first().ok_or_else(|| fail("empty calldata"))?;
+    let granted = match call {
+        ORG_GRANT => true,
+        ORG_REVOKE => false,
+        _ => return Err(fail("unknown grants call")),
+    };
+    if payload.len() <= 20 {
+        return Err(fail("missing contract or org"));
+    }
+    let contract = Address::from_slice(&payload[..20]).unwrap();
+    let grantee = std::str::from_utf8(&payload[20..]).map_err(|_| fail("invalid org"))?;
+    if !isolation.is_isolated(&contract) {
+        return Err(fail("contract is not isolated"));
+    }
+    let owner = isolation
+        .admins
+        .get(&context.caller)
+        .ok_or_else(|| fail("only org admins can change grants"))?;
+    if owner == grantee {
+        return Err(fail("an org always reads its own namespace"));
+    }
+
+    let mut flag = [0u8; 32];
+    flag[31] = granted as u8;
+    let slot = org_grant_slot(&contract, owner, grantee);
+    state.set_storage(&org_grants_address(), slot, H256::from(flag));
+    Ok(OrgGrant {
+        contract,
+        owner: owner.clone(),
+        grantee: grantee.to_string(),
+        granted,
+    })
+}
+
+/// Serves an `ORG_READ` host call of an isolated contract: returns a slot
+/// of the owner org's namespace if the origin's org holds a grant to it.
+fn read_org_storage(
+    data: &[u8],
+    context: &EvmContext,
+    state: &EvmState,
+) -> Result<H256, EvmError> {
+    let fail = |msg: &str| EvmError::OrgGrantFailed(msg.to_string());
+
+    let isolation = state.org_isolation().ok_or_else(|| fail("org isolation is disabled"))?;
+    if data.first() != Some(&ORG_READ) || data.len() <= 33 {
+        return Err(fail("invalid read call"));
+    }
+    let slot = H256::from_slice(&data[1..33]).unwrap();
+    let owner = std::str::from_utf8(&data[33..]).map_err(|_| fail("invalid org"))?;
+    if !isolation.is_isolated(&context.address) {
+        return Err(fail("contract is not isolated"));
+    }
+    let reader = isolation
+        .org_of(&context.origin)
+        .ok_or(EvmError::NotOrgMember(context.origin))?;
+    if !state.has_org_grant(&context.address, owner, reader) {
+        return Err(fail("no grant from the owner org"));
+    }
+    Ok(state.get_storage(&context.address, &org_slot(owner, &slot)))
+}
+
+// =============================================================================
+// Contract Method Permissions
+// =============================================================================
+
+/// Contract ACL call: deploy a contract with a method permission manifest.
+/// Calldata: `0x01 || manifest length (u16 BE) || manifest || init code`.
+pub const ACL_INSTALL: u8 = 0x01;
+/// Contract ACL call: replace an installed contract's manifest; an empty
+/// manifest lifts every restriction. Calldata: `0x02 || contract(20) ||
+/// manifest`.
+pub const ACL_SET: u8 = 0x02;
+/// Contract ACL call: pause a contract, rejecting transactions to it while
+/// read-only calls still run. Calldata: `0x03 || contract(20)`.
+pub const ACL_PAUSE: u8 = 0x03;
+/// Contract ACL call: lift a pause. Calldata: `0x04 || contract(20)`.
+pub const ACL_RESUME: u8 = 0x04;
+/// Contract ACL call: replace an installed contract's runtime code and
+/// run an optional migration call against it. Calldata: `0x05 ||
+/// contract(20) || code length (u32 BE) || code || migration calldata`.
+pub const ACL_UPGRADE: u8 = 0x05;
+
+/// Returns the address of the contract ACL system contract (0x…010B).
+pub fn contract_acl_address() -> Address {
+    SystemContract::ContractAcl.address()
+}
+
+/// Org of each member account and admin key.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct OrgMembers {
+    /// Org of each member account
+    pub members: HashMap<Address, String>,
+    /// Org of each admin key
+    pub admins: HashMap<Address, String>,
+}
+
+impl OrgMembers {
+    /// Returns the org `account` belongs to, as admin or member.
+    pub fn org_of(&self, account: &Address) -> Option<&str> {
+        self.admins
+            .get(account)
+            .or_else(|| self.members.get(account))
+            .map(String::as_str)
+    }
+}
+
+/// Role a method's caller must hold in its org.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum MethodRole {
+    /// Any member account or admin key
+    Member,
+    /// Admin keys only
+    Admin,
+}
+
+impl MethodRole {
+    /// Decodes the role byte of a manifest entry.
+    pub fn from_u8(role: u8) -> Option<Self> {
+        match role {
+            0 => Some(Self::Member),
+            1 => Some(Self::Admin),
+            _ => None,
+        }
+    }
+
+    /// Returns the role byte of a manifest entry.
+    pub fn as_u8(self) -> u8 {
+        self as u8
+    }
+}
+
+/// Who may invoke one contract method.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MethodRule {
+    /// Role the caller must hold
+    pub role: MethodRole,
+    /// Orgs the caller must belong to (any org if empty)
+    pub orgs: Vec<String>,
+}
+
+impl MethodRule {
+    /// Returns true if `account` satisfies the rule.
+    pub fn permits(&self, members: &OrgMembers, account: &Address) -> bool {
+        let org = match self.role {
+            MethodRole::Member => members.org_of(account),
+            MethodRole::Admin => members.admins.get(account).map(String::as_str),
+        };
+        org.is_some_and(|org| self.orgs.is_empty() || self.orgs.iter().any(|o| o == org))
+    }
+}
+
+/// Method permission manifest of a contract, by method selector.
+///
+/// Methods the manifest doesn't list, and calls with less than a selector
+/// of calldata, are open to every caller.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct MethodPermissions {
+    /// Rule of each restricted method
+    pub methods: BTreeMap<[u8; 4], MethodRule>,
+}
+
+impl MethodPermissions {
+    /// Decodes a manifest: `count(1)`, then per method `selector(4) ||
+    /// role(1) || orgs length(1) || orgs`, with orgs comma-separated.
+    /// None if malformed or a selector repeats.
+    pub fn decode(data: &[u8]) -> Option<Self> {
+        let (&count, mut rest) = data.split_first()?;
+        let mut methods = BTreeMap::new();
+        for _ in 0..count {
+            if rest.len() < 6 {
+                return None;
+            }
+            let selector: [u8; 4] = rest[..4].try_into().unwrap();
+            let role = MethodRole::from_u8(rest[4])?;
+            let len = usize::from(rest[5]);
+            let orgs = std::str::from_utf8(rest.get(6..6 + len)?).ok()?;
+            let orgs = orgs
+                .split(',')
+                .filter(|org| !org.is_empty())
+                .map(str::to_string)
+                .collect();
+            if methods.insert(selector, MethodRule { role, orgs }).is_some() {
+                return None;
+            }
+            rest = &rest[6 + len..];
+        }
+        rest.is_empty().then_some(Self { methods })
+    }
+
+    /// Encodes the manifest, or None if it lists more than 255 methods or
+    /// a method's orgs take more than 255 bytes.
+    pub fn encode(&self) -> Option<Vec<u8>> {
+        let mut data = vec![u8::try_from(self.methods.len()).ok()?];
+        for (selector, rule) in &self.methods {
+            let orgs = rule.orgs.join(",");
+            data.extend_from_slice(selector);
+            data.push(rule.role.as_u8());
+            data.push(u8::try_from(orgs.len()).ok()?);
+            data.extend_from_slice(orgs.as_bytes());
+        }
+        Some(data)
+    }
+
+    /// Returns true if no method is restricted.
+    pub fn is_empty(&self) -> bool {
+        self.methods.is_empty()
+    }
+}
+
+impl EvmState {
+    /// Returns the method permission manifest of `contract`, if any.
+    pub fn method_permissions(&self, contract: &Address) -> Option<&MethodPermissions> {
+        self.method_permissions.get(contract)
+    }
+
+    /// Replaces the method permission manifest of `contract`; an empty one
+    /// removes it.
+    pub fn set_method_permissions(&mut self, contract: Address, permissions: MethodPermissions) {
+        if permissions.is_empty() {
+            self.method_permissions.remove(&contract);
+        } else {
+            self.method_permissions.insert(contract, permissions);
+        }
+    }
+
+    /// Returns the account that installed `contract` through the contract
+    /// ACL contract, if any.
+    pub fn installer_of(&self, contract: &Address) -> Option<&Address> {
+        self.contract_installers.get(contract)
+    }
+
+    /// Returns true if `account` may manage `contract`: it installed the
+    /// contract, or holds an admin key of the installer's org.
+    pub fn may_manage_contract(&self, contract: &Address, account: &Address) -> bool {
+        let Some(installer) = self.contract_installers.get(contract) else {
+            return false;
+        };
+        if installer == account {
+            return true;
+        }
+        self.org_members.as_ref().is_some_and(|members| {
+            let admin_org = members.admins.get(account).map(String::as_str);
+            admin_org.is_some() && admin_org == members.org_of(installer)
+        })
+    }
+
+    /// Returns true if `account` may pause or resume `contract`: it holds
+    /// an admin key of the org owning the contract, the installer's org.
+    /// A contract whose installer belongs to no org, as when org
+    /// membership is off, is paused by its installer.
+    pub fn may_pause_contract(&self, contract: &Address, account: &Address) -> bool {
+        let Some(installer) = self.contract_installers.get(contract) else {
+            return false;
+        };
+        match self.org_members.as_ref().and_then(|m| m.org_of(installer)) {
+            Some(owner) => self
+                .org_members
+                .as_ref()
+                .is_some_and(|m| m.admins.get(account).is_some_and(|org| org == owner)),
+            None => installer == account,
+        }
+    }
+
+    /// Returns true if `contract` is paused.
+    pub fn is_paused(&self, contract: &Address) -> bool {
+        self.paused_contracts.contains(contract)
+    }
+
+    /// Pauses or resumes `contract`.
+    pub fn set_paused(&mut self, contract: Address, paused: bool) {
+        if paused {
+            self.paused_contracts.insert(contract);
+        } else {
+            self.paused_contracts.remove(&contract);
+        }
+    }
+
+    /// Checks that `account` may invoke the method of `contract` that
+    /// `data` selects.
+    pub fn check_method_permission(
+        &self,
+        contract: &Address,
+        account: &Address,
+        data: &[u8],
+    ) -> Result<(), EvmError> {
+        let (Some(permissions), Some(selector)) =
+            (self.method_permissions.get(contract), data.get(..4))
+        else {
+            return Ok(());
+        };
+        let selector: [u8; 4] = selector.try_into().unwrap();
+        let Some(rule) = permissions.methods.get(&selector) else {
+            return Ok(());
+        };
+        match &self.org_members {
+            Some(members) if rule.permits(members, account) => Ok(()),
+            _ => Err(EvmError::MethodNotPermitted {
+                contract: *contract,
+                selector,
+            }),
+        }
+    }
+}
+
+/// Executes a call to the contract ACL contract and returns the contract
+/// it installed or changed.
+///
+/// Any account may install a contract with a manifest and becomes its
+/// installer. Only the installer, or an admin key of the installer's org,
+/// may replace the manifest or upgrade the code; only an admin key of the
+/// installer's org may pause or resume the contract. Checks are on the direct caller
+/// (`msg.sender`), never the transaction origin.
+pub fn execute_contract_acl(
+    data: &[u8],
+    context: EvmContext,
+    state: &mut EvmState,
+) -> Result<Address, EvmError> {
+    let fail = |msg: &str| EvmError::AclFailed(msg.to_string());
+
+    let (&call, payload) = data.split_first().ok_or_else(|| fail("empty calldata"))?;
+    match call {
+        ACL_INSTALL => {
+            if payload.len() < 2 {
+                return Err(fail("missing manifest length"));
+            }
+            let len = usize::from(u16::from_be_bytes([payload[0], payload[1]]));
+            let manifest = payload.get(2..2 + len).ok_or_else(|| fail("truncated manifest"))?;
+            let permissions =
+                MethodPermissions::decode(manifest).ok_or_else(|| fail("invalid manifest"))?;
+            let code = &payload[2 + len..];
+            if code.is_empty() {
+                return Err(fail("missing init code"));
+            }
+            let installer = context.caller;
+            let contract = deploy_contract(code, context, state)?;
+            state.set_method_permissions(contract, permissions);
+            state.contract_installers.insert(contract, installer);
+            Ok(contract)
+        }
+        ACL_SET | ACL_PAUSE | ACL_RESUME => {
+            if payload.len() < 20 {
+                return Err(fail("missing contract"));
+            }
+            let contract = Address::from_slice(&payload[..20]).unwrap();
+            if state.get_code(&contract).is_empty() {
+                return Err(fail("not a contract"));
+            }
+            if call == ACL_SET {
+                if !state.may_manage_contract(&contract, &context.caller) {
+                    return Err(fail("only the installer or its org admins can set permissions"));
+                }
+                let permissions = MethodPermissions::decode(&payload[20..])
+                    .ok_or_else(|| fail("invalid manifest"))?;
+                state.set_method_permissions(contract, permissions);
+            } else if !state.may_pause_contract(&contract, &context.caller) {
+                return Err(fail("only the owning org's admins can pause the contract"));
+            } else if payload.len() == 20 {
+                state.set_paused(contract, call == ACL_PAUSE);
+            } else {
+                return Err(fail("unexpected data after contract"));
+            }
+            Ok(contract)
+        }
+        ACL_UPGRADE => {
+            if payload.len() < 24 {
+                return Err(fail("missing contract or code length"));
+            }
+            let contract = Address::from_slice(&payload[..20]).unwrap();
+            if !state.may_manage_contract(&contract, &context.caller) {
+                return Err(fail("only the installer or its org admins can upgrade"));
+            }
+            let len = u32::from_be_bytes(payload[20..24].try_into().unwrap()) as usize;
+            let code = payload.get(24..24 + len).ok_or_else(|| fail("truncated code"))?;
+            let migrate = &payload[24 + len..];
+            let migrate = (!migrate.is_empty()).then_some(migrate);
+            upgrade_contract(contract, code.to_vec(), None, migrate, context, state)?;
+            Ok(contract)
+        }
+        _ => Err(fail("unknown ACL call")),
+    }
+}
+
+/// Gas limit of a `ContractInstall` that doesn't set one
+pub const DEFAULT_INSTALL_GAS_LIMIT: u64 = 30_000_000;
+
+/// A contract deployment with constructor arguments and, optionally, a
+/// method permission manifest.
+///
+/// Without a manifest it is a creation transaction carrying the init code
+/// followed by the ABI-encoded constructor arguments; with one it is an
+/// `ACL_INSTALL` call to the contract ACL contract.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ContractInstall {
+    /// Init code of the contract
+    pub code: Vec<u8>,
+    /// ABI-encoded constructor arguments
+    pub init_args: Vec<u8>,
+    /// Method permission manifest; empty to install without one
+    pub permissions: MethodPermissions,
+    /// Value sent to the new contract
+    pub value: U256,
+    /// Gas limit of the deployment
+    pub gas_limit: u64,
+}
+
+impl ContractInstall {
+    /// Starts an install of `code` without arguments, manifest or value.
+    pub fn new(code: Vec<u8>) -> Self {
+        Self {
+            code,
+            init_args: Vec::new(),
+            permissions: MethodPermissions::default(),
+            value: U256::ZERO,
+            gas_limit: DEFAULT_INSTALL_GAS_LIMIT,
+        }
+    }
+
+    /// Appends ABI-encoded constructor arguments.
+    pub fn with_init_args(mut self, args: &[u8]) -> Self {
+        self.init_args.extend_from_slice(args);
+        self
+    }
+
+    /// Sets the method permission manifest.
+    pub fn with_permissions(mut self, permissions: MethodPermissions) -> Self {
+        self.permissions = permissions;
+        self
+    }
+
+    /// Sets the value sent to the new contract.
+    pub fn with_value(mut self, value: U256) -> Self {
+        self.value = value;
+        self
+    }
+
+    /// Sets the gas limit.
+    pub fn with_gas_limit(mut self, gas_limit: u64) -> Self {
+        self.gas_limit = gas_limit;
+        self
+    }
+
+    /// Returns the init code followed by the constructor arguments.
+    pub fn init_code(&self) -> Vec<u8> {
+        [self.code.as_slice(), &self.init_args].concat()
+    }
+
+    /// Returns the recipient of the install transaction: none for a
+    /// creation, the contract ACL contract with a manifest.
+    pub fn to(&self) -> Option<Address> {
+        (!self.permissions.is_empty()).then(contract_acl_address)
+    }
+
+    /// Returns the data of the install transaction.
+    pub fn calldata(&self) -> Result<Vec<u8>, EvmError> {
+        if self.permissions.is_empty() {
+            return Ok(self.init_code());
+        }
+        let manifest = self
+            .permissions
+            .encode()
+            .filter(|manifest| manifest.len() <= usize::from(u16::MAX))
+            .ok_or_else(|| EvmError::AclFailed("manifest too large".to_string()))?;
+        let mut data = vec![ACL_INSTALL];
+        data.extend_from_slice(&(manifest.len() as u16).to_be_bytes());
+        data.extend_from_slice(&manifest);
+        data.extend_from_slice(&self.init_code());
+        Ok(data)
+    }
+
+    /// Deploys the contract from `context.caller` with the install's value
+    /// and gas limit, then sets its manifest. Returns the contract address.
+    pub fn execute(&self, context: EvmContext, state: &mut EvmState) -> Result<Address, EvmError> {
+        let data = self.calldata()?;
+        let context = EvmContext {
+            value: self.value,
+            gas_limit: self.gas_limit,
+            data: data.clone(),
+            ..context
+        };
+        if self.permissions.is_empty() {
+            deploy_contract(&data, context, state)
+        } else {
+            execute_contract_acl(&data, context, state)
+        }
+    }
+}
+
+// =============================================================================
+// Public API
+// =============================================================================
+
+/// Execute EVM bytecode
+pub fn execute(code: &[u8], context: EvmContext, state: &mut EvmState) -> ExecutionResult {
+    let mut evm = Evm::new();
+    evm.execute(code, &context, state)
+}
+
+/// Deploy a contract
+pub fn deploy_contract(
+    code: &[u8],
+    context: EvmContext,
+    state: &mut EvmState,
+) -> Result<Address, EvmError> {
+    create_contract(code, context, state).map(|(address, _)| address)
+}
+
+/// Deploys a contract, also returning the execution of its init code for
+/// its gas used and logs.
+pub fn create_contract(
+    code: &[u8],
+    context: EvmContext,
+    state: &mut EvmState,
+) -> Result<(Address, ExecutionResult), EvmError> {
+    let sender = context.caller;
+    let nonce = state.get_nonce(&sender);
+    let contract_address = create_address(&sender, nonce);
+
+    // Increment sender nonce
+    state.increment_nonce(&sender);
+
+    // Transfer value if any
+    if !context.value.is_zero() {
+        state.transfer(&sender, &contract_address, context.value)?;
+    }
+
+    // Execute init code
+    let mut deploy_context = context;
+    deploy_context.address = contract_address;
+
+    let mut evm = Evm::new();
+    let mut result = evm.execute(code, &deploy_context, state);
+
+    if !result.success {
+        return Err(result.error.unwrap_or(EvmError::CreateFailed));
+    }
+
+    // Check code size limit
+    if result.output.len() > MAX_CODE_SIZE {
+        return Err(EvmError::CodeSizeExceeded);
+    }
+
+    // Check for EIP-3541 (reject code starting with 0xEF)
+    if !result.output.is_empty() && result.output[0] == 0xEF {
+        return Err(EvmError::InvalidCode);
+    }
+
+    // Store the deployed code
+    let code = std::mem::take(&mut result.output);
+    state.set_code(&contract_address, code);
+
+    Ok((contract_address, result))
+}
+
+/// Call a contract, if the transaction's origin may invoke the method the
+/// calldata selects; only read-only calls run while it is paused
+pub fn call_contract(
+    address: Address,
+    data: &[u8],
+    context: EvmContext,
+    state: &mut EvmState,
+) -> ExecutionResult {
+    let guard = if state.is_paused(&address) && !context.is_static {
+        Err(EvmError::ContractPaused(address))
+    } else {
+        state.check_method_permission(&address, &context.origin, data)
+    };
+    if let Err(error) = guard {
+        return ExecutionResult {
+            success: false,
+            gas_used: 0,
+            output: Vec::new(),
+            error: Some(error),
+            logs: Vec::new(),
+            call_trace: Vec::new(),
+            contract_logs: ContractLogs::default(),
+        };
+    }
+    run_contract(address, data, context, state)
+}
+
+/// Runs a contract's code without checking method permissions.
+fn run_contract(
+    address: Address,
+    data: &[u8],
+    context: EvmContext,
+    state: &mut EvmState,
+) -> ExecutionResult {
+    let code = state.get_code(&address);
+
+    let mut call_context = context;
+    call_context.address = address;
+    call_context.data = data.to_vec();
+
+    let mut evm = Evm::new().with_code_hash(state.get_code_hash(&address));
+    evm.execute(&code, &call_context, state)
+}
+
+/// Replaces a contract's runtime code and optionally runs a migration.
+///
+/// If `migrate_data` is given, the new code is called with it (typically
+/// the `upgrade_migrate` selector and arguments) in the same step as the
+/// code swap, so its storage writes land together with the upgrade. If
+/// the migration fails, the code and every account it changed are rolled
+/// back and the error is returned. If `permissions` is given, it replaces
+/// the contract's method permission manifest along with the code; the
+/// migration itself is not subject to it. Authorization is up to the
+/// caller; transactions upgrade through `ACL_UPGRADE`.
+pub fn upgrade_contract(
+    address: Address,
+    new_code: Vec<u8>,
+    permissions: Option<MethodPermissions>,
+    migrate_data: Option<&[u8]>,
+    context: EvmContext,
+    state: &mut EvmState,
+) -> Result<ExecutionResult, EvmError> {
+    if state.get_code(&address).is_empty() {
+        return Err(EvmError::UpgradeFailed("not a contract".to_string()));
+    }
+    if new_code.is_empty() {
+        return Err(EvmError::UpgradeFailed("empty code".to_string()));
+    }
+    if new_code.len() > MAX_CODE_SIZE {
+        return Err(EvmError::CodeSizeExceeded);
+    }
+    if new_code[0] == 0xEF {
+        return Err(EvmError::InvalidCode);
+    }
+
+    let previous_permissions = state.method_permissions(&address).cloned();
+    state.begin_undo();
+    state.set_code(&address, new_code);
+    if let Some(permissions) = permissions {
+        state.set_method_permissions(address, permissions);
+    }
+
+    let Some(data) = migrate_data else {
+        state.commit_undo();
+        return Ok(ExecutionResult {
+            success: true,
+            gas_used: 0,
+            output: Vec::new(),
+            error: None,
+            logs: Vec::new(),
+            call_trace: Vec::new(),
+            contract_logs: ContractLogs::default(),
+        });
+    };
+
+    let result = run_contract(address, data, context, state);
+    if !result.success {
+        state.rollback_undo();
+        state.set_method_permissions(address, previous_permissions.unwrap_or_default());
+        return Err(result.error.unwrap_or_else(|| {
+            EvmError::UpgradeFailed("migration failed".to_string())
+        }));
+    }
+    state.commit_undo();
+    Ok(result)
+}
+
+// =============================================================================
+// Tests
+// =============================================================================
+
+#[cfg(test)]
+mod tests {
     use super::*;
 
     #[test]
@@ -2048,6 +4286,37 @@ mod tests {
         assert_eq!(result.output[31], 0x42);
     }
 
+    #[test]
+    fn test_storage_quota_fails_sstore() {
+        // SSTORE 0x42 into slot `key`
+        let store = |key: u8, value: u8| {
+            vec![opcode::PUSH1, value, opcode::PUSH1, key, opcode::SSTORE, opcode::STOP]
+        };
+        let context = EvmContext::default();
+        let contract = context.address;
+        let mut state = EvmState::new().with_feature_gates(Arc::new(FeatureGates::all()));
+        state.set_storage_quota(Some(2 * STORAGE_SLOT_BYTES));
+
+        assert!(execute(&store(1, 0x42), context.clone(), &mut state).success);
+        assert!(execute(&store(2, 0x42), context.clone(), &mut state).success);
+        let result = execute(&store(3, 0x42), context.clone(), &mut state);
+        assert!(!result.success);
+        assert_eq!(
+            result.error,
+            Some(EvmError::StorageQuotaExceeded {
+                address: contract,
+                quota: 2 * STORAGE_SLOT_BYTES,
+            })
+        );
+        assert!(state.get_storage(&contract, &H256::from(U256::from_u64(3).to_be_bytes())).is_zero());
+
+        // Overwrites always work, and clearing a slot frees room
+        assert!(execute(&store(2, 0x43), context.clone(), &mut state).success);
+        assert!(execute(&store(1, 0), context.clone(), &mut state).success);
+        assert_eq!(state.storage_usage(&contract), STORAGE_SLOT_BYTES);
+        assert!(execute(&store(3, 0x42), context, &mut state).success);
+    }
+
     #[test]
     fn test_jump() {
         // PUSH1 0x05, JUMP, INVALID, JUMPDEST, PUSH1 0x42, ...
@@ -2267,6 +4536,1027 @@ mod tests {
         assert_eq!(call_result.output[31], 0x42);
     }
 
+    #[test]
+    fn test_check_affordability() {
+        let alice = Address::from([0xAA; 20]);
+        let mut state = EvmState::new();
+        state.set_balance(&alice, U256::from_u64(21_000 * 10 + 5));
+
+        let gas_price = U256::from_u64(10);
+        let exact = state.check_affordability(&alice, 21_000, gas_price, U256::from_u64(5));
+        assert!(exact.is_affordable());
+        assert_eq!(exact.shortfall(), U256::ZERO);
+
+        let short = state.check_affordability(&alice, 21_000, gas_price, U256::from_u64(8));
+        assert!(!short.is_affordable());
+        assert_eq!(short.shortfall(), U256::from_u64(3));
+        assert!(state.transfer(&alice, &Address::zero(), U256::from_u64(21_000 * 10 + 6)).is_err());
+
+        // An overflowing cost is never affordable
+        let overflow = state.check_affordability(&alice, u64::MAX, U256::MAX, U256::ZERO);
+        assert_eq!(overflow.required, U256::MAX);
+        assert!(!overflow.is_affordable());
+    }
+
+    #[test]
+    fn test_balance_events() {
+        let alice = Address::from([0xAA; 20]);
+        let bob = Address::from([0xBB; 20]);
+        let mut state = EvmState::new();
+        state.set_balance(&alice, U256::from_u64(100));
+        state.transfer(&alice, &bob, U256::from_u64(30)).unwrap();
+        // Unchanged balances are not recorded
+        state.set_balance(&bob, U256::from_u64(30));
+
+        assert_eq!(
+            state.take_balance_events(),
+            vec![
+                BalanceEvent { address: alice, delta: BalanceDelta::Credit(U256::from_u64(100)), reason: BalanceChangeReason::Set },
+                BalanceEvent { address: alice, delta: BalanceDelta::Debit(U256::from_u64(30)), reason: BalanceChangeReason::Transfer },
+                BalanceEvent { address: bob, delta: BalanceDelta::Credit(U256::from_u64(30)), reason: BalanceChangeReason::Transfer },
+            ]
+        );
+        assert!(state.balance_events().is_empty());
+
+        // PUSH20 bob, SELFDESTRUCT
+        let mut code = vec![opcode::PUSH1 + 19];
+        code.extend_from_slice(bob.as_bytes());
+        code.push(opcode::SELFDESTRUCT);
+        let mut context = EvmContext::default();
+        context.address = alice;
+        assert!(execute(&code, context, &mut state).success);
+
+        let events = state.take_balance_events();
+        assert_eq!(events.len(), 2);
+        assert!(events.iter().all(|e| e.reason == BalanceChangeReason::SelfDestruct));
+        assert_eq!(events[0].delta, BalanceDelta::Credit(U256::from_u64(70)));
+        assert_eq!(events[1].delta, BalanceDelta::Debit(U256::from_u64(70)));
+
+        let tx_hash = H256::from([7u8; 32]);
+        let log = events[1].to_log(tx_hash);
+        assert_eq!(log.address, account_manager_address());
+        assert_eq!(log.topics[0], balance_changed_topic());
+        assert_eq!(&log.topics[1].as_bytes()[12..], alice.as_bytes());
+        assert_eq!(log.data[31], BalanceChangeReason::SelfDestruct.code());
+        assert_eq!(&log.data[32..64], &U256::ZERO.wrapping_sub(&U256::from_u64(70)).to_be_bytes());
+        assert_eq!(&log.data[64..], tx_hash.as_bytes());
+
+        // A state nobody drains keeps a bounded journal
+        for n in 1..=MAX_BALANCE_EVENTS as u64 + 2 {
+            state.set_balance(&alice, U256::from_u64(n));
+        }
+        assert_eq!(state.balance_events().len(), MAX_BALANCE_EVENTS);
+        assert_eq!(state.balance_events_dropped(), 2);
+        state.take_balance_events();
+        assert_eq!(state.balance_events_dropped(), 0);
+    }
+
+    #[test]
+    fn test_code_cache_shared_across_executions() {
+        // PUSH1 0x04, JUMP, INVALID, JUMPDEST, STOP
+        let code = vec![opcode::PUSH1, 0x04, opcode::JUMP, opcode::INVALID, opcode::JUMPDEST, opcode::STOP];
+        let cache = Arc::new(CodeCache::new(1));
+        let mut state = EvmState::new().with_code_cache(Arc::clone(&cache));
+        let (contract, other) = (Address::from([0xc1; 20]), Address::from([0xc2; 20]));
+        state.set_code(&contract, code.clone());
+        state.set_code(&other, vec![opcode::STOP]);
+        assert_eq!(state.get_code_hash(&contract), keccak256(&code));
+
+        let call = |state: &mut EvmState, address: Address| {
+            call_contract(address, &[], EvmContext::default(), state).success
+        };
+        assert!(call(&mut state, contract));
+        // A cloned state (e.g. for eth_call) shares the cache
+        let mut copy = state.clone();
+        assert!(call(&mut copy, contract));
+
+        let stats = cache.stats();
+        assert_eq!((stats.hits, stats.misses, stats.entries), (1, 1, 1));
+
+        // A different contract evicts the least recently used entry
+        assert!(call(&mut state, other));
+        let stats = cache.stats();
+        assert_eq!((stats.misses, stats.evictions, stats.entries), (2, 1, 1));
+
+        // Init code run directly isn't cached
+        assert!(execute(&code, EvmContext::default(), &mut state).success);
+        assert_eq!(cache.stats().misses, 2);
+
+        cache.clear();
+        assert_eq!(cache.stats().entries, 0);
+    }
+
+    #[test]
+    fn test_code_cache_evicts_least_recently_used() {
+        let cache = CodeCache::new(2);
+        let hash = |n: u8| H256::from([n; 32]);
+        cache.get_or_analyze(hash(1), &[opcode::STOP]);
+        cache.get_or_analyze(hash(2), &[opcode::STOP]);
+        // Touching 1 makes 2 the least recently used
+        cache.get_or_analyze(hash(1), &[opcode::STOP]);
+        cache.get_or_analyze(hash(3), &[opcode::STOP]);
+        cache.get_or_analyze(hash(1), &[opcode::STOP]);
+        let stats = cache.stats();
+        assert_eq!((stats.hits, stats.misses, stats.evictions), (2, 3, 1));
+        cache.get_or_analyze(hash(2), &[opcode::STOP]);
+        assert_eq!(cache.stats().misses, 4);
+    }
+
+    #[test]
+    fn test_upgrade_with_migration() {
+        let contract = Address::from_hex("0x00000000000000000000000000000000000000cc").unwrap();
+        let mut state = EvmState::new();
+        state.set_code(&contract, vec![opcode::STOP]);
+
+        // v2 migration writes slot 0 = 7
+        let v2 = vec![
+            opcode::PUSH1, 0x07,
+            opcode::PUSH1, 0x00,
+            opcode::SSTORE,
+            opcode::STOP,
+        ];
+        let result = upgrade_contract(contract, v2.clone(), None, Some(&[0x01]), EvmContext::default(), &mut state).unwrap();
+        assert!(result.success);
+        assert_eq!(state.get_code(&contract), v2);
+        assert_eq!(state.get_storage(&contract, &H256::zero()).as_bytes()[31], 7);
+
+        // v3 migration writes, has another contract write, then reverts:
+        // code and storage of both roll back
+        let other = Address::from_hex("0x00000000000000000000000000000000000000ee").unwrap();
+        state.set_code(&other, vec![opcode::PUSH1, 0x05, opcode::PUSH1, 0x00, opcode::SSTORE]);
+        let mut v3 = vec![
+            opcode::PUSH1, 0x09,
+            opcode::PUSH1, 0x00,
+            opcode::SSTORE,
+            opcode::PUSH1, 0x00,
+            opcode::PUSH1, 0x00,
+            opcode::PUSH1, 0x00,
+            opcode::PUSH1, 0x00,
+            opcode::PUSH1, 0x00,
+            opcode::PUSH1 + 19,
+        ];
+        v3.extend_from_slice(other.as_bytes());
+        v3.extend_from_slice(&[opcode::GAS, opcode::CALL, opcode::POP]);
+        v3.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::PUSH1, 0x00, opcode::REVERT]);
+        let mut context = EvmContext::default();
+        context.gas_limit = 1_000_000;
+        let err = upgrade_contract(contract, v3.clone(), None, Some(&[0x01]), context, &mut state);
+        assert!(matches!(err, Err(EvmError::Revert(_))));
+        assert_eq!(state.get_code(&contract), v2);
+        assert_eq!(state.get_storage(&contract, &H256::zero()).as_bytes()[31], 7);
+        assert_eq!(state.get_storage(&other, &H256::zero()), H256::zero());
+
+        // Without a migration only the code changes
+        upgrade_contract(contract, v3.clone(), None, None, EvmContext::default(), &mut state).unwrap();
+        assert_eq!(state.get_code(&contract), v3);
+
+        // Accounts without code can't be upgraded
+        let eoa = Address::from_hex("0x00000000000000000000000000000000000000dd").unwrap();
+        assert!(upgrade_contract(eoa, v2, None, None, EvmContext::default(), &mut state).is_err());
+    }
+
+    #[test]
+    fn test_call_trace_records_nested_failure() {
+        let a = Address::from_hex("0x00000000000000000000000000000000000000aa").unwrap();
+        let b = Address::from_hex("0x00000000000000000000000000000000000000bb").unwrap();
+        let mut state = EvmState::new();
+
+        // B always reverts
+        state.set_code(&b, vec![opcode::PUSH1, 0x00, opcode::PUSH1, 0x00, opcode::REVERT]);
+
+        // A calls B with selector 0xaabbccdd and ignores the failure
+        let mut code_a = vec![
+            0x63, 0xaa, 0xbb, 0xcc, 0xdd, // PUSH4 selector
+            opcode::PUSH1, 0xe0,
+            opcode::SHL,
+            opcode::PUSH1, 0x00,
+            opcode::MSTORE,
+            opcode::PUSH1, 0x00, // retSize
+            opcode::PUSH1, 0x00, // retOffset
+            opcode::PUSH1, 0x04, // argsSize
+            opcode::PUSH1, 0x00, // argsOffset
+            opcode::PUSH1, 0x00, // value
+            0x73,                // PUSH20 B
+        ];
+        code_a.extend_from_slice(b.as_bytes());
+        code_a.extend_from_slice(&[0x61, 0xff, 0xff, opcode::CALL, opcode::STOP]);
+        state.set_code(&a, code_a);
+
+        let mut context = EvmContext::default();
+        context.gas_limit = 1_000_000;
+        let result = call_contract(a, &[], context, &mut state);
+        assert!(result.success);
+
+        assert_eq!(result.call_trace.len(), 1);
+        let frame = &result.call_trace[0];
+        assert_eq!(frame.depth, 1);
+        assert_eq!(frame.kind, CallKind::Call);
+        assert_eq!((frame.from, frame.to), (a, b));
+        assert_eq!(frame.selector, Some([0xaa, 0xbb, 0xcc, 0xdd]));
+        assert!(!frame.success);
+        assert_eq!(frame.error, Some(EvmError::Revert(Vec::new())));
+    }
+
+    #[test]
+    fn test_staged_deploy() {
+        let runtime_code = vec![
+            opcode::PUSH1, 0x42,
+            opcode::PUSH1, 0x00,
+            opcode::MSTORE,
+            opcode::PUSH1, 0x20,
+            opcode::PUSH1, 0x00,
+            opcode::RETURN,
+        ];
+        let mut init_code = vec![
+            opcode::PUSH1, runtime_code.len() as u8,
+            opcode::PUSH1, 0x0C,
+            opcode::PUSH1, 0x00,
+            opcode::CODECOPY,
+            opcode::PUSH1, runtime_code.len() as u8,
+            opcode::PUSH1, 0x00,
+            opcode::RETURN,
+        ];
+        init_code.extend(&runtime_code);
+        let hash = keccak256(&init_code);
+
+        let mut context = EvmContext::default();
+        context.caller = Address::from_hex("0x1234567890123456789012345678901234567890").unwrap();
+        let mut state = EvmState::new().with_feature_gates(Arc::new(FeatureGates::all()));
+
+        let call = |op: u8, payload: &[u8]| {
+            let mut data = vec![op];
+            data.extend_from_slice(hash.as_bytes());
+            data.extend_from_slice(payload);
+            data
+        };
+
+        // Install before all chunks arrive fails
+        execute_staging(&call(STAGING_BEGIN, &(init_code.len() as u64).to_be_bytes()), context.clone(), &mut state).unwrap();
+        execute_staging(&call(STAGING_CHUNK, &init_code[..8]), context.clone(), &mut state).unwrap();
+        assert!(execute_staging(&call(STAGING_INSTALL, &[]), context.clone(), &mut state).is_err());
+
+        // Restart and upload in three chunks
+        execute_staging(&call(STAGING_BEGIN, &(init_code.len() as u64).to_be_bytes()), context.clone(), &mut state).unwrap();
+        for chunk in init_code.chunks(8) {
+            execute_staging(&call(STAGING_CHUNK, chunk), context.clone(), &mut state).unwrap();
+        }
+        assert_eq!(state.staged_code(&context.caller, &hash).unwrap().data, init_code);
+        assert!(!state.get_storage(&bytecode_staging_address(), &staging_slot(&context.caller, &hash, 1)).is_zero());
+
+        // Other senders can't touch the upload
+        let mut other = context.clone();
+        other.caller = Address::from_hex("0x0000000000000000000000000000000000000099").unwrap();
+        assert!(execute_staging(&call(STAGING_CHUNK, &[0]), other, &mut state).is_err());
+
+        let addr = execute_staging(&call(STAGING_INSTALL, &[]), context.clone(), &mut state)
+            .unwrap()
+            .deployed
+            .unwrap();
+        assert_eq!(state.get_code(&addr), runtime_code);
+        assert!(state.staged_code(&context.caller, &hash).is_none());
+        assert!(state.get_account(&bytecode_staging_address()).storage.is_empty());
+
+        // Chunks are charged per byte within the gas limit
+        execute_staging(&call(STAGING_BEGIN, &(init_code.len() as u64).to_be_bytes()), context.clone(), &mut state).unwrap();
+        let result = execute_staging(&call(STAGING_CHUNK, &init_code[..8]), context.clone(), &mut state).unwrap();
+        assert_eq!(result.gas_used, 8 * GAS_STAGING_BYTE);
+        let mut starved = context.clone();
+        starved.gas_limit = 7 * GAS_STAGING_BYTE;
+        assert_eq!(
+            execute_staging(&call(STAGING_CHUNK, &init_code[8..16]), starved, &mut state),
+            Err(EvmError::OutOfGas)
+        );
+
+        // Each sender has a bounded number of uploads in progress
+        for i in 1..MAX_STAGED_UPLOADS {
+            let mut begin = vec![STAGING_BEGIN];
+            begin.extend_from_slice(keccak256(&i.to_be_bytes()).as_bytes());
+            begin.extend_from_slice(&32u64.to_be_bytes());
+            execute_staging(&begin, context.clone(), &mut state).unwrap();
+        }
+        let mut begin = vec![STAGING_BEGIN];
+        begin.extend_from_slice(H256::zero().as_bytes());
+        begin.extend_from_slice(&32u64.to_be_bytes());
+        assert!(execute_staging(&begin, context.clone(), &mut state).is_err());
+        // Restarting an upload doesn't take another one
+        execute_staging(&call(STAGING_BEGIN, &(init_code.len() as u64).to_be_bytes()), context.clone(), &mut state).unwrap();
+        assert!(state.staged_code(&context.caller, &hash).unwrap().data.is_empty());
+
+        // Oversized uploads are rejected up front
+        let too_big = (MAX_STAGED_CODE_SIZE as u64 + 1).to_be_bytes();
+        assert_eq!(
+            execute_staging(&call(STAGING_BEGIN, &too_big), context, &mut state),
+            Err(EvmError::CodeSizeExceeded)
+        );
+    }
+
+    #[test]
+    fn test_faucet_rate_limits_per_recipient_and_caller() {
+        let config = FaucetConfig {
+            amount: U256::from_u64(1_000),
+            window_secs: 60,
+        };
+        let mut context = EvmContext::default();
+        context.caller = Address::from_hex("0x1234567890123456789012345678901234567890").unwrap();
+        context.timestamp = 1_000;
+        let other = Address::from_hex("0x0000000000000000000000000000000000000099").unwrap();
+        let mut state = EvmState::new();
+
+        let grant = execute_faucet(&[FAUCET_REQUEST], &context, &mut state, &config).unwrap();
+        assert_eq!(grant.recipient, context.caller);
+        assert_eq!(grant.next_grant_at, 1_060);
+        assert_eq!(state.get_balance(&context.caller), U256::from_u64(1_000));
+        assert_eq!(state.faucet_last_grant(&context.caller), Some(1_000));
+        assert_eq!(state.balance_events()[0].reason, BalanceChangeReason::Faucet);
+
+        // A second request inside the window is refused, for any sender
+        context.timestamp = 1_059;
+        let mut request = vec![FAUCET_REQUEST];
+        request.extend_from_slice(context.caller.as_bytes());
+        let mut sender = context.clone();
+        sender.caller = other;
+        assert_eq!(
+            execute_faucet(&request, &sender, &mut state, &config),
+            Err(EvmError::FaucetRateLimited { next_grant_at: 1_060 })
+        );
+
+        // Other recipients have their own window
+        execute_faucet(&[FAUCET_REQUEST], &sender, &mut state, &config).unwrap();
+        assert_eq!(state.get_balance(&other), U256::from_u64(1_000));
+        assert_eq!(state.faucet_last_request(&other), Some(1_059));
+
+        // but a caller gets one grant per window, whoever it is for
+        let mut fresh = vec![FAUCET_REQUEST];
+        fresh.extend_from_slice(&[0x42; 20]);
+        assert_eq!(
+            execute_faucet(&fresh, &sender, &mut state, &config),
+            Err(EvmError::FaucetRateLimited { next_grant_at: 1_119 })
+        );
+
+        context.timestamp = 1_060;
+        execute_faucet(&[FAUCET_REQUEST], &context, &mut state, &config).unwrap();
+        assert_eq!(state.get_balance(&context.caller), U256::from_u64(2_000));
+
+        assert!(execute_faucet(&[], &context, &mut state, &config).is_err());
+        assert!(execute_faucet(&[0x02], &context, &mut state, &config).is_err());
+        assert!(execute_faucet(&[FAUCET_REQUEST, 1, 2], &context, &mut state, &config).is_err());
+    }
+
+    /// Code that writes `level || message` through the contract log host
+    /// call with `call_op`, then returns the call's status word (or
+    /// reverts).
+    fn contract_log_code(
+        call_op: u8,
+        level: ContractLogLevel,
+        message: &[u8],
+        revert: bool,
+    ) -> Vec<u8> {
+        let data = ContractLog::encode_call(level, message);
+        let mut code = vec![opcode::PUSH1 + data.len() as u8 - 1];
+        code.extend_from_slice(&data);
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::MSTORE]);
+        // ret size and offset, args size and offset
+        let len = data.len() as u8;
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::PUSH1, 0x00]);
+        code.extend_from_slice(&[opcode::PUSH1, len, opcode::PUSH1, 32 - len]);
+        if call_op == opcode::CALL {
+            code.extend_from_slice(&[opcode::PUSH1, 0x00]);
+        }
+        code.extend_from_slice(&[opcode::PUSH1 + 1, 0x01, 0x09]);
+        code.extend_from_slice(&[opcode::PUSH1 + 1, 0xff, 0xff, call_op]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::MSTORE]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x20, opcode::PUSH1, 0x00]);
+        code.push(if revert { opcode::REVERT } else { opcode::RETURN });
+        code
+    }
+
+    #[test]
+    fn test_contract_logs() {
+        let mut context = EvmContext::default();
+        context.address = Address::from_hex("0x0000000000000000000000000000000000000042").unwrap();
+        let mut state = EvmState::new().with_feature_gates(Arc::new(FeatureGates::all()));
+
+        let code = contract_log_code(opcode::CALL, ContractLogLevel::Info, b"hi", false);
+        let result = execute(&code, context.clone(), &mut state);
+        assert!(result.success);
+        assert_eq!(result.output[31], 1);
+        assert!(result.logs.is_empty());
+        assert_eq!(
+            result.contract_logs.entries,
+            vec![ContractLog {
+                address: context.address,
+                level: ContractLogLevel::Info,
+                message: b"hi".to_vec(),
+            }]
+        );
+
+        // Allowed in static calls, and kept when the transaction reverts
+        let code = contract_log_code(opcode::STATICCALL, ContractLogLevel::Error, b"bad", true);
+        let result = execute(&code, context.clone(), &mut state);
+        assert!(!result.success);
+        assert_eq!(result.output[31], 1);
+        assert_eq!(result.contract_logs.entries[0].message, b"bad".to_vec());
+        assert_eq!(result.contract_logs.entries[0].level, ContractLogLevel::Error);
+
+        // Logs of a called contract follow the caller's
+        let callee = Address::from_hex("0x0000000000000000000000000000000000000043").unwrap();
+        let inner = contract_log_code(opcode::CALL, ContractLogLevel::Debug, b"inner", false);
+        state.set_code(&callee, inner);
+        let mut code = [opcode::PUSH1, 0x00].repeat(5);
+        code.push(opcode::PUSH1 + 19);
+        code.extend_from_slice(callee.as_bytes());
+        code.extend_from_slice(&[opcode::PUSH1 + 1, 0xff, 0xff, opcode::CALL, opcode::STOP]);
+        let result = execute(&code, context, &mut state);
+        assert!(result.success);
+        assert_eq!(result.contract_logs.entries[0].address, callee);
+        assert_eq!(result.contract_logs.entries[0].message, b"inner".to_vec());
+
+        // Unknown levels are refused
+        assert!(ContractLog::decode(callee, &[4, b'x']).is_none());
+        assert!(ContractLog::decode(callee, &[]).is_none());
+    }
+
+    /// Code that calls the index registry with `data` (at most 32 bytes)
+    /// through `call_op`, then returns the call's status word.
+    fn index_call_code(call_op: u8, data: &[u8]) -> Vec<u8> {
+        let len = data.len() as u8;
+        let mut code = vec![opcode::PUSH1 + len - 1];
+        code.extend_from_slice(data);
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::MSTORE]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::PUSH1, 0x00]);
+        code.extend_from_slice(&[opcode::PUSH1, len, opcode::PUSH1, 32 - len]);
+        if call_op == opcode::CALL {
+            code.extend_from_slice(&[opcode::PUSH1, 0x00]);
+        }
+        code.extend_from_slice(&[opcode::PUSH1 + 1, 0x01, 0x08]);
+        code.extend_from_slice(&[opcode::PUSH1 + 2, 0x01, 0x00, 0x00, call_op]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::MSTORE]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x20, opcode::PUSH1, 0x00, opcode::RETURN]);
+        code
+    }
+
+    #[test]
+    fn test_index_calls_are_logged_for_the_calling_contract() {
+        let mut context = EvmContext::default();
+        context.caller = Address::from([0x11; 20]);
+        context.address = Address::from([0x42; 20]);
+        let data = b"\x02by_age";
+        let code = index_call_code(opcode::CALL, data);
+
+        // Before the feature activates the registry is a plain account
+        let mut state = EvmState::new();
+        let result = execute(&code, context.clone(), &mut state);
+        assert!(result.success);
+        assert!(result.logs.is_empty());
+
+        let mut state = EvmState::new().with_feature_gates(Arc::new(FeatureGates::all()));
+        let result = execute(&code, context.clone(), &mut state);
+        assert!(result.success);
+        assert_eq!(result.output[31], 1);
+        assert_eq!(result.logs.len(), 1);
+        assert_eq!(decode_index_call(&result.logs[0]), Some((context.address, &data[..])));
+
+        // A contract's own LOG can't pose as a registry call
+        let forged = Log {
+            address: context.address,
+            ..result.logs[0].clone()
+        };
+        assert_eq!(decode_index_call(&forged), None);
+
+        // Calls through a proxy name the proxy's callee, not the sender
+        let callee = Address::from([0x43; 20]);
+        state.set_code(&callee, code.clone());
+        let mut proxy = [opcode::PUSH1, 0x00].repeat(5);
+        proxy.push(opcode::PUSH1 + 19);
+        proxy.extend_from_slice(callee.as_bytes());
+        proxy.extend_from_slice(&[opcode::PUSH1 + 2, 0x01, 0x00, 0x00, opcode::CALL, opcode::STOP]);
+        let result = execute(&proxy, context.clone(), &mut state);
+        assert!(result.success);
+        assert_eq!(decode_index_call(&result.logs[0]).unwrap().0, callee);
+
+        // Static calls can't change indexes
+        let code = index_call_code(opcode::STATICCALL, data);
+        let result = execute(&code, context, &mut state);
+        assert_eq!(result.output[31], 0);
+        assert!(result.logs.is_empty());
+    }
+
+    #[test]
+    fn test_contract_logs_are_capped() {
+        let address = Address::zero();
+        let log = |len: usize| ContractLog {
+            address,
+            level: ContractLogLevel::Debug,
+            message: vec![b'x'; len],
+        };
+        let mut logs = ContractLogs::default();
+        logs.push(log(MAX_CONTRACT_LOG_BYTES - 10));
+        logs.push(log(20));
+        logs.push(log(5));
+        assert_eq!(logs.entries.len(), 1);
+        assert_eq!(logs.dropped, 2);
+
+        let mut outer = ContractLogs::default();
+        outer.push(log(11));
+        outer.append(&mut logs);
+        assert!(logs.is_empty());
+        assert_eq!(outer.entries.len(), 1);
+        assert_eq!(outer.dropped, 3);
+    }
+
+    #[test]
+    fn test_features_inactive_before_activation() {
+        let mut context = EvmContext::default();
+        context.address = Address::from_hex("0x0000000000000000000000000000000000000042").unwrap();
+        context.block_number = 9;
+        let gates = FeatureGates::new([
+            (FEATURE_CONTRACT_LOG.to_string(), 10),
+            (FEATURE_BYTECODE_STAGING.to_string(), 10),
+        ]);
+        let mut state = EvmState::new().with_feature_gates(Arc::new(gates));
+
+        // Before activation the log address is a plain (empty) account,
+        // costing the same gas as a call to any other one
+        let code = contract_log_code(opcode::CALL, ContractLogLevel::Info, b"hi", false);
+        let result = execute(&code, context.clone(), &mut state);
+        assert!(result.success);
+        assert!(result.contract_logs.is_empty());
+        let at = code.windows(3).position(|w| w == [opcode::PUSH1 + 1, 0x01, 0x09]).unwrap();
+        let mut plain = code.clone();
+        plain[at + 2] = 0xff;
+        let plain = execute(&plain, context.clone(), &mut state);
+        assert_eq!((result.gas_used, &result.output), (plain.gas_used, &plain.output));
+        assert!(matches!(
+            execute_staging(&[0u8; 33], context.clone(), &mut state),
+            Err(EvmError::FeatureInactive(f)) if f == FEATURE_BYTECODE_STAGING
+        ));
+
+        context.block_number = 10;
+        let result = execute(&code, context.clone(), &mut state);
+        assert_eq!(result.contract_logs.entries.len(), 1);
+        assert_ne!(result.gas_used, plain.gas_used);
+        assert!(!state.is_feature_active(FEATURE_STORAGE_SCAN, u64::MAX));
+    }
+
+    /// Code making a storage scan host call for `scan` into memory
+    /// `0..ret_size`, leaving the call's success flag on the stack.
+    fn storage_scan_call(scan: &StorageScan, ret_size: u8) -> Vec<u8> {
+        let mut code = vec![opcode::PUSH1 + 1];
+        code.extend_from_slice(&scan.limit.to_be_bytes());
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::MSTORE]);
+        if let Some(cursor) = &scan.cursor {
+            code.push(opcode::PUSH1 + 31);
+            code.extend_from_slice(cursor.as_bytes());
+            code.extend_from_slice(&[opcode::PUSH1, 0x20, opcode::MSTORE]);
+        }
+        // ret size and offset, args size and offset
+        let len = scan.encode_call().len() as u8;
+        code.extend_from_slice(&[opcode::PUSH1, ret_size, opcode::PUSH1, 0x00]);
+        code.extend_from_slice(&[opcode::PUSH1, len, opcode::PUSH1, 30]);
+        code.extend_from_slice(&[opcode::PUSH1 + 1, 0x01, 0x0C]);
+        code.extend_from_slice(&[opcode::PUSH1 + 1, 0xff, 0xff, opcode::STATICCALL]);
+        code
+    }
+
+    /// Code returning memory `0..size`.
+    fn return_memory(size: u8) -> [u8; 5] {
+        [opcode::PUSH1, size, opcode::PUSH1, 0x00, opcode::RETURN]
+    }
+
+    /// Code returning the word on top of the stack.
+    const RETURN_TOP: [u8; 8] = [
+        opcode::PUSH1, 0x00, opcode::MSTORE,
+        opcode::PUSH1, 0x20, opcode::PUSH1, 0x00, opcode::RETURN,
+    ];
+
+    #[test]
+    fn test_scan_storage() {
+        let contract = Address::from_slice(&[0x42; 20]).unwrap();
+        let slot = |n: u8| H256::from([n; 32]);
+        let mut state = EvmState::new();
+        for n in [5, 1, 4, 2, 3] {
+            state.set_storage(&contract, slot(n), slot(n + 100));
+        }
+        // Cleared slots are dropped, not scanned
+        state.set_storage(&contract, slot(9), H256::zero());
+        state.set_storage(&contract, slot(6), slot(106));
+        state.set_storage(&contract, slot(6), H256::zero());
+        assert_eq!(state.get_account(&contract).storage.len(), 5);
+
+        let first = StorageScan::first(3);
+        let page = state.scan_storage(&contract, None, 3);
+        assert_eq!(
+            page.entries,
+            vec![(slot(1), slot(101)), (slot(2), slot(102)), (slot(3), slot(103))]
+        );
+        assert!(page.more);
+        assert_eq!(page.next_cursor(), Some(slot(3)));
+        assert_eq!(StoragePage::decode(&page.encode()), Some(page.clone()));
+
+        let next = first.after(&page).unwrap();
+        assert_eq!(StorageScan::decode(&next.encode_call()), Some(next));
+        let page = state.scan_storage(&contract, next.cursor.as_ref(), 3);
+        assert_eq!(page.entries, vec![(slot(4), slot(104)), (slot(5), slot(105))]);
+        assert!(!page.more);
+        assert!(first.after(&page).is_none());
+
+        assert_eq!(state.scan_storage(&Address::zero(), None, 3), StoragePage::default());
+        assert!(StorageScan::decode(&[0, 1, 2]).is_none());
+        assert!(StoragePage::decode(&[2; 32]).is_none());
+    }
+
+    #[test]
+    fn test_storage_scan_host_call() {
+        let mut context = EvmContext::default();
+        context.address = Address::from_slice(&[0x42; 20]).unwrap();
+        let slot = |n: u8| H256::from([n; 32]);
+        let mut state = EvmState::new().with_feature_gates(Arc::new(FeatureGates::all()));
+        for n in 1..=5 {
+            state.set_storage(&context.address, slot(n), slot(n + 100));
+        }
+
+        // Pages resume from the cursor and are charged per page and entry
+        let first = StorageScan::first(3);
+        let mut code = storage_scan_call(&first, 224);
+        code.extend_from_slice(&return_memory(224));
+        let result = execute(&code, context.clone(), &mut state);
+        assert!(result.success);
+        assert!(result.gas_used > GAS_CALL + GAS_STORAGE_SCAN_PAGE + 3 * GAS_SLOAD);
+        let page = StoragePage::decode(&result.output).unwrap();
+        assert_eq!(page.entries.len(), 3);
+        assert_eq!(page.next_cursor(), Some(slot(3)));
+
+        let mut code = storage_scan_call(&first.after(&page).unwrap(), 160);
+        code.extend_from_slice(&return_memory(160));
+        let result = execute(&code, context.clone(), &mut state);
+        let page = StoragePage::decode(&result.output).unwrap();
+        assert_eq!(page.entries, vec![(slot(4), slot(104)), (slot(5), slot(105))]);
+        assert!(!page.more);
+
+        // Oversized pages are refused
+        let mut code = storage_scan_call(&StorageScan::first(MAX_STORAGE_SCAN_PAGE as u16 + 1), 0);
+        code.extend_from_slice(&RETURN_TOP);
+        assert_eq!(execute(&code, context.clone(), &mut state).output[31], 0);
+
+        // The page budget is shared by every frame of the transaction
+        let callee = Address::from_slice(&[0x43; 20]).unwrap();
+        let mut callee_code = storage_scan_call(&StorageScan::first(1), 0);
+        callee_code.extend_from_slice(&RETURN_TOP);
+        state.set_code(&callee, callee_code);
+        let call_callee = |scans: usize| {
+            let mut code = storage_scan_call(&StorageScan::first(1), 0).repeat(scans);
+            code.extend_from_slice(&[opcode::PUSH1, 0x20, opcode::PUSH1, 0x00]);
+            code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::PUSH1, 0x00]);
+            code.push(opcode::PUSH1 + 19);
+            code.extend_from_slice(callee.as_bytes());
+            code.extend_from_slice(&[opcode::PUSH1 + 2, 0x0f, 0xff, 0xff, opcode::STATICCALL]);
+            code.extend_from_slice(&return_memory(32));
+            code
+        };
+        let code = call_callee(MAX_STORAGE_SCAN_PAGES - 1);
+        assert_eq!(execute(&code, context.clone(), &mut state).output[31], 1);
+        let code = call_callee(MAX_STORAGE_SCAN_PAGES);
+        let result = execute(&code, context.clone(), &mut state);
+        assert!(result.success);
+        assert_eq!(result.output[31], 0);
+
+        // Isolated contracts can't scan their raw slots
+        let (mut state, _) = isolated_state(&[context.address]);
+        state.set_feature_gates(Arc::new(FeatureGates::all()));
+        let mut code = storage_scan_call(&first, 0);
+        code.extend_from_slice(&RETURN_TOP);
+        assert_eq!(execute(&code, context, &mut state).output[31], 0);
+    }
+
+    fn isolated_state(contracts: &[Address]) -> (EvmState, [Address; 4]) {
+        let addr = |n: u8| Address::from_slice(&[n; 20]).unwrap();
+        let (admin_a, alice, bob, outsider) = (addr(0xa0), addr(0xa1), addr(0xb1), addr(0xcc));
+        let isolation = OrgIsolation {
+            contracts: contracts.iter().copied().collect(),
+            members: [(alice, "a".to_string()), (bob, "b".to_string())].into(),
+            admins: [(admin_a, "a".to_string())].into(),
+        };
+        let state = EvmState::new().with_org_isolation(Some(Arc::new(isolation)));
+        (state, [admin_a, alice, bob, outsider])
+    }
+
+    #[test]
+    fn test_org_isolated_storage() {
+        let contract = Address::from_slice(&[0x42; 20]).unwrap();
+        let (mut state, [_, alice, bob, outsider]) = isolated_state(&[contract]);
+        // Stores the first calldata word in slot 0
+        let code = vec![
+            opcode::PUSH1, 0x00, opcode::CALLDATALOAD,
+            opcode::PUSH1, 0x00, opcode::SSTORE,
+            opcode::STOP,
+        ];
+        state.set_code(&contract, code);
+        let word = |n: u8| {
+            let mut word = [0u8; 32];
+            word[31] = n;
+            word
+        };
+
+        let mut context = EvmContext::default();
+        for (origin, n) in [(alice, 1), (bob, 2)] {
+            context.origin = origin;
+            assert!(call_contract(contract, &word(n), context.clone(), &mut state).success);
+        }
+        let slot = H256::zero();
+        assert_eq!(state.get_storage(&contract, &org_slot("a", &slot)), H256::from(word(1)));
+        assert_eq!(state.get_storage(&contract, &org_slot("b", &slot)), H256::from(word(2)));
+        assert!(state.get_storage(&contract, &slot).is_zero());
+
+        context.origin = outsider;
+        let result = call_contract(contract, &word(3), context, &mut state);
+        assert_eq!(result.error, Some(EvmError::NotOrgMember(outsider)));
+    }
+
+    #[test]
+    fn test_org_grants() {
+        let contract = Address::from_slice(&[0x42; 20]).unwrap();
+        let (mut state, [admin_a, alice, bob, _]) = isolated_state(&[contract]);
+        state.set_feature_gates(Arc::new(FeatureGates::all()));
+        state.set_storage(&contract, org_slot("a", &H256::zero()), H256::from([7u8; 32]));
+
+        // Reads slot 0 of org "a" through the grants host call
+        let code = vec![
+            opcode::PUSH1, ORG_READ, opcode::PUSH1, 0x00, opcode::MSTORE8,
+            opcode::PUSH1, b'a', opcode::PUSH1, 33, opcode::MSTORE8,
+            opcode::PUSH1, 32, opcode::PUSH1, 64, opcode::PUSH1, 34, opcode::PUSH1, 0x00,
+            opcode::PUSH1, 0x00, opcode::PUSH1 + 1, 0x01, 0x0A, opcode::PUSH1 + 1, 0xff, 0xff,
+            opcode::CALL,
+            opcode::PUSH1, 32, opcode::PUSH1, 64, opcode::RETURN,
+        ];
+        let read = |state: &mut EvmState, origin: Address, code: &[u8]| {
+            state.set_code(&contract, code.to_vec());
+            let mut context = EvmContext::default();
+            context.origin = origin;
+            call_contract(contract, &[], context, state).output
+        };
+        assert_eq!(read(&mut state, alice, &code), vec![7u8; 32]);
+        assert_eq!(read(&mut state, bob, &code), vec![0u8; 32]);
+
+        let mut grant = vec![ORG_GRANT];
+        grant.extend_from_slice(contract.as_bytes());
+        grant.extend_from_slice(b"b");
+        let mut context = EvmContext::default();
+        context.caller = alice;
+        assert!(execute_org_grants(&grant, &context, &mut state).is_err());
+        context.caller = admin_a;
+        let made = execute_org_grants(&grant, &context, &mut state).unwrap();
+        assert_eq!((made.owner.as_str(), made.grantee.as_str()), ("a", "b"));
+        assert!(state.has_org_grant(&contract, "a", "b"));
+        assert!(!state.has_org_grant(&contract, "b", "a"));
+        assert_eq!(read(&mut state, bob, &code), vec![7u8; 32]);
+
+        grant[0] = ORG_REVOKE;
+        assert!(!execute_org_grants(&grant, &context, &mut state).unwrap().granted);
+        assert_eq!(read(&mut state, bob, &code), vec![0u8; 32]);
+
+        // Only isolated contracts have namespaces to share
+        grant[0] = ORG_GRANT;
+        grant[1..21].copy_from_slice(&[0x43; 20]);
+        assert!(execute_org_grants(&grant, &context, &mut state).is_err());
+    }
+
+    #[test]
+    fn test_method_permissions_manifest() {
+        let permissions = MethodPermissions {
+            methods: [
+                ([1, 2, 3, 4], MethodRule { role: MethodRole::Member, orgs: vec!["a".into()] }),
+                ([5, 6, 7, 8], MethodRule { role: MethodRole::Admin, orgs: Vec::new() }),
+            ]
+            .into(),
+        };
+        let encoded = permissions.encode().unwrap();
+        assert_eq!(MethodPermissions::decode(&encoded), Some(permissions));
+        assert_eq!(MethodPermissions::decode(&[0]), Some(MethodPermissions::default()));
+
+        // Truncated, trailing bytes, unknown role, repeated selector
+        assert!(MethodPermissions::decode(&encoded[..encoded.len() - 1]).is_none());
+        assert!(MethodPermissions::decode(&[encoded.as_slice(), &[0]].concat()).is_none());
+        assert!(MethodPermissions::decode(&[1, 1, 2, 3, 4, 2, 0]).is_none());
+        assert!(MethodPermissions::decode(&[2, 1, 2, 3, 4, 0, 0, 1, 2, 3, 4, 1, 0]).is_none());
+    }
+
+    #[test]
+    fn test_method_permissions() {
+        let addr = |n: u8| Address::from_slice(&[n; 20]).unwrap();
+        let (admin_a, alice, bob, outsider) = (addr(0xa0), addr(0xa1), addr(0xb1), addr(0xcc));
+        let admin_b = addr(0xb0);
+        let members = OrgMembers {
+            members: [(alice, "a".to_string()), (bob, "b".to_string())].into(),
+            admins: [(admin_a, "a".to_string()), (admin_b, "b".to_string())].into(),
+        };
+        let mut state = EvmState::new().with_org_members(Some(Arc::new(members)));
+
+        // Install a contract whose runtime code is STOP, with method
+        // 0x01020304 open to org "a" and 0x05060708 to admins
+        let manifest = MethodPermissions {
+            methods: [
+                ([1, 2, 3, 4], MethodRule { role: MethodRole::Member, orgs: vec!["a".into()] }),
+                ([5, 6, 7, 8], MethodRule { role: MethodRole::Admin, orgs: Vec::new() }),
+            ]
+            .into(),
+        };
+        let manifest = manifest.encode().unwrap();
+        let mut install = vec![ACL_INSTALL];
+        install.extend_from_slice(&(manifest.len() as u16).to_be_bytes());
+        install.extend_from_slice(&manifest);
+        install.extend_from_slice(&[opcode::PUSH1, 0x01, opcode::PUSH1, 0x00, opcode::RETURN]);
+        let mut context = EvmContext::default();
+        context.caller = bob;
+        let contract = execute_contract_acl(&install, context.clone(), &mut state).unwrap();
+        assert_eq!(state.get_code(&contract), vec![opcode::STOP]);
+        assert_eq!(state.installer_of(&contract), Some(&bob));
+
+        let call = |state: &mut EvmState, origin: Address, selector: [u8; 4]| {
+            let mut context = EvmContext::default();
+            context.origin = origin;
+            call_contract(contract, &selector, context, state).error
+        };
+        assert_eq!(call(&mut state, alice, [1, 2, 3, 4]), None);
+        assert_eq!(call(&mut state, admin_a, [5, 6, 7, 8]), None);
+        assert_eq!(call(&mut state, outsider, [9, 9, 9, 9]), None);
+        let denied = Some(EvmError::MethodNotPermitted { contract, selector: [1, 2, 3, 4] });
+        assert_eq!(call(&mut state, bob, [1, 2, 3, 4]), denied);
+        assert!(call(&mut state, alice, [5, 6, 7, 8]).is_some());
+
+        // A proxy can't call the method for an origin outside org "a"
+        let proxy = addr(0x99);
+        let mut code = vec![opcode::PUSH1 + 3, 1, 2, 3, 4, opcode::PUSH1, 224, opcode::SHL];
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::MSTORE]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::PUSH1, 0x00]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x04, opcode::PUSH1, 0x00, opcode::PUSH1, 0x00]);
+        code.push(opcode::PUSH1 + 19);
+        code.extend_from_slice(contract.as_bytes());
+        code.extend_from_slice(&[opcode::GAS, opcode::CALL]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::MSTORE]);
+        code.extend_from_slice(&[opcode::PUSH1, 32, opcode::PUSH1, 0x00, opcode::RETURN]);
+        state.set_code(&proxy, code);
+        let proxied = |state: &mut EvmState, origin: Address| {
+            let mut context = EvmContext::default();
+            context.origin = origin;
+            call_contract(proxy, &[], context, state).output[31]
+        };
+        assert_eq!(proxied(&mut state, alice), 1);
+        assert_eq!(proxied(&mut state, bob), 0);
+
+        // Only the installer and its org's admins can change the manifest,
+        // whatever the origin; an empty one lifts it
+        let mut set = vec![ACL_SET];
+        set.extend_from_slice(contract.as_bytes());
+        set.push(0);
+        context.origin = bob;
+        for caller in [outsider, admin_a, alice] {
+            context.caller = caller;
+            assert!(execute_contract_acl(&set, context.clone(), &mut state).is_err());
+        }
+        assert!(state.may_manage_contract(&contract, &bob));
+        context.caller = admin_b;
+        execute_contract_acl(&set, context.clone(), &mut state).unwrap();
+        assert!(state.method_permissions(&contract).is_none());
+        assert_eq!(call(&mut state, bob, [1, 2, 3, 4]), None);
+
+        // An upgrade can carry a new manifest
+        let admin_only = MethodPermissions {
+            methods: [([1, 2, 3, 4], MethodRule { role: MethodRole::Admin, orgs: Vec::new() })]
+                .into(),
+        };
+        upgrade_contract(contract, vec![opcode::STOP], Some(admin_only), None, context, &mut state)
+            .unwrap();
+        assert!(call(&mut state, alice, [1, 2, 3, 4]).is_some());
+        assert_eq!(call(&mut state, admin_a, [1, 2, 3, 4]), None);
+    }
+
+    #[test]
+    fn test_acl_upgrade() {
+        let installer = Address::from_slice(&[0xa1; 20]).unwrap();
+        let outsider = Address::from_slice(&[0xee; 20]).unwrap();
+        let mut state = EvmState::new();
+        let mut context = EvmContext::default();
+        context.caller = installer;
+        context.gas_limit = 1_000_000;
+        // Empty manifest, init code returning the runtime code 0x00
+        let mut install = vec![ACL_INSTALL, 0, 1, 0];
+        install.extend_from_slice(&[0x60, 0x00, 0x60, 0x00, 0x53, 0x60, 0x01, 0x60, 0x00, 0xf3]);
+        let contract = execute_contract_acl(&install, context.clone(), &mut state).unwrap();
+
+        // v2 with a migration writing slot 0 = 7
+        let v2 = [opcode::PUSH1, 0x07, opcode::PUSH1, 0x00, opcode::SSTORE];
+        let mut upgrade = vec![ACL_UPGRADE];
+        upgrade.extend_from_slice(contract.as_bytes());
+        upgrade.extend_from_slice(&(v2.len() as u32).to_be_bytes());
+        upgrade.extend_from_slice(&v2);
+        upgrade.push(0x01);
+
+        context.caller = outsider;
+        assert!(execute_contract_acl(&upgrade, context.clone(), &mut state).is_err());
+        assert_eq!(state.get_code(&contract), vec![0x00]);
+
+        context.caller = installer;
+        execute_contract_acl(&upgrade, context.clone(), &mut state).unwrap();
+        assert_eq!(state.get_code(&contract), v2);
+        assert_eq!(state.get_storage(&contract, &H256::zero()).as_bytes()[31], 7);
+
+        // Contracts deployed without the ACL contract have no installer
+        let plain = Address::from_slice(&[0xcc; 20]).unwrap();
+        state.set_code(&plain, vec![opcode::STOP]);
+        upgrade[1..21].copy_from_slice(plain.as_bytes());
+        assert!(execute_contract_acl(&upgrade, context, &mut state).is_err());
+    }
+
+    #[test]
+    fn test_contract_install() {
+        let deployer = Address::from_slice(&[0xd1; 20]).unwrap();
+        let mut state = EvmState::new();
+        state.set_balance(&deployer, U256::from_u64(1_000));
+        let mut context = EvmContext::default();
+        context.caller = deployer;
+        // Runtime code is STOP; the argument word after the init code is
+        // never executed
+        let code = vec![opcode::PUSH1, 0x01, opcode::PUSH1, 0x00, opcode::RETURN];
+        let args = [7u8; 32];
+
+        let plain = ContractInstall::new(code.clone())
+            .with_init_args(&args)
+            .with_value(U256::from_u64(5));
+        assert_eq!(plain.to(), None);
+        assert_eq!(plain.calldata().unwrap(), [code.as_slice(), &args].concat());
+        let expected = create_address(&deployer, 0);
+        assert_eq!(plain.execute(context.clone(), &mut state).unwrap(), expected);
+        assert_eq!(state.get_balance(&expected), U256::from_u64(5));
+        assert!(state.method_permissions(&expected).is_none());
+
+        let permissions = MethodPermissions {
+            methods: [([1, 2, 3, 4], MethodRule { role: MethodRole::Admin, orgs: Vec::new() })]
+                .into(),
+        };
+        let acl = ContractInstall::new(code).with_permissions(permissions.clone());
+        assert_eq!(acl.to(), Some(contract_acl_address()));
+        assert_eq!(acl.calldata().unwrap()[0], ACL_INSTALL);
+        let contract = acl.execute(context, &mut state).unwrap();
+        assert_eq!(contract, create_address(&deployer, 1));
+        assert_eq!(state.method_permissions(&contract), Some(&permissions));
+
+        // Out of gas before the init code returns
+        let starved = ContractInstall::new(vec![opcode::PUSH1, 0x01]).with_gas_limit(1);
+        assert!(starved.execute(EvmContext::default(), &mut state).is_err());
+    }
+
+    #[test]
+    fn test_paused_contract() {
+        let addr = |n: u8| Address::from_slice(&[n; 20]).unwrap();
+        let (admin, member, outsider, proxy) = (addr(0xa0), addr(0xa1), addr(0xcc), addr(0x99));
+        let members = OrgMembers {
+            members: [(member, "a".to_string())].into(),
+            admins: [(admin, "a".to_string())].into(),
+        };
+        let mut state = EvmState::new().with_org_members(Some(Arc::new(members)));
+        let mut install = vec![ACL_INSTALL, 0, 1, 0];
+        install.extend_from_slice(&[opcode::PUSH1, 0x01, opcode::PUSH1, 0x00, opcode::RETURN]);
+        let mut context = EvmContext::default();
+        context.caller = member;
+        let contract = execute_contract_acl(&install, context.clone(), &mut state).unwrap();
+        // Calls the contract and returns whether the call succeeded
+        let mut code = vec![opcode::PUSH1, 0x00, opcode::DUP1, opcode::DUP1, opcode::DUP1];
+        code.extend_from_slice(&[opcode::DUP1, opcode::PUSH1 + 19]);
+        code.extend_from_slice(contract.as_bytes());
+        code.extend_from_slice(&[opcode::GAS, opcode::CALL]);
+        code.extend_from_slice(&[opcode::PUSH1, 0x00, opcode::MSTORE]);
+        code.extend_from_slice(&[opcode::PUSH1, 32, opcode::PUSH1, 0x00, opcode::RETURN]);
+        state.set_code(&proxy, code);
+
+        let mut pause = vec![ACL_PAUSE];
+        pause.extend_from_slice(contract.as_bytes());
+        // The installer needs its org's admin key
+        for caller in [outsider, member] {
+            context.caller = caller;
+            assert!(execute_contract_acl(&pause, context.clone(), &mut state).is_err());
+        }
+        context.caller = admin;
+        execute_contract_acl(&pause, context.clone(), &mut state).unwrap();
+        assert!(state.is_paused(&contract));
+
+        // Transactions are rejected, directly or through another contract;
+        // read-only calls still run
+        let call = |state: &mut EvmState, to: Address, is_static: bool| {
+            let mut context = EvmContext::default();
+            context.is_static = is_static;
+            call_contract(to, &[], context, state)
+        };
+        let result = call(&mut state, contract, false);
+        assert_eq!(result.error, Some(EvmError::ContractPaused(contract)));
+        assert!(call(&mut state, contract, true).success);
+        assert_eq!(call(&mut state, proxy, false).output[31], 0);
+
+        pause[0] = ACL_RESUME;
+        execute_contract_acl(&pause, context, &mut state).unwrap();
+        assert!(call(&mut state, contract, false).success);
+        assert_eq!(call(&mut state, proxy, false).output[31], 1);
+    }
+
     #[test]
     fn test_bitwise_operations() {
         // Test AND: 0xFF AND 0x0F = 0x0F
@@ -0,0 +1,268 @@
+//! BachLedger Message Bus
+//!
+//! In-process publish/subscribe between node components.
+//!
+//! # Topics
+//!
+//! - `Topic::BlockCommitted`: the block, its receipts and its state changes
+//!   after every commit
+//! - `Topic::CommitReport`: a `BlockCommitReport` after every committed block
+//! - `Topic::TxRequeued`: a `TxRequeue` for each pooled transaction returned
+//!   to the pool because the block it was proposed in timed out
+//!
+//! Each topic is a bounded broadcast channel. Publishing never blocks; a
+//! subscriber that falls more than the channel capacity behind skips the
+//! oldest messages and sees `RecvError::Lagged` on its next receive.
+//!
+//! # Example
+//!
+//! ```ignore
+//! use bach_msgbus::{Message, MsgBus, Topic};
+//!
+//! let bus = MsgBus::default();
+//! let mut reports = bus.subscribe(Topic::CommitReport);
+//! bus.publish(Message::CommitReport(Arc::new(report)));
+//! let Message::CommitReport(report) = reports.recv().await?;
+//! ```
+
+#![forbid(unsafe_code)]
+
+use bach_primitives::H256;
+use bach_storage::{StateChange, TransactionReceipt};
+use bach_types::Block;
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+use tokio::sync::broadcast;
+
+mod report;
+
+pub use report::{BlockCommitReport, DagStats, PhaseTimer, PhaseTimings};
+pub use tokio::sync::broadcast::error::{RecvError, TryRecvError};
+
+/// Messages buffered per topic before slow subscribers start lagging
+pub const DEFAULT_TOPIC_CAPACITY: usize = 1024;
+
+/// A message bus topic.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum Topic {
+    /// Each committed block with its receipts
+    BlockCommitted,
+    /// Structured report for each committed block
+    CommitReport,
+    /// Each transaction deferred to a later block
+    TxRequeued,
+}
+
+/// A committed block with the receipts of its transactions.
+#[derive(Debug, Clone)]
+pub struct BlockInfo {
+    /// The committed block
+    pub block: Block,
+    /// Receipts in block order
+    pub receipts: Vec<TransactionReceipt>,
+    /// Storage slots the block changed, in commit order
+    pub changes: Vec<StateChange>,
+}
+
+/// A pooled transaction deferred to a later block: it was proposed at
+/// `height`, but consensus timed out before the block committed and the
+/// transaction went back to the pool.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TxRequeue {
+    /// Hash of the deferred transaction
+    pub tx_hash: H256,
+    /// Height the transaction was proposed at
+    pub height: u64,
+    /// Consensus rounds that timed out at that height
+    pub rounds: u32,
+    /// Times the transaction has been requeued so far, including this one
+    pub requeues: u32,
+}
+
+/// A message published on the bus.
+#[derive(Debug, Clone)]
+pub enum Message {
+    /// Published on `Topic::BlockCommitted`
+    BlockCommitted(Arc<BlockInfo>),
+    /// Published on `Topic::CommitReport`
+    CommitReport(Arc<BlockCommitReport>),
+    /// Published on `Topic::TxRequeued`
+    TxRequeued(Arc<TxRequeue>),
+}
+
+impl Message {
+    /// Returns the topic this message is published on.
+    pub fn topic(&self) -> Topic {
+        match self {
+            Message::BlockCommitted(_) => Topic::BlockCommitted,
+            Message::CommitReport(_) => Topic::CommitReport,
+            Message::TxRequeued(_) => Topic::TxRequeued,
+        }
+    }
+}
+
+/// Receives messages for one topic.
+pub type Subscriber = broadcast::Receiver<Message>;
+
+/// In-process message bus.
+#[derive(Debug)]
+pub struct MsgBus {
+    topics: RwLock<HashMap<Topic, broadcast::Sender<Message>>>,
+    capacity: usize,
+}
+
+impl MsgBus {
+    /// Creates a bus buffering `capacity` messages per topic.
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            topics: RwLock::new(HashMap::new()),
+            capacity: capacity.max(1),
+        }
+    }
+
+    /// Subscribes to a topic. Only messages published afterwards are received.
+    pub fn subscribe(&self, topic: Topic) -> Subscriber {
+        if let Some(sender) = self.topics.read().unwrap().get(&topic) {
+            return sender.subscribe();
+        }
+        self.topics
+            .write()
+            .unwrap()
+            .entry(topic)
+            .or_insert_with(|| broadcast::channel(self.capacity).0)
+            .subscribe()
+    }
+
+    /// Publishes a message and returns the number of subscribers it reached.
+    pub fn publish(&self, message: Message) -> usize {
+        let topics = self.topics.read().unwrap();
+        match topics.get(&message.topic()) {
+            Some(sender) => sender.send(message).unwrap_or(0),
+            None => 0,
+        }
+    }
+
+    /// Returns the number of live subscribers on a topic.
+    pub fn subscriber_count(&self, topic: Topic) -> usize {
+        self.topics
+            .read()
+            .unwrap()
+            .get(&topic)
+            .map(|sender| sender.receiver_count())
+            .unwrap_or(0)
+    }
+}
+
+impl Default for MsgBus {
+    fn default() -> Self {
+        Self::new(DEFAULT_TOPIC_CAPACITY)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn report(height: u64) -> Message {
+        Message::CommitReport(Arc::new(BlockCommitReport {
+            height,
+            block_hash: [0u8; 32],
+            legacy_block_hash: None,
+            tx_count: 0,
+            failed_tx_count: 0,
+            write_count: 0,
+            conflicts: 0,
+            signatures: 0,
+            dag: None,
+            phases: PhaseTimings::default(),
+        }))
+    }
+
+    fn height(message: Message) -> u64 {
+        match message {
+            Message::BlockCommitted(info) => info.block.height,
+            Message::CommitReport(report) => report.height,
+            Message::TxRequeued(requeue) => requeue.height,
+        }
+    }
+
+    #[test]
+    fn test_publish_without_subscribers() {
+        let bus = MsgBus::default();
+        assert_eq!(bus.publish(report(1)), 0);
+        assert_eq!(bus.subscriber_count(Topic::CommitReport), 0);
+    }
+
+    #[test]
+    fn test_every_subscriber_receives_in_order() {
+        let bus = MsgBus::default();
+        let mut first = bus.subscribe(Topic::CommitReport);
+        let mut second = bus.subscribe(Topic::CommitReport);
+        assert_eq!(bus.subscriber_count(Topic::CommitReport), 2);
+
+        assert_eq!(bus.publish(report(1)), 2);
+        assert_eq!(bus.publish(report(2)), 2);
+
+        for subscriber in [&mut first, &mut second] {
+            assert_eq!(height(subscriber.try_recv().unwrap()), 1);
+            assert_eq!(height(subscriber.try_recv().unwrap()), 2);
+            assert!(matches!(subscriber.try_recv(), Err(TryRecvError::Empty)));
+        }
+
+        drop(second);
+        assert_eq!(bus.publish(report(3)), 1);
+    }
+
+    #[test]
+    fn test_topics_are_independent() {
+        let bus = MsgBus::default();
+        let mut blocks = bus.subscribe(Topic::BlockCommitted);
+        let info = BlockInfo {
+            block: Block::new(4, H256::zero(), Vec::new(), 1000),
+            receipts: Vec::new(),
+            changes: Vec::new(),
+        };
+
+        assert_eq!(bus.publish(report(1)), 0);
+        assert_eq!(bus.publish(Message::BlockCommitted(Arc::new(info))), 1);
+        assert_eq!(height(blocks.try_recv().unwrap()), 4);
+        assert!(matches!(blocks.try_recv(), Err(TryRecvError::Empty)));
+
+        let mut requeues = bus.subscribe(Topic::TxRequeued);
+        let requeue = TxRequeue {
+            tx_hash: H256::zero(),
+            height: 5,
+            rounds: 3,
+            requeues: 1,
+        };
+        assert_eq!(bus.publish(Message::TxRequeued(Arc::new(requeue))), 1);
+        assert_eq!(height(requeues.try_recv().unwrap()), 5);
+        assert!(matches!(blocks.try_recv(), Err(TryRecvError::Empty)));
+    }
+
+    #[test]
+    fn test_slow_subscriber_lags() {
+        let bus = MsgBus::new(2);
+        let mut subscriber = bus.subscribe(Topic::CommitReport);
+        for h in 1..=3 {
+            bus.publish(report(h));
+        }
+
+        assert!(matches!(
+            subscriber.try_recv(),
+            Err(TryRecvError::Lagged(1))
+        ));
+        assert_eq!(height(subscriber.try_recv().unwrap()), 2);
+        assert_eq!(height(subscriber.try_recv().unwrap()), 3);
+    }
+
+    #[test]
+    fn test_phase_timer_on_fake_clock() {
+        let clock = bach_primitives::FakeClock::new();
+        let mut timer = PhaseTimer::start_on(Arc::new(clock.clone()));
+
+        clock.advance(std::time::Duration::from_micros(250));
+        assert_eq!(timer.lap(), 250);
+        assert_eq!(timer.lap(), 0);
+    }
+}
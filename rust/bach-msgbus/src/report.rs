@@ -0,0 +1,187 @@
+//! Structured block commit reports
+
+use bach_primitives::{Clock, SystemClock, H256};
+use bach_types::TxDag;
+use serde::{Deserialize, Serialize};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+/// Time spent in each commit phase, in microseconds.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct PhaseTimings {
+    /// Applying state writes
+    pub state_micros: u64,
+    /// Persisting the block and header
+    pub block_micros: u64,
+    /// Indexing receipts and gas usage
+    pub receipts_micros: u64,
+    /// Flushing storage to disk
+    pub flush_micros: u64,
+}
+
+impl PhaseTimings {
+    /// Returns the time spent across all phases.
+    pub fn total_micros(&self) -> u64 {
+        self.state_micros + self.block_micros + self.receipts_micros + self.flush_micros
+    }
+}
+
+/// Measures consecutive commit phases.
+#[derive(Debug)]
+pub struct PhaseTimer {
+    clock: Arc<dyn Clock>,
+    last: Instant,
+}
+
+impl PhaseTimer {
+    /// Starts timing the first phase.
+    pub fn start() -> Self {
+        Self::start_on(Arc::new(SystemClock))
+    }
+
+    /// Starts timing the first phase on the given clock.
+    pub fn start_on(clock: Arc<dyn Clock>) -> Self {
+        let last = clock.now();
+        Self { clock, last }
+    }
+
+    /// Ends the current phase and starts the next one.
+    pub fn lap(&mut self) -> u64 {
+        let now = self.clock.now();
+        let elapsed = now.duration_since(self.last);
+        self.last = now;
+        duration_micros(elapsed)
+    }
+}
+
+fn duration_micros(duration: Duration) -> u64 {
+    u64::try_from(duration.as_micros()).unwrap_or(u64::MAX)
+}
+
+/// Shape of a block's transaction dependency DAG.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct DagStats {
+    /// Transactions in the DAG
+    pub tx_count: usize,
+    /// Length of the longest dependency chain
+    pub depth: usize,
+    /// Most transactions that can run at once
+    pub width: usize,
+    /// Transactions that conflict with every other level and run serially
+    pub sequential_tx_count: usize,
+}
+
+impl DagStats {
+    /// Computes the statistics of a DAG.
+    pub fn from_dag(dag: &TxDag) -> Self {
+        Self {
+            tx_count: dag.len(),
+            depth: dag.depth(),
+            width: dag.max_width(),
+            sequential_tx_count: dag.sequential_count(),
+        }
+    }
+
+    /// Returns the average number of transactions per level, or 0 for an
+    /// empty block.
+    pub fn parallelism(&self) -> f64 {
+        match self.depth {
+            0 => 0.0,
+            depth => self.tx_count as f64 / depth as f64,
+        }
+    }
+}
+
+/// Machine-readable summary of a committed block.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct BlockCommitReport {
+    /// Committed block height
+    pub height: u64,
+    /// Committed block hash
+    pub block_hash: [u8; 32],
+    /// Hash under the previous algorithm, for hash migration transition
+    /// blocks only
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub legacy_block_hash: Option<[u8; 32]>,
+    /// Transactions in the block
+    pub tx_count: usize,
+    /// Transactions that failed execution
+    pub failed_tx_count: usize,
+    /// Storage slots written
+    pub write_count: usize,
+    /// Re-executions caused by read-write conflicts
+    pub conflicts: usize,
+    /// Pre-commit signatures collected for the block
+    pub signatures: usize,
+    /// Transaction DAG statistics, if the DAG was known
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dag: Option<DagStats>,
+    /// Per-phase durations
+    pub phases: PhaseTimings,
+}
+
+impl BlockCommitReport {
+    pub fn block_hash_h256(&self) -> H256 {
+        H256::from(self.block_hash)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_report_json_is_camel_case() {
+        let report = BlockCommitReport {
+            height: 7,
+            block_hash: [0xab; 32],
+            legacy_block_hash: None,
+            tx_count: 3,
+            failed_tx_count: 1,
+            write_count: 5,
+            conflicts: 2,
+            signatures: 4,
+            dag: None,
+            phases: PhaseTimings {
+                state_micros: 10,
+                block_micros: 20,
+                receipts_micros: 30,
+                flush_micros: 40,
+            },
+        };
+        assert_eq!(report.phases.total_micros(), 100);
+
+        let json = serde_json::to_value(&report).unwrap();
+        assert_eq!(json["txCount"], 3);
+        assert_eq!(json["phases"]["flushMicros"], 40);
+        assert!(json.get("dag").is_none());
+        assert!(json.get("legacyBlockHash").is_none());
+
+        let decoded: BlockCommitReport = serde_json::from_value(json).unwrap();
+        assert_eq!(decoded, report);
+        assert_eq!(decoded.block_hash_h256(), H256::from([0xab; 32]));
+    }
+
+    #[test]
+    fn test_dag_stats() {
+        let dag = TxDag::from_dependencies(vec![vec![], vec![], vec![0, 1], vec![2]]).unwrap();
+        let stats = DagStats::from_dag(&dag);
+        assert_eq!(
+            stats,
+            DagStats {
+                tx_count: 4,
+                depth: 3,
+                width: 2,
+                sequential_tx_count: 2,
+            }
+        );
+        assert!((stats.parallelism() - 4.0 / 3.0).abs() < f64::EPSILON);
+        assert_eq!(DagStats::default().parallelism(), 0.0);
+
+        let json = serde_json::to_value(stats).unwrap();
+        assert_eq!(json["sequentialTxCount"], 2);
+    }
+}
@@ -1,4 +1,11 @@
 //! Message encoding/decoding for network transport
+//!
+//! Large transaction and block messages are compressed with zstd on
+//! connections where both peers advertised `CAP_ZSTD` in the handshake.
+//! Compressed frames set the top bit of the length prefix; the rest of the
+//! prefix is the compressed length. A compressed frame must declare its
+//! decompressed size, which may not exceed `MAX_MESSAGE_SIZE`, so a small
+//! frame can't expand into an unbounded allocation.
 
 use bytes::{Buf, BufMut, BytesMut};
 use tokio_util::codec::{Decoder, Encoder};
@@ -6,19 +13,45 @@ use tokio_util::codec::{Decoder, Encoder};
 use crate::error::NetworkError;
 use crate::message::NetworkMessage;
 
-/// Maximum message size (16 MB).
+/// Maximum message size (16 MB), before and after decompression.
 const MAX_MESSAGE_SIZE: usize = 16 * 1024 * 1024;
 
 /// Length prefix size (4 bytes).
 const LENGTH_PREFIX_SIZE: usize = 4;
 
+/// Length prefix bit marking a zstd-compressed payload.
+const COMPRESSED_FLAG: u32 = 1 << 31;
+
+/// When and how hard to compress messages on connections that negotiated
+/// compression.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct CompressionConfig {
+    /// Transaction and block messages whose encoding is at least this many
+    /// bytes are compressed
+    pub threshold: usize,
+    /// zstd compression level
+    pub level: i32,
+}
+
+impl Default for CompressionConfig {
+    fn default() -> Self {
+        Self {
+            threshold: 1024,
+            level: 3,
+        }
+    }
+}
+
 /// Codec for encoding/decoding network messages.
 ///
-/// Wire format: [length: u32 BE] [bincode-encoded message]
+/// Wire format: [length: u32 BE, top bit set if compressed] [bincode-encoded
+/// message, zstd-compressed if flagged]
 #[derive(Debug, Default)]
 pub struct MessageCodec {
     /// Partial decode state
     decode_state: DecodeState,
+    /// Compression agreed with the peer (None until negotiated)
+    compression: Option<CompressionConfig>,
 }
 
 #[derive(Debug, Default)]
@@ -27,6 +60,7 @@ enum DecodeState {
     ReadingLength,
     ReadingPayload {
         length: usize,
+        compressed: bool,
     },
 }
 
@@ -36,8 +70,19 @@ impl MessageCodec {
         Self::default()
     }
 
-    /// Encodes a message to bytes (standalone function).
-    pub fn encode_message(msg: &NetworkMessage) -> Result<Vec<u8>, NetworkError> {
+    /// Compresses eligible outgoing messages and accepts compressed
+    /// incoming ones (None: neither). Set once the handshake has shown
+    /// that both peers support compression.
+    pub fn set_compression(&mut self, compression: Option<CompressionConfig>) {
+        self.compression = compression;
+    }
+
+    /// Serializes a message, compressing it if `compression` applies, and
+    /// returns the length prefix to send with the payload.
+    fn encode_payload(
+        msg: &NetworkMessage,
+        compression: Option<&CompressionConfig>,
+    ) -> Result<(u32, Vec<u8>), NetworkError> {
         let payload = bincode::serialize(msg)
             .map_err(|e| NetworkError::Codec(format!("serialize error: {}", e)))?;
 
@@ -49,26 +94,80 @@ impl MessageCodec {
             )));
         }
 
+        let compression =
+            compression.filter(|config| msg.is_compressible() && payload.len() >= config.threshold);
+        if let Some(config) = compression {
+            let compressed = zstd::bulk::compress(&payload, config.level)
+                .map_err(|e| NetworkError::Codec(format!("compress error: {}", e)))?;
+            // Incompressible payloads go out as they are
+            if compressed.len() < payload.len() {
+                return Ok((compressed.len() as u32 | COMPRESSED_FLAG, compressed));
+            }
+        }
+        Ok((payload.len() as u32, payload))
+    }
+
+    /// Deserializes a payload, decompressing it first if it is flagged.
+    fn decode_payload(payload: &[u8], compressed: bool) -> Result<NetworkMessage, NetworkError> {
+        let decompressed;
+        let payload = if compressed {
+            let size = zstd::zstd_safe::get_frame_content_size(payload)
+                .ok()
+                .flatten()
+                .ok_or_else(|| NetworkError::Codec("compressed size not declared".into()))?;
+            if size > MAX_MESSAGE_SIZE as u64 {
+                return Err(NetworkError::Codec(format!(
+                    "decompressed length {} exceeds max {}",
+                    size, MAX_MESSAGE_SIZE
+                )));
+            }
+            // Decompression fails if the frame expands beyond its declared size
+            decompressed = zstd::bulk::decompress(payload, size as usize)
+                .map_err(|e| NetworkError::Codec(format!("decompress error: {}", e)))?;
+            &decompressed[..]
+        } else {
+            payload
+        };
+        bincode::deserialize(payload)
+            .map_err(|e| NetworkError::Codec(format!("deserialize error: {}", e)))
+    }
+
+    /// Splits a length prefix into the payload length and compressed flag,
+    /// rejecting compressed payloads unless `compression_allowed`.
+    fn parse_prefix(prefix: u32, compression_allowed: bool) -> Result<(usize, bool), NetworkError> {
+        let compressed = prefix & COMPRESSED_FLAG != 0;
+        if compressed && !compression_allowed {
+            return Err(NetworkError::Codec("compression was not negotiated".into()));
+        }
+        let length = (prefix & !COMPRESSED_FLAG) as usize;
+        if length > MAX_MESSAGE_SIZE {
+            return Err(NetworkError::Codec(format!(
+                "message length {} exceeds max {}",
+                length, MAX_MESSAGE_SIZE
+            )));
+        }
+        Ok((length, compressed))
+    }
+
+    /// Encodes a message to bytes (standalone function, uncompressed).
+    pub fn encode_message(msg: &NetworkMessage) -> Result<Vec<u8>, NetworkError> {
+        let (prefix, payload) = Self::encode_payload(msg, None)?;
+
         let mut buf = Vec::with_capacity(LENGTH_PREFIX_SIZE + payload.len());
-        buf.extend_from_slice(&(payload.len() as u32).to_be_bytes());
+        buf.extend_from_slice(&prefix.to_be_bytes());
         buf.extend_from_slice(&payload);
         Ok(buf)
     }
 
-    /// Decodes a message from bytes (standalone function).
+    /// Decodes a message from bytes (standalone function, compressed or
+    /// not).
     pub fn decode_message(data: &[u8]) -> Result<NetworkMessage, NetworkError> {
         if data.len() < LENGTH_PREFIX_SIZE {
             return Err(NetworkError::Codec("data too short for length prefix".into()));
         }
 
-        let length = u32::from_be_bytes([data[0], data[1], data[2], data[3]]) as usize;
-
-        if length > MAX_MESSAGE_SIZE {
-            return Err(NetworkError::Codec(format!(
-                "message length {} exceeds max {}",
-                length, MAX_MESSAGE_SIZE
-            )));
-        }
+        let prefix = u32::from_be_bytes([data[0], data[1], data[2], data[3]]);
+        let (length, compressed) = Self::parse_prefix(prefix, true)?;
 
         let expected_len = LENGTH_PREFIX_SIZE + length;
         if data.len() < expected_len {
@@ -80,8 +179,7 @@ impl MessageCodec {
         }
 
         let payload = &data[LENGTH_PREFIX_SIZE..expected_len];
-        bincode::deserialize(payload)
-            .map_err(|e| NetworkError::Codec(format!("deserialize error: {}", e)))
+        Self::decode_payload(payload, compressed)
     }
 }
 
@@ -97,20 +195,15 @@ impl Decoder for MessageCodec {
                         return Ok(None);
                     }
 
-                    let length = u32::from_be_bytes([src[0], src[1], src[2], src[3]]) as usize;
-
-                    if length > MAX_MESSAGE_SIZE {
-                        return Err(NetworkError::Codec(format!(
-                            "message length {} exceeds max {}",
-                            length, MAX_MESSAGE_SIZE
-                        )));
-                    }
+                    let prefix = u32::from_be_bytes([src[0], src[1], src[2], src[3]]);
+                    let (length, compressed) =
+                        Self::parse_prefix(prefix, self.compression.is_some())?;
 
                     src.advance(LENGTH_PREFIX_SIZE);
-                    self.decode_state = DecodeState::ReadingPayload { length };
+                    self.decode_state = DecodeState::ReadingPayload { length, compressed };
                 }
-                DecodeState::ReadingPayload { length } => {
-                    let length = *length;
+                DecodeState::ReadingPayload { length, compressed } => {
+                    let (length, compressed) = (*length, *compressed);
                     if src.len() < length {
                         return Ok(None);
                     }
@@ -118,8 +211,7 @@ impl Decoder for MessageCodec {
                     let payload = src.split_to(length);
                     self.decode_state = DecodeState::ReadingLength;
 
-                    let msg: NetworkMessage = bincode::deserialize(&payload)
-                        .map_err(|e| NetworkError::Codec(format!("deserialize error: {}", e)))?;
+                    let msg = Self::decode_payload(&payload, compressed)?;
 
                     return Ok(Some(msg));
                 }
@@ -132,19 +224,10 @@ impl Encoder<NetworkMessage> for MessageCodec {
     type Error = NetworkError;
 
     fn encode(&mut self, item: NetworkMessage, dst: &mut BytesMut) -> Result<(), Self::Error> {
-        let payload = bincode::serialize(&item)
-            .map_err(|e| NetworkError::Codec(format!("serialize error: {}", e)))?;
-
-        if payload.len() > MAX_MESSAGE_SIZE {
-            return Err(NetworkError::Codec(format!(
-                "message too large: {} bytes (max {})",
-                payload.len(),
-                MAX_MESSAGE_SIZE
-            )));
-        }
+        let (prefix, payload) = Self::encode_payload(&item, self.compression.as_ref())?;
 
         dst.reserve(LENGTH_PREFIX_SIZE + payload.len());
-        dst.put_u32(payload.len() as u32);
+        dst.put_u32(prefix);
         dst.put_slice(&payload);
         Ok(())
     }
@@ -162,6 +245,8 @@ mod tests {
             peer_id: [1u8; 32],
             genesis_hash: [2u8; 32],
             public_key: [3u8; 64],
+            capabilities: 0,
+            features: vec!["fast-sync".to_string()],
         };
 
         let encoded = MessageCodec::encode_message(&msg).unwrap();
@@ -220,11 +305,88 @@ mod tests {
             nonce: 0,
             to: None,
             value: [0u8; 32],
+            gas: 21_000,
             data: large_data,
-            signature: [0u8; 65],
+            signature: vec![0u8; 65],
         }]);
 
         let result = MessageCodec::encode_message(&msg);
         assert!(result.is_err());
     }
+
+    fn transaction_with(data: Vec<u8>) -> NetworkMessage {
+        NetworkMessage::NewTransaction(crate::message::SerializableTransaction {
+            nonce: 1,
+            to: None,
+            value: [0u8; 32],
+            gas: 21_000,
+            data,
+            signature: vec![0u8; 65],
+        })
+    }
+
+    fn compressing_codec() -> MessageCodec {
+        let mut codec = MessageCodec::new();
+        codec.set_compression(Some(CompressionConfig::default()));
+        codec
+    }
+
+    #[test]
+    fn test_compressed_roundtrip() {
+        let mut codec = compressing_codec();
+        let mut buf = BytesMut::new();
+
+        let large = transaction_with(vec![0x60; 64 * 1024]);
+        codec.encode(large.clone(), &mut buf).unwrap();
+        let prefix = u32::from_be_bytes([buf[0], buf[1], buf[2], buf[3]]);
+        assert_ne!(prefix & COMPRESSED_FLAG, 0);
+        assert!(buf.len() < 4096);
+        assert_eq!(codec.decode(&mut buf).unwrap(), Some(large.clone()));
+
+        // Small and non-transaction messages go out as they are
+        let small = transaction_with(vec![0x60; 16]);
+        codec.encode(small.clone(), &mut buf).unwrap();
+        assert_eq!(buf[0] & 0x80, 0);
+        assert_eq!(codec.decode(&mut buf).unwrap(), Some(small));
+        codec
+            .encode(NetworkMessage::disconnect("x".repeat(4096)), &mut buf)
+            .unwrap();
+        assert_eq!(buf[0] & 0x80, 0);
+
+        // Without negotiated compression large messages aren't compressed
+        let encoded = MessageCodec::encode_message(&large).unwrap();
+        assert_eq!(encoded[0] & 0x80, 0);
+    }
+
+    #[test]
+    fn test_compressed_frame_requires_negotiation() {
+        let mut buf = BytesMut::new();
+        compressing_codec()
+            .encode(transaction_with(vec![0x60; 64 * 1024]), &mut buf)
+            .unwrap();
+
+        let result = MessageCodec::new().decode(&mut buf);
+        assert!(matches!(result, Err(NetworkError::Codec(_))));
+    }
+
+    #[test]
+    fn test_decompression_is_bounded() {
+        // Declares more than the maximum message size
+        let bomb = zstd::bulk::compress(&vec![0u8; MAX_MESSAGE_SIZE + 1], 3).unwrap();
+        let mut buf = BytesMut::new();
+        buf.put_u32(bomb.len() as u32 | COMPRESSED_FLAG);
+        buf.put_slice(&bomb);
+        let result = compressing_codec().decode(&mut buf);
+        assert!(matches!(result, Err(NetworkError::Codec(_))));
+
+        // Doesn't declare its size at all
+        let mut encoder = zstd::stream::Encoder::new(Vec::new(), 3).unwrap();
+        std::io::Write::write_all(&mut encoder, &[0u8; 1024]).unwrap();
+        let undeclared = encoder.finish().unwrap();
+        let mut buf = BytesMut::new();
+        buf.put_u32(undeclared.len() as u32 | COMPRESSED_FLAG);
+        buf.put_slice(&undeclared);
+        let result = compressing_codec().decode(&mut buf);
+        assert!(matches!(result, Err(NetworkError::Codec(_))));
+    }
 }
@@ -0,0 +1,571 @@
+//! DNS-based bootstrap discovery
+//!
+//! Seeds are given as socket addresses, as `host:port` names whose A/AAAA
+//! records are all dialed, or as `srv:` service names (for example
+//! `srv:_bach._tcp.example.org`) whose SRV records supply both the seed
+//! hosts and their ports. SRV lookups go straight to the nameserver in
+//! `/etc/resolv.conf` over UDP.
+
+use futures::future::BoxFuture;
+use std::collections::HashSet;
+use std::fmt;
+use std::net::{IpAddr, Ipv4Addr, SocketAddr};
+use std::str::FromStr;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use tokio::net::UdpSocket;
+use tracing::warn;
+
+use crate::error::{NetworkError, NetworkResult};
+
+/// Prefix marking a seed as an SRV service name
+const SRV_PREFIX: &str = "srv:";
+
+/// DNS record type of SRV records
+const DNS_TYPE_SRV: u16 = 33;
+
+/// DNS class IN
+const DNS_CLASS_IN: u16 = 1;
+
+/// Deadline for one SRV query
+const SRV_QUERY_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Largest DNS response read over UDP
+const MAX_DNS_RESPONSE: usize = 4096;
+
+/// A bootstrap endpoint given as an address, a DNS name or an SRV name.
+///
+/// DNS seeds are resolved each time the service starts, so operators can
+/// rotate seed nodes by updating DNS records instead of node configs.
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub enum SeedSource {
+    /// Literal socket address
+    Addr(SocketAddr),
+    /// Host name whose records are all used as seeds
+    Dns {
+        /// Host name
+        host: String,
+        /// Port to connect to on every resolved address
+        port: u16,
+    },
+    /// Service name whose SRV records name the seeds and their ports
+    Srv {
+        /// Service name, e.g. `_bach._tcp.example.org`
+        name: String,
+    },
+}
+
+/// One SRV record.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SrvRecord {
+    /// Lower is tried first
+    pub priority: u16,
+    /// Higher is preferred among records of equal priority
+    pub weight: u16,
+    /// Port the service listens on
+    pub port: u16,
+    /// Host name of the target
+    pub target: String,
+}
+
+/// Looks up DNS records for seeds.
+pub trait SeedResolver: Send + Sync + fmt::Debug {
+    /// Returns the addresses of `host`, all with `port`.
+    fn lookup_host(
+        &self,
+        host: &str,
+        port: u16,
+    ) -> BoxFuture<'static, NetworkResult<Vec<SocketAddr>>>;
+
+    /// Returns the SRV records of `name`.
+    fn lookup_srv(&self, name: &str) -> BoxFuture<'static, NetworkResult<Vec<SrvRecord>>>;
+}
+
+/// Resolves through the operating system and the configured nameserver.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct SystemResolver;
+
+impl SeedResolver for SystemResolver {
+    fn lookup_host(
+        &self,
+        host: &str,
+        port: u16,
+    ) -> BoxFuture<'static, NetworkResult<Vec<SocketAddr>>> {
+        let host = host.to_string();
+        Box::pin(async move {
+            let addrs = tokio::net::lookup_host((host.as_str(), port))
+                .await
+                .map_err(|e| NetworkError::ConnectionFailed(format!("resolve {}: {}", host, e)))?;
+            Ok(addrs.collect())
+        })
+    }
+
+    fn lookup_srv(&self, name: &str) -> BoxFuture<'static, NetworkResult<Vec<SrvRecord>>> {
+        let name = name.to_string();
+        Box::pin(async move { query_srv(system_nameserver(), &name).await })
+    }
+}
+
+impl SeedSource {
+    /// Resolves this seed to socket addresses.
+    pub async fn resolve(&self) -> NetworkResult<Vec<SocketAddr>> {
+        self.resolve_with(&SystemResolver).await
+    }
+
+    /// Resolves this seed to socket addresses using `resolver`.
+    ///
+    /// SRV targets are returned by ascending priority, and by descending
+    /// weight within a priority.
+    pub async fn resolve_with(
+        &self,
+        resolver: &dyn SeedResolver,
+    ) -> NetworkResult<Vec<SocketAddr>> {
+        match self {
+            Self::Addr(addr) => Ok(vec![*addr]),
+            Self::Dns { host, port } => resolver.lookup_host(host, *port).await,
+            Self::Srv { name } => {
+                let mut records = resolver.lookup_srv(name).await?;
+                records.sort_by_key(|record| (record.priority, std::cmp::Reverse(record.weight)));
+                let mut addrs = Vec::new();
+                for record in records {
+                    // A target of "." means the service is not offered
+                    if record.target.is_empty() || record.target == "." {
+                        continue;
+                    }
+                    match resolver.lookup_host(&record.target, record.port).await {
+                        Ok(found) => addrs.extend(found),
+                        Err(e) => warn!("Failed to resolve SRV target {}: {}", record.target, e),
+                    }
+                }
+                Ok(addrs)
+            }
+        }
+    }
+}
+
+impl FromStr for SeedSource {
+    type Err = NetworkError;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let s = s.trim();
+        if let Ok(addr) = s.parse() {
+            return Ok(Self::Addr(addr));
+        }
+        if let Some(name) = s.strip_prefix(SRV_PREFIX) {
+            let name = name.trim_end_matches('.');
+            let invalid_label = |label: &str| label.is_empty() || label.len() > 63;
+            if name.is_empty() || name.split('.').any(invalid_label) {
+                return Err(NetworkError::InvalidMessage(format!("seed {} is not a DNS name", s)));
+            }
+            return Ok(Self::Srv {
+                name: name.to_string(),
+            });
+        }
+
+        let (host, port) = s
+            .rsplit_once(':')
+            .ok_or_else(|| NetworkError::InvalidMessage(format!("seed {} has no port", s)))?;
+        let port = port
+            .parse()
+            .map_err(|_| NetworkError::InvalidMessage(format!("seed {} has an invalid port", s)))?;
+        if host.is_empty() {
+            return Err(NetworkError::InvalidMessage(format!("seed {} has no host", s)));
+        }
+
+        Ok(Self::Dns {
+            host: host.to_string(),
+            port,
+        })
+    }
+}
+
+impl fmt::Display for SeedSource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Addr(addr) => write!(f, "{}", addr),
+            Self::Dns { host, port } => write!(f, "{}:{}", host, port),
+            Self::Srv { name } => write!(f, "{}{}", SRV_PREFIX, name),
+        }
+    }
+}
+
+/// Resolves all seeds, skipping ones that fail. Duplicates are removed.
+pub async fn resolve_seeds(seeds: &[SeedSource]) -> Vec<SocketAddr> {
+    resolve_seeds_with(&SystemResolver, seeds).await
+}
+
+/// Resolves all seeds using `resolver`, skipping ones that fail.
+/// Duplicates are removed.
+pub async fn resolve_seeds_with(
+    resolver: &dyn SeedResolver,
+    seeds: &[SeedSource],
+) -> Vec<SocketAddr> {
+    let mut seen = HashSet::new();
+    let mut resolved = Vec::new();
+
+    for seed in seeds {
+        match seed.resolve_with(resolver).await {
+            Ok(addrs) => {
+                for addr in addrs {
+                    if seen.insert(addr) {
+                        resolved.push(addr);
+                    }
+                }
+            }
+            Err(e) => warn!("Failed to resolve seed {}: {}", seed, e),
+        }
+    }
+
+    resolved
+}
+
+/// Returns the first nameserver in `/etc/resolv.conf`, or the local host.
+fn system_nameserver() -> SocketAddr {
+    let ip = std::fs::read_to_string("/etc/resolv.conf")
+        .ok()
+        .and_then(|conf| {
+            conf.lines().find_map(|line| {
+                let mut words = line.split_whitespace();
+                match (words.next(), words.next()) {
+                    (Some("nameserver"), Some(ip)) => ip.parse::<IpAddr>().ok(),
+                    _ => None,
+                }
+            })
+        })
+        .unwrap_or(IpAddr::V4(Ipv4Addr::LOCALHOST));
+    SocketAddr::new(ip, 53)
+}
+
+/// Asks `nameserver` for the SRV records of `name`.
+async fn query_srv(nameserver: SocketAddr, name: &str) -> NetworkResult<Vec<SrvRecord>> {
+    let id = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|elapsed| elapsed.subsec_nanos() as u16)
+        .unwrap_or_default();
+    let query = encode_srv_query(id, name)?;
+
+    let bind: SocketAddr = if nameserver.is_ipv4() {
+        (Ipv4Addr::UNSPECIFIED, 0).into()
+    } else {
+        (std::net::Ipv6Addr::UNSPECIFIED, 0).into()
+    };
+    let socket = UdpSocket::bind(bind).await?;
+    socket.connect(nameserver).await?;
+    socket.send(&query).await?;
+
+    let mut response = vec![0u8; MAX_DNS_RESPONSE];
+    let len = tokio::time::timeout(SRV_QUERY_TIMEOUT, socket.recv(&mut response))
+        .await
+        .map_err(|_| NetworkError::ConnectionFailed(format!("SRV query for {} timed out", name)))??;
+    decode_srv_response(id, &response[..len])
+}
+
+/// Builds a recursive DNS query for the SRV records of `name`.
+fn encode_srv_query(id: u16, name: &str) -> NetworkResult<Vec<u8>> {
+    let mut query = Vec::with_capacity(18 + name.len());
+    query.extend_from_slice(&id.to_be_bytes());
+    // Recursion desired, one question
+    query.extend_from_slice(&[0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0]);
+    for label in name.trim_end_matches('.').split('.') {
+        if label.is_empty() || label.len() > 63 {
+            return Err(NetworkError::InvalidMessage(format!("{} is not a DNS name", name)));
+        }
+        query.push(label.len() as u8);
+        query.extend_from_slice(label.as_bytes());
+    }
+    query.push(0);
+    query.extend_from_slice(&DNS_TYPE_SRV.to_be_bytes());
+    query.extend_from_slice(&DNS_CLASS_IN.to_be_bytes());
+    Ok(query)
+}
+
+/// Extracts the SRV records from the answer to query `id`. A name that
+/// does not exist has no records.
+fn decode_srv_response(id: u16, packet: &[u8]) -> NetworkResult<Vec<SrvRecord>> {
+    let malformed = || NetworkError::InvalidMessage("malformed DNS response".to_string());
+    if packet.len() < 12 || read_u16(packet, 0)? != id || packet[2] & 0x80 == 0 {
+        return Err(malformed());
+    }
+    match packet[3] & 0x0f {
+        0 => {}
+        3 => return Ok(Vec::new()),
+        rcode => {
+            return Err(NetworkError::ConnectionFailed(format!(
+                "DNS server answered rcode {}",
+                rcode
+            )))
+        }
+    }
+
+    let questions = read_u16(packet, 4)?;
+    let answers = read_u16(packet, 6)?;
+    let mut pos = 12;
+    for _ in 0..questions {
+        pos = read_name(packet, pos)?.1 + 4;
+    }
+
+    let mut records = Vec::new();
+    for _ in 0..answers {
+        pos = read_name(packet, pos)?.1;
+        let record_type = read_u16(packet, pos)?;
+        let len = read_u16(packet, pos + 8)? as usize;
+        let data = pos + 10;
+        if data + len > packet.len() {
+            return Err(malformed());
+        }
+        if record_type == DNS_TYPE_SRV {
+            records.push(SrvRecord {
+                priority: read_u16(packet, data)?,
+                weight: read_u16(packet, data + 2)?,
+                port: read_u16(packet, data + 4)?,
+                target: read_name(packet, data + 6)?.0,
+            });
+        }
+        pos = data + len;
+    }
+    Ok(records)
+}
+
+fn read_u16(packet: &[u8], pos: usize) -> NetworkResult<u16> {
+    packet
+        .get(pos..pos + 2)
+        .map(|bytes| u16::from_be_bytes([bytes[0], bytes[1]]))
+        .ok_or_else(|| NetworkError::InvalidMessage("truncated DNS response".to_string()))
+}
+
+/// Reads the possibly compressed name at `pos`. Returns the name and the
+/// position just past it.
+fn read_name(packet: &[u8], mut pos: usize) -> NetworkResult<(String, usize)> {
+    let malformed = || NetworkError::InvalidMessage("malformed DNS name".to_string());
+    let mut labels = Vec::new();
+    let mut end = None;
+    // Bounds pointer chains, which could otherwise loop
+    for _ in 0..packet.len() {
+        let len = *packet.get(pos).ok_or_else(malformed)? as usize;
+        if len == 0 {
+            let name = if labels.is_empty() { ".".to_string() } else { labels.join(".") };
+            return Ok((name, end.unwrap_or(pos + 1)));
+        }
+        if len & 0xc0 == 0xc0 {
+            let pointer = (read_u16(packet, pos)? & 0x3fff) as usize;
+            end.get_or_insert(pos + 2);
+            pos = pointer;
+            continue;
+        }
+        let label = packet.get(pos + 1..pos + 1 + len).ok_or_else(malformed)?;
+        labels.push(String::from_utf8_lossy(label).into_owned());
+        pos += 1 + len;
+    }
+    Err(malformed())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashMap;
+
+    /// Answers from fixed tables instead of DNS.
+    #[derive(Debug, Default)]
+    struct MockResolver {
+        hosts: HashMap<String, Vec<IpAddr>>,
+        srv: HashMap<String, Vec<SrvRecord>>,
+    }
+
+    impl MockResolver {
+        fn host(mut self, host: &str, ips: &[&str]) -> Self {
+            let ips = ips.iter().map(|ip| ip.parse().unwrap()).collect();
+            self.hosts.insert(host.to_string(), ips);
+            self
+        }
+
+        fn srv(mut self, name: &str, records: &[(u16, u16, u16, &str)]) -> Self {
+            let records = records
+                .iter()
+                .map(|&(priority, weight, port, target)| SrvRecord {
+                    priority,
+                    weight,
+                    port,
+                    target: target.to_string(),
+                })
+                .collect();
+            self.srv.insert(name.to_string(), records);
+            self
+        }
+    }
+
+    impl SeedResolver for MockResolver {
+        fn lookup_host(
+            &self,
+            host: &str,
+            port: u16,
+        ) -> BoxFuture<'static, NetworkResult<Vec<SocketAddr>>> {
+            let result = self
+                .hosts
+                .get(host)
+                .map(|ips| ips.iter().map(|ip| SocketAddr::new(*ip, port)).collect())
+                .ok_or_else(|| NetworkError::ConnectionFailed(format!("no host {}", host)));
+            Box::pin(async move { result })
+        }
+
+        fn lookup_srv(&self, name: &str) -> BoxFuture<'static, NetworkResult<Vec<SrvRecord>>> {
+            let records = self.srv.get(name).cloned().unwrap_or_default();
+            Box::pin(async move { Ok(records) })
+        }
+    }
+
+    /// Builds a DNS response to `query` with the given SRV answers, naming
+    /// the question by a compression pointer as servers do.
+    fn srv_response(query: &[u8], answers: &[(u16, u16, u16, &str)]) -> Vec<u8> {
+        let mut packet = query.to_vec();
+        packet[2] |= 0x80;
+        packet[6..8].copy_from_slice(&(answers.len() as u16).to_be_bytes());
+        for &(priority, weight, port, target) in answers {
+            packet.extend_from_slice(&[0xc0, 12]);
+            packet.extend_from_slice(&DNS_TYPE_SRV.to_be_bytes());
+            packet.extend_from_slice(&DNS_CLASS_IN.to_be_bytes());
+            packet.extend_from_slice(&300u32.to_be_bytes());
+            let mut data = Vec::new();
+            for value in [priority, weight, port] {
+                data.extend_from_slice(&value.to_be_bytes());
+            }
+            for label in target.split('.') {
+                data.push(label.len() as u8);
+                data.extend_from_slice(label.as_bytes());
+            }
+            data.push(0);
+            packet.extend_from_slice(&(data.len() as u16).to_be_bytes());
+            packet.extend_from_slice(&data);
+        }
+        packet
+    }
+
+    #[test]
+    fn test_parse_seed() {
+        assert_eq!(
+            "127.0.0.1:30303".parse::<SeedSource>().unwrap(),
+            SeedSource::Addr("127.0.0.1:30303".parse().unwrap())
+        );
+        assert_eq!(
+            "seed.example.org:30303".parse::<SeedSource>().unwrap(),
+            SeedSource::Dns {
+                host: "seed.example.org".into(),
+                port: 30303
+            }
+        );
+        assert!("seed.example.org".parse::<SeedSource>().is_err());
+        assert!("seed.example.org:http".parse::<SeedSource>().is_err());
+        assert!(":30303".parse::<SeedSource>().is_err());
+
+        let srv = "srv:_bach._tcp.example.org.".parse::<SeedSource>().unwrap();
+        assert_eq!(
+            srv,
+            SeedSource::Srv {
+                name: "_bach._tcp.example.org".into()
+            }
+        );
+        assert_eq!(srv.to_string(), "srv:_bach._tcp.example.org");
+        assert!("srv:".parse::<SeedSource>().is_err());
+        assert!("srv:_bach..example.org".parse::<SeedSource>().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_resolve_seeds_dedups_and_skips_failures() {
+        let resolver = MockResolver::default().host("seed.example.org", &["10.0.0.1", "10.0.0.2"]);
+        let seeds = vec![
+            SeedSource::Addr("10.0.0.1:30303".parse().unwrap()),
+            SeedSource::Addr("10.0.0.1:30303".parse().unwrap()),
+            SeedSource::Dns {
+                host: "seed.example.org".into(),
+                port: 30303,
+            },
+            SeedSource::Dns {
+                host: "does-not-exist.invalid".into(),
+                port: 30303,
+            },
+        ];
+
+        let resolved = resolve_seeds_with(&resolver, &seeds).await;
+        assert_eq!(
+            resolved,
+            vec![
+                "10.0.0.1:30303".parse::<SocketAddr>().unwrap(),
+                "10.0.0.2:30303".parse().unwrap(),
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_resolve_srv_seeds() {
+        let resolver = MockResolver::default()
+            .host("a.example.org", &["10.0.0.1"])
+            .host("b.example.org", &["10.0.0.2"])
+            .host("c.example.org", &["10.0.0.3"])
+            .srv(
+                "_bach._tcp.example.org",
+                &[
+                    (20, 0, 30305, "c.example.org"),
+                    (10, 5, 30303, "a.example.org"),
+                    (10, 50, 30304, "b.example.org"),
+                    (10, 0, 30306, "gone.example.org"),
+                ],
+            )
+            .srv("_bach._tcp.disabled.org", &[(0, 0, 0, ".")]);
+        let seeds = vec![
+            "srv:_bach._tcp.example.org".parse().unwrap(),
+            "srv:_bach._tcp.disabled.org".parse().unwrap(),
+        ];
+
+        let resolved = resolve_seeds_with(&resolver, &seeds).await;
+        assert_eq!(
+            resolved,
+            vec![
+                "10.0.0.2:30304".parse::<SocketAddr>().unwrap(),
+                "10.0.0.1:30303".parse().unwrap(),
+                "10.0.0.3:30305".parse().unwrap(),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_decode_srv_response() {
+        let query = encode_srv_query(7, "_bach._tcp.example.org").unwrap();
+        let response = srv_response(&query, &[(10, 5, 30303, "a.example.org")]);
+        assert_eq!(
+            decode_srv_response(7, &response).unwrap(),
+            vec![SrvRecord {
+                priority: 10,
+                weight: 5,
+                port: 30303,
+                target: "a.example.org".into(),
+            }]
+        );
+
+        // Answers to another query, truncated packets and NXDOMAIN
+        assert!(decode_srv_response(8, &response).is_err());
+        assert!(decode_srv_response(7, &response[..response.len() - 3]).is_err());
+        let mut missing = srv_response(&query, &[]);
+        missing[3] |= 3;
+        assert!(decode_srv_response(7, &missing).unwrap().is_empty());
+
+        // Pointer loops are rejected instead of followed forever
+        let mut looped = srv_response(&query, &[(10, 5, 30303, "a.example.org")]);
+        looped[12..14].copy_from_slice(&[0xc0, 12]);
+        assert!(decode_srv_response(7, &looped).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_query_srv_over_udp() {
+        let server = UdpSocket::bind("127.0.0.1:0").await.unwrap();
+        let nameserver = server.local_addr().unwrap();
+        tokio::spawn(async move {
+            let mut buf = [0u8; 512];
+            let (len, from) = server.recv_from(&mut buf).await.unwrap();
+            let response = srv_response(&buf[..len], &[(0, 0, 30303, "seed.example.org")]);
+            server.send_to(&response, from).await.unwrap();
+        });
+
+        let records = query_srv(nameserver, "_bach._tcp.example.org").await.unwrap();
+        assert_eq!(records.len(), 1);
+        assert_eq!(records[0].target, "seed.example.org");
+        assert_eq!(records[0].port, 30303);
+    }
+}
@@ -0,0 +1,487 @@
+//! Transaction gossip with compact announcements
+//!
+//! Instead of pushing every transaction body to every peer, a node announces
+//! the hashes of new transactions (`NewTransactionHashes`) and peers fetch
+//! the bodies they have not seen (`GetTransactions`). Per-peer caches of
+//! known hashes keep a node from announcing a transaction to a peer that
+//! sent or announced it, and in-flight fetches keep the same body from being
+//! requested from several announcers at once.
+//!
+//! Only bodies the node fetched are taken in; unsolicited ones are dropped.
+//! A fetched body is neither served nor announced until the application has
+//! admitted it and hands it back through `announce`; `reject` marks one it
+//! refused so later announcements of it are ignored.
+
+use bach_primitives::{system_clock, Clock};
+use parking_lot::Mutex;
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use crate::message::{NetworkMessage, SerializableTransaction};
+use crate::peer::PeerId;
+
+/// Gossip cache sizes and fetch timing
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct GossipConfig {
+    /// Hashes remembered per peer as already known to it
+    pub known_txs_per_peer: usize,
+    /// Transaction bodies kept to answer fetches
+    pub max_bodies: usize,
+    /// Most hashes in one announcement or fetch request
+    pub max_hashes_per_message: usize,
+    /// How long a fetch may stay unanswered before another announcer is asked
+    pub fetch_timeout: Duration,
+}
+
+impl Default for GossipConfig {
+    fn default() -> Self {
+        Self {
+            known_txs_per_peer: 32 * 1024,
+            max_bodies: 4096,
+            max_hashes_per_message: 256,
+            fetch_timeout: Duration::from_secs(5),
+        }
+    }
+}
+
+/// Gossip metrics snapshot
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct GossipMetrics {
+    /// Hashes announced to peers
+    pub announced: u64,
+    /// Announcements skipped because the peer already knew the transaction
+    pub announcements_suppressed: u64,
+    /// Announced hashes ignored because the body was held or being fetched
+    pub duplicate_announcements: u64,
+    /// Bodies requested from peers
+    pub fetched: u64,
+    /// Bodies received that were already held
+    pub duplicate_bodies: u64,
+    /// Bodies sent in answer to fetches
+    pub served: u64,
+    /// Bodies received without being fetched, dropped
+    pub unsolicited_bodies: u64,
+    /// Transactions the application refused
+    pub rejected: u64,
+}
+
+/// Insertion-ordered set that forgets its oldest entries beyond `capacity`.
+#[derive(Debug)]
+struct BoundedSet {
+    items: HashSet<[u8; 32]>,
+    order: VecDeque<[u8; 32]>,
+    capacity: usize,
+}
+
+impl BoundedSet {
+    fn new(capacity: usize) -> Self {
+        Self {
+            items: HashSet::new(),
+            order: VecDeque::new(),
+            capacity,
+        }
+    }
+
+    fn contains(&self, hash: &[u8; 32]) -> bool {
+        self.items.contains(hash)
+    }
+
+    /// Returns false if the hash was already present.
+    fn insert(&mut self, hash: [u8; 32]) -> bool {
+        if !self.items.insert(hash) {
+            return false;
+        }
+        self.order.push_back(hash);
+        while self.order.len() > self.capacity {
+            if let Some(oldest) = self.order.pop_front() {
+                self.items.remove(&oldest);
+            }
+        }
+        true
+    }
+}
+
+/// Transaction bodies held for fetches, oldest evicted first.
+#[derive(Debug, Default)]
+struct BodyCache {
+    bodies: HashMap<[u8; 32], SerializableTransaction>,
+    order: VecDeque<[u8; 32]>,
+}
+
+impl BodyCache {
+    fn insert(&mut self, hash: [u8; 32], tx: SerializableTransaction, capacity: usize) -> bool {
+        if self.bodies.contains_key(&hash) {
+            return false;
+        }
+        self.bodies.insert(hash, tx);
+        self.order.push_back(hash);
+        while self.order.len() > capacity {
+            if let Some(oldest) = self.order.pop_front() {
+                self.bodies.remove(&oldest);
+            }
+        }
+        true
+    }
+}
+
+/// Announce/fetch state of the transaction gossip protocol.
+///
+/// Methods return the messages to send; the network service delivers them.
+#[derive(Debug)]
+pub struct TxGossip {
+    config: GossipConfig,
+    clock: Arc<dyn Clock>,
+    known: Mutex<HashMap<PeerId, BoundedSet>>,
+    bodies: Mutex<BodyCache>,
+    requested: Mutex<HashMap<[u8; 32], Instant>>,
+    rejected: Mutex<BoundedSet>,
+    announced: AtomicU64,
+    announcements_suppressed: AtomicU64,
+    duplicate_announcements: AtomicU64,
+    fetched: AtomicU64,
+    duplicate_bodies: AtomicU64,
+    served: AtomicU64,
+    unsolicited_bodies: AtomicU64,
+    rejected_count: AtomicU64,
+}
+
+impl TxGossip {
+    /// Creates empty gossip state.
+    pub fn new(config: GossipConfig) -> Self {
+        let rejected = BoundedSet::new(config.max_bodies);
+        Self {
+            config,
+            clock: system_clock(),
+            known: Mutex::new(HashMap::new()),
+            bodies: Mutex::new(BodyCache::default()),
+            requested: Mutex::new(HashMap::new()),
+            rejected: Mutex::new(rejected),
+            announced: AtomicU64::new(0),
+            announcements_suppressed: AtomicU64::new(0),
+            duplicate_announcements: AtomicU64::new(0),
+            fetched: AtomicU64::new(0),
+            duplicate_bodies: AtomicU64::new(0),
+            served: AtomicU64::new(0),
+            unsolicited_bodies: AtomicU64::new(0),
+            rejected_count: AtomicU64::new(0),
+        }
+    }
+
+    /// Uses `clock` for fetch timeouts.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Returns the gossip configuration.
+    pub fn config(&self) -> &GossipConfig {
+        &self.config
+    }
+
+    /// Returns true if the transaction body is held.
+    pub fn has_body(&self, hash: &[u8; 32]) -> bool {
+        self.bodies.lock().bodies.contains_key(hash)
+    }
+
+    /// Returns true if `peer` is known to have the transaction.
+    pub fn peer_knows(&self, peer: &PeerId, hash: &[u8; 32]) -> bool {
+        self.known
+            .lock()
+            .get(peer)
+            .map_or(false, |known| known.contains(hash))
+    }
+
+    /// Forgets a disconnected peer.
+    pub fn remove_peer(&self, peer: &PeerId) {
+        self.known.lock().remove(peer);
+    }
+
+    /// Records a local or admitted transaction and returns the
+    /// announcements for the `peers` that don't know it yet. Returns
+    /// nothing if the transaction was already held.
+    pub fn announce(
+        &self,
+        tx: SerializableTransaction,
+        peers: &[PeerId],
+    ) -> Vec<(PeerId, NetworkMessage)> {
+        let hash = *tx.hash().as_bytes();
+        if !self.bodies.lock().insert(hash, tx, self.config.max_bodies) {
+            return Vec::new();
+        }
+        self.announce_hashes(&[hash], peers)
+    }
+
+    /// Marks `hashes` as known to `from` and returns the fetch request for
+    /// those neither held, rejected nor already being fetched.
+    pub fn on_announcement(&self, from: PeerId, hashes: &[[u8; 32]]) -> Option<NetworkMessage> {
+        let hashes = &hashes[..hashes.len().min(self.config.max_hashes_per_message)];
+        self.mark_known(from, hashes.iter().copied());
+
+        let now = self.clock.now();
+        let bodies = self.bodies.lock();
+        let rejected = self.rejected.lock();
+        let mut requested = self.requested.lock();
+        requested.retain(|_, at| now.saturating_duration_since(*at) < self.config.fetch_timeout);
+        let wanted: Vec<[u8; 32]> = hashes
+            .iter()
+            .filter(|hash| {
+                !bodies.bodies.contains_key(*hash)
+                    && !rejected.contains(hash)
+                    && !requested.contains_key(*hash)
+            })
+            .copied()
+            .collect();
+        for hash in &wanted {
+            requested.insert(*hash, now);
+        }
+
+        let duplicates = (hashes.len() - wanted.len()) as u64;
+        self.duplicate_announcements
+            .fetch_add(duplicates, Ordering::Relaxed);
+        if wanted.is_empty() {
+            return None;
+        }
+        self.fetched
+            .fetch_add(wanted.len() as u64, Ordering::Relaxed);
+        Some(NetworkMessage::GetTransactions(wanted))
+    }
+
+    /// Answers a fetch with the requested bodies that are held.
+    pub fn on_request(&self, from: PeerId, hashes: &[[u8; 32]]) -> Option<NetworkMessage> {
+        let hashes = &hashes[..hashes.len().min(self.config.max_hashes_per_message)];
+        let txs: Vec<SerializableTransaction> = {
+            let bodies = self.bodies.lock();
+            hashes
+                .iter()
+                .filter_map(|hash| bodies.bodies.get(hash).cloned())
+                .collect()
+        };
+        if txs.is_empty() {
+            return None;
+        }
+        self.mark_known(from, txs.iter().map(|tx| *tx.hash().as_bytes()));
+        self.served.fetch_add(txs.len() as u64, Ordering::Relaxed);
+        Some(NetworkMessage::Transactions(txs))
+    }
+
+    /// Takes the bodies received from `from` and returns the fetched ones
+    /// not held before, for the application to admit. Bodies already held
+    /// count as duplicates; bodies nobody fetched are dropped.
+    pub fn on_bodies(
+        &self,
+        from: PeerId,
+        txs: Vec<SerializableTransaction>,
+    ) -> Vec<SerializableTransaction> {
+        let mut fresh = Vec::new();
+        for tx in txs {
+            let hash = *tx.hash().as_bytes();
+            self.mark_known(from, [hash]);
+            if self.requested.lock().remove(&hash).is_some() {
+                fresh.push(tx);
+            } else if self.has_body(&hash) {
+                self.duplicate_bodies.fetch_add(1, Ordering::Relaxed);
+            } else {
+                self.unsolicited_bodies.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+        fresh
+    }
+
+    /// Records that the application refused a fetched transaction, so it
+    /// isn't fetched again when announced.
+    pub fn reject(&self, hash: [u8; 32]) {
+        if self.rejected.lock().insert(hash) {
+            self.rejected_count.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// Returns announcements of held `hashes` for the `peers` that don't
+    /// know them yet, split into messages of at most
+    /// `max_hashes_per_message` hashes.
+    pub fn announce_hashes(
+        &self,
+        hashes: &[[u8; 32]],
+        peers: &[PeerId],
+    ) -> Vec<(PeerId, NetworkMessage)> {
+        let mut known = self.known.lock();
+        let mut announcements = Vec::new();
+        for peer in peers {
+            let peer_known = known
+                .entry(*peer)
+                .or_insert_with(|| BoundedSet::new(self.config.known_txs_per_peer));
+            let unknown: Vec<[u8; 32]> = hashes
+                .iter()
+                .filter(|hash| peer_known.insert(**hash))
+                .copied()
+                .collect();
+
+            let suppressed = (hashes.len() - unknown.len()) as u64;
+            self.announcements_suppressed
+                .fetch_add(suppressed, Ordering::Relaxed);
+            self.announced
+                .fetch_add(unknown.len() as u64, Ordering::Relaxed);
+            for chunk in unknown.chunks(self.config.max_hashes_per_message.max(1)) {
+                announcements.push((*peer, NetworkMessage::NewTransactionHashes(chunk.to_vec())));
+            }
+        }
+        announcements
+    }
+
+    /// Returns a snapshot of the gossip metrics.
+    pub fn metrics(&self) -> GossipMetrics {
+        GossipMetrics {
+            announced: self.announced.load(Ordering::Relaxed),
+            announcements_suppressed: self.announcements_suppressed.load(Ordering::Relaxed),
+            duplicate_announcements: self.duplicate_announcements.load(Ordering::Relaxed),
+            fetched: self.fetched.load(Ordering::Relaxed),
+            duplicate_bodies: self.duplicate_bodies.load(Ordering::Relaxed),
+            served: self.served.load(Ordering::Relaxed),
+            unsolicited_bodies: self.unsolicited_bodies.load(Ordering::Relaxed),
+            rejected: self.rejected_count.load(Ordering::Relaxed),
+        }
+    }
+
+    fn mark_known(&self, peer: PeerId, hashes: impl IntoIterator<Item = [u8; 32]>) {
+        let mut known = self.known.lock();
+        let peer_known = known
+            .entry(peer)
+            .or_insert_with(|| BoundedSet::new(self.config.known_txs_per_peer));
+        for hash in hashes {
+            peer_known.insert(hash);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_primitives::FakeClock;
+
+    fn tx(nonce: u64) -> SerializableTransaction {
+        SerializableTransaction {
+            nonce,
+            to: Some([1u8; 20]),
+            value: [0u8; 32],
+            gas: 21_000,
+            data: vec![nonce as u8],
+            signature: vec![2u8; 65],
+        }
+    }
+
+    fn peer(n: u8) -> PeerId {
+        PeerId::from_bytes([n; 32])
+    }
+
+    #[test]
+    fn test_announce_skips_peers_that_know_tx() {
+        let gossip = TxGossip::new(GossipConfig::default());
+        let (a, b) = (peer(1), peer(2));
+        let hash = *tx(1).hash().as_bytes();
+
+        // `a` announced the transaction, so only `b` hears about it
+        assert_eq!(
+            gossip.on_announcement(a, &[hash]),
+            Some(NetworkMessage::GetTransactions(vec![hash]))
+        );
+        let fresh = gossip.on_bodies(a, vec![tx(1)]);
+        assert_eq!(fresh, vec![tx(1)]);
+        // Not served until admitted
+        assert!(!gossip.has_body(&hash));
+        let announcements = gossip.announce(tx(1), &[a, b]);
+        assert_eq!(
+            announcements,
+            vec![(b, NetworkMessage::NewTransactionHashes(vec![hash]))]
+        );
+        assert!(gossip.peer_knows(&b, &hash));
+
+        // Announcing a held transaction again sends nothing
+        assert!(gossip.announce(tx(1), &[a, b]).is_empty());
+        let metrics = gossip.metrics();
+        assert_eq!(metrics.announced, 1);
+        assert_eq!(metrics.announcements_suppressed, 1);
+        assert_eq!(metrics.fetched, 1);
+    }
+
+    #[test]
+    fn test_fetch_deduplicates_announcements_and_bodies() {
+        let clock = Arc::new(FakeClock::new());
+        let gossip =
+            TxGossip::new(GossipConfig::default()).with_clock(Arc::clone(&clock) as Arc<dyn Clock>);
+        let (a, b) = (peer(1), peer(2));
+        let hash = *tx(1).hash().as_bytes();
+
+        assert!(gossip.on_announcement(a, &[hash]).is_some());
+        // Already being fetched from `a`
+        assert_eq!(gossip.on_announcement(b, &[hash]), None);
+        // `a` did not answer in time, so `b` is asked
+        clock.advance(Duration::from_secs(6));
+        assert!(gossip.on_announcement(b, &[hash]).is_some());
+
+        assert_eq!(gossip.on_bodies(b, vec![tx(1)]).len(), 1);
+        gossip.announce(tx(1), &[]);
+        assert!(gossip.on_bodies(a, vec![tx(1)]).is_empty());
+        assert_eq!(gossip.on_announcement(a, &[hash]), None);
+
+        let metrics = gossip.metrics();
+        assert_eq!(metrics.fetched, 2);
+        assert_eq!(metrics.duplicate_announcements, 2);
+        assert_eq!(metrics.duplicate_bodies, 1);
+    }
+
+    #[test]
+    fn test_drops_unsolicited_and_rejected_bodies() {
+        let gossip = TxGossip::new(GossipConfig::default());
+        let (a, b) = (peer(1), peer(2));
+        let hash = *tx(1).hash().as_bytes();
+
+        assert!(gossip.on_bodies(a, vec![tx(1)]).is_empty());
+        assert!(!gossip.has_body(&hash));
+
+        // Fetched, then refused by the application
+        assert!(gossip.on_announcement(a, &[hash]).is_some());
+        assert_eq!(gossip.on_bodies(a, vec![tx(1)]), vec![tx(1)]);
+        gossip.reject(hash);
+        assert_eq!(gossip.on_announcement(b, &[hash]), None);
+        assert_eq!(gossip.on_request(b, &[hash]), None);
+
+        let metrics = gossip.metrics();
+        assert_eq!(metrics.unsolicited_bodies, 1);
+        assert_eq!(metrics.rejected, 1);
+    }
+
+    #[test]
+    fn test_serves_held_bodies() {
+        let config = GossipConfig {
+            max_bodies: 2,
+            ..Default::default()
+        };
+        let gossip = TxGossip::new(config);
+        let a = peer(1);
+        for nonce in 1..=3 {
+            let announcements = gossip.announce(tx(nonce), &[a]);
+            assert_eq!(announcements.len(), 1);
+        }
+
+        // The oldest body was evicted
+        let hashes: Vec<[u8; 32]> = (1..=3).map(|n| *tx(n).hash().as_bytes()).collect();
+        assert_eq!(
+            gossip.on_request(a, &hashes),
+            Some(NetworkMessage::Transactions(vec![tx(2), tx(3)]))
+        );
+        assert_eq!(gossip.on_request(a, &hashes[..1]), None);
+        assert_eq!(gossip.metrics().served, 2);
+    }
+
+    #[test]
+    fn test_known_cache_is_bounded() {
+        let mut known = BoundedSet::new(2);
+        assert!(known.insert([1u8; 32]));
+        assert!(!known.insert([1u8; 32]));
+        known.insert([2u8; 32]);
+        known.insert([3u8; 32]);
+        assert!(!known.contains(&[1u8; 32]));
+        assert!(known.contains(&[3u8; 32]));
+    }
+}
@@ -0,0 +1,328 @@
+//! Node health
+//!
+//! `NodeHealth` tells whether a node is taking part in the chain, not just
+//! whether its process is up. It is computed from the signals the node
+//! already produces: cache warm-up and sync progress, committed blocks,
+//! and consensus rounds that ended without a quorum of signatures. A
+//! validator only counts as participating while its last commit is recent,
+//! so a stalled chain shows even where nothing reports quorum failures. The
+//! RPC layer serves it on the health endpoints and as metrics, together
+//! with how far proposed block timestamps drift from the node's clock and
+//! how many transactions were deferred to a later block.
+
+use crate::SyncProgress;
+use bach_primitives::{system_clock, Clock};
+use std::sync::atomic::{AtomicBool, AtomicI64, AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+/// Consecutive heights without a signature quorum after which a node is
+/// degraded
+pub const DEFAULT_DEGRADED_AFTER: u64 = 3;
+
+/// Time without a committed block after which a validator no longer
+/// counts as participating
+pub const DEFAULT_STALE_AFTER: Duration = Duration::from_secs(60);
+
+/// How far a node takes part in the chain
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HealthStatus {
+    /// The process is up but neither syncing nor committing as a validator
+    Up,
+    /// Loading recent chain data into caches after a start, `remaining`
+    /// blocks to go
+    WarmingUp { remaining: u64 },
+    /// Catching up with peers, `behind` blocks from the sync target
+    Syncing { behind: u64 },
+    /// A validator that committed a block within the staleness bound
+    Participating,
+    /// Consensus failed to gather a signature quorum for
+    /// `quorum_failures` heights in a row
+    Degraded { quorum_failures: u64 },
+}
+
+impl HealthStatus {
+    /// Returns the status name.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Up => "up",
+            Self::WarmingUp { .. } => "warming_up",
+            Self::Syncing { .. } => "syncing",
+            Self::Participating => "participating",
+            Self::Degraded { .. } => "degraded",
+        }
+    }
+
+    /// Returns true if the node serves current chain data. Degraded nodes
+    /// do: their ledger is current, it just isn't advancing.
+    pub fn is_ready(&self) -> bool {
+        !matches!(self, Self::WarmingUp { .. } | Self::Syncing { .. })
+    }
+}
+
+/// Shared, lock-free health signals of a node.
+#[derive(Debug)]
+pub struct NodeHealth {
+    sync: Arc<SyncProgress>,
+    validator: AtomicBool,
+    head_height: AtomicU64,
+    committed_blocks: AtomicU64,
+    /// Microseconds from `started` to the last commit
+    last_commit: AtomicU64,
+    quorum_failures: AtomicU64,
+    proposal_backoff: AtomicU64,
+    clock_drift: AtomicI64,
+    timestamp_rejections: AtomicU64,
+    requeued_txs: AtomicU64,
+    warmup_remaining: AtomicU64,
+    degraded_after: u64,
+    stale_after: Duration,
+    clock: Arc<dyn Clock>,
+    started: Instant,
+}
+
+impl NodeHealth {
+    /// Creates health reading sync state from `sync`.
+    pub fn new(sync: Arc<SyncProgress>) -> Self {
+        let clock = system_clock();
+        Self {
+            sync,
+            validator: AtomicBool::new(false),
+            head_height: AtomicU64::new(0),
+            committed_blocks: AtomicU64::new(0),
+            last_commit: AtomicU64::new(0),
+            quorum_failures: AtomicU64::new(0),
+            proposal_backoff: AtomicU64::new(1),
+            clock_drift: AtomicI64::new(0),
+            timestamp_rejections: AtomicU64::new(0),
+            requeued_txs: AtomicU64::new(0),
+            warmup_remaining: AtomicU64::new(0),
+            degraded_after: DEFAULT_DEGRADED_AFTER,
+            stale_after: DEFAULT_STALE_AFTER,
+            started: clock.now(),
+            clock,
+        }
+    }
+
+    /// Measures the time since the last commit on `clock`.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.started = clock.now();
+        self.clock = clock;
+        self
+    }
+
+    /// Sets how long after its last commit a validator stops participating.
+    pub fn with_stale_after(mut self, stale_after: Duration) -> Self {
+        self.stale_after = stale_after;
+        self
+    }
+
+    fn elapsed(&self) -> Duration {
+        self.clock.now().saturating_duration_since(self.started)
+    }
+
+    /// Sets how many consecutive quorum failures make the node degraded.
+    pub fn with_degraded_after(mut self, failures: u64) -> Self {
+        self.degraded_after = failures.max(1);
+        self
+    }
+
+    /// Records whether the node is a validator.
+    pub fn set_validator(&self, validator: bool) {
+        self.validator.store(validator, Ordering::Relaxed);
+    }
+
+    /// Records that the block at `height` was committed.
+    pub fn record_commit(&self, height: u64) {
+        self.head_height.fetch_max(height, Ordering::Relaxed);
+        self.committed_blocks.fetch_add(1, Ordering::Relaxed);
+        let at = self.elapsed().as_micros() as u64;
+        self.last_commit.store(at, Ordering::Relaxed);
+        self.quorum_failures.store(0, Ordering::Relaxed);
+    }
+
+    /// Records that consensus gave up on a height without a signature
+    /// quorum.
+    pub fn record_quorum_failure(&self) {
+        self.quorum_failures.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Records the factor by which the proposer currently stretches its
+    /// proposal interval, 1 at full rate.
+    pub fn set_proposal_backoff(&self, factor: u64) {
+        self.proposal_backoff.store(factor.max(1), Ordering::Relaxed);
+    }
+
+    /// Returns the factor by which the proposal interval is stretched.
+    pub fn proposal_backoff(&self) -> u64 {
+        self.proposal_backoff.load(Ordering::Relaxed)
+    }
+
+    /// Records the timestamp drift of the last checked proposal in seconds,
+    /// positive if it was ahead of our clock, and how many proposals were
+    /// rejected for their timestamp.
+    pub fn set_clock_drift(&self, drift: i64, rejections: u64) {
+        self.clock_drift.store(drift, Ordering::Relaxed);
+        self.timestamp_rejections.store(rejections, Ordering::Relaxed);
+    }
+
+    /// Returns the timestamp drift of the last checked proposal in seconds.
+    pub fn clock_drift(&self) -> i64 {
+        self.clock_drift.load(Ordering::Relaxed)
+    }
+
+    /// Returns how many proposals were rejected for their timestamp.
+    pub fn timestamp_rejections(&self) -> u64 {
+        self.timestamp_rejections.load(Ordering::Relaxed)
+    }
+
+    /// Records that `count` pooled transactions went back to the pool
+    /// because the block they were proposed in timed out.
+    pub fn record_requeued_txs(&self, count: u64) {
+        self.requeued_txs.fetch_add(count, Ordering::Relaxed);
+    }
+
+    /// Returns how many transactions were returned to the pool after a
+    /// timeout.
+    pub fn requeued_txs(&self) -> u64 {
+        self.requeued_txs.load(Ordering::Relaxed)
+    }
+
+    /// Records how many blocks the startup cache warm-up still has to load,
+    /// 0 once it is done.
+    pub fn set_warmup_remaining(&self, blocks: u64) {
+        self.warmup_remaining.store(blocks, Ordering::Relaxed);
+    }
+
+    /// Returns how many blocks the cache warm-up still has to load.
+    pub fn warmup_remaining(&self) -> u64 {
+        self.warmup_remaining.load(Ordering::Relaxed)
+    }
+
+    /// Returns the height of the last committed block.
+    pub fn head_height(&self) -> u64 {
+        self.head_height.load(Ordering::Relaxed)
+    }
+
+    /// Returns the heights in a row that failed to reach a quorum.
+    pub fn quorum_failures(&self) -> u64 {
+        self.quorum_failures.load(Ordering::Relaxed)
+    }
+
+    /// Returns the time since the last commit, or None before the first.
+    pub fn since_last_commit(&self) -> Option<Duration> {
+        if self.committed_blocks.load(Ordering::Relaxed) == 0 {
+            return None;
+        }
+        let at = Duration::from_micros(self.last_commit.load(Ordering::Relaxed));
+        Some(self.elapsed().saturating_sub(at))
+    }
+
+    /// Returns true if the node is a validator.
+    pub fn is_validator(&self) -> bool {
+        self.validator.load(Ordering::Relaxed)
+    }
+
+    /// Returns the current status.
+    pub fn status(&self) -> HealthStatus {
+        let quorum_failures = self.quorum_failures();
+        if quorum_failures >= self.degraded_after {
+            return HealthStatus::Degraded { quorum_failures };
+        }
+        let remaining = self.warmup_remaining();
+        if remaining > 0 {
+            return HealthStatus::WarmingUp { remaining };
+        }
+        let sync = self.sync.status();
+        if sync.syncing {
+            return HealthStatus::Syncing {
+                behind: sync.remaining(),
+            };
+        }
+        let recent = self
+            .since_last_commit()
+            .is_some_and(|since| since < self.stale_after);
+        if self.is_validator() && recent {
+            return HealthStatus::Participating;
+        }
+        HealthStatus::Up
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_primitives::FakeClock;
+
+    #[test]
+    fn test_status_transitions() {
+        let sync = Arc::new(SyncProgress::new());
+        let health = NodeHealth::new(Arc::clone(&sync));
+        assert_eq!(health.status(), HealthStatus::Up);
+
+        sync.begin(10, 50);
+        sync.set_synced(20);
+        assert_eq!(health.status(), HealthStatus::Syncing { behind: 30 });
+        assert!(!health.status().is_ready());
+        sync.finish();
+
+        // Only validators that commit take part
+        health.record_commit(50);
+        assert_eq!(health.status(), HealthStatus::Up);
+        health.set_validator(true);
+        assert_eq!(health.status(), HealthStatus::Participating);
+        assert_eq!(health.head_height(), 50);
+    }
+
+    #[test]
+    fn test_warmup_delays_ready() {
+        let health = NodeHealth::new(Arc::new(SyncProgress::new()));
+        health.set_warmup_remaining(16);
+        let status = health.status();
+        assert_eq!(status, HealthStatus::WarmingUp { remaining: 16 });
+        assert_eq!(status.as_str(), "warming_up");
+        assert!(!status.is_ready());
+
+        health.set_warmup_remaining(0);
+        assert_eq!(health.status(), HealthStatus::Up);
+    }
+
+    #[test]
+    fn test_quorum_failures_degrade() {
+        let health = NodeHealth::new(Arc::new(SyncProgress::new())).with_degraded_after(2);
+        health.set_validator(true);
+        health.record_commit(1);
+
+        health.record_quorum_failure();
+        assert_eq!(health.status(), HealthStatus::Participating);
+        health.record_quorum_failure();
+        let status = health.status();
+        assert_eq!(status, HealthStatus::Degraded { quorum_failures: 2 });
+        assert_eq!(status.as_str(), "degraded");
+        assert!(status.is_ready());
+
+        health.record_commit(2);
+        assert_eq!(health.status(), HealthStatus::Participating);
+        assert_eq!(health.quorum_failures(), 0);
+    }
+
+    #[test]
+    fn test_participation_goes_stale() {
+        let clock = Arc::new(FakeClock::new());
+        let health = NodeHealth::new(Arc::new(SyncProgress::new()))
+            .with_clock(Arc::clone(&clock) as Arc<dyn Clock>)
+            .with_stale_after(Duration::from_secs(10));
+        health.set_validator(true);
+        assert_eq!(health.since_last_commit(), None);
+        health.record_commit(1);
+        clock.advance(Duration::from_secs(9));
+        assert_eq!(health.status(), HealthStatus::Participating);
+
+        // A chain that stops committing stops counting as participation
+        clock.advance(Duration::from_secs(1));
+        assert_eq!(health.since_last_commit(), Some(Duration::from_secs(10)));
+        assert_eq!(health.status(), HealthStatus::Up);
+        health.record_commit(2);
+        assert_eq!(health.status(), HealthStatus::Participating);
+    }
+}
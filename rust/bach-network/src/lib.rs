@@ -7,7 +7,19 @@
 //! - `PeerId`: 32-byte identifier derived from public key
 //! - `PeerInfo`: Information about a connected peer
 //! - `PeerManager`: Manages peer connections and discovery
+//! - `ClusterCapabilities`: Protocol features advertised by a node and its peers
+//! - `SeedSource`: Bootstrap endpoints given as addresses, DNS names or SRV names
 //! - `NetworkMessage`: Protocol messages for peer communication
+//! - `MessageCodec`: Length-prefixed framing, with zstd compression of large
+//!   transaction and block messages when both peers support it
+//! - `MessagePriority`: Delivery classes so consensus traffic preempts gossip
+//! - `RateLimiter`: Per-peer inbound rate limits by message class
+//! - `PeerScorer`: Penalizes misbehaving peers and keeps a persistent ban list
+//! - `PeerAllowlist`: Fixed peer set for static topology mode (no discovery)
+//! - `RevocationChecker`: Online key status checks with caching and a fail policy
+//! - `TxGossip`: Transaction hash announcements with on-demand body fetches
+//! - `SyncProgress`: Shared progress of a node catching up with its peers
+//! - `NodeHealth`: Whether a node is syncing, taking part in consensus or degraded
 //! - `NetworkService`: Main service handling connections and messaging
 //!
 //! # Example
@@ -25,13 +37,38 @@
 #![forbid(unsafe_code)]
 
 mod codec;
+mod discovery;
 mod error;
+mod gossip;
+mod health;
 mod message;
 mod peer;
+mod priority;
+mod revocation;
+mod scoring;
 mod service;
+mod sync;
+mod topology;
 
-pub use codec::MessageCodec;
+pub use codec::{CompressionConfig, MessageCodec};
+pub use discovery::{
+    resolve_seeds, resolve_seeds_with, SeedResolver, SeedSource, SrvRecord, SystemResolver,
+};
 pub use error::NetworkError;
-pub use message::{ConsensusMessage, NetworkMessage, PROTOCOL_VERSION};
-pub use peer::{PeerId, PeerInfo, PeerManager, PeerStatus};
+pub use gossip::{GossipConfig, GossipMetrics, TxGossip};
+pub use health::{HealthStatus, NodeHealth, DEFAULT_DEGRADED_AFTER};
+pub use message::{
+    ConsensusMessage, NetworkMessage, SerializableHeader, SerializableTransaction, CAP_HEADER_SYNC,
+    CAP_ZSTD, MAX_ADVERTISED_FEATURES, MAX_ADVERTISED_FEATURE_LEN, MIN_PROTOCOL_VERSION,
+    PROTOCOL_VERSION,
+};
+pub use peer::{ClusterCapabilities, PeerId, PeerInfo, PeerManager, PeerStatus};
+pub use priority::{MessagePriority, RateLimitConfig, RateLimiter};
+pub use revocation::{
+    KeyStatus, RevocationCheckConfig, RevocationCheckError, RevocationChecker, RevocationPolicy,
+    StatusResponder,
+};
+pub use scoring::{BanEntry, Misbehavior, PeerScorer, ScoringConfig};
 pub use service::{NetworkCommand, NetworkConfig, NetworkEvent, NetworkService};
+pub use sync::{SyncProgress, SyncStatus};
+pub use topology::{PeerAllowlist, StaticPeer};
@@ -1,13 +1,43 @@
 //! Network protocol messages
 
-use bach_primitives::H256;
+use bach_crypto::{keccak256, CryptoError, MemberSignature};
+use bach_primitives::{Address, H256, U256};
+use bach_types::Transaction;
 use serde::{Deserialize, Serialize};
 use serde_with::serde_as;
 
 use crate::peer::{PeerId, SerializablePeerInfo};
+use crate::priority::MessagePriority;
 
 /// Protocol version for compatibility checking.
-pub const PROTOCOL_VERSION: u32 = 1;
+///
+/// Version 2 added compact transaction announcements
+/// (`NewTransactionHashes`) and variable-length transaction signatures, so
+/// Ed25519 signatures (public key + signature) fit. Version 3 added
+/// capability flags to the handshake. Version 4 added the protocol features
+/// a node supports to the handshake and the responder's version to
+/// `HelloAck`. Messages added since are sent only to peers advertising the
+/// matching capability flag, so they don't need a new version.
+pub const PROTOCOL_VERSION: u32 = 4;
+
+/// Oldest protocol version this node still talks to. Versions from here to
+/// `PROTOCOL_VERSION` share the handshake layout; a connection speaks the
+/// lower of the two peers' versions.
+pub const MIN_PROTOCOL_VERSION: u32 = 4;
+
+/// Capability flag: the peer accepts zstd-compressed transaction and block
+/// messages.
+pub const CAP_ZSTD: u32 = 1 << 0;
+
+/// Capability flag: the peer understands block header requests
+/// (`GetBlockHeaders` and `BlockHeaders`) for header-first sync.
+pub const CAP_HEADER_SYNC: u32 = 1 << 1;
+
+/// Most protocol features a peer may advertise in the handshake.
+pub const MAX_ADVERTISED_FEATURES: usize = 64;
+
+/// Longest protocol feature name a peer may advertise.
+pub const MAX_ADVERTISED_FEATURE_LEN: usize = 64;
 
 /// Consensus-related messages.
 #[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
@@ -43,15 +73,60 @@ pub enum ConsensusMessage {
 }
 
 /// Serializable transaction for network transfer.
-#[serde_as]
 #[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
 pub struct SerializableTransaction {
     pub nonce: u64,
     pub to: Option<[u8; 20]>,
     pub value: [u8; 32],
+    pub gas: u64,
     pub data: Vec<u8>,
-    #[serde_as(as = "[_; 65]")]
-    pub signature: [u8; 65],
+    /// Encoded `bach_crypto::MemberSignature` (65 or 96 bytes)
+    pub signature: Vec<u8>,
+}
+
+impl SerializableTransaction {
+    /// Computes the transaction hash, matching `bach_types::Transaction::hash`.
+    pub fn hash(&self) -> H256 {
+        let mut data = Vec::new();
+        data.extend_from_slice(&self.nonce.to_be_bytes());
+        if let Some(addr) = &self.to {
+            data.push(1);
+            data.extend_from_slice(addr);
+        } else {
+            data.push(0);
+        }
+        data.extend_from_slice(&self.value);
+        data.extend_from_slice(&self.gas.to_be_bytes());
+        data.extend_from_slice(&self.data);
+        data.extend_from_slice(&self.signature);
+        keccak256(&data)
+    }
+
+    /// Decodes the chain transaction; fails if the signature doesn't
+    /// decode.
+    pub fn to_transaction(&self) -> Result<Transaction, CryptoError> {
+        Ok(Transaction {
+            nonce: self.nonce,
+            to: self.to.map(Address::from),
+            value: U256::from_be_bytes(self.value),
+            gas: self.gas,
+            data: self.data.clone(),
+            signature: MemberSignature::from_bytes(&self.signature)?,
+        })
+    }
+}
+
+impl From<&Transaction> for SerializableTransaction {
+    fn from(tx: &Transaction) -> Self {
+        Self {
+            nonce: tx.nonce,
+            to: tx.to.map(|address| *address.as_bytes()),
+            value: tx.value.to_be_bytes(),
+            gas: tx.gas,
+            data: tx.data.clone(),
+            signature: tx.signature.to_bytes(),
+        }
+    }
 }
 
 /// Serializable block for network transfer.
@@ -63,6 +138,22 @@ pub struct SerializableBlock {
     pub timestamp: u64,
 }
 
+/// Serializable block header for header-first sync.
+///
+/// `hash` and `legacy_hash` are the serving peer's claims; the receiver
+/// recomputes them from the header fields and, for the legacy hash of a
+/// transition block, from the body.
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct SerializableHeader {
+    pub height: u64,
+    pub parent_hash: [u8; 32],
+    pub timestamp: u64,
+    pub transactions_hash: [u8; 32],
+    pub state_root: [u8; 32],
+    pub hash: [u8; 32],
+    pub legacy_hash: Option<[u8; 32]>,
+}
+
 /// Network protocol messages.
 #[serde_as]
 #[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
@@ -79,15 +170,25 @@ pub enum NetworkMessage {
         /// Sender's public key (64 bytes, uncompressed without prefix)
         #[serde_as(as = "[_; 64]")]
         public_key: [u8; 64],
+        /// Sender's capability flags (`CAP_*`)
+        capabilities: u32,
+        /// Protocol features the sender supports
+        features: Vec<String>,
     },
 
     /// Handshake acknowledgment
     HelloAck {
+        /// Responder's protocol version
+        version: u32,
         /// Responder's peer ID
         peer_id: [u8; 32],
         /// Responder's public key
         #[serde_as(as = "[_; 64]")]
         public_key: [u8; 64],
+        /// Responder's capability flags (`CAP_*`)
+        capabilities: u32,
+        /// Protocol features the responder supports
+        features: Vec<String>,
     },
 
     // ========== Peer Discovery ==========
@@ -107,6 +208,10 @@ pub enum NetworkMessage {
     /// Response with requested transactions
     Transactions(Vec<SerializableTransaction>),
 
+    /// Announce new transactions by hash; peers fetch unknown bodies with
+    /// `GetTransactions`
+    NewTransactionHashes(Vec<[u8; 32]>),
+
     // ========== Block Propagation ==========
     /// Announce a new block
     NewBlock(SerializableBlock),
@@ -126,6 +231,17 @@ pub enum NetworkMessage {
         hash: [u8; 32],
     },
 
+    /// Request block headers by height range (`CAP_HEADER_SYNC` peers
+    /// only)
+    GetBlockHeaders {
+        start: u64,
+        count: u64,
+    },
+
+    /// Response with requested block headers (`CAP_HEADER_SYNC` peers
+    /// only)
+    BlockHeaders(Vec<SerializableHeader>),
+
     // ========== Consensus ==========
     /// Consensus protocol message
     Consensus(ConsensusMessage),
@@ -154,10 +270,13 @@ impl NetworkMessage {
             Self::NewTransaction(_) => "NewTransaction",
             Self::GetTransactions(_) => "GetTransactions",
             Self::Transactions(_) => "Transactions",
+            Self::NewTransactionHashes(_) => "NewTransactionHashes",
             Self::NewBlock(_) => "NewBlock",
             Self::GetBlocks { .. } => "GetBlocks",
             Self::Blocks(_) => "Blocks",
             Self::NewBlockHash { .. } => "NewBlockHash",
+            Self::GetBlockHeaders { .. } => "GetBlockHeaders",
+            Self::BlockHeaders(_) => "BlockHeaders",
             Self::Consensus(_) => "Consensus",
             Self::Ping(_) => "Ping",
             Self::Pong(_) => "Pong",
@@ -165,24 +284,88 @@ impl NetworkMessage {
         }
     }
 
+    /// Returns the delivery class used for queueing and rate limiting.
+    pub fn priority(&self) -> MessagePriority {
+        match self {
+            Self::Consensus(_) => MessagePriority::Consensus,
+            Self::Hello { .. }
+            | Self::HelloAck { .. }
+            | Self::Ping(_)
+            | Self::Pong(_)
+            | Self::Disconnect { .. } => MessagePriority::Control,
+            Self::NewBlock(_) | Self::NewBlockHash { .. } => MessagePriority::Normal,
+            Self::GetBlocks { .. }
+            | Self::Blocks(_)
+            | Self::GetBlockHeaders { .. }
+            | Self::BlockHeaders(_) => MessagePriority::Sync,
+            Self::GetPeers
+            | Self::Peers(_)
+            | Self::NewTransaction(_)
+            | Self::GetTransactions(_)
+            | Self::Transactions(_)
+            | Self::NewTransactionHashes(_) => MessagePriority::Bulk,
+        }
+    }
+
+    /// Returns the capability flag a peer must advertise to be sent this
+    /// message, or 0 if every peer understands it.
+    pub fn required_capability(&self) -> u32 {
+        match self {
+            Self::GetBlockHeaders { .. } | Self::BlockHeaders(_) => CAP_HEADER_SYNC,
+            _ => 0,
+        }
+    }
+
+    /// Returns true for the transaction and block messages that may be
+    /// compressed on the wire.
+    pub fn is_compressible(&self) -> bool {
+        matches!(
+            self,
+            Self::NewTransaction(_) | Self::Transactions(_) | Self::NewBlock(_) | Self::Blocks(_)
+        )
+    }
+
     /// Creates a Hello message.
-    pub fn hello(peer_id: PeerId, genesis_hash: H256, public_key: [u8; 64]) -> Self {
+    pub fn hello(
+        peer_id: PeerId,
+        genesis_hash: H256,
+        public_key: [u8; 64],
+        capabilities: u32,
+        features: Vec<String>,
+    ) -> Self {
         Self::Hello {
             version: PROTOCOL_VERSION,
             peer_id: peer_id.0,
             genesis_hash: *genesis_hash.as_bytes(),
             public_key,
+            capabilities,
+            features,
         }
     }
 
     /// Creates a HelloAck message.
-    pub fn hello_ack(peer_id: PeerId, public_key: [u8; 64]) -> Self {
+    pub fn hello_ack(
+        peer_id: PeerId,
+        public_key: [u8; 64],
+        capabilities: u32,
+        features: Vec<String>,
+    ) -> Self {
         Self::HelloAck {
+            version: PROTOCOL_VERSION,
             peer_id: peer_id.0,
             public_key,
+            capabilities,
+            features,
         }
     }
 
+    /// Returns the version to speak with a peer at `peer_version`: the lower
+    /// of the two, or None if the peer is outside the supported range.
+    pub fn negotiate_version(peer_version: u32) -> Option<u32> {
+        let version = peer_version.min(PROTOCOL_VERSION);
+        (version >= MIN_PROTOCOL_VERSION).then_some(version)
+    }
+
     /// Creates a Ping message with the current timestamp.
     pub fn ping() -> Self {
         use std::time::{SystemTime, UNIX_EPOCH};
@@ -216,24 +399,86 @@ mod tests {
         assert_eq!(NetworkMessage::Ping(0).name(), "Ping");
     }
 
+    #[test]
+    fn test_message_priority() {
+        let vote = NetworkMessage::Consensus(ConsensusMessage::VoteRequest { height: 1, round: 0 });
+        assert_eq!(vote.priority(), MessagePriority::Consensus);
+        assert_eq!(NetworkMessage::Ping(0).priority(), MessagePriority::Control);
+        assert_eq!(
+            NetworkMessage::NewBlockHash { height: 1, hash: [0u8; 32] }.priority(),
+            MessagePriority::Normal
+        );
+        assert_eq!(
+            NetworkMessage::GetBlocks { start: 1, count: 10 }.priority(),
+            MessagePriority::Sync
+        );
+        assert_eq!(NetworkMessage::GetTransactions(vec![]).priority(), MessagePriority::Bulk);
+    }
+
+    #[test]
+    fn test_transaction_hash_matches_chain_hash() {
+        let key = bach_crypto::PrivateKey::random();
+        let to = bach_primitives::Address::from([9u8; 20]);
+        let value = bach_primitives::U256::from_u64(7);
+        let signature = key.sign(&H256::zero());
+        let tx = bach_types::Transaction::new(3, Some(to), value, vec![1, 2], signature)
+            .with_gas(50_000);
+        let wire = SerializableTransaction::from(&tx);
+        assert_eq!(wire.hash(), tx.hash());
+        assert_eq!(wire.to_transaction().unwrap(), tx);
+    }
+
     #[test]
     fn test_hello_message() {
         let peer_id = PeerId::from_bytes([1u8; 32]);
         let genesis = H256::from([2u8; 32]);
         let pubkey = [3u8; 64];
 
-        let msg = NetworkMessage::hello(peer_id, genesis, pubkey);
+        let features = vec!["fast-sync".to_string()];
+        let msg = NetworkMessage::hello(peer_id, genesis, pubkey, CAP_ZSTD, features.clone());
         match msg {
-            NetworkMessage::Hello { version, peer_id: pid, genesis_hash, public_key } => {
+            NetworkMessage::Hello {
+                version,
+                peer_id: pid,
+                genesis_hash,
+                public_key,
+                capabilities,
+                features: advertised,
+            } => {
                 assert_eq!(version, PROTOCOL_VERSION);
                 assert_eq!(pid, [1u8; 32]);
                 assert_eq!(genesis_hash, [2u8; 32]);
                 assert_eq!(public_key, [3u8; 64]);
+                assert_eq!(capabilities, CAP_ZSTD);
+                assert_eq!(advertised, features);
             }
             _ => panic!("wrong message type"),
         }
     }
 
+    #[test]
+    fn test_negotiate_version() {
+        assert_eq!(NetworkMessage::negotiate_version(PROTOCOL_VERSION), Some(PROTOCOL_VERSION));
+        assert_eq!(
+            NetworkMessage::negotiate_version(MIN_PROTOCOL_VERSION),
+            Some(MIN_PROTOCOL_VERSION)
+        );
+        // Newer peers talk at our version and gate the rest on capabilities
+        assert_eq!(
+            NetworkMessage::negotiate_version(PROTOCOL_VERSION + 3),
+            Some(PROTOCOL_VERSION)
+        );
+        assert_eq!(NetworkMessage::negotiate_version(MIN_PROTOCOL_VERSION - 1), None);
+    }
+
+    #[test]
+    fn test_required_capability() {
+        let request = NetworkMessage::GetBlockHeaders { start: 1, count: 8 };
+        assert_eq!(request.required_capability(), CAP_HEADER_SYNC);
+        assert_eq!(NetworkMessage::BlockHeaders(vec![]).required_capability(), CAP_HEADER_SYNC);
+        assert_eq!(NetworkMessage::GetBlocks { start: 1, count: 8 }.required_capability(), 0);
+    }
+
     #[test]
     fn test_ping_pong() {
         let ping = NetworkMessage::ping();
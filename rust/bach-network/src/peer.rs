@@ -1,12 +1,17 @@
 //! Peer management and discovery
 
 use bach_crypto::{keccak256, PublicKey};
+use bach_primitives::{system_clock, Clock};
 use parking_lot::RwLock;
 use serde::{Deserialize, Serialize};
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap};
 use std::net::SocketAddr;
+use std::sync::Arc;
 use std::time::{Duration, Instant};
 
+use crate::scoring::PeerScorer;
+use crate::topology::PeerAllowlist;
+
 /// A 32-byte peer identifier derived from the public key.
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
 pub struct PeerId(pub [u8; 32]);
@@ -73,6 +78,8 @@ pub struct PeerInfo {
     pub last_seen: Instant,
     /// Protocol version reported by peer
     pub version: Option<u32>,
+    /// Protocol features the peer advertised in the handshake
+    pub features: Vec<String>,
     /// Number of failed connection attempts
     pub failed_attempts: u32,
     /// Last connection failure time
@@ -80,8 +87,8 @@ pub struct PeerInfo {
 }
 
 impl PeerInfo {
-    /// Creates new peer info for an outgoing connection.
-    pub fn new_outgoing(address: SocketAddr) -> Self {
+    /// Creates new peer info for an outgoing connection opened at `now`.
+    pub fn new_outgoing(address: SocketAddr, now: Instant) -> Self {
         // Generate temporary ID from address until handshake completes
         let mut id_bytes = [0u8; 32];
         let addr_bytes = format!("{}", address);
@@ -93,33 +100,40 @@ impl PeerInfo {
             address,
             public_key: None,
             status: PeerStatus::Connecting,
-            last_seen: Instant::now(),
+            last_seen: now,
             version: None,
+            features: Vec::new(),
             failed_attempts: 0,
             last_failure: None,
         }
     }
 
-    /// Creates new peer info for an incoming connection.
-    pub fn new_incoming(address: SocketAddr) -> Self {
-        let mut info = Self::new_outgoing(address);
+    /// Creates new peer info for an incoming connection accepted at `now`.
+    pub fn new_incoming(address: SocketAddr, now: Instant) -> Self {
+        let mut info = Self::new_outgoing(address, now);
         info.status = PeerStatus::Connected;
         info
     }
 
-    /// Updates the peer with handshake information.
-    pub fn complete_handshake(&mut self, id: PeerId, public_key: PublicKey, version: u32) {
+    /// Updates the peer with handshake information received at `now`.
+    pub fn complete_handshake(
+        &mut self,
+        id: PeerId,
+        public_key: PublicKey,
+        version: u32,
+        now: Instant,
+    ) {
         self.id = id;
         self.public_key = Some(public_key);
         self.version = Some(version);
         self.status = PeerStatus::Active;
-        self.last_seen = Instant::now();
+        self.last_seen = now;
     }
 
-    /// Records a failed connection attempt.
-    pub fn record_failure(&mut self) {
+    /// Records a connection attempt that failed at `now`.
+    pub fn record_failure(&mut self, now: Instant) {
         self.failed_attempts += 1;
-        self.last_failure = Some(Instant::now());
+        self.last_failure = Some(now);
     }
 
     /// Returns the backoff duration before next connection attempt.
@@ -129,11 +143,11 @@ impl PeerInfo {
         base * factor
     }
 
-    /// Returns true if enough time has passed since the last failure.
-    pub fn can_retry(&self) -> bool {
+    /// Returns true if enough time has passed by `now` since the last failure.
+    pub fn can_retry(&self, now: Instant) -> bool {
         match self.last_failure {
             None => true,
-            Some(t) => t.elapsed() >= self.backoff_duration(),
+            Some(t) => now.saturating_duration_since(t) >= self.backoff_duration(),
         }
     }
 }
@@ -156,6 +170,37 @@ impl From<&PeerInfo> for SerializablePeerInfo {
     }
 }
 
+/// Protocol features advertised across the local node and its active
+/// peers.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ClusterCapabilities {
+    /// Nodes counted: the local node and its active peers
+    pub nodes: usize,
+    /// Features the local node supports
+    pub local: Vec<String>,
+    /// Features advertised by each active peer
+    pub peers: Vec<(PeerId, Vec<String>)>,
+}
+
+impl ClusterCapabilities {
+    /// Returns the number of nodes advertising each feature.
+    pub fn feature_counts(&self) -> BTreeMap<&str, usize> {
+        let mut counts = BTreeMap::new();
+        let advertised = std::iter::once(&self.local).chain(self.peers.iter().map(|(_, f)| f));
+        for features in advertised {
+            for feature in features {
+                *counts.entry(feature.as_str()).or_default() += 1;
+            }
+        }
+        counts
+    }
+
+    /// Returns true if every counted node advertises `feature`.
+    pub fn supported_by_all(&self, feature: &str) -> bool {
+        self.feature_counts().get(feature) == Some(&self.nodes)
+    }
+}
+
 /// Manages peer connections and discovery.
 pub struct PeerManager {
     /// Known peers by ID
@@ -168,6 +213,14 @@ pub struct PeerManager {
     bootstrap_nodes: Vec<SocketAddr>,
     /// Our peer ID
     local_id: Option<PeerId>,
+    /// Protocol features we advertise
+    local_features: Vec<String>,
+    /// Peer scores and bans
+    scorer: PeerScorer,
+    /// Allowed peers in static topology mode (None for dynamic discovery)
+    allowlist: RwLock<Option<PeerAllowlist>>,
+    /// Time source for peer liveness
+    clock: Arc<dyn Clock>,
 }
 
 impl PeerManager {
@@ -179,9 +232,29 @@ impl PeerManager {
             max_peers,
             bootstrap_nodes,
             local_id: None,
+            local_features: Vec::new(),
+            scorer: PeerScorer::default(),
+            allowlist: RwLock::new(None),
+            clock: system_clock(),
         }
     }
 
+    /// Uses `clock` to track when peers were last seen.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Replaces the peer scorer.
+    pub fn set_scorer(&mut self, scorer: PeerScorer) {
+        self.scorer = scorer;
+    }
+
+    /// Returns the peer scorer.
+    pub fn scorer(&self) -> &PeerScorer {
+        &self.scorer
+    }
+
     /// Sets the local peer ID.
     pub fn set_local_id(&mut self, id: PeerId) {
         self.local_id = Some(id);
@@ -192,6 +265,48 @@ impl PeerManager {
         self.local_id
     }
 
+    /// Sets the protocol features we advertise.
+    pub fn set_local_features(&mut self, features: Vec<String>) {
+        self.local_features = features;
+    }
+
+    /// Returns the protocol features we advertise.
+    pub fn local_features(&self) -> &[String] {
+        &self.local_features
+    }
+
+    /// Switches to static topology with the given allowlist, or back to
+    /// dynamic discovery with None.
+    pub fn set_allowlist(&self, allowlist: Option<PeerAllowlist>) {
+        *self.allowlist.write() = allowlist;
+    }
+
+    /// Returns the current allowlist, if in static topology mode.
+    pub fn allowlist(&self) -> Option<PeerAllowlist> {
+        self.allowlist.read().clone()
+    }
+
+    /// Returns true if running in static topology mode.
+    pub fn is_static(&self) -> bool {
+        self.allowlist.read().is_some()
+    }
+
+    /// Returns true if a node ID may connect. Always true in dynamic mode.
+    pub fn is_allowed(&self, id: &PeerId) -> bool {
+        match &*self.allowlist.read() {
+            Some(list) => list.contains(id),
+            None => true,
+        }
+    }
+
+    /// Returns active peers that are not on the allowlist.
+    pub fn disallowed_peers(&self) -> Vec<PeerId> {
+        self.active_peers()
+            .into_iter()
+            .filter(|id| !self.is_allowed(id))
+            .collect()
+    }
+
     /// Adds a new peer (before handshake completes).
     pub fn add_peer(&self, info: PeerInfo) -> Result<(), &'static str> {
         let mut peers = self.peers.write();
@@ -222,11 +337,33 @@ impl PeerManager {
 
         if let Some(mut info) = peers.remove(&old_id) {
             by_addr.insert(info.address, new_id);
-            info.complete_handshake(new_id, public_key, version);
+            info.complete_handshake(new_id, public_key, version, self.clock.now());
             peers.insert(new_id, info);
         }
     }
 
+    /// Records the protocol features a peer advertised.
+    pub fn set_peer_features(&self, id: &PeerId, features: Vec<String>) {
+        if let Some(peer) = self.peers.write().get_mut(id) {
+            peer.features = features;
+        }
+    }
+
+    /// Returns the protocol features advertised by us and our active peers.
+    pub fn cluster_capabilities(&self) -> ClusterCapabilities {
+        let mut peers: Vec<_> = self.peers.read()
+            .values()
+            .filter(|p| p.status == PeerStatus::Active)
+            .map(|p| (p.id, p.features.clone()))
+            .collect();
+        peers.sort_by_key(|(id, _)| *id.as_bytes());
+        ClusterCapabilities {
+            nodes: peers.len() + 1,
+            local: self.local_features.clone(),
+            peers,
+        }
+    }
+
     /// Removes a peer.
     pub fn remove_peer(&self, id: &PeerId) {
         let mut peers = self.peers.write();
@@ -250,7 +387,7 @@ impl PeerManager {
     /// Updates last seen time for a peer.
     pub fn touch_peer(&self, id: &PeerId) {
         if let Some(peer) = self.peers.write().get_mut(id) {
-            peer.last_seen = Instant::now();
+            peer.last_seen = self.clock.now();
         }
     }
 
@@ -271,8 +408,11 @@ impl PeerManager {
             .count()
     }
 
-    /// Returns all peer info for peer exchange.
+    /// Returns all peer info for peer exchange (none in static topology mode).
     pub fn get_peers_for_exchange(&self) -> Vec<SerializablePeerInfo> {
+        if self.is_static() {
+            return Vec::new();
+        }
         self.peers.read()
             .values()
             .filter(|p| p.status == PeerStatus::Active)
@@ -285,13 +425,17 @@ impl PeerManager {
         &self.bootstrap_nodes
     }
 
-    /// Returns addresses to connect to (bootstrap nodes not yet connected).
+    /// Returns addresses to connect to (bootstrap nodes, or allowlisted
+    /// peers in static topology mode, not yet connected).
     pub fn get_connectable_addresses(&self) -> Vec<SocketAddr> {
+        let candidates = match &*self.allowlist.read() {
+            Some(list) => list.addresses(),
+            None => self.bootstrap_nodes.clone(),
+        };
         let by_addr = self.peers_by_addr.read();
-        self.bootstrap_nodes
-            .iter()
+        candidates
+            .into_iter()
             .filter(|addr| !by_addr.contains_key(addr))
-            .copied()
             .collect()
     }
 
@@ -302,9 +446,13 @@ impl PeerManager {
 
     /// Returns peers that have been inactive for too long.
     pub fn stale_peers(&self, timeout: Duration) -> Vec<PeerId> {
+        let now = self.clock.now();
         self.peers.read()
             .values()
-            .filter(|p| p.status == PeerStatus::Active && p.last_seen.elapsed() > timeout)
+            .filter(|p| {
+                p.status == PeerStatus::Active
+                    && now.saturating_duration_since(p.last_seen) > timeout
+            })
             .map(|p| p.id)
             .collect()
     }
@@ -322,6 +470,7 @@ impl std::fmt::Debug for PeerManager {
             .field("peer_count", &peers.len())
             .field("max_peers", &self.max_peers)
             .field("bootstrap_nodes", &self.bootstrap_nodes.len())
+            .field("scorer", &self.scorer)
             .finish()
     }
 }
@@ -329,6 +478,7 @@ impl std::fmt::Debug for PeerManager {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use bach_primitives::FakeClock;
 
     #[test]
     fn test_peer_id_from_bytes() {
@@ -348,20 +498,22 @@ mod tests {
 
     #[test]
     fn test_peer_info_backoff() {
-        let mut info = PeerInfo::new_outgoing("127.0.0.1:8080".parse().unwrap());
-        assert!(info.can_retry());
+        let now = Instant::now();
+        let mut info = PeerInfo::new_outgoing("127.0.0.1:8080".parse().unwrap(), now);
+        assert!(info.can_retry(now));
 
-        info.record_failure();
+        info.record_failure(now);
         assert_eq!(info.failed_attempts, 1);
         // Just after failure, should need to wait
-        assert!(!info.can_retry());
+        assert!(!info.can_retry(now));
+        assert!(info.can_retry(now + info.backoff_duration()));
     }
 
     #[test]
     fn test_peer_manager_add_remove() {
         let manager = PeerManager::new(10, vec![]);
         let addr: SocketAddr = "127.0.0.1:8080".parse().unwrap();
-        let info = PeerInfo::new_incoming(addr);
+        let info = PeerInfo::new_incoming(addr, Instant::now());
         let id = info.id;
 
         manager.add_peer(info).unwrap();
@@ -379,15 +531,86 @@ mod tests {
         // Add two peers successfully
         for i in 0..2 {
             let addr: SocketAddr = format!("127.0.0.1:808{}", i).parse().unwrap();
-            let mut info = PeerInfo::new_incoming(addr);
+            let mut info = PeerInfo::new_incoming(addr, Instant::now());
             info.status = PeerStatus::Active;
             manager.add_peer(info).unwrap();
         }
 
         // Third should fail
         let addr: SocketAddr = "127.0.0.1:8082".parse().unwrap();
-        let mut info = PeerInfo::new_incoming(addr);
+        let mut info = PeerInfo::new_incoming(addr, Instant::now());
         info.status = PeerStatus::Active;
         assert!(manager.add_peer(info).is_err());
     }
+
+    #[test]
+    fn test_peer_manager_static_topology() {
+        let bootstrap: SocketAddr = "127.0.0.1:9000".parse().unwrap();
+        let manager = PeerManager::new(10, vec![bootstrap]);
+        let allowed = PeerId::from_bytes([1u8; 32]);
+        let unknown = PeerId::from_bytes([2u8; 32]);
+        assert!(manager.is_allowed(&unknown));
+
+        let static_addr: SocketAddr = "127.0.0.1:9001".parse().unwrap();
+        manager.set_allowlist(Some(PeerAllowlist::new(vec![
+            crate::topology::StaticPeer::new("org1", allowed, static_addr),
+        ])));
+
+        assert!(manager.is_static());
+        assert!(manager.is_allowed(&allowed));
+        assert!(!manager.is_allowed(&unknown));
+        assert_eq!(manager.get_connectable_addresses(), vec![static_addr]);
+
+        manager.set_allowlist(None);
+        assert!(manager.is_allowed(&unknown));
+        assert_eq!(manager.get_connectable_addresses(), vec![bootstrap]);
+    }
+
+    #[test]
+    fn test_stale_peers_on_clock() {
+        let clock = FakeClock::new();
+        let manager = PeerManager::new(10, vec![]).with_clock(Arc::new(clock.clone()));
+        let mut ids = Vec::new();
+        for i in 0..2 {
+            let addr: SocketAddr = format!("127.0.0.1:808{}", i).parse().unwrap();
+            let mut info = PeerInfo::new_incoming(addr, clock.now());
+            info.status = PeerStatus::Active;
+            ids.push(info.id);
+            manager.add_peer(info).unwrap();
+        }
+
+        clock.advance(Duration::from_secs(60));
+        manager.touch_peer(&ids[1]);
+        assert!(manager.stale_peers(Duration::from_secs(90)).is_empty());
+
+        clock.advance(Duration::from_secs(31));
+        assert_eq!(manager.stale_peers(Duration::from_secs(90)), vec![ids[0]]);
+    }
+
+    #[test]
+    fn test_cluster_capabilities() {
+        let mut manager = PeerManager::new(10, vec![]);
+        manager.set_local_features(vec!["a".to_string(), "b".to_string()]);
+        let mut ids = Vec::new();
+        for (i, features) in [vec!["a"], vec!["a", "b"], vec!["b"]].into_iter().enumerate() {
+            let addr: SocketAddr = format!("127.0.0.1:808{}", i).parse().unwrap();
+            let mut info = PeerInfo::new_incoming(addr, Instant::now());
+            // The last peer's handshake is still pending
+            if i < 2 {
+                info.status = PeerStatus::Active;
+            }
+            ids.push(info.id);
+            manager.add_peer(info).unwrap();
+            manager.set_peer_features(&ids[i], features.iter().map(|f| f.to_string()).collect());
+        }
+
+        let capabilities = manager.cluster_capabilities();
+        assert_eq!(capabilities.nodes, 3);
+        assert_eq!(capabilities.peers.len(), 2);
+        assert_eq!(capabilities.feature_counts().get("a"), Some(&3));
+        assert_eq!(capabilities.feature_counts().get("b"), Some(&2));
+        assert!(capabilities.supported_by_all("a"));
+        assert!(!capabilities.supported_by_all("b"));
+        assert!(!capabilities.supported_by_all("c"));
+    }
 }
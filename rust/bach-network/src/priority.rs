@@ -0,0 +1,389 @@
+//! Message priority classes and per-peer rate limiting
+
+use bach_primitives::{Clock, TokenBucket};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tokio::sync::mpsc;
+
+use crate::message::NetworkMessage;
+
+/// Delivery class of a network message.
+///
+/// Higher classes are always written to a peer before lower ones, so bulk
+/// gossip cannot delay consensus traffic.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub enum MessagePriority {
+    /// Transaction gossip and peer exchange
+    Bulk,
+    /// Block and header sync requests and responses
+    Sync,
+    /// Block propagation
+    Normal,
+    /// Handshakes, pings and disconnects
+    Control,
+    /// Consensus votes and proposals
+    Consensus,
+}
+
+/// Per-peer rate limits for inbound messages.
+///
+/// Consensus-class messages are never rate limited. Connection control has
+/// its own bucket, so a peer flooding pings can't fill the consensus queue.
+#[derive(Debug, Clone, PartialEq)]
+pub struct RateLimitConfig {
+    /// Sustained control-class messages per second
+    pub control_per_sec: f64,
+    /// Burst size for control-class messages
+    pub control_burst: u32,
+    /// Sustained block-class messages per second
+    pub normal_per_sec: f64,
+    /// Burst size for block-class messages
+    pub normal_burst: u32,
+    /// Sustained sync-class messages per second
+    pub sync_per_sec: f64,
+    /// Burst size for sync-class messages
+    pub sync_burst: u32,
+    /// Sustained bulk-class messages per second
+    pub bulk_per_sec: f64,
+    /// Burst size for bulk-class messages
+    pub bulk_burst: u32,
+    /// Outbound queue capacity per class
+    pub queue_capacity: usize,
+    /// Recently dropped messages that count as one misbehavior report
+    pub drop_score_threshold: f64,
+    /// Time for the dropped message score to halve
+    pub drop_score_half_life: Duration,
+}
+
+impl Default for RateLimitConfig {
+    fn default() -> Self {
+        Self {
+            control_per_sec: 10.0,
+            control_burst: 20,
+            normal_per_sec: 50.0,
+            normal_burst: 100,
+            sync_per_sec: 100.0,
+            sync_burst: 200,
+            bulk_per_sec: 500.0,
+            bulk_burst: 1000,
+            queue_capacity: 256,
+            drop_score_threshold: 50.0,
+            drop_score_half_life: Duration::from_secs(10),
+        }
+    }
+}
+
+/// Inbound rate limiter for a single peer.
+///
+/// Dropped messages also add to a drop score that halves every
+/// `drop_score_half_life`, so a short burst over the limit fades while
+/// sustained flooding reaches `drop_score_threshold` and is reported.
+#[derive(Debug, Clone)]
+pub struct RateLimiter {
+    clock: Arc<dyn Clock>,
+    control: TokenBucket,
+    normal: TokenBucket,
+    sync: TokenBucket,
+    bulk: TokenBucket,
+    dropped: u64,
+    drop_score: f64,
+    drop_score_at: Instant,
+    drop_score_threshold: f64,
+    drop_score_half_life: Duration,
+}
+
+impl RateLimiter {
+    /// Creates a limiter with full buckets, refilled as time passes on
+    /// `clock`.
+    pub fn new(config: &RateLimitConfig, clock: Arc<dyn Clock>) -> Self {
+        let now = clock.now();
+        Self {
+            clock,
+            control: TokenBucket::new(config.control_per_sec, config.control_burst, now),
+            normal: TokenBucket::new(config.normal_per_sec, config.normal_burst, now),
+            sync: TokenBucket::new(config.sync_per_sec, config.sync_burst, now),
+            bulk: TokenBucket::new(config.bulk_per_sec, config.bulk_burst, now),
+            dropped: 0,
+            drop_score: 0.0,
+            drop_score_at: now,
+            drop_score_threshold: config.drop_score_threshold,
+            drop_score_half_life: config.drop_score_half_life,
+        }
+    }
+
+    /// Returns true if a message of this class may be processed now.
+    pub fn allow(&mut self, priority: MessagePriority) -> bool {
+        let now = self.clock.now();
+        let allowed = match priority {
+            MessagePriority::Consensus => true,
+            MessagePriority::Control => self.control.try_take(now),
+            MessagePriority::Normal => self.normal.try_take(now),
+            MessagePriority::Sync => self.sync.try_take(now),
+            MessagePriority::Bulk => self.bulk.try_take(now),
+        };
+        if !allowed {
+            self.dropped += 1;
+            self.drop_score = self.drop_score_at(now) + 1.0;
+            self.drop_score_at = now;
+        }
+        allowed
+    }
+
+    /// Returns the number of messages rejected so far.
+    pub fn dropped(&self) -> u64 {
+        self.dropped
+    }
+
+    /// Returns true, and starts the drop score over, once recent drops
+    /// reach the threshold. The caller then reports the peer.
+    pub fn take_report(&mut self) -> bool {
+        let now = self.clock.now();
+        if self.drop_score_at(now) < self.drop_score_threshold {
+            return false;
+        }
+        self.drop_score = 0.0;
+        self.drop_score_at = now;
+        true
+    }
+
+    /// Returns the drop score decayed to `now`.
+    fn drop_score_at(&self, now: Instant) -> f64 {
+        let half_life = self.drop_score_half_life.as_secs_f64();
+        if half_life <= 0.0 {
+            return 0.0;
+        }
+        let elapsed = now.saturating_duration_since(self.drop_score_at).as_secs_f64();
+        self.drop_score * 0.5f64.powf(elapsed / half_life)
+    }
+}
+
+/// Outbound queues for one peer connection, one per priority class.
+#[derive(Debug, Clone)]
+pub(crate) struct PrioritySender {
+    consensus: mpsc::Sender<NetworkMessage>,
+    control: mpsc::Sender<NetworkMessage>,
+    normal: mpsc::Sender<NetworkMessage>,
+    sync: mpsc::Sender<NetworkMessage>,
+    bulk: mpsc::Sender<NetworkMessage>,
+}
+
+/// Receiving side of `PrioritySender`.
+pub(crate) struct PriorityReceiver {
+    consensus: mpsc::Receiver<NetworkMessage>,
+    control: mpsc::Receiver<NetworkMessage>,
+    normal: mpsc::Receiver<NetworkMessage>,
+    sync: mpsc::Receiver<NetworkMessage>,
+    bulk: mpsc::Receiver<NetworkMessage>,
+}
+
+/// Creates a set of per-class outbound queues.
+pub(crate) fn priority_channel(capacity: usize) -> (PrioritySender, PriorityReceiver) {
+    let capacity = capacity.max(1);
+    let (consensus_tx, consensus_rx) = mpsc::channel(capacity);
+    let (control_tx, control_rx) = mpsc::channel(capacity);
+    let (normal_tx, normal_rx) = mpsc::channel(capacity);
+    let (sync_tx, sync_rx) = mpsc::channel(capacity);
+    let (bulk_tx, bulk_rx) = mpsc::channel(capacity);
+    (
+        PrioritySender {
+            consensus: consensus_tx,
+            control: control_tx,
+            normal: normal_tx,
+            sync: sync_tx,
+            bulk: bulk_tx,
+        },
+        PriorityReceiver {
+            consensus: consensus_rx,
+            control: control_rx,
+            normal: normal_rx,
+            sync: sync_rx,
+            bulk: bulk_rx,
+        },
+    )
+}
+
+impl PrioritySender {
+    /// Queues a message on its class queue without waiting.
+    ///
+    /// A message is dropped when its queue is full, so a slow peer can't
+    /// stall the event loop and with it every other peer's consensus
+    /// traffic. Returns false if the message was dropped.
+    pub fn send(&self, message: NetworkMessage) -> bool {
+        let queue = match message.priority() {
+            MessagePriority::Consensus => &self.consensus,
+            MessagePriority::Control => &self.control,
+            MessagePriority::Normal => &self.normal,
+            MessagePriority::Sync => &self.sync,
+            MessagePriority::Bulk => &self.bulk,
+        };
+        queue.try_send(message).is_ok()
+    }
+}
+
+impl PriorityReceiver {
+    /// Receives the next message, always draining higher classes first.
+    ///
+    /// Returns None once all senders are dropped and the queues are empty.
+    pub async fn recv(&mut self) -> Option<NetworkMessage> {
+        tokio::select! {
+            biased;
+            Some(msg) = self.consensus.recv() => Some(msg),
+            Some(msg) = self.control.recv() => Some(msg),
+            Some(msg) = self.normal.recv() => Some(msg),
+            Some(msg) = self.sync.recv() => Some(msg),
+            Some(msg) = self.bulk.recv() => Some(msg),
+            else => None,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+    use crate::message::ConsensusMessage;
+    use bach_primitives::FakeClock;
+
+    fn consensus_message() -> NetworkMessage {
+        NetworkMessage::Consensus(ConsensusMessage::VoteRequest { height: 1, round: 0 })
+    }
+
+    fn tight_config() -> RateLimitConfig {
+        RateLimitConfig {
+            control_per_sec: 1.0,
+            control_burst: 2,
+            normal_per_sec: 1.0,
+            normal_burst: 2,
+            sync_per_sec: 1.0,
+            sync_burst: 1,
+            bulk_per_sec: 10.0,
+            bulk_burst: 3,
+            queue_capacity: 2,
+            drop_score_threshold: 3.0,
+            drop_score_half_life: Duration::from_secs(10),
+        }
+    }
+
+    #[test]
+    fn test_consensus_never_limited() {
+        let mut limiter = RateLimiter::new(&tight_config(), Arc::new(FakeClock::new()));
+        for _ in 0..10_000 {
+            assert!(limiter.allow(MessagePriority::Consensus));
+        }
+        assert_eq!(limiter.dropped(), 0);
+    }
+
+    #[test]
+    fn test_control_limited_apart_from_consensus() {
+        let clock = FakeClock::new();
+        let mut limiter = RateLimiter::new(&tight_config(), Arc::new(clock.clone()));
+
+        assert!(limiter.allow(MessagePriority::Control));
+        assert!(limiter.allow(MessagePriority::Control));
+        assert!(!limiter.allow(MessagePriority::Control));
+        assert!(limiter.allow(MessagePriority::Consensus));
+        assert_eq!(limiter.dropped(), 1);
+    }
+
+    #[test]
+    fn test_bucket_exhausts_and_refills() {
+        let clock = FakeClock::new();
+        let mut limiter = RateLimiter::new(&tight_config(), Arc::new(clock.clone()));
+
+        assert!(limiter.allow(MessagePriority::Bulk));
+        assert!(limiter.allow(MessagePriority::Bulk));
+        assert!(limiter.allow(MessagePriority::Bulk));
+        assert!(!limiter.allow(MessagePriority::Bulk));
+        assert_eq!(limiter.dropped(), 1);
+
+        // 10 per second refills one token in 100ms
+        clock.advance(Duration::from_millis(100));
+        assert!(limiter.allow(MessagePriority::Bulk));
+        assert!(!limiter.allow(MessagePriority::Bulk));
+    }
+
+    #[test]
+    fn test_classes_have_independent_buckets() {
+        let clock = FakeClock::new();
+        let mut limiter = RateLimiter::new(&tight_config(), Arc::new(clock.clone()));
+
+        for _ in 0..3 {
+            limiter.allow(MessagePriority::Bulk);
+        }
+        assert!(!limiter.allow(MessagePriority::Bulk));
+        assert!(limiter.allow(MessagePriority::Normal));
+
+        // A syncing peer can't starve block propagation
+        assert!(limiter.allow(MessagePriority::Sync));
+        assert!(!limiter.allow(MessagePriority::Sync));
+        assert!(limiter.allow(MessagePriority::Normal));
+    }
+
+    #[test]
+    fn test_drop_score_decays() {
+        let clock = FakeClock::new();
+        let mut limiter = RateLimiter::new(&tight_config(), Arc::new(clock.clone()));
+        for _ in 0..3 {
+            limiter.allow(MessagePriority::Sync);
+        }
+        // One message passed; two drops stay under the threshold
+        assert!(!limiter.take_report());
+
+        // Drops spread out fade before they add up
+        clock.advance(Duration::from_secs(20));
+        assert!(limiter.allow(MessagePriority::Sync));
+        assert!(!limiter.allow(MessagePriority::Sync));
+        assert!(!limiter.allow(MessagePriority::Sync));
+        assert!(!limiter.take_report());
+
+        // A burst reaches it, and the score starts over once reported
+        assert!(!limiter.allow(MessagePriority::Sync));
+        assert!(limiter.take_report());
+        assert!(!limiter.take_report());
+        assert_eq!(limiter.dropped(), 5);
+    }
+
+    #[tokio::test]
+    async fn test_receiver_prefers_consensus() {
+        let (tx, mut rx) = priority_channel(8);
+
+        assert!(tx.send(NetworkMessage::GetTransactions(vec![])));
+        assert!(tx.send(NetworkMessage::GetBlocks { start: 0, count: 1 }));
+        assert!(tx.send(NetworkMessage::NewBlockHash { hash: [0; 32], height: 1 }));
+        assert!(tx.send(NetworkMessage::Ping(1)));
+        assert!(tx.send(consensus_message()));
+
+        assert_eq!(rx.recv().await.unwrap().priority(), MessagePriority::Consensus);
+        assert_eq!(rx.recv().await.unwrap().priority(), MessagePriority::Control);
+        assert_eq!(rx.recv().await.unwrap().priority(), MessagePriority::Normal);
+        assert_eq!(rx.recv().await.unwrap().priority(), MessagePriority::Sync);
+        assert_eq!(rx.recv().await.unwrap().priority(), MessagePriority::Bulk);
+    }
+
+    #[test]
+    fn test_full_queues_drop_without_blocking() {
+        let (tx, _rx) = priority_channel(2);
+
+        assert!(tx.send(NetworkMessage::GetPeers));
+        assert!(tx.send(NetworkMessage::GetPeers));
+        assert!(!tx.send(NetworkMessage::GetPeers));
+
+        // A full control queue leaves room for consensus messages
+        assert!(tx.send(NetworkMessage::Ping(1)));
+        assert!(tx.send(NetworkMessage::Ping(2)));
+        assert!(!tx.send(NetworkMessage::Ping(3)));
+        assert!(tx.send(consensus_message()));
+        assert!(tx.send(consensus_message()));
+        assert!(!tx.send(consensus_message()));
+    }
+
+    #[tokio::test]
+    async fn test_receiver_ends_when_senders_dropped() {
+        let (tx, mut rx) = priority_channel(2);
+        tx.send(NetworkMessage::GetPeers);
+        drop(tx);
+
+        assert!(rx.recv().await.is_some());
+        assert!(rx.recv().await.is_none());
+    }
+}
@@ -0,0 +1,305 @@
+//! Online key revocation checks
+//!
+//! Beyond the revocation lists a node loads from its ledger, a connection
+//! can ask a status responder whether the remote key is still good when a
+//! peer completes the handshake or a client authenticates, and again for
+//! connected peers once the cached answer expires. Answers are cached for a
+//! configurable time. A key the responder doesn't know is rejected. When
+//! the responder cannot be reached, the policy decides: soft-fail accepts
+//! the key, hard-fail rejects it.
+
+use bach_primitives::{system_clock, timeout, Address, Clock};
+use futures::future::BoxFuture;
+use parking_lot::Mutex;
+use std::collections::HashMap;
+use std::fmt;
+use std::str::FromStr;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use thiserror::Error;
+use tracing::warn;
+
+/// Revocation status reported for a key.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum KeyStatus {
+    /// Key is valid
+    Good,
+    /// Key has been revoked
+    Revoked,
+    /// Responder does not know the key
+    Unknown,
+}
+
+/// Answers revocation status queries, e.g. by asking a remote node.
+pub trait StatusResponder: Send + Sync + fmt::Debug {
+    /// Returns the status of the key with `address`. Errors mean the
+    /// responder could not be reached.
+    fn status(&self, address: Address) -> BoxFuture<'static, Result<KeyStatus, String>>;
+}
+
+/// What to do when a key's status cannot be determined.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum RevocationPolicy {
+    /// Accept the key and log a warning
+    #[default]
+    SoftFail,
+    /// Reject the key
+    HardFail,
+}
+
+impl FromStr for RevocationPolicy {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "soft-fail" | "soft_fail" | "soft" => Ok(Self::SoftFail),
+            "hard-fail" | "hard_fail" | "hard" => Ok(Self::HardFail),
+            other => Err(format!("unknown revocation policy: {}", other)),
+        }
+    }
+}
+
+impl fmt::Display for RevocationPolicy {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::SoftFail => f.write_str("soft-fail"),
+            Self::HardFail => f.write_str("hard-fail"),
+        }
+    }
+}
+
+/// Online revocation check settings
+#[derive(Debug, Clone)]
+pub struct RevocationCheckConfig {
+    /// Handling of keys whose status can't be determined
+    pub policy: RevocationPolicy,
+    /// How long a Good or Revoked answer is reused
+    pub cache_ttl: Duration,
+    /// How long to wait for the responder
+    pub timeout: Duration,
+}
+
+impl Default for RevocationCheckConfig {
+    fn default() -> Self {
+        Self {
+            policy: RevocationPolicy::SoftFail,
+            cache_ttl: Duration::from_secs(300),
+            timeout: Duration::from_secs(2),
+        }
+    }
+}
+
+/// Reasons a key fails the revocation check.
+#[derive(Debug, Error, Clone, PartialEq, Eq)]
+pub enum RevocationCheckError {
+    #[error("key {0} has been revoked")]
+    Revoked(String),
+
+    #[error("key {0} is unknown to the status responder")]
+    Unknown(String),
+
+    #[error("revocation status of {address} unavailable: {reason}")]
+    Unavailable { address: String, reason: String },
+}
+
+/// Checks keys against a status responder, caching the answers.
+#[derive(Debug)]
+pub struct RevocationChecker {
+    responder: Arc<dyn StatusResponder>,
+    config: RevocationCheckConfig,
+    clock: Arc<dyn Clock>,
+    cache: Mutex<HashMap<Address, (KeyStatus, Instant)>>,
+}
+
+impl RevocationChecker {
+    /// Creates a checker querying `responder`.
+    pub fn new(responder: Arc<dyn StatusResponder>, config: RevocationCheckConfig) -> Self {
+        Self {
+            responder,
+            config,
+            clock: system_clock(),
+            cache: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Uses `clock` for cache expiry and responder timeouts.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Returns the check settings.
+    pub fn config(&self) -> &RevocationCheckConfig {
+        &self.config
+    }
+
+    /// Returns the cached status of a key, if still fresh.
+    pub fn cached(&self, address: &Address) -> Option<KeyStatus> {
+        let cache = self.cache.lock();
+        let (status, checked_at) = cache.get(address)?;
+        let age = self.clock.now().saturating_duration_since(*checked_at);
+        (age < self.config.cache_ttl).then_some(*status)
+    }
+
+    /// Drops all cached answers, e.g. after new revocations are published.
+    pub fn clear_cache(&self) {
+        self.cache.lock().clear();
+    }
+
+    /// Checks a key, asking the responder unless a fresh answer is cached.
+    pub async fn check(&self, address: &Address) -> Result<(), RevocationCheckError> {
+        let status = match self.cached(address) {
+            Some(status) => Ok(status),
+            None => self.query(address).await,
+        };
+        match status {
+            Ok(KeyStatus::Good) => Ok(()),
+            Ok(KeyStatus::Revoked) => Err(RevocationCheckError::Revoked(address.to_string())),
+            Ok(KeyStatus::Unknown) => Err(RevocationCheckError::Unknown(address.to_string())),
+            Err(reason) => self.undetermined(address, reason),
+        }
+    }
+
+    async fn query(&self, address: &Address) -> Result<KeyStatus, String> {
+        let request = self.responder.status(*address);
+        let status = timeout(self.clock.as_ref(), self.config.timeout, request)
+            .await
+            .ok_or_else(|| "responder timed out".to_string())??;
+        if status != KeyStatus::Unknown {
+            self.cache
+                .lock()
+                .insert(*address, (status, self.clock.now()));
+        }
+        Ok(status)
+    }
+
+    fn undetermined(&self, address: &Address, reason: String) -> Result<(), RevocationCheckError> {
+        match self.config.policy {
+            RevocationPolicy::SoftFail => {
+                warn!(
+                    "Accepting {} without revocation status: {}",
+                    address, reason
+                );
+                Ok(())
+            }
+            RevocationPolicy::HardFail => Err(RevocationCheckError::Unavailable {
+                address: address.to_string(),
+                reason,
+            }),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_primitives::FakeClock;
+    use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+
+    /// Responder answering from a fixed table, counting queries.
+    #[derive(Debug, Default)]
+    struct TableResponder {
+        statuses: Mutex<HashMap<Address, KeyStatus>>,
+        offline: AtomicBool,
+        queries: AtomicUsize,
+    }
+
+    impl TableResponder {
+        fn set(&self, address: Address, status: KeyStatus) {
+            self.statuses.lock().insert(address, status);
+        }
+    }
+
+    impl StatusResponder for TableResponder {
+        fn status(&self, address: Address) -> BoxFuture<'static, Result<KeyStatus, String>> {
+            self.queries.fetch_add(1, Ordering::SeqCst);
+            let result = if self.offline.load(Ordering::SeqCst) {
+                Err("connection refused".to_string())
+            } else {
+                Ok(self
+                    .statuses
+                    .lock()
+                    .get(&address)
+                    .copied()
+                    .unwrap_or(KeyStatus::Unknown))
+            };
+            Box::pin(async move { result })
+        }
+    }
+
+    fn checker(
+        responder: &Arc<TableResponder>,
+        policy: RevocationPolicy,
+        clock: &Arc<FakeClock>,
+    ) -> RevocationChecker {
+        let config = RevocationCheckConfig {
+            policy,
+            cache_ttl: Duration::from_secs(60),
+            ..Default::default()
+        };
+        RevocationChecker::new(Arc::clone(responder) as Arc<dyn StatusResponder>, config)
+            .with_clock(Arc::clone(clock) as Arc<dyn Clock>)
+    }
+
+    #[tokio::test]
+    async fn test_answers_are_cached_until_ttl() {
+        let responder = Arc::new(TableResponder::default());
+        let clock = Arc::new(FakeClock::new());
+        let checker = checker(&responder, RevocationPolicy::HardFail, &clock);
+        let key = Address::from([1u8; 20]);
+        responder.set(key, KeyStatus::Good);
+
+        checker.check(&key).await.unwrap();
+        responder.set(key, KeyStatus::Revoked);
+        checker.check(&key).await.unwrap();
+        assert_eq!(responder.queries.load(Ordering::SeqCst), 1);
+
+        clock.advance(Duration::from_secs(61));
+        assert!(matches!(
+            checker.check(&key).await,
+            Err(RevocationCheckError::Revoked(_))
+        ));
+        assert_eq!(checker.cached(&key), Some(KeyStatus::Revoked));
+        assert_eq!(responder.queries.load(Ordering::SeqCst), 2);
+    }
+
+    #[tokio::test]
+    async fn test_policy_decides_when_status_unavailable() {
+        let responder = Arc::new(TableResponder::default());
+        responder.offline.store(true, Ordering::SeqCst);
+        let clock = Arc::new(FakeClock::new());
+        let key = Address::from([2u8; 20]);
+
+        let soft = checker(&responder, RevocationPolicy::SoftFail, &clock);
+        assert!(soft.check(&key).await.is_ok());
+
+        let hard = checker(&responder, RevocationPolicy::HardFail, &clock);
+        assert!(matches!(
+            hard.check(&key).await,
+            Err(RevocationCheckError::Unavailable { .. })
+        ));
+
+        // Unknown keys are an answer, rejected under either policy
+        responder.offline.store(false, Ordering::SeqCst);
+        assert_eq!(
+            soft.check(&key).await,
+            Err(RevocationCheckError::Unknown(key.to_string()))
+        );
+        assert!(hard.check(&key).await.is_err());
+        assert_eq!(hard.cached(&key), None);
+    }
+
+    #[test]
+    fn test_policy_parsing() {
+        assert_eq!(
+            "hard-fail".parse::<RevocationPolicy>().unwrap(),
+            RevocationPolicy::HardFail
+        );
+        assert_eq!(
+            "Soft".parse::<RevocationPolicy>().unwrap(),
+            RevocationPolicy::SoftFail
+        );
+        assert!("strict".parse::<RevocationPolicy>().is_err());
+        assert_eq!(RevocationPolicy::HardFail.to_string(), "hard-fail");
+    }
+}
@@ -0,0 +1,373 @@
+//! Peer scoring and ban list
+
+use bach_primitives::{system_clock, Clock};
+use parking_lot::RwLock;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tracing::warn;
+
+use crate::error::{NetworkError, NetworkResult};
+use crate::peer::PeerId;
+
+/// Misbehavior that lowers a peer's score.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub enum Misbehavior {
+    /// Message could not be decoded
+    MalformedMessage,
+    /// Block failed validation
+    InvalidBlock,
+    /// Transaction failed validation
+    InvalidTransaction,
+    /// Proposal or vote failed validation
+    InvalidConsensusMessage,
+    /// Peer exceeded its inbound rate limit
+    RateLimitExceeded,
+}
+
+impl Misbehavior {
+    /// Returns the score penalty for this misbehavior.
+    pub fn penalty(&self) -> i64 {
+        match self {
+            Self::MalformedMessage => 50,
+            Self::InvalidBlock => 40,
+            Self::InvalidConsensusMessage => 40,
+            Self::InvalidTransaction => 10,
+            Self::RateLimitExceeded => 1,
+        }
+    }
+}
+
+/// Scoring thresholds and ban settings
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ScoringConfig {
+    /// Peers at or below this score are banned
+    pub ban_threshold: i64,
+    /// How long a ban lasts
+    pub ban_duration: Duration,
+    /// Points recovered per minute of good behavior (score never exceeds 0)
+    pub recovery_per_minute: i64,
+    /// File the ban list is persisted to (in-memory only if None)
+    pub ban_list_path: Option<PathBuf>,
+}
+
+impl Default for ScoringConfig {
+    fn default() -> Self {
+        Self {
+            ban_threshold: -100,
+            ban_duration: Duration::from_secs(3600),
+            recovery_per_minute: 5,
+            ban_list_path: None,
+        }
+    }
+}
+
+/// A banned peer.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BanEntry {
+    /// Banned peer
+    pub peer_id: PeerId,
+    /// Unix time (seconds) when the ban expires
+    pub until: u64,
+    /// Why the peer was banned
+    pub reason: String,
+}
+
+impl BanEntry {
+    /// Returns true if the ban has not expired by `now` (Unix seconds).
+    pub fn is_active(&self, now: u64) -> bool {
+        self.until > now
+    }
+}
+
+#[derive(Debug, Clone, Copy)]
+struct ScoreState {
+    score: i64,
+    updated: Instant,
+}
+
+/// Tracks peer scores and bans peers that fall below the threshold.
+pub struct PeerScorer {
+    config: ScoringConfig,
+    scores: RwLock<HashMap<PeerId, ScoreState>>,
+    bans: RwLock<HashMap<PeerId, BanEntry>>,
+    clock: Arc<dyn Clock>,
+}
+
+impl PeerScorer {
+    /// Creates a scorer with no history.
+    pub fn new(config: ScoringConfig) -> Self {
+        Self {
+            config,
+            scores: RwLock::new(HashMap::new()),
+            bans: RwLock::new(HashMap::new()),
+            clock: system_clock(),
+        }
+    }
+
+    /// Uses `clock` for score recovery and ban expiry.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Records misbehavior. Returns true if the peer is banned as a result.
+    pub fn report(&self, peer: &PeerId, misbehavior: Misbehavior) -> bool {
+        let score = {
+            let now = self.clock.now();
+            let mut scores = self.scores.write();
+            let state = scores.entry(*peer).or_insert(ScoreState {
+                score: 0,
+                updated: now,
+            });
+            self.recover(state, now);
+            state.score -= misbehavior.penalty();
+            state.score
+        };
+
+        if score <= self.config.ban_threshold && !self.is_banned(peer) {
+            self.ban(peer, self.config.ban_duration, format!("score {} after {:?}", score, misbehavior));
+            return true;
+        }
+        false
+    }
+
+    /// Returns the current score of a peer (0 if unknown).
+    pub fn score(&self, peer: &PeerId) -> i64 {
+        let now = self.clock.now();
+        let mut scores = self.scores.write();
+        match scores.get_mut(peer) {
+            Some(state) => {
+                self.recover(state, now);
+                state.score
+            }
+            None => 0,
+        }
+    }
+
+    /// Returns all tracked scores.
+    pub fn scores(&self) -> Vec<(PeerId, i64)> {
+        let now = self.clock.now();
+        let mut scores = self.scores.write();
+        scores
+            .iter_mut()
+            .map(|(id, state)| {
+                self.recover(state, now);
+                (*id, state.score)
+            })
+            .collect()
+    }
+
+    /// Returns the scoring configuration.
+    pub fn config(&self) -> &ScoringConfig {
+        &self.config
+    }
+
+    /// Bans a peer for the given duration.
+    pub fn ban(&self, peer: &PeerId, duration: Duration, reason: impl Into<String>) {
+        let entry = BanEntry {
+            peer_id: *peer,
+            until: self.clock.unix_timestamp().saturating_add(duration.as_secs()),
+            reason: reason.into(),
+        };
+        self.bans.write().insert(*peer, entry);
+        self.persist();
+    }
+
+    /// Lifts a ban and resets the peer's score. Returns true if a ban was removed.
+    pub fn unban(&self, peer: &PeerId) -> bool {
+        self.scores.write().remove(peer);
+        let removed = self.bans.write().remove(peer).is_some();
+        if removed {
+            self.persist();
+        }
+        removed
+    }
+
+    /// Returns true if the peer is currently banned.
+    pub fn is_banned(&self, peer: &PeerId) -> bool {
+        let now = self.clock.unix_timestamp();
+        self.bans.read().get(peer).is_some_and(|b| b.is_active(now))
+    }
+
+    /// Returns active bans, dropping expired ones.
+    pub fn banned_peers(&self) -> Vec<BanEntry> {
+        let now = self.clock.unix_timestamp();
+        let mut bans = self.bans.write();
+        bans.retain(|_, b| b.is_active(now));
+        bans.values().cloned().collect()
+    }
+
+    /// Writes active bans to the configured ban list file.
+    pub fn save_bans(&self) -> NetworkResult<()> {
+        let Some(path) = &self.config.ban_list_path else {
+            return Ok(());
+        };
+        let bans = self.banned_peers();
+        let encoded = bincode::serialize(&bans)
+            .map_err(|e| NetworkError::Codec(format!("serialize ban list: {}", e)))?;
+        std::fs::write(path, encoded)?;
+        Ok(())
+    }
+
+    /// Loads bans from the configured ban list file, ignoring expired
+    /// entries. A missing file is not an error.
+    pub fn load_bans(&self) -> NetworkResult<()> {
+        let Some(path) = &self.config.ban_list_path else {
+            return Ok(());
+        };
+        let data = match std::fs::read(path) {
+            Ok(data) => data,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(()),
+            Err(e) => return Err(e.into()),
+        };
+        let entries: Vec<BanEntry> = bincode::deserialize(&data)
+            .map_err(|e| NetworkError::Codec(format!("deserialize ban list: {}", e)))?;
+
+        let now = self.clock.unix_timestamp();
+        let mut bans = self.bans.write();
+        for entry in entries.into_iter().filter(|b| b.is_active(now)) {
+            bans.insert(entry.peer_id, entry);
+        }
+        Ok(())
+    }
+
+    fn persist(&self) {
+        if let Err(e) = self.save_bans() {
+            warn!("Failed to persist ban list: {}", e);
+        }
+    }
+
+    /// Moves a negative score back toward zero based on time elapsed by `now`.
+    fn recover(&self, state: &mut ScoreState, now: Instant) {
+        let per_minute = self.config.recovery_per_minute;
+        let minutes = now.saturating_duration_since(state.updated).as_secs() / 60;
+        if minutes > 0 {
+            state.score = (state.score + per_minute.saturating_mul(minutes as i64)).min(0);
+            state.updated += Duration::from_secs(minutes * 60);
+        }
+    }
+}
+
+impl Default for PeerScorer {
+    fn default() -> Self {
+        Self::new(ScoringConfig::default())
+    }
+}
+
+impl std::fmt::Debug for PeerScorer {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("PeerScorer")
+            .field("tracked", &self.scores.read().len())
+            .field("banned", &self.bans.read().len())
+            .finish()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_primitives::FakeClock;
+
+    fn peer(n: u8) -> PeerId {
+        PeerId::from_bytes([n; 32])
+    }
+
+    #[test]
+    fn test_penalties_accumulate() {
+        let scorer = PeerScorer::default();
+        assert_eq!(scorer.score(&peer(1)), 0);
+
+        assert!(!scorer.report(&peer(1), Misbehavior::InvalidTransaction));
+        assert!(!scorer.report(&peer(1), Misbehavior::InvalidBlock));
+        assert_eq!(scorer.score(&peer(1)), -50);
+        assert_eq!(scorer.score(&peer(2)), 0);
+    }
+
+    #[test]
+    fn test_ban_at_threshold() {
+        let scorer = PeerScorer::default();
+
+        assert!(!scorer.report(&peer(1), Misbehavior::MalformedMessage));
+        assert!(scorer.report(&peer(1), Misbehavior::MalformedMessage));
+        assert!(scorer.is_banned(&peer(1)));
+        assert_eq!(scorer.banned_peers().len(), 1);
+
+        // Further reports don't re-trigger a ban
+        assert!(!scorer.report(&peer(1), Misbehavior::MalformedMessage));
+    }
+
+    #[test]
+    fn test_unban_resets_score() {
+        let scorer = PeerScorer::default();
+        scorer.ban(&peer(1), Duration::from_secs(60), "manual");
+        scorer.report(&peer(1), Misbehavior::InvalidBlock);
+
+        assert!(scorer.unban(&peer(1)));
+        assert!(!scorer.is_banned(&peer(1)));
+        assert_eq!(scorer.score(&peer(1)), 0);
+        assert!(!scorer.unban(&peer(1)));
+    }
+
+    #[test]
+    fn test_expired_ban_is_inactive() {
+        let scorer = PeerScorer::default();
+        scorer.ban(&peer(1), Duration::ZERO, "expired");
+
+        assert!(!scorer.is_banned(&peer(1)));
+        assert!(scorer.banned_peers().is_empty());
+    }
+
+    #[test]
+    fn test_ban_expires_and_score_recovers() {
+        let clock = FakeClock::new();
+        let scorer = PeerScorer::default().with_clock(Arc::new(clock.clone()));
+        scorer.ban(&peer(1), Duration::from_secs(60), "test");
+        scorer.report(&peer(2), Misbehavior::InvalidBlock);
+
+        clock.advance(Duration::from_secs(59));
+        assert!(scorer.is_banned(&peer(1)));
+        assert_eq!(scorer.score(&peer(2)), -40);
+
+        clock.advance(Duration::from_secs(1));
+        assert!(!scorer.is_banned(&peer(1)));
+        assert_eq!(scorer.score(&peer(2)), -35);
+    }
+
+    #[test]
+    fn test_bans_persist() {
+        let dir = std::env::temp_dir().join(format!("bach-bans-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("bans.bin");
+
+        let config = ScoringConfig {
+            ban_list_path: Some(path),
+            ..Default::default()
+        };
+
+        // Bans are written as they are made
+        let scorer = PeerScorer::new(config.clone());
+        scorer.ban(&peer(1), Duration::from_secs(600), "test");
+        scorer.ban(&peer(2), Duration::ZERO, "expired");
+        scorer.ban(&peer(3), Duration::from_secs(600), "lifted");
+        scorer.unban(&peer(3));
+
+        let restored = PeerScorer::new(config);
+        restored.load_bans().unwrap();
+        assert!(restored.is_banned(&peer(1)));
+        assert!(!restored.is_banned(&peer(2)));
+        assert!(!restored.is_banned(&peer(3)));
+
+        // Missing file is fine
+        let empty = PeerScorer::new(ScoringConfig {
+            ban_list_path: Some(dir.join("missing.bin")),
+            ..Default::default()
+        });
+        empty.load_bans().unwrap();
+        assert!(empty.banned_peers().is_empty());
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
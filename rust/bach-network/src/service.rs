@@ -1,7 +1,7 @@
 //! Network service for managing P2P connections
 
 use bach_crypto::{PrivateKey, PublicKey};
-use bach_primitives::H256;
+use bach_primitives::{system_clock, Clock, H256};
 use futures::stream::StreamExt;
 use parking_lot::RwLock;
 use std::collections::HashMap;
@@ -13,10 +13,19 @@ use tokio::sync::mpsc;
 use tokio_util::codec::{FramedRead, FramedWrite};
 use tracing::{debug, error, info, warn};
 
-use crate::codec::MessageCodec;
+use crate::codec::{CompressionConfig, MessageCodec};
+use crate::discovery::{resolve_seeds, SeedSource};
 use crate::error::{NetworkError, NetworkResult};
-use crate::message::{NetworkMessage, PROTOCOL_VERSION};
+use crate::gossip::{GossipConfig, TxGossip};
+use crate::message::{
+    NetworkMessage, SerializableTransaction, CAP_HEADER_SYNC, CAP_ZSTD, MAX_ADVERTISED_FEATURES,
+    MAX_ADVERTISED_FEATURE_LEN, PROTOCOL_VERSION,
+};
 use crate::peer::{PeerId, PeerInfo, PeerManager};
+use crate::priority::{priority_channel, PriorityReceiver, PrioritySender, RateLimitConfig, RateLimiter};
+use crate::revocation::RevocationChecker;
+use crate::scoring::{Misbehavior, PeerScorer, ScoringConfig};
+use crate::topology::{PeerAllowlist, StaticPeer};
 
 /// Configuration for the network service.
 #[derive(Debug, Clone)]
@@ -27,6 +36,8 @@ pub struct NetworkConfig {
     pub max_peers: usize,
     /// Bootstrap node addresses
     pub bootstrap_nodes: Vec<SocketAddr>,
+    /// Bootstrap seeds resolved via DNS (A/AAAA or SRV) when the service starts
+    pub seeds: Vec<SeedSource>,
     /// Genesis hash for chain identification
     pub genesis_hash: H256,
     /// Private key for signing (generates random if None)
@@ -37,6 +48,23 @@ pub struct NetworkConfig {
     pub ping_interval: Duration,
     /// Peer timeout (disconnect if no activity)
     pub peer_timeout: Duration,
+    /// Per-peer rate limits and outbound queue sizes
+    pub rate_limit: RateLimitConfig,
+    /// Peer scoring thresholds and ban duration
+    pub scoring: ScoringConfig,
+    /// Static topology allowlist; disables discovery and unknown peers when set
+    pub static_peers: Option<Vec<StaticPeer>>,
+    /// Online revocation check of peer keys after the handshake (off if None)
+    pub revocation_checker: Option<Arc<RevocationChecker>>,
+    /// Transaction announcement cache sizes and fetch timeout
+    pub gossip: GossipConfig,
+    /// Compression of large transaction and block messages, used with peers
+    /// that support it (never compress if None)
+    pub compression: Option<CompressionConfig>,
+    /// Protocol features this node supports, advertised in the handshake
+    pub features: Vec<String>,
+    /// Time source for rate limits, peer liveness, bans and gossip
+    pub clock: Arc<dyn Clock>,
 }
 
 impl Default for NetworkConfig {
@@ -45,11 +73,20 @@ impl Default for NetworkConfig {
             listen_addr: "0.0.0.0:30303".parse().unwrap(),
             max_peers: 25,
             bootstrap_nodes: Vec::new(),
+            seeds: Vec::new(),
             genesis_hash: H256::zero(),
             private_key: None,
             connection_timeout: Duration::from_secs(10),
             ping_interval: Duration::from_secs(30),
             peer_timeout: Duration::from_secs(90),
+            rate_limit: RateLimitConfig::default(),
+            scoring: ScoringConfig::default(),
+            static_peers: None,
+            revocation_checker: None,
+            gossip: GossipConfig::default(),
+            compression: Some(CompressionConfig::default()),
+            features: Vec::new(),
+            clock: system_clock(),
         }
     }
 }
@@ -73,6 +110,12 @@ impl NetworkConfig {
         self
     }
 
+    /// Sets the DNS bootstrap seeds.
+    pub fn with_seeds(mut self, seeds: Vec<SeedSource>) -> Self {
+        self.seeds = seeds;
+        self
+    }
+
     /// Sets the genesis hash.
     pub fn with_genesis_hash(mut self, hash: H256) -> Self {
         self.genesis_hash = hash;
@@ -84,6 +127,54 @@ impl NetworkConfig {
         self.private_key = Some(key);
         self
     }
+
+    /// Sets the per-peer rate limits.
+    pub fn with_rate_limit(mut self, rate_limit: RateLimitConfig) -> Self {
+        self.rate_limit = rate_limit;
+        self
+    }
+
+    /// Sets the peer scoring thresholds.
+    pub fn with_scoring(mut self, scoring: ScoringConfig) -> Self {
+        self.scoring = scoring;
+        self
+    }
+
+    /// Enables static topology with the given allowlist.
+    pub fn with_static_peers(mut self, peers: Vec<StaticPeer>) -> Self {
+        self.static_peers = Some(peers);
+        self
+    }
+
+    /// Checks each peer's key with `checker` before accepting it.
+    pub fn with_revocation_checker(mut self, checker: Arc<RevocationChecker>) -> Self {
+        self.revocation_checker = Some(checker);
+        self
+    }
+
+    /// Sets the transaction gossip cache sizes.
+    pub fn with_gossip(mut self, gossip: GossipConfig) -> Self {
+        self.gossip = gossip;
+        self
+    }
+
+    /// Sets message compression (None: never compress).
+    pub fn with_compression(mut self, compression: Option<CompressionConfig>) -> Self {
+        self.compression = compression;
+        self
+    }
+
+    /// Sets the protocol features advertised to peers.
+    pub fn with_features(mut self, features: Vec<String>) -> Self {
+        self.features = features;
+        self
+    }
+
+    /// Sets the clock the service times peers and limits with.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
 }
 
 /// Events emitted by the network service.
@@ -94,6 +185,10 @@ pub enum NetworkEvent {
     /// A peer disconnected
     PeerDisconnected(PeerId),
     /// Message received from a peer
+    ///
+    /// Transaction gossip is handled by the service: only fetched bodies
+    /// not seen before are delivered, as `NetworkMessage::Transactions`.
+    /// The application admits them before anything is relayed.
     MessageReceived {
         from: PeerId,
         message: NetworkMessage,
@@ -112,10 +207,20 @@ pub enum NetworkCommand {
     Broadcast {
         message: NetworkMessage,
     },
+    /// Announce a local transaction by hash to peers that don't know it
+    AnnounceTransaction(SerializableTransaction),
     /// Connect to a new peer
     Connect(SocketAddr),
     /// Disconnect from a peer
     Disconnect(PeerId),
+    /// Penalize a peer for misbehavior detected by the application
+    ReportPeer {
+        peer: PeerId,
+        misbehavior: Misbehavior,
+    },
+    /// Replace the static topology allowlist; an empty list returns to
+    /// dynamic discovery
+    UpdateAllowlist(Vec<StaticPeer>),
     /// Shutdown the service
     Shutdown,
 }
@@ -140,12 +245,17 @@ enum ConnectionEvent {
         real_id: PeerId,
         public_key: PublicKey,
         version: u32,
+        features: Vec<String>,
+    },
+    Misbehaved {
+        peer_id: PeerId,
+        misbehavior: Misbehavior,
     },
 }
 
 /// Handle to send messages to specific peers.
 struct PeerHandle {
-    sender: mpsc::Sender<NetworkMessage>,
+    sender: PrioritySender,
 }
 
 /// The main network service.
@@ -156,6 +266,7 @@ pub struct NetworkService {
     private_key: PrivateKey,
     public_key: PublicKey,
     local_id: PeerId,
+    gossip: Arc<TxGossip>,
     event_tx: mpsc::Sender<NetworkEvent>,
     event_rx: Option<mpsc::Receiver<NetworkEvent>>,
     command_tx: Option<mpsc::Sender<NetworkCommand>>,
@@ -172,10 +283,23 @@ impl NetworkService {
         let public_key = private_key.public_key();
         let local_id = PeerId::from_public_key(&public_key);
 
-        let mut peer_manager = PeerManager::new(config.max_peers, config.bootstrap_nodes.clone());
+        let mut peer_manager = PeerManager::new(config.max_peers, config.bootstrap_nodes.clone())
+            .with_clock(Arc::clone(&config.clock));
         peer_manager.set_local_id(local_id);
+        peer_manager.set_local_features(config.features.clone());
+
+        let scorer = PeerScorer::new(config.scoring.clone()).with_clock(Arc::clone(&config.clock));
+        if let Err(e) = scorer.load_bans() {
+            warn!("Failed to load ban list: {}", e);
+        }
+        peer_manager.set_scorer(scorer);
+        if let Some(peers) = &config.static_peers {
+            peer_manager.set_allowlist(Some(PeerAllowlist::new(peers.clone())));
+        }
 
         let (event_tx, event_rx) = mpsc::channel(1024);
+        let gossip =
+            Arc::new(TxGossip::new(config.gossip.clone()).with_clock(Arc::clone(&config.clock)));
 
         Self {
             config,
@@ -183,6 +307,7 @@ impl NetworkService {
             private_key,
             public_key,
             local_id,
+            gossip,
             event_tx,
             event_rx: Some(event_rx),
             command_tx: None,
@@ -205,6 +330,11 @@ impl NetworkService {
         &self.peer_manager
     }
 
+    /// Returns the transaction gossip state and its metrics.
+    pub fn tx_gossip(&self) -> &Arc<TxGossip> {
+        &self.gossip
+    }
+
     /// Takes the event receiver (can only be called once).
     pub fn subscribe(&mut self) -> Option<mpsc::Receiver<NetworkEvent>> {
         self.event_rx.take()
@@ -244,6 +374,7 @@ impl NetworkService {
 
         let running = self.running.clone();
         let peer_manager = self.peer_manager.clone();
+        let gossip = self.gossip.clone();
         let event_tx = self.event_tx.clone();
         let config = self.config.clone();
         let local_id = self.local_id;
@@ -256,6 +387,7 @@ impl NetworkService {
                 command_rx,
                 conn_event_rx,
                 peer_manager,
+                gossip,
                 event_tx,
                 handles,
                 config,
@@ -267,10 +399,18 @@ impl NetworkService {
             .await;
         });
 
-        // Connect to bootstrap nodes
-        for addr in &self.config.bootstrap_nodes {
+        // Connect to bootstrap nodes (or the allowlist in static mode)
+        let mut addrs = self.peer_manager.get_connectable_addresses();
+        if !self.peer_manager.is_static() && !self.config.seeds.is_empty() {
+            for addr in resolve_seeds(&self.config.seeds).await {
+                if !addrs.contains(&addr) && addr != self.config.listen_addr {
+                    addrs.push(addr);
+                }
+            }
+        }
+        for addr in addrs {
             let _ = command_tx
-                .send(NetworkCommand::Connect(*addr))
+                .send(NetworkCommand::Connect(addr))
                 .await;
         }
 
@@ -293,6 +433,29 @@ impl NetworkService {
             .map_err(|_| NetworkError::ChannelSend)
     }
 
+    /// Announces a local transaction to peers by hash; peers fetch the body
+    /// if they don't have it.
+    pub async fn announce_transaction(&self, tx: SerializableTransaction) -> NetworkResult<()> {
+        let cmd_tx = self.command_tx.as_ref().ok_or(NetworkError::NotRunning)?;
+        cmd_tx
+            .send(NetworkCommand::AnnounceTransaction(tx))
+            .await
+            .map_err(|_| NetworkError::ChannelSend)
+    }
+
+    /// Refuses a transaction received from `from` that failed admission:
+    /// it isn't fetched again, and the peer is penalized.
+    pub async fn reject_transaction(&self, from: PeerId, hash: H256) -> NetworkResult<()> {
+        self.gossip.reject(*hash.as_bytes());
+        let tx = self.command_tx.as_ref().ok_or(NetworkError::NotRunning)?;
+        tx.send(NetworkCommand::ReportPeer {
+            peer: from,
+            misbehavior: Misbehavior::InvalidTransaction,
+        })
+        .await
+        .map_err(|_| NetworkError::ChannelSend)
+    }
+
     /// Sends a message to a specific peer.
     pub async fn send_to(&self, peer: PeerId, msg: NetworkMessage) -> NetworkResult<()> {
         let tx = self.command_tx.as_ref().ok_or(NetworkError::NotRunning)?;
@@ -304,6 +467,16 @@ impl NetworkService {
         .map_err(|_| NetworkError::ChannelSend)
     }
 
+    /// Replaces the static topology allowlist, disconnecting peers that are
+    /// no longer allowed and dialing newly added ones. An empty list returns
+    /// to dynamic discovery.
+    pub async fn update_allowlist(&self, peers: Vec<StaticPeer>) -> NetworkResult<()> {
+        let tx = self.command_tx.as_ref().ok_or(NetworkError::NotRunning)?;
+        tx.send(NetworkCommand::UpdateAllowlist(peers))
+            .await
+            .map_err(|_| NetworkError::ChannelSend)
+    }
+
     /// Accepts incoming connections.
     async fn accept_connections(
         listener: TcpListener,
@@ -340,6 +513,7 @@ impl NetworkService {
         mut command_rx: mpsc::Receiver<NetworkCommand>,
         mut conn_event_rx: mpsc::Receiver<ConnectionEvent>,
         peer_manager: Arc<PeerManager>,
+        gossip: Arc<TxGossip>,
         event_tx: mpsc::Sender<NetworkEvent>,
         peer_handles: Arc<tokio::sync::RwLock<HashMap<PeerId, PeerHandle>>>,
         config: NetworkConfig,
@@ -360,38 +534,34 @@ impl NetworkService {
                                 handles.get(&to).map(|h| h.sender.clone())
                             };
                             if let Some(sender) = sender {
-                                let _ = sender.send(message).await;
+                                let name = message.name();
+                                if !sender.send(message) {
+                                    debug!("Dropped {} to {}: queue full", name, to.short_hex());
+                                }
                             }
                         }
                         NetworkCommand::Broadcast { message } => {
                             let senders: Vec<_> = {
                                 let handles = peer_handles.read().await;
-                                handles.values().map(|h| h.sender.clone()).collect()
+                                handles.iter().map(|(id, h)| (*id, h.sender.clone())).collect()
                             };
-                            for sender in senders {
-                                let _ = sender.send(message.clone()).await;
+                            for (peer, sender) in senders {
+                                if !sender.send(message.clone()) {
+                                    debug!(
+                                        "Dropped {} to {}: queue full",
+                                        message.name(),
+                                        peer.short_hex()
+                                    );
+                                }
                             }
                         }
+                        NetworkCommand::AnnounceTransaction(tx) => {
+                            let peers: Vec<_> = peer_handles.read().await.keys().copied().collect();
+                            let announcements = gossip.announce(tx, &peers);
+                            Self::send_all(announcements, &peer_handles).await;
+                        }
                         NetworkCommand::Connect(addr) => {
-                            let conn_tx = conn_tx.clone();
-                            let timeout = config.connection_timeout;
-                            tokio::spawn(async move {
-                                match tokio::time::timeout(timeout, TcpStream::connect(addr)).await {
-                                    Ok(Ok(stream)) => {
-                                        let _ = conn_tx.send(ConnectionEvent::NewConnection {
-                                            stream,
-                                            addr,
-                                            outgoing: true,
-                                        }).await;
-                                    }
-                                    Ok(Err(e)) => {
-                                        warn!("Failed to connect to {}: {}", addr, e);
-                                    }
-                                    Err(_) => {
-                                        warn!("Connection to {} timed out", addr);
-                                    }
-                                }
-                            });
+                            Self::dial(addr, conn_tx.clone(), config.connection_timeout);
                         }
                         NetworkCommand::Disconnect(peer_id) => {
                             let sender = {
@@ -399,10 +569,36 @@ impl NetworkService {
                                 handles.remove(&peer_id).map(|h| h.sender)
                             };
                             if let Some(sender) = sender {
-                                let _ = sender.send(NetworkMessage::disconnect("requested")).await;
+                                let _ = sender.send(NetworkMessage::disconnect("requested"));
                             }
                             peer_manager.remove_peer(&peer_id);
                         }
+                        NetworkCommand::ReportPeer { peer, misbehavior } => {
+                            Self::penalize(peer, misbehavior, &peer_manager, &peer_handles).await;
+                        }
+                        NetworkCommand::UpdateAllowlist(peers) => {
+                            if peers.is_empty() {
+                                info!("Static topology disabled");
+                                peer_manager.set_allowlist(None);
+                            } else {
+                                info!("Static topology updated: {} allowed peers", peers.len());
+                                peer_manager.set_allowlist(Some(PeerAllowlist::new(peers)));
+                            }
+
+                            for peer_id in peer_manager.disallowed_peers() {
+                                let sender = {
+                                    let mut handles = peer_handles.write().await;
+                                    handles.remove(&peer_id).map(|h| h.sender)
+                                };
+                                if let Some(sender) = sender {
+                                    let _ = sender.send(NetworkMessage::disconnect("not in allowlist"));
+                                }
+                                peer_manager.remove_peer(&peer_id);
+                            }
+                            for addr in peer_manager.get_connectable_addresses() {
+                                Self::dial(addr, conn_tx.clone(), config.connection_timeout);
+                            }
+                        }
                         NetworkCommand::Shutdown => {
                             *running.write() = false;
                             break;
@@ -412,16 +608,17 @@ impl NetworkService {
                 Some(event) = conn_event_rx.recv() => {
                     match event {
                         ConnectionEvent::NewConnection { stream, addr, outgoing } => {
+                            let now = config.clock.now();
                             let info = if outgoing {
-                                PeerInfo::new_outgoing(addr)
+                                PeerInfo::new_outgoing(addr, now)
                             } else {
-                                PeerInfo::new_incoming(addr)
+                                PeerInfo::new_incoming(addr, now)
                             };
                             let temp_id = info.id;
 
                             if peer_manager.add_peer(info).is_ok() {
                                 // Spawn connection handler
-                                let (msg_tx, msg_rx) = mpsc::channel(64);
+                                let (msg_tx, msg_rx) = priority_channel(config.rate_limit.queue_capacity);
                                 {
                                     let mut handles = peer_handles.write().await;
                                     handles.insert(temp_id, PeerHandle { sender: msg_tx });
@@ -430,6 +627,11 @@ impl NetworkService {
                                 let conn_tx = conn_tx.clone();
                                 let genesis = config.genesis_hash;
                                 let pubkey = public_key_bytes;
+                                let limiter =
+                                    RateLimiter::new(&config.rate_limit, Arc::clone(&config.clock));
+                                let revocation = config.revocation_checker.clone();
+                                let compression = config.compression;
+                                let features = config.features.clone();
 
                                 tokio::spawn(async move {
                                     Self::handle_connection(
@@ -440,6 +642,10 @@ impl NetworkService {
                                         pubkey,
                                         outgoing,
                                         msg_rx,
+                                        limiter,
+                                        revocation,
+                                        compression,
+                                        features,
                                         conn_tx,
                                     ).await;
                                 });
@@ -457,7 +663,7 @@ impl NetworkService {
                                         handles.get(&peer_id).map(|h| h.sender.clone())
                                     };
                                     if let Some(sender) = sender {
-                                        let _ = sender.send(NetworkMessage::Peers(peers)).await;
+                                        let _ = sender.send(NetworkMessage::Peers(peers));
                                     }
                                 }
                                 NetworkMessage::Ping(nonce) => {
@@ -466,9 +672,29 @@ impl NetworkService {
                                         handles.get(&peer_id).map(|h| h.sender.clone())
                                     };
                                     if let Some(sender) = sender {
-                                        let _ = sender.send(NetworkMessage::pong(*nonce)).await;
+                                        let _ = sender.send(NetworkMessage::pong(*nonce));
+                                    }
+                                }
+                                NetworkMessage::NewTransactionHashes(hashes) => {
+                                    if let Some(fetch) = gossip.on_announcement(peer_id, hashes) {
+                                        Self::send_all(vec![(peer_id, fetch)], &peer_handles).await;
+                                    }
+                                }
+                                NetworkMessage::GetTransactions(hashes) => {
+                                    if let Some(reply) = gossip.on_request(peer_id, hashes) {
+                                        Self::send_all(vec![(peer_id, reply)], &peer_handles).await;
                                     }
                                 }
+                                NetworkMessage::Transactions(txs) => {
+                                    let txs = txs.clone();
+                                    Self::receive_transactions(peer_id, txs, &gossip, &event_tx)
+                                        .await;
+                                }
+                                NetworkMessage::NewTransaction(tx) => {
+                                    let txs = vec![tx.clone()];
+                                    Self::receive_transactions(peer_id, txs, &gossip, &event_tx)
+                                        .await;
+                                }
                                 _ => {
                                     // Forward to application
                                     let _ = event_tx.send(NetworkEvent::MessageReceived {
@@ -485,11 +711,35 @@ impl NetworkService {
                                 handles.remove(&peer_id);
                             }
                             peer_manager.remove_peer(&peer_id);
+                            gossip.remove_peer(&peer_id);
                             let _ = event_tx.send(NetworkEvent::PeerDisconnected(peer_id)).await;
                         }
-                        ConnectionEvent::HandshakeComplete { temp_id, real_id, public_key, version } => {
+                        ConnectionEvent::HandshakeComplete {
+                            temp_id, real_id, public_key, version, features,
+                        } => {
+                            let rejection = if peer_manager.scorer().is_banned(&real_id) {
+                                Some("banned")
+                            } else if !peer_manager.is_allowed(&real_id) {
+                                Some("not in allowlist")
+                            } else {
+                                None
+                            };
+                            if let Some(reason) = rejection {
+                                debug!("Rejecting peer {}: {}", real_id.short_hex(), reason);
+                                let sender = {
+                                    let mut handles = peer_handles.write().await;
+                                    handles.remove(&temp_id).map(|h| h.sender)
+                                };
+                                if let Some(sender) = sender {
+                                    let _ = sender.send(NetworkMessage::disconnect(reason));
+                                }
+                                peer_manager.remove_peer(&temp_id);
+                                continue;
+                            }
+
                             // Update peer manager with real ID
                             peer_manager.update_peer_id(temp_id, real_id, public_key, version);
+                            peer_manager.set_peer_features(&real_id, features);
 
                             // Update handles map
                             {
@@ -502,6 +752,9 @@ impl NetworkService {
                             info!("Peer connected: {}", real_id.short_hex());
                             let _ = event_tx.send(NetworkEvent::PeerConnected(real_id)).await;
                         }
+                        ConnectionEvent::Misbehaved { peer_id, misbehavior } => {
+                            Self::penalize(peer_id, misbehavior, &peer_manager, &peer_handles).await;
+                        }
                     }
                 }
                 _ = ping_interval.tick() => {
@@ -512,18 +765,23 @@ impl NetworkService {
                     };
                     let ping = NetworkMessage::ping();
                     for sender in senders {
-                        let _ = sender.send(ping.clone()).await;
+                        let _ = sender.send(ping.clone());
                     }
 
-                    // Check for stale peers
-                    let stale = peer_manager.stale_peers(config.peer_timeout);
-                    for peer_id in stale {
+                    // Check for stale peers and peers dropped from the allowlist
+                    let stale = peer_manager.stale_peers(config.peer_timeout)
+                        .into_iter()
+                        .map(|id| (id, "timeout"));
+                    let disallowed = peer_manager.disallowed_peers()
+                        .into_iter()
+                        .map(|id| (id, "not in allowlist"));
+                    for (peer_id, reason) in stale.chain(disallowed).collect::<Vec<_>>() {
                         let sender = {
                             let mut handles = peer_handles.write().await;
                             handles.remove(&peer_id).map(|h| h.sender)
                         };
                         if let Some(sender) = sender {
-                            let _ = sender.send(NetworkMessage::disconnect("timeout")).await;
+                            let _ = sender.send(NetworkMessage::disconnect(reason));
                         }
                         peer_manager.remove_peer(&peer_id);
                     }
@@ -535,6 +793,88 @@ impl NetworkService {
         info!("Network event loop terminated");
     }
 
+    /// Opens an outgoing connection in the background.
+    fn dial(addr: SocketAddr, conn_tx: mpsc::Sender<ConnectionEvent>, timeout: Duration) {
+        tokio::spawn(async move {
+            match tokio::time::timeout(timeout, TcpStream::connect(addr)).await {
+                Ok(Ok(stream)) => {
+                    let _ = conn_tx.send(ConnectionEvent::NewConnection {
+                        stream,
+                        addr,
+                        outgoing: true,
+                    }).await;
+                }
+                Ok(Err(e)) => {
+                    warn!("Failed to connect to {}: {}", addr, e);
+                }
+                Err(_) => {
+                    warn!("Connection to {} timed out", addr);
+                }
+            }
+        });
+    }
+
+    /// Hands fetched transaction bodies not seen before to the application.
+    /// Nothing is relayed here: the application admits each one and
+    /// announces it with `announce_transaction`, or refuses it with
+    /// `reject_transaction`.
+    async fn receive_transactions(
+        from: PeerId,
+        txs: Vec<SerializableTransaction>,
+        gossip: &TxGossip,
+        event_tx: &mpsc::Sender<NetworkEvent>,
+    ) {
+        let fresh = gossip.on_bodies(from, txs);
+        if fresh.is_empty() {
+            return;
+        }
+
+        let _ = event_tx
+            .send(NetworkEvent::MessageReceived {
+                from,
+                message: NetworkMessage::Transactions(fresh),
+            })
+            .await;
+    }
+
+    /// Queues messages for the given peers, skipping disconnected ones.
+    async fn send_all(
+        messages: Vec<(PeerId, NetworkMessage)>,
+        peer_handles: &tokio::sync::RwLock<HashMap<PeerId, PeerHandle>>,
+    ) {
+        for (peer, message) in messages {
+            let sender = {
+                let handles = peer_handles.read().await;
+                handles.get(&peer).map(|h| h.sender.clone())
+            };
+            if let Some(sender) = sender {
+                let _ = sender.send(message);
+            }
+        }
+    }
+
+    /// Lowers a peer's score, disconnecting the peer if it gets banned.
+    async fn penalize(
+        peer_id: PeerId,
+        misbehavior: Misbehavior,
+        peer_manager: &PeerManager,
+        peer_handles: &tokio::sync::RwLock<HashMap<PeerId, PeerHandle>>,
+    ) {
+        if !peer_manager.scorer().report(&peer_id, misbehavior) {
+            return;
+        }
+
+        warn!("Banning peer {} after {:?}", peer_id.short_hex(), misbehavior);
+        let sender = {
+            let mut handles = peer_handles.write().await;
+            handles.remove(&peer_id).map(|h| h.sender)
+        };
+        if let Some(sender) = sender {
+            let _ = sender.send(NetworkMessage::disconnect("banned"));
+        }
+        peer_manager.remove_peer(&peer_id);
+    }
+
     /// Handles a single peer connection.
     #[allow(clippy::too_many_arguments)]
     async fn handle_connection(
@@ -544,7 +884,11 @@ impl NetworkService {
         genesis_hash: H256,
         public_key_bytes: [u8; 64],
         outgoing: bool,
-        mut msg_rx: mpsc::Receiver<NetworkMessage>,
+        mut msg_rx: PriorityReceiver,
+        mut limiter: RateLimiter,
+        revocation: Option<Arc<RevocationChecker>>,
+        compression: Option<CompressionConfig>,
+        features: Vec<String>,
         conn_tx: mpsc::Sender<ConnectionEvent>,
     ) {
         let (read_half, write_half) = stream.into_split();
@@ -552,29 +896,56 @@ impl NetworkService {
         let mut writer = FramedWrite::new(write_half, MessageCodec::new());
 
         // Perform handshake
+        let capabilities = CAP_HEADER_SYNC | if compression.is_some() { CAP_ZSTD } else { 0 };
         let handshake_result = Self::perform_handshake(
             &mut reader,
             &mut writer,
             local_id,
             genesis_hash,
             public_key_bytes,
+            capabilities,
+            features,
             outgoing,
         )
         .await;
 
-        let (real_id, peer_pubkey, peer_version) = match handshake_result {
-            Ok(result) => result,
-            Err(e) => {
-                warn!("Handshake failed: {}", e);
+        let (real_id, peer_pubkey, peer_version, peer_capabilities, peer_features) =
+            match handshake_result {
+                Ok(result) => result,
+                Err(e) => {
+                    warn!("Handshake failed: {}", e);
+                    let _ = conn_tx
+                        .send(ConnectionEvent::ConnectionClosed {
+                            peer_id: temp_id,
+                            reason: format!("handshake failed: {}", e),
+                        })
+                        .await;
+                    return;
+                }
+            };
+
+        // Compress only if both sides support it
+        if peer_capabilities & capabilities & CAP_ZSTD != 0 {
+            reader.decoder_mut().set_compression(compression);
+            writer.encoder_mut().set_compression(compression);
+        }
+
+        // Reject peers whose key is revoked (or unverifiable under hard-fail)
+        let peer_address = peer_pubkey.to_address();
+        if let Some(checker) = &revocation {
+            if let Err(e) = checker.check(&peer_address).await {
+                use futures::SinkExt;
+                warn!("Rejecting peer {}: {}", real_id.short_hex(), e);
+                let _ = writer.send(NetworkMessage::disconnect("revocation check failed")).await;
                 let _ = conn_tx
                     .send(ConnectionEvent::ConnectionClosed {
                         peer_id: temp_id,
-                        reason: format!("handshake failed: {}", e),
+                        reason: format!("revocation check failed: {}", e),
                     })
                     .await;
                 return;
             }
-        };
+        }
 
         // Notify handshake complete
         let _ = conn_tx
@@ -583,12 +954,36 @@ impl NetworkService {
                 real_id,
                 public_key: peer_pubkey,
                 version: peer_version,
+                features: peer_features,
             })
             .await;
 
+        // Re-check the peer's key whenever the cached answer expires
+        let recheck_every = revocation
+            .as_ref()
+            .map_or(Duration::from_secs(3600), |c| c.config().cache_ttl)
+            .max(Duration::from_secs(1));
+        let mut recheck =
+            tokio::time::interval_at(tokio::time::Instant::now() + recheck_every, recheck_every);
+
         // Main message loop
         loop {
             tokio::select! {
+                _ = recheck.tick(), if revocation.is_some() => {
+                    let Some(checker) = &revocation else { continue };
+                    if let Err(e) = checker.check(&peer_address).await {
+                        use futures::SinkExt;
+                        warn!("Disconnecting peer {}: {}", real_id.short_hex(), e);
+                        let _ = writer
+                            .send(NetworkMessage::disconnect("revocation check failed"))
+                            .await;
+                        let _ = conn_tx.send(ConnectionEvent::ConnectionClosed {
+                            peer_id: real_id,
+                            reason: format!("revocation check failed: {}", e),
+                        }).await;
+                        break;
+                    }
+                }
                 msg_result = reader.next() => {
                     match msg_result {
                         Some(Ok(msg)) => {
@@ -599,12 +994,33 @@ impl NetworkService {
                                 }).await;
                                 break;
                             }
+                            if !limiter.allow(msg.priority()) {
+                                debug!(
+                                    "Rate limited {} from {} ({} dropped)",
+                                    msg.name(),
+                                    real_id.short_hex(),
+                                    limiter.dropped()
+                                );
+                                if limiter.take_report() {
+                                    let _ = conn_tx.send(ConnectionEvent::Misbehaved {
+                                        peer_id: real_id,
+                                        misbehavior: Misbehavior::RateLimitExceeded,
+                                    }).await;
+                                }
+                                continue;
+                            }
                             let _ = conn_tx.send(ConnectionEvent::MessageReceived {
                                 peer_id: real_id,
                                 message: msg,
                             }).await;
                         }
                         Some(Err(e)) => {
+                            if matches!(e, NetworkError::Codec(_)) {
+                                let _ = conn_tx.send(ConnectionEvent::Misbehaved {
+                                    peer_id: real_id,
+                                    misbehavior: Misbehavior::MalformedMessage,
+                                }).await;
+                            }
                             let _ = conn_tx.send(ConnectionEvent::ConnectionClosed {
                                 peer_id: real_id,
                                 reason: format!("read error: {}", e),
@@ -622,6 +1038,13 @@ impl NetworkService {
                 }
                 Some(msg) = msg_rx.recv() => {
                     use futures::SinkExt;
+                    // Peers that didn't advertise a message's capability
+                    // can't decode it
+                    let required = msg.required_capability();
+                    if peer_capabilities & required != required {
+                        debug!("Not sending {} to {}", msg.name(), real_id.short_hex());
+                        continue;
+                    }
                     if writer.send(msg).await.is_err() {
                         let _ = conn_tx.send(ConnectionEvent::ConnectionClosed {
                             peer_id: real_id,
@@ -634,15 +1057,19 @@ impl NetworkService {
         }
     }
 
-    /// Performs the handshake protocol.
+    /// Performs the handshake protocol, returning the peer's ID, key,
+    /// protocol version, capability flags and protocol features.
+    #[allow(clippy::too_many_arguments)]
     async fn perform_handshake<R, W>(
         reader: &mut FramedRead<R, MessageCodec>,
         writer: &mut FramedWrite<W, MessageCodec>,
         local_id: PeerId,
         genesis_hash: H256,
         public_key_bytes: [u8; 64],
+        capabilities: u32,
+        features: Vec<String>,
         outgoing: bool,
-    ) -> NetworkResult<(PeerId, PublicKey, u32)>
+    ) -> NetworkResult<(PeerId, PublicKey, u32, u32, Vec<String>)>
     where
         R: tokio::io::AsyncRead + Unpin,
         W: tokio::io::AsyncWrite + Unpin,
@@ -651,7 +1078,13 @@ impl NetworkService {
 
         if outgoing {
             // Send Hello first
-            let hello = NetworkMessage::hello(local_id, genesis_hash, public_key_bytes);
+            let hello = NetworkMessage::hello(
+                local_id,
+                genesis_hash,
+                public_key_bytes,
+                capabilities,
+                features,
+            );
             writer
                 .send(hello)
                 .await
@@ -665,7 +1098,15 @@ impl NetworkService {
                 .map_err(|e| NetworkError::HandshakeFailed(format!("read HelloAck: {}", e)))?;
 
             match response {
-                NetworkMessage::HelloAck { peer_id, public_key } => {
+                NetworkMessage::HelloAck {
+                    version,
+                    peer_id,
+                    public_key,
+                    capabilities: peer_capabilities,
+                    features: peer_features,
+                } => {
+                    let version = negotiate_version(version)?;
+                    check_features(&peer_features)?;
                     let pubkey = PublicKey::from_bytes(&public_key)
                         .map_err(|_| NetworkError::HandshakeFailed("invalid public key".into()))?;
                     let expected_id = PeerId::from_public_key(&pubkey);
@@ -674,7 +1115,7 @@ impl NetworkService {
                             "peer ID doesn't match public key".into(),
                         ));
                     }
-                    Ok((expected_id, pubkey, PROTOCOL_VERSION))
+                    Ok((expected_id, pubkey, version, peer_capabilities, peer_features))
                 }
                 _ => Err(NetworkError::HandshakeFailed("expected HelloAck".into())),
             }
@@ -692,14 +1133,11 @@ impl NetworkService {
                     peer_id,
                     genesis_hash: peer_genesis,
                     public_key,
+                    capabilities: peer_capabilities,
+                    features: peer_features,
                 } => {
                     // Verify version
-                    if version != PROTOCOL_VERSION {
-                        return Err(NetworkError::VersionMismatch {
-                            our_version: PROTOCOL_VERSION,
-                            peer_version: version,
-                        });
-                    }
+                    let version = negotiate_version(version)?;
 
                     // Verify genesis
                     if peer_genesis != *genesis_hash.as_bytes() {
@@ -719,14 +1157,21 @@ impl NetworkService {
                         ));
                     }
 
+                    check_features(&peer_features)?;
+
                     // Send HelloAck
-                    let ack = NetworkMessage::hello_ack(local_id, public_key_bytes);
+                    let ack = NetworkMessage::hello_ack(
+                        local_id,
+                        public_key_bytes,
+                        capabilities,
+                        features,
+                    );
                     writer
                         .send(ack)
                         .await
                         .map_err(|e| NetworkError::HandshakeFailed(format!("send HelloAck: {}", e)))?;
 
-                    Ok((expected_id, pubkey, version))
+                    Ok((expected_id, pubkey, version, peer_capabilities, peer_features))
                 }
                 _ => Err(NetworkError::HandshakeFailed("expected Hello".into())),
             }
@@ -734,6 +1179,25 @@ impl NetworkService {
     }
 }
 
+/// Returns the version to speak with a peer advertising `peer_version`,
+/// rejecting peers outside the supported range.
+fn negotiate_version(peer_version: u32) -> NetworkResult<u32> {
+    NetworkMessage::negotiate_version(peer_version).ok_or(NetworkError::VersionMismatch {
+        our_version: PROTOCOL_VERSION,
+        peer_version,
+    })
+}
+
+/// Rejects feature lists over the advertisement limits.
+fn check_features(features: &[String]) -> NetworkResult<()> {
+    if features.len() > MAX_ADVERTISED_FEATURES
+        || features.iter().any(|f| f.len() > MAX_ADVERTISED_FEATURE_LEN)
+    {
+        return Err(NetworkError::HandshakeFailed("too many or too long features".into()));
+    }
+    Ok(())
+}
+
 /// Helper for hex encoding (used in genesis mismatch error).
 mod hex {
     pub fn encode(bytes: impl AsRef<[u8]>) -> String {
@@ -763,6 +1227,42 @@ mod tests {
         assert!(!service.local_id().as_bytes().iter().all(|&b| b == 0));
     }
 
+    #[tokio::test]
+    async fn test_static_topology_config() {
+        let allowed = PeerId::from_bytes([3u8; 32]);
+        let config = NetworkConfig::default().with_static_peers(vec![StaticPeer::new(
+            "org1",
+            allowed,
+            "127.0.0.1:30310".parse().unwrap(),
+        )]);
+        let service = NetworkService::new(config).await;
+
+        let peers = service.peer_manager();
+        assert!(peers.is_static());
+        assert!(peers.is_allowed(&allowed));
+        assert!(!peers.is_allowed(&PeerId::from_bytes([4u8; 32])));
+    }
+
+    #[tokio::test]
+    async fn test_service_loads_ban_list() {
+        let dir = std::env::temp_dir().join(format!("bach-net-bans-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("bans.bin");
+        let banned = PeerId::from_bytes([7u8; 32]);
+
+        let scoring = ScoringConfig {
+            ban_list_path: Some(path),
+            ..Default::default()
+        };
+        PeerScorer::new(scoring.clone()).ban(&banned, Duration::from_secs(600), "test");
+
+        let config = NetworkConfig::default().with_scoring(scoring);
+        let service = NetworkService::new(config).await;
+        assert!(service.peer_manager().scorer().is_banned(&banned));
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
     #[tokio::test]
     async fn test_peer_to_peer_connection() {
         // Create two services
@@ -0,0 +1,171 @@
+//! Block sync progress
+//!
+//! A node catching up with its peers records how far it has got in a shared
+//! `SyncProgress`: the height it started from, the height it is syncing to,
+//! how far headers have been verified and blocks applied, and how many
+//! ranges are being fetched. The sync engine updates it and the RPC layer
+//! reads snapshots for metrics and the admin API.
+
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+
+/// Sync progress snapshot
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct SyncStatus {
+    /// Whether a sync is running
+    pub syncing: bool,
+    /// Head height when the current (or last) sync started
+    pub start_height: u64,
+    /// Height being synced to
+    pub target_height: u64,
+    /// Highest height whose header chain is verified
+    pub verified_height: u64,
+    /// Highest height applied
+    pub synced_height: u64,
+    /// Ranges being fetched or waiting to be applied
+    pub in_flight_ranges: u64,
+    /// Blocks fetched and not yet applied
+    pub buffered_blocks: u64,
+    /// Blocks fetched since the node started
+    pub fetched_blocks: u64,
+    /// Range fetches that failed and were retried on another peer
+    pub failed_fetches: u64,
+}
+
+impl SyncStatus {
+    /// Returns the blocks still to be applied.
+    pub fn remaining(&self) -> u64 {
+        self.target_height.saturating_sub(self.synced_height)
+    }
+}
+
+/// Shared, lock-free sync progress counters.
+#[derive(Debug, Default)]
+pub struct SyncProgress {
+    syncing: AtomicBool,
+    start_height: AtomicU64,
+    target_height: AtomicU64,
+    verified_height: AtomicU64,
+    synced_height: AtomicU64,
+    in_flight_ranges: AtomicU64,
+    buffered_blocks: AtomicU64,
+    fetched_blocks: AtomicU64,
+    failed_fetches: AtomicU64,
+}
+
+impl SyncProgress {
+    /// Creates idle progress.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Records the start of a sync from `start_height` to `target_height`.
+    pub fn begin(&self, start_height: u64, target_height: u64) {
+        self.start_height.store(start_height, Ordering::Relaxed);
+        self.target_height.store(target_height, Ordering::Relaxed);
+        self.verified_height.store(start_height, Ordering::Relaxed);
+        self.synced_height.store(start_height, Ordering::Relaxed);
+        self.in_flight_ranges.store(0, Ordering::Relaxed);
+        self.buffered_blocks.store(0, Ordering::Relaxed);
+        self.syncing.store(true, Ordering::Relaxed);
+    }
+
+    /// Records the end of a sync, successful or not.
+    pub fn finish(&self) {
+        self.in_flight_ranges.store(0, Ordering::Relaxed);
+        self.buffered_blocks.store(0, Ordering::Relaxed);
+        self.syncing.store(false, Ordering::Relaxed);
+    }
+
+    /// Records that a range fetch started.
+    pub fn range_started(&self) {
+        self.in_flight_ranges.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Records that a range of `blocks` blocks was fetched and buffered.
+    pub fn range_fetched(&self, blocks: u64) {
+        self.buffered_blocks.fetch_add(blocks, Ordering::Relaxed);
+        self.fetched_blocks.fetch_add(blocks, Ordering::Relaxed);
+    }
+
+    /// Records a failed range fetch.
+    pub fn fetch_failed(&self) {
+        self.failed_fetches.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Records that a fetched range was applied (or dropped) and left the
+    /// pipeline.
+    pub fn range_done(&self, blocks: u64) {
+        let _ = self
+            .in_flight_ranges
+            .fetch_update(Ordering::Relaxed, Ordering::Relaxed, |n| {
+                Some(n.saturating_sub(1))
+            });
+        let _ = self
+            .buffered_blocks
+            .fetch_update(Ordering::Relaxed, Ordering::Relaxed, |n| {
+                Some(n.saturating_sub(blocks))
+            });
+    }
+
+    /// Records that headers up to `height` are verified.
+    pub fn set_verified(&self, height: u64) {
+        self.verified_height.fetch_max(height, Ordering::Relaxed);
+    }
+
+    /// Records that blocks up to `height` are applied.
+    pub fn set_synced(&self, height: u64) {
+        self.synced_height.fetch_max(height, Ordering::Relaxed);
+    }
+
+    /// Returns a snapshot of the progress.
+    pub fn status(&self) -> SyncStatus {
+        SyncStatus {
+            syncing: self.syncing.load(Ordering::Relaxed),
+            start_height: self.start_height.load(Ordering::Relaxed),
+            target_height: self.target_height.load(Ordering::Relaxed),
+            verified_height: self.verified_height.load(Ordering::Relaxed),
+            synced_height: self.synced_height.load(Ordering::Relaxed),
+            in_flight_ranges: self.in_flight_ranges.load(Ordering::Relaxed),
+            buffered_blocks: self.buffered_blocks.load(Ordering::Relaxed),
+            fetched_blocks: self.fetched_blocks.load(Ordering::Relaxed),
+            failed_fetches: self.failed_fetches.load(Ordering::Relaxed),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_progress_lifecycle() {
+        let progress = SyncProgress::new();
+        assert!(!progress.status().syncing);
+
+        progress.begin(10, 50);
+        progress.range_started();
+        progress.range_started();
+        progress.range_fetched(20);
+        progress.set_verified(30);
+        let status = progress.status();
+        assert!(status.syncing);
+        assert_eq!(status.in_flight_ranges, 2);
+        assert_eq!(status.buffered_blocks, 20);
+        assert_eq!(status.verified_height, 30);
+        assert_eq!(status.remaining(), 40);
+
+        progress.range_done(20);
+        progress.set_synced(30);
+        progress.set_synced(25);
+        let status = progress.status();
+        assert_eq!(status.in_flight_ranges, 1);
+        assert_eq!(status.buffered_blocks, 0);
+        assert_eq!(status.synced_height, 30);
+
+        progress.finish();
+        let status = progress.status();
+        assert!(!status.syncing);
+        assert_eq!(status.in_flight_ranges, 0);
+        assert_eq!(status.fetched_blocks, 20);
+    }
+}
@@ -0,0 +1,110 @@
+//! Static network topology
+
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::net::SocketAddr;
+
+use crate::peer::PeerId;
+
+/// A peer permitted in static topology mode.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct StaticPeer {
+    /// Organization operating the node
+    pub org: String,
+    /// Expected node ID
+    pub node_id: PeerId,
+    /// Address to dial
+    pub address: SocketAddr,
+}
+
+impl StaticPeer {
+    /// Creates a static peer entry.
+    pub fn new(org: impl Into<String>, node_id: PeerId, address: SocketAddr) -> Self {
+        Self {
+            org: org.into(),
+            node_id,
+            address,
+        }
+    }
+}
+
+/// The set of peers a node may talk to when dynamic discovery is disabled.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct PeerAllowlist {
+    peers: HashMap<PeerId, StaticPeer>,
+}
+
+impl PeerAllowlist {
+    /// Builds an allowlist. Later entries replace earlier ones with the same node ID.
+    pub fn new(peers: impl IntoIterator<Item = StaticPeer>) -> Self {
+        Self {
+            peers: peers.into_iter().map(|p| (p.node_id, p)).collect(),
+        }
+    }
+
+    /// Returns true if the node ID is allowed.
+    pub fn contains(&self, id: &PeerId) -> bool {
+        self.peers.contains_key(id)
+    }
+
+    /// Returns the entry for a node ID.
+    pub fn get(&self, id: &PeerId) -> Option<&StaticPeer> {
+        self.peers.get(id)
+    }
+
+    /// Returns the addresses of all allowed peers.
+    pub fn addresses(&self) -> Vec<SocketAddr> {
+        self.peers.values().map(|p| p.address).collect()
+    }
+
+    /// Returns all entries belonging to an organization.
+    pub fn org_peers(&self, org: &str) -> Vec<&StaticPeer> {
+        self.peers.values().filter(|p| p.org == org).collect()
+    }
+
+    /// Returns the number of allowed peers.
+    pub fn len(&self) -> usize {
+        self.peers.len()
+    }
+
+    /// Returns true if no peers are allowed.
+    pub fn is_empty(&self) -> bool {
+        self.peers.is_empty()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn entry(org: &str, n: u8, port: u16) -> StaticPeer {
+        StaticPeer::new(
+            org,
+            PeerId::from_bytes([n; 32]),
+            format!("127.0.0.1:{}", port).parse().unwrap(),
+        )
+    }
+
+    #[test]
+    fn test_allowlist_lookup() {
+        let list = PeerAllowlist::new(vec![
+            entry("org1", 1, 30301),
+            entry("org1", 2, 30302),
+            entry("org2", 3, 30303),
+        ]);
+
+        assert_eq!(list.len(), 3);
+        assert!(list.contains(&PeerId::from_bytes([1; 32])));
+        assert!(!list.contains(&PeerId::from_bytes([9; 32])));
+        assert_eq!(list.org_peers("org1").len(), 2);
+        assert_eq!(list.get(&PeerId::from_bytes([3; 32])).unwrap().org, "org2");
+    }
+
+    #[test]
+    fn test_duplicate_node_id_replaced() {
+        let list = PeerAllowlist::new(vec![entry("org1", 1, 30301), entry("org1", 1, 30399)]);
+
+        assert_eq!(list.len(), 1);
+        assert_eq!(list.addresses(), vec!["127.0.0.1:30399".parse().unwrap()]);
+    }
+}
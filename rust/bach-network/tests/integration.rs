@@ -2,11 +2,11 @@
 
 use bach_network::{
     MessageCodec, NetworkConfig, NetworkMessage, NetworkService, PeerId, PeerInfo,
-    PeerManager, PROTOCOL_VERSION,
+    PeerManager, SerializableHeader, PROTOCOL_VERSION,
 };
 use bach_primitives::H256;
 use std::net::SocketAddr;
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
 /// Test message codec roundtrip with various message types.
 #[test]
@@ -18,6 +18,16 @@ fn test_codec_all_message_types() {
         NetworkMessage::Pong(12345),
         NetworkMessage::GetBlocks { start: 0, count: 10 },
         NetworkMessage::Blocks(vec![]),
+        NetworkMessage::GetBlockHeaders { start: 1, count: 128 },
+        NetworkMessage::BlockHeaders(vec![SerializableHeader {
+            height: 1,
+            parent_hash: [0x01; 32],
+            timestamp: 1000,
+            transactions_hash: [0x02; 32],
+            state_root: [0x03; 32],
+            hash: [0x04; 32],
+            legacy_hash: Some([0x05; 32]),
+        }]),
         NetworkMessage::NewBlockHash {
             height: 100,
             hash: [0xab; 32],
@@ -48,8 +58,8 @@ fn test_peer_manager_operations() {
     let addr1: SocketAddr = "192.168.1.1:8080".parse().unwrap();
     let addr2: SocketAddr = "192.168.1.2:8080".parse().unwrap();
 
-    let info1 = PeerInfo::new_incoming(addr1);
-    let info2 = PeerInfo::new_incoming(addr2);
+    let info1 = PeerInfo::new_incoming(addr1, Instant::now());
+    let info2 = PeerInfo::new_incoming(addr2, Instant::now());
 
     let id1 = info1.id;
     let id2 = info2.id;
@@ -76,11 +86,11 @@ fn test_peer_status_transitions() {
     let addr: SocketAddr = "127.0.0.1:8080".parse().unwrap();
 
     // Outgoing connection starts as Connecting
-    let outgoing = PeerInfo::new_outgoing(addr);
+    let outgoing = PeerInfo::new_outgoing(addr, Instant::now());
     assert_eq!(outgoing.status, PeerStatus::Connecting);
 
     // Incoming connection starts as Connected
-    let incoming = PeerInfo::new_incoming(addr);
+    let incoming = PeerInfo::new_incoming(addr, Instant::now());
     assert_eq!(incoming.status, PeerStatus::Connected);
 }
 
@@ -88,19 +98,20 @@ fn test_peer_status_transitions() {
 #[test]
 fn test_peer_backoff() {
     let addr: SocketAddr = "127.0.0.1:8080".parse().unwrap();
-    let mut info = PeerInfo::new_outgoing(addr);
+    let now = Instant::now();
+    let mut info = PeerInfo::new_outgoing(addr, now);
 
     // Initial state - can retry
-    assert!(info.can_retry());
+    assert!(info.can_retry(now));
 
     // After failure - exponential backoff
-    info.record_failure();
+    info.record_failure(now);
     let backoff1 = info.backoff_duration();
 
-    info.record_failure();
+    info.record_failure(now);
     let backoff2 = info.backoff_duration();
 
-    info.record_failure();
+    info.record_failure(now);
     let backoff3 = info.backoff_duration();
 
     // Backoff should increase exponentially
@@ -115,7 +126,7 @@ fn test_hello_message() {
     let genesis = H256::from([2u8; 32]);
     let pubkey = [3u8; 64];
 
-    let msg = NetworkMessage::hello(peer_id, genesis, pubkey);
+    let msg = NetworkMessage::hello(peer_id, genesis, pubkey, 0, Vec::new());
 
     match msg {
         NetworkMessage::Hello {
@@ -123,11 +134,15 @@ fn test_hello_message() {
             peer_id: pid,
             genesis_hash,
             public_key,
+            capabilities,
+            features,
         } => {
             assert_eq!(version, PROTOCOL_VERSION);
             assert_eq!(pid, [1u8; 32]);
             assert_eq!(genesis_hash, [2u8; 32]);
             assert_eq!(public_key, pubkey);
+            assert_eq!(capabilities, 0);
+            assert!(features.is_empty());
         }
         _ => panic!("expected Hello message"),
     }
@@ -0,0 +1,226 @@
+//! Proposed block simulation for consensus
+//!
+//! `ExecutionVerifier` is the node's `BlockVerifier`: it runs a proposed
+//! block through the scheduler on a copy-on-write branch of its parent's
+//! state, so the engine only pre-votes for blocks that extend a known block
+//! and execute, and the cached result can be checked against the state root
+//! when the block commits.
+//!
+//! The shared `VerifierHead` keeps the states in a `SnapshotManager`: the
+//! committed one and one per verified block, so competing proposals at a
+//! height share unchanged state and a proposal extending a verified but
+//! uncommitted block branches from that block. The node moves the head to
+//! each committed block, which drops the branches that conflict with it.
+
+use bach_consensus::{BlockVerifier, Verdict, VerificationResult};
+use bach_crypto::HashSchedule;
+use bach_primitives::H256;
+use bach_scheduler::{Scheduler, SeamlessScheduler, TransactionExecutor};
+use bach_state::{Snapshot, SnapshotManager};
+use bach_types::{Block, ReadWriteSet};
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+
+/// The committed and verified block states proposals branch from.
+#[derive(Debug, Clone)]
+pub struct VerifierHead {
+    inner: Arc<RwLock<HeadState>>,
+}
+
+#[derive(Debug)]
+struct HeadState {
+    snapshots: SnapshotManager,
+    /// Names verified blocks as their children reference them
+    schedule: HashSchedule,
+}
+
+impl VerifierHead {
+    /// Starts at block `hash` at `height` with state `state`.
+    pub fn new(height: u64, hash: H256, state: Snapshot) -> Self {
+        Self {
+            inner: Arc::new(RwLock::new(HeadState {
+                snapshots: SnapshotManager::new(height, hash, state),
+                schedule: HashSchedule::default(),
+            })),
+        }
+    }
+
+    /// Moves the head to the committed block `hash` at `height` with
+    /// state `state`, keeping the verified blocks that extend it. Later
+    /// blocks are named under `schedule`.
+    pub fn advance(&self, height: u64, hash: H256, state: Snapshot, schedule: HashSchedule) {
+        let mut head = self.inner.write().unwrap();
+        if head.snapshots.commit(height, hash).is_none() {
+            // Not verified here, e.g. our own proposal or a synced block
+            head.snapshots = SnapshotManager::new(height, hash, state);
+        }
+        head.schedule = schedule;
+    }
+
+    /// Returns the committed height.
+    pub fn height(&self) -> u64 {
+        self.inner.read().unwrap().snapshots.committed_height()
+    }
+
+    /// Returns the number of verified blocks above the committed one.
+    pub fn branch_count(&self) -> usize {
+        self.inner.read().unwrap().snapshots.branch_count()
+    }
+}
+
+/// Verifies proposals by executing them on a branch of the head state.
+pub struct ExecutionVerifier {
+    head: VerifierHead,
+    scheduler: SeamlessScheduler,
+    executor: Arc<dyn TransactionExecutor>,
+}
+
+impl ExecutionVerifier {
+    /// Creates a verifier executing with `scheduler` and `executor` on top
+    /// of `head`.
+    pub fn new(
+        head: VerifierHead,
+        scheduler: SeamlessScheduler,
+        executor: Arc<dyn TransactionExecutor>,
+    ) -> Self {
+        Self {
+            head,
+            scheduler,
+            executor,
+        }
+    }
+}
+
+impl BlockVerifier for ExecutionVerifier {
+    fn verify(&self, block: &Block) -> VerificationResult {
+        let (branch, hash) = {
+            let head = self.head.inner.read().unwrap();
+            let branch = head.snapshots.branch(block.height, &block.parent_hash);
+            (branch, block.digests(&head.schedule).hash)
+        };
+        let invalid = |reason: String| VerificationResult {
+            rwsets: Vec::new(),
+            state_root: H256::zero(),
+            verdict: Verdict::Invalid(reason),
+        };
+        let Some(mut branch) = branch else {
+            return invalid(format!(
+                "parent {:?} of block {} is unknown",
+                block.parent_hash, block.height
+            ));
+        };
+
+        let result =
+            match self.scheduler.schedule(block.clone(), &mut branch, self.executor.as_ref()) {
+                Ok(result) => result,
+                Err(e) => return invalid(format!("execution failed: {:?}", e)),
+            };
+        self.head.inner.write().unwrap().snapshots.insert(
+            block.height,
+            hash,
+            block.parent_hash,
+            branch,
+        );
+        let mut rwsets: HashMap<H256, ReadWriteSet> = result
+            .confirmed
+            .into_iter()
+            .map(|etx| (etx.hash(), etx.rwset))
+            .collect();
+        VerificationResult {
+            rwsets: block
+                .transactions
+                .iter()
+                .map(|tx| rwsets.remove(&tx.hash()).unwrap_or_default())
+                .collect(),
+            state_root: result.state_root,
+            verdict: Verdict::Valid,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_crypto::PrivateKey;
+    use bach_primitives::U256;
+    use bach_scheduler::ExecutionResult;
+    use bach_state::{MemoryStateDB, StateDB};
+    use bach_types::Transaction;
+
+    /// Writes each transaction's data under the key `keccak256(data)`.
+    struct DataWriter;
+
+    impl TransactionExecutor for DataWriter {
+        fn execute(&self, tx: &Transaction, _: &Snapshot) -> (ReadWriteSet, ExecutionResult) {
+            let mut rwset = ReadWriteSet::new();
+            rwset.record_write(bach_crypto::keccak256(&tx.data), tx.data.clone());
+            (rwset, ExecutionResult::Success { output: Vec::new() })
+        }
+    }
+
+    fn tx(key: &PrivateKey, nonce: u64) -> Transaction {
+        let data = vec![nonce as u8];
+        Transaction::new(nonce, None, U256::ZERO, data, key.sign(&H256::zero()))
+    }
+
+    #[test]
+    fn test_verifies_against_head() {
+        let state = MemoryStateDB::new();
+        let genesis = H256::from([1u8; 32]);
+        let head = VerifierHead::new(0, genesis, state.snapshot());
+        let verifier =
+            ExecutionVerifier::new(head.clone(), SeamlessScheduler::new(1), Arc::new(DataWriter));
+
+        let key = PrivateKey::random();
+        let block = Block::new(1, genesis, vec![tx(&key, 0), tx(&key, 1)], 1000);
+        let result = verifier.verify(&block);
+        assert!(result.verdict.is_valid());
+        assert_eq!(result.rwsets.len(), 2);
+        assert_eq!(result.rwsets[1].writes()[0].1, vec![1]);
+
+        // Executing the block for real gives the same root
+        let mut committed = MemoryStateDB::new();
+        let executed = SeamlessScheduler::new(1)
+            .schedule(block.clone(), &mut committed, &DataWriter)
+            .unwrap();
+        assert_eq!(result.state_root, executed.state_root);
+
+        // Proposals on unknown blocks are rejected
+        let orphan = Block::new(2, H256::from([9u8; 32]), vec![tx(&key, 2)], 1001);
+        assert!(!verifier.verify(&orphan).verdict.is_valid());
+    }
+
+    #[test]
+    fn test_branches_share_verified_parents() {
+        let state = MemoryStateDB::new();
+        let genesis = H256::from([1u8; 32]);
+        let head = VerifierHead::new(0, genesis, state.snapshot());
+        let verifier =
+            ExecutionVerifier::new(head.clone(), SeamlessScheduler::new(1), Arc::new(DataWriter));
+        let key = PrivateKey::random();
+
+        // Two competing proposals at height 1, and a child of the first
+        let first = Block::new(1, genesis, vec![tx(&key, 0)], 1000);
+        let second = Block::new(1, genesis, vec![tx(&key, 1)], 1000);
+        let child = Block::new(2, first.hash(), vec![tx(&key, 2)], 1001);
+        for block in [&first, &second, &child] {
+            assert!(verifier.verify(block).verdict.is_valid());
+        }
+        assert_eq!(head.branch_count(), 3);
+
+        // The child sees its parent's writes
+        let mut committed = MemoryStateDB::new();
+        let scheduler = SeamlessScheduler::new(1);
+        scheduler.schedule(first.clone(), &mut committed, &DataWriter).unwrap();
+        let executed = scheduler.schedule(child.clone(), &mut committed, &DataWriter).unwrap();
+        assert_eq!(verifier.verify(&child).state_root, executed.state_root);
+
+        // Committing the first drops the competing proposal
+        head.advance(1, first.hash(), committed.snapshot(), HashSchedule::default());
+        assert_eq!((head.height(), head.branch_count()), (1, 1));
+
+        // A block verified nowhere resets the head to the committed state
+        head.advance(2, H256::from([7u8; 32]), committed.snapshot(), HashSchedule::default());
+        assert_eq!((head.height(), head.branch_count()), (2, 0));
+    }
+}
@@ -0,0 +1,228 @@
+//! Block commit pipeline
+
+use crate::outbox::EventOutbox;
+use bach_contracts::IndexSpec;
+use bach_crypto::HashSchedule;
+use bach_msgbus::{BlockCommitReport, DagStats, Message, MsgBus, PhaseTimer, PhaseTimings};
+use bach_primitives::{Address, Clock, SystemClock, H256};
+use bach_storage::{
+    chain_receipts_root, receipts_root, BlockHeader, GasReportBuilder, GasUsage, HeaderExtension,
+    LogsBloom, OutboxEvent, Storage, StorageError, TransactionReceipt,
+};
+use bach_types::{Block, TxDag};
+use std::collections::HashMap;
+use std::sync::Arc;
+
+/// Everything produced by executing a finalized block.
+#[derive(Debug, Clone, Copy)]
+pub struct BlockCommit<'a> {
+    /// The finalized block
+    pub block: &'a Block,
+    /// State root after executing the block
+    pub state_root: H256,
+    /// Sparse Merkle commitment over the state after the block, recorded
+    /// in the header extension when present
+    pub state_commitment: Option<H256>,
+    /// Storage writes as (contract, slot, value)
+    pub writes: &'a [(Address, H256, H256)],
+    /// Hash of the transaction that last wrote each entry of `writes`,
+    /// recorded in the key history; empty if unknown
+    pub writers: &'a [H256],
+    /// Full values of `writes`, in the same order, for maintaining the
+    /// secondary indexes contracts declared; empty if unknown
+    pub values: &'a [Vec<u8>],
+    /// Code the block deployed or replaced, by account; empty code clears
+    /// an account's code
+    pub code: &'a [(Address, Vec<u8>)],
+    /// Receipts in block order
+    pub receipts: &'a [TransactionReceipt],
+    /// Dependencies between the block's transactions, if known
+    pub dag: Option<&'a TxDag>,
+    /// Re-executions caused by read-write conflicts
+    pub conflicts: usize,
+    /// Pre-commit signatures collected for the block
+    pub signatures: usize,
+}
+
+/// Persists finalized blocks and publishes a report for each one.
+#[derive(Debug, Clone)]
+pub struct BlockCommitter {
+    bus: Arc<MsgBus>,
+    clock: Arc<dyn Clock>,
+    outbox: EventOutbox,
+}
+
+impl BlockCommitter {
+    /// Creates a committer publishing reports on the given bus.
+    pub fn new(bus: Arc<MsgBus>) -> Self {
+        Self::with_clock(bus, Arc::new(SystemClock))
+    }
+
+    /// Creates a committer that times commit phases on the given clock.
+    pub fn with_clock(bus: Arc<MsgBus>, clock: Arc<dyn Clock>) -> Self {
+        let outbox = EventOutbox::new(Arc::clone(&bus));
+        Self { bus, clock, outbox }
+    }
+
+    /// Returns the outbox dispatcher publishing committed blocks.
+    pub fn outbox(&self) -> &EventOutbox {
+        &self.outbox
+    }
+
+    /// Writes the block to storage, then publishes it with its receipts and
+    /// state changes, and its `BlockCommitReport`.
+    ///
+    /// The block is written last, together with its outbox event, so a
+    /// block is only committed once its events are durable. If publishing
+    /// fails the commit still succeeds and the event is retried later.
+    pub fn commit(
+        &self,
+        storage: &Storage,
+        commit: BlockCommit<'_>,
+    ) -> Result<BlockCommitReport, StorageError> {
+        self.commit_with_schedule(storage, commit, &HashSchedule::default())
+    }
+
+    /// Like `commit`, hashing the block with the algorithm `schedule` puts
+    /// in force at its height. A transition block is also stored under its
+    /// legacy hash, which the report carries.
+    pub fn commit_with_schedule(
+        &self,
+        storage: &Storage,
+        commit: BlockCommit<'_>,
+        schedule: &HashSchedule,
+    ) -> Result<BlockCommitReport, StorageError> {
+        let block = commit.block;
+        let digests = block.digests(schedule);
+        let block_hash = digests.hash;
+        let mut timer = PhaseTimer::start_on(Arc::clone(&self.clock));
+        let mut phases = PhaseTimings::default();
+
+        let changes = storage
+            .state
+            .apply_block_writes_from(block.height, commit.writes, commit.writers)?;
+        update_indexes(storage, commit.writes, commit.values)?;
+        for (address, code) in commit.code {
+            storage.state.set_account_code(address, code)?;
+        }
+        phases.state_micros = timer.lap();
+
+        for receipt in commit.receipts {
+            storage.transactions.put_receipt(receipt)?;
+        }
+        storage.transactions.index_block_transactions(block)?;
+        storage
+            .transactions
+            .put_gas_report(block.height, &gas_report(block, commit.receipts))?;
+        if let Some(dag) = commit.dag {
+            storage.transactions.put_tx_dag(block.height, dag)?;
+        }
+        phases.receipts_micros = timer.lap();
+
+        storage.blocks.put_block_header(
+            &block_hash,
+            &BlockHeader::from_block_with(
+                block,
+                commit.state_root,
+                schedule.algorithm_at(block.height),
+            ),
+        )?;
+        let receipts_root = receipts_root(commit.receipts);
+        let parent_chain_root = storage
+            .blocks
+            .get_header_extension(&block.parent_hash)
+            .and_then(|parent| parent.receipts_chain_root)
+            .map_or_else(H256::zero, H256::from);
+        let extension = HeaderExtension {
+            state_commitment: commit.state_commitment.map(|c| *c.as_bytes()),
+            logs_bloom: Some(LogsBloom::from_logs(
+                commit.receipts.iter().flat_map(|receipt| &receipt.logs),
+            )),
+            receipts_root: Some(*receipts_root.as_bytes()),
+            receipts_chain_root: Some(
+                *chain_receipts_root(parent_chain_root, receipts_root).as_bytes(),
+            ),
+        };
+        storage.blocks.put_header_extension(&block_hash, &extension)?;
+        let event = OutboxEvent {
+            block_hash: *block_hash.as_bytes(),
+            receipts: commit.receipts.to_vec(),
+            changes,
+        };
+        storage.blocks.put_block_with_digests(block, &digests, &event)?;
+        phases.block_micros = timer.lap();
+
+        storage.flush()?;
+        phases.flush_micros = timer.lap();
+
+        let report = BlockCommitReport {
+            height: block.height,
+            block_hash: *block_hash.as_bytes(),
+            legacy_block_hash: digests.legacy_hash.map(|hash| *hash.as_bytes()),
+            tx_count: block.transactions.len(),
+            failed_tx_count: commit.receipts.iter().filter(|r| !r.status).count(),
+            write_count: commit.writes.len(),
+            conflicts: commit.conflicts,
+            signatures: commit.signatures,
+            dag: commit.dag.map(DagStats::from_dag),
+            phases,
+        };
+
+        tracing::info!(
+            height = report.height,
+            hash = %block_hash,
+            txs = report.tx_count,
+            conflicts = report.conflicts,
+            total_us = report.phases.total_micros(),
+            "Block committed"
+        );
+
+        if let Err(e) = self.outbox.dispatch(storage) {
+            tracing::warn!(height = report.height, "Failed to publish block events: {}", e);
+        }
+        self.bus
+            .publish(Message::CommitReport(Arc::new(report.clone())));
+        Ok(report)
+    }
+}
+
+/// Sums the gas the block's contract calls used per contract method, from
+/// the receipts in block order. Creations have no contract to charge.
+fn gas_report(block: &Block, receipts: &[TransactionReceipt]) -> Vec<GasUsage> {
+    let mut report = GasReportBuilder::new();
+    for (tx, receipt) in block.transactions.iter().zip(receipts) {
+        if let Some(contract) = &tx.to {
+            report.record(contract, &tx.data, receipt.gas_used);
+        }
+    }
+    report.finish()
+}
+
+/// Updates the secondary indexes the written contracts declared with the
+/// new values of their slots.
+fn update_indexes(
+    storage: &Storage,
+    writes: &[(Address, H256, H256)],
+    values: &[Vec<u8>],
+) -> Result<(), StorageError> {
+    if values.is_empty() {
+        return Ok(());
+    }
+    let mut specs: HashMap<Address, Vec<IndexSpec>> = HashMap::new();
+    for (contract, name, data) in storage.state.get_index_specs() {
+        match IndexSpec::decode(&data) {
+            Ok(spec) => specs.entry(contract).or_default().push(spec),
+            Err(e) => tracing::warn!(%contract, name, "Skipping index: {}", e),
+        }
+    }
+
+    for ((contract, slot, _), value) in writes.iter().zip(values) {
+        for spec in specs.get(contract).into_iter().flatten() {
+            let index_key = spec.index_key(value);
+            storage
+                .state
+                .update_index_entry(contract, &spec.name, slot, index_key.as_deref())?;
+        }
+    }
+    Ok(())
+}
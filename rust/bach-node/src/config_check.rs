@@ -0,0 +1,426 @@
+//! Config file validation
+//!
+//! Serde only checks that a config file has the right shape: a port of 0,
+//! RPC enabled without an address or a misspelt key (which TOML parsing
+//! silently ignores) all load fine and fail later, or never. `NodeConfig`
+//! validation checks a node's local config before anything uses it:
+//! values out of range, settings another setting requires, member and role
+//! names that don't parse and retention windows that don't fit together
+//! are errors; unknown keys and deprecated settings are
+//! warnings. `validate_chain_config` checks a chain config file (JSON, as
+//! `chain-config show -o json` prints parameters) the same way, running
+//! every parameter through the setter that update transactions use.
+//!
+//! `NodeConfig::load` refuses configs with errors and logs the warnings;
+//! `bach-node util validate-config` reports both for node and chain config
+//! files before they are deployed.
+
+use crate::{NodeConfig, NodeError, DEFAULT_WARMUP_BLOCKS};
+use bach_contracts::{is_did, ChainConfig, CONFIG_PARAMS, PROTOCOL_FEATURES};
+use bach_crypto::PrivateKey;
+use bach_network::{RevocationPolicy, SeedSource};
+use bach_primitives::Address;
+use bach_rpc::AdminRole;
+use bach_storage::DEFAULT_BLOCK_CACHE_SIZE;
+use serde::Serialize;
+use std::path::Path;
+
+/// How serious a config issue is
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Severity {
+    /// The config can't be used
+    Error,
+    /// The config works, but likely not as intended
+    Warning,
+}
+
+impl Severity {
+    /// Returns the severity name.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Error => "error",
+            Self::Warning => "warning",
+        }
+    }
+}
+
+/// A problem found in a config file
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ConfigIssue {
+    /// How serious the issue is
+    pub severity: Severity,
+    /// Key the issue is about
+    pub field: String,
+    /// What is wrong
+    pub message: String,
+}
+
+/// Issues found in one config file
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ConfigReport {
+    /// Issues in the order found
+    pub issues: Vec<ConfigIssue>,
+}
+
+impl ConfigReport {
+    /// Returns true if the report holds no errors.
+    pub fn is_valid(&self) -> bool {
+        self.errors().next().is_none()
+    }
+
+    /// Returns the errors.
+    pub fn errors(&self) -> impl Iterator<Item = &ConfigIssue> {
+        self.issues
+            .iter()
+            .filter(|issue| issue.severity == Severity::Error)
+    }
+
+    /// Returns the warnings.
+    pub fn warnings(&self) -> impl Iterator<Item = &ConfigIssue> {
+        self.issues
+            .iter()
+            .filter(|issue| issue.severity == Severity::Warning)
+    }
+
+    fn error(&mut self, field: &str, message: impl Into<String>) {
+        self.add(Severity::Error, field, message.into());
+    }
+
+    fn warn(&mut self, field: &str, message: impl Into<String>) {
+        self.add(Severity::Warning, field, message.into());
+    }
+
+    fn add(&mut self, severity: Severity, field: &str, message: String) {
+        self.issues.push(ConfigIssue {
+            severity,
+            field: field.to_string(),
+            message,
+        });
+    }
+
+    /// Warns about the top-level keys of `file` that `T` doesn't have.
+    fn unknown_keys<T: Serialize>(&mut self, file: &serde_json::Value, known: &T) {
+        let (Some(file), Ok(serde_json::Value::Object(known))) =
+            (file.as_object(), serde_json::to_value(known))
+        else {
+            return;
+        };
+        for key in file.keys().filter(|key| !known.contains_key(*key)) {
+            self.warn(key, "unknown key, ignored");
+        }
+    }
+}
+
+impl NodeConfig {
+    /// Loads a config file, refusing it if validation finds errors.
+    /// Warnings are logged.
+    pub fn load(path: &Path) -> Result<Self, NodeError> {
+        let content = std::fs::read_to_string(path)?;
+        let (config, report) = Self::parse(&content)?;
+        for issue in report.warnings() {
+            tracing::warn!(field = %issue.field, "{}: {}", path.display(), issue.message);
+        }
+        if !report.is_valid() {
+            let errors: Vec<String> = report
+                .errors()
+                .map(|issue| format!("{}: {}", issue.field, issue.message))
+                .collect();
+            return Err(NodeError::ConfigError(format!(
+                "Invalid config {}: {}",
+                path.display(),
+                errors.join("; ")
+            )));
+        }
+        Ok(config)
+    }
+
+    /// Parses a TOML config and validates it, including the keys it
+    /// doesn't know.
+    pub fn parse(content: &str) -> Result<(Self, ConfigReport), NodeError> {
+        let config: Self = toml::from_str(content)
+            .map_err(|e| NodeError::ConfigError(format!("Failed to parse config: {}", e)))?;
+        let mut report = ConfigReport::default();
+        if let Ok(file) = toml::from_str::<serde_json::Value>(content) {
+            report.unknown_keys(&file, &config);
+        }
+        report.issues.extend(config.validate().issues);
+        Ok((config, report))
+    }
+
+    /// Checks the config's values and how they fit together.
+    pub fn validate(&self) -> ConfigReport {
+        let mut report = ConfigReport::default();
+        let defaults = NodeConfig::default();
+
+        if self.chain_id == 0 {
+            report.error("chain_id", "must be positive");
+        }
+        if self.listen_addr.port() == 0 {
+            report.error("listen_addr", "port must be positive");
+        }
+        for seed in &self.seeds {
+            if seed.parse::<SeedSource>().is_err() {
+                report.error("seeds", format!("{} is not host:port or srv:<name>", seed));
+            }
+        }
+        if let Some(key) = &self.validator_key {
+            if PrivateKey::from_bytes(key).is_err() {
+                report.error("validator_key", "not a valid private key");
+            }
+        }
+        if self.block_time_ms != defaults.block_time_ms {
+            report.warn(
+                "block_time_ms",
+                "deprecated and ignored; blocks follow the chain config's proposal_interval_ms",
+            );
+        }
+        if self.max_txs_per_block == 0 {
+            report.error("max_txs_per_block", "must be positive");
+        }
+
+        match self.rpc_addr {
+            None if self.rpc_enabled => {
+                report.error("rpc_addr", "required when rpc_enabled is set");
+            }
+            Some(addr) if self.rpc_enabled && addr == self.listen_addr => {
+                report.error("rpc_addr", "same as listen_addr");
+            }
+            _ => {}
+        }
+        for member in &self.rpc_auth_members {
+            check_member(&mut report, "rpc_auth_members", member);
+        }
+        if !self.rpc_auth_members.is_empty()
+            && self.validator_key.is_none()
+            && self.rpc_auth_audience.is_none()
+        {
+            report.error(
+                "rpc_auth_audience",
+                "required for token auth on a node without a validator key",
+            );
+        }
+        for (member, role) in &self.rpc_admin_roles {
+            check_member(&mut report, "rpc_admin_roles", member);
+            if let Err(e) = role.parse::<AdminRole>() {
+                report.error("rpc_admin_roles", e);
+            }
+        }
+        if !self.rpc_admin_roles.is_empty() && self.rpc_auth_members.is_empty() {
+            report.warn(
+                "rpc_admin_roles",
+                "ignored while rpc_auth_members is empty (token auth disabled)",
+            );
+        }
+
+        if self.scheduler_min_threads == Some(0) {
+            report.error("scheduler_min_threads", "must be positive");
+        }
+        if self.scheduler_max_threads == Some(0) {
+            report.error("scheduler_max_threads", "must be positive");
+        }
+        if let (Some(min), Some(max)) = (self.scheduler_min_threads, self.scheduler_max_threads) {
+            if min > max {
+                report.error("scheduler_min_threads", "above scheduler_max_threads");
+            }
+        }
+
+        if let Some(export) = &self.export {
+            if export.nats_addr.is_empty() {
+                report.error("export.nats_addr", "required");
+            }
+            if export.subject.is_empty() {
+                report.error("export.subject", "must not be empty");
+            }
+            if export.retry_interval_ms == 0 {
+                report.error("export.retry_interval_ms", "must be positive");
+            }
+        }
+
+        if let Some(key_status) = &self.key_status {
+            if key_status.responder.is_empty() {
+                report.error("key_status.responder", "required");
+            }
+            if Address::from_hex(&key_status.responder_key).is_err() {
+                report.error("key_status.responder_key", "must be a hex address");
+            }
+            if let Err(e) = key_status.policy.parse::<RevocationPolicy>() {
+                report.error("key_status.policy", e);
+            }
+            if key_status.timeout_ms == 0 {
+                report.error("key_status.timeout_ms", "must be positive");
+            }
+        }
+
+        if let Some(persistence) = &self.tx_pool_persistence {
+            if persistence.max_txs == 0 {
+                report.error("tx_pool_persistence.max_txs", "must be positive");
+            }
+            if persistence.max_age_secs == 0 {
+                report.error("tx_pool_persistence.max_age_secs", "must be positive");
+            }
+        }
+        match self.tx_verification_workers {
+            Some(0) => report.error("tx_verification_workers", "must be positive"),
+            Some(_) if !self.parallel_tx_verification => report.warn(
+                "tx_verification_workers",
+                "ignored unless parallel_tx_verification is set",
+            ),
+            _ => {}
+        }
+        if self.contract_log_retention_blocks == Some(0) {
+            report.error("contract_log_retention_blocks", "must be positive");
+        }
+        if self.proposal_backoff_max == Some(0) {
+            report.error("proposal_backoff_max", "must be positive");
+        }
+        if let Err(e) = self.retention.validate() {
+            report.error("retention", e.to_string());
+        }
+        let warmup = self.warmup_blocks.unwrap_or(DEFAULT_WARMUP_BLOCKS);
+        if warmup > DEFAULT_BLOCK_CACHE_SIZE as u64 {
+            report.warn(
+                "warmup_blocks",
+                format!(
+                    "above the block cache size; only the last {} blocks are warmed",
+                    DEFAULT_BLOCK_CACHE_SIZE
+                ),
+            );
+        }
+        if self.gas_settlement && self.validator_key.is_none() {
+            report.error("gas_settlement", "needs a validator key to sign settlements");
+        }
+        report
+    }
+}
+
+/// Reports `member` unless it is a DID or an address.
+fn check_member(report: &mut ConfigReport, field: &str, member: &str) {
+    if !is_did(member) && Address::from_hex(member).is_err() {
+        report.error(field, format!("{} is neither an address nor a DID", member));
+    }
+}
+
+/// Parses a JSON chain config and validates it. Parameters the file
+/// leaves out take their defaults.
+pub fn validate_chain_config(content: &str) -> Result<(ChainConfig, ConfigReport), NodeError> {
+    let file: serde_json::Value = serde_json::from_str(content)
+        .map_err(|e| NodeError::ConfigError(format!("Failed to parse chain config: {}", e)))?;
+    let config: ChainConfig = serde_json::from_value(file.clone())
+        .map_err(|e| NodeError::ConfigError(format!("Failed to parse chain config: {}", e)))?;
+
+    let mut report = ConfigReport::default();
+    report.unknown_keys(&file, &config);
+    // The setters enforce each parameter's range
+    let mut checked = config.clone();
+    for name in CONFIG_PARAMS {
+        let value = config.get(name).expect("listed parameter");
+        if let Err(e) = checked.set(name, &value) {
+            report.error(name, e.to_string());
+        }
+    }
+    if let Err(e) = config.validate() {
+        report.error("config", e.to_string());
+    }
+    for activation in &config.feature_activations {
+        if !PROTOCOL_FEATURES.contains(&activation.feature.as_str()) {
+            report.warn(
+                "feature_activations",
+                format!(
+                    "{} at height {} is not supported by this build",
+                    activation.feature, activation.activation_height
+                ),
+            );
+        }
+    }
+    Ok((config, report))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn fields(report: &ConfigReport, severity: Severity) -> Vec<&str> {
+        report
+            .issues
+            .iter()
+            .filter(|issue| issue.severity == severity)
+            .map(|issue| issue.field.as_str())
+            .collect()
+    }
+
+    #[test]
+    fn test_default_config_is_valid() {
+        let report = NodeConfig::default().validate();
+        assert!(report.issues.is_empty(), "{:?}", report.issues);
+
+        let content = toml::to_string_pretty(&NodeConfig::default()).unwrap();
+        let (_, report) = NodeConfig::parse(&content).unwrap();
+        assert!(report.issues.is_empty(), "{:?}", report.issues);
+    }
+
+    #[test]
+    fn test_node_config_errors_and_warnings() {
+        let mut config = NodeConfig::default();
+        config.chain_id = 0;
+        config.rpc_enabled = true;
+        config.rpc_auth_members = vec!["not-a-member".to_string()];
+        config.scheduler_min_threads = Some(8);
+        config.scheduler_max_threads = Some(2);
+        config.block_time_ms = 1000;
+        config.tx_verification_workers = Some(4);
+        config.gas_settlement = true;
+        let report = config.validate();
+        assert!(!report.is_valid());
+        assert_eq!(
+            fields(&report, Severity::Error),
+            vec![
+                "chain_id",
+                "rpc_addr",
+                "rpc_auth_members",
+                "rpc_auth_audience",
+                "scheduler_min_threads",
+                "gas_settlement"
+            ]
+        );
+        assert_eq!(
+            fields(&report, Severity::Warning),
+            vec!["block_time_ms", "tx_verification_workers"]
+        );
+    }
+
+    #[test]
+    fn test_load_reports_unknown_keys() {
+        let mut content = toml::to_string_pretty(&NodeConfig::default()).unwrap();
+        content.insert_str(0, "max_tx_per_block = 10\n");
+        let (_, report) = NodeConfig::parse(&content).unwrap();
+        assert!(report.is_valid());
+        assert_eq!(fields(&report, Severity::Warning), vec!["max_tx_per_block"]);
+
+        let temp_dir = tempfile::tempdir().unwrap();
+        let path = temp_dir.path().join("node.toml");
+        std::fs::write(&path, content.replace("chain_id = 1", "chain_id = 0")).unwrap();
+        let err = NodeConfig::load(&path).unwrap_err().to_string();
+        assert!(err.contains("chain_id: must be positive"), "{}", err);
+    }
+
+    #[test]
+    fn test_chain_config() {
+        let content = serde_json::to_string(&ChainConfig::default()).unwrap();
+        let (_, report) = validate_chain_config(&content).unwrap();
+        assert!(report.issues.is_empty(), "{:?}", report.issues);
+
+        let content = r#"{
+            "block_gas_limit": 30000000,
+            "max_tx_data_size": 65536,
+            "storage_quota": null,
+            "proposal_interval_ms": 1000,
+            "proposal_min_interval_ms": 5000,
+            "block_gas_limt": 1
+        }"#;
+        let (_, report) = validate_chain_config(content).unwrap();
+        assert_eq!(fields(&report, Severity::Error), vec!["config"]);
+        assert_eq!(fields(&report, Severity::Warning), vec!["block_gas_limt"]);
+
+        assert!(validate_chain_config("{").is_err());
+    }
+}
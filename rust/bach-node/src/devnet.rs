@@ -0,0 +1,1063 @@
+//! Local development network
+//!
+//! `Devnet` runs a single SOLO node in memory for contract development: no
+//! key files, genesis or peers to set up. It generates an ephemeral
+//! validator key and a set of funded accounts, serves JSON-RPC, and seals
+//! the RPC pool into blocks when the chain-configured proposal timer says
+//! so. By default that is every `DEFAULT_DEVNET_INTERVAL` while
+//! transactions are pooled; an `empty_block_interval_ms` heartbeat seals
+//! empty blocks on an idle chain.
+//!
+//! The RPC server executes transactions when they are submitted, so sealing
+//! only orders them into blocks and writes the receipts of that execution.
+//! Transactions submitted signed with `eth_sendRawTransaction` keep their
+//! signature. The accounts are unlocked: unsigned transactions sent from
+//! them are signed with their ephemeral keys when sealed. Unsigned
+//! transactions from any other sender can't be signed and are dropped from
+//! the pool.
+//!
+//! Optionally a directory of compiled contracts (`*.bin` files holding hex
+//! init code, as written by `solc --bin`) is watched, and each contract is
+//! deployed again whenever its file changes.
+
+use crate::{BachNode, BlockCommit, NodeConfig, NodeError};
+use bach_consensus::{ProposalAction, Validator, ValidatorSet};
+use bach_crypto::{keccak256, MemberSignature, PrivateKey};
+use bach_evm::EvmState;
+use bach_msgbus::BlockCommitReport;
+use bach_primitives::{Address, H256, U256};
+use bach_rpc::PendingTransaction;
+use bach_storage::{Log, StateStore, Storage, TransactionReceipt};
+use bach_types::{Block, ReadWriteSet, Transaction, TxDag};
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant, SystemTime};
+
+/// Default number of funded accounts
+pub const DEFAULT_DEVNET_ACCOUNTS: usize = 10;
+
+/// Interval at which a devnet polls its proposal timer and checks the
+/// contract directory, and its default proposal interval.
+pub const DEFAULT_DEVNET_INTERVAL: Duration = Duration::from_millis(200);
+
+/// Gas limit of contract deployments from the watched directory
+const DEPLOY_GAS_LIMIT: u64 = 30_000_000;
+
+/// Local development network configuration.
+#[derive(Debug, Clone)]
+pub struct DevnetConfig {
+    /// Chain ID
+    pub chain_id: u64,
+    /// JSON-RPC listen address
+    pub rpc_addr: SocketAddr,
+    /// Number of funded accounts
+    pub accounts: usize,
+    /// Balance of each account, in wei
+    pub balance: U256,
+    /// Directory of `*.bin` contracts to deploy and redeploy (off if None)
+    pub contracts_dir: Option<PathBuf>,
+    /// Genesis chain config parameters, overriding the devnet's defaults
+    pub chain_config: Vec<(String, String)>,
+    /// Maintain a state commitment over contract storage
+    pub state_commitment: bool,
+}
+
+impl Default for DevnetConfig {
+    fn default() -> Self {
+        Self {
+            chain_id: 31337,
+            rpc_addr: "127.0.0.1:8545".parse().unwrap(),
+            accounts: DEFAULT_DEVNET_ACCOUNTS,
+            balance: U256::from(10_000u128 * 1_000_000_000_000_000_000),
+            contracts_dir: None,
+            chain_config: Vec::new(),
+            state_commitment: false,
+        }
+    }
+}
+
+/// A funded account with an ephemeral key.
+#[derive(Clone)]
+pub struct DevAccount {
+    /// Account address
+    pub address: Address,
+    /// Private key, generated at startup and never written to disk
+    pub key: PrivateKey,
+}
+
+/// A contract deployed from the watched directory.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ContractDeployment {
+    /// Contract file
+    pub path: PathBuf,
+    /// Address of the new instance
+    pub address: Address,
+}
+
+/// A running local development network.
+pub struct Devnet {
+    node: BachNode,
+    accounts: Vec<DevAccount>,
+    contracts_dir: Option<PathBuf>,
+    /// Modification time of each contract file when it was last deployed
+    deployed: HashMap<PathBuf, SystemTime>,
+    /// When the last block was sealed, or the devnet started
+    last_block: Instant,
+}
+
+/// Activation list enabling every EVM protocol feature from genesis, so
+/// contracts can use the host calls without scheduling them first.
+fn all_evm_features() -> String {
+    bach_evm::EVM_FEATURES
+        .iter()
+        .map(|feature| format!("{}@0", feature))
+        .collect::<Vec<_>>()
+        .join(",")
+}
+
+impl Devnet {
+    /// Starts the node on temporary storage and funds the accounts.
+    pub async fn start(config: DevnetConfig) -> Result<Self, NodeError> {
+        let validator = PrivateKey::random();
+        let interval = DEFAULT_DEVNET_INTERVAL.as_millis().to_string();
+        let mut node_config = NodeConfig::default()
+            .with_chain_id(config.chain_id)
+            .with_validator_key(validator.to_bytes())
+            .with_validator_set(ValidatorSet::new(vec![Validator::new(
+                validator.public_key(),
+                1,
+            )]))
+            .with_rpc(config.rpc_addr)
+            .with_gas_settlement(true)
+            .with_state_commitment(config.state_commitment)
+            .with_genesis_chain_config("feature_activations", &all_evm_features())
+            .with_genesis_chain_config("proposal_timer", "suppress-empty")
+            .with_genesis_chain_config("proposal_interval_ms", &interval)
+            .with_genesis_chain_config("proposal_min_interval_ms", &interval);
+        for (name, value) in &config.chain_config {
+            node_config = node_config.with_genesis_chain_config(name, value);
+        }
+        let mut node = BachNode::new(node_config);
+        node.init_with_storage(Storage::temporary()?)?;
+        node.start().await?;
+
+        let accounts: Vec<DevAccount> = (0..config.accounts)
+            .map(|_| {
+                let key = PrivateKey::random();
+                DevAccount {
+                    address: key.public_key().to_address(),
+                    key,
+                }
+            })
+            .collect();
+        for account in &accounts {
+            node.set_balance(&account.address, config.balance)?;
+        }
+
+        tracing::info!(
+            chain_id = config.chain_id,
+            rpc_addr = %config.rpc_addr,
+            accounts = accounts.len(),
+            "Devnet started"
+        );
+        Ok(Self {
+            last_block: node.clock().now(),
+            node,
+            accounts,
+            contracts_dir: config.contracts_dir,
+            deployed: HashMap::new(),
+        })
+    }
+
+    /// Returns the node.
+    pub fn node(&self) -> &BachNode {
+        &self.node
+    }
+
+    /// Returns the funded accounts.
+    pub fn accounts(&self) -> &[DevAccount] {
+        &self.accounts
+    }
+
+    /// Asks the proposal timer whether the next block is due, given the
+    /// pooled transactions and the time since the last block, and if so
+    /// seals it like `seal_block`. The block is empty if the pool is, e.g.
+    /// for the `empty_block_interval_ms` heartbeat. Returns None while the
+    /// timer says to wait.
+    pub fn propose(&mut self) -> Result<Option<BlockCommitReport>, NodeError> {
+        let state = self.node.rpc_state().ok_or(NodeError::NotRunning)?;
+        let pending = state.pending_txs.read().unwrap().len();
+        let idle = self.node.clock().now().saturating_duration_since(self.last_block);
+        match self.node.proposal_timer()?.next(pending, idle) {
+            ProposalAction::Propose => self.seal(true),
+            ProposalAction::Wait(_) => Ok(None),
+        }
+    }
+
+    /// Seals the pooled transactions, oldest first, into the next block.
+    /// Returns None if the pool is empty.
+    ///
+    /// The block takes transactions until their declared gas limits would
+    /// exceed the chain config block gas limit, and at most
+    /// `max_txs_per_sender` from one sender; the rest stay in the pool for
+    /// later blocks. A transaction declaring more gas than a whole block
+    /// allows is dropped.
+    ///
+    /// Receipts carry the status, gas used and logs of executing each
+    /// transaction on submission, and the storage and code of the accounts
+    /// the transactions reached are persisted with the block. A transaction restored from the persisted
+    /// pool wasn't executed by this node and is reported as failed.
+    ///
+    /// A gas settlement system transaction, signed with the devnet's
+    /// validator key, closes the block; pooled transactions calling its
+    /// reserved address are dropped.
+    pub fn seal_block(&mut self) -> Result<Option<BlockCommitReport>, NodeError> {
+        self.seal(false)
+    }
+
+    /// Seals the next block; one without pooled transactions only if
+    /// `empty` is set.
+    fn seal(&mut self, empty: bool) -> Result<Option<BlockCommitReport>, NodeError> {
+        let state = self.node.rpc_state().ok_or(NodeError::NotRunning)?;
+        let mut pending: Vec<PendingTransaction> = state
+            .pending_txs
+            .read()
+            .unwrap()
+            .values()
+            .cloned()
+            .collect();
+        pending.sort_by_key(|tx| (tx.received_at, tx.from, tx.nonce));
+
+        let gas_limit = self.node.block_gas_limit()?;
+        let sender_limit = self.node.max_txs_per_sender()?;
+        let mut per_sender: HashMap<Address, u64> = HashMap::new();
+        let mut gas = 0u64;
+        let mut included = Vec::new();
+        let mut transactions = Vec::new();
+        for tx in pending {
+            if transactions.len() == self.node.config().max_txs_per_block {
+                break;
+            }
+            if tx.gas > gas_limit {
+                tracing::warn!(
+                    hash = %tx.hash,
+                    gas = tx.gas,
+                    gas_limit,
+                    "Dropping transaction declaring more gas than a block allows"
+                );
+                state.pending_txs.write().unwrap().remove(&tx.hash);
+                continue;
+            }
+            if gas + tx.gas > gas_limit {
+                break;
+            }
+            let sent = per_sender.entry(tx.from).or_default();
+            if sender_limit > 0 && *sent >= sender_limit {
+                continue;
+            }
+            let signed = match &tx.signature {
+                Some(signature) => Some(transaction(&tx, signature.clone())),
+                None => self
+                    .accounts
+                    .iter()
+                    .find(|account| account.address == tx.from)
+                    .map(|account| sign(&account.key, &tx)),
+            };
+            match signed {
+                Some(signed) if self.node.system_txs().is_system_tx(&signed) => {
+                    tracing::warn!(
+                        hash = %tx.hash,
+                        "Dropping transaction calling an address reserved for system transactions"
+                    );
+                    state.pending_txs.write().unwrap().remove(&tx.hash);
+                }
+                Some(signed) => {
+                    *sent += 1;
+                    gas += tx.gas;
+                    transactions.push(signed);
+                    included.push(tx);
+                }
+                None => {
+                    tracing::warn!(
+                        hash = %tx.hash,
+                        from = %tx.from,
+                        "Dropping transaction from an account without a devnet key"
+                    );
+                    state.pending_txs.write().unwrap().remove(&tx.hash);
+                }
+            }
+        }
+        if transactions.is_empty() && !empty {
+            return Ok(None);
+        }
+
+        let height = self.node.current_height() + 1;
+        let parent_hash = self.node.current_hash();
+        let system_txs = self
+            .node
+            .append_system_txs(height, &parent_hash, &mut transactions)?;
+        let block = Block::new(
+            height,
+            parent_hash,
+            transactions,
+            self.node.clock().unix_timestamp(),
+        );
+        let block_hash = self.node.block_digests(&block).hash;
+        let mut log_index = 0u32;
+        let receipts: Vec<TransactionReceipt> = included
+            .iter()
+            .enumerate()
+            .map(|(index, tx)| {
+                let execution = tx.execution.clone().unwrap_or_default();
+                let logs = execution
+                    .logs
+                    .iter()
+                    .map(|log| {
+                        log_index += 1;
+                        Log {
+                            address: *log.address.as_bytes(),
+                            topics: log.topics.iter().map(|t| *t.as_bytes()).collect(),
+                            data: log.data.clone(),
+                            block_number: block.height,
+                            transaction_hash: *tx.hash.as_bytes(),
+                            transaction_index: index as u32,
+                            log_index: log_index - 1,
+                        }
+                    })
+                    .collect();
+                TransactionReceipt {
+                    transaction_hash: *tx.hash.as_bytes(),
+                    block_hash: *block_hash.as_bytes(),
+                    block_number: block.height,
+                    transaction_index: index as u32,
+                    gas_used: execution.gas_used,
+                    status: execution.success,
+                    logs,
+                }
+            })
+            .chain(
+                block.transactions[included.len()..]
+                    .iter()
+                    .enumerate()
+                    .map(|(offset, tx)| TransactionReceipt {
+                        transaction_hash: *tx.hash().as_bytes(),
+                        block_hash: *block_hash.as_bytes(),
+                        block_number: block.height,
+                        transaction_index: (included.len() + offset) as u32,
+                        gas_used: 0,
+                        status: true,
+                        logs: Vec::new(),
+                    }),
+            )
+            .collect();
+
+        let access: Vec<ReadWriteSet> = included.iter().map(account_access).collect();
+        let mut dag = TxDag::from_rwsets(&access);
+        for _ in 0..system_txs {
+            dag.append_system_tx();
+        }
+        let accounts = reached_accounts(&included);
+        let (writes, code) = {
+            let evm_state = state.evm_state.read().unwrap();
+            (
+                changed_storage(&evm_state, &state.storage.state, &accounts),
+                changed_code(&evm_state, &state.storage.state, &accounts),
+            )
+        };
+        let report = self.node.commit_block(BlockCommit {
+            block: &block,
+            state_root: H256::zero(),
+            state_commitment: None,
+            writes: &writes,
+            writers: &[],
+            values: &[],
+            code: &code,
+            receipts: &receipts,
+            dag: Some(&dag),
+            conflicts: 0,
+            signatures: 1,
+        })?;
+        self.last_block = self.node.clock().now();
+        // A solo validator's proposals always commit
+        self.node.record_proposal_commit();
+        Ok(Some(report))
+    }
+
+    /// Deploys every contract in the watched directory that is new or
+    /// changed since its last deployment, from the first account.
+    ///
+    /// Files that can't be decoded or deployed are logged and retried once
+    /// they change again.
+    pub fn redeploy_changed(&mut self) -> Result<Vec<ContractDeployment>, NodeError> {
+        let Some(dir) = &self.contracts_dir else {
+            return Ok(Vec::new());
+        };
+        let deployer = self
+            .accounts
+            .first()
+            .ok_or_else(|| NodeError::ConfigError("devnet has no accounts".to_string()))?
+            .address;
+
+        let mut deployments = Vec::new();
+        for (path, modified) in contract_files(dir)? {
+            if self.deployed.get(&path) == Some(&modified) {
+                continue;
+            }
+            self.deployed.insert(path.clone(), modified);
+
+            let deployed = read_init_code(&path).and_then(|code| {
+                self.node
+                    .deploy_contract(deployer, &code, U256::ZERO, DEPLOY_GAS_LIMIT)
+            });
+            match deployed {
+                Ok(address) => {
+                    tracing::info!(path = %path.display(), %address, "Contract deployed");
+                    deployments.push(ContractDeployment { path, address });
+                }
+                Err(e) => {
+                    tracing::warn!(path = %path.display(), "Failed to deploy contract: {}", e)
+                }
+            }
+        }
+        Ok(deployments)
+    }
+
+    /// Stops the node; the chain is discarded.
+    pub async fn stop(mut self) -> Result<(), NodeError> {
+        self.node.stop().await
+    }
+}
+
+/// Signs a pooled transaction with its sender's key.
+fn sign(key: &PrivateKey, tx: &PendingTransaction) -> Transaction {
+    let unsigned = transaction(tx, key.sign(&H256::zero()).into());
+    Transaction {
+        signature: key.sign(&unsigned.signing_hash()).into(),
+        ..unsigned
+    }
+}
+
+/// Records the accounts a pooled transaction touched as written, so the
+/// block's DAG orders transactions that share an account.
+///
+/// Devnet executes on submission without tracking storage keys, so this
+/// is coarser than the scheduler's read-write sets but never misses a
+/// dependency between accounts.
+fn account_access(tx: &PendingTransaction) -> ReadWriteSet {
+    let mut access = ReadWriteSet::new();
+    let nested = tx.execution.iter().flat_map(|execution| &execution.accounts);
+    for account in std::iter::once(&tx.from).chain(&tx.to).chain(nested) {
+        access.record_write(keccak256(account.as_bytes()), Vec::new());
+    }
+    access
+}
+
+/// Returns the recipients of pooled transactions and the accounts their
+/// execution reached.
+fn reached_accounts(included: &[PendingTransaction]) -> BTreeSet<Address> {
+    included
+        .iter()
+        .flat_map(|tx| tx.to.iter().chain(tx.execution.iter().flat_map(|e| &e.accounts)))
+        .copied()
+        .collect()
+}
+
+/// Lists the storage slots of `accounts` whose executed value differs
+/// from the persisted one, as writes; a slot execution cleared is written
+/// as zero.
+fn changed_storage(
+    evm_state: &EvmState,
+    state: &StateStore,
+    accounts: &BTreeSet<Address>,
+) -> Vec<(Address, H256, H256)> {
+    let mut writes = Vec::new();
+    for address in accounts {
+        let executed = evm_state.get_account(address).storage;
+        let stored: BTreeMap<H256, H256> = state.contract_storage(address).into_iter().collect();
+        for (slot, value) in &executed {
+            if stored.get(slot) != Some(value) {
+                writes.push((*address, *slot, *value));
+            }
+        }
+        for slot in stored.keys().filter(|slot| !executed.contains_key(slot)) {
+            writes.push((*address, *slot, H256::zero()));
+        }
+    }
+    writes
+}
+
+/// Lists the accounts pooled transactions reached whose executed code
+/// differs from their persisted code, with the code to persist.
+fn changed_code(
+    evm_state: &EvmState,
+    state: &StateStore,
+    accounts: &BTreeSet<Address>,
+) -> Vec<(Address, Vec<u8>)> {
+    accounts
+        .iter()
+        .copied()
+        .filter_map(|account| {
+            let code = evm_state.get_code(&account);
+            let stored = state
+                .get_account(&account)
+                .map_or_else(|| keccak256(&[]), |stored| stored.code_hash_h256());
+            (keccak256(&code) != stored).then_some((account, code))
+        })
+        .collect()
+}
+
+/// Builds the chain transaction of a pooled transaction with `signature`.
+fn transaction(tx: &PendingTransaction, signature: MemberSignature) -> Transaction {
+    Transaction::new(tx.nonce, tx.to, tx.value, tx.data.clone(), signature).with_gas(tx.gas)
+}
+
+/// Lists the `*.bin` files in `dir` with their modification times, in path
+/// order.
+fn contract_files(dir: &Path) -> Result<Vec<(PathBuf, SystemTime)>, NodeError> {
+    let mut files = Vec::new();
+    for entry in std::fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.extension().map_or(false, |ext| ext == "bin") {
+            let modified = std::fs::metadata(&path)?.modified()?;
+            files.push((path, modified));
+        }
+    }
+    files.sort();
+    Ok(files)
+}
+
+fn read_init_code(path: &Path) -> Result<Vec<u8>, NodeError> {
+    let text = std::fs::read_to_string(path)?;
+    let text = text.trim();
+    hex::decode(text.strip_prefix("0x").unwrap_or(text)).map_err(|e| {
+        NodeError::ConfigError(format!("{} is not hex bytecode: {}", path.display(), e))
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_contracts::{chain_config_address, encode_update};
+    use bach_consensus::GasSettlement;
+    use bach_rpc::{CallRequest, EthApiImpl, EthApiServer};
+    use std::sync::Arc;
+
+    fn config() -> DevnetConfig {
+        DevnetConfig {
+            rpc_addr: "127.0.0.1:0".parse().unwrap(),
+            accounts: 2,
+            ..Default::default()
+        }
+    }
+
+    #[tokio::test]
+    async fn test_accounts_are_funded() {
+        let devnet = Devnet::start(config()).await.unwrap();
+        assert_eq!(devnet.accounts().len(), 2);
+        for account in devnet.accounts() {
+            assert_eq!(
+                devnet.node().get_balance(&account.address).unwrap(),
+                DevnetConfig::default().balance
+            );
+        }
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_seal_pooled_transactions() {
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        assert!(devnet.seal_block().unwrap().is_none());
+
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let request = |from: Address| CallRequest {
+            from: Some(format!("0x{}", hex::encode(from.as_bytes()))),
+            to: Some(format!("0x{}", hex::encode([0x22; 20]))),
+            ..Default::default()
+        };
+        let sender = devnet.accounts()[0].address;
+        for _ in 0..2 {
+            api.send_transaction(request(sender)).await.unwrap();
+        }
+        let foreign = Address::from([0x33; 20]);
+        let key = bach_testutil::test_key(0);
+        for account in [foreign, key.public_key().to_address()] {
+            devnet.node().set_balance(&account, DevnetConfig::default().balance).unwrap();
+        }
+        api.send_transaction(request(foreign))
+            .await
+            .unwrap();
+
+        let report = devnet.seal_block().unwrap().unwrap();
+        assert_eq!(report.height, 1);
+        assert_eq!(report.tx_count, 3);
+        let state = devnet.node().rpc_state().unwrap().clone();
+        let block = state.storage.blocks.get_block_by_height(1).unwrap();
+        assert!(block.transactions[..2]
+            .iter()
+            .all(|tx| tx.sender().unwrap() == sender));
+        // The gas settlement closes the block and runs after the transfers
+        let settlement = &block.transactions[2];
+        let declared = block.transactions[0].gas + block.transactions[1].gas;
+        assert_eq!(GasSettlement::decode(&settlement.data), Some((2, declared)));
+        assert!(state.storage.transactions.get_receipt(&settlement.hash()).unwrap().status);
+        // Both transfers touch the sender's account, so the second waits
+        let dag = state.storage.transactions.get_tx_dag(1).unwrap();
+        assert_eq!(dag.dependencies_of(1), &[0]);
+        assert_eq!(dag.dependencies_of(2), &[0, 1]);
+
+        // The foreign transaction was dropped rather than left in the pool
+        assert!(state.pending_txs.read().unwrap().is_empty());
+        assert!(devnet.seal_block().unwrap().is_none());
+
+        // A foreign sender's signed transaction is sealed as submitted
+        let mut signed = Transaction::new(
+            0,
+            Some(Address::from([0x22; 20])),
+            U256::ZERO,
+            vec![],
+            key.sign(&H256::zero()),
+        );
+        signed.sign(&key, &[]);
+        let raw = format!("0x{}", hex::encode(signed.encode()));
+        api.send_raw_transaction(raw).await.unwrap();
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 2);
+        let block = state.storage.blocks.get_block_by_height(2).unwrap();
+        assert_eq!(block.transactions[..1], [signed.clone()]);
+        assert!(state.storage.transactions.get_receipt(&signed.hash()).unwrap().status);
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_proposal_timer_paces_blocks() {
+        // An idle devnet waits for transactions
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        assert!(devnet.propose().unwrap().is_none());
+        devnet.stop().await.unwrap();
+
+        // The heartbeat seals an empty block once the chain idles for it
+        let mut devnet = Devnet::start(DevnetConfig {
+            chain_config: vec![("empty_block_interval_ms".to_string(), "1".to_string())],
+            ..config()
+        })
+        .await
+        .unwrap();
+        tokio::time::sleep(Duration::from_millis(5)).await;
+        let report = devnet.propose().unwrap().unwrap();
+        assert_eq!(report.height, 1);
+        let state = devnet.node().rpc_state().unwrap().clone();
+        let block = state.storage.blocks.get_block_by_height(1).unwrap();
+        assert!(block
+            .transactions
+            .iter()
+            .all(|tx| devnet.node().system_txs().is_system_tx(tx)));
+        // The timer restarts with the block
+        assert!(devnet.propose().unwrap().is_none());
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_seal_caps_txs_per_sender() {
+        let mut devnet = Devnet::start(DevnetConfig {
+            chain_config: vec![("max_txs_per_sender".to_string(), "2".to_string())],
+            ..config()
+        })
+        .await
+        .unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let request = |from: Address| CallRequest {
+            from: Some(format!("0x{}", hex::encode(from.as_bytes()))),
+            to: Some(format!("0x{}", hex::encode([0x22; 20]))),
+            ..Default::default()
+        };
+        let (first, second) = (devnet.accounts()[0].address, devnet.accounts()[1].address);
+        for from in [first, first, first, second] {
+            api.send_transaction(request(from)).await.unwrap();
+        }
+
+        // The third transaction from the first sender waits for the next
+        // block, plus the gas settlement closing each block
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 4);
+        let state = devnet.node().rpc_state().unwrap().clone();
+        assert_eq!(state.pending_txs.read().unwrap().len(), 1);
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 2);
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_seal_records_account_dag() {
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let accounts: Vec<Address> = devnet.accounts().iter().map(|a| a.address).collect();
+        for (i, from) in accounts[..2].iter().enumerate() {
+            let request = CallRequest {
+                from: Some(format!("0x{}", hex::encode(from.as_bytes()))),
+                to: Some(format!("0x{}", hex::encode([0x40 + i as u8; 20]))),
+                ..Default::default()
+            };
+            api.send_transaction(request).await.unwrap();
+        }
+
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 3);
+        let state = devnet.node().rpc_state().unwrap().clone();
+        let dag = state.storage.transactions.get_tx_dag(1).unwrap();
+        assert!(dag.dependencies_of(1).is_empty());
+        assert_eq!(dag.max_width(), 2);
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_receipts_carry_execution_results() {
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let sender = devnet.accounts()[0].address;
+        let deploy = |code: &str| CallRequest {
+            from: Some(format!("0x{}", hex::encode(sender.as_bytes()))),
+            data: Some(code.to_string()),
+            gas: Some("0x100000".to_string()),
+            ..Default::default()
+        };
+
+        // Init code emitting an empty LOG0, and init code hitting INVALID
+        let logged = api.send_transaction(deploy("0x60006000a000")).await.unwrap();
+        let failed = api.send_transaction(deploy("0xfe")).await.unwrap();
+        let funded = CallRequest {
+            value: Some("0x5".to_string()),
+            ..deploy("0x00")
+        };
+        let funded = api.send_transaction(funded).await.unwrap();
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 4);
+
+        let state = devnet.node().rpc_state().unwrap().clone();
+        let receipt = |hash: &str| {
+            let hash = bach_rpc::parse_h256(hash).unwrap();
+            state.storage.transactions.get_receipt(&hash).unwrap()
+        };
+        let logged = receipt(&logged);
+        assert!(logged.status);
+        assert!(logged.gas_used > 0 && logged.gas_used < 0x100000);
+        assert_eq!(logged.logs.len(), 1);
+        assert_eq!(logged.logs[0].block_number, 1);
+        let failed = receipt(&failed);
+        assert!(!failed.status);
+        assert_eq!(failed.gas_used, 0x100000);
+        assert!(failed.logs.is_empty());
+
+        // Value moved by a transaction is logged as balance changes
+        let funded = receipt(&funded);
+        let topics: Vec<_> = funded.logs.iter().map(|log| log.topics[0]).collect();
+        assert_eq!(topics, vec![*bach_evm::balance_changed_topic().as_bytes(); 2]);
+        assert_eq!(funded.logs[0].address, *bach_evm::account_manager_address().as_bytes());
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_deployed_code_persisted_on_seal() {
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let sender = devnet.accounts()[0].address;
+        let deploy = CallRequest {
+            from: Some(format!("0x{}", hex::encode(sender.as_bytes()))),
+            // Init code returning the one-byte runtime code 0x01
+            data: Some("0x600160005360016000f3".to_string()),
+            gas: Some("0x100000".to_string()),
+            ..Default::default()
+        };
+        api.send_transaction(deploy.clone()).await.unwrap();
+        api.send_transaction(deploy).await.unwrap();
+        devnet.seal_block().unwrap().unwrap();
+
+        let state = &devnet.node().rpc_state().unwrap().storage.state;
+        let code_hash = keccak256(&[0x01]);
+        for nonce in 0..2 {
+            let contract = bach_evm::create_address(&sender, nonce);
+            let account = state.get_account(&contract).unwrap();
+            assert_eq!(account.code_hash_h256(), code_hash);
+        }
+        assert_eq!(state.get_code(&code_hash), Some(vec![0x01]));
+        assert_eq!(state.code_ref_count(&code_hash), 2);
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_storage_committed_on_seal() {
+        let mut devnet = Devnet::start(DevnetConfig {
+            state_commitment: true,
+            ..config()
+        })
+        .await
+        .unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let sender = devnet.accounts()[0].address;
+        let from = Some(format!("0x{}", hex::encode(sender.as_bytes())));
+        let deploy = CallRequest {
+            from: from.clone(),
+            // Init code storing 0x2a at slot 7 and returning runtime code
+            // that clears it
+            data: Some("0x602a600755656000600755006000526006601af3".to_string()),
+            gas: Some("0x100000".to_string()),
+            ..Default::default()
+        };
+        api.send_transaction(deploy).await.unwrap();
+        devnet.seal_block().unwrap().unwrap();
+
+        let contract = bach_evm::create_address(&sender, 0);
+        let word = |n: u8| {
+            let mut bytes = [0u8; 32];
+            bytes[31] = n;
+            H256::from(bytes)
+        };
+        let (slot, value) = (word(7), word(0x2a));
+        let state = devnet.node().rpc_state().unwrap().clone();
+        assert_eq!(state.storage.state.get_storage(&contract, &slot), value);
+        let mut expected = bach_state::SparseMerkleTree::new();
+        expected.apply_storage_writes(&[(contract, slot, value)]);
+        assert_eq!(devnet.node().state_commitment(), Some(expected.root()));
+
+        let clear = CallRequest {
+            from,
+            to: Some(format!("0x{}", hex::encode(contract.as_bytes()))),
+            gas: Some("0x100000".to_string()),
+            ..Default::default()
+        };
+        api.send_transaction(clear).await.unwrap();
+        devnet.seal_block().unwrap().unwrap();
+        assert!(state.storage.state.get_storage(&contract, &slot).is_zero());
+        assert_eq!(devnet.node().state_commitment(), Some(H256::zero()));
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_acl_upgrade_persists_code() {
+        use bach_evm::{contract_acl_address, create_address, ACL_INSTALL, ACL_UPGRADE};
+
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let sender = devnet.accounts()[0].address;
+        let acl = |data: Vec<u8>| CallRequest {
+            from: Some(format!("0x{}", hex::encode(sender.as_bytes()))),
+            to: Some(format!("0x{}", hex::encode(contract_acl_address().as_bytes()))),
+            data: Some(format!("0x{}", hex::encode(data))),
+            gas: Some("0x100000".to_string()),
+            ..Default::default()
+        };
+
+        // Install with an empty manifest and the runtime code 0x01
+        let mut install = vec![ACL_INSTALL, 0, 1, 0];
+        install.extend_from_slice(&hex::decode("600160005360016000f3").unwrap());
+        api.send_transaction(acl(install)).await.unwrap();
+        devnet.seal_block().unwrap().unwrap();
+        let contract = create_address(&sender, 0);
+
+        let mut upgrade = vec![ACL_UPGRADE];
+        upgrade.extend_from_slice(contract.as_bytes());
+        upgrade.extend_from_slice(&1u32.to_be_bytes());
+        upgrade.push(0x02);
+        api.send_transaction(acl(upgrade)).await.unwrap();
+        devnet.seal_block().unwrap().unwrap();
+
+        let state = &devnet.node().rpc_state().unwrap().storage.state;
+        let account = state.get_account(&contract).unwrap();
+        assert_eq!(account.code_hash_h256(), keccak256(&[0x02]));
+        assert_eq!(state.code_ref_count(&keccak256(&[0x01])), 0);
+        assert_eq!(state.get_code(&keccak256(&[0x01])), None);
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_did_registration_is_a_transaction() {
+        use bach_contracts::{did_registry_address, encode_did_register, DidDocument, DidEvent};
+
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let account = &devnet.accounts()[0];
+        let (sender, did) = (account.address, "did:bach:lab");
+        let register = |version: u64| CallRequest {
+            from: Some(format!("0x{}", hex::encode(sender.as_bytes()))),
+            to: Some(format!("0x{}", hex::encode(did_registry_address().as_bytes()))),
+            data: Some(format!(
+                "0x{}",
+                hex::encode(encode_did_register(
+                    &DidDocument::new(did, version, [sender], Vec::new()).sign(&account.key)
+                ))
+            )),
+            ..Default::default()
+        };
+
+        // The pool sees the first registration, so the replay fails
+        let created = api.send_transaction(register(1)).await.unwrap();
+        let replayed = api.send_transaction(register(1)).await.unwrap();
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 3);
+
+        let state = devnet.node().rpc_state().unwrap().clone();
+        let receipt = |hash: &str| {
+            let hash = bach_rpc::parse_h256(hash).unwrap();
+            state.storage.transactions.get_receipt(&hash).unwrap()
+        };
+        let created = receipt(&created);
+        assert!(created.status);
+        assert_eq!(created.logs.len(), 1);
+        assert_eq!(created.logs[0].topics[0], *DidEvent::Created.topic().as_bytes());
+        let replayed = receipt(&replayed);
+        assert!(!replayed.status && replayed.logs.is_empty());
+
+        // Committing the block recorded the document
+        let dids = devnet.node().dids().unwrap();
+        assert_eq!(dids.resolve(did).unwrap().version, 1);
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_seal_within_block_gas_limit() {
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let sender = devnet.accounts()[0].address;
+
+        // The limit is lowered by a chain config transaction, effective
+        // from the next block
+        let changes = [("block_gas_limit".to_string(), "50000".to_string())];
+        let update = CallRequest {
+            from: Some(format!("0x{}", hex::encode(sender.as_bytes()))),
+            to: Some(chain_config_address().to_string()),
+            data: Some(format!("0x{}", hex::encode(encode_update(&changes)))),
+            gas: Some("0x30000".to_string()),
+            ..Default::default()
+        };
+        api.send_transaction(update).await.unwrap();
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 2);
+        assert_eq!(devnet.node().block_gas_limit().unwrap(), 50_000);
+
+        let request = |gas: u64| CallRequest {
+            from: Some(format!("0x{}", hex::encode(sender.as_bytes()))),
+            to: Some(format!("0x{}", hex::encode([0x22; 20]))),
+            gas: Some(format!("0x{:x}", gas)),
+            ..Default::default()
+        };
+        for _ in 0..3 {
+            api.send_transaction(request(21_000)).await.unwrap();
+        }
+        api.send_transaction(request(60_000)).await.unwrap();
+
+        // Two transfers fit under the limit; the third waits for the next
+        // block and the oversized one is dropped. Each block also carries
+        // its gas settlement.
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 3);
+        let state = devnet.node().rpc_state().unwrap().clone();
+        assert_eq!(state.pending_txs.read().unwrap().len(), 2);
+        assert_eq!(devnet.seal_block().unwrap().unwrap().tx_count, 2);
+        assert!(state.pending_txs.read().unwrap().is_empty());
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_rejected_config_update_fails_receipt() {
+        let mut devnet = Devnet::start(config()).await.unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let sender = devnet.accounts()[0].address;
+        let update = |name: &str, value: &str| CallRequest {
+            from: Some(format!("0x{}", hex::encode(sender.as_bytes()))),
+            to: Some(chain_config_address().to_string()),
+            data: Some(format!(
+                "0x{}",
+                hex::encode(encode_update(&[(name.to_string(), value.to_string())]))
+            )),
+            gas: Some("0x30000".to_string()),
+            ..Default::default()
+        };
+
+        // The contract refuses unknown parameters at submission
+        let accepted = api.send_transaction(update("storage_quota", "4096")).await.unwrap();
+        let refused = api.send_transaction(update("gas_price", "1")).await.unwrap();
+        devnet.seal_block().unwrap().unwrap();
+
+        let state = devnet.node().rpc_state().unwrap().clone();
+        let status = |hash: &str| {
+            let hash = bach_rpc::parse_h256(hash).unwrap();
+            state.storage.transactions.get_receipt(&hash).unwrap().status
+        };
+        assert!(status(&accepted));
+        assert!(!status(&refused));
+        assert_eq!(devnet.node().chain_config().unwrap().current().version, 1);
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_refused_multi_sign_vote_fails_receipt() {
+        use bach_contracts::{
+            encode_multi_sign_approve, encode_multi_sign_propose, multi_sign_address,
+        };
+
+        let config = DevnetConfig {
+            accounts: 3,
+            ..config()
+        };
+        let mut devnet = Devnet::start(config).await.unwrap();
+        let api = EthApiImpl::new(Arc::clone(devnet.node().rpc_state().unwrap()));
+        let accounts: Vec<Address> = devnet.accounts().iter().map(|a| a.address).collect();
+        let call = |from: &Address, to: Address, data: Vec<u8>| CallRequest {
+            from: Some(format!("0x{}", hex::encode(from.as_bytes()))),
+            to: Some(to.to_string()),
+            data: Some(format!("0x{}", hex::encode(data))),
+            gas: Some("0x30000".to_string()),
+            ..Default::default()
+        };
+        let signers = format!("{},{}", accounts[0], accounts[1]);
+        let changes = [("multi_sign_signers".to_string(), signers)];
+        api.send_transaction(call(&accounts[0], chain_config_address(), encode_update(&changes)))
+            .await
+            .unwrap();
+        devnet.seal_block().unwrap().unwrap();
+
+        let address = multi_sign_address();
+        api.send_transaction(call(&accounts[0], address, encode_multi_sign_propose(100, b"a")))
+            .await
+            .unwrap();
+        let outsider = api
+            .send_transaction(call(&accounts[2], address, encode_multi_sign_approve(0)))
+            .await
+            .unwrap();
+        let signer = api
+            .send_transaction(call(&accounts[1], address, encode_multi_sign_approve(0)))
+            .await
+            .unwrap();
+        devnet.seal_block().unwrap().unwrap();
+
+        let state = devnet.node().rpc_state().unwrap().clone();
+        let status = |hash: &str| {
+            let hash = bach_rpc::parse_h256(hash).unwrap();
+            state.storage.transactions.get_receipt(&hash).unwrap().status
+        };
+        assert!(!status(&outsider));
+        assert!(status(&signer));
+        devnet.stop().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_redeploy_changed_contracts() {
+        let dir = tempfile::tempdir().unwrap();
+        let mut devnet = Devnet::start(DevnetConfig {
+            contracts_dir: Some(dir.path().to_path_buf()),
+            ..config()
+        })
+        .await
+        .unwrap();
+        assert!(devnet.redeploy_changed().unwrap().is_empty());
+
+        // Init code returning a one-byte runtime (STOP)
+        let path = dir.path().join("Counter.bin");
+        std::fs::write(&path, "0x600060005360016000f3\n").unwrap();
+        std::fs::write(dir.path().join("README.md"), "not a contract").unwrap();
+        let first = devnet.redeploy_changed().unwrap();
+        assert_eq!(first.len(), 1);
+        assert_eq!(first[0].path, path);
+        assert!(devnet.redeploy_changed().unwrap().is_empty());
+
+        let file = std::fs::File::options().write(true).open(&path).unwrap();
+        file.set_modified(SystemTime::now() + Duration::from_secs(10))
+            .unwrap();
+        let second = devnet.redeploy_changed().unwrap();
+        assert_eq!(second.len(), 1);
+        assert_ne!(second[0].address, first[0].address);
+        devnet.stop().await.unwrap();
+    }
+}
@@ -0,0 +1,549 @@
+//! Block export to an external message bus (NATS)
+//!
+//! The exporter publishes every committed block, with its transactions and
+//! events, as one JSON message. Delivery is at-least-once: the height of the
+//! last block the sink confirmed is checkpointed in the local block store,
+//! and after a restart, a lost connection or a lagging subscription the
+//! exporter resumes from the block after the checkpoint.
+
+use bach_msgbus::{BlockInfo, Message, RecvError, Subscriber};
+use bach_primitives::{timeout, Clock, SystemClock};
+use bach_storage::{Storage, TransactionReceipt};
+use bach_types::Block;
+use serde::{Deserialize, Serialize};
+use std::future::Future;
+use std::sync::Arc;
+use std::time::Duration;
+use thiserror::Error;
+use tokio::io::{AsyncBufReadExt, AsyncWriteExt, BufReader};
+use tokio::net::TcpStream;
+
+/// Export errors
+#[derive(Debug, Error)]
+pub enum ExportError {
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Sink error: {0}")]
+    Sink(String),
+
+    #[error("Encoding error: {0}")]
+    Encoding(#[from] serde_json::Error),
+
+    #[error("Storage error: {0}")]
+    Storage(#[from] bach_storage::StorageError),
+}
+
+/// Exporter configuration
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ExportConfig {
+    /// NATS server address (`host:port`, optionally prefixed with `nats://`)
+    pub nats_addr: String,
+
+    /// Subject blocks are published on
+    #[serde(default = "default_export_subject")]
+    pub subject: String,
+
+    /// Name of the checkpoint in the local block store
+    #[serde(default = "default_export_name")]
+    pub name: String,
+
+    /// Delay before retrying after the sink fails, in milliseconds
+    #[serde(default = "default_retry_interval_ms")]
+    pub retry_interval_ms: u64,
+}
+
+fn default_export_subject() -> String {
+    "bach.blocks".to_string()
+}
+
+fn default_export_name() -> String {
+    "nats-export".to_string()
+}
+
+fn default_retry_interval_ms() -> u64 {
+    1000
+}
+
+impl ExportConfig {
+    /// Creates a config exporting to the given NATS server.
+    pub fn new(nats_addr: impl Into<String>) -> Self {
+        Self {
+            nats_addr: nats_addr.into(),
+            subject: default_export_subject(),
+            name: default_export_name(),
+            retry_interval_ms: default_retry_interval_ms(),
+        }
+    }
+}
+
+/// Exported event log
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ExportedLog {
+    pub address: String,
+    pub topics: Vec<String>,
+    pub data: String,
+}
+
+/// Exported transaction with its execution outcome
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ExportedTransaction {
+    pub hash: String,
+    pub index: u32,
+    /// Sender (None if the signature does not recover)
+    pub from: Option<String>,
+    pub to: Option<String>,
+    pub value: String,
+    pub nonce: u64,
+    /// Execution status (None if no receipt was stored)
+    pub status: Option<bool>,
+    pub gas_used: Option<u64>,
+    pub logs: Vec<ExportedLog>,
+}
+
+/// One exported block message
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ExportedBlock {
+    pub height: u64,
+    pub hash: String,
+    pub parent_hash: String,
+    pub timestamp: u64,
+    pub transactions: Vec<ExportedTransaction>,
+}
+
+fn hex0x(bytes: &[u8]) -> String {
+    format!("0x{}", hex::encode(bytes))
+}
+
+impl ExportedBlock {
+    /// Builds the export message for a block and its receipts.
+    pub fn new(block: &Block, receipts: &[TransactionReceipt]) -> Self {
+        let transactions = block
+            .transactions
+            .iter()
+            .enumerate()
+            .map(|(index, tx)| {
+                let hash = tx.hash();
+                let receipt = receipts
+                    .iter()
+                    .find(|r| r.transaction_hash == *hash.as_bytes());
+                ExportedTransaction {
+                    hash: hex0x(hash.as_bytes()),
+                    index: index as u32,
+                    from: tx.sender().ok().map(|from| hex0x(from.as_bytes())),
+                    to: tx.to.map(|to| hex0x(to.as_bytes())),
+                    value: hex0x(&tx.value.to_be_bytes()),
+                    nonce: tx.nonce,
+                    status: receipt.map(|r| r.status),
+                    gas_used: receipt.map(|r| r.gas_used),
+                    logs: receipt
+                        .map(|r| {
+                            r.logs
+                                .iter()
+                                .map(|log| ExportedLog {
+                                    address: hex0x(&log.address),
+                                    topics: log.topics.iter().map(|t| hex0x(t)).collect(),
+                                    data: hex0x(&log.data),
+                                })
+                                .collect()
+                        })
+                        .unwrap_or_default(),
+                }
+            })
+            .collect();
+
+        Self {
+            height: block.height,
+            hash: hex0x(block.hash().as_bytes()),
+            parent_hash: hex0x(block.parent_hash.as_bytes()),
+            timestamp: block.timestamp,
+            transactions,
+        }
+    }
+}
+
+/// Destination of exported blocks.
+pub trait ExportSink: Send {
+    /// Publishes a message and returns once the destination has accepted it.
+    fn publish(
+        &mut self,
+        subject: &str,
+        payload: &[u8],
+    ) -> impl Future<Output = Result<(), ExportError>> + Send;
+}
+
+/// Time allowed for a NATS round trip before the connection is dropped
+const NATS_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Publishes to a NATS server over its text protocol.
+///
+/// Each publish is followed by a PING and only succeeds once the matching
+/// PONG arrives, which confirms the server processed the PUB. Any failure
+/// drops the connection; the next publish reconnects.
+#[derive(Debug)]
+pub struct NatsSink {
+    addr: String,
+    conn: Option<BufReader<TcpStream>>,
+    clock: Arc<dyn Clock>,
+}
+
+impl NatsSink {
+    /// Creates a sink for the given server. Connects lazily.
+    pub fn new(addr: &str) -> Self {
+        Self {
+            addr: addr.strip_prefix("nats://").unwrap_or(addr).to_string(),
+            conn: None,
+            clock: Arc::new(SystemClock),
+        }
+    }
+
+    /// Times round trips out on the given clock.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Returns true if a connection is open.
+    pub fn is_connected(&self) -> bool {
+        self.conn.is_some()
+    }
+
+    async fn connect(&self) -> Result<BufReader<TcpStream>, ExportError> {
+        let stream = TcpStream::connect(&self.addr).await?;
+        let mut conn = BufReader::new(stream);
+
+        let mut info = String::new();
+        conn.read_line(&mut info).await?;
+        if !info.starts_with("INFO") {
+            return Err(ExportError::Sink(format!(
+                "unexpected greeting: {}",
+                info.trim()
+            )));
+        }
+        conn.get_mut()
+            .write_all(
+                b"CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"bach-exporter\"}\r\n",
+            )
+            .await?;
+        Ok(conn)
+    }
+
+    async fn publish_confirmed(
+        conn: &mut BufReader<TcpStream>,
+        subject: &str,
+        payload: &[u8],
+    ) -> Result<(), ExportError> {
+        let mut frame = format!("PUB {} {}\r\n", subject, payload.len()).into_bytes();
+        frame.extend_from_slice(payload);
+        frame.extend_from_slice(b"\r\nPING\r\n");
+        conn.get_mut().write_all(&frame).await?;
+
+        loop {
+            let mut line = String::new();
+            if conn.read_line(&mut line).await? == 0 {
+                return Err(ExportError::Sink("connection closed".to_string()));
+            }
+            match line.trim_end() {
+                "PONG" => return Ok(()),
+                "PING" => conn.get_mut().write_all(b"PONG\r\n").await?,
+                err if err.starts_with("-ERR") => return Err(ExportError::Sink(err.to_string())),
+                _ => {} // +OK and INFO updates
+            }
+        }
+    }
+}
+
+impl ExportSink for NatsSink {
+    async fn publish(&mut self, subject: &str, payload: &[u8]) -> Result<(), ExportError> {
+        let mut conn = match self.conn.take() {
+            Some(conn) => conn,
+            None => timeout(self.clock.as_ref(), NATS_TIMEOUT, self.connect())
+                .await
+                .ok_or_else(|| ExportError::Sink("connect timed out".to_string()))??,
+        };
+
+        let result = timeout(
+            self.clock.as_ref(),
+            NATS_TIMEOUT,
+            Self::publish_confirmed(&mut conn, subject, payload),
+        )
+        .await
+        .ok_or_else(|| ExportError::Sink("publish timed out".to_string()))?;
+
+        if result.is_ok() {
+            self.conn = Some(conn);
+        }
+        result
+    }
+}
+
+/// Streams committed blocks to an `ExportSink`.
+pub struct BlockExporter<S> {
+    storage: Storage,
+    sink: S,
+    config: ExportConfig,
+    clock: Arc<dyn Clock>,
+}
+
+impl<S: ExportSink> BlockExporter<S> {
+    /// Creates an exporter reading from `storage`.
+    pub fn new(storage: Storage, sink: S, config: ExportConfig) -> Self {
+        Self {
+            storage,
+            sink,
+            config,
+            clock: Arc::new(SystemClock),
+        }
+    }
+
+    /// Waits between retries on the given clock.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Returns the height of the last exported block.
+    pub fn checkpoint(&self) -> Option<u64> {
+        self.storage.blocks.get_checkpoint(&self.config.name)
+    }
+
+    /// Returns the height of the next block to export.
+    fn next_height(&self) -> u64 {
+        self.checkpoint().map_or(0, |height| height + 1)
+    }
+
+    /// Exports one block and advances the checkpoint.
+    async fn export(
+        &mut self,
+        block: &Block,
+        receipts: &[TransactionReceipt],
+    ) -> Result<(), ExportError> {
+        let payload = serde_json::to_vec(&ExportedBlock::new(block, receipts))?;
+        self.sink.publish(&self.config.subject, &payload).await?;
+        self.storage
+            .blocks
+            .put_checkpoint(&self.config.name, block.height)?;
+        Ok(())
+    }
+
+    /// Exports stored blocks after the checkpoint and returns how many were sent.
+    pub async fn catch_up(&mut self) -> Result<usize, ExportError> {
+        let mut exported = 0;
+        loop {
+            let height = self.next_height();
+            let Some(block) = self.storage.blocks.get_block_by_height(height) else {
+                return Ok(exported);
+            };
+            let receipts: Vec<TransactionReceipt> = block
+                .transactions
+                .iter()
+                .filter_map(|tx| self.storage.transactions.get_receipt(&tx.hash()))
+                .collect();
+            self.export(&block, &receipts).await?;
+            exported += 1;
+        }
+    }
+
+    /// Exports a block delivered on the bus, catching up first if blocks
+    /// were missed. Blocks at or below the checkpoint are skipped.
+    pub async fn handle(&mut self, info: &BlockInfo) -> Result<(), ExportError> {
+        let next = self.next_height();
+        if info.block.height < next {
+            return Ok(());
+        }
+        if info.block.height > next {
+            self.catch_up().await?;
+            return Ok(());
+        }
+        self.export(&info.block, &info.receipts).await
+    }
+
+    /// Runs until the bus closes, retrying failed exports.
+    ///
+    /// `blocks` must be subscribed to `Topic::BlockCommitted` before the
+    /// first catch-up so no commit falls between the two.
+    pub async fn run(mut self, mut blocks: Subscriber) {
+        let retry = Duration::from_millis(self.config.retry_interval_ms);
+        let mut pending: Option<Arc<BlockInfo>> = None;
+        let mut caught_up = false;
+
+        loop {
+            let result = match (&pending, caught_up) {
+                (_, false) => self.catch_up().await.map(|_| ()),
+                (Some(info), true) => self.handle(info).await,
+                (None, true) => Ok(()),
+            };
+            match result {
+                Ok(()) => {
+                    caught_up = true;
+                    pending = None;
+                }
+                Err(e) => {
+                    tracing::warn!(error = %e, "Block export failed, retrying");
+                    self.clock.sleep(retry).await;
+                    continue;
+                }
+            }
+
+            match blocks.recv().await {
+                Ok(Message::BlockCommitted(info)) => pending = Some(info),
+                Ok(_) => {}
+                Err(RecvError::Lagged(skipped)) => {
+                    tracing::warn!(skipped, "Block exporter lagged, catching up from storage");
+                    caught_up = false;
+                }
+                Err(RecvError::Closed) => return,
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+    use tokio::net::TcpListener;
+
+    /// Records payloads and fails the first `failures` publishes
+    #[derive(Default)]
+    struct MemorySink {
+        published: Vec<ExportedBlock>,
+        failures: usize,
+    }
+
+    impl ExportSink for MemorySink {
+        async fn publish(&mut self, _subject: &str, payload: &[u8]) -> Result<(), ExportError> {
+            if self.failures > 0 {
+                self.failures -= 1;
+                return Err(ExportError::Sink("unavailable".to_string()));
+            }
+            self.published.push(serde_json::from_slice(payload)?);
+            Ok(())
+        }
+    }
+
+    fn store_chain(storage: &Storage, count: usize) -> Vec<Block> {
+        bach_testutil::test_chain(count, 2)
+            .into_iter()
+            .map(|fixture| {
+                storage.blocks.put_block(&fixture.block).unwrap();
+                fixture.block
+            })
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn test_catch_up_is_at_least_once() {
+        let temp_dir = TempDir::new().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let blocks = store_chain(&storage, 3);
+
+        let sink = MemorySink {
+            failures: 1,
+            ..Default::default()
+        };
+        let mut exporter = BlockExporter::new(storage.clone(), sink, ExportConfig::new("unused"));
+
+        // A failed publish leaves the checkpoint untouched
+        assert!(exporter.catch_up().await.is_err());
+        assert_eq!(exporter.checkpoint(), None);
+
+        assert_eq!(exporter.catch_up().await.unwrap(), 3);
+        assert_eq!(exporter.checkpoint(), Some(2));
+        let heights: Vec<u64> = exporter.sink.published.iter().map(|b| b.height).collect();
+        assert_eq!(heights, vec![0, 1, 2]);
+
+        // Old and duplicate deliveries are skipped, gaps are filled from storage
+        let next = Block::new(3, blocks[2].hash(), Vec::new(), 1003);
+        storage.blocks.put_block(&next).unwrap();
+        let later = Block::new(4, next.hash(), Vec::new(), 1004);
+        storage.blocks.put_block(&later).unwrap();
+
+        let old = BlockInfo {
+            block: blocks[1].clone(),
+            receipts: Vec::new(),
+            changes: Vec::new(),
+        };
+        exporter.handle(&old).await.unwrap();
+        let info = BlockInfo {
+            block: later,
+            receipts: Vec::new(),
+            changes: Vec::new(),
+        };
+        exporter.handle(&info).await.unwrap();
+        let heights: Vec<u64> = exporter.sink.published.iter().map(|b| b.height).collect();
+        assert_eq!(heights, vec![0, 1, 2, 3, 4]);
+        assert_eq!(exporter.checkpoint(), Some(4));
+    }
+
+    #[tokio::test]
+    async fn test_nats_sink_waits_for_pong() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+
+        let server = tokio::spawn(async move {
+            let (stream, _) = listener.accept().await.unwrap();
+            let mut conn = BufReader::new(stream);
+            conn.get_mut().write_all(b"INFO {}\r\n").await.unwrap();
+
+            let mut lines = Vec::new();
+            loop {
+                let mut line = String::new();
+                conn.read_line(&mut line).await.unwrap();
+                let line = line.trim_end().to_string();
+                if line == "PING" {
+                    conn.get_mut().write_all(b"PONG\r\n").await.unwrap();
+                    return lines;
+                }
+                lines.push(line);
+            }
+        });
+
+        let mut sink = NatsSink::new(&format!("nats://{}", addr));
+        sink.publish("bach.blocks", b"{}").await.unwrap();
+        assert!(sink.is_connected());
+
+        let lines = server.await.unwrap();
+        assert!(lines[0].starts_with("CONNECT"));
+        assert_eq!(lines[1], "PUB bach.blocks 2");
+        assert_eq!(lines[2], "{}");
+
+        // The server is gone; the failure drops the connection for a retry
+        assert!(sink.publish("bach.blocks", b"{}").await.is_err());
+        assert!(!sink.is_connected());
+    }
+    #[tokio::test]
+    async fn test_nats_sink_times_out_on_clock() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+
+        // Accepts and greets but never answers the PING
+        let server = tokio::spawn(async move {
+            let (stream, _) = listener.accept().await.unwrap();
+            let mut conn = BufReader::new(stream);
+            conn.get_mut().write_all(b"INFO {}\r\n").await.unwrap();
+            let mut line = String::new();
+            while conn.read_line(&mut line).await.unwrap() > 0 {}
+        });
+
+        let clock = bach_primitives::FakeClock::new();
+        let mut sink =
+            NatsSink::new(&format!("nats://{}", addr)).with_clock(Arc::new(clock.clone()));
+        let publish = tokio::spawn(async move {
+            let result = sink.publish("bach.blocks", b"{}").await;
+            (result, sink.is_connected())
+        });
+
+        while !publish.is_finished() {
+            clock.advance(NATS_TIMEOUT);
+            tokio::time::sleep(Duration::from_millis(10)).await;
+        }
+        let (result, connected) = publish.await.unwrap();
+        assert!(result.is_err());
+        assert!(!connected);
+        server.abort();
+    }
+}
@@ -0,0 +1,116 @@
+//! Test network faucet client
+//!
+//! Asks a node's JSON-RPC server (`bach_requestFaucet`) to grant gas to an
+//! address. The grant and its rate limit are enforced on-chain by the
+//! faucet system contract; chains whose config leaves the faucet disabled
+//! reject every request. Requests go through the bounded HTTP client.
+
+use crate::http::HttpClient;
+use crate::NodeError;
+use bach_primitives::Address;
+use bach_rpc::FaucetGrantResponse;
+
+/// Requests faucet grants from a remote node.
+#[derive(Debug, Clone)]
+pub struct FaucetClient {
+    http: HttpClient,
+}
+
+impl FaucetClient {
+    /// Creates a client for the given JSON-RPC address.
+    pub fn new(addr: &str) -> Self {
+        Self {
+            http: HttpClient::new(addr),
+        }
+    }
+
+    /// Requests a gas grant for `address`.
+    pub async fn request(&self, address: Address) -> Result<FaucetGrantResponse, NodeError> {
+        let body = serde_json::json!({
+            "jsonrpc": "2.0",
+            "id": 1,
+            "method": "bach_requestFaucet",
+            "params": [address.to_string()],
+        })
+        .to_string();
+        let response = self.http.post_json(&body, None).await?;
+        parse_response(&response)
+    }
+}
+
+/// Extracts the grant from a `bach_requestFaucet` HTTP response.
+fn parse_response(response: &[u8]) -> Result<FaucetGrantResponse, NodeError> {
+    let response = String::from_utf8_lossy(response);
+    let (head, body) = response
+        .split_once("\r\n\r\n")
+        .ok_or_else(|| NodeError::ConfigError("truncated faucet response".to_string()))?;
+    let status_line = head.lines().next().unwrap_or_default();
+    if status_line.split_whitespace().nth(1) != Some("200") {
+        return Err(NodeError::ConfigError(format!(
+            "faucet request returned {}",
+            status_line
+        )));
+    }
+
+    let reply: serde_json::Value = serde_json::from_str(body.trim())
+        .map_err(|e| NodeError::ConfigError(format!("invalid faucet response: {}", e)))?;
+    if let Some(error) = reply.get("error") {
+        let message = error.get("message").and_then(|m| m.as_str());
+        return Err(NodeError::Rejected(
+            message.map_or_else(|| error.to_string(), str::to_string),
+        ));
+    }
+    let result = reply.get("result").cloned().unwrap_or_default();
+    serde_json::from_value(result)
+        .map_err(|e| NodeError::ConfigError(format!("invalid faucet response: {}", e)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::TcpListener;
+
+    /// Serves one HTTP request with a fixed JSON-RPC reply.
+    async fn serve_once(reply: &'static str) -> String {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        tokio::spawn(async move {
+            let (mut stream, _) = listener.accept().await.unwrap();
+            let mut buf = [0u8; 1024];
+            let _ = stream.read(&mut buf).await.unwrap();
+            let response = format!(
+                "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\
+                 Content-Length: {}\r\n\r\n{}",
+                reply.len(),
+                reply
+            );
+            stream.write_all(response.as_bytes()).await.unwrap();
+        });
+        addr
+    }
+
+    #[tokio::test]
+    async fn test_request_grant() {
+        let addr = serve_once(
+            r#"{"jsonrpc":"2.0","id":1,"result":{"transactionHash":"0x01",
+            "recipient":"0x03","amount":"0x3e8","nextGrantAt":"0x3c"}}"#,
+        )
+        .await;
+        let client = FaucetClient::new(&format!("http://{}", addr));
+        let grant = client.request(Address::from([3u8; 20])).await.unwrap();
+        assert_eq!(grant.amount, "0x3e8");
+        assert_eq!(grant.next_grant_at, "0x3c");
+    }
+
+    #[test]
+    fn test_parse_response_errors() {
+        assert!(parse_response(b"HTTP/1.1 401 Unauthorized\r\n\r\n").is_err());
+        let limited = b"HTTP/1.1 200 OK\r\n\r\n\
+            {\"error\":{\"code\":-32003,\"message\":\"granted recently\"}}";
+        assert!(matches!(
+            parse_response(limited),
+            Err(NodeError::Rejected(msg)) if msg == "granted recently"
+        ));
+    }
+}
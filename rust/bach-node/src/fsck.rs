@@ -0,0 +1,449 @@
+//! Chain data consistency checks
+//!
+//! `ChainChecker` walks the blocks in the local store and re-derives what
+//! each one commits to, so data damaged by a disk incident is found before
+//! the node serves or builds on it. For every height it checks:
+//!
+//! - hash linkage: the height index points at the block's own hash, and the
+//!   block's parent hash is the hash of the block below it;
+//! - the header: it matches the block, and its transactions hash is
+//!   recomputed from the block's transactions;
+//! - the write set: every recorded slot change hashes to its value and
+//!   agrees with the slot's key history;
+//! - results: every stored receipt points at the block, and the stored
+//!   dependency DAG covers its transactions;
+//! - the finality checkpoint signed at the height, if any: it commits to
+//!   the block and its state root, and its signatures are valid and, given
+//!   the validator set, form a quorum.
+//!
+//! Blocks are hashed with the chain config's hash schedule. Data a
+//! retention policy pruned is not checked.
+//!
+//! Heights found corrupt can be quarantined: storage records them and they
+//! are no longer served to syncing peers until restored.
+
+use crate::NodeError;
+use bach_consensus::{verify_checkpoint, ValidatorSet};
+use bach_contracts::ChainConfigContract;
+use bach_crypto::{keccak256, HashSchedule};
+use bach_primitives::{Address, H256};
+use bach_storage::{BlockHeader, DataClass, Storage};
+use bach_types::{Block, BlockDigests, Checkpoint};
+use std::fmt;
+
+/// What a consistency check covers
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum FsckCheck {
+    /// The block is missing or can't be decoded
+    Block,
+    /// Block hash and parent links
+    HashLinkage,
+    /// Header record and its transactions hash
+    Header,
+    /// Recorded slot changes and key history
+    RwSet,
+    /// Receipts and the transaction DAG
+    Results,
+    /// Finality checkpoint signatures and quorum
+    Checkpoint,
+}
+
+impl FsckCheck {
+    /// Returns the check name.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            FsckCheck::Block => "block",
+            FsckCheck::HashLinkage => "hash linkage",
+            FsckCheck::Header => "header",
+            FsckCheck::RwSet => "rw set",
+            FsckCheck::Results => "results",
+            FsckCheck::Checkpoint => "checkpoint",
+        }
+    }
+}
+
+/// Corrupt data found at a height
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FsckIssue {
+    pub height: u64,
+    pub check: FsckCheck,
+    pub detail: String,
+}
+
+impl fmt::Display for FsckIssue {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.check.as_str(), self.detail)
+    }
+}
+
+/// Outcome of a consistency check over `from..=to`
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct FsckReport {
+    pub from: u64,
+    pub to: u64,
+    /// Blocks checked
+    pub blocks: u64,
+    /// Finality checkpoints checked
+    pub checkpoints: u64,
+    /// Issues found, in height order
+    pub issues: Vec<FsckIssue>,
+}
+
+impl FsckReport {
+    /// Returns true if no issue was found.
+    pub fn is_clean(&self) -> bool {
+        self.issues.is_empty()
+    }
+
+    /// Returns the heights with at least one issue, lowest first.
+    pub fn corrupt_heights(&self) -> Vec<u64> {
+        let mut heights: Vec<u64> = self.issues.iter().map(|issue| issue.height).collect();
+        heights.dedup();
+        heights
+    }
+
+    /// Quarantines every corrupt height, recording its first issue as the
+    /// reason. Returns the number of heights quarantined.
+    pub fn quarantine(&self, storage: &Storage) -> Result<usize, NodeError> {
+        let heights = self.corrupt_heights();
+        for height in &heights {
+            let issue = self.issues.iter().find(|issue| issue.height == *height);
+            let reason = issue.map(ToString::to_string).unwrap_or_default();
+            storage.blocks.quarantine(*height, &reason)?;
+        }
+        storage.flush()?;
+        Ok(heights.len())
+    }
+
+    fn add(&mut self, height: u64, check: FsckCheck, detail: impl Into<String>) {
+        self.issues.push(FsckIssue {
+            height,
+            check,
+            detail: detail.into(),
+        });
+    }
+}
+
+/// Checks the consistency of the chain data in a store.
+pub struct ChainChecker<'a> {
+    storage: &'a Storage,
+    chain_config: Option<&'a ChainConfigContract>,
+    validators: Option<&'a ValidatorSet>,
+}
+
+impl<'a> ChainChecker<'a> {
+    /// Creates a checker hashing blocks with the default schedule and
+    /// checking only checkpoint signatures, not their quorum.
+    pub fn new(storage: &'a Storage) -> Self {
+        Self {
+            storage,
+            chain_config: None,
+            validators: None,
+        }
+    }
+
+    /// Hashes blocks with the schedule `chain_config` has in force at
+    /// their height.
+    pub fn with_chain_config(mut self, chain_config: &'a ChainConfigContract) -> Self {
+        self.chain_config = Some(chain_config);
+        self
+    }
+
+    /// Checks that finality checkpoints carry a quorum of `validators`.
+    pub fn with_validators(mut self, validators: &'a ValidatorSet) -> Self {
+        self.validators = Some(validators);
+        self
+    }
+
+    /// Checks the blocks `from..=to`, stopping at the head.
+    pub fn check(&self, from: u64, to: u64) -> FsckReport {
+        let to = to.min(self.storage.blocks.get_block_height());
+        let mut report = FsckReport {
+            from,
+            to,
+            ..Default::default()
+        };
+        let mut parent = from
+            .checked_sub(1)
+            .and_then(|height| self.storage.blocks.get_block_by_height(height))
+            .map(|block| block.digests(&self.schedule_at(block.height)));
+        for height in from..=to {
+            parent = self.check_block(height, parent.as_ref(), &mut report);
+        }
+        report
+    }
+
+    fn schedule_at(&self, height: u64) -> HashSchedule {
+        self.chain_config
+            .map(|chain_config| chain_config.config_at(height).config.hash_schedule())
+            .unwrap_or_default()
+    }
+
+    /// Checks one block and returns its digests for the next height to
+    /// link to.
+    fn check_block(
+        &self,
+        height: u64,
+        parent: Option<&BlockDigests>,
+        report: &mut FsckReport,
+    ) -> Option<BlockDigests> {
+        report.blocks += 1;
+        let Some(block) = self.storage.blocks.get_block_by_height(height) else {
+            report.add(height, FsckCheck::Block, "missing or can't be decoded");
+            return None;
+        };
+        if block.height != height {
+            let detail = format!("indexed at {} but records height {}", height, block.height);
+            report.add(height, FsckCheck::Block, detail);
+        }
+
+        let schedule = self.schedule_at(height);
+        let digests = block.digests(&schedule);
+        if let Some(indexed) = self.storage.blocks.hash_at_height(height) {
+            if !digests.matches(&indexed) {
+                let detail = format!("indexed as {} but hashes to {}", indexed, digests.hash);
+                report.add(height, FsckCheck::HashLinkage, detail);
+            }
+        }
+        if let Some(parent) = parent.filter(|parent| !parent.matches(&block.parent_hash)) {
+            let detail = format!(
+                "parent hash {} is not the hash {} of block {}",
+                block.parent_hash,
+                parent.hash,
+                height - 1
+            );
+            report.add(height, FsckCheck::HashLinkage, detail);
+        }
+
+        let header = self.storage.blocks.get_block_header(&digests.hash);
+        match &header {
+            Some(header) => {
+                let expected = BlockHeader::from_block_with(
+                    &block,
+                    H256::from(header.state_root),
+                    schedule.algorithm_at(height),
+                );
+                if header.transactions_hash != expected.transactions_hash {
+                    let detail = "transactions hash doesn't match the block's transactions";
+                    report.add(height, FsckCheck::Header, detail);
+                } else if *header != expected {
+                    report.add(height, FsckCheck::Header, "doesn't match the block");
+                }
+            }
+            None if height >= self.storage.pruned_below(DataClass::Headers) => {
+                report.add(height, FsckCheck::Header, "missing");
+            }
+            None => {}
+        }
+
+        if height >= self.storage.pruned_below(DataClass::RwSets) {
+            self.check_rw_set(height, report);
+        }
+        if height >= self.storage.pruned_below(DataClass::Results) {
+            self.check_results(&block, &digests, report);
+        }
+        self.check_checkpoint(height, &digests, header.as_ref(), report);
+        Some(digests)
+    }
+
+    /// Checks the slot changes recorded for the block at `height` against
+    /// their value hashes and the key history.
+    fn check_rw_set(&self, height: u64, report: &mut FsckReport) {
+        let Some(parent) = height.checked_sub(1) else {
+            return;
+        };
+        for change in self.storage.state.get_state_diff(parent, height, None) {
+            let address = Address::from(change.address);
+            let slot = H256::from(change.slot);
+            if change.height != height {
+                let detail = format!(
+                    "change of {} slot {} records height {}",
+                    address, slot, change.height
+                );
+                report.add(height, FsckCheck::RwSet, detail);
+            } else if keccak256(&change.new_value) != H256::from(change.new_value_hash) {
+                let detail = format!("value of {} slot {} doesn't match its hash", address, slot);
+                report.add(height, FsckCheck::RwSet, detail);
+            } else {
+                let history = self
+                    .storage
+                    .state
+                    .get_key_history(&address, &slot, Some(parent), 1);
+                let recorded = history.first().filter(|entry| entry.height == height);
+                if recorded.map(|entry| entry.value_hash) != Some(change.new_value_hash) {
+                    let detail = format!("key history of {} slot {} disagrees", address, slot);
+                    report.add(height, FsckCheck::RwSet, detail);
+                }
+            }
+        }
+    }
+
+    /// Checks the stored receipts and transaction DAG of `block`.
+    fn check_results(&self, block: &Block, digests: &BlockDigests, report: &mut FsckReport) {
+        let height = block.height;
+        for (index, tx) in block.transactions.iter().enumerate() {
+            let Some(receipt) = self.storage.transactions.get_receipt(&tx.hash()) else {
+                continue;
+            };
+            if receipt.block_number != height
+                || receipt.transaction_index as usize != index
+                || !digests.matches(&receipt.block_hash_h256())
+            {
+                let detail = format!("receipt of transaction {} points elsewhere", index);
+                report.add(height, FsckCheck::Results, detail);
+            }
+        }
+        if let Some(dag) = self.storage.transactions.get_tx_dag(height) {
+            if dag.len() != block.transactions.len() {
+                let detail = format!(
+                    "DAG covers {} of {} transactions",
+                    dag.len(),
+                    block.transactions.len()
+                );
+                report.add(height, FsckCheck::Results, detail);
+            }
+        }
+    }
+
+    /// Checks the finality checkpoint signed at `height`, if any.
+    fn check_checkpoint(
+        &self,
+        height: u64,
+        digests: &BlockDigests,
+        header: Option<&BlockHeader>,
+        report: &mut FsckReport,
+    ) {
+        let Some(signed) = self.storage.blocks.get_finality_checkpoint(height) else {
+            return;
+        };
+        report.checkpoints += 1;
+        if let Some(header) = header {
+            let receipts_root = self
+                .storage
+                .blocks
+                .get_header_extension(&digests.hash)
+                .and_then(|extension| extension.receipts_chain_root)
+                .map_or_else(H256::zero, H256::from);
+            let local = Checkpoint::new(height, digests.hash, H256::from(header.state_root))
+                .with_receipts_root(receipts_root);
+            if signed.checkpoint != local {
+                report.add(height, FsckCheck::Checkpoint, "doesn't match the block");
+            }
+        }
+        if signed.verify_signatures().is_err() {
+            report.add(
+                height,
+                FsckCheck::Checkpoint,
+                "invalid or repeated signature",
+            );
+        } else if let Some(validators) = self.validators {
+            if let Err(e) = verify_checkpoint(&signed, validators) {
+                report.add(height, FsckCheck::Checkpoint, format!("{:?}", e));
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_consensus::Validator;
+    use bach_crypto::PrivateKey;
+    use bach_types::{SignedCheckpoint, TxDag};
+
+    /// Stores a chain of `len` empty blocks with their headers.
+    fn chain(storage: &Storage, len: u64) -> Vec<Block> {
+        let mut parent = H256::zero();
+        (0..len)
+            .map(|height| {
+                let block = Block::new(height, parent, Vec::new(), 1000 + height);
+                parent = block.hash();
+                storage.blocks.put_block(&block).unwrap();
+                let header = BlockHeader::from_block(&block, H256::from([height as u8; 32]));
+                storage.blocks.put_block_header(&parent, &header).unwrap();
+                block
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_clean_chain() {
+        let storage = Storage::temporary().unwrap();
+        chain(&storage, 5);
+        let report = ChainChecker::new(&storage).check(0, u64::MAX);
+        assert!(report.is_clean(), "{:?}", report.issues);
+        assert_eq!((report.to, report.blocks), (4, 5));
+    }
+
+    #[test]
+    fn test_detects_broken_links_and_headers() {
+        let storage = Storage::temporary().unwrap();
+        let blocks = chain(&storage, 5);
+
+        // A block replaced at its height breaks the link from its child
+        let mut forged = blocks[2].clone();
+        forged.timestamp += 1;
+        let header = BlockHeader::from_block(&forged, H256::zero());
+        storage
+            .blocks
+            .put_block_header(&forged.hash(), &header)
+            .unwrap();
+        storage.blocks.put_block(&forged).unwrap();
+        let mut header = BlockHeader::from_block(&blocks[4], H256::zero());
+        header.transactions_hash = [9; 32];
+        storage
+            .blocks
+            .put_block_header(&blocks[4].hash(), &header)
+            .unwrap();
+
+        let report = ChainChecker::new(&storage).check(1, 4);
+        let found: Vec<(u64, FsckCheck)> = report
+            .issues
+            .iter()
+            .map(|issue| (issue.height, issue.check))
+            .collect();
+        assert_eq!(
+            found,
+            vec![(3, FsckCheck::HashLinkage), (4, FsckCheck::Header)]
+        );
+        assert_eq!(report.corrupt_heights(), vec![3, 4]);
+
+        assert_eq!(report.quarantine(&storage).unwrap(), 2);
+        assert!(storage.blocks.is_quarantined(4));
+        assert!(!storage.blocks.is_quarantined(2));
+    }
+
+    #[test]
+    fn test_checks_dag_and_checkpoint_quorum() {
+        let storage = Storage::temporary().unwrap();
+        let blocks = chain(&storage, 3);
+        let keys: Vec<PrivateKey> = (1..=4u8)
+            .map(|n| PrivateKey::from_bytes(&[n; 32]).unwrap())
+            .collect();
+        let validators = ValidatorSet::new(
+            keys.iter()
+                .map(|key| Validator::new(key.public_key(), 1))
+                .collect(),
+        );
+
+        let hash = blocks[2].hash();
+        let mut signed = SignedCheckpoint::new(Checkpoint::new(2, hash, H256::from([2u8; 32])));
+        signed.signatures.push(signed.checkpoint.sign(&keys[0]));
+        storage.blocks.put_finality_checkpoint(&signed).unwrap();
+
+        let report = ChainChecker::new(&storage).check(0, 2);
+        assert!(report.is_clean());
+        assert_eq!(report.checkpoints, 1);
+        let report = ChainChecker::new(&storage)
+            .with_validators(&validators)
+            .check(0, 2);
+        assert_eq!(report.corrupt_heights(), vec![2]);
+        assert_eq!(report.issues[0].check, FsckCheck::Checkpoint);
+
+        // A DAG stored for transactions the block doesn't have
+        let dag = TxDag::from_dependencies(vec![Vec::new()]).unwrap();
+        storage.transactions.put_tx_dag(1, &dag).unwrap();
+        let report = ChainChecker::new(&storage).check(0, 1);
+        assert_eq!(report.issues[0].check, FsckCheck::Results);
+    }
+}
@@ -0,0 +1,67 @@
+//! Node health client
+//!
+//! Reads a running node's health from its RPC server's `/health` probe:
+//! whether it is syncing and how far behind, taking part in consensus, or
+//! degraded by consensus rounds that end without a signature quorum.
+//! Requests go through the bounded HTTP client.
+
+use crate::http::HttpClient;
+use crate::NodeError;
+use bach_rpc::{HealthResponse, HEALTH_PATH};
+
+/// Reads the health of a remote node.
+#[derive(Debug, Clone)]
+pub struct HealthClient {
+    http: HttpClient,
+}
+
+impl HealthClient {
+    /// Creates a client for the given JSON-RPC address.
+    pub fn new(addr: &str) -> Self {
+        Self {
+            http: HttpClient::new(addr),
+        }
+    }
+
+    /// Fetches the node's health.
+    pub async fn check(&self) -> Result<HealthResponse, NodeError> {
+        let response = self.http.get(HEALTH_PATH).await?;
+        parse_response(&response)
+    }
+}
+
+/// Extracts the health from a `/health` HTTP response.
+fn parse_response(response: &[u8]) -> Result<HealthResponse, NodeError> {
+    let response = String::from_utf8_lossy(response);
+    let (head, body) = response
+        .split_once("\r\n\r\n")
+        .ok_or_else(|| NodeError::ConfigError("truncated health response".to_string()))?;
+    let status_line = head.lines().next().unwrap_or_default();
+    if status_line.split_whitespace().nth(1) != Some("200") {
+        return Err(NodeError::ConfigError(format!(
+            "health request returned {}",
+            status_line
+        )));
+    }
+    serde_json::from_str(body.trim())
+        .map_err(|e| NodeError::ConfigError(format!("invalid health response: {}", e)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_response() {
+        let response = b"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n\
+            {\"status\":\"syncing\",\"ready\":false,\"validator\":true,\"blockHeight\":5,\
+            \"blocksBehind\":20,\"quorumFailures\":0,\"proposalBackoff\":1}";
+        let health = parse_response(response).unwrap();
+        assert_eq!(health.status, "syncing");
+        assert_eq!(health.blocks_behind, 20);
+        assert!(!health.ready);
+
+        assert!(parse_response(b"HTTP/1.1 404 Not Found\r\n\r\n").is_err());
+        assert!(parse_response(b"HTTP/1.1 200 OK\r\n\r\nnot json").is_err());
+    }
+}
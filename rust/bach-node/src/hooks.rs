@@ -0,0 +1,337 @@
+//! Commit hooks
+//!
+//! Internal modules extend what happens when a block is committed by
+//! registering a `CommitHook` instead of editing the committer. Hooks run
+//! after the commit and off its path: a background task receives every
+//! committed block from the message bus, with its receipts and write set,
+//! and runs the hooks on it in registration order, one block at a time in
+//! height order.
+//!
+//! A hook that fails or panics is logged and counted; the other hooks still
+//! run and the block stays committed. Blocks a lagging subscription missed
+//! are read back from storage, and a block the outbox delivers twice runs
+//! once. The runner records the last block it ran as the
+//! `COMMIT_HOOKS_CONSUMER` checkpoint, which acknowledges outbox events.
+
+use crate::NodeError;
+use bach_msgbus::{BlockInfo, Message, RecvError, Subscriber};
+use bach_storage::{RetentionPolicy, Storage};
+use std::collections::HashMap;
+use std::panic::{catch_unwind, AssertUnwindSafe};
+use std::sync::{Arc, Mutex, RwLock};
+
+/// Storage checkpoint of the last block the commit hooks ran on.
+pub const COMMIT_HOOKS_CONSUMER: &str = "commit-hooks";
+
+/// Side effect run after each committed block.
+pub trait CommitHook: Send + Sync {
+    /// Hook name, used in logs and failure counts.
+    fn name(&self) -> &str;
+
+    /// Runs the side effect for a committed block. `block.changes` is the
+    /// block's write set, in commit order.
+    fn on_commit(&self, block: &BlockInfo) -> Result<(), NodeError>;
+}
+
+/// Registered commit hooks, shared by clones.
+#[derive(Clone, Default)]
+pub struct CommitHooks {
+    hooks: Arc<RwLock<Vec<Arc<dyn CommitHook>>>>,
+    failures: Arc<Mutex<HashMap<String, u64>>>,
+}
+
+impl std::fmt::Debug for CommitHooks {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let hooks = self.hooks.read().unwrap();
+        f.debug_list()
+            .entries(hooks.iter().map(|hook| hook.name()))
+            .finish()
+    }
+}
+
+impl CommitHooks {
+    /// Creates an empty registry.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Registers a hook, to run after the hooks registered before it.
+    pub fn register(&self, hook: Arc<dyn CommitHook>) {
+        self.hooks.write().unwrap().push(hook);
+    }
+
+    /// Returns the number of registered hooks.
+    pub fn len(&self) -> usize {
+        self.hooks.read().unwrap().len()
+    }
+
+    /// Returns true if no hook is registered.
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Returns how many blocks the named hook failed on.
+    pub fn failures(&self, name: &str) -> u64 {
+        self.failures
+            .lock()
+            .unwrap()
+            .get(name)
+            .copied()
+            .unwrap_or(0)
+    }
+
+    /// Runs every hook on `block` in registration order and returns how
+    /// many failed.
+    pub fn run(&self, block: &BlockInfo) -> usize {
+        let hooks = self.hooks.read().unwrap().clone();
+        let mut failed = 0;
+        for hook in hooks {
+            let error = match catch_unwind(AssertUnwindSafe(|| hook.on_commit(block))) {
+                Ok(Ok(())) => continue,
+                Ok(Err(e)) => e.to_string(),
+                Err(_) => "panicked".to_string(),
+            };
+            tracing::warn!(
+                hook = hook.name(),
+                height = block.block.height,
+                "Commit hook failed: {}",
+                error
+            );
+            *self
+                .failures
+                .lock()
+                .unwrap()
+                .entry(hook.name().to_string())
+                .or_default() += 1;
+            failed += 1;
+        }
+        failed
+    }
+
+    /// Runs the hooks on every block received from `blocks` until the bus
+    /// closes, resuming after the `COMMIT_HOOKS_CONSUMER` checkpoint. Hooks
+    /// registered later run from the next block on.
+    pub async fn run_on(self, storage: Storage, mut blocks: Subscriber) {
+        let mut next_height = storage
+            .blocks
+            .get_checkpoint(COMMIT_HOOKS_CONSUMER)
+            .map(|height| height + 1);
+        loop {
+            let info = match blocks.recv().await {
+                Ok(Message::BlockCommitted(info)) => info,
+                Ok(_) => continue,
+                Err(RecvError::Lagged(skipped)) => {
+                    tracing::warn!(
+                        skipped,
+                        "Commit hooks lagged, reading missed blocks from storage"
+                    );
+                    continue;
+                }
+                Err(RecvError::Closed) => return,
+            };
+            let height = info.block.height;
+            if next_height.is_some_and(|next| height < next) {
+                // Replayed by the outbox
+                continue;
+            }
+            for missed in next_height.unwrap_or(height)..height {
+                if let Some(info) = read_block_info(&storage, missed) {
+                    self.run_blocking(Arc::new(info)).await;
+                }
+            }
+            self.run_blocking(info).await;
+            next_height = Some(height + 1);
+            if let Err(e) = storage.blocks.put_checkpoint(COMMIT_HOOKS_CONSUMER, height) {
+                tracing::warn!(height, "Failed to record the commit hooks checkpoint: {}", e);
+            }
+        }
+    }
+
+    /// Runs the hooks on a blocking thread so slow hooks don't stall the
+    /// runtime.
+    async fn run_blocking(&self, info: Arc<BlockInfo>) {
+        if self.is_empty() {
+            return;
+        }
+        let hooks = self.clone();
+        if let Err(e) = tokio::task::spawn_blocking(move || hooks.run(&info)).await {
+            tracing::warn!("Commit hooks did not complete: {}", e);
+        }
+    }
+}
+
+/// Prunes the block data the retention policy no longer keeps after each
+/// committed block, so pruning never delays a commit.
+pub struct PruneHook {
+    storage: Storage,
+    policy: RetentionPolicy,
+}
+
+impl PruneHook {
+    /// Creates a hook pruning `storage` by `policy`.
+    pub fn new(storage: Storage, policy: RetentionPolicy) -> Self {
+        Self { storage, policy }
+    }
+}
+
+impl CommitHook for PruneHook {
+    fn name(&self) -> &str {
+        "prune"
+    }
+
+    fn on_commit(&self, block: &BlockInfo) -> Result<(), NodeError> {
+        let head = block.block.height;
+        let report = self.storage.prune(&self.policy, head)?;
+        if report.total() > 0 {
+            tracing::debug!(head, records = report.total(), "Pruned block data");
+        }
+        Ok(())
+    }
+}
+
+/// Rebuilds a committed block's bus message from storage.
+fn read_block_info(storage: &Storage, height: u64) -> Option<BlockInfo> {
+    let block = storage.blocks.get_block_by_height(height)?;
+    let receipts = block
+        .transactions
+        .iter()
+        .filter_map(|tx| storage.transactions.get_receipt(&tx.hash()))
+        .collect();
+    let changes = match height.checked_sub(1) {
+        Some(parent) => storage.state.get_state_diff(parent, height, None),
+        None => Vec::new(),
+    };
+    Some(BlockInfo {
+        block,
+        receipts,
+        changes,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_msgbus::{MsgBus, Topic};
+    use bach_primitives::H256;
+    use bach_types::Block;
+
+    struct Recorder {
+        name: &'static str,
+        seen: Arc<Mutex<Vec<(&'static str, u64)>>>,
+    }
+
+    impl CommitHook for Recorder {
+        fn name(&self) -> &str {
+            self.name
+        }
+
+        fn on_commit(&self, block: &BlockInfo) -> Result<(), NodeError> {
+            self.seen
+                .lock()
+                .unwrap()
+                .push((self.name, block.block.height));
+            match self.name {
+                "failing" => Err(NodeError::ExecutionFailed("boom".to_string())),
+                "panicking" => panic!("boom"),
+                _ => Ok(()),
+            }
+        }
+    }
+
+    fn info(height: u64) -> BlockInfo {
+        BlockInfo {
+            block: Block::new(height, H256::zero(), Vec::new(), 1000 + height),
+            receipts: Vec::new(),
+            changes: Vec::new(),
+        }
+    }
+
+    fn hooks(names: &[&'static str]) -> (CommitHooks, Arc<Mutex<Vec<(&'static str, u64)>>>) {
+        let hooks = CommitHooks::new();
+        let seen = Arc::new(Mutex::new(Vec::new()));
+        for name in names {
+            hooks.register(Arc::new(Recorder {
+                name,
+                seen: Arc::clone(&seen),
+            }));
+        }
+        (hooks, seen)
+    }
+
+    #[test]
+    fn test_hooks_run_in_order_and_isolate_failures() {
+        let (hooks, seen) = hooks(&["first", "failing", "panicking", "last"]);
+        assert_eq!(hooks.run(&info(1)), 2);
+        assert_eq!(
+            *seen.lock().unwrap(),
+            vec![("first", 1), ("failing", 1), ("panicking", 1), ("last", 1)]
+        );
+        assert_eq!(hooks.failures("failing"), 1);
+        assert_eq!(hooks.failures("panicking"), 1);
+        assert_eq!(hooks.failures("first"), 0);
+    }
+
+    #[tokio::test]
+    async fn test_runner_fills_gaps_and_skips_replays() {
+        let storage = Storage::temporary().unwrap();
+        storage.blocks.put_block(&info(2).block).unwrap();
+        let bus = MsgBus::default();
+        let (hooks, seen) = hooks(&["recorder"]);
+        let runner = hooks
+            .clone()
+            .run_on(storage.clone(), bus.subscribe(Topic::BlockCommitted));
+        let runner = tokio::spawn(runner);
+
+        for height in [1, 3, 3] {
+            bus.publish(Message::BlockCommitted(Arc::new(info(height))));
+        }
+        drop(bus);
+        runner.await.unwrap();
+
+        let heights: Vec<u64> = seen.lock().unwrap().iter().map(|(_, h)| *h).collect();
+        assert_eq!(heights, vec![1, 2, 3]);
+        assert_eq!(storage.blocks.get_checkpoint(COMMIT_HOOKS_CONSUMER), Some(3));
+
+        // After a restart, blocks up to the checkpoint are replays
+        let bus = MsgBus::default();
+        let runner = tokio::spawn(hooks.run_on(storage, bus.subscribe(Topic::BlockCommitted)));
+        for height in [3, 4] {
+            bus.publish(Message::BlockCommitted(Arc::new(info(height))));
+        }
+        drop(bus);
+        runner.await.unwrap();
+        let heights: Vec<u64> = seen.lock().unwrap().iter().map(|(_, h)| *h).collect();
+        assert_eq!(heights, vec![1, 2, 3, 4]);
+    }
+
+    #[test]
+    fn test_prune_hook_stops_at_checkpoint() {
+        let storage = Storage::temporary().unwrap();
+        let mut parent_hash = H256::zero();
+        for height in 1..=4 {
+            let block = Block::new(height, parent_hash, Vec::new(), 1000 + height);
+            parent_hash = block.hash();
+            storage.blocks.put_block(&block).unwrap();
+        }
+        let policy = RetentionPolicy {
+            headers: Some(1),
+            transactions: Some(1),
+            results: Some(1),
+            rw_sets: Some(1),
+            events: Some(1),
+            sync_window: 1,
+        };
+        let hook = PruneHook::new(storage.clone(), policy);
+
+        hook.on_commit(&info(4)).unwrap();
+        assert_eq!(storage.pruned_below(bach_storage::DataClass::Results), 0);
+
+        let checkpoint = bach_types::Checkpoint::new(2, parent_hash, H256::zero());
+        storage
+            .blocks
+            .put_finality_checkpoint(&bach_types::SignedCheckpoint::new(checkpoint))
+            .unwrap();
+        hook.on_commit(&info(4)).unwrap();
+        assert_eq!(storage.pruned_below(bach_storage::DataClass::Results), 2);
+    }
+}
@@ -0,0 +1,248 @@
+//! Bounded HTTP/1.1 client
+//!
+//! The node's RPC clients (faucet, health, block verification, submission
+//! and key status checks) speak plain HTTP/1.1 over a fresh connection per
+//! request. `HttpClient` does the exchange for all of them with a deadline
+//! and a cap on the response size, so a slow or oversized answer can't
+//! hold a caller or its memory.
+//!
+//! The server may be given as `srv:<service name>`, so clients can
+//! bootstrap from a domain name: its SRV records are looked up before each
+//! connection and the targets tried in priority order until one accepts.
+
+use bach_network::{SeedResolver, SeedSource, SystemResolver};
+use std::io;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+/// Default cap on response size
+pub(crate) const DEFAULT_MAX_RESPONSE_BYTES: u64 = 4 * 1024 * 1024;
+
+/// Default deadline for connecting, sending and reading the response
+pub(crate) const DEFAULT_REQUEST_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Sends HTTP requests to one server.
+#[derive(Debug, Clone)]
+pub(crate) struct HttpClient {
+    addr: String,
+    /// SRV service the server is found through, if `addr` names one
+    service: Option<SeedSource>,
+    resolver: Arc<dyn SeedResolver>,
+    timeout: Duration,
+    max_response_bytes: u64,
+}
+
+impl HttpClient {
+    /// Creates a client for `addr`, with or without an `http://` prefix.
+    pub(crate) fn new(addr: &str) -> Self {
+        let addr = addr.strip_prefix("http://").unwrap_or(addr).trim_end_matches('/');
+        let service = addr
+            .parse()
+            .ok()
+            .filter(|source| matches!(source, SeedSource::Srv { .. }));
+        Self {
+            addr: addr.to_string(),
+            service,
+            resolver: Arc::new(SystemResolver),
+            timeout: DEFAULT_REQUEST_TIMEOUT,
+            max_response_bytes: DEFAULT_MAX_RESPONSE_BYTES,
+        }
+    }
+
+    /// Sets the largest response accepted.
+    pub(crate) fn with_max_response_bytes(mut self, max: u64) -> Self {
+        self.max_response_bytes = max;
+        self
+    }
+
+    /// Posts a JSON `body` to `/`, with a bearer token if given, and
+    /// returns the raw response.
+    pub(crate) async fn post_json(
+        &self,
+        body: &str,
+        bearer: Option<&str>,
+    ) -> io::Result<Vec<u8>> {
+        let authorization = bearer
+            .map_or_else(String::new, |token| format!("Authorization: Bearer {}\r\n", token));
+        let request = format!(
+            "POST / HTTP/1.1\r\nHost: {}\r\nContent-Type: application/json\r\n\
+             {}Content-Length: {}\r\nConnection: close\r\n\r\n{}",
+            self.host(),
+            authorization,
+            body.len(),
+            body
+        );
+        self.exchange(&request).await
+    }
+
+    /// Gets `path` and returns the raw response.
+    pub(crate) async fn get(&self, path: &str) -> io::Result<Vec<u8>> {
+        let request = format!(
+            "GET {} HTTP/1.1\r\nHost: {}\r\nConnection: close\r\n\r\n",
+            path,
+            self.host()
+        );
+        self.exchange(&request).await
+    }
+
+    async fn exchange(&self, request: &str) -> io::Result<Vec<u8>> {
+        let mut response = Vec::new();
+        let exchange = async {
+            let mut stream = self.connect().await?;
+            stream.write_all(request.as_bytes()).await?;
+            stream
+                .take(self.max_response_bytes + 1)
+                .read_to_end(&mut response)
+                .await
+        };
+        tokio::time::timeout(self.timeout, exchange)
+            .await
+            .map_err(|_| io::Error::new(io::ErrorKind::TimedOut, "request timed out"))??;
+        if response.len() as u64 > self.max_response_bytes {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                format!("response exceeds {} bytes", self.max_response_bytes),
+            ));
+        }
+        Ok(response)
+    }
+
+    /// Returns the Host header value: the service name for SRV endpoints.
+    fn host(&self) -> &str {
+        match &self.service {
+            Some(SeedSource::Srv { name }) => name,
+            _ => &self.addr,
+        }
+    }
+
+    /// Connects to the server, trying each SRV target in turn.
+    async fn connect(&self) -> io::Result<TcpStream> {
+        let Some(service) = &self.service else {
+            return TcpStream::connect(&self.addr).await;
+        };
+        let targets = service
+            .resolve_with(self.resolver.as_ref())
+            .await
+            .map_err(|e| io::Error::new(io::ErrorKind::NotFound, e.to_string()))?;
+        let mut last_error = io::Error::new(
+            io::ErrorKind::NotFound,
+            format!("no endpoints found for {}", service),
+        );
+        for target in targets {
+            match TcpStream::connect(target).await {
+                Ok(stream) => return Ok(stream),
+                Err(e) => last_error = e,
+            }
+        }
+        Err(last_error)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_network::{NetworkError, SrvRecord};
+    use std::collections::HashMap;
+    use std::future::Future;
+    use std::net::SocketAddr;
+    use std::pin::Pin;
+    use tokio::net::TcpListener;
+
+    /// Answers one request with `reply`, or never if None.
+    async fn serve_once(reply: Option<Vec<u8>>) -> String {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        tokio::spawn(async move {
+            let (mut stream, _) = listener.accept().await.unwrap();
+            let mut buf = [0u8; 1024];
+            let _ = stream.read(&mut buf).await.unwrap();
+            match reply {
+                Some(reply) => stream.write_all(&reply).await.unwrap(),
+                None => std::future::pending::<()>().await,
+            }
+        });
+        addr
+    }
+
+    #[tokio::test]
+    async fn test_bounds_response_size_and_time() {
+        let addr = serve_once(Some(b"HTTP/1.1 200 OK\r\n\r\nok".to_vec())).await;
+        let client = HttpClient::new(&format!("http://{}/", addr));
+        assert_eq!(client.get("/").await.unwrap(), b"HTTP/1.1 200 OK\r\n\r\nok");
+
+        let addr = serve_once(Some(vec![b'x'; 64])).await;
+        let client = HttpClient::new(&addr).with_max_response_bytes(32);
+        let err = client.post_json("{}", Some("token")).await.unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+
+        let addr = serve_once(None).await;
+        let client = HttpClient {
+            timeout: Duration::from_millis(50),
+            ..HttpClient::new(&addr)
+        };
+        let err = client.get("/").await.unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::TimedOut);
+    }
+
+    /// Answers SRV and host lookups from fixed tables.
+    #[derive(Debug, Default)]
+    struct MockResolver {
+        hosts: HashMap<String, SocketAddr>,
+        srv: HashMap<String, Vec<SrvRecord>>,
+    }
+
+    impl SeedResolver for MockResolver {
+        fn lookup_host(&self, host: &str, _: u16) -> Lookup<Vec<SocketAddr>> {
+            let result = self
+                .hosts
+                .get(host)
+                .map(|addr| vec![*addr])
+                .ok_or_else(|| NetworkError::ConnectionFailed(format!("no host {}", host)));
+            Box::pin(async move { result })
+        }
+
+        fn lookup_srv(&self, name: &str) -> Lookup<Vec<SrvRecord>> {
+            let records = self.srv.get(name).cloned().unwrap_or_default();
+            Box::pin(async move { Ok(records) })
+        }
+    }
+
+    type Lookup<T> = Pin<Box<dyn Future<Output = Result<T, NetworkError>> + Send>>;
+
+    fn srv_record(priority: u16, target: &str) -> SrvRecord {
+        SrvRecord {
+            priority,
+            weight: 0,
+            port: 0,
+            target: target.to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_srv_endpoint_falls_back_by_priority() {
+        let live = serve_once(Some(b"HTTP/1.1 200 OK\r\n\r\nok".to_vec())).await;
+        let dead = TcpListener::bind("127.0.0.1:0").await.unwrap().local_addr().unwrap();
+
+        let mut resolver = MockResolver::default();
+        resolver.hosts.insert("a.example.org".to_string(), dead);
+        resolver.hosts.insert("b.example.org".to_string(), live.parse().unwrap());
+        resolver.srv.insert(
+            "_bach-rpc._tcp.example.org".to_string(),
+            vec![srv_record(1, "b.example.org"), srv_record(0, "a.example.org")],
+        );
+        let client = HttpClient {
+            resolver: Arc::new(resolver),
+            ..HttpClient::new("srv:_bach-rpc._tcp.example.org")
+        };
+        assert_eq!(client.host(), "_bach-rpc._tcp.example.org");
+        assert_eq!(client.get("/").await.unwrap(), b"HTTP/1.1 200 OK\r\n\r\nok");
+
+        let client = HttpClient {
+            resolver: Arc::new(MockResolver::default()),
+            ..HttpClient::new("srv:_bach-rpc._tcp.example.org")
+        };
+        assert_eq!(client.get("/").await.unwrap_err().kind(), io::ErrorKind::NotFound);
+    }
+}
@@ -0,0 +1,349 @@
+//! Online key status checks against a remote node
+//!
+//! A node can ask another node's JSON-RPC server (`bach_getKeyStatus`)
+//! whether a peer or client key has been revoked, instead of relying only
+//! on the revocation lists in its own ledger. Requests go through the
+//! bounded HTTP client.
+//!
+//! Requests carry a bearer token signed with the node's key, so responders
+//! behind token auth answer them, and a random nonce. The responder signs
+//! its answer together with the nonce; answers not signed by the configured
+//! `responder_key`, or for another key or nonce, are discarded.
+
+use crate::http::HttpClient;
+use crate::NodeError;
+use bach_crypto::{PrivateKey, Signature, SIGNATURE_LENGTH};
+use bach_network::{
+    KeyStatus, RevocationCheckConfig, RevocationChecker, RevocationPolicy, StatusResponder,
+};
+use bach_primitives::{Address, Clock};
+use bach_rpc::{key_status_signing_hash, AuthToken, KeyStatusResponse, TokenAudience};
+use serde::{Deserialize, Serialize};
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::Arc;
+use std::time::Duration;
+
+/// Online revocation check configuration
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct KeyStatusConfig {
+    /// JSON-RPC address of the status responder (`host:port`, optionally
+    /// prefixed with `http://`)
+    pub responder: String,
+
+    /// Address of the key the responder signs its answers with
+    pub responder_key: String,
+
+    /// `soft-fail` accepts keys whose status can't be determined,
+    /// `hard-fail` rejects them
+    #[serde(default = "default_policy")]
+    pub policy: String,
+
+    /// How long an answer is reused, in seconds
+    #[serde(default = "default_cache_secs")]
+    pub cache_secs: u64,
+
+    /// How long to wait for the responder, in milliseconds
+    #[serde(default = "default_timeout_ms")]
+    pub timeout_ms: u64,
+}
+
+fn default_policy() -> String {
+    RevocationPolicy::SoftFail.to_string()
+}
+
+fn default_cache_secs() -> u64 {
+    300
+}
+
+fn default_timeout_ms() -> u64 {
+    2000
+}
+
+impl KeyStatusConfig {
+    /// Creates a soft-fail config querying `responder`, which signs with
+    /// `responder_key`.
+    pub fn new(responder: &str, responder_key: &Address) -> Self {
+        Self {
+            responder: responder.to_string(),
+            responder_key: responder_key.to_string(),
+            policy: default_policy(),
+            cache_secs: default_cache_secs(),
+            timeout_ms: default_timeout_ms(),
+        }
+    }
+
+    /// Builds the checker used by the network and RPC layers. Requests are
+    /// authenticated with `auth_key` if given, by tokens for the responder
+    /// on chain `chain_id`.
+    pub fn checker(
+        &self,
+        clock: Arc<dyn Clock>,
+        chain_id: u64,
+        auth_key: Option<PrivateKey>,
+    ) -> Result<RevocationChecker, NodeError> {
+        let policy: RevocationPolicy = self.policy.parse().map_err(NodeError::ConfigError)?;
+        let responder_key = Address::from_hex(&self.responder_key).map_err(|e| {
+            NodeError::ConfigError(format!("Invalid key_status.responder_key: {:?}", e))
+        })?;
+        let config = RevocationCheckConfig {
+            policy,
+            cache_ttl: Duration::from_secs(self.cache_secs),
+            timeout: Duration::from_millis(self.timeout_ms),
+        };
+        let mut responder = RpcStatusResponder::new(&self.responder, responder_key);
+        if let Some(key) = auth_key {
+            responder = responder.with_auth_key(key, chain_id);
+        }
+        Ok(RevocationChecker::new(Arc::new(responder), config).with_clock(clock))
+    }
+}
+
+/// Largest `bach_getKeyStatus` HTTP response read, headers included.
+const MAX_RESPONSE_BYTES: u64 = 16 * 1024;
+
+/// Lifetime of the bearer tokens sent to the responder.
+const TOKEN_TTL: Duration = Duration::from_secs(60);
+
+/// Queries `bach_getKeyStatus` on a remote node.
+#[derive(Debug, Clone)]
+pub struct RpcStatusResponder {
+    http: HttpClient,
+    responder_key: Address,
+    auth: Option<(PrivateKey, TokenAudience)>,
+}
+
+impl RpcStatusResponder {
+    /// Creates a responder for the given JSON-RPC address, whose answers
+    /// must be signed by `responder_key`.
+    pub fn new(addr: &str, responder_key: Address) -> Self {
+        Self {
+            http: HttpClient::new(addr).with_max_response_bytes(MAX_RESPONSE_BYTES),
+            responder_key,
+            auth: None,
+        }
+    }
+
+    /// Sends a bearer token signed with `key` with each request, issued
+    /// for the responder on chain `chain_id`.
+    pub fn with_auth_key(mut self, key: PrivateKey, chain_id: u64) -> Self {
+        let audience = TokenAudience::new(chain_id, self.responder_key.to_string());
+        self.auth = Some((key, audience));
+        self
+    }
+
+    async fn query(self, address: Address) -> Result<KeyStatus, String> {
+        let nonce = u64::from_be_bytes(PrivateKey::random().to_bytes()[..8].try_into().unwrap());
+        let body = serde_json::json!({
+            "jsonrpc": "2.0",
+            "id": 1,
+            "method": "bach_getKeyStatus",
+            "params": [address.to_string(), nonce],
+        })
+        .to_string();
+        let token = self
+            .auth
+            .as_ref()
+            .map(|(key, audience)| AuthToken::issue(key, audience, TOKEN_TTL).encode());
+        let response = self
+            .http
+            .post_json(&body, token.as_deref())
+            .await
+            .map_err(|e| e.to_string())?;
+        parse_response(&response, &address, nonce, &self.responder_key)
+    }
+}
+
+impl StatusResponder for RpcStatusResponder {
+    fn status(
+        &self,
+        address: Address,
+    ) -> Pin<Box<dyn Future<Output = Result<KeyStatus, String>> + Send>> {
+        Box::pin(self.clone().query(address))
+    }
+}
+
+/// Extracts the key status from a `bach_getKeyStatus` HTTP response, checking
+/// it answers for `address` and `nonce` and is signed by `responder_key`.
+fn parse_response(
+    response: &[u8],
+    address: &Address,
+    nonce: u64,
+    responder_key: &Address,
+) -> Result<KeyStatus, String> {
+    let response = String::from_utf8_lossy(response);
+    let (head, body) = response
+        .split_once("\r\n\r\n")
+        .ok_or_else(|| "truncated response".to_string())?;
+    let status_line = head.lines().next().unwrap_or_default();
+    if status_line.split_whitespace().nth(1) != Some("200") {
+        return Err(format!("responder returned {}", status_line));
+    }
+
+    let reply: serde_json::Value = serde_json::from_str(body.trim()).map_err(|e| e.to_string())?;
+    if let Some(error) = reply.get("error") {
+        return Err(format!("responder error: {}", error));
+    }
+    let result: KeyStatusResponse = reply
+        .get("result")
+        .cloned()
+        .map(serde_json::from_value)
+        .transpose()
+        .map_err(|e| e.to_string())?
+        .ok_or_else(|| "response has no result".to_string())?;
+    if Address::from_hex(&result.address).ok().as_ref() != Some(address) || result.nonce != nonce {
+        return Err("answer is for another request".to_string());
+    }
+    let signature = hex::decode(result.signature.trim_start_matches("0x"))
+        .ok()
+        .and_then(|bytes| <[u8; SIGNATURE_LENGTH]>::try_from(bytes).ok())
+        .and_then(|bytes| Signature::from_bytes(&bytes).ok())
+        .ok_or_else(|| "malformed answer signature".to_string())?;
+    let hash = key_status_signing_hash(address, &result.status, nonce);
+    match signature.recover(&hash) {
+        Ok(key) if key.to_address() == *responder_key => {}
+        _ => return Err("answer not signed by the responder key".to_string()),
+    }
+    match result.status.as_str() {
+        "good" => Ok(KeyStatus::Good),
+        "revoked" => Ok(KeyStatus::Revoked),
+        "unknown" => Ok(KeyStatus::Unknown),
+        other => Err(format!("unrecognized status {}", other)),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::TcpListener;
+
+    /// Serves one HTTP request, answering `status` for the queried key and
+    /// nonce signed by `signer`, and returns the request.
+    async fn serve_once(
+        signer: PrivateKey,
+        status: &'static str,
+    ) -> (String, tokio::task::JoinHandle<String>) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let handle = tokio::spawn(async move {
+            let (mut stream, _) = listener.accept().await.unwrap();
+            let mut buf = [0u8; 4096];
+            let n = stream.read(&mut buf).await.unwrap();
+            let request = String::from_utf8_lossy(&buf[..n]).to_string();
+            let (_, body) = request.split_once("\r\n\r\n").unwrap();
+            let body: serde_json::Value = serde_json::from_str(body).unwrap();
+            let address = Address::from_hex(body["params"][0].as_str().unwrap()).unwrap();
+            let nonce = body["params"][1].as_u64().unwrap();
+            let signature = signer.sign(&key_status_signing_hash(&address, status, nonce));
+            let reply = serde_json::json!({
+                "jsonrpc": "2.0",
+                "id": 1,
+                "result": {
+                    "address": address.to_string(),
+                    "status": status,
+                    "nonce": nonce,
+                    "signature": format!("0x{}", hex::encode(signature.to_bytes())),
+                },
+            })
+            .to_string();
+            let response = format!(
+                "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\
+                 Content-Length: {}\r\n\r\n{}",
+                reply.len(),
+                reply
+            );
+            stream.write_all(response.as_bytes()).await.unwrap();
+            request
+        });
+        (addr, handle)
+    }
+
+    #[tokio::test]
+    async fn test_rpc_responder_status() {
+        let key = Address::from([3u8; 20]);
+        let signer = PrivateKey::from_bytes(&[0x44; 32]).unwrap();
+        let signer_address = signer.public_key().to_address();
+
+        let (addr, request) = serve_once(signer.clone(), "revoked").await;
+        let client = PrivateKey::from_bytes(&[0x55; 32]).unwrap();
+        let responder = RpcStatusResponder::new(&format!("http://{}", addr), signer_address)
+            .with_auth_key(client, 1);
+        assert_eq!(responder.status(key).await, Ok(KeyStatus::Revoked));
+        assert!(request.await.unwrap().contains("Authorization: Bearer 0x"));
+
+        let (addr, _) = serve_once(signer.clone(), "good").await;
+        let responder = RpcStatusResponder::new(&addr, signer_address);
+        assert_eq!(responder.status(key).await, Ok(KeyStatus::Good));
+
+        let (addr, _) = serve_once(signer, "unknown").await;
+        let responder = RpcStatusResponder::new(&addr, signer_address);
+        assert_eq!(responder.status(key).await, Ok(KeyStatus::Unknown));
+
+        // Answers signed by another key are discarded
+        let (addr, _) = serve_once(PrivateKey::random(), "good").await;
+        let responder = RpcStatusResponder::new(&addr, signer_address);
+        assert!(responder.status(key).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_response_size_is_bounded() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        tokio::spawn(async move {
+            let (mut stream, _) = listener.accept().await.unwrap();
+            let mut buf = [0u8; 4096];
+            let _ = stream.read(&mut buf).await.unwrap();
+            let padding = vec![b' '; MAX_RESPONSE_BYTES as usize];
+            let _ = stream.write_all(b"HTTP/1.1 200 OK\r\n\r\n").await;
+            let _ = stream.write_all(&padding).await;
+        });
+        let responder = RpcStatusResponder::new(&addr, Address::from([1u8; 20]));
+        let err = responder.status(Address::from([3u8; 20])).await.unwrap_err();
+        assert!(err.contains("exceeds"));
+    }
+
+    #[test]
+    fn test_parse_response_errors() {
+        let key = Address::from([3u8; 20]);
+        let signer = PrivateKey::from_bytes(&[0x44; 32]).unwrap();
+        let responder_key = signer.public_key().to_address();
+        let parse = |response: &[u8]| parse_response(response, &key, 9, &responder_key);
+        assert!(parse(b"HTTP/1.1 401 Unauthorized\r\n\r\n").is_err());
+        assert!(parse(b"HTTP/1.1 200 OK\r\n").is_err());
+        assert!(parse(b"HTTP/1.1 200 OK\r\n\r\n{\"error\":{\"code\":-32601}}").is_err());
+        assert!(parse(b"HTTP/1.1 200 OK\r\n\r\n{\"result\":\"good\"}").is_err());
+
+        // A signed answer replayed for another nonce
+        let signature = signer.sign(&key_status_signing_hash(&key, "good", 8));
+        let reply = serde_json::json!({
+            "result": {
+                "address": key.to_string(),
+                "status": "good",
+                "nonce": 8,
+                "signature": format!("0x{}", hex::encode(signature.to_bytes())),
+            },
+        });
+        let response = format!("HTTP/1.1 200 OK\r\n\r\n{}", reply);
+        assert!(parse(response.as_bytes()).is_err());
+        assert_eq!(
+            parse_response(response.as_bytes(), &key, 8, &responder_key),
+            Ok(KeyStatus::Good)
+        );
+    }
+
+    #[tokio::test]
+    async fn test_config_builds_checker() {
+        let mut config = KeyStatusConfig::new("127.0.0.1:1", &Address::from([1u8; 20]));
+        config.policy = "hard-fail".to_string();
+        let checker = config.checker(bach_primitives::system_clock(), 1, None).unwrap();
+        assert_eq!(checker.config().policy, RevocationPolicy::HardFail);
+        assert!(checker.check(&Address::from([4u8; 20])).await.is_err());
+
+        config.policy = "lenient".to_string();
+        assert!(config.checker(bach_primitives::system_clock(), 1, None).is_err());
+        config.policy = "soft-fail".to_string();
+        config.responder_key = "node-b".to_string();
+        assert!(config.checker(bach_primitives::system_clock(), 1, None).is_err());
+    }
+}
@@ -30,19 +30,138 @@
 //! |  +-----------+    |
 //! +-------------------+
 //! ```
+//!
+//! # Consensus Driver
+//!
+//! `BachNode::start` runs storage, RPC and the commit pipeline but no
+//! consensus loop yet; blocks reach it through `commit_block`. The policies
+//! a consensus driver applies are exposed for one to use: `proposal_timer`
+//! (timer strategies and the empty-block heartbeat), `proposal_backoff`
+//! with `record_proposal_failure` and `record_proposal_commit`,
+//! `record_quorum_failure`, `record_tx_requeues`, the chain-configured
+//! proposal checks (`timestamp_validator`, `max_txs_per_sender`,
+//! `block_gas_limit`) and the trailing system transactions (`system_txs`,
+//! `append_system_txs`). In
+//! this tree the in-process `TestNetwork`, built in tests or with the
+//! `testnet` feature, is the only driver, so these are library APIs rather
+//! than behavior of a running node. Devnet, the other block producer, paces
+//! its blocks with `proposal_timer`, heartbeat included, fills them within
+//! `block_gas_limit` and `max_txs_per_sender`, appends the system
+//! transactions and records each block as a committed proposal. As a solo
+//! validator it never misses a quorum, so it has no failures or requeues
+//! to record. Without quorum failure reports
+//! the node's health still stops reporting it as participating once its
+//! commits go stale.
+//!
+//! Equivocation evidence is a transaction to the evidence registry native
+//! contract. Committing a block runs its evidence calls against the
+//! configured validator set, records the evidence they prove and returns
+//! an `EvidenceRecorded` log in each call's receipt; a call the registry
+//! rejects gets a failed receipt. A consensus driver submits the evidence
+//! its engine detects with `evidence_transaction` and applies
+//! `penalties_at` before each height.
+//!
+//! A network service is connected with `attach_network`, which keeps its
+//! static topology allowlist in step with the `nodes.<org>` chain config
+//! parameters.
 
 #![forbid(unsafe_code)]
 
-use bach_crypto::PrivateKey;
-use bach_primitives::{Address, H256, U256};
-use bach_rpc::{RpcConfig, RpcServer, RpcState};
-use bach_storage::Storage;
+use bach_contracts::{
+    chain_config_address, did_registry_address, is_did, ChainConfig, ChainConfigContract, ChainConfigVersion, DidError,
+    DidEvent, DidRegistry, IndexChange, IndexRegistry, IndexSpec, MultiSign, PolicyEvaluation,
+    multi_sign_address, revocation_registry_address, ActiveRevocationList, RevocationRegistry, SignedDidDocument,
+    ACL_RESOURCE_PREFIX, PAUSE_RESOURCE_PREFIX, PROTOCOL_FEATURES, DID_REGISTER, REVOCATION_UPLOAD,
+};
+use bach_consensus::{
+    evidence_registry_address, is_checkpoint_height, verify_checkpoint, BackoffTimer,
+    CheckpointCollector, CheckpointVote, Evidence, EvidenceRecord, EvidenceRegistry,
+    GasSettlement, Penalty, ProposalStrategy, ProposalTimer, ProposalTimerConfig,
+    ProposerBackoff, SystemTxGenerator, SystemTxs, ThresholdPenaltyHook, TimestampValidator,
+    TxSignatureVerifier, ValidatorSet, DEFAULT_BACKOFF_AFTER, DEFAULT_MAX_BACKOFF,
+};
+use bach_crypto::{HashSchedule, PrivateKey, SignatureScheme};
+use bach_evm::decode_index_call;
+use bach_msgbus::{BlockCommitReport, Message, MsgBus, TxRequeue};
+use bach_network::{
+    NetworkCommand, NodeHealth, PeerId, RevocationChecker, SerializableTransaction, StaticPeer,
+    SyncProgress,
+};
+use bach_primitives::{Address, Clock, ErrorCode, ErrorCoded, SystemClock, H256, U256};
+use bach_rpc::{
+    AdminRole, InterceptorConfig, KnownKeys, LogLevelHandle, RevokedKeys, RpcConfig, RpcServer,
+    RpcState, TokenAudience, TokenAuthConfig, TxPoolPersistence,
+};
+use bach_scheduler::{PoolSizeConfig, SeamlessScheduler};
+use bach_state::SparseMerkleTree;
+use bach_storage::{Log, RetentionPolicy, Storage, TransactionReceipt};
+use bach_types::{Block, BlockDigests, Checkpoint, SignedCheckpoint, Transaction};
 use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
 use std::net::SocketAddr;
 use std::path::PathBuf;
-use std::sync::Arc;
+use std::sync::{Arc, RwLock};
+use std::time::Duration;
 use thiserror::Error;
 
+mod block_verifier;
+mod committer;
+mod config_check;
+mod devnet;
+mod exporter;
+mod faucet;
+mod fsck;
+mod health;
+mod hooks;
+mod http;
+mod key_status;
+mod outbox;
+mod output;
+mod plugin;
+mod profile;
+mod submit;
+mod subscription;
+mod sync;
+#[cfg(any(test, feature = "testnet"))]
+mod testnet;
+mod verify;
+mod warmup;
+
+pub use block_verifier::{ExecutionVerifier, VerifierHead};
+pub use committer::{BlockCommit, BlockCommitter};
+pub use config_check::{validate_chain_config, ConfigIssue, ConfigReport, Severity};
+pub use devnet::{
+    ContractDeployment, DevAccount, Devnet, DevnetConfig, DEFAULT_DEVNET_ACCOUNTS,
+    DEFAULT_DEVNET_INTERVAL,
+};
+pub use exporter::{
+    BlockExporter, ExportConfig, ExportError, ExportSink, ExportedBlock, ExportedLog,
+    ExportedTransaction, NatsSink,
+};
+pub use faucet::FaucetClient;
+pub use fsck::{ChainChecker, FsckCheck, FsckIssue, FsckReport};
+pub use health::HealthClient;
+pub use hooks::{CommitHook, CommitHooks, PruneHook, COMMIT_HOOKS_CONSUMER};
+pub use outbox::{EventOutbox, DEFAULT_OUTBOX_RETRY_INTERVAL};
+pub use output::{
+    render_error, render_list, render_one, OutputFormat, Tabular, EXIT_CONFIG, EXIT_DENIED,
+    EXIT_FAILURE, EXIT_NETWORK, EXIT_REJECTED,
+};
+pub use key_status::{KeyStatusConfig, RpcStatusResponder};
+pub use plugin::{Plugin, PLUGIN_PREFIX};
+pub use profile::{Context, Profile, BACH_HOME_ENV};
+pub use submit::{RetryPolicy, Submitted, TxSubmitter, RETRYABLE_HTTP_STATUSES};
+pub use subscription::{StateChangeFilter, StateChangeSubscription};
+pub use sync::{
+    BlockSource, StorageSource, StreamingSync, SyncConfig, SyncHeader, SyncReport,
+    DEFAULT_SYNC_MAX_IN_FLIGHT, DEFAULT_SYNC_RANGE_SIZE,
+};
+#[cfg(any(test, feature = "testnet"))]
+pub use testnet::{ConsensusMode, TestNetwork, TestNetworkConfig, TestNode};
+pub use verify::{verify_block_response, VerifiedBlock, VerifiedReceipt, VerifyingClient};
+pub use warmup::{WarmupReport, DEFAULT_WARMUP_BLOCKS};
+use warmup::{hot_contracts, warm_blocks, warm_code, warmup_heights};
+
 /// Node errors
 #[derive(Debug, Error)]
 pub enum NodeError {
@@ -58,6 +177,21 @@ pub enum NodeError {
     #[error("Consensus error: {0}")]
     ConsensusError(String),
 
+    #[error("Block {height} is missing")]
+    PreBlockMissing { height: u64 },
+
+    #[error("Block {height} diverged from its verified read/write sets")]
+    RwSetMismatch { height: u64 },
+
+    #[error("No signature quorum for block {height} after {rounds} round(s)")]
+    SigQuorumNotReached { height: u64, rounds: u32 },
+
+    #[error("Execution failed: {0}")]
+    ExecutionFailed(String),
+
+    #[error("Transaction {0:?} was already committed")]
+    DuplicateTx(H256),
+
     #[error("IO error: {0}")]
     IoError(#[from] std::io::Error),
 
@@ -66,6 +200,70 @@ pub enum NodeError {
 
     #[error("Node already running")]
     AlreadyRunning,
+
+    #[error("Rejected by chain: {0}")]
+    Rejected(String),
+
+    #[error("Permission denied: {0}")]
+    PermissionDenied(String),
+
+    #[error("Response failed verification: {0}")]
+    VerificationFailed(String),
+}
+
+impl NodeError {
+    /// Returns the process exit code for this error.
+    pub fn exit_code(&self) -> u8 {
+        match self {
+            NodeError::ConfigError(_) => EXIT_CONFIG,
+            NodeError::NetworkError(_) => EXIT_NETWORK,
+            NodeError::Rejected(_)
+            | NodeError::ConsensusError(_)
+            | NodeError::RwSetMismatch { .. }
+            | NodeError::ExecutionFailed(_)
+            | NodeError::DuplicateTx(_) => EXIT_REJECTED,
+            NodeError::PermissionDenied(_) => EXIT_DENIED,
+            NodeError::StorageError(_)
+            | NodeError::PreBlockMissing { .. }
+            | NodeError::SigQuorumNotReached { .. }
+            | NodeError::VerificationFailed(_)
+            | NodeError::IoError(_)
+            | NodeError::NotRunning
+            | NodeError::AlreadyRunning => EXIT_FAILURE,
+        }
+    }
+
+    /// Returns a stable name for the kind of error, for machine-readable output.
+    pub fn kind(&self) -> &'static str {
+        match self.exit_code() {
+            EXIT_CONFIG => "config",
+            EXIT_NETWORK => "network",
+            EXIT_REJECTED => "rejected",
+            EXIT_DENIED => "denied",
+            _ => "failure",
+        }
+    }
+}
+
+impl ErrorCoded for NodeError {
+    fn error_code(&self) -> ErrorCode {
+        match self {
+            NodeError::ConfigError(_) => ErrorCode::Config,
+            NodeError::StorageError(e) => e.error_code(),
+            NodeError::NetworkError(_) => ErrorCode::Network,
+            NodeError::ConsensusError(_) => ErrorCode::InvalidConsensusMessage,
+            NodeError::PreBlockMissing { .. } => ErrorCode::PreBlockMissing,
+            NodeError::RwSetMismatch { .. } => ErrorCode::RwSetMismatch,
+            NodeError::SigQuorumNotReached { .. } => ErrorCode::SigQuorumNotReached,
+            NodeError::ExecutionFailed(_) => ErrorCode::ExecutionFailed,
+            NodeError::DuplicateTx(_) => ErrorCode::DuplicateTx,
+            NodeError::IoError(_) => ErrorCode::Internal,
+            NodeError::NotRunning | NodeError::AlreadyRunning => ErrorCode::Unavailable,
+            NodeError::Rejected(_) => ErrorCode::Rejected,
+            NodeError::PermissionDenied(_) => ErrorCode::PermissionDenied,
+            NodeError::VerificationFailed(_) => ErrorCode::ResponseUnverified,
+        }
+    }
 }
 
 /// Node configuration
@@ -80,9 +278,20 @@ pub struct NodeConfig {
     /// Bootstrap peers to connect to
     pub bootstrap_peers: Vec<SocketAddr>,
 
+    /// DNS bootstrap seeds (`host:port` or `srv:<service name>`), resolved
+    /// when networking starts
+    #[serde(default)]
+    pub seeds: Vec<String>,
+
     /// Validator private key (if this node is a validator)
     pub validator_key: Option<[u8; 32]>,
 
+    /// Validators whose quorum signs finality checkpoints. A validator
+    /// signs the checkpoint of each block it commits at a checkpoint
+    /// height, and records it at once when its own signature is a quorum
+    #[serde(skip)]
+    pub validator_set: Option<ValidatorSet>,
+
     /// Chain ID
     pub chain_id: u64,
 
@@ -97,6 +306,113 @@ pub struct NodeConfig {
 
     /// RPC listen address
     pub rpc_addr: Option<SocketAddr>,
+
+    /// Member addresses or DIDs allowed to call RPC with a bearer token
+    /// (token auth is disabled when empty)
+    #[serde(default)]
+    pub rpc_auth_members: Vec<String>,
+
+    /// Node name bearer tokens must be issued for (default: the validator
+    /// address). Tokens for another node or chain are refused.
+    #[serde(default)]
+    pub rpc_auth_audience: Option<String>,
+
+    /// Admin roles (`auditor`, `operator`, `consensus_admin`) by member
+    /// address or DID. Roles are only granted here, never by the roles a
+    /// DID document claims.
+    #[serde(default)]
+    pub rpc_admin_roles: HashMap<String, String>,
+
+    /// Hash of the approved document of each DID configured as a member,
+    /// as shown by `bach-node did resolve`. A DID resolves to keys only
+    /// while its current document matches the pin, so a holder can't add
+    /// keys without the operator re-pinning.
+    #[serde(default)]
+    pub did_pins: HashMap<String, String>,
+
+    /// Per-method params size and rate limits of RPC calls, and the
+    /// slow-request log threshold
+    #[serde(default)]
+    pub rpc_interceptors: InterceptorConfig,
+
+    /// Bearer token Prometheus presents on `/metrics`. Without one, scrapes
+    /// need a member token when token auth is enabled.
+    #[serde(default)]
+    pub metrics_token: Option<String>,
+
+    /// Smallest execution pool size for the auto-tuned scheduler (default 1)
+    #[serde(default)]
+    pub scheduler_min_threads: Option<usize>,
+
+    /// Largest execution pool size for the auto-tuned scheduler (default: CPU count)
+    #[serde(default)]
+    pub scheduler_max_threads: Option<usize>,
+
+    /// Export committed blocks to NATS (disabled when unset)
+    #[serde(default)]
+    pub export: Option<ExportConfig>,
+
+    /// Ask a remote node whether peer and client keys are revoked
+    /// (disabled when unset)
+    #[serde(default)]
+    pub key_status: Option<KeyStatusConfig>,
+
+    /// Persist pooled transactions so they survive a restart (disabled
+    /// when unset)
+    #[serde(default)]
+    pub tx_pool_persistence: Option<TxPoolPersistence>,
+
+    /// Check transaction signatures of proposed blocks on a pool of worker
+    /// threads instead of one by one
+    #[serde(default)]
+    pub parallel_tx_verification: bool,
+
+    /// Worker threads for parallel signature checks (all cores if unset)
+    #[serde(default)]
+    pub tx_verification_workers: Option<usize>,
+
+    /// Blocks for which contract debug logs of transactions submitted over
+    /// RPC are kept locally (not kept when unset)
+    #[serde(default)]
+    pub contract_log_retention_blocks: Option<u64>,
+
+    /// Quorum failures of our own blocks in a row after which proposals
+    /// slow down (default 3, 0 disables backoff)
+    #[serde(default)]
+    pub proposal_backoff_after: Option<u32>,
+
+    /// Largest factor by which backoff stretches the proposal interval
+    /// (default 8)
+    #[serde(default)]
+    pub proposal_backoff_max: Option<u32>,
+
+    /// Blocks of headers, transaction indexes, results, write sets and
+    /// events to keep (all kept by default). Pruned in the background,
+    /// never past the latest finality checkpoint or the sync window.
+    #[serde(default)]
+    pub retention: RetentionPolicy,
+
+    /// Recent blocks loaded into caches before the node reports ready
+    /// (default 64, 0 disables the warm-up)
+    #[serde(default)]
+    pub warmup_blocks: Option<u64>,
+
+    /// Chain config parameters of the genesis version, used when storage
+    /// holds no chain config yet. Later changes are chain config
+    /// transactions.
+    #[serde(default)]
+    pub genesis_chain_config: BTreeMap<String, String>,
+
+    /// Append a gas settlement system transaction to every block holding
+    /// user transactions (see `GasSettlement`)
+    #[serde(default)]
+    pub gas_settlement: bool,
+
+    /// Maintain a sparse Merkle commitment over contract storage, recorded
+    /// in every block's header extension and proven by
+    /// `bach_getStateProof`. Off by default: every write rehashes a path.
+    #[serde(default)]
+    pub state_commitment: bool,
 }
 
 impl Default for NodeConfig {
@@ -105,12 +421,35 @@ impl Default for NodeConfig {
             data_dir: PathBuf::from("./data"),
             listen_addr: "0.0.0.0:30303".parse().unwrap(),
             bootstrap_peers: Vec::new(),
+            seeds: Vec::new(),
             validator_key: None,
+            validator_set: None,
             chain_id: 1,
             block_time_ms: 3000,
             max_txs_per_block: 1000,
             rpc_enabled: false,
             rpc_addr: None,
+            rpc_auth_members: Vec::new(),
+            rpc_auth_audience: None,
+            rpc_admin_roles: HashMap::new(),
+            did_pins: HashMap::new(),
+            rpc_interceptors: InterceptorConfig::default(),
+            metrics_token: None,
+            scheduler_min_threads: None,
+            scheduler_max_threads: None,
+            export: None,
+            key_status: None,
+            tx_pool_persistence: None,
+            parallel_tx_verification: false,
+            tx_verification_workers: None,
+            contract_log_retention_blocks: None,
+            proposal_backoff_after: None,
+            proposal_backoff_max: None,
+            retention: RetentionPolicy::default(),
+            warmup_blocks: None,
+            genesis_chain_config: BTreeMap::new(),
+            gas_settlement: false,
+            state_commitment: false,
         }
     }
 }
@@ -136,12 +475,24 @@ impl NodeConfig {
         self
     }
 
+    /// Sets the DNS bootstrap seeds.
+    pub fn with_seeds(mut self, seeds: Vec<String>) -> Self {
+        self.seeds = seeds;
+        self
+    }
+
     /// Sets the validator key.
     pub fn with_validator_key(mut self, key: [u8; 32]) -> Self {
         self.validator_key = Some(key);
         self
     }
 
+    /// Sets the validators whose quorum signs finality checkpoints.
+    pub fn with_validator_set(mut self, validator_set: ValidatorSet) -> Self {
+        self.validator_set = Some(validator_set);
+        self
+    }
+
     /// Sets the chain ID.
     pub fn with_chain_id(mut self, chain_id: u64) -> Self {
         self.chain_id = chain_id;
@@ -155,7 +506,151 @@ impl NodeConfig {
         self
     }
 
-    /// Loads config from a TOML file.
+    /// Enables or disables the gas settlement system transaction.
+    pub fn with_gas_settlement(mut self, enabled: bool) -> Self {
+        self.gas_settlement = enabled;
+        self
+    }
+
+    /// Enables or disables the state commitment.
+    pub fn with_state_commitment(mut self, enabled: bool) -> Self {
+        self.state_commitment = enabled;
+        self
+    }
+
+    /// Sets a chain config parameter of the genesis version.
+    pub fn with_genesis_chain_config(mut self, name: &str, value: &str) -> Self {
+        self.genesis_chain_config
+            .insert(name.to_string(), value.to_string());
+        self
+    }
+
+    /// Returns the execution pool bounds for the scheduler.
+    pub fn scheduler_pool_config(&self) -> PoolSizeConfig {
+        let defaults = PoolSizeConfig::default();
+        PoolSizeConfig {
+            min_threads: self.scheduler_min_threads.unwrap_or(defaults.min_threads),
+            max_threads: self.scheduler_max_threads.unwrap_or(defaults.max_threads),
+        }
+        .normalized()
+    }
+
+    /// Returns a scheduler executing on its own pool, auto-tuned within
+    /// `scheduler_pool_config`.
+    pub fn scheduler(&self) -> SeamlessScheduler {
+        SeamlessScheduler::with_auto_tuning(self.scheduler_pool_config())
+    }
+
+    /// Returns the verifier for transaction signatures of proposed blocks.
+    pub fn tx_signature_verifier(&self) -> TxSignatureVerifier {
+        if self.parallel_tx_verification {
+            TxSignatureVerifier::parallel(self.tx_verification_workers)
+        } else {
+            TxSignatureVerifier::sequential()
+        }
+    }
+
+    /// Builds the RPC token auth settings, resolving DID members through
+    /// `dids`. Returns None when token auth is disabled.
+    pub fn token_auth_config(
+        &self,
+        dids: &DidRegistry,
+    ) -> Result<Option<TokenAuthConfig>, NodeError> {
+        if self.rpc_auth_members.is_empty() {
+            return Ok(None);
+        }
+
+        let mut config = TokenAuthConfig {
+            audience: self.rpc_auth_audience()?,
+            ..Default::default()
+        };
+        for member in &self.rpc_auth_members {
+            let keys = self.resolve_member(member, dids, "RPC auth member")?;
+            if is_did(member) {
+                for key in &keys {
+                    config.dids.insert(*key, member.clone());
+                }
+            }
+            config.members.extend(keys);
+        }
+        for (member, role) in &self.rpc_admin_roles {
+            let role: AdminRole = role.parse().map_err(NodeError::ConfigError)?;
+            for key in self.resolve_member(member, dids, "RPC admin")? {
+                config.roles.insert(key, role);
+            }
+        }
+        Ok(Some(config))
+    }
+
+    /// Returns the chain and node name bearer tokens must be issued for.
+    pub fn rpc_auth_audience(&self) -> Result<TokenAudience, NodeError> {
+        let node = match (&self.rpc_auth_audience, &self.validator_key) {
+            (Some(name), _) => name.clone(),
+            (None, Some(key)) => PrivateKey::from_bytes(key)
+                .map_err(|_| NodeError::ConfigError("Invalid validator key".to_string()))?
+                .public_key()
+                .to_address()
+                .to_string(),
+            (None, None) => {
+                return Err(NodeError::ConfigError(
+                    "Token auth needs rpc_auth_audience or a validator key".to_string(),
+                ))
+            }
+        };
+        Ok(TokenAudience::new(self.chain_id, node))
+    }
+
+    /// Resolves a configured member, given as a hex address or a DID, to
+    /// the keys that act for it. A DID has no keys unless it is registered,
+    /// active and its current document matches the one pinned in
+    /// `did_pins`.
+    pub fn resolve_member(
+        &self,
+        member: &str,
+        dids: &DidRegistry,
+        kind: &str,
+    ) -> Result<Vec<Address>, NodeError> {
+        if !is_did(member) {
+            let address = Address::from_hex(member).map_err(|e| {
+                NodeError::ConfigError(format!("Invalid {} {}: {:?}", kind, member, e))
+            })?;
+            return Ok(vec![address]);
+        }
+        let document = match dids.resolve(member) {
+            Ok(document) => document,
+            Err(e @ (DidError::NotFound(_) | DidError::Deactivated(_))) => {
+                tracing::warn!("Ignoring {}: {}", kind, e);
+                return Ok(Vec::new());
+            }
+            Err(e) => {
+                return Err(NodeError::ConfigError(format!("Invalid {} {}: {}", kind, member, e)))
+            }
+        };
+        let Some(pin) = self.did_pins.get(member) else {
+            tracing::warn!("Ignoring {} {}: its document is not pinned", kind, member);
+            return Ok(Vec::new());
+        };
+        let pin = H256::from_hex(pin).map_err(|e| {
+            NodeError::ConfigError(format!("Invalid document pin of {}: {:?}", member, e))
+        })?;
+        if document.signing_hash() != pin {
+            tracing::warn!(
+                "Ignoring {} {}: document version {} doesn't match the pin",
+                kind,
+                member,
+                document.version
+            );
+            return Ok(Vec::new());
+        }
+        Ok(document.key_addrs().collect())
+    }
+
+    /// Returns how many recent blocks are warmed up on start.
+    pub fn warmup_blocks(&self) -> u64 {
+        self.warmup_blocks.unwrap_or(DEFAULT_WARMUP_BLOCKS)
+    }
+
+    /// Loads config from a TOML file without validating it (see `load`).
     pub fn from_file(path: &std::path::Path) -> Result<Self, NodeError> {
         let content = std::fs::read_to_string(path)?;
         toml::from_str(&content)
@@ -186,6 +681,188 @@ pub enum NodeState {
     ShuttingDown,
 }
 
+/// What a block's system contract calls change, worked out on copies of
+/// the node's registries before the block is stored.
+struct SystemCallEffects {
+    /// Chain config with the block's calls applied, if they made a version
+    chain_config: Option<ChainConfigContract>,
+    /// Revocation registry and the issuers whose lists were uploaded, if
+    /// the lists or the trusted issuers changed
+    revocations: Option<(RevocationRegistry, Vec<Address>)>,
+    /// DID registry and the DIDs registered, if any were
+    dids: Option<(DidRegistry, Vec<String>)>,
+    /// Multi-sign proposals and whether they changed
+    multi_sign: (MultiSign, bool),
+    /// Index declarations and drops of contracts
+    indexes: Vec<(Address, IndexChange)>,
+}
+
+/// Runs `block`'s calls to the system contract at `address` with `call`,
+/// failing the receipt of each call it rejects. Calls whose receipt
+/// already failed are skipped; blocks committed without receipts run every
+/// call.
+fn run_system_contract_calls(
+    block: &Block,
+    address: Address,
+    receipts: &mut [TransactionReceipt],
+    contract: &str,
+    mut call: impl FnMut(&Transaction) -> Result<(), String>,
+) {
+    for tx in block.transactions.iter().filter(|tx| tx.to == Some(address)) {
+        let hash = tx.hash();
+        let receipt = receipts
+            .iter_mut()
+            .find(|receipt| receipt.transaction_hash == *hash.as_bytes());
+        if receipt.as_ref().is_some_and(|receipt| !receipt.status) {
+            continue;
+        }
+        if let Err(e) = call(tx) {
+            tracing::debug!(tx = %hash, error = %e, "{} call rejected", contract);
+            if let Some(receipt) = receipt {
+                receipt.status = false;
+            }
+        }
+    }
+}
+
+/// Reads the DID documents recorded in storage into a registry.
+pub fn read_dids(storage: &Storage) -> Result<DidRegistry, NodeError> {
+    let mut registry = DidRegistry::new();
+    for (did, data) in storage.blocks.get_did_documents() {
+        let document = SignedDidDocument::decode(&data)
+            .map_err(|e| NodeError::ConfigError(e.to_string()))?;
+        registry
+            .restore(document)
+            .map_err(|e| NodeError::ConfigError(format!("DID document of {}: {}", did, e)))?;
+    }
+    Ok(registry)
+}
+
+/// Reads the equivocation evidence committed blocks recorded in storage
+/// into a registry.
+pub fn read_evidence(storage: &Storage) -> Result<EvidenceRegistry, NodeError> {
+    let mut registry = EvidenceRegistry::new();
+    for data in storage.blocks.get_evidence_records() {
+        let record = EvidenceRecord::decode(&data)
+            .map_err(|e| NodeError::ConfigError(format!("Evidence record: {:?}", e)))?;
+        registry.restore(record);
+    }
+    Ok(registry)
+}
+
+/// Reads the revocation lists committed blocks recorded in storage into a
+/// registry trusting `issuers`. Lists of issuers that are no longer
+/// trusted are kept but don't count.
+pub fn read_revocations(
+    storage: &Storage,
+    issuers: &[Address],
+) -> Result<RevocationRegistry, NodeError> {
+    let mut registry = RevocationRegistry::new(issuers.iter().copied());
+    for (issuer, data) in storage.blocks.get_revocation_lists() {
+        let entry = ActiveRevocationList::decode(&data)
+            .map_err(|e| NodeError::ConfigError(e.to_string()))?;
+        registry
+            .restore(entry)
+            .map_err(|e| NodeError::ConfigError(format!("Revocation list of {}: {}", issuer, e)))?;
+    }
+    Ok(registry)
+}
+
+/// Reads the multi-sign proposals committed blocks recorded in storage,
+/// voted on by `signers`.
+pub fn read_multi_sign(storage: &Storage, signers: &[Address]) -> Result<MultiSign, NodeError> {
+    let mut contract = MultiSign::with_signers(signers.iter().copied());
+    if let Some(data) = storage.blocks.get_multi_sign_proposals() {
+        contract
+            .restore(&data)
+            .map_err(|e| NodeError::ConfigError(format!("Multi-sign proposals: {}", e)))?;
+    }
+    Ok(contract)
+}
+
+/// Reads the secondary indexes contracts declared into a registry.
+pub fn read_indexes(storage: &Storage) -> Result<IndexRegistry, NodeError> {
+    let mut registry = IndexRegistry::new();
+    for (contract, name, data) in storage.state.get_index_specs() {
+        let spec = IndexSpec::decode(&data).map_err(|e| NodeError::ConfigError(e.to_string()))?;
+        registry
+            .declare(contract, spec)
+            .map_err(|e| NodeError::ConfigError(format!("Index {} of {}: {}", name, contract, e)))?;
+    }
+    Ok(registry)
+}
+
+/// Reads the chain config versions recorded in storage (None if none are).
+pub fn read_chain_config(storage: &Storage) -> Result<Option<ChainConfigContract>, NodeError> {
+    let history = storage.blocks.get_chain_config_history();
+    if history.is_empty() {
+        return Ok(None);
+    }
+    let versions = history
+        .iter()
+        .map(|(_, data)| ChainConfigVersion::decode(data))
+        .collect::<Result<Vec<_>, _>>()
+        .map_err(|e| NodeError::ConfigError(e.to_string()))?;
+    ChainConfigContract::from_versions(versions)
+        .map(Some)
+        .ok_or_else(|| NodeError::ConfigError("Chain config history lacks genesis".to_string()))
+}
+
+/// Applies the execution settings of `config` to the RPC server's EVM
+/// state, which executes transactions for the next block.
+fn configure_evm(state: &RpcState, config: &ChainConfig) {
+    let mut evm_state = state.evm_state.write().unwrap();
+    evm_state.set_org_isolation(config.org_isolation().map(Arc::new));
+    evm_state.set_org_members(Some(Arc::new(config.org_members())));
+    evm_state.set_storage_quota(config.storage_quota);
+    evm_state.set_feature_gates(Arc::new(config.feature_gates()));
+    evm_state.set_faucet(config.faucet_enabled.then(|| bach_evm::FaucetConfig {
+        amount: U256::from_u64(config.faucet_amount),
+        window_secs: config.faucet_window_secs,
+    }));
+}
+
+/// Warns about protocol features the config activates that this build
+/// doesn't implement; the node can't follow the chain past their
+/// activation.
+fn warn_unsupported_features(config: &ChainConfig) {
+    let unsupported = config
+        .feature_activations
+        .iter()
+        .filter(|a| !PROTOCOL_FEATURES.contains(&a.feature.as_str()));
+    for activation in unsupported {
+        tracing::warn!(
+            feature = %activation.feature,
+            height = activation.activation_height,
+            "Chain config activates a protocol feature this node does not support"
+        );
+    }
+}
+
+/// Translates the `proposal_*` and `empty_block_interval_ms` chain config
+/// parameters into proposal timer settings. Unknown strategies fall back to a fixed interval.
+pub fn proposal_timer_config(config: &ChainConfig) -> ProposalTimerConfig {
+    ProposalTimerConfig {
+        strategy: ProposalStrategy::from_name(&config.proposal_timer).unwrap_or_default(),
+        interval: Duration::from_millis(config.proposal_interval_ms),
+        min_interval: Duration::from_millis(config.proposal_min_interval_ms),
+        deep_pool: config.proposal_deep_pool as usize,
+        max_idle: Duration::from_millis(config.proposal_max_idle_ms),
+        empty_block_interval: (config.empty_block_interval_ms > 0)
+            .then(|| Duration::from_millis(config.empty_block_interval_ms)),
+    }
+}
+
+/// Translates the `nodes.<org>` chain config parameters into the network's
+/// static topology allowlist. Empty when the network discovers peers.
+pub fn static_peers(config: &ChainConfig) -> Vec<StaticPeer> {
+    config
+        .org_nodes()
+        .into_iter()
+        .map(|(org, node)| StaticPeer::new(org, PeerId::from_bytes(node.node_id), node.address))
+        .collect()
+}
+
 /// BachLedger full node
 pub struct BachNode {
     /// Node configuration
@@ -211,11 +888,84 @@ pub struct BachNode {
 
     /// Current block hash
     current_hash: H256,
+
+    /// Legacy hash of the current block if it is a hash migration
+    /// transition block
+    current_legacy_hash: Option<H256>,
+
+    /// Hook for changing the log filter at runtime
+    log_level: Option<LogLevelHandle>,
+
+    /// In-process message bus
+    msgbus: Arc<MsgBus>,
+
+    /// Persists finalized blocks
+    committer: BlockCommitter,
+
+    /// Time source shared with node components
+    clock: Arc<dyn Clock>,
+
+    /// Chain config versions (loaded on init)
+    chain_config: Option<ChainConfigContract>,
+
+    /// Revocation lists recorded by committed blocks (loaded on init)
+    revocations: RevocationRegistry,
+
+    /// Multi-sign proposals recorded by committed blocks (loaded on init)
+    multi_sign: MultiSign,
+
+    /// Equivocation evidence recorded by committed blocks (loaded on init)
+    evidence: EvidenceRegistry,
+
+    /// Member keys revoked at the next height, shared with the RPC server
+    revoked_keys: RevokedKeys,
+
+    /// Member keys our key status answers vouch for, shared with the RPC
+    /// server
+    known_keys: KnownKeys,
+
+    /// Online key status checks (built on init when configured)
+    revocation_checker: Option<Arc<RevocationChecker>>,
+
+    /// Block sync progress, served over the admin RPC and metrics
+    sync_progress: Arc<SyncProgress>,
+
+    /// Chain participation health, served on the health probes and metrics
+    health: Arc<NodeHealth>,
+
+    /// Sparse Merkle commitment over contract storage (built on init when
+    /// configured), shared with the RPC server
+    state_tree: Option<Arc<RwLock<SparseMerkleTree>>>,
+
+    /// Slows down our proposals while our blocks miss a quorum
+    proposal_backoff: Arc<ProposerBackoff>,
+
+    /// Side effects run after every committed block
+    commit_hooks: CommitHooks,
+
+    /// Generators of the system transactions closing each block
+    system_txs: SystemTxs,
+
+    /// Commands to the network service, told about allowlist changes
+    network_commands: Option<tokio::sync::mpsc::Sender<NetworkCommand>>,
 }
 
 impl BachNode {
     /// Creates a new node with the given configuration.
     pub fn new(config: NodeConfig) -> Self {
+        let msgbus = Arc::new(MsgBus::default());
+        let clock: Arc<dyn Clock> = Arc::new(SystemClock);
+        let committer = BlockCommitter::with_clock(Arc::clone(&msgbus), Arc::clone(&clock));
+        let sync_progress = Arc::new(SyncProgress::new());
+        let health = Arc::new(NodeHealth::new(Arc::clone(&sync_progress)));
+        let proposal_backoff = Arc::new(ProposerBackoff::new(
+            config.proposal_backoff_after.unwrap_or(DEFAULT_BACKOFF_AFTER),
+            config.proposal_backoff_max.unwrap_or(DEFAULT_MAX_BACKOFF),
+        ));
+        let mut system_txs = SystemTxs::new();
+        if config.gas_settlement {
+            system_txs.register(Arc::new(GasSettlement));
+        }
         Self {
             config,
             state: NodeState::Stopped,
@@ -225,9 +975,60 @@ impl BachNode {
             validator_address: None,
             current_height: 0,
             current_hash: H256::zero(),
+            current_legacy_hash: None,
+            log_level: None,
+            msgbus,
+            committer,
+            clock,
+            chain_config: None,
+            revocations: RevocationRegistry::default(),
+            multi_sign: MultiSign::default(),
+            evidence: EvidenceRegistry::new(),
+            revoked_keys: RevokedKeys::default(),
+            known_keys: KnownKeys::default(),
+            revocation_checker: None,
+            sync_progress,
+            health,
+            state_tree: None,
+            proposal_backoff,
+            commit_hooks: CommitHooks::new(),
+            system_txs,
+            network_commands: None,
         }
     }
 
+    /// Replaces the time source. Must be called before `start`.
+    pub fn set_clock(&mut self, clock: Arc<dyn Clock>) {
+        self.committer = BlockCommitter::with_clock(Arc::clone(&self.msgbus), Arc::clone(&clock));
+        self.health = Arc::new(
+            NodeHealth::new(Arc::clone(&self.sync_progress)).with_clock(Arc::clone(&clock)),
+        );
+        self.clock = clock;
+    }
+
+    /// Returns the root of the state commitment over contract storage, if
+    /// the node maintains one.
+    pub fn state_commitment(&self) -> Option<H256> {
+        let tree = self.state_tree.as_ref()?;
+        let root = tree.read().unwrap().root();
+        Some(root)
+    }
+
+    /// Returns the node's time source.
+    pub fn clock(&self) -> &Arc<dyn Clock> {
+        &self.clock
+    }
+
+    /// Sets the hook used to change the log filter through the admin RPC.
+    pub fn set_log_level_handle(&mut self, handle: LogLevelHandle) {
+        self.log_level = Some(handle);
+    }
+
+    /// Returns the message bus shared by node components.
+    pub fn msgbus(&self) -> &Arc<MsgBus> {
+        &self.msgbus
+    }
+
     /// Returns the current node state.
     pub fn state(&self) -> NodeState {
         self.state
@@ -248,6 +1049,829 @@ impl BachNode {
         self.current_hash
     }
 
+    /// Returns the digests of the current block; a transition block also
+    /// has its legacy hash.
+    pub fn head_digests(&self) -> BlockDigests {
+        BlockDigests {
+            hash: self.current_hash,
+            legacy_hash: self.current_legacy_hash,
+        }
+    }
+
+    /// Returns the block sync progress shared with the RPC server.
+    pub fn sync_progress(&self) -> &Arc<SyncProgress> {
+        &self.sync_progress
+    }
+
+    /// Returns the node's health shared with the RPC server. Consensus
+    /// reports heights it gave up on without a quorum here.
+    pub fn health(&self) -> &Arc<NodeHealth> {
+        &self.health
+    }
+
+    /// Returns the commit hooks. Hooks registered before `start` also see
+    /// the blocks the outbox replays.
+    pub fn commit_hooks(&self) -> &CommitHooks {
+        &self.commit_hooks
+    }
+
+    /// Returns a source serving this node's blocks to a syncing peer
+    /// (None before `init`).
+    pub fn sync_source(&self, name: impl Into<String>) -> Option<StorageSource> {
+        let storage = self.storage.clone()?;
+        Some(StorageSource::new(
+            name,
+            storage,
+            self.hash_schedule_at(self.current_height),
+        ))
+    }
+
+    /// Returns the block hash schedule in force at `height` (Keccak-256
+    /// everywhere before `init`).
+    pub fn hash_schedule_at(&self, height: u64) -> HashSchedule {
+        self.chain_config
+            .as_ref()
+            .map(|chain_config| chain_config.config_at(height).config.hash_schedule())
+            .unwrap_or_default()
+    }
+
+    /// Returns the digests of `block` under the chain's hash schedule.
+    pub fn block_digests(&self, block: &Block) -> BlockDigests {
+        block.digests(&self.hash_schedule_at(block.height))
+    }
+
+    /// Returns the chain config versions (None before `init`).
+    pub fn chain_config(&self) -> Option<&ChainConfigContract> {
+        self.chain_config.as_ref()
+    }
+
+    /// Evaluates the endorsement policy guarding `resource` for a call in
+    /// the next block, as if `members` (addresses or DIDs) had endorsed it.
+    /// The owning org of an `acl.<contract>` or `pause.<contract>` resource
+    /// is the org of the contract's installer.
+    pub fn simulate_endorsement(
+        &self,
+        resource: &str,
+        members: &[String],
+    ) -> Result<PolicyEvaluation, NodeError> {
+        let dids = self.dids()?;
+        let mut endorsers = Vec::new();
+        for member in members {
+            endorsers.extend(self.config.resolve_member(member, &dids, "endorser")?);
+        }
+        let chain_config = self.chain_config.as_ref().ok_or(NodeError::NotRunning)?;
+        let height = self.current_height + 1;
+        let installer = [ACL_RESOURCE_PREFIX, PAUSE_RESOURCE_PREFIX]
+            .iter()
+            .find_map(|prefix| resource.strip_prefix(prefix))
+            .and_then(|contract| Address::from_hex(contract).ok())
+            .zip(self.rpc_state.as_ref())
+            .and_then(|(contract, state)| {
+                state.evm_state.read().unwrap().installer_of(&contract).copied()
+            });
+        let config = &chain_config.config_at(height).config;
+        let owner = installer.and_then(|installer| config.org_of(&installer));
+        chain_config
+            .simulate_endorsement(resource, owner, &endorsers, height)
+            .map_err(|e| NodeError::Rejected(e.to_string()))
+    }
+
+    /// Returns the proposal timer for the next block, as selected by chain
+    /// config and slowed down by proposal backoff.
+    pub fn proposal_timer(&self) -> Result<Box<dyn ProposalTimer>, NodeError> {
+        let chain_config = self.chain_config.as_ref().ok_or(NodeError::NotRunning)?;
+        let version = chain_config.config_at(self.current_height + 1);
+        let timer = proposal_timer_config(&version.config).build();
+        Ok(Box::new(BackoffTimer::new(timer, Arc::clone(&self.proposal_backoff))))
+    }
+
+    /// Returns the validator checking proposed block timestamps against
+    /// our clock, with the drift allowed by chain config.
+    pub fn timestamp_validator(&self) -> Result<TimestampValidator, NodeError> {
+        Ok(TimestampValidator::new(Arc::clone(&self.clock), self.max_clock_drift()?))
+    }
+
+    /// Returns how far the next block's timestamp may be ahead of our clock.
+    /// The drift can change with chain config, so callers holding a
+    /// timestamp validator re-read it every height.
+    pub fn max_clock_drift(&self) -> Result<Duration, NodeError> {
+        let chain_config = self.chain_config.as_ref().ok_or(NodeError::NotRunning)?;
+        let version = chain_config.config_at(self.current_height + 1);
+        Ok(Duration::from_secs(version.config.max_clock_drift_secs))
+    }
+
+    /// Returns how many transactions from one sender the next block may
+    /// hold, 0 if chain config sets no cap.
+    pub fn max_txs_per_sender(&self) -> Result<u64, NodeError> {
+        let chain_config = self.chain_config.as_ref().ok_or(NodeError::NotRunning)?;
+        Ok(chain_config.config_at(self.current_height + 1).config.max_txs_per_sender)
+    }
+
+    /// Returns the most gas the transactions of the next block may declare
+    /// in total, from chain config.
+    pub fn block_gas_limit(&self) -> Result<u64, NodeError> {
+        let chain_config = self.chain_config.as_ref().ok_or(NodeError::NotRunning)?;
+        Ok(chain_config.config_at(self.current_height + 1).config.block_gas_limit)
+    }
+
+    /// Returns the signature schemes transactions of the next block may be
+    /// signed with, from chain config.
+    pub fn signature_schemes(&self) -> Result<Vec<SignatureScheme>, NodeError> {
+        let chain_config = self.chain_config.as_ref().ok_or(NodeError::NotRunning)?;
+        Ok(chain_config.config_at(self.current_height + 1).config.signature_schemes())
+    }
+
+    /// Returns the member keys revoked at the next height, whose
+    /// transactions proposals may not hold.
+    pub fn revoked_senders(&self) -> BTreeSet<Address> {
+        self.revocations.revoked(self.current_height + 1)
+    }
+
+    /// Returns true if the transaction was committed in an earlier block.
+    pub fn is_tx_committed(&self, hash: &H256) -> bool {
+        self.active_storage()
+            .is_some_and(|storage| storage.transactions.is_committed(hash))
+    }
+
+    /// Checks a signed transaction before it enters the pool and returns
+    /// its sender. Transactions already committed, signed with a scheme the
+    /// next block's chain config doesn't allow, whose sender can't be
+    /// recovered or whose sender's key is revoked are rejected; proposals
+    /// holding them fail verification.
+    pub fn check_admission(&self, tx: &Transaction) -> Result<Address, NodeError> {
+        if self.is_tx_committed(&tx.hash()) {
+            return Err(NodeError::DuplicateTx(tx.hash()));
+        }
+        let scheme = tx.signature.scheme();
+        if !self.signature_schemes()?.contains(&scheme) {
+            return Err(NodeError::Rejected(format!(
+                "transaction {:?} is signed with {}, which the chain config doesn't allow",
+                tx.hash(),
+                scheme
+            )));
+        }
+        if self.system_txs.is_system_tx(tx) {
+            return Err(NodeError::Rejected(format!(
+                "transaction {:?} calls an address reserved for system transactions",
+                tx.hash()
+            )));
+        }
+        let sender = tx.sender().map_err(|_| {
+            NodeError::Rejected(format!("transaction {:?} has an invalid signature", tx.hash()))
+        })?;
+        if self.revoked_keys.contains(&sender) {
+            return Err(NodeError::Rejected(format!(
+                "transaction {:?} is signed by revoked key {}",
+                tx.hash(),
+                sender
+            )));
+        }
+        Ok(sender)
+    }
+
+    /// Checks transaction bodies fetched over gossip with `check_admission`.
+    /// Returns the admitted ones, to pool and announce with
+    /// `NetworkService::announce_transaction`, and the refused ones with
+    /// the reason, to pass to `NetworkService::reject_transaction`.
+    pub fn admit_gossiped_txs(
+        &self,
+        txs: Vec<SerializableTransaction>,
+    ) -> (Vec<SerializableTransaction>, Vec<(H256, NodeError)>) {
+        let mut admitted = Vec::new();
+        let mut refused = Vec::new();
+        for wire in txs {
+            let checked = wire
+                .to_transaction()
+                .map_err(|e| NodeError::Rejected(format!("undecodable signature: {:?}", e)))
+                .and_then(|tx| self.check_admission(&tx));
+            match checked {
+                Ok(_) => admitted.push(wire),
+                Err(e) => refused.push((wire.hash(), e)),
+            }
+        }
+        (admitted, refused)
+    }
+
+    /// Returns the generators of the system transactions closing each
+    /// block, for the consensus driver to append and verify.
+    pub fn system_txs(&self) -> &SystemTxs {
+        &self.system_txs
+    }
+
+    /// Registers a system transaction generator after the configured ones.
+    pub fn register_system_tx_generator(&mut self, generator: Arc<dyn SystemTxGenerator>) {
+        self.system_txs.register(generator);
+    }
+
+    /// Drops pooled transactions calling a reserved address from
+    /// `transactions` and appends the system transactions of the block at
+    /// `height`, signed with the validator key. Returns how many were
+    /// appended.
+    pub fn append_system_txs(
+        &self,
+        height: u64,
+        parent_hash: &H256,
+        transactions: &mut Vec<Transaction>,
+    ) -> Result<usize, NodeError> {
+        if self.system_txs.is_empty() {
+            return Ok(0);
+        }
+        let key = self.node_key()?.ok_or_else(|| {
+            NodeError::ConfigError("system transactions need a validator key".to_string())
+        })?;
+        transactions.retain(|tx| !self.system_txs.is_system_tx(tx));
+        let user_txs = transactions.len();
+        self.system_txs.append(height, parent_hash, transactions, &key);
+        Ok(transactions.len() - user_txs)
+    }
+
+    /// Returns the governor slowing down our proposals.
+    pub fn proposal_backoff(&self) -> &ProposerBackoff {
+        &self.proposal_backoff
+    }
+
+    /// Records that a block we proposed failed to gather a signature
+    /// quorum.
+    pub fn record_proposal_failure(&self) {
+        let backing_off = self.proposal_backoff.is_backing_off();
+        let factor = self.proposal_backoff.record_failure();
+        self.health.set_proposal_backoff(factor.into());
+        if factor > 1 && !backing_off {
+            tracing::warn!(
+                failures = self.proposal_backoff.failures(),
+                factor,
+                "Own blocks keep missing a signature quorum, slowing down proposals"
+            );
+        }
+    }
+
+    /// Records that consensus gave up on the next height without a
+    /// signature quorum, which degrades the node's health after a few
+    /// heights in a row.
+    pub fn record_quorum_failure(&self) {
+        self.health.record_quorum_failure();
+        tracing::warn!(
+            height = self.current_height + 1,
+            failures = self.health.quorum_failures(),
+            "Height ended without a signature quorum"
+        );
+    }
+
+    /// Publishes a `TxRequeued` event for each pooled transaction deferred
+    /// to a later block and counts them in the node's health.
+    pub fn record_tx_requeues(&self, requeues: Vec<TxRequeue>) {
+        self.health.record_requeued_txs(requeues.len() as u64);
+        for requeue in requeues {
+            self.msgbus.publish(Message::TxRequeued(Arc::new(requeue)));
+        }
+    }
+
+    /// Records that a block we proposed was committed, restoring the full
+    /// proposal rate.
+    pub fn record_proposal_commit(&self) {
+        if self.proposal_backoff.is_backing_off() {
+            tracing::info!("Own block committed, proposing at full rate again");
+        }
+        self.proposal_backoff.record_commit();
+        self.health.set_proposal_backoff(1);
+    }
+
+    /// Runs the chain config calls among `block`'s transactions on a copy
+    /// of the chain config, effective from the next block, failing the
+    /// receipts of the calls the contract rejects. Returns the copy if the
+    /// calls produced a version. Every node runs the same calls against the
+    /// same versions, so a rejected call is skipped on all of them.
+    fn run_config_transactions(
+        &self,
+        block: &Block,
+        receipts: &mut [TransactionReceipt],
+    ) -> Result<Option<ChainConfigContract>, NodeError> {
+        let address = chain_config_address();
+        if !block.transactions.iter().any(|tx| tx.to == Some(address)) {
+            return Ok(None);
+        }
+        let height = block.height + 1;
+        let mut chain_config = self.chain_config.clone().ok_or(NodeError::NotRunning)?;
+        let before = chain_config.current().version;
+        run_system_contract_calls(block, address, receipts, "Chain config", |tx| {
+            let sender = tx.sender().map_err(|_| "unrecoverable sender".to_string())?;
+            chain_config.execute(&tx.data, sender, height).map_err(|e| e.to_string())?;
+            Ok(())
+        });
+        Ok((chain_config.current().version != before).then_some(chain_config))
+    }
+
+    /// Makes `chain_config` the node's chain config and records its
+    /// current version, which takes effect at `height`.
+    fn record_chain_config(
+        &mut self,
+        height: u64,
+        chain_config: ChainConfigContract,
+    ) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+        let nodes_before = self
+            .chain_config
+            .as_ref()
+            .map(|before| before.current().config.nodes.clone());
+        let version = chain_config.current().clone();
+        self.chain_config = Some(chain_config);
+        if let Some(state) = &self.rpc_state {
+            configure_evm(state, &version.config);
+        }
+        tracing::info!(version = version.version, height, "Chain config updated");
+        warn_unsupported_features(&version.config);
+        if nodes_before.as_ref() != Some(&version.config.nodes) {
+            self.send_allowlist(static_peers(&version.config));
+        }
+
+        storage.blocks.put_chain_config(height, &version.encode())?;
+        storage.state.set_storage_quota(version.config.storage_quota)?;
+        Ok(())
+    }
+
+    /// Connects the node to a running network service: the static topology
+    /// allowlist is set from chain config now and follows its updates.
+    pub fn attach_network(&mut self, commands: tokio::sync::mpsc::Sender<NetworkCommand>) {
+        self.network_commands = Some(commands);
+        if let Some(chain_config) = &self.chain_config {
+            let peers = static_peers(&chain_config.current().config);
+            if !peers.is_empty() {
+                self.send_allowlist(peers);
+            }
+        }
+    }
+
+    /// Hands a new allowlist to the attached network service, if any.
+    fn send_allowlist(&self, peers: Vec<StaticPeer>) {
+        let Some(commands) = &self.network_commands else {
+            return;
+        };
+        let count = peers.len();
+        if let Err(e) = commands.try_send(NetworkCommand::UpdateAllowlist(peers)) {
+            tracing::warn!(peers = count, error = %e, "Failed to update network allowlist");
+        }
+    }
+
+    /// Runs the revocation registry calls among `block`'s transactions on
+    /// a copy of the registry, with lists taking effect from the next
+    /// block. Issuers are trusted as `chain_config` sets them for the next
+    /// block. Returns the copy and the issuers whose lists were uploaded,
+    /// or None if neither the lists nor the issuers changed. An upload the
+    /// registry rejects, from an untrusted issuer, with a bad signature or
+    /// replaying an older list, fails its receipt and is skipped on every
+    /// node, like rejected evidence.
+    fn run_revocation_transactions(
+        &self,
+        block: &Block,
+        chain_config: &ChainConfigContract,
+        receipts: &mut [TransactionReceipt],
+    ) -> Option<(RevocationRegistry, Vec<Address>)> {
+        let height = block.height + 1;
+        let address = revocation_registry_address();
+        let issuers = chain_config.config_at(height).config.revocation_issuers();
+        let issuers_changed = !self.revocations.issuers().eq(issuers.iter());
+        if !issuers_changed && !block.transactions.iter().any(|tx| tx.to == Some(address)) {
+            return None;
+        }
+
+        let mut registry = self.revocations.clone();
+        registry.set_issuers(issuers);
+        let mut uploaded = Vec::new();
+        run_system_contract_calls(block, address, receipts, "Revocation registry", |tx| {
+            let result = registry.execute(&tx.data, height).map_err(|e| e.to_string())?;
+            if tx.data.first() == Some(&REVOCATION_UPLOAD) {
+                uploaded.extend(Address::from_slice(&result).ok());
+            }
+            Ok(())
+        });
+        (issuers_changed || !uploaded.is_empty()).then_some((registry, uploaded))
+    }
+
+    /// Makes `registry` the node's revocation registry at `height` and
+    /// records the lists of the `uploaded` issuers.
+    fn record_revocations(
+        &mut self,
+        height: u64,
+        (registry, uploaded): (RevocationRegistry, Vec<Address>),
+    ) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+        self.revoked_keys.replace(registry.revoked(height));
+        if let Some(checker) = &self.revocation_checker {
+            checker.clear_cache();
+        }
+        self.revocations = registry;
+
+        for issuer in uploaded {
+            if let Some((_, entry)) = self.revocations.lists().find(|(i, _)| **i == issuer) {
+                storage.blocks.put_revocation_list(&issuer, &entry.encode())?;
+                tracing::info!(%issuer, height, "Revocation list updated");
+            }
+        }
+        Ok(())
+    }
+
+    /// Runs the multi-sign calls among `block`'s transactions on a copy of
+    /// the proposals, with the signers `chain_config` sets for the next
+    /// block, then expires the proposals past their deadline at that
+    /// height. Returns the copy and whether its proposals changed. A call
+    /// the contract rejects, such as a vote from a non-signer or on an
+    /// expired or decided proposal, fails its receipt and is skipped on
+    /// every node.
+    fn run_multi_sign_transactions(
+        &self,
+        block: &Block,
+        chain_config: &ChainConfigContract,
+        receipts: &mut [TransactionReceipt],
+    ) -> (MultiSign, bool) {
+        let height = block.height + 1;
+        let mut multi_sign = self.multi_sign.clone();
+        multi_sign.set_signers(chain_config.config_at(height).config.multi_sign_signers());
+        let before = multi_sign.encode();
+
+        run_system_contract_calls(block, multi_sign_address(), receipts, "Multi-sign", |tx| {
+            let sender = tx.sender().map_err(|_| "unrecoverable sender".to_string())?;
+            multi_sign.execute(&tx.data, sender, height).map_err(|e| e.to_string())?;
+            Ok(())
+        });
+        for id in multi_sign.expire(height) {
+            tracing::info!(id, height, "Multi-sign proposal expired");
+        }
+
+        let changed = multi_sign.encode() != before;
+        (multi_sign, changed)
+    }
+
+    /// Makes `multi_sign` the node's proposals, recording them if changed.
+    fn record_multi_sign(
+        &mut self,
+        (multi_sign, changed): (MultiSign, bool),
+    ) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+        self.multi_sign = multi_sign;
+        if changed {
+            storage.blocks.put_multi_sign_proposals(&self.multi_sign.encode())?;
+        }
+        Ok(())
+    }
+
+    /// Returns the multi-sign proposals recorded by committed blocks.
+    pub fn multi_sign(&self) -> &MultiSign {
+        &self.multi_sign
+    }
+
+    /// Runs the evidence registry calls among `block`'s successful
+    /// transactions on a copy of the registry, verifying them against the
+    /// configured validator set, and returns it with `receipts` updated:
+    /// recorded evidence adds an `EvidenceRecorded` log, rejected evidence
+    /// fails the receipt. None if the block makes no evidence calls or no
+    /// validator set is configured to check them against.
+    fn run_evidence_transactions(
+        &self,
+        block: &Block,
+        receipts: &mut [TransactionReceipt],
+    ) -> Option<EvidenceRegistry> {
+        let address = evidence_registry_address();
+        if !block.transactions.iter().any(|tx| tx.to == Some(address)) {
+            return None;
+        }
+        let Some(validator_set) = &self.config.validator_set else {
+            tracing::warn!(height = block.height, "No validator set to check evidence against");
+            return None;
+        };
+
+        let mut registry = self.evidence.clone();
+        for tx in block.transactions.iter().filter(|tx| tx.to == Some(address)) {
+            let hash = tx.hash();
+            let Some(receipt) = receipts
+                .iter_mut()
+                .find(|receipt| receipt.transaction_hash == *hash.as_bytes() && receipt.status)
+            else {
+                continue;
+            };
+            let Ok(submitter) = tx.sender() else {
+                continue;
+            };
+            match registry.submit(submitter, &tx.data, validator_set, block.height) {
+                Ok(event) => receipt.logs.push(Log {
+                    address: *address.as_bytes(),
+                    topics: event.log_topics().iter().map(|topic| *topic.as_bytes()).collect(),
+                    data: event.log_data(),
+                    block_number: block.height,
+                    transaction_hash: *hash.as_bytes(),
+                    transaction_index: receipt.transaction_index,
+                    log_index: 0,
+                }),
+                Err(e) => {
+                    tracing::debug!(tx = %hash, error = ?e, "Evidence rejected");
+                    receipt.status = false;
+                }
+            }
+        }
+        registry.take_events();
+        let logs = receipts.iter_mut().flat_map(|receipt| receipt.logs.iter_mut());
+        for (index, log) in logs.enumerate() {
+            log.log_index = index as u32;
+        }
+        Some(registry)
+    }
+
+    /// Records the evidence `registry` holds beyond the committed entries
+    /// and makes it the node's registry.
+    fn record_evidence(&mut self, registry: EvidenceRegistry) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?;
+        for record in registry.records() {
+            let hash = record.evidence.hash();
+            if self.evidence.get(&hash).is_some() {
+                continue;
+            }
+            storage.blocks.put_evidence_record(&hash, &record.encode())?;
+            tracing::warn!(
+                validator = %record.evidence.validator,
+                height = record.evidence.height,
+                kind = ?record.evidence.kind,
+                "Equivocation evidence recorded"
+            );
+        }
+        self.evidence = registry;
+        Ok(())
+    }
+
+    /// Returns the equivocation evidence recorded by committed blocks.
+    pub fn evidence(&self) -> &EvidenceRegistry {
+        &self.evidence
+    }
+
+    /// Returns the penalties in force at `height`: validators with more
+    /// active evidence records than chain config's `max_evidence` are
+    /// excluded. A consensus driver passes them to `set_penalties` before
+    /// deciding the height.
+    pub fn penalties_at(&self, height: u64) -> Result<Vec<(Address, Penalty)>, NodeError> {
+        let chain_config = self.chain_config.as_ref().ok_or(NodeError::NotRunning)?;
+        let max_evidence = chain_config.config_at(height).config.max_evidence;
+        let hook = ThresholdPenaltyHook {
+            max_evidence: usize::try_from(max_evidence).unwrap_or(usize::MAX),
+        };
+        Ok(self.evidence.penalties(&hook, height))
+    }
+
+    /// Builds the transaction submitting `evidence` to the evidence
+    /// registry, signed with the validator key.
+    pub fn evidence_transaction(
+        &self,
+        evidence: &Evidence,
+        nonce: u64,
+    ) -> Result<Transaction, NodeError> {
+        let key = self
+            .node_key()?
+            .ok_or_else(|| NodeError::ConfigError("Evidence is signed by validators".to_string()))?;
+        let to = Some(evidence_registry_address());
+        let mut tx =
+            Transaction::new(nonce, to, U256::ZERO, evidence.encode(), key.sign(&H256::zero()));
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        Ok(tx)
+    }
+
+    /// Returns the revoked member keys, shared with the RPC server.
+    pub fn revoked_keys(&self) -> &RevokedKeys {
+        &self.revoked_keys
+    }
+
+    /// Returns the member keys our key status answers vouch for: RPC
+    /// members and the keys of active DID documents.
+    pub fn known_keys(&self) -> &KnownKeys {
+        &self.known_keys
+    }
+
+    fn refresh_known_keys(&self, dids: &DidRegistry) -> Result<(), NodeError> {
+        let mut known: HashSet<Address> = dids
+            .documents()
+            .filter(|signed| !signed.document.deactivated)
+            .flat_map(|signed| signed.document.key_addrs())
+            .collect();
+        if let Some(token_auth) = self.config.token_auth_config(dids)? {
+            known.extend(token_auth.members);
+        }
+        self.known_keys.replace(known);
+        Ok(())
+    }
+
+    /// Returns the validator key, which also authenticates our key status
+    /// queries and signs our answers.
+    fn node_key(&self) -> Result<Option<PrivateKey>, NodeError> {
+        self.config
+            .validator_key
+            .as_ref()
+            .map(|bytes| {
+                PrivateKey::from_bytes(bytes)
+                    .map_err(|_| NodeError::ConfigError("Invalid validator key".to_string()))
+            })
+            .transpose()
+    }
+
+    /// Returns the revocation lists recorded by committed blocks.
+    pub fn revocations(&self) -> &RevocationRegistry {
+        &self.revocations
+    }
+
+    /// Returns the DID documents currently recorded in storage.
+    pub fn dids(&self) -> Result<DidRegistry, NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?;
+        read_dids(storage)
+    }
+
+    /// Runs the DID registry calls among `block`'s transactions on the
+    /// recorded documents, creating, updating or deactivating DIDs.
+    /// Returns the registry and the DIDs the calls registered, or None if
+    /// the block registers none. Like revocation registry calls, a call the
+    /// registry rejects is skipped on every node.
+    fn run_did_transactions(
+        &self,
+        block: &Block,
+        receipts: &mut [TransactionReceipt],
+    ) -> Result<Option<(DidRegistry, Vec<String>)>, NodeError> {
+        let address = did_registry_address();
+        let registers =
+            |tx: &Transaction| tx.to == Some(address) && tx.data.first() == Some(&DID_REGISTER);
+        if !block.transactions.iter().any(registers) {
+            return Ok(None);
+        }
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?;
+        let mut registry = read_dids(storage)?;
+        let mut registered = Vec::new();
+        run_system_contract_calls(block, address, receipts, "DID registry", |tx| {
+            if !registers(tx) {
+                return Ok(());
+            }
+            let did = registry.execute(&tx.data).map_err(|e| e.to_string())?;
+            let did = String::from_utf8_lossy(&did).into_owned();
+            for log in registry.take_logs() {
+                if let Some(event) = DidEvent::from_log(&log) {
+                    tracing::info!(%did, event = event.signature(), "DID document changed");
+                }
+            }
+            registered.push(did);
+            Ok(())
+        });
+        Ok(Some((registry, registered)))
+    }
+
+    /// Records the documents of the `registered` DIDs. Members configured
+    /// by a DID pick up its new keys on the next start.
+    fn record_dids(
+        &mut self,
+        (registry, registered): (DidRegistry, Vec<String>),
+    ) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+        let refreshed = self.refresh_known_keys(&registry);
+        for did in registered {
+            if let Some(signed) = registry.documents().find(|signed| signed.document.id == did) {
+                storage.blocks.put_did_document(&did, &signed.encode())?;
+            }
+        }
+        refreshed
+    }
+
+    /// Returns the secondary indexes contracts declared.
+    pub fn indexes(&self) -> Result<IndexRegistry, NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?;
+        read_indexes(storage)
+    }
+
+    /// Runs the index registry calls contracts made in the successful
+    /// transactions of `receipts` and records the indexes they declare or
+    /// drop.
+    pub(crate) fn apply_index_calls(
+        &mut self,
+        receipts: &[TransactionReceipt],
+    ) -> Result<(), NodeError> {
+        let changes = self.run_index_calls(receipts)?;
+        self.record_index_changes(changes)
+    }
+
+    /// Runs the index registry calls contracts made in the successful
+    /// transactions of `receipts`, declaring or dropping their indexes. The
+    /// EVM records each call as a log naming the calling contract, so an
+    /// index always belongs to the contract that called. A declared index
+    /// covers writes committed from then on; a dropped one is removed with
+    /// its entries. Like chain config calls, a call the registry rejects is
+    /// skipped on every node.
+    fn run_index_calls(
+        &self,
+        receipts: &[TransactionReceipt],
+    ) -> Result<Vec<(Address, IndexChange)>, NodeError> {
+        let calls: Vec<(Address, Vec<u8>)> = receipts
+            .iter()
+            .filter(|receipt| receipt.status)
+            .flat_map(|receipt| &receipt.logs)
+            .filter_map(|log| {
+                let log = bach_evm::Log {
+                    address: Address::from(log.address),
+                    topics: log.topics.iter().copied().map(H256::from).collect(),
+                    data: log.data.clone(),
+                };
+                decode_index_call(&log).map(|(contract, data)| (contract, data.to_vec()))
+            })
+            .collect();
+        if calls.is_empty() {
+            return Ok(Vec::new());
+        }
+
+        let mut registry = self.indexes()?;
+        let mut changes = Vec::new();
+        for (contract, data) in calls {
+            match registry.execute(contract, &data) {
+                Ok(change) => changes.push((contract, change)),
+                Err(e) => {
+                    tracing::debug!(%contract, error = %e, "Index registry call rejected");
+                }
+            }
+        }
+        Ok(changes)
+    }
+
+    /// Records the index declarations and drops of committed calls.
+    fn record_index_changes(
+        &mut self,
+        changes: Vec<(Address, IndexChange)>,
+    ) -> Result<(), NodeError> {
+        if changes.is_empty() {
+            return Ok(());
+        }
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+        for (contract, change) in changes {
+            match change {
+                IndexChange::Declared(spec) => {
+                    storage.state.put_index_spec(&contract, &spec.name, &spec.encode())?;
+                    tracing::info!(%contract, index = %spec.name, "Index declared");
+                }
+                IndexChange::Dropped(name) => {
+                    storage.state.delete_index(&contract, &name)?;
+                    tracing::info!(%contract, index = %name, "Index dropped");
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Runs `block`'s system contract calls against copies of the node's
+    /// registries, failing the receipts of the calls they reject. Nothing
+    /// is recorded until `record_system_calls`, so a failure here leaves
+    /// the node as it was.
+    fn run_system_calls(
+        &self,
+        block: &Block,
+        receipts: &mut [TransactionReceipt],
+    ) -> Result<SystemCallEffects, NodeError> {
+        let chain_config = self.run_config_transactions(block, receipts)?;
+        let next_config = chain_config
+            .as_ref()
+            .or(self.chain_config.as_ref())
+            .ok_or(NodeError::NotRunning)?;
+        let revocations = self.run_revocation_transactions(block, next_config, receipts);
+        let multi_sign = self.run_multi_sign_transactions(block, next_config, receipts);
+        let dids = self.run_did_transactions(block, receipts)?;
+        let indexes = self.run_index_calls(receipts)?;
+        Ok(SystemCallEffects {
+            chain_config,
+            revocations,
+            dids,
+            multi_sign,
+            indexes,
+        })
+    }
+
+    /// Makes what a committed block's system contract calls changed the
+    /// node's state and records it, effective from `height`. Every step
+    /// runs even if an earlier one fails to write; the first error is
+    /// returned.
+    fn record_system_calls(
+        &mut self,
+        height: u64,
+        effects: SystemCallEffects,
+    ) -> Result<(), NodeError> {
+        let SystemCallEffects {
+            chain_config,
+            revocations,
+            dids,
+            multi_sign,
+            indexes,
+        } = effects;
+        let results = [
+            chain_config.map_or(Ok(()), |config| self.record_chain_config(height, config)),
+            revocations.map_or(Ok(()), |revocations| self.record_revocations(height, revocations)),
+            dids.map_or(Ok(()), |dids| self.record_dids(dids)),
+            self.record_multi_sign(multi_sign),
+            self.record_index_changes(indexes),
+        ];
+        results.into_iter().collect()
+    }
+
+    /// Returns the online key status checker, for the network service and
+    /// RPC server. None unless `key_status` is configured.
+    pub fn revocation_checker(&self) -> Option<&Arc<RevocationChecker>> {
+        self.revocation_checker.as_ref()
+    }
+
     /// Returns the validator address if this node is a validator.
     pub fn validator_address(&self) -> Option<&Address> {
         self.validator_address.as_ref()
@@ -264,20 +1888,97 @@ impl BachNode {
             return Err(NodeError::AlreadyRunning);
         }
 
-        self.state = NodeState::Starting;
-
         // Create data directory if needed
         std::fs::create_dir_all(&self.config.data_dir)?;
 
         // Open storage
         let storage = Storage::open(&self.config.data_dir)?;
+        self.init_with_storage(storage)
+    }
+
+    /// Initializes the node on already opened storage instead of the data
+    /// directory (e.g. `Storage::temporary` in tests).
+    pub fn init_with_storage(&mut self, storage: Storage) -> Result<(), NodeError> {
+        if self.state != NodeState::Stopped {
+            return Err(NodeError::AlreadyRunning);
+        }
+        self.config.retention.validate()?;
+
+        self.state = NodeState::Starting;
 
         // Load current chain state
         self.current_height = storage.blocks.get_block_height();
+
+        let chain_config = match read_chain_config(&storage)? {
+            Some(chain_config) => chain_config,
+            None => {
+                let mut genesis = ChainConfig {
+                    storage_quota: storage.state.storage_quota(),
+                    ..Default::default()
+                };
+                for (name, value) in &self.config.genesis_chain_config {
+                    genesis
+                        .set(name, value)
+                        .map_err(|e| NodeError::ConfigError(e.to_string()))?;
+                }
+                genesis
+                    .validate()
+                    .map_err(|e| NodeError::ConfigError(e.to_string()))?;
+                storage.state.set_storage_quota(genesis.storage_quota)?;
+                let chain_config = ChainConfigContract::new(genesis);
+                storage
+                    .blocks
+                    .put_chain_config(0, &chain_config.current().encode())?;
+                chain_config
+            }
+        };
         if let Some(block) = storage.blocks.get_latest_block() {
-            self.current_hash = block.hash();
+            let schedule = chain_config.config_at(block.height).config.hash_schedule();
+            let digests = block.digests(&schedule);
+            self.current_hash = digests.hash;
+            self.current_legacy_hash = digests.legacy_hash;
+        }
+        warn_unsupported_features(&chain_config.current().config);
+        self.chain_config = Some(chain_config);
+        let quarantined = storage.blocks.get_quarantined();
+        if let Some((height, reason)) = quarantined.first() {
+            tracing::warn!(
+                blocks = quarantined.len(),
+                height,
+                "Storage holds quarantined blocks, the lowest for {}",
+                reason
+            );
+        }
+        let next = self.current_height + 1;
+        let issuers = self
+            .chain_config
+            .as_ref()
+            .map(|chain_config| chain_config.config_at(next).config.revocation_issuers())
+            .unwrap_or_default();
+        let revocations = read_revocations(&storage, &issuers)?;
+        self.revoked_keys.replace(revocations.revoked(next));
+        self.revocations = revocations;
+        let signers = self
+            .chain_config
+            .as_ref()
+            .map(|chain_config| chain_config.config_at(next).config.multi_sign_signers())
+            .unwrap_or_default();
+        self.multi_sign = read_multi_sign(&storage, &signers)?;
+        self.evidence = read_evidence(&storage)?;
+        if let Some(key_status) = &self.config.key_status {
+            let checker = key_status.checker(
+                Arc::clone(&self.clock),
+                self.config.chain_id,
+                self.node_key()?,
+            )?;
+            self.revocation_checker = Some(Arc::new(checker));
+        }
+        self.refresh_known_keys(&read_dids(&storage)?)?;
+        if self.config.state_commitment {
+            let mut tree = SparseMerkleTree::new();
+            tree.apply_storage_writes(&storage.state.storage_slots());
+            self.state_tree = Some(Arc::new(RwLock::new(tree)));
         }
-
         self.storage = Some(storage);
 
         // Initialize validator identity if key provided
@@ -286,6 +1987,7 @@ impl BachNode {
                 .map_err(|_| NodeError::ConfigError("Invalid validator key".to_string()))?;
             self.validator_address = Some(private_key.public_key().to_address());
         }
+        self.health.set_validator(self.validator_address.is_some());
 
         tracing::info!(
             height = self.current_height,
@@ -315,19 +2017,124 @@ impl BachNode {
             "Node starting"
         );
 
+        // Not ready until the caches are warm, also while RPC comes up
+        let warmup = match self.active_storage() {
+            Some(storage) => {
+                warmup_heights(storage, self.current_height, self.config.warmup_blocks())
+            }
+            None => 0..0,
+        };
+        self.health.set_warmup_remaining(warmup.end - warmup.start);
+
         // Start RPC server if enabled
         if self.config.rpc_enabled {
             self.start_rpc().await?;
         }
 
+        // Start block export if configured
+        if let Some(export) = self.config.export.clone() {
+            self.start_exporter(export)?;
+        }
+
+        self.start_commit_hooks()?;
+
+        // After the consumers above subscribed, so replayed events reach them
+        self.start_outbox_dispatcher()?;
+
+        self.warm_caches(warmup);
+
         // TODO: Start network service
         // TODO: Start consensus engine
         // TODO: Start block sync
 
         self.state = NodeState::Running;
 
-        tracing::info!("Node started");
+        tracing::info!("Node started");
+
+        Ok(())
+    }
+
+    /// Loads the blocks at `heights` and the bytecode of the contracts they
+    /// call most into caches, then marks the warm-up done.
+    fn warm_caches(&self, heights: std::ops::Range<u64>) -> WarmupReport {
+        let mut report = WarmupReport::default();
+        let storage = match self.active_storage() {
+            Some(storage) if !heights.is_empty() => storage,
+            _ => {
+                self.health.set_warmup_remaining(0);
+                return report;
+            }
+        };
+        let started = std::time::Instant::now();
+        report.blocks = warm_blocks(storage, heights.clone(), &self.health);
+        let cache = self.rpc_state.as_ref().and_then(|state| {
+            state.evm_state.read().unwrap().code_cache().cloned()
+        });
+        if let Some(cache) = cache {
+            let contracts = hot_contracts(storage, heights, cache.capacity());
+            report.contracts = warm_code(storage, &cache, &contracts);
+        }
+        self.health.set_warmup_remaining(0);
+        tracing::info!(
+            blocks = report.blocks,
+            contracts = report.contracts,
+            elapsed_ms = started.elapsed().as_millis() as u64,
+            "Caches warmed"
+        );
+        report
+    }
+
+    /// Starts exporting committed blocks in the background.
+    fn start_exporter(&mut self, config: ExportConfig) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+
+        tracing::info!(
+            nats_addr = %config.nats_addr,
+            subject = %config.subject,
+            "Block export enabled"
+        );
+
+        // Subscribe before the exporter catches up so no commit is missed,
+        // and keep outbox events until the exporter checkpoints them
+        EventOutbox::register_consumer(&storage, &config.name)?;
+        let blocks = self.msgbus.subscribe(bach_msgbus::Topic::BlockCommitted);
+        let sink = NatsSink::new(&config.nats_addr).with_clock(Arc::clone(&self.clock));
+        let exporter =
+            BlockExporter::new(storage, sink, config).with_clock(Arc::clone(&self.clock));
+        tokio::spawn(exporter.run(blocks));
+        Ok(())
+    }
+
+    /// Runs the commit hooks on committed blocks in the background,
+    /// registering pruning when the retention policy prunes.
+    fn start_commit_hooks(&mut self) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+        if self.config.retention.is_pruning() {
+            self.commit_hooks.register(Arc::new(hooks::PruneHook::new(
+                storage.clone(),
+                self.config.retention,
+            )));
+        }
+        EventOutbox::register_consumer(&storage, hooks::COMMIT_HOOKS_CONSUMER)?;
+        let blocks = self.msgbus.subscribe(bach_msgbus::Topic::BlockCommitted);
+        tokio::spawn(self.commit_hooks.clone().run_on(storage, blocks));
+        Ok(())
+    }
 
+    /// Publishes block events left in the outbox by an interrupted commit,
+    /// then keeps retrying failed publications in the background.
+    fn start_outbox_dispatcher(&mut self) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+        let outbox = self.committer.outbox().clone();
+        let pending = storage.blocks.outbox_len();
+        if pending > 0 {
+            tracing::info!(pending, "Replaying unpublished block events");
+        }
+        tokio::spawn(outbox.run(
+            storage,
+            Arc::clone(&self.clock),
+            DEFAULT_OUTBOX_RETRY_INTERVAL,
+        ));
         Ok(())
     }
 
@@ -338,15 +2145,45 @@ impl BachNode {
         })?;
 
         let storage = self.storage.take().ok_or(NodeError::NotRunning)?;
+        let token_auth = self.config.token_auth_config(&read_dids(&storage)?)?;
 
-        let rpc_config = RpcConfig {
+        let mut rpc_config = RpcConfig {
             http_addr: rpc_addr.ip().to_string(),
             http_port: rpc_addr.port(),
+            token_auth,
+            clock: Arc::clone(&self.clock),
+            revoked_keys: self.revoked_keys.clone(),
+            revocation_checker: self.revocation_checker.clone(),
+            key_status_signer: self.node_key()?,
+            known_keys: self.known_keys.clone(),
+            tx_pool_persistence: self.config.tx_pool_persistence,
+            contract_log_retention: self.config.contract_log_retention_blocks,
+            interceptors: self.config.rpc_interceptors.clone(),
+            metrics_token: self.config.metrics_token.clone(),
             ..Default::default()
         };
+        if let Some(chain_config) = &self.chain_config {
+            let config = &chain_config.current().config;
+            rpc_config.max_tx_data_size = config.max_tx_data_size as usize;
+            if let Some(token_auth) = &mut rpc_config.token_auth {
+                token_auth.algorithms = config.signature_algorithms();
+                token_auth.max_clock_skew = Duration::from_secs(config.max_clock_drift_secs);
+            }
+        }
 
         let mut rpc_server = RpcServer::new(rpc_config, storage, self.config.chain_id);
+        if let Some(handle) = &self.log_level {
+            rpc_server.set_log_level_handle(Arc::clone(handle));
+        }
+        rpc_server.attach_sync(Arc::clone(&self.sync_progress));
+        rpc_server.attach_health(Arc::clone(&self.health));
+        if let Some(tree) = &self.state_tree {
+            rpc_server.attach_state_tree(Arc::clone(tree));
+        }
         let state = rpc_server.state();
+        if let Some(chain_config) = &self.chain_config {
+            configure_evm(&state, &chain_config.config_at(self.current_height + 1).config);
+        }
 
         // Set initial block height
         {
@@ -437,10 +2274,7 @@ impl BachNode {
             gas_limit,
             gas_price: U256::ZERO,
             block_number: self.current_height,
-            timestamp: std::time::SystemTime::now()
-                .duration_since(std::time::UNIX_EPOCH)
-                .unwrap()
-                .as_secs(),
+            timestamp: self.clock.unix_timestamp(),
             block_gas_limit: 30_000_000,
             coinbase: Address::zero(),
             difficulty: U256::ZERO,
@@ -451,7 +2285,7 @@ impl BachNode {
         };
 
         bach_evm::deploy_contract(code, context, &mut evm_state)
-            .map_err(|e| NodeError::ConsensusError(format!("Contract deployment failed: {:?}", e)))
+            .map_err(|e| NodeError::ExecutionFailed(format!("Contract deployment failed: {:?}", e)))
     }
 
     /// Calls a contract and returns the output.
@@ -476,10 +2310,7 @@ impl BachNode {
             gas_limit,
             gas_price: U256::ZERO,
             block_number: self.current_height,
-            timestamp: std::time::SystemTime::now()
-                .duration_since(std::time::UNIX_EPOCH)
-                .unwrap()
-                .as_secs(),
+            timestamp: self.clock.unix_timestamp(),
             block_gas_limit: 30_000_000,
             coinbase: Address::zero(),
             difficulty: U256::ZERO,
@@ -494,13 +2325,205 @@ impl BachNode {
         if result.success {
             Ok(result.output)
         } else {
-            Err(NodeError::ConsensusError(format!(
+            Err(NodeError::ExecutionFailed(format!(
                 "Contract call failed: {:?}",
                 result.error
             )))
         }
     }
 
+    /// Commits a finalized block and advances the chain head.
+    ///
+    /// Publishes a `BlockCommitReport` on `Topic::CommitReport`, removes
+    /// the block's transactions from the RPC pool and wakes RPC callers
+    /// waiting on them. Validators checked the block before it was
+    /// finalized, so only blocks extending the head whose parent hash is
+    /// neither the head's hash nor, for a hash migration transition block,
+    /// its legacy hash are rejected. The block's evidence registry and
+    /// other system contract calls run before it is stored, so their
+    /// receipts record the outcome and a failure to run them leaves the
+    /// head where it was.
+    pub fn commit_block(
+        &mut self,
+        commit: BlockCommit<'_>,
+    ) -> Result<BlockCommitReport, NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?;
+        let block = commit.block;
+        let extends_head = self.current_height > 0 && block.height == self.current_height + 1;
+        let linked = block.parent_hash == self.current_hash
+            || self.current_legacy_hash == Some(block.parent_hash);
+        if extends_head && !linked {
+            return Err(NodeError::Rejected(format!(
+                "block {} has parent {}, but the head is {}",
+                block.height, block.parent_hash, self.current_hash
+            )));
+        }
+        let schedule = self.hash_schedule_at(block.height);
+        let mut receipts = commit.receipts.to_vec();
+        let evidence = self.run_evidence_transactions(block, &mut receipts);
+        let system_calls = self.run_system_calls(block, &mut receipts)?;
+        let commit = BlockCommit {
+            receipts: &receipts,
+            ..commit
+        };
+        // Held until the block is stored, so proofs match the stored head
+        let state_tree = self.state_tree.clone();
+        let mut tree = state_tree.as_ref().map(|tree| tree.write().unwrap());
+        let commit = match &mut tree {
+            Some(tree) if commit.state_commitment.is_none() => {
+                tree.apply_storage_writes(commit.writes);
+                BlockCommit {
+                    state_commitment: Some(tree.root()),
+                    ..commit
+                }
+            }
+            _ => commit,
+        };
+        let report = self
+            .committer
+            .commit_with_schedule(storage, commit, &schedule)?;
+        drop(tree);
+
+        self.current_height = report.height;
+        self.current_hash = report.block_hash_h256();
+        self.current_legacy_hash = report.legacy_block_hash.map(H256::from);
+        self.health.record_commit(report.height);
+        let recorded = self.record_system_calls(block.height + 1, system_calls);
+        self.sign_checkpoint(report.height);
+        if let Some(state) = &self.rpc_state {
+            *state.block_height.write().unwrap() = report.height;
+            let mut pending = state.pending_txs.write().unwrap();
+            for receipt in commit.receipts {
+                pending.remove(&receipt.transaction_hash_h256());
+                state.tx_watcher.notify(receipt);
+            }
+        }
+        if let Some(registry) = evidence {
+            self.record_evidence(registry)?;
+        }
+        recorded?;
+        Ok(report)
+    }
+
+    /// Returns this validator's vote on the checkpoint of the committed
+    /// block at `height`, for broadcasting to the other validators. None if
+    /// the node isn't a validator, no checkpoint is due at `height` or the
+    /// block isn't stored.
+    pub fn checkpoint_vote(&self, height: u64) -> Option<CheckpointVote> {
+        let key = PrivateKey::from_bytes(self.config.validator_key.as_ref()?).ok()?;
+        if !is_checkpoint_height(height, self.checkpoint_interval_at(height)) {
+            return None;
+        }
+        let checkpoint = self.checkpoint_at(height)?;
+        Some(CheckpointVote {
+            checkpoint,
+            signature: checkpoint.sign(&key),
+        })
+    }
+
+    /// Records the checkpoint at `height` signed by this validator alone
+    /// when that signature is a quorum of the configured validator set, as
+    /// on a single-validator chain. With more validators the checkpoint is
+    /// recorded once consensus gathers a quorum of votes.
+    fn sign_checkpoint(&self, height: u64) {
+        let (Some(validator_set), Some(vote)) =
+            (&self.config.validator_set, self.checkpoint_vote(height))
+        else {
+            return;
+        };
+        let mut collector = CheckpointCollector::new(vote.checkpoint);
+        let recorded = match collector.add(vote.signature, validator_set) {
+            Ok(true) => collector
+                .finish(validator_set)
+                .map(|signed| self.record_checkpoint(&signed, validator_set)),
+            Ok(false) => None,
+            Err(e) => Some(Err(NodeError::ConsensusError(format!("{:?}", e)))),
+        };
+        if let Some(Err(e)) = recorded {
+            tracing::warn!(height, "Checkpoint not recorded: {}", e);
+        }
+    }
+
+    /// Returns the blocks between finality checkpoints at `height` (0 when
+    /// checkpoints are disabled or before `init`).
+    pub fn checkpoint_interval_at(&self, height: u64) -> u64 {
+        self.chain_config
+            .as_ref()
+            .map_or(0, |chain_config| chain_config.config_at(height).config.checkpoint_interval)
+    }
+
+    /// Returns the checkpoint validators sign for the committed block at
+    /// `height`, or None if the block isn't stored.
+    pub fn checkpoint_at(&self, height: u64) -> Option<Checkpoint> {
+        let storage = self.active_storage()?;
+        let block = storage.blocks.get_block_by_height(height)?;
+        let hash = self.block_digests(&block).hash;
+        let header = storage.blocks.get_block_header(&hash)?;
+        let receipts_root = storage
+            .blocks
+            .get_header_extension(&hash)
+            .and_then(|extension| extension.receipts_chain_root)
+            .map_or_else(H256::zero, H256::from);
+        Some(
+            Checkpoint::new(height, hash, H256::from(header.state_root))
+                .with_receipts_root(receipts_root),
+        )
+    }
+
+    /// Records a finality checkpoint once it matches the local block at its
+    /// height and carries signatures of a quorum of `validator_set`.
+    pub fn record_checkpoint(
+        &self,
+        signed: &SignedCheckpoint,
+        validator_set: &ValidatorSet,
+    ) -> Result<(), NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?;
+        let height = signed.height();
+        let local = self
+            .checkpoint_at(height)
+            .ok_or(NodeError::PreBlockMissing { height })?;
+        if local != signed.checkpoint {
+            return Err(NodeError::Rejected(format!(
+                "checkpoint at height {} doesn't match the local block {}",
+                height, local.block_hash
+            )));
+        }
+        verify_checkpoint(signed, validator_set)
+            .map_err(|e| NodeError::ConsensusError(format!("{:?}", e)))?;
+
+        storage.blocks.put_finality_checkpoint(signed)?;
+        tracing::info!(height, signers = signed.signatures.len(), "Finality checkpoint recorded");
+        Ok(())
+    }
+
+    /// Returns the highest recorded finality checkpoint.
+    pub fn latest_checkpoint(&self) -> Option<SignedCheckpoint> {
+        self.active_storage()?
+            .blocks
+            .get_latest_finality_checkpoint(u64::MAX)
+    }
+
+    /// Streams changes to the contract slots selected by `filter`, starting
+    /// after the `resume` position (or from the start of the chain).
+    pub fn subscribe_state_changes(
+        &self,
+        filter: StateChangeFilter,
+        resume: Option<(u64, H256)>,
+    ) -> Result<StateChangeSubscription, NodeError> {
+        let storage = self.active_storage().ok_or(NodeError::NotRunning)?.clone();
+        let blocks = self.msgbus.subscribe(bach_msgbus::Topic::BlockCommitted);
+        Ok(StateChangeSubscription::new(storage, blocks, filter, resume))
+    }
+
+    /// Returns the storage in use, which the RPC server owns once started.
+    fn active_storage(&self) -> Option<&Storage> {
+        match (&self.storage, &self.rpc_state) {
+            (Some(storage), _) => Some(storage),
+            (None, Some(state)) => Some(&state.storage),
+            (None, None) => None,
+        }
+    }
+
     /// Returns a reference to the storage layer.
     pub fn storage(&self) -> Option<&Storage> {
         self.storage.as_ref()
@@ -527,8 +2550,88 @@ impl Drop for BachNode {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use bach_consensus::{SignatureCheckMode, Validator};
+    use bach_msgbus::{Message, Topic};
+    use bach_contracts::{DidDocument, ProposalStatus, RevocationList};
+    use bach_crypto::{keccak256, Ed25519PrivateKey, HashAlgorithm, SigningMember, Sm2PrivateKey};
+    use bach_storage::{OutboxEvent, TransactionReceipt};
+    use bach_types::{Block, Transaction};
+    use bach_rpc::EthApiServer;
     use tempfile::TempDir;
 
+    /// Builds a commit of `block` without execution results.
+    fn bare_commit(block: &Block) -> BlockCommit<'_> {
+        BlockCommit {
+            block,
+            state_root: H256::zero(),
+            state_commitment: None,
+            writes: &[],
+            writers: &[],
+            values: &[],
+            code: &[],
+            receipts: &[],
+            dag: None,
+            conflicts: 0,
+            signatures: 1,
+        }
+    }
+
+    /// Returns a call to the chain config contract signed by `key`.
+    fn config_tx(key: &PrivateKey, nonce: u64, data: Vec<u8>) -> Transaction {
+        let to = Some(chain_config_address());
+        let mut tx = Transaction::new(nonce, to, U256::ZERO, data, key.sign(&H256::zero()));
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    /// Commits a block holding `txs` on top of `node`'s head.
+    fn commit_txs(node: &mut BachNode, txs: Vec<Transaction>) -> BlockCommitReport {
+        let height = node.current_height() + 1;
+        let block = Block::new(height, node.current_hash(), txs, 1000 + height);
+        node.commit_block(bare_commit(&block)).unwrap()
+    }
+
+    /// Commits a block holding `txs`, each with a successful receipt, on
+    /// top of `node`'s head and returns the stored receipt statuses.
+    fn commit_with_receipts(node: &mut BachNode, txs: Vec<Transaction>) -> Vec<bool> {
+        let height = node.current_height() + 1;
+        let block = Block::new(height, node.current_hash(), txs, 1000 + height);
+        let receipts: Vec<TransactionReceipt> = block
+            .transactions
+            .iter()
+            .enumerate()
+            .map(|(index, tx)| TransactionReceipt {
+                transaction_hash: *tx.hash().as_bytes(),
+                block_hash: *block.hash().as_bytes(),
+                block_number: height,
+                transaction_index: index as u32,
+                gas_used: 0,
+                status: true,
+                logs: vec![],
+            })
+            .collect();
+        node.commit_block(BlockCommit {
+            receipts: &receipts,
+            ..bare_commit(&block)
+        })
+        .unwrap();
+        let transactions = &node.storage().unwrap().transactions;
+        block
+            .transactions
+            .iter()
+            .map(|tx| transactions.get_receipt(&tx.hash()).unwrap().status)
+            .collect()
+    }
+
+    /// Returns the encoded update of the named chain config parameters.
+    fn config_update(changes: &[(&str, &str)]) -> Vec<u8> {
+        let changes: Vec<(String, String)> = changes
+            .iter()
+            .map(|(name, value)| (name.to_string(), value.to_string()))
+            .collect();
+        bach_contracts::encode_update(&changes)
+    }
+
     #[test]
     fn test_default_config() {
         let config = NodeConfig::default();
@@ -550,6 +2653,33 @@ mod tests {
         assert_eq!(config.rpc_addr.unwrap().port(), 8545);
     }
 
+    #[test]
+    fn test_scheduler_pool_config() {
+        let mut config = NodeConfig::default();
+        assert_eq!(config.scheduler_pool_config(), PoolSizeConfig::default().normalized());
+
+        config.scheduler_min_threads = Some(6);
+        config.scheduler_max_threads = Some(2);
+        assert_eq!(
+            config.scheduler_pool_config(),
+            PoolSizeConfig { min_threads: 6, max_threads: 6 }
+        );
+        assert_eq!(config.scheduler().pool_size(), Some(6));
+    }
+
+    #[test]
+    fn test_tx_signature_verifier_mode() {
+        let mut config = NodeConfig::default();
+        assert_eq!(config.tx_signature_verifier().mode(), SignatureCheckMode::Sequential);
+
+        config.parallel_tx_verification = true;
+        config.tx_verification_workers = Some(3);
+        assert_eq!(
+            config.tx_signature_verifier().mode(),
+            SignatureCheckMode::Parallel { workers: 3 }
+        );
+    }
+
     #[test]
     fn test_node_creation() {
         let config = NodeConfig::default();
@@ -588,6 +2718,802 @@ mod tests {
         assert_eq!(node.validator_address(), Some(&expected_addr));
     }
 
+    #[test]
+    fn test_chain_config_history_persists() {
+        let temp_dir = TempDir::new().unwrap();
+        let admin = PrivateKey::random();
+        {
+            let mut node = BachNode::new(NodeConfig::new(temp_dir.path().to_path_buf()));
+            node.init().unwrap();
+            assert_eq!(node.chain_config().unwrap().current().version, 0);
+
+            // Calls take effect from the block after the one holding them
+            let update = config_update(&[("storage_quota", "2048")]);
+            commit_txs(&mut node, vec![config_tx(&admin, 0, update)]);
+            let version = node.chain_config().unwrap().current();
+            assert_eq!((version.version, version.height), (1, 2));
+            assert_eq!(node.storage().unwrap().state.storage_quota(), Some(2048));
+
+            // A rejected call fails its receipt without failing the block
+            let unknown = config_update(&[("gas_price", "1")]);
+            let statuses = commit_with_receipts(&mut node, vec![config_tx(&admin, 1, unknown)]);
+            assert_eq!(statuses, vec![false]);
+            assert_eq!(node.current_height(), 2);
+            assert_eq!(node.chain_config().unwrap().current().version, 1);
+            node.storage().unwrap().flush().unwrap();
+        }
+
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let chain_config = read_chain_config(&storage).unwrap().unwrap();
+        assert_eq!(chain_config.config_at(1).config.storage_quota, None);
+        assert_eq!(chain_config.config_at(2).config.storage_quota, Some(2048));
+        assert_eq!(
+            chain_config.current().updated_by_addr(),
+            admin.public_key().to_address()
+        );
+    }
+
+    #[test]
+    fn test_static_peers_follow_chain_config() {
+        let temp_dir = TempDir::new().unwrap();
+        let admin = PrivateKey::random();
+        let first = format!("{}@10.0.0.1:30303", hex::encode([1u8; 32]));
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_genesis_chain_config("nodes.org1", &first);
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+
+        // Attaching hands the network the genesis allowlist
+        let (tx, mut rx) = tokio::sync::mpsc::channel(4);
+        node.attach_network(tx);
+        let Ok(NetworkCommand::UpdateAllowlist(peers)) = rx.try_recv() else {
+            panic!("expected an allowlist");
+        };
+        assert_eq!(peers, vec![StaticPeer::new(
+            "org1",
+            PeerId::from_bytes([1u8; 32]),
+            "10.0.0.1:30303".parse().unwrap(),
+        )]);
+
+        // Updates to the node lists reach it, other updates don't
+        let second = format!("{}@10.0.0.2:30303", hex::encode([2u8; 32]));
+        let update = config_update(&[("nodes.org2", &second)]);
+        commit_txs(&mut node, vec![config_tx(&admin, 0, update)]);
+        let Ok(NetworkCommand::UpdateAllowlist(peers)) = rx.try_recv() else {
+            panic!("expected an allowlist");
+        };
+        assert_eq!(peers.len(), 2);
+        commit_txs(&mut node, vec![config_tx(&admin, 1, config_update(&[("storage_quota", "1")]))]);
+        assert!(rx.try_recv().is_err());
+
+        // Removing every list returns the network to discovery
+        let update = config_update(&[("nodes.org1", "none"), ("nodes.org2", "none")]);
+        commit_txs(&mut node, vec![config_tx(&admin, 2, update)]);
+        let Ok(NetworkCommand::UpdateAllowlist(peers)) = rx.try_recv() else {
+            panic!("expected an allowlist");
+        };
+        assert!(peers.is_empty());
+    }
+
+    #[test]
+    fn test_genesis_chain_config() {
+        let temp_dir = TempDir::new().unwrap();
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_genesis_chain_config("block_gas_limit", "50000");
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+        assert_eq!(node.chain_config().unwrap().current().version, 0);
+        assert_eq!(node.block_gas_limit().unwrap(), 50_000);
+
+        let invalid = NodeConfig::new(temp_dir.path().join("invalid"))
+            .with_genesis_chain_config("gas_price", "1");
+        let mut node = BachNode::new(invalid);
+        assert!(matches!(node.init(), Err(NodeError::ConfigError(_))));
+    }
+
+    #[test]
+    fn test_revocation_transactions() {
+        let temp_dir = TempDir::new().unwrap();
+        let issuer = PrivateKey::random();
+        let member = PrivateKey::random();
+        let revoked = member.public_key().to_address();
+        let config = NodeConfig::new(temp_dir.path().to_path_buf()).with_genesis_chain_config(
+            "revocation_issuers",
+            &issuer.public_key().to_address().to_string(),
+        );
+        let mut node = BachNode::new(config.clone());
+        node.init().unwrap();
+
+        let mut tx = Transaction::new(0, None, U256::ZERO, vec![1], issuer.sign(&H256::zero()));
+        tx.signature = member.sign(&tx.signing_hash()).into();
+        assert_eq!(node.check_admission(&tx).unwrap(), revoked);
+
+        // Lists apply from the block after the one uploading them
+        let upload = |key: &PrivateKey, nonce: u64, list: RevocationList| {
+            let to = Some(revocation_registry_address());
+            let data = bach_contracts::encode_revocation_upload(&list.sign(key));
+            let mut tx = Transaction::new(nonce, to, U256::ZERO, data, key.sign(&H256::zero()));
+            tx.signature = key.sign(&tx.signing_hash()).into();
+            tx
+        };
+        let list = RevocationList::new(1, 1000, [revoked]);
+        commit_txs(&mut node, vec![upload(&issuer, 0, list.clone())]);
+        assert!(node.revoked_keys().contains(&revoked));
+        assert_eq!(node.revoked_senders(), BTreeSet::from([revoked]));
+        assert!(matches!(node.check_admission(&tx), Err(NodeError::Rejected(_))));
+
+        // Replays and untrusted issuers fail their receipts; finalized
+        // blocks still commit
+        let untrusted = RevocationList::new(2, 1000, []);
+        let statuses = commit_with_receipts(
+            &mut node,
+            vec![upload(&issuer, 1, list), upload(&member, 0, untrusted), tx.clone()],
+        );
+        assert_eq!(statuses, vec![false, false, true]);
+        assert!(node.revoked_keys().contains(&revoked));
+
+        // Restarting restores the lists
+        drop(node);
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+        assert!(node.revoked_keys().contains(&revoked));
+
+        let cleared = RevocationList::new(2, 2000, []);
+        commit_txs(&mut node, vec![upload(&issuer, 2, cleared)]);
+        assert!(node.revoked_keys().is_empty());
+        let mut next = Transaction::new(1, None, U256::ZERO, vec![1], issuer.sign(&H256::zero()));
+        next.signature = member.sign(&next.signing_hash()).into();
+        assert_eq!(node.check_admission(&next).unwrap(), revoked);
+    }
+
+    #[test]
+    fn test_multi_sign_transactions() {
+        let temp_dir = TempDir::new().unwrap();
+        let keys: Vec<PrivateKey> = (0..3).map(|_| PrivateKey::random()).collect();
+        let signers: Vec<String> =
+            keys.iter().map(|k| k.public_key().to_address().to_string()).collect();
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_genesis_chain_config("multi_sign_signers", &signers.join(","));
+        let mut node = BachNode::new(config.clone());
+        node.init().unwrap();
+
+        let call = |key: &PrivateKey, nonce: u64, data: Vec<u8>| {
+            let to = Some(multi_sign_address());
+            let mut tx = Transaction::new(nonce, to, U256::ZERO, data, key.sign(&H256::zero()));
+            tx.signature = key.sign(&tx.signing_hash()).into();
+            tx
+        };
+        let height = node.current_height();
+        commit_txs(
+            &mut node,
+            vec![
+                call(&keys[0], 0, bach_contracts::encode_multi_sign_propose(height + 5, b"a")),
+                call(&keys[0], 1, bach_contracts::encode_multi_sign_propose(height + 3, b"b")),
+            ],
+        );
+        // Outsiders' votes fail their receipts; two of three signers
+        // approve, and a vote on the decided proposal fails too
+        let outsider = PrivateKey::random();
+        let statuses = commit_with_receipts(
+            &mut node,
+            vec![
+                call(&outsider, 0, bach_contracts::encode_multi_sign_approve(0)),
+                call(&keys[1], 0, bach_contracts::encode_multi_sign_approve(0)),
+                call(&keys[2], 0, bach_contracts::encode_multi_sign_approve(0)),
+                call(&keys[0], 2, bach_contracts::encode_multi_sign_reject(0)),
+            ],
+        );
+        assert_eq!(statuses, vec![false, true, true, false]);
+        assert_eq!(node.multi_sign().get(0).unwrap().status, ProposalStatus::Approved);
+        assert_eq!(node.multi_sign().get(1).unwrap().status, ProposalStatus::Open);
+
+        // Proposals expire as blocks pass their deadline, even without calls
+        commit_txs(&mut node, vec![]);
+        assert_eq!(node.multi_sign().get(1).unwrap().status, ProposalStatus::Expired);
+
+        // Restarting restores the proposals
+        drop(node);
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+        assert_eq!(node.multi_sign().get(0).unwrap().status, ProposalStatus::Approved);
+        assert_eq!(node.multi_sign().signers().len(), 3);
+    }
+
+    #[test]
+    fn test_ed25519_admission_needs_chain_config() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut node = BachNode::new(NodeConfig::new(temp_dir.path().to_path_buf()));
+        node.init().unwrap();
+
+        let member = Ed25519PrivateKey::random();
+        let placeholder = member.sign_member(&H256::zero());
+        let mut tx = Transaction::new(0, None, U256::ZERO, vec![1], placeholder);
+        tx.signature = member.sign_member(&tx.signing_hash());
+        assert!(matches!(node.check_admission(&tx), Err(NodeError::Rejected(_))));
+
+        // Validators checked the finalized block, so commit doesn't
+        let block = Block::new(1, H256::zero(), vec![tx.clone()], 1000);
+        node.commit_block(bare_commit(&block)).unwrap();
+
+        // Allowed from the block after the one changing the config
+        let update = config_update(&[("signature_algorithms", "secp256k1,ed25519")]);
+        commit_txs(&mut node, vec![config_tx(&PrivateKey::random(), 0, update)]);
+        assert_eq!(node.check_admission(&tx).unwrap(), member.public_key().to_address());
+    }
+
+    #[test]
+    fn test_sm2_admission_follows_chain_schemes() {
+        let temp_dir = TempDir::new().unwrap();
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_genesis_chain_config("signature_algorithms", "secp256k1/sha256,sm2");
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+        let schemes = node.signature_schemes().unwrap();
+
+        // Signers derive the hash from their key: SHA-256 for ECDSA, SM3
+        // for SM2
+        let ecdsa = PrivateKey::random();
+        let sm2 = Sm2PrivateKey::random();
+        let unsigned = |nonce| {
+            Transaction::new(nonce, None, U256::ZERO, vec![1], ecdsa.sign(&H256::zero()))
+        };
+        let mut ecdsa_tx = unsigned(0);
+        ecdsa_tx.sign(&ecdsa, &schemes);
+        let mut sm2_tx = unsigned(1);
+        sm2_tx.sign(&sm2, &schemes);
+        assert_eq!(sm2_tx.signature.hash_algorithm(), HashAlgorithm::Sm3);
+        assert_eq!(node.check_admission(&ecdsa_tx).unwrap(), ecdsa.public_key().to_address());
+        assert_eq!(node.check_admission(&sm2_tx).unwrap(), sm2.public_key().to_address());
+
+        // ECDSA over Keccak-256 is another scheme, not allowed here
+        let mut keccak_tx = unsigned(2);
+        keccak_tx.sign(&ecdsa, &[]);
+        assert!(matches!(node.check_admission(&keccak_tx), Err(NodeError::Rejected(_))));
+    }
+
+    #[test]
+    fn test_hash_migration_transition_block() {
+        fn commit(block: &Block) -> BlockCommit<'_> {
+            BlockCommit {
+                block,
+                state_root: H256::zero(),
+                state_commitment: None,
+                writes: &[],
+                writers: &[],
+                values: &[],
+                code: &[],
+                receipts: &[],
+                dag: None,
+                conflicts: 0,
+                signatures: 1,
+            }
+        }
+
+        let temp_dir = TempDir::new().unwrap();
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_genesis_chain_config("hash_migrations", "sha256@3");
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+
+        let first = Block::new(1, H256::zero(), vec![], 1000);
+        node.commit_block(commit(&first)).unwrap();
+        let second = Block::new(2, first.hash(), vec![], 1001);
+        let report = node.commit_block(commit(&second)).unwrap();
+        assert_eq!(report.block_hash_h256(), second.hash());
+        assert_eq!(report.legacy_block_hash, None);
+
+        // The transition block is hashed with SHA-256 and keeps its Keccak-256 hash
+        let transition = Block::new(3, second.hash(), vec![], 1002);
+        let report = node.commit_block(commit(&transition)).unwrap();
+        let hash = transition.hash_with(HashAlgorithm::Sha256);
+        assert_eq!(report.block_hash_h256(), hash);
+        assert_eq!(report.legacy_block_hash, Some(*transition.hash().as_bytes()));
+        assert_eq!(node.current_hash(), hash);
+        let blocks = &node.storage().unwrap().blocks;
+        assert_eq!(blocks.get_block_by_hash(&hash), Some(transition.clone()));
+        assert_eq!(blocks.get_block_by_hash(&transition.hash()), Some(transition.clone()));
+
+        // Children may link to either digest of the transition block
+        let child = Block::new(4, transition.hash(), vec![], 1003);
+        node.commit_block(commit(&child)).unwrap();
+        assert_eq!(node.current_hash(), child.hash_with(HashAlgorithm::Sha256));
+        let unlinked = Block::new(5, child.hash(), vec![], 1004);
+        assert!(matches!(node.commit_block(commit(&unlinked)), Err(NodeError::Rejected(_))));
+        let linked = Block::new(5, node.current_hash(), vec![], 1004);
+        node.commit_block(commit(&linked)).unwrap();
+    }
+
+    #[test]
+    fn test_admin_key_rotation() {
+        let temp_dir = TempDir::new().unwrap();
+        let (a_key, b_key) = (PrivateKey::random(), PrivateKey::random());
+        let (a, b) = (a_key.public_key().to_address(), b_key.public_key().to_address());
+        let new_a = Address::from([4u8; 20]);
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_genesis_chain_config("admin.org-a", &a.to_string())
+            .with_genesis_chain_config("admin.org-b", &b.to_string());
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+
+        // The second staging is rejected; the endorsement still lands
+        let stage = bach_contracts::encode_stage_rotation("org-a", &new_a, 10);
+        let endorse = bach_contracts::encode_endorse_rotation("org-a");
+        commit_txs(
+            &mut node,
+            vec![
+                config_tx(&a_key, 0, stage.clone()),
+                config_tx(&a_key, 1, stage),
+                config_tx(&b_key, 0, endorse),
+            ],
+        );
+        let chain_config = node.chain_config().unwrap();
+        assert_eq!(chain_config.current().version, 2);
+        assert!(chain_config.current().config.rotations["org-a"].is_endorsed());
+        assert_eq!(chain_config.admin_keys_at("org-a", 9), vec![a]);
+        assert_eq!(chain_config.admin_keys_at("org-a", 10), vec![a, new_a]);
+
+        let update = config_update(&[("block_gas_limit", "1")]);
+        commit_txs(&mut node, vec![config_tx(&PrivateKey::random(), 0, update)]);
+        assert_eq!(node.chain_config().unwrap().current().version, 2);
+    }
+
+    #[test]
+    fn test_simulate_endorsement() {
+        let temp_dir = TempDir::new().unwrap();
+        let (a, b) = (Address::from([1u8; 20]), Address::from([2u8; 20]));
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_genesis_chain_config("admin.org-a", &a.to_string())
+            .with_genesis_chain_config("admin.org-b", &b.to_string());
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+
+        let eval = node
+            .simulate_endorsement("rotation.org-a", &[b.to_string()])
+            .unwrap();
+        assert!(!eval.satisfied);
+        assert_eq!(eval.missing_orgs, vec!["org-a".to_string()]);
+        let members = [a.to_string(), b.to_string(), "did:bach:unknown".to_string()];
+        assert!(node.simulate_endorsement("rotation.org-a", &members).unwrap().satisfied);
+        assert!(matches!(
+            node.simulate_endorsement("treasury", &members),
+            Err(NodeError::Rejected(_))
+        ));
+
+        // A contract nobody installed has no owning org to endorse
+        let pause = format!("pause.{}", Address::from([0x42; 20]));
+        assert!(matches!(
+            node.simulate_endorsement(&pause, &members),
+            Err(NodeError::Rejected(_))
+        ));
+    }
+
+    #[test]
+    fn test_did_members() {
+        let temp_dir = TempDir::new().unwrap();
+        let key = PrivateKey::random();
+        let address = key.public_key().to_address();
+        let did = "did:bach:clinic";
+        let mut config = NodeConfig::new(temp_dir.path().to_path_buf());
+        config.rpc_auth_members = vec![did.to_string()];
+        config.rpc_auth_audience = Some("clinic-node".to_string());
+        let mut node = BachNode::new(config.clone());
+        node.init().unwrap();
+
+        // Unregistered DIDs resolve to no keys until their document exists
+        let dids = node.dids().unwrap();
+        assert!(config.token_auth_config(&dids).unwrap().unwrap().members.is_empty());
+
+        // Documents are recorded by registry transactions in committed blocks
+        let mut nonce = 0;
+        let mut register = |node: &mut BachNode, document: &SignedDidDocument| {
+            let to = Some(did_registry_address());
+            let data = bach_contracts::encode_did_register(document);
+            let mut tx = Transaction::new(nonce, to, U256::ZERO, data, key.sign(&H256::zero()));
+            tx.signature = key.sign(&tx.signing_hash()).into();
+            nonce += 1;
+            commit_txs(node, vec![tx]);
+        };
+        let roles = vec!["member".to_string(), "auditor".to_string()];
+        let document = DidDocument::new(did, 1, [address], roles).sign(&key);
+        let pin = document.document.signing_hash().to_string();
+        register(&mut node, &document);
+        assert_eq!(node.dids().unwrap().resolve(did).unwrap().version, 1);
+        // Replays are skipped; the block still commits
+        register(&mut node, &document);
+        assert_eq!(node.dids().unwrap().documents().count(), 1);
+
+        // Registered documents count only once the operator pins them, and
+        // the roles they claim are never granted
+        let dids = node.dids().unwrap();
+        assert!(config.token_auth_config(&dids).unwrap().unwrap().members.is_empty());
+        config.did_pins = HashMap::from([(did.to_string(), pin)]);
+        let auth = config.token_auth_config(&dids).unwrap().unwrap();
+        assert_eq!(auth.members, vec![address]);
+        assert_eq!(auth.audience, TokenAudience::new(config.chain_id, "clinic-node"));
+        assert_eq!(auth.roles.get(&address), None);
+        assert_eq!(auth.dids.get(&address).map(String::as_str), Some(did));
+
+        config.rpc_admin_roles = HashMap::from([(did.to_string(), "operator".to_string())]);
+        let auth = config.token_auth_config(&dids).unwrap().unwrap();
+        assert_eq!(auth.roles.get(&address), Some(&AdminRole::Operator));
+
+        // The holder adding a key unpins the DID until the operator re-pins
+        let other = PrivateKey::random().public_key().to_address();
+        let update = DidDocument::new(did, 2, [address, other], Vec::new()).sign(&key);
+        register(&mut node, &update);
+        let dids = node.dids().unwrap();
+        assert_eq!(dids.resolve(did).unwrap().version, 2);
+        assert!(config.token_auth_config(&dids).unwrap().unwrap().members.is_empty());
+
+        register(&mut node, &DidDocument::deactivation(did, 3).sign(&key));
+        let dids = node.dids().unwrap();
+        assert!(dids.resolve(did).is_err());
+        assert!(config.token_auth_config(&dids).unwrap().unwrap().members.is_empty());
+
+        config.rpc_auth_members = vec!["did:web:example.com".to_string()];
+        assert!(config.token_auth_config(&dids).is_err());
+
+        // Without a configured name, tokens are issued for the validator
+        config.rpc_auth_audience = None;
+        assert!(config.rpc_auth_audience().is_err());
+        config.validator_key = Some(key.to_bytes());
+        assert_eq!(config.rpc_auth_audience().unwrap().node, address.to_string());
+    }
+
+    #[test]
+    fn test_commit_block_publishes_report() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut node = BachNode::new(NodeConfig::new(temp_dir.path().to_path_buf()));
+        node.init().unwrap();
+        let mut reports = node.msgbus().subscribe(Topic::CommitReport);
+
+        let block = Block::new(1, H256::zero(), vec![], 1000);
+        let contract = Address::from([0xcc; 20]);
+        let writes = [(contract, H256::from([1u8; 32]), H256::from([2u8; 32]))];
+        let report = node
+            .commit_block(BlockCommit {
+                block: &block,
+                state_root: H256::zero(),
+                state_commitment: None,
+                writes: &writes,
+                writers: &[],
+                values: &[],
+                code: &[],
+                receipts: &[],
+                dag: None,
+                conflicts: 3,
+                signatures: 4,
+            })
+            .unwrap();
+
+        assert_eq!(report.height, 1);
+        assert_eq!(report.write_count, 1);
+        assert_eq!(report.conflicts, 3);
+        assert_eq!(report.signatures, 4);
+        assert_eq!(node.current_height(), 1);
+        assert_eq!(node.current_hash(), block.hash());
+        assert!(node.storage().unwrap().blocks.get_block_by_height(1).is_some());
+
+        let Message::CommitReport(published) = reports.try_recv().unwrap() else {
+            panic!("expected a commit report");
+        };
+        assert_eq!(*published, report);
+        assert_eq!(node.storage().unwrap().blocks.outbox_len(), 0);
+    }
+
+    #[test]
+    fn test_solo_validator_records_checkpoints_at_commit() {
+        let key = PrivateKey::from_bytes(&[0x31; 32]).unwrap();
+        let other = PrivateKey::from_bytes(&[0x32; 32]).unwrap();
+        let commit_blocks = |validators: &[&PrivateKey]| {
+            let set = ValidatorSet::new(
+                validators
+                    .iter()
+                    .map(|key| Validator::new(key.public_key(), 1))
+                    .collect(),
+            );
+            let config = NodeConfig::default()
+                .with_validator_key(key.to_bytes())
+                .with_validator_set(set)
+                .with_genesis_chain_config("checkpoint_interval", "2");
+            let mut node = BachNode::new(config);
+            node.init_with_storage(Storage::temporary().unwrap()).unwrap();
+            for height in 1..=3 {
+                let block = Block::new(height, node.current_hash(), vec![], 1000 + height);
+                node.commit_block(BlockCommit {
+                    block: &block,
+                    state_root: H256::zero(),
+                    state_commitment: None,
+                    writes: &[],
+                    writers: &[],
+                    values: &[],
+                    code: &[],
+                    receipts: &[],
+                    dag: None,
+                    conflicts: 0,
+                    signatures: 1,
+                })
+                .unwrap();
+            }
+            node
+        };
+
+        let node = commit_blocks(&[&key]);
+        let signed = node.latest_checkpoint().unwrap();
+        assert_eq!(signed.height(), 2);
+        assert_eq!(Some(signed.checkpoint), node.checkpoint_at(2));
+        assert!(!signed.checkpoint.receipts_root.is_zero());
+        assert!(node.checkpoint_vote(3).is_none());
+
+        // With another validator the vote alone isn't a quorum
+        let node = commit_blocks(&[&key, &other]);
+        assert!(node.latest_checkpoint().is_none());
+        let vote = node.checkpoint_vote(2).unwrap();
+        assert!(vote.signature.verify(&vote.checkpoint));
+    }
+
+    #[test]
+    fn test_committed_tx_refused_at_admission() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut node = BachNode::new(NodeConfig::new(temp_dir.path().to_path_buf()));
+        node.init().unwrap();
+
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let mut tx = Transaction::new(0, None, U256::ZERO, vec![1], key.sign(&H256::zero()));
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        assert!(node.check_admission(&tx).is_ok());
+
+        let block = Block::new(1, H256::zero(), vec![tx.clone()], 1000);
+        let receipt = TransactionReceipt {
+            transaction_hash: *tx.hash().as_bytes(),
+            block_hash: *block.hash().as_bytes(),
+            block_number: 1,
+            transaction_index: 0,
+            gas_used: 0,
+            status: true,
+            logs: vec![],
+        };
+        let mut commit = bare_commit(&block);
+        commit.receipts = std::slice::from_ref(&receipt);
+        node.commit_block(commit).unwrap();
+
+        assert!(node.is_tx_committed(&tx.hash()));
+        let err = node.check_admission(&tx).unwrap_err();
+        assert!(matches!(err, NodeError::DuplicateTx(hash) if hash == tx.hash()));
+        assert_eq!(err.error_code(), ErrorCode::DuplicateTx);
+
+        // Gossiped bodies pass the same check before they are relayed
+        let mut fresh = Transaction::new(1, None, U256::ZERO, vec![2], key.sign(&H256::zero()));
+        fresh.signature = key.sign(&fresh.signing_hash()).into();
+        let mut garbled = SerializableTransaction::from(&fresh);
+        garbled.signature.truncate(10);
+        let (admitted, refused) = node.admit_gossiped_txs(vec![
+            SerializableTransaction::from(&tx),
+            SerializableTransaction::from(&fresh),
+            garbled.clone(),
+        ]);
+        assert_eq!(admitted, vec![SerializableTransaction::from(&fresh)]);
+        let refused: Vec<H256> = refused.into_iter().map(|(hash, _)| hash).collect();
+        assert_eq!(refused, vec![tx.hash(), garbled.hash()]);
+    }
+
+    #[test]
+    fn test_gas_settlement_appended_and_reserved() {
+        let temp_dir = TempDir::new().unwrap();
+        let validator = PrivateKey::random();
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_validator_key(validator.to_bytes())
+            .with_gas_settlement(true);
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let signed = |to: Address| {
+            let mut tx = Transaction::new(0, Some(to), U256::ZERO, vec![], key.sign(&H256::zero()));
+            tx.signature = key.sign(&tx.signing_hash()).into();
+            tx
+        };
+        let reserved = signed(bach_consensus::gas_settlement_address());
+        assert!(matches!(node.check_admission(&reserved), Err(NodeError::Rejected(_))));
+
+        let mut transactions = vec![signed(Address::from([0x22; 20])), reserved];
+        assert_eq!(node.append_system_txs(1, &H256::zero(), &mut transactions).unwrap(), 1);
+        assert_eq!(transactions.len(), 2);
+        let block = Block::new(1, H256::zero(), transactions, 1000);
+        let proposer = validator.public_key().to_address();
+        assert!(node.system_txs().verify(&block, &proposer).is_ok());
+        let settlement = &block.transactions[1];
+        let declared = block.transactions[0].gas;
+        assert_eq!(
+            GasSettlement::decode(&settlement.data),
+            Some((1, declared))
+        );
+    }
+
+    #[test]
+    fn test_committed_code_is_reference_counted() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut node = BachNode::new(NodeConfig::new(temp_dir.path().to_path_buf()));
+        node.init().unwrap();
+
+        let (a, b) = (Address::from([0xa1; 20]), Address::from([0xb2; 20]));
+        let (v1, v2) = (keccak256(&[0x60, 0x01]), keccak256(&[0x60, 0x02]));
+        let block = Block::new(1, H256::zero(), vec![], 1000);
+        let code = [(a, vec![0x60, 0x01]), (b, vec![0x60, 0x01])];
+        node.commit_block(BlockCommit { code: &code, ..bare_commit(&block) }).unwrap();
+        let state = &node.storage().unwrap().state;
+        assert_eq!(state.code_ref_count(&v1), 2);
+
+        // Upgrading one account keeps the shared code for the other
+        let block = Block::new(2, node.current_hash(), vec![], 1001);
+        let code = [(a, vec![0x60, 0x02])];
+        node.commit_block(BlockCommit { code: &code, ..bare_commit(&block) }).unwrap();
+        let state = &node.storage().unwrap().state;
+        assert_eq!(state.get_account(&a).unwrap().code_hash_h256(), v2);
+        assert_eq!((state.code_ref_count(&v1), state.code_ref_count(&v2)), (1, 1));
+        assert_eq!(state.get_code(&v1), Some(vec![0x60, 0x01]));
+    }
+
+    #[test]
+    fn test_state_commitment_over_committed_storage() {
+        let temp_dir = TempDir::new().unwrap();
+        let config = NodeConfig::new(temp_dir.path().to_path_buf()).with_state_commitment(true);
+        let mut node = BachNode::new(config.clone());
+        node.init().unwrap();
+        assert_eq!(node.state_commitment(), Some(H256::zero()));
+
+        let contract = Address::from([0xcc; 20]);
+        let (one, two) = (H256::from([1u8; 32]), H256::from([2u8; 32]));
+        let writes = [(contract, one, one), (contract, two, two)];
+        let block = Block::new(1, H256::zero(), vec![], 1000);
+        node.commit_block(BlockCommit { writes: &writes, ..bare_commit(&block) }).unwrap();
+        let mut expected = SparseMerkleTree::new();
+        expected.apply_storage_writes(&writes);
+        assert_eq!(node.state_commitment(), Some(expected.root()));
+
+        // Cleared slots leave the commitment, which the header records
+        let writes = [(contract, two, H256::zero())];
+        let block = Block::new(2, node.current_hash(), vec![], 1001);
+        node.commit_block(BlockCommit { writes: &writes, ..bare_commit(&block) }).unwrap();
+        let mut expected = SparseMerkleTree::new();
+        expected.apply_storage_writes(&[(contract, one, one)]);
+        let extension = node
+            .storage()
+            .unwrap()
+            .blocks
+            .get_header_extension(&node.current_hash())
+            .unwrap();
+        assert_eq!(extension.state_commitment, Some(*expected.root().as_bytes()));
+
+        // A restarted node rebuilds the same commitment from storage
+        drop(node);
+        let mut node = BachNode::new(config);
+        node.init().unwrap();
+        assert_eq!(node.state_commitment(), Some(expected.root()));
+    }
+
+    #[test]
+    fn test_index_calls_applied_from_receipt_logs() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut node = BachNode::new(NodeConfig::new(temp_dir.path().to_path_buf()));
+        node.init().unwrap();
+
+        let contract = Address::from([0xcc; 20]);
+        let spec = IndexSpec::new("by_age", vec![bach_contracts::IndexField::number("age")]);
+        let call = bach_evm::index_call_log(contract, bach_contracts::encode_index_declare(&spec));
+        let receipt = |status: bool, address: Address| TransactionReceipt {
+            transaction_hash: [status as u8; 32],
+            block_hash: [0; 32],
+            block_number: 1,
+            transaction_index: 0,
+            gas_used: 0,
+            status,
+            logs: vec![bach_storage::Log {
+                address: *address.as_bytes(),
+                topics: call.topics.iter().map(|topic| *topic.as_bytes()).collect(),
+                data: call.data.clone(),
+                block_number: 1,
+                transaction_hash: [0; 32],
+                transaction_index: 0,
+                log_index: 0,
+            }],
+        };
+
+        // Logs of failed transactions, or posing as the registry from a
+        // contract address, don't count
+        let block = Block::new(1, H256::zero(), vec![], 1000);
+        let receipts = [receipt(false, call.address), receipt(true, contract)];
+        node.commit_block(BlockCommit {
+            receipts: &receipts,
+            ..bare_commit(&block)
+        })
+        .unwrap();
+        assert!(node.indexes().unwrap().is_empty());
+
+        let block = Block::new(2, node.current_hash(), vec![], 1001);
+        let receipts = [receipt(true, call.address)];
+        node.commit_block(BlockCommit {
+            receipts: &receipts,
+            ..bare_commit(&block)
+        })
+        .unwrap();
+        assert_eq!(node.indexes().unwrap().get(&contract, "by_age"), Some(&spec));
+    }
+
+    #[test]
+    fn test_gas_report_aggregated_at_commit() {
+        let temp_dir = TempDir::new().unwrap();
+        let mut node = BachNode::new(NodeConfig::new(temp_dir.path().to_path_buf()));
+        node.init().unwrap();
+
+        let key = PrivateKey::random();
+        let contract = Address::from([0xcc; 20]);
+        let call = |nonce: u64, to: Option<Address>, data: &[u8]| {
+            let signature = key.sign(&H256::zero());
+            Transaction::new(nonce, to, U256::ZERO, data.to_vec(), signature)
+        };
+        let transactions = vec![
+            call(0, Some(contract), &[1, 2, 3, 4, 0xff]),
+            call(1, Some(contract), &[1, 2, 3, 4]),
+            call(2, Some(contract), &[9]),
+            call(3, None, &[0x60, 0x00]),
+        ];
+        let block = Block::new(1, H256::zero(), transactions, 1000);
+        let receipts: Vec<TransactionReceipt> = [30_000, 20_000, 21_000, 50_000]
+            .into_iter()
+            .enumerate()
+            .map(|(index, gas_used)| TransactionReceipt {
+                transaction_hash: *block.transactions[index].hash().as_bytes(),
+                block_hash: *block.hash().as_bytes(),
+                block_number: 1,
+                transaction_index: index as u32,
+                gas_used,
+                status: true,
+                logs: Vec::new(),
+            })
+            .collect();
+        node.commit_block(BlockCommit {
+            receipts: &receipts,
+            ..bare_commit(&block)
+        })
+        .unwrap();
+
+        let report = node.storage().unwrap().transactions.get_gas_report(1);
+        let totals: Vec<_> = report.iter().map(|u| (u.selector, u.calls, u.gas_used)).collect();
+        assert_eq!(totals, vec![(None, 1, 21_000), (Some([1, 2, 3, 4]), 2, 50_000)]);
+        assert!(report.iter().all(|usage| usage.contract_addr() == contract));
+    }
+
+    #[tokio::test]
+    async fn test_unpublished_block_events_replayed_on_start() {
+        let temp_dir = TempDir::new().unwrap();
+        let block = Block::new(1, H256::zero(), vec![], 1000);
+        {
+            // The block was committed but the node stopped before publishing
+            let storage = Storage::open(temp_dir.path()).unwrap();
+            let event = OutboxEvent {
+                block_hash: *block.hash().as_bytes(),
+                receipts: vec![],
+                changes: vec![],
+            };
+            storage.blocks.put_block_with_event(&block, &event).unwrap();
+            storage.flush().unwrap();
+        }
+
+        let mut node = BachNode::new(NodeConfig::new(temp_dir.path().to_path_buf()));
+        let mut blocks = node.msgbus().subscribe(Topic::BlockCommitted);
+        node.start().await.unwrap();
+        let received = tokio::time::timeout(Duration::from_secs(5), blocks.recv())
+            .await
+            .unwrap()
+            .unwrap();
+        let Message::BlockCommitted(info) = received else {
+            panic!("expected a committed block");
+        };
+        assert_eq!(info.block.hash(), block.hash());
+        node.stop().await.unwrap();
+    }
+
     #[tokio::test]
     async fn test_node_start_stop() {
         let temp_dir = TempDir::new().unwrap();
@@ -690,4 +3616,56 @@ mod tests {
 
         node.stop().await.unwrap();
     }
+
+    #[tokio::test]
+    async fn test_node_install_contract() {
+        let temp_dir = TempDir::new().unwrap();
+        let config = NodeConfig::new(temp_dir.path().to_path_buf())
+            .with_rpc("127.0.0.1:0".parse().unwrap());
+        let mut node = BachNode::new(config);
+        node.start().await.unwrap();
+
+        let deployer = bach_testutil::test_address(0);
+        node.set_balance(&deployer, U256::from_u64(u64::MAX)).unwrap();
+        let state = Arc::clone(node.rpc_state().unwrap());
+        let api = bach_rpc::EthApiImpl::new(Arc::clone(&state));
+        let submit = |raw: Vec<u8>| api.send_raw_transaction(bach_rpc::format_bytes(&raw));
+
+        // Init code returning the runtime code STOP, followed by a
+        // constructor argument it ignores
+        let permissions = bach_evm::MethodPermissions {
+            methods: [(
+                [1, 2, 3, 4],
+                bach_evm::MethodRule {
+                    role: bach_evm::MethodRole::Admin,
+                    orgs: Vec::new(),
+                },
+            )]
+            .into(),
+        };
+        let install = bach_evm::ContractInstall::new(vec![0x60, 0x01, 0x60, 0x00, 0xf3])
+            .with_init_args(&[0x2a; 32])
+            .with_permissions(permissions.clone())
+            .with_gas_limit(100_000);
+        let installed = bach_testutil::install_contract(0, 0, &install, submit).await.unwrap();
+        assert_eq!(installed.address, bach_evm::create_address(&deployer, 0));
+        {
+            let evm_state = state.evm_state.read().unwrap();
+            assert_eq!(evm_state.get_code(&installed.address), [0x00]);
+            assert_eq!(evm_state.method_permissions(&installed.address), Some(&permissions));
+        }
+
+        let second = bach_testutil::install_contract(0, 1, &install, submit).await.unwrap();
+        assert_ne!(second.address, installed.address);
+        assert!(!state.evm_state.read().unwrap().get_code(&second.address).is_empty());
+
+        // Out of gas, the install is pooled as failed
+        let starved = install.clone().with_gas_limit(1);
+        let failed = bach_testutil::install_contract(0, 2, &starved, submit).await.unwrap();
+        let pending = state.pending_txs.read().unwrap();
+        assert!(!pending[&failed.transaction.hash()].execution.as_ref().unwrap().success);
+        drop(pending);
+
+        node.stop().await.unwrap();
+    }
 }
@@ -2,10 +2,29 @@
 //!
 //! Command-line interface for running a BachLedger node.
 
-use bach_node::{BachNode, NodeConfig, NodeError};
-use clap::{Parser, Subcommand};
+use bach_contracts::PolicyEvaluation;
+use bach_consensus::{Validator, ValidatorSet};
+use bach_crypto::{HashAlgorithm, HashSchedule, KeyAlgorithm, MemberKey, PublicKey, SigningMember};
+use bach_node::{
+    render_error, render_list, render_one, validate_chain_config, BachNode, ChainChecker,
+    ConfigReport, Context, Devnet, DevnetConfig, FaucetClient, HealthClient, NodeConfig, NodeError,
+    OutputFormat, Plugin, Profile, RetryPolicy, Tabular, TxSubmitter, VerifyingClient,
+    DEFAULT_DEVNET_ACCOUNTS, DEFAULT_DEVNET_INTERVAL, EXIT_FAILURE, PLUGIN_PREFIX,
+};
+use bach_network::SeedSource;
+use bach_primitives::{Address, H256, U256};
+use bach_rpc::{format_h256, LogLevelHandle};
+use bach_storage::{Storage, StorageError};
+use clap::parser::ValueSource;
+use clap::{ArgMatches, CommandFactory, FromArgMatches, Parser, Subcommand};
+use serde::Serialize;
+use std::collections::BTreeSet;
+use std::ffi::OsString;
 use std::net::SocketAddr;
 use std::path::PathBuf;
+use std::process::ExitCode;
+use std::sync::Arc;
+use tracing_subscriber::{fmt, prelude::*, reload, EnvFilter};
 
 /// BachLedger Medical Blockchain Node
 #[derive(Parser)]
@@ -25,7 +44,8 @@ struct Cli {
     #[arg(long, default_value = "0.0.0.0:30303")]
     listen_addr: String,
 
-    /// Bootstrap peers (comma-separated)
+    /// Bootstrap peers (comma-separated `ip:port`, `host:port` or
+    /// `srv:<service name>`)
     #[arg(long)]
     bootnodes: Option<String>,
 
@@ -33,6 +53,11 @@ struct Cli {
     #[arg(long)]
     validator_key: Option<PathBuf>,
 
+    /// Validator public keys (comma-separated hex, as printed by `gen-key`)
+    /// whose quorum signs finality checkpoints
+    #[arg(long, value_delimiter = ',')]
+    validators: Vec<String>,
+
     /// Chain ID
     #[arg(long, default_value = "31337")]
     chain_id: u64,
@@ -45,7 +70,8 @@ struct Cli {
     #[arg(long, default_value = "true")]
     rpc: bool,
 
-    /// JSON-RPC HTTP listen address
+    /// JSON-RPC HTTP listen address, and the endpoint client commands
+    /// call, which may also be `host:port` or `srv:<service name>`
     #[arg(long, default_value = "0.0.0.0:8545")]
     rpc_addr: String,
 
@@ -56,6 +82,14 @@ struct Cli {
     /// Configuration file
     #[arg(short, long)]
     config: Option<PathBuf>,
+
+    /// Profile context to use instead of the current one
+    #[arg(long, global = true)]
+    context: Option<String>,
+
+    /// Output format
+    #[arg(short, long, global = true, value_enum, default_value_t = OutputFormat::Table)]
+    output: OutputFormat,
 }
 
 #[derive(Subcommand)]
@@ -73,182 +107,2893 @@ enum Commands {
     /// Show node information
     Info,
 
-    /// Generate a new validator key
+    /// Generate a new validator or member key
     GenKey {
-        /// Output file path
+        /// File the private key is written to
         #[arg(long, default_value = "validator.key")]
-        output: PathBuf,
+        key_file: PathBuf,
+
+        /// Key algorithm: secp256k1, ed25519 or sm2 (validators need secp256k1)
+        #[arg(long, default_value = "secp256k1")]
+        algorithm: String,
+    },
+
+    /// Show storage slots changed between two block heights
+    StateDiff {
+        /// Starting block height (exclusive)
+        #[arg(long)]
+        from: u64,
+
+        /// Ending block height (inclusive)
+        #[arg(long)]
+        to: u64,
+
+        /// Only show changes for this contract address
+        #[arg(long)]
+        contract: Option<String>,
+    },
+
+    /// Show gas used per contract method in a block, most expensive first
+    GasReport {
+        /// Block height
+        #[arg(long)]
+        height: u64,
+    },
+
+    /// Look up committed transactions by hash (one line per hash, in order)
+    GetTxs {
+        /// Transaction hashes (comma-separated)
+        #[arg(long, value_delimiter = ',', required = true)]
+        hashes: Vec<String>,
+    },
+
+    /// Look up blocks by height (one line per height, in order)
+    GetBlocks {
+        /// Block heights (comma-separated)
+        #[arg(long, value_delimiter = ',', required = true)]
+        heights: Vec<u64>,
+    },
+
+    /// Inspect committed chain data
+    Query {
+        #[command(subcommand)]
+        action: QueryCommand,
+    },
+
+    /// Maintenance tools for the local data directory
+    Util {
+        #[command(subcommand)]
+        action: UtilCommand,
+    },
+
+    /// Run a throwaway single-node chain for contract development
+    Devnet {
+        #[command(subcommand)]
+        action: DevnetCommand,
+    },
+
+    /// Request gas from a test network's faucet
+    Faucet {
+        #[command(subcommand)]
+        action: FaucetCommand,
+    },
+
+    /// Submit a signed raw transaction to `--rpc-addr`, retrying transient
+    /// failures without submitting it twice
+    Submit {
+        /// Raw transaction bytes (hex)
+        raw: String,
+
+        /// Attempts in total before giving up
+        #[arg(long, default_value = "5")]
+        max_attempts: u32,
+    },
+
+    /// Show a running node's health: syncing, participating or degraded
+    Health,
+
+    /// Fetch a block or receipt from a node and check it against validator
+    /// trust roots instead of trusting the node
+    Verify {
+        /// Validator public keys (comma-separated hex, as printed by
+        /// `gen-key`); checkpoints must carry a quorum of them
+        #[arg(long, value_delimiter = ',', required = true)]
+        validators: Vec<String>,
+
+        /// Block hash migrations of the chain as HEIGHT:ALGORITHM
+        /// (comma-separated, e.g. 1000:sm3); blocks are Keccak-256 before
+        /// the first
+        #[arg(long, value_delimiter = ',')]
+        hash_migrations: Vec<String>,
+
+        #[command(subcommand)]
+        action: VerifyCommand,
+    },
+
+    /// Issue a short-lived RPC access token signed by a member key
+    AuthToken {
+        /// Member private key file (default: the context's member key)
+        #[arg(long)]
+        key: Option<PathBuf>,
+
+        /// Token lifetime in seconds
+        #[arg(long, default_value = "900")]
+        ttl: u64,
+
+        /// Node the token is for: its `rpc_auth_audience`, or else its
+        /// validator address
+        #[arg(long)]
+        audience: String,
+    },
+
+    /// Inspect chain config versions and prepare parameter reverts
+    ChainConfig {
+        #[command(subcommand)]
+        action: ChainConfigCommand,
+    },
+
+    /// Publish and inspect member key revocation lists
+    Revocation {
+        #[command(subcommand)]
+        action: RevocationCommand,
+    },
+
+    /// Register and resolve DID members
+    Did {
+        #[command(subcommand)]
+        action: DidCommand,
+    },
+
+    /// Print a shell completion script (e.g. `source <(bach-node completion bash)`)
+    Completion {
+        /// Shell to generate the script for
+        #[arg(value_enum)]
+        shell: clap_complete::Shell,
     },
+
+    /// List `bach-node-<name>` plugins found on PATH
+    Plugins,
+
+    /// Manage profile contexts (~/.bach/config.toml)
+    Config {
+        #[command(subcommand)]
+        action: ConfigCommand,
+    },
+
+    /// Runs the `bach-node-<name>` plugin on PATH
+    #[command(external_subcommand)]
+    Plugin(Vec<OsString>),
 }
 
-#[tokio::main]
-async fn main() -> Result<(), NodeError> {
-    let cli = Cli::parse();
-
-    // Initialize logging
-    tracing_subscriber::fmt()
-        .with_env_filter(
-            tracing_subscriber::EnvFilter::try_from_default_env()
-                .unwrap_or_else(|_| tracing_subscriber::EnvFilter::new(&cli.log_level)),
-        )
-        .init();
+#[derive(Subcommand)]
+enum ConfigCommand {
+    /// List contexts, marking the current one
+    GetContexts,
 
-    // Load config from file if specified, otherwise use CLI args
-    let config = if let Some(config_path) = cli.config {
-        NodeConfig::from_file(&config_path)?
-    } else {
-        build_config_from_cli(&cli)?
-    };
+    /// Show the current context
+    CurrentContext,
 
-    match cli.command {
-        Some(Commands::Init { genesis }) => {
-            init_node(&config, genesis.as_deref()).await?;
-        }
-        Some(Commands::Info) => {
-            show_info(&config).await?;
-        }
-        Some(Commands::GenKey { output }) => {
-            generate_key(&output)?;
-        }
-        Some(Commands::Run) | None => {
-            run_node(config).await?;
-        }
-    }
+    /// Make a context the current one
+    UseContext {
+        /// Context name
+        name: String,
+    },
 
-    Ok(())
+    /// Create a context or update its settings
+    SetContext {
+        /// Context name
+        name: String,
+
+        /// Organization the context acts for
+        #[arg(long)]
+        org: Option<String>,
+
+        /// Node configuration file
+        #[arg(long = "node-config")]
+        config: Option<PathBuf>,
+
+        /// Data directory for blockchain storage
+        #[arg(long)]
+        data_dir: Option<PathBuf>,
+
+        /// JSON-RPC endpoint (`ip:port`, `host:port` or `srv:<service name>`)
+        #[arg(long)]
+        rpc_addr: Option<String>,
+
+        /// Chain ID
+        #[arg(long)]
+        chain_id: Option<u64>,
+
+        /// Validator private key file
+        #[arg(long)]
+        validator_key: Option<PathBuf>,
+
+        /// Member private key file
+        #[arg(long)]
+        member_key: Option<PathBuf>,
+    },
+
+    /// Remove a context
+    DeleteContext {
+        /// Context name
+        name: String,
+    },
 }
 
-fn build_config_from_cli(cli: &Cli) -> Result<NodeConfig, NodeError> {
-    let listen_addr: SocketAddr = cli.listen_addr.parse().map_err(|e| {
-        NodeError::ConfigError(format!("Invalid listen address: {}", e))
-    })?;
+#[derive(Subcommand)]
+enum QueryCommand {
+    /// Show a block's header and transactions, and optionally the
+    /// dependency DAG its transactions were executed by
+    Block {
+        /// Block height
+        #[arg(long)]
+        height: u64,
 
-    let rpc_addr: SocketAddr = cli.rpc_addr.parse().map_err(|e| {
-        NodeError::ConfigError(format!("Invalid RPC address: {}", e))
-    })?;
+        /// Also render the transaction dependency DAG as a Graphviz digraph
+        #[arg(long)]
+        dag: bool,
 
-    let bootstrap_peers: Vec<SocketAddr> = cli
-        .bootnodes
-        .as_ref()
-        .map(|s| {
-            s.split(',')
-                .filter_map(|addr| addr.trim().parse().ok())
-                .collect()
-        })
-        .unwrap_or_default();
+        /// Write the DAG to this `.dot` file instead of stdout
+        #[arg(long, requires = "dag")]
+        dot: Option<PathBuf>,
+    },
+    /// Show the latest validator-signed finality checkpoint
+    Checkpoint {
+        /// Show the latest checkpoint at or below this height instead
+        #[arg(long)]
+        height: Option<u64>,
+    },
+}
 
-    let validator_key = if let Some(ref key_path) = cli.validator_key {
-        let key_hex = std::fs::read_to_string(key_path).map_err(|e| {
-            NodeError::ConfigError(format!("Failed to read validator key: {}", e))
-        })?;
-        let key_bytes = hex::decode(key_hex.trim()).map_err(|e| {
-            NodeError::ConfigError(format!("Invalid key format: {}", e))
-        })?;
-        if key_bytes.len() != 32 {
-            return Err(NodeError::ConfigError("Key must be 32 bytes".to_string()));
-        }
-        let mut key = [0u8; 32];
-        key.copy_from_slice(&key_bytes);
-        Some(key)
-    } else {
-        None
-    };
+#[derive(Subcommand)]
+enum VerifyCommand {
+    /// Verify a block's hash and its link to a finality checkpoint
+    Block {
+        /// Block height
+        #[arg(long)]
+        height: u64,
+    },
+    /// Verify that a transaction's receipt names a block that includes it
+    Receipt {
+        /// Transaction hash
+        #[arg(long)]
+        hash: String,
+    },
+}
 
-    let mut config = NodeConfig::new(cli.data_dir.clone())
-        .with_listen_addr(listen_addr)
-        .with_bootstrap_peers(bootstrap_peers)
-        .with_chain_id(cli.chain_id);
+#[derive(Subcommand)]
+enum UtilCommand {
+    /// Check the stored chain for corruption: hash links, headers and
+    /// their transactions hashes, write sets, results and finality
+    /// checkpoints. Exits with an error if any height is corrupt
+    Fsck {
+        /// First height to check
+        #[arg(long, default_value_t = 0)]
+        from: u64,
 
-    if let Some(key) = validator_key {
-        config = config.with_validator_key(key);
-    }
+        /// Last height to check (default: the head)
+        #[arg(long)]
+        to: Option<u64>,
 
-    if cli.rpc {
-        config = config.with_rpc(rpc_addr);
-    }
+        /// Validator public keys (comma-separated hex, as printed by
+        /// `gen-key`); checkpoints must carry a quorum of them
+        #[arg(long, value_delimiter = ',')]
+        validators: Option<Vec<String>>,
 
-    config.block_time_ms = cli.block_time;
+        /// Quarantine corrupt heights so they are no longer served to
+        /// syncing peers
+        #[arg(long)]
+        quarantine: bool,
+    },
 
-    Ok(config)
+    /// Check node and chain config files before deployment: values out
+    /// of range, missing settings, unknown keys and deprecated settings.
+    /// Exits with an error if either file has errors
+    ValidateConfig {
+        /// Node config file (TOML)
+        #[arg(long)]
+        node: Option<PathBuf>,
+
+        /// Chain config file (JSON)
+        #[arg(long)]
+        chain: Option<PathBuf>,
+    },
 }
 
-async fn run_node(config: NodeConfig) -> Result<(), NodeError> {
-    tracing::info!("Starting BachLedger node");
-    tracing::info!("Chain ID: {}", config.chain_id);
-    tracing::info!("Data directory: {:?}", config.data_dir);
-    tracing::info!("P2P address: {}", config.listen_addr);
+#[derive(Subcommand)]
+enum DevnetCommand {
+    /// Start an in-memory SOLO chain with funded accounts; transactions are
+    /// sealed into blocks as they arrive and nothing is kept on exit
+    Up {
+        /// JSON-RPC listen address
+        #[arg(long, default_value = "127.0.0.1:8545")]
+        addr: SocketAddr,
 
-    if config.rpc_enabled {
-        tracing::info!("RPC address: {:?}", config.rpc_addr);
-    }
+        /// Number of funded accounts
+        #[arg(long, default_value_t = DEFAULT_DEVNET_ACCOUNTS)]
+        accounts: usize,
 
-    let mut node = BachNode::new(config);
-    node.start().await?;
+        /// Balance of each account, in whole tokens (10^18 wei)
+        #[arg(long, default_value = "10000")]
+        balance: u64,
 
-    tracing::info!("Node started successfully");
+        /// Directory of compiled `*.bin` contracts, deployed on start and
+        /// redeployed whenever a file changes
+        #[arg(long)]
+        contracts: Option<PathBuf>,
 
-    // Wait for shutdown signal
-    tokio::signal::ctrl_c()
-        .await
-        .expect("Failed to listen for ctrl+c");
+        /// Maintain a state commitment in block headers, served with proofs
+        /// by `bach_getStateProof`
+        #[arg(long)]
+        state_commitment: bool,
+    },
+}
 
-    tracing::info!("Shutdown signal received");
-    node.stop().await?;
+#[derive(Subcommand)]
+enum FaucetCommand {
+    /// Ask the node at `--rpc-addr` to grant gas; each address is granted
+    /// at most once per window set in the chain config
+    Request {
+        /// Address to fund (default: the context's member key)
+        #[arg(long)]
+        address: Option<String>,
+    },
+}
 
-    tracing::info!("Node stopped");
-    Ok(())
+#[derive(Subcommand)]
+enum ChainConfigCommand {
+    /// List config versions and the height each took effect
+    History,
+
+    /// Show the parameters in force at a height (default: latest)
+    Show {
+        /// Block height
+        #[arg(long)]
+        height: Option<u64>,
+    },
+
+    /// Show the parameters that differ between two versions
+    Diff {
+        /// Older version
+        from: u64,
+
+        /// Newer version
+        to: u64,
+    },
+
+    /// Prepare an update transaction restoring a parameter to its value in
+    /// an earlier version
+    Revert {
+        /// Parameter name
+        param: String,
+
+        /// Version holding the value to restore
+        #[arg(long = "to-version")]
+        version: u64,
+    },
+
+    /// Show each org's admin keys and staged rotations at a height
+    /// (default: latest)
+    Admins {
+        /// Block height
+        #[arg(long)]
+        height: Option<u64>,
+    },
+
+    /// Prepare a transaction staging a rotation of an org's admin key
+    StageRotation {
+        /// Org whose admin key is rotated
+        org: String,
+
+        /// Address of the new admin key
+        #[arg(long = "new-key")]
+        new_key: String,
+
+        /// First height the new key is honored
+        #[arg(long = "activation-height")]
+        activation_height: u64,
+    },
+
+    /// Prepare a transaction endorsing an org's staged admin key rotation
+    EndorseRotation {
+        /// Org whose rotation is endorsed
+        org: String,
+    },
+
+    /// Check whether endorsements from the given members would satisfy the
+    /// policy guarding a resource in the next block
+    Simulate {
+        /// Policy resource: `config`, `rotation.<org>`, `acl.<contract>` or
+        /// `pause.<contract>`
+        resource: String,
+
+        /// Endorsing members (addresses or DIDs)
+        #[arg(long, value_delimiter = ',')]
+        members: Vec<String>,
+
+        /// Org owning the contract of an `acl.` or `pause.` resource
+        #[arg(long)]
+        owner: Option<String>,
+    },
+
+    /// Show protocol features: the orgs that signaled support, whether
+    /// they are a majority, activation and support by this build
+    Features,
+
+    /// Prepare a transaction signaling the protocol features the org's
+    /// nodes support
+    SignalFeatures {
+        /// Supported features (comma-separated; default: the features this
+        /// build implements)
+        #[arg(long, value_delimiter = ',')]
+        features: Option<Vec<String>>,
+    },
 }
 
-async fn init_node(config: &NodeConfig, _genesis: Option<&std::path::Path>) -> Result<(), NodeError> {
-    tracing::info!("Initializing new node at {:?}", config.data_dir);
+#[derive(Subcommand)]
+enum RevocationCommand {
+    /// Sign a revocation list with an issuer key and print the transaction
+    /// uploading it, replacing the issuer's previous list
+    Upload {
+        /// Issuer private key file
+        #[arg(long)]
+        key: PathBuf,
 
-    // Create data directory
-    std::fs::create_dir_all(&config.data_dir)?;
+        /// List sequence number; must exceed the issuer's previous list
+        #[arg(long)]
+        sequence: u64,
 
-    // Initialize storage
-    let mut node = BachNode::new(config.clone());
-    node.init()?;
+        /// Revoked member addresses (comma-separated; empty clears the list)
+        #[arg(long, value_delimiter = ',')]
+        revoke: Vec<String>,
+    },
 
-    tracing::info!("Node initialized successfully");
-    Ok(())
+    /// Show whether a member address is revoked and by which issuers
+    Query {
+        /// Member address
+        address: String,
+    },
+
+    /// List the current revocation list of each issuer
+    List,
 }
 
-async fn show_info(config: &NodeConfig) -> Result<(), NodeError> {
-    println!("BachLedger Node Configuration");
-    println!("==============================");
-    println!("Data directory: {:?}", config.data_dir);
-    println!("Chain ID: {}", config.chain_id);
-    println!("P2P address: {}", config.listen_addr);
-    println!("Bootstrap peers: {:?}", config.bootstrap_peers);
-    println!("RPC enabled: {}", config.rpc_enabled);
-    if let Some(ref addr) = config.rpc_addr {
-        println!("RPC address: {}", addr);
-    }
-    println!("Block time: {}ms", config.block_time_ms);
-    println!("Max transactions per block: {}", config.max_txs_per_block);
-    println!("Validator: {}", config.validator_key.is_some());
+#[derive(Subcommand)]
+enum DidCommand {
+    /// Sign a DID document with a controller key and print the transaction
+    /// recording it, creating the DID or replacing its current document
+    Register {
+        /// The DID, e.g. did:bach:hospital-a
+        did: String,
 
-    Ok(())
+        /// Private key file of a controller (for updates, a controller of
+        /// the current document)
+        #[arg(long)]
+        key: PathBuf,
+
+        /// Document version; must exceed the current document's
+        #[arg(long)]
+        version: u64,
+
+        /// Addresses of the keys acting for the DID (comma-separated;
+        /// defaults to the signing key)
+        #[arg(long = "keys", value_delimiter = ',')]
+        keys: Vec<String>,
+
+        /// Addresses allowed to change the document (comma-separated;
+        /// defaults to the DID's keys)
+        #[arg(long = "controllers", value_delimiter = ',')]
+        controllers: Vec<String>,
+
+        /// Service endpoint as `<id>:<type>:<endpoint>` (repeatable)
+        #[arg(long = "service")]
+        services: Vec<String>,
+
+        /// Roles held by the DID member (comma-separated)
+        #[arg(long = "roles", value_delimiter = ',')]
+        roles: Vec<String>,
+    },
+
+    /// Sign a DID's final document and print the transaction permanently
+    /// deactivating it
+    Deactivate {
+        /// The DID
+        did: String,
+
+        /// Private key file of a controller of the current document
+        #[arg(long)]
+        key: PathBuf,
+
+        /// Final document version; must exceed the current document's
+        #[arg(long)]
+        version: u64,
+    },
+
+    /// Show the keys, services and roles a DID resolves to
+    Resolve {
+        /// The DID
+        did: String,
+    },
+
+    /// List every registered DID
+    List,
 }
 
-fn generate_key(output: &PathBuf) -> Result<(), NodeError> {
-    use bach_crypto::PrivateKey;
+#[tokio::main]
+async fn main() -> ExitCode {
+    let matches = Cli::command().get_matches();
+    let cli = Cli::from_arg_matches(&matches).unwrap_or_else(|e| e.exit());
+    let output = cli.output;
+
+    match run(cli, &matches).await {
+        Ok(()) => ExitCode::SUCCESS,
+        Err(e) => {
+            eprintln!("{}", render_error(output, &e));
+            ExitCode::from(e.exit_code())
+        }
+    }
+}
+
+async fn run(mut cli: Cli, matches: &ArgMatches) -> Result<(), NodeError> {
+    // Initialize logging (the filter can be swapped at runtime via admin_setLogLevel)
+    let filter = EnvFilter::try_from_default_env()
+        .unwrap_or_else(|_| EnvFilter::new(&cli.log_level));
+    let (filter, filter_handle) = reload::Layer::new(filter);
+    tracing_subscriber::registry()
+        .with(filter)
+        .with(fmt::layer())
+        .init();
+    let log_level: LogLevelHandle = Arc::new(move |directives: &str| {
+        let filter = EnvFilter::try_new(directives).map_err(|e| e.to_string())?;
+        filter_handle.reload(filter).map_err(|e| e.to_string())
+    });
 
-    tracing::info!("Generating new validator key");
+    // Profile commands must work even if the current context is broken
+    let profile_path = Profile::default_path();
+    if let Some(Commands::Config { action }) = cli.command {
+        let path = profile_path.ok_or_else(|| {
+            NodeError::ConfigError("Cannot locate profile: HOME is not set".to_string())
+        })?;
+        return manage_profile(&path, action, cli.output);
+    }
+    if let Some(Commands::Completion { shell }) = cli.command {
+        let mut command = Cli::command();
+        clap_complete::generate(shell, &mut command, "bach-node", &mut std::io::stdout());
+        return Ok(());
+    }
 
-    let key = PrivateKey::random();
-    let key_bytes = key.to_bytes();
-    let key_hex = hex::encode(&key_bytes);
+    // Options not given on the command line come from the profile context
+    let profile = match &profile_path {
+        Some(path) => Profile::load(path)?,
+        None => Profile::default(),
+    };
+    let member_key = match profile.resolve(cli.context.as_deref())? {
+        Some(context) => {
+            apply_context(&mut cli, matches, context);
+            context.member_key.clone()
+        }
+        None => None,
+    };
 
-    std::fs::write(output, &key_hex)?;
+    match cli.command.take() {
+        Some(Commands::Plugins) => return list_plugins(cli.output),
+        Some(Commands::Plugin(args)) => {
+            let context = cli.context.clone().or(profile.current_context.clone());
+            let code = run_plugin(&cli, context, &args)?;
+            std::process::exit(code);
+        }
+        command => cli.command = command,
+    }
 
-    let address = key.public_key().to_address();
-    let pubkey = key.public_key().to_bytes();
+    // Load config from file if specified, otherwise use CLI args
+    let config = if let Some(config_path) = cli.config.clone() {
+        NodeConfig::load(&config_path)?
+    } else {
+        build_config_from_cli(&cli)?
+    };
 
-    println!("Validator key generated successfully");
-    println!("Private key saved to: {:?}", output);
-    println!("Address: 0x{}", hex::encode(address.as_bytes()));
-    println!("Public key: 0x04{}", hex::encode(&pubkey));
+    let output = cli.output;
+    match cli.command {
+        Some(Commands::Init { genesis }) => {
+            init_node(&config, genesis.as_deref()).await?;
+        }
+        Some(Commands::Info) => {
+            show_info(&config, output).await?;
+        }
+        Some(Commands::GenKey { key_file, algorithm }) => {
+            generate_key(&key_file, &algorithm, output)?;
+        }
+        Some(Commands::StateDiff { from, to, contract }) => {
+            show_state_diff(&config, from, to, contract.as_deref(), output)?;
+        }
+        Some(Commands::GasReport { height }) => {
+            show_gas_report(&config, height, output)?;
+        }
+        Some(Commands::GetTxs { hashes }) => {
+            show_transactions(&config, &hashes, output)?;
+        }
+        Some(Commands::GetBlocks { heights }) => {
+            show_blocks(&config, &heights, output)?;
+        }
+        Some(Commands::Query { action }) => {
+            query(&config, action, output)?;
+        }
+        Some(Commands::Util { action }) => {
+            util(&config, action, output)?;
+        }
+        Some(Commands::ChainConfig { action }) => {
+            show_chain_config(&config, action, output)?;
+        }
+        Some(Commands::Revocation { action }) => {
+            manage_revocations(&config, action, output)?;
+        }
+        Some(Commands::Did { action }) => {
+            manage_dids(&config, action, output)?;
+        }
+        Some(Commands::Devnet { action }) => {
+            devnet(&config, action, output).await?;
+        }
+        Some(Commands::Faucet { action }) => {
+            request_faucet(&cli.rpc_addr, action, member_key, output).await?;
+        }
+        Some(Commands::Submit { raw, max_attempts }) => {
+            submit_tx(&cli.rpc_addr, &raw, max_attempts, output).await?;
+        }
+        Some(Commands::Health) => {
+            show_health(&cli.rpc_addr, output).await?;
+        }
+        Some(Commands::Verify {
+            validators,
+            hash_migrations,
+            action,
+        }) => {
+            verify(&cli.rpc_addr, &validators, &hash_migrations, action, output).await?;
+        }
+        Some(Commands::AuthToken { key, ttl, audience }) => {
+            let key = key.or(member_key).ok_or_else(|| {
+                NodeError::ConfigError("No --key given and no member key in context".to_string())
+            })?;
+            let audience = bach_rpc::TokenAudience::new(cli.chain_id, audience);
+            issue_auth_token(&key, &audience, ttl, output)?;
+        }
+        Some(Commands::Config { .. })
+        | Some(Commands::Completion { .. })
+        | Some(Commands::Plugins)
+        | Some(Commands::Plugin(_)) => unreachable!("handled above"),
+        Some(Commands::Run) | None => {
+            run_node(config, log_level).await?;
+        }
+    }
+
+    Ok(())
+}
+
+/// Fills options left at their defaults from the profile context.
+fn apply_context(cli: &mut Cli, matches: &ArgMatches, context: &Context) {
+    let defaulted = |id: &str| matches.value_source(id) != Some(ValueSource::CommandLine);
+
+    if let Some(data_dir) = context.data_dir.clone().filter(|_| defaulted("data_dir")) {
+        cli.data_dir = data_dir;
+    }
+    if let Some(rpc_addr) = context.rpc_addr.clone().filter(|_| defaulted("rpc_addr")) {
+        cli.rpc_addr = rpc_addr;
+    }
+    if let Some(chain_id) = context.chain_id.filter(|_| defaulted("chain_id")) {
+        cli.chain_id = chain_id;
+    }
+    if cli.validator_key.is_none() {
+        cli.validator_key = context.validator_key.clone();
+    }
+    if cli.config.is_none() {
+        cli.config = context.config.clone();
+    }
+}
+
+/// `config get-contexts` entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct ContextEntry {
+    name: String,
+    current: bool,
+    org: Option<String>,
+    rpc_addr: Option<String>,
+    data_dir: Option<PathBuf>,
+    chain_id: Option<u64>,
+}
+
+impl ContextEntry {
+    fn new(name: &str, current: bool, context: &Context) -> Self {
+        Self {
+            name: name.to_string(),
+            current,
+            org: context.org.clone(),
+            rpc_addr: context.rpc_addr.clone(),
+            data_dir: context.data_dir.clone(),
+            chain_id: context.chain_id,
+        }
+    }
+}
+
+impl Tabular for ContextEntry {
+    const HEADERS: &'static [&'static str] =
+        &["CURRENT", "NAME", "ORG", "RPC ADDRESS", "CHAIN ID"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            if self.current { "*" } else { "" }.to_string(),
+            self.name.clone(),
+            self.org.clone().unwrap_or_default(),
+            self.rpc_addr.clone().unwrap_or_default(),
+            self.chain_id.map(|id| id.to_string()).unwrap_or_default(),
+        ]
+    }
+}
+
+fn manage_profile(
+    path: &std::path::Path,
+    action: ConfigCommand,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let mut profile = Profile::load(path)?;
+
+    match action {
+        ConfigCommand::GetContexts => {
+            let entries: Vec<ContextEntry> = profile
+                .contexts
+                .iter()
+                .map(|(name, context)| {
+                    let current = profile.current_context.as_ref() == Some(name);
+                    ContextEntry::new(name, current, context)
+                })
+                .collect();
+            println!("{}", render_list(output, &entries)?);
+            return Ok(());
+        }
+        ConfigCommand::CurrentContext => {
+            let current = profile.current_context.as_ref().and_then(|name| {
+                profile
+                    .contexts
+                    .get(name)
+                    .map(|context| ContextEntry::new(name, true, context))
+            });
+            match current {
+                Some(entry) => println!("{}", render_one(output, &entry)?),
+                None => eprintln!("No current context set"),
+            }
+            return Ok(());
+        }
+        ConfigCommand::UseContext { name } => {
+            profile.use_context(&name)?;
+            eprintln!("Switched to context {}", name);
+        }
+        ConfigCommand::SetContext {
+            name,
+            org,
+            config,
+            data_dir,
+            rpc_addr,
+            chain_id,
+            validator_key,
+            member_key,
+        } => {
+            let context = Context {
+                org,
+                config,
+                data_dir,
+                rpc_addr,
+                chain_id,
+                validator_key,
+                member_key,
+            };
+            profile.set_context(&name, context);
+            eprintln!("Context {} saved", name);
+        }
+        ConfigCommand::DeleteContext { name } => {
+            profile.delete_context(&name)?;
+            eprintln!("Context {} deleted", name);
+        }
+    }
+
+    profile.save(path)
+}
+
+/// `plugins` entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct PluginEntry {
+    name: String,
+    path: PathBuf,
+}
+
+impl Tabular for PluginEntry {
+    const HEADERS: &'static [&'static str] = &["NAME", "PATH"];
+
+    fn row(&self) -> Vec<String> {
+        vec![self.name.clone(), self.path.display().to_string()]
+    }
+}
+
+fn list_plugins(output: OutputFormat) -> Result<(), NodeError> {
+    let entries: Vec<PluginEntry> = Plugin::discover()
+        .into_iter()
+        .map(|plugin| PluginEntry {
+            name: plugin.name,
+            path: plugin.path,
+        })
+        .collect();
+    println!("{}", render_list(output, &entries)?);
+    Ok(())
+}
+
+/// Runs a plugin with the effective settings in its environment and returns
+/// its exit code.
+fn run_plugin(cli: &Cli, context: Option<String>, args: &[OsString]) -> Result<i32, NodeError> {
+    let (name, args) = args
+        .split_first()
+        .ok_or_else(|| NodeError::ConfigError("Missing plugin name".to_string()))?;
+    let name = name.to_string_lossy();
+    let plugin = Plugin::find(&name).ok_or_else(|| {
+        NodeError::ConfigError(format!(
+            "Unknown command '{}' (no {}{} on PATH)",
+            name, PLUGIN_PREFIX, name
+        ))
+    })?;
+
+    let mut env = vec![
+        ("BACH_DATA_DIR", cli.data_dir.display().to_string()),
+        ("BACH_RPC_ADDR", cli.rpc_addr.clone()),
+        ("BACH_CHAIN_ID", cli.chain_id.to_string()),
+        ("BACH_OUTPUT", cli.output.as_str().to_string()),
+    ];
+    if let Some(context) = context {
+        env.push(("BACH_CONTEXT", context));
+    }
+
+    let status = plugin.run(args, &env)?;
+    // A plugin killed by a signal has no exit code
+    Ok(status.code().unwrap_or(EXIT_FAILURE as i32))
+}
+
+fn build_config_from_cli(cli: &Cli) -> Result<NodeConfig, NodeError> {
+    let listen_addr: SocketAddr = cli.listen_addr.parse().map_err(|e| {
+        NodeError::ConfigError(format!("Invalid listen address: {}", e))
+    })?;
+
+    let rpc_addr: SocketAddr = cli.rpc_addr.parse().map_err(|e| {
+        NodeError::ConfigError(format!("Invalid RPC address: {}", e))
+    })?;
+
+    let mut bootstrap_peers = Vec::new();
+    let mut seeds = Vec::new();
+    for entry in cli.bootnodes.iter().flat_map(|s| s.split(',')) {
+        match entry.parse::<SeedSource>() {
+            Ok(SeedSource::Addr(addr)) => bootstrap_peers.push(addr),
+            Ok(seed) => seeds.push(seed.to_string()),
+            Err(e) => {
+                return Err(NodeError::ConfigError(format!("Invalid bootnode {}: {}", entry, e)));
+            }
+        }
+    }
+
+    let validator_key = match cli.validator_key {
+        Some(ref key_path) => Some(read_key_file(key_path)?),
+        None => None,
+    };
+
+    let mut config = NodeConfig::new(cli.data_dir.clone())
+        .with_listen_addr(listen_addr)
+        .with_bootstrap_peers(bootstrap_peers)
+        .with_seeds(seeds)
+        .with_chain_id(cli.chain_id);
+
+    if let Some(key) = validator_key {
+        config = config.with_validator_key(key);
+    }
+    if !cli.validators.is_empty() {
+        config = config.with_validator_set(parse_validator_set(&cli.validators)?);
+    }
+
+    if cli.rpc {
+        config = config.with_rpc(rpc_addr);
+    }
+
+    config.block_time_ms = cli.block_time;
+
+    Ok(config)
+}
+
+async fn run_node(config: NodeConfig, log_level: LogLevelHandle) -> Result<(), NodeError> {
+    tracing::info!("Starting BachLedger node");
+    tracing::info!("Chain ID: {}", config.chain_id);
+    tracing::info!("Data directory: {:?}", config.data_dir);
+    tracing::info!("P2P address: {}", config.listen_addr);
+
+    if config.rpc_enabled {
+        tracing::info!("RPC address: {:?}", config.rpc_addr);
+    }
+
+    let mut node = BachNode::new(config);
+    node.set_log_level_handle(log_level);
+    node.start().await?;
+
+    tracing::info!("Node started successfully");
+
+    // Wait for shutdown signal
+    tokio::signal::ctrl_c()
+        .await
+        .expect("Failed to listen for ctrl+c");
+
+    tracing::info!("Shutdown signal received");
+    node.stop().await?;
+
+    tracing::info!("Node stopped");
+    Ok(())
+}
+
+/// `devnet up` account entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct DevAccountEntry {
+    address: String,
+    private_key: String,
+    balance: String,
+}
+
+impl Tabular for DevAccountEntry {
+    const HEADERS: &'static [&'static str] = &["ADDRESS", "PRIVATE KEY", "BALANCE (WEI)"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.address.clone(),
+            self.private_key.clone(),
+            self.balance.clone(),
+        ]
+    }
+}
+
+async fn devnet(
+    config: &NodeConfig,
+    action: DevnetCommand,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let DevnetCommand::Up {
+        addr,
+        accounts,
+        balance,
+        contracts,
+        state_commitment,
+    } = action;
+    let devnet_config = DevnetConfig {
+        chain_id: config.chain_id,
+        rpc_addr: addr,
+        accounts,
+        balance: U256::from(balance as u128 * 1_000_000_000_000_000_000),
+        contracts_dir: contracts,
+        chain_config: Vec::new(),
+        state_commitment,
+    };
+    let mut devnet = Devnet::start(devnet_config.clone()).await?;
+
+    let entries: Vec<DevAccountEntry> = devnet
+        .accounts()
+        .iter()
+        .map(|account| DevAccountEntry {
+            address: format!("0x{}", hex::encode(account.address.as_bytes())),
+            private_key: format!("0x{}", hex::encode(account.key.to_bytes())),
+            balance: devnet_config.balance.to_string(),
+        })
+        .collect();
+    println!("{}", render_list(output, &entries)?);
+    eprintln!(
+        "Devnet (chain {}) serving JSON-RPC on {}; press Ctrl+C to stop",
+        devnet_config.chain_id, addr
+    );
+
+    let shutdown = tokio::signal::ctrl_c();
+    tokio::pin!(shutdown);
+    let mut ticker = tokio::time::interval(DEFAULT_DEVNET_INTERVAL);
+    loop {
+        tokio::select! {
+            _ = &mut shutdown => break,
+            _ = ticker.tick() => {
+                for deployment in devnet.redeploy_changed()? {
+                    eprintln!(
+                        "Deployed {} at 0x{}",
+                        deployment.path.display(),
+                        hex::encode(deployment.address.as_bytes())
+                    );
+                }
+                if let Some(report) = devnet.propose()? {
+                    eprintln!(
+                        "Sealed block {} with {} transactions",
+                        report.height, report.tx_count
+                    );
+                }
+            }
+        }
+    }
+
+    devnet.stop().await?;
+    eprintln!("Devnet stopped; its chain was discarded");
+    Ok(())
+}
+
+/// `faucet request` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct FaucetGrantEntry {
+    recipient: String,
+    amount: String,
+    next_grant_at: u64,
+    transaction_hash: String,
+}
+
+impl Tabular for FaucetGrantEntry {
+    const HEADERS: &'static [&'static str] =
+        &["RECIPIENT", "AMOUNT (WEI)", "NEXT GRANT AT", "TRANSACTION"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.recipient.clone(),
+            self.amount.clone(),
+            self.next_grant_at.to_string(),
+            self.transaction_hash.clone(),
+        ]
+    }
+}
+
+async fn request_faucet(
+    rpc_addr: &str,
+    action: FaucetCommand,
+    member_key: Option<PathBuf>,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let FaucetCommand::Request { address } = action;
+    let address = match (address, member_key) {
+        (Some(address), _) => Address::from_hex(&address)
+            .map_err(|_| NodeError::ConfigError(format!("Invalid address: {}", address)))?,
+        (None, Some(key_path)) => read_member_key(&key_path)?.address(),
+        (None, None) => {
+            return Err(NodeError::ConfigError(
+                "No --address given and no member key in context".to_string(),
+            ))
+        }
+    };
+
+    let grant = FaucetClient::new(rpc_addr).request(address).await?;
+    let invalid = |e: bach_rpc::RpcError| {
+        NodeError::ConfigError(format!("invalid faucet response: {}", e))
+    };
+    let entry = FaucetGrantEntry {
+        amount: bach_rpc::parse_u256(&grant.amount).map_err(invalid)?.to_string(),
+        next_grant_at: bach_rpc::parse_u64(&grant.next_grant_at).map_err(invalid)?,
+        recipient: grant.recipient,
+        transaction_hash: grant.transaction_hash,
+    };
+    println!("{}", render_one(output, &entry)?);
+    Ok(())
+}
+
+/// `submit` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct SubmitEntry {
+    transaction_hash: String,
+    attempts: u32,
+    committed: bool,
+}
+
+impl Tabular for SubmitEntry {
+    const HEADERS: &'static [&'static str] = &["TRANSACTION", "ATTEMPTS", "COMMITTED"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.transaction_hash.clone(),
+            self.attempts.to_string(),
+            self.committed.to_string(),
+        ]
+    }
+}
+
+async fn submit_tx(
+    rpc_addr: &str,
+    raw: &str,
+    max_attempts: u32,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let tx = hex::decode(raw.trim_start_matches("0x"))
+        .ok()
+        .and_then(|bytes| bach_types::Transaction::decode(&bytes).ok())
+        .ok_or_else(|| NodeError::ConfigError(format!("Invalid raw transaction: {}", raw)))?;
+    let policy = RetryPolicy {
+        max_attempts: max_attempts.max(1),
+        ..RetryPolicy::default()
+    };
+    let submitted = TxSubmitter::new(rpc_addr)
+        .with_policy(policy)
+        .submit(&tx)
+        .await?;
+    let entry = SubmitEntry {
+        transaction_hash: format_h256(&submitted.tx_id),
+        attempts: submitted.attempts,
+        committed: submitted.committed,
+    };
+    println!("{}", render_one(output, &entry)?);
+    Ok(())
+}
+
+/// `health` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct HealthEntry {
+    status: String,
+    ready: bool,
+    validator: bool,
+    block_height: u64,
+    blocks_behind: u64,
+    quorum_failures: u64,
+    proposal_backoff: u64,
+    clock_drift: i64,
+    timestamp_rejections: u64,
+    requeued_txs: u64,
+    warmup_remaining: u64,
+}
+
+impl Tabular for HealthEntry {
+    const HEADERS: &'static [&'static str] = &[
+        "STATUS",
+        "READY",
+        "VALIDATOR",
+        "HEIGHT",
+        "BLOCKS BEHIND",
+        "QUORUM FAILURES",
+        "PROPOSAL BACKOFF",
+        "CLOCK DRIFT",
+        "TIMESTAMP REJECTIONS",
+        "REQUEUED TXS",
+        "WARMUP REMAINING",
+    ];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.status.clone(),
+            self.ready.to_string(),
+            self.validator.to_string(),
+            self.block_height.to_string(),
+            self.blocks_behind.to_string(),
+            self.quorum_failures.to_string(),
+            self.proposal_backoff.to_string(),
+            self.clock_drift.to_string(),
+            self.timestamp_rejections.to_string(),
+            self.requeued_txs.to_string(),
+            self.warmup_remaining.to_string(),
+        ]
+    }
+}
+
+async fn show_health(rpc_addr: &str, output: OutputFormat) -> Result<(), NodeError> {
+    let health = HealthClient::new(rpc_addr).check().await?;
+    let entry = HealthEntry {
+        status: health.status,
+        ready: health.ready,
+        validator: health.validator,
+        block_height: health.block_height,
+        blocks_behind: health.blocks_behind,
+        quorum_failures: health.quorum_failures,
+        proposal_backoff: health.proposal_backoff,
+        clock_drift: health.clock_drift,
+        timestamp_rejections: health.timestamp_rejections,
+        requeued_txs: health.requeued_txs,
+        warmup_remaining: health.warmup_remaining,
+    };
+    println!("{}", render_one(output, &entry)?);
+    Ok(())
+}
+
+async fn init_node(config: &NodeConfig, _genesis: Option<&std::path::Path>) -> Result<(), NodeError> {
+    tracing::info!("Initializing new node at {:?}", config.data_dir);
+
+    // Create data directory
+    std::fs::create_dir_all(&config.data_dir)?;
+
+    // Initialize storage
+    let mut node = BachNode::new(config.clone());
+    node.init()?;
+
+    tracing::info!("Node initialized successfully");
+    Ok(())
+}
+
+/// `info` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct NodeInfo {
+    data_dir: PathBuf,
+    chain_id: u64,
+    p2p_address: String,
+    bootstrap_peers: Vec<String>,
+    rpc_enabled: bool,
+    rpc_address: Option<String>,
+    block_time_ms: u64,
+    max_txs_per_block: usize,
+    validator: bool,
+}
+
+impl Tabular for NodeInfo {
+    const HEADERS: &'static [&'static str] = &[
+        "DATA DIR",
+        "CHAIN ID",
+        "P2P ADDRESS",
+        "BOOTSTRAP PEERS",
+        "RPC ENABLED",
+        "RPC ADDRESS",
+        "BLOCK TIME (MS)",
+        "MAX TXS PER BLOCK",
+        "VALIDATOR",
+    ];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.data_dir.display().to_string(),
+            self.chain_id.to_string(),
+            self.p2p_address.clone(),
+            self.bootstrap_peers.join(","),
+            self.rpc_enabled.to_string(),
+            self.rpc_address.clone().unwrap_or_default(),
+            self.block_time_ms.to_string(),
+            self.max_txs_per_block.to_string(),
+            self.validator.to_string(),
+        ]
+    }
+}
+
+async fn show_info(config: &NodeConfig, output: OutputFormat) -> Result<(), NodeError> {
+    let info = NodeInfo {
+        data_dir: config.data_dir.clone(),
+        chain_id: config.chain_id,
+        p2p_address: config.listen_addr.to_string(),
+        bootstrap_peers: config.bootstrap_peers.iter().map(|p| p.to_string()).collect(),
+        rpc_enabled: config.rpc_enabled,
+        rpc_address: config.rpc_addr.map(|addr| addr.to_string()),
+        block_time_ms: config.block_time_ms,
+        max_txs_per_block: config.max_txs_per_block,
+        validator: config.validator_key.is_some(),
+    };
+    println!("{}", render_one(output, &info)?);
+
+    Ok(())
+}
+
+/// Prefix of Ed25519 key files; secp256k1 key files hold bare hex.
+const ED25519_KEY_PREFIX: &str = "ed25519:";
+
+/// Prefix of SM2 key files
+const SM2_KEY_PREFIX: &str = "sm2:";
+
+/// Reads a key file, returning the key's algorithm and raw bytes.
+fn read_key_file_with_algorithm(path: &PathBuf) -> Result<(KeyAlgorithm, [u8; 32]), NodeError> {
+    let contents = std::fs::read_to_string(path).map_err(|e| {
+        NodeError::ConfigError(format!("Failed to read key file: {}", e))
+    })?;
+    let contents = contents.trim();
+    let (algorithm, key_hex) = if let Some(key_hex) = contents.strip_prefix(ED25519_KEY_PREFIX) {
+        (KeyAlgorithm::Ed25519, key_hex)
+    } else if let Some(key_hex) = contents.strip_prefix(SM2_KEY_PREFIX) {
+        (KeyAlgorithm::Sm2, key_hex)
+    } else {
+        (KeyAlgorithm::Secp256k1, contents)
+    };
+    let key_bytes = hex::decode(key_hex).map_err(|e| {
+        NodeError::ConfigError(format!("Invalid key format: {}", e))
+    })?;
+    if key_bytes.len() != 32 {
+        return Err(NodeError::ConfigError("Key must be 32 bytes".to_string()));
+    }
+    let mut key = [0u8; 32];
+    key.copy_from_slice(&key_bytes);
+    Ok((algorithm, key))
+}
+
+/// Reads a secp256k1 key file, as used for validator, issuer and DID keys.
+fn read_key_file(path: &PathBuf) -> Result<[u8; 32], NodeError> {
+    match read_key_file_with_algorithm(path)? {
+        (KeyAlgorithm::Secp256k1, key) => Ok(key),
+        (algorithm, _) => Err(NodeError::ConfigError(format!(
+            "{} needs a secp256k1 key, not {}",
+            path.display(),
+            algorithm
+        ))),
+    }
+}
+
+/// Reads a member key file of any algorithm.
+fn read_member_key(path: &PathBuf) -> Result<MemberKey, NodeError> {
+    let (algorithm, key) = read_key_file_with_algorithm(path)?;
+    MemberKey::from_bytes(algorithm, &key)
+        .map_err(|_| NodeError::ConfigError("Invalid member key".to_string()))
+}
+
+/// `gen-key` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct GeneratedKey {
+    key_file: PathBuf,
+    address: String,
+    public_key: String,
+}
+
+impl Tabular for GeneratedKey {
+    const HEADERS: &'static [&'static str] = &["KEY FILE", "ADDRESS", "PUBLIC KEY"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.key_file.display().to_string(),
+            self.address.clone(),
+            self.public_key.clone(),
+        ]
+    }
+}
+
+fn generate_key(
+    key_file: &PathBuf,
+    algorithm: &str,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let algorithm = KeyAlgorithm::from_name(algorithm).ok_or_else(|| {
+        NodeError::ConfigError(format!("Unknown key algorithm: {}", algorithm))
+    })?;
+
+    tracing::info!("Generating new {} key", algorithm);
+
+    let key = MemberKey::generate(algorithm);
+    let key_hex = hex::encode(key.to_bytes());
+    let (contents, public_key) = match algorithm {
+        KeyAlgorithm::Secp256k1 => {
+            let public_key = format!("0x04{}", hex::encode(key.public_key_bytes()));
+            (key_hex, public_key)
+        }
+        KeyAlgorithm::Ed25519 => (
+            format!("{}{}", ED25519_KEY_PREFIX, key_hex),
+            format!("0x{}", hex::encode(key.public_key_bytes())),
+        ),
+        KeyAlgorithm::Sm2 => (
+            format!("{}{}", SM2_KEY_PREFIX, key_hex),
+            format!("0x{}", hex::encode(key.public_key_bytes())),
+        ),
+    };
+
+    std::fs::write(key_file, &contents)?;
+
+    let address = key.address();
+    let generated = GeneratedKey {
+        key_file: key_file.clone(),
+        address: format!("0x{}", hex::encode(address.as_bytes())),
+        public_key,
+    };
+    println!("{}", render_one(output, &generated)?);
+
+    Ok(())
+}
+
+/// `state-diff` entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct StateChangeEntry {
+    address: String,
+    slot: String,
+    old_value_hash: String,
+    new_value_hash: String,
+}
+
+impl Tabular for StateChangeEntry {
+    const HEADERS: &'static [&'static str] =
+        &["ADDRESS", "SLOT", "OLD VALUE HASH", "NEW VALUE HASH"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.address.clone(),
+            self.slot.clone(),
+            self.old_value_hash.clone(),
+            self.new_value_hash.clone(),
+        ]
+    }
+}
+
+fn show_state_diff(
+    config: &NodeConfig,
+    from: u64,
+    to: u64,
+    contract: Option<&str>,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    if from > to {
+        return Err(NodeError::ConfigError(format!(
+            "--from {} must not be greater than --to {}",
+            from, to
+        )));
+    }
+
+    let contract = contract
+        .map(|s| {
+            Address::from_hex(s)
+                .map_err(|e| NodeError::ConfigError(format!("Invalid contract address: {:?}", e)))
+        })
+        .transpose()?;
+
+    let storage = Storage::open(&config.data_dir)?;
+    let changes = storage.state.get_state_diff(from, to, contract.as_ref());
+
+    let entries: Vec<StateChangeEntry> = changes
+        .iter()
+        .map(|change| StateChangeEntry {
+            address: format!("0x{}", hex::encode(change.address)),
+            slot: format!("0x{}", hex::encode(change.slot)),
+            old_value_hash: format!("0x{}", hex::encode(change.old_value_hash)),
+            new_value_hash: format!("0x{}", hex::encode(change.new_value_hash)),
+        })
+        .collect();
+    println!("{}", render_list(output, &entries)?);
+    eprintln!("{} changed slot(s) between heights {} and {}", changes.len(), from, to);
+
+    Ok(())
+}
+
+/// `gas-report` entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct GasUsageEntry {
+    contract: String,
+    selector: Option<String>,
+    calls: u64,
+    gas_used: u64,
+}
+
+impl Tabular for GasUsageEntry {
+    const HEADERS: &'static [&'static str] = &["CONTRACT", "SELECTOR", "CALLS", "GAS USED"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.contract.clone(),
+            self.selector.clone().unwrap_or_else(|| "-".to_string()),
+            self.calls.to_string(),
+            self.gas_used.to_string(),
+        ]
+    }
+}
+
+fn show_gas_report(
+    config: &NodeConfig,
+    height: u64,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let storage = Storage::open(&config.data_dir)?;
+    let mut report = storage.transactions.get_gas_report(height);
+    report.sort_by(|a, b| b.gas_used.cmp(&a.gas_used));
+
+    let entries: Vec<GasUsageEntry> = report
+        .iter()
+        .map(|usage| GasUsageEntry {
+            contract: format!("0x{}", hex::encode(usage.contract)),
+            selector: usage.selector.map(|s| format!("0x{}", hex::encode(s))),
+            calls: usage.calls,
+            gas_used: usage.gas_used,
+        })
+        .collect();
+    println!("{}", render_list(output, &entries)?);
+    let total: u64 = report.iter().map(|u| u.gas_used).sum();
+    eprintln!("{} method(s), {} gas in block {}", report.len(), total, height);
+
+    Ok(())
+}
+
+/// `get-txs` entry; `error` is set instead of the location when the lookup fails
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct TransactionEntry {
+    hash: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    block_number: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    transaction_index: Option<u32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    nonce: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
+}
+
+impl TransactionEntry {
+    fn failed(hash: &str, error: &str) -> Self {
+        Self {
+            hash: hash.to_string(),
+            block_number: None,
+            transaction_index: None,
+            nonce: None,
+            error: Some(error.to_string()),
+        }
+    }
+}
+
+impl Tabular for TransactionEntry {
+    const HEADERS: &'static [&'static str] = &["HASH", "BLOCK", "INDEX", "NONCE", "ERROR"];
+
+    fn row(&self) -> Vec<String> {
+        let cell = |value: Option<String>| value.unwrap_or_else(|| "-".to_string());
+        vec![
+            self.hash.clone(),
+            cell(self.block_number.map(|n| n.to_string())),
+            cell(self.transaction_index.map(|i| i.to_string())),
+            cell(self.nonce.map(|n| n.to_string())),
+            self.error.clone().unwrap_or_default(),
+        ]
+    }
+}
+
+fn show_transactions(
+    config: &NodeConfig,
+    hashes: &[String],
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let storage = Storage::open(&config.data_dir)?;
+    let parsed: Vec<Option<H256>> = hashes.iter().map(|h| H256::from_hex(h).ok()).collect();
+    let lookups: Vec<H256> = parsed.iter().flatten().copied().collect();
+    let mut found = storage.get_transactions(&lookups).into_iter();
+
+    let entries: Vec<TransactionEntry> = hashes
+        .iter()
+        .zip(&parsed)
+        .map(|(hash, parsed)| {
+            if parsed.is_none() {
+                return TransactionEntry::failed(hash, "invalid hash");
+            }
+            match found.next().flatten() {
+                Some(tx) => TransactionEntry {
+                    hash: hash.clone(),
+                    block_number: Some(tx.block_number),
+                    transaction_index: Some(tx.transaction_index),
+                    nonce: Some(tx.transaction.nonce),
+                    error: None,
+                },
+                None => TransactionEntry::failed(hash, "not found"),
+            }
+        })
+        .collect();
+    println!("{}", render_list(output, &entries)?);
+    let count = entries.iter().filter(|entry| entry.error.is_none()).count();
+    eprintln!("{} of {} transaction(s) found", count, hashes.len());
+
+    Ok(())
+}
+
+/// `get-blocks` entry; `error` is set instead of the block fields when the lookup fails
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct BlockEntry {
+    height: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    hash: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    transaction_count: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    timestamp: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
+}
+
+impl Tabular for BlockEntry {
+    const HEADERS: &'static [&'static str] = &["HEIGHT", "HASH", "TXS", "TIMESTAMP", "ERROR"];
+
+    fn row(&self) -> Vec<String> {
+        let cell = |value: Option<String>| value.unwrap_or_else(|| "-".to_string());
+        vec![
+            self.height.to_string(),
+            cell(self.hash.clone()),
+            cell(self.transaction_count.map(|n| n.to_string())),
+            cell(self.timestamp.map(|t| t.to_string())),
+            self.error.clone().unwrap_or_default(),
+        ]
+    }
+}
+
+fn show_blocks(
+    config: &NodeConfig,
+    heights: &[u64],
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let storage = Storage::open(&config.data_dir)?;
+    let blocks = storage.get_blocks_by_heights(heights);
+
+    let entries: Vec<BlockEntry> = heights
+        .iter()
+        .zip(&blocks)
+        .map(|(height, block)| match block {
+            Some(block) => BlockEntry {
+                height: *height,
+                hash: Some(format!("0x{}", hex::encode(block.hash().as_bytes()))),
+                transaction_count: Some(block.transactions.len()),
+                timestamp: Some(block.timestamp),
+                error: None,
+            },
+            None => BlockEntry {
+                height: *height,
+                hash: None,
+                transaction_count: None,
+                timestamp: None,
+                error: Some("not found".to_string()),
+            },
+        })
+        .collect();
+    println!("{}", render_list(output, &entries)?);
+    let count = blocks.iter().flatten().count();
+    eprintln!("{} of {} block(s) found", count, heights.len());
+
+    Ok(())
+}
+
+/// `query block` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct BlockInspection {
+    height: u64,
+    hash: String,
+    parent_hash: String,
+    timestamp: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    state_root: Option<String>,
+    /// Sparse Merkle state commitment from the header extension
+    #[serde(skip_serializing_if = "Option::is_none")]
+    state_commitment: Option<String>,
+    transaction_count: usize,
+    /// Length of the longest dependency chain
+    #[serde(skip_serializing_if = "Option::is_none")]
+    dag_depth: Option<usize>,
+    /// Most transactions on one DAG level
+    #[serde(skip_serializing_if = "Option::is_none")]
+    dag_width: Option<usize>,
+    transactions: Vec<BlockTransactionEntry>,
+    /// Graphviz digraph, unless written to a file
+    #[serde(skip_serializing_if = "Option::is_none")]
+    dag: Option<String>,
+}
+
+impl Tabular for BlockInspection {
+    const HEADERS: &'static [&'static str] = &[
+        "HEIGHT",
+        "HASH",
+        "PARENT",
+        "TIMESTAMP",
+        "STATE ROOT",
+        "TXS",
+        "DAG DEPTH",
+        "DAG WIDTH",
+    ];
+
+    fn row(&self) -> Vec<String> {
+        let cell = |value: Option<String>| value.unwrap_or_else(|| "-".to_string());
+        vec![
+            self.height.to_string(),
+            self.hash.clone(),
+            self.parent_hash.clone(),
+            self.timestamp.to_string(),
+            cell(self.state_root.clone()),
+            self.transaction_count.to_string(),
+            cell(self.dag_depth.map(|n| n.to_string())),
+            cell(self.dag_width.map(|n| n.to_string())),
+        ]
+    }
+}
+
+/// `query block` transaction entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct BlockTransactionEntry {
+    index: usize,
+    hash: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    from: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    to: Option<String>,
+    nonce: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    status: Option<bool>,
+    /// Indexes of the transactions this one waited for
+    #[serde(skip_serializing_if = "Option::is_none")]
+    depends_on: Option<Vec<u32>>,
+}
+
+impl Tabular for BlockTransactionEntry {
+    const HEADERS: &'static [&'static str] =
+        &["INDEX", "HASH", "FROM", "TO", "NONCE", "STATUS", "DEPENDS ON"];
+
+    fn row(&self) -> Vec<String> {
+        let cell = |value: Option<String>| value.unwrap_or_else(|| "-".to_string());
+        vec![
+            self.index.to_string(),
+            self.hash.clone(),
+            cell(self.from.clone()),
+            cell(self.to.clone()),
+            self.nonce.to_string(),
+            cell(self.status.map(|ok| if ok { "ok" } else { "failed" }.to_string())),
+            cell(self.depends_on.as_ref().map(|deps| {
+                deps.iter()
+                    .map(|dep| dep.to_string())
+                    .collect::<Vec<_>>()
+                    .join(",")
+            })),
+        ]
+    }
+}
+
+fn query(
+    config: &NodeConfig,
+    action: QueryCommand,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    match action {
+        QueryCommand::Block { height, dag, dot } => {
+            inspect_block(config, height, dag, dot, output)
+        }
+        QueryCommand::Checkpoint { height } => inspect_checkpoint(config, height, output),
+    }
+}
+
+fn inspect_block(
+    config: &NodeConfig,
+    height: u64,
+    show_dag: bool,
+    dot_file: Option<PathBuf>,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let not_found = |what: String| NodeError::StorageError(StorageError::NotFound(what));
+    let storage = Storage::open(&config.data_dir)?;
+    let block = storage
+        .blocks
+        .get_block_by_height(height)
+        .ok_or_else(|| not_found(format!("block {}", height)))?;
+    let block_hash = block.hash();
+    let header = storage.blocks.get_block_header(&block_hash);
+    let dag = show_dag
+        .then(|| {
+            storage
+                .transactions
+                .get_tx_dag(height)
+                .ok_or_else(|| not_found(format!("transaction DAG of block {}", height)))
+        })
+        .transpose()?;
+
+    let to_hex = |bytes: &[u8]| format!("0x{}", hex::encode(bytes));
+    let transactions = block
+        .transactions
+        .iter()
+        .enumerate()
+        .map(|(index, tx)| {
+            let hash = tx.hash();
+            BlockTransactionEntry {
+                index,
+                hash: to_hex(hash.as_bytes()),
+                from: tx.sender().ok().map(|from| to_hex(from.as_bytes())),
+                to: tx.to.map(|to| to_hex(to.as_bytes())),
+                nonce: tx.nonce,
+                status: storage.transactions.get_receipt(&hash).map(|r| r.status),
+                depends_on: dag.as_ref().map(|dag| dag.dependencies_of(index).to_vec()),
+            }
+        })
+        .collect();
+    let tx_hashes: Vec<H256> = block.transactions.iter().map(|tx| tx.hash()).collect();
+    let dot = dag.as_ref().map(|dag| dag.to_dot(&tx_hashes));
+
+    let inspection = BlockInspection {
+        height,
+        hash: to_hex(block_hash.as_bytes()),
+        parent_hash: to_hex(block.parent_hash.as_bytes()),
+        timestamp: block.timestamp,
+        state_root: header.map(|header| to_hex(&header.state_root)),
+        state_commitment: storage
+            .blocks
+            .get_header_extension(&block_hash)
+            .and_then(|extension| extension.state_commitment)
+            .map(|commitment| to_hex(&commitment)),
+        transaction_count: block.transactions.len(),
+        dag_depth: dag.as_ref().map(|dag| dag.depth()),
+        dag_width: dag.as_ref().map(|dag| dag.max_width()),
+        transactions,
+        dag: dot.clone().filter(|_| dot_file.is_none()),
+    };
+
+    println!("{}", render_one(output, &inspection)?);
+    if output == OutputFormat::Table {
+        println!();
+        println!("{}", render_list(output, &inspection.transactions)?);
+        if let Some(dot) = &inspection.dag {
+            println!();
+            println!("{}", dot);
+        }
+    }
+    if let (Some(path), Some(dot)) = (dot_file, dot) {
+        std::fs::write(&path, dot + "\n")?;
+        eprintln!("Wrote transaction DAG to {}", path.display());
+    }
+
+    Ok(())
+}
+
+fn util(config: &NodeConfig, action: UtilCommand, output: OutputFormat) -> Result<(), NodeError> {
+    match action {
+        UtilCommand::Fsck {
+            from,
+            to,
+            validators,
+            quarantine,
+        } => check_chain(config, from, to, validators.as_deref(), quarantine, output),
+        UtilCommand::ValidateConfig { node, chain } => {
+            validate_config(node.as_deref(), chain.as_deref(), output)
+        }
+    }
+}
+
+/// `util validate-config` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct ConfigIssueEntry {
+    file: String,
+    severity: String,
+    field: String,
+    message: String,
+}
+
+impl Tabular for ConfigIssueEntry {
+    const HEADERS: &'static [&'static str] = &["FILE", "SEVERITY", "FIELD", "MESSAGE"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.file.clone(),
+            self.severity.clone(),
+            self.field.clone(),
+            self.message.clone(),
+        ]
+    }
+}
+
+fn validate_config(
+    node: Option<&std::path::Path>,
+    chain: Option<&std::path::Path>,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    if node.is_none() && chain.is_none() {
+        return Err(NodeError::ConfigError(
+            "Give a --node or --chain config file to validate".to_string(),
+        ));
+    }
+    let mut reports: Vec<(&std::path::Path, ConfigReport)> = Vec::new();
+    if let Some(path) = node {
+        let (_, report) = NodeConfig::parse(&std::fs::read_to_string(path)?)?;
+        reports.push((path, report));
+    }
+    if let Some(path) = chain {
+        let (_, report) = validate_chain_config(&std::fs::read_to_string(path)?)?;
+        reports.push((path, report));
+    }
+
+    let entries: Vec<ConfigIssueEntry> = reports
+        .iter()
+        .flat_map(|(path, report)| {
+            report.issues.iter().map(move |issue| ConfigIssueEntry {
+                file: path.display().to_string(),
+                severity: issue.severity.as_str().to_string(),
+                field: issue.field.clone(),
+                message: issue.message.clone(),
+            })
+        })
+        .collect();
+    println!("{}", render_list(output, &entries)?);
+    let errors: usize = reports.iter().map(|(_, report)| report.errors().count()).sum();
+    eprintln!(
+        "Checked {} file(s): {} error(s), {} warning(s)",
+        reports.len(),
+        errors,
+        entries.len() - errors
+    );
+    if errors > 0 {
+        return Err(NodeError::ConfigError(format!("{} config error(s)", errors)));
+    }
+    Ok(())
+}
+
+/// `verify` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct VerifiedEntry {
+    height: u64,
+    block_hash: String,
+    timestamp: u64,
+    transactions: usize,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    transaction_hash: Option<String>,
+}
+
+impl Tabular for VerifiedEntry {
+    const HEADERS: &'static [&'static str] =
+        &["HEIGHT", "BLOCK HASH", "TIMESTAMP", "TRANSACTIONS", "TRANSACTION"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.height.to_string(),
+            self.block_hash.clone(),
+            self.timestamp.to_string(),
+            self.transactions.to_string(),
+            self.transaction_hash.clone().unwrap_or_default(),
+        ]
+    }
+}
+
+async fn verify(
+    rpc_addr: &str,
+    validators: &[String],
+    hash_migrations: &[String],
+    action: VerifyCommand,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let client = VerifyingClient::new(rpc_addr, parse_validator_set(validators)?)
+        .with_hash_schedule(parse_hash_schedule(hash_migrations)?);
+    let (block, transaction_hash) = match action {
+        VerifyCommand::Block { height } => (client.block(height).await?, None),
+        VerifyCommand::Receipt { hash } => {
+            let tx_hash = H256::from_hex(&hash)
+                .map_err(|_| NodeError::ConfigError(format!("Invalid hash: {}", hash)))?;
+            let verified = client.receipt(tx_hash).await?.ok_or_else(|| {
+                NodeError::Rejected(format!("no receipt for transaction {}", hash))
+            })?;
+            (verified.block, Some(format_h256(&tx_hash)))
+        }
+    };
+    let entry = VerifiedEntry {
+        height: block.height,
+        block_hash: format_h256(&block.hash),
+        timestamp: block.timestamp,
+        transactions: block.transactions.len(),
+        transaction_hash,
+    };
+    println!("{}", render_one(output, &entry)?);
+    Ok(())
+}
+
+/// `util fsck` entry, one per issue found
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct FsckEntry {
+    height: u64,
+    check: String,
+    detail: String,
+}
+
+impl Tabular for FsckEntry {
+    const HEADERS: &'static [&'static str] = &["HEIGHT", "CHECK", "DETAIL"];
+
+    fn row(&self) -> Vec<String> {
+        vec![self.height.to_string(), self.check.clone(), self.detail.clone()]
+    }
+}
+
+/// Parses validator public keys (`0x04`-prefixed or bare 64-byte hex)
+/// into an equally weighted validator set.
+fn parse_validator_set(keys: &[String]) -> Result<ValidatorSet, NodeError> {
+    let validators = keys
+        .iter()
+        .map(|key| {
+            let invalid =
+                || NodeError::ConfigError(format!("Invalid validator public key {}", key));
+            let bytes = hex::decode(key.trim_start_matches("0x")).map_err(|_| invalid())?;
+            let bytes = match bytes.len() {
+                65 if bytes[0] == 0x04 => &bytes[1..],
+                _ => &bytes[..],
+            };
+            let bytes: &[u8; 64] = bytes.try_into().map_err(|_| invalid())?;
+            let public_key = PublicKey::from_bytes(bytes).map_err(|_| invalid())?;
+            Ok(Validator::new(public_key, 1))
+        })
+        .collect::<Result<Vec<_>, NodeError>>()?;
+    Ok(ValidatorSet::new(validators))
+}
+
+fn parse_hash_schedule(migrations: &[String]) -> Result<HashSchedule, NodeError> {
+    migrations.iter().try_fold(HashSchedule::default(), |schedule, migration| {
+        let invalid = || NodeError::ConfigError(format!("Invalid hash migration {}", migration));
+        let (height, algorithm) = migration.split_once(':').ok_or_else(invalid)?;
+        let height = height.trim().parse().map_err(|_| invalid())?;
+        let algorithm = HashAlgorithm::from_name(algorithm).ok_or_else(invalid)?;
+        Ok(schedule.with_migration(height, algorithm))
+    })
+}
+
+fn check_chain(
+    config: &NodeConfig,
+    from: u64,
+    to: Option<u64>,
+    validators: Option<&[String]>,
+    quarantine: bool,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let storage = Storage::open(&config.data_dir)?;
+    let chain_config = bach_node::read_chain_config(&storage)?;
+    let validators = validators.map(parse_validator_set).transpose()?;
+    let mut checker = ChainChecker::new(&storage);
+    if let Some(chain_config) = &chain_config {
+        checker = checker.with_chain_config(chain_config);
+    }
+    if let Some(validators) = &validators {
+        checker = checker.with_validators(validators);
+    }
+    let report = checker.check(from, to.unwrap_or(u64::MAX));
+
+    let entries: Vec<FsckEntry> = report
+        .issues
+        .iter()
+        .map(|issue| FsckEntry {
+            height: issue.height,
+            check: issue.check.as_str().to_string(),
+            detail: issue.detail.clone(),
+        })
+        .collect();
+    println!("{}", render_list(output, &entries)?);
+    eprintln!(
+        "Checked {} block(s) and {} checkpoint(s) from {} to {}",
+        report.blocks, report.checkpoints, report.from, report.to
+    );
+    let heights = report.corrupt_heights();
+    let Some(lowest) = heights.first() else {
+        return Ok(());
+    };
+    if quarantine {
+        report.quarantine(&storage)?;
+        eprintln!("Quarantined {} height(s)", heights.len());
+    }
+    Err(NodeError::StorageError(StorageError::CorruptedData(format!(
+        "{} corrupt height(s), the lowest {}",
+        heights.len(),
+        lowest
+    ))))
+}
+
+/// `query checkpoint` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct CheckpointInspection {
+    height: u64,
+    block_hash: String,
+    state_root: String,
+    signers: Vec<String>,
+}
+
+impl Tabular for CheckpointInspection {
+    const HEADERS: &'static [&'static str] = &["HEIGHT", "BLOCK HASH", "STATE ROOT", "SIGNERS"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.height.to_string(),
+            self.block_hash.clone(),
+            self.state_root.clone(),
+            self.signers.join(","),
+        ]
+    }
+}
+
+fn inspect_checkpoint(
+    config: &NodeConfig,
+    height: Option<u64>,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    let storage = Storage::open(&config.data_dir)?;
+    let signed = storage
+        .blocks
+        .get_latest_finality_checkpoint(height.unwrap_or(u64::MAX))
+        .ok_or_else(|| {
+            NodeError::StorageError(StorageError::NotFound("finality checkpoint".to_string()))
+        })?;
+
+    let to_hex = |bytes: &[u8]| format!("0x{}", hex::encode(bytes));
+    let inspection = CheckpointInspection {
+        height: signed.height(),
+        block_hash: to_hex(signed.checkpoint.block_hash.as_bytes()),
+        state_root: to_hex(signed.checkpoint.state_root.as_bytes()),
+        signers: signed
+            .signers()
+            .iter()
+            .map(|signer| to_hex(signer.as_bytes()))
+            .collect(),
+    };
+    println!("{}", render_one(output, &inspection)?);
+    Ok(())
+}
+
+/// `chain-config history` entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct ConfigVersionEntry {
+    version: u64,
+    height: u64,
+    updated_by: String,
+    changed: Vec<String>,
+}
+
+impl Tabular for ConfigVersionEntry {
+    const HEADERS: &'static [&'static str] = &["VERSION", "HEIGHT", "UPDATED BY", "CHANGED"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.version.to_string(),
+            self.height.to_string(),
+            self.updated_by.clone(),
+            if self.changed.is_empty() {
+                "-".to_string()
+            } else {
+                self.changed.join(",")
+            },
+        ]
+    }
+}
+
+/// `chain-config show` entry
+#[derive(Serialize)]
+struct ConfigParamEntry {
+    name: String,
+    value: String,
+}
+
+impl Tabular for ConfigParamEntry {
+    const HEADERS: &'static [&'static str] = &["PARAMETER", "VALUE"];
+
+    fn row(&self) -> Vec<String> {
+        vec![self.name.clone(), self.value.clone()]
+    }
+}
+
+/// `chain-config diff` entry
+#[derive(Serialize)]
+struct ConfigChangeEntry {
+    name: String,
+    from: String,
+    to: String,
+}
+
+impl Tabular for ConfigChangeEntry {
+    const HEADERS: &'static [&'static str] = &["PARAMETER", "FROM", "TO"];
+
+    fn row(&self) -> Vec<String> {
+        vec![self.name.clone(), self.from.clone(), self.to.clone()]
+    }
+}
+
+/// `chain-config revert` output: the transaction to submit
+#[derive(Serialize)]
+struct RevertTransaction {
+    to: String,
+    data: String,
+    param: String,
+    value: String,
+}
+
+impl Tabular for RevertTransaction {
+    const HEADERS: &'static [&'static str] = &["TO", "DATA", "PARAMETER", "VALUE"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.to.clone(),
+            self.data.clone(),
+            self.param.clone(),
+            self.value.clone(),
+        ]
+    }
+}
+
+/// `chain-config admins` entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct AdminKeyEntry {
+    org: String,
+    keys: Vec<String>,
+    rotating_to: Option<String>,
+    activation_height: Option<u64>,
+    endorsements: Option<String>,
+}
+
+impl Tabular for AdminKeyEntry {
+    const HEADERS: &'static [&'static str] =
+        &["ORG", "KEYS", "ROTATING TO", "ACTIVATION", "ENDORSEMENTS"];
+
+    fn row(&self) -> Vec<String> {
+        let or_dash = |v: Option<String>| v.unwrap_or_else(|| "-".to_string());
+        vec![
+            self.org.clone(),
+            self.keys.join(","),
+            or_dash(self.rotating_to.clone()),
+            or_dash(self.activation_height.map(|h| h.to_string())),
+            or_dash(self.endorsements.clone()),
+        ]
+    }
+}
+
+/// `chain-config simulate` output
+#[derive(Serialize)]
+struct PolicyEvaluationEntry(PolicyEvaluation);
+
+impl Tabular for PolicyEvaluationEntry {
+    const HEADERS: &'static [&'static str] = &[
+        "RESOURCE",
+        "RULE",
+        "SATISFIED",
+        "ENDORSED",
+        "MISSING",
+        "IGNORED",
+    ];
+
+    fn row(&self) -> Vec<String> {
+        let or_dash = |v: &[String]| {
+            if v.is_empty() {
+                "-".to_string()
+            } else {
+                v.join(",")
+            }
+        };
+        vec![
+            self.0.resource.clone(),
+            self.0.rule.clone(),
+            self.0.satisfied.to_string(),
+            or_dash(&self.0.endorsed_orgs),
+            or_dash(&self.0.missing_orgs),
+            or_dash(&self.0.ignored),
+        ]
+    }
+}
+
+/// `chain-config features` entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct FeatureEntry {
+    feature: String,
+    supporters: Vec<String>,
+    quorum: bool,
+    activation_height: Option<u64>,
+    supported: bool,
+}
+
+impl Tabular for FeatureEntry {
+    const HEADERS: &'static [&'static str] =
+        &["FEATURE", "SUPPORTERS", "QUORUM", "ACTIVATION", "THIS NODE"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.feature.clone(),
+            if self.supporters.is_empty() {
+                "-".to_string()
+            } else {
+                self.supporters.join(",")
+            },
+            self.quorum.to_string(),
+            self.activation_height.map_or_else(|| "-".to_string(), |h| h.to_string()),
+            self.supported.to_string(),
+        ]
+    }
+}
+
+/// `chain-config signal-features` output: the transaction to submit
+#[derive(Serialize)]
+struct SignalTransaction {
+    to: String,
+    data: String,
+    features: Vec<String>,
+}
+
+impl Tabular for SignalTransaction {
+    const HEADERS: &'static [&'static str] = &["TO", "DATA", "FEATURES"];
+
+    fn row(&self) -> Vec<String> {
+        vec![self.to.clone(), self.data.clone(), self.features.join(",")]
+    }
+}
+
+/// `chain-config stage-rotation` and `endorse-rotation` output: the
+/// transaction to submit
+#[derive(Serialize)]
+struct RotationTransaction {
+    to: String,
+    data: String,
+    org: String,
+}
+
+impl Tabular for RotationTransaction {
+    const HEADERS: &'static [&'static str] = &["TO", "DATA", "ORG"];
+
+    fn row(&self) -> Vec<String> {
+        vec![self.to.clone(), self.data.clone(), self.org.clone()]
+    }
+}
+
+fn show_chain_config(
+    config: &NodeConfig,
+    action: ChainConfigCommand,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    use bach_contracts::{
+        chain_config_address, diff_chain_config, encode_endorse_rotation, encode_signal_features,
+        encode_stage_rotation, revert_update, PROTOCOL_FEATURES,
+    };
+
+    let storage = Storage::open(&config.data_dir)?;
+    let chain_config = bach_node::read_chain_config(&storage)?.ok_or_else(|| {
+        NodeError::ConfigError("No chain config recorded; initialize the node first".to_string())
+    })?;
+    let version = |n| {
+        chain_config
+            .version(n)
+            .map_err(|e| NodeError::ConfigError(e.to_string()))
+    };
+
+    match action {
+        ChainConfigCommand::History => {
+            let mut previous = None;
+            let entries: Vec<ConfigVersionEntry> = chain_config
+                .versions()
+                .map(|v| {
+                    let changed = previous
+                        .map(|p| diff_chain_config(p, &v.config))
+                        .unwrap_or_default()
+                        .into_iter()
+                        .map(|change| change.name.to_string())
+                        .collect();
+                    previous = Some(&v.config);
+                    ConfigVersionEntry {
+                        version: v.version,
+                        height: v.height,
+                        updated_by: v.updated_by_addr().to_string(),
+                        changed,
+                    }
+                })
+                .collect();
+            println!("{}", render_list(output, &entries)?);
+        }
+        ChainConfigCommand::Show { height } => {
+            let v = match height {
+                Some(height) => chain_config.config_at(height),
+                None => chain_config.current(),
+            };
+            let entries: Vec<ConfigParamEntry> = v
+                .config
+                .params()
+                .into_iter()
+                .map(|(name, value)| ConfigParamEntry {
+                    name: name.to_string(),
+                    value,
+                })
+                .collect();
+            println!("{}", render_list(output, &entries)?);
+            eprintln!("Version {} (effective at height {})", v.version, v.height);
+        }
+        ChainConfigCommand::Diff { from, to } => {
+            let entries: Vec<ConfigChangeEntry> =
+                diff_chain_config(&version(from)?.config, &version(to)?.config)
+                    .into_iter()
+                    .map(|change| ConfigChangeEntry {
+                        name: change.name.to_string(),
+                        from: change.from,
+                        to: change.to,
+                    })
+                    .collect();
+            println!("{}", render_list(output, &entries)?);
+        }
+        ChainConfigCommand::Revert { param, version: n } => {
+            let target = &version(n)?.config;
+            let current = &chain_config.current().config;
+            let data = revert_update(current, target, &param)
+                .map_err(|e| NodeError::ConfigError(e.to_string()))?;
+            let Some(data) = data else {
+                eprintln!("{} already has its version {} value", param, n);
+                return Ok(());
+            };
+            let tx = RevertTransaction {
+                to: chain_config_address().to_string(),
+                data: format!("0x{}", hex::encode(data)),
+                value: target.get(&param).unwrap_or_default(),
+                param,
+            };
+            println!("{}", render_one(output, &tx)?);
+        }
+        ChainConfigCommand::Admins { height } => {
+            let v = match height {
+                Some(height) => chain_config.config_at(height),
+                None => chain_config.current(),
+            };
+            let height = height.unwrap_or(v.height);
+            let entries: Vec<AdminKeyEntry> = v
+                .config
+                .admins
+                .keys()
+                .map(|org| {
+                    let rotation = v.config.rotations.get(org);
+                    AdminKeyEntry {
+                        org: org.clone(),
+                        keys: v
+                            .config
+                            .admin_keys(org, height)
+                            .iter()
+                            .map(|k| k.to_string())
+                            .collect(),
+                        rotating_to: rotation.map(|r| r.new_key_addr().to_string()),
+                        activation_height: rotation.map(|r| r.activation_height),
+                        endorsements: rotation.map(|r| {
+                            format!("{}/{}", r.endorsements.len(), r.required_endorsements)
+                        }),
+                    }
+                })
+                .collect();
+            println!("{}", render_list(output, &entries)?);
+        }
+        ChainConfigCommand::StageRotation {
+            org,
+            new_key,
+            activation_height,
+        } => {
+            let new_key = Address::from_hex(&new_key).map_err(|e| {
+                NodeError::ConfigError(format!("Invalid address {}: {:?}", new_key, e))
+            })?;
+            let data = encode_stage_rotation(&org, &new_key, activation_height);
+            let tx = RotationTransaction {
+                to: chain_config_address().to_string(),
+                data: format!("0x{}", hex::encode(data)),
+                org,
+            };
+            println!("{}", render_one(output, &tx)?);
+        }
+        ChainConfigCommand::EndorseRotation { org } => {
+            let tx = RotationTransaction {
+                to: chain_config_address().to_string(),
+                data: format!("0x{}", hex::encode(encode_endorse_rotation(&org))),
+                org,
+            };
+            println!("{}", render_one(output, &tx)?);
+        }
+        ChainConfigCommand::Simulate {
+            resource,
+            members,
+            owner,
+        } => {
+            let dids = bach_node::read_dids(&storage)?;
+            let mut endorsers = Vec::new();
+            for member in &members {
+                endorsers.extend(config.resolve_member(member, &dids, "endorser")?);
+            }
+            let height = storage.blocks.get_block_height() + 1;
+            let evaluation = chain_config
+                .simulate_endorsement(&resource, owner.as_deref(), &endorsers, height)
+                .map_err(|e| NodeError::ConfigError(e.to_string()))?;
+            println!("{}", render_one(output, &PolicyEvaluationEntry(evaluation))?);
+        }
+        ChainConfigCommand::Features => {
+            let config = &chain_config.current().config;
+            let mut features: BTreeSet<&str> = PROTOCOL_FEATURES.iter().copied().collect();
+            features.extend(config.feature_support.values().flatten().map(String::as_str));
+            features.extend(config.feature_activations.iter().map(|a| a.feature.as_str()));
+            let entries: Vec<FeatureEntry> = features
+                .into_iter()
+                .map(|feature| FeatureEntry {
+                    feature: feature.to_string(),
+                    supporters: config
+                        .feature_supporters(feature)
+                        .into_iter()
+                        .map(str::to_string)
+                        .collect(),
+                    quorum: config.has_feature_quorum(feature),
+                    activation_height: config
+                        .feature_activations
+                        .iter()
+                        .find(|a| a.feature == feature)
+                        .map(|a| a.activation_height),
+                    supported: PROTOCOL_FEATURES.contains(&feature),
+                })
+                .collect();
+            println!("{}", render_list(output, &entries)?);
+        }
+        ChainConfigCommand::SignalFeatures { features } => {
+            let features = features
+                .unwrap_or_else(|| PROTOCOL_FEATURES.iter().map(|f| f.to_string()).collect());
+            let names: Vec<&str> = features.iter().map(String::as_str).collect();
+            let tx = SignalTransaction {
+                to: chain_config_address().to_string(),
+                data: format!("0x{}", hex::encode(encode_signal_features(&names))),
+                features,
+            };
+            println!("{}", render_one(output, &tx)?);
+        }
+    }
+
+    Ok(())
+}
+
+/// `revocation upload` output: the transaction to submit
+#[derive(Serialize)]
+struct RevocationTransaction {
+    to: String,
+    data: String,
+    issuer: String,
+}
+
+impl Tabular for RevocationTransaction {
+    const HEADERS: &'static [&'static str] = &["TO", "DATA", "ISSUER"];
+
+    fn row(&self) -> Vec<String> {
+        vec![self.to.clone(), self.data.clone(), self.issuer.clone()]
+    }
+}
+
+/// `revocation list` entry
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct RevocationListEntry {
+    issuer: String,
+    sequence: u64,
+    issued_at: u64,
+    activation_height: u64,
+    revoked: Vec<String>,
+}
+
+impl RevocationListEntry {
+    fn new(issuer: &Address, entry: &bach_contracts::ActiveRevocationList) -> Self {
+        let list = &entry.list.list;
+        Self {
+            issuer: issuer.to_string(),
+            sequence: list.sequence,
+            issued_at: list.issued_at,
+            activation_height: entry.activation_height,
+            revoked: list.revoked_addrs().map(|a| a.to_string()).collect(),
+        }
+    }
+}
+
+impl Tabular for RevocationListEntry {
+    const HEADERS: &'static [&'static str] =
+        &["ISSUER", "SEQUENCE", "ISSUED AT", "ACTIVE FROM", "REVOKED"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.issuer.clone(),
+            self.sequence.to_string(),
+            self.issued_at.to_string(),
+            self.activation_height.to_string(),
+            if self.revoked.is_empty() {
+                "-".to_string()
+            } else {
+                self.revoked.join(",")
+            },
+        ]
+    }
+}
+
+/// `revocation query` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct RevocationStatus {
+    address: String,
+    revoked: bool,
+    revoked_by: Vec<String>,
+}
+
+impl Tabular for RevocationStatus {
+    const HEADERS: &'static [&'static str] = &["ADDRESS", "REVOKED", "REVOKED BY"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.address.clone(),
+            self.revoked.to_string(),
+            if self.revoked_by.is_empty() {
+                "-".to_string()
+            } else {
+                self.revoked_by.join(",")
+            },
+        ]
+    }
+}
+
+fn manage_revocations(
+    config: &NodeConfig,
+    action: RevocationCommand,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    use bach_contracts::{encode_revocation_upload, revocation_registry_address, RevocationList};
+    use bach_crypto::PrivateKey;
+    use bach_primitives::{Clock, SystemClock};
+
+    let parse_address = |s: &str| {
+        Address::from_hex(s)
+            .map_err(|e| NodeError::ConfigError(format!("Invalid address {}: {:?}", s, e)))
+    };
+    // Lists recorded by committed blocks, trusting chain config's issuers
+    let registry = || -> Result<_, NodeError> {
+        let storage = Storage::open(&config.data_dir)?;
+        let issuers = bach_node::read_chain_config(&storage)?
+            .map(|chain_config| chain_config.current().config.revocation_issuers())
+            .unwrap_or_default();
+        bach_node::read_revocations(&storage, &issuers)
+    };
+
+    match action {
+        RevocationCommand::Upload {
+            key,
+            sequence,
+            revoke,
+        } => {
+            let key = PrivateKey::from_bytes(&read_key_file(&key)?)
+                .map_err(|_| NodeError::ConfigError("Invalid issuer key".to_string()))?;
+            let revoked = revoke
+                .iter()
+                .filter(|s| !s.is_empty())
+                .map(|s| parse_address(s))
+                .collect::<Result<Vec<_>, _>>()?;
+
+            let issued_at = SystemClock.unix_timestamp();
+            let list = RevocationList::new(sequence, issued_at, revoked).sign(&key);
+            let tx = RevocationTransaction {
+                to: revocation_registry_address().to_string(),
+                data: format!("0x{}", hex::encode(encode_revocation_upload(&list))),
+                issuer: key.public_key().to_address().to_string(),
+            };
+            println!("{}", render_one(output, &tx)?);
+        }
+        RevocationCommand::Query { address } => {
+            let address = parse_address(&address)?;
+            let revoked_by: Vec<String> = registry()?
+                .lists()
+                .filter(|(_, entry)| entry.list.list.contains(&address))
+                .map(|(issuer, _)| issuer.to_string())
+                .collect();
+            let status = RevocationStatus {
+                address: address.to_string(),
+                revoked: !revoked_by.is_empty(),
+                revoked_by,
+            };
+            println!("{}", render_one(output, &status)?);
+        }
+        RevocationCommand::List => {
+            let entries: Vec<RevocationListEntry> = registry()?
+                .lists()
+                .map(|(issuer, entry)| RevocationListEntry::new(issuer, entry))
+                .collect();
+            println!("{}", render_list(output, &entries)?);
+        }
+    }
+
+    Ok(())
+}
+
+/// `did` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct DidEntry {
+    did: String,
+    version: u64,
+    /// Hash to pin in `did_pins`
+    pin: String,
+    keys: Vec<String>,
+    controllers: Vec<String>,
+    services: Vec<String>,
+    roles: Vec<String>,
+    deactivated: bool,
+}
+
+impl DidEntry {
+    fn new(document: &bach_contracts::DidDocument) -> Self {
+        Self {
+            did: document.id.clone(),
+            version: document.version,
+            pin: document.signing_hash().to_string(),
+            keys: document.key_addrs().map(|a| a.to_string()).collect(),
+            controllers: document.controller_addrs().map(|a| a.to_string()).collect(),
+            services: document
+                .services
+                .iter()
+                .map(|s| format!("{}:{}:{}", s.id, s.kind, s.endpoint))
+                .collect(),
+            roles: document.roles.clone(),
+            deactivated: document.deactivated,
+        }
+    }
+}
+
+impl Tabular for DidEntry {
+    const HEADERS: &'static [&'static str] = &[
+        "DID",
+        "VERSION",
+        "PIN",
+        "KEYS",
+        "CONTROLLERS",
+        "SERVICES",
+        "ROLES",
+        "DEACTIVATED",
+    ];
+
+    fn row(&self) -> Vec<String> {
+        let join = |items: &[String]| {
+            if items.is_empty() {
+                "-".to_string()
+            } else {
+                items.join(",")
+            }
+        };
+        vec![
+            self.did.clone(),
+            self.version.to_string(),
+            self.pin.clone(),
+            join(&self.keys),
+            join(&self.controllers),
+            join(&self.services),
+            join(&self.roles),
+            self.deactivated.to_string(),
+        ]
+    }
+}
+
+/// `did register` and `did deactivate` output: the transaction to submit
+#[derive(Serialize)]
+struct DidTransaction {
+    to: String,
+    data: String,
+    did: String,
+    version: u64,
+}
+
+impl Tabular for DidTransaction {
+    const HEADERS: &'static [&'static str] = &["TO", "DATA", "DID", "VERSION"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.to.clone(),
+            self.data.clone(),
+            self.did.clone(),
+            self.version.to_string(),
+        ]
+    }
+}
+
+fn manage_dids(
+    config: &NodeConfig,
+    action: DidCommand,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    use bach_contracts::{
+        did_registry_address, encode_did_register, DidDocument, ServiceEndpoint, SignedDidDocument,
+    };
+    use bach_crypto::PrivateKey;
+
+    let parse_addresses = |list: &[String]| {
+        list.iter()
+            .filter(|s| !s.is_empty())
+            .map(|s| {
+                Address::from_hex(s)
+                    .map_err(|e| NodeError::ConfigError(format!("Invalid address {}: {:?}", s, e)))
+            })
+            .collect::<Result<Vec<_>, _>>()
+    };
+    let read_key = |path: &PathBuf| -> Result<PrivateKey, NodeError> {
+        PrivateKey::from_bytes(&read_key_file(path)?)
+            .map_err(|_| NodeError::ConfigError("Invalid DID key".to_string()))
+    };
+    // Documents are recorded by a registry transaction every node runs
+    let record = |document: SignedDidDocument| -> Result<(), NodeError> {
+        let tx = DidTransaction {
+            to: did_registry_address().to_string(),
+            data: format!("0x{}", hex::encode(encode_did_register(&document))),
+            did: document.document.id.clone(),
+            version: document.document.version,
+        };
+        println!("{}", render_one(output, &tx)?);
+        Ok(())
+    };
+
+    match action {
+        DidCommand::Register {
+            did,
+            key,
+            version,
+            keys,
+            controllers,
+            services,
+            roles,
+        } => {
+            let key = read_key(&key)?;
+            let mut keys = parse_addresses(&keys)?;
+            if keys.is_empty() {
+                keys.push(key.public_key().to_address());
+            }
+            let roles = roles.into_iter().filter(|r| !r.is_empty()).collect();
+
+            let mut document = DidDocument::new(&did, version, keys, roles)
+                .with_controllers(parse_addresses(&controllers)?);
+            for service in &services {
+                let mut parts = service.splitn(3, ':');
+                let (Some(id), Some(kind), Some(endpoint)) =
+                    (parts.next(), parts.next(), parts.next())
+                else {
+                    return Err(NodeError::ConfigError(format!(
+                        "Invalid service {}: expected <id>:<type>:<endpoint>",
+                        service
+                    )));
+                };
+                document = document.with_service(ServiceEndpoint::new(id, kind, endpoint));
+            }
+            record(document.sign(&key))?;
+        }
+        DidCommand::Deactivate { did, key, version } => {
+            let key = read_key(&key)?;
+            record(DidDocument::deactivation(&did, version).sign(&key))?;
+        }
+        DidCommand::Resolve { did } => {
+            let storage = Storage::open(&config.data_dir)?;
+            let registry = bach_node::read_dids(&storage)?;
+            let document = registry
+                .resolve(&did)
+                .map_err(|e| NodeError::ConfigError(e.to_string()))?;
+            println!("{}", render_one(output, &DidEntry::new(document))?);
+        }
+        DidCommand::List => {
+            let storage = Storage::open(&config.data_dir)?;
+            let registry = bach_node::read_dids(&storage)?;
+            let entries: Vec<DidEntry> = registry
+                .documents()
+                .map(|signed| DidEntry::new(&signed.document))
+                .collect();
+            println!("{}", render_list(output, &entries)?);
+        }
+    }
+
+    Ok(())
+}
+
+/// `auth-token` output
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct IssuedToken {
+    token: String,
+    subject: String,
+    expires_in_secs: u64,
+}
+
+impl Tabular for IssuedToken {
+    const HEADERS: &'static [&'static str] = &["TOKEN", "SUBJECT", "EXPIRES IN (S)"];
+
+    fn row(&self) -> Vec<String> {
+        vec![
+            self.token.clone(),
+            self.subject.clone(),
+            self.expires_in_secs.to_string(),
+        ]
+    }
+}
+
+fn issue_auth_token(
+    key_path: &PathBuf,
+    audience: &bach_rpc::TokenAudience,
+    ttl: u64,
+    output: OutputFormat,
+) -> Result<(), NodeError> {
+    use bach_rpc::AuthToken;
+
+    let key = read_member_key(key_path)?;
+    let token = AuthToken::issue(&key, audience, std::time::Duration::from_secs(ttl));
+
+    // The bare token is what scripts pipe into headers
+    if output == OutputFormat::Table {
+        println!("{}", token.encode());
+        eprintln!(
+            "Token for 0x{} expires in {}s",
+            hex::encode(token.subject.as_bytes()),
+            ttl
+        );
+        return Ok(());
+    }
+
+    let issued = IssuedToken {
+        token: token.encode(),
+        subject: format!("0x{}", hex::encode(token.subject.as_bytes())),
+        expires_in_secs: ttl,
+    };
+    println!("{}", render_one(output, &issued)?);
 
     Ok(())
 }
@@ -0,0 +1,216 @@
+//! Durable publication of committed block events
+//!
+//! The committer records each block's events in the storage outbox in the
+//! same write as the block itself. `EventOutbox` publishes pending events on
+//! the message bus in height order. Publishing doesn't acknowledge them:
+//! consumers registered with `register_consumer` record the last height
+//! they processed as their storage checkpoint, and the outbox is truncated
+//! only behind the slowest of them. Events not yet acknowledged by every
+//! consumer are published again by the next background dispatch, so a
+//! consumer that missed one, e.g. after lagging or a crash, still gets it.
+//! Subscribers may see a block twice but never miss one. Without registered
+//! consumers, events are dropped once published.
+
+use bach_msgbus::{BlockInfo, Message, MsgBus};
+use bach_primitives::Clock;
+use bach_storage::{Storage, StorageError};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+/// Default interval between background outbox dispatches
+pub const DEFAULT_OUTBOX_RETRY_INTERVAL: Duration = Duration::from_secs(5);
+
+/// Publishes outbox events on the message bus.
+///
+/// Clones share a lock, and the height published up to, so the committer
+/// and the background dispatcher never publish the same event concurrently.
+#[derive(Debug, Clone)]
+pub struct EventOutbox {
+    bus: Arc<MsgBus>,
+    published: Arc<Mutex<Option<u64>>>,
+}
+
+impl EventOutbox {
+    /// Creates an outbox dispatcher publishing on the given bus.
+    pub fn new(bus: Arc<MsgBus>) -> Self {
+        Self {
+            bus,
+            published: Arc::new(Mutex::new(None)),
+        }
+    }
+
+    /// Makes the outbox keep events until `consumer`'s storage checkpoint
+    /// reaches their height. Register consumers before the first dispatch.
+    pub fn register_consumer(storage: &Storage, consumer: &str) -> Result<(), StorageError> {
+        storage.blocks.register_outbox_consumer(consumer)
+    }
+
+    /// Truncates the events every consumer acknowledged, then publishes the
+    /// pending events not published yet, oldest first. Returns the number
+    /// published.
+    ///
+    /// Stops at the first event whose block can't be read; it stays in the
+    /// outbox for the next dispatch.
+    pub fn dispatch(&self, storage: &Storage) -> Result<usize, StorageError> {
+        let mut published_height = self.published.lock().unwrap();
+        let acked = storage.blocks.outbox_acked_height();
+        if let Some(acked) = acked {
+            storage.blocks.ack_outbox_events(acked)?;
+        }
+        let mut published = 0;
+        let mut result = Ok(());
+        for (height, event) in storage.blocks.get_outbox_events()? {
+            if published_height.is_some_and(|published| height <= published) {
+                continue;
+            }
+            let Some(block) = storage.blocks.get_block_by_hash(&event.block_hash_h256()) else {
+                result = Err(StorageError::NotFound(format!(
+                    "block {} of outbox event",
+                    height
+                )));
+                break;
+            };
+            self.bus
+                .publish(Message::BlockCommitted(Arc::new(BlockInfo {
+                    block,
+                    receipts: event.receipts,
+                    changes: event.changes,
+                })));
+            *published_height = Some(height);
+            published += 1;
+        }
+        if let (None, Some(height)) = (acked, *published_height) {
+            storage.blocks.ack_outbox_events(height)?;
+        }
+        result.map(|_| published)
+    }
+
+    /// Publishes again, on the next dispatch, the events some consumer
+    /// hasn't acknowledged. Returns how many there are.
+    pub fn redeliver(&self, storage: &Storage) -> usize {
+        let mut published = self.published.lock().unwrap();
+        let pending = storage.blocks.outbox_len();
+        if pending > 0 {
+            *published = None;
+        }
+        pending
+    }
+
+    /// Retries publication every `interval` until the task is dropped.
+    pub async fn run(self, storage: Storage, clock: Arc<dyn Clock>, interval: Duration) {
+        loop {
+            match self.dispatch(&storage) {
+                Ok(0) => {}
+                Ok(published) => tracing::info!(published, "Published outbox events"),
+                Err(e) => tracing::warn!("Failed to publish outbox events: {}", e),
+            }
+            clock.sleep(interval).await;
+            let pending = self.redeliver(&storage);
+            if pending > 0 {
+                tracing::debug!(pending, "Republishing unacknowledged outbox events");
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_msgbus::{Subscriber, Topic, TryRecvError};
+    use bach_primitives::H256;
+    use bach_storage::OutboxEvent;
+    use bach_types::Block;
+
+    fn put_block(storage: &Storage, height: u64) -> Block {
+        let block = Block::new(height, H256::zero(), Vec::new(), 1000 + height);
+        let event = OutboxEvent {
+            block_hash: *block.hash().as_bytes(),
+            receipts: Vec::new(),
+            changes: Vec::new(),
+        };
+        storage.blocks.put_block_with_event(&block, &event).unwrap();
+        block
+    }
+
+    fn received_heights(blocks: &mut Subscriber) -> Vec<u64> {
+        let mut heights = Vec::new();
+        loop {
+            match blocks.try_recv() {
+                Ok(Message::BlockCommitted(info)) => heights.push(info.block.height),
+                Ok(other) => panic!("unexpected message {:?}", other),
+                Err(TryRecvError::Empty) => return heights,
+                Err(e) => panic!("unexpected error {:?}", e),
+            }
+        }
+    }
+
+    #[test]
+    fn test_dispatch_publishes_and_truncates() {
+        let storage = Storage::temporary().unwrap();
+        let bus = Arc::new(MsgBus::default());
+        let mut blocks = bus.subscribe(Topic::BlockCommitted);
+        let outbox = EventOutbox::new(Arc::clone(&bus));
+
+        // Events of blocks whose publication never happened
+        put_block(&storage, 1);
+        put_block(&storage, 2);
+        assert_eq!(outbox.clone().dispatch(&storage).unwrap(), 2);
+        assert_eq!(received_heights(&mut blocks), vec![1, 2]);
+
+        // Without consumers, nothing waits for an acknowledgement
+        assert_eq!(storage.blocks.outbox_len(), 0);
+        assert_eq!(outbox.dispatch(&storage).unwrap(), 0);
+        assert!(matches!(blocks.try_recv(), Err(TryRecvError::Empty)));
+    }
+
+    #[test]
+    fn test_events_wait_for_consumer_acks() {
+        let storage = Storage::temporary().unwrap();
+        let bus = Arc::new(MsgBus::default());
+        let mut blocks = bus.subscribe(Topic::BlockCommitted);
+        let outbox = EventOutbox::new(Arc::clone(&bus));
+        EventOutbox::register_consumer(&storage, "hooks").unwrap();
+
+        put_block(&storage, 1);
+        put_block(&storage, 2);
+        assert_eq!(outbox.dispatch(&storage).unwrap(), 2);
+        assert_eq!(received_heights(&mut blocks), vec![1, 2]);
+        assert_eq!(storage.blocks.outbox_len(), 2);
+
+        // Published events aren't repeated until a redelivery
+        put_block(&storage, 3);
+        assert_eq!(outbox.dispatch(&storage).unwrap(), 1);
+        assert_eq!(received_heights(&mut blocks), vec![3]);
+
+        // The consumer acknowledged block 1 only
+        storage.blocks.put_checkpoint("hooks", 1).unwrap();
+        assert_eq!(outbox.redeliver(&storage), 3);
+        assert_eq!(outbox.dispatch(&storage).unwrap(), 2);
+        assert_eq!(received_heights(&mut blocks), vec![2, 3]);
+        assert_eq!(storage.blocks.outbox_len(), 2);
+
+        storage.blocks.put_checkpoint("hooks", 3).unwrap();
+        assert_eq!(outbox.dispatch(&storage).unwrap(), 0);
+        assert_eq!(storage.blocks.outbox_len(), 0);
+        assert_eq!(outbox.redeliver(&storage), 0);
+    }
+
+    #[test]
+    fn test_missing_block_stays_pending() {
+        let storage = Storage::temporary().unwrap();
+        let outbox = EventOutbox::new(Arc::new(MsgBus::default()));
+        let event = OutboxEvent {
+            block_hash: [7u8; 32],
+            receipts: Vec::new(),
+            changes: Vec::new(),
+        };
+        let block = put_block(&storage, 1);
+        storage
+            .blocks
+            .put_block_with_event(&Block::new(2, block.hash(), Vec::new(), 1002), &event)
+            .unwrap();
+
+        assert!(outbox.dispatch(&storage).is_err());
+        assert_eq!(storage.blocks.get_outbox_events().unwrap()[0].0, 2);
+    }
+}
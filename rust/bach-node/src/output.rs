@@ -0,0 +1,286 @@
+//! CLI output rendering
+//!
+//! Every command renders its result through `render_list` or `render_one`
+//! in the format chosen with `--output`. JSON and YAML use the same
+//! camelCase field names as the JSON-RPC API; tables are for people.
+//! Failures exit with a code identifying the kind of failure (see
+//! `NodeError::exit_code`) so scripts can tell them apart.
+
+use crate::NodeError;
+use bach_primitives::ErrorCoded;
+use serde::Serialize;
+use serde_json::Value;
+
+/// Exit code for local failures (storage, IO)
+pub const EXIT_FAILURE: u8 = 1;
+
+/// Exit code for invalid arguments or configuration (as for usage errors)
+pub const EXIT_CONFIG: u8 = 2;
+
+/// Exit code when a peer or endpoint cannot be reached
+pub const EXIT_NETWORK: u8 = 3;
+
+/// Exit code when the chain rejects a request
+pub const EXIT_REJECTED: u8 = 4;
+
+/// Exit code when the caller is not permitted to perform a request
+pub const EXIT_DENIED: u8 = 5;
+
+/// Output format selected with `--output`
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum OutputFormat {
+    /// Aligned columns
+    #[default]
+    Table,
+    /// JSON
+    Json,
+    /// YAML
+    Yaml,
+}
+
+impl OutputFormat {
+    /// Returns the `--output` value selecting this format.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            OutputFormat::Table => "table",
+            OutputFormat::Json => "json",
+            OutputFormat::Yaml => "yaml",
+        }
+    }
+}
+
+/// A record that can also be shown as a table row.
+pub trait Tabular: Serialize {
+    /// Column headers
+    const HEADERS: &'static [&'static str];
+
+    /// Cells in `HEADERS` order
+    fn row(&self) -> Vec<String>;
+}
+
+/// Renders a list of records.
+pub fn render_list<T: Tabular>(format: OutputFormat, items: &[T]) -> Result<String, NodeError> {
+    match format {
+        OutputFormat::Table => Ok(table(
+            T::HEADERS,
+            &items.iter().map(Tabular::row).collect::<Vec<_>>(),
+        )),
+        _ => render_value(format, items),
+    }
+}
+
+/// Renders a single record; tables show one field per line.
+pub fn render_one<T: Tabular>(format: OutputFormat, item: &T) -> Result<String, NodeError> {
+    match format {
+        OutputFormat::Table => {
+            let rows: Vec<Vec<String>> = T::HEADERS
+                .iter()
+                .zip(item.row())
+                .map(|(header, cell)| vec![format!("{}:", header), cell])
+                .collect();
+            Ok(table(&[], &rows))
+        }
+        _ => render_value(format, item),
+    }
+}
+
+/// Renders an error for stderr.
+pub fn render_error(format: OutputFormat, err: &NodeError) -> String {
+    let value = serde_json::json!({
+        "error": {
+            "code": err.exit_code(),
+            "kind": err.kind(),
+            "error_code": err.error_code().as_str(),
+            "message": err.to_string(),
+        }
+    });
+    match format {
+        OutputFormat::Table => format!("Error: {}", err),
+        OutputFormat::Json => value.to_string(),
+        OutputFormat::Yaml => yaml(&value),
+    }
+}
+
+fn render_value<T: Serialize + ?Sized>(
+    format: OutputFormat,
+    value: &T,
+) -> Result<String, NodeError> {
+    let encoded = match format {
+        OutputFormat::Yaml => serde_json::to_value(value).map(|value| yaml(&value)),
+        _ => serde_json::to_string_pretty(value),
+    };
+    encoded.map_err(|e| NodeError::ConfigError(format!("Failed to encode output: {}", e)))
+}
+
+/// Lays out rows in columns padded to the widest cell.
+fn table(headers: &[&str], rows: &[Vec<String>]) -> String {
+    let header_row: Vec<String> = headers.iter().map(|h| h.to_string()).collect();
+    let all_rows = std::iter::once(&header_row)
+        .filter(|row| !row.is_empty())
+        .chain(rows);
+
+    let mut widths: Vec<usize> = Vec::new();
+    for row in all_rows.clone() {
+        for (i, cell) in row.iter().enumerate() {
+            match widths.get_mut(i) {
+                Some(width) => *width = (*width).max(cell.len()),
+                None => widths.push(cell.len()),
+            }
+        }
+    }
+
+    all_rows
+        .map(|row| {
+            let line: Vec<String> = row
+                .iter()
+                .enumerate()
+                .map(|(i, cell)| format!("{:width$}", cell, width = widths[i]))
+                .collect();
+            line.join("  ").trim_end().to_string()
+        })
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+fn yaml(value: &Value) -> String {
+    yaml_lines(value).join("\n")
+}
+
+fn yaml_lines(value: &Value) -> Vec<String> {
+    match value {
+        Value::Object(map) if !map.is_empty() => map
+            .iter()
+            .flat_map(|(key, value)| {
+                if is_block(value) {
+                    let nested = yaml_lines(value).into_iter().map(|l| format!("  {}", l));
+                    std::iter::once(format!("{}:", key)).chain(nested).collect()
+                } else {
+                    vec![format!("{}: {}", key, yaml_scalar(value))]
+                }
+            })
+            .collect(),
+        Value::Array(items) if !items.is_empty() => items
+            .iter()
+            .flat_map(|item| {
+                yaml_lines(item).into_iter().enumerate().map(|(i, line)| {
+                    if i == 0 {
+                        format!("- {}", line)
+                    } else {
+                        format!("  {}", line)
+                    }
+                })
+            })
+            .collect(),
+        _ => vec![yaml_scalar(value)],
+    }
+}
+
+/// Non-empty objects and arrays are written as indented blocks
+fn is_block(value: &Value) -> bool {
+    match value {
+        Value::Object(map) => !map.is_empty(),
+        Value::Array(items) => !items.is_empty(),
+        _ => false,
+    }
+}
+
+fn yaml_scalar(value: &Value) -> String {
+    match value {
+        Value::Null => "null".to_string(),
+        Value::Bool(b) => b.to_string(),
+        Value::Number(n) => n.to_string(),
+        Value::String(s) if is_plain(s) => s.clone(),
+        Value::String(s) => Value::String(s.clone()).to_string(),
+        Value::Array(_) => "[]".to_string(),
+        Value::Object(_) => "{}".to_string(),
+    }
+}
+
+/// Strings that YAML reads back as the same string without quotes
+fn is_plain(s: &str) -> bool {
+    let starts_ok = s
+        .chars()
+        .next()
+        .map_or(false, |c| c.is_ascii_alphabetic() || c == '/' || c == '.');
+    let reserved = matches!(
+        s.to_ascii_lowercase().as_str(),
+        "true" | "false" | "null" | "yes" | "no" | "on" | "off"
+    );
+    starts_ok
+        && !reserved
+        && s
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.' | '/'))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[derive(Serialize)]
+    #[serde(rename_all = "camelCase")]
+    struct Record {
+        name: String,
+        block_height: u64,
+        tags: Vec<String>,
+    }
+
+    impl Tabular for Record {
+        const HEADERS: &'static [&'static str] = &["NAME", "HEIGHT"];
+
+        fn row(&self) -> Vec<String> {
+            vec![self.name.clone(), self.block_height.to_string()]
+        }
+    }
+
+    fn records() -> Vec<Record> {
+        vec![
+            Record {
+                name: "genesis".to_string(),
+                block_height: 0,
+                tags: Vec::new(),
+            },
+            Record {
+                name: "0xabc".to_string(),
+                block_height: 1200,
+                tags: vec!["a b".to_string(), "true".to_string()],
+            },
+        ]
+    }
+
+    #[test]
+    fn test_table_columns_align() {
+        let out = render_list(OutputFormat::Table, &records()).unwrap();
+        assert_eq!(out, "NAME     HEIGHT\ngenesis  0\n0xabc    1200");
+
+        let out = render_one(OutputFormat::Table, &records()[0]).unwrap();
+        assert_eq!(out, "NAME:    genesis\nHEIGHT:  0");
+    }
+
+    #[test]
+    fn test_json_and_yaml_share_field_names() {
+        let json: Value =
+            serde_json::from_str(&render_list(OutputFormat::Json, &records()).unwrap()).unwrap();
+        assert_eq!(json[1]["blockHeight"], 1200);
+
+        let out = render_list(OutputFormat::Yaml, &records()).unwrap();
+        let expected = "- blockHeight: 0\n  name: genesis\n  tags: []\n\
+                        - blockHeight: 1200\n  name: \"0xabc\"\n  tags:\n    - \"a b\"\n    - \"true\"";
+        assert_eq!(out, expected);
+    }
+
+    #[test]
+    fn test_error_carries_exit_code() {
+        let err = NodeError::PermissionDenied("not a member".to_string());
+        assert_eq!(err.exit_code(), EXIT_DENIED);
+
+        let json: Value = serde_json::from_str(&render_error(OutputFormat::Json, &err)).unwrap();
+        assert_eq!(json["error"]["code"], EXIT_DENIED);
+        assert_eq!(json["error"]["kind"], "denied");
+        assert_eq!(json["error"]["error_code"], "PERMISSION_DENIED");
+        assert_eq!(
+            render_error(OutputFormat::Table, &err),
+            "Error: Permission denied: not a member"
+        );
+    }
+}
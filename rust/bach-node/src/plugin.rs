@@ -0,0 +1,160 @@
+//! CLI plugins
+//!
+//! Any executable named `bach-node-<name>` on `PATH` can be run as
+//! `bach-node <name> [args...]`. The plugin receives the remaining arguments
+//! unchanged and the effective CLI settings (context, data directory, RPC
+//! endpoint, chain ID, output format) as `BACH_*` environment variables, so
+//! teams can add commands without changing this binary.
+
+use crate::NodeError;
+use std::ffi::{OsStr, OsString};
+use std::path::{Path, PathBuf};
+use std::process::{Command, ExitStatus};
+
+/// File name prefix of plugin executables
+pub const PLUGIN_PREFIX: &str = "bach-node-";
+
+/// A plugin executable found on the search path.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Plugin {
+    /// Subcommand name (file name without prefix)
+    pub name: String,
+    /// Executable path
+    pub path: PathBuf,
+}
+
+impl Plugin {
+    /// Finds the plugin for subcommand `name` on `PATH`.
+    pub fn find(name: &str) -> Option<Plugin> {
+        Self::find_in(&std::env::var_os("PATH")?, name)
+    }
+
+    /// Finds the plugin for subcommand `name` on the given search path.
+    /// The first matching directory wins, as for any executable lookup.
+    pub fn find_in(search_path: &OsStr, name: &str) -> Option<Plugin> {
+        if name.is_empty() || name.contains(std::path::is_separator) {
+            return None;
+        }
+        std::env::split_paths(search_path)
+            .map(|dir| dir.join(format!("{}{}", PLUGIN_PREFIX, name)))
+            .find(|path| is_executable(path))
+            .map(|path| Plugin {
+                name: name.to_string(),
+                path,
+            })
+    }
+
+    /// Lists the plugins on `PATH`.
+    pub fn discover() -> Vec<Plugin> {
+        std::env::var_os("PATH")
+            .map(|path| Self::discover_in(&path))
+            .unwrap_or_default()
+    }
+
+    /// Lists the plugins on the given search path, sorted by name. A name
+    /// shadowed by an earlier directory is listed once.
+    pub fn discover_in(search_path: &OsStr) -> Vec<Plugin> {
+        let mut plugins: Vec<Plugin> = Vec::new();
+        for dir in std::env::split_paths(search_path) {
+            let Ok(entries) = std::fs::read_dir(&dir) else {
+                continue;
+            };
+            for entry in entries.flatten() {
+                let file_name = entry.file_name();
+                let Some(name) = file_name
+                    .to_str()
+                    .and_then(|f| f.strip_prefix(PLUGIN_PREFIX))
+                else {
+                    continue;
+                };
+                if name.is_empty()
+                    || plugins.iter().any(|p| p.name == name)
+                    || !is_executable(&entry.path())
+                {
+                    continue;
+                }
+                plugins.push(Plugin {
+                    name: name.to_string(),
+                    path: entry.path(),
+                });
+            }
+        }
+        plugins.sort_by(|a, b| a.name.cmp(&b.name));
+        plugins
+    }
+
+    /// Runs the plugin with `args`, adding `env` to the inherited environment,
+    /// and waits for it to exit.
+    pub fn run(&self, args: &[OsString], env: &[(&str, String)]) -> Result<ExitStatus, NodeError> {
+        Command::new(&self.path)
+            .args(args)
+            .envs(env.iter().map(|(key, value)| (key, value)))
+            .status()
+            .map_err(|e| {
+                NodeError::ConfigError(format!(
+                    "Failed to run plugin {}: {}",
+                    self.path.display(),
+                    e
+                ))
+            })
+    }
+}
+
+#[cfg(unix)]
+fn is_executable(path: &Path) -> bool {
+    use std::os::unix::fs::PermissionsExt;
+    std::fs::metadata(path)
+        .map(|meta| meta.is_file() && meta.permissions().mode() & 0o111 != 0)
+        .unwrap_or(false)
+}
+
+#[cfg(not(unix))]
+fn is_executable(path: &Path) -> bool {
+    path.is_file()
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::PermissionsExt;
+
+    fn write_script(dir: &Path, file_name: &str, body: &str, mode: u32) -> PathBuf {
+        let path = dir.join(file_name);
+        std::fs::write(&path, format!("#!/bin/sh\n{}\n", body)).unwrap();
+        std::fs::set_permissions(&path, std::fs::Permissions::from_mode(mode)).unwrap();
+        path
+    }
+
+    #[test]
+    fn test_plugins_found_on_search_path() {
+        let first = tempfile::tempdir().unwrap();
+        let second = tempfile::tempdir().unwrap();
+        let hello = write_script(
+            first.path(),
+            "bach-node-hello",
+            "[ \"$1\" = world ] && [ \"$BACH_OUTPUT\" = json ] || exit 9\nexit 7",
+            0o755,
+        );
+        write_script(second.path(), "bach-node-hello", "exit 0", 0o755);
+        write_script(second.path(), "bach-node-audit", "exit 0", 0o755);
+        write_script(second.path(), "bach-node-notes", "exit 0", 0o644);
+        write_script(second.path(), "other-tool", "exit 0", 0o755);
+
+        let search_path = std::env::join_paths([first.path(), second.path()]).unwrap();
+        let names: Vec<String> = Plugin::discover_in(&search_path)
+            .into_iter()
+            .map(|p| p.name)
+            .collect();
+        assert_eq!(names, vec!["audit", "hello"]);
+
+        let plugin = Plugin::find_in(&search_path, "hello").unwrap();
+        assert_eq!(plugin.path, hello);
+        assert!(Plugin::find_in(&search_path, "notes").is_none());
+        assert!(Plugin::find_in(&search_path, "../bach-node-hello").is_none());
+
+        let status = plugin
+            .run(&["world".into()], &[("BACH_OUTPUT", "json".to_string())])
+            .unwrap();
+        assert_eq!(status.code(), Some(7));
+    }
+}
@@ -0,0 +1,215 @@
+//! CLI profiles
+//!
+//! A profile file (`~/.bach/config.toml`, or `$BACH_HOME/config.toml`) holds
+//! named contexts, each bundling the settings one would otherwise repeat on
+//! every invocation: data directory, RPC endpoint, chain ID and key paths.
+//! The current context fills in any option not given on the command line.
+//!
+//! ```toml
+//! current_context = "org1"
+//!
+//! [contexts.org1]
+//! org = "org1"
+//! data_dir = "/var/lib/bach/org1"
+//! rpc_addr = "127.0.0.1:8545"
+//! chain_id = 31337
+//! member_key = "/etc/bach/org1/member.key"
+//! ```
+
+use crate::NodeError;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+/// Environment variable overriding the profile directory
+pub const BACH_HOME_ENV: &str = "BACH_HOME";
+
+/// Settings applied when a context is active. Unset fields fall back to
+/// the command-line defaults.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Context {
+    /// Organization the context acts for
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub org: Option<String>,
+
+    /// Node configuration file
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub config: Option<PathBuf>,
+
+    /// Data directory for blockchain storage
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub data_dir: Option<PathBuf>,
+
+    /// JSON-RPC endpoint
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rpc_addr: Option<String>,
+
+    /// Chain ID
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub chain_id: Option<u64>,
+
+    /// Validator private key file
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub validator_key: Option<PathBuf>,
+
+    /// Member private key file used to sign RPC access tokens
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub member_key: Option<PathBuf>,
+}
+
+impl Context {
+    /// Overwrites the fields set in `other`.
+    pub fn merge(&mut self, other: Context) {
+        let Context {
+            org,
+            config,
+            data_dir,
+            rpc_addr,
+            chain_id,
+            validator_key,
+            member_key,
+        } = other;
+        self.org = org.or(self.org.take());
+        self.config = config.or(self.config.take());
+        self.data_dir = data_dir.or(self.data_dir.take());
+        self.rpc_addr = rpc_addr.or(self.rpc_addr.take());
+        self.chain_id = chain_id.or(self.chain_id);
+        self.validator_key = validator_key.or(self.validator_key.take());
+        self.member_key = member_key.or(self.member_key.take());
+    }
+}
+
+/// Named contexts and the one currently in use.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Profile {
+    /// Context applied when none is named on the command line
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub current_context: Option<String>,
+
+    /// Contexts by name
+    #[serde(default)]
+    pub contexts: BTreeMap<String, Context>,
+}
+
+impl Profile {
+    /// Returns the profile file location, or None if no home directory is known.
+    pub fn default_path() -> Option<PathBuf> {
+        let home = match std::env::var_os(BACH_HOME_ENV) {
+            Some(dir) => PathBuf::from(dir),
+            None => PathBuf::from(std::env::var_os("HOME")?).join(".bach"),
+        };
+        Some(home.join("config.toml"))
+    }
+
+    /// Loads a profile file. A missing file is an empty profile.
+    pub fn load(path: &Path) -> Result<Self, NodeError> {
+        let content = match std::fs::read_to_string(path) {
+            Ok(content) => content,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Self::default()),
+            Err(e) => return Err(e.into()),
+        };
+        toml::from_str(&content)
+            .map_err(|e| NodeError::ConfigError(format!("Failed to parse profile: {}", e)))
+    }
+
+    /// Saves the profile, creating its directory if needed.
+    pub fn save(&self, path: &Path) -> Result<(), NodeError> {
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)?;
+        }
+        let content = toml::to_string_pretty(self)
+            .map_err(|e| NodeError::ConfigError(format!("Failed to serialize profile: {}", e)))?;
+        std::fs::write(path, content)?;
+        Ok(())
+    }
+
+    /// Makes `name` the current context.
+    pub fn use_context(&mut self, name: &str) -> Result<(), NodeError> {
+        if !self.contexts.contains_key(name) {
+            return Err(NodeError::ConfigError(format!("Unknown context: {}", name)));
+        }
+        self.current_context = Some(name.to_string());
+        Ok(())
+    }
+
+    /// Creates a context or updates the fields set in `context`.
+    pub fn set_context(&mut self, name: &str, context: Context) {
+        self.contexts
+            .entry(name.to_string())
+            .or_default()
+            .merge(context);
+    }
+
+    /// Removes a context, clearing it as the current one.
+    pub fn delete_context(&mut self, name: &str) -> Result<(), NodeError> {
+        if self.contexts.remove(name).is_none() {
+            return Err(NodeError::ConfigError(format!("Unknown context: {}", name)));
+        }
+        if self.current_context.as_deref() == Some(name) {
+            self.current_context = None;
+        }
+        Ok(())
+    }
+
+    /// Returns the context to apply: the named one if given, otherwise the
+    /// current one. Naming an unknown context is an error.
+    pub fn resolve(&self, name: Option<&str>) -> Result<Option<&Context>, NodeError> {
+        match name.or(self.current_context.as_deref()) {
+            Some(name) => self
+                .contexts
+                .get(name)
+                .map(Some)
+                .ok_or_else(|| NodeError::ConfigError(format!("Unknown context: {}", name))),
+            None => Ok(None),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_profile_round_trip_and_resolution() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let path = temp_dir.path().join("bach").join("config.toml");
+        assert_eq!(Profile::load(&path).unwrap(), Profile::default());
+
+        let mut profile = Profile::default();
+        profile.set_context(
+            "org1",
+            Context {
+                org: Some("org1".to_string()),
+                chain_id: Some(7),
+                ..Default::default()
+            },
+        );
+        profile.set_context(
+            "org1",
+            Context {
+                rpc_addr: Some("127.0.0.1:9545".to_string()),
+                ..Default::default()
+            },
+        );
+        profile.set_context("org2", Context::default());
+        assert!(profile.use_context("org3").is_err());
+        profile.use_context("org1").unwrap();
+        profile.save(&path).unwrap();
+
+        let loaded = Profile::load(&path).unwrap();
+        assert_eq!(loaded, profile);
+        let current = loaded.resolve(None).unwrap().unwrap();
+        assert_eq!(current.chain_id, Some(7));
+        assert_eq!(current.rpc_addr.as_deref(), Some("127.0.0.1:9545"));
+        assert_eq!(
+            loaded.resolve(Some("org2")).unwrap(),
+            Some(&Context::default())
+        );
+        assert!(loaded.resolve(Some("org3")).is_err());
+
+        let mut profile = loaded;
+        profile.delete_context("org1").unwrap();
+        assert_eq!(profile.current_context, None);
+        assert_eq!(profile.resolve(None).unwrap(), None);
+    }
+}
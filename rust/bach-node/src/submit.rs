@@ -0,0 +1,475 @@
+//! Retrying transaction submission
+//!
+//! `TxSubmitter` sends a signed transaction with `eth_sendRawTransaction`
+//! and retries failures a `RetryPolicy` deems
+//! transient instead of giving up on the first one: unreachable nodes,
+//! overloaded ones (HTTP 429, 502, 503, 504) and JSON-RPC errors whose
+//! catalog code the policy lists. Other errors fail at once.
+//!
+//! Resubmitting is idempotent: the node identifies a transaction by its
+//! hash, the tx id, so every attempt submits the same transaction, and a
+//! `DUPLICATE_TX` reply means an earlier attempt got through. Before each retry the submitter also looks the tx id up
+//! with `eth_getTransactionReceipt`, the receipt the node's tx watcher
+//! hands out on commit, so an attempt whose reply was lost but whose
+//! transaction was committed isn't submitted again. Backoff doubles per
+//! retry up to a cap, minus jitter derived from the tx id so clients
+//! retrying together spread out. Requests go through the bounded
+//! HTTP client.
+
+use crate::http::HttpClient;
+use crate::NodeError;
+use bach_crypto::keccak256_concat;
+use bach_primitives::{Clock, ErrorCode, SystemClock, H256};
+use bach_rpc::{format_bytes, format_h256, parse_h256};
+use bach_types::Transaction;
+use serde::de::DeserializeOwned;
+use std::sync::Arc;
+use std::time::Duration;
+
+/// HTTP statuses retried whatever the policy's error codes.
+pub const RETRYABLE_HTTP_STATUSES: &[u16] = &[429, 502, 503, 504];
+
+/// When and how often a failed submission is retried
+#[derive(Debug, Clone, PartialEq)]
+pub struct RetryPolicy {
+    /// Attempts in total, the first included
+    pub max_attempts: u32,
+    /// Wait before the first retry
+    pub initial_backoff: Duration,
+    /// Longest wait between two attempts
+    pub max_backoff: Duration,
+    /// Fraction of each wait taken off at random, from 0.0 to 1.0
+    pub jitter: f64,
+    /// JSON-RPC error codes worth retrying
+    pub retryable_codes: Vec<ErrorCode>,
+}
+
+impl Default for RetryPolicy {
+    fn default() -> Self {
+        Self {
+            max_attempts: 5,
+            initial_backoff: Duration::from_millis(200),
+            max_backoff: Duration::from_secs(5),
+            jitter: 0.2,
+            retryable_codes: vec![
+                ErrorCode::Unavailable,
+                ErrorCode::Network,
+                ErrorCode::PreBlockMissing,
+                ErrorCode::SigQuorumNotReached,
+            ],
+        }
+    }
+}
+
+impl RetryPolicy {
+    /// Returns a policy that never retries.
+    pub fn no_retry() -> Self {
+        Self {
+            max_attempts: 1,
+            ..Self::default()
+        }
+    }
+
+    /// Returns the wait before retry number `retry` (from 1) of the
+    /// transaction `tx_id`.
+    pub fn backoff(&self, retry: u32, tx_id: &H256) -> Duration {
+        let factor = 2u32.saturating_pow(retry.saturating_sub(1));
+        let backoff = self
+            .initial_backoff
+            .saturating_mul(factor)
+            .min(self.max_backoff);
+        let sample = keccak256_concat(&[tx_id.as_bytes(), &retry.to_be_bytes()]);
+        let sample = u64::from_be_bytes(sample.as_bytes()[..8].try_into().unwrap());
+        let fraction = sample as f64 / u64::MAX as f64;
+        backoff.mul_f64(1.0 - self.jitter.clamp(0.0, 1.0) * fraction)
+    }
+
+    fn is_retryable(&self, error: &RequestError) -> bool {
+        match error {
+            RequestError::Transport(_) => true,
+            RequestError::Rpc { code, .. } => {
+                code.is_some_and(|code| self.retryable_codes.contains(&code))
+            }
+            RequestError::Invalid(_) => false,
+        }
+    }
+}
+
+/// A transaction the node accepted
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Submitted {
+    /// Hash identifying the transaction
+    pub tx_id: H256,
+    /// Attempts it took
+    pub attempts: u32,
+    /// True if a retry found the transaction already committed
+    pub committed: bool,
+}
+
+/// Submits signed raw transactions to a remote node, retrying transient
+/// failures.
+#[derive(Debug, Clone)]
+pub struct TxSubmitter {
+    http: HttpClient,
+    policy: RetryPolicy,
+    clock: Arc<dyn Clock>,
+}
+
+impl TxSubmitter {
+    /// Creates a submitter for the given JSON-RPC address with the default
+    /// retry policy.
+    pub fn new(addr: &str) -> Self {
+        Self {
+            http: HttpClient::new(addr),
+            policy: RetryPolicy::default(),
+            clock: Arc::new(SystemClock),
+        }
+    }
+
+    /// Sets the retry policy.
+    pub fn with_policy(mut self, policy: RetryPolicy) -> Self {
+        self.policy = policy;
+        self
+    }
+
+    /// Sets the clock backoffs are waited on.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Returns the retry policy.
+    pub fn policy(&self) -> &RetryPolicy {
+        &self.policy
+    }
+
+    /// Submits `tx` until the node accepts it, a retry finds it committed
+    /// or the policy gives up.
+    pub async fn submit(&self, tx: &Transaction) -> Result<Submitted, NodeError> {
+        let raw = &tx.encode()[..];
+        let tx_id = tx.hash();
+        let mut attempts = 0;
+        loop {
+            attempts += 1;
+            match self.attempt(raw, &tx_id, attempts > 1).await {
+                Ok(committed) => {
+                    return Ok(Submitted {
+                        tx_id,
+                        attempts,
+                        committed,
+                    })
+                }
+                Err(e) if attempts < self.policy.max_attempts && self.policy.is_retryable(&e) => {
+                    let backoff = self.policy.backoff(attempts, &tx_id);
+                    tracing::debug!(
+                        "Submitting {:?} failed ({}), retrying in {:?}",
+                        tx_id,
+                        NodeError::from(e),
+                        backoff
+                    );
+                    self.clock.sleep(backoff).await;
+                }
+                Err(e) => return Err(e.into()),
+            }
+        }
+    }
+
+    /// Submits `raw` once and returns true if a retry found it committed
+    /// instead.
+    async fn attempt(&self, raw: &[u8], tx_id: &H256, retry: bool) -> Result<bool, RequestError> {
+        if retry {
+            let receipt: Option<serde_json::Value> = self
+                .call(
+                    "eth_getTransactionReceipt",
+                    serde_json::json!([format_h256(tx_id)]),
+                )
+                .await?;
+            if receipt.is_some() {
+                return Ok(true);
+            }
+        }
+        let hash: String = match self
+            .call(
+                "eth_sendRawTransaction",
+                serde_json::json!([format_bytes(raw)]),
+            )
+            .await
+        {
+            Err(RequestError::Rpc {
+                code: Some(ErrorCode::DuplicateTx),
+                ..
+            }) => return Ok(false),
+            result => result?,
+        };
+        if parse_h256(&hash).ok() != Some(*tx_id) {
+            return Err(RequestError::Invalid(NodeError::ConfigError(format!(
+                "node accepted the transaction as {}, expected {}",
+                hash,
+                format_h256(tx_id)
+            ))));
+        }
+        Ok(false)
+    }
+
+    /// Sends a JSON-RPC request and decodes its result.
+    async fn call<T: DeserializeOwned>(
+        &self,
+        method: &str,
+        params: serde_json::Value,
+    ) -> Result<T, RequestError> {
+        let body = serde_json::json!({
+            "jsonrpc": "2.0",
+            "id": 1,
+            "method": method,
+            "params": params,
+        })
+        .to_string();
+        let response = self
+            .http
+            .post_json(&body, None)
+            .await
+            .map_err(|e| RequestError::Transport(e.into()))?;
+        parse_response(&response, method)
+    }
+}
+
+/// Why a request failed
+#[derive(Debug)]
+enum RequestError {
+    /// The node couldn't be reached or was too busy to answer
+    Transport(NodeError),
+    /// The node answered with a JSON-RPC error
+    Rpc {
+        code: Option<ErrorCode>,
+        message: String,
+    },
+    /// The node's answer couldn't be used
+    Invalid(NodeError),
+}
+
+impl From<RequestError> for NodeError {
+    fn from(error: RequestError) -> Self {
+        match error {
+            RequestError::Transport(e) | RequestError::Invalid(e) => e,
+            RequestError::Rpc {
+                code: Some(ErrorCode::PermissionDenied),
+                message,
+            } => NodeError::PermissionDenied(message),
+            RequestError::Rpc { message, .. } => NodeError::Rejected(message),
+        }
+    }
+}
+
+/// Extracts the result of a JSON-RPC HTTP response.
+fn parse_response<T: DeserializeOwned>(response: &[u8], method: &str) -> Result<T, RequestError> {
+    let invalid = |detail: String| RequestError::Invalid(NodeError::ConfigError(detail));
+    let response = String::from_utf8_lossy(response);
+    let (head, body) = response
+        .split_once("\r\n\r\n")
+        .ok_or_else(|| invalid(format!("truncated {} response", method)))?;
+    let status_line = head.lines().next().unwrap_or_default();
+    let status = status_line
+        .split_whitespace()
+        .nth(1)
+        .and_then(|s| s.parse().ok());
+    if status != Some(200) {
+        let error = format!("{} request returned {}", method, status_line);
+        return Err(match status {
+            Some(status) if RETRYABLE_HTTP_STATUSES.contains(&status) => {
+                RequestError::Transport(NodeError::ConfigError(error))
+            }
+            _ => invalid(error),
+        });
+    }
+
+    let reply: serde_json::Value = serde_json::from_str(body.trim())
+        .map_err(|e| invalid(format!("invalid {} response: {}", method, e)))?;
+    if let Some(error) = reply.get("error") {
+        let message = error.get("message").and_then(|m| m.as_str());
+        let code = error
+            .pointer("/data/errorCode")
+            .and_then(|code| code.as_str())
+            .and_then(ErrorCode::from_name);
+        return Err(RequestError::Rpc {
+            code,
+            message: message.map_or_else(|| error.to_string(), str::to_string),
+        });
+    }
+    let result = reply.get("result").cloned().unwrap_or_default();
+    serde_json::from_value(result)
+        .map_err(|e| invalid(format!("invalid {} response: {}", method, e)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Mutex;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::TcpListener;
+
+    /// Serves one connection per reply, in order, and records the method
+    /// of each request.
+    async fn serve(replies: Vec<(&'static str, String)>) -> (String, Arc<Mutex<Vec<String>>>) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let methods = Arc::new(Mutex::new(Vec::new()));
+        let seen = Arc::clone(&methods);
+        tokio::spawn(async move {
+            for (status, reply) in replies {
+                let (mut stream, _) = listener.accept().await.unwrap();
+                let mut buf = [0u8; 4096];
+                let n = stream.read(&mut buf).await.unwrap();
+                let request = String::from_utf8_lossy(&buf[..n]).to_string();
+                let body = request.split_once("\r\n\r\n").unwrap().1;
+                let body: serde_json::Value = serde_json::from_str(body).unwrap();
+                seen.lock()
+                    .unwrap()
+                    .push(body["method"].as_str().unwrap().to_string());
+                let response = format!(
+                    "HTTP/1.1 {}\r\nContent-Type: application/json\r\n\
+                     Content-Length: {}\r\n\r\n{}",
+                    status,
+                    reply.len(),
+                    reply
+                );
+                stream.write_all(response.as_bytes()).await.unwrap();
+            }
+        });
+        (addr, methods)
+    }
+
+    fn result(value: serde_json::Value) -> (&'static str, String) {
+        let reply = serde_json::json!({"jsonrpc": "2.0", "id": 1, "result": value});
+        ("200 OK", reply.to_string())
+    }
+
+    fn error(code: ErrorCode) -> (&'static str, String) {
+        let reply = serde_json::json!({
+            "jsonrpc": "2.0",
+            "id": 1,
+            "error": {"code": -32000, "message": "failed", "data": {"errorCode": code.as_str()}},
+        });
+        ("200 OK", reply.to_string())
+    }
+
+    fn submitter(addr: &str) -> TxSubmitter {
+        TxSubmitter::new(addr).with_policy(RetryPolicy {
+            initial_backoff: Duration::ZERO,
+            ..RetryPolicy::default()
+        })
+    }
+
+    fn tx() -> Transaction {
+        let key = bach_testutil::test_key(0);
+        let mut tx = Transaction::new(
+            0,
+            None,
+            Default::default(),
+            vec![1, 2, 3],
+            key.sign(&H256::zero()),
+        );
+        tx.sign(&key, &[]);
+        tx
+    }
+
+    #[tokio::test]
+    async fn test_retries_until_accepted() {
+        let tx_id = format_h256(&tx().hash());
+        let (addr, methods) = serve(vec![
+            ("503 Service Unavailable", String::new()),
+            result(serde_json::Value::Null),
+            error(ErrorCode::Unavailable),
+            result(serde_json::Value::Null),
+            result(serde_json::json!(tx_id)),
+        ])
+        .await;
+
+        let submitted = submitter(&addr).submit(&tx()).await.unwrap();
+        assert_eq!(submitted.tx_id, tx().hash());
+        assert_eq!(submitted.attempts, 3);
+        assert!(!submitted.committed);
+        assert_eq!(
+            *methods.lock().unwrap(),
+            [
+                "eth_sendRawTransaction",
+                "eth_getTransactionReceipt",
+                "eth_sendRawTransaction",
+                "eth_getTransactionReceipt",
+                "eth_sendRawTransaction",
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_committed_transaction_is_not_resubmitted() {
+        let (addr, methods) = serve(vec![
+            error(ErrorCode::Network),
+            result(serde_json::json!({"status": "0x1"})),
+        ])
+        .await;
+
+        let submitted = submitter(&addr).submit(&tx()).await.unwrap();
+        assert_eq!(submitted.attempts, 2);
+        assert!(submitted.committed);
+        assert_eq!(methods.lock().unwrap().len(), 2);
+
+        // A duplicate means an earlier attempt got through
+        let (addr, _) = serve(vec![error(ErrorCode::DuplicateTx)]).await;
+        assert_eq!(submitter(&addr).submit(&tx()).await.unwrap().attempts, 1);
+    }
+
+    #[tokio::test]
+    async fn test_gives_up_on_permanent_errors() {
+        let (addr, methods) = serve(vec![error(ErrorCode::InvalidArgument)]).await;
+        assert!(matches!(
+            submitter(&addr).submit(&tx()).await,
+            Err(NodeError::Rejected(_))
+        ));
+        assert_eq!(methods.lock().unwrap().len(), 1);
+
+        // The retry's receipt lookup fails too and uses up the attempts
+        let (addr, methods) = serve(vec![error(ErrorCode::Unavailable); 2]).await;
+        let policy = RetryPolicy {
+            max_attempts: 2,
+            initial_backoff: Duration::ZERO,
+            ..RetryPolicy::default()
+        };
+        let submitter = TxSubmitter::new(&addr).with_policy(policy);
+        assert!(submitter.submit(&tx()).await.is_err());
+        assert_eq!(
+            *methods.lock().unwrap(),
+            ["eth_sendRawTransaction", "eth_getTransactionReceipt"]
+        );
+    }
+
+    #[test]
+    fn test_backoff() {
+        let tx_id = tx().hash();
+        let policy = RetryPolicy {
+            initial_backoff: Duration::from_millis(100),
+            max_backoff: Duration::from_millis(1000),
+            jitter: 0.0,
+            ..RetryPolicy::default()
+        };
+        let waits: Vec<_> = (1..=6).map(|retry| policy.backoff(retry, &tx_id)).collect();
+        assert_eq!(
+            waits,
+            [100, 200, 400, 800, 1000, 1000].map(Duration::from_millis)
+        );
+
+        let jittered = RetryPolicy {
+            jitter: 0.5,
+            ..policy
+        };
+        for retry in 1..=6 {
+            let wait = jittered.backoff(retry, &tx_id);
+            assert!(wait <= waits[retry as usize - 1]);
+            assert!(wait >= waits[retry as usize - 1] / 2);
+            assert_eq!(wait, jittered.backoff(retry, &tx_id));
+        }
+        assert_ne!(
+            jittered.backoff(1, &tx_id),
+            jittered.backoff(1, &bach_crypto::keccak256(&[4]))
+        );
+    }
+}
@@ -0,0 +1,205 @@
+//! Streaming subscriptions to contract state changes
+//!
+//! A `StateChangeSubscription` first replays the changes recorded in
+//! storage after its resume point, then tails newly committed blocks on the
+//! message bus. Each change carries its position; a client that persists the
+//! position of the last change it applied can resume from it after a restart
+//! and receives every later change at least once.
+
+use bach_msgbus::{Message, RecvError, Subscriber};
+use bach_primitives::{Address, H256};
+use bach_storage::{StateChange, Storage};
+use std::collections::VecDeque;
+
+/// Changes read from storage per catch-up page
+const CATCH_UP_PAGE_SIZE: usize = 256;
+
+/// Selects the state changes a subscription delivers.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StateChangeFilter {
+    /// Contract whose storage is mirrored
+    pub address: Address,
+    /// Leading bytes of the slots of interest (empty matches every slot)
+    pub slot_prefix: Vec<u8>,
+}
+
+impl StateChangeFilter {
+    /// Creates a filter for the slots of `address` starting with `slot_prefix`.
+    pub fn new(address: Address, slot_prefix: Vec<u8>) -> Self {
+        Self {
+            address,
+            slot_prefix,
+        }
+    }
+
+    /// Returns true if the change is selected by this filter.
+    pub fn matches(&self, change: &StateChange) -> bool {
+        change.address == *self.address.as_bytes() && change.slot.starts_with(&self.slot_prefix)
+    }
+}
+
+/// Stream of state changes matching a `StateChangeFilter`.
+pub struct StateChangeSubscription {
+    storage: Storage,
+    blocks: Subscriber,
+    filter: StateChangeFilter,
+    position: Option<(u64, H256)>,
+    buffer: VecDeque<StateChange>,
+    live: bool,
+}
+
+impl StateChangeSubscription {
+    /// Creates a subscription delivering changes after `resume` (or from the
+    /// start of the chain).
+    ///
+    /// `blocks` must be subscribed to `Topic::BlockCommitted` before the
+    /// subscription starts reading storage so no commit falls between the two.
+    pub fn new(
+        storage: Storage,
+        blocks: Subscriber,
+        filter: StateChangeFilter,
+        resume: Option<(u64, H256)>,
+    ) -> Self {
+        Self {
+            storage,
+            blocks,
+            filter,
+            position: resume,
+            buffer: VecDeque::new(),
+            live: false,
+        }
+    }
+
+    /// Returns the position of the last delivered change, to resume from.
+    pub fn resume_token(&self) -> Option<(u64, H256)> {
+        self.position
+    }
+
+    /// Returns true once historical changes have been replayed.
+    pub fn is_live(&self) -> bool {
+        self.live
+    }
+
+    /// Returns the next matching change, or None once the bus closes.
+    pub async fn next(&mut self) -> Option<StateChange> {
+        loop {
+            if let Some(change) = self.buffer.pop_front() {
+                self.position = Some(change.position());
+                return Some(change);
+            }
+
+            if !self.live {
+                let page = self.storage.state.get_state_changes(
+                    &self.filter.address,
+                    &self.filter.slot_prefix,
+                    self.position,
+                    CATCH_UP_PAGE_SIZE,
+                );
+                match (page.changes.is_empty(), page.resume) {
+                    // Nothing matched within the scanned range, skip past it
+                    (true, Some(resume)) => self.position = Some(resume),
+                    (empty, _) => self.live = empty,
+                }
+                self.buffer.extend(page.changes);
+                continue;
+            }
+
+            match self.blocks.recv().await {
+                Ok(Message::BlockCommitted(info)) => {
+                    // Blocks already replayed from storage are skipped
+                    let position = self.position;
+                    self.buffer
+                        .extend(info.changes.iter().cloned().filter(|change| {
+                            self.filter.matches(change)
+                                && position.map_or(true, |after| change.position() > after)
+                        }));
+                }
+                Ok(_) => {}
+                Err(RecvError::Lagged(skipped)) => {
+                    tracing::debug!(skipped, "State change subscription lagged, replaying");
+                    self.live = false;
+                }
+                Err(RecvError::Closed) => return None,
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_msgbus::{BlockInfo, MsgBus, Topic};
+    use bach_types::Block;
+    use std::sync::Arc;
+    use tempfile::TempDir;
+
+    fn commit(storage: &Storage, bus: &MsgBus, height: u64, writes: &[(Address, H256, H256)]) {
+        let changes = storage.state.apply_block_writes(height, writes).unwrap();
+        bus.publish(Message::BlockCommitted(Arc::new(BlockInfo {
+            block: Block::new(height, H256::zero(), Vec::new(), 1000 + height),
+            receipts: Vec::new(),
+            changes,
+        })));
+    }
+
+    #[tokio::test]
+    async fn test_catch_up_then_tail_and_resume() {
+        let temp_dir = TempDir::new().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let bus = MsgBus::default();
+
+        let contract = Address::from([0x11; 20]);
+        let slot = |first: u8, last: u8| {
+            let mut slot = [first; 32];
+            slot[31] = last;
+            H256::from(slot)
+        };
+        let value = H256::from([0xaa; 32]);
+        commit(&storage, &bus, 1, &[(contract, slot(0xab, 1), value)]);
+        commit(&storage, &bus, 2, &[(contract, slot(0xcd, 1), value)]);
+
+        let filter = StateChangeFilter::new(contract, vec![0xab]);
+        let blocks = bus.subscribe(Topic::BlockCommitted);
+        let mut sub = StateChangeSubscription::new(storage.clone(), blocks, filter.clone(), None);
+
+        // Historical changes, including a commit made while replaying
+        assert_eq!(sub.next().await.unwrap().position(), (1, slot(0xab, 1)));
+        commit(&storage, &bus, 3, &[(contract, slot(0xab, 2), value)]);
+        assert_eq!(sub.next().await.unwrap().position(), (3, slot(0xab, 2)));
+        assert!(!sub.is_live());
+
+        // Live changes; the bus copy of block 3 is not delivered twice
+        let live = StateChange {
+            height: 5,
+            address: *contract.as_bytes(),
+            slot: *slot(0xab, 5).as_bytes(),
+            old_value_hash: [0u8; 32],
+            new_value_hash: [0u8; 32],
+            new_value: [0x01; 32],
+        };
+        bus.publish(Message::BlockCommitted(Arc::new(BlockInfo {
+            block: Block::new(5, H256::zero(), Vec::new(), 1005),
+            receipts: Vec::new(),
+            changes: vec![live.clone()],
+        })));
+        assert_eq!(sub.next().await.unwrap(), live);
+        assert!(sub.is_live());
+        let token = Some((3, slot(0xab, 2)));
+
+        // A resumed subscription skips what was already delivered
+        commit(
+            &storage,
+            &bus,
+            4,
+            &[(contract, slot(0xab, 1), H256::zero())],
+        );
+        let blocks = bus.subscribe(Topic::BlockCommitted);
+        let mut resumed = StateChangeSubscription::new(storage.clone(), blocks, filter, token);
+        let change = resumed.next().await.unwrap();
+        assert_eq!(change.position(), (4, slot(0xab, 1)));
+        assert_eq!(change.new_value_h256(), H256::zero());
+
+        drop(bus);
+        assert!(resumed.next().await.is_none());
+    }
+}
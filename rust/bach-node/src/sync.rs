@@ -0,0 +1,925 @@
+//! Streaming block sync
+//!
+//! A node that is behind its peers fetches the missing blocks header-first.
+//! It fetches and checks every header up to the sync target before any
+//! body: each hash is recomputed from the header fields and each parent
+//! link followed, so a peer serving a forged chain is dropped after one
+//! small response and retried on the next, and no block is applied before
+//! the header chain from the node's head to the target is known. The
+//! bodies are then fetched in ranges from several peers at once, checked
+//! against their headers and applied in height order while later ranges
+//! are still being fetched.
+//!
+//! With a validator set (`with_checkpoints`) the target is the highest
+//! finality checkpoint a peer holds that is signed by a quorum of those
+//! validators. Headers are then checked backwards from the checkpoint's
+//! block, and the checkpointed header must carry its state root, so every
+//! synced block is vouched for by the validators whichever peers served
+//! it. Blocks above the checkpoint are left to consensus. Without a
+//! validator set, e.g. on a chain with checkpoints disabled, the target is
+//! the highest peer head and headers are checked forwards from the node's
+//! head, trusting the peers as far as the parent links go.
+//!
+//! At most `max_in_flight` ranges of bodies are fetched or buffered at a
+//! time, which bounds the blocks a sync holds to
+//! `max_in_flight * range_size`; the headers up to the target are held for
+//! the whole sync. A range a peer fails to serve, or serves wrongly, is
+//! retried on the next peer that has it.
+//!
+//! Applying a block re-executes it. `apply` gets the state root the block's
+//! header records and must compare it with its own before committing, so a
+//! block that diverges is never committed.
+
+use crate::NodeError;
+use bach_consensus::{verify_checkpoint, ValidatorSet};
+use bach_crypto::{HashAlgorithm, HashSchedule};
+use bach_network::{SerializableHeader, SyncProgress};
+use bach_primitives::H256;
+use bach_storage::{BlockHeader, Storage};
+use bach_types::{Block, BlockDigests, SignedCheckpoint};
+use std::collections::VecDeque;
+use std::sync::Arc;
+use std::thread;
+
+/// Default number of blocks in a fetched range
+pub const DEFAULT_SYNC_RANGE_SIZE: u64 = 128;
+
+/// Default number of ranges fetched or buffered at once
+pub const DEFAULT_SYNC_MAX_IN_FLIGHT: usize = 4;
+
+/// Streaming sync settings.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct SyncConfig {
+    /// Blocks per fetched range
+    pub range_size: u64,
+    /// Ranges of bodies fetched or buffered at once
+    pub max_in_flight: usize,
+}
+
+impl Default for SyncConfig {
+    fn default() -> Self {
+        Self {
+            range_size: DEFAULT_SYNC_RANGE_SIZE,
+            max_in_flight: DEFAULT_SYNC_MAX_IN_FLIGHT,
+        }
+    }
+}
+
+/// A block header with the hashes the serving peer claims for it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SyncHeader {
+    /// Stored header
+    pub header: BlockHeader,
+    /// Block hash
+    pub hash: H256,
+    /// Hash under the previous algorithm, for a transition block
+    pub legacy_hash: Option<H256>,
+}
+
+impl SyncHeader {
+    /// Recomputes the block hash from the header fields.
+    pub fn compute_hash(&self, algorithm: HashAlgorithm) -> H256 {
+        algorithm.digest_concat(&[
+            &self.header.height.to_be_bytes(),
+            &self.header.parent_hash,
+            &self.header.transactions_hash,
+            &self.header.timestamp.to_be_bytes(),
+        ])
+    }
+
+    /// Returns the block height.
+    pub fn height(&self) -> u64 {
+        self.header.height
+    }
+
+    /// Returns whether `hash` is this block's hash or legacy hash.
+    pub fn is_hash(&self, hash: &H256) -> bool {
+        self.hash == *hash || self.legacy_hash.as_ref() == Some(hash)
+    }
+}
+
+impl From<&SyncHeader> for SerializableHeader {
+    fn from(header: &SyncHeader) -> Self {
+        Self {
+            height: header.header.height,
+            parent_hash: header.header.parent_hash,
+            timestamp: header.header.timestamp,
+            transactions_hash: header.header.transactions_hash,
+            state_root: header.header.state_root,
+            hash: *header.hash.as_bytes(),
+            legacy_hash: header.legacy_hash.map(|hash| *hash.as_bytes()),
+        }
+    }
+}
+
+impl From<SerializableHeader> for SyncHeader {
+    fn from(header: SerializableHeader) -> Self {
+        Self {
+            header: BlockHeader {
+                height: header.height,
+                parent_hash: header.parent_hash,
+                timestamp: header.timestamp,
+                transactions_hash: header.transactions_hash,
+                state_root: header.state_root,
+            },
+            hash: H256::from(header.hash),
+            legacy_hash: header.legacy_hash.map(H256::from),
+        }
+    }
+}
+
+/// A peer blocks can be synced from.
+///
+/// Responses may be short or wrong; the sync engine checks them.
+pub trait BlockSource: Send + Sync {
+    /// Returns a name for logs and errors.
+    fn name(&self) -> &str;
+
+    /// Returns the peer's head height.
+    fn head(&self) -> u64;
+
+    /// Returns the headers of `count` blocks from `start`.
+    fn headers(&self, start: u64, count: u64) -> Vec<SyncHeader>;
+
+    /// Returns `count` blocks from `start`.
+    fn blocks(&self, start: u64, count: u64) -> Vec<Block>;
+
+    /// Returns the peer's highest finality checkpoint, if any.
+    fn checkpoint(&self) -> Option<SignedCheckpoint>;
+}
+
+/// Serves blocks from a node's storage, up to the first quarantined one.
+pub struct StorageSource {
+    name: String,
+    storage: Storage,
+    schedule: HashSchedule,
+}
+
+impl StorageSource {
+    /// Creates a source hashing blocks with `schedule`.
+    pub fn new(name: impl Into<String>, storage: Storage, schedule: HashSchedule) -> Self {
+        Self {
+            name: name.into(),
+            storage,
+            schedule,
+        }
+    }
+}
+
+impl BlockSource for StorageSource {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn head(&self) -> u64 {
+        self.storage.blocks.get_block_height()
+    }
+
+    fn headers(&self, start: u64, count: u64) -> Vec<SyncHeader> {
+        self.blocks(start, count)
+            .iter()
+            .map_while(|block| {
+                let digests = block.digests(&self.schedule);
+                let header = self.storage.blocks.get_block_header(&digests.hash)?;
+                Some(SyncHeader {
+                    header,
+                    hash: digests.hash,
+                    legacy_hash: digests.legacy_hash,
+                })
+            })
+            .collect()
+    }
+
+    fn blocks(&self, start: u64, count: u64) -> Vec<Block> {
+        self.storage.blocks.prefetch(start, count);
+        // Quarantined blocks are corrupt and not served
+        (start..start.saturating_add(count))
+            .take_while(|height| !self.storage.blocks.is_quarantined(*height))
+            .map_while(|height| self.storage.blocks.get_block_by_height(height))
+            .collect()
+    }
+
+    fn checkpoint(&self) -> Option<SignedCheckpoint> {
+        self.storage.blocks.get_latest_finality_checkpoint(u64::MAX)
+    }
+}
+
+/// Outcome of a sync.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct SyncReport {
+    /// Head height before the sync
+    pub start_height: u64,
+    /// Head height after the sync
+    pub end_height: u64,
+    /// Ranges applied
+    pub ranges: u64,
+    /// Checkpoint the sync was anchored to, once reached
+    pub checkpoint: Option<SignedCheckpoint>,
+}
+
+impl SyncReport {
+    /// Returns the number of blocks applied.
+    pub fn blocks(&self) -> u64 {
+        self.end_height - self.start_height
+    }
+}
+
+/// Streaming sync engine.
+pub struct StreamingSync {
+    config: SyncConfig,
+    progress: Arc<SyncProgress>,
+    /// Validators whose checkpoints anchor the sync
+    validators: Option<ValidatorSet>,
+}
+
+impl StreamingSync {
+    /// Creates an engine with its own progress counters.
+    pub fn new(config: SyncConfig) -> Self {
+        Self {
+            config: SyncConfig {
+                range_size: config.range_size.max(1),
+                max_in_flight: config.max_in_flight.max(1),
+            },
+            progress: Arc::new(SyncProgress::new()),
+            validators: None,
+        }
+    }
+
+    /// Reports progress to `progress`, e.g. the counters served over RPC.
+    pub fn with_progress(mut self, progress: Arc<SyncProgress>) -> Self {
+        self.progress = progress;
+        self
+    }
+
+    /// Syncs only to finality checkpoints signed by a quorum of
+    /// `validators`.
+    pub fn with_checkpoints(mut self, validators: ValidatorSet) -> Self {
+        self.validators = Some(validators);
+        self
+    }
+
+    /// Returns the settings.
+    pub fn config(&self) -> &SyncConfig {
+        &self.config
+    }
+
+    /// Returns the progress counters.
+    pub fn progress(&self) -> &Arc<SyncProgress> {
+        &self.progress
+    }
+
+    /// Syncs from the head at `height` (with digests `head`) to the target
+    /// among `sources`, hashing with `schedule`. `apply` executes a block,
+    /// checks its state root against the given one and only then commits
+    /// it.
+    pub fn run<F>(
+        &self,
+        sources: &[&dyn BlockSource],
+        height: u64,
+        head: BlockDigests,
+        schedule: &HashSchedule,
+        mut apply: F,
+    ) -> Result<SyncReport, NodeError>
+    where
+        F: FnMut(&Block, H256) -> Result<(), NodeError>,
+    {
+        let mut report = SyncReport {
+            start_height: height,
+            end_height: height,
+            ..SyncReport::default()
+        };
+        let (target, anchor) = self.target(sources, height);
+        if target <= height {
+            return Ok(report);
+        }
+
+        self.progress.begin(height, target);
+        let result = self
+            .fetch_headers(sources, height + 1, target, head, anchor.as_ref(), schedule)
+            .and_then(|headers| {
+                self.progress.set_verified(target);
+                self.apply_bodies(sources, &headers, schedule, &mut apply, &mut report)
+            });
+        self.progress.finish();
+        result?;
+        report.checkpoint = anchor;
+        Ok(report)
+    }
+
+    /// Picks the height to sync to and the checkpoint anchoring it: the
+    /// highest verified checkpoint above `height` with a validator set, the
+    /// highest peer head otherwise.
+    fn target(
+        &self,
+        sources: &[&dyn BlockSource],
+        height: u64,
+    ) -> (u64, Option<SignedCheckpoint>) {
+        let Some(validators) = &self.validators else {
+            return (sources.iter().map(|s| s.head()).max().unwrap_or(0), None);
+        };
+        let anchor = sources
+            .iter()
+            .filter_map(|source| Some((source.name(), source.checkpoint()?)))
+            .filter(|(_, signed)| signed.height() > height)
+            .filter(|(name, signed)| match verify_checkpoint(signed, validators) {
+                Ok(()) => true,
+                Err(e) => {
+                    tracing::warn!(
+                        "Ignoring checkpoint {} from {}: {:?}",
+                        signed.height(),
+                        name,
+                        e
+                    );
+                    false
+                }
+            })
+            .map(|(_, signed)| signed)
+            .max_by_key(|signed| signed.height());
+        match anchor {
+            Some(signed) => (signed.height(), Some(signed)),
+            None => (height, None),
+        }
+    }
+
+    /// Fetches and checks the headers of `first..=last`: backwards from
+    /// `anchor` when there is one, forwards from `head` otherwise. Either
+    /// way the chain must link to `head`.
+    fn fetch_headers(
+        &self,
+        sources: &[&dyn BlockSource],
+        first: u64,
+        last: u64,
+        head: BlockDigests,
+        anchor: Option<&SignedCheckpoint>,
+        schedule: &HashSchedule,
+    ) -> Result<Vec<SyncHeader>, NodeError> {
+        let ranges = plan_ranges(first, last, self.config.range_size);
+        let mut fetched = Vec::with_capacity(ranges.len());
+        match anchor {
+            Some(signed) => {
+                let mut expected = signed.checkpoint.block_hash;
+                for (index, &(start, end)) in ranges.iter().enumerate().rev() {
+                    let headers = self.fetch_with(sources, index, start, end, |source| {
+                        let headers = source.headers(start, end - start + 1);
+                        verify_headers(&headers, start, end - start + 1, schedule)?;
+                        let tail = &headers[headers.len() - 1];
+                        if !tail.is_hash(&expected) {
+                            return Err(format!("header {} is off the checkpointed chain", end));
+                        }
+                        if end == signed.height()
+                            && H256::from(tail.header.state_root) != signed.checkpoint.state_root
+                        {
+                            return Err(format!("header {} has another state root", end));
+                        }
+                        Ok(headers)
+                    })?;
+                    expected = H256::from(headers[0].header.parent_hash);
+                    fetched.push(headers);
+                }
+                fetched.reverse();
+                if !head.matches(&expected) {
+                    return Err(NodeError::Rejected(format!(
+                        "checkpoint {} is on a chain that does not extend the head {}",
+                        signed.height(),
+                        head.hash
+                    )));
+                }
+            }
+            None => {
+                let mut parent = head;
+                for (index, &(start, end)) in ranges.iter().enumerate() {
+                    let headers = self.fetch_with(sources, index, start, end, |source| {
+                        let headers = source.headers(start, end - start + 1);
+                        verify_headers(&headers, start, end - start + 1, schedule)?;
+                        if !parent.matches(&H256::from(headers[0].header.parent_hash)) {
+                            return Err(format!(
+                                "header {} does not extend the head {}",
+                                start, parent.hash
+                            ));
+                        }
+                        Ok(headers)
+                    })?;
+                    let tail = &headers[headers.len() - 1];
+                    parent = BlockDigests {
+                        hash: tail.hash,
+                        legacy_hash: tail.legacy_hash,
+                    };
+                    fetched.push(headers);
+                }
+            }
+        }
+        Ok(fetched.into_iter().flatten().collect())
+    }
+
+    /// Fetches the bodies of the verified `headers` range by range and
+    /// applies them in order.
+    fn apply_bodies<F>(
+        &self,
+        sources: &[&dyn BlockSource],
+        headers: &[SyncHeader],
+        schedule: &HashSchedule,
+        apply: &mut F,
+        report: &mut SyncReport,
+    ) -> Result<(), NodeError>
+    where
+        F: FnMut(&Block, H256) -> Result<(), NodeError>,
+    {
+        let range_size = self.config.range_size as usize;
+        thread::scope(|scope| {
+            let mut ranges = headers.chunks(range_size).enumerate();
+            let mut pipeline = VecDeque::with_capacity(self.config.max_in_flight);
+            loop {
+                while pipeline.len() < self.config.max_in_flight {
+                    let Some((index, range)) = ranges.next() else {
+                        break;
+                    };
+                    self.progress.range_started();
+                    let fetch =
+                        scope.spawn(move || self.fetch_bodies(sources, index, range, schedule));
+                    pipeline.push_back((range, fetch));
+                }
+                let Some((range, fetch)) = pipeline.pop_front() else {
+                    return Ok(());
+                };
+                let fetched = fetch.join().expect("sync fetch thread panicked");
+                let applied = fetched.and_then(|blocks| {
+                    for (header, block) in range.iter().zip(&blocks) {
+                        apply(block, H256::from(header.header.state_root))?;
+                        self.progress.set_synced(block.height);
+                    }
+                    Ok(())
+                });
+                self.progress.range_done(range.len() as u64);
+                applied?;
+                report.end_height = range[range.len() - 1].height();
+                report.ranges += 1;
+            }
+        })
+    }
+
+    /// Fetches the bodies of a range of verified headers.
+    fn fetch_bodies(
+        &self,
+        sources: &[&dyn BlockSource],
+        index: usize,
+        headers: &[SyncHeader],
+        schedule: &HashSchedule,
+    ) -> Result<Vec<Block>, NodeError> {
+        let first = headers[0].height();
+        let last = headers[headers.len() - 1].height();
+        let blocks = self.fetch_with(sources, index, first, last, |source| {
+            let count = last - first + 1;
+            let blocks = source.blocks(first, count);
+            if blocks.len() as u64 != count {
+                return Err(format!("served {} of {} blocks", blocks.len(), count));
+            }
+            for (header, block) in headers.iter().zip(&blocks) {
+                verify_body(header, block, schedule)?;
+            }
+            Ok(blocks)
+        })?;
+        self.progress.range_fetched(blocks.len() as u64);
+        Ok(blocks)
+    }
+
+    /// Runs `fetch` for `first..=last` on the sources that have the range,
+    /// starting with the `index`th so consecutive ranges go to different
+    /// peers, until one serves it correctly.
+    fn fetch_with<T>(
+        &self,
+        sources: &[&dyn BlockSource],
+        index: usize,
+        first: u64,
+        last: u64,
+        fetch: impl Fn(&dyn BlockSource) -> Result<T, String>,
+    ) -> Result<T, NodeError> {
+        let candidates: Vec<&dyn BlockSource> = sources
+            .iter()
+            .copied()
+            .filter(|source| source.head() >= last)
+            .collect();
+        if candidates.is_empty() {
+            return Err(NodeError::PreBlockMissing { height: last });
+        }
+
+        let mut error = String::new();
+        for offset in 0..candidates.len() {
+            let source = candidates[(index + offset) % candidates.len()];
+            match fetch(source) {
+                Ok(fetched) => return Ok(fetched),
+                Err(e) => {
+                    tracing::warn!(
+                        "Sync of blocks {}..={} from {} failed: {}",
+                        first,
+                        last,
+                        source.name(),
+                        e
+                    );
+                    self.progress.fetch_failed();
+                    error = e;
+                }
+            }
+        }
+        Err(NodeError::Rejected(format!(
+            "no peer served blocks {}..={}: {}",
+            first, last, error
+        )))
+    }
+}
+
+/// Splits `first..=last` into ranges of at most `size` blocks.
+fn plan_ranges(first: u64, last: u64, size: u64) -> Vec<(u64, u64)> {
+    let mut ranges = Vec::new();
+    let mut start = first;
+    while start <= last {
+        let end = last.min(start.saturating_add(size - 1));
+        ranges.push((start, end));
+        start = end + 1;
+    }
+    ranges
+}
+
+/// Checks that `headers` are the consecutive heights from `first`, that
+/// each hash matches its header and that each links to the one before.
+fn verify_headers(
+    headers: &[SyncHeader],
+    first: u64,
+    count: u64,
+    schedule: &HashSchedule,
+) -> Result<(), String> {
+    if headers.len() as u64 != count {
+        return Err(format!("served {} of {} headers", headers.len(), count));
+    }
+    for (expected, header) in (first..).zip(headers) {
+        let height = header.height();
+        if height != expected {
+            return Err(format!("expected header {}, got {}", expected, height));
+        }
+        if header.compute_hash(schedule.algorithm_at(height)) != header.hash {
+            return Err(format!("header {} does not match its hash", height));
+        }
+        if header.legacy_hash.is_some() != schedule.legacy_algorithm_at(height).is_some() {
+            return Err(format!("header {} has a wrong legacy hash", height));
+        }
+    }
+    for pair in headers.windows(2) {
+        if !pair[0].is_hash(&H256::from(pair[1].header.parent_hash)) {
+            return Err(format!(
+                "header {} does not extend header {}",
+                pair[1].height(),
+                pair[0].height()
+            ));
+        }
+    }
+    Ok(())
+}
+
+/// Checks that a block is the one its verified header describes.
+fn verify_body(header: &SyncHeader, block: &Block, schedule: &HashSchedule) -> Result<(), String> {
+    let digests = block.digests(schedule);
+    if block.height != header.height()
+        || digests.hash != header.hash
+        || digests.legacy_hash != header.legacy_hash
+    {
+        return Err(format!(
+            "block {} does not match its header",
+            header.height()
+        ));
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_consensus::Validator;
+    use bach_crypto::PrivateKey;
+    use bach_types::Checkpoint;
+    use std::sync::atomic::{AtomicU64, Ordering};
+    use std::sync::Mutex;
+
+    /// In-memory chain; `tamper` forges the block at that height.
+    struct MemorySource {
+        name: String,
+        chain: Vec<(SyncHeader, Block)>,
+        tamper: Option<u64>,
+        checkpoint: Option<SignedCheckpoint>,
+        header_requests: AtomicU64,
+        block_requests: AtomicU64,
+    }
+
+    impl MemorySource {
+        fn new(name: &str, chain: &[(SyncHeader, Block)]) -> Self {
+            Self {
+                name: name.to_string(),
+                chain: chain.to_vec(),
+                tamper: None,
+                checkpoint: None,
+                header_requests: AtomicU64::new(0),
+                block_requests: AtomicU64::new(0),
+            }
+        }
+
+        fn range(&self, start: u64, count: u64) -> impl Iterator<Item = &(SyncHeader, Block)> {
+            self.chain.iter().filter(move |(header, _)| {
+                header.height() >= start && header.height() < start + count
+            })
+        }
+    }
+
+    impl BlockSource for MemorySource {
+        fn name(&self) -> &str {
+            &self.name
+        }
+
+        fn head(&self) -> u64 {
+            self.chain.last().map_or(0, |(header, _)| header.height())
+        }
+
+        fn headers(&self, start: u64, count: u64) -> Vec<SyncHeader> {
+            self.header_requests.fetch_add(1, Ordering::Relaxed);
+            self.range(start, count)
+                .map(|(header, _)| {
+                    let mut header = header.clone();
+                    if self.tamper == Some(header.height()) {
+                        header.header.timestamp += 1;
+                    }
+                    header
+                })
+                .collect()
+        }
+
+        fn blocks(&self, start: u64, count: u64) -> Vec<Block> {
+            self.block_requests.fetch_add(1, Ordering::Relaxed);
+            self.range(start, count)
+                .map(|(_, block)| block.clone())
+                .collect()
+        }
+
+        fn checkpoint(&self) -> Option<SignedCheckpoint> {
+            self.checkpoint.clone()
+        }
+    }
+
+    fn state_root(height: u64) -> H256 {
+        H256::from([height as u8; 32])
+    }
+
+    fn genesis() -> BlockDigests {
+        BlockDigests {
+            hash: H256::zero(),
+            legacy_hash: None,
+        }
+    }
+
+    /// Builds blocks 1..=len on the zero hash, as peers would serve them.
+    fn chain(len: u64, schedule: &HashSchedule) -> Vec<(SyncHeader, Block)> {
+        chain_at(len, schedule, 1000)
+    }
+
+    /// Builds a chain whose block timestamps start after `time`.
+    fn chain_at(len: u64, schedule: &HashSchedule, time: u64) -> Vec<(SyncHeader, Block)> {
+        let mut parent = H256::zero();
+        (1..=len)
+            .map(|height| {
+                let block = Block::new(height, parent, vec![], time + height);
+                let digests = block.digests(schedule);
+                let header = SyncHeader {
+                    header: BlockHeader::from_block_with(
+                        &block,
+                        state_root(height),
+                        schedule.algorithm_at(height),
+                    ),
+                    hash: digests.hash,
+                    legacy_hash: digests.legacy_hash,
+                };
+                parent = digests.hash;
+                (header, block)
+            })
+            .collect()
+    }
+
+    fn config(range_size: u64) -> SyncConfig {
+        SyncConfig {
+            range_size,
+            max_in_flight: 2,
+        }
+    }
+
+    fn apply_ok(block: &Block, root: H256) -> Result<(), NodeError> {
+        assert_eq!(root, state_root(block.height));
+        Ok(())
+    }
+
+    /// Checkpoints the block at `height` of `chain`, signed by `key`.
+    fn checkpoint(
+        chain: &[(SyncHeader, Block)],
+        height: u64,
+        key: &PrivateKey,
+    ) -> SignedCheckpoint {
+        let (header, _) = &chain[height as usize - 1];
+        let checkpoint = Checkpoint::new(height, header.hash, state_root(height));
+        let mut signed = SignedCheckpoint::new(checkpoint);
+        signed.signatures.push(checkpoint.sign(key));
+        signed
+    }
+
+    #[test]
+    fn test_plan_ranges() {
+        assert_eq!(plan_ranges(1, 10, 4), vec![(1, 4), (5, 8), (9, 10)]);
+        assert_eq!(plan_ranges(5, 5, 4), vec![(5, 5)]);
+        assert!(plan_ranges(6, 5, 4).is_empty());
+    }
+
+    #[test]
+    fn test_sync_across_peers_in_order() {
+        let schedule = HashSchedule::default();
+        let blocks = chain(10, &schedule);
+        let a = MemorySource::new("a", &blocks);
+        let b = MemorySource::new("b", &blocks);
+        let sync = StreamingSync::new(config(3));
+
+        let mut applied = Vec::new();
+        let report = sync
+            .run(&[&a, &b], 0, genesis(), &schedule, |block, root| {
+                applied.push(block.height);
+                apply_ok(block, root)
+            })
+            .unwrap();
+
+        assert_eq!(applied, (1..=10).collect::<Vec<_>>());
+        assert_eq!(report.blocks(), 10);
+        assert_eq!(report.ranges, 4);
+        // Ranges alternate between the peers
+        assert_eq!(a.header_requests.load(Ordering::Relaxed), 2);
+        assert_eq!(a.block_requests.load(Ordering::Relaxed), 2);
+        assert_eq!(b.block_requests.load(Ordering::Relaxed), 2);
+
+        let status = sync.progress().status();
+        assert!(!status.syncing);
+        assert_eq!(status.synced_height, 10);
+        assert_eq!(status.verified_height, 10);
+        assert_eq!(status.fetched_blocks, 10);
+        assert_eq!(status.buffered_blocks, 0);
+        assert!(report.checkpoint.is_none());
+    }
+
+    #[test]
+    fn test_forged_headers_are_refetched() {
+        let schedule = HashSchedule::default();
+        let blocks = chain(6, &schedule);
+        let mut forged = MemorySource::new("forged", &blocks);
+        forged.tamper = Some(2);
+        let honest = MemorySource::new("honest", &blocks);
+        let sync = StreamingSync::new(config(6));
+
+        let report = sync
+            .run(&[&forged, &honest], 0, genesis(), &schedule, apply_ok)
+            .unwrap();
+
+        // The headers come from the honest peer; the bodies, checked
+        // against them, may come from either
+        assert_eq!(report.end_height, 6);
+        assert_eq!(forged.header_requests.load(Ordering::Relaxed), 1);
+        assert_eq!(honest.header_requests.load(Ordering::Relaxed), 1);
+        assert_eq!(sync.progress().status().failed_fetches, 1);
+    }
+
+    #[test]
+    fn test_range_must_extend_head() {
+        let schedule = HashSchedule::default();
+        let blocks = chain(4, &schedule);
+        let source = MemorySource::new("a", &blocks);
+        let other_head = BlockDigests {
+            hash: H256::from([9u8; 32]),
+            legacy_hash: None,
+        };
+
+        let result =
+            StreamingSync::new(config(4)).run(&[&source], 0, other_head, &schedule, apply_ok);
+        assert!(matches!(result, Err(NodeError::Rejected(_))));
+        // No body was fetched for a chain that doesn't extend the head
+        assert_eq!(source.block_requests.load(Ordering::Relaxed), 0);
+    }
+
+    #[test]
+    fn test_state_root_checked_before_commit() {
+        let schedule = HashSchedule::default();
+        let blocks = chain(4, &schedule);
+        let source = MemorySource::new("a", &blocks);
+        // Execution diverges at block 2, which must not be committed
+        let committed = Mutex::new(Vec::new());
+        let apply = |block: &Block, root: H256| -> Result<(), NodeError> {
+            let computed = match block.height {
+                2 => H256::zero(),
+                height => state_root(height),
+            };
+            if computed != root {
+                return Err(NodeError::RwSetMismatch {
+                    height: block.height,
+                });
+            }
+            committed.lock().unwrap().push(block.height);
+            Ok(())
+        };
+
+        let result = StreamingSync::new(config(4)).run(&[&source], 0, genesis(), &schedule, apply);
+        assert!(matches!(
+            result,
+            Err(NodeError::RwSetMismatch { height: 2 })
+        ));
+        assert_eq!(*committed.lock().unwrap(), vec![1]);
+    }
+
+    #[test]
+    fn test_sync_to_checkpoint() {
+        let key = PrivateKey::from_bytes(&[0x31; 32]).unwrap();
+        let validators = ValidatorSet::new(vec![Validator::new(key.public_key(), 1)]);
+        let schedule = HashSchedule::default();
+        let blocks = chain(10, &schedule);
+
+        // Peers hold a checkpoint at 6; blocks above it are left to
+        // consensus
+        let mut source = MemorySource::new("a", &blocks);
+        source.checkpoint = Some(checkpoint(&blocks, 6, &key));
+        let sync = StreamingSync::new(config(4)).with_checkpoints(validators.clone());
+        let report = sync.run(&[&source], 0, genesis(), &schedule, apply_ok).unwrap();
+        assert_eq!(report.end_height, 6);
+        assert_eq!(report.checkpoint.unwrap().height(), 6);
+
+        // A forged range is retried on a peer serving the checkpointed chain
+        let mut forged = MemorySource::new("forged", &blocks);
+        forged.tamper = Some(2);
+        let report = StreamingSync::new(config(4))
+            .with_checkpoints(validators.clone())
+            .run(&[&forged, &source], 0, genesis(), &schedule, apply_ok)
+            .unwrap();
+        assert_eq!(report.end_height, 6);
+
+        // A checkpoint outside the trust roots gives nothing to sync to
+        let other = PrivateKey::from_bytes(&[0x32; 32]).unwrap();
+        let mut untrusted = MemorySource::new("untrusted", &blocks);
+        untrusted.checkpoint = Some(checkpoint(&blocks, 8, &other));
+        let report = StreamingSync::new(config(4))
+            .with_checkpoints(validators.clone())
+            .run(&[&untrusted], 0, genesis(), &schedule, apply_ok)
+            .unwrap();
+        assert_eq!(report.blocks(), 0);
+
+        // A peer serving another chain up to a checkpointed height is
+        // refused before any body
+        let fork = chain_at(6, &schedule, 2000);
+        let mut forked = MemorySource::new("forked", &fork);
+        forked.checkpoint = Some(checkpoint(&blocks, 6, &key));
+        let result = StreamingSync::new(config(4))
+            .with_checkpoints(validators)
+            .run(&[&forked], 0, genesis(), &schedule, apply_ok);
+        assert!(matches!(result, Err(NodeError::Rejected(_))));
+        assert_eq!(forked.block_requests.load(Ordering::Relaxed), 0);
+    }
+
+    #[test]
+    fn test_sync_through_hash_migration() {
+        let schedule = HashSchedule::default().with_migration(3, HashAlgorithm::Sha256);
+        let mut blocks = chain(5, &schedule);
+        // The block after the transition links to its legacy hash
+        let legacy = blocks[2].0.legacy_hash.unwrap();
+        let block = Block::new(4, legacy, vec![], 1004);
+        let digests = block.digests(&schedule);
+        blocks[3] = (
+            SyncHeader {
+                header: BlockHeader::from_block_with(&block, state_root(4), HashAlgorithm::Sha256),
+                hash: digests.hash,
+                legacy_hash: None,
+            },
+            block,
+        );
+        blocks.truncate(4);
+        let source = MemorySource::new("a", &blocks);
+
+        let report = StreamingSync::new(config(2))
+            .run(&[&source], 0, genesis(), &schedule, apply_ok)
+            .unwrap();
+        assert_eq!(report.end_height, 4);
+    }
+
+    #[test]
+    fn test_missing_range_fails() {
+        let schedule = HashSchedule::default();
+        let blocks = chain(3, &schedule);
+        let mut short = MemorySource::new("short", &blocks);
+        short.chain.remove(1);
+
+        let result =
+            StreamingSync::new(config(3)).run(&[&short], 0, genesis(), &schedule, apply_ok);
+        assert!(matches!(result, Err(NodeError::Rejected(_))));
+    }
+
+    #[test]
+    fn test_header_wire_roundtrip() {
+        let schedule = HashSchedule::default().with_migration(1, HashAlgorithm::Sha256);
+        let (header, _) = chain(1, &schedule).remove(0);
+        assert!(header.legacy_hash.is_some());
+        assert_eq!(SyncHeader::from(SerializableHeader::from(&header)), header);
+    }
+}
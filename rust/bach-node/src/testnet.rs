@@ -0,0 +1,1492 @@
+//! In-process multi-node test network
+//!
+//! `TestNetwork` boots N nodes in one process on in-memory storage and
+//! drives them through consensus, execution and commit without sockets or
+//! timers. Consensus messages travel over a fake network that delivers them
+//! in FIFO order and can be partitioned, so a run is fully deterministic:
+//! the same configuration and transactions always produce the same chain.
+//!
+//! Transactions run through each node's scheduler, auto-tuned within its
+//! config's pool bounds, with the configured executor. Validators execute
+//! a proposal with an `ExecutionVerifier` before voting for it. The keys
+//! transactions write are committed as storage slots of `Address::zero()`.
+//! With `state_commitment` on, every node also maintains a sparse Merkle
+//! commitment over its state and records it in each block's header
+//! extension.
+//!
+//! `propose` drives the proposer loop from a transaction pool: the leader's
+//! chain-configured `ProposalTimer` decides, given the pool depth and the
+//! time since the last block, whether a block is produced. When a proposed
+//! block times out, its transactions go back to the pool and each node
+//! publishes a `TxRequeued` event per transaction on its message bus.
+//!
+//! Blocks are stamped one second apart from the genesis timestamp. With a
+//! clock configured, they are stamped from the clock instead, and
+//! validators check proposed timestamps against it within the drift chain
+//! config allows, reporting the drift in their health.
+//!
+//! When chain config sets a `checkpoint_interval`, the validators that
+//! committed a block at a checkpoint height co-sign its checkpoint and
+//! record it once a quorum signed. Lagging nodes then sync only up to the
+//! latest checkpoint their peers hold, and record it; the blocks above it
+//! they get from consensus or a later checkpoint.
+//!
+//! System transaction generators registered on the configuration append
+//! their transactions to every block; validators check them before
+//! pre-voting.
+//!
+//! Equivocation evidence a node's consensus detects is submitted, signed
+//! by that node, as an evidence registry transaction at the front of the
+//! next block. Before each height every node applies the penalties its
+//! recorded evidence puts in force then.
+//!
+//! ```ignore
+//! let mut net = TestNetwork::new(TestNetworkConfig::tbft(4))?;
+//! net.produce_block(vec![tx])?;
+//! net.isolate(3);
+//! net.produce_block(Vec::new())?; // 3 of 4 still reach quorum
+//! net.heal();
+//! net.produce_block(Vec::new())?; // node 3 syncs, then votes again
+//! assert!(net.in_agreement());
+//! ```
+
+use crate::{
+    BachNode, BlockCommit, BlockSource, ExecutionVerifier, NodeConfig, NodeError, StorageSource,
+    StreamingSync, SyncConfig, VerifierHead,
+};
+use bach_consensus::{
+    cap_block_gas, cap_txs_per_sender, drop_duplicate_txs, is_checkpoint_height, ConsensusError,
+    ConsensusMessage, ProposalAction, SystemTxGenerator, SystemTxs, TbftConsensus, Validator,
+    ValidatorSet,
+};
+use bach_crypto::{keccak256, PrivateKey};
+use bach_evm::index_call_log;
+use bach_msgbus::TxRequeue;
+use bach_primitives::{Address, Clock, H256, U256};
+use bach_scheduler::{ExecutionResult, Scheduler, SeamlessScheduler, TransactionExecutor};
+use bach_state::{MemoryStateDB, Snapshot, StateDB, StateProof};
+use bach_storage::{
+    GenesisAccount, GenesisConfig, Log, Storage, TransactionReceipt, ValidatorConfig,
+};
+use bach_types::{Block, ReadWriteSet, SignedCheckpoint, Transaction};
+use std::collections::{BTreeMap, HashMap, HashSet, VecDeque};
+use std::sync::Arc;
+use std::time::Duration;
+
+/// How the test network orders blocks.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ConsensusMode {
+    /// A single node commits its own proposals without voting
+    Solo,
+    /// Validators run TBFT rounds (proposal, pre-vote, pre-commit)
+    Tbft,
+}
+
+/// Test network configuration.
+#[derive(Clone)]
+pub struct TestNetworkConfig {
+    /// Number of nodes; every node is a validator with voting power 1
+    pub nodes: usize,
+    /// Consensus mode
+    pub mode: ConsensusMode,
+    /// Chain ID
+    pub chain_id: u64,
+    /// Genesis state; validators are filled in from the node keys
+    pub genesis: GenesisConfig,
+    /// Rounds attempted per height before `produce_block` gives up
+    pub max_rounds: u32,
+    /// Executes block transactions on every node
+    pub executor: Arc<dyn TransactionExecutor>,
+    /// Whether nodes maintain a sparse Merkle state commitment
+    pub state_commitment: bool,
+    /// Clock shared by the nodes, stamping blocks and checking their
+    /// timestamps if set
+    pub clock: Option<Arc<dyn Clock>>,
+    /// Generators of the system transactions ending every block
+    pub system_txs: SystemTxs,
+    /// Chain config parameters of the genesis version
+    pub chain_config: BTreeMap<String, String>,
+}
+
+impl TestNetworkConfig {
+    /// Creates a single-node SOLO network.
+    pub fn solo() -> Self {
+        Self {
+            nodes: 1,
+            mode: ConsensusMode::Solo,
+            chain_id: 31337,
+            genesis: GenesisConfig::default(),
+            max_rounds: 4,
+            executor: Arc::new(NoopExecutor),
+            state_commitment: false,
+            clock: None,
+            system_txs: SystemTxs::new(),
+            chain_config: BTreeMap::new(),
+        }
+    }
+
+    /// Creates an `n`-validator TBFT network.
+    pub fn tbft(nodes: usize) -> Self {
+        Self {
+            nodes,
+            mode: ConsensusMode::Tbft,
+            ..Self::solo()
+        }
+    }
+
+    /// Sets the transaction executor.
+    pub fn with_executor(mut self, executor: Arc<dyn TransactionExecutor>) -> Self {
+        self.executor = executor;
+        self
+    }
+
+    /// Makes nodes maintain a sparse Merkle state commitment.
+    pub fn with_state_commitment(mut self) -> Self {
+        self.state_commitment = true;
+        self
+    }
+
+    /// Makes nodes stamp blocks from `clock` and check proposed timestamps
+    /// against it.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = Some(clock);
+        self
+    }
+
+    /// Registers a generator of system transactions appended to every
+    /// block.
+    pub fn with_system_tx_generator(mut self, generator: Arc<dyn SystemTxGenerator>) -> Self {
+        self.system_txs.register(generator);
+        self
+    }
+
+    /// Sets a chain config parameter of the genesis version.
+    pub fn with_chain_config(mut self, name: &str, value: &str) -> Self {
+        self.chain_config
+            .insert(name.to_string(), value.to_string());
+        self
+    }
+
+    /// Funds an account at genesis.
+    pub fn with_balance(mut self, address: Address, balance: U256) -> Self {
+        self.genesis
+            .alloc
+            .entry(address)
+            .and_modify(|account| account.balance = balance)
+            .or_insert(GenesisAccount {
+                balance,
+                code: None,
+                storage: None,
+            });
+        self
+    }
+}
+
+/// Executor used when none is configured: every transaction succeeds
+/// without touching state.
+struct NoopExecutor;
+
+impl TransactionExecutor for NoopExecutor {
+    fn execute(&self, _tx: &Transaction, _snapshot: &Snapshot) -> (ReadWriteSet, ExecutionResult) {
+        (
+            ReadWriteSet::new(),
+            ExecutionResult::Success { output: Vec::new() },
+        )
+    }
+}
+
+/// One node of the test network.
+pub struct TestNode {
+    node: BachNode,
+    consensus: TbftConsensus,
+    state: MemoryStateDB,
+    scheduler: SeamlessScheduler,
+    /// Committed block and state the consensus engine verifies against
+    head: VerifierHead,
+}
+
+impl TestNode {
+    /// Returns the node.
+    pub fn node(&self) -> &BachNode {
+        &self.node
+    }
+
+    /// Returns the node's consensus engine.
+    pub fn consensus(&self) -> &TbftConsensus {
+        &self.consensus
+    }
+
+    /// Returns the node's storage.
+    pub fn storage(&self) -> &Storage {
+        self.node.storage().expect("test nodes keep their storage")
+    }
+
+    /// Returns a proof of `key`'s state value under the node's state
+    /// commitment, if it maintains one.
+    pub fn state_proof(&self, key: &H256) -> Option<StateProof> {
+        self.state.prove(key)
+    }
+
+    /// Returns the height and hash of the node's chain head.
+    pub fn head(&self) -> (u64, H256) {
+        (self.node.current_height(), self.node.current_hash())
+    }
+
+    /// Executes a finalized block and commits it, returning its state root.
+    /// The block isn't committed if its state root differs from
+    /// `expected_root` or from the one simulated when it was proposed.
+    fn apply_block(
+        &mut self,
+        block: &Block,
+        executor: &dyn TransactionExecutor,
+        signatures: usize,
+        expected_root: Option<H256>,
+    ) -> Result<H256, NodeError> {
+        let result = self
+            .scheduler
+            .schedule(block.clone(), &mut self.state, executor)
+            .map_err(|e| NodeError::ExecutionFailed(format!("{:?}", e)))?;
+        let verified = self
+            .consensus
+            .verification_result(&self.consensus.block_hash(block))
+            .map(|verified| verified.state_root);
+        if [expected_root, verified]
+            .into_iter()
+            .flatten()
+            .any(|root| root != result.state_root)
+        {
+            return Err(NodeError::RwSetMismatch {
+                height: block.height,
+            });
+        }
+
+        // Written keys with the transaction that last wrote them, in
+        // confirmation order
+        let mut keys: BTreeMap<H256, H256> = BTreeMap::new();
+        for etx in &result.confirmed {
+            let writes = etx.rwset.writes().iter().map(|(key, _)| *key);
+            for key in writes.chain(etx.rwset.deltas().iter().map(|(key, _)| *key)) {
+                keys.insert(key, etx.hash());
+            }
+        }
+        // Their values after the whole block
+        let mut writes = Vec::with_capacity(keys.len());
+        let mut writers = Vec::with_capacity(keys.len());
+        let mut values = Vec::with_capacity(keys.len());
+        for (key, writer) in keys {
+            let value = self.state.get(&key).unwrap_or_default();
+            writes.push((Address::zero(), key, slot_value(&value)));
+            writers.push(writer);
+            values.push(value);
+        }
+
+        let block_hash = *self.node.block_digests(block).hash.as_bytes();
+        let receipts: Vec<TransactionReceipt> = result
+            .confirmed
+            .iter()
+            .map(|etx| {
+                let hash = etx.hash();
+                let index = block
+                    .transactions
+                    .iter()
+                    .position(|tx| tx.hash() == hash)
+                    .unwrap_or_default();
+                TransactionReceipt {
+                    transaction_hash: *hash.as_bytes(),
+                    block_hash,
+                    block_number: block.height,
+                    transaction_index: index as u32,
+                    gas_used: 0,
+                    status: etx.result.is_success(),
+                    logs: Vec::new(),
+                }
+            })
+            .collect();
+
+        let dag = result.dag_with_system_txs(block, self.consensus.system_txs().count(block));
+        self.node.commit_block(BlockCommit {
+            block,
+            state_root: result.state_root,
+            state_commitment: result.state_commitment,
+            writes: &writes,
+            writers: &writers,
+            values: &values,
+            code: &[],
+            receipts: &receipts,
+            dag: Some(&dag),
+            conflicts: result.reexecution_count,
+            signatures,
+        })?;
+        self.head.advance(
+            block.height,
+            self.node.current_hash(),
+            self.state.snapshot(),
+            self.node.hash_schedule_at(block.height + 1),
+        );
+        self.consensus.set_parent_timestamp(block.timestamp);
+        self.consensus.start_height(block.height + 1);
+        Ok(result.state_root)
+    }
+}
+
+/// Stores a state value in a 32-byte slot: shorter values are left-padded,
+/// longer ones are replaced by their hash.
+fn slot_value(value: &[u8]) -> H256 {
+    if value.len() > 32 {
+        return keccak256(value);
+    }
+    let mut slot = [0u8; 32];
+    slot[32 - value.len()..].copy_from_slice(value);
+    H256::from(slot)
+}
+
+/// A consensus message in flight.
+struct Envelope {
+    from: usize,
+    to: usize,
+    message: ConsensusMessage,
+}
+
+/// Deterministic multi-node network running in the current process.
+pub struct TestNetwork {
+    nodes: Vec<TestNode>,
+    config: TestNetworkConfig,
+    queue: VecDeque<Envelope>,
+    /// Unordered node pairs whose link is down
+    cut: HashSet<(usize, usize)>,
+    genesis_timestamp: u64,
+    /// Times each pooled transaction was returned to the pool
+    requeues: HashMap<H256, u32>,
+    /// Evidence transactions waiting for the next block
+    evidence: Vec<Transaction>,
+    /// Hashes of the evidence already submitted
+    reported: HashSet<H256>,
+}
+
+impl TestNetwork {
+    /// Boots the network with every node at genesis.
+    pub fn new(config: TestNetworkConfig) -> Result<Self, NodeError> {
+        if config.nodes == 0 || (config.mode == ConsensusMode::Solo && config.nodes != 1) {
+            return Err(NodeError::ConfigError(format!(
+                "{:?} network cannot have {} node(s)",
+                config.mode, config.nodes
+            )));
+        }
+
+        // Keys are derived from the node index so runs are reproducible
+        let keys: Vec<PrivateKey> = (0..config.nodes)
+            .map(|i| {
+                let seed = keccak256(format!("bach-testnet-{}", i).as_bytes());
+                PrivateKey::from_bytes(seed.as_bytes())
+                    .map_err(|_| NodeError::ConfigError("Invalid test key".to_string()))
+            })
+            .collect::<Result<_, _>>()?;
+        let validator_set = ValidatorSet::new(
+            keys.iter()
+                .map(|key| Validator::new(key.public_key(), 1))
+                .collect(),
+        );
+
+        let mut genesis = config.genesis.clone();
+        genesis.chain_id = config.chain_id;
+        genesis.validators = keys
+            .iter()
+            .map(|key| ValidatorConfig {
+                address: key.public_key().to_address(),
+                stake: U256::from(1u64),
+            })
+            .collect();
+
+        let mut nodes = Vec::with_capacity(keys.len());
+        for key in keys {
+            let mut storage = Storage::temporary()?;
+            storage.init_genesis(&genesis)?;
+
+            let node_config = NodeConfig {
+                genesis_chain_config: config.chain_config.clone(),
+                ..NodeConfig::default()
+            }
+            .with_chain_id(config.chain_id)
+            .with_validator_key(key.to_bytes())
+            .with_validator_set(validator_set.clone());
+            let signature_verifier = node_config.tx_signature_verifier();
+            let mut node = BachNode::new(node_config);
+            node.init_with_storage(storage)?;
+
+            let state = if config.state_commitment {
+                MemoryStateDB::with_commitment()
+            } else {
+                MemoryStateDB::new()
+            };
+            let head = VerifierHead::new(0, node.current_hash(), state.snapshot());
+            let verifier = ExecutionVerifier::new(
+                head.clone(),
+                node.config().scheduler(),
+                Arc::clone(&config.executor),
+            );
+
+            let committed = node.storage().ok_or(NodeError::NotRunning)?.clone();
+            let mut system_txs = node.system_txs().clone();
+            system_txs.extend(&config.system_txs);
+            let mut consensus = TbftConsensus::new(validator_set.clone(), key)
+                .with_tx_signature_verifier(signature_verifier)
+                .with_committed_txs(Arc::new(move |hash: &H256| {
+                    committed.transactions.is_committed(hash)
+                }))
+                .with_system_txs(system_txs)
+                .with_block_verifier(Box::new(verifier));
+            if let Some(clock) = &config.clock {
+                node.set_clock(Arc::clone(clock));
+                consensus = consensus.with_timestamp_validator(node.timestamp_validator()?);
+            }
+            consensus.set_parent_timestamp(genesis.timestamp);
+            consensus.start_height(1);
+
+            let scheduler = node.config().scheduler();
+            nodes.push(TestNode {
+                node,
+                consensus,
+                state,
+                scheduler,
+                head,
+            });
+        }
+
+        Ok(Self {
+            nodes,
+            genesis_timestamp: genesis.timestamp,
+            requeues: HashMap::new(),
+            evidence: Vec::new(),
+            reported: HashSet::new(),
+            config,
+            queue: VecDeque::new(),
+            cut: HashSet::new(),
+        })
+    }
+
+    /// Returns the nodes in index order.
+    pub fn nodes(&self) -> &[TestNode] {
+        &self.nodes
+    }
+
+    /// Returns node `index`.
+    pub fn node(&self, index: usize) -> &TestNode {
+        &self.nodes[index]
+    }
+
+    /// Returns the highest committed height on any node.
+    pub fn height(&self) -> u64 {
+        self.nodes.iter().map(|n| n.head().0).max().unwrap_or(0)
+    }
+
+    /// Returns true if every node has the same chain head.
+    pub fn in_agreement(&self) -> bool {
+        self.nodes
+            .windows(2)
+            .all(|pair| pair[0].head() == pair[1].head())
+    }
+
+    /// Cuts every link between nodes in `group` and nodes outside it.
+    pub fn partition(&mut self, group: &[usize]) {
+        for &a in group {
+            for b in (0..self.nodes.len()).filter(|b| !group.contains(b)) {
+                self.cut.insert((a.min(b), a.max(b)));
+            }
+        }
+    }
+
+    /// Cuts every link of node `index`.
+    pub fn isolate(&mut self, index: usize) {
+        self.partition(&[index]);
+    }
+
+    /// Restores all links.
+    pub fn heal(&mut self) {
+        self.cut.clear();
+    }
+
+    /// Returns true if nodes `a` and `b` can exchange messages.
+    pub fn connected(&self, a: usize, b: usize) -> bool {
+        a == b || !self.cut.contains(&(a.min(b), a.max(b)))
+    }
+
+    /// Applies, on every node, an index registry call `contract` made with
+    /// `data`, as a committed receipt carrying the log the EVM records for
+    /// it. The executors of a test network don't run the EVM.
+    pub fn apply_index_call(&mut self, contract: Address, data: &[u8]) -> Result<(), NodeError> {
+        let log = index_call_log(contract, data.to_vec());
+        let receipt = TransactionReceipt {
+            transaction_hash: [0u8; 32],
+            block_hash: [0u8; 32],
+            block_number: 0,
+            transaction_index: 0,
+            gas_used: 0,
+            status: true,
+            logs: vec![Log {
+                address: *log.address.as_bytes(),
+                topics: log.topics.iter().map(|topic| *topic.as_bytes()).collect(),
+                data: log.data,
+                block_number: 0,
+                transaction_hash: [0u8; 32],
+                transaction_index: 0,
+                log_index: 0,
+            }],
+        };
+        for node in &mut self.nodes {
+            node.node.apply_index_calls(std::slice::from_ref(&receipt))?;
+        }
+        Ok(())
+    }
+
+    /// Asks the proposal timer of the most advanced node what to do with
+    /// `pending` pooled transactions when `idle` has passed since the last
+    /// block.
+    pub fn next_proposal(
+        &self,
+        pending: usize,
+        idle: Duration,
+    ) -> Result<ProposalAction, NodeError> {
+        let leader = self
+            .nodes
+            .iter()
+            .max_by_key(|n| n.head().0)
+            .expect("networks have nodes");
+        Ok(leader.node.proposal_timer()?.next(pending, idle))
+    }
+
+    /// Runs one step of the proposer loop: produces a block from the whole
+    /// `pool` if the proposal timer says so, and otherwise leaves the pool
+    /// untouched and returns None. Transactions over the per-sender cap stay
+    /// in the pool for a later block.
+    ///
+    /// If every round times out, the transactions go back to the front of
+    /// the pool and every node publishes a `TxRequeued` event for each of
+    /// them before the error is returned.
+    pub fn propose(
+        &mut self,
+        pool: &mut Vec<Transaction>,
+        idle: Duration,
+    ) -> Result<Option<Block>, NodeError> {
+        if let ProposalAction::Wait(_) = self.next_proposal(pool.len(), idle)? {
+            return Ok(None);
+        }
+        let transactions = std::mem::take(pool);
+        match self.produce_block(transactions.clone()) {
+            Ok(block) => {
+                let included: HashSet<H256> =
+                    block.transactions.iter().map(Transaction::hash).collect();
+                let system_txs = self.nodes[0].consensus.system_txs();
+                for tx in transactions {
+                    let hash = tx.hash();
+                    if included.contains(&hash) {
+                        self.requeues.remove(&hash);
+                    } else if !system_txs.is_system_tx(&tx) {
+                        pool.push(tx);
+                    }
+                }
+                Ok(Some(block))
+            }
+            Err(NodeError::SigQuorumNotReached { height, rounds }) => {
+                self.requeue(&transactions, height, rounds);
+                pool.splice(0..0, transactions);
+                Err(NodeError::SigQuorumNotReached { height, rounds })
+            }
+            Err(e) => {
+                pool.splice(0..0, transactions);
+                Err(e)
+            }
+        }
+    }
+
+    /// Counts a requeue of each of `transactions`, proposed at `height`
+    /// and timed out after `rounds`, and notifies every node.
+    fn requeue(&mut self, transactions: &[Transaction], height: u64, rounds: u32) {
+        let requeues: Vec<TxRequeue> = transactions
+            .iter()
+            .map(|tx| {
+                let tx_hash = tx.hash();
+                let count = self.requeues.entry(tx_hash).or_insert(0);
+                *count += 1;
+                TxRequeue {
+                    tx_hash,
+                    height,
+                    rounds,
+                    requeues: *count,
+                }
+            })
+            .collect();
+        tracing::debug!(
+            height,
+            count = requeues.len(),
+            "Returned timed out transactions to the pool"
+        );
+        for node in &self.nodes {
+            node.node.record_tx_requeues(requeues.clone());
+        }
+    }
+
+    /// Orders, executes and commits a block containing `transactions` on
+    /// every node that can reach a quorum, and returns it.
+    ///
+    /// Nodes behind a connected peer first sync the blocks they missed.
+    /// Rounds whose proposer cannot gather a quorum time out; after
+    /// `max_rounds` failed rounds an error is returned.
+    pub fn produce_block(&mut self, transactions: Vec<Transaction>) -> Result<Block, NodeError> {
+        self.sync()?;
+        let transactions: Vec<Transaction> =
+            self.evidence.iter().cloned().chain(transactions).collect();
+
+        let height = self.height() + 1;
+        let leader = self
+            .nodes
+            .iter()
+            .position(|n| n.head().0 + 1 == height)
+            .unwrap_or(0);
+        let (_, parent_hash) = self.nodes[leader].head();
+        let timestamp = match &self.config.clock {
+            Some(clock) => clock.unix_timestamp(),
+            None => self.genesis_timestamp + height,
+        };
+
+        for node in self.nodes.iter_mut().filter(|n| n.head().0 + 1 == height) {
+            let limit = node.node.max_txs_per_sender()?;
+            node.consensus.set_max_txs_per_sender(limit);
+            let gas_limit = node.node.block_gas_limit()?;
+            node.consensus.set_block_gas_limit(gas_limit);
+            let schemes = node.node.signature_schemes()?;
+            node.consensus.set_tx_signature_schemes(schemes);
+            let revoked = node.node.revoked_senders();
+            node.consensus.set_revoked_tx_signers(revoked);
+            let schedule = node.node.hash_schedule_at(height);
+            node.consensus.set_hash_schedule(schedule);
+            let penalties = node.node.penalties_at(height)?;
+            node.consensus.set_penalties(penalties);
+            if let Some(validator) = node.consensus.timestamp_validator() {
+                validator.set_max_drift(node.node.max_clock_drift()?);
+            }
+        }
+
+        if self.config.mode == ConsensusMode::Solo {
+            let mut transactions = transactions;
+            let consensus = &self.nodes[0].consensus;
+            let committed = |hash: &H256| self.nodes[0].node.is_tx_committed(hash);
+            drop_duplicate_txs(&mut transactions, Some(&committed));
+            cap_txs_per_sender(&mut transactions, consensus.max_txs_per_sender());
+            cap_block_gas(&mut transactions, consensus.block_gas_limit());
+            self.nodes[0]
+                .consensus
+                .append_system_txs(height, &parent_hash, &mut transactions);
+            let block = Block::new(height, parent_hash, transactions, timestamp);
+            let executor = Arc::clone(&self.config.executor);
+            self.nodes[0].apply_block(&block, executor.as_ref(), 0, None)?;
+            self.checkpoint(height, &[0])?;
+            self.collect_evidence(&block)?;
+            return Ok(block);
+        }
+
+        for _ in 0..self.config.max_rounds {
+            self.queue.clear();
+            self.align_rounds(height);
+            let proposal = self
+                .nodes
+                .iter_mut()
+                .enumerate()
+                .filter(|(_, n)| n.head().0 + 1 == height)
+                .find_map(|(i, n)| {
+                    let proposal = n.consensus.create_proposal(
+                        transactions.clone(),
+                        parent_hash,
+                        timestamp,
+                    )?;
+                    Some((i, proposal))
+                });
+
+            let proposer = proposal.as_ref().map(|(i, _)| *i);
+            if let Some((proposer, proposal)) = proposal {
+                // The proposer votes for its own block right away
+                let block_hash = match &proposal {
+                    ConsensusMessage::Proposal(p) => {
+                        self.nodes[proposer].consensus.block_hash(&p.block)
+                    }
+                    _ => unreachable!("create_proposal returns a proposal"),
+                };
+                let prevote = self.nodes[proposer]
+                    .consensus
+                    .create_prevote(Some(block_hash));
+                self.broadcast(proposer, vec![proposal, ConsensusMessage::PreVote(prevote)]);
+                self.deliver_all();
+            }
+
+            let committed: Vec<(usize, Block, usize)> = self
+                .nodes
+                .iter()
+                .enumerate()
+                .filter_map(|(i, n)| {
+                    let block = n.consensus.state().committed_block()?.clone();
+                    Some((i, block, n.consensus.precommit_count()))
+                })
+                .collect();
+            if let Some((_, block, _)) = committed.first() {
+                let block = block.clone();
+                let executor = Arc::clone(&self.config.executor);
+                let mut signers = Vec::with_capacity(committed.len());
+                for (i, committed_block, signatures) in committed {
+                    self.nodes[i].apply_block(
+                        &committed_block,
+                        executor.as_ref(),
+                        signatures,
+                        None,
+                    )?;
+                    signers.push(i);
+                }
+                self.checkpoint(height, &signers)?;
+                if let Some(proposer) = proposer {
+                    self.nodes[proposer].node.record_proposal_commit();
+                }
+                self.collect_evidence(&block)?;
+                return Ok(block);
+            }
+
+            tracing::debug!(height, "Test network round timed out");
+            if let Some(proposer) = proposer {
+                self.nodes[proposer].node.record_proposal_failure();
+            }
+            for node in self.nodes.iter_mut().filter(|n| n.head().0 + 1 == height) {
+                node.consensus.handle_timeout();
+            }
+        }
+
+        for node in self.nodes.iter().filter(|n| n.head().0 + 1 == height) {
+            node.node.record_quorum_failure();
+        }
+        Err(NodeError::SigQuorumNotReached {
+            height,
+            rounds: self.config.max_rounds,
+        })
+    }
+
+    /// Brings every node up to the highest head it can reach by streaming
+    /// committed blocks from its connected peers and executing them.
+    pub fn sync(&mut self) -> Result<(), NodeError> {
+        let executor = Arc::clone(&self.config.executor);
+        loop {
+            let mut progressed = false;
+            for i in 0..self.nodes.len() {
+                let height = self.nodes[i].head().0;
+                let sources: Vec<StorageSource> = (0..self.nodes.len())
+                    .filter(|&p| self.connected(i, p) && self.nodes[p].head().0 > height)
+                    .filter_map(|p| self.nodes[p].node.sync_source(format!("node {}", p)))
+                    .collect();
+                if sources.is_empty() {
+                    continue;
+                }
+                let sources: Vec<&dyn BlockSource> =
+                    sources.iter().map(|s| s as &dyn BlockSource).collect();
+
+                let node = &mut self.nodes[i];
+                let validator_set = node.consensus.validator_set().clone();
+                let mut sync = StreamingSync::new(SyncConfig::default())
+                    .with_progress(Arc::clone(node.node.sync_progress()));
+                // With checkpoints on, sync only to blocks the validators
+                // signed for
+                if node.node.checkpoint_interval_at(height) > 0 {
+                    sync = sync.with_checkpoints(validator_set.clone());
+                }
+                let schedule = node.node.hash_schedule_at(u64::MAX);
+                let head = node.node.head_digests();
+                let report = sync.run(&sources, height, head, &schedule, |block, state_root| {
+                    node.apply_block(block, executor.as_ref(), 0, Some(state_root))
+                        .map(|_| ())
+                })?;
+                if let Some(signed) = &report.checkpoint {
+                    node.node.record_checkpoint(signed, &validator_set)?;
+                }
+                progressed |= report.blocks() > 0;
+            }
+            if !progressed {
+                return Ok(());
+            }
+        }
+    }
+
+    /// Drops the evidence transactions `block` included, and queues one
+    /// for each piece of evidence a node's consensus detected that no node
+    /// submitted yet, signed by the node that detected it.
+    fn collect_evidence(&mut self, block: &Block) -> Result<(), NodeError> {
+        let included: HashSet<H256> = block.transactions.iter().map(Transaction::hash).collect();
+        self.evidence.retain(|tx| !included.contains(&tx.hash()));
+        for node in &mut self.nodes {
+            for evidence in node.consensus.take_evidence() {
+                if !self.reported.insert(evidence.hash()) {
+                    continue;
+                }
+                let nonce = self.reported.len() as u64;
+                self.evidence.push(node.node.evidence_transaction(&evidence, nonce)?);
+            }
+        }
+        Ok(())
+    }
+
+    /// If a checkpoint is due at `height`, has the `signers` that committed
+    /// the block broadcast their checkpoint votes, and records the
+    /// checkpoint on every node whose consensus gathered a quorum of votes
+    /// for it. Returns the recorded checkpoint.
+    fn checkpoint(
+        &mut self,
+        height: u64,
+        signers: &[usize],
+    ) -> Result<Option<SignedCheckpoint>, NodeError> {
+        let first = &self.nodes[signers[0]];
+        if !is_checkpoint_height(height, first.node.checkpoint_interval_at(height)) {
+            return Ok(None);
+        }
+        let validator_set = first.consensus.validator_set().clone();
+
+        for &i in signers {
+            let checkpoint = self.nodes[i]
+                .node
+                .checkpoint_at(height)
+                .ok_or(NodeError::PreBlockMissing { height })?;
+            let vote = self.nodes[i].consensus.sign_checkpoint_vote(checkpoint);
+            self.broadcast(i, vec![vote]);
+        }
+        self.deliver_all();
+
+        let mut recorded = None;
+        for node in &mut self.nodes {
+            for signed in node.consensus.take_checkpoints() {
+                node.node.record_checkpoint(&signed, &validator_set)?;
+                if signed.height() == height {
+                    recorded = Some(signed);
+                }
+            }
+        }
+        if recorded.is_none() {
+            tracing::warn!(height, "Checkpoint signers fell short of a quorum");
+        }
+        Ok(recorded)
+    }
+
+    /// Moves nodes deciding `height` to the highest round any of them is in,
+    /// as a node does on seeing messages from a later round.
+    fn align_rounds(&mut self, height: u64) {
+        let deciding = |n: &&mut TestNode| n.head().0 + 1 == height;
+        let Some(round) = self
+            .nodes
+            .iter_mut()
+            .filter(deciding)
+            .map(|n| n.consensus.state().round())
+            .max()
+        else {
+            return;
+        };
+        for node in self.nodes.iter_mut().filter(deciding) {
+            while node.consensus.state().round() < round {
+                node.consensus.handle_timeout();
+            }
+        }
+    }
+
+    /// Queues `messages` from node `from` for every connected peer.
+    fn broadcast(&mut self, from: usize, messages: Vec<ConsensusMessage>) {
+        let peers: Vec<usize> = (0..self.nodes.len())
+            .filter(|&to| to != from && self.connected(from, to))
+            .collect();
+        for message in messages {
+            for &to in &peers {
+                self.queue.push_back(Envelope {
+                    from,
+                    to,
+                    message: message.clone(),
+                });
+            }
+        }
+    }
+
+    /// Delivers queued messages, and the responses they trigger, until the
+    /// network is quiet.
+    fn deliver_all(&mut self) {
+        while let Some(Envelope { from, to, message }) = self.queue.pop_front() {
+            let proposal = matches!(message, ConsensusMessage::Proposal(_));
+            let result = self.nodes[to].consensus.handle_message(message);
+            let node = &self.nodes[to];
+            if let (true, Some(validator)) = (proposal, node.consensus.timestamp_validator()) {
+                node.node
+                    .health()
+                    .set_clock_drift(validator.last_drift(), validator.rejections());
+            }
+            match result {
+                Ok(responses) => self.broadcast(to, responses),
+                // Stragglers from earlier rounds or heights are expected
+                Err(ConsensusError::WrongHeight { .. } | ConsensusError::WrongRound { .. }) => {}
+                Err(e) => tracing::debug!(from, to, error = ?e, "Test network message rejected"),
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_consensus::DEFAULT_BACKOFF_AFTER;
+    use bach_contracts::{
+        chain_config_address, encode_index_declare, encode_index_drop, encode_update, IndexField,
+        IndexSpec,
+    };
+    use bach_msgbus::{Message, Topic};
+    use bach_primitives::{ErrorCode, ErrorCoded};
+    use bach_types::DEFAULT_TX_GAS;
+
+    /// Writes `tx.data` under the key `keccak256(nonce)`.
+    struct KeyValueExecutor;
+
+    impl TransactionExecutor for KeyValueExecutor {
+        fn execute(
+            &self,
+            tx: &Transaction,
+            _snapshot: &Snapshot,
+        ) -> (ReadWriteSet, ExecutionResult) {
+            let mut rwset = ReadWriteSet::new();
+            rwset.record_write(keccak256(&tx.nonce.to_be_bytes()), tx.data.clone());
+            (rwset, ExecutionResult::Success { output: Vec::new() })
+        }
+    }
+
+    /// Appends a transaction recording how many user transactions the
+    /// block holds.
+    struct TxCounter;
+
+    impl SystemTxGenerator for TxCounter {
+        fn name(&self) -> &str {
+            "tx-counter"
+        }
+
+        fn address(&self) -> Address {
+            Address::from([0x0c; 20])
+        }
+
+        fn generate(&self, _: u64, _: &H256, transactions: &[Transaction]) -> Vec<Vec<u8>> {
+            vec![(transactions.len() as u64).to_be_bytes().to_vec()]
+        }
+    }
+
+    fn put(nonce: u64, value: u8) -> Transaction {
+        put_bytes(nonce, vec![value])
+    }
+
+    fn put_bytes(nonce: u64, value: impl Into<Vec<u8>>) -> Transaction {
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let mut tx =
+            Transaction::new(nonce, None, U256::ZERO, value.into(), key.sign(&H256::zero()));
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    /// Returns a chain config update of the named parameters.
+    fn config_tx(nonce: u64, changes: &[(&str, &str)]) -> Transaction {
+        let changes: Vec<(String, String)> = changes
+            .iter()
+            .map(|(name, value)| (name.to_string(), value.to_string()))
+            .collect();
+        let key = PrivateKey::from_bytes(&[0x22; 32]).unwrap();
+        let data = encode_update(&changes);
+        let to = Some(chain_config_address());
+        let mut tx = Transaction::new(nonce, to, U256::ZERO, data, key.sign(&H256::zero()));
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    fn stored(node: &TestNode, nonce: u64) -> H256 {
+        node.storage()
+            .state
+            .get_storage(&Address::zero(), &keccak256(&nonce.to_be_bytes()))
+    }
+
+    #[test]
+    fn test_solo_commits_without_votes() {
+        let config = TestNetworkConfig::solo().with_executor(Arc::new(KeyValueExecutor));
+        let mut net = TestNetwork::new(config).unwrap();
+
+        let block = net.produce_block(vec![put(1, 0x2a)]).unwrap();
+        assert_eq!(block.height, 1);
+        assert_eq!(net.node(0).head(), (1, block.hash()));
+        assert_eq!(stored(net.node(0), 1), slot_value(&[0x2a]));
+        assert!(TestNetwork::new(TestNetworkConfig {
+            nodes: 2,
+            ..TestNetworkConfig::solo()
+        })
+        .is_err());
+    }
+
+    #[test]
+    fn test_proposer_honors_chain_config_timer() {
+        let config = TestNetworkConfig::solo().with_executor(Arc::new(KeyValueExecutor));
+        let mut net = TestNetwork::new(config).unwrap();
+        let secs = Duration::from_secs;
+
+        // The default fixed timer proposes empty blocks every interval
+        let mut pool = Vec::new();
+        assert!(net.propose(&mut pool, secs(1)).unwrap().is_none());
+        assert_eq!(net.propose(&mut pool, secs(3)).unwrap().unwrap().height, 1);
+
+        // The timer switches once the block holding the update is committed
+        pool.push(config_tx(
+            0,
+            &[
+                ("proposal_timer", "suppress-empty"),
+                ("proposal_max_idle_ms", "10000"),
+            ],
+        ));
+        assert_eq!(net.propose(&mut pool, secs(3)).unwrap().unwrap().height, 2);
+
+        // Empty blocks wait for the idle bound, pooled work does not
+        assert_eq!(
+            net.next_proposal(0, secs(3)).unwrap(),
+            ProposalAction::Wait(secs(3))
+        );
+        assert!(net.propose(&mut pool, secs(9)).unwrap().is_none());
+        assert_eq!(net.propose(&mut pool, secs(10)).unwrap().unwrap().height, 3);
+        pool.push(put(1, 1));
+        let block = net.propose(&mut pool, secs(3)).unwrap().unwrap();
+        assert_eq!(block.transactions.len(), 1);
+        assert!(pool.is_empty());
+    }
+
+    #[test]
+    fn test_empty_block_heartbeat() {
+        let config = TestNetworkConfig::tbft(4)
+            .with_executor(Arc::new(KeyValueExecutor))
+            .with_chain_config("proposal_timer", "suppress-empty")
+            .with_chain_config("proposal_max_idle_ms", "60000")
+            .with_chain_config("empty_block_interval_ms", "5000");
+        let mut net = TestNetwork::new(config).unwrap();
+        let secs = Duration::from_secs;
+
+        // The heartbeat cuts the idle bound short, and every validator
+        // accepts the empty block
+        let mut pool = Vec::new();
+        assert_eq!(
+            net.next_proposal(0, secs(4)).unwrap(),
+            ProposalAction::Wait(secs(1))
+        );
+        let block = net.propose(&mut pool, secs(5)).unwrap().unwrap();
+        assert!(block.transactions.is_empty());
+        assert!(net.in_agreement());
+    }
+
+    #[test]
+    fn test_validators_check_block_timestamps() {
+        let clock = bach_primitives::FakeClock::new();
+        clock.advance(Duration::from_secs(1_000_000));
+        let config = TestNetworkConfig::tbft(4)
+            .with_executor(Arc::new(KeyValueExecutor))
+            .with_clock(Arc::new(clock.clone()));
+        let mut net = TestNetwork::new(config).unwrap();
+
+        let block = net.produce_block(Vec::new()).unwrap();
+        assert_eq!(block.timestamp, 1_000_000);
+
+        // A proposal stamped past the allowed drift gets no votes
+        let address = net.nodes[0].consensus.validator_set().get_proposer(2, 0).address;
+        let proposer = net
+            .nodes
+            .iter()
+            .position(|n| *n.consensus.our_address() == address)
+            .unwrap();
+        let parent_hash = net.node(0).node().block_digests(&block).hash;
+        let proposal = net.nodes[proposer]
+            .consensus
+            .create_proposal(Vec::new(), parent_hash, 1_000_016)
+            .unwrap();
+        net.broadcast(proposer, vec![proposal]);
+        net.deliver_all();
+        for (i, node) in net.nodes().iter().enumerate() {
+            if i != proposer {
+                assert_eq!(node.node().health().timestamp_rejections(), 1);
+                assert_eq!(node.node().health().clock_drift(), 16);
+            }
+        }
+
+        clock.advance(Duration::from_secs(5));
+        let block = net.produce_block(Vec::new()).unwrap();
+        assert_eq!((block.height, block.timestamp), (2, 1_000_005));
+        assert!(net.in_agreement());
+
+        // Validators pick up a drift change from chain config
+        net.produce_block(vec![config_tx(0, &[("max_clock_drift_secs", "30")])])
+            .unwrap();
+        net.produce_block(Vec::new()).unwrap();
+        for node in net.nodes() {
+            let validator = node.consensus.timestamp_validator().unwrap();
+            assert_eq!(validator.max_drift(), Duration::from_secs(30));
+        }
+    }
+
+    #[test]
+    fn test_tbft_partition_and_recovery() {
+        let config = TestNetworkConfig::tbft(4).with_executor(Arc::new(KeyValueExecutor));
+        let mut net = TestNetwork::new(config).unwrap();
+
+        let block = net.produce_block(vec![put(1, 1)]).unwrap();
+        assert!(net.in_agreement());
+        // The three followers executed the proposal before voting for it
+        let verified = net.nodes().iter().map(|n| n.consensus().verification_cache().misses());
+        assert_eq!(verified.sum::<u64>(), 3);
+        let receipt = net
+            .node(2)
+            .storage()
+            .transactions
+            .get_receipt(&block.transactions[0].hash())
+            .unwrap();
+        assert!(receipt.status);
+
+        // Three of four validators still reach quorum; the isolated one
+        // falls behind, including when it is the scheduled proposer
+        net.isolate(3);
+        for nonce in 2..=5 {
+            net.produce_block(vec![put(nonce, nonce as u8)]).unwrap();
+        }
+        assert_eq!(net.height(), 5);
+        assert_eq!(net.node(3).head().0, 1);
+
+        // Two of four cannot
+        net.isolate(2);
+        let err = net.produce_block(Vec::new()).unwrap_err();
+        assert!(matches!(err, NodeError::SigQuorumNotReached { height: 6, rounds: 4 }));
+        assert_eq!(err.error_code(), ErrorCode::SigQuorumNotReached);
+        assert_eq!(net.node(0).node.health().quorum_failures(), 1);
+
+        // Once healed, lagging nodes sync and the chains converge
+        net.heal();
+        net.produce_block(vec![put(6, 6)]).unwrap();
+        assert!(net.in_agreement());
+        assert_eq!(net.height(), 6);
+        assert_eq!(net.node(0).node.health().quorum_failures(), 0);
+        for node in net.nodes() {
+            assert_eq!(stored(node, 4), slot_value(&[4]));
+        }
+
+        // Identical runs produce identical chains
+        let mut replay =
+            TestNetwork::new(TestNetworkConfig::tbft(4).with_executor(Arc::new(KeyValueExecutor)))
+                .unwrap();
+        let first = replay.produce_block(vec![put(1, 1)]).unwrap();
+        assert_eq!(first.hash(), block.hash());
+    }
+
+    #[test]
+    fn test_equivocation_evidence_excludes_validator() {
+        use bach_consensus::{EvidenceEvent, Penalty};
+
+        let config = TestNetworkConfig::tbft(4).with_executor(Arc::new(KeyValueExecutor));
+        let mut net = TestNetwork::new(config).unwrap();
+        net.produce_block(vec![put(1, 1)]).unwrap();
+
+        // Node 3 pre-votes twice at height 2
+        let byzantine = *net.nodes[3].consensus.our_address();
+        let first = net.nodes[3].consensus.create_prevote(Some(H256::from([9u8; 32])));
+        let second = net.nodes[3].consensus.create_prevote(None);
+        net.broadcast(3, vec![ConsensusMessage::PreVote(first), ConsensusMessage::PreVote(second)]);
+        net.deliver_all();
+        net.produce_block(vec![put(2, 2)]).unwrap();
+        let submitted: Vec<H256> = net.evidence.iter().map(Transaction::hash).collect();
+        assert!(!submitted.is_empty());
+
+        // The next block records it, with a log in each evidence receipt
+        let block = net.produce_block(Vec::new()).unwrap();
+        assert_eq!(block.transactions[0].hash(), submitted[0]);
+        assert!(net.evidence.is_empty());
+        for hash in &submitted {
+            let receipt = net.node(0).storage().transactions.get_receipt(hash).unwrap();
+            assert!(receipt.status);
+            let log = &receipt.logs[0];
+            let topics: Vec<H256> = log.topics.iter().copied().map(H256::from).collect();
+            let event = EvidenceEvent::from_log(&topics, &log.data).unwrap();
+            assert_eq!((event.validator, event.height), (byzantine, 2));
+        }
+
+        // From the following height on, every node excludes the validator
+        net.produce_block(vec![put(4, 4)]).unwrap();
+        for node in net.nodes() {
+            assert_eq!(node.consensus.penalties(), &[(byzantine, Penalty::Exclude)]);
+            let recorded = crate::read_evidence(node.storage()).unwrap();
+            assert_eq!(recorded.records_for(&byzantine).len(), submitted.len());
+        }
+        assert!(net.in_agreement());
+    }
+
+    #[test]
+    fn test_proposal_backoff_after_quorum_failures() {
+        let config = TestNetworkConfig::tbft(4).with_executor(Arc::new(KeyValueExecutor));
+        let mut net = TestNetwork::new(config).unwrap();
+        let secs = Duration::from_secs;
+        net.produce_block(vec![put(1, 1)]).unwrap();
+
+        // Every proposer sees its blocks miss the quorum and slows down
+        net.isolate(2);
+        net.isolate(3);
+        for _ in 0..DEFAULT_BACKOFF_AFTER {
+            assert!(net.produce_block(Vec::new()).is_err());
+        }
+        for node in net.nodes() {
+            assert_eq!(node.node.proposal_backoff().factor(), 2);
+            assert_eq!(node.node.health().proposal_backoff(), 2);
+        }
+        assert_eq!(
+            net.next_proposal(0, secs(3)).unwrap(),
+            ProposalAction::Wait(secs(3))
+        );
+        assert_eq!(net.next_proposal(0, secs(6)).unwrap(), ProposalAction::Propose);
+
+        // Proposers return to full rate once their own blocks commit
+        net.heal();
+        for nonce in 2..=5 {
+            net.produce_block(vec![put(nonce, nonce as u8)]).unwrap();
+        }
+        for node in net.nodes() {
+            assert!(!node.node.proposal_backoff().is_backing_off());
+            assert_eq!(node.node.health().proposal_backoff(), 1);
+        }
+        assert_eq!(net.next_proposal(0, secs(3)).unwrap(), ProposalAction::Propose);
+    }
+
+    #[test]
+    fn test_sender_cap_defers_excess_txs() {
+        let config = TestNetworkConfig::tbft(4)
+            .with_executor(Arc::new(KeyValueExecutor))
+            .with_chain_config("max_txs_per_sender", "2");
+        let mut net = TestNetwork::new(config).unwrap();
+        let idle = Duration::from_secs(60);
+
+        // Every validator accepts the capped block; the rest waits its turn
+        let mut pool: Vec<Transaction> = (1..=3).map(|nonce| put(nonce, nonce as u8)).collect();
+        let block = net.propose(&mut pool, idle).unwrap().unwrap();
+        assert_eq!(block.transactions.len(), 2);
+        assert_eq!(pool.len(), 1);
+        assert_eq!(pool[0].nonce, 3);
+        assert!(net.in_agreement());
+
+        let block = net.propose(&mut pool, idle).unwrap().unwrap();
+        assert_eq!(block.transactions[0].nonce, 3);
+        assert!(pool.is_empty());
+    }
+
+    #[test]
+    fn test_timed_out_txs_return_to_pool() {
+        let config = TestNetworkConfig::tbft(4).with_executor(Arc::new(KeyValueExecutor));
+        let mut net = TestNetwork::new(config).unwrap();
+        let idle = Duration::from_secs(60);
+        let mut requeued = net.node(1).node.msgbus().subscribe(Topic::TxRequeued);
+
+        // A proposal that times out leaves its transactions pooled
+        net.isolate(2);
+        net.isolate(3);
+        let mut pool = vec![put(1, 1), put(2, 2)];
+        let hashes: Vec<H256> = pool.iter().map(Transaction::hash).collect();
+        for attempt in 1..=2 {
+            let err = net.propose(&mut pool, idle).unwrap_err();
+            assert!(matches!(err, NodeError::SigQuorumNotReached { height: 1, .. }));
+            assert_eq!(pool.iter().map(Transaction::hash).collect::<Vec<_>>(), hashes);
+            for hash in &hashes {
+                let Message::TxRequeued(requeue) = requeued.try_recv().unwrap() else {
+                    panic!("expected a requeue");
+                };
+                assert_eq!(requeue.tx_hash, *hash);
+                assert_eq!((requeue.height, requeue.rounds), (1, 4));
+                assert_eq!(requeue.requeues, attempt);
+            }
+        }
+        for node in net.nodes() {
+            assert_eq!(node.node.health().requeued_txs(), 4);
+        }
+
+        // Once the network heals they commit and the count starts over
+        net.heal();
+        let block = net.propose(&mut pool, idle).unwrap().unwrap();
+        assert_eq!(block.transactions.len(), 2);
+        assert!(pool.is_empty());
+        assert!(net.requeues.is_empty());
+        assert!(requeued.try_recv().is_err());
+    }
+
+    #[test]
+    fn test_state_commitment_in_header_extension() {
+        let config = TestNetworkConfig::tbft(4)
+            .with_executor(Arc::new(KeyValueExecutor))
+            .with_state_commitment();
+        let mut net = TestNetwork::new(config).unwrap();
+        net.produce_block(vec![put(1, 1), put(2, 2)]).unwrap();
+        let block = net.produce_block(vec![put(1, 3)]).unwrap();
+
+        let commitments: Vec<H256> = net
+            .nodes()
+            .iter()
+            .map(|node| {
+                let hash = node.node().block_digests(&block).hash;
+                let extension = node.storage().blocks.get_header_extension(&hash).unwrap();
+                H256::from(extension.state_commitment.unwrap())
+            })
+            .collect();
+        assert!(commitments.windows(2).all(|pair| pair[0] == pair[1]));
+
+        let key = keccak256(&1u64.to_be_bytes());
+        let proof = net.node(2).state_proof(&key).unwrap();
+        assert!(proof.verify(&commitments[0], &key, Some(&[3])));
+        let missing = keccak256(&3u64.to_be_bytes());
+        let proof = net.node(2).state_proof(&missing).unwrap();
+        assert!(proof.verify(&commitments[0], &missing, None));
+
+        // Without the flag the extension records no commitment
+        let mut plain =
+            TestNetwork::new(TestNetworkConfig::solo().with_executor(Arc::new(KeyValueExecutor)))
+                .unwrap();
+        let block = plain.produce_block(vec![put(1, 1)]).unwrap();
+        let storage = plain.node(0).storage();
+        let extension = storage.blocks.get_header_extension(&block.hash()).unwrap();
+        assert!(extension.state_commitment.is_none());
+        assert!(extension.logs_bloom.is_some());
+        assert!(plain.node(0).state_proof(&key).is_none());
+    }
+
+    #[test]
+    fn test_system_txs_end_every_block() {
+        for config in [TestNetworkConfig::solo(), TestNetworkConfig::tbft(4)] {
+            let config = config
+                .with_executor(Arc::new(KeyValueExecutor))
+                .with_system_tx_generator(Arc::new(TxCounter));
+            let mut net = TestNetwork::new(config).unwrap();
+            let block = net.produce_block(vec![put(1, 1), put(2, 2)]).unwrap();
+            assert_eq!(block.transactions.len(), 3);
+            assert_eq!(block.transactions[2].data, 2u64.to_be_bytes());
+            assert!(net.in_agreement());
+
+            // The system transaction runs after both user transactions
+            let dag = net.node(0).storage().transactions.get_tx_dag(1).unwrap();
+            assert!(dag.dependencies_of(1).is_empty());
+            assert_eq!(dag.dependencies_of(2), &[0, 1]);
+
+            let block = net.produce_block(Vec::new()).unwrap();
+            assert_eq!(block.transactions.len(), 1);
+        }
+    }
+
+    #[test]
+    fn test_key_history_records_writers() {
+        let config = TestNetworkConfig::tbft(4).with_executor(Arc::new(KeyValueExecutor));
+        let mut net = TestNetwork::new(config).unwrap();
+        let (first, second) = (put(1, 1), put(1, 2));
+        net.produce_block(vec![first.clone(), put(2, 2)]).unwrap();
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let mut rewrite = put(2, 2).with_gas(DEFAULT_TX_GAS + 1);
+        rewrite.signature = key.sign(&rewrite.signing_hash()).into();
+        net.produce_block(vec![rewrite]).unwrap();
+        net.produce_block(vec![second.clone()]).unwrap();
+
+        let key = keccak256(&1u64.to_be_bytes());
+        for node in net.nodes() {
+            let history = node.storage().state.get_key_history(&Address::zero(), &key, None, 10);
+            let writes: Vec<(u64, Option<H256>)> = history
+                .iter()
+                .map(|entry| (entry.height, entry.tx_hash_h256()))
+                .collect();
+            assert_eq!(writes, vec![(1, Some(first.hash())), (3, Some(second.hash()))]);
+            assert_eq!(history[1].value_hash_h256(), keccak256(stored(node, 1).as_bytes()));
+        }
+
+        // Rewriting the same value isn't a change
+        let key = keccak256(&2u64.to_be_bytes());
+        let history = net.node(1).storage().state.get_key_history(&Address::zero(), &key, None, 10);
+        assert_eq!(history.len(), 1);
+    }
+
+    #[test]
+    fn test_declared_index_follows_records() {
+        let config = TestNetworkConfig::tbft(4).with_executor(Arc::new(KeyValueExecutor));
+        let mut net = TestNetwork::new(config).unwrap();
+        let spec = IndexSpec::new("by_age", vec![IndexField::number("age")]);
+        net.apply_index_call(Address::zero(), &encode_index_declare(&spec)).unwrap();
+
+        let record = |nonce: u64, age: u64| put_bytes(nonce, format!(r#"{{"age":{}}}"#, age));
+        net.produce_block(vec![record(1, 40), record(2, 25), record(3, 61), put(4, 7)]).unwrap();
+        net.produce_block(vec![record(1, 70)]).unwrap();
+
+        let bound = |age: u64| spec.encode_bound(&[age.into()]).unwrap();
+        let slot = |nonce: u64| keccak256(&nonce.to_be_bytes());
+        for node in net.nodes() {
+            let entries = node.storage().state.scan_index(
+                &Address::zero(),
+                "by_age",
+                &bound(30),
+                Some(&bound(65)),
+                None,
+                10,
+            );
+            let slots: Vec<H256> = entries.iter().map(|entry| entry.slot_h256()).collect();
+            assert_eq!(slots, vec![slot(3)]);
+        }
+
+        net.apply_index_call(Address::zero(), &encode_index_drop("by_age")).unwrap();
+        let storage = net.node(0).storage();
+        let entries = storage.state.scan_index(&Address::zero(), "by_age", &[], None, None, 10);
+        assert!(entries.is_empty());
+
+        // Calls the registry rejects are skipped, and only a contract's own
+        // indexes can be dropped
+        net.apply_index_call(Address::zero(), &encode_index_drop("by_age")).unwrap();
+        net.apply_index_call(Address::zero(), &encode_index_declare(&spec)).unwrap();
+        net.apply_index_call(Address::from([9u8; 20]), &encode_index_drop("by_age")).unwrap();
+        for node in net.nodes() {
+            let indexes = node.node().indexes().unwrap();
+            assert!(indexes.get(&Address::zero(), "by_age").is_some());
+        }
+    }
+
+    #[test]
+    fn test_validators_cosign_checkpoints() {
+        let config = TestNetworkConfig::tbft(4)
+            .with_executor(Arc::new(KeyValueExecutor))
+            .with_chain_config("checkpoint_interval", "2");
+        let mut net = TestNetwork::new(config).unwrap();
+        net.produce_block(Vec::new()).unwrap();
+        assert!(net.node(0).node().latest_checkpoint().is_none());
+
+        net.produce_block(vec![put(1, 1)]).unwrap();
+        for node in net.nodes() {
+            let signed = node.node().latest_checkpoint().unwrap();
+            assert_eq!(node.node().checkpoint_at(2), Some(signed.checkpoint));
+            // Recorded as soon as the votes reached a quorum
+            assert_eq!(signed.signatures.len(), 3);
+        }
+
+        // The isolated validator misses the next checkpoint, which the
+        // other three still reach a quorum on
+        net.isolate(3);
+        net.produce_block(Vec::new()).unwrap();
+        net.produce_block(Vec::new()).unwrap();
+        let signed = net.node(0).node().latest_checkpoint().unwrap();
+        assert_eq!(signed.height(), 4);
+        assert_eq!(signed.signatures.len(), 3);
+        assert_eq!(net.node(3).node().latest_checkpoint().unwrap().height(), 2);
+
+        // A checkpoint for another block or without a quorum is refused
+        let validator_set = net.node(0).consensus().validator_set().clone();
+        let mut forged = signed.clone();
+        forged.checkpoint.state_root = H256::zero();
+        assert!(matches!(
+            net.node(0).node().record_checkpoint(&forged, &validator_set),
+            Err(NodeError::Rejected(_))
+        ));
+        let mut short = signed;
+        short.signatures.truncate(2);
+        assert!(matches!(
+            net.node(0).node().record_checkpoint(&short, &validator_set),
+            Err(NodeError::ConsensusError(_))
+        ));
+
+        // Back online, the validator syncs to the checkpoint and records it
+        net.heal();
+        net.produce_block(Vec::new()).unwrap();
+        assert_eq!(net.node(3).node().latest_checkpoint().unwrap().height(), 4);
+        assert_eq!(net.node(3).head().0, 5);
+    }
+}
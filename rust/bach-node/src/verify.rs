@@ -0,0 +1,944 @@
+//! Verifying RPC client
+//!
+//! A plain RPC client trusts whatever the node returns. `VerifyingClient`
+//! keeps its own trust root, the validator set, and checks every block and
+//! receipt before returning it, failing with `NodeError::VerificationFailed`
+//! on the first mismatch:
+//!
+//! - A finality checkpoint must carry valid signatures of validators
+//!   holding a quorum of voting power.
+//! - A block must hash to its reported hash from its height, parent hash,
+//!   transactions root and timestamp, and its transactions must hash to its
+//!   transactions root. Each transaction is rebuilt from its fields and
+//!   must match its reported id.
+//! - A block must link by parent hashes to a checkpoint at or above it.
+//!   Blocks above the latest checkpoint aren't final and are rejected.
+//! - A receipt's transaction must be listed at its index in its block, so
+//!   the block's transaction list is the inclusion proof.
+//! - A receipt's status, gas used and logs must be what the chain
+//!   committed. The receipts of its block are fetched and hashed to the
+//!   block's receipts root, which is chained through the receipts roots of
+//!   the blocks above it to the receipts chain root a checkpoint signed.
+//!
+//! Blocks carry no proposer signature in this tree, so a block is trusted
+//! through the checkpoint quorum it links to. Blocks and their transactions
+//! are hashed with the algorithm the client's hash schedule sets for their
+//! height, which must match the chain's; transaction ids stay Keccak-256.
+//! Blocks are fetched with full transactions, since only ids are reported
+//! otherwise and a root under another algorithm can't be recomputed from
+//! them. Verified block hashes are kept, with the receipts chain root
+//! after the block once a receipt verification covered it, and later
+//! blocks below them link to them instead of fetching a checkpoint again.
+//! Requests go through the bounded HTTP client.
+
+use crate::http::HttpClient;
+use crate::NodeError;
+use bach_consensus::{verify_checkpoint, ValidatorSet};
+use bach_crypto::{
+    HashAlgorithm, HashSchedule, KeyAlgorithm, MemberSignature, Signature, SIGNATURE_LENGTH,
+};
+use bach_primitives::H256;
+use bach_rpc::{
+    format_h256, format_u64, parse_address, parse_bytes, parse_h256, parse_u256, parse_u64,
+    BatchItem, BlockResponse, CheckpointResponse, ReceiptResponse, TransactionResponse,
+    TransactionsResponse, MAX_BATCH_QUERY_SIZE,
+};
+use bach_storage::{chain_receipts_root, receipts_root, Log, TransactionReceipt};
+use bach_types::{Checkpoint, CheckpointSignature, SignedCheckpoint, Transaction};
+use serde::de::DeserializeOwned;
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+
+/// A block whose hash and transactions root were recomputed and that links
+/// to a verified checkpoint
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VerifiedBlock {
+    pub height: u64,
+    pub hash: H256,
+    pub parent_hash: H256,
+    pub timestamp: u64,
+    /// Transaction hashes in block order
+    pub transactions: Vec<H256>,
+}
+
+/// A receipt whose transaction is included in its verified block and whose
+/// outcome the chain committed
+#[derive(Debug, Clone)]
+pub struct VerifiedReceipt {
+    pub receipt: ReceiptResponse,
+    pub block: VerifiedBlock,
+}
+
+/// Queries a remote node and verifies the results against local trust
+/// roots.
+#[derive(Debug)]
+pub struct VerifyingClient {
+    http: HttpClient,
+    validators: ValidatorSet,
+    /// Block hash algorithm by height
+    schedule: HashSchedule,
+    /// Verified blocks and checkpoints, by height
+    anchors: Mutex<BTreeMap<u64, Anchor>>,
+}
+
+/// A trusted block hash, with the receipts chain root after the block once
+/// it is verified
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+struct Anchor {
+    hash: H256,
+    receipts: Option<H256>,
+}
+
+/// A verified block with the receipts roots the node reported for it
+#[derive(Debug, Clone)]
+struct FetchedBlock {
+    block: VerifiedBlock,
+    receipts_root: H256,
+    receipts_chain_root: H256,
+}
+
+impl VerifyingClient {
+    /// Creates a client for the given JSON-RPC address, trusting
+    /// checkpoints signed by a quorum of `validators`.
+    pub fn new(addr: &str, validators: ValidatorSet) -> Self {
+        Self {
+            http: HttpClient::new(addr),
+            validators,
+            schedule: HashSchedule::default(),
+            anchors: Mutex::new(BTreeMap::new()),
+        }
+    }
+
+    /// Hashes blocks with the chain's hash schedule instead of Keccak-256
+    /// throughout.
+    pub fn with_hash_schedule(mut self, schedule: HashSchedule) -> Self {
+        self.schedule = schedule;
+        self
+    }
+
+    /// Fetches the latest finality checkpoint and verifies its quorum.
+    pub async fn checkpoint(&self) -> Result<SignedCheckpoint, NodeError> {
+        let response: Option<CheckpointResponse> = self
+            .call("bach_getCheckpoint", serde_json::json!(["latest"]))
+            .await?;
+        let response = response
+            .ok_or_else(|| failed("the node reports no finality checkpoint".to_string()))?;
+        let signed = parse_checkpoint(&response)?;
+        verify_checkpoint(&signed, &self.validators)
+            .map_err(|e| failed(format!("checkpoint {}: {:?}", signed.height(), e)))?;
+        let receipts = signed.checkpoint.receipts_root;
+        self.anchors.lock().unwrap().insert(
+            signed.height(),
+            Anchor {
+                hash: signed.checkpoint.block_hash,
+                receipts: (!receipts.is_zero()).then_some(receipts),
+            },
+        );
+        Ok(signed)
+    }
+
+    /// Fetches the block at `height` and verifies it.
+    pub async fn block(&self, height: u64) -> Result<VerifiedBlock, NodeError> {
+        let (anchor_height, anchor) = self.anchor_for(height, false).await?;
+        let mut blocks = self.fetch_chain(height, anchor_height, anchor.hash).await?;
+        Ok(blocks.swap_remove(0).block)
+    }
+
+    /// Fetches the blocks from `from` to `anchor_height`, verifies each and
+    /// checks that they link to `anchor_hash`, and keeps their hashes.
+    async fn fetch_chain(
+        &self,
+        from: u64,
+        anchor_height: u64,
+        anchor_hash: H256,
+    ) -> Result<Vec<FetchedBlock>, NodeError> {
+        let mut blocks = Vec::new();
+        let heights: Vec<u64> = (from..=anchor_height).collect();
+        for chunk in heights.chunks(MAX_BATCH_QUERY_SIZE) {
+            let params: Vec<String> = chunk.iter().map(|h| format_u64(*h)).collect();
+            let items: Vec<BatchItem<BlockResponse>> = self
+                .call(
+                    "bach_getBlocksByHeights",
+                    serde_json::json!([params, true]),
+                )
+                .await?;
+            if items.len() != chunk.len() {
+                return Err(failed(format!(
+                    "asked for {} blocks, got {}",
+                    chunk.len(),
+                    items.len()
+                )));
+            }
+            for (h, item) in chunk.iter().zip(items) {
+                let response = item
+                    .result
+                    .ok_or_else(|| failed(format!("the node did not return block {}", h)))?;
+                let block = verify_block_response(&response, &self.schedule)?;
+                let root = |value: Option<&String>, field| {
+                    value.map_or(Ok(H256::zero()), |v| parse_h256(v).map_err(invalid(field)))
+                };
+                blocks.push(FetchedBlock {
+                    block,
+                    receipts_root: root(Some(&response.receipts_root), "receipts root")?,
+                    receipts_chain_root: root(
+                        response.receipts_chain_root.as_ref(),
+                        "receipts chain root",
+                    )?,
+                });
+            }
+        }
+        let verified: Vec<VerifiedBlock> = blocks.iter().map(|b| b.block.clone()).collect();
+        verify_links(&verified, from, anchor_hash)?;
+
+        let mut anchors = self.anchors.lock().unwrap();
+        for block in &verified {
+            anchors.entry(block.height).or_insert(Anchor {
+                hash: block.hash,
+                receipts: None,
+            });
+        }
+        Ok(blocks)
+    }
+
+    /// Fetches the receipt of transaction `hash` and verifies that its
+    /// block includes the transaction and that the chain committed its
+    /// outcome. Returns None if the node reports no receipt, which can't be
+    /// verified.
+    pub async fn receipt(&self, hash: H256) -> Result<Option<VerifiedReceipt>, NodeError> {
+        let Some(receipt) = self.fetch_receipt(hash).await? else {
+            return Ok(None);
+        };
+        let height = parse_u64(&receipt.block_number).map_err(invalid("block number"))?;
+        let index = parse_u64(&receipt.transaction_index).map_err(invalid("transaction index"))?;
+        let block_hash = parse_h256(&receipt.block_hash).map_err(invalid("block hash"))?;
+
+        // The parent's receipts chain root starts the chain; the node
+        // can't choose it without breaking the chain to the anchor
+        let (anchor_height, anchor) = self.anchor_for(height, true).await?;
+        let from = height.saturating_sub(1);
+        let blocks = self.fetch_chain(from, anchor_height, anchor.hash).await?;
+        let (parent_root, blocks) = if height == 0 {
+            (H256::zero(), &blocks[..])
+        } else {
+            (blocks[0].receipts_chain_root, &blocks[1..])
+        };
+        let block = blocks[0].block.clone();
+        verify_inclusion(&block, block_hash, index, hash)?;
+
+        let mut outcomes = Vec::with_capacity(block.transactions.len());
+        for (i, tx_hash) in block.transactions.iter().enumerate() {
+            let response = if *tx_hash == hash {
+                receipt.clone()
+            } else {
+                self.fetch_receipt(*tx_hash)
+                    .await?
+                    .ok_or_else(|| failed(format!("the node has no receipt for {:?}", tx_hash)))?
+            };
+            let outcome = receipt_outcome(&response)?;
+            if outcome.transaction_index as usize != i || outcome.block_hash_h256() != block.hash {
+                return Err(failed(format!(
+                    "receipt {:?} is not at index {} of block {}",
+                    tx_hash, i, block.height
+                )));
+            }
+            outcomes.push(outcome);
+        }
+
+        let mut chain_roots = Vec::with_capacity(blocks.len());
+        let mut chain_root = chain_receipts_root(parent_root, receipts_root(&outcomes));
+        chain_roots.push(chain_root);
+        for fetched in &blocks[1..] {
+            chain_root = chain_receipts_root(chain_root, fetched.receipts_root);
+            chain_roots.push(chain_root);
+        }
+        let expected = anchor
+            .receipts
+            .ok_or_else(|| failed(format!("block {} has no receipts root", anchor_height)))?;
+        if chain_root != expected {
+            return Err(failed(format!(
+                "receipts of block {} don't chain to the receipts root of block {}",
+                height, anchor_height
+            )));
+        }
+
+        let mut anchors = self.anchors.lock().unwrap();
+        for (fetched, root) in blocks.iter().zip(chain_roots) {
+            anchors.insert(
+                fetched.block.height,
+                Anchor {
+                    hash: fetched.block.hash,
+                    receipts: Some(root),
+                },
+            );
+        }
+        Ok(Some(VerifiedReceipt { receipt, block }))
+    }
+
+    /// Fetches the receipt of transaction `hash`, checking that it is the
+    /// one asked for.
+    async fn fetch_receipt(&self, hash: H256) -> Result<Option<ReceiptResponse>, NodeError> {
+        let receipt: Option<ReceiptResponse> = self
+            .call(
+                "eth_getTransactionReceipt",
+                serde_json::json!([format_h256(&hash)]),
+            )
+            .await?;
+        if let Some(receipt) = &receipt {
+            let tx_hash = parse_h256(&receipt.transaction_hash).map_err(invalid("tx hash"))?;
+            if tx_hash != hash {
+                return Err(failed(format!(
+                    "asked for receipt {:?}, got {:?}",
+                    hash, tx_hash
+                )));
+            }
+        }
+        Ok(receipt)
+    }
+
+    /// Returns the lowest trusted height at or above `height`, one with a
+    /// verified receipts chain root if `receipts` is set, fetching the
+    /// latest checkpoint if none is known.
+    async fn anchor_for(&self, height: u64, receipts: bool) -> Result<(u64, Anchor), NodeError> {
+        let known = self
+            .anchors
+            .lock()
+            .unwrap()
+            .range(height..)
+            .find(|(_, anchor)| !receipts || anchor.receipts.is_some())
+            .map(|(h, anchor)| (*h, *anchor));
+        if let Some(anchor) = known {
+            return Ok(anchor);
+        }
+        let signed = self.checkpoint().await?;
+        if signed.height() < height {
+            return Err(failed(format!(
+                "block {} is above the latest checkpoint {} and not final",
+                height,
+                signed.height()
+            )));
+        }
+        if receipts && signed.checkpoint.receipts_root.is_zero() {
+            return Err(failed(format!(
+                "checkpoint {} commits to no receipts",
+                signed.height()
+            )));
+        }
+        let receipts = signed.checkpoint.receipts_root;
+        Ok((
+            signed.height(),
+            Anchor {
+                hash: signed.checkpoint.block_hash,
+                receipts: (!receipts.is_zero()).then_some(receipts),
+            },
+        ))
+    }
+
+    /// Sends a JSON-RPC request and decodes its result.
+    async fn call<T: DeserializeOwned>(
+        &self,
+        method: &str,
+        params: serde_json::Value,
+    ) -> Result<T, NodeError> {
+        let body = serde_json::json!({
+            "jsonrpc": "2.0",
+            "id": 1,
+            "method": method,
+            "params": params,
+        })
+        .to_string();
+        let response = self.http.post_json(&body, None).await?;
+        parse_response(&response, method)
+    }
+}
+
+/// Recomputes a block's transactions root and hash from its fields, with
+/// the algorithm `schedule` sets for its height. A response listing only
+/// transaction ids can be checked only where that algorithm is Keccak-256.
+pub fn verify_block_response(
+    response: &BlockResponse,
+    schedule: &HashSchedule,
+) -> Result<VerifiedBlock, NodeError> {
+    let height = parse_u64(&response.number).map_err(invalid("block number"))?;
+    let hash = parse_h256(&response.hash).map_err(invalid("block hash"))?;
+    let parent_hash = parse_h256(&response.parent_hash).map_err(invalid("parent hash"))?;
+    let root = parse_h256(&response.transactions_root).map_err(invalid("transactions root"))?;
+    let timestamp = parse_u64(&response.timestamp).map_err(invalid("timestamp"))?;
+    let algorithm = schedule.algorithm_at(height);
+    let (transactions, hashes) = match &response.transactions {
+        TransactionsResponse::Hashes(hashes) if algorithm == HashAlgorithm::Keccak256 => {
+            let ids = hashes
+                .iter()
+                .map(|h| parse_h256(h))
+                .collect::<Result<Vec<_>, _>>()
+                .map_err(invalid("transaction hash"))?;
+            (ids.clone(), ids)
+        }
+        TransactionsResponse::Hashes(_) => {
+            return Err(failed(format!(
+                "block {} lists only transaction ids, which don't give its {} root",
+                height, algorithm
+            )));
+        }
+        TransactionsResponse::Full(txs) => {
+            let mut ids = Vec::with_capacity(txs.len());
+            let mut hashes = Vec::with_capacity(txs.len());
+            for response in txs {
+                let tx = parse_transaction(response)?;
+                let id = parse_h256(&response.hash).map_err(invalid("transaction hash"))?;
+                if tx.hash() != id {
+                    return Err(failed(format!(
+                        "block {} transaction {:?} hashes to {:?}",
+                        height,
+                        id,
+                        tx.hash()
+                    )));
+                }
+                ids.push(id);
+                hashes.push(tx.hash_with(algorithm));
+            }
+            (ids, hashes)
+        }
+    };
+
+    let hashes: Vec<u8> = hashes.iter().flat_map(|h| h.as_bytes().to_vec()).collect();
+    if algorithm.digest(&hashes) != root {
+        return Err(failed(format!(
+            "block {} transactions don't hash to its transactions root",
+            height
+        )));
+    }
+    let computed = algorithm.digest_concat(&[
+        &height.to_be_bytes(),
+        parent_hash.as_bytes(),
+        root.as_bytes(),
+        &timestamp.to_be_bytes(),
+    ]);
+    if computed != hash {
+        return Err(failed(format!(
+            "block {} hashes to {:?}, not the reported {:?}",
+            height, computed, hash
+        )));
+    }
+    Ok(VerifiedBlock {
+        height,
+        hash,
+        parent_hash,
+        timestamp,
+        transactions,
+    })
+}
+
+/// Rebuilds the committed outcome of a receipt from its reported fields.
+fn receipt_outcome(response: &ReceiptResponse) -> Result<TransactionReceipt, NodeError> {
+    let transaction_hash = parse_h256(&response.transaction_hash).map_err(invalid("tx hash"))?;
+    let status = match response.status.as_str() {
+        "0x1" => true,
+        "0x0" => false,
+        other => return Err(failed(format!("invalid status {}", other))),
+    };
+    let logs = response
+        .logs
+        .iter()
+        .map(|log| {
+            let topics = log
+                .topics
+                .iter()
+                .map(|topic| parse_h256(topic).map(|t| *t.as_bytes()))
+                .collect::<Result<Vec<_>, _>>()
+                .map_err(invalid("log topic"))?;
+            Ok(Log {
+                address: *parse_address(&log.address)
+                    .map_err(invalid("log address"))?
+                    .as_bytes(),
+                topics,
+                data: parse_bytes(&log.data).map_err(invalid("log data"))?,
+                block_number: 0,
+                transaction_hash: *transaction_hash.as_bytes(),
+                transaction_index: 0,
+                log_index: 0,
+            })
+        })
+        .collect::<Result<Vec<_>, NodeError>>()?;
+    let index = parse_u64(&response.transaction_index).map_err(invalid("transaction index"))?;
+    Ok(TransactionReceipt {
+        transaction_hash: *transaction_hash.as_bytes(),
+        block_hash: *parse_h256(&response.block_hash)
+            .map_err(invalid("block hash"))?
+            .as_bytes(),
+        block_number: parse_u64(&response.block_number).map_err(invalid("block number"))?,
+        transaction_index: u32::try_from(index).map_err(invalid("transaction index"))?,
+        gas_used: parse_u64(&response.gas_used).map_err(invalid("gas used"))?,
+        status,
+        logs,
+    })
+}
+
+/// Rebuilds a transaction from its reported fields and signature.
+fn parse_transaction(response: &TransactionResponse) -> Result<Transaction, NodeError> {
+    let key = KeyAlgorithm::from_name(&response.signature_algorithm)
+        .ok_or_else(|| failed(format!("unknown key {}", response.signature_algorithm)))?;
+    let hash = HashAlgorithm::from_name(&response.signing_hash_algorithm)
+        .ok_or_else(|| failed(format!("unknown hash {}", response.signing_hash_algorithm)))?;
+    let mut bytes = Vec::new();
+    if key != KeyAlgorithm::Secp256k1 {
+        let public_key = response
+            .public_key
+            .as_deref()
+            .ok_or_else(|| failed(format!("{} signature without a public key", key)))?;
+        bytes.extend(parse_bytes(public_key).map_err(invalid("public key"))?);
+    }
+    bytes.extend(parse_bytes(&response.r).map_err(invalid("signature r"))?);
+    bytes.extend(parse_bytes(&response.s).map_err(invalid("signature s"))?);
+    if key == KeyAlgorithm::Secp256k1 {
+        let v = parse_u64(&response.v).map_err(invalid("signature v"))?;
+        bytes.push(u8::try_from(v).map_err(invalid("signature v"))?);
+    }
+    if hash != HashAlgorithm::Keccak256 {
+        bytes.push(hash.id());
+    }
+    let signature = MemberSignature::from_bytes(&bytes)
+        .map_err(|e| failed(format!("invalid signature: {:?}", e)))?;
+
+    let to = match &response.to {
+        Some(to) => Some(parse_address(to).map_err(invalid("recipient"))?),
+        None => None,
+    };
+    let mut tx = Transaction::new(
+        parse_u64(&response.nonce).map_err(invalid("nonce"))?,
+        to,
+        parse_u256(&response.value).map_err(invalid("value"))?,
+        parse_bytes(&response.input).map_err(invalid("input"))?,
+        signature,
+    );
+    tx.gas = parse_u64(&response.gas).map_err(invalid("gas"))?;
+    Ok(tx)
+}
+
+/// Checks that `blocks` are consecutive from `from` and link by parent
+/// hashes to `anchor`, the trusted hash of the last one.
+fn verify_links(blocks: &[VerifiedBlock], from: u64, anchor: H256) -> Result<(), NodeError> {
+    let mut expected = anchor;
+    for (offset, block) in blocks.iter().enumerate().rev() {
+        let height = from + offset as u64;
+        if block.height != height {
+            return Err(failed(format!(
+                "asked for block {}, got {}",
+                height, block.height
+            )));
+        }
+        if block.hash != expected {
+            return Err(failed(format!(
+                "block {} is {:?}, but the verified chain has {:?}",
+                height, block.hash, expected
+            )));
+        }
+        expected = block.parent_hash;
+    }
+    Ok(())
+}
+
+/// Checks that `block` is the receipt's block and lists `tx_hash` at
+/// `index`.
+fn verify_inclusion(
+    block: &VerifiedBlock,
+    block_hash: H256,
+    index: u64,
+    tx_hash: H256,
+) -> Result<(), NodeError> {
+    if block.hash != block_hash {
+        return Err(failed(format!(
+            "receipt names block {:?}, but block {} is {:?}",
+            block_hash, block.height, block.hash
+        )));
+    }
+    let listed = usize::try_from(index)
+        .ok()
+        .and_then(|i| block.transactions.get(i));
+    if listed != Some(&tx_hash) {
+        return Err(failed(format!(
+            "block {} does not include transaction {:?} at index {}",
+            block.height, tx_hash, index
+        )));
+    }
+    Ok(())
+}
+
+/// Decodes a checkpoint response.
+fn parse_checkpoint(response: &CheckpointResponse) -> Result<SignedCheckpoint, NodeError> {
+    let checkpoint = Checkpoint::new(
+        parse_u64(&response.block_number).map_err(invalid("checkpoint height"))?,
+        parse_h256(&response.block_hash).map_err(invalid("checkpoint block hash"))?,
+        parse_h256(&response.state_root).map_err(invalid("checkpoint state root"))?,
+    )
+    .with_receipts_root(
+        parse_h256(&response.receipts_root).map_err(invalid("checkpoint receipts root"))?,
+    );
+    let mut signed = SignedCheckpoint::new(checkpoint);
+    for signature in &response.signatures {
+        let bytes = parse_bytes(&signature.signature).map_err(invalid("signature"))?;
+        let bytes: &[u8; SIGNATURE_LENGTH] = bytes
+            .as_slice()
+            .try_into()
+            .map_err(|_| failed(format!("invalid signature {}", signature.signature)))?;
+        signed.signatures.push(CheckpointSignature {
+            validator: parse_address(&signature.validator).map_err(invalid("validator"))?,
+            signature: Signature::from_bytes(bytes)
+                .map_err(|_| failed(format!("invalid signature {}", signature.signature)))?,
+        });
+    }
+    Ok(signed)
+}
+
+/// Extracts the result from a JSON-RPC HTTP response.
+fn parse_response<T: DeserializeOwned>(response: &[u8], method: &str) -> Result<T, NodeError> {
+    let response = String::from_utf8_lossy(response);
+    let (head, body) = response
+        .split_once("\r\n\r\n")
+        .ok_or_else(|| NodeError::ConfigError(format!("truncated {} response", method)))?;
+    let status_line = head.lines().next().unwrap_or_default();
+    if status_line.split_whitespace().nth(1) != Some("200") {
+        return Err(NodeError::ConfigError(format!(
+            "{} request returned {}",
+            method, status_line
+        )));
+    }
+
+    let reply: serde_json::Value = serde_json::from_str(body.trim())
+        .map_err(|e| NodeError::ConfigError(format!("invalid {} response: {}", method, e)))?;
+    if let Some(error) = reply.get("error") {
+        let message = error.get("message").and_then(|m| m.as_str());
+        return Err(NodeError::Rejected(
+            message.map_or_else(|| error.to_string(), str::to_string),
+        ));
+    }
+    let result = reply.get("result").cloned().unwrap_or_default();
+    serde_json::from_value(result)
+        .map_err(|e| failed(format!("invalid {} response: {}", method, e)))
+}
+
+fn failed(detail: String) -> NodeError {
+    NodeError::VerificationFailed(detail)
+}
+
+fn invalid<E: std::fmt::Display>(field: &'static str) -> impl Fn(E) -> NodeError {
+    move |e| failed(format!("invalid {}: {}", field, e))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_consensus::Validator;
+    use bach_crypto::PrivateKey;
+    use bach_primitives::U256;
+    use bach_rpc::{format_address, format_bytes, format_u256, LogResponse};
+    use bach_types::Block;
+    use std::sync::Arc;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::TcpListener;
+
+    fn tx(nonce: u64) -> Transaction {
+        let key = PrivateKey::from_bytes(&[0x11; 32]).unwrap();
+        let mut tx = Transaction::new(nonce, None, U256::ZERO, vec![1], key.sign(&H256::zero()));
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    fn chain(len: u64) -> Vec<Block> {
+        let mut blocks = vec![Block::new(0, H256::zero(), Vec::new(), 1000)];
+        for height in 1..len {
+            let parent = blocks.last().unwrap().hash();
+            blocks.push(Block::new(height, parent, vec![tx(height)], 1000 + height));
+        }
+        blocks
+    }
+
+    fn tx_response(tx: &Transaction) -> TransactionResponse {
+        let signature = tx.signature.to_bytes();
+        TransactionResponse {
+            block_hash: None,
+            block_number: None,
+            from: format_address(&tx.sender().unwrap()),
+            gas: format_u64(tx.gas),
+            gas_price: "0x0".to_string(),
+            hash: format_h256(&tx.hash()),
+            input: format_bytes(&tx.data),
+            nonce: format_u64(tx.nonce),
+            to: tx.to.as_ref().map(format_address),
+            transaction_index: None,
+            value: format_u256(&tx.value),
+            v: format_u64(signature[64] as u64),
+            r: format_bytes(&signature[..32]),
+            s: format_bytes(&signature[32..64]),
+            signature_algorithm: tx.signature.algorithm().to_string(),
+            signing_hash_algorithm: tx.signature.hash_algorithm().to_string(),
+            public_key: None,
+        }
+    }
+
+    fn response(block: &Block) -> BlockResponse {
+        response_with(block, &HashSchedule::default())
+    }
+
+    fn response_with(block: &Block, schedule: &HashSchedule) -> BlockResponse {
+        let hex = |h: H256| format_h256(&h);
+        let algorithm = schedule.algorithm_at(block.height);
+        BlockResponse {
+            number: format_u64(block.height),
+            hash: hex(block.digests(schedule).hash),
+            parent_hash: hex(block.parent_hash),
+            nonce: "0x0000000000000000".to_string(),
+            sha3_uncles: hex(H256::zero()),
+            logs_bloom: "0x".to_string(),
+            transactions_root: hex(block.transactions_hash_with(algorithm)),
+            state_root: hex(H256::zero()),
+            receipts_root: hex(H256::zero()),
+            receipts_chain_root: None,
+            miner: "0x0000000000000000000000000000000000000000".to_string(),
+            difficulty: "0x0".to_string(),
+            total_difficulty: "0x0".to_string(),
+            extra_data: "0x".to_string(),
+            size: "0x0".to_string(),
+            gas_limit: "0x0".to_string(),
+            gas_used: "0x0".to_string(),
+            timestamp: format_u64(block.timestamp),
+            transactions: TransactionsResponse::Full(
+                block.transactions.iter().map(tx_response).collect(),
+            ),
+            uncles: Vec::new(),
+        }
+    }
+
+    fn receipt(block: &Block, index: usize, status: &str) -> ReceiptResponse {
+        let tx_hash = format_h256(&block.transactions[index].hash());
+        let block_hash = format_h256(&block.hash());
+        ReceiptResponse {
+            transaction_hash: tx_hash.clone(),
+            transaction_index: format_u64(index as u64),
+            block_hash: block_hash.clone(),
+            block_number: format_u64(block.height),
+            from: "0x0000000000000000000000000000000000000000".to_string(),
+            to: None,
+            cumulative_gas_used: "0x0".to_string(),
+            gas_used: "0x5208".to_string(),
+            contract_address: None,
+            logs: vec![LogResponse {
+                removed: false,
+                log_index: "0x0".to_string(),
+                transaction_index: format_u64(index as u64),
+                transaction_hash: tx_hash,
+                block_hash,
+                block_number: format_u64(block.height),
+                address: "0x0000000000000000000000000000000000000042".to_string(),
+                data: "0x01".to_string(),
+                topics: vec![format_h256(&H256::from([7u8; 32]))],
+            }],
+            logs_bloom: "0x".to_string(),
+            tx_type: "0x0".to_string(),
+            status: status.to_string(),
+        }
+    }
+
+    /// Each block's receipts root and receipts chain root, as committed
+    fn roots(blocks: &[Block]) -> Vec<(H256, H256)> {
+        let mut chain_root = H256::zero();
+        blocks
+            .iter()
+            .map(|block| {
+                let outcomes: Vec<TransactionReceipt> = (0..block.transactions.len())
+                    .map(|i| receipt_outcome(&receipt(block, i, "0x1")).unwrap())
+                    .collect();
+                let root = receipts_root(&outcomes);
+                chain_root = chain_receipts_root(chain_root, root);
+                (root, chain_root)
+            })
+            .collect()
+    }
+
+    fn checkpoint(blocks: &[Block], height: usize, key: &PrivateKey) -> CheckpointResponse {
+        let checkpoint = Checkpoint::new(height as u64, blocks[height].hash(), H256::zero())
+            .with_receipts_root(roots(blocks)[height].1);
+        let mut signed = SignedCheckpoint::new(checkpoint);
+        signed.signatures.push(checkpoint.sign(key));
+        CheckpointResponse::from(&signed)
+    }
+
+    /// Serves JSON-RPC requests from a fixed chain until the test ends,
+    /// answering receipts from `receipts` first.
+    async fn serve(
+        blocks: Vec<Block>,
+        checkpoint: CheckpointResponse,
+        receipts: Vec<ReceiptResponse>,
+    ) -> String {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let roots = roots(&blocks);
+        let blocks = Arc::new(blocks);
+        tokio::spawn(async move {
+            loop {
+                let (mut stream, _) = listener.accept().await.unwrap();
+                let mut buf = vec![0u8; 64 * 1024];
+                let n = stream.read(&mut buf).await.unwrap();
+                let request = String::from_utf8_lossy(&buf[..n]);
+                let body = request.split_once("\r\n\r\n").unwrap().1;
+                let request: serde_json::Value = serde_json::from_str(body).unwrap();
+                let result = match request["method"].as_str().unwrap() {
+                    "bach_getCheckpoint" => serde_json::to_value(&checkpoint).unwrap(),
+                    "eth_getTransactionReceipt" => {
+                        let hash = request["params"][0].as_str().unwrap();
+                        let committed = blocks.iter().find_map(|block| {
+                            let index = block
+                                .transactions
+                                .iter()
+                                .position(|tx| format_h256(&tx.hash()) == hash)?;
+                            Some(receipt(block, index, "0x1"))
+                        });
+                        let served = receipts
+                            .iter()
+                            .find(|r| r.transaction_hash == hash)
+                            .cloned()
+                            .or(committed);
+                        serde_json::to_value(&served).unwrap()
+                    }
+                    "bach_getBlocksByHeights" => request["params"][0]
+                        .as_array()
+                        .unwrap()
+                        .iter()
+                        .map(|h| {
+                            let height = parse_u64(h.as_str().unwrap()).unwrap() as usize;
+                            let mut block = response(&blocks[height]);
+                            block.receipts_root = format_h256(&roots[height].0);
+                            block.receipts_chain_root = Some(format_h256(&roots[height].1));
+                            serde_json::json!({ "result": block })
+                        })
+                        .collect(),
+                    method => panic!("unexpected {}", method),
+                };
+                let reply = serde_json::json!({ "jsonrpc": "2.0", "id": 1, "result": result });
+                let reply = reply.to_string();
+                let response = format!(
+                    "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\
+                     Content-Length: {}\r\n\r\n{}",
+                    reply.len(),
+                    reply
+                );
+                stream.write_all(response.as_bytes()).await.unwrap();
+            }
+        });
+        addr
+    }
+
+    fn validators(key: &PrivateKey) -> ValidatorSet {
+        ValidatorSet::new(vec![Validator::new(key.public_key(), 1)])
+    }
+
+    #[test]
+    fn test_verify_block_response() {
+        let blocks = chain(3);
+        let keccak = HashSchedule::default();
+        let verified = verify_block_response(&response(&blocks[2]), &keccak).unwrap();
+        assert_eq!(verified.hash, blocks[2].hash());
+        assert_eq!(
+            verified.transactions,
+            vec![blocks[2].transactions[0].hash()]
+        );
+        assert!(verify_links(&[verified.clone()], 2, blocks[2].hash()).is_ok());
+        assert!(verify_links(&[verified], 2, blocks[1].hash()).is_err());
+
+        let mut forged = response(&blocks[2]);
+        forged.timestamp = "0x1".to_string();
+        assert!(matches!(
+            verify_block_response(&forged, &keccak),
+            Err(NodeError::VerificationFailed(_))
+        ));
+        let mut forged = response(&blocks[2]);
+        forged.transactions = TransactionsResponse::Hashes(Vec::new());
+        assert!(verify_block_response(&forged, &keccak).is_err());
+
+        // A transaction whose fields don't match its id
+        let mut forged = response(&blocks[2]);
+        if let TransactionsResponse::Full(txs) = &mut forged.transactions {
+            txs[0].input = "0x02".to_string();
+        }
+        assert!(verify_block_response(&forged, &keccak).is_err());
+
+        // Ids alone still verify under Keccak-256
+        let mut ids = response(&blocks[2]);
+        ids.transactions =
+            TransactionsResponse::Hashes(vec![format_h256(&blocks[2].transactions[0].hash())]);
+        assert!(verify_block_response(&ids, &keccak).is_ok());
+    }
+
+    #[test]
+    fn test_verify_block_response_with_schedule() {
+        let blocks = chain(3);
+        let schedule = HashSchedule::default().with_migration(2, HashAlgorithm::Sha256);
+        let response = response_with(&blocks[2], &schedule);
+        let verified = verify_block_response(&response, &schedule).unwrap();
+        assert_eq!(verified.hash, blocks[2].digests(&schedule).hash);
+        assert_eq!(verified.transactions, vec![blocks[2].transactions[0].hash()]);
+
+        // A client hashing with Keccak-256 rejects the migrated block
+        assert!(verify_block_response(&response, &HashSchedule::default()).is_err());
+
+        // Ids alone can't give a SHA-256 root
+        let mut ids = response.clone();
+        ids.transactions =
+            TransactionsResponse::Hashes(vec![format_h256(&blocks[2].transactions[0].hash())]);
+        assert!(verify_block_response(&ids, &schedule).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_client_verifies_against_checkpoint() {
+        let key = PrivateKey::from_bytes(&[0x21; 32]).unwrap();
+        let blocks = chain(5);
+        let addr = serve(blocks.clone(), checkpoint(&blocks, 3, &key), Vec::new()).await;
+        let client = VerifyingClient::new(&format!("http://{}", addr), validators(&key));
+
+        let block = client.block(1).await.unwrap();
+        assert_eq!(block.hash, blocks[1].hash());
+        assert_eq!(client.anchors.lock().unwrap().len(), 3);
+        let tx_hash = blocks[2].transactions[0].hash();
+        let verified = client.receipt(tx_hash).await.unwrap().unwrap();
+        assert_eq!(verified.block.height, 2);
+        assert!(client.anchors.lock().unwrap()[&2].receipts.is_some());
+
+        // Not final yet
+        assert!(client.block(4).await.is_err());
+
+        // A receipt pointing at the wrong index
+        let mut wrong_index = receipt(&blocks[2], 0, "0x1");
+        wrong_index.transaction_index = "0x1".to_string();
+        let addr = serve(blocks.clone(), checkpoint(&blocks, 3, &key), vec![wrong_index]).await;
+        let client = VerifyingClient::new(&addr, validators(&key));
+        assert!(matches!(
+            client.receipt(tx_hash).await,
+            Err(NodeError::VerificationFailed(_))
+        ));
+
+        // A receipt reporting another outcome than the chain committed
+        let mut forged_log = receipt(&blocks[2], 0, "0x1");
+        forged_log.logs[0].data = "0x02".to_string();
+        for forged in [receipt(&blocks[2], 0, "0x0"), forged_log] {
+            let addr = serve(blocks.clone(), checkpoint(&blocks, 3, &key), vec![forged]).await;
+            let client = VerifyingClient::new(&addr, validators(&key));
+            assert!(matches!(
+                client.receipt(tx_hash).await,
+                Err(NodeError::VerificationFailed(_))
+            ));
+        }
+
+        // A checkpoint signed by a key outside the trust roots
+        let other = PrivateKey::from_bytes(&[0x22; 32]).unwrap();
+        let addr = serve(blocks.clone(), checkpoint(&blocks, 3, &other), Vec::new()).await;
+        let client = VerifyingClient::new(&addr, validators(&key));
+        assert!(client.checkpoint().await.is_err());
+        assert!(client.block(1).await.is_err());
+
+        // A node serving a forked block that still hashes correctly
+        let mut forked = blocks.clone();
+        forked[2] = Block::new(2, blocks[1].hash(), Vec::new(), 2000);
+        let addr = serve(forked, checkpoint(&blocks, 3, &key), Vec::new()).await;
+        let client = VerifyingClient::new(&addr, validators(&key));
+        assert!(client.block(2).await.is_err());
+    }
+}
@@ -0,0 +1,174 @@
+//! Startup cache warm-up
+//!
+//! A restarted node starts with empty caches, so verifying its first
+//! blocks decodes every recent block from the database again and analyzes
+//! every contract they run from scratch. Before the node reports ready it
+//! loads the last blocks into the storage block cache and analyzes the
+//! bytecode the contracts those blocks called most have persisted in the
+//! state database into the EVM code cache. The chain config history is read into memory by `init`, so it is
+//! warm before this runs.
+//!
+//! Blocks are loaded in chunks. After each chunk the node's health records
+//! the blocks left, which keeps `/ready` at 503 and is exported as the
+//! `bach_node_warmup_remaining_blocks` gauge, and the progress is logged.
+
+use bach_evm::CodeCache;
+use bach_network::NodeHealth;
+use bach_primitives::Address;
+use bach_storage::Storage;
+use std::collections::HashMap;
+use std::ops::Range;
+
+/// Recent blocks loaded into the block cache on startup by default
+pub const DEFAULT_WARMUP_BLOCKS: u64 = 64;
+
+/// Blocks loaded between progress updates
+const WARMUP_CHUNK: u64 = 16;
+
+/// What the startup warm-up loaded
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct WarmupReport {
+    /// Blocks read from the database into the block cache
+    pub blocks: usize,
+    /// Contracts whose bytecode was analyzed into the code cache
+    pub contracts: usize,
+}
+
+/// Returns the heights of the last `blocks` blocks up to `head`, at most
+/// as many as the block cache of `storage` holds.
+pub fn warmup_heights(storage: &Storage, head: u64, blocks: u64) -> Range<u64> {
+    let blocks = blocks.min(storage.blocks.cache_metrics().capacity);
+    let end = head.saturating_add(1);
+    end.saturating_sub(blocks)..end
+}
+
+/// Loads the blocks at `heights` into the block cache, recording the
+/// blocks left in `health` as it goes. Returns the number of blocks read
+/// from the database.
+pub fn warm_blocks(storage: &Storage, heights: Range<u64>, health: &NodeHealth) -> usize {
+    let total = heights.end - heights.start;
+    let mut loaded = 0;
+    let mut from = heights.start;
+    health.set_warmup_remaining(total);
+    while from < heights.end {
+        let count = WARMUP_CHUNK.min(heights.end - from);
+        loaded += storage.blocks.prefetch(from, count);
+        from += count;
+        health.set_warmup_remaining(heights.end - from);
+        tracing::info!(
+            warmed = total - (heights.end - from),
+            total,
+            "Warming block cache"
+        );
+    }
+    loaded
+}
+
+/// Returns the contracts the blocks at `heights` called, most called
+/// first, at most `limit` of them.
+pub fn hot_contracts(storage: &Storage, heights: Range<u64>, limit: usize) -> Vec<Address> {
+    let mut calls: HashMap<Address, u64> = HashMap::new();
+    for height in heights {
+        let Some(block) = storage.blocks.get_block_by_height(height) else {
+            continue;
+        };
+        for to in block.transactions.iter().filter_map(|tx| tx.to) {
+            *calls.entry(to).or_insert(0) += 1;
+        }
+    }
+    let mut contracts: Vec<(Address, u64)> = calls.into_iter().collect();
+    contracts.sort_by(|a, b| b.1.cmp(&a.1).then(a.0.cmp(&b.0)));
+    contracts
+        .into_iter()
+        .map(|(address, _)| address)
+        .take(limit)
+        .collect()
+}
+
+/// Analyzes the bytecode `storage` holds for `contracts` into `cache`,
+/// skipping accounts without code. Returns the number of contracts
+/// analyzed.
+pub fn warm_code(storage: &Storage, cache: &CodeCache, contracts: &[Address]) -> usize {
+    let mut analyzed = 0;
+    for contract in contracts {
+        let Some(code_hash) = storage
+            .state
+            .get_account(contract)
+            .map(|account| account.code_hash_h256())
+        else {
+            continue;
+        };
+        let code = storage.state.get_code(&code_hash).unwrap_or_default();
+        if !code.is_empty() {
+            cache.get_or_analyze(code_hash, &code);
+            analyzed += 1;
+        }
+    }
+    analyzed
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_crypto::PrivateKey;
+    use bach_network::SyncProgress;
+    use bach_primitives::{H256, U256};
+    use bach_types::{Block, Transaction};
+    use std::sync::Arc;
+    use tempfile::TempDir;
+
+    fn call(key: &PrivateKey, nonce: u64, to: Address) -> Transaction {
+        let mut tx = Transaction::new(
+            nonce,
+            Some(to),
+            U256::ZERO,
+            Vec::new(),
+            key.sign(&H256::zero()),
+        );
+        tx.signature = key.sign(&tx.signing_hash()).into();
+        tx
+    }
+
+    #[test]
+    fn test_warm_blocks_and_code() {
+        let (hot, cold) = (Address::from([1; 20]), Address::from([2; 20]));
+        let key = PrivateKey::random();
+        let temp_dir = TempDir::new().unwrap();
+        {
+            let storage = Storage::open(temp_dir.path()).unwrap();
+            let mut parent = H256::zero();
+            for height in 0..40 {
+                let mut transactions = vec![call(&key, height * 2, hot)];
+                if height == 39 {
+                    transactions.push(call(&key, height * 2 + 1, cold));
+                }
+                let block = Block::new(height, parent, transactions, 1000 + height);
+                parent = block.hash();
+                storage.blocks.put_block(&block).unwrap();
+            }
+            storage.state.set_account_code(&hot, &[0x5b, 0x00]).unwrap();
+            storage.flush().unwrap();
+        }
+
+        // Reopened storage starts with a cold cache
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let health = NodeHealth::new(Arc::new(SyncProgress::new()));
+        let heights = warmup_heights(&storage, 39, 20);
+        assert_eq!(heights, 20..40);
+        assert_eq!(warm_blocks(&storage, heights.clone(), &health), 20);
+        assert_eq!(health.warmup_remaining(), 0);
+        assert!(storage.blocks.get_block_by_height(20).is_some());
+        assert_eq!(storage.blocks.cache_metrics().misses, 0);
+
+        let contracts = hot_contracts(&storage, heights, 10);
+        assert_eq!(contracts, vec![hot, cold]);
+
+        // Code is read from the state database, not an in-memory EVM state
+        let cache = CodeCache::new(8);
+        assert_eq!(warm_code(&storage, &cache, &contracts), 1);
+        assert_eq!(cache.stats().entries, 1);
+
+        // Short chains are warmed from genesis
+        assert_eq!(warmup_heights(&storage, 3, 20), 0..4);
+    }
+}
@@ -0,0 +1,308 @@
+//! Time source abstraction
+//!
+//! Components that read the time or wait for a timeout take a `Clock`
+//! instead of calling `Instant::now()` or `tokio::time::sleep` directly.
+//! Production code uses `SystemClock`; tests use `FakeClock` and move time
+//! forward explicitly, so timeout paths run instantly and deterministically.
+//!
+//! Neither depends on an async runtime: `SystemClock` sleeps are woken by
+//! one shared timer thread, so the clock works under any executor.
+
+use std::collections::{BTreeMap, HashMap};
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::{Arc, Condvar, Mutex, Once, OnceLock};
+use std::task::{Context, Poll, Waker};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+/// Future returned by `Clock::sleep`
+pub type Sleep = Pin<Box<dyn Future<Output = ()> + Send + 'static>>;
+
+/// Source of the current time and of timers.
+pub trait Clock: Send + Sync + std::fmt::Debug {
+    /// Returns the current monotonic time.
+    fn now(&self) -> Instant;
+
+    /// Returns the current wall-clock time.
+    fn system_time(&self) -> SystemTime;
+
+    /// Returns a future that completes once `duration` has passed on this clock.
+    fn sleep(&self, duration: Duration) -> Sleep;
+
+    /// Returns the wall-clock time in whole seconds since the Unix epoch.
+    fn unix_timestamp(&self) -> u64 {
+        self.system_time()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0)
+    }
+}
+
+/// Returns the shared system clock.
+pub fn system_clock() -> Arc<dyn Clock> {
+    Arc::new(SystemClock)
+}
+
+/// Runs `future` until it completes or `duration` passes on `clock`.
+///
+/// Returns None on timeout.
+pub async fn timeout<F: Future>(
+    clock: &dyn Clock,
+    duration: Duration,
+    future: F,
+) -> Option<F::Output> {
+    let mut future = std::pin::pin!(future);
+    let mut sleep = clock.sleep(duration);
+    std::future::poll_fn(|cx| {
+        if let Poll::Ready(output) = future.as_mut().poll(cx) {
+            return Poll::Ready(Some(output));
+        }
+        sleep.as_mut().poll(cx).map(|()| None)
+    })
+    .await
+}
+
+/// The operating system clock; sleeps on a shared timer thread.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    fn now(&self) -> Instant {
+        Instant::now()
+    }
+
+    fn system_time(&self) -> SystemTime {
+        SystemTime::now()
+    }
+
+    fn sleep(&self, duration: Duration) -> Sleep {
+        let timer = Timer::shared();
+        let mut state = timer.state.lock().unwrap();
+        let id = state.next_sleep_id;
+        state.next_sleep_id += 1;
+        Box::pin(SystemSleep {
+            timer,
+            id,
+            // Too far to ever arrive
+            deadline: Instant::now().checked_add(duration),
+        })
+    }
+}
+
+/// Thread waking `SystemClock` sleeps once their deadline passes
+#[derive(Debug, Default)]
+struct Timer {
+    state: Mutex<TimerState>,
+    /// Notified when a sleep is registered
+    registered: Condvar,
+}
+
+#[derive(Debug, Default)]
+struct TimerState {
+    next_sleep_id: u64,
+    /// Pending sleeps by deadline and id
+    sleepers: BTreeMap<(Instant, u64), Waker>,
+}
+
+impl Timer {
+    /// Returns the process-wide timer, starting its thread on first use.
+    fn shared() -> &'static Timer {
+        static TIMER: OnceLock<Timer> = OnceLock::new();
+        static START: Once = Once::new();
+        let timer = TIMER.get_or_init(Timer::default);
+        START.call_once(|| {
+            std::thread::Builder::new()
+                .name("clock-timer".to_string())
+                .spawn(move || timer.run())
+                .expect("failed to spawn the clock timer thread");
+        });
+        timer
+    }
+
+    fn run(&self) {
+        let mut state = self.state.lock().unwrap();
+        loop {
+            let now = Instant::now();
+            let pending = state.sleepers.split_off(&(now, u64::MAX));
+            let due = std::mem::replace(&mut state.sleepers, pending);
+            if !due.is_empty() {
+                // Wake without the lock, as woken tasks may sleep again
+                drop(state);
+                due.into_values().for_each(Waker::wake);
+                state = self.state.lock().unwrap();
+                continue;
+            }
+            state = match state.sleepers.keys().next() {
+                Some(&(deadline, _)) => {
+                    self.registered.wait_timeout(state, deadline - now).unwrap().0
+                }
+                None => self.registered.wait(state).unwrap(),
+            };
+        }
+    }
+}
+
+/// Sleep on the `SystemClock`
+struct SystemSleep {
+    timer: &'static Timer,
+    id: u64,
+    deadline: Option<Instant>,
+}
+
+impl Future for SystemSleep {
+    type Output = ();
+
+    fn poll(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<()> {
+        let Some(deadline) = self.deadline else {
+            return Poll::Pending;
+        };
+        let mut state = self.timer.state.lock().unwrap();
+        if Instant::now() >= deadline {
+            state.sleepers.remove(&(deadline, self.id));
+            return Poll::Ready(());
+        }
+        state.sleepers.insert((deadline, self.id), cx.waker().clone());
+        self.timer.registered.notify_one();
+        Poll::Pending
+    }
+}
+
+impl Drop for SystemSleep {
+    fn drop(&mut self) {
+        if let (Some(deadline), Ok(mut state)) = (self.deadline, self.timer.state.lock()) {
+            state.sleepers.remove(&(deadline, self.id));
+        }
+    }
+}
+
+/// A clock that only moves when `advance` is called.
+///
+/// Clones share the same time. Sleeps complete when the clock is advanced
+/// past their deadline.
+#[derive(Debug, Clone)]
+pub struct FakeClock {
+    inner: Arc<FakeClockInner>,
+}
+
+#[derive(Debug)]
+struct FakeClockInner {
+    /// Monotonic time at elapsed zero
+    base: Instant,
+    /// Wall-clock time at elapsed zero
+    system_base: SystemTime,
+    state: Mutex<FakeClockState>,
+}
+
+#[derive(Debug, Default)]
+struct FakeClockState {
+    elapsed: Duration,
+    next_sleep_id: u64,
+    /// Pending sleeps by id, with their deadline
+    sleepers: HashMap<u64, (Duration, Waker)>,
+}
+
+impl FakeClock {
+    /// Creates a clock whose wall-clock time starts at the Unix epoch.
+    pub fn new() -> Self {
+        Self::at(UNIX_EPOCH)
+    }
+
+    /// Creates a clock whose wall-clock time starts at `system_time`.
+    pub fn at(system_time: SystemTime) -> Self {
+        Self {
+            inner: Arc::new(FakeClockInner {
+                base: Instant::now(),
+                system_base: system_time,
+                state: Mutex::new(FakeClockState::default()),
+            }),
+        }
+    }
+
+    /// Moves time forward and wakes the sleeps that are now due.
+    pub fn advance(&self, duration: Duration) {
+        let due: Vec<Waker> = {
+            let mut state = self.inner.state.lock().unwrap();
+            state.elapsed += duration;
+            let elapsed = state.elapsed;
+            let ids: Vec<u64> = state
+                .sleepers
+                .iter()
+                .filter(|(_, (deadline, _))| *deadline <= elapsed)
+                .map(|(id, _)| *id)
+                .collect();
+            ids.iter()
+                .filter_map(|id| state.sleepers.remove(id))
+                .map(|(_, waker)| waker)
+                .collect()
+        };
+        due.into_iter().for_each(Waker::wake);
+    }
+
+    /// Returns the time advanced since the clock was created.
+    pub fn elapsed(&self) -> Duration {
+        self.inner.state.lock().unwrap().elapsed
+    }
+
+    /// Returns the number of sleeps waiting for the clock to advance.
+    pub fn pending_sleeps(&self) -> usize {
+        self.inner.state.lock().unwrap().sleepers.len()
+    }
+}
+
+impl Default for FakeClock {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl Clock for FakeClock {
+    fn now(&self) -> Instant {
+        self.inner.base + self.elapsed()
+    }
+
+    fn system_time(&self) -> SystemTime {
+        self.inner.system_base + self.elapsed()
+    }
+
+    fn sleep(&self, duration: Duration) -> Sleep {
+        let mut state = self.inner.state.lock().unwrap();
+        let id = state.next_sleep_id;
+        state.next_sleep_id += 1;
+        Box::pin(FakeSleep {
+            inner: Arc::clone(&self.inner),
+            id,
+            deadline: state.elapsed + duration,
+        })
+    }
+}
+
+/// Sleep on a `FakeClock`
+struct FakeSleep {
+    inner: Arc<FakeClockInner>,
+    id: u64,
+    deadline: Duration,
+}
+
+impl Future for FakeSleep {
+    type Output = ();
+
+    fn poll(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<()> {
+        let mut state = self.inner.state.lock().unwrap();
+        if state.elapsed >= self.deadline {
+            state.sleepers.remove(&self.id);
+            return Poll::Ready(());
+        }
+        state
+            .sleepers
+            .insert(self.id, (self.deadline, cx.waker().clone()));
+        Poll::Pending
+    }
+}
+
+impl Drop for FakeSleep {
+    fn drop(&mut self) {
+        if let Ok(mut state) = self.inner.state.lock() {
+            state.sleepers.remove(&self.id);
+        }
+    }
+}
@@ -0,0 +1,147 @@
+//! Error code catalog
+//!
+//! Every crate's error type maps its variants onto one `ErrorCode`, so
+//! callers branch on the code instead of matching error messages, and the
+//! RPC boundary reports the same failure with the same code wherever it
+//! originated. Codes and their names are stable: add new ones, never
+//! renumber or rename existing ones.
+
+use std::fmt;
+
+/// Stable, machine-readable error codes.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord)]
+pub enum ErrorCode {
+    /// Unclassified failure
+    Internal = 1,
+    /// Invalid input from the caller
+    InvalidArgument = 2,
+    /// A requested resource does not exist
+    NotFound = 3,
+    /// The caller lacks the required permission
+    PermissionDenied = 4,
+    /// The component is not running or not ready
+    Unavailable = 5,
+    /// Rejected by chain rules or configuration
+    Rejected = 6,
+    /// Persistent storage failed
+    Storage = 7,
+    /// Invalid local configuration
+    Config = 8,
+    /// Peer-to-peer networking failed
+    Network = 9,
+
+    /// The block preceding the one being processed is not available
+    PreBlockMissing = 100,
+    /// Executing a block diverged from its verified read/write sets
+    RwSetMismatch = 101,
+    /// Too few validator signatures were collected to commit a block
+    SigQuorumNotReached = 102,
+    /// A transaction in a block carries an unrecoverable signature
+    InvalidTxSignature = 103,
+    /// A proposed block failed validation
+    InvalidProposal = 104,
+    /// A consensus message is malformed, misdirected or mis-signed
+    InvalidConsensusMessage = 105,
+    /// A validator signed two conflicting messages
+    Equivocation = 106,
+    /// Executing a block's transactions failed
+    ExecutionFailed = 107,
+    /// A block repeats a transaction already in it or already committed
+    DuplicateTx = 108,
+    /// A proposed block's timestamp precedes its parent's or is too far
+    /// from the local clock
+    InvalidBlockTimestamp = 109,
+    /// A node's response doesn't match the client's trust roots
+    ResponseUnverified = 110,
+}
+
+impl ErrorCode {
+    /// All codes in ascending order.
+    pub const ALL: &'static [ErrorCode] = &[
+        ErrorCode::Internal,
+        ErrorCode::InvalidArgument,
+        ErrorCode::NotFound,
+        ErrorCode::PermissionDenied,
+        ErrorCode::Unavailable,
+        ErrorCode::Rejected,
+        ErrorCode::Storage,
+        ErrorCode::Config,
+        ErrorCode::Network,
+        ErrorCode::PreBlockMissing,
+        ErrorCode::RwSetMismatch,
+        ErrorCode::SigQuorumNotReached,
+        ErrorCode::InvalidTxSignature,
+        ErrorCode::InvalidProposal,
+        ErrorCode::InvalidConsensusMessage,
+        ErrorCode::Equivocation,
+        ErrorCode::ExecutionFailed,
+        ErrorCode::DuplicateTx,
+        ErrorCode::InvalidBlockTimestamp,
+        ErrorCode::ResponseUnverified,
+    ];
+
+    /// Returns the numeric code.
+    pub fn as_u16(&self) -> u16 {
+        *self as u16
+    }
+
+    /// Returns the stable name, e.g. `PRE_BLOCK_MISSING`.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            ErrorCode::Internal => "INTERNAL",
+            ErrorCode::InvalidArgument => "INVALID_ARGUMENT",
+            ErrorCode::NotFound => "NOT_FOUND",
+            ErrorCode::PermissionDenied => "PERMISSION_DENIED",
+            ErrorCode::Unavailable => "UNAVAILABLE",
+            ErrorCode::Rejected => "REJECTED",
+            ErrorCode::Storage => "STORAGE",
+            ErrorCode::Config => "CONFIG",
+            ErrorCode::Network => "NETWORK",
+            ErrorCode::PreBlockMissing => "PRE_BLOCK_MISSING",
+            ErrorCode::RwSetMismatch => "RWSET_MISMATCH",
+            ErrorCode::SigQuorumNotReached => "SIG_QUORUM_NOT_REACHED",
+            ErrorCode::InvalidTxSignature => "INVALID_TX_SIGNATURE",
+            ErrorCode::InvalidProposal => "INVALID_PROPOSAL",
+            ErrorCode::InvalidConsensusMessage => "INVALID_CONSENSUS_MESSAGE",
+            ErrorCode::Equivocation => "EQUIVOCATION",
+            ErrorCode::ExecutionFailed => "EXECUTION_FAILED",
+            ErrorCode::DuplicateTx => "DUPLICATE_TX",
+            ErrorCode::InvalidBlockTimestamp => "INVALID_BLOCK_TIMESTAMP",
+            ErrorCode::ResponseUnverified => "RESPONSE_UNVERIFIED",
+        }
+    }
+
+    /// Parses a stable name.
+    pub fn from_name(name: &str) -> Option<Self> {
+        Self::ALL.iter().copied().find(|code| code.as_str() == name)
+    }
+}
+
+impl fmt::Display for ErrorCode {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// An error that maps onto the catalog.
+pub trait ErrorCoded {
+    /// Returns the catalog code for this error.
+    fn error_code(&self) -> ErrorCode;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_codes_are_unique_and_round_trip() {
+        for pair in ErrorCode::ALL.windows(2) {
+            assert!(pair[0].as_u16() < pair[1].as_u16());
+        }
+        for code in ErrorCode::ALL {
+            assert_eq!(ErrorCode::from_name(code.as_str()), Some(*code));
+        }
+        assert_eq!(ErrorCode::PreBlockMissing.to_string(), "PRE_BLOCK_MISSING");
+        assert_eq!(ErrorCode::from_name("no such transaction"), None);
+    }
+}
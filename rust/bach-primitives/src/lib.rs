@@ -5,9 +5,23 @@
 //! - `H256`: 32-byte hash value
 //! - `H160`: Type alias for Address
 //! - `U256`: 256-bit unsigned integer
+//! - `Clock`: time source, replaceable with `FakeClock` in tests
+//! - `TokenBucket`: rate limiter shared by peer and RPC limits
+//! - `ErrorCode`: stable error code catalog shared by all crates
+//! - `SystemContract`: addresses of the native system contracts
 
 #![forbid(unsafe_code)]
 
+mod clock;
+mod error_code;
+mod rate;
+mod system;
+
+pub use clock::{system_clock, timeout, Clock, FakeClock, Sleep, SystemClock};
+pub use error_code::{ErrorCode, ErrorCoded};
+pub use rate::TokenBucket;
+pub use system::SystemContract;
+
 /// Length of an Ethereum-style address in bytes
 pub const ADDRESS_LENGTH: usize = 20;
 
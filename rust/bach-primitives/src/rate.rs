@@ -0,0 +1,71 @@
+//! Token bucket rate limiting
+//!
+//! Shared by the peer message limiter and the RPC interceptor. The bucket
+//! never reads the time itself; callers pass `Clock::now()` so limits can be
+//! tested with `FakeClock`.
+
+use std::time::Instant;
+
+/// Token bucket refilled continuously at a fixed rate.
+#[derive(Debug, Clone)]
+pub struct TokenBucket {
+    capacity: f64,
+    tokens: f64,
+    refill_per_sec: f64,
+    last_refill: Instant,
+}
+
+impl TokenBucket {
+    /// Creates a full bucket of `burst` tokens refilled at `refill_per_sec`.
+    pub fn new(refill_per_sec: f64, burst: u32, now: Instant) -> Self {
+        Self {
+            capacity: burst as f64,
+            tokens: burst as f64,
+            refill_per_sec,
+            last_refill: now,
+        }
+    }
+
+    /// Takes one token if one is available at `now`.
+    pub fn try_take(&mut self, now: Instant) -> bool {
+        self.tokens = self.tokens_at(now);
+        self.last_refill = now;
+
+        if self.tokens >= 1.0 {
+            self.tokens -= 1.0;
+            true
+        } else {
+            false
+        }
+    }
+
+    /// Returns true if the bucket has refilled completely by `now`.
+    pub fn is_full(&self, now: Instant) -> bool {
+        self.tokens_at(now) >= self.capacity
+    }
+
+    fn tokens_at(&self, now: Instant) -> f64 {
+        let elapsed = now.saturating_duration_since(self.last_refill).as_secs_f64();
+        (self.tokens + elapsed * self.refill_per_sec).min(self.capacity)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn test_burst_then_refill() {
+        let start = Instant::now();
+        let mut bucket = TokenBucket::new(2.0, 3, start);
+        assert!((0..3).all(|_| bucket.try_take(start)));
+        assert!(!bucket.try_take(start));
+        assert!(!bucket.is_full(start));
+
+        let later = start + Duration::from_millis(500);
+        assert!(bucket.try_take(later));
+        assert!(!bucket.try_take(later));
+        assert!(bucket.is_full(later + Duration::from_secs(2)));
+    }
+}
@@ -0,0 +1,113 @@
+//! Addresses of the native system contracts.
+//!
+//! Every system contract lives at `0x00…01NN`. This is the one place the
+//! low bytes are assigned; crates expose their contract's address through
+//! [`SystemContract::address`] so two contracts can't end up sharing one.
+
+use crate::{Address, ADDRESS_LENGTH};
+
+/// A native system contract.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord)]
+pub enum SystemContract {
+    /// Consensus evidence registry
+    EvidenceRegistry,
+    /// Large bytecode staging area
+    BytecodeStaging,
+    /// Multi-signature proposals
+    MultiSign,
+    /// Versioned chain config
+    ChainConfig,
+    /// Member key revocation lists
+    RevocationRegistry,
+    /// Member DID documents
+    DidRegistry,
+    /// Devnet faucet
+    Faucet,
+    /// Secondary index registry
+    IndexRegistry,
+    /// Contract debug log host call
+    ContractLog,
+    /// Org storage grants
+    OrgGrants,
+    /// Contract access control lists
+    ContractAcl,
+    /// Paged storage scan host call
+    StorageScan,
+    /// Address balance change logs are attributed to
+    AccountManager,
+    /// Per-block gas settlement system transactions
+    GasSettlement,
+}
+
+impl SystemContract {
+    /// Every system contract, in address order.
+    pub const ALL: [SystemContract; 14] = [
+        Self::EvidenceRegistry,
+        Self::BytecodeStaging,
+        Self::MultiSign,
+        Self::ChainConfig,
+        Self::RevocationRegistry,
+        Self::DidRegistry,
+        Self::Faucet,
+        Self::IndexRegistry,
+        Self::ContractLog,
+        Self::OrgGrants,
+        Self::ContractAcl,
+        Self::StorageScan,
+        Self::AccountManager,
+        Self::GasSettlement,
+    ];
+
+    /// Returns the low byte of the contract's address.
+    pub const fn id(self) -> u8 {
+        match self {
+            Self::EvidenceRegistry => 0x01,
+            Self::BytecodeStaging => 0x02,
+            Self::MultiSign => 0x03,
+            Self::ChainConfig => 0x04,
+            Self::RevocationRegistry => 0x05,
+            Self::DidRegistry => 0x06,
+            Self::Faucet => 0x07,
+            Self::IndexRegistry => 0x08,
+            Self::ContractLog => 0x09,
+            Self::OrgGrants => 0x0A,
+            Self::ContractAcl => 0x0B,
+            Self::StorageScan => 0x0C,
+            Self::AccountManager => 0x0D,
+            Self::GasSettlement => 0x0E,
+        }
+    }
+
+    /// Returns the contract's address (0x…01NN).
+    pub fn address(self) -> Address {
+        let mut bytes = [0u8; ADDRESS_LENGTH];
+        bytes[18] = 0x01;
+        bytes[19] = self.id();
+        Address::from(bytes)
+    }
+
+    /// Returns the system contract at `address`, if any.
+    pub fn at(address: &Address) -> Option<Self> {
+        Self::ALL.into_iter().find(|c| c.address() == *address)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashSet;
+
+    #[test]
+    fn test_addresses_are_unique() {
+        let addresses: HashSet<Address> = SystemContract::ALL.iter().map(|c| c.address()).collect();
+        assert_eq!(addresses.len(), SystemContract::ALL.len());
+        for contract in SystemContract::ALL {
+            assert_eq!(SystemContract::at(&contract.address()), Some(contract));
+        }
+        assert_eq!(SystemContract::at(&Address::zero()), None);
+        assert_eq!(
+            SystemContract::ChainConfig.address().to_string(),
+            "0x0000000000000000000000000000000000000104"
+        );
+    }
+}
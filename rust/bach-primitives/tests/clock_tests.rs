@@ -0,0 +1,74 @@
+//! Tests for the Clock abstraction
+
+use bach_primitives::{timeout, Clock, FakeClock, SystemClock};
+use std::time::{Duration, UNIX_EPOCH};
+
+#[test]
+fn fake_clock_moves_only_when_advanced() {
+    let clock = FakeClock::at(UNIX_EPOCH + Duration::from_secs(1_000));
+    let start = clock.now();
+    assert_eq!(clock.unix_timestamp(), 1_000);
+
+    clock.advance(Duration::from_millis(1_500));
+    assert_eq!(clock.now() - start, Duration::from_millis(1_500));
+    assert_eq!(clock.unix_timestamp(), 1_001);
+
+    // Clones share the same time
+    let clone = clock.clone();
+    clone.advance(Duration::from_secs(1));
+    assert_eq!(clock.elapsed(), Duration::from_millis(2_500));
+}
+
+#[tokio::test(flavor = "current_thread")]
+async fn fake_sleep_completes_after_advance() {
+    let clock = FakeClock::new();
+    let sleeper = clock.clone();
+    let task = tokio::spawn(async move { sleeper.sleep(Duration::from_secs(10)).await });
+
+    while clock.pending_sleeps() == 0 {
+        tokio::task::yield_now().await;
+    }
+    clock.advance(Duration::from_secs(9));
+    tokio::task::yield_now().await;
+    assert!(!task.is_finished());
+    assert_eq!(clock.pending_sleeps(), 1);
+
+    clock.advance(Duration::from_secs(1));
+    task.await.unwrap();
+    assert_eq!(clock.pending_sleeps(), 0);
+}
+
+#[tokio::test(flavor = "current_thread")]
+async fn timeout_on_fake_clock() {
+    let clock = FakeClock::new();
+
+    // Completes before the deadline
+    let ready = timeout(&clock, Duration::from_secs(1), async { 7 }).await;
+    assert_eq!(ready, Some(7));
+
+    // Times out once the clock passes the deadline, without real waiting
+    let waiter = clock.clone();
+    let task = tokio::spawn(async move {
+        timeout(&waiter, Duration::from_secs(30), std::future::pending::<()>()).await
+    });
+    while clock.pending_sleeps() == 0 {
+        tokio::task::yield_now().await;
+    }
+    clock.advance(Duration::from_secs(30));
+    assert_eq!(task.await.unwrap(), None);
+
+    // Dropped sleeps are forgotten
+    drop(clock.sleep(Duration::from_secs(1)));
+    assert_eq!(clock.pending_sleeps(), 0);
+}
+
+#[tokio::test(flavor = "current_thread")]
+async fn system_clock_sleeps() {
+    let clock = SystemClock;
+    let start = clock.now();
+    clock.sleep(Duration::from_millis(5)).await;
+    assert!(clock.now() - start >= Duration::from_millis(5));
+    assert!(timeout(&clock, Duration::from_millis(5), std::future::pending::<()>())
+        .await
+        .is_none());
+}
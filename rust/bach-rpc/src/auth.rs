@@ -0,0 +1,770 @@
+//! Token authentication for the RPC server
+//!
+//! Members sign a short-lived token with their account key and send it as
+//! `Authorization: Bearer <token>`. This authenticates requests even when
+//! TLS is terminated by a gateway in front of the node.
+//!
+//! Members may additionally hold an `AdminRole`, which decides which
+//! `admin_*` methods they can call. Keys on the node's revocation lists
+//! (`RevokedKeys`) are rejected even if they are still listed as members,
+//! and a `RevocationChecker` can additionally ask an online status responder.
+//!
+//! A member identified by a DID is listed through the keys its DID document
+//! resolves to; `dids` records which DID each such key acts for.
+//!
+//! A token names the chain and node it was issued for (`TokenAudience`)
+//! and is refused by any other, so a token captured by one node can't be
+//! replayed against another or on another chain.
+//!
+//! Tokens may be signed with secp256k1 or Ed25519 keys. Ed25519 tokens
+//! carry the signer's public key, and only the algorithms listed in
+//! `algorithms` (the chain config's `signature_algorithms`) are accepted.
+
+use bach_crypto::{
+    keccak256, keccak256_concat, KeyAlgorithm, MemberSignature, SigningMember,
+    ED25519_MEMBER_SIGNATURE_LENGTH, SIGNATURE_LENGTH,
+};
+use bach_network::RevocationChecker;
+use bach_primitives::{system_clock, Address, Clock, SystemClock, H256};
+use http::{header::AUTHORIZATION, HeaderMap, Request, Response, StatusCode};
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::future::Future;
+use std::pin::Pin;
+use std::str::FromStr;
+use std::sync::{Arc, RwLock};
+use std::task::{Context, Poll};
+use std::time::Duration;
+use thiserror::Error;
+use tower::{Layer, Service};
+
+/// Domain separator so auth tokens can't be confused with other signatures.
+const TOKEN_DOMAIN: &[u8] = b"bach-rpc-auth-v2";
+
+/// Encoded length of the token fields before the signature: subject (20) +
+/// chain_id (8) + audience (32) + issued_at (8) + expires_at (8).
+const TOKEN_FIELDS_LENGTH: usize = 20 + 8 + 32 + 8 + 8;
+
+/// Token validation errors
+#[derive(Debug, Error, PartialEq, Eq)]
+pub enum AuthError {
+    #[error("missing bearer token")]
+    MissingToken,
+
+    #[error("malformed token: {0}")]
+    Malformed(String),
+
+    #[error("token expired")]
+    Expired,
+
+    #[error("token issued in the future")]
+    NotYetValid,
+
+    #[error("token was issued for another chain or node")]
+    WrongAudience,
+
+    #[error("token lifetime exceeds {0}s")]
+    LifetimeTooLong(u64),
+
+    #[error("token signature does not match subject")]
+    BadSignature,
+
+    #[error("{0} is not a member")]
+    NotMember(String),
+
+    #[error("{0} has been revoked")]
+    Revoked(String),
+
+    #[error("{0} keys are not accepted")]
+    UnsupportedAlgorithm(KeyAlgorithm),
+}
+
+/// Node administration role, separate from on-chain governance.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum AdminRole {
+    /// Read-only access to node status, peers and metrics
+    Auditor,
+    /// Node operations: log level, peer bans
+    Operator,
+    /// Consensus network membership (static topology allowlist)
+    ConsensusAdmin,
+}
+
+/// What an admin method does, used to check it against the caller's role.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum AdminPermission {
+    /// Read node state
+    Read,
+    /// Change local node behavior
+    NodeOps,
+    /// Change consensus network membership
+    Consensus,
+}
+
+impl AdminRole {
+    /// Returns true if this role grants the permission.
+    pub fn allows(&self, permission: AdminPermission) -> bool {
+        match (self, permission) {
+            (_, AdminPermission::Read) => true,
+            (Self::Operator, AdminPermission::NodeOps) => true,
+            (Self::ConsensusAdmin, AdminPermission::Consensus) => true,
+            _ => false,
+        }
+    }
+}
+
+impl FromStr for AdminRole {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_ascii_lowercase().as_str() {
+            "auditor" => Ok(Self::Auditor),
+            "operator" => Ok(Self::Operator),
+            "consensus_admin" | "consensus-admin" => Ok(Self::ConsensusAdmin),
+            other => Err(format!("unknown admin role: {}", other)),
+        }
+    }
+}
+
+impl fmt::Display for AdminRole {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Auditor => f.write_str("auditor"),
+            Self::Operator => f.write_str("operator"),
+            Self::ConsensusAdmin => f.write_str("consensus_admin"),
+        }
+    }
+}
+
+/// Chain and node a token is issued for.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct TokenAudience {
+    /// Chain ID of the node
+    pub chain_id: u64,
+    /// Name of the node, by default its validator address
+    pub node: String,
+}
+
+impl TokenAudience {
+    /// Creates an audience for `node` on chain `chain_id`.
+    pub fn new(chain_id: u64, node: impl Into<String>) -> Self {
+        Self {
+            chain_id,
+            node: node.into(),
+        }
+    }
+
+    fn node_hash(&self) -> H256 {
+        keccak256(self.node.as_bytes())
+    }
+}
+
+/// A signed, short-lived RPC access token.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AuthToken {
+    /// Member the token was issued to
+    pub subject: Address,
+    /// Chain the token is valid on
+    pub chain_id: u64,
+    /// Hash of the name of the node the token is valid for
+    pub audience: H256,
+    /// Unix time (seconds) the token was issued
+    pub issued_at: u64,
+    /// Unix time (seconds) the token expires
+    pub expires_at: u64,
+    /// Subject's signature over the token fields
+    pub signature: MemberSignature,
+}
+
+impl AuthToken {
+    /// Issues a token for `audience` valid for `ttl`, signed by the
+    /// member's key.
+    pub fn issue(key: &impl SigningMember, audience: &TokenAudience, ttl: Duration) -> Self {
+        Self::issue_at(key, audience, SystemClock.unix_timestamp(), ttl)
+    }
+
+    fn issue_at(
+        key: &impl SigningMember,
+        audience: &TokenAudience,
+        issued_at: u64,
+        ttl: Duration,
+    ) -> Self {
+        let subject = key.address();
+        let node = audience.node_hash();
+        let expires_at = issued_at.saturating_add(ttl.as_secs());
+        let hash = Self::fields_hash(&subject, audience.chain_id, &node, issued_at, expires_at);
+        Self {
+            subject,
+            chain_id: audience.chain_id,
+            audience: node,
+            issued_at,
+            expires_at,
+            signature: key.sign_member(&hash),
+        }
+    }
+
+    fn signing_hash(&self) -> H256 {
+        Self::fields_hash(
+            &self.subject,
+            self.chain_id,
+            &self.audience,
+            self.issued_at,
+            self.expires_at,
+        )
+    }
+
+    fn fields_hash(
+        subject: &Address,
+        chain_id: u64,
+        audience: &H256,
+        issued_at: u64,
+        expires_at: u64,
+    ) -> H256 {
+        keccak256_concat(&[
+            TOKEN_DOMAIN,
+            subject.as_bytes(),
+            &chain_id.to_be_bytes(),
+            audience.as_bytes(),
+            &issued_at.to_be_bytes(),
+            &expires_at.to_be_bytes(),
+        ])
+    }
+
+    /// Encodes the token as a hex string.
+    pub fn encode(&self) -> String {
+        let mut bytes = Vec::with_capacity(TOKEN_FIELDS_LENGTH + ED25519_MEMBER_SIGNATURE_LENGTH);
+        bytes.extend_from_slice(self.subject.as_bytes());
+        bytes.extend_from_slice(&self.chain_id.to_be_bytes());
+        bytes.extend_from_slice(self.audience.as_bytes());
+        bytes.extend_from_slice(&self.issued_at.to_be_bytes());
+        bytes.extend_from_slice(&self.expires_at.to_be_bytes());
+        bytes.extend_from_slice(&self.signature.to_bytes());
+        format!("0x{}", hex::encode(bytes))
+    }
+
+    /// Decodes a token produced by `encode`.
+    pub fn decode(s: &str) -> Result<Self, AuthError> {
+        let s = s.strip_prefix("0x").unwrap_or(s);
+        let bytes = hex::decode(s).map_err(|e| AuthError::Malformed(e.to_string()))?;
+        let signature_length = bytes.len().saturating_sub(TOKEN_FIELDS_LENGTH);
+        if ![SIGNATURE_LENGTH, ED25519_MEMBER_SIGNATURE_LENGTH].contains(&signature_length) {
+            return Err(AuthError::Malformed(format!(
+                "expected {} or {} bytes, got {}",
+                TOKEN_FIELDS_LENGTH + SIGNATURE_LENGTH,
+                TOKEN_FIELDS_LENGTH + ED25519_MEMBER_SIGNATURE_LENGTH,
+                bytes.len()
+            )));
+        }
+
+        let subject = Address::from_slice(&bytes[..20])
+            .map_err(|e| AuthError::Malformed(format!("{:?}", e)))?;
+        let chain_id = u64::from_be_bytes(bytes[20..28].try_into().unwrap());
+        let audience = H256::from_slice(&bytes[28..60])
+            .map_err(|e| AuthError::Malformed(format!("{:?}", e)))?;
+        let issued_at = u64::from_be_bytes(bytes[60..68].try_into().unwrap());
+        let expires_at = u64::from_be_bytes(bytes[68..76].try_into().unwrap());
+        let signature = MemberSignature::from_bytes(&bytes[TOKEN_FIELDS_LENGTH..])
+            .map_err(|e| AuthError::Malformed(format!("{:?}", e)))?;
+
+        Ok(Self {
+            subject,
+            chain_id,
+            audience,
+            issued_at,
+            expires_at,
+            signature,
+        })
+    }
+}
+
+/// Token authentication settings
+#[derive(Debug, Clone)]
+pub struct TokenAuthConfig {
+    /// Accounts allowed to authenticate
+    pub members: Vec<Address>,
+    /// Longest lifetime a token may be issued with
+    pub max_ttl: Duration,
+    /// How far ahead of the node's clock a token's issue time may be, for
+    /// clients whose clocks run slightly fast
+    pub max_clock_skew: Duration,
+    /// Admin roles held by members; members without one can't call `admin_*`
+    pub roles: HashMap<Address, AdminRole>,
+    /// DID each member key was resolved from; raw key members have none
+    pub dids: HashMap<Address, String>,
+    /// Key algorithms tokens may be signed with
+    pub algorithms: Vec<KeyAlgorithm>,
+    /// Chain and node tokens must be issued for
+    pub audience: TokenAudience,
+}
+
+impl Default for TokenAuthConfig {
+    fn default() -> Self {
+        Self {
+            members: Vec::new(),
+            max_ttl: Duration::from_secs(3600),
+            max_clock_skew: Duration::from_secs(15),
+            roles: HashMap::new(),
+            dids: HashMap::new(),
+            algorithms: vec![KeyAlgorithm::Secp256k1],
+            audience: TokenAudience::default(),
+        }
+    }
+}
+
+/// Member keys revoked by the trusted issuers, shared with the node so a
+/// refreshed revocation list takes effect without restarting the server.
+#[derive(Debug, Clone, Default)]
+pub struct RevokedKeys(Arc<RwLock<HashSet<Address>>>);
+
+impl RevokedKeys {
+    /// Replaces the revoked set.
+    pub fn replace(&self, revoked: impl IntoIterator<Item = Address>) {
+        *self.0.write().unwrap() = revoked.into_iter().collect();
+    }
+
+    /// Returns true if the key has been revoked.
+    pub fn contains(&self, address: &Address) -> bool {
+        self.0.read().unwrap().contains(address)
+    }
+
+    /// Returns the number of revoked keys.
+    pub fn len(&self) -> usize {
+        self.0.read().unwrap().len()
+    }
+
+    /// Returns true if no keys are revoked.
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+}
+
+/// Member keys the node knows of, e.g. RPC members and keys in registered
+/// DID documents. The key status responder answers "unknown" for others.
+#[derive(Debug, Clone, Default)]
+pub struct KnownKeys(Arc<RwLock<HashSet<Address>>>);
+
+impl KnownKeys {
+    /// Replaces the known set.
+    pub fn replace(&self, known: impl IntoIterator<Item = Address>) {
+        *self.0.write().unwrap() = known.into_iter().collect();
+    }
+
+    /// Returns true if the key is known.
+    pub fn contains(&self, address: &Address) -> bool {
+        self.0.read().unwrap().contains(address)
+    }
+}
+
+/// Checks tokens against the member list.
+#[derive(Debug)]
+pub struct TokenValidator {
+    members: HashSet<Address>,
+    max_ttl: Duration,
+    max_clock_skew: Duration,
+    roles: HashMap<Address, AdminRole>,
+    dids: HashMap<Address, String>,
+    algorithms: HashSet<KeyAlgorithm>,
+    chain_id: u64,
+    audience: H256,
+    revoked: RevokedKeys,
+    clock: Arc<dyn Clock>,
+}
+
+impl TokenValidator {
+    /// Creates a validator from config.
+    pub fn new(config: &TokenAuthConfig) -> Self {
+        Self {
+            members: config.members.iter().copied().collect(),
+            max_ttl: config.max_ttl,
+            max_clock_skew: config.max_clock_skew,
+            roles: config.roles.clone(),
+            dids: config.dids.clone(),
+            algorithms: config.algorithms.iter().copied().collect(),
+            chain_id: config.audience.chain_id,
+            audience: config.audience.node_hash(),
+            revoked: RevokedKeys::default(),
+            clock: system_clock(),
+        }
+    }
+
+    /// Checks token lifetimes against `clock`.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Rejects tokens of members whose keys are in `revoked`.
+    pub fn with_revoked(mut self, revoked: RevokedKeys) -> Self {
+        self.revoked = revoked;
+        self
+    }
+
+    /// Validates an encoded token, returning the authenticated member.
+    pub fn validate(&self, token: &str) -> Result<Address, AuthError> {
+        self.validate_at(token, self.clock.unix_timestamp())
+    }
+
+    fn validate_at(&self, token: &str, now: u64) -> Result<Address, AuthError> {
+        let token = AuthToken::decode(token)?;
+
+        if token.expires_at <= now {
+            return Err(AuthError::Expired);
+        }
+        if token.issued_at > now.saturating_add(self.max_clock_skew.as_secs()) {
+            return Err(AuthError::NotYetValid);
+        }
+        if token.expires_at.saturating_sub(token.issued_at) > self.max_ttl.as_secs() {
+            return Err(AuthError::LifetimeTooLong(self.max_ttl.as_secs()));
+        }
+
+        let algorithm = token.signature.algorithm();
+        if !self.algorithms.contains(&algorithm) {
+            return Err(AuthError::UnsupportedAlgorithm(algorithm));
+        }
+        let signer = token
+            .signature
+            .signer(&token.signing_hash())
+            .map_err(|_| AuthError::BadSignature)?;
+        if signer != token.subject {
+            return Err(AuthError::BadSignature);
+        }
+        if token.chain_id != self.chain_id || token.audience != self.audience {
+            return Err(AuthError::WrongAudience);
+        }
+
+        if !self.members.contains(&token.subject) {
+            return Err(AuthError::NotMember(format!("0x{}", hex::encode(token.subject.as_bytes()))));
+        }
+        if self.revoked.contains(&token.subject) {
+            return Err(AuthError::Revoked(format!("0x{}", hex::encode(token.subject.as_bytes()))));
+        }
+
+        Ok(token.subject)
+    }
+
+    /// Validates the bearer token in request headers.
+    pub fn authorize(&self, headers: &HeaderMap) -> Result<AuthenticatedMember, AuthError> {
+        let value = headers
+            .get(AUTHORIZATION)
+            .and_then(|v| v.to_str().ok())
+            .ok_or(AuthError::MissingToken)?;
+        let token = value
+            .strip_prefix("Bearer ")
+            .ok_or(AuthError::MissingToken)?;
+        let address = self.validate(token.trim())?;
+        Ok(AuthenticatedMember {
+            address,
+            role: self.roles.get(&address).copied(),
+            did: self.dids.get(&address).cloned(),
+        })
+    }
+}
+
+/// Member authenticated for the current request, stored in request extensions.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AuthenticatedMember {
+    /// Member account
+    pub address: Address,
+    /// Admin role, if any
+    pub role: Option<AdminRole>,
+    /// DID the account acts for, if the member is identified by one
+    pub did: Option<String>,
+}
+
+/// HTTP middleware layer that rejects requests without a valid token.
+#[derive(Debug, Clone)]
+pub struct TokenAuthLayer {
+    validator: Arc<TokenValidator>,
+    revocation: Option<Arc<RevocationChecker>>,
+}
+
+impl TokenAuthLayer {
+    /// Creates the layer.
+    pub fn new(validator: TokenValidator) -> Self {
+        Self {
+            validator: Arc::new(validator),
+            revocation: None,
+        }
+    }
+
+    /// Checks each authenticated member's key with `checker` as well.
+    pub fn with_revocation_checker(mut self, checker: Arc<RevocationChecker>) -> Self {
+        self.revocation = Some(checker);
+        self
+    }
+}
+
+impl<S> Layer<S> for TokenAuthLayer {
+    type Service = TokenAuth<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        TokenAuth {
+            inner,
+            validator: Arc::clone(&self.validator),
+            revocation: self.revocation.clone(),
+        }
+    }
+}
+
+/// Service produced by `TokenAuthLayer`.
+#[derive(Debug, Clone)]
+pub struct TokenAuth<S> {
+    inner: S,
+    validator: Arc<TokenValidator>,
+    revocation: Option<Arc<RevocationChecker>>,
+}
+
+fn unauthorized<ResBody: Default>() -> Response<ResBody> {
+    let mut response = Response::new(ResBody::default());
+    *response.status_mut() = StatusCode::UNAUTHORIZED;
+    response
+}
+
+impl<S, B, ResBody> Service<Request<B>> for TokenAuth<S>
+where
+    S: Service<Request<B>, Response = Response<ResBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    S::Error: Send + 'static,
+    B: Send + 'static,
+    ResBody: Default + Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut req: Request<B>) -> Self::Future {
+        let member = match self.validator.authorize(req.headers()) {
+            Ok(member) => member,
+            Err(e) => {
+                tracing::debug!("Rejected RPC request: {}", e);
+                return Box::pin(async move { Ok(unauthorized()) });
+            }
+        };
+        let address = member.address;
+        req.extensions_mut().insert(member);
+
+        let Some(checker) = self.revocation.clone() else {
+            return Box::pin(self.inner.call(req));
+        };
+        // Call the service readied by poll_ready; keep a clone for later requests
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        Box::pin(async move {
+            if let Err(e) = checker.check(&address).await {
+                tracing::debug!("Rejected RPC request: {}", e);
+                return Ok(unauthorized());
+            }
+            inner.call(req).await
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_crypto::{Ed25519PrivateKey, PrivateKey};
+    use bach_primitives::FakeClock;
+    use std::time::UNIX_EPOCH;
+
+    fn audience() -> TokenAudience {
+        TokenAudience::new(7, "node-a")
+    }
+
+    fn validator_for(key: &PrivateKey) -> TokenValidator {
+        TokenValidator::new(&TokenAuthConfig {
+            members: vec![key.public_key().to_address()],
+            max_ttl: Duration::from_secs(600),
+            audience: audience(),
+            ..Default::default()
+        })
+    }
+
+    #[test]
+    fn test_token_roundtrip() {
+        let key = PrivateKey::random();
+        let token = AuthToken::issue(&key, &audience(), Duration::from_secs(60));
+
+        let decoded = AuthToken::decode(&token.encode()).unwrap();
+        assert_eq!(decoded, token);
+        assert!(AuthToken::decode("0x1234").is_err());
+    }
+
+    #[test]
+    fn test_ed25519_token() {
+        let key = Ed25519PrivateKey::random();
+        let address = key.public_key().to_address();
+        let token = AuthToken::issue_at(&key, &audience(), 1000, Duration::from_secs(60));
+        assert_eq!(AuthToken::decode(&token.encode()).unwrap(), token);
+
+        let mut config = TokenAuthConfig {
+            members: vec![address],
+            audience: audience(),
+            ..Default::default()
+        };
+        assert_eq!(
+            TokenValidator::new(&config).validate_at(&token.encode(), 1010),
+            Err(AuthError::UnsupportedAlgorithm(KeyAlgorithm::Ed25519))
+        );
+
+        config.algorithms.push(KeyAlgorithm::Ed25519);
+        let validator = TokenValidator::new(&config);
+        assert_eq!(validator.validate_at(&token.encode(), 1010).unwrap(), address);
+
+        let mut tampered = token.clone();
+        tampered.expires_at += 30;
+        assert_eq!(
+            validator.validate_at(&tampered.encode(), 1010),
+            Err(AuthError::BadSignature)
+        );
+    }
+
+    #[test]
+    fn test_validate_member_token() {
+        let key = PrivateKey::random();
+        let validator = validator_for(&key);
+        let token = AuthToken::issue_at(&key, &audience(), 1000, Duration::from_secs(60));
+
+        assert_eq!(
+            validator.validate_at(&token.encode(), 1010).unwrap(),
+            key.public_key().to_address()
+        );
+        assert_eq!(validator.validate_at(&token.encode(), 1060), Err(AuthError::Expired));
+    }
+
+    #[test]
+    fn test_validate_on_clock() {
+        let key = PrivateKey::random();
+        let clock = FakeClock::at(UNIX_EPOCH + Duration::from_secs(990));
+        let validator = validator_for(&key).with_clock(Arc::new(clock.clone()));
+        let token = AuthToken::issue_at(&key, &audience(), 1000, Duration::from_secs(60));
+
+        // Issued by a client whose clock runs 10s fast
+        assert!(validator.validate(&token.encode()).is_ok());
+        clock.advance(Duration::from_secs(10));
+        assert!(validator.validate(&token.encode()).is_ok());
+        clock.advance(Duration::from_secs(60));
+        assert_eq!(validator.validate(&token.encode()), Err(AuthError::Expired));
+    }
+
+    #[test]
+    fn test_reject_non_member_and_long_lived() {
+        let key = PrivateKey::random();
+        let validator = validator_for(&key);
+
+        let outsider = PrivateKey::random();
+        let token = AuthToken::issue_at(&outsider, &audience(), 1000, Duration::from_secs(60));
+        assert!(matches!(
+            validator.validate_at(&token.encode(), 1010),
+            Err(AuthError::NotMember(_))
+        ));
+
+        let token = AuthToken::issue_at(&key, &audience(), 1000, Duration::from_secs(3600));
+        assert_eq!(
+            validator.validate_at(&token.encode(), 1010),
+            Err(AuthError::LifetimeTooLong(600))
+        );
+    }
+
+    #[test]
+    fn test_reject_future_and_foreign_tokens() {
+        let key = PrivateKey::random();
+        let validator = validator_for(&key);
+
+        let token = AuthToken::issue_at(&key, &audience(), 1000, Duration::from_secs(60));
+        assert!(validator.validate_at(&token.encode(), 985).is_ok());
+        assert_eq!(validator.validate_at(&token.encode(), 984), Err(AuthError::NotYetValid));
+
+        for other in [TokenAudience::new(8, "node-a"), TokenAudience::new(7, "node-b")] {
+            let token = AuthToken::issue_at(&key, &other, 1000, Duration::from_secs(60));
+            assert_eq!(
+                validator.validate_at(&token.encode(), 1010),
+                Err(AuthError::WrongAudience)
+            );
+        }
+
+        let mut token = AuthToken::issue_at(&key, &audience(), 1000, Duration::from_secs(60));
+        token.chain_id = 8;
+        assert_eq!(validator.validate_at(&token.encode(), 1010), Err(AuthError::BadSignature));
+    }
+
+    #[test]
+    fn test_reject_tampered_token() {
+        let key = PrivateKey::random();
+        let validator = validator_for(&key);
+        let mut token = AuthToken::issue_at(&key, &audience(), 1000, Duration::from_secs(60));
+        token.expires_at += 30;
+
+        assert_eq!(validator.validate_at(&token.encode(), 1010), Err(AuthError::BadSignature));
+    }
+
+    #[test]
+    fn test_reject_revoked_member() {
+        let key = PrivateKey::random();
+        let revoked = RevokedKeys::default();
+        let validator = validator_for(&key).with_revoked(revoked.clone());
+        let token = AuthToken::issue_at(&key, &audience(), 1000, Duration::from_secs(60));
+        assert!(validator.validate_at(&token.encode(), 1010).is_ok());
+
+        revoked.replace([key.public_key().to_address()]);
+        assert!(matches!(
+            validator.validate_at(&token.encode(), 1010),
+            Err(AuthError::Revoked(_))
+        ));
+
+        revoked.replace([]);
+        assert!(validator.validate_at(&token.encode(), 1010).is_ok());
+    }
+
+    #[test]
+    fn test_authorize_header() {
+        let key = PrivateKey::random();
+        let validator = validator_for(&key);
+        let token = AuthToken::issue(&key, &audience(), Duration::from_secs(60));
+
+        let mut headers = HeaderMap::new();
+        assert_eq!(validator.authorize(&headers), Err(AuthError::MissingToken));
+
+        headers.insert(AUTHORIZATION, format!("Bearer {}", token.encode()).parse().unwrap());
+        let member = validator.authorize(&headers).unwrap();
+        assert_eq!(member.address, key.public_key().to_address());
+        assert_eq!(member.role, None);
+    }
+
+    #[test]
+    fn test_authorize_did_member() {
+        let key = PrivateKey::random();
+        let address = key.public_key().to_address();
+        let validator = TokenValidator::new(&TokenAuthConfig {
+            members: vec![address],
+            roles: HashMap::from([(address, AdminRole::Auditor)]),
+            dids: HashMap::from([(address, "did:bach:clinic".to_string())]),
+            audience: audience(),
+            ..Default::default()
+        });
+        let token = AuthToken::issue(&key, &audience(), Duration::from_secs(60));
+
+        let mut headers = HeaderMap::new();
+        headers.insert(AUTHORIZATION, format!("Bearer {}", token.encode()).parse().unwrap());
+        let member = validator.authorize(&headers).unwrap();
+        assert_eq!(member.did.as_deref(), Some("did:bach:clinic"));
+        assert_eq!(member.role, Some(AdminRole::Auditor));
+    }
+
+    #[test]
+    fn test_role_permissions() {
+        assert!(AdminRole::Auditor.allows(AdminPermission::Read));
+        assert!(!AdminRole::Auditor.allows(AdminPermission::NodeOps));
+        assert!(AdminRole::Operator.allows(AdminPermission::NodeOps));
+        assert!(!AdminRole::Operator.allows(AdminPermission::Consensus));
+        assert!(AdminRole::ConsensusAdmin.allows(AdminPermission::Consensus));
+        assert!(!AdminRole::ConsensusAdmin.allows(AdminPermission::NodeOps));
+
+        assert_eq!("Operator".parse::<AdminRole>().unwrap(), AdminRole::Operator);
+        assert_eq!("consensus-admin".parse::<AdminRole>().unwrap(), AdminRole::ConsensusAdmin);
+        assert!("root".parse::<AdminRole>().is_err());
+    }
+}
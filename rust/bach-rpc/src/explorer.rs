@@ -0,0 +1,287 @@
+//! Read-only chain explorer API
+//!
+//! Serves paginated block and transaction lists and a unified search from
+//! the indexes written at commit time, so a web explorer never has to
+//! execute calls against contract state. Pages are walked newest first
+//! with opaque `next` cursors.
+
+use crate::{
+    format_address, format_bytes, format_h256, format_u64, parse_address, parse_bytes, parse_h256,
+    parse_u64, RpcError, RpcState,
+};
+use bach_primitives::{Address, H256};
+use bach_types::Block;
+use jsonrpsee::core::RpcResult;
+use jsonrpsee::proc_macros::rpc;
+use serde::{Deserialize, Serialize};
+use std::sync::Arc;
+
+/// Page size used when the client does not ask for one
+pub const DEFAULT_EXPLORER_PAGE_SIZE: usize = 20;
+
+/// Largest page the explorer serves
+pub const MAX_EXPLORER_PAGE_SIZE: usize = 100;
+
+/// Block list entry
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct BlockSummary {
+    /// Block number
+    pub number: String,
+    /// Block hash
+    pub hash: String,
+    /// Parent block hash
+    pub parent_hash: String,
+    /// Block timestamp
+    pub timestamp: String,
+    /// Number of transactions
+    pub transaction_count: String,
+}
+
+/// Transaction list entry
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct TransactionSummary {
+    /// Transaction hash
+    pub hash: String,
+    /// Block number
+    pub block_number: String,
+    /// Index within the block
+    pub transaction_index: String,
+    /// Execution status (None if no receipt is stored)
+    pub status: Option<bool>,
+}
+
+/// A page of results
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct Page<T> {
+    /// Entries, newest first
+    pub items: Vec<T>,
+    /// Cursor for the next page (None on the last page)
+    pub next: Option<String>,
+}
+
+/// What a search query matched
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(tag = "kind", rename_all = "camelCase")]
+pub enum SearchResult {
+    /// A block by number or hash
+    Block(BlockSummary),
+    /// A transaction by hash
+    Transaction(TransactionSummary),
+    /// An account or contract address
+    Address {
+        /// The address
+        address: String,
+    },
+    /// Nothing matched
+    NotFound,
+}
+
+/// Explorer namespace RPC methods
+#[rpc(server, namespace = "explorer")]
+pub trait ExplorerApi {
+    /// Returns blocks newest first, starting below the `before` cursor
+    #[method(name = "getBlocks")]
+    async fn get_blocks(
+        &self,
+        before: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<Page<BlockSummary>>;
+
+    /// Returns transactions sent by or to an address, newest first
+    #[method(name = "getTransactionsByAddress")]
+    async fn get_transactions_by_address(
+        &self,
+        address: String,
+        before: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<Page<TransactionSummary>>;
+
+    /// Looks up a block number, block hash, transaction hash or address
+    #[method(name = "search")]
+    async fn search(&self, query: String) -> RpcResult<SearchResult>;
+}
+
+/// Implementation of ExplorerApi trait.
+pub struct ExplorerApiImpl {
+    state: Arc<RpcState>,
+}
+
+impl ExplorerApiImpl {
+    pub fn new(state: Arc<RpcState>) -> Self {
+        Self { state }
+    }
+
+    fn transaction_summary(
+        &self,
+        tx_hash: &H256,
+        block_number: u64,
+        index: u32,
+    ) -> TransactionSummary {
+        TransactionSummary {
+            hash: format_h256(tx_hash),
+            block_number: format_u64(block_number),
+            transaction_index: format_u64(index as u64),
+            status: self
+                .state
+                .storage
+                .transactions
+                .get_receipt(tx_hash)
+                .map(|receipt| receipt.status),
+        }
+    }
+}
+
+fn page_size(limit: Option<usize>) -> Result<usize, RpcError> {
+    match limit.unwrap_or(DEFAULT_EXPLORER_PAGE_SIZE) {
+        0 => Err(RpcError::InvalidParams(
+            "limit must be positive".to_string(),
+        )),
+        n if n > MAX_EXPLORER_PAGE_SIZE => Err(RpcError::InvalidParams(format!(
+            "limit is {}, maximum is {}",
+            n, MAX_EXPLORER_PAGE_SIZE
+        ))),
+        n => Ok(n),
+    }
+}
+
+fn encode_position((block_number, index): (u64, u32)) -> String {
+    let mut cursor = [0u8; 12];
+    cursor[0..8].copy_from_slice(&block_number.to_be_bytes());
+    cursor[8..12].copy_from_slice(&index.to_be_bytes());
+    format_bytes(&cursor)
+}
+
+fn decode_position(cursor: &str) -> Result<(u64, u32), RpcError> {
+    let bytes = parse_bytes(cursor)?;
+    if bytes.len() != 12 {
+        return Err(RpcError::InvalidParams(format!(
+            "invalid cursor: {}",
+            cursor
+        )));
+    }
+    let block_number = u64::from_be_bytes(bytes[0..8].try_into().unwrap());
+    let index = u32::from_be_bytes(bytes[8..12].try_into().unwrap());
+    Ok((block_number, index))
+}
+
+fn block_summary(block: &Block) -> BlockSummary {
+    BlockSummary {
+        number: format_u64(block.height),
+        hash: format_h256(&block.hash()),
+        parent_hash: format_h256(&block.parent_hash),
+        timestamp: format_u64(block.timestamp),
+        transaction_count: format_u64(block.transactions.len() as u64),
+    }
+}
+
+#[jsonrpsee::core::async_trait]
+impl ExplorerApiServer for ExplorerApiImpl {
+    async fn get_blocks(
+        &self,
+        before: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<Page<BlockSummary>> {
+        let limit = page_size(limit).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let end = match before {
+            Some(cursor) => parse_u64(&cursor).map_err(jsonrpsee::types::ErrorObjectOwned::from)?,
+            None => *self.state.block_height.read().unwrap() + 1,
+        };
+
+        let first = end.saturating_sub(limit as u64);
+        let items: Vec<BlockSummary> = (first..end)
+            .rev()
+            .filter_map(|height| self.state.storage.blocks.get_block_by_height(height))
+            .map(|block| block_summary(&block))
+            .collect();
+
+        Ok(Page {
+            items,
+            next: (first > 0).then(|| format_u64(first)),
+        })
+    }
+
+    async fn get_transactions_by_address(
+        &self,
+        address: String,
+        before: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<Page<TransactionSummary>> {
+        let address = parse_address(&address).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let limit = page_size(limit).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let before = before
+            .as_deref()
+            .map(decode_position)
+            .transpose()
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+
+        // Fetch one extra entry to learn whether another page exists
+        let mut entries =
+            self.state
+                .storage
+                .transactions
+                .get_address_transactions(&address, before, limit + 1);
+        let next = if entries.len() > limit {
+            entries.truncate(limit);
+            entries
+                .last()
+                .map(|entry| encode_position(entry.position()))
+        } else {
+            None
+        };
+
+        let items = entries
+            .iter()
+            .map(|entry| {
+                self.transaction_summary(
+                    &entry.tx_hash_h256(),
+                    entry.block_number,
+                    entry.transaction_index,
+                )
+            })
+            .collect();
+        Ok(Page { items, next })
+    }
+
+    async fn search(&self, query: String) -> RpcResult<SearchResult> {
+        let query = query.trim();
+        let hex = query.strip_prefix("0x").unwrap_or(query);
+        let storage = &self.state.storage;
+
+        if hex.len() == 64 {
+            let hash = parse_h256(query).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+            if let Some(block) = storage.blocks.get_block_by_hash(&hash) {
+                return Ok(SearchResult::Block(block_summary(&block)));
+            }
+            if let Some(receipt) = storage.transactions.get_receipt(&hash) {
+                return Ok(SearchResult::Transaction(self.transaction_summary(
+                    &hash,
+                    receipt.block_number,
+                    receipt.transaction_index,
+                )));
+            }
+            return Ok(SearchResult::NotFound);
+        }
+
+        if hex.len() == 40 {
+            let address: Address =
+                parse_address(query).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+            return Ok(SearchResult::Address {
+                address: format_address(&address),
+            });
+        }
+
+        // Block numbers are accepted in decimal or 0x-prefixed hex
+        let height = if query.starts_with("0x") {
+            parse_u64(query).ok()
+        } else {
+            query.parse::<u64>().ok()
+        };
+        match height.and_then(|height| storage.blocks.get_block_by_height(height)) {
+            Some(block) => Ok(SearchResult::Block(block_summary(&block))),
+            None => Ok(SearchResult::NotFound),
+        }
+    }
+}
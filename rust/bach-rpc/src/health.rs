@@ -0,0 +1,131 @@
+//! Health and readiness endpoints
+//!
+//! `HealthLayer` answers `GET /health` and `GET /ready` on the RPC port with
+//! the node's `HealthResponse` as JSON and passes every other request on.
+//! `/health` is a liveness probe and always answers 200 while the server
+//! runs; `/ready` answers 503 while the node is still warming its caches
+//! or syncing, so load balancers only route to nodes serving current chain
+//! data. The status
+//! itself tells whether the node takes part in consensus or is degraded.
+//!
+//! Like `/metrics`, the endpoints sit in front of token authentication.
+
+use crate::RpcState;
+use http::{header::CONTENT_TYPE, HeaderValue, Method, Request, Response, StatusCode};
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::Arc;
+use std::task::{Context, Poll};
+use tower::{Layer, Service};
+
+/// Liveness probe path
+pub const HEALTH_PATH: &str = "/health";
+
+/// Readiness probe path
+pub const READY_PATH: &str = "/ready";
+
+/// HTTP middleware layer serving the health endpoints.
+#[derive(Clone)]
+pub struct HealthLayer {
+    state: Arc<RpcState>,
+}
+
+impl HealthLayer {
+    /// Creates the layer reading health from the given state.
+    pub fn new(state: Arc<RpcState>) -> Self {
+        Self { state }
+    }
+}
+
+impl<S> Layer<S> for HealthLayer {
+    type Service = Health<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        Health {
+            inner,
+            state: Arc::clone(&self.state),
+        }
+    }
+}
+
+/// Service produced by `HealthLayer`.
+#[derive(Clone)]
+pub struct Health<S> {
+    inner: S,
+    state: Arc<RpcState>,
+}
+
+impl<S, B, ResBody> Service<Request<B>> for Health<S>
+where
+    S: Service<Request<B>, Response = Response<ResBody>>,
+    S::Future: Send + 'static,
+    ResBody: From<String> + Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, req: Request<B>) -> Self::Future {
+        let path = req.uri().path();
+        if req.method() != Method::GET || (path != HEALTH_PATH && path != READY_PATH) {
+            return Box::pin(self.inner.call(req));
+        }
+        let health = self.state.health();
+        let status = if path == READY_PATH && !health.ready {
+            StatusCode::SERVICE_UNAVAILABLE
+        } else {
+            StatusCode::OK
+        };
+        let body = serde_json::to_string(&health).unwrap_or_default();
+        let mut response = Response::new(ResBody::from(body));
+        *response.status_mut() = status;
+        response
+            .headers_mut()
+            .insert(CONTENT_TYPE, HeaderValue::from_static("application/json"));
+        Box::pin(async move { Ok(response) })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::HealthResponse;
+    use crate::{RpcConfig, RpcServer};
+    use bach_network::{NodeHealth, SyncProgress};
+    use bach_storage::Storage;
+    use std::convert::Infallible;
+    use tower::{service_fn, ServiceExt};
+
+    #[tokio::test]
+    async fn test_probes_follow_sync() {
+        let server = RpcServer::new(RpcConfig::default(), Storage::temporary().unwrap(), 1);
+        let sync = Arc::new(SyncProgress::new());
+        server.attach_health(Arc::new(NodeHealth::new(Arc::clone(&sync))));
+
+        let inner = service_fn(|_: Request<()>| async {
+            Ok::<_, Infallible>(Response::new("rpc".to_string()))
+        });
+        let service = HealthLayer::new(server.state()).layer(inner);
+        let get = |path: &str| Request::builder().uri(path).body(()).unwrap();
+
+        sync.begin(0, 10);
+        let response = service.clone().oneshot(get(READY_PATH)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+        let health: HealthResponse = serde_json::from_str(response.body()).unwrap();
+        assert_eq!(health.status, "syncing");
+        assert_eq!(health.blocks_behind, 10);
+        let response = service.clone().oneshot(get(HEALTH_PATH)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        sync.finish();
+        let response = service.clone().oneshot(get(READY_PATH)).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        let response = service.clone().oneshot(get("/")).await.unwrap();
+        assert_eq!(response.body(), "rpc");
+    }
+}
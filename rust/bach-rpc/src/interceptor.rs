@@ -0,0 +1,547 @@
+//! RPC request interceptors
+//!
+//! `InterceptorLayer` runs in front of every JSON-RPC method call, after
+//! token authentication. It rejects calls whose params exceed the method's
+//! size limit, and calls over the method's rate limit for the calling
+//! client, before they reach the method. Clients are told apart by their
+//! authenticated member account, or else by the IP address they connect
+//! from (`ClientAddr`). Buckets of clients that have refilled are dropped
+//! once `MAX_RATE_LIMIT_BUCKETS` are tracked.
+//!
+//! The latency of every call is recorded in per-method histograms, exported
+//! on `/metrics` as `bach_rpc_method_latency_seconds`, and calls slower than
+//! `slow_request_ms` are logged with their method, client and latency.
+
+use crate::{AuthenticatedMember, RpcError};
+use bach_primitives::{Clock, TokenBucket};
+use jsonrpsee::server::middleware::rpc::RpcServiceT;
+use jsonrpsee::types::{ErrorObjectOwned, Request};
+use jsonrpsee::MethodResponse;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fmt::Write;
+use std::future::Future;
+use std::net::IpAddr;
+use std::pin::Pin;
+use std::sync::{Arc, Mutex};
+use std::task::{Context, Poll};
+use std::time::{Duration, Instant};
+use tower::{Layer, Service};
+
+/// Client identity of calls with neither an authenticated member nor a
+/// remote address
+pub const ANONYMOUS_CLIENT: &str = "anonymous";
+
+/// Rate limit buckets kept before refilled ones are dropped
+pub const MAX_RATE_LIMIT_BUCKETS: usize = 65_536;
+
+/// Method label of calls to methods the server doesn't have, so unknown
+/// names can't grow the rate limit and latency tables
+const OTHER_METHOD: &str = "other";
+
+/// Upper bounds of the latency histogram buckets, in seconds
+pub(crate) const LATENCY_BUCKETS: [f64; 11] = [
+    0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0,
+];
+
+/// Token bucket rate: `per_second` calls on average, up to `burst` at once.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RateLimit {
+    /// Calls allowed per second on average
+    pub per_second: u32,
+    /// Calls allowed back to back
+    pub burst: u32,
+}
+
+/// Limits and logging applied to every RPC call
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct InterceptorConfig {
+    /// Largest params, in bytes, of methods without their own limit
+    /// (unlimited if None)
+    pub max_params_size: Option<usize>,
+    /// Params size limits of individual methods
+    pub method_max_params_size: HashMap<String, usize>,
+    /// Rate limit per client of methods without their own limit
+    /// (unlimited if None)
+    pub rate_limit: Option<RateLimit>,
+    /// Rate limits per client of individual methods
+    pub method_rate_limits: HashMap<String, RateLimit>,
+    /// Calls taking at least this long are logged, in milliseconds
+    pub slow_request_ms: u64,
+}
+
+impl Default for InterceptorConfig {
+    fn default() -> Self {
+        Self {
+            max_params_size: None,
+            method_max_params_size: HashMap::new(),
+            rate_limit: None,
+            method_rate_limits: HashMap::new(),
+            slow_request_ms: 1000,
+        }
+    }
+}
+
+impl InterceptorConfig {
+    /// Returns the params size limit of `method`.
+    pub fn max_params_size_of(&self, method: &str) -> Option<usize> {
+        self.method_max_params_size
+            .get(method)
+            .copied()
+            .or(self.max_params_size)
+    }
+
+    /// Returns the per-client rate limit of `method`.
+    pub fn rate_limit_of(&self, method: &str) -> Option<RateLimit> {
+        self.method_rate_limits
+            .get(method)
+            .copied()
+            .or(self.rate_limit)
+    }
+}
+
+/// Latency histogram of one method.
+#[derive(Debug, Clone, Default)]
+pub(crate) struct Histogram {
+    /// Calls per bucket (not cumulative); the last counts slower calls
+    buckets: [u64; LATENCY_BUCKETS.len() + 1],
+    sum: Duration,
+    count: u64,
+}
+
+impl Histogram {
+    /// Counts one observation that took `elapsed`.
+    pub(crate) fn record(&mut self, elapsed: Duration) {
+        let secs = elapsed.as_secs_f64();
+        let bucket = LATENCY_BUCKETS
+            .iter()
+            .position(|bound| secs <= *bound)
+            .unwrap_or(LATENCY_BUCKETS.len());
+        self.buckets[bucket] += 1;
+        self.sum += elapsed;
+        self.count += 1;
+    }
+
+    /// Returns the number of observations.
+    pub(crate) fn count(&self) -> u64 {
+        self.count
+    }
+
+    /// Writes the bucket, sum and count samples of metric `name` with the
+    /// given comma separated `labels`.
+    pub(crate) fn render(&self, out: &mut String, name: &str, labels: &str) {
+        let mut cumulative = 0;
+        for (bound, observations) in LATENCY_BUCKETS.iter().zip(&self.buckets) {
+            cumulative += observations;
+            let _ = writeln!(
+                out,
+                "{}_bucket{{{},le=\"{}\"}} {}",
+                name, labels, bound, cumulative
+            );
+        }
+        let _ = writeln!(
+            out,
+            "{}_bucket{{{},le=\"+Inf\"}} {}",
+            name, labels, self.count
+        );
+        let _ = writeln!(out, "{}_sum{{{}}} {}", name, labels, self.sum.as_secs_f64());
+        let _ = writeln!(out, "{}_count{{{}}} {}", name, labels, self.count);
+    }
+}
+
+/// Per-method call latency histograms.
+#[derive(Debug, Default)]
+pub struct MethodLatencies {
+    histograms: Mutex<BTreeMap<String, Histogram>>,
+}
+
+impl MethodLatencies {
+    /// Records a call of `method` that took `elapsed`.
+    pub fn record(&self, method: &str, elapsed: Duration) {
+        let mut histograms = self.histograms.lock().unwrap();
+        histograms
+            .entry(method.to_string())
+            .or_default()
+            .record(elapsed);
+    }
+
+    /// Returns the number of recorded calls of `method`.
+    pub fn count(&self, method: &str) -> u64 {
+        self.histograms
+            .lock()
+            .unwrap()
+            .get(method)
+            .map_or(0, |histogram| histogram.count)
+    }
+
+    /// Renders the histograms in the Prometheus text format (empty if no
+    /// call was recorded).
+    pub fn render(&self) -> String {
+        let histograms = self.histograms.lock().unwrap();
+        let mut out = String::new();
+        if histograms.is_empty() {
+            return out;
+        }
+        let name = "bach_rpc_method_latency_seconds";
+        let _ = writeln!(out, "# HELP {} Latency of RPC method calls", name);
+        let _ = writeln!(out, "# TYPE {} histogram", name);
+        for (method, histogram) in histograms.iter() {
+            histogram.render(&mut out, name, &format!("method=\"{}\"", method));
+        }
+        out
+    }
+}
+
+/// Applies an `InterceptorConfig` to RPC calls.
+#[derive(Debug)]
+pub struct Interceptor {
+    config: InterceptorConfig,
+    clock: Arc<dyn Clock>,
+    /// Methods the server has (None: every name is a method)
+    methods: Option<HashSet<String>>,
+    /// Rate limit buckets by client and method
+    buckets: Mutex<HashMap<(String, String), TokenBucket>>,
+    latencies: Arc<MethodLatencies>,
+}
+
+impl Interceptor {
+    /// Creates an interceptor timing calls with `clock`.
+    pub fn new(config: InterceptorConfig, clock: Arc<dyn Clock>) -> Self {
+        Self {
+            config,
+            clock,
+            methods: None,
+            buckets: Mutex::new(HashMap::new()),
+            latencies: Arc::new(MethodLatencies::default()),
+        }
+    }
+
+    /// Tracks only the given methods by name; calls of any other name are
+    /// limited and timed together.
+    pub fn with_methods<I, M>(mut self, methods: I) -> Self
+    where
+        I: IntoIterator<Item = M>,
+        M: Into<String>,
+    {
+        self.methods = Some(methods.into_iter().map(Into::into).collect());
+        self
+    }
+
+    /// Returns the latency histograms of the calls seen so far.
+    pub fn latencies(&self) -> Arc<MethodLatencies> {
+        Arc::clone(&self.latencies)
+    }
+
+    /// Returns the label `method` is tracked under.
+    fn label<'m>(&self, method: &'m str) -> &'m str {
+        match &self.methods {
+            Some(methods) if !methods.contains(method) => OTHER_METHOD,
+            _ => method,
+        }
+    }
+
+    /// Checks a call of `method` by `client` with `params_size` bytes of
+    /// params against the size and rate limits.
+    pub fn admit(&self, method: &str, client: &str, params_size: usize) -> Result<(), RpcError> {
+        if let Some(max) = self.config.max_params_size_of(method) {
+            if params_size > max {
+                return Err(RpcError::InvalidParams(format!(
+                    "params of {} are {} bytes, max {}",
+                    method, params_size, max
+                )));
+            }
+        }
+
+        let Some(limit) = self.config.rate_limit_of(method) else {
+            return Ok(());
+        };
+        let now = self.clock.now();
+        let key = (client.to_string(), self.label(method).to_string());
+        let mut buckets = self.buckets.lock().unwrap();
+        if buckets.len() >= MAX_RATE_LIMIT_BUCKETS && !buckets.contains_key(&key) {
+            buckets.retain(|(_, method), bucket| {
+                self.config.rate_limit_of(method).is_some() && !bucket.is_full(now)
+            });
+        }
+        let bucket = buckets
+            .entry(key)
+            .or_insert_with(|| TokenBucket::new(limit.per_second as f64, limit.burst, now));
+        if !bucket.try_take(now) {
+            return Err(RpcError::LimitExceeded(format!(
+                "rate limit of {} exceeded",
+                method
+            )));
+        }
+        Ok(())
+    }
+
+    /// Records a finished call of `method` that started at `started`.
+    pub fn finish(&self, method: &str, client: &str, started: Instant) {
+        let elapsed = self.clock.now().saturating_duration_since(started);
+        self.latencies.record(self.label(method), elapsed);
+        if elapsed >= Duration::from_millis(self.config.slow_request_ms) {
+            tracing::warn!(
+                method,
+                client,
+                elapsed_ms = elapsed.as_millis() as u64,
+                "Slow RPC request"
+            );
+        }
+    }
+}
+
+/// Remote IP address of the connection a request came in on, stored in
+/// request extensions.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ClientAddr(pub IpAddr);
+
+/// HTTP service tagging every request of one connection with its
+/// `ClientAddr`.
+#[derive(Debug, Clone)]
+pub struct WithClientAddr<S> {
+    inner: S,
+    addr: ClientAddr,
+}
+
+impl<S> WithClientAddr<S> {
+    /// Wraps the service of a connection from `addr`.
+    pub fn new(inner: S, addr: IpAddr) -> Self {
+        Self {
+            inner,
+            addr: ClientAddr(addr),
+        }
+    }
+}
+
+impl<S, B> Service<http::Request<B>> for WithClientAddr<S>
+where
+    S: Service<http::Request<B>>,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = S::Future;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut req: http::Request<B>) -> Self::Future {
+        req.extensions_mut().insert(self.addr);
+        self.inner.call(req)
+    }
+}
+
+/// Returns the identity a request with `extensions` is rate limited under.
+pub(crate) fn client_of(extensions: &http::Extensions) -> String {
+    if let Some(member) = extensions.get::<AuthenticatedMember>() {
+        return member.address.to_string();
+    }
+    extensions
+        .get::<ClientAddr>()
+        .map_or_else(|| ANONYMOUS_CLIENT.to_string(), |addr| addr.0.to_string())
+}
+
+/// RPC middleware layer applying an `Interceptor` to every method call.
+#[derive(Debug, Clone)]
+pub struct InterceptorLayer {
+    interceptor: Arc<Interceptor>,
+}
+
+impl InterceptorLayer {
+    /// Creates the layer.
+    pub fn new(interceptor: Arc<Interceptor>) -> Self {
+        Self { interceptor }
+    }
+}
+
+impl<S> Layer<S> for InterceptorLayer {
+    type Service = Intercepted<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        Intercepted {
+            inner,
+            interceptor: Arc::clone(&self.interceptor),
+        }
+    }
+}
+
+/// Service produced by `InterceptorLayer`.
+#[derive(Debug, Clone)]
+pub struct Intercepted<S> {
+    inner: S,
+    interceptor: Arc<Interceptor>,
+}
+
+impl<'a, S> RpcServiceT<'a> for Intercepted<S>
+where
+    S: RpcServiceT<'a> + Send + Sync + Clone + 'static,
+{
+    type Future = Pin<Box<dyn Future<Output = MethodResponse> + Send + 'a>>;
+
+    fn call(&self, req: Request<'a>) -> Self::Future {
+        let method = req.method_name().to_string();
+        let client = client_of(req.extensions());
+        let params_size = req.params().as_str().map_or(0, str::len);
+
+        if let Err(e) = self.interceptor.admit(&method, &client, params_size) {
+            tracing::debug!(method, client, "Rejected RPC request: {}", e);
+            let response = MethodResponse::error(req.id(), ErrorObjectOwned::from(e));
+            return Box::pin(async move { response });
+        }
+
+        let interceptor = Arc::clone(&self.interceptor);
+        let started = interceptor.clock.now();
+        let call = self.inner.call(req);
+        Box::pin(async move {
+            let response = call.await;
+            interceptor.finish(&method, &client, started);
+            response
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_primitives::FakeClock;
+
+    fn interceptor(config: InterceptorConfig) -> (Interceptor, FakeClock) {
+        let clock = FakeClock::new();
+        let interceptor = Interceptor::new(config, Arc::new(clock.clone()))
+            .with_methods(["eth_call", "eth_sendRawTransaction"]);
+        (interceptor, clock)
+    }
+
+    #[test]
+    fn test_params_size_limits() {
+        let (interceptor, _) = interceptor(InterceptorConfig {
+            max_params_size: Some(100),
+            method_max_params_size: HashMap::from([("eth_sendRawTransaction".to_string(), 1000)]),
+            ..Default::default()
+        });
+
+        assert!(interceptor.admit("eth_call", "a", 100).is_ok());
+        assert!(matches!(
+            interceptor.admit("eth_call", "a", 101),
+            Err(RpcError::InvalidParams(_))
+        ));
+        assert!(interceptor
+            .admit("eth_sendRawTransaction", "a", 1000)
+            .is_ok());
+        assert!(interceptor
+            .admit("eth_sendRawTransaction", "a", 1001)
+            .is_err());
+    }
+
+    #[test]
+    fn test_rate_limits_per_client_and_method() {
+        let (interceptor, clock) = interceptor(InterceptorConfig {
+            rate_limit: Some(RateLimit {
+                per_second: 1,
+                burst: 2,
+            }),
+            method_rate_limits: HashMap::from([(
+                "eth_sendRawTransaction".to_string(),
+                RateLimit {
+                    per_second: 10,
+                    burst: 5,
+                },
+            )]),
+            ..Default::default()
+        });
+
+        assert!(interceptor.admit("eth_call", "a", 0).is_ok());
+        assert!(interceptor.admit("eth_call", "a", 0).is_ok());
+        assert!(matches!(
+            interceptor.admit("eth_call", "a", 0),
+            Err(RpcError::LimitExceeded(_))
+        ));
+
+        // Other clients and methods have their own buckets
+        assert!(interceptor.admit("eth_call", "b", 0).is_ok());
+        for _ in 0..5 {
+            assert!(interceptor.admit("eth_sendRawTransaction", "a", 0).is_ok());
+        }
+        assert!(interceptor.admit("eth_sendRawTransaction", "a", 0).is_err());
+
+        clock.advance(Duration::from_secs(1));
+        assert!(interceptor.admit("eth_call", "a", 0).is_ok());
+        assert!(interceptor.admit("eth_call", "a", 0).is_err());
+
+        // Unknown methods share one bucket
+        assert!(interceptor.admit("foo", "a", 0).is_ok());
+        assert!(interceptor.admit("bar", "a", 0).is_ok());
+        assert!(interceptor.admit("baz", "a", 0).is_err());
+    }
+
+    #[test]
+    fn test_clients_by_member_or_address() {
+        let mut extensions = http::Extensions::new();
+        assert_eq!(client_of(&extensions), ANONYMOUS_CLIENT);
+
+        extensions.insert(ClientAddr("10.0.0.7".parse().unwrap()));
+        assert_eq!(client_of(&extensions), "10.0.0.7");
+
+        let address = bach_primitives::Address::from([0x11; 20]);
+        extensions.insert(AuthenticatedMember {
+            address,
+            role: None,
+            did: None,
+        });
+        assert_eq!(client_of(&extensions), address.to_string());
+    }
+
+    #[test]
+    fn test_refilled_buckets_are_dropped() {
+        let (interceptor, clock) = interceptor(InterceptorConfig {
+            rate_limit: Some(RateLimit {
+                per_second: 1,
+                burst: 1,
+            }),
+            ..Default::default()
+        });
+        for client in 0..MAX_RATE_LIMIT_BUCKETS {
+            interceptor.admit("eth_call", &client.to_string(), 0).unwrap();
+        }
+        assert!(interceptor.admit("eth_call", "0", 0).is_err());
+
+        clock.advance(Duration::from_secs(1));
+        interceptor.admit("eth_call", "new", 0).unwrap();
+        assert_eq!(interceptor.buckets.lock().unwrap().len(), 1);
+    }
+
+    #[test]
+    fn test_latency_histograms() {
+        let (interceptor, clock) = interceptor(InterceptorConfig::default());
+        let started = clock.now();
+        clock.advance(Duration::from_millis(30));
+        interceptor.finish("eth_call", "a", started);
+        clock.advance(Duration::from_secs(2));
+        interceptor.finish("eth_call", "a", started);
+        interceptor.finish("nonexistent", "a", clock.now());
+
+        let latencies = interceptor.latencies();
+        assert_eq!(latencies.count("eth_call"), 2);
+        assert_eq!(latencies.count("nonexistent"), 0);
+        assert_eq!(latencies.count(OTHER_METHOD), 1);
+
+        let metrics = latencies.render();
+        let name = "bach_rpc_method_latency_seconds";
+        assert!(metrics.contains(&format!("# TYPE {} histogram\n", name)));
+        assert!(metrics.contains(&format!(
+            "{}_bucket{{method=\"eth_call\",le=\"0.025\"}} 0\n",
+            name
+        )));
+        assert!(metrics.contains(&format!(
+            "{}_bucket{{method=\"eth_call\",le=\"0.05\"}} 1\n",
+            name
+        )));
+        assert!(metrics.contains(&format!(
+            "{}_bucket{{method=\"eth_call\",le=\"2.5\"}} 2\n",
+            name
+        )));
+        assert!(metrics.contains(&format!("{}_count{{method=\"eth_call\"}} 2\n", name)));
+        assert!(MethodLatencies::default().render().is_empty());
+    }
+}
@@ -4,13 +4,55 @@
 //!
 //! Implements standard Ethereum RPC methods:
 //! - Transaction submission: `eth_sendTransaction`, `eth_sendRawTransaction`
+//!   (`bach_sendTransactionWithResult` also waits for the receipt)
 //! - State queries: `eth_call`, `eth_getBalance`, `eth_getStorageAt`, `eth_getCode`
+//!   (`bach_checkAffordability` tells whether a sender can pay for a transaction)
 //! - Block queries: `eth_getBlockByNumber`, `eth_getBlockByHash`
+//!   (`bach_getBlocksByHeights` and `bach_getTransactionsByHashes` fetch many
+//!   entries in one round trip)
 //! - Receipt/Log queries: `eth_getTransactionReceipt`, `eth_getLogs`
+//!
+//! The read-only `explorer` namespace serves paginated block and transaction
+//! lists and search for block explorers.
+//!
+//! Node operators additionally get the `admin` namespace for node status, log
+//! level and peer management, gated by `AdminRole` when token auth is enabled.
+//! Requests can be authenticated with short-lived signed tokens (see `auth`).
+//! Block statistics are exported for Prometheus on `/metrics` (see `metrics`),
+//! and liveness and readiness probes are served on `/health` and `/ready`
+//! (see `health`).
+//! Method calls pass through size and rate limits and are timed (see
+//! `interceptor`).
 
 #![forbid(unsafe_code)]
 
-use bach_primitives::{Address, H256, U256};
+mod auth;
+mod explorer;
+mod health;
+mod interceptor;
+mod metrics;
+mod pool_metrics;
+mod watch;
+
+pub use auth::{
+    AdminPermission, AdminRole, AuthError, AuthToken, AuthenticatedMember, KnownKeys,
+    RevokedKeys, TokenAudience, TokenAuth, TokenAuthConfig, TokenAuthLayer, TokenValidator,
+};
+pub use explorer::{
+    BlockSummary, ExplorerApiImpl, ExplorerApiServer, Page, SearchResult, TransactionSummary,
+    DEFAULT_EXPLORER_PAGE_SIZE, MAX_EXPLORER_PAGE_SIZE,
+};
+pub use health::{Health, HealthLayer, HEALTH_PATH, READY_PATH};
+pub use interceptor::{
+    ClientAddr, Intercepted, Interceptor, InterceptorConfig, InterceptorLayer, MethodLatencies,
+    RateLimit, WithClientAddr, ANONYMOUS_CLIENT, MAX_RATE_LIMIT_BUCKETS,
+};
+pub use metrics::{render_metrics, Metrics, MetricsLayer, METRICS_PATH};
+pub use pool_metrics::{EvictionReason, TxLane, TxPoolMetrics};
+pub use watch::{TxWatcher, DEFAULT_SUBMIT_WAIT_MS, MAX_SUBMIT_WAIT_MS};
+
+use bach_primitives::{Address, Clock, ErrorCode, ErrorCoded, SystemClock, H256, U256};
+use bach_state::SparseMerkleTree;
 use jsonrpsee::core::RpcResult;
 use jsonrpsee::proc_macros::rpc;
 use serde::{Deserialize, Serialize};
@@ -41,6 +83,41 @@ pub enum RpcErrorCode {
     ResourceNotFound = -32001,
     /// Execution error (revert, out of gas, etc.)
     ExecutionError = -32015,
+    /// Caller lacks the required role
+    Unauthorized = -32004,
+    /// Request rate limit exceeded
+    LimitExceeded = -32005,
+}
+
+impl From<ErrorCode> for RpcErrorCode {
+    /// Maps a catalog code onto the JSON-RPC code reported to clients.
+    /// Failures inside the node's block pipeline all surface as server
+    /// errors; the catalog name in the error data tells them apart.
+    fn from(code: ErrorCode) -> Self {
+        match code {
+            ErrorCode::InvalidArgument | ErrorCode::InvalidConsensusMessage => {
+                RpcErrorCode::InvalidParams
+            }
+            ErrorCode::NotFound => RpcErrorCode::ResourceNotFound,
+            ErrorCode::PermissionDenied => RpcErrorCode::Unauthorized,
+            ErrorCode::Rejected
+            | ErrorCode::InvalidTxSignature
+            | ErrorCode::InvalidProposal
+            | ErrorCode::InvalidBlockTimestamp
+            | ErrorCode::Equivocation
+            | ErrorCode::DuplicateTx => RpcErrorCode::TransactionRejected,
+            ErrorCode::ExecutionFailed => RpcErrorCode::ExecutionError,
+            ErrorCode::Unavailable
+            | ErrorCode::Storage
+            | ErrorCode::Config
+            | ErrorCode::Network
+            | ErrorCode::PreBlockMissing
+            | ErrorCode::RwSetMismatch
+            | ErrorCode::SigQuorumNotReached
+            | ErrorCode::ResponseUnverified => RpcErrorCode::ServerError,
+            ErrorCode::Internal => RpcErrorCode::InternalError,
+        }
+    }
 }
 
 /// RPC operation errors
@@ -63,19 +140,75 @@ pub enum RpcError {
 
     #[error("Storage error: {0}")]
     StorageError(String),
+
+    #[error("Unauthorized: {0}")]
+    Unauthorized(String),
+
+    #[error("Limit exceeded: {0}")]
+    LimitExceeded(String),
+
+    #[error("{message}")]
+    Coded { code: ErrorCode, message: String },
 }
 
-impl From<RpcError> for jsonrpsee::types::ErrorObjectOwned {
-    fn from(err: RpcError) -> Self {
-        let (code, message) = match &err {
+impl RpcError {
+    /// Wraps an error from another crate, keeping its catalog code.
+    pub fn coded<E: ErrorCoded + std::fmt::Display>(err: &E) -> Self {
+        RpcError::Coded {
+            code: err.error_code(),
+            message: err.to_string(),
+        }
+    }
+
+    /// Returns the JSON-RPC error code and message for this error.
+    pub fn code_and_message(&self) -> (i32, String) {
+        match self {
             RpcError::InvalidParams(msg) => (RpcErrorCode::InvalidParams as i32, msg.clone()),
             RpcError::NotFound(msg) => (RpcErrorCode::ResourceNotFound as i32, msg.clone()),
             RpcError::TransactionRejected(msg) => (RpcErrorCode::TransactionRejected as i32, msg.clone()),
             RpcError::ExecutionError(msg) => (RpcErrorCode::ExecutionError as i32, msg.clone()),
             RpcError::InternalError(msg) => (RpcErrorCode::InternalError as i32, msg.clone()),
             RpcError::StorageError(msg) => (RpcErrorCode::ServerError as i32, msg.clone()),
+            RpcError::Unauthorized(msg) => (RpcErrorCode::Unauthorized as i32, msg.clone()),
+            RpcError::LimitExceeded(msg) => (RpcErrorCode::LimitExceeded as i32, msg.clone()),
+            RpcError::Coded { code, message } => {
+                (RpcErrorCode::from(*code) as i32, message.clone())
+            }
+        }
+    }
+}
+
+impl ErrorCoded for RpcError {
+    fn error_code(&self) -> ErrorCode {
+        match self {
+            RpcError::InvalidParams(_) => ErrorCode::InvalidArgument,
+            RpcError::NotFound(_) => ErrorCode::NotFound,
+            RpcError::TransactionRejected(_) => ErrorCode::Rejected,
+            RpcError::ExecutionError(_) => ErrorCode::ExecutionFailed,
+            RpcError::InternalError(_) => ErrorCode::Internal,
+            RpcError::StorageError(_) => ErrorCode::Storage,
+            RpcError::Unauthorized(_) => ErrorCode::PermissionDenied,
+            RpcError::LimitExceeded(_) => ErrorCode::Unavailable,
+            RpcError::Coded { code, .. } => *code,
+        }
+    }
+}
+
+/// Error data attached to every RPC error
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct RpcErrorData {
+    /// Stable catalog name of the error, e.g. `PRE_BLOCK_MISSING`
+    pub error_code: String,
+}
+
+impl From<RpcError> for jsonrpsee::types::ErrorObjectOwned {
+    fn from(err: RpcError) -> Self {
+        let (code, message) = err.code_and_message();
+        let data = RpcErrorData {
+            error_code: err.error_code().as_str().to_string(),
         };
-        jsonrpsee::types::ErrorObjectOwned::owned(code, message, None::<()>)
+        jsonrpsee::types::ErrorObjectOwned::owned(code, message, Some(data))
     }
 }
 
@@ -277,8 +410,13 @@ pub struct BlockResponse {
     pub transactions_root: String,
     /// State root
     pub state_root: String,
-    /// Receipts root
+    /// Hash of the block's receipt digests; zero for blocks committed
+    /// before receipts roots were recorded
     pub receipts_root: String,
+    /// Receipts chain root after the block, committing to the receipts of
+    /// every block up to it; absent where not recorded
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub receipts_chain_root: Option<String>,
     /// Miner/validator address
     pub miner: String,
     /// Difficulty
@@ -335,12 +473,20 @@ pub struct TransactionResponse {
     pub transaction_index: Option<String>,
     /// Transfer value
     pub value: String,
-    /// ECDSA recovery id
+    /// ECDSA recovery id (0 for Ed25519 and SM2)
     pub v: String,
-    /// ECDSA signature r
+    /// ECDSA signature r (Ed25519: R)
     pub r: String,
-    /// ECDSA signature s
+    /// ECDSA signature s (Ed25519: S)
     pub s: String,
+    /// Signature algorithm ("secp256k1", "ed25519" or "sm2")
+    pub signature_algorithm: String,
+    /// Hash algorithm the transaction was digested with before signing
+    pub signing_hash_algorithm: String,
+    /// Signer's public key, for Ed25519 and SM2 signatures which can't be
+    /// recovered
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub public_key: Option<String>,
 }
 
 /// Transaction receipt response
@@ -400,6 +546,541 @@ pub struct LogResponse {
     pub topics: Vec<String>,
 }
 
+/// Storage slot change between two block heights
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StateChangeResponse {
+    /// Contract address
+    pub address: String,
+    /// Storage slot
+    pub slot: String,
+    /// Hash of the value at the starting height
+    pub old_value_hash: String,
+    /// Hash of the value at the ending height
+    pub new_value_hash: String,
+    /// Value at the ending height
+    pub new_value: String,
+    /// Block that last wrote the slot
+    pub block_number: String,
+}
+
+/// A page of the slots changed between two heights, for `bach_getStateDiff`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StateDiffResponse {
+    /// Changed slots, ordered by address and then slot
+    pub changes: Vec<StateChangeResponse>,
+    /// Last slot the page covers, to pass as `after` on the next call; None
+    /// once the diff is complete
+    pub resume_token: Option<String>,
+}
+
+/// A page of state changes for `bach_getStateChanges`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StateChangesResponse {
+    /// Changes in commit order
+    pub changes: Vec<StateChangeResponse>,
+    /// Position of the last change, to pass as `after` on the next call
+    /// (the `after` given when the page is empty)
+    pub resume_token: Option<String>,
+}
+
+/// A write that changed a contract slot, from `bach_getKeyHistory`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct KeyHistoryEntryResponse {
+    /// Block that wrote the slot
+    pub block_number: String,
+    /// Transaction that last wrote the slot in the block, if known
+    pub transaction_hash: Option<String>,
+    /// Hash of the value written
+    pub value_hash: String,
+}
+
+/// Proof of a contract slot's value under the state commitment, from
+/// `bach_getStateProof`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StateProofResponse {
+    /// Block whose header extension commits to `root`
+    pub block_number: String,
+    /// State commitment root
+    pub root: String,
+    /// Key the slot is committed under
+    pub key: String,
+    /// Current value of the slot
+    pub value: String,
+    /// Hashes of the siblings on the key's path, from the root down
+    pub siblings: Vec<String>,
+    /// The only entry in the subtree the path ends in, if any
+    pub leaf: Option<StateProofLeafResponse>,
+}
+
+/// The entry a state proof's path ends in
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StateProofLeafResponse {
+    /// Key of the entry
+    pub key: String,
+    /// Hash of the entry's value
+    pub value_hash: String,
+}
+
+/// A record found through a contract index, from `bach_queryIndex`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct IndexEntryResponse {
+    /// Slot holding the record
+    pub slot: String,
+    /// Current value of the slot
+    pub value: String,
+}
+
+/// A page of index query results for `bach_queryIndex`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct IndexQueryResponse {
+    /// Records in index order
+    pub entries: Vec<IndexEntryResponse>,
+    /// Position of the last entry, to pass as `after` on the next call
+    /// (the `after` given when the page is empty)
+    pub resume_token: Option<String>,
+}
+
+/// Contract bytecode stored under a hash
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct CodeResponse {
+    /// Bytecode
+    pub code: String,
+    /// Number of accounts using this bytecode
+    pub ref_count: String,
+}
+
+/// Storage accounted to a contract
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StorageUsageResponse {
+    /// Bytes of occupied storage slots
+    pub used_bytes: String,
+    /// Per-contract quota in bytes (None if unlimited)
+    pub quota: Option<String>,
+}
+
+/// A sender's balance against the up-front cost of a transaction
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct AffordabilityResponse {
+    /// Whether the balance covers the cost
+    pub affordable: bool,
+    /// Sender balance
+    pub balance: String,
+    /// Gas limit times gas price plus value
+    pub required: String,
+    /// Amount the balance falls short by (0x0 if affordable)
+    pub shortfall: String,
+}
+
+/// A signed `bach_getKeyStatus` answer
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct KeyStatusResponse {
+    /// Key the status is for
+    pub address: String,
+    /// "good", "revoked" or "unknown"
+    pub status: String,
+    /// Nonce from the request
+    pub nonce: u64,
+    /// Responder's signature over `key_status_signing_hash`
+    pub signature: String,
+}
+
+/// Domain separator so key status answers can't be confused with other
+/// signatures.
+const KEY_STATUS_DOMAIN: &[u8] = b"bach-key-status-v1";
+
+/// Returns the hash a key status responder signs.
+pub fn key_status_signing_hash(address: &Address, status: &str, nonce: u64) -> H256 {
+    bach_crypto::keccak256_concat(&[
+        KEY_STATUS_DOMAIN,
+        address.as_bytes(),
+        status.as_bytes(),
+        &nonce.to_be_bytes(),
+    ])
+}
+
+/// Gas used by one contract method within a block
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct GasUsageResponse {
+    /// Contract address
+    pub contract: String,
+    /// Method selector (None for calls without one)
+    pub selector: Option<String>,
+    /// Number of calls
+    pub calls: String,
+    /// Total gas used
+    pub gas_used: String,
+}
+
+/// Shape of a block's transaction dependency DAG
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct DagStatsResponse {
+    /// Block number
+    pub block_number: String,
+    /// Transactions in the block
+    pub tx_count: String,
+    /// Length of the longest dependency chain
+    pub depth: String,
+    /// Most transactions that can run at once
+    pub width: String,
+    /// Average transactions per level
+    pub parallelism: f64,
+    /// Transactions that run serially
+    pub sequential_tx_count: String,
+}
+
+/// Validator-signed finality checkpoint
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct CheckpointResponse {
+    /// Checkpoint block number
+    pub block_number: String,
+    /// Hash of the checkpoint block
+    pub block_hash: String,
+    /// State root after the checkpoint block
+    pub state_root: String,
+    /// Receipts chain root after the checkpoint block
+    pub receipts_root: String,
+    /// Validator signatures over the checkpoint
+    pub signatures: Vec<CheckpointSignatureResponse>,
+}
+
+/// A validator's signature over a finality checkpoint
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct CheckpointSignatureResponse {
+    /// Signing validator
+    pub validator: String,
+    /// Signature (r + s + v)
+    pub signature: String,
+}
+
+impl From<&SignedCheckpoint> for CheckpointResponse {
+    fn from(signed: &SignedCheckpoint) -> Self {
+        Self {
+            block_number: format_u64(signed.checkpoint.height),
+            block_hash: format_h256(&signed.checkpoint.block_hash),
+            state_root: format_h256(&signed.checkpoint.state_root),
+            receipts_root: format_h256(&signed.checkpoint.receipts_root),
+            signatures: signed
+                .signatures
+                .iter()
+                .map(|s| CheckpointSignatureResponse {
+                    validator: format_address(&s.validator),
+                    signature: format_bytes(&s.signature.to_bytes()),
+                })
+                .collect(),
+        }
+    }
+}
+
+/// Gas granted by the test network faucet
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct FaucetGrantResponse {
+    /// Hash of the faucet transaction
+    pub transaction_hash: String,
+    /// Address credited
+    pub recipient: String,
+    /// Amount credited, in wei
+    pub amount: String,
+    /// Earliest unix time the recipient can be granted again
+    pub next_grant_at: String,
+}
+
+/// Result of submitting a transaction and waiting for its commit
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct SubmitResultResponse {
+    /// Transaction hash
+    pub transaction_hash: String,
+    /// Whether the transaction was committed before the wait ended
+    pub committed: bool,
+    /// Receipt with block height, index, gas used and events (None if not committed)
+    pub receipt: Option<ReceiptResponse>,
+}
+
+/// Error for one entry of a batch query
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BatchItemError {
+    /// JSON-RPC error code (see `RpcErrorCode`)
+    pub code: i32,
+    /// Error message
+    pub message: String,
+}
+
+/// One entry of a batch query response: exactly one of `result` and `error` is set
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BatchItem<T> {
+    /// The entry's result
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub result: Option<T>,
+    /// Why the entry failed
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<BatchItemError>,
+}
+
+impl<T> From<Result<T, RpcError>> for BatchItem<T> {
+    fn from(result: Result<T, RpcError>) -> Self {
+        match result {
+            Ok(value) => Self {
+                result: Some(value),
+                error: None,
+            },
+            Err(err) => {
+                let (code, message) = err.code_and_message();
+                Self {
+                    result: None,
+                    error: Some(BatchItemError { code, message }),
+                }
+            }
+        }
+    }
+}
+
+/// Result of a traced call
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct TraceCallResponse {
+    /// Whether the top-level call succeeded
+    pub success: bool,
+    /// Gas used by the top-level call
+    pub gas_used: String,
+    /// Return data
+    pub output: String,
+    /// Failure reason
+    pub error: Option<String>,
+    /// Nested calls in call order
+    pub calls: Vec<CallFrameResponse>,
+    /// Debug logs written by the contracts, in order; kept on failure
+    pub contract_logs: Vec<ContractLogResponse>,
+    /// Debug logs dropped after the per-transaction size limit
+    pub dropped_contract_logs: usize,
+}
+
+/// A debug log written by a contract through the contract log host call
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ContractLogResponse {
+    /// Contract that wrote the log
+    pub address: String,
+    /// debug, info, warn or error
+    pub level: String,
+    /// Message bytes
+    pub message: String,
+    /// Message as text, if it is valid UTF-8
+    pub text: Option<String>,
+}
+
+/// A nested call frame
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct CallFrameResponse {
+    /// Call depth (1 for calls made by the top-level contract)
+    pub depth: usize,
+    /// call, callcode, delegatecall, staticcall, create or create2
+    pub kind: String,
+    /// Calling contract
+    pub from: String,
+    /// Called or created address
+    pub to: String,
+    /// Method selector
+    pub selector: Option<String>,
+    /// Gas used by the frame
+    pub gas_used: String,
+    /// Whether the frame succeeded
+    pub success: bool,
+    /// Failure reason
+    pub error: Option<String>,
+}
+
+/// Peer reputation score
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct PeerScoreResponse {
+    /// Peer ID
+    pub peer_id: String,
+    /// Current score (0 is neutral, lower is worse)
+    pub score: i64,
+    /// Whether the peer is currently banned
+    pub banned: bool,
+}
+
+/// Banned peer
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct BannedPeerResponse {
+    /// Peer ID
+    pub peer_id: String,
+    /// Unix time (seconds) when the ban expires
+    pub until: u64,
+    /// Why the peer was banned
+    pub reason: String,
+}
+
+/// Protocol features advertised by this node and its active peers
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ClusterCapabilitiesResponse {
+    /// Nodes counted: this node and its active peers
+    pub nodes: usize,
+    /// Features this node supports
+    pub local_features: Vec<String>,
+    /// Each advertised feature and how many nodes support it
+    pub features: Vec<FeatureSupportResponse>,
+    /// Features advertised by each active peer
+    pub peers: Vec<PeerFeaturesResponse>,
+}
+
+/// Support for a protocol feature across the cluster
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct FeatureSupportResponse {
+    /// Feature name
+    pub feature: String,
+    /// Nodes advertising the feature
+    pub nodes: usize,
+    /// Whether every counted node advertises the feature
+    pub all_nodes: bool,
+}
+
+/// Protocol features a peer advertised in the handshake
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct PeerFeaturesResponse {
+    /// Peer ID
+    pub peer_id: String,
+    /// Advertised features
+    pub features: Vec<String>,
+}
+
+/// Node status snapshot
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct NodeStatusResponse {
+    /// Chain ID
+    pub chain_id: u64,
+    /// Current block height
+    pub block_height: u64,
+    /// Transactions waiting in the pool
+    pub pending_transactions: usize,
+    /// Connected peers (0 if the network is not attached)
+    pub peer_count: usize,
+    /// Currently banned peers
+    pub banned_peers: usize,
+    /// Whether the network runs with a static peer allowlist
+    pub static_topology: bool,
+    /// EVM code cache hits
+    pub code_cache_hits: u64,
+    /// EVM code cache misses
+    pub code_cache_misses: u64,
+    /// EVM code cache evictions
+    pub code_cache_evictions: u64,
+    /// Contracts currently in the EVM code cache
+    pub code_cache_entries: usize,
+}
+
+/// Node health, as served by the health probes
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct HealthResponse {
+    /// `up`, `warming_up`, `syncing`, `participating` or `degraded`
+    pub status: String,
+    /// Whether the node serves current chain data (false while warming up
+    /// or syncing)
+    pub ready: bool,
+    /// Whether the node is a validator
+    pub validator: bool,
+    /// Current block height
+    pub block_height: u64,
+    /// Blocks left to sync (0 unless syncing)
+    pub blocks_behind: u64,
+    /// Heights in a row consensus failed to gather a signature quorum for
+    pub quorum_failures: u64,
+    /// Factor by which the node slows down its block proposals after its
+    /// own blocks failed to gather a quorum (1 at full rate)
+    pub proposal_backoff: u64,
+    /// Seconds the last proposed block's timestamp was ahead of the node's
+    /// clock, negative if behind
+    #[serde(default)]
+    pub clock_drift: i64,
+    /// Proposals rejected for their timestamp
+    #[serde(default)]
+    pub timestamp_rejections: u64,
+    /// Transactions returned to the pool because the block they were
+    /// proposed in timed out
+    #[serde(default)]
+    pub requeued_txs: u64,
+    /// Blocks the startup cache warm-up still has to load (0 once done)
+    #[serde(default)]
+    pub warmup_remaining: u64,
+}
+
+/// Block sync progress
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct SyncStatusResponse {
+    /// Whether a sync is running
+    pub syncing: bool,
+    /// Head height when the current (or last) sync started
+    pub start_height: u64,
+    /// Height being synced to
+    pub target_height: u64,
+    /// Highest height whose header chain is verified
+    pub verified_height: u64,
+    /// Highest height applied
+    pub synced_height: u64,
+    /// Ranges being fetched or waiting to be applied
+    pub in_flight_ranges: u64,
+    /// Blocks fetched and not yet applied
+    pub buffered_blocks: u64,
+    /// Blocks fetched since the node started
+    pub fetched_blocks: u64,
+    /// Range fetches retried on another peer
+    pub failed_fetches: u64,
+}
+
+impl From<SyncStatus> for SyncStatusResponse {
+    fn from(status: SyncStatus) -> Self {
+        Self {
+            syncing: status.syncing,
+            start_height: status.start_height,
+            target_height: status.target_height,
+            verified_height: status.verified_height,
+            synced_height: status.synced_height,
+            in_flight_ranges: status.in_flight_ranges,
+            buffered_blocks: status.buffered_blocks,
+            fetched_blocks: status.fetched_blocks,
+            failed_fetches: status.failed_fetches,
+        }
+    }
+}
+
+/// Allowlisted peer for static topology mode
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct StaticPeerRequest {
+    /// Organization operating the node
+    pub org: String,
+    /// Node ID (32-byte hex)
+    pub node_id: String,
+    /// Address to dial (`ip:port`)
+    pub address: String,
+}
+
 // =============================================================================
 // RPC Trait Definition
 // =============================================================================
@@ -416,7 +1097,10 @@ pub trait EthApi {
     async fn send_transaction(&self, tx: CallRequest) -> RpcResult<String>;
 
     /// Executes a call without creating a transaction
-    #[method(name = "call")]
+    ///
+    /// With org isolation on, the call runs as the authenticated member;
+    /// without one, isolated contracts refuse it.
+    #[method(name = "call", with_extensions)]
     async fn call(
         &self,
         tx: CallRequest,
@@ -432,7 +1116,10 @@ pub trait EthApi {
     ) -> RpcResult<String>;
 
     /// Returns the storage value at a position
-    #[method(name = "getStorageAt")]
+    ///
+    /// Positions of an isolated contract are read in the authenticated
+    /// member's org namespace.
+    #[method(name = "getStorageAt", with_extensions)]
     async fn get_storage_at(
         &self,
         address: String,
@@ -536,6 +1223,235 @@ pub trait Web3Api {
     async fn sha3(&self, data: String) -> RpcResult<String>;
 }
 
+/// Most entries a single `bach_getTransactionsByHashes`,
+/// `bach_getBlocksByHeights`, `bach_getStateChanges` or `bach_getStateDiff`
+/// call may return
+pub const MAX_BATCH_QUERY_SIZE: usize = 1000;
+
+/// Changes returned by `bach_getStateChanges` and `bach_getStateDiff` when
+/// no limit is given
+pub const DEFAULT_STATE_CHANGES_PAGE_SIZE: usize = 100;
+
+/// Gas price submitted transactions are charged at (1 gwei)
+pub const DEFAULT_GAS_PRICE: u64 = 1_000_000_000;
+
+/// Bach namespace RPC methods (chain-specific extensions)
+#[rpc(server, namespace = "bach")]
+pub trait BachApi {
+    /// Returns the storage slots whose values changed between two block
+    /// heights, a page of `limit` slots at a time after the `after` resume
+    /// token
+    #[method(name = "getStateDiff")]
+    async fn get_state_diff(
+        &self,
+        from_block: BlockNumberOrTag,
+        to_block: BlockNumberOrTag,
+        address: Option<String>,
+        after: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<StateDiffResponse>;
+
+    /// Returns stored contract bytecode by its hash, for auditing
+    #[method(name = "getCodeByHash")]
+    async fn get_code_by_hash(&self, code_hash: String) -> RpcResult<Option<CodeResponse>>;
+
+    /// Returns the storage bytes used by a contract and the chain quota
+    #[method(name = "getStorageUsage")]
+    async fn get_storage_usage(&self, address: String) -> RpcResult<StorageUsageResponse>;
+
+    /// Executes a call without creating a transaction and returns its call tree
+    ///
+    /// Runs as the authenticated member under org isolation, as `eth_call`.
+    #[method(name = "traceCall", with_extensions)]
+    async fn trace_call(&self, tx: CallRequest) -> RpcResult<TraceCallResponse>;
+
+    /// Returns the debug logs contracts wrote during a transaction submitted
+    /// to this node
+    ///
+    /// Logs are only kept when the node enables contract log retention, and
+    /// only for the configured number of blocks.
+    #[method(name = "getContractLogs")]
+    async fn get_contract_logs(&self, tx_hash: String) -> RpcResult<Vec<ContractLogResponse>>;
+
+    /// Returns the gas used per contract method in a block
+    #[method(name = "getGasReport")]
+    async fn get_gas_report(&self, block: BlockNumberOrTag) -> RpcResult<Vec<GasUsageResponse>>;
+
+    /// Returns the transaction dependency DAG statistics of a block, or
+    /// null if the block or its DAG is unknown
+    #[method(name = "getDagStats")]
+    async fn get_dag_stats(
+        &self,
+        block: BlockNumberOrTag,
+    ) -> RpcResult<Option<DagStatsResponse>>;
+
+    /// Returns the latest finality checkpoint at or below a block, or null
+    /// if none was recorded
+    ///
+    /// The checkpoint's signatures are checked against the validator set
+    /// by the caller; a quorum of them makes the block final.
+    #[method(name = "getCheckpoint")]
+    async fn get_checkpoint(
+        &self,
+        block: BlockNumberOrTag,
+    ) -> RpcResult<Option<CheckpointResponse>>;
+
+    /// Requests gas from the test network faucet for `address`
+    ///
+    /// Fails if the chain has no faucet, or the address was granted or the
+    /// client (authenticated member, else remote address) made a request
+    /// within the current window.
+    #[method(name = "requestFaucet", with_extensions)]
+    async fn request_faucet(&self, address: String) -> RpcResult<FaucetGrantResponse>;
+
+    /// Submits a transaction and waits (bounded) for its receipt
+    ///
+    /// Returns `committed: false` if the wait ends first; the receipt can
+    /// then be fetched later with `eth_getTransactionReceipt`.
+    #[method(name = "sendTransactionWithResult")]
+    async fn send_transaction_with_result(
+        &self,
+        tx: CallRequest,
+        timeout_ms: Option<u64>,
+    ) -> RpcResult<SubmitResultResponse>;
+
+    /// Returns changes to the contract slots starting with `slot_prefix`, in
+    /// commit order, after the `after` resume token
+    ///
+    /// Clients mirroring contract state poll with the returned token; every
+    /// change is delivered at least once across restarts.
+    #[method(name = "getStateChanges")]
+    async fn get_state_changes(
+        &self,
+        address: String,
+        slot_prefix: String,
+        after: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<StateChangesResponse>;
+
+    /// Returns the writes that changed a contract slot, oldest first, after
+    /// block `after`
+    ///
+    /// Provenance clients page through a record's history by passing the
+    /// last entry's block number as `after`.
+    #[method(name = "getKeyHistory")]
+    async fn get_key_history(
+        &self,
+        address: String,
+        slot: String,
+        after: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<Vec<KeyHistoryEntryResponse>>;
+
+    /// Returns a proof of a contract slot's value under the node's state
+    /// commitment as of the latest block
+    ///
+    /// The proof verifies against the state commitment in that block's
+    /// header extension. Fails unless the node maintains the commitment.
+    #[method(name = "getStateProof")]
+    async fn get_state_proof(&self, address: String, slot: String)
+        -> RpcResult<StateProofResponse>;
+
+    /// Returns a contract's records in the order of one of its declared
+    /// indexes, from `from` through `to`, after the `after` resume token
+    ///
+    /// Bounds are values of the index's leading fields; an upper bound with
+    /// fewer values than fields covers every record starting with them.
+    #[method(name = "queryIndex")]
+    async fn query_index(
+        &self,
+        address: String,
+        index: String,
+        from: Option<Vec<serde_json::Value>>,
+        to: Option<Vec<serde_json::Value>>,
+        after: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<IndexQueryResponse>;
+
+    /// Returns committed transactions by hash, one entry per requested hash
+    ///
+    /// Entries keep the request order; a malformed or unknown hash fails
+    /// only its own entry.
+    #[method(name = "getTransactionsByHashes")]
+    async fn get_transactions_by_hashes(
+        &self,
+        hashes: Vec<String>,
+    ) -> RpcResult<Vec<BatchItem<TransactionResponse>>>;
+
+    /// Returns blocks by height, one entry per requested height
+    #[method(name = "getBlocksByHeights")]
+    async fn get_blocks_by_heights(
+        &self,
+        heights: Vec<BlockNumberOrTag>,
+        full_transactions: bool,
+    ) -> RpcResult<Vec<BatchItem<BlockResponse>>>;
+
+    /// Returns the revocation status of a member key ("good", "revoked" or
+    /// "unknown") from this node's revocation lists, for other nodes'
+    /// online checks. The answer echoes `nonce` and is signed by the node.
+    #[method(name = "getKeyStatus")]
+    async fn get_key_status(&self, address: String, nonce: u64)
+        -> RpcResult<KeyStatusResponse>;
+
+    /// Checks whether `sender` can pay for a transaction with `gas_limit`
+    /// transferring `value` at the node's gas price, so SDKs can warn
+    /// before submitting. Submission rejects the transactions this finds
+    /// unaffordable; faucet requests are admitted whatever the balance.
+    #[method(name = "checkAffordability")]
+    async fn check_affordability(
+        &self,
+        sender: String,
+        gas_limit: String,
+        value: Option<String>,
+    ) -> RpcResult<AffordabilityResponse>;
+}
+
+/// Admin namespace RPC methods (node operators only)
+///
+/// Each method requires an `AdminRole` that grants its permission: reads
+/// are open to every role, node operations need `Operator` and topology
+/// changes need `ConsensusAdmin`. Roles come from token auth, so without it
+/// every admin method is refused.
+#[rpc(server, namespace = "admin")]
+pub trait AdminApi {
+    /// Returns a snapshot of node status (read)
+    #[method(name = "nodeStatus", with_extensions)]
+    async fn node_status(&self) -> RpcResult<NodeStatusResponse>;
+
+    /// Returns the block sync progress (read)
+    #[method(name = "syncStatus", with_extensions)]
+    async fn sync_status(&self) -> RpcResult<SyncStatusResponse>;
+
+    /// Returns the scores of all tracked peers (read)
+    #[method(name = "peerScores", with_extensions)]
+    async fn peer_scores(&self) -> RpcResult<Vec<PeerScoreResponse>>;
+
+    /// Returns the currently banned peers (read)
+    #[method(name = "bannedPeers", with_extensions)]
+    async fn banned_peers(&self) -> RpcResult<Vec<BannedPeerResponse>>;
+
+    /// Returns the protocol features this node and its peers advertise, to
+    /// check a feature is supported everywhere before scheduling it (read)
+    #[method(name = "clusterCapabilities", with_extensions)]
+    async fn cluster_capabilities(&self) -> RpcResult<ClusterCapabilitiesResponse>;
+
+    /// Bans a peer for the given number of seconds (node ops)
+    #[method(name = "banPeer", with_extensions)]
+    async fn ban_peer(&self, peer_id: String, duration_secs: u64) -> RpcResult<bool>;
+
+    /// Lifts a peer ban; returns false if the peer was not banned (node ops)
+    #[method(name = "unbanPeer", with_extensions)]
+    async fn unban_peer(&self, peer_id: String) -> RpcResult<bool>;
+
+    /// Replaces the log filter, e.g. `info,bach_network=debug` (node ops)
+    #[method(name = "setLogLevel", with_extensions)]
+    async fn set_log_level(&self, filter: String) -> RpcResult<bool>;
+
+    /// Replaces the static topology allowlist (consensus)
+    #[method(name = "setPeerAllowlist", with_extensions)]
+    async fn set_peer_allowlist(&self, peers: Vec<StaticPeerRequest>) -> RpcResult<bool>;
+}
+
 // =============================================================================
 // Helper Functions
 // =============================================================================
@@ -586,6 +1502,15 @@ pub fn parse_bytes(s: &str) -> Result<Vec<u8>, RpcError> {
     hex::decode(s).map_err(|e| RpcError::InvalidParams(format!("Invalid hex data: {}", e)))
 }
 
+/// Parse hex string to PeerId
+pub fn parse_peer_id(s: &str) -> Result<PeerId, RpcError> {
+    let bytes = parse_bytes(s)?;
+    let bytes: [u8; 32] = bytes
+        .try_into()
+        .map_err(|_| RpcError::InvalidParams("Peer ID must be 32 bytes".to_string()))?;
+    Ok(PeerId::from_bytes(bytes))
+}
+
 /// Format Address as hex string
 pub fn format_address(addr: &Address) -> String {
     format!("0x{}", hex::encode(addr.as_bytes()))
@@ -645,6 +1570,62 @@ pub struct RpcConfig {
     pub cors_enabled: bool,
     /// Allowed origins for CORS
     pub cors_origins: Vec<String>,
+    /// Require signed bearer tokens (disabled if None)
+    pub token_auth: Option<TokenAuthConfig>,
+    /// Maximum transaction input size in bytes. Larger contract code must
+    /// be uploaded in chunks through the bytecode staging contract.
+    pub max_tx_data_size: usize,
+    /// Number of analyzed contracts kept in the EVM code cache
+    pub code_cache_size: usize,
+    /// Time source for timestamps and submit timeouts
+    pub clock: Arc<dyn Clock>,
+    /// Revoked member keys, refreshed by the node
+    pub revoked_keys: RevokedKeys,
+    /// Online revocation check of authenticated members (off if None)
+    pub revocation_checker: Option<Arc<RevocationChecker>>,
+    /// Signs `bach_getKeyStatus` answers (the method is refused if None)
+    pub key_status_signer: Option<PrivateKey>,
+    /// Keys `bach_getKeyStatus` reports as good unless revoked
+    pub known_keys: KnownKeys,
+    /// Persist pooled transactions so they survive a restart (off if None)
+    pub tx_pool_persistence: Option<TxPoolPersistence>,
+    /// Serve Prometheus metrics on `METRICS_PATH`
+    pub metrics_enabled: bool,
+    /// Bearer token scrapers present on `METRICS_PATH` instead of a member
+    /// token (behind token auth, if enabled, when None)
+    pub metrics_token: Option<String>,
+    /// Serve the health probes on `HEALTH_PATH` and `READY_PATH`, without
+    /// token auth
+    pub health_enabled: bool,
+    /// Blocks for which contract debug logs of submitted transactions are
+    /// kept (not kept if None)
+    pub contract_log_retention: Option<u64>,
+    /// Per-org storage namespacing of designated contracts (off if None)
+    pub org_isolation: Option<Arc<OrgIsolation>>,
+    /// Org of each account, for contract method permission checks
+    /// (restricted methods are denied to every caller if None)
+    pub org_members: Option<Arc<OrgMembers>>,
+    /// Size and rate limits and slow-request logging of method calls
+    pub interceptors: InterceptorConfig,
+}
+
+/// Bounds on the transactions persisted from the pool
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct TxPoolPersistence {
+    /// Most transactions kept on disk; later ones stay in memory only
+    pub max_txs: usize,
+    /// Transactions older than this are dropped on reload, in seconds
+    pub max_age_secs: u64,
+}
+
+impl Default for TxPoolPersistence {
+    fn default() -> Self {
+        Self {
+            max_txs: 10_000,
+            max_age_secs: 3600,
+        }
+    }
 }
 
 impl Default for RpcConfig {
@@ -657,6 +1638,22 @@ impl Default for RpcConfig {
             max_connections: 100,
             cors_enabled: true,
             cors_origins: vec!["*".to_string()],
+            token_auth: None,
+            max_tx_data_size: 64 * 1024,
+            code_cache_size: 1024,
+            clock: Arc::new(SystemClock),
+            revoked_keys: RevokedKeys::default(),
+            revocation_checker: None,
+            key_status_signer: None,
+            known_keys: KnownKeys::default(),
+            tx_pool_persistence: None,
+            metrics_enabled: true,
+            metrics_token: None,
+            health_enabled: true,
+            contract_log_retention: None,
+            org_isolation: None,
+            org_members: None,
+            interceptors: InterceptorConfig::default(),
         }
     }
 }
@@ -665,14 +1662,38 @@ impl Default for RpcConfig {
 // RPC Server Implementation
 // =============================================================================
 
-use bach_crypto::keccak256;
-use bach_evm::{call_contract, deploy_contract, EvmContext, EvmState};
-use bach_storage::Storage;
-use bach_types::Block;
-use jsonrpsee::server::{ServerBuilder, ServerHandle};
-use std::collections::HashMap;
+use bach_contracts::{
+    chain_config_address, did_registry_address, multi_sign_address, revocation_registry_address,
+    ActiveRevocationList, ChainConfigContract, ChainConfigVersion, DidRegistry, IndexSpec,
+    MultiSign, RevocationRegistry, SignedDidDocument,
+};
+use bach_crypto::{keccak256, MemberSignature, PrivateKey};
+use bach_evm::{
+    bytecode_staging_address, call_contract, contract_acl_address, create_contract,
+    execute_contract_acl, execute_faucet, execute_org_grants, execute_staging, faucet_address,
+    org_grants_address, org_slot, CallFrame, CallKind, CodeCache, ContractLog, ContractLogLevel,
+    Affordability, ContractLogs, EvmContext, EvmError, EvmState, ExecutionResult, FaucetConfig,
+    Log, OrgIsolation, OrgMembers, FAUCET_REQUEST,
+};
+use bach_network::{
+    HealthStatus, NodeHealth, PeerAllowlist, PeerId, PeerManager, RevocationChecker, StaticPeer,
+    SyncProgress, SyncStatus,
+};
+use interceptor::client_of;
+use jsonrpsee::Extensions;
+use bach_storage::{
+    CommittedTransaction, ContractLogRecord, HistoryFeature, LogsBloom, PooledTransaction,
+    Storage,
+};
+use bach_types::{Block, SignedCheckpoint, Transaction};
+use jsonrpsee::server::middleware::rpc::RpcServiceBuilder;
+use jsonrpsee::server::{
+    serve_with_graceful_shutdown, stop_channel, Methods, ServerBuilder, ServerHandle,
+};
+use std::collections::{BTreeSet, HashMap};
 use std::net::SocketAddr;
-use std::sync::{Arc, RwLock};
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::Instant;
 
 /// RPC server implementation with EVM execution support.
 pub struct RpcServer {
@@ -698,8 +1719,30 @@ pub struct RpcState {
     pub block_height: RwLock<u64>,
     /// Account nonces (managed externally in production)
     pub account_nonces: RwLock<HashMap<Address, u64>>,
+    /// Peer manager of the running network service (None until attached)
+    pub network: RwLock<Option<Arc<PeerManager>>>,
+    /// Block sync progress of the node (None until attached)
+    pub sync: RwLock<Option<Arc<SyncProgress>>>,
+    /// Chain participation health of the node (None until attached)
+    pub health: RwLock<Option<Arc<NodeHealth>>>,
+    /// Hook that replaces the node's log filter (None if not supported)
+    pub log_level: RwLock<Option<LogLevelHandle>>,
+    /// Callers waiting for transactions to be committed
+    pub tx_watcher: TxWatcher,
+    /// Time source for timestamps and timeouts
+    pub clock: Arc<dyn Clock>,
+    /// Revoked member keys; transactions from them are rejected
+    pub revoked_keys: RevokedKeys,
+    /// Admission latencies and evictions of the transaction pool
+    pub tx_pool_metrics: TxPoolMetrics,
+    /// Sparse Merkle commitment over contract storage, if the node
+    /// maintains one (None until attached)
+    pub state_tree: RwLock<Option<Arc<RwLock<SparseMerkleTree>>>>,
 }
 
+/// Applies a new log filter directive string.
+pub type LogLevelHandle = Arc<dyn Fn(&str) -> Result<(), String> + Send + Sync>;
+
 /// A transaction waiting to be included in a block.
 #[derive(Debug, Clone)]
 pub struct PendingTransaction {
@@ -721,24 +1764,326 @@ pub struct PendingTransaction {
     pub nonce: u64,
     /// Timestamp when received
     pub received_at: u64,
+    /// What executing it on submission did (None if restored from the
+    /// persisted pool)
+    pub execution: Option<TxExecution>,
+    /// Sender's signature if it was submitted signed (None: the node
+    /// signs it for an unlocked account)
+    pub signature: Option<MemberSignature>,
 }
 
-impl RpcServer {
-    /// Creates a new RPC server.
-    pub fn new(config: RpcConfig, storage: Storage, chain_id: u64) -> Self {
-        let state = Arc::new(RpcState {
-            chain_id,
-            storage,
-            pending_txs: RwLock::new(HashMap::new()),
-            evm_state: RwLock::new(EvmState::new()),
-            block_height: RwLock::new(0),
-            account_nonces: RwLock::new(HashMap::new()),
-        });
+/// What executing a transaction on submission did.
+#[derive(Debug, Clone, Default)]
+pub struct TxExecution {
+    /// Whether execution succeeded
+    pub success: bool,
+    /// Gas used; system contract calls aren't metered and use none
+    pub gas_used: u64,
+    /// Logs emitted
+    pub logs: Vec<Log>,
+    /// Accounts reached by nested calls and creates, and the contract a
+    /// creation deployed, sorted
+    pub accounts: Vec<Address>,
+}
 
+impl TxExecution {
+    fn system(success: bool, gas_used: u64) -> Self {
         Self {
-            config,
-            state,
-            handle: None,
+            success,
+            gas_used,
+            logs: Vec::new(),
+            accounts: Vec::new(),
+        }
+    }
+
+    /// Adds `account` to the accounts the transaction reached.
+    fn with_account(mut self, account: Address) -> Self {
+        if let Err(index) = self.accounts.binary_search(&account) {
+            self.accounts.insert(index, account);
+        }
+        self
+    }
+}
+
+impl From<&ExecutionResult> for TxExecution {
+    fn from(result: &ExecutionResult) -> Self {
+        Self {
+            success: result.success,
+            gas_used: result.gas_used,
+            logs: result.logs.clone(),
+            accounts: result
+                .call_trace
+                .iter()
+                .flat_map(|frame| [frame.from, frame.to])
+                .collect::<BTreeSet<_>>()
+                .into_iter()
+                .collect(),
+        }
+    }
+}
+
+impl From<&PendingTransaction> for PooledTransaction {
+    fn from(tx: &PendingTransaction) -> Self {
+        Self {
+            hash: *tx.hash.as_bytes(),
+            from: *tx.from.as_bytes(),
+            to: tx.to.map(|a| *a.as_bytes()),
+            value: tx.value.to_be_bytes(),
+            data: tx.data.clone(),
+            gas: tx.gas,
+            gas_price: tx.gas_price.to_be_bytes(),
+            nonce: tx.nonce,
+            received_at: tx.received_at,
+        }
+    }
+}
+
+impl From<&PooledTransaction> for PendingTransaction {
+    fn from(tx: &PooledTransaction) -> Self {
+        Self {
+            hash: tx.hash_h256(),
+            from: Address::from(tx.from),
+            to: tx.to.map(Address::from),
+            value: U256::from_be_bytes(tx.value),
+            data: tx.data.clone(),
+            gas: tx.gas,
+            gas_price: U256::from_be_bytes(tx.gas_price),
+            nonce: tx.nonce,
+            received_at: tx.received_at,
+            execution: None,
+            signature: None,
+        }
+    }
+}
+
+impl RpcState {
+    /// Creates the state of chain `chain_id` over `storage`: an empty pool
+    /// and EVM state at height 0 on the system clock, with nothing attached.
+    pub fn new(chain_id: u64, storage: Storage) -> Self {
+        Self {
+            chain_id,
+            storage,
+            pending_txs: RwLock::new(HashMap::new()),
+            evm_state: RwLock::new(EvmState::new()),
+            block_height: RwLock::new(0),
+            account_nonces: RwLock::new(HashMap::new()),
+            network: RwLock::new(None),
+            sync: RwLock::new(None),
+            health: RwLock::new(None),
+            log_level: RwLock::new(None),
+            tx_watcher: TxWatcher::new(),
+            clock: Arc::new(SystemClock),
+            revoked_keys: RevokedKeys::default(),
+            tx_pool_metrics: TxPoolMetrics::default(),
+            state_tree: RwLock::new(None),
+        }
+    }
+
+    /// Checks whether `sender` can pay up front for a transaction with
+    /// `gas_limit` transferring `value` at the pool's gas price.
+    pub fn affordability(&self, sender: &Address, gas_limit: u64, value: U256) -> Affordability {
+        self.evm_state.read().unwrap().check_affordability(
+            sender,
+            gas_limit,
+            U256::from_u64(DEFAULT_GAS_PRICE),
+            value,
+        )
+    }
+
+    /// Returns true if `contract` keeps its storage in per-org namespaces.
+    fn is_isolated(&self, contract: &Address) -> bool {
+        self.evm_state
+            .read()
+            .unwrap()
+            .org_isolation()
+            .is_some_and(|isolation| isolation.is_isolated(contract))
+    }
+
+    /// Refuses raw slot reads of an isolated contract, which would expose
+    /// every org's namespace.
+    fn check_not_isolated(&self, contract: &Address) -> Result<(), RpcError> {
+        if self.is_isolated(contract) {
+            return Err(RpcError::Unauthorized(format!(
+                "storage of {} is isolated per org",
+                format_address(contract)
+            )));
+        }
+        Ok(())
+    }
+
+    /// Returns the origin a read-only call with sender `from` runs as.
+    ///
+    /// Isolated contracts namespace storage by the origin's org, so under
+    /// org isolation the origin is the authenticated member, never `from`;
+    /// unauthenticated calls run as the zero address, which is in no org,
+    /// and isolated contracts refuse them.
+    fn call_origin(&self, ext: &Extensions, from: Address) -> Address {
+        if self.evm_state.read().unwrap().org_isolation().is_none() {
+            return from;
+        }
+        ext.get::<AuthenticatedMember>()
+            .map_or_else(Address::zero, |member| member.address)
+    }
+
+    /// Returns where `slot` of `contract` is stored for the caller: in the
+    /// authenticated member's org namespace if the contract is isolated.
+    fn member_slot(&self, ext: &Extensions, contract: &Address, slot: H256) -> Result<H256, RpcError> {
+        let evm_state = self.evm_state.read().unwrap();
+        let Some(isolation) = evm_state
+            .org_isolation()
+            .filter(|isolation| isolation.is_isolated(contract))
+        else {
+            return Ok(slot);
+        };
+        let member = ext.get::<AuthenticatedMember>().ok_or_else(|| {
+            RpcError::Unauthorized(format!(
+                "storage of {} is isolated per org; authenticate as a member",
+                format_address(contract)
+            ))
+        })?;
+        let org = isolation.org_of(&member.address).ok_or_else(|| {
+            RpcError::Unauthorized(format!("{} is in no org", format_address(&member.address)))
+        })?;
+        Ok(org_slot(org, &slot))
+    }
+
+    /// Fails if the data `feature` reads for `height` has been pruned.
+    fn ensure_history(&self, feature: HistoryFeature, height: u64) -> Result<(), RpcError> {
+        let available_from = self.storage.history_available_from(feature);
+        if height < available_from {
+            return Err(RpcError::NotFound(format!(
+                "{} before block {} have been pruned",
+                feature.as_str(),
+                available_from
+            )));
+        }
+        Ok(())
+    }
+
+    /// Returns the node's health; a server without attached node health
+    /// reports the process as up.
+    pub fn health(&self) -> HealthResponse {
+        let block_height = *self.block_height.read().unwrap();
+        let Some(health) = self.health.read().unwrap().clone() else {
+            return HealthResponse {
+                status: HealthStatus::Up.as_str().to_string(),
+                ready: true,
+                validator: false,
+                block_height,
+                blocks_behind: 0,
+                quorum_failures: 0,
+                proposal_backoff: 1,
+                clock_drift: 0,
+                timestamp_rejections: 0,
+                requeued_txs: 0,
+                warmup_remaining: 0,
+            };
+        };
+        let status = health.status();
+        HealthResponse {
+            status: status.as_str().to_string(),
+            ready: status.is_ready(),
+            validator: health.is_validator(),
+            block_height: block_height.max(health.head_height()),
+            blocks_behind: match status {
+                HealthStatus::Syncing { behind } => behind,
+                _ => 0,
+            },
+            quorum_failures: health.quorum_failures(),
+            proposal_backoff: health.proposal_backoff(),
+            clock_drift: health.clock_drift(),
+            timestamp_rejections: health.timestamp_rejections(),
+            requeued_txs: health.requeued_txs(),
+            warmup_remaining: health.warmup_remaining(),
+        }
+    }
+
+    /// Writes a transaction to the persisted pool before it is pooled in
+    /// memory. Once `max_txs` are persisted, further transactions are only
+    /// kept in memory.
+    pub fn persist_pending_tx(&self, tx: &PendingTransaction, persistence: &TxPoolPersistence) {
+        let transactions = &self.storage.transactions;
+        if transactions.pooled_tx_count() >= persistence.max_txs {
+            tracing::warn!(
+                "Transaction pool persistence full ({} txs), {:?} kept in memory only",
+                persistence.max_txs,
+                tx.hash
+            );
+            return;
+        }
+        if let Err(e) = transactions.put_pooled_tx(&PooledTransaction::from(tx)) {
+            tracing::warn!("Failed to persist pooled transaction {:?}: {}", tx.hash, e);
+        }
+    }
+
+    /// Reloads the persisted pool, skipping transactions that were
+    /// committed, are older than `max_age_secs` or exceed `max_txs` (oldest
+    /// first). Skipped transactions are removed from disk and sender nonces
+    /// resume after the restored ones. Returns the number restored.
+    pub fn restore_pending_txs(&self, persistence: &TxPoolPersistence) -> usize {
+        let transactions = &self.storage.transactions;
+        let now = self.clock.unix_timestamp();
+        let pooled = transactions.get_pooled_txs();
+        let overflow = pooled.len().saturating_sub(persistence.max_txs);
+
+        let mut pending = self.pending_txs.write().unwrap();
+        let mut nonces = self.account_nonces.write().unwrap();
+        let mut dropped = 0;
+        for (index, tx) in pooled.iter().enumerate() {
+            let hash = tx.hash_h256();
+            let reason = if transactions.is_committed(&hash) {
+                Some(EvictionReason::Duplicate)
+            } else if now.saturating_sub(tx.received_at) > persistence.max_age_secs {
+                Some(EvictionReason::Expired)
+            } else if index < overflow {
+                Some(EvictionReason::Quota)
+            } else {
+                None
+            };
+            if let Some(reason) = reason {
+                if let Err(e) = transactions.remove_pooled_tx(&hash) {
+                    tracing::warn!("Failed to drop pooled transaction {:?}: {}", hash, e);
+                }
+                self.tx_pool_metrics.record_evictions(reason, 1);
+                dropped += 1;
+                continue;
+            }
+            let tx = PendingTransaction::from(tx);
+            let next_nonce = nonces.entry(tx.from).or_insert(0);
+            *next_nonce = (*next_nonce).max(tx.nonce + 1);
+            pending.insert(hash, tx);
+        }
+
+        let restored = pooled.len() - dropped;
+        tracing::info!(restored, dropped, "Restored transaction pool");
+        restored
+    }
+}
+
+impl RpcServer {
+    /// Creates a new RPC server.
+    pub fn new(config: RpcConfig, storage: Storage, chain_id: u64) -> Self {
+        let code_cache = Arc::new(CodeCache::new(config.code_cache_size));
+        let state = Arc::new(RpcState {
+            evm_state: RwLock::new(
+                EvmState::new()
+                    .with_code_cache(code_cache)
+                    .with_org_isolation(config.org_isolation.clone())
+                    .with_org_members(config.org_members.clone()),
+            ),
+            tx_watcher: TxWatcher::with_clock(Arc::clone(&config.clock)),
+            clock: Arc::clone(&config.clock),
+            revoked_keys: config.revoked_keys.clone(),
+            ..RpcState::new(chain_id, storage)
+        });
+        if let Some(persistence) = &config.tx_pool_persistence {
+            state.restore_pending_txs(persistence);
+        }
+
+        Self {
+            config,
+            state,
+            handle: None,
         }
     }
 
@@ -747,24 +2092,66 @@ impl RpcServer {
         Arc::clone(&self.state)
     }
 
+    /// Attaches the network layer so peer information can be served.
+    pub fn attach_network(&self, peer_manager: Arc<PeerManager>) {
+        *self.state.network.write().unwrap() = Some(peer_manager);
+    }
+
+    /// Attaches the node's sync progress so it can be served.
+    pub fn attach_sync(&self, progress: Arc<SyncProgress>) {
+        *self.state.sync.write().unwrap() = Some(progress);
+    }
+
+    /// Attaches the node's health so it can be served.
+    pub fn attach_health(&self, health: Arc<NodeHealth>) {
+        *self.state.health.write().unwrap() = Some(health);
+    }
+
+    /// Attaches the node's state commitment so proofs can be served.
+    pub fn attach_state_tree(&self, tree: Arc<RwLock<SparseMerkleTree>>) {
+        *self.state.state_tree.write().unwrap() = Some(tree);
+    }
+
+    /// Sets the hook used by `admin_setLogLevel`.
+    pub fn set_log_level_handle(&self, handle: LogLevelHandle) {
+        *self.state.log_level.write().unwrap() = Some(handle);
+    }
+
     /// Starts the HTTP RPC server.
     pub async fn start(&mut self) -> Result<SocketAddr, RpcError> {
         let addr: SocketAddr = format!("{}:{}", self.config.http_addr, self.config.http_port)
             .parse()
             .map_err(|e| RpcError::InternalError(format!("Invalid address: {}", e)))?;
 
-        let eth_impl = EthApiImpl::new(Arc::clone(&self.state));
+        let eth_impl = EthApiImpl::new(Arc::clone(&self.state))
+            .with_max_tx_data_size(self.config.max_tx_data_size)
+            .with_pool_persistence(self.config.tx_pool_persistence)
+            .with_contract_log_retention(self.config.contract_log_retention);
         let net_impl = NetApiImpl::new(Arc::clone(&self.state));
         let web3_impl = Web3ApiImpl::new();
-
-        let server = ServerBuilder::default()
-            .max_connections(self.config.max_connections)
-            .build(addr)
-            .await
-            .map_err(|e| RpcError::InternalError(format!("Failed to build server: {}", e)))?;
-
-        let bound_addr = server.local_addr()
-            .map_err(|e| RpcError::InternalError(format!("Failed to get address: {}", e)))?;
+        let bach_impl = BachApiImpl::new(Arc::clone(&self.state))
+            .with_max_tx_data_size(self.config.max_tx_data_size)
+            .with_pool_persistence(self.config.tx_pool_persistence)
+            .with_contract_log_retention(self.config.contract_log_retention)
+            .with_key_status(
+                self.config.key_status_signer.clone(),
+                self.config.known_keys.clone(),
+            );
+        let admin_impl = AdminApiImpl::new(Arc::clone(&self.state));
+        let explorer_impl = ExplorerApiImpl::new(Arc::clone(&self.state));
+
+        let auth_layer = self.config.token_auth.as_ref().map(|auth| {
+            tracing::info!("RPC token authentication enabled for {} members", auth.members.len());
+            let layer = TokenAuthLayer::new(
+                TokenValidator::new(auth)
+                    .with_revoked(self.config.revoked_keys.clone())
+                    .with_clock(Arc::clone(&self.config.clock)),
+            );
+            match &self.config.revocation_checker {
+                Some(checker) => layer.with_revocation_checker(Arc::clone(checker)),
+                None => layer,
+            }
+        });
 
         let mut module = jsonrpsee::RpcModule::new(());
         module.merge(EthApiServer::into_rpc(eth_impl))
@@ -773,8 +2160,78 @@ impl RpcServer {
             .map_err(|e| RpcError::InternalError(format!("Failed to merge net module: {}", e)))?;
         module.merge(Web3ApiServer::into_rpc(web3_impl))
             .map_err(|e| RpcError::InternalError(format!("Failed to merge web3 module: {}", e)))?;
+        module.merge(BachApiServer::into_rpc(bach_impl))
+            .map_err(|e| RpcError::InternalError(format!("Failed to merge bach module: {}", e)))?;
+        module.merge(AdminApiServer::into_rpc(admin_impl))
+            .map_err(|e| RpcError::InternalError(format!("Failed to merge admin module: {}", e)))?;
+        module.merge(ExplorerApiServer::into_rpc(explorer_impl))
+            .map_err(|e| RpcError::InternalError(format!("Failed to merge explorer module: {}", e)))?;
+
+        let interceptor = Arc::new(
+            Interceptor::new(self.config.interceptors.clone(), Arc::clone(&self.config.clock))
+                .with_methods(module.method_names()),
+        );
+
+        let health_layer = self
+            .config
+            .health_enabled
+            .then(|| HealthLayer::new(Arc::clone(&self.state)));
+
+        let metrics_layer = self.config.metrics_enabled.then(|| {
+            MetricsLayer::new(Arc::clone(&self.state)).with_latencies(interceptor.latencies())
+        });
+        // A scrape token replaces member tokens on the metrics path;
+        // otherwise scrapes pass token auth like any other request
+        let (public_metrics, authed_metrics) = match &self.config.metrics_token {
+            Some(token) => (metrics_layer.map(|layer| layer.with_token(token)), None),
+            None => (None, metrics_layer),
+        };
+
+        let service_builder = ServerBuilder::default()
+            .max_connections(self.config.max_connections)
+            .set_http_middleware(
+                tower::ServiceBuilder::new()
+                    .option_layer(health_layer)
+                    .option_layer(public_metrics)
+                    .option_layer(auth_layer)
+                    .option_layer(authed_metrics),
+            )
+            .set_rpc_middleware(RpcServiceBuilder::new().layer(InterceptorLayer::new(interceptor)))
+            .to_service_builder();
+
+        let listener = tokio::net::TcpListener::bind(addr)
+            .await
+            .map_err(|e| RpcError::InternalError(format!("Failed to build server: {}", e)))?;
+        let bound_addr = listener.local_addr()
+            .map_err(|e| RpcError::InternalError(format!("Failed to get address: {}", e)))?;
 
-        let handle = server.start(module);
+        // Connections are accepted here rather than by the server so each
+        // request carries its remote address for per-client rate limits
+        let methods: Methods = module.into();
+        let (stop_handle, handle) = stop_channel();
+        tokio::spawn(async move {
+            loop {
+                let (socket, remote) = tokio::select! {
+                    accepted = listener.accept() => match accepted {
+                        Ok(accepted) => accepted,
+                        Err(e) => {
+                            tracing::debug!("Failed to accept RPC connection: {}", e);
+                            continue;
+                        }
+                    },
+                    _ = stop_handle.clone().shutdown() => break,
+                };
+                let service = service_builder
+                    .clone()
+                    .build(methods.clone(), stop_handle.clone());
+                let service = WithClientAddr::new(service, remote.ip());
+                tokio::spawn(serve_with_graceful_shutdown(
+                    socket,
+                    service,
+                    stop_handle.clone().shutdown(),
+                ));
+            }
+        });
         self.handle = Some(handle);
 
         tracing::info!("RPC server started on {}", bound_addr);
@@ -791,6 +2248,39 @@ impl RpcServer {
     }
 }
 
+/// Builds the context for a read-only call against the latest state.
+fn read_only_context(
+    state: &RpcState,
+    origin: Address,
+    from: Address,
+    to: Address,
+    value: U256,
+    data: Vec<u8>,
+    gas: u64,
+) -> EvmContext {
+    let block_height = *state.block_height.read().unwrap();
+    let timestamp = state.clock.unix_timestamp();
+
+    EvmContext {
+        origin,
+        caller: from,
+        address: to,
+        value,
+        data,
+        gas_limit: gas,
+        gas_price: U256::ZERO, // No gas cost for calls
+        block_number: block_height,
+        timestamp,
+        block_gas_limit: 30_000_000,
+        coinbase: Address::zero(),
+        difficulty: U256::ZERO,
+        chain_id: state.chain_id,
+        base_fee: U256::ZERO,
+        is_static: true, // calls are read-only
+        depth: 0,
+    }
+}
+
 // =============================================================================
 // EthApi Implementation
 // =============================================================================
@@ -798,76 +2288,291 @@ impl RpcServer {
 /// Implementation of EthApi trait.
 pub struct EthApiImpl {
     state: Arc<RpcState>,
+    max_tx_data_size: usize,
+    pool_persistence: Option<TxPoolPersistence>,
+    contract_log_retention: Option<u64>,
 }
 
 impl EthApiImpl {
     pub fn new(state: Arc<RpcState>) -> Self {
-        Self { state }
+        Self {
+            state,
+            max_tx_data_size: RpcConfig::default().max_tx_data_size,
+            pool_persistence: None,
+            contract_log_retention: None,
+        }
     }
-}
 
-#[jsonrpsee::core::async_trait]
-impl EthApiServer for EthApiImpl {
-    async fn send_raw_transaction(&self, data: String) -> RpcResult<String> {
-        // Parse raw transaction bytes
-        let tx_bytes = parse_bytes(&data)
-            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+    /// Sets the maximum transaction input size.
+    pub fn with_max_tx_data_size(mut self, size: usize) -> Self {
+        self.max_tx_data_size = size;
+        self
+    }
 
-        // For now, just hash the raw bytes and store as pending
-        let tx_hash = keccak256(&tx_bytes);
+    /// Persists pooled transactions within the given bounds (off if None).
+    pub fn with_pool_persistence(mut self, persistence: Option<TxPoolPersistence>) -> Self {
+        self.pool_persistence = persistence;
+        self
+    }
 
-        // TODO: Properly decode RLP-encoded signed transaction
-        // For MVP, we accept the raw data
+    /// Keeps contract debug logs of submitted transactions for the given
+    /// number of blocks (not kept if None).
+    pub fn with_contract_log_retention(mut self, blocks: Option<u64>) -> Self {
+        self.contract_log_retention = blocks;
+        self
+    }
 
-        Ok(format_h256(&tx_hash))
+    /// Stores a transaction's contract debug logs and prunes those older
+    /// than the retention window. Failures only lose debug output, so they
+    /// are logged rather than failing the transaction.
+    fn keep_contract_logs(
+        &self,
+        height: u64,
+        tx_hash: H256,
+        logs: &ContractLogs,
+        retention: u64,
+    ) {
+        let transactions = &self.state.storage.transactions;
+        if !logs.entries.is_empty() {
+            let records: Vec<_> = logs.entries.iter().map(contract_log_record).collect();
+            if let Err(e) = transactions.put_contract_logs(height, &tx_hash, &records) {
+                tracing::warn!("Failed to store contract logs of {:?}: {}", tx_hash, e);
+            }
+        }
+        if let Err(e) = transactions.prune_contract_logs(height.saturating_sub(retention)) {
+            tracing::warn!("Failed to prune contract logs: {}", e);
+        }
     }
 
-    async fn send_transaction(&self, tx: CallRequest) -> RpcResult<String> {
-        let from = tx.from_address()
-            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
-            .ok_or_else(|| jsonrpsee::types::ErrorObjectOwned::from(
-                RpcError::InvalidParams("'from' is required".to_string())
-            ))?;
+    fn check_data_size(&self, len: usize) -> Result<(), RpcError> {
+        if len > self.max_tx_data_size {
+            return Err(RpcError::InvalidParams(format!(
+                "transaction data is {} bytes, limit is {}; upload large code through the staging contract",
+                len, self.max_tx_data_size
+            )));
+        }
+        Ok(())
+    }
 
-        let to = tx.to_address()
-            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+    /// Runs a DID registry call against the recorded documents and the
+    /// pool's earlier registrations, returning the registry's change
+    /// events as the receipt's logs. Nodes run the call again when its
+    /// block commits, which is what records the document.
+    fn execute_did_call(&self, data: &[u8]) -> TxExecution {
+        let mut registry = DidRegistry::new();
+        for (did, encoded) in self.state.storage.blocks.get_did_documents() {
+            let restored = SignedDidDocument::decode(&encoded)
+                .and_then(|document| registry.restore(document));
+            if let Err(e) = restored {
+                tracing::warn!("Recorded document of {} is invalid: {}", did, e);
+            }
+        }
+        let mut pooled: Vec<(u64, u64, Vec<u8>)> = self
+            .state
+            .pending_txs
+            .read()
+            .unwrap()
+            .values()
+            .filter(|tx| tx.to == Some(did_registry_address()))
+            .filter(|tx| tx.execution.as_ref().is_some_and(|execution| execution.success))
+            .map(|tx| (tx.received_at, tx.nonce, tx.data.clone()))
+            .collect();
+        pooled.sort();
+        for (_, _, data) in pooled {
+            let _ = registry.execute(&data);
+        }
+        registry.take_logs();
 
-        let value = tx.value_u256()
-            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        match registry.execute(data) {
+            Ok(_) => TxExecution {
+                logs: registry.take_logs(),
+                ..TxExecution::system(true, 0)
+            },
+            Err(e) => {
+                tracing::warn!("DID registry call failed: {}", e);
+                TxExecution::system(false, 0)
+            }
+        }
+    }
 
-        let data = tx.input_data()
-            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+    /// Returns the chain config versions recorded in storage, None if
+    /// there are none or they can't be read.
+    fn recorded_chain_config(&self) -> Option<ChainConfigContract> {
+        let versions: Result<Vec<_>, _> = self
+            .state
+            .storage
+            .blocks
+            .get_chain_config_history()
+            .iter()
+            .map(|(_, data)| ChainConfigVersion::decode(data))
+            .collect();
+        versions.ok().and_then(ChainConfigContract::from_versions)
+    }
 
-        let gas = tx.gas_limit()
-            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
-            .unwrap_or(21000);
+    /// Returns the senders and inputs of the pooled calls to `address`
+    /// that succeeded on submission, in submission order.
+    fn pooled_calls(&self, address: Address) -> Vec<(Address, Vec<u8>)> {
+        let mut pooled: Vec<(u64, u64, Address, Vec<u8>)> = self
+            .state
+            .pending_txs
+            .read()
+            .unwrap()
+            .values()
+            .filter(|tx| tx.to == Some(address))
+            .filter(|tx| tx.execution.as_ref().is_some_and(|execution| execution.success))
+            .map(|tx| (tx.received_at, tx.nonce, tx.from, tx.data.clone()))
+            .collect();
+        pooled.sort();
+        pooled.into_iter().map(|(_, _, from, data)| (from, data)).collect()
+    }
 
-        // Get or assign nonce
-        let nonce = {
-            let mut nonces = self.state.account_nonces.write().unwrap();
-            let nonce = nonces.entry(from).or_insert(0);
-            let current = *nonce;
-            *nonce += 1;
-            current
+    /// Runs a chain config call from `from` against the recorded versions
+    /// and the pool's earlier calls, so a change the contract refuses fails
+    /// its receipt. Nodes run the call again when its block commits, which
+    /// is what records the version.
+    fn execute_config_call(&self, from: Address, data: &[u8], block_height: u64) -> TxExecution {
+        let Some(mut contract) = self.recorded_chain_config() else {
+            tracing::warn!("Chain config call failed: no chain config is recorded");
+            return TxExecution::system(false, 0);
         };
 
-        // Hash the transaction data to create tx hash
-        let mut tx_data = Vec::new();
-        tx_data.extend_from_slice(from.as_bytes());
-        if let Some(ref to_addr) = to {
-            tx_data.extend_from_slice(to_addr.as_bytes());
+        // The next block holds the call, which takes effect after it
+        let height = block_height + 2;
+        for (sender, data) in self.pooled_calls(chain_config_address()) {
+            let _ = contract.execute(&data, sender, height);
         }
-        tx_data.extend_from_slice(&value.to_be_bytes());
-        tx_data.extend_from_slice(&data);
-        tx_data.extend_from_slice(&nonce.to_be_bytes());
-        let tx_hash = keccak256(&tx_data);
 
-        // Execute the transaction
+        match contract.execute(data, from, height) {
+            Ok(_) => TxExecution::system(true, 0),
+            Err(e) => {
+                tracing::warn!("Chain config call failed: {}", e);
+                TxExecution::system(false, 0)
+            }
+        }
+    }
+
+    /// Runs a multi-sign call from `from` against the recorded proposals
+    /// and the pool's earlier calls, with the signers the recorded chain
+    /// config sets, so a vote or veto the contract refuses fails its
+    /// receipt. Nodes run the call again when its block commits.
+    fn execute_multi_sign_call(
+        &self,
+        from: Address,
+        data: &[u8],
+        block_height: u64,
+    ) -> TxExecution {
+        let height = block_height + 2;
+        let signers = self
+            .recorded_chain_config()
+            .map(|contract| contract.config_at(height).config.multi_sign_signers())
+            .unwrap_or_default();
+        let mut contract = MultiSign::with_signers(signers);
+        if let Some(recorded) = self.state.storage.blocks.get_multi_sign_proposals() {
+            if let Err(e) = contract.restore(&recorded) {
+                tracing::warn!("Recorded multi-sign proposals are invalid: {}", e);
+            }
+        }
+        for (sender, data) in self.pooled_calls(multi_sign_address()) {
+            let _ = contract.execute(&data, sender, height);
+        }
+
+        match contract.execute(data, from, height) {
+            Ok(_) => TxExecution::system(true, 0),
+            Err(e) => {
+                tracing::warn!("Multi-sign call failed: {}", e);
+                TxExecution::system(false, 0)
+            }
+        }
+    }
+
+    /// Runs a revocation registry call against the recorded lists and the
+    /// pool's earlier uploads, trusting the issuers the recorded chain
+    /// config sets, so a list from an untrusted issuer or with a bad
+    /// signature fails its receipt. Nodes run the call again when its
+    /// block commits, which is what records the list.
+    fn execute_revocation_call(&self, data: &[u8], block_height: u64) -> TxExecution {
+        let height = block_height + 2;
+        let issuers = self
+            .recorded_chain_config()
+            .map(|contract| contract.config_at(height).config.revocation_issuers())
+            .unwrap_or_default();
+        let mut registry = RevocationRegistry::new(issuers);
+        for (issuer, encoded) in self.state.storage.blocks.get_revocation_lists() {
+            let restored = ActiveRevocationList::decode(&encoded)
+                .and_then(|entry| registry.restore(entry));
+            if let Err(e) = restored {
+                tracing::warn!("Recorded revocation list of {} is invalid: {}", issuer, e);
+            }
+        }
+        for (_, data) in self.pooled_calls(revocation_registry_address()) {
+            let _ = registry.execute(&data, height);
+        }
+
+        match registry.execute(data, height) {
+            Ok(_) => TxExecution::system(true, 0),
+            Err(e) => {
+                tracing::warn!("Revocation registry call failed: {}", e);
+                TxExecution::system(false, 0)
+            }
+        }
+    }
+
+    /// Returns the faucet config if `to` is the faucet, failing if the
+    /// chain disables it.
+    fn faucet_for(&self, to: Option<Address>) -> Result<Option<FaucetConfig>, RpcError> {
+        if to != Some(faucet_address()) {
+            return Ok(None);
+        }
+        let faucet = self.state.evm_state.read().unwrap().faucet();
+        faucet.map(Some).ok_or_else(|| {
+            RpcError::TransactionRejected("the faucet is disabled on this chain".to_string())
+        })
+    }
+
+    /// Rejects a transaction its sender can't pay for up front, the check
+    /// `bach_checkAffordability` answers.
+    fn check_funds(&self, from: &Address, gas: u64, value: U256) -> Result<(), RpcError> {
+        let affordability = self.state.affordability(from, gas, value);
+        if !affordability.is_affordable() {
+            return Err(RpcError::TransactionRejected(format!(
+                "{} has {} but the transaction needs {} up front",
+                format_address(from),
+                affordability.balance,
+                affordability.required
+            )));
+        }
+        Ok(())
+    }
+
+    fn check_revoked(&self, from: &Address) -> Result<(), RpcError> {
+        if self.state.revoked_keys.contains(from) {
+            return Err(RpcError::Unauthorized(format!(
+                "{} has been revoked",
+                format_address(from)
+            )));
+        }
+        Ok(())
+    }
+
+    /// Executes a validated transaction, adds it to the pool and returns
+    /// its hash.
+    fn admit(
+        &self,
+        mut pending_tx: PendingTransaction,
+        faucet: Option<FaucetConfig>,
+        received: Instant,
+    ) -> H256 {
         let block_height = *self.state.block_height.read().unwrap();
-        let timestamp = std::time::SystemTime::now()
-            .duration_since(std::time::UNIX_EPOCH)
-            .unwrap()
-            .as_secs();
+        let PendingTransaction {
+            hash: tx_hash,
+            from,
+            to,
+            value,
+            ref data,
+            gas,
+            received_at: timestamp,
+            ..
+        } = pending_tx;
 
         let context = EvmContext {
             origin: from,
@@ -876,7 +2581,7 @@ impl EthApiServer for EthApiImpl {
             value,
             data: data.clone(),
             gas_limit: gas,
-            gas_price: U256::from_u64(1_000_000_000), // 1 gwei default
+            gas_price: U256::from_u64(DEFAULT_GAS_PRICE),
             block_number: block_height,
             timestamp,
             block_gas_limit: 30_000_000,
@@ -888,63 +2593,332 @@ impl EthApiServer for EthApiImpl {
             depth: 0,
         };
 
+        // DID registry calls read the pool, so they run before the EVM
+        // state is locked
+        let did_execution =
+            (to == Some(did_registry_address())).then(|| self.execute_did_call(&data));
+        let config_execution = (to == Some(chain_config_address()))
+            .then(|| self.execute_config_call(from, data, block_height));
+        let multi_sign_execution = (to == Some(multi_sign_address()))
+            .then(|| self.execute_multi_sign_call(from, data, block_height));
+        let revocation_execution = (to == Some(revocation_registry_address()))
+            .then(|| self.execute_revocation_call(data, block_height));
+
         // Execute based on whether this is a contract creation or call
-        {
+        let execution = {
             let mut evm_state = self.state.evm_state.write().unwrap();
+            // Changes made outside a transaction (genesis, funding) aren't
+            // this transaction's
+            evm_state.take_balance_events();
 
-            if to.is_none() && !data.is_empty() {
+            let mut execution = if to.is_none() && !data.is_empty() {
                 // Contract creation
-                match deploy_contract(&data, context, &mut evm_state) {
-                    Ok(contract_addr) => {
+                match create_contract(&data, context, &mut evm_state) {
+                    Ok((contract_addr, result)) => {
                         tracing::info!("Contract deployed at {:?}", contract_addr);
+                        TxExecution::from(&result).with_account(contract_addr)
                     }
                     Err(e) => {
                         tracing::warn!("Contract deployment failed: {:?}", e);
+                        TxExecution::system(false, gas)
+                    }
+                }
+            } else if to == Some(bytecode_staging_address()) {
+                // Chunked bytecode upload
+                match execute_staging(&data, context, &mut evm_state) {
+                    Ok(result) => match result.deployed {
+                        Some(contract_addr) => {
+                            tracing::info!("Staged contract deployed at {:?}", contract_addr);
+                            TxExecution::system(true, result.gas_used).with_account(contract_addr)
+                        }
+                        None => {
+                            tracing::debug!("Staged upload used {} gas", result.gas_used);
+                            TxExecution::system(true, result.gas_used)
+                        }
+                    },
+                    Err(e) => {
+                        tracing::warn!("Bytecode staging failed: {:?}", e);
+                        TxExecution::system(false, 0)
+                    }
+                }
+            } else if to == Some(org_grants_address()) {
+                // Cross-org read grant of an isolated contract
+                match execute_org_grants(&data, &context, &mut evm_state) {
+                    Ok(grant) => {
+                        tracing::info!(
+                            "Org {} {} org {} reads of {:?}",
+                            grant.owner,
+                            if grant.granted { "granted" } else { "revoked" },
+                            grant.grantee,
+                            grant.contract
+                        );
+                        TxExecution::system(true, 0)
+                    }
+                    Err(e) => {
+                        tracing::warn!("Org grants call failed: {:?}", e);
+                        TxExecution::system(false, 0)
+                    }
+                }
+            } else if to == Some(contract_acl_address()) {
+                // Contract install, method permission change, pause or upgrade
+                match execute_contract_acl(&data, context, &mut evm_state) {
+                    Ok(contract_addr) => {
+                        tracing::info!("Contract ACL call applied to {:?}", contract_addr);
+                        TxExecution::system(true, 0).with_account(contract_addr)
+                    }
+                    Err(e) => {
+                        tracing::warn!("Contract ACL call failed: {:?}", e);
+                        TxExecution::system(false, 0)
+                    }
+                }
+            } else if let Some(execution) = did_execution {
+                // DID document registration, recorded when the block commits
+                execution
+            } else if let Some(execution) = config_execution {
+                // Chain config call, recorded when the block commits
+                execution
+            } else if let Some(execution) = multi_sign_execution {
+                // Multi-sign proposal or vote, recorded when the block commits
+                execution
+            } else if let Some(execution) = revocation_execution {
+                // Revocation list upload, recorded when the block commits
+                execution
+            } else if let Some(faucet) = &faucet {
+                // Test network gas grant
+                match execute_faucet(&data, &context, &mut evm_state, faucet) {
+                    Ok(grant) => {
+                        tracing::info!("Faucet granted {} to {:?}", grant.amount, grant.recipient);
+                        TxExecution::system(true, 0)
+                    }
+                    Err(e) => {
+                        tracing::warn!("Faucet request failed: {:?}", e);
+                        TxExecution::system(false, 0)
                     }
                 }
-            } else if let Some(to_addr) = to {
+            } else {
                 // Contract call or value transfer
-                let code = evm_state.get_code(&to_addr);
-                if !code.is_empty() {
-                    // Contract call
-                    let result = call_contract(to_addr, &data, context, &mut evm_state);
-                    tracing::info!("Contract call result: {:?}", result);
+                let code = to.map(|to_addr| evm_state.get_code(&to_addr)).unwrap_or_default();
+                match to {
+                    Some(to_addr) if !code.is_empty() => {
+                        let result = call_contract(to_addr, &data, context, &mut evm_state);
+                        tracing::info!("Contract call result: {:?}", result);
+                        if let Some(retention) = self.contract_log_retention {
+                            let logs = &result.contract_logs;
+                            self.keep_contract_logs(block_height, tx_hash, logs, retention);
+                        }
+                        TxExecution::from(&result)
+                    }
+                    // Value transfer is implicit through EVM execution
+                    _ => TxExecution::system(true, 0),
                 }
-                // Value transfer is implicit through EVM execution
-            }
-        }
+            };
 
-        // Store as pending transaction
-        let pending_tx = PendingTransaction {
-            hash: tx_hash,
-            from,
-            to,
-            value,
-            data,
-            gas,
-            gas_price: U256::from_u64(1_000_000_000),
-            nonce,
-            received_at: timestamp,
+            // Balance changes go into the receipt as logs, like events;
+            // a failed transaction's receipt carries none
+            let dropped = evm_state.balance_events_dropped();
+            let events = evm_state.take_balance_events();
+            if execution.success {
+                if dropped > 0 {
+                    tracing::warn!("{} balance changes of {:?} not logged", dropped, tx_hash);
+                }
+                execution.logs.extend(events.iter().map(|event| event.to_log(tx_hash)));
+            }
+            execution
         };
 
+        pending_tx.execution = Some(execution);
+
+        let metrics = &self.state.tx_pool_metrics;
+        if let Some(persistence) = &self.pool_persistence {
+            self.state.persist_pending_tx(&pending_tx, persistence);
+        }
         {
             let mut pending = self.state.pending_txs.write().unwrap();
-            pending.insert(tx_hash, pending_tx);
+            if pending.insert(tx_hash, pending_tx).is_some() {
+                metrics.record_evictions(EvictionReason::Duplicate, 1);
+            }
         }
-
-        Ok(format_h256(&tx_hash))
+        metrics.record_admission(self.state.clock.now().saturating_duration_since(received));
+        tx_hash
     }
+}
 
-    async fn call(
-        &self,
-        tx: CallRequest,
-        _block: Option<BlockNumberOrTag>,
-    ) -> RpcResult<String> {
-        let from = tx.from_address()
-            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
-            .unwrap_or_else(Address::zero);
-
-        let to = tx.to_address()
+#[jsonrpsee::core::async_trait]
+impl EthApiServer for EthApiImpl {
+    async fn send_raw_transaction(&self, data: String) -> RpcResult<String> {
+        let received = self.state.clock.now();
+        let checked = (|| {
+            let tx_bytes = parse_bytes(&data)
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+            self.check_data_size(tx_bytes.len())
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+            let tx = Transaction::decode(&tx_bytes).map_err(|e| {
+                jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(format!(
+                    "invalid raw transaction: {:?}",
+                    e
+                )))
+            })?;
+
+            let tx_hash = tx.hash();
+            let from = tx.sender().map_err(|_| {
+                jsonrpsee::types::ErrorObjectOwned::from(RpcError::Coded {
+                    code: ErrorCode::InvalidTxSignature,
+                    message: format!(
+                        "transaction {} has an invalid signature",
+                        format_h256(&tx_hash)
+                    ),
+                })
+            })?;
+            if self.state.pending_txs.read().unwrap().contains_key(&tx_hash)
+                || self.state.storage.transactions.is_committed(&tx_hash)
+            {
+                return Err(jsonrpsee::types::ErrorObjectOwned::from(RpcError::Coded {
+                    code: ErrorCode::DuplicateTx,
+                    message: format!(
+                        "transaction {} was already submitted",
+                        format_h256(&tx_hash)
+                    ),
+                }));
+            }
+            self.check_revoked(&from)
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+            let faucet = self.faucet_for(tx.to)
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+            if faucet.is_none() {
+                self.check_funds(&from, tx.gas, tx.value)
+                    .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+            }
+
+            // Signed transactions carry their nonce, which must be the next one
+            {
+                let mut nonces = self.state.account_nonces.write().unwrap();
+                let next = nonces.entry(from).or_insert(0);
+                if tx.nonce != *next {
+                    return Err(jsonrpsee::types::ErrorObjectOwned::from(
+                        RpcError::TransactionRejected(format!(
+                            "nonce {} of {} is not the next one, {}",
+                            tx.nonce,
+                            format_address(&from),
+                            next
+                        )),
+                    ));
+                }
+                *next += 1;
+            }
+            Ok::<_, jsonrpsee::types::ErrorObjectOwned>((tx, tx_hash, from, faucet))
+        })();
+        self.state
+            .tx_pool_metrics
+            .record_validation(
+                self.state.clock.now().saturating_duration_since(received),
+                checked.is_ok(),
+            );
+        let (tx, tx_hash, from, faucet) = checked?;
+
+        let pending_tx = PendingTransaction {
+            hash: tx_hash,
+            from,
+            to: tx.to,
+            value: tx.value,
+            data: tx.data,
+            gas: tx.gas,
+            gas_price: U256::from_u64(DEFAULT_GAS_PRICE),
+            nonce: tx.nonce,
+            received_at: self.state.clock.unix_timestamp(),
+            execution: None,
+            signature: Some(tx.signature),
+        };
+        Ok(format_h256(&self.admit(pending_tx, faucet, received)))
+    }
+
+    async fn send_transaction(&self, tx: CallRequest) -> RpcResult<String> {
+        let received = self.state.clock.now();
+        let checked = (|| {
+            let from = tx.from_address()
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
+                .ok_or_else(|| jsonrpsee::types::ErrorObjectOwned::from(
+                    RpcError::InvalidParams("'from' is required".to_string())
+                ))?;
+            self.check_revoked(&from)
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+            let to = tx.to_address()
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+            let faucet = self.faucet_for(to)
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+            let value = tx.value_u256()
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+            let data = tx.input_data()
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+            self.check_data_size(data.len())
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+            let gas = tx.gas_limit()
+                .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
+                .unwrap_or(21000);
+            if faucet.is_none() {
+                self.check_funds(&from, gas, value)
+                    .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+            }
+            Ok::<_, jsonrpsee::types::ErrorObjectOwned>((from, to, value, data, gas, faucet))
+        })();
+        self.state
+            .tx_pool_metrics
+            .record_validation(
+                self.state.clock.now().saturating_duration_since(received),
+                checked.is_ok(),
+            );
+        let (from, to, value, data, gas, faucet) = checked?;
+
+        // Get or assign nonce
+        let nonce = {
+            let mut nonces = self.state.account_nonces.write().unwrap();
+            let nonce = nonces.entry(from).or_insert(0);
+            let current = *nonce;
+            *nonce += 1;
+            current
+        };
+
+        // Hash the transaction data to create tx hash
+        let mut tx_data = Vec::new();
+        tx_data.extend_from_slice(from.as_bytes());
+        if let Some(ref to_addr) = to {
+            tx_data.extend_from_slice(to_addr.as_bytes());
+        }
+        tx_data.extend_from_slice(&value.to_be_bytes());
+        tx_data.extend_from_slice(&data);
+        tx_data.extend_from_slice(&nonce.to_be_bytes());
+        let tx_hash = keccak256(&tx_data);
+
+        let pending_tx = PendingTransaction {
+            hash: tx_hash,
+            from,
+            to,
+            value,
+            data,
+            gas,
+            gas_price: U256::from_u64(DEFAULT_GAS_PRICE),
+            nonce,
+            received_at: self.state.clock.unix_timestamp(),
+            execution: None,
+            signature: None,
+        };
+        Ok(format_h256(&self.admit(pending_tx, faucet, received)))
+    }
+
+    async fn call(
+        &self,
+        ext: &Extensions,
+        tx: CallRequest,
+        _block: Option<BlockNumberOrTag>,
+    ) -> RpcResult<String> {
+        let from = tx.from_address()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
+            .unwrap_or_else(Address::zero);
+
+        let to = tx.to_address()
             .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
             .ok_or_else(|| jsonrpsee::types::ErrorObjectOwned::from(
                 RpcError::InvalidParams("'to' is required for eth_call".to_string())
@@ -960,30 +2934,8 @@ impl EthApiServer for EthApiImpl {
             .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
             .unwrap_or(10_000_000);
 
-        let block_height = *self.state.block_height.read().unwrap();
-        let timestamp = std::time::SystemTime::now()
-            .duration_since(std::time::UNIX_EPOCH)
-            .unwrap()
-            .as_secs();
-
-        let context = EvmContext {
-            origin: from,
-            caller: from,
-            address: to,
-            value,
-            data: data.clone(),
-            gas_limit: gas,
-            gas_price: U256::ZERO, // No gas cost for calls
-            block_number: block_height,
-            timestamp,
-            block_gas_limit: 30_000_000,
-            coinbase: Address::zero(),
-            difficulty: U256::ZERO,
-            chain_id: self.state.chain_id,
-            base_fee: U256::ZERO,
-            is_static: true, // eth_call is read-only
-            depth: 0,
-        };
+        let origin = self.state.call_origin(ext, from);
+        let context = read_only_context(&self.state, origin, from, to, value, data.clone(), gas);
 
         // Execute call on a copy of state (read-only)
         let result = {
@@ -1023,6 +2975,7 @@ impl EthApiServer for EthApiImpl {
 
     async fn get_storage_at(
         &self,
+        ext: &Extensions,
         address: String,
         position: String,
         _block: Option<BlockNumberOrTag>,
@@ -1032,6 +2985,8 @@ impl EthApiServer for EthApiImpl {
 
         let slot = parse_h256(&position)
             .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let slot = self.state.member_slot(ext, &addr, slot)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
 
         let value = {
             let evm_state = self.state.evm_state.read().unwrap();
@@ -1067,7 +3022,7 @@ impl EthApiServer for EthApiImpl {
 
         if let Some(num) = block_num {
             if let Some(block) = self.state.storage.blocks.get_block_by_height(num) {
-                return Ok(Some(block_to_response(&block, full_transactions)));
+                return Ok(Some(block_to_response(&self.state.storage, &block, full_transactions)));
             }
         }
 
@@ -1083,7 +3038,7 @@ impl EthApiServer for EthApiImpl {
             .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
 
         if let Some(block) = self.state.storage.blocks.get_block_by_hash(&block_hash) {
-            return Ok(Some(block_to_response(&block, full_transactions)));
+            return Ok(Some(block_to_response(&self.state.storage, &block, full_transactions)));
         }
 
         Ok(None)
@@ -1189,7 +3144,7 @@ impl EthApiServer for EthApiImpl {
 
     async fn gas_price(&self) -> RpcResult<String> {
         // Return a fixed gas price of 1 gwei for now
-        Ok("0x3b9aca00".to_string())
+        Ok(format_u64(DEFAULT_GAS_PRICE))
     }
 
     async fn set_balance(&self, address: String, balance: String) -> RpcResult<bool> {
@@ -1200,6 +3155,7 @@ impl EthApiServer for EthApiImpl {
 
         let mut evm_state = self.state.evm_state.write().unwrap();
         evm_state.set_balance(&addr, bal);
+        evm_state.take_balance_events();
         tracing::info!("Set balance for {:?} to {:?}", addr, bal);
         Ok(true)
     }
@@ -1231,8 +3187,11 @@ impl NetApiServer for NetApiImpl {
     }
 
     async fn peer_count(&self) -> RpcResult<String> {
-        // TODO: Get actual peer count from network layer
-        Ok("0x0".to_string())
+        let count = self.state.network.read().unwrap()
+            .as_ref()
+            .map(|peers| peers.active_count())
+            .unwrap_or(0);
+        Ok(format_u64(count as u64))
     }
 }
 
@@ -1270,278 +3229,2671 @@ impl Web3ApiServer for Web3ApiImpl {
 }
 
 // =============================================================================
-// Helper Functions for Response Conversion
+// BachApi Implementation
 // =============================================================================
 
-fn block_to_response(block: &Block, _full_transactions: bool) -> BlockResponse {
-    let hash = block.hash();
-    let tx_hash = block.transactions_hash();
-    BlockResponse {
-        number: format_u64(block.height),
-        hash: format_h256(&hash),
-        parent_hash: format_h256(&block.parent_hash),
-        nonce: "0x0000000000000000".to_string(),
-        sha3_uncles: format_h256(&H256::zero()),
-        logs_bloom: format_bytes(&[0u8; 256]),
-        transactions_root: format_h256(&tx_hash),
-        state_root: format_h256(&H256::zero()), // Block doesn't track state root
-        receipts_root: format_h256(&H256::zero()),
-        miner: format_address(&Address::zero()), // Block doesn't track proposer
-        difficulty: "0x0".to_string(),
-        total_difficulty: "0x0".to_string(),
-        extra_data: "0x".to_string(),
-        size: format_u64(0),
-        gas_limit: format_u64(30_000_000),
-        gas_used: format_u64(0),
-        timestamp: format_u64(block.timestamp),
-        transactions: TransactionsResponse::Hashes(
-            block.transactions.iter().map(|tx| format_h256(&tx.hash())).collect()
-        ),
-        uncles: Vec::new(),
-    }
+/// Implementation of BachApi trait.
+pub struct BachApiImpl {
+    state: Arc<RpcState>,
+    max_tx_data_size: usize,
+    pool_persistence: Option<TxPoolPersistence>,
+    contract_log_retention: Option<u64>,
+    key_status_signer: Option<PrivateKey>,
+    known_keys: KnownKeys,
+    /// Last faucet request time of each client
+    faucet_clients: Mutex<HashMap<String, u64>>,
 }
 
-fn receipt_to_response(receipt: &bach_storage::TransactionReceipt) -> ReceiptResponse {
-    let tx_hash = H256::from(receipt.transaction_hash);
-    let block_hash = H256::from(receipt.block_hash);
-
-    ReceiptResponse {
-        transaction_hash: format_h256(&tx_hash),
-        transaction_index: format_u64(receipt.transaction_index as u64),
-        block_hash: format_h256(&block_hash),
-        block_number: format_u64(receipt.block_number),
-        from: "0x0000000000000000000000000000000000000000".to_string(), // Not tracked
-        to: None, // Not tracked
-        cumulative_gas_used: format_u64(receipt.gas_used),
-        gas_used: format_u64(receipt.gas_used),
-        contract_address: None, // Not tracked in receipt
-        logs: receipt.logs.iter().map(|log| {
-            let log_tx_hash = H256::from(log.transaction_hash);
-            let log_address = Address::from(log.address);
-            LogResponse {
-                removed: false,
-                log_index: format_u64(log.log_index as u64),
-                transaction_index: format_u64(log.transaction_index as u64),
-                transaction_hash: format_h256(&log_tx_hash),
-                block_hash: format_h256(&block_hash),
-                block_number: format_u64(log.block_number),
-                address: format_address(&log_address),
-                data: format_bytes(&log.data),
-                topics: log.topics.iter().map(|t| format!("0x{}", hex::encode(t))).collect(),
-            }
-        }).collect(),
-        logs_bloom: format_bytes(&[0u8; 256]),
-        tx_type: "0x0".to_string(),
-        status: if receipt.status { "0x1".to_string() } else { "0x0".to_string() },
+impl BachApiImpl {
+    pub fn new(state: Arc<RpcState>) -> Self {
+        Self {
+            state,
+            max_tx_data_size: RpcConfig::default().max_tx_data_size,
+            pool_persistence: None,
+            contract_log_retention: None,
+            key_status_signer: None,
+            known_keys: KnownKeys::default(),
+            faucet_clients: Mutex::new(HashMap::new()),
+        }
     }
-}
-
-#[cfg(test)]
-mod tests {
-    use super::*;
 
-    #[test]
-    fn test_parse_address() {
-        let addr = parse_address("0x742d35Cc6634C0532925a3b844Bc9e7595f1b0E0").unwrap();
-        assert!(!addr.is_zero());
+    /// Answers key status queries about `known` keys, signed by `signer`
+    /// (refused if None).
+    pub fn with_key_status(mut self, signer: Option<PrivateKey>, known: KnownKeys) -> Self {
+        self.key_status_signer = signer;
+        self.known_keys = known;
+        self
     }
 
-    #[test]
-    fn test_parse_u256() {
-        let val = parse_u256("0x1").unwrap();
-        assert_eq!(val, U256::from_u64(1));
+    /// Sets the maximum transaction input size.
+    pub fn with_max_tx_data_size(mut self, max_tx_data_size: usize) -> Self {
+        self.max_tx_data_size = max_tx_data_size;
+        self
+    }
 
-        let val = parse_u256("0x10").unwrap();
-        assert_eq!(val, U256::from_u64(16));
+    /// Persists pooled transactions within the given bounds (off if None).
+    pub fn with_pool_persistence(mut self, persistence: Option<TxPoolPersistence>) -> Self {
+        self.pool_persistence = persistence;
+        self
+    }
 
-        let val = parse_u256("0x0").unwrap();
-        assert_eq!(val, U256::ZERO);
+    /// Keeps contract debug logs of submitted transactions for the given
+    /// number of blocks (not kept if None).
+    pub fn with_contract_log_retention(mut self, blocks: Option<u64>) -> Self {
+        self.contract_log_retention = blocks;
+        self
     }
 
-    #[test]
-    fn test_parse_u64() {
-        assert_eq!(parse_u64("0x1").unwrap(), 1);
-        assert_eq!(parse_u64("0x10").unwrap(), 16);
-        assert_eq!(parse_u64("0xff").unwrap(), 255);
+    /// Refuses a faucet request from `client` if it made one within the
+    /// window. Expired entries are dropped first, and no more than
+    /// `MAX_RATE_LIMIT_BUCKETS` clients are tracked at once.
+    fn check_faucet_client(
+        &self,
+        client: &str,
+        now: u64,
+        window_secs: u64,
+    ) -> Result<(), RpcError> {
+        let mut clients = self.faucet_clients.lock().unwrap();
+        clients.retain(|_, last| now < last.saturating_add(window_secs));
+        if let Some(last) = clients.get(client) {
+            return Err(RpcError::TransactionRejected(format!(
+                "{} requested a grant recently; try again after {}",
+                client,
+                last.saturating_add(window_secs)
+            )));
+        }
+        if clients.len() >= MAX_RATE_LIMIT_BUCKETS {
+            return Err(RpcError::TransactionRejected(
+                "too many faucet clients; try again later".to_string(),
+            ));
+        }
+        Ok(())
     }
+}
 
-    #[test]
-    fn test_parse_bytes() {
-        let bytes = parse_bytes("0x1234").unwrap();
-        assert_eq!(bytes, vec![0x12, 0x34]);
+#[jsonrpsee::core::async_trait]
+impl BachApiServer for BachApiImpl {
+    async fn get_state_diff(
+        &self,
+        from_block: BlockNumberOrTag,
+        to_block: BlockNumberOrTag,
+        address: Option<String>,
+        after: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<StateDiffResponse> {
+        let height = *self.state.block_height.read().unwrap();
 
-        let empty = parse_bytes("0x").unwrap();
-        assert!(empty.is_empty());
-    }
+        let from = from_block.to_block_number(height).ok_or_else(|| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                "pending is not a valid starting height".to_string(),
+            ))
+        })?;
+        let to = to_block.to_block_number(height).ok_or_else(|| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                "pending is not a valid ending height".to_string(),
+            ))
+        })?;
 
-    #[test]
-    fn test_format_u256() {
-        assert_eq!(format_u256(&U256::ZERO), "0x0");
-        assert_eq!(format_u256(&U256::from_u64(1)), "0x1");
-        assert_eq!(format_u256(&U256::from_u64(16)), "0x10");
-        assert_eq!(format_u256(&U256::from_u64(255)), "0xff");
-    }
+        if from > to {
+            return Err(jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                format!("fromBlock {} is after toBlock {}", from, to),
+            )));
+        }
 
-    #[test]
-    fn test_format_u64() {
-        assert_eq!(format_u64(0), "0x0");
-        assert_eq!(format_u64(1), "0x1");
-        assert_eq!(format_u64(255), "0xff");
+        self.state
+            .ensure_history(HistoryFeature::StateHistory, from.saturating_add(1))
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+
+        let address = address
+            .map(|a| parse_address(&a))
+            .transpose()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        if let Some(address) = &address {
+            self.state
+                .check_not_isolated(address)
+                .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        }
+        let after = after
+            .as_deref()
+            .map(decode_slot_position)
+            .transpose()
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let limit = limit.unwrap_or(DEFAULT_STATE_CHANGES_PAGE_SIZE);
+        if limit > MAX_BATCH_QUERY_SIZE {
+            return Err(jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                format!("limit is {}, maximum is {}", limit, MAX_BATCH_QUERY_SIZE),
+            )));
+        }
+
+        let page =
+            self.state.storage.state.get_state_diff_page(from, to, address.as_ref(), after, limit);
+        Ok(StateDiffResponse {
+            changes: page
+                .changes
+                .iter()
+                .filter(|change| !self.state.is_isolated(&Address::from(change.address)))
+                .map(state_change_to_response)
+                .collect(),
+            resume_token: page.resume.map(encode_slot_position),
+        })
     }
 
-    #[test]
-    fn test_block_number_or_tag() {
-        let latest = BlockNumberOrTag::Tag(BlockTag::Latest);
-        assert_eq!(latest.to_block_number(100), Some(100));
+    async fn get_code_by_hash(&self, code_hash: String) -> RpcResult<Option<CodeResponse>> {
+        let hash = parse_h256(&code_hash)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
 
-        let earliest = BlockNumberOrTag::Tag(BlockTag::Earliest);
-        assert_eq!(earliest.to_block_number(100), Some(0));
+        let state = &self.state.storage.state;
+        Ok(state.get_code(&hash).map(|code| CodeResponse {
+            code: format_bytes(&code),
+            ref_count: format_u64(state.code_ref_count(&hash)),
+        }))
+    }
 
-        let pending = BlockNumberOrTag::Tag(BlockTag::Pending);
-        assert_eq!(pending.to_block_number(100), None);
+    async fn get_storage_usage(&self, address: String) -> RpcResult<StorageUsageResponse> {
+        let address = parse_address(&address)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
 
-        let number = BlockNumberOrTag::Number("0x10".to_string());
-        assert_eq!(number.to_block_number(100), Some(16));
+        let state = &self.state.storage.state;
+        Ok(StorageUsageResponse {
+            used_bytes: format_u64(state.storage_usage(&address)),
+            quota: state.storage_quota().map(format_u64),
+        })
     }
 
-    #[test]
-    fn test_call_request_parsing() {
-        let req = CallRequest {
-            from: Some("0x742d35Cc6634C0532925a3b844Bc9e7595f1b0E0".to_string()),
-            to: Some("0x742d35Cc6634C0532925a3b844Bc9e7595f1b0E1".to_string()),
-            value: Some("0x1".to_string()),
-            data: Some("0x1234".to_string()),
-            gas: Some("0x5208".to_string()),
-            nonce: Some("0x1".to_string()),
-            ..Default::default()
+    async fn trace_call(&self, ext: &Extensions, tx: CallRequest) -> RpcResult<TraceCallResponse> {
+        let from = tx.from_address()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
+            .unwrap_or_else(Address::zero);
+        let to = tx.to_address()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
+            .ok_or_else(|| jsonrpsee::types::ErrorObjectOwned::from(
+                RpcError::InvalidParams("'to' is required for bach_traceCall".to_string())
+            ))?;
+        let value = tx.value_u256()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let data = tx.input_data()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let gas = tx.gas_limit()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
+            .unwrap_or(10_000_000);
+
+        let origin = self.state.call_origin(ext, from);
+        let context = read_only_context(&self.state, origin, from, to, value, data.clone(), gas);
+        let result = {
+            let mut state_copy = self.state.evm_state.read().unwrap().clone();
+            call_contract(to, &data, context, &mut state_copy)
         };
 
-        assert!(req.from_address().unwrap().is_some());
-        assert!(req.to_address().unwrap().is_some());
-        assert_eq!(req.value_u256().unwrap(), U256::from_u64(1));
-        assert_eq!(req.input_data().unwrap(), vec![0x12, 0x34]);
-        assert_eq!(req.gas_limit().unwrap(), Some(21000));
-        assert_eq!(req.nonce_u64().unwrap(), Some(1));
+        Ok(TraceCallResponse {
+            success: result.success,
+            gas_used: format_u64(result.gas_used),
+            output: format_bytes(&result.output),
+            error: result.error.map(|e| format!("{:?}", e)),
+            calls: result.call_trace.iter().map(call_frame_to_response).collect(),
+            contract_logs: result
+                .contract_logs
+                .entries
+                .iter()
+                .map(|log| contract_log_to_response(&contract_log_record(log)))
+                .collect(),
+            dropped_contract_logs: result.contract_logs.dropped,
+        })
     }
 
-    #[test]
-    fn test_rpc_state_creation() {
-        let temp_dir = tempfile::tempdir().unwrap();
-        let storage = Storage::open(temp_dir.path()).unwrap();
+    async fn get_contract_logs(&self, tx_hash: String) -> RpcResult<Vec<ContractLogResponse>> {
+        let tx_hash = parse_h256(&tx_hash).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let logs = self.state.storage.transactions.get_contract_logs(&tx_hash);
+        Ok(logs.iter().map(contract_log_to_response).collect())
+    }
 
-        let state = Arc::new(RpcState {
-            chain_id: 1,
-            storage,
-            pending_txs: RwLock::new(HashMap::new()),
-            evm_state: RwLock::new(EvmState::new()),
-            block_height: RwLock::new(0),
-            account_nonces: RwLock::new(HashMap::new()),
-        });
+    async fn get_gas_report(&self, block: BlockNumberOrTag) -> RpcResult<Vec<GasUsageResponse>> {
+        let height = *self.state.block_height.read().unwrap();
+        let block = block.to_block_number(height).ok_or_else(|| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                "pending blocks have no gas report".to_string(),
+            ))
+        })?;
+        self.state
+            .ensure_history(HistoryFeature::Receipts, block)
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
 
-        assert_eq!(state.chain_id, 1);
-        assert_eq!(*state.block_height.read().unwrap(), 0);
+        let report = self.state.storage.transactions.get_gas_report(block);
+        Ok(report.iter().map(gas_usage_to_response).collect())
     }
 
-    #[test]
+    async fn get_dag_stats(
+        &self,
+        block: BlockNumberOrTag,
+    ) -> RpcResult<Option<DagStatsResponse>> {
+        let height = *self.state.block_height.read().unwrap();
+        let block = block.to_block_number(height).ok_or_else(|| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                "pending blocks have no DAG".to_string(),
+            ))
+        })?;
+        self.state
+            .ensure_history(HistoryFeature::Receipts, block)
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+
+        Ok(self.state.storage.transactions.get_tx_dag(block).map(|dag| DagStatsResponse {
+            block_number: format_u64(block),
+            tx_count: format_u64(dag.len() as u64),
+            depth: format_u64(dag.depth() as u64),
+            width: format_u64(dag.max_width() as u64),
+            parallelism: dag.parallelism(),
+            sequential_tx_count: format_u64(dag.sequential_count() as u64),
+        }))
+    }
+
+    async fn get_checkpoint(
+        &self,
+        block: BlockNumberOrTag,
+    ) -> RpcResult<Option<CheckpointResponse>> {
+        let height = *self.state.block_height.read().unwrap();
+        let block = block.to_block_number(height).ok_or_else(|| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                "pending blocks have no checkpoint".to_string(),
+            ))
+        })?;
+
+        let checkpoint = self.state.storage.blocks.get_latest_finality_checkpoint(block);
+        Ok(checkpoint.as_ref().map(CheckpointResponse::from))
+    }
+
+    async fn request_faucet(
+        &self,
+        ext: &Extensions,
+        address: String,
+    ) -> RpcResult<FaucetGrantResponse> {
+        let recipient = parse_address(&address)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let faucet = self.state.evm_state.read().unwrap().faucet().ok_or_else(|| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::TransactionRejected(
+                "the faucet is disabled on this chain".to_string(),
+            ))
+        })?;
+        let client = client_of(ext);
+        let now = self.state.clock.unix_timestamp();
+        self.check_faucet_client(&client, now, faucet.window_secs)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        // Check the grant on a copy first; the transaction itself only logs
+        // failures
+        let mut data = vec![FAUCET_REQUEST];
+        data.extend_from_slice(recipient.as_bytes());
+        let context = read_only_context(
+            &self.state,
+            recipient,
+            recipient,
+            faucet_address(),
+            U256::ZERO,
+            data.clone(),
+            0,
+        );
+        let grant = {
+            let mut state_copy = self.state.evm_state.read().unwrap().clone();
+            execute_faucet(&data, &context, &mut state_copy, &faucet)
+        }
+        .map_err(|e| {
+            let msg = match e {
+                EvmError::FaucetRateLimited { next_grant_at } => format!(
+                    "{} was granted recently; try again after {}",
+                    format_address(&recipient),
+                    next_grant_at
+                ),
+                e => format!("faucet request failed: {:?}", e),
+            };
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::TransactionRejected(msg))
+        })?;
+
+        let eth = EthApiImpl::new(Arc::clone(&self.state))
+            .with_max_tx_data_size(self.max_tx_data_size)
+            .with_pool_persistence(self.pool_persistence)
+            .with_contract_log_retention(self.contract_log_retention);
+        let transaction_hash = eth
+            .send_transaction(CallRequest {
+                from: Some(format_address(&recipient)),
+                to: Some(format_address(&faucet_address())),
+                data: Some(format_bytes(&data)),
+                ..Default::default()
+            })
+            .await?;
+        self.faucet_clients.lock().unwrap().insert(client, now);
+
+        Ok(FaucetGrantResponse {
+            transaction_hash,
+            recipient: format_address(&grant.recipient),
+            amount: format_u256(&grant.amount),
+            next_grant_at: format_u64(grant.next_grant_at),
+        })
+    }
+
+    async fn send_transaction_with_result(
+        &self,
+        tx: CallRequest,
+        timeout_ms: Option<u64>,
+    ) -> RpcResult<SubmitResultResponse> {
+        let timeout_ms = timeout_ms.unwrap_or(DEFAULT_SUBMIT_WAIT_MS);
+        if timeout_ms > MAX_SUBMIT_WAIT_MS {
+            return Err(jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                format!("timeout is {} ms, limit is {}", timeout_ms, MAX_SUBMIT_WAIT_MS),
+            )));
+        }
+
+        let eth = EthApiImpl::new(Arc::clone(&self.state))
+            .with_max_tx_data_size(self.max_tx_data_size)
+            .with_pool_persistence(self.pool_persistence)
+            .with_contract_log_retention(self.contract_log_retention);
+        let hash = eth.send_transaction(tx).await?;
+        let tx_hash = parse_h256(&hash)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        // Watch before checking storage so a commit in between is not missed
+        let rx = self.state.tx_watcher.watch(tx_hash);
+        let receipt = match self.state.storage.transactions.get_receipt(&tx_hash) {
+            Some(receipt) => Some(receipt),
+            None => {
+                let timeout = std::time::Duration::from_millis(timeout_ms);
+                self.state.tx_watcher.wait(tx_hash, rx, timeout).await
+            }
+        };
+
+        Ok(SubmitResultResponse {
+            transaction_hash: hash,
+            committed: receipt.is_some(),
+            receipt: receipt.as_ref().map(receipt_to_response),
+        })
+    }
+
+    async fn get_state_changes(
+        &self,
+        address: String,
+        slot_prefix: String,
+        after: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<StateChangesResponse> {
+        let address = parse_address(&address).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        self.state
+            .check_not_isolated(&address)
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let slot_prefix =
+            parse_bytes(&slot_prefix).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let after = after
+            .as_deref()
+            .map(decode_change_position)
+            .transpose()
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let limit = limit.unwrap_or(DEFAULT_STATE_CHANGES_PAGE_SIZE);
+        if limit > MAX_BATCH_QUERY_SIZE {
+            return Err(jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                format!("limit is {}, maximum is {}", limit, MAX_BATCH_QUERY_SIZE),
+            )));
+        }
+
+        let page =
+            self.state.storage.state.get_state_changes(&address, &slot_prefix, after, limit);
+        let resume_token = page
+            .resume
+            .or_else(|| page.changes.last().map(|change| change.position()))
+            .or(after);
+
+        Ok(StateChangesResponse {
+            changes: page.changes.iter().map(state_change_to_response).collect(),
+            resume_token: resume_token.map(encode_change_position),
+        })
+    }
+
+    async fn get_key_history(
+        &self,
+        address: String,
+        slot: String,
+        after: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<Vec<KeyHistoryEntryResponse>> {
+        let address = parse_address(&address).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        self.state
+            .check_not_isolated(&address)
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let slot = parse_h256(&slot).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let after = after
+            .as_deref()
+            .map(parse_u64)
+            .transpose()
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let limit = limit.unwrap_or(DEFAULT_STATE_CHANGES_PAGE_SIZE);
+        if limit > MAX_BATCH_QUERY_SIZE {
+            return Err(jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                format!("limit is {}, maximum is {}", limit, MAX_BATCH_QUERY_SIZE),
+            )));
+        }
+
+        let history = self.state.storage.state.get_key_history(&address, &slot, after, limit);
+        Ok(history.iter().map(key_history_entry_to_response).collect())
+    }
+
+    async fn get_state_proof(
+        &self,
+        address: String,
+        slot: String,
+    ) -> RpcResult<StateProofResponse> {
+        let address = parse_address(&address).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        self.state
+            .check_not_isolated(&address)
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let slot = parse_h256(&slot).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let tree = self.state.state_tree.read().unwrap().clone().ok_or_else(|| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::NotFound(
+                "this node maintains no state commitment".to_string(),
+            ))
+        })?;
+
+        // The node updates the tree and commits the block under the write
+        // lock, so the tree, height and slot read here agree
+        let tree = tree.read().unwrap();
+        let key = SparseMerkleTree::storage_key(&address, &slot);
+        let proof = tree.prove(&key);
+        Ok(StateProofResponse {
+            block_number: format_u64(self.state.storage.blocks.get_block_height()),
+            root: format_h256(&tree.root()),
+            key: format_h256(&key),
+            value: format_h256(&self.state.storage.state.get_storage(&address, &slot)),
+            siblings: proof.siblings.iter().map(format_h256).collect(),
+            leaf: proof.leaf.map(|(key, value_hash)| StateProofLeafResponse {
+                key: format_h256(&key),
+                value_hash: format_h256(&value_hash),
+            }),
+        })
+    }
+
+    async fn query_index(
+        &self,
+        address: String,
+        index: String,
+        from: Option<Vec<serde_json::Value>>,
+        to: Option<Vec<serde_json::Value>>,
+        after: Option<String>,
+        limit: Option<usize>,
+    ) -> RpcResult<IndexQueryResponse> {
+        let address = parse_address(&address).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        self.state
+            .check_not_isolated(&address)
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let after = after
+            .as_deref()
+            .map(parse_bytes)
+            .transpose()
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let limit = limit.unwrap_or(DEFAULT_STATE_CHANGES_PAGE_SIZE);
+        if limit > MAX_BATCH_QUERY_SIZE {
+            return Err(jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(
+                format!("limit is {}, maximum is {}", limit, MAX_BATCH_QUERY_SIZE),
+            )));
+        }
+
+        let state = &self.state.storage.state;
+        let data = state
+            .get_index_spec(&address, &index)
+            .ok_or_else(|| {
+                RpcError::NotFound(format!("index {} of {}", index, format_address(&address)))
+            })
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let spec = IndexSpec::decode(&data)
+            .map_err(|e| RpcError::InternalError(e.to_string()))
+            .map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let encode = |values: Option<Vec<serde_json::Value>>| {
+            values
+                .map(|values| spec.encode_bound(&values))
+                .transpose()
+                .map_err(|e| RpcError::InvalidParams(e.to_string()))
+        };
+        let from = encode(from).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+        let to = encode(to).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+
+        let entries = state.scan_index(
+            &address,
+            &index,
+            from.as_deref().unwrap_or_default(),
+            to.as_deref(),
+            after.as_deref(),
+            limit,
+        );
+        let resume_token = entries.last().map(|entry| format_bytes(&entry.position()));
+
+        Ok(IndexQueryResponse {
+            entries: entries
+                .iter()
+                .map(|entry| IndexEntryResponse {
+                    slot: format_h256(&entry.slot_h256()),
+                    value: format_h256(&state.get_storage(&address, &entry.slot_h256())),
+                })
+                .collect(),
+            resume_token: resume_token.or_else(|| after.map(|after| format_bytes(&after))),
+        })
+    }
+
+    async fn get_transactions_by_hashes(
+        &self,
+        hashes: Vec<String>,
+    ) -> RpcResult<Vec<BatchItem<TransactionResponse>>> {
+        check_batch_size(hashes.len()).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+
+        let items = hashes
+            .iter()
+            .map(|hash| {
+                let tx_hash = parse_h256(hash)?;
+                self.state
+                    .storage
+                    .get_transaction(&tx_hash)
+                    .map(|committed| transaction_to_response(&committed))
+                    .ok_or_else(|| RpcError::NotFound(format!("transaction {}", hash)))
+            })
+            .map(BatchItem::from)
+            .collect();
+        Ok(items)
+    }
+
+    async fn get_blocks_by_heights(
+        &self,
+        heights: Vec<BlockNumberOrTag>,
+        full_transactions: bool,
+    ) -> RpcResult<Vec<BatchItem<BlockResponse>>> {
+        check_batch_size(heights.len()).map_err(jsonrpsee::types::ErrorObjectOwned::from)?;
+
+        let current = *self.state.block_height.read().unwrap();
+        let items = heights
+            .iter()
+            .map(|block| {
+                let height = block.to_block_number(current).ok_or_else(|| {
+                    RpcError::InvalidParams("invalid or pending block height".to_string())
+                })?;
+                self.state
+                    .storage
+                    .blocks
+                    .get_block_by_height(height)
+                    .map(|block| block_to_response(&self.state.storage, &block, full_transactions))
+                    .ok_or_else(|| RpcError::NotFound(format!("block {}", height)))
+            })
+            .map(BatchItem::from)
+            .collect();
+        Ok(items)
+    }
+
+    async fn get_key_status(&self, address: String, nonce: u64)
+        -> RpcResult<KeyStatusResponse>
+    {
+        let signer = self.key_status_signer.as_ref()
+            .ok_or_else(|| RpcError::NotFound("key status responder not enabled".to_string()))
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let address = parse_address(&address)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let status = if self.state.revoked_keys.contains(&address) {
+            "revoked"
+        } else if self.known_keys.contains(&address) {
+            "good"
+        } else {
+            "unknown"
+        };
+        let signature = signer.sign(&key_status_signing_hash(&address, status, nonce));
+        Ok(KeyStatusResponse {
+            address: format_address(&address),
+            status: status.to_string(),
+            nonce,
+            signature: format_bytes(&signature.to_bytes()),
+        })
+    }
+
+    async fn check_affordability(
+        &self,
+        sender: String,
+        gas_limit: String,
+        value: Option<String>,
+    ) -> RpcResult<AffordabilityResponse> {
+        let sender = parse_address(&sender)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let gas_limit = parse_u64(&gas_limit)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let value = value
+            .as_deref()
+            .map(parse_u256)
+            .transpose()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?
+            .unwrap_or(U256::ZERO);
+
+        let affordability = self.state.affordability(&sender, gas_limit, value);
+        Ok(AffordabilityResponse {
+            affordable: affordability.is_affordable(),
+            balance: format_u256(&affordability.balance),
+            required: format_u256(&affordability.required),
+            shortfall: format_u256(&affordability.shortfall()),
+        })
+    }
+}
+
+/// Encodes a state change position as a `bach_getStateChanges` resume token.
+fn encode_change_position((height, slot): (u64, H256)) -> String {
+    let mut token = [0u8; 40];
+    token[0..8].copy_from_slice(&height.to_be_bytes());
+    token[8..40].copy_from_slice(slot.as_bytes());
+    format_bytes(&token)
+}
+
+fn decode_change_position(token: &str) -> Result<(u64, H256), RpcError> {
+    let bytes = parse_bytes(token)?;
+    if bytes.len() != 40 {
+        return Err(RpcError::InvalidParams(format!("invalid resume token: {}", token)));
+    }
+    let height = u64::from_be_bytes(bytes[0..8].try_into().unwrap());
+    let slot = H256::from_slice(&bytes[8..40])
+        .map_err(|_| RpcError::InvalidParams(format!("invalid resume token: {}", token)))?;
+    Ok((height, slot))
+}
+
+/// Encodes an (address, slot) as a `bach_getStateDiff` resume token.
+fn encode_slot_position((address, slot): (Address, H256)) -> String {
+    format_bytes(&[address.as_bytes().as_slice(), slot.as_bytes()].concat())
+}
+
+fn decode_slot_position(token: &str) -> Result<(Address, H256), RpcError> {
+    let bytes = parse_bytes(token)?;
+    let invalid = || RpcError::InvalidParams(format!("invalid resume token: {}", token));
+    if bytes.len() != 52 {
+        return Err(invalid());
+    }
+    let address = Address::from_slice(&bytes[0..20]).map_err(|_| invalid())?;
+    let slot = H256::from_slice(&bytes[20..52]).map_err(|_| invalid())?;
+    Ok((address, slot))
+}
+
+/// Rejects batch queries larger than `MAX_BATCH_QUERY_SIZE`.
+fn check_batch_size(len: usize) -> Result<(), RpcError> {
+    if len > MAX_BATCH_QUERY_SIZE {
+        return Err(RpcError::InvalidParams(format!(
+            "batch has {} entries, maximum is {}",
+            len, MAX_BATCH_QUERY_SIZE
+        )));
+    }
+    Ok(())
+}
+
+// =============================================================================
+// AdminApi Implementation
+// =============================================================================
+
+/// Implementation of AdminApi trait.
+pub struct AdminApiImpl {
+    state: Arc<RpcState>,
+}
+
+impl AdminApiImpl {
+    pub fn new(state: Arc<RpcState>) -> Self {
+        Self { state }
+    }
+
+    /// Checks the caller's role. Requests carry no member when token auth is
+    /// disabled; they are refused, since the port may be reachable from any
+    /// browser page.
+    fn authorize(ext: &Extensions, permission: AdminPermission) -> Result<(), RpcError> {
+        let Some(member) = ext.get::<AuthenticatedMember>() else {
+            return Err(RpcError::Unauthorized(
+                "admin methods need token auth".to_string(),
+            ));
+        };
+        match member.role {
+            Some(role) if role.allows(permission) => Ok(()),
+            Some(role) => Err(RpcError::Unauthorized(format!(
+                "role {} may not perform {:?} operations",
+                role, permission
+            ))),
+            None => Err(RpcError::Unauthorized(format!(
+                "{} has no admin role",
+                member.did.clone().unwrap_or_else(|| format_address(&member.address))
+            ))),
+        }
+    }
+
+    fn peer_manager(&self) -> Result<Arc<PeerManager>, RpcError> {
+        self.state.network.read().unwrap()
+            .clone()
+            .ok_or_else(|| RpcError::NotFound("network service not attached".to_string()))
+    }
+}
+
+#[jsonrpsee::core::async_trait]
+impl AdminApiServer for AdminApiImpl {
+    async fn node_status(&self, ext: &Extensions) -> RpcResult<NodeStatusResponse> {
+        Self::authorize(ext, AdminPermission::Read)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        let network = self.state.network.read().unwrap().clone();
+        let cache = self.state.evm_state.read().unwrap()
+            .code_cache()
+            .map(|c| c.stats())
+            .unwrap_or_default();
+        Ok(NodeStatusResponse {
+            chain_id: self.state.chain_id,
+            block_height: *self.state.block_height.read().unwrap(),
+            pending_transactions: self.state.pending_txs.read().unwrap().len(),
+            peer_count: network.as_ref().map(|n| n.active_count()).unwrap_or(0),
+            banned_peers: network.as_ref().map(|n| n.scorer().banned_peers().len()).unwrap_or(0),
+            static_topology: network.as_ref().map(|n| n.is_static()).unwrap_or(false),
+            code_cache_hits: cache.hits,
+            code_cache_misses: cache.misses,
+            code_cache_evictions: cache.evictions,
+            code_cache_entries: cache.entries,
+        })
+    }
+
+    async fn sync_status(&self, ext: &Extensions) -> RpcResult<SyncStatusResponse> {
+        Self::authorize(ext, AdminPermission::Read)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let progress = self.state.sync.read().unwrap().clone()
+            .ok_or_else(|| RpcError::NotFound("sync progress not attached".to_string()))
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        Ok(progress.status().into())
+    }
+
+    async fn peer_scores(&self, ext: &Extensions) -> RpcResult<Vec<PeerScoreResponse>> {
+        Self::authorize(ext, AdminPermission::Read)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let peers = self.peer_manager()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let scorer = peers.scorer();
+
+        let mut scores: Vec<_> = scorer.scores()
+            .into_iter()
+            .map(|(id, score)| PeerScoreResponse {
+                peer_id: format_bytes(id.as_bytes()),
+                score,
+                banned: scorer.is_banned(&id),
+            })
+            .collect();
+        scores.sort_by_key(|s| s.score);
+        Ok(scores)
+    }
+
+    async fn banned_peers(&self, ext: &Extensions) -> RpcResult<Vec<BannedPeerResponse>> {
+        Self::authorize(ext, AdminPermission::Read)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let peers = self.peer_manager()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        Ok(peers.scorer().banned_peers()
+            .into_iter()
+            .map(|ban| BannedPeerResponse {
+                peer_id: format_bytes(ban.peer_id.as_bytes()),
+                until: ban.until,
+                reason: ban.reason,
+            })
+            .collect())
+    }
+
+    async fn cluster_capabilities(
+        &self,
+        ext: &Extensions,
+    ) -> RpcResult<ClusterCapabilitiesResponse> {
+        Self::authorize(ext, AdminPermission::Read)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let peers = self.peer_manager()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        let capabilities = peers.cluster_capabilities();
+        let features = capabilities.feature_counts()
+            .into_iter()
+            .map(|(feature, nodes)| FeatureSupportResponse {
+                feature: feature.to_string(),
+                nodes,
+                all_nodes: nodes == capabilities.nodes,
+            })
+            .collect();
+        Ok(ClusterCapabilitiesResponse {
+            nodes: capabilities.nodes,
+            local_features: capabilities.local.clone(),
+            features,
+            peers: capabilities.peers
+                .iter()
+                .map(|(id, features)| PeerFeaturesResponse {
+                    peer_id: format_bytes(id.as_bytes()),
+                    features: features.clone(),
+                })
+                .collect(),
+        })
+    }
+
+    async fn ban_peer(&self, ext: &Extensions, peer_id: String, duration_secs: u64) -> RpcResult<bool> {
+        Self::authorize(ext, AdminPermission::NodeOps)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let id = parse_peer_id(&peer_id)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let peers = self.peer_manager()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        peers.scorer().ban(&id, std::time::Duration::from_secs(duration_secs), "admin");
+        tracing::info!("Banned peer {} for {}s", id.short_hex(), duration_secs);
+        Ok(true)
+    }
+
+    async fn unban_peer(&self, ext: &Extensions, peer_id: String) -> RpcResult<bool> {
+        Self::authorize(ext, AdminPermission::NodeOps)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let id = parse_peer_id(&peer_id)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let peers = self.peer_manager()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        let removed = peers.scorer().unban(&id);
+        if removed {
+            tracing::info!("Unbanned peer {}", id.short_hex());
+        }
+        Ok(removed)
+    }
+
+    async fn set_log_level(&self, ext: &Extensions, filter: String) -> RpcResult<bool> {
+        Self::authorize(ext, AdminPermission::NodeOps)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let handle = self.state.log_level.read().unwrap().clone().ok_or_else(|| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::NotFound(
+                "log level control not available".to_string(),
+            ))
+        })?;
+
+        handle(&filter).map_err(|e| {
+            jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams(format!(
+                "Invalid log filter: {}",
+                e
+            )))
+        })?;
+        tracing::info!("Log filter set to {}", filter);
+        Ok(true)
+    }
+
+    async fn set_peer_allowlist(&self, ext: &Extensions, peers: Vec<StaticPeerRequest>) -> RpcResult<bool> {
+        Self::authorize(ext, AdminPermission::Consensus)
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+        let manager = self.peer_manager()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        let entries = peers
+            .iter()
+            .map(|p| {
+                let node_id = parse_peer_id(&p.node_id)?;
+                let address = p.address.parse().map_err(|e| {
+                    RpcError::InvalidParams(format!("Invalid peer address {}: {}", p.address, e))
+                })?;
+                Ok(StaticPeer::new(p.org.clone(), node_id, address))
+            })
+            .collect::<Result<Vec<_>, RpcError>>()
+            .map_err(|e| jsonrpsee::types::ErrorObjectOwned::from(e))?;
+
+        tracing::info!("Static topology allowlist replaced with {} peers", entries.len());
+        manager.set_allowlist(Some(PeerAllowlist::new(entries)));
+        Ok(true)
+    }
+}
+
+// =============================================================================
+// Helper Functions for Response Conversion
+// =============================================================================
+
+/// Builds the response for a stored block. The hash and roots come from the
+/// stored header, so they follow the chain's hash schedule.
+fn block_to_response(storage: &Storage, block: &Block, full_transactions: bool) -> BlockResponse {
+    let hash = storage
+        .blocks
+        .hash_at_height(block.height)
+        .unwrap_or_else(|| block.hash());
+    let header = storage.blocks.get_block_header(&hash);
+    let tx_hash = header
+        .as_ref()
+        .map(|header| H256::from(header.transactions_hash))
+        .unwrap_or_else(|| block.transactions_hash());
+    let state_root = header
+        .as_ref()
+        .map(|header| H256::from(header.state_root))
+        .unwrap_or_else(H256::zero);
+    let extension = storage.blocks.get_header_extension(&hash).unwrap_or_default();
+    let transactions = if full_transactions {
+        TransactionsResponse::Full(
+            block
+                .transactions
+                .iter()
+                .enumerate()
+                .map(|(index, tx)| {
+                    transaction_to_response(&CommittedTransaction {
+                        transaction: tx.clone(),
+                        block_hash: hash,
+                        block_number: block.height,
+                        transaction_index: index as u32,
+                    })
+                })
+                .collect(),
+        )
+    } else {
+        TransactionsResponse::Hashes(
+            block.transactions.iter().map(|tx| format_h256(&tx.hash())).collect(),
+        )
+    };
+    BlockResponse {
+        number: format_u64(block.height),
+        hash: format_h256(&hash),
+        parent_hash: format_h256(&block.parent_hash),
+        nonce: "0x0000000000000000".to_string(),
+        sha3_uncles: format_h256(&H256::zero()),
+        logs_bloom: format_bytes(&[0u8; 256]),
+        transactions_root: format_h256(&tx_hash),
+        state_root: format_h256(&state_root),
+        receipts_root: format_h256(
+            &extension.receipts_root.map_or_else(H256::zero, H256::from),
+        ),
+        receipts_chain_root: extension
+            .receipts_chain_root
+            .map(|root| format_h256(&H256::from(root))),
+        miner: format_address(&Address::zero()), // Block doesn't track proposer
+        difficulty: "0x0".to_string(),
+        total_difficulty: "0x0".to_string(),
+        extra_data: "0x".to_string(),
+        size: format_u64(0),
+        gas_limit: format_u64(30_000_000),
+        gas_used: format_u64(0),
+        timestamp: format_u64(block.timestamp),
+        transactions,
+        uncles: Vec::new(),
+    }
+}
+
+fn transaction_to_response(committed: &CommittedTransaction) -> TransactionResponse {
+    let tx = &committed.transaction;
+    let (v, r, s, public_key) = match &tx.signature {
+        MemberSignature::Secp256k1 { signature: sig, .. } => {
+            (sig.v() as u64, sig.r().to_vec(), sig.s().to_vec(), None)
+        }
+        MemberSignature::Ed25519 {
+            public_key,
+            signature,
+            ..
+        } => {
+            let bytes = signature.to_bytes();
+            let public_key = format_bytes(&public_key.to_bytes());
+            (0, bytes[..32].to_vec(), bytes[32..].to_vec(), Some(public_key))
+        }
+        MemberSignature::Sm2 {
+            public_key,
+            signature,
+            ..
+        } => {
+            let bytes = signature.to_bytes();
+            let public_key = format_bytes(&public_key.to_bytes());
+            (0, bytes[..32].to_vec(), bytes[32..].to_vec(), Some(public_key))
+        }
+    };
+    TransactionResponse {
+        block_hash: Some(format_h256(&committed.block_hash)),
+        block_number: Some(format_u64(committed.block_number)),
+        from: format_address(&tx.sender().unwrap_or_else(|_| Address::zero())),
+        gas: format_u64(tx.gas),
+        gas_price: format_u64(0),
+        hash: format_h256(&tx.hash()),
+        input: format_bytes(&tx.data),
+        nonce: format_u64(tx.nonce),
+        to: tx.to.as_ref().map(format_address),
+        transaction_index: Some(format_u64(committed.transaction_index as u64)),
+        value: format_u256(&tx.value),
+        v: format_u64(v),
+        r: format_bytes(&r),
+        s: format_bytes(&s),
+        signature_algorithm: tx.signature.algorithm().to_string(),
+        signing_hash_algorithm: tx.signature.hash_algorithm().to_string(),
+        public_key,
+    }
+}
+
+fn receipt_to_response(receipt: &bach_storage::TransactionReceipt) -> ReceiptResponse {
+    let tx_hash = H256::from(receipt.transaction_hash);
+    let block_hash = H256::from(receipt.block_hash);
+
+    ReceiptResponse {
+        transaction_hash: format_h256(&tx_hash),
+        transaction_index: format_u64(receipt.transaction_index as u64),
+        block_hash: format_h256(&block_hash),
+        block_number: format_u64(receipt.block_number),
+        from: "0x0000000000000000000000000000000000000000".to_string(), // Not tracked
+        to: None, // Not tracked
+        cumulative_gas_used: format_u64(receipt.gas_used),
+        gas_used: format_u64(receipt.gas_used),
+        contract_address: None, // Not tracked in receipt
+        logs: receipt.logs.iter().map(|log| {
+            let log_tx_hash = H256::from(log.transaction_hash);
+            let log_address = Address::from(log.address);
+            LogResponse {
+                removed: false,
+                log_index: format_u64(log.log_index as u64),
+                transaction_index: format_u64(log.transaction_index as u64),
+                transaction_hash: format_h256(&log_tx_hash),
+                block_hash: format_h256(&block_hash),
+                block_number: format_u64(log.block_number),
+                address: format_address(&log_address),
+                data: format_bytes(&log.data),
+                topics: log.topics.iter().map(|t| format!("0x{}", hex::encode(t))).collect(),
+            }
+        }).collect(),
+        logs_bloom: format_bytes(LogsBloom::from_logs(&receipt.logs).as_bytes()),
+        tx_type: "0x0".to_string(),
+        status: if receipt.status { "0x1".to_string() } else { "0x0".to_string() },
+    }
+}
+
+/// Converts an EVM call frame to its RPC representation.
+fn call_frame_to_response(frame: &CallFrame) -> CallFrameResponse {
+    let kind = match frame.kind {
+        CallKind::Call => "call",
+        CallKind::CallCode => "callcode",
+        CallKind::DelegateCall => "delegatecall",
+        CallKind::StaticCall => "staticcall",
+        CallKind::Create => "create",
+        CallKind::Create2 => "create2",
+    };
+    CallFrameResponse {
+        depth: frame.depth,
+        kind: kind.to_string(),
+        from: format_address(&frame.from),
+        to: format_address(&frame.to),
+        selector: frame.selector.map(|s| format_bytes(&s)),
+        gas_used: format_u64(frame.gas_used),
+        success: frame.success,
+        error: frame.error.as_ref().map(|e| format!("{:?}", e)),
+    }
+}
+
+fn gas_usage_to_response(usage: &bach_storage::GasUsage) -> GasUsageResponse {
+    GasUsageResponse {
+        contract: format_address(&usage.contract_addr()),
+        selector: usage.selector.map(|s| format_bytes(&s)),
+        calls: format_u64(usage.calls),
+        gas_used: format_u64(usage.gas_used),
+    }
+}
+
+fn state_change_to_response(change: &bach_storage::StateChange) -> StateChangeResponse {
+    StateChangeResponse {
+        address: format_address(&change.address_addr()),
+        slot: format_h256(&change.slot_h256()),
+        old_value_hash: format_h256(&H256::from(change.old_value_hash)),
+        new_value_hash: format_h256(&H256::from(change.new_value_hash)),
+        new_value: format_h256(&change.new_value_h256()),
+        block_number: format_u64(change.height),
+    }
+}
+
+fn contract_log_record(log: &ContractLog) -> ContractLogRecord {
+    ContractLogRecord {
+        address: *log.address.as_bytes(),
+        level: log.level.as_u8(),
+        message: log.message.clone(),
+    }
+}
+
+fn contract_log_to_response(record: &ContractLogRecord) -> ContractLogResponse {
+    let level = ContractLogLevel::from_u8(record.level).map_or("unknown", |level| level.as_str());
+    ContractLogResponse {
+        address: format_address(&record.address_addr()),
+        level: level.to_string(),
+        message: format_bytes(&record.message),
+        text: String::from_utf8(record.message.clone()).ok(),
+    }
+}
+
+fn key_history_entry_to_response(entry: &bach_storage::KeyHistoryEntry) -> KeyHistoryEntryResponse {
+    KeyHistoryEntryResponse {
+        block_number: format_u64(entry.height),
+        transaction_hash: entry.tx_hash_h256().map(|hash| format_h256(&hash)),
+        value_hash: format_h256(&entry.value_hash_h256()),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_evm::FeatureGates;
+
+    #[test]
+    fn test_parse_address() {
+        let addr = parse_address("0x742d35Cc6634C0532925a3b844Bc9e7595f1b0E0").unwrap();
+        assert!(!addr.is_zero());
+    }
+
+    #[test]
+    fn test_parse_u256() {
+        let val = parse_u256("0x1").unwrap();
+        assert_eq!(val, U256::from_u64(1));
+
+        let val = parse_u256("0x10").unwrap();
+        assert_eq!(val, U256::from_u64(16));
+
+        let val = parse_u256("0x0").unwrap();
+        assert_eq!(val, U256::ZERO);
+    }
+
+    #[test]
+    fn test_coded_errors_keep_catalog_code() {
+        let err = RpcError::coded(&bach_storage::StorageError::NotFound("block 7".to_string()));
+        assert_eq!(err.error_code(), ErrorCode::NotFound);
+        assert_eq!(err.code_and_message().0, RpcErrorCode::ResourceNotFound as i32);
+
+        let err = RpcError::Coded {
+            code: ErrorCode::PreBlockMissing,
+            message: "Block 6 is missing".to_string(),
+        };
+        let object = jsonrpsee::types::ErrorObjectOwned::from(err);
+        assert_eq!(object.code(), RpcErrorCode::ServerError as i32);
+        assert_eq!(object.message(), "Block 6 is missing");
+        let data: RpcErrorData = serde_json::from_str(object.data().unwrap().get()).unwrap();
+        assert_eq!(data.error_code, "PRE_BLOCK_MISSING");
+
+        let object = jsonrpsee::types::ErrorObjectOwned::from(RpcError::InvalidParams("x".into()));
+        let data: RpcErrorData = serde_json::from_str(object.data().unwrap().get()).unwrap();
+        assert_eq!(data.error_code, "INVALID_ARGUMENT");
+    }
+
+    #[test]
+    fn test_parse_u64() {
+        assert_eq!(parse_u64("0x1").unwrap(), 1);
+        assert_eq!(parse_u64("0x10").unwrap(), 16);
+        assert_eq!(parse_u64("0xff").unwrap(), 255);
+    }
+
+    #[test]
+    fn test_parse_bytes() {
+        let bytes = parse_bytes("0x1234").unwrap();
+        assert_eq!(bytes, vec![0x12, 0x34]);
+
+        let empty = parse_bytes("0x").unwrap();
+        assert!(empty.is_empty());
+    }
+
+    #[test]
+    fn test_format_u256() {
+        assert_eq!(format_u256(&U256::ZERO), "0x0");
+        assert_eq!(format_u256(&U256::from_u64(1)), "0x1");
+        assert_eq!(format_u256(&U256::from_u64(16)), "0x10");
+        assert_eq!(format_u256(&U256::from_u64(255)), "0xff");
+    }
+
+    #[test]
+    fn test_format_u64() {
+        assert_eq!(format_u64(0), "0x0");
+        assert_eq!(format_u64(1), "0x1");
+        assert_eq!(format_u64(255), "0xff");
+    }
+
+    #[test]
+    fn test_block_number_or_tag() {
+        let latest = BlockNumberOrTag::Tag(BlockTag::Latest);
+        assert_eq!(latest.to_block_number(100), Some(100));
+
+        let earliest = BlockNumberOrTag::Tag(BlockTag::Earliest);
+        assert_eq!(earliest.to_block_number(100), Some(0));
+
+        let pending = BlockNumberOrTag::Tag(BlockTag::Pending);
+        assert_eq!(pending.to_block_number(100), None);
+
+        let number = BlockNumberOrTag::Number("0x10".to_string());
+        assert_eq!(number.to_block_number(100), Some(16));
+    }
+
+    #[test]
+    fn test_call_request_parsing() {
+        let req = CallRequest {
+            from: Some("0x742d35Cc6634C0532925a3b844Bc9e7595f1b0E0".to_string()),
+            to: Some("0x742d35Cc6634C0532925a3b844Bc9e7595f1b0E1".to_string()),
+            value: Some("0x1".to_string()),
+            data: Some("0x1234".to_string()),
+            gas: Some("0x5208".to_string()),
+            nonce: Some("0x1".to_string()),
+            ..Default::default()
+        };
+
+        assert!(req.from_address().unwrap().is_some());
+        assert!(req.to_address().unwrap().is_some());
+        assert_eq!(req.value_u256().unwrap(), U256::from_u64(1));
+        assert_eq!(req.input_data().unwrap(), vec![0x12, 0x34]);
+        assert_eq!(req.gas_limit().unwrap(), Some(21000));
+        assert_eq!(req.nonce_u64().unwrap(), Some(1));
+    }
+
+    #[test]
+    fn test_rpc_state_creation() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+
+        let state = Arc::new(RpcState::new(1, storage));
+
+        assert_eq!(state.chain_id, 1);
+        assert_eq!(*state.block_height.read().unwrap(), 0);
+    }
+
+    #[test]
     fn test_evm_state_integration() {
         let temp_dir = tempfile::tempdir().unwrap();
         let storage = Storage::open(temp_dir.path()).unwrap();
 
         let state = Arc::new(RpcState {
-            chain_id: 42,
-            storage,
-            pending_txs: RwLock::new(HashMap::new()),
-            evm_state: RwLock::new(EvmState::new()),
-            block_height: RwLock::new(100),
-            account_nonces: RwLock::new(HashMap::new()),
+            block_height: RwLock::new(100),
+            ..RpcState::new(42, storage)
+        });
+
+        // Test setting and getting balance
+        let addr = Address::from([0xaa; 20]);
+        {
+            let mut evm_state = state.evm_state.write().unwrap();
+            evm_state.set_balance(&addr, U256::from_u64(1000));
+        }
+
+        {
+            let evm_state = state.evm_state.read().unwrap();
+            let balance = evm_state.get_balance(&addr);
+            assert_eq!(balance, U256::from_u64(1000));
+        }
+    }
+
+    #[test]
+    fn test_pending_transaction() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+
+        let state = Arc::new(RpcState::new(1, storage));
+
+        let tx_hash = H256::from([0x12; 32]);
+        let pending_tx = PendingTransaction {
+            hash: tx_hash,
+            from: Address::from([0xaa; 20]),
+            to: Some(Address::from([0xbb; 20])),
+            value: U256::from_u64(1000),
+            data: vec![0x12, 0x34],
+            gas: 21000,
+            gas_price: U256::from_u64(1_000_000_000),
+            nonce: 0,
+            received_at: 12345678,
+            execution: None,
+            signature: None,
+        };
+
+        {
+            let mut pending = state.pending_txs.write().unwrap();
+            pending.insert(tx_hash, pending_tx.clone());
+        }
+
+        {
+            let pending = state.pending_txs.read().unwrap();
+            assert!(pending.contains_key(&tx_hash));
+            let tx = pending.get(&tx_hash).unwrap();
+            assert_eq!(tx.nonce, 0);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_tx_pool_persists_across_restarts() {
+        use std::time::{Duration, SystemTime};
+
+        let temp_dir = tempfile::tempdir().unwrap();
+        let clock = Arc::new(bach_primitives::FakeClock::at(
+            SystemTime::UNIX_EPOCH + Duration::from_secs(1_000_000),
+        ));
+        let persistence = TxPoolPersistence {
+            max_txs: 2,
+            max_age_secs: 60,
+        };
+        let config = || RpcConfig {
+            clock: Arc::clone(&clock) as Arc<dyn Clock>,
+            tx_pool_persistence: Some(persistence),
+            ..Default::default()
+        };
+        let sender = Address::from([0x11; 20]);
+        let request = || CallRequest {
+            from: Some(format_address(&sender)),
+            to: Some(format_address(&Address::from([0x22; 20]))),
+            ..Default::default()
+        };
+
+        let hashes = {
+            let server = RpcServer::new(config(), Storage::open(temp_dir.path()).unwrap(), 1);
+            let state = server.state();
+            fund(&state, &[sender]);
+            let api = EthApiImpl::new(Arc::clone(&state)).with_pool_persistence(Some(persistence));
+            let mut hashes = Vec::new();
+            for _ in 0..2 {
+                hashes.push(parse_h256(&api.send_transaction(request()).await.unwrap()).unwrap());
+            }
+            assert_eq!(state.storage.transactions.pooled_tx_count(), 2);
+
+            // The first transaction commits, but the node stops before its
+            // pool entry is removed
+            let committed = PooledTransaction::from(&state.pending_txs.read().unwrap()[&hashes[0]]);
+            state.storage.transactions.put_receipt(&bach_storage::TransactionReceipt {
+                transaction_hash: *hashes[0].as_bytes(),
+                block_hash: [0x33; 32],
+                block_number: 1,
+                transaction_index: 0,
+                gas_used: 21000,
+                status: true,
+                logs: Vec::new(),
+            }).unwrap();
+            state.storage.transactions.put_pooled_tx(&committed).unwrap();
+
+            // Beyond max_txs transactions are pooled in memory only
+            hashes.push(parse_h256(&api.send_transaction(request()).await.unwrap()).unwrap());
+            assert_eq!(state.pending_txs.read().unwrap().len(), 3);
+            assert_eq!(state.storage.transactions.pooled_tx_count(), 2);
+            state.storage.flush().unwrap();
+            hashes
+        };
+
+        {
+            let server = RpcServer::new(config(), Storage::open(temp_dir.path()).unwrap(), 1);
+            let state = server.state();
+            let pending = state.pending_txs.read().unwrap();
+            assert_eq!(pending.keys().collect::<Vec<_>>(), vec![&hashes[1]]);
+            assert_eq!(state.account_nonces.read().unwrap()[&sender], 2);
+            assert_eq!(state.storage.transactions.pooled_tx_count(), 1);
+            state.storage.flush().unwrap();
+        }
+
+        // Expired transactions are dropped on reload
+        clock.advance(Duration::from_secs(61));
+        let server = RpcServer::new(config(), Storage::open(temp_dir.path()).unwrap(), 1);
+        assert!(server.state().pending_txs.read().unwrap().is_empty());
+        assert_eq!(server.state().storage.transactions.pooled_tx_count(), 0);
+    }
+
+    #[test]
+    fn test_account_nonce_tracking() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+
+        let state = Arc::new(RpcState::new(1, storage));
+
+        let addr = Address::from([0xcc; 20]);
+
+        // Test nonce increment
+        for expected in 0..5u64 {
+            let nonce = {
+                let mut nonces = state.account_nonces.write().unwrap();
+                let nonce = nonces.entry(addr).or_insert(0);
+                let current = *nonce;
+                *nonce += 1;
+                current
+            };
+            assert_eq!(nonce, expected);
+        }
+
+        // Verify final nonce
+        {
+            let nonces = state.account_nonces.read().unwrap();
+            assert_eq!(*nonces.get(&addr).unwrap(), 5);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_get_state_diff() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+
+        let contract = Address::from([0xaa; 20]);
+        let slot = H256::from([0x01; 32]);
+        let other = H256::from([0x03; 32]);
+        storage
+            .state
+            .apply_block_writes(
+                1,
+                &[
+                    (contract, other, H256::from([0x02; 32])),
+                    (contract, slot, H256::from([0x02; 32])),
+                ],
+            )
+            .unwrap();
+
+        let state = Arc::new(RpcState {
+            block_height: RwLock::new(1),
+            ..RpcState::new(1, storage)
+        });
+        let api = BachApiImpl::new(state);
+
+        let diff = api
+            .get_state_diff(
+                BlockNumberOrTag::Tag(BlockTag::Earliest),
+                BlockNumberOrTag::Tag(BlockTag::Latest),
+                Some(format_address(&contract)),
+                None,
+                None,
+            )
+            .await
+            .unwrap();
+        assert_eq!(diff.changes.len(), 2);
+        assert_eq!(diff.changes[0].slot, format_h256(&slot));
+        assert_eq!(diff.resume_token, None);
+
+        // One slot per page, resuming after the last
+        let mut slots = Vec::new();
+        let mut after = None;
+        loop {
+            let page = api
+                .get_state_diff(
+                    BlockNumberOrTag::Tag(BlockTag::Earliest),
+                    BlockNumberOrTag::Tag(BlockTag::Latest),
+                    None,
+                    after,
+                    Some(1),
+                )
+                .await
+                .unwrap();
+            slots.extend(page.changes.into_iter().map(|change| change.slot));
+            after = page.resume_token;
+            if after.is_none() {
+                break;
+            }
+        }
+        assert_eq!(slots, vec![format_h256(&slot), format_h256(&other)]);
+
+        let result = api
+            .get_state_diff(
+                BlockNumberOrTag::Number("0x2".to_string()),
+                BlockNumberOrTag::Number("0x1".to_string()),
+                None,
+                None,
+                None,
+            )
+            .await;
+        assert!(result.is_err());
+
+        let result = api
+            .get_state_diff(
+                BlockNumberOrTag::Tag(BlockTag::Earliest),
+                BlockNumberOrTag::Tag(BlockTag::Latest),
+                None,
+                None,
+                Some(MAX_BATCH_QUERY_SIZE + 1),
+            )
+            .await;
+        assert!(result.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_get_state_changes_resumes() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+
+        let contract = Address::from([0xaa; 20]);
+        let slots: Vec<H256> = (1..=3u8).map(|i| H256::from([i; 32])).collect();
+        for (height, slot) in slots.iter().enumerate() {
+            storage
+                .state
+                .apply_block_writes(height as u64 + 1, &[(contract, *slot, H256::from([0x09; 32]))])
+                .unwrap();
+        }
+
+        let state = Arc::new(RpcState {
+            block_height: RwLock::new(3),
+            ..RpcState::new(1, storage)
+        });
+        let api = BachApiImpl::new(state);
+        let address = format_address(&contract);
+
+        let page = api
+            .get_state_changes(address.clone(), "0x".to_string(), None, Some(2))
+            .await
+            .unwrap();
+        assert_eq!(page.changes.len(), 2);
+        assert_eq!(page.changes[1].block_number, "0x2");
+        assert_eq!(page.changes[1].new_value, format_h256(&H256::from([0x09; 32])));
+
+        let page = api
+            .get_state_changes(address.clone(), "0x".to_string(), page.resume_token, None)
+            .await
+            .unwrap();
+        assert_eq!(page.changes.len(), 1);
+        assert_eq!(page.changes[0].slot, format_h256(&slots[2]));
+
+        // An empty page hands back the same token
+        let token = page.resume_token.clone();
+        let page = api
+            .get_state_changes(address.clone(), "0x".to_string(), token.clone(), None)
+            .await
+            .unwrap();
+        assert!(page.changes.is_empty());
+        assert_eq!(page.resume_token, token);
+
+        // Prefix filtering
+        let page = api
+            .get_state_changes(address.clone(), "0x02".to_string(), None, None)
+            .await
+            .unwrap();
+        assert_eq!(page.changes.len(), 1);
+
+        assert!(api
+            .get_state_changes(address, "0x".to_string(), Some("0x01".to_string()), None)
+            .await
+            .is_err());
+    }
+
+    #[tokio::test]
+    async fn test_get_state_proof() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let contract = Address::from([0xaa; 20]);
+        let (slot, value) = (H256::from([0x01; 32]), H256::from([0x02; 32]));
+        let writes = [(contract, slot, value), (contract, value, value)];
+        storage.state.apply_block_writes(1, &writes).unwrap();
+
+        let server = RpcServer::new(RpcConfig::default(), storage, 1);
+        let api = BachApiImpl::new(server.state());
+        let (address, slot_hex) = (format_address(&contract), format_h256(&slot));
+        // Off unless the node maintains a commitment
+        assert!(api.get_state_proof(address.clone(), slot_hex.clone()).await.is_err());
+
+        let mut tree = SparseMerkleTree::new();
+        tree.apply_storage_writes(&writes);
+        let root = tree.root();
+        server.attach_state_tree(Arc::new(RwLock::new(tree)));
+        let response = api.get_state_proof(address, slot_hex).await.unwrap();
+        assert_eq!(response.root, format_h256(&root));
+        assert_eq!(response.value, format_h256(&value));
+        let proof = bach_state::StateProof {
+            siblings: response.siblings.iter().map(|s| parse_h256(s).unwrap()).collect(),
+            leaf: response.leaf.map(|leaf| {
+                (parse_h256(&leaf.key).unwrap(), parse_h256(&leaf.value_hash).unwrap())
+            }),
+        };
+        let key = parse_h256(&response.key).unwrap();
+        assert!(proof.verify(&root, &key, Some(value.as_bytes())));
+    }
+
+    #[tokio::test]
+    async fn test_get_key_history() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let contract = Address::from([0xaa; 20]);
+        let slot = H256::from([0x01; 32]);
+        let tx = H256::from([0x77; 32]);
+        for height in 1..=3u8 {
+            let writes = [(contract, slot, H256::from([height; 32]))];
+            storage.state.apply_block_writes_from(height as u64, &writes, &[tx]).unwrap();
+        }
+
+        let server = RpcServer::new(RpcConfig::default(), storage, 1);
+        let api = BachApiImpl::new(server.state());
+        let address = format_address(&contract);
+        let slot = format_h256(&slot);
+
+        let page = api.get_key_history(address.clone(), slot.clone(), None, Some(2)).await.unwrap();
+        assert_eq!(page.len(), 2);
+        assert_eq!(page[0].block_number, "0x1");
+        assert_eq!(page[0].transaction_hash, Some(format_h256(&tx)));
+        assert_eq!(page[1].value_hash, format_h256(&keccak256(&[0x02; 32])));
+
+        let after = Some(page[1].block_number.clone());
+        let rest = api.get_key_history(address.clone(), slot.clone(), after, None).await.unwrap();
+        assert_eq!(rest.len(), 1);
+        assert_eq!(rest[0].block_number, "0x3");
+
+        assert!(api
+            .get_key_history(address, slot, None, Some(MAX_BATCH_QUERY_SIZE + 1))
+            .await
+            .is_err());
+    }
+
+    #[tokio::test]
+    async fn test_query_index() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let contract = Address::from([0xaa; 20]);
+        let spec = IndexSpec::new("by_age", vec![bach_contracts::IndexField::number("age")]);
+        storage.state.put_index_spec(&contract, "by_age", &spec.encode()).unwrap();
+        for (n, age) in [(1u8, 40u64), (2, 25), (3, 61), (4, 40)] {
+            let slot = H256::from([n; 32]);
+            let record = serde_json::to_vec(&serde_json::json!({ "age": age })).unwrap();
+            let index_key = spec.index_key(&record);
+            storage
+                .state
+                .update_index_entry(&contract, "by_age", &slot, index_key.as_deref())
+                .unwrap();
+            storage.state.apply_block_writes(1, &[(contract, slot, H256::from([n; 32]))]).unwrap();
+        }
+
+        let server = RpcServer::new(RpcConfig::default(), storage, 1);
+        let api = BachApiImpl::new(server.state());
+        let address = format_address(&contract);
+        let bound = |age: u64| Some(vec![serde_json::json!(age)]);
+
+        let page = api
+            .query_index(address.clone(), "by_age".to_string(), bound(30), bound(61), None, Some(2))
+            .await
+            .unwrap();
+        let slot = |n: u8| format_h256(&H256::from([n; 32]));
+        let slots: Vec<String> = page.entries.iter().map(|entry| entry.slot.clone()).collect();
+        assert_eq!(slots, vec![slot(1), slot(4)]);
+        assert_eq!(page.entries[1].value, format_h256(&H256::from([4u8; 32])));
+
+        let by_age = "by_age".to_string();
+        let rest = api
+            .query_index(address.clone(), by_age, bound(30), bound(61), page.resume_token, None)
+            .await
+            .unwrap();
+        assert_eq!(rest.entries.len(), 1);
+        assert_eq!(rest.entries[0].slot, slot(3));
+
+        let all = api.query_index(address.clone(), "by_age".to_string(), None, None, None, None);
+        assert_eq!(all.await.unwrap().entries.len(), 4);
+        let wrong_kind = Some(vec![serde_json::json!("forty")]);
+        assert!(api
+            .query_index(address.clone(), "by_age".to_string(), wrong_kind, None, None, None)
+            .await
+            .is_err());
+        assert!(api
+            .query_index(address, "by_name".to_string(), None, None, None, None)
+            .await
+            .is_err());
+    }
+
+    #[tokio::test]
+    async fn test_get_code_by_hash() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let code = vec![0x60, 0x01, 0x00];
+        let hash = storage
+            .state
+            .set_account_code(&Address::from([0xaa; 20]), &code)
+            .unwrap();
+
+        let state = Arc::new(RpcState::new(1, storage));
+        let api = BachApiImpl::new(state);
+
+        let found = api.get_code_by_hash(format_h256(&hash)).await.unwrap().unwrap();
+        assert_eq!(found.code, format_bytes(&code));
+        assert_eq!(found.ref_count, "0x1");
+
+        let missing = api.get_code_by_hash(format_h256(&H256::from([0x01; 32]))).await.unwrap();
+        assert!(missing.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_trace_call() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let a = Address::from([0xaa; 20]);
+        let b = Address::from([0xbb; 20]);
+
+        let mut evm_state = EvmState::new();
+        // B reverts, A calls B without arguments
+        evm_state.set_code(&b, vec![0x60, 0x00, 0x60, 0x00, 0xfd]);
+        let mut code_a = vec![0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x73];
+        code_a.extend_from_slice(b.as_bytes());
+        code_a.extend_from_slice(&[0x61, 0xff, 0xff, 0xf1, 0x00]);
+        evm_state.set_code(&a, code_a);
+
+        let state = Arc::new(RpcState {
+            evm_state: RwLock::new(evm_state),
+            ..RpcState::new(1, storage)
         });
+        let api = BachApiImpl::new(state);
 
-        // Test setting and getting balance
-        let addr = Address::from([0xaa; 20]);
-        {
-            let mut evm_state = state.evm_state.write().unwrap();
-            evm_state.set_balance(&addr, U256::from_u64(1000));
+        let trace = api
+            .trace_call(&Extensions::new(), CallRequest {
+                to: Some(format_address(&a)),
+                ..Default::default()
+            })
+            .await
+            .unwrap();
+        assert!(trace.success);
+        assert_eq!(trace.calls.len(), 1);
+        assert_eq!(trace.calls[0].kind, "call");
+        assert_eq!(trace.calls[0].to, format_address(&b));
+        assert!(!trace.calls[0].success);
+        assert!(trace.calls[0].selector.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_contract_logs() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let contract = Address::from([0xaa; 20]);
+        let from = Address::from([0xcc; 20]);
+
+        // Writes an info log "hi" through the contract log host call
+        let mut evm_state = EvmState::new().with_feature_gates(Arc::new(FeatureGates::all()));
+        let mut code = vec![0x62, 0x01, b'h', b'i', 0x60, 0x00, 0x52];
+        code.extend_from_slice(&[0x60, 0x00, 0x60, 0x00, 0x60, 0x03, 0x60, 0x1d, 0x60, 0x00]);
+        code.extend_from_slice(&[0x61, 0x01, 0x09, 0x61, 0xff, 0xff, 0xf1, 0x00]);
+        evm_state.set_code(&contract, code);
+
+        let state = Arc::new(RpcState {
+            evm_state: RwLock::new(evm_state),
+            block_height: RwLock::new(1),
+            ..RpcState::new(1, storage)
+        });
+        fund(&state, &[from]);
+        let call = CallRequest {
+            from: Some(format_address(&from)),
+            to: Some(format_address(&contract)),
+            ..Default::default()
+        };
+
+        // Dry runs return the logs
+        let bach = BachApiImpl::new(Arc::clone(&state));
+        let trace = bach.trace_call(&Extensions::new(), call.clone()).await.unwrap();
+        assert!(trace.success);
+        assert_eq!(trace.contract_logs.len(), 1);
+        assert_eq!(trace.contract_logs[0].address, format_address(&contract));
+        assert_eq!(trace.contract_logs[0].level, "info");
+        assert_eq!(trace.contract_logs[0].text.as_deref(), Some("hi"));
+        assert_eq!(trace.dropped_contract_logs, 0);
+
+        // Submitted transactions keep them only when retention is on
+        let eth = EthApiImpl::new(Arc::clone(&state));
+        let hash = eth.send_transaction(call.clone()).await.unwrap();
+        assert!(bach.get_contract_logs(hash).await.unwrap().is_empty());
+
+        let eth = EthApiImpl::new(Arc::clone(&state)).with_contract_log_retention(Some(2));
+        let first = eth.send_transaction(call.clone()).await.unwrap();
+        let logs = bach.get_contract_logs(first.clone()).await.unwrap();
+        assert_eq!(logs.len(), 1);
+        assert_eq!(logs[0].message, format_bytes(b"hi"));
+
+        // ...for the configured number of blocks
+        *state.block_height.write().unwrap() = 4;
+        let second = eth.send_transaction(call).await.unwrap();
+        assert!(bach.get_contract_logs(first).await.unwrap().is_empty());
+        assert_eq!(bach.get_contract_logs(second).await.unwrap().len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_get_storage_usage() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let contract = Address::from([0xaa; 20]);
+        storage.state.set_storage_quota(Some(1024)).unwrap();
+        storage
+            .state
+            .apply_block_writes(1, &[(contract, H256::from([0x01; 32]), H256::from([0x02; 32]))])
+            .unwrap();
+
+        let state = Arc::new(RpcState {
+            block_height: RwLock::new(1),
+            ..RpcState::new(1, storage)
+        });
+        let api = BachApiImpl::new(state);
+
+        let usage = api.get_storage_usage(format_address(&contract)).await.unwrap();
+        assert_eq!(usage.used_bytes, "0x40");
+        assert_eq!(usage.quota.as_deref(), Some("0x400"));
+    }
+
+    #[tokio::test]
+    async fn test_check_affordability() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let sender = Address::from([0xaa; 20]);
+        let mut evm_state = EvmState::new();
+        evm_state.set_balance(&sender, U256::from_u64(21_000 * DEFAULT_GAS_PRICE));
+
+        let state = Arc::new(RpcState {
+            evm_state: RwLock::new(evm_state),
+            ..RpcState::new(1, Storage::open(temp_dir.path()).unwrap())
+        });
+        let api = BachApiImpl::new(Arc::clone(&state));
+        let eth = EthApiImpl::new(state);
+        let sender = format_address(&sender);
+
+        let check = api
+            .check_affordability(sender.clone(), "0x5208".to_string(), None)
+            .await
+            .unwrap();
+        assert!(check.affordable);
+        assert_eq!(check.required, check.balance);
+        assert_eq!(check.shortfall, "0x0");
+
+        let check = api
+            .check_affordability(sender.clone(), "0x5208".to_string(), Some("0x1".to_string()))
+            .await
+            .unwrap();
+        assert!(!check.affordable);
+        assert_eq!(check.shortfall, "0x1");
+
+        // Submission agrees
+        let request = |value: &str| CallRequest {
+            from: Some(sender.clone()),
+            to: Some(format_address(&Address::from([0xbb; 20]))),
+            gas: Some("0x5208".to_string()),
+            value: Some(value.to_string()),
+            ..Default::default()
+        };
+        assert!(eth.send_transaction(request("0x1")).await.is_err());
+        eth.send_transaction(request("0x0")).await.unwrap();
+        assert!(api
+            .check_affordability("0x12".to_string(), "0x5208".to_string(), None)
+            .await
+            .is_err());
+    }
+
+    #[tokio::test]
+    async fn test_get_gas_report() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let contract = Address::from([0xaa; 20]);
+        let mut builder = bach_storage::GasReportBuilder::new();
+        builder.record(&contract, &[0x12, 0x34, 0x56, 0x78], 40_000);
+        builder.record(&contract, &[0x12, 0x34, 0x56, 0x78], 2_000);
+        storage.transactions.put_gas_report(1, &builder.finish()).unwrap();
+
+        let state = Arc::new(RpcState {
+            block_height: RwLock::new(1),
+            ..RpcState::new(1, storage)
+        });
+        let api = BachApiImpl::new(state);
+
+        let report = api.get_gas_report(BlockNumberOrTag::Tag(BlockTag::Latest)).await.unwrap();
+        assert_eq!(report.len(), 1);
+        assert_eq!(report[0].contract, format_address(&contract));
+        assert_eq!(report[0].selector.as_deref(), Some("0x12345678"));
+        assert_eq!(report[0].calls, "0x2");
+        assert_eq!(report[0].gas_used, format_u64(42_000));
+
+        assert!(api.get_gas_report(BlockNumberOrTag::Tag(BlockTag::Pending)).await.is_err());
+
+        // Reports of pruned blocks are refused rather than served empty
+        let policy = bach_storage::RetentionPolicy {
+            results: Some(1),
+            sync_window: 1,
+            ..Default::default()
+        };
+        let checkpoint = bach_types::Checkpoint::new(2, H256::from([2u8; 32]), H256::zero());
+        api.state
+            .storage
+            .blocks
+            .put_finality_checkpoint(&SignedCheckpoint::new(checkpoint))
+            .unwrap();
+        api.state.storage.prune(&policy, 2).unwrap();
+        let block = BlockNumberOrTag::Number("0x1".to_string());
+        assert!(api.get_gas_report(block).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_get_dag_stats() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let dag = bach_types::TxDag::from_dependencies(vec![vec![], vec![], vec![0, 1]]).unwrap();
+        storage.transactions.put_tx_dag(2, &dag).unwrap();
+
+        let server = RpcServer::new(RpcConfig::default(), storage, 1);
+        let state = server.state();
+        *state.block_height.write().unwrap() = 2;
+        let api = BachApiImpl::new(Arc::clone(&state));
+
+        let stats = api
+            .get_dag_stats(BlockNumberOrTag::Tag(BlockTag::Latest))
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(stats.block_number, "0x2");
+        assert_eq!(stats.tx_count, "0x3");
+        assert_eq!(stats.depth, "0x2");
+        assert_eq!(stats.width, "0x2");
+        assert_eq!(stats.parallelism, 1.5);
+        assert_eq!(stats.sequential_tx_count, "0x1");
+
+        let unknown = BlockNumberOrTag::Number("0x1".to_string());
+        assert!(api.get_dag_stats(unknown).await.unwrap().is_none());
+        assert!(api.get_dag_stats(BlockNumberOrTag::Tag(BlockTag::Pending)).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_get_checkpoint() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let key = bach_crypto::PrivateKey::from_bytes(&[0x42; 32]).unwrap();
+        let checkpoint = bach_types::Checkpoint::new(10, H256::from([1u8; 32]), H256::zero());
+        let mut signed = SignedCheckpoint::new(checkpoint);
+        signed.signatures.push(checkpoint.sign(&key));
+        storage.blocks.put_finality_checkpoint(&signed).unwrap();
+
+        let server = RpcServer::new(RpcConfig::default(), storage, 1);
+        let state = server.state();
+        *state.block_height.write().unwrap() = 12;
+        let api = BachApiImpl::new(Arc::clone(&state));
+
+        let response = api
+            .get_checkpoint(BlockNumberOrTag::Tag(BlockTag::Latest))
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(response.block_number, "0xa");
+        assert_eq!(response.block_hash, format_h256(&H256::from([1u8; 32])));
+        assert_eq!(response.signatures.len(), 1);
+        assert_eq!(
+            response.signatures[0].validator,
+            format_address(&key.public_key().to_address())
+        );
+
+        let before = BlockNumberOrTag::Number("0x9".to_string());
+        assert!(api.get_checkpoint(before).await.unwrap().is_none());
+        assert!(api.get_checkpoint(BlockNumberOrTag::Tag(BlockTag::Pending)).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_send_transaction_with_result() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let state = Arc::new(RpcState::new(1, storage));
+        fund(&state, &[Address::from([0x11; 20])]);
+        let api = BachApiImpl::new(Arc::clone(&state));
+        let request = || CallRequest {
+            from: Some(format_address(&Address::from([0x11; 20]))),
+            to: Some(format_address(&Address::from([0x22; 20]))),
+            ..Default::default()
+        };
+
+        // Nothing commits, so the bounded wait ends without a receipt
+        let result = api.send_transaction_with_result(request(), Some(10)).await.unwrap();
+        assert!(!result.committed);
+        assert!(result.receipt.is_none());
+        assert_eq!(state.tx_watcher.watched_count(), 0);
+
+        assert!(api
+            .send_transaction_with_result(request(), Some(MAX_SUBMIT_WAIT_MS + 1))
+            .await
+            .is_err());
+
+        // A committer delivers the receipt while the caller waits
+        let committer = Arc::clone(&state);
+        tokio::spawn(async move {
+            loop {
+                let hashes: Vec<H256> =
+                    committer.pending_txs.read().unwrap().keys().copied().collect();
+                for hash in hashes {
+                    let receipt = bach_storage::TransactionReceipt {
+                        transaction_hash: *hash.as_bytes(),
+                        block_hash: [0x33; 32],
+                        block_number: 9,
+                        transaction_index: 4,
+                        gas_used: 21000,
+                        status: true,
+                        logs: Vec::new(),
+                    };
+                    committer.tx_watcher.notify(&receipt);
+                }
+                tokio::time::sleep(std::time::Duration::from_millis(5)).await;
+            }
+        });
+
+        let result = api.send_transaction_with_result(request(), None).await.unwrap();
+        assert!(result.committed);
+        let receipt = result.receipt.unwrap();
+        assert_eq!(receipt.transaction_hash, result.transaction_hash);
+        assert_eq!(receipt.block_number, "0x9");
+        assert_eq!(receipt.transaction_index, "0x4");
+        assert_eq!(receipt.gas_used, format_u64(21000));
+    }
+
+    #[tokio::test]
+    async fn test_explorer_api() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let key = bach_crypto::PrivateKey::random();
+        let sender = key.public_key().to_address();
+        let recipient = Address::from([0x55; 20]);
+
+        let mut parent = H256::zero();
+        let mut tx_hashes = Vec::new();
+        for height in 0..3u64 {
+            let to = Some(recipient);
+            let unsigned = |signature| {
+                bach_types::Transaction::new(height, to, U256::ZERO, Vec::new(), signature)
+            };
+            let signing_hash = unsigned(key.sign(&H256::zero())).signing_hash();
+            let tx = unsigned(key.sign(&signing_hash));
+            let block = Block::new(height, parent, vec![tx.clone()], 1000 + height);
+            storage.blocks.put_block(&block).unwrap();
+            storage.transactions.index_block_transactions(&block).unwrap();
+            storage.transactions.put_receipt(&bach_storage::TransactionReceipt {
+                transaction_hash: *tx.hash().as_bytes(),
+                block_hash: *block.hash().as_bytes(),
+                block_number: height,
+                transaction_index: 0,
+                gas_used: 21000,
+                status: true,
+                logs: Vec::new(),
+            }).unwrap();
+            parent = block.hash();
+            tx_hashes.push(tx.hash());
         }
 
+        let state = Arc::new(RpcState {
+            block_height: RwLock::new(2),
+            ..RpcState::new(1, storage)
+        });
+        let api = ExplorerApiImpl::new(state);
+
+        // Blocks, newest first
+        let page = api.get_blocks(None, Some(2)).await.unwrap();
+        let numbers: Vec<_> = page.items.iter().map(|b| b.number.as_str()).collect();
+        assert_eq!(numbers, vec!["0x2", "0x1"]);
+        let page = api.get_blocks(page.next, Some(2)).await.unwrap();
+        assert_eq!(page.items.len(), 1);
+        assert_eq!(page.items[0].number, "0x0");
+        assert!(page.next.is_none());
+        assert!(api.get_blocks(None, Some(MAX_EXPLORER_PAGE_SIZE + 1)).await.is_err());
+
+        // Transactions by address, paged with cursors
+        let page = api
+            .get_transactions_by_address(format_address(&recipient), None, Some(2))
+            .await
+            .unwrap();
+        assert_eq!(page.items.len(), 2);
+        assert_eq!(page.items[0].hash, format_h256(&tx_hashes[2]));
+        assert_eq!(page.items[0].status, Some(true));
+        let page = api
+            .get_transactions_by_address(format_address(&recipient), page.next, Some(2))
+            .await
+            .unwrap();
+        assert_eq!(page.items.len(), 1);
+        assert_eq!(page.items[0].hash, format_h256(&tx_hashes[0]));
+        assert!(page.next.is_none());
+
+        // Senders are indexed too
+        let page = api
+            .get_transactions_by_address(format_address(&sender), None, None)
+            .await
+            .unwrap();
+        assert_eq!(page.items.len(), 3);
+
+        // Search
+        let result = api.search(format_h256(&tx_hashes[1])).await.unwrap();
+        assert!(matches!(result, SearchResult::Transaction(tx) if tx.block_number == "0x1"));
+        let result = api.search(format_h256(&parent)).await.unwrap();
+        assert!(matches!(result, SearchResult::Block(block) if block.number == "0x2"));
+        let result = api.search("1".to_string()).await.unwrap();
+        assert!(matches!(result, SearchResult::Block(block) if block.number == "0x1"));
+        let result = api.search(format_address(&recipient)).await.unwrap();
+        assert!(matches!(result, SearchResult::Address { .. }));
+        let result = api.search("99".to_string()).await.unwrap();
+        assert!(matches!(result, SearchResult::NotFound));
+    }
+
+    #[tokio::test]
+    async fn test_tx_data_size_limit() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let gates = Arc::new(FeatureGates::all());
+        let state = Arc::new(RpcState {
+            evm_state: RwLock::new(EvmState::new().with_feature_gates(gates)),
+            ..RpcState::new(1, storage)
+        });
+        let api = EthApiImpl::new(Arc::clone(&state)).with_max_tx_data_size(64);
+        let from = Address::from([0x11; 20]);
+        fund(&state, &[from]);
+        let code = vec![0x60u8; 100];
+        let hash = keccak256(&code);
+
+        // Code over the limit can't be sent in one transaction
+        let create = CallRequest {
+            from: Some(format_address(&from)),
+            data: Some(format_bytes(&code)),
+            ..Default::default()
+        };
+        assert!(api.send_transaction(create).await.is_err());
+
+        // ...but can be staged in chunks that fit
+        let mut begin = vec![bach_evm::STAGING_BEGIN];
+        begin.extend_from_slice(hash.as_bytes());
+        begin.extend_from_slice(&(code.len() as u64).to_be_bytes());
+        let stage = CallRequest {
+            from: Some(format_address(&from)),
+            to: Some(format_address(&bytecode_staging_address())),
+            data: Some(format_bytes(&begin)),
+            ..Default::default()
+        };
+        api.send_transaction(stage).await.unwrap();
+        assert!(state.evm_state.read().unwrap().staged_code(&from, &hash).is_some());
+    }
+
+    #[tokio::test]
+    async fn test_org_grants_transaction() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let contract = Address::from([0x42; 20]);
+        let (admin, member) = (Address::from([0xa0; 20]), Address::from([0xa1; 20]));
+        let isolation = OrgIsolation {
+            contracts: [contract].into(),
+            members: [(member, "a".to_string())].into(),
+            admins: [(admin, "a".to_string())].into(),
+        };
+        let config = RpcConfig {
+            org_isolation: Some(Arc::new(isolation)),
+            ..Default::default()
+        };
+        let server = RpcServer::new(config, Storage::open(temp_dir.path()).unwrap(), 1);
+        let api = EthApiImpl::new(server.state());
+        fund(&server.state(), &[admin, member]);
+        server.state().evm_state.write().unwrap().set_feature_gates(Arc::new(FeatureGates::all()));
+
+        let mut grant = vec![bach_evm::ORG_GRANT];
+        grant.extend_from_slice(contract.as_bytes());
+        grant.extend_from_slice(b"b");
+        let call = |from: Address| CallRequest {
+            from: Some(format_address(&from)),
+            to: Some(format_address(&org_grants_address())),
+            data: Some(format_bytes(&grant)),
+            ..Default::default()
+        };
+
+        // Members can't share their org's data; its admin can
+        api.send_transaction(call(member)).await.unwrap();
+        assert!(!server.state().evm_state.read().unwrap().has_org_grant(&contract, "a", "b"));
+        api.send_transaction(call(admin)).await.unwrap();
+        let state = server.state();
+        let evm_state = state.evm_state.read().unwrap();
+        assert!(evm_state.has_org_grant(&contract, "a", "b"));
+        assert!(!evm_state.has_org_grant(&contract, "b", "a"));
+    }
+
+    #[tokio::test]
+    async fn test_isolated_reads_bound_to_member() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let contract = Address::from([0x42; 20]);
+        let (member, outsider) = (Address::from([0xa1; 20]), Address::from([0xb1; 20]));
+        let isolation = OrgIsolation {
+            contracts: [contract].into(),
+            members: [(member, "a".to_string())].into(),
+            admins: HashMap::new(),
+        };
+        let config = RpcConfig {
+            org_isolation: Some(Arc::new(isolation)),
+            ..Default::default()
+        };
+        let server = RpcServer::new(config, Storage::open(temp_dir.path()).unwrap(), 1);
+        let api = EthApiImpl::new(server.state());
         {
-            let evm_state = state.evm_state.read().unwrap();
-            let balance = evm_state.get_balance(&addr);
-            assert_eq!(balance, U256::from_u64(1000));
+            let state = server.state();
+            let mut evm_state = state.evm_state.write().unwrap();
+            // PUSH1 0 SLOAD PUSH1 0 MSTORE PUSH1 32 PUSH1 0 RETURN
+            evm_state.set_code(
+                &contract,
+                vec![0x60, 0x00, 0x54, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3],
+            );
+            evm_state.set_storage(&contract, org_slot("a", &H256::zero()), H256::from([7u8; 32]));
         }
+        let as_member = |address: Address| {
+            let mut ext = Extensions::new();
+            ext.insert(AuthenticatedMember {
+                address,
+                role: None,
+                did: None,
+            });
+            ext
+        };
+        let call = CallRequest {
+            from: Some(format_address(&member)),
+            to: Some(format_address(&contract)),
+            ..Default::default()
+        };
+        let zero = format_h256(&H256::zero());
+        let address = format_address(&contract);
+
+        // Claiming a member's address as `from` reads nothing
+        assert!(api.call(&Extensions::new(), call.clone(), None).await.is_err());
+        assert!(api.call(&as_member(outsider), call.clone(), None).await.is_err());
+        assert_eq!(
+            api.call(&as_member(member), call, None).await.unwrap(),
+            format_bytes(&[7u8; 32])
+        );
+
+        // Raw slots resolve in the member's own namespace only
+        assert!(api
+            .get_storage_at(&Extensions::new(), address.clone(), zero.clone(), None)
+            .await
+            .is_err());
+        assert_eq!(
+            api.get_storage_at(&as_member(member), address.clone(), zero.clone(), None)
+                .await
+                .unwrap(),
+            format_h256(&H256::from([7u8; 32]))
+        );
+        let bach = BachApiImpl::new(server.state());
+        assert!(bach.get_key_history(address, zero, None, None).await.is_err());
     }
 
-    #[test]
-    fn test_pending_transaction() {
+    #[tokio::test]
+    async fn test_contract_acl_transaction() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let (alice, bob) = (Address::from([0xa1; 20]), Address::from([0xb1; 20]));
+        let members = OrgMembers {
+            members: [(alice, "a".to_string()), (bob, "b".to_string())].into(),
+            admins: HashMap::new(),
+        };
+        let config = RpcConfig {
+            org_members: Some(Arc::new(members)),
+            ..Default::default()
+        };
+        let server = RpcServer::new(config, Storage::open(temp_dir.path()).unwrap(), 1);
+        let api = EthApiImpl::new(server.state());
+        fund(&server.state(), &[alice, bob]);
+
+        // Install a STOP contract whose method 0x01020304 only org "a" may call
+        let manifest = bach_evm::MethodPermissions {
+            methods: [(
+                [1, 2, 3, 4],
+                bach_evm::MethodRule {
+                    role: bach_evm::MethodRole::Member,
+                    orgs: vec!["a".to_string()],
+                },
+            )]
+            .into(),
+        };
+        let manifest = manifest.encode().unwrap();
+        let mut install = vec![bach_evm::ACL_INSTALL];
+        install.extend_from_slice(&(manifest.len() as u16).to_be_bytes());
+        install.extend_from_slice(&manifest);
+        install.extend_from_slice(&[0x60, 0x01, 0x60, 0x00, 0xf3]);
+        let deploy = CallRequest {
+            from: Some(format_address(&bob)),
+            to: Some(format_address(&contract_acl_address())),
+            data: Some(format_bytes(&install)),
+            ..Default::default()
+        };
+        let contract = {
+            let mut state = server.state().evm_state.read().unwrap().clone();
+            let context = EvmContext {
+                caller: bob,
+                ..Default::default()
+            };
+            execute_contract_acl(&install, context, &mut state).unwrap()
+        };
+        api.send_transaction(deploy).await.unwrap();
+        assert!(server.state().evm_state.read().unwrap().method_permissions(&contract).is_some());
+
+        let call = |from: Address| CallRequest {
+            from: Some(format_address(&from)),
+            to: Some(format_address(&contract)),
+            data: Some(format_bytes(&[1, 2, 3, 4])),
+            ..Default::default()
+        };
+        let ext = Extensions::new();
+        assert!(api.call(&ext, call(alice), None).await.is_ok());
+        assert!(api.call(&ext, call(bob), None).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_request_faucet() {
+        use std::time::{Duration, SystemTime};
+
         let temp_dir = tempfile::tempdir().unwrap();
         let storage = Storage::open(temp_dir.path()).unwrap();
+        let clock = Arc::new(bach_primitives::FakeClock::at(
+            SystemTime::UNIX_EPOCH + Duration::from_secs(1_000_000),
+        ));
+        let state = Arc::new(RpcState {
+            clock: Arc::clone(&clock) as Arc<dyn Clock>,
+            ..RpcState::new(1, storage)
+        });
+        let faucet = FaucetConfig {
+            amount: U256::from_u64(1_000),
+            window_secs: 60,
+        };
+        let address = Address::from([0x11; 20]);
+
+        // Chains without a faucet reject requests and faucet transactions
+        let api = BachApiImpl::new(Arc::clone(&state));
+        let ext = Extensions::new();
+        assert!(api.request_faucet(&ext, format_address(&address)).await.is_err());
+        let call = CallRequest {
+            from: Some(format_address(&address)),
+            to: Some(format_address(&faucet_address())),
+            data: Some(format_bytes(&[FAUCET_REQUEST])),
+            ..Default::default()
+        };
+        assert!(EthApiImpl::new(Arc::clone(&state)).send_transaction(call).await.is_err());
+
+        // Enabling it in the EVM state, as a config change does, takes
+        // effect without a restart
+        state.evm_state.write().unwrap().set_faucet(Some(faucet));
+        let grant = api.request_faucet(&ext, format_address(&address)).await.unwrap();
+        assert_eq!(grant.amount, "0x3e8");
+        assert_eq!(grant.next_grant_at, format_u64(1_000_060));
+        assert_eq!(state.evm_state.read().unwrap().get_balance(&address), U256::from_u64(1_000));
+        assert_eq!(state.pending_txs.read().unwrap().len(), 1);
+
+        // Rate limited until the window passes
+        assert!(api.request_faucet(&ext, format_address(&address)).await.is_err());
+
+        // A client gets one grant per window, whichever address it asks for
+        let mut remote = Extensions::new();
+        remote.insert(ClientAddr("10.0.0.1".parse().unwrap()));
+        let other = format_address(&Address::from([0x22; 20]));
+        api.request_faucet(&remote, other).await.unwrap();
+        let third = format_address(&Address::from([0x33; 20]));
+        assert!(api.request_faucet(&remote, third.clone()).await.is_err());
+
+        clock.advance(Duration::from_secs(60));
+        api.request_faucet(&ext, format_address(&address)).await.unwrap();
+        assert_eq!(state.evm_state.read().unwrap().get_balance(&address), U256::from_u64(2_000));
+        api.request_faucet(&remote, third).await.unwrap();
+    }
 
+    #[tokio::test]
+    async fn test_revoked_sender_rejected() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let revoked = RevokedKeys::default();
         let state = Arc::new(RpcState {
-            chain_id: 1,
-            storage,
-            pending_txs: RwLock::new(HashMap::new()),
-            evm_state: RwLock::new(EvmState::new()),
-            block_height: RwLock::new(0),
-            account_nonces: RwLock::new(HashMap::new()),
+            revoked_keys: revoked.clone(),
+            ..RpcState::new(1, storage)
         });
+        let api = EthApiImpl::new(Arc::clone(&state));
+        let from = Address::from([0x11; 20]);
+        fund(&state, &[from]);
+        let request = || CallRequest {
+            from: Some(format_address(&from)),
+            to: Some(format_address(&Address::from([0x22; 20]))),
+            ..Default::default()
+        };
 
-        let tx_hash = H256::from([0x12; 32]);
-        let pending_tx = PendingTransaction {
-            hash: tx_hash,
-            from: Address::from([0xaa; 20]),
-            to: Some(Address::from([0xbb; 20])),
-            value: U256::from_u64(1000),
-            data: vec![0x12, 0x34],
-            gas: 21000,
-            gas_price: U256::from_u64(1_000_000_000),
-            nonce: 0,
-            received_at: 12345678,
+        // Refused without a key to sign answers with
+        let unsigned = BachApiImpl::new(Arc::clone(&state));
+        assert!(unsigned.get_key_status(format_address(&from), 1).await.is_err());
+
+        let signer = PrivateKey::from_bytes(&[0x33; 32]).unwrap();
+        let known = KnownKeys::default();
+        let bach = BachApiImpl::new(Arc::clone(&state))
+            .with_key_status(Some(signer.clone()), known.clone());
+        let (bach, signer) = (&bach, &signer);
+        let status = |address: Address| async move {
+            let response = bach.get_key_status(format_address(&address), 7).await.unwrap();
+            assert_eq!(response.nonce, 7);
+            let signature = parse_bytes(&response.signature).unwrap();
+            let signature = bach_crypto::Signature::from_bytes(&signature.try_into().unwrap())
+                .unwrap();
+            let hash = key_status_signing_hash(&address, &response.status, 7);
+            assert_eq!(
+                signature.recover(&hash).unwrap().to_address(),
+                signer.public_key().to_address()
+            );
+            response.status
         };
 
-        {
-            let mut pending = state.pending_txs.write().unwrap();
-            pending.insert(tx_hash, pending_tx.clone());
-        }
+        api.send_transaction(request()).await.unwrap();
+        assert_eq!(status(from).await, "unknown");
+        known.replace([from]);
+        assert_eq!(status(from).await, "good");
+        revoked.replace([from]);
+        assert!(api.send_transaction(request()).await.is_err());
+        assert_eq!(status(from).await, "revoked");
+        // The refused submission still counts towards validation latency
+        assert_eq!(state.tx_pool_metrics.rejected(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_send_raw_transaction() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let state = Arc::new(RpcState::new(1, storage));
+        let api = EthApiImpl::new(Arc::clone(&state));
+        let key = PrivateKey::from_bytes(&[0x44; 32]).unwrap();
+        let from = key.public_key().to_address();
+        fund(&state, &[from]);
+        let to = Address::from([0x22; 20]);
+        let signed = |nonce: u64| {
+            let signature = key.sign(&H256::zero());
+            let mut tx = Transaction::new(nonce, Some(to), U256::ZERO, vec![], signature);
+            tx.sign(&key, &[]);
+            tx
+        };
+        let error_code = |err: jsonrpsee::types::ErrorObjectOwned| {
+            let data: RpcErrorData = serde_json::from_str(err.data().unwrap().get()).unwrap();
+            data.error_code
+        };
 
+        let tx = signed(0);
+        let hash = api.send_raw_transaction(format_bytes(&tx.encode())).await.unwrap();
+        assert_eq!(hash, format_h256(&tx.hash()));
         {
             let pending = state.pending_txs.read().unwrap();
-            assert!(pending.contains_key(&tx_hash));
-            let tx = pending.get(&tx_hash).unwrap();
-            assert_eq!(tx.nonce, 0);
+            let pooled = &pending[&tx.hash()];
+            assert_eq!(pooled.from, from);
+            assert_eq!(pooled.signature, Some(tx.signature.clone()));
+            assert!(pooled.execution.as_ref().unwrap().success);
         }
+
+        // Resubmitting is a duplicate; a skipped nonce or garbage is refused
+        let err = api.send_raw_transaction(format_bytes(&tx.encode())).await.unwrap_err();
+        assert_eq!(error_code(err), "DUPLICATE_TX");
+        assert!(api.send_raw_transaction(format_bytes(&signed(2).encode())).await.is_err());
+        let err = api.send_raw_transaction("0x010203".to_string()).await.unwrap_err();
+        assert_eq!(error_code(err), "INVALID_ARGUMENT");
+
+        api.send_raw_transaction(format_bytes(&signed(1).encode())).await.unwrap();
+        assert_eq!(state.account_nonces.read().unwrap()[&from], 2);
     }
 
-    #[test]
-    fn test_account_nonce_tracking() {
+    /// Gives `accounts` enough to pay for any test transaction.
+    fn fund(state: &RpcState, accounts: &[Address]) {
+        let mut evm_state = state.evm_state.write().unwrap();
+        for account in accounts {
+            evm_state.set_balance(account, U256::from_u64(u64::MAX));
+        }
+    }
+
+    /// Returns request extensions for a token-authenticated admin.
+    fn as_admin(role: AdminRole) -> Extensions {
+        let mut ext = Extensions::new();
+        ext.insert(AuthenticatedMember {
+            address: Address::from([0xaa; 20]),
+            role: Some(role),
+            did: None,
+        });
+        ext
+    }
+
+    #[tokio::test]
+    async fn test_admin_peer_scores() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+
+        let state = Arc::new(RpcState::new(1, storage));
+        let api = AdminApiImpl::new(Arc::clone(&state));
+        let ext = as_admin(AdminRole::Operator);
+
+        // Unavailable until the network is attached
+        assert!(api.peer_scores(&ext).await.is_err());
+
+        let peers = Arc::new(PeerManager::new(25, Vec::new()));
+        let bad = PeerId::from_bytes([0x11; 32]);
+        peers.scorer().report(&bad, bach_network::Misbehavior::MalformedMessage);
+        peers.scorer().report(&bad, bach_network::Misbehavior::MalformedMessage);
+        *state.network.write().unwrap() = Some(peers);
+
+        let scores = api.peer_scores(&ext).await.unwrap();
+        assert_eq!(scores.len(), 1);
+        assert_eq!(scores[0].peer_id, format_bytes(bad.as_bytes()));
+        assert!(scores[0].banned);
+
+        let banned = api.banned_peers(&ext).await.unwrap();
+        assert_eq!(banned.len(), 1);
+
+        assert!(api.unban_peer(&ext, format_bytes(bad.as_bytes())).await.unwrap());
+        assert!(api.banned_peers(&ext).await.unwrap().is_empty());
+        assert!(api.unban_peer(&ext, "0x1234".to_string()).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_admin_cluster_capabilities() {
+        use bach_network::{PeerInfo, PeerStatus};
+
+        let server = RpcServer::new(RpcConfig::default(), Storage::temporary().unwrap(), 1);
+        let api = AdminApiImpl::new(server.state());
+        let ext = as_admin(AdminRole::Auditor);
+        assert!(api.cluster_capabilities(&ext).await.is_err());
+
+        let mut peers = PeerManager::new(25, Vec::new());
+        peers.set_local_features(vec!["fast-sync".to_string()]);
+        let mut info =
+            PeerInfo::new_incoming("127.0.0.1:30304".parse().unwrap(), server.state().clock.now());
+        info.status = PeerStatus::Active;
+        let peer = info.id;
+        peers.add_peer(info).unwrap();
+        peers.set_peer_features(&peer, vec!["dag-v2".to_string(), "fast-sync".to_string()]);
+        server.attach_network(Arc::new(peers));
+
+        let capabilities = api.cluster_capabilities(&ext).await.unwrap();
+        assert_eq!(capabilities.nodes, 2);
+        assert_eq!(capabilities.local_features, vec!["fast-sync".to_string()]);
+        assert_eq!(capabilities.peers[0].peer_id, format_bytes(peer.as_bytes()));
+        let support: Vec<_> = capabilities
+            .features
+            .iter()
+            .map(|f| (f.feature.as_str(), f.nodes, f.all_nodes))
+            .collect();
+        assert_eq!(support, vec![("dag-v2", 1, false), ("fast-sync", 2, true)]);
+    }
+
+    #[tokio::test]
+    async fn test_admin_sync_status() {
+        let server = RpcServer::new(RpcConfig::default(), Storage::temporary().unwrap(), 1);
+        let api = AdminApiImpl::new(server.state());
+        let ext = as_admin(AdminRole::Auditor);
+
+        // Unavailable until sync progress is attached
+        assert!(api.sync_status(&ext).await.is_err());
+
+        let progress = Arc::new(SyncProgress::new());
+        server.attach_sync(Arc::clone(&progress));
+        progress.begin(5, 105);
+        progress.range_started();
+        progress.range_fetched(64);
+        progress.set_verified(69);
+
+        // Never served to anonymous callers
+        assert!(api.sync_status(&Extensions::new()).await.is_err());
+
+        let status = api.sync_status(&ext).await.unwrap();
+        assert!(status.syncing);
+        assert_eq!(status.start_height, 5);
+        assert_eq!(status.target_height, 105);
+        assert_eq!(status.verified_height, 69);
+        assert_eq!(status.synced_height, 5);
+        assert_eq!(status.in_flight_ranges, 1);
+        assert_eq!(status.buffered_blocks, 64);
+    }
+
+    #[tokio::test]
+    async fn test_admin_roles() {
         let temp_dir = tempfile::tempdir().unwrap();
         let storage = Storage::open(temp_dir.path()).unwrap();
 
         let state = Arc::new(RpcState {
-            chain_id: 1,
-            storage,
-            pending_txs: RwLock::new(HashMap::new()),
-            evm_state: RwLock::new(EvmState::new()),
-            block_height: RwLock::new(0),
-            account_nonces: RwLock::new(HashMap::new()),
+            block_height: RwLock::new(3),
+            network: RwLock::new(Some(Arc::new(PeerManager::new(25, Vec::new())))),
+            ..RpcState::new(7, storage)
         });
+        let api = AdminApiImpl::new(state);
+        let peer = format_bytes(&[0x22; 32]);
+
+        let as_role = |role: Option<AdminRole>| {
+            let mut ext = Extensions::new();
+            ext.insert(AuthenticatedMember {
+                address: Address::from([0xaa; 20]),
+                role,
+                did: None,
+            });
+            ext
+        };
+        let auditor = as_role(Some(AdminRole::Auditor));
+        let operator = as_role(Some(AdminRole::Operator));
+        let consensus = as_role(Some(AdminRole::ConsensusAdmin));
+        let member = as_role(None);
+
+        // Reads are open to every role but not to plain members, nor to
+        // anonymous callers when token auth is off
+        let status = api.node_status(&auditor).await.unwrap();
+        assert_eq!(status.chain_id, 7);
+        assert_eq!(status.block_height, 3);
+        assert!(api.node_status(&member).await.is_err());
+        assert!(api.node_status(&Extensions::new()).await.is_err());
+
+        // Only operators manage bans
+        assert!(api.ban_peer(&auditor, peer.clone(), 60).await.is_err());
+        assert!(api.ban_peer(&consensus, peer.clone(), 60).await.is_err());
+        assert!(api.ban_peer(&operator, peer.clone(), 60).await.unwrap());
+        assert_eq!(api.node_status(&auditor).await.unwrap().banned_peers, 1);
+
+        // Only consensus admins change the allowlist
+        let allowlist = vec![StaticPeerRequest {
+            org: "org1".to_string(),
+            node_id: peer.clone(),
+            address: "127.0.0.1:30303".to_string(),
+        }];
+        assert!(api.set_peer_allowlist(&operator, allowlist.clone()).await.is_err());
+        assert!(api.set_peer_allowlist(&consensus, allowlist).await.unwrap());
+        assert!(api.node_status(&auditor).await.unwrap().static_topology);
+
+        // Log level needs a handle from the node
+        assert!(api.set_log_level(&operator, "debug".to_string()).await.is_err());
+    }
 
-        let addr = Address::from([0xcc; 20]);
+    #[tokio::test]
+    async fn test_batch_queries() {
+        let temp_dir = tempfile::tempdir().unwrap();
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        let key = bach_crypto::PrivateKey::random();
 
-        // Test nonce increment
-        for expected in 0..5u64 {
-            let nonce = {
-                let mut nonces = state.account_nonces.write().unwrap();
-                let nonce = nonces.entry(addr).or_insert(0);
-                let current = *nonce;
-                *nonce += 1;
-                current
-            };
-            assert_eq!(nonce, expected);
-        }
+        let unsigned = |signature| {
+            bach_types::Transaction::new(0, None, U256::ZERO, Vec::new(), signature)
+        };
+        let signing_hash = unsigned(key.sign(&H256::zero())).signing_hash();
+        let tx = unsigned(key.sign(&signing_hash));
+        let block = Block::new(1, H256::zero(), vec![tx.clone()], 1001);
+        storage.blocks.put_block(&block).unwrap();
+        storage.transactions.put_receipt(&bach_storage::TransactionReceipt {
+            transaction_hash: *tx.hash().as_bytes(),
+            block_hash: *block.hash().as_bytes(),
+            block_number: 1,
+            transaction_index: 0,
+            gas_used: 21000,
+            status: true,
+            logs: Vec::new(),
+        }).unwrap();
 
-        // Verify final nonce
-        {
-            let nonces = state.account_nonces.read().unwrap();
-            assert_eq!(*nonces.get(&addr).unwrap(), 5);
-        }
+        let state = Arc::new(RpcState {
+            block_height: RwLock::new(1),
+            ..RpcState::new(1, storage)
+        });
+        let api = BachApiImpl::new(state);
+
+        // Entries keep request order and fail individually
+        let hashes = vec![
+            "0xzz".to_string(),
+            format_h256(&tx.hash()),
+            format_h256(&H256::from([0x77; 32])),
+        ];
+        let items = api.get_transactions_by_hashes(hashes).await.unwrap();
+        assert_eq!(items.len(), 3);
+        assert_eq!(items[0].error.as_ref().unwrap().code, RpcErrorCode::InvalidParams as i32);
+        let found = items[1].result.as_ref().unwrap();
+        assert_eq!(found.hash, format_h256(&tx.hash()));
+        assert_eq!(found.block_number.as_deref(), Some("0x1"));
+        assert_eq!(found.from, format_address(&key.public_key().to_address()));
+        assert!(items[1].error.is_none());
+        assert_eq!(items[2].error.as_ref().unwrap().code, RpcErrorCode::ResourceNotFound as i32);
+
+        let heights = vec![
+            BlockNumberOrTag::Number("0x1".to_string()),
+            BlockNumberOrTag::Number("0x2".to_string()),
+            BlockNumberOrTag::Tag(BlockTag::Latest),
+        ];
+        let items = api.get_blocks_by_heights(heights, false).await.unwrap();
+        assert_eq!(items[0].result.as_ref().unwrap().hash, format_h256(&block.hash()));
+        assert_eq!(items[1].error.as_ref().unwrap().code, RpcErrorCode::ResourceNotFound as i32);
+        assert_eq!(items[2].result.as_ref().unwrap().number, "0x1");
+
+        let json = serde_json::to_value(&items[1]).unwrap();
+        assert!(json.get("result").is_none());
+
+        let too_many = vec![BlockNumberOrTag::default(); MAX_BATCH_QUERY_SIZE + 1];
+        assert!(api.get_blocks_by_heights(too_many, false).await.is_err());
     }
 }
@@ -0,0 +1,498 @@
+//! Prometheus metrics endpoint
+//!
+//! `MetricsLayer` answers `GET /metrics` on the RPC port with gauges in the
+//! Prometheus text format and passes every other request on. The gauges
+//! describe the latest committed block, including the shape of its
+//! transaction dependency DAG, so dashboards can follow how much of each
+//! block the scheduler could run in parallel. They are computed from
+//! storage on every scrape; older blocks are served by `bach_getDagStats`.
+//! Once the node attaches its sync progress, the `bach_sync_*` gauges
+//! follow a catch-up sync as it fetches, verifies and applies blocks.
+//! Once the node attaches its health, the `bach_node_*` gauges tell whether
+//! it is ready or still warming its caches, taking part in consensus or
+//! degraded, and whether it slowed
+//! down its block proposals because its own blocks miss a quorum.
+//! The `bach_txpool_*` series give the pool's depth per lane, how long
+//! transactions took to validate and admit, and why pooled transactions
+//! were evicted, labelled with the chain ID.
+//! With the interceptor's `MethodLatencies` attached, RPC call latencies
+//! are exported as histograms as well.
+//!
+//! The metrics are not public. With a scrape token set, the layer sits in
+//! front of token authentication and answers only requests bearing that
+//! token; without one, the server places it behind token authentication
+//! so scrapers present a member token like any other client.
+
+use crate::{MethodLatencies, RpcState};
+use bach_network::HealthStatus;
+use http::{
+    header::{AUTHORIZATION, CONTENT_TYPE},
+    HeaderValue, Method, Request, Response, StatusCode,
+};
+use std::fmt::Write;
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::Arc;
+use std::task::{Context, Poll};
+use tower::{Layer, Service};
+
+/// Path the metrics are served on
+pub const METRICS_PATH: &str = "/metrics";
+
+/// Content type of the Prometheus text exposition format
+const METRICS_CONTENT_TYPE: &str = "text/plain; version=0.0.4";
+
+/// Renders the node's metrics in the Prometheus text format.
+pub fn render_metrics(state: &RpcState) -> String {
+    let height = *state.block_height.read().unwrap();
+    let dag = state.storage.transactions.get_tx_dag(height);
+
+    let mut out = String::new();
+    gauge(
+        &mut out,
+        "bach_block_height",
+        "Height of the latest committed block",
+        height,
+    );
+    if let Some(dag) = dag {
+        gauge(
+            &mut out,
+            "bach_block_dag_tx_count",
+            "Transactions in the latest block's dependency DAG",
+            dag.len(),
+        );
+        gauge(
+            &mut out,
+            "bach_block_dag_depth",
+            "Longest dependency chain in the latest block",
+            dag.depth(),
+        );
+        gauge(
+            &mut out,
+            "bach_block_dag_width",
+            "Most transactions of the latest block that can run at once",
+            dag.max_width(),
+        );
+        gauge(
+            &mut out,
+            "bach_block_dag_parallelism",
+            "Average transactions per DAG level in the latest block",
+            dag.parallelism(),
+        );
+        gauge(
+            &mut out,
+            "bach_block_dag_sequential_txs",
+            "Transactions of the latest block that run serially",
+            dag.sequential_count(),
+        );
+    }
+    if let Some(progress) = state.sync.read().unwrap().as_ref() {
+        let status = progress.status();
+        gauge(
+            &mut out,
+            "bach_sync_active",
+            "Whether a block sync is running (1) or not (0)",
+            u8::from(status.syncing),
+        );
+        gauge(
+            &mut out,
+            "bach_sync_target_height",
+            "Height the node is syncing to",
+            status.target_height,
+        );
+        gauge(
+            &mut out,
+            "bach_sync_verified_height",
+            "Highest synced height whose header chain is verified",
+            status.verified_height,
+        );
+        gauge(
+            &mut out,
+            "bach_sync_synced_height",
+            "Highest synced height applied",
+            status.synced_height,
+        );
+        gauge(
+            &mut out,
+            "bach_sync_in_flight_ranges",
+            "Block ranges being fetched or waiting to be applied",
+            status.in_flight_ranges,
+        );
+        gauge(
+            &mut out,
+            "bach_sync_buffered_blocks",
+            "Fetched blocks not yet applied",
+            status.buffered_blocks,
+        );
+        gauge(
+            &mut out,
+            "bach_sync_fetched_blocks",
+            "Blocks fetched by sync since the node started",
+            status.fetched_blocks,
+        );
+        gauge(
+            &mut out,
+            "bach_sync_failed_fetches",
+            "Range fetches retried on another peer",
+            status.failed_fetches,
+        );
+    }
+    if state.health.read().unwrap().is_some() {
+        let health = state.health();
+        gauge(
+            &mut out,
+            "bach_node_ready",
+            "Whether the node serves current chain data (1) or is warming up or syncing (0)",
+            u8::from(health.ready),
+        );
+        gauge(
+            &mut out,
+            "bach_node_warmup_remaining_blocks",
+            "Blocks the startup cache warm-up still has to load",
+            health.warmup_remaining,
+        );
+        gauge(
+            &mut out,
+            "bach_node_participating",
+            "Whether the node is a validator committing blocks (1) or not (0)",
+            u8::from(health.status == HealthStatus::Participating.as_str()),
+        );
+        gauge(
+            &mut out,
+            "bach_node_blocks_behind",
+            "Blocks the node still has to sync",
+            health.blocks_behind,
+        );
+        gauge(
+            &mut out,
+            "bach_node_quorum_failures",
+            "Heights in a row consensus failed to gather a signature quorum for",
+            health.quorum_failures,
+        );
+        gauge(
+            &mut out,
+            "bach_node_proposal_backoff",
+            "Factor by which block proposals are slowed after quorum failures (1 at full rate)",
+            health.proposal_backoff,
+        );
+        gauge(
+            &mut out,
+            "bach_node_clock_drift_seconds",
+            "Seconds the last proposed block's timestamp was ahead of the local clock",
+            health.clock_drift,
+        );
+        gauge(
+            &mut out,
+            "bach_node_timestamp_rejections",
+            "Proposals rejected for a timestamp before their parent's or too far from the clock",
+            health.timestamp_rejections,
+        );
+        gauge(
+            &mut out,
+            "bach_node_requeued_txs",
+            "Transactions returned to the pool because their block timed out",
+            health.requeued_txs,
+        );
+    }
+    let pending = state.pending_txs.read().unwrap();
+    out.push_str(&state.tx_pool_metrics.render(state.chain_id, pending.values()));
+    out
+}
+
+fn gauge(out: &mut String, name: &str, help: &str, value: impl std::fmt::Display) {
+    let _ = writeln!(out, "# HELP {} {}", name, help);
+    let _ = writeln!(out, "# TYPE {} gauge", name);
+    let _ = writeln!(out, "{} {}", name, value);
+}
+
+/// HTTP middleware layer serving `GET /metrics`.
+#[derive(Clone)]
+pub struct MetricsLayer {
+    state: Arc<RpcState>,
+    latencies: Option<Arc<MethodLatencies>>,
+    token: Option<Arc<str>>,
+}
+
+impl MetricsLayer {
+    /// Creates the layer reading metrics from the given state.
+    pub fn new(state: Arc<RpcState>) -> Self {
+        Self {
+            state,
+            latencies: None,
+            token: None,
+        }
+    }
+
+    /// Answers only scrapes bearing `Authorization: Bearer <token>`.
+    pub fn with_token(mut self, token: &str) -> Self {
+        self.token = Some(Arc::from(token));
+        self
+    }
+
+    /// Exports the given RPC call latencies too.
+    pub fn with_latencies(mut self, latencies: Arc<MethodLatencies>) -> Self {
+        self.latencies = Some(latencies);
+        self
+    }
+}
+
+impl<S> Layer<S> for MetricsLayer {
+    type Service = Metrics<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        Metrics {
+            inner,
+            state: Arc::clone(&self.state),
+            latencies: self.latencies.clone(),
+            token: self.token.clone(),
+        }
+    }
+}
+
+/// Service produced by `MetricsLayer`.
+#[derive(Clone)]
+pub struct Metrics<S> {
+    inner: S,
+    state: Arc<RpcState>,
+    latencies: Option<Arc<MethodLatencies>>,
+    token: Option<Arc<str>>,
+}
+
+impl<S> Metrics<S> {
+    fn authorized<B>(&self, req: &Request<B>) -> bool {
+        let Some(token) = &self.token else {
+            return true;
+        };
+        req.headers()
+            .get(AUTHORIZATION)
+            .and_then(|value| value.to_str().ok())
+            .and_then(|value| value.strip_prefix("Bearer "))
+            .is_some_and(|presented| presented.as_bytes() == token.as_bytes())
+    }
+}
+
+impl<S, B, ResBody> Service<Request<B>> for Metrics<S>
+where
+    S: Service<Request<B>, Response = Response<ResBody>>,
+    S::Future: Send + 'static,
+    ResBody: From<String> + Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, req: Request<B>) -> Self::Future {
+        if req.method() != Method::GET || req.uri().path() != METRICS_PATH {
+            return Box::pin(self.inner.call(req));
+        }
+        if !self.authorized(&req) {
+            let mut response = Response::new(ResBody::from(String::new()));
+            *response.status_mut() = StatusCode::UNAUTHORIZED;
+            return Box::pin(async move { Ok(response) });
+        }
+        let mut metrics = render_metrics(&self.state);
+        if let Some(latencies) = &self.latencies {
+            metrics.push_str(&latencies.render());
+        }
+        let mut response = Response::new(ResBody::from(metrics));
+        response
+            .headers_mut()
+            .insert(CONTENT_TYPE, HeaderValue::from_static(METRICS_CONTENT_TYPE));
+        Box::pin(async move { Ok(response) })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{RpcConfig, RpcServer};
+    use bach_primitives::{Address, H256, U256};
+    use bach_storage::Storage;
+    use bach_types::TxDag;
+    use std::convert::Infallible;
+    use tower::{service_fn, ServiceExt};
+
+    fn state() -> Arc<RpcState> {
+        let storage = Storage::temporary().unwrap();
+        let dag = TxDag::from_dependencies(vec![vec![], vec![], vec![0, 1]]).unwrap();
+        storage.transactions.put_tx_dag(3, &dag).unwrap();
+        let state = RpcServer::new(RpcConfig::default(), storage, 1).state();
+        *state.block_height.write().unwrap() = 3;
+        state
+    }
+
+    #[test]
+    fn test_render_latest_block_dag() {
+        let state = state();
+        let metrics = render_metrics(&state);
+        assert!(metrics.contains("# TYPE bach_block_height gauge\nbach_block_height 3\n"));
+        assert!(metrics.contains("bach_block_dag_depth 2\n"));
+        assert!(metrics.contains("bach_block_dag_width 2\n"));
+        assert!(metrics.contains("bach_block_dag_parallelism 1.5\n"));
+        assert!(metrics.contains("bach_block_dag_sequential_txs 1\n"));
+
+        // Blocks committed without a DAG only report their height
+        *state.block_height.write().unwrap() = 4;
+        let metrics = render_metrics(&state);
+        assert!(metrics.starts_with("# HELP bach_block_height "));
+        assert!(!metrics.contains("bach_block_dag_"));
+    }
+
+    #[test]
+    fn test_render_sync_progress() {
+        let state = state();
+        assert!(!render_metrics(&state).contains("bach_sync_"));
+
+        let progress = Arc::new(bach_network::SyncProgress::new());
+        *state.sync.write().unwrap() = Some(Arc::clone(&progress));
+        progress.begin(3, 40);
+        progress.range_started();
+        progress.range_fetched(16);
+        let metrics = render_metrics(&state);
+        assert!(metrics.contains("bach_sync_active 1\n"));
+        assert!(metrics.contains("bach_sync_target_height 40\n"));
+        assert!(metrics.contains("bach_sync_synced_height 3\n"));
+        assert!(metrics.contains("bach_sync_in_flight_ranges 1\n"));
+        assert!(metrics.contains("bach_sync_buffered_blocks 16\n"));
+
+        progress.finish();
+        assert!(render_metrics(&state).contains("bach_sync_active 0\n"));
+    }
+
+    #[test]
+    fn test_render_health() {
+        let state = state();
+        assert!(!render_metrics(&state).contains("bach_node_"));
+
+        let health = Arc::new(bach_network::NodeHealth::new(Arc::new(
+            bach_network::SyncProgress::new(),
+        )));
+        *state.health.write().unwrap() = Some(Arc::clone(&health));
+        health.set_validator(true);
+        health.record_commit(3);
+        let metrics = render_metrics(&state);
+        assert!(metrics.contains("bach_node_ready 1\n"));
+        assert!(metrics.contains("bach_node_participating 1\n"));
+
+        for _ in 0..bach_network::DEFAULT_DEGRADED_AFTER {
+            health.record_quorum_failure();
+        }
+        let metrics = render_metrics(&state);
+        assert!(metrics.contains("bach_node_participating 0\n"));
+        assert!(metrics.contains("bach_node_quorum_failures 3\n"));
+        assert!(metrics.contains("bach_node_proposal_backoff 1\n"));
+
+        health.set_proposal_backoff(4);
+        assert!(render_metrics(&state).contains("bach_node_proposal_backoff 4\n"));
+
+        health.set_clock_drift(-7, 2);
+        let metrics = render_metrics(&state);
+        assert!(metrics.contains("bach_node_clock_drift_seconds -7\n"));
+        assert!(metrics.contains("bach_node_timestamp_rejections 2\n"));
+
+        health.record_requeued_txs(5);
+        assert!(render_metrics(&state).contains("bach_node_requeued_txs 5\n"));
+
+        // Quorum failures are cleared by a commit, leaving the warm-up
+        health.record_commit(4);
+        health.set_warmup_remaining(8);
+        let metrics = render_metrics(&state);
+        assert!(metrics.contains("bach_node_ready 0\n"));
+        assert!(metrics.contains("bach_node_warmup_remaining_blocks 8\n"));
+    }
+
+    #[test]
+    fn test_render_tx_pool() {
+        let state = state();
+        let metrics = render_metrics(&state);
+        assert!(metrics.contains("bach_txpool_size{chain_id=\"1\",lane=\"transfer\"} 0\n"));
+
+        let tx = crate::PendingTransaction {
+            hash: H256::from([1; 32]),
+            from: Address::zero(),
+            to: Some(Address::from([2; 20])),
+            value: U256::ZERO,
+            data: Vec::new(),
+            gas: 21000,
+            gas_price: U256::ZERO,
+            nonce: 0,
+            received_at: 0,
+            execution: None,
+            signature: None,
+        };
+        state.pending_txs.write().unwrap().insert(tx.hash, tx);
+        state
+            .tx_pool_metrics
+            .record_evictions(crate::EvictionReason::Expired, 3);
+        let metrics = render_metrics(&state);
+        assert!(metrics.contains("bach_txpool_size{chain_id=\"1\",lane=\"transfer\"} 1\n"));
+        assert!(metrics
+            .contains("bach_txpool_evictions_total{chain_id=\"1\",reason=\"expired\"} 3\n"));
+    }
+
+    #[tokio::test]
+    async fn test_layer_serves_metrics_path_only() {
+        let inner = service_fn(|_: Request<()>| async {
+            Ok::<_, Infallible>(Response::new("rpc".to_string()))
+        });
+        let latencies = Arc::new(MethodLatencies::default());
+        latencies.record("eth_call", std::time::Duration::from_millis(3));
+        let service = MetricsLayer::new(state())
+            .with_latencies(latencies)
+            .layer(inner);
+
+        let request = |method: Method, path: &str| {
+            Request::builder()
+                .method(method)
+                .uri(path)
+                .body(())
+                .unwrap()
+        };
+        let response = service
+            .clone()
+            .oneshot(request(Method::GET, METRICS_PATH))
+            .await
+            .unwrap();
+        assert_eq!(response.headers()[CONTENT_TYPE], METRICS_CONTENT_TYPE);
+        assert!(response.body().contains("bach_block_dag_depth 2"));
+        assert!(response
+            .body()
+            .contains("bach_rpc_method_latency_seconds_count{method=\"eth_call\"} 1"));
+
+        for (method, path) in [(Method::POST, METRICS_PATH), (Method::GET, "/")] {
+            let response = service
+                .clone()
+                .oneshot(request(method, path))
+                .await
+                .unwrap();
+            assert_eq!(response.body(), "rpc");
+        }
+    }
+
+    #[tokio::test]
+    async fn test_layer_requires_scrape_token() {
+        let inner = service_fn(|_: Request<()>| async {
+            Ok::<_, Infallible>(Response::new("rpc".to_string()))
+        });
+        let service = MetricsLayer::new(state()).with_token("scrape").layer(inner);
+        let scrape = |authorization: Option<&str>| {
+            let mut request = Request::builder().method(Method::GET).uri(METRICS_PATH);
+            if let Some(value) = authorization {
+                request = request.header(AUTHORIZATION, value);
+            }
+            request.body(()).unwrap()
+        };
+
+        for authorization in [None, Some("Bearer other"), Some("scrape")] {
+            let response = service.clone().oneshot(scrape(authorization)).await.unwrap();
+            assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+        }
+        let response = service.clone().oneshot(scrape(Some("Bearer scrape"))).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        assert!(response.body().contains("bach_block_height"));
+    }
+}
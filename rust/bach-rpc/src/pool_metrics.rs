@@ -0,0 +1,289 @@
+//! Transaction pool metrics
+//!
+//! `TxPoolMetrics` follows the pool between a transaction's admission and
+//! its block: how long validation took, for accepted and rejected
+//! submissions alike, how long admission took, and why pooled
+//! transactions were dropped without being committed. `/metrics` exports
+//! them next to the pool's current depth per lane, every series labelled
+//! with the chain ID so scrapers of several chains can tell them apart.
+//!
+//! Lanes group pooled transactions by what they do: contract deployments,
+//! calls to the node's native contracts (faucet, bytecode staging, org
+//! grants, contract ACL), other calls carrying data, and plain transfers.
+
+use crate::interceptor::Histogram;
+use crate::PendingTransaction;
+use bach_evm::{
+    bytecode_staging_address, contract_acl_address, faucet_address, org_grants_address,
+};
+use std::fmt::Write;
+use std::sync::Mutex;
+use std::time::Duration;
+
+/// Kind of work a pooled transaction does
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord)]
+pub enum TxLane {
+    /// Contract creation
+    Deploy,
+    /// Call to a native contract
+    Native,
+    /// Contract call with calldata
+    Call,
+    /// Value transfer without calldata
+    Transfer,
+}
+
+impl TxLane {
+    /// Every lane, in declaration order.
+    pub const ALL: [TxLane; 4] = [Self::Deploy, Self::Native, Self::Call, Self::Transfer];
+
+    /// Returns the lane of `tx`.
+    pub fn of(tx: &PendingTransaction) -> Self {
+        let native = [
+            faucet_address(),
+            bytecode_staging_address(),
+            org_grants_address(),
+            contract_acl_address(),
+        ];
+        match tx.to {
+            None => Self::Deploy,
+            Some(to) if native.contains(&to) => Self::Native,
+            Some(_) if !tx.data.is_empty() => Self::Call,
+            Some(_) => Self::Transfer,
+        }
+    }
+
+    /// Returns the lane's metric label.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Deploy => "deploy",
+            Self::Native => "native",
+            Self::Call => "call",
+            Self::Transfer => "transfer",
+        }
+    }
+}
+
+/// Why a transaction left the pool without being committed
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord)]
+pub enum EvictionReason {
+    /// Older than the pool's age limit
+    Expired,
+    /// Already committed, or replaced by a resubmission with the same hash
+    Duplicate,
+    /// Over the pool's transaction limit
+    Quota,
+}
+
+impl EvictionReason {
+    /// Every reason, in declaration order.
+    pub const ALL: [EvictionReason; 3] = [Self::Expired, Self::Duplicate, Self::Quota];
+
+    /// Returns the reason's metric label.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Expired => "expired",
+            Self::Duplicate => "duplicate",
+            Self::Quota => "quota",
+        }
+    }
+}
+
+/// Admission latencies and eviction counts of the transaction pool.
+#[derive(Debug, Default)]
+pub struct TxPoolMetrics {
+    inner: Mutex<PoolCounters>,
+}
+
+#[derive(Debug, Default)]
+struct PoolCounters {
+    /// Time from receipt to the end of the transaction's checks, of
+    /// accepted and rejected transactions
+    validation: [Histogram; 2],
+    /// Time from receipt to the transaction entering the pool
+    admission: Histogram,
+    /// Evictions per reason, indexed like `EvictionReason::ALL`
+    evictions: [u64; EvictionReason::ALL.len()],
+}
+
+impl TxPoolMetrics {
+    /// Records a transaction whose checks took `elapsed` and passed if
+    /// `accepted`.
+    pub fn record_validation(&self, elapsed: Duration, accepted: bool) {
+        self.inner.lock().unwrap().validation[usize::from(!accepted)].record(elapsed);
+    }
+
+    /// Returns the number of submitted transactions that failed their
+    /// checks.
+    pub fn rejected(&self) -> u64 {
+        self.inner.lock().unwrap().validation[1].count()
+    }
+
+    /// Records a transaction that entered the pool `elapsed` after it was
+    /// received.
+    pub fn record_admission(&self, elapsed: Duration) {
+        self.inner.lock().unwrap().admission.record(elapsed);
+    }
+
+    /// Records `count` transactions dropped from the pool for `reason`.
+    pub fn record_evictions(&self, reason: EvictionReason, count: u64) {
+        self.inner.lock().unwrap().evictions[reason as usize] += count;
+    }
+
+    /// Returns the number of transactions dropped for `reason`.
+    pub fn evictions(&self, reason: EvictionReason) -> u64 {
+        self.inner.lock().unwrap().evictions[reason as usize]
+    }
+
+    /// Returns the number of transactions admitted to the pool.
+    pub fn admitted(&self) -> u64 {
+        self.inner.lock().unwrap().admission.count()
+    }
+
+    /// Renders the pool metrics of chain `chain_id` holding `pending` in
+    /// the Prometheus text format.
+    pub fn render<'a>(
+        &self,
+        chain_id: u64,
+        pending: impl IntoIterator<Item = &'a PendingTransaction>,
+    ) -> String {
+        let chain = format!("chain_id=\"{}\"", chain_id);
+        let mut depth = [0usize; TxLane::ALL.len()];
+        for tx in pending {
+            depth[TxLane::of(tx) as usize] += 1;
+        }
+
+        let mut out = String::new();
+        let name = "bach_txpool_size";
+        header(
+            &mut out,
+            name,
+            "Transactions waiting in the pool, by lane",
+            "gauge",
+        );
+        for (lane, count) in TxLane::ALL.iter().zip(depth) {
+            let _ = writeln!(
+                out,
+                "{}{{{},lane=\"{}\"}} {}",
+                name,
+                chain,
+                lane.as_str(),
+                count
+            );
+        }
+
+        let counters = self.inner.lock().unwrap();
+        let name = "bach_txpool_evictions_total";
+        header(
+            &mut out,
+            name,
+            "Transactions dropped from the pool without being committed, by reason",
+            "counter",
+        );
+        for (reason, count) in EvictionReason::ALL.iter().zip(counters.evictions) {
+            let _ = writeln!(
+                out,
+                "{}{{{},reason=\"{}\"}} {}",
+                name,
+                chain,
+                reason.as_str(),
+                count
+            );
+        }
+
+        let name = "bach_txpool_validation_seconds";
+        header(
+            &mut out,
+            name,
+            "Time taken to check submitted transactions",
+            "histogram",
+        );
+        for (histogram, outcome) in counters.validation.iter().zip(["accepted", "rejected"]) {
+            let labels = format!("{},outcome=\"{}\"", chain, outcome);
+            histogram.render(&mut out, name, &labels);
+        }
+        let name = "bach_txpool_admission_seconds";
+        header(
+            &mut out,
+            name,
+            "Time from receiving a transaction to adding it to the pool",
+            "histogram",
+        );
+        counters.admission.render(&mut out, name, &chain);
+        out
+    }
+}
+
+fn header(out: &mut String, name: &str, help: &str, kind: &str) {
+    let _ = writeln!(out, "# HELP {} {}", name, help);
+    let _ = writeln!(out, "# TYPE {} {}", name, kind);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_primitives::{Address, H256, U256};
+
+    fn pending(to: Option<Address>, data: &[u8]) -> PendingTransaction {
+        PendingTransaction {
+            hash: H256::zero(),
+            from: Address::zero(),
+            to,
+            value: U256::ZERO,
+            data: data.to_vec(),
+            gas: 21000,
+            gas_price: U256::ZERO,
+            nonce: 0,
+            received_at: 0,
+            execution: None,
+            signature: None,
+        }
+    }
+
+    #[test]
+    fn test_lanes() {
+        let other = Address::from([7; 20]);
+        assert_eq!(TxLane::of(&pending(None, &[1])), TxLane::Deploy);
+        assert_eq!(
+            TxLane::of(&pending(Some(faucet_address()), &[])),
+            TxLane::Native
+        );
+        assert_eq!(TxLane::of(&pending(Some(other), &[1])), TxLane::Call);
+        assert_eq!(TxLane::of(&pending(Some(other), &[])), TxLane::Transfer);
+    }
+
+    #[test]
+    fn test_render() {
+        let metrics = TxPoolMetrics::default();
+        metrics.record_validation(Duration::from_millis(2), true);
+        metrics.record_validation(Duration::from_millis(40), false);
+        assert_eq!(metrics.rejected(), 1);
+        metrics.record_admission(Duration::from_millis(30));
+        metrics.record_evictions(EvictionReason::Expired, 2);
+        metrics.record_evictions(EvictionReason::Quota, 1);
+        assert_eq!(metrics.evictions(EvictionReason::Expired), 2);
+        assert_eq!(metrics.evictions(EvictionReason::Duplicate), 0);
+        assert_eq!(metrics.admitted(), 1);
+
+        let other = Address::from([7; 20]);
+        let pool = [
+            pending(Some(other), &[]),
+            pending(Some(other), &[]),
+            pending(None, &[1]),
+        ];
+        let out = metrics.render(9, &pool);
+        assert!(out.contains("# TYPE bach_txpool_size gauge\n"));
+        assert!(out.contains("bach_txpool_size{chain_id=\"9\",lane=\"transfer\"} 2\n"));
+        assert!(out.contains("bach_txpool_size{chain_id=\"9\",lane=\"deploy\"} 1\n"));
+        assert!(out.contains("bach_txpool_size{chain_id=\"9\",lane=\"native\"} 0\n"));
+        assert!(out.contains("bach_txpool_evictions_total{chain_id=\"9\",reason=\"expired\"} 2\n"));
+        assert!(out.contains("bach_txpool_evictions_total{chain_id=\"9\",reason=\"quota\"} 1\n"));
+        let validation = "bach_txpool_validation_seconds_bucket{chain_id=\"9\"";
+        assert!(out.contains(&format!("{},outcome=\"accepted\",le=\"0.005\"}} 1\n", validation)));
+        assert!(out.contains(&format!("{},outcome=\"rejected\",le=\"0.005\"}} 0\n", validation)));
+        assert!(
+            out.contains("bach_txpool_admission_seconds_bucket{chain_id=\"9\",le=\"0.025\"} 0\n")
+        );
+        assert!(out.contains("bach_txpool_admission_seconds_count{chain_id=\"9\"} 1\n"));
+    }
+}
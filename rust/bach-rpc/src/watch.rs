@@ -0,0 +1,161 @@
+//! Waiting for transactions to be committed
+
+use bach_primitives::{Clock, SystemClock, H256};
+use bach_storage::TransactionReceipt;
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::sync::oneshot;
+
+/// Default time `bach_sendTransactionWithResult` waits for commit
+pub const DEFAULT_SUBMIT_WAIT_MS: u64 = 10_000;
+
+/// Longest time a client may ask `bach_sendTransactionWithResult` to wait
+pub const MAX_SUBMIT_WAIT_MS: u64 = 60_000;
+
+/// Hands receipts of committed transactions to callers waiting on them.
+///
+/// The committer calls `notify` for every receipt it persists. Receipts
+/// for transactions nobody is watching are dropped.
+#[derive(Debug)]
+pub struct TxWatcher {
+    waiters: Mutex<HashMap<H256, Vec<oneshot::Sender<TransactionReceipt>>>>,
+    clock: Arc<dyn Clock>,
+}
+
+impl Default for TxWatcher {
+    fn default() -> Self {
+        Self::with_clock(Arc::new(SystemClock))
+    }
+}
+
+impl TxWatcher {
+    /// Creates a watcher with no waiters.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Creates a watcher whose waits time out on the given clock.
+    pub fn with_clock(clock: Arc<dyn Clock>) -> Self {
+        Self {
+            waiters: Mutex::new(HashMap::new()),
+            clock,
+        }
+    }
+
+    /// Registers interest in a transaction's receipt.
+    pub fn watch(&self, tx_hash: H256) -> oneshot::Receiver<TransactionReceipt> {
+        let (tx, rx) = oneshot::channel();
+        self.waiters.lock().unwrap().entry(tx_hash).or_default().push(tx);
+        rx
+    }
+
+    /// Delivers a committed receipt and returns the number of waiters woken.
+    pub fn notify(&self, receipt: &TransactionReceipt) -> usize {
+        let waiters = self
+            .waiters
+            .lock()
+            .unwrap()
+            .remove(&receipt.transaction_hash_h256())
+            .unwrap_or_default();
+        waiters
+            .into_iter()
+            .map(|waiter| waiter.send(receipt.clone()))
+            .filter(Result::is_ok)
+            .count()
+    }
+
+    /// Waits up to `timeout` for a receipt registered with `watch`.
+    ///
+    /// Drops the registration on timeout so abandoned waits do not pile up.
+    pub async fn wait(
+        &self,
+        tx_hash: H256,
+        rx: oneshot::Receiver<TransactionReceipt>,
+        timeout: Duration,
+    ) -> Option<TransactionReceipt> {
+        let result = bach_primitives::timeout(self.clock.as_ref(), timeout, rx).await;
+        match result {
+            Some(Ok(receipt)) => Some(receipt),
+            _ => {
+                let mut waiters = self.waiters.lock().unwrap();
+                if let Some(pending) = waiters.get_mut(&tx_hash) {
+                    pending.retain(|waiter| !waiter.is_closed());
+                    if pending.is_empty() {
+                        waiters.remove(&tx_hash);
+                    }
+                }
+                None
+            }
+        }
+    }
+
+    /// Returns the number of transactions being waited on.
+    pub fn watched_count(&self) -> usize {
+        self.waiters.lock().unwrap().len()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn receipt(tx_hash: H256) -> TransactionReceipt {
+        TransactionReceipt {
+            transaction_hash: *tx_hash.as_bytes(),
+            block_hash: [0x11; 32],
+            block_number: 5,
+            transaction_index: 2,
+            gas_used: 21000,
+            status: true,
+            logs: Vec::new(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_notify_wakes_all_waiters() {
+        let watcher = TxWatcher::new();
+        let hash = H256::from([1u8; 32]);
+        let first = watcher.watch(hash);
+        let second = watcher.watch(hash);
+        assert_eq!(watcher.watched_count(), 1);
+
+        assert_eq!(watcher.notify(&receipt(H256::from([2u8; 32]))), 0);
+        assert_eq!(watcher.notify(&receipt(hash)), 2);
+        assert_eq!(watcher.watched_count(), 0);
+
+        let wait = Duration::from_millis(100);
+        assert_eq!(watcher.wait(hash, first, wait).await.unwrap().block_number, 5);
+        assert_eq!(watcher.wait(hash, second, wait).await.unwrap().transaction_index, 2);
+    }
+
+    #[tokio::test]
+    async fn test_wait_times_out_and_unregisters() {
+        let watcher = TxWatcher::new();
+        let hash = H256::from([3u8; 32]);
+        let rx = watcher.watch(hash);
+
+        assert!(watcher.wait(hash, rx, Duration::from_millis(10)).await.is_none());
+        assert_eq!(watcher.watched_count(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_wait_times_out_on_fake_clock() {
+        let clock = bach_primitives::FakeClock::new();
+        let watcher = Arc::new(TxWatcher::with_clock(Arc::new(clock.clone())));
+        let hash = H256::from([4u8; 32]);
+        let rx = watcher.watch(hash);
+
+        let waiting = Arc::clone(&watcher);
+        let wait = tokio::spawn(async move {
+            waiting.wait(hash, rx, Duration::from_secs(30)).await
+        });
+        while clock.pending_sleeps() == 0 {
+            tokio::task::yield_now().await;
+        }
+        clock.advance(Duration::from_secs(30));
+
+        assert!(wait.await.unwrap().is_none());
+        assert_eq!(watcher.watched_count(), 0);
+    }
+}
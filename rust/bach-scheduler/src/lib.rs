@@ -4,14 +4,20 @@
 //! - `SeamlessScheduler`: Implementation of Algorithm 2 (Seamless Scheduling)
 //! - `TransactionExecutor`: Trait for executing transactions
 //! - `Scheduler`: Trait for scheduling blocks
+//! - `PoolTuner`: Sizes the execution pool from conflict rate and utilization
+
+mod tuner;
+
+pub use tuner::{ConflictWindow, PoolSizeConfig, PoolTuner};
 
 use bach_crypto::keccak256_concat;
-use bach_primitives::H256;
+use bach_primitives::{Clock, ErrorCode, ErrorCoded, SystemClock, H256};
 use bach_state::{OwnershipTable, Snapshot, StateDB, StateError};
-use bach_types::{Block, PriorityCode, ReadWriteSet, Transaction};
+use bach_types::{Block, PriorityCode, ReadWriteSet, Transaction, TxDag};
 use rayon::prelude::*;
 use std::collections::HashMap;
-use std::sync::Arc;
+use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
 
 /// Default number of worker threads
 pub const DEFAULT_THREAD_COUNT: usize = 4;
@@ -22,6 +28,9 @@ pub const MAX_RETRIES: usize = 100;
 /// Maximum re-execution attempts per individual transaction
 pub const MAX_TX_RETRIES: usize = 10;
 
+/// Keys an ownership table may hold and still be kept for the next block
+const MAX_RETAINED_OWNERSHIP_KEYS: usize = 1 << 16;
+
 /// Errors from scheduling operations
 #[derive(Debug, Clone)]
 pub enum SchedulerError {
@@ -41,6 +50,18 @@ impl From<StateError> for SchedulerError {
     }
 }
 
+impl ErrorCoded for SchedulerError {
+    fn error_code(&self) -> ErrorCode {
+        match self {
+            SchedulerError::ExecutionFailed { .. } | SchedulerError::MaxRetriesExceeded { .. } => {
+                ErrorCode::ExecutionFailed
+            }
+            SchedulerError::InvalidBlock(_) => ErrorCode::InvalidProposal,
+            SchedulerError::StateError(_) => ErrorCode::Storage,
+        }
+    }
+}
+
 /// Result of executing a single transaction.
 #[derive(Debug, Clone)]
 pub enum ExecutionResult {
@@ -92,10 +113,43 @@ pub struct ScheduleResult {
     pub block_hash: H256,
     /// New state root after applying changes
     pub state_root: H256,
+    /// Sparse Merkle commitment over the new state, if the state database
+    /// maintains one
+    pub state_commitment: Option<H256>,
     /// Number of re-executions performed
     pub reexecution_count: usize,
 }
 
+impl ScheduleResult {
+    /// Returns the dependency DAG of the block's transactions in block
+    /// order. Transactions that were not confirmed have no accesses.
+    pub fn dag(&self, block: &Block) -> TxDag {
+        self.dag_with_system_txs(block, 0)
+    }
+
+    /// Returns the dependency DAG of the block's transactions, whose last
+    /// `system_txs` are system transactions depending on every transaction
+    /// before them.
+    pub fn dag_with_system_txs(&self, block: &Block, system_txs: usize) -> TxDag {
+        let rwsets: HashMap<H256, &ReadWriteSet> = self
+            .confirmed
+            .iter()
+            .map(|etx| (etx.hash(), &etx.rwset))
+            .collect();
+        let empty = ReadWriteSet::new();
+        let user_txs = block.transactions.len().saturating_sub(system_txs);
+        let mut dag = TxDag::from_rwsets(
+            block.transactions[..user_txs]
+                .iter()
+                .map(|tx| rwsets.get(&tx.hash()).copied().unwrap_or(&empty)),
+        );
+        for _ in user_txs..block.transactions.len() {
+            dag.append_system_tx();
+        }
+        dag
+    }
+}
+
 /// Interface for executing transactions.
 pub trait TransactionExecutor: Send + Sync {
     /// Executes a transaction against a state snapshot.
@@ -142,6 +196,24 @@ pub struct SeamlessScheduler {
     /// Number of parallel execution threads (reserved for future use)
     #[allow(dead_code)]
     thread_count: usize,
+    /// Dedicated execution pool and its tuner (global rayon pool if None)
+    tuning: Option<AutoTuning>,
+    /// Times executions for the tuner
+    clock: Arc<dyn Clock>,
+    /// Ownership table of the last block, reused by the next one in a new
+    /// epoch
+    ownership: Mutex<Option<OwnershipTable>>,
+}
+
+/// A dedicated execution pool whose width a `PoolTuner` adjusts.
+///
+/// The pool holds the tuner's largest size and is built once; resizing
+/// only changes how many pieces each block's executions are split into,
+/// so at most `width` workers run transactions at a time.
+struct AutoTuning {
+    pool: rayon::ThreadPool,
+    width: AtomicUsize,
+    tuner: Mutex<PoolTuner>,
 }
 
 impl SeamlessScheduler {
@@ -152,7 +224,12 @@ impl SeamlessScheduler {
     pub fn new(thread_count: usize) -> Self {
         // Configure rayon thread pool
         let thread_count = if thread_count == 0 { 1 } else { thread_count };
-        Self { thread_count }
+        Self {
+            thread_count,
+            tuning: None,
+            clock: Arc::new(SystemClock),
+            ownership: Mutex::new(None),
+        }
     }
 
     /// Creates a scheduler with default thread count.
@@ -160,6 +237,77 @@ impl SeamlessScheduler {
         Self::new(DEFAULT_THREAD_COUNT)
     }
 
+    /// Creates a scheduler that executes on its own pool, resized after
+    /// every block within the given bounds.
+    pub fn with_auto_tuning(config: PoolSizeConfig) -> Self {
+        let tuner = PoolTuner::new(config);
+        let threads = tuner.threads();
+        let pool = rayon::ThreadPoolBuilder::new()
+            .num_threads(tuner.config().max_threads)
+            .build()
+            .expect("failed to build execution pool");
+        Self {
+            thread_count: threads,
+            tuning: Some(AutoTuning {
+                pool,
+                width: AtomicUsize::new(threads),
+                tuner: Mutex::new(tuner),
+            }),
+            clock: Arc::new(SystemClock),
+            ownership: Mutex::new(None),
+        }
+    }
+
+    /// Sets the clock used to time executions.
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Returns the current execution pool size (None on the global pool).
+    pub fn pool_size(&self) -> Option<usize> {
+        self.tuning
+            .as_ref()
+            .map(|t| t.width.load(Ordering::Relaxed))
+    }
+
+    /// Returns the smallest piece `items` executions are split into, so
+    /// that no more pieces run at once than the tuned pool size.
+    fn min_split(&self, items: usize) -> usize {
+        self.pool_size()
+            .map_or(1, |width| items.div_ceil(width.max(1)).max(1))
+    }
+
+    /// Feeds a scheduled block to the tuner and resizes the pool if needed.
+    fn tune(&self, txs: usize, reexecutions: usize, busy_nanos: u64, wall_nanos: u64) {
+        let Some(tuning) = &self.tuning else {
+            return;
+        };
+        let threads = tuning.width.load(Ordering::Relaxed);
+        let capacity = wall_nanos.saturating_mul(threads as u64).max(1);
+        let utilization = (busy_nanos as f64 / capacity as f64).min(1.0);
+
+        let resized = tuning.tuner.lock().unwrap().observe(txs, reexecutions, utilization);
+        if let Some(threads) = resized {
+            tuning.width.store(threads, Ordering::Relaxed);
+        }
+    }
+
+    /// Runs an executor call and adds its duration to `busy`.
+    fn timed_execute(
+        &self,
+        executor: &dyn TransactionExecutor,
+        tx: &Transaction,
+        snapshot: &Snapshot,
+        busy: &AtomicU64,
+    ) -> (ReadWriteSet, ExecutionResult) {
+        let started = self.clock.now();
+        let output = executor.execute(tx, snapshot);
+        let elapsed = self.clock.now().saturating_duration_since(started);
+        busy.fetch_add(elapsed.as_nanos() as u64, Ordering::Relaxed);
+        output
+    }
+
     /// Computes the priority code for a transaction in a block.
     fn compute_priority(tx: &Transaction, block: &Block) -> PriorityCode {
         let tx_hash = tx.hash();
@@ -175,16 +323,18 @@ impl SeamlessScheduler {
         snapshot: &Snapshot,
         ownership_table: &OwnershipTable,
         executor: &dyn TransactionExecutor,
+        busy: &AtomicU64,
     ) -> Vec<ExecutedTransaction> {
         block
             .transactions
             .par_iter()
+            .with_min_len(self.min_split(block.transactions.len()))
             .map(|tx| {
                 // Compute priority code
                 let priority = Self::compute_priority(tx, block);
 
                 // Execute transaction
-                let (rwset, result) = executor.execute(tx, snapshot);
+                let (rwset, result) = self.timed_execute(executor, tx, snapshot, busy);
 
                 // Try to claim ownership of write keys
                 for (key, _) in rwset.writes() {
@@ -223,9 +373,12 @@ impl SeamlessScheduler {
             }
 
             // Check read set: abort if another transaction has written to a key we read
-            // A reader conflicts if any writer (other than itself) owns the key
+            // A reader conflicts if any writer (other than itself) owns the key.
+            // Delta keys are checked the same way: deltas commute with each other
+            // but not with a plain write, so they never claim ownership themselves.
             if !conflict {
-                for key in etx.rwset.reads() {
+                let delta_keys = etx.rwset.deltas().iter().map(|(k, _)| k);
+                for key in etx.rwset.reads().iter().chain(delta_keys) {
                     let entry = ownership_table.get_or_create(key);
                     let current_owner = entry.current_owner();
                     // Conflict if someone else owns this key (they wrote to it)
@@ -247,18 +400,48 @@ impl SeamlessScheduler {
         (passed, aborted)
     }
 
+    /// Resolves a confirmed transaction's writes and deltas against the
+    /// values committed earlier in the block (or the snapshot).
+    ///
+    /// Returns None if a delta underflows, overflows or targets a non-numeric
+    /// value; the transaction must then be failed instead of confirmed.
+    fn resolve_writes(
+        etx: &ExecutedTransaction,
+        pending: &HashMap<H256, Vec<u8>>,
+        snapshot: &Snapshot,
+    ) -> Option<Vec<(H256, Vec<u8>)>> {
+        let mut writes = etx.rwset.writes().to_vec();
+        let mut values: HashMap<H256, Vec<u8>> = HashMap::new();
+        for (key, delta) in etx.rwset.deltas() {
+            let current = values
+                .get(key)
+                .or_else(|| pending.get(key))
+                .cloned()
+                .or_else(|| snapshot.get(key));
+            let value = delta.apply(current.as_deref())?.to_be_bytes().to_vec();
+            values.insert(*key, value.clone());
+            writes.push((*key, value));
+        }
+        Some(writes)
+    }
+
     /// Re-executes aborted transactions (Phase 2 continued).
     fn re_execute(
+        &self,
         aborted: Vec<ExecutedTransaction>,
         snapshot: &Snapshot,
         ownership_table: &OwnershipTable,
         executor: &dyn TransactionExecutor,
+        busy: &AtomicU64,
     ) -> Vec<ExecutedTransaction> {
+        let min_split = self.min_split(aborted.len());
         aborted
             .into_par_iter()
+            .with_min_len(min_split)
             .map(|etx| {
                 // Re-execute with same priority
-                let (rwset, result) = executor.execute(&etx.transaction, snapshot);
+                let (rwset, result) =
+                    self.timed_execute(executor, &etx.transaction, snapshot, busy);
 
                 // Try to claim ownership of new write keys
                 for (key, _) in rwset.writes() {
@@ -290,8 +473,38 @@ impl Scheduler for SeamlessScheduler {
         state: &mut dyn StateDB,
         executor: &dyn TransactionExecutor,
     ) -> Result<ScheduleResult, SchedulerError> {
-        // Create ownership table for conflict tracking
-        let ownership_table = Arc::new(OwnershipTable::new());
+        let Some(tuning) = &self.tuning else {
+            return self.schedule_block(block, state, executor, &AtomicU64::new(0));
+        };
+
+        let txs = block.transactions.len();
+        let busy = AtomicU64::new(0);
+        let started = self.clock.now();
+        let result = tuning
+            .pool
+            .install(|| self.schedule_block(block, state, executor, &busy));
+
+        if let Ok(scheduled) = &result {
+            let wall = self.clock.now().saturating_duration_since(started).as_nanos() as u64;
+            self.tune(txs, scheduled.reexecution_count, busy.load(Ordering::Relaxed), wall);
+        }
+        result
+    }
+}
+
+impl SeamlessScheduler {
+    /// Runs Algorithm 2 on the current rayon pool.
+    fn schedule_block(
+        &self,
+        block: Block,
+        state: &mut dyn StateDB,
+        executor: &dyn TransactionExecutor,
+        busy: &AtomicU64,
+    ) -> Result<ScheduleResult, SchedulerError> {
+        // Ownership table for conflict tracking; a reused one starts a new
+        // epoch so the previous block's claims don't count
+        let ownership_table = self.ownership.lock().unwrap().take().unwrap_or_default();
+        ownership_table.advance_epoch();
 
         // Create snapshot for consistent reads
         let snapshot = state.snapshot();
@@ -300,11 +513,17 @@ impl Scheduler for SeamlessScheduler {
         let mut confirmed: Vec<ExecutedTransaction> = Vec::new();
         let mut reexecution_count: usize = 0;
 
+        // Writes of confirmed transactions in confirmation order, with deltas
+        // resolved to values, and the latest value per key
+        let mut all_writes: Vec<(H256, Vec<u8>)> = Vec::new();
+        let mut pending_values: HashMap<H256, Vec<u8>> = HashMap::new();
+
         // Track per-transaction retry counts to prevent DoS
         let mut tx_retry_counts: HashMap<H256, usize> = HashMap::new();
 
         // Phase 1: Optimistic parallel execution
-        let mut pending = self.optimistic_execute(&block, &snapshot, &ownership_table, executor);
+        let mut pending =
+            self.optimistic_execute(&block, &snapshot, &ownership_table, executor, busy);
 
         // Phase 2: Conflict detection and resolution loop
         let mut iteration = 0;
@@ -329,7 +548,23 @@ impl Scheduler for SeamlessScheduler {
                 let write_keys: Vec<H256> = etx.rwset.writes().iter().map(|(k, _)| *k).collect();
                 ownership_table.release_all(&write_keys);
 
-                confirmed.push(etx);
+                match Self::resolve_writes(&etx, &pending_values, &snapshot) {
+                    Some(writes) => {
+                        for (key, value) in &writes {
+                            pending_values.insert(*key, value.clone());
+                        }
+                        all_writes.extend(writes);
+                        confirmed.push(etx);
+                    }
+                    None => confirmed.push(ExecutedTransaction {
+                        transaction: etx.transaction,
+                        priority: etx.priority,
+                        rwset: ReadWriteSet::new(),
+                        result: ExecutionResult::Failed {
+                            reason: "Delta out of range".to_string(),
+                        },
+                    }),
+                }
             }
 
             // Re-execute aborted transactions (excluding those that exceeded per-tx retry limit)
@@ -358,7 +593,13 @@ impl Scheduler for SeamlessScheduler {
 
                 if !to_reexecute.is_empty() {
                     reexecution_count += to_reexecute.len();
-                    pending = Self::re_execute(to_reexecute, &snapshot, &ownership_table, executor);
+                    pending = self.re_execute(
+                        to_reexecute,
+                        &snapshot,
+                        &ownership_table,
+                        executor,
+                        busy,
+                    );
                 } else {
                     pending = Vec::new();
                 }
@@ -367,20 +608,22 @@ impl Scheduler for SeamlessScheduler {
             }
         }
 
-        // Phase 3: Commit all writes to state
-        let mut all_writes: Vec<(H256, Vec<u8>)> = Vec::new();
-        for etx in &confirmed {
-            for (key, value) in etx.rwset.writes() {
-                all_writes.push((*key, value.clone()));
-            }
+        // Keep the table for the next block unless it grew too large
+        if ownership_table.len() > MAX_RETAINED_OWNERSHIP_KEYS {
+            ownership_table.clear();
         }
+        *self.ownership.lock().unwrap() = Some(ownership_table);
+
+        // Phase 3: Commit all writes to state
         state.commit(&all_writes);
 
         // Compute state root (simplified - use snapshot hash)
         let state_root = {
             let final_snapshot = state.snapshot();
-            // Use keys hash as simple state root
-            let keys = state.keys();
+            // Use keys hash as simple state root, in key order so every
+            // node computes the same root for the same state
+            let mut keys = state.keys();
+            keys.sort();
             if keys.is_empty() {
                 H256::zero()
             } else {
@@ -399,9 +642,10 @@ impl Scheduler for SeamlessScheduler {
             confirmed,
             block_hash: block.hash(),
             state_root,
+            state_commitment: state.commitment(),
             reexecution_count,
         })
     }
 }
 
-// SeamlessScheduler is automatically Send + Sync because it only contains usize
+// SeamlessScheduler is Send + Sync: the tuned pool and tuner sit behind locks
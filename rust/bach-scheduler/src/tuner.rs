@@ -0,0 +1,189 @@
+//! Worker pool auto-tuning from conflict rate and worker utilization
+
+use std::collections::VecDeque;
+
+/// Blocks of history used to compute the conflict rate
+pub const CONFLICT_WINDOW_BLOCKS: usize = 16;
+
+/// Re-executions per transaction above which the pool shrinks
+pub const HIGH_CONFLICT_RATE: f64 = 0.5;
+
+/// Re-executions per transaction below which the pool may grow
+pub const LOW_CONFLICT_RATE: f64 = 0.1;
+
+/// Worker utilization above which the pool may grow
+pub const HIGH_UTILIZATION: f64 = 0.75;
+
+/// Worker utilization below which the pool shrinks
+pub const LOW_UTILIZATION: f64 = 0.25;
+
+/// Bounds for the execution pool size.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct PoolSizeConfig {
+    /// Smallest pool size
+    pub min_threads: usize,
+    /// Largest pool size
+    pub max_threads: usize,
+}
+
+impl PoolSizeConfig {
+    /// Returns the bounds with `min_threads >= 1` and `max_threads >= min_threads`.
+    pub fn normalized(self) -> Self {
+        let min_threads = self.min_threads.max(1);
+        Self {
+            min_threads,
+            max_threads: self.max_threads.max(min_threads),
+        }
+    }
+}
+
+impl Default for PoolSizeConfig {
+    fn default() -> Self {
+        let cpus = std::thread::available_parallelism().map(|n| n.get()).unwrap_or(1);
+        Self {
+            min_threads: 1,
+            max_threads: cpus,
+        }
+    }
+}
+
+/// Sliding window of per-block transaction and re-execution counts.
+#[derive(Debug, Clone)]
+pub struct ConflictWindow {
+    samples: VecDeque<(usize, usize)>,
+    capacity: usize,
+}
+
+impl ConflictWindow {
+    /// Creates a window covering the last `capacity` blocks.
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            samples: VecDeque::with_capacity(capacity),
+            capacity: capacity.max(1),
+        }
+    }
+
+    /// Records one block.
+    pub fn record(&mut self, txs: usize, reexecutions: usize) {
+        if self.samples.len() == self.capacity {
+            self.samples.pop_front();
+        }
+        self.samples.push_back((txs, reexecutions));
+    }
+
+    /// Returns re-executions per transaction over the window.
+    pub fn rate(&self) -> f64 {
+        let (txs, reexecutions) = self
+            .samples
+            .iter()
+            .fold((0, 0), |(t, r), (txs, reexec)| (t + txs, r + reexec));
+        if txs == 0 {
+            0.0
+        } else {
+            reexecutions as f64 / txs as f64
+        }
+    }
+}
+
+/// Adjusts the pool size one thread at a time after each block.
+///
+/// Shrinks when transactions keep aborting (extra workers only produce
+/// more re-executions) or when workers sit idle, and grows when workers
+/// are busy and conflicts are rare.
+#[derive(Debug, Clone)]
+pub struct PoolTuner {
+    config: PoolSizeConfig,
+    threads: usize,
+    window: ConflictWindow,
+}
+
+impl PoolTuner {
+    /// Creates a tuner starting at the largest allowed pool size.
+    pub fn new(config: PoolSizeConfig) -> Self {
+        let config = config.normalized();
+        Self {
+            config,
+            threads: config.max_threads,
+            window: ConflictWindow::new(CONFLICT_WINDOW_BLOCKS),
+        }
+    }
+
+    /// Returns the current pool size.
+    pub fn threads(&self) -> usize {
+        self.threads
+    }
+
+    /// Returns the pool size bounds.
+    pub fn config(&self) -> PoolSizeConfig {
+        self.config
+    }
+
+    /// Returns the conflict rate over the recent blocks.
+    pub fn conflict_rate(&self) -> f64 {
+        self.window.rate()
+    }
+
+    /// Records a scheduled block and returns the new pool size if it changed.
+    ///
+    /// `utilization` is the fraction of worker time spent executing
+    /// transactions while the block was scheduled.
+    pub fn observe(&mut self, txs: usize, reexecutions: usize, utilization: f64) -> Option<usize> {
+        if txs == 0 {
+            return None;
+        }
+        self.window.record(txs, reexecutions);
+
+        let rate = self.window.rate();
+        let target = if rate > HIGH_CONFLICT_RATE || utilization < LOW_UTILIZATION {
+            self.threads.saturating_sub(1)
+        } else if rate < LOW_CONFLICT_RATE && utilization > HIGH_UTILIZATION {
+            self.threads + 1
+        } else {
+            self.threads
+        };
+
+        let target = target.clamp(self.config.min_threads, self.config.max_threads);
+        if target == self.threads {
+            return None;
+        }
+        self.threads = target;
+        Some(target)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_shrinks_on_conflicts_and_grows_when_busy() {
+        let mut tuner = PoolTuner::new(PoolSizeConfig { min_threads: 2, max_threads: 4 });
+        assert_eq!(tuner.threads(), 4);
+
+        // Every transaction re-executed once
+        assert_eq!(tuner.observe(10, 10, 0.9), Some(3));
+        assert_eq!(tuner.observe(10, 10, 0.9), Some(2));
+        assert_eq!(tuner.observe(10, 10, 0.9), None);
+
+        // Conflicts fade out of the window, then busy workers grow the pool
+        for _ in 0..CONFLICT_WINDOW_BLOCKS {
+            tuner.observe(10, 0, 0.5);
+        }
+        assert!(tuner.conflict_rate() < LOW_CONFLICT_RATE);
+        assert_eq!(tuner.observe(10, 0, 0.9), Some(3));
+        assert_eq!(tuner.observe(10, 0, 0.9), Some(4));
+        assert_eq!(tuner.observe(10, 0, 0.9), None);
+
+        // Idle workers shrink the pool
+        assert_eq!(tuner.observe(10, 0, 0.1), Some(3));
+    }
+
+    #[test]
+    fn test_empty_blocks_and_bounds() {
+        let mut tuner = PoolTuner::new(PoolSizeConfig { min_threads: 0, max_threads: 0 });
+        assert_eq!(tuner.config(), PoolSizeConfig { min_threads: 1, max_threads: 1 });
+        assert_eq!(tuner.observe(0, 0, 0.0), None);
+        assert_eq!(tuner.observe(5, 50, 0.0), None);
+        assert_eq!(tuner.threads(), 1);
+    }
+}
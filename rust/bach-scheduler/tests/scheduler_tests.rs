@@ -10,13 +10,14 @@
 //! - Algorithm 2: Seamless Scheduling scenarios
 
 use bach_scheduler::{
-    ExecutedTransaction, ExecutionResult, ScheduleResult, Scheduler, SchedulerError,
-    SeamlessScheduler, TransactionExecutor, DEFAULT_THREAD_COUNT, MAX_RETRIES,
+    ExecutedTransaction, ExecutionResult, PoolSizeConfig, ScheduleResult, Scheduler,
+    SchedulerError, SeamlessScheduler, TransactionExecutor, DEFAULT_THREAD_COUNT, MAX_RETRIES,
 };
 use bach_primitives::{Address, H256, U256};
-use bach_types::{Block, PriorityCode, ReadWriteSet, Transaction};
-use bach_state::{MemoryStateDB, Snapshot, StateError};
+use bach_types::{Block, Delta, PriorityCode, ReadWriteSet, Transaction};
+use bach_state::{MemoryStateDB, Snapshot, StateDB, StateError};
 use bach_crypto::PrivateKey;
+use bach_testutil::TestBlockBuilder;
 use std::collections::HashMap;
 use std::sync::{Arc, Mutex};
 
@@ -295,6 +296,7 @@ fn schedule_result_contains_all_fields() {
         confirmed: vec![],
         block_hash: H256::from([1u8; 32]),
         state_root: H256::from([2u8; 32]),
+        state_commitment: None,
         reexecution_count: 5,
     };
 
@@ -317,6 +319,7 @@ fn schedule_result_with_confirmed_transactions() {
         confirmed: vec![executed],
         block_hash: H256::zero(),
         state_root: H256::zero(),
+        state_commitment: None,
         reexecution_count: 0,
     };
 
@@ -329,6 +332,7 @@ fn schedule_result_zero_reexecution_count() {
         confirmed: vec![],
         block_hash: H256::zero(),
         state_root: H256::zero(),
+        state_commitment: None,
         reexecution_count: 0,
     };
 
@@ -341,6 +345,7 @@ fn schedule_result_is_debug() {
         confirmed: vec![],
         block_hash: H256::zero(),
         state_root: H256::zero(),
+        state_commitment: None,
         reexecution_count: 0,
     };
 
@@ -654,6 +659,31 @@ fn schedule_releases_ownership_after_confirmation() {
     }
 }
 
+#[test]
+fn schedule_reuses_ownership_table_across_blocks() {
+    let scheduler = SeamlessScheduler::default();
+    let key = H256::from([0x44u8; 32]);
+    let txs: Vec<Transaction> = (1..=3).map(create_test_transaction).collect();
+    let mut executor = MockExecutor::new();
+    for (i, tx) in txs.iter().enumerate() {
+        let mut rwset = ReadWriteSet::new();
+        rwset.record_read(key);
+        rwset.record_write(key, vec![i as u8]);
+        executor = executor.with_rwset(tx.hash(), rwset);
+    }
+
+    // The second block's claims start from a clean epoch, so scheduling
+    // it on a used scheduler gives the same result as on a fresh one
+    let run = |scheduler: &SeamlessScheduler, height: u64| {
+        let block = Block::new(height, H256::zero(), txs.clone(), 1000);
+        let result = scheduler.schedule(block, &mut MemoryStateDB::new(), &executor).unwrap();
+        let order: Vec<H256> = result.confirmed.iter().map(|etx| etx.hash()).collect();
+        (order, result.state_root)
+    };
+    run(&scheduler, 1);
+    assert_eq!(run(&scheduler, 2), run(&SeamlessScheduler::default(), 2));
+}
+
 #[test]
 fn schedule_handles_transaction_failure() {
     let scheduler = SeamlessScheduler::default();
@@ -727,6 +757,28 @@ fn schedule_updates_state() {
     }
 }
 
+#[test]
+fn schedule_reports_state_commitment() {
+    let scheduler = SeamlessScheduler::default();
+    let tx = create_test_transaction(1);
+    let key = H256::from([1u8; 32]);
+    let mut rwset = ReadWriteSet::new();
+    rwset.record_write(key, vec![1, 2, 3]);
+    let executor = MockExecutor::new().with_rwset(tx.hash(), rwset);
+    let block = Block::new(1, H256::zero(), vec![tx], 1000);
+
+    let mut plain = MemoryStateDB::new();
+    let result = scheduler.schedule(block.clone(), &mut plain, &executor).unwrap();
+    assert!(result.state_commitment.is_none());
+
+    let mut committed = MemoryStateDB::with_commitment();
+    let result = scheduler.schedule(block, &mut committed, &executor).unwrap();
+    let commitment = result.state_commitment.unwrap();
+    assert_eq!(Some(commitment), committed.commitment());
+    let proof = committed.prove(&key).unwrap();
+    assert!(proof.verify(&commitment, &key, Some(&[1, 2, 3])));
+}
+
 #[test]
 fn schedule_computes_block_hash() {
     let scheduler = SeamlessScheduler::default();
@@ -1007,6 +1059,171 @@ fn algorithm2_priority_determines_ownership() {
     }
 }
 
+#[test]
+fn schedule_same_sender_deltas_do_not_conflict() {
+    let scheduler = SeamlessScheduler::default();
+    let mut state = MemoryStateDB::new();
+
+    let balance_key = H256::from([0xccu8; 32]);
+    state.commit(&[(balance_key, U256::from_u64(100).to_be_bytes().to_vec())]);
+
+    let txs: Vec<Transaction> = (1..=3).map(create_test_transaction).collect();
+    let mut executor = MockExecutor::new();
+    for (i, tx) in txs.iter().enumerate() {
+        // Each transaction pays a fee from the same balance and writes its own key
+        let mut rwset = ReadWriteSet::new();
+        rwset.record_delta(balance_key, Delta::Sub(U256::from_u64(10)));
+        rwset.record_write(H256::from([i as u8 + 1; 32]), vec![1]);
+        executor = executor.with_rwset(tx.hash(), rwset);
+    }
+
+    let block = Block::new(1, H256::zero(), txs.clone(), 1000);
+    let result = scheduler.schedule(block, &mut state, &executor).unwrap();
+
+    assert_eq!(result.confirmed.len(), 3);
+    assert_eq!(result.reexecution_count, 0);
+    assert!(result.confirmed.iter().all(|etx| etx.result.is_success()));
+    for tx in &txs {
+        assert_eq!(executor.call_count(&tx.hash()), 1);
+    }
+    assert_eq!(state.get(&balance_key), Some(U256::from_u64(70).to_be_bytes().to_vec()));
+}
+
+#[test]
+fn schedule_delta_conflicts_with_plain_write() {
+    let scheduler = SeamlessScheduler::default();
+    let mut state = MemoryStateDB::new();
+
+    let key = H256::from([0xddu8; 32]);
+    let tx1 = create_test_transaction(1);
+    let tx2 = create_test_transaction(2);
+
+    let mut rwset1 = ReadWriteSet::new();
+    rwset1.record_write(key, U256::from_u64(50).to_be_bytes().to_vec());
+    let mut rwset2 = ReadWriteSet::new();
+    rwset2.record_delta(key, Delta::Add(U256::from_u64(5)));
+
+    let executor = MockExecutor::new()
+        .with_rwset(tx1.hash(), rwset1)
+        .with_rwset(tx2.hash(), rwset2);
+
+    let block = Block::new(1, H256::zero(), vec![tx1, tx2.clone()], 1000);
+    let result = scheduler.schedule(block, &mut state, &executor).unwrap();
+
+    // The delta waits for the write and is applied on top of it
+    assert_eq!(executor.call_count(&tx2.hash()), 2);
+    assert_eq!(state.get(&key), Some(U256::from_u64(55).to_be_bytes().to_vec()));
+    assert_eq!(result.confirmed.len(), 2);
+}
+
+#[test]
+fn schedule_fails_transaction_whose_delta_underflows() {
+    let scheduler = SeamlessScheduler::default();
+    let mut state = MemoryStateDB::new();
+
+    let key = H256::from([0xeeu8; 32]);
+    state.commit(&[(key, U256::from_u64(15).to_be_bytes().to_vec())]);
+
+    let tx1 = create_test_transaction(1);
+    let tx2 = create_test_transaction(2);
+    let mut executor = MockExecutor::new();
+    for tx in [&tx1, &tx2] {
+        let mut rwset = ReadWriteSet::new();
+        rwset.record_delta(key, Delta::Sub(U256::from_u64(10)));
+        executor = executor.with_rwset(tx.hash(), rwset);
+    }
+
+    let block = Block::new(1, H256::zero(), vec![tx1, tx2], 1000);
+    let result = scheduler.schedule(block, &mut state, &executor).unwrap();
+
+    // Only one of the two fees fits in the balance
+    let failed: Vec<_> = result.confirmed.iter().filter(|etx| !etx.result.is_success()).collect();
+    assert_eq!(failed.len(), 1);
+    assert!(failed[0].rwset.deltas().is_empty());
+    assert_eq!(state.get(&key), Some(U256::from_u64(5).to_be_bytes().to_vec()));
+}
+
+#[test]
+fn auto_tuned_scheduler_stays_within_bounds() {
+    let config = PoolSizeConfig { min_threads: 1, max_threads: 3 };
+    let scheduler = SeamlessScheduler::with_auto_tuning(config);
+    assert_eq!(scheduler.pool_size(), Some(3));
+    assert_eq!(SeamlessScheduler::default().pool_size(), None);
+
+    let mut state = MemoryStateDB::new();
+    let key = H256::from([0x33u8; 32]);
+    for height in 1..=5 {
+        // Every transaction writes the same key, so most of them re-execute
+        let txs: Vec<Transaction> = (1..=4).map(|n| create_test_transaction(height * 10 + n)).collect();
+        let mut executor = MockExecutor::new();
+        for tx in &txs {
+            let mut rwset = ReadWriteSet::new();
+            rwset.record_write(key, vec![height as u8]);
+            executor = executor.with_rwset(tx.hash(), rwset);
+        }
+
+        let block = Block::new(height, H256::zero(), txs, 1000);
+        let result = scheduler.schedule(block, &mut state, &executor).unwrap();
+        assert_eq!(result.confirmed.len(), 4);
+
+        let size = scheduler.pool_size().unwrap();
+        assert!((config.min_threads..=config.max_threads).contains(&size));
+    }
+    assert_eq!(scheduler.pool_size(), Some(1));
+
+    // The pool keeps its threads, but a shrunk size caps how many
+    // transactions execute at once
+    let executor = InFlightExecutor::default();
+    let txs: Vec<Transaction> = (1..=6).map(|n| create_test_transaction(100 + n)).collect();
+    let block = Block::new(6, H256::zero(), txs, 1000);
+    scheduler.schedule(block, &mut state, &executor).unwrap();
+    assert_eq!(*executor.peak.lock().unwrap(), 1);
+}
+
+/// Executor recording the most executions in flight at once.
+#[derive(Default)]
+struct InFlightExecutor {
+    running: Mutex<usize>,
+    peak: Mutex<usize>,
+}
+
+impl TransactionExecutor for InFlightExecutor {
+    fn execute(&self, _tx: &Transaction, _snapshot: &Snapshot) -> (ReadWriteSet, ExecutionResult) {
+        let running = {
+            let mut running = self.running.lock().unwrap();
+            *running += 1;
+            *running
+        };
+        let mut peak = self.peak.lock().unwrap();
+        *peak = (*peak).max(running);
+        drop(peak);
+        std::thread::sleep(std::time::Duration::from_millis(5));
+        *self.running.lock().unwrap() -= 1;
+        (ReadWriteSet::new(), ExecutionResult::Success { output: vec![] })
+    }
+}
+
+#[test]
+fn schedule_reproduces_fixture_dag() {
+    let fixture = TestBlockBuilder::new(1)
+        .with_txs(3)
+        .with_conflicting_txs(3)
+        .with_config_tx(vec![0x01])
+        .build();
+    let mut executor = MockExecutor::new();
+    for (tx, rwset) in fixture.txs_with_rwsets() {
+        executor = executor.with_rwset(tx.hash(), rwset.clone());
+    }
+
+    let scheduler = SeamlessScheduler::default();
+    let mut state = MemoryStateDB::new();
+    let result = scheduler
+        .schedule(fixture.block.clone(), &mut state, &executor)
+        .unwrap();
+    assert_eq!(result.confirmed.len(), 7);
+    assert_eq!(result.dag(&fixture.block), fixture.dag);
+}
+
 // ============================================================================
 // Helper Functions
 // ============================================================================
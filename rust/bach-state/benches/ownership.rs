@@ -0,0 +1,81 @@
+//! Ownership table throughput with one shard vs the default shard count
+//!
+//! Run with `cargo bench -p bach-state --bench ownership`.
+//!
+//! Each thread claims and checks the write keys of its share of a block's
+//! transactions, as optimistic execution and conflict detection do. A
+//! fraction of the keys is shared by every thread.
+
+use bach_crypto::keccak256;
+use bach_primitives::H256;
+use bach_state::{OwnershipTable, DEFAULT_OWNERSHIP_SHARDS};
+use bach_types::PriorityCode;
+use std::time::{Duration, Instant};
+
+const ROUNDS: u32 = 5;
+const TXS: u64 = 20_000;
+const KEYS_PER_TX: u64 = 4;
+const THREADS: u64 = 8;
+
+fn key(tx: u64, index: u64) -> H256 {
+    // One key in eight is a hot key every transaction may touch
+    let key = if index == 0 && tx % 8 == 0 {
+        index
+    } else {
+        tx * KEYS_PER_TX + index
+    };
+    keccak256(&key.to_be_bytes())
+}
+
+fn run(table: &OwnershipTable) {
+    table.advance_epoch();
+    std::thread::scope(|scope| {
+        for thread in 0..THREADS {
+            scope.spawn(move || {
+                for tx in (thread..TXS).step_by(THREADS as usize) {
+                    let priority = PriorityCode::new(1, keccak256(&tx.to_be_bytes()));
+                    for index in 0..KEYS_PER_TX {
+                        table
+                            .get_or_create(&key(tx, index))
+                            .try_set_owner(&priority);
+                    }
+                    for index in 0..KEYS_PER_TX {
+                        table
+                            .get_or_create(&key(tx, index))
+                            .check_ownership(&priority);
+                    }
+                }
+            });
+        }
+    });
+}
+
+/// Returns the fastest of `ROUNDS` runs, on a fresh table and on one
+/// reused through epochs.
+fn time(shards: usize) -> (Duration, Duration) {
+    let fastest = |reuse: bool| {
+        let reused = OwnershipTable::with_shards(shards);
+        (0..ROUNDS)
+            .map(|_| {
+                let fresh = OwnershipTable::with_shards(shards);
+                let table = if reuse { &reused } else { &fresh };
+                let start = Instant::now();
+                run(table);
+                start.elapsed()
+            })
+            .min()
+            .unwrap()
+    };
+    (fastest(false), fastest(true))
+}
+
+fn main() {
+    println!(
+        "{:>8} {:>14} {:>14}",
+        "shards", "fresh table", "reused table"
+    );
+    for shards in [1, DEFAULT_OWNERSHIP_SHARDS] {
+        let (fresh, reused) = time(shards);
+        println!("{:>8} {:>14?} {:>14?}", shards, fresh, reused);
+    }
+}
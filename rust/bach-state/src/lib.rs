@@ -3,14 +3,26 @@
 //! State management for blockchain operations:
 //! - `StateDB`: Trait for state storage
 //! - `MemoryStateDB`: In-memory implementation
-//! - `Snapshot`: Read-only state snapshot
+//! - `Snapshot`: Read-only, copy-on-write state snapshot
+//! - `StateOverlay`: Writable speculative branch on top of a snapshot
+//! - `SnapshotManager`: Speculative branch states by height and block hash
+//! - `SparseMerkleTree`, `StateProof`: Optional incremental state commitment
+//!   and proofs against it
 //! - `OwnershipEntry`: Per-key ownership tracking
-//! - `OwnershipTable`: Concurrent ownership table
+//! - `OwnershipTable`: Concurrent ownership table, sharded and reusable
+//!   across blocks through epochs
 
-use std::collections::HashMap;
-use std::sync::{Arc, RwLock};
+use std::collections::{HashMap, HashSet};
+use std::sync::Arc;
 use bach_primitives::H256;
-use bach_types::PriorityCode;
+
+mod overlay;
+mod ownership;
+mod smt;
+
+pub use overlay::{SnapshotManager, StateOverlay, MAX_COMMITTED_DEPTH};
+pub use ownership::{OwnershipEntry, OwnershipTable, DEFAULT_OWNERSHIP_SHARDS};
+pub use smt::{SparseMerkleTree, StateProof};
 
 /// Errors from state operations
 #[derive(Debug, Clone, PartialEq, Eq)]
@@ -42,21 +54,50 @@ pub trait StateDB: Send + Sync {
 
     /// Returns all keys (for testing/debugging).
     fn keys(&self) -> Vec<H256>;
+
+    /// Returns the root of the sparse Merkle commitment over the state, if
+    /// this database maintains one.
+    fn commitment(&self) -> Option<H256> {
+        None
+    }
 }
 
 /// In-memory implementation of StateDB.
+///
+/// The map is shared with snapshots and only copied on the first write
+/// after a snapshot is taken.
+///
+/// A database created `with_commitment` also maintains a
+/// `SparseMerkleTree` over its state, rehashed on every write. It is off by
+/// default because of that cost.
 #[derive(Debug, Default)]
 pub struct MemoryStateDB {
-    data: HashMap<H256, Vec<u8>>,
+    data: Arc<HashMap<H256, Vec<u8>>>,
+    tree: Option<SparseMerkleTree>,
 }
 
 impl MemoryStateDB {
     /// Creates a new empty state database.
     pub fn new() -> Self {
         Self {
-            data: HashMap::new(),
+            data: Arc::new(HashMap::new()),
+            tree: None,
+        }
+    }
+
+    /// Creates a new empty state database maintaining a state commitment.
+    pub fn with_commitment() -> Self {
+        Self {
+            tree: Some(SparseMerkleTree::new()),
+            ..Self::new()
         }
     }
+
+    /// Returns a proof of `key`'s value (or absence) under the current
+    /// commitment, if one is maintained.
+    pub fn prove(&self, key: &H256) -> Option<StateProof> {
+        self.tree.as_ref().map(|tree| tree.prove(key))
+    }
 }
 
 impl StateDB for MemoryStateDB {
@@ -65,174 +106,167 @@ impl StateDB for MemoryStateDB {
     }
 
     fn set(&mut self, key: H256, value: Vec<u8>) {
-        self.data.insert(key, value);
+        if let Some(tree) = &mut self.tree {
+            tree.insert(key, &value);
+        }
+        Arc::make_mut(&mut self.data).insert(key, value);
     }
 
     fn delete(&mut self, key: &H256) {
-        self.data.remove(key);
+        if self.data.contains_key(key) {
+            if let Some(tree) = &mut self.tree {
+                tree.remove(key);
+            }
+            Arc::make_mut(&mut self.data).remove(key);
+        }
     }
 
     fn snapshot(&self) -> Snapshot {
         Snapshot {
-            data: self.data.clone(),
+            layer: Arc::new(Layer::Base(Arc::clone(&self.data))),
         }
     }
 
     fn commit(&mut self, writes: &[(H256, Vec<u8>)]) {
+        if writes.is_empty() {
+            return;
+        }
+        let data = Arc::make_mut(&mut self.data);
         for (key, value) in writes {
-            self.data.insert(*key, value.clone());
+            if let Some(tree) = &mut self.tree {
+                tree.insert(*key, value);
+            }
+            data.insert(*key, value.clone());
         }
     }
 
     fn keys(&self) -> Vec<H256> {
         self.data.keys().copied().collect()
     }
+
+    fn commitment(&self) -> Option<H256> {
+        self.tree.as_ref().map(SparseMerkleTree::root)
+    }
 }
 
 /// A read-only snapshot of state at a point in time.
+///
+/// Cloning is cheap: snapshots share their state maps, and a snapshot of a
+/// `StateOverlay` only holds the keys that branch changed on top of its
+/// parent. Sibling branches at the same height share the parent layers.
 #[derive(Debug, Clone)]
 pub struct Snapshot {
-    data: HashMap<H256, Vec<u8>>,
+    layer: Arc<Layer>,
 }
 
-impl Snapshot {
-    /// Reads a value by key from the snapshot.
-    pub fn get(&self, key: &H256) -> Option<Vec<u8>> {
-        self.data.get(key).cloned()
-    }
+/// One level of a snapshot chain
+#[derive(Debug)]
+enum Layer {
+    /// Full state map
+    Base(Arc<HashMap<H256, Vec<u8>>>),
+    /// Changes on top of a parent snapshot; None marks a deleted key
+    Overlay {
+        parent: Snapshot,
+        changes: HashMap<H256, Option<Vec<u8>>>,
+    },
 }
 
-/// An entry in the ownership table for a single key.
-/// Implements Algorithm 1 from the Seamless Scheduling paper.
-pub struct OwnershipEntry {
-    /// Current owner's priority code. Protected by RwLock for thread safety.
-    /// DISOWNED state is represented by a released PriorityCode.
-    owner: RwLock<PriorityCode>,
-}
-
-impl OwnershipEntry {
-    /// Creates a new entry with DISOWNED status.
-    pub fn new() -> Self {
-        // Create a released priority code to represent DISOWNED
-        let mut pc = PriorityCode::new(u64::MAX, H256::zero());
-        pc.release();
+impl Snapshot {
+    /// Creates a snapshot applying `changes` on top of `parent`.
+    fn layered(parent: Snapshot, changes: HashMap<H256, Option<Vec<u8>>>) -> Self {
+        if changes.is_empty() {
+            return parent;
+        }
         Self {
-            owner: RwLock::new(pc),
+            layer: Arc::new(Layer::Overlay { parent, changes }),
         }
     }
 
-    /// Releases ownership by setting status to DISOWNED.
-    pub fn release_ownership(&self) {
-        let mut owner = self.owner.write().unwrap();
-        owner.release();
-    }
-
-    /// Checks if the given priority code can claim ownership.
-    /// Returns true if `who <= current_owner` (higher or equal priority).
-    pub fn check_ownership(&self, who: &PriorityCode) -> bool {
-        let owner = self.owner.read().unwrap();
-        who <= &*owner
-    }
-
-    /// Attempts to claim ownership.
-    /// Returns true if ownership was successfully claimed (who has higher or equal priority).
-    /// Returns false if a higher-priority transaction already owns this key.
-    pub fn try_set_owner(&self, who: &PriorityCode) -> bool {
-        let mut owner = self.owner.write().unwrap();
-        if who <= &*owner {
-            *owner = who.clone();
-            true
-        } else {
-            false
+    /// Reads a value by key from the snapshot.
+    pub fn get(&self, key: &H256) -> Option<Vec<u8>> {
+        let mut layer = &*self.layer;
+        loop {
+            match layer {
+                Layer::Base(data) => return data.get(key).cloned(),
+                Layer::Overlay { parent, changes } => match changes.get(key) {
+                    Some(value) => return value.clone(),
+                    None => layer = &*parent.layer,
+                },
+            }
         }
     }
 
-    /// Returns a clone of the current owner's priority code.
-    pub fn current_owner(&self) -> PriorityCode {
-        self.owner.read().unwrap().clone()
-    }
-}
-
-impl Default for OwnershipEntry {
-    fn default() -> Self {
-        Self::new()
-    }
-}
-
-impl Clone for OwnershipEntry {
-    fn clone(&self) -> Self {
-        let owner = self.owner.read().unwrap().clone();
-        Self {
-            owner: RwLock::new(owner),
+    /// Returns all keys with a value in the snapshot.
+    pub fn keys(&self) -> Vec<H256> {
+        let mut seen = HashSet::new();
+        let mut keys = Vec::new();
+        let mut layer = &*self.layer;
+        loop {
+            match layer {
+                Layer::Base(data) => {
+                    keys.extend(data.keys().filter(|key| !seen.contains(*key)));
+                    return keys;
+                }
+                Layer::Overlay { parent, changes } => {
+                    for (key, value) in changes {
+                        if seen.insert(*key) && value.is_some() {
+                            keys.push(*key);
+                        }
+                    }
+                    layer = &*parent.layer;
+                }
+            }
         }
     }
-}
-
-/// Table mapping storage keys to their ownership entries.
-/// Uses a concurrent hashmap for thread-safe access.
-pub struct OwnershipTable {
-    entries: RwLock<HashMap<H256, Arc<OwnershipEntry>>>,
-}
 
-impl OwnershipTable {
-    /// Creates a new empty ownership table.
-    pub fn new() -> Self {
-        Self {
-            entries: RwLock::new(HashMap::new()),
+    /// Returns the number of overlay layers above the base state.
+    pub fn depth(&self) -> usize {
+        let mut depth = 0;
+        let mut layer = &*self.layer;
+        while let Layer::Overlay { parent, .. } = layer {
+            depth += 1;
+            layer = &*parent.layer;
         }
+        depth
     }
 
-    /// Gets the ownership entry for a key, creating one if it doesn't exist.
-    pub fn get_or_create(&self, key: &H256) -> Arc<OwnershipEntry> {
-        // First try to read
-        {
-            let entries = self.entries.read().unwrap();
-            if let Some(entry) = entries.get(key) {
-                return Arc::clone(entry);
+    /// Collapses the overlay layers into a single state map.
+    pub fn flatten(&self) -> Snapshot {
+        let mut overlays = Vec::new();
+        let mut layer = &*self.layer;
+        let base = loop {
+            match layer {
+                Layer::Base(data) => break data,
+                Layer::Overlay { parent, changes } => {
+                    overlays.push(changes);
+                    layer = &*parent.layer;
+                }
             }
+        };
+        if overlays.is_empty() {
+            return self.clone();
         }
 
-        // Need to write - acquire write lock and check again
-        let mut entries = self.entries.write().unwrap();
-        if let Some(entry) = entries.get(key) {
-            return Arc::clone(entry);
-        }
-
-        // Create new entry
-        let entry = Arc::new(OwnershipEntry::new());
-        entries.insert(*key, Arc::clone(&entry));
-        entry
-    }
-
-    /// Releases ownership of all specified keys.
-    pub fn release_all(&self, keys: &[H256]) {
-        let entries = self.entries.read().unwrap();
-        for key in keys {
-            if let Some(entry) = entries.get(key) {
-                entry.release_ownership();
+        let mut data = HashMap::clone(base);
+        for changes in overlays.into_iter().rev() {
+            for (key, value) in changes {
+                match value {
+                    Some(value) => data.insert(*key, value.clone()),
+                    None => data.remove(key),
+                };
             }
         }
+        Snapshot {
+            layer: Arc::new(Layer::Base(Arc::new(data))),
+        }
     }
 
-    /// Clears all entries from the table.
-    pub fn clear(&self) {
-        let mut entries = self.entries.write().unwrap();
-        entries.clear();
-    }
-
-    /// Returns the number of entries.
-    pub fn len(&self) -> usize {
-        self.entries.read().unwrap().len()
-    }
-
-    /// Returns true if the table is empty.
-    pub fn is_empty(&self) -> bool {
-        self.entries.read().unwrap().is_empty()
-    }
-}
-
-impl Default for OwnershipTable {
-    fn default() -> Self {
-        Self::new()
+    /// Returns true if both snapshots share the same underlying state.
+    pub fn shares_state_with(&self, other: &Snapshot) -> bool {
+        Arc::ptr_eq(&self.layer, &other.layer)
+            || matches!(
+                (&*self.layer, &*other.layer),
+                (Layer::Base(a), Layer::Base(b)) if Arc::ptr_eq(a, b)
+            )
     }
 }
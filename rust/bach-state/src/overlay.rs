@@ -0,0 +1,214 @@
+//! Speculative state branches
+//!
+//! When several proposals exist at one height, each is executed on its own
+//! `StateOverlay` over the same parent snapshot. An overlay records only the
+//! keys its block writes; everything else is read through from the parent,
+//! so branches share unchanged state instead of copying it. Freezing an
+//! overlay yields a snapshot that the next height's branches build on.
+
+use crate::{Snapshot, StateDB};
+use bach_primitives::H256;
+use std::collections::HashMap;
+
+/// Writable copy-on-write view over a parent snapshot.
+#[derive(Debug, Clone)]
+pub struct StateOverlay {
+    parent: Snapshot,
+    /// Keys written in this branch; None marks a deleted key
+    changes: HashMap<H256, Option<Vec<u8>>>,
+}
+
+impl StateOverlay {
+    /// Creates an empty branch on top of `parent`.
+    pub fn new(parent: Snapshot) -> Self {
+        Self {
+            parent,
+            changes: HashMap::new(),
+        }
+    }
+
+    /// Returns the snapshot this branch was created from.
+    pub fn parent(&self) -> &Snapshot {
+        &self.parent
+    }
+
+    /// Returns the number of keys written or deleted in this branch.
+    pub fn change_count(&self) -> usize {
+        self.changes.len()
+    }
+
+    /// Returns the branch's own changes; None marks a deleted key.
+    pub fn changes(&self) -> impl Iterator<Item = (&H256, Option<&Vec<u8>>)> {
+        self.changes
+            .iter()
+            .map(|(key, value)| (key, value.as_ref()))
+    }
+
+    /// Writes this branch's changes to `state`, e.g. once its block is
+    /// finalized and `state` holds the parent snapshot's state.
+    pub fn apply_to(&self, state: &mut dyn StateDB) {
+        for (key, value) in &self.changes {
+            match value {
+                Some(value) => state.set(*key, value.clone()),
+                None => state.delete(key),
+            }
+        }
+    }
+
+    /// Turns the branch into a snapshot without copying its changes.
+    pub fn freeze(self) -> Snapshot {
+        Snapshot::layered(self.parent, self.changes)
+    }
+}
+
+impl StateDB for StateOverlay {
+    fn get(&self, key: &H256) -> Option<Vec<u8>> {
+        match self.changes.get(key) {
+            Some(value) => value.clone(),
+            None => self.parent.get(key),
+        }
+    }
+
+    fn set(&mut self, key: H256, value: Vec<u8>) {
+        self.changes.insert(key, Some(value));
+    }
+
+    fn delete(&mut self, key: &H256) {
+        self.changes.insert(*key, None);
+    }
+
+    fn snapshot(&self) -> Snapshot {
+        Snapshot::layered(self.parent.clone(), self.changes.clone())
+    }
+
+    fn commit(&mut self, writes: &[(H256, Vec<u8>)]) {
+        for (key, value) in writes {
+            self.changes.insert(*key, Some(value.clone()));
+        }
+    }
+
+    fn keys(&self) -> Vec<H256> {
+        self.snapshot().keys()
+    }
+}
+
+/// Committed state is flattened once it has more overlay layers than this,
+/// so a long-running chain does not keep every block's changes alive.
+pub const MAX_COMMITTED_DEPTH: usize = 16;
+
+/// Executed but not yet committed block on a speculative branch
+#[derive(Debug, Clone)]
+struct Branch {
+    parent_hash: H256,
+    state: Snapshot,
+}
+
+/// Tracks the state of speculative blocks by (height, block hash).
+///
+/// Every proposal at the next height branches from the committed snapshot;
+/// proposals further ahead branch from the block they extend. Committing a
+/// block drops every branch that does not descend from it.
+#[derive(Debug, Clone)]
+pub struct SnapshotManager {
+    height: u64,
+    hash: H256,
+    committed: Snapshot,
+    branches: HashMap<(u64, H256), Branch>,
+}
+
+impl SnapshotManager {
+    /// Creates a manager whose committed state is block `hash` at `height`.
+    pub fn new(height: u64, hash: H256, committed: Snapshot) -> Self {
+        Self {
+            height,
+            hash,
+            committed,
+            branches: HashMap::new(),
+        }
+    }
+
+    /// Returns the committed height.
+    pub fn committed_height(&self) -> u64 {
+        self.height
+    }
+
+    /// Returns the committed state.
+    pub fn committed(&self) -> &Snapshot {
+        &self.committed
+    }
+
+    /// Returns the state of a parent block, committed or speculative.
+    fn parent_state(&self, height: u64, hash: &H256) -> Option<&Snapshot> {
+        if height == self.height && *hash == self.hash {
+            return Some(&self.committed);
+        }
+        self.branches.get(&(height, *hash)).map(|b| &b.state)
+    }
+
+    /// Creates an overlay for executing a block at `height` that extends
+    /// `parent_hash`. Returns None if the parent is unknown.
+    pub fn branch(&self, height: u64, parent_hash: &H256) -> Option<StateOverlay> {
+        let parent_height = height.checked_sub(1)?;
+        self.parent_state(parent_height, parent_hash)
+            .cloned()
+            .map(StateOverlay::new)
+    }
+
+    /// Records the state after executing block `hash` at `height`.
+    pub fn insert(&mut self, height: u64, hash: H256, parent_hash: H256, state: StateOverlay) {
+        if height <= self.height {
+            return;
+        }
+        let branch = Branch {
+            parent_hash,
+            state: state.freeze(),
+        };
+        self.branches.insert((height, hash), branch);
+    }
+
+    /// Returns the state after block `hash` at `height`.
+    pub fn get(&self, height: u64, hash: &H256) -> Option<&Snapshot> {
+        self.parent_state(height, hash)
+    }
+
+    /// Returns the number of speculative blocks held.
+    pub fn branch_count(&self) -> usize {
+        self.branches.len()
+    }
+
+    /// Marks block `hash` at `height` as committed and drops the branches
+    /// that conflict with it. Returns its state, or None if unknown.
+    pub fn commit(&mut self, height: u64, hash: H256) -> Option<Snapshot> {
+        let mut state = self.branches.get(&(height, hash))?.state.clone();
+        if state.depth() > MAX_COMMITTED_DEPTH {
+            state = state.flatten();
+        }
+        let mut heights: Vec<u64> = self
+            .branches
+            .keys()
+            .map(|(h, _)| *h)
+            .filter(|h| *h > height)
+            .collect();
+        heights.sort_unstable();
+        heights.dedup();
+
+        let mut live = vec![hash];
+        let mut kept = HashMap::new();
+        for h in heights {
+            let children: Vec<((u64, H256), Branch)> = self
+                .branches
+                .iter()
+                .filter(|((bh, _), b)| *bh == h && live.contains(&b.parent_hash))
+                .map(|(key, b)| (*key, b.clone()))
+                .collect();
+            live = children.iter().map(|((_, child), _)| *child).collect();
+            kept.extend(children);
+        }
+
+        self.branches = kept;
+        self.height = height;
+        self.hash = hash;
+        self.committed = state.clone();
+        Some(state)
+    }
+}
@@ -0,0 +1,241 @@
+//! Key ownership for optimistic concurrency control
+//!
+//! During a block's optimistic execution each transaction claims the keys
+//! it writes (Algorithm 1 of the Seamless Scheduling paper); conflict
+//! detection then aborts every transaction that lost a key it wrote, or
+//! read a key another transaction owns.
+//!
+//! Claims are decided by `PriorityCode`'s total order (block height, then
+//! hash), and a claim only ever lowers an entry's owner. The owner of a key
+//! once all claims are in is therefore the highest-priority claimant,
+//! whatever order the threads ran in.
+//!
+//! The table is split into shards, each a map behind its own lock, so
+//! threads claiming different keys rarely wait on each other. Every claim
+//! is tagged with the table's epoch; starting a new epoch for the next
+//! block releases all earlier claims at once while keeping the entries, so
+//! a scheduler can reuse one table instead of rebuilding it per block.
+
+use bach_primitives::H256;
+use bach_types::PriorityCode;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, RwLock};
+
+/// Shards of an `OwnershipTable` created with `new`
+pub const DEFAULT_OWNERSHIP_SHARDS: usize = 64;
+
+/// Returns the priority code of an unowned key.
+fn disowned() -> PriorityCode {
+    let mut pc = PriorityCode::new(u64::MAX, H256::zero());
+    pc.release();
+    pc
+}
+
+/// Owner of an entry and the epoch it claimed the entry in.
+#[derive(Clone)]
+struct Claim {
+    epoch: u64,
+    owner: PriorityCode,
+}
+
+/// An entry in the ownership table for a single key.
+/// Implements Algorithm 1 from the Seamless Scheduling paper.
+pub struct OwnershipEntry {
+    /// Current claim. Protected by RwLock for thread safety.
+    /// DISOWNED state is represented by a released PriorityCode.
+    claim: RwLock<Claim>,
+    /// Current epoch of the table the entry belongs to; claims from
+    /// earlier epochs count as DISOWNED
+    epoch: Arc<AtomicU64>,
+}
+
+impl OwnershipEntry {
+    /// Creates a new entry with DISOWNED status.
+    pub fn new() -> Self {
+        Self::in_epoch(Arc::new(AtomicU64::new(0)))
+    }
+
+    fn in_epoch(epoch: Arc<AtomicU64>) -> Self {
+        Self {
+            claim: RwLock::new(Claim {
+                epoch: epoch.load(Ordering::Acquire),
+                owner: disowned(),
+            }),
+            epoch,
+        }
+    }
+
+    /// Returns the owner of `claim` in the current epoch.
+    fn owner_of(&self, claim: &Claim) -> PriorityCode {
+        if claim.epoch == self.epoch.load(Ordering::Acquire) {
+            claim.owner.clone()
+        } else {
+            disowned()
+        }
+    }
+
+    /// Releases ownership by setting status to DISOWNED.
+    pub fn release_ownership(&self) {
+        let mut claim = self.claim.write().unwrap();
+        claim.owner.release();
+    }
+
+    /// Checks if the given priority code can claim ownership.
+    /// Returns true if `who <= current_owner` (higher or equal priority).
+    pub fn check_ownership(&self, who: &PriorityCode) -> bool {
+        who <= &self.current_owner()
+    }
+
+    /// Attempts to claim ownership.
+    /// Returns true if ownership was successfully claimed (who has higher or equal priority).
+    /// Returns false if a higher-priority transaction already owns this key.
+    pub fn try_set_owner(&self, who: &PriorityCode) -> bool {
+        let mut claim = self.claim.write().unwrap();
+        if who <= &self.owner_of(&claim) {
+            *claim = Claim {
+                epoch: self.epoch.load(Ordering::Acquire),
+                owner: who.clone(),
+            };
+            true
+        } else {
+            false
+        }
+    }
+
+    /// Returns a clone of the current owner's priority code.
+    pub fn current_owner(&self) -> PriorityCode {
+        self.owner_of(&self.claim.read().unwrap())
+    }
+}
+
+impl Default for OwnershipEntry {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl Clone for OwnershipEntry {
+    fn clone(&self) -> Self {
+        let claim = self.claim.read().unwrap().clone();
+        Self {
+            claim: RwLock::new(claim),
+            epoch: Arc::new(AtomicU64::new(self.epoch.load(Ordering::Acquire))),
+        }
+    }
+}
+
+type Shard = RwLock<HashMap<H256, Arc<OwnershipEntry>>>;
+
+/// Table mapping storage keys to their ownership entries.
+/// Keys are spread over independently locked shards.
+pub struct OwnershipTable {
+    shards: Box<[Shard]>,
+    /// Current epoch, shared with every entry of the table
+    epoch: Arc<AtomicU64>,
+}
+
+impl OwnershipTable {
+    /// Creates a new empty ownership table with `DEFAULT_OWNERSHIP_SHARDS`
+    /// shards.
+    pub fn new() -> Self {
+        Self::with_shards(DEFAULT_OWNERSHIP_SHARDS)
+    }
+
+    /// Creates a new empty ownership table with `shards` shards, rounded up
+    /// to a power of two.
+    pub fn with_shards(shards: usize) -> Self {
+        let shards = shards.max(1).next_power_of_two();
+        Self {
+            shards: (0..shards).map(|_| RwLock::new(HashMap::new())).collect(),
+            epoch: Arc::new(AtomicU64::new(0)),
+        }
+    }
+
+    /// Returns the number of shards.
+    pub fn shard_count(&self) -> usize {
+        self.shards.len()
+    }
+
+    /// Returns the shard holding `key`.
+    fn shard(&self, key: &H256) -> &Shard {
+        // Fold the whole key so keys differing in any byte spread out
+        let folded = key.as_bytes().chunks_exact(8).fold(0u64, |acc, word| {
+            acc ^ u64::from_le_bytes(word.try_into().unwrap())
+        });
+        &self.shards[folded as usize & (self.shards.len() - 1)]
+    }
+
+    /// Returns the current epoch.
+    pub fn epoch(&self) -> u64 {
+        self.epoch.load(Ordering::Acquire)
+    }
+
+    /// Starts a new epoch, releasing every claim made so far while keeping
+    /// the entries. Returns the new epoch.
+    ///
+    /// Call it between blocks, not while transactions are claiming keys.
+    pub fn advance_epoch(&self) -> u64 {
+        self.epoch.fetch_add(1, Ordering::AcqRel) + 1
+    }
+
+    /// Gets the ownership entry for a key, creating one if it doesn't exist.
+    pub fn get_or_create(&self, key: &H256) -> Arc<OwnershipEntry> {
+        let shard = self.shard(key);
+        // First try to read
+        {
+            let entries = shard.read().unwrap();
+            if let Some(entry) = entries.get(key) {
+                return Arc::clone(entry);
+            }
+        }
+
+        // Need to write - acquire write lock and check again
+        let mut entries = shard.write().unwrap();
+        if let Some(entry) = entries.get(key) {
+            return Arc::clone(entry);
+        }
+
+        // Create new entry
+        let entry = Arc::new(OwnershipEntry::in_epoch(Arc::clone(&self.epoch)));
+        entries.insert(*key, Arc::clone(&entry));
+        entry
+    }
+
+    /// Releases ownership of all specified keys.
+    pub fn release_all(&self, keys: &[H256]) {
+        for key in keys {
+            if let Some(entry) = self.shard(key).read().unwrap().get(key) {
+                entry.release_ownership();
+            }
+        }
+    }
+
+    /// Clears all entries from the table.
+    pub fn clear(&self) {
+        for shard in self.shards.iter() {
+            shard.write().unwrap().clear();
+        }
+    }
+
+    /// Returns the number of entries.
+    pub fn len(&self) -> usize {
+        self.shards
+            .iter()
+            .map(|shard| shard.read().unwrap().len())
+            .sum()
+    }
+
+    /// Returns true if the table is empty.
+    pub fn is_empty(&self) -> bool {
+        self.shards
+            .iter()
+            .all(|shard| shard.read().unwrap().is_empty())
+    }
+}
+
+impl Default for OwnershipTable {
+    fn default() -> Self {
+        Self::new()
+    }
+}
@@ -0,0 +1,277 @@
+//! Sparse Merkle state commitment
+//!
+//! `SparseMerkleTree` commits to a key-value state with a 256-level binary
+//! tree addressed by the key bits, most significant first. Empty subtrees
+//! hash to zero and a subtree holding a single entry hashes to that
+//! entry's leaf, so only the branches above two or more entries are
+//! computed and kept. Writing a key rehashes the branches on its path, at
+//! most one per bit the key shares with its neighbours.
+//!
+//! A `StateProof` shows that a key holds a value, or holds none, under a
+//! root, so light clients and snapshot verification don't need the state.
+
+use crate::Snapshot;
+use bach_crypto::keccak256;
+use bach_primitives::{Address, H256};
+use std::collections::{BTreeMap, HashMap};
+
+/// Number of key bits, and levels below the root
+const KEY_BITS: usize = 256;
+
+/// Domain tag of leaf hashes
+const LEAF_TAG: u8 = 0x00;
+
+/// Domain tag of branch hashes
+const BRANCH_TAG: u8 = 0x01;
+
+/// Hashes an entry; the value is committed by its hash.
+fn leaf_hash(key: &H256, value_hash: &H256) -> H256 {
+    let mut data = [0u8; 65];
+    data[0] = LEAF_TAG;
+    data[1..33].copy_from_slice(key.as_bytes());
+    data[33..65].copy_from_slice(value_hash.as_bytes());
+    keccak256(&data)
+}
+
+/// Hashes a branch from its children.
+fn branch_hash(left: &H256, right: &H256) -> H256 {
+    let mut data = [0u8; 65];
+    data[0] = BRANCH_TAG;
+    data[1..33].copy_from_slice(left.as_bytes());
+    data[33..65].copy_from_slice(right.as_bytes());
+    keccak256(&data)
+}
+
+/// Returns bit `index` of `key`, most significant first.
+fn bit(key: &H256, index: usize) -> bool {
+    key.as_bytes()[index / 8] & (0x80 >> (index % 8)) != 0
+}
+
+/// Returns the lowest and highest keys sharing `key`'s first `depth` bits.
+fn subtree_range(key: &H256, depth: usize) -> (H256, H256) {
+    let mut low = *key.as_bytes();
+    let mut high = low;
+    for index in depth..KEY_BITS {
+        let mask = 0x80 >> (index % 8);
+        low[index / 8] &= !mask;
+        high[index / 8] |= mask;
+    }
+    (H256::from(low), H256::from(high))
+}
+
+/// Returns `key` with bit `index` flipped.
+fn flip(key: &H256, index: usize) -> H256 {
+    let mut bytes = *key.as_bytes();
+    bytes[index / 8] ^= 0x80 >> (index % 8);
+    H256::from(bytes)
+}
+
+/// Returns the number of leading bits `a` and `b` share.
+fn common_prefix(a: &H256, b: &H256) -> usize {
+    for (index, (x, y)) in a.as_bytes().iter().zip(b.as_bytes()).enumerate() {
+        if x != y {
+            return index * 8 + (x ^ y).leading_zeros() as usize;
+        }
+    }
+    KEY_BITS
+}
+
+/// Incrementally maintained sparse Merkle tree over a key-value state.
+#[derive(Debug, Clone, Default)]
+pub struct SparseMerkleTree {
+    /// Entries by key, with the hash of their value
+    leaves: BTreeMap<H256, H256>,
+    /// Hashes of the branches holding two or more entries, by depth and
+    /// the lowest key below them
+    branches: HashMap<(u8, H256), H256>,
+}
+
+impl SparseMerkleTree {
+    /// Creates an empty tree.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Builds the tree over every key in `snapshot`.
+    pub fn from_snapshot(snapshot: &Snapshot) -> Self {
+        let mut tree = Self::new();
+        for key in snapshot.keys() {
+            if let Some(value) = snapshot.get(&key) {
+                tree.insert(key, &value);
+            }
+        }
+        tree
+    }
+
+    /// Returns the number of entries.
+    pub fn len(&self) -> usize {
+        self.leaves.len()
+    }
+
+    /// Returns true if the tree has no entries.
+    pub fn is_empty(&self) -> bool {
+        self.leaves.is_empty()
+    }
+
+    /// Returns the root hash; zero for an empty tree.
+    pub fn root(&self) -> H256 {
+        self.node_hash(&H256::zero(), 0)
+    }
+
+    /// Sets `key` to `value`.
+    pub fn insert(&mut self, key: H256, value: &[u8]) {
+        self.leaves.insert(key, keccak256(value));
+        self.rehash_path(&key);
+    }
+
+    /// Returns the key contract `address`'s storage slot `slot` is
+    /// committed under.
+    pub fn storage_key(address: &Address, slot: &H256) -> H256 {
+        let mut data = [0u8; 52];
+        data[..20].copy_from_slice(address.as_bytes());
+        data[20..].copy_from_slice(slot.as_bytes());
+        keccak256(&data)
+    }
+
+    /// Applies contract storage writes as (contract, slot, value), each
+    /// under its `storage_key`; a zero value clears the slot.
+    pub fn apply_storage_writes(&mut self, writes: &[(Address, H256, H256)]) {
+        for (address, slot, value) in writes {
+            let key = Self::storage_key(address, slot);
+            if value.is_zero() {
+                self.remove(&key);
+            } else {
+                self.insert(key, value.as_bytes());
+            }
+        }
+    }
+
+    /// Removes `key`.
+    pub fn remove(&mut self, key: &H256) {
+        if self.leaves.remove(key).is_some() {
+            self.rehash_path(key);
+        }
+    }
+
+    /// Returns a proof of `key`'s value, or of its absence, under the
+    /// current root.
+    pub fn prove(&self, key: &H256) -> StateProof {
+        let mut siblings = Vec::new();
+        for depth in 0..KEY_BITS {
+            if self.branch(key, depth).is_none() {
+                break;
+            }
+            siblings.push(self.node_hash(&flip(key, depth), depth + 1));
+        }
+        let (low, high) = subtree_range(key, siblings.len());
+        let leaf = self
+            .leaves
+            .range(low..=high)
+            .next()
+            .map(|(key, value_hash)| (*key, *value_hash));
+        StateProof { siblings, leaf }
+    }
+
+    /// Returns the cached hash of the branch on `key`'s path at `depth`,
+    /// if it holds two or more entries.
+    fn branch(&self, key: &H256, depth: usize) -> Option<H256> {
+        let (low, _) = subtree_range(key, depth);
+        self.branches.get(&(depth as u8, low)).copied()
+    }
+
+    /// Returns the hash of the subtree at `depth` containing `key`.
+    fn node_hash(&self, key: &H256, depth: usize) -> H256 {
+        if depth < KEY_BITS {
+            if let Some(hash) = self.branch(key, depth) {
+                return hash;
+            }
+        }
+        let (low, high) = subtree_range(key, depth);
+        self.leaves
+            .range(low..=high)
+            .next()
+            .map_or(H256::zero(), |(key, value_hash)| leaf_hash(key, value_hash))
+    }
+
+    /// Recomputes the branches on `key`'s path after it was written.
+    fn rehash_path(&mut self, key: &H256) {
+        // Only branches above a neighbour of `key` can hold two entries
+        let before = self.leaves.range(..*key).next_back();
+        let after = self.leaves.range(*key..).find(|(k, _)| *k != key);
+        let shared = [before, after]
+            .into_iter()
+            .flatten()
+            .map(|(neighbour, _)| common_prefix(key, neighbour))
+            .max();
+        let Some(shared) = shared else {
+            // At most one entry left
+            self.branches.clear();
+            return;
+        };
+
+        for depth in (0..=shared.min(KEY_BITS - 1)).rev() {
+            let (low, high) = subtree_range(key, depth);
+            let index = (depth as u8, low);
+            if self.leaves.range(low..=high).nth(1).is_none() {
+                self.branches.remove(&index);
+                continue;
+            }
+            let (left, right) = if bit(key, depth) {
+                (flip(key, depth), *key)
+            } else {
+                (*key, flip(key, depth))
+            };
+            let hash = branch_hash(
+                &self.node_hash(&left, depth + 1),
+                &self.node_hash(&right, depth + 1),
+            );
+            self.branches.insert(index, hash);
+        }
+    }
+}
+
+/// Proof of a key's value, or of its absence, in a `SparseMerkleTree`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StateProof {
+    /// Hashes of the siblings on the key's path, from the root down
+    pub siblings: Vec<H256>,
+    /// The only entry (key, value hash) in the subtree the path ends in;
+    /// None if it is empty
+    pub leaf: Option<(H256, H256)>,
+}
+
+impl StateProof {
+    /// Returns the root this proof leads to for `key`, or None if the
+    /// proof's leaf isn't on `key`'s path.
+    pub fn root(&self, key: &H256) -> Option<H256> {
+        let depth = self.siblings.len();
+        if depth > KEY_BITS {
+            return None;
+        }
+        let mut hash = match &self.leaf {
+            Some((leaf_key, _)) if common_prefix(key, leaf_key) < depth => return None,
+            Some((leaf_key, value_hash)) => leaf_hash(leaf_key, value_hash),
+            None => H256::zero(),
+        };
+        for (index, sibling) in self.siblings.iter().enumerate().rev() {
+            hash = if bit(key, index) {
+                branch_hash(sibling, &hash)
+            } else {
+                branch_hash(&hash, sibling)
+            };
+        }
+        Some(hash)
+    }
+
+    /// Checks that `key` holds `value` (None: holds nothing) under `root`.
+    pub fn verify(&self, root: &H256, key: &H256, value: Option<&[u8]>) -> bool {
+        let holds = match (&self.leaf, value) {
+            (Some((leaf_key, value_hash)), Some(value)) => {
+                leaf_key == key && *value_hash == keccak256(value)
+            }
+            (Some((leaf_key, _)), None) => leaf_key != key,
+            (None, value) => value.is_none(),
+        };
+        holds && self.root(key).as_ref() == Some(root)
+    }
+}
@@ -0,0 +1,195 @@
+//! Tests for copy-on-write snapshots, StateOverlay, and SnapshotManager
+
+use bach_primitives::H256;
+use bach_state::{MemoryStateDB, SnapshotManager, StateDB, StateOverlay, MAX_COMMITTED_DEPTH};
+
+fn key(n: u8) -> H256 {
+    H256::from([n; 32])
+}
+
+fn block_hash(n: u8) -> H256 {
+    H256::from([0xb0 | n; 32])
+}
+
+fn base_state() -> MemoryStateDB {
+    let mut db = MemoryStateDB::new();
+    db.set(key(1), vec![1]);
+    db.set(key(2), vec![2]);
+    db
+}
+
+// =============================================================================
+// Snapshot sharing tests
+// =============================================================================
+
+mod snapshot_sharing {
+    use super::*;
+
+    #[test]
+    fn snapshots_share_state_until_write() {
+        let mut db = base_state();
+        let first = db.snapshot();
+        let second = db.snapshot();
+        assert!(first.shares_state_with(&second));
+
+        db.set(key(3), vec![3]);
+        let third = db.snapshot();
+        assert!(!first.shares_state_with(&third));
+        assert_eq!(first.get(&key(3)), None);
+        assert_eq!(third.get(&key(3)), Some(vec![3]));
+    }
+
+    #[test]
+    fn flatten_matches_layered_reads() {
+        let mut branch = StateOverlay::new(base_state().snapshot());
+        branch.set(key(1), vec![10]);
+        branch.delete(&key(2));
+        let mut next = StateOverlay::new(branch.freeze());
+        next.set(key(3), vec![3]);
+        let layered = next.freeze();
+        assert_eq!(layered.depth(), 2);
+
+        let flat = layered.flatten();
+        assert_eq!(flat.depth(), 0);
+        for n in 1..=3 {
+            assert_eq!(flat.get(&key(n)), layered.get(&key(n)));
+        }
+        let mut keys = flat.keys();
+        keys.sort();
+        assert_eq!(keys, vec![key(1), key(3)]);
+    }
+}
+
+// =============================================================================
+// StateOverlay tests
+// =============================================================================
+
+mod state_overlay {
+    use super::*;
+
+    #[test]
+    fn reads_fall_through_to_parent() {
+        let overlay = StateOverlay::new(base_state().snapshot());
+        assert_eq!(overlay.get(&key(1)), Some(vec![1]));
+        assert_eq!(overlay.get(&key(9)), None);
+        assert_eq!(overlay.change_count(), 0);
+    }
+
+    #[test]
+    fn sibling_branches_are_isolated() {
+        let parent = base_state().snapshot();
+        let mut left = StateOverlay::new(parent.clone());
+        let mut right = StateOverlay::new(parent.clone());
+
+        left.set(key(1), vec![11]);
+        right.delete(&key(1));
+        right.commit(&[(key(4), vec![4])]);
+
+        assert_eq!(left.get(&key(1)), Some(vec![11]));
+        assert_eq!(right.get(&key(1)), None);
+        assert_eq!(left.get(&key(4)), None);
+        assert_eq!(parent.get(&key(1)), Some(vec![1]));
+        assert!(left.parent().shares_state_with(right.parent()));
+        assert_eq!(right.change_count(), 2);
+    }
+
+    #[test]
+    fn snapshot_is_isolated_from_later_writes() {
+        let mut overlay = StateOverlay::new(base_state().snapshot());
+        overlay.set(key(1), vec![11]);
+        let snapshot = overlay.snapshot();
+        overlay.set(key(1), vec![12]);
+
+        assert_eq!(snapshot.get(&key(1)), Some(vec![11]));
+        assert_eq!(overlay.get(&key(1)), Some(vec![12]));
+    }
+
+    #[test]
+    fn apply_to_writes_changes() {
+        let mut db = base_state();
+        let mut overlay = StateOverlay::new(db.snapshot());
+        overlay.set(key(1), vec![11]);
+        overlay.delete(&key(2));
+
+        overlay.apply_to(&mut db);
+
+        assert_eq!(db.get(&key(1)), Some(vec![11]));
+        assert_eq!(db.get(&key(2)), None);
+    }
+}
+
+// =============================================================================
+// SnapshotManager tests
+// =============================================================================
+
+mod snapshot_manager {
+    use super::*;
+
+    fn execute(manager: &mut SnapshotManager, height: u64, hash: u8, parent: H256, value: u8) {
+        let mut overlay = manager.branch(height, &parent).unwrap();
+        overlay.set(key(1), vec![value]);
+        manager.insert(height, block_hash(hash), parent, overlay);
+    }
+
+    #[test]
+    fn competing_proposals_branch_from_committed_state() {
+        let mut manager = SnapshotManager::new(0, block_hash(0), base_state().snapshot());
+        execute(&mut manager, 1, 1, block_hash(0), 10);
+        execute(&mut manager, 1, 2, block_hash(0), 20);
+
+        assert_eq!(manager.branch_count(), 2);
+        assert_eq!(
+            manager.get(1, &block_hash(1)).unwrap().get(&key(1)),
+            Some(vec![10])
+        );
+        assert_eq!(
+            manager.get(1, &block_hash(2)).unwrap().get(&key(1)),
+            Some(vec![20])
+        );
+        assert_eq!(
+            manager.get(1, &block_hash(1)).unwrap().get(&key(2)),
+            Some(vec![2])
+        );
+        assert!(manager.branch(1, &block_hash(9)).is_none());
+    }
+
+    #[test]
+    fn commit_keeps_only_descendants() {
+        let mut manager = SnapshotManager::new(0, block_hash(0), base_state().snapshot());
+        execute(&mut manager, 1, 1, block_hash(0), 10);
+        execute(&mut manager, 1, 2, block_hash(0), 20);
+        execute(&mut manager, 2, 3, block_hash(1), 30);
+        execute(&mut manager, 2, 4, block_hash(2), 40);
+
+        let committed = manager.commit(1, block_hash(1)).unwrap();
+
+        assert_eq!(committed.get(&key(1)), Some(vec![10]));
+        assert_eq!(manager.committed_height(), 1);
+        assert_eq!(manager.branch_count(), 1);
+        assert!(manager.get(2, &block_hash(3)).is_some());
+        assert!(manager.get(2, &block_hash(4)).is_none());
+        assert!(manager.get(1, &block_hash(2)).is_none());
+        assert!(manager.commit(1, block_hash(2)).is_none());
+    }
+
+    #[test]
+    fn committed_state_is_flattened() {
+        let mut manager = SnapshotManager::new(0, block_hash(0), base_state().snapshot());
+        let mut parent = block_hash(0);
+        for height in 1..=(MAX_COMMITTED_DEPTH as u64 + 1) {
+            let hash = H256::from([height as u8; 32]);
+            let mut overlay = manager.branch(height, &parent).unwrap();
+            overlay.set(key(1), vec![height as u8]);
+            manager.insert(height, hash, parent, overlay);
+            manager.commit(height, hash).unwrap();
+            parent = hash;
+        }
+
+        assert!(manager.committed().depth() <= MAX_COMMITTED_DEPTH);
+        assert_eq!(
+            manager.committed().get(&key(1)),
+            Some(vec![MAX_COMMITTED_DEPTH as u8 + 1])
+        );
+        assert_eq!(manager.committed().get(&key(2)), Some(vec![2]));
+    }
+}
@@ -732,3 +732,116 @@ mod algorithm1_scenarios {
         }
     }
 }
+
+// =============================================================================
+// Sharding tests
+// =============================================================================
+
+mod sharding {
+    use super::*;
+
+    fn key(n: u64) -> H256 {
+        let mut bytes = [0u8; 32];
+        bytes[24..].copy_from_slice(&n.to_be_bytes());
+        H256::from(bytes)
+    }
+
+    #[test]
+    fn shard_count_rounds_up_to_power_of_two() {
+        assert_eq!(OwnershipTable::new().shard_count(), bach_state::DEFAULT_OWNERSHIP_SHARDS);
+        assert_eq!(OwnershipTable::with_shards(0).shard_count(), 1);
+        assert_eq!(OwnershipTable::with_shards(5).shard_count(), 8);
+    }
+
+    #[test]
+    fn keys_are_found_across_shards() {
+        let table = OwnershipTable::with_shards(4);
+        let keys: Vec<H256> = (0..100).map(key).collect();
+        for (i, key) in keys.iter().enumerate() {
+            table.get_or_create(key).try_set_owner(&PriorityCode::new(i as u64, H256::zero()));
+        }
+        assert_eq!(table.len(), 100);
+        for (i, key) in keys.iter().enumerate() {
+            assert_eq!(table.get_or_create(key).current_owner().block_height(), i as u64);
+        }
+
+        table.release_all(&keys);
+        assert!(keys.iter().all(|key| table.get_or_create(key).current_owner().is_released()));
+        table.clear();
+        assert!(table.is_empty());
+    }
+}
+
+// =============================================================================
+// Epoch tests
+// =============================================================================
+
+mod epochs {
+    use super::*;
+
+    #[test]
+    fn new_epoch_releases_claims_and_keeps_entries() {
+        let table = OwnershipTable::new();
+        let key = H256::from([7u8; 32]);
+        let owner = PriorityCode::new(1, H256::zero());
+        let entry = table.get_or_create(&key);
+        assert!(entry.try_set_owner(&owner));
+
+        assert_eq!(table.advance_epoch(), 1);
+        assert_eq!(table.epoch(), 1);
+        assert_eq!(table.len(), 1);
+        assert!(entry.current_owner().is_released());
+
+        // A lower-priority transaction of the next block claims the key
+        let next = PriorityCode::new(2, H256::zero());
+        assert!(table.get_or_create(&key).try_set_owner(&next));
+        assert_eq!(entry.current_owner(), next);
+        assert!(!entry.check_ownership(&PriorityCode::new(3, H256::zero())));
+    }
+
+    #[test]
+    fn cloned_entry_keeps_its_epoch() {
+        let table = OwnershipTable::new();
+        let entry = table.get_or_create(&H256::zero());
+        let owner = PriorityCode::new(1, H256::zero());
+        entry.try_set_owner(&owner);
+
+        let copy = (*entry).clone();
+        table.advance_epoch();
+        assert!(entry.current_owner().is_released());
+        assert_eq!(copy.current_owner(), owner);
+    }
+}
+
+// =============================================================================
+// Deterministic claim tests
+// =============================================================================
+
+mod deterministic_claims {
+    use super::*;
+
+    #[test]
+    fn final_owner_does_not_depend_on_claim_order() {
+        let claimants: Vec<PriorityCode> = (0..8u8)
+            .map(|i| PriorityCode::new(5, H256::from([i.wrapping_mul(37); 32])))
+            .collect();
+        let best = claimants.iter().min().unwrap().clone();
+
+        for rotation in 0..claimants.len() {
+            let table = Arc::new(OwnershipTable::with_shards(2));
+            let handles: Vec<_> = (0..claimants.len())
+                .map(|i| {
+                    let table = Arc::clone(&table);
+                    let pc = claimants[(i + rotation) % claimants.len()].clone();
+                    std::thread::spawn(move || {
+                        table.get_or_create(&H256::zero()).try_set_owner(&pc);
+                    })
+                })
+                .collect();
+            for handle in handles {
+                handle.join().unwrap();
+            }
+            assert_eq!(table.get_or_create(&H256::zero()).current_owner(), best);
+        }
+    }
+}
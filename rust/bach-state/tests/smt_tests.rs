@@ -0,0 +1,202 @@
+//! Tests for the sparse Merkle state commitment
+
+use bach_primitives::{Address, H256};
+use bach_state::{MemoryStateDB, SparseMerkleTree, StateDB};
+
+fn key(n: u8) -> H256 {
+    H256::from([n; 32])
+}
+
+/// Keys differing only in their last bit, so their branch is 255 deep
+fn twins() -> (H256, H256) {
+    let mut bytes = [0x5a; 32];
+    let low = H256::from(bytes);
+    bytes[31] |= 0x01;
+    (low, H256::from(bytes))
+}
+
+fn rebuilt(entries: &[(H256, Vec<u8>)]) -> H256 {
+    let mut tree = SparseMerkleTree::new();
+    for (key, value) in entries {
+        tree.insert(*key, value);
+    }
+    tree.root()
+}
+
+// =============================================================================
+// Root tests
+// =============================================================================
+
+mod root {
+    use super::*;
+
+    #[test]
+    fn empty_tree_has_zero_root() {
+        let tree = SparseMerkleTree::new();
+        assert!(tree.is_empty());
+        assert_eq!(tree.root(), H256::zero());
+    }
+
+    #[test]
+    fn root_is_independent_of_write_order() {
+        let (a, b) = twins();
+        let entries: Vec<(H256, Vec<u8>)> = vec![
+            (key(1), vec![1]),
+            (key(0x81), vec![2]),
+            (a, vec![3]),
+            (b, vec![4]),
+            (key(0xff), vec![5]),
+        ];
+        let mut reversed = entries.clone();
+        reversed.reverse();
+        assert_eq!(rebuilt(&entries), rebuilt(&reversed));
+        assert_ne!(rebuilt(&entries), rebuilt(&entries[1..]));
+    }
+
+    #[test]
+    fn removal_restores_previous_root() {
+        let (a, b) = twins();
+        let mut tree = SparseMerkleTree::new();
+        tree.insert(key(1), &[1]);
+        tree.insert(a, &[2]);
+        let root = tree.root();
+
+        tree.insert(b, &[3]);
+        tree.insert(key(1), &[4]);
+        assert_ne!(tree.root(), root);
+        tree.insert(key(1), &[1]);
+        tree.remove(&b);
+        assert_eq!(tree.root(), root);
+        assert_eq!(tree.len(), 2);
+
+        tree.remove(&a);
+        tree.remove(&key(1));
+        assert_eq!(tree.root(), H256::zero());
+    }
+
+    #[test]
+    fn values_are_committed() {
+        let mut one = SparseMerkleTree::new();
+        one.insert(key(1), &[1]);
+        let mut other = SparseMerkleTree::new();
+        other.insert(key(1), &[2]);
+        assert_ne!(one.root(), other.root());
+    }
+}
+
+// =============================================================================
+// Proof tests
+// =============================================================================
+
+mod proofs {
+    use super::*;
+
+    fn tree() -> SparseMerkleTree {
+        let (a, b) = twins();
+        let mut tree = SparseMerkleTree::new();
+        for (key, value) in [(key(1), 1u8), (key(0x81), 2), (a, 3), (b, 4)] {
+            tree.insert(key, &[value]);
+        }
+        tree
+    }
+
+    #[test]
+    fn proves_inclusion() {
+        let tree = tree();
+        let root = tree.root();
+        let (a, b) = twins();
+
+        let proof = tree.prove(&b);
+        assert_eq!(proof.siblings.len(), 256);
+        assert!(proof.verify(&root, &b, Some(&[4])));
+        assert!(!proof.verify(&root, &b, Some(&[3])));
+        assert!(!proof.verify(&root, &b, None));
+        assert!(!proof.verify(&root, &a, Some(&[4])));
+        assert!(tree.prove(&key(1)).verify(&root, &key(1), Some(&[1])));
+    }
+
+    #[test]
+    fn proves_absence() {
+        let tree = tree();
+        let root = tree.root();
+
+        // Ends in another entry's leaf, or in an empty subtree
+        for missing in [key(0x80), key(0x40)] {
+            let proof = tree.prove(&missing);
+            assert!(proof.verify(&root, &missing, None));
+            assert!(!proof.verify(&root, &missing, Some(&[1])));
+        }
+        assert!(SparseMerkleTree::new()
+            .prove(&key(1))
+            .verify(&H256::zero(), &key(1), None));
+    }
+
+    #[test]
+    fn rejects_proofs_for_other_roots_or_keys() {
+        let mut tree = tree();
+        let proof = tree.prove(&key(1));
+        tree.insert(key(0x82), &[5]);
+        assert!(!proof.verify(&tree.root(), &key(1), Some(&[1])));
+
+        // A leaf off the key's path doesn't prove its absence
+        let other = tree.prove(&key(0x81));
+        assert!(other.root(&key(1)).is_none());
+        assert!(!other.verify(&tree.root(), &key(1), None));
+    }
+}
+
+// =============================================================================
+// MemoryStateDB commitment tests
+// =============================================================================
+
+mod state_db {
+    use super::*;
+
+    #[test]
+    fn commitment_is_opt_in() {
+        let mut db = MemoryStateDB::new();
+        db.set(key(1), vec![1]);
+        assert!(db.commitment().is_none());
+        assert!(db.prove(&key(1)).is_none());
+    }
+
+    #[test]
+    fn commitment_follows_writes() {
+        let mut db = MemoryStateDB::with_commitment();
+        assert_eq!(db.commitment(), Some(H256::zero()));
+
+        db.commit(&[(key(1), vec![1]), (key(2), vec![2])]);
+        db.set(key(3), vec![3]);
+        db.delete(&key(2));
+        let root = db.commitment().unwrap();
+        assert_eq!(root, rebuilt(&[(key(1), vec![1]), (key(3), vec![3])]));
+        assert_eq!(SparseMerkleTree::from_snapshot(&db.snapshot()).root(), root);
+
+        let proof = db.prove(&key(3)).unwrap();
+        assert!(proof.verify(&root, &key(3), Some(&[3])));
+        assert!(db.prove(&key(2)).unwrap().verify(&root, &key(2), None));
+    }
+}
+
+// =============================================================================
+// Contract storage tests
+// =============================================================================
+
+mod contract_storage {
+    use super::*;
+
+    #[test]
+    fn writes_commit_under_storage_keys() {
+        let contract = Address::from([0x11; 20]);
+        let value = H256::from([7; 32]);
+        let mut tree = SparseMerkleTree::new();
+        tree.apply_storage_writes(&[(contract, key(1), value), (contract, key(2), value)]);
+        let slot = SparseMerkleTree::storage_key(&contract, &key(1));
+        assert_ne!(slot, SparseMerkleTree::storage_key(&Address::from([0x12; 20]), &key(1)));
+        assert!(tree.prove(&slot).verify(&tree.root(), &slot, Some(value.as_bytes())));
+
+        // Zero values clear their slot
+        tree.apply_storage_writes(&[(contract, key(2), H256::zero())]);
+        assert_eq!(tree.root(), rebuilt(&[(slot, value.as_bytes().to_vec())]));
+    }
+}
@@ -0,0 +1,242 @@
+//! Bounded in-memory block cache
+//!
+//! Recently written or read blocks are kept by height so the latest block
+//! and blocks being verified or served during sync are not decoded from the
+//! database again. The least recently used block is evicted when full.
+
+use bach_primitives::H256;
+use bach_types::Block;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+
+/// Default number of blocks kept in memory
+pub const DEFAULT_BLOCK_CACHE_SIZE: usize = 256;
+
+/// Block cache metrics snapshot
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct BlockCacheMetrics {
+    /// Blocks currently cached
+    pub blocks: u64,
+    /// Maximum number of cached blocks
+    pub capacity: u64,
+    /// Lookups served from the cache
+    pub hits: u64,
+    /// Lookups that fell through to the database
+    pub misses: u64,
+    /// Blocks loaded ahead of use by `prefetch`
+    pub prefetched: u64,
+    /// Blocks evicted to make room
+    pub evictions: u64,
+}
+
+#[derive(Debug)]
+struct CachedBlock {
+    block: Block,
+    hash: H256,
+    last_used: u64,
+}
+
+#[derive(Debug, Default)]
+struct CacheEntries {
+    by_height: HashMap<u64, CachedBlock>,
+    heights_by_hash: HashMap<H256, u64>,
+    clock: u64,
+}
+
+impl CacheEntries {
+    fn touch(&mut self, height: u64) -> Option<Block> {
+        self.clock += 1;
+        let clock = self.clock;
+        let entry = self.by_height.get_mut(&height)?;
+        entry.last_used = clock;
+        Some(entry.block.clone())
+    }
+}
+
+/// Height-indexed LRU cache of blocks, also addressable by hash.
+#[derive(Debug)]
+pub struct BlockCache {
+    capacity: usize,
+    entries: Mutex<CacheEntries>,
+    hits: AtomicU64,
+    misses: AtomicU64,
+    prefetched: AtomicU64,
+    evictions: AtomicU64,
+}
+
+impl BlockCache {
+    /// Creates a cache holding at most `capacity` blocks (0 disables it).
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            entries: Mutex::new(CacheEntries::default()),
+            hits: AtomicU64::new(0),
+            misses: AtomicU64::new(0),
+            prefetched: AtomicU64::new(0),
+            evictions: AtomicU64::new(0),
+        }
+    }
+
+    /// Returns the maximum number of cached blocks.
+    pub fn capacity(&self) -> usize {
+        self.capacity
+    }
+
+    /// Returns the number of cached blocks.
+    pub fn len(&self) -> usize {
+        self.entries.lock().unwrap().by_height.len()
+    }
+
+    /// Returns true if no blocks are cached.
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Returns true if the block at `height` is cached, without counting a
+    /// lookup or refreshing its recency.
+    pub fn contains(&self, height: u64) -> bool {
+        self.entries.lock().unwrap().by_height.contains_key(&height)
+    }
+
+    /// Returns the cached block at `height`.
+    pub fn get_by_height(&self, height: u64) -> Option<Block> {
+        let block = self.entries.lock().unwrap().touch(height);
+        self.record(block.is_some());
+        block
+    }
+
+    /// Returns the cached block with `hash`.
+    pub fn get_by_hash(&self, hash: &H256) -> Option<Block> {
+        let block = {
+            let mut entries = self.entries.lock().unwrap();
+            match entries.heights_by_hash.get(hash).copied() {
+                Some(height) => entries.touch(height),
+                None => None,
+            }
+        };
+        self.record(block.is_some());
+        block
+    }
+
+    /// Caches a block, replacing any other block at the same height.
+    pub fn insert(&self, block: &Block) {
+        self.insert_with_hash(block, block.hash());
+    }
+
+    /// Caches a block loaded ahead of use.
+    pub(crate) fn insert_prefetched(&self, block: &Block, hash: H256) {
+        self.insert_with_hash(block, hash);
+        self.prefetched.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub(crate) fn insert_with_hash(&self, block: &Block, hash: H256) {
+        if self.capacity == 0 {
+            return;
+        }
+        let mut entries = self.entries.lock().unwrap();
+        entries.clock += 1;
+        let entry = CachedBlock {
+            block: block.clone(),
+            hash,
+            last_used: entries.clock,
+        };
+        if let Some(old) = entries.by_height.insert(block.height, entry) {
+            entries.heights_by_hash.remove(&old.hash);
+        }
+        entries.heights_by_hash.insert(hash, block.height);
+
+        while entries.by_height.len() > self.capacity {
+            let Some(oldest) = entries
+                .by_height
+                .iter()
+                .min_by_key(|(_, entry)| entry.last_used)
+                .map(|(height, _)| *height)
+            else {
+                break;
+            };
+            if let Some(evicted) = entries.by_height.remove(&oldest) {
+                entries.heights_by_hash.remove(&evicted.hash);
+            }
+            self.evictions.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// Drops all cached blocks.
+    pub fn clear(&self) {
+        let mut entries = self.entries.lock().unwrap();
+        entries.by_height.clear();
+        entries.heights_by_hash.clear();
+    }
+
+    /// Returns a snapshot of the cache metrics.
+    pub fn metrics(&self) -> BlockCacheMetrics {
+        BlockCacheMetrics {
+            blocks: self.len() as u64,
+            capacity: self.capacity as u64,
+            hits: self.hits.load(Ordering::Relaxed),
+            misses: self.misses.load(Ordering::Relaxed),
+            prefetched: self.prefetched.load(Ordering::Relaxed),
+            evictions: self.evictions.load(Ordering::Relaxed),
+        }
+    }
+
+    fn record(&self, hit: bool) {
+        let counter = if hit { &self.hits } else { &self.misses };
+        counter.fetch_add(1, Ordering::Relaxed);
+    }
+}
+
+impl Default for BlockCache {
+    fn default() -> Self {
+        Self::new(DEFAULT_BLOCK_CACHE_SIZE)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn block(height: u64) -> Block {
+        Block::new(height, H256::zero(), Vec::new(), 1000 + height)
+    }
+
+    #[test]
+    fn test_evicts_least_recently_used() {
+        let cache = BlockCache::new(2);
+        cache.insert(&block(1));
+        cache.insert(&block(2));
+        assert!(cache.get_by_height(1).is_some());
+
+        cache.insert(&block(3));
+
+        assert!(cache.contains(1));
+        assert!(!cache.contains(2));
+        assert!(cache.get_by_hash(&block(2).hash()).is_none());
+        assert_eq!(cache.get_by_hash(&block(3).hash()).unwrap().height, 3);
+        let metrics = cache.metrics();
+        assert_eq!((metrics.blocks, metrics.evictions), (2, 1));
+        assert_eq!((metrics.hits, metrics.misses), (2, 1));
+    }
+
+    #[test]
+    fn test_replacing_height_drops_old_hash() {
+        let cache = BlockCache::new(4);
+        let first = block(5);
+        let second = Block::new(5, H256::from([1u8; 32]), Vec::new(), 2000);
+        cache.insert(&first);
+        cache.insert(&second);
+
+        assert_eq!(cache.len(), 1);
+        assert!(cache.get_by_hash(&first.hash()).is_none());
+        assert_eq!(cache.get_by_height(5).unwrap().hash(), second.hash());
+    }
+
+    #[test]
+    fn test_zero_capacity_disables_cache() {
+        let cache = BlockCache::new(0);
+        cache.insert(&block(1));
+        assert!(cache.is_empty());
+        assert!(cache.get_by_height(1).is_none());
+    }
+}
@@ -1,19 +1,45 @@
 //! BachLedger Storage
 //!
 //! Persistent storage layer for the medical blockchain:
-//! - `BlockStore`: Block storage by hash and height
-//! - `StateStore`: Account state and contract storage
-//! - `TransactionStore`: Transaction receipts and logs
+//! - `BlockStore`: Block storage by hash and height, with an outbox of
+//!   block events awaiting publication and validator-signed finality
+//!   checkpoints
+//! - `BlockCache`: Bounded cache of recent blocks in front of `BlockStore`
+//! - `StateStore`: Account state and contract storage, with a per-slot write
+//!   history and contract-declared secondary indexes
+//! - `TransactionStore`: Transaction receipts, logs, per-block gas reports and
+//!   per-address transaction history
+//! - `LogsBloom`: Per-block bloom over event addresses and topics, letting
+//!   log queries skip blocks
+//! - `ShardedCuckooFilter`: Persistent duplicate filter for transaction hashes
+//! - `RetentionPolicy`: Per-class retention windows for pruning block data
 //! - `Storage`: Unified storage interface
 
 #![forbid(unsafe_code)]
 
-use bach_crypto::{keccak256, Signature};
-use bach_primitives::{Address, H256, U256};
-use bach_types::{Block, Transaction};
+mod block_cache;
+mod logs_bloom;
+mod pruning;
+mod tx_filter;
+
+pub use block_cache::{BlockCache, BlockCacheMetrics, DEFAULT_BLOCK_CACHE_SIZE};
+pub use logs_bloom::{LogsBloom, LOGS_BLOOM_SIZE};
+pub use pruning::{DataClass, HistoryFeature, PruneReport, RetentionPolicy, DEFAULT_SYNC_WINDOW};
+pub use tx_filter::{
+    ShardedCuckooFilter, TxFilter, TxFilterConfig, TxFilterMetrics,
+};
+
+use bach_crypto::{keccak256, HashAlgorithm, HashSchedule, MemberSignature, Signature};
+use bach_primitives::{Address, ErrorCode, ErrorCoded, H256, U256};
+use bach_types::{
+    Block, BlockDigests, Checkpoint, CheckpointSignature, SignedCheckpoint, Transaction, TxDag,
+};
 use serde::{Deserialize, Serialize};
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::path::Path;
+use sled::transaction::{ConflictableTransactionError, TransactionError, Transactional};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
 use thiserror::Error;
 
 // =============================================================================
@@ -40,6 +66,23 @@ pub enum StorageError {
 
     #[error("Genesis already initialized")]
     GenesisAlreadyInitialized,
+
+    #[error("Invalid retention policy: {0}")]
+    InvalidRetention(String),
+}
+
+impl ErrorCoded for StorageError {
+    fn error_code(&self) -> ErrorCode {
+        match self {
+            StorageError::NotFound(_) => ErrorCode::NotFound,
+            StorageError::GenesisAlreadyInitialized => ErrorCode::Rejected,
+            StorageError::InvalidRetention(_) => ErrorCode::Config,
+            StorageError::IoError(_)
+            | StorageError::SledError(_)
+            | StorageError::SerializationError(_)
+            | StorageError::CorruptedData(_) => ErrorCode::Storage,
+        }
+    }
 }
 
 impl From<bincode::Error> for StorageError {
@@ -114,6 +157,65 @@ impl TransactionReceipt {
     pub fn block_hash_h256(&self) -> H256 {
         H256::from(self.block_hash)
     }
+
+    /// Hashes the receipt's outcome: its transaction, status, gas used and
+    /// the address, topics and data of each log.
+    pub fn digest(&self) -> H256 {
+        let mut data = Vec::with_capacity(32 + 1 + 8 + 4);
+        data.extend_from_slice(&self.transaction_hash);
+        data.push(self.status as u8);
+        data.extend_from_slice(&self.gas_used.to_be_bytes());
+        data.extend_from_slice(&(self.logs.len() as u32).to_be_bytes());
+        for log in &self.logs {
+            data.extend_from_slice(&log.address);
+            data.extend_from_slice(&(log.topics.len() as u32).to_be_bytes());
+            for topic in &log.topics {
+                data.extend_from_slice(topic);
+            }
+            data.extend_from_slice(&(log.data.len() as u32).to_be_bytes());
+            data.extend_from_slice(&log.data);
+        }
+        keccak256(&data)
+    }
+}
+
+/// Hashes the digests of a block's receipts, in transaction order.
+pub fn receipts_root(receipts: &[TransactionReceipt]) -> H256 {
+    let digests: Vec<u8> = receipts
+        .iter()
+        .flat_map(|receipt| receipt.digest().as_bytes().to_vec())
+        .collect();
+    keccak256(&digests)
+}
+
+/// Extends the receipts chain root of a block's parent with the block's
+/// receipts root. The chain root of a block commits to the receipts of
+/// every block up to it, so a checkpoint signing one covers them all.
+pub fn chain_receipts_root(parent: H256, receipts_root: H256) -> H256 {
+    let mut data = [0u8; 64];
+    data[..32].copy_from_slice(parent.as_bytes());
+    data[32..].copy_from_slice(receipts_root.as_bytes());
+    keccak256(&data)
+}
+
+/// Transaction waiting in the pool, persisted so it survives a restart
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct PooledTransaction {
+    pub hash: [u8; 32],
+    pub from: [u8; 20],
+    pub to: Option<[u8; 20]>,
+    pub value: [u8; 32],
+    pub data: Vec<u8>,
+    pub gas: u64,
+    pub gas_price: [u8; 32],
+    pub nonce: u64,
+    pub received_at: u64,
+}
+
+impl PooledTransaction {
+    pub fn hash_h256(&self) -> H256 {
+        H256::from(self.hash)
+    }
 }
 
 /// Event log
@@ -138,6 +240,201 @@ impl Log {
     }
 }
 
+/// Debug log a contract wrote during a transaction, kept locally outside
+/// consensus state
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct ContractLogRecord {
+    pub address: [u8; 20],
+    /// Severity, as the level byte of the log call
+    pub level: u8,
+    pub message: Vec<u8>,
+}
+
+impl ContractLogRecord {
+    pub fn address_addr(&self) -> Address {
+        Address::from(self.address)
+    }
+}
+
+/// A storage slot change recorded when a block's write set is committed
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct StateChange {
+    /// Height of the block that (last) wrote the slot
+    pub height: u64,
+    pub address: [u8; 20],
+    pub slot: [u8; 32],
+    pub old_value_hash: [u8; 32],
+    pub new_value_hash: [u8; 32],
+    pub new_value: [u8; 32],
+}
+
+/// A write that changed a contract slot, recorded in the key history
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct KeyHistoryEntry {
+    /// Height of the block that wrote the slot
+    pub height: u64,
+    /// Hash of the transaction that last wrote the slot in the block, if known
+    pub tx_hash: Option<[u8; 32]>,
+    /// Hash of the value written
+    pub value_hash: [u8; 32],
+}
+
+impl KeyHistoryEntry {
+    pub fn tx_hash_h256(&self) -> Option<H256> {
+        self.tx_hash.map(H256::from)
+    }
+
+    pub fn value_hash_h256(&self) -> H256 {
+        H256::from(self.value_hash)
+    }
+}
+
+/// An entry of a contract's secondary index
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct IndexEntry {
+    /// Index key built from the record's indexed fields
+    pub key: Vec<u8>,
+    /// Slot holding the record
+    pub slot: [u8; 32],
+}
+
+impl IndexEntry {
+    pub fn slot_h256(&self) -> H256 {
+        H256::from(self.slot)
+    }
+
+    /// Position of the entry in index order, usable as a resume point for
+    /// `StateStore::scan_index`
+    pub fn position(&self) -> Vec<u8> {
+        [self.key.as_slice(), &self.slot].concat()
+    }
+}
+
+/// Events of a committed block held in the outbox until they have been
+/// published to subscribers
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct OutboxEvent {
+    pub block_hash: [u8; 32],
+    /// Receipts in block order
+    pub receipts: Vec<TransactionReceipt>,
+    /// Storage slots the block changed, in commit order
+    pub changes: Vec<StateChange>,
+}
+
+impl OutboxEvent {
+    pub fn block_hash_h256(&self) -> H256 {
+        H256::from(self.block_hash)
+    }
+}
+
+impl StateChange {
+    pub fn address_addr(&self) -> Address {
+        Address::from(self.address)
+    }
+
+    pub fn slot_h256(&self) -> H256 {
+        H256::from(self.slot)
+    }
+
+    pub fn new_value_h256(&self) -> H256 {
+        H256::from(self.new_value)
+    }
+
+    /// Position of the change in commit order, usable as a resume point
+    /// for `StateStore::get_state_changes`
+    pub fn position(&self) -> (u64, H256) {
+        (self.height, self.slot_h256())
+    }
+}
+
+/// A page of a contract's state changes
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct StateChangePage {
+    /// Matching changes, in commit order
+    pub changes: Vec<StateChange>,
+    /// Position to resume from if the query stopped before the end of the
+    /// history, possibly past the last matching change
+    pub resume: Option<(u64, H256)>,
+}
+
+/// A page of the slots changed between two block heights
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct StateDiffPage {
+    /// Changed slots, ordered by address and then slot
+    pub changes: Vec<StateChange>,
+    /// Last (address, slot) the page covers, to resume after if the diff
+    /// has more slots
+    pub resume: Option<(Address, H256)>,
+}
+
+/// Gas consumed by calls to one contract method within a block
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub struct GasUsage {
+    pub contract: [u8; 20],
+    /// Method selector (None for calls with less than four bytes of input)
+    pub selector: Option<[u8; 4]>,
+    pub calls: u64,
+    pub gas_used: u64,
+}
+
+impl GasUsage {
+    pub fn contract_addr(&self) -> Address {
+        Address::from(self.contract)
+    }
+}
+
+/// Sums gas used per (contract, method) while a block is committed
+#[derive(Debug, Clone, Default)]
+pub struct GasReportBuilder {
+    usage: BTreeMap<([u8; 20], Option<[u8; 4]>), GasUsage>,
+}
+
+impl GasReportBuilder {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Records a call to `contract` with the given input
+    pub fn record(&mut self, contract: &Address, input: &[u8], gas_used: u64) {
+        let selector: Option<[u8; 4]> = input.get(..4).map(|s| s.try_into().unwrap());
+        let usage = self
+            .usage
+            .entry((*contract.as_bytes(), selector))
+            .or_insert_with(|| GasUsage {
+                contract: *contract.as_bytes(),
+                selector,
+                calls: 0,
+                gas_used: 0,
+            });
+        usage.calls += 1;
+        usage.gas_used = usage.gas_used.saturating_add(gas_used);
+    }
+
+    /// Returns the per-method totals ordered by contract and selector
+    pub fn finish(self) -> Vec<GasUsage> {
+        self.usage.into_values().collect()
+    }
+}
+
+/// A transaction that touched an address, as indexed at commit time
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct AddressTransaction {
+    pub tx_hash: [u8; 32],
+    pub block_number: u64,
+    pub transaction_index: u32,
+}
+
+impl AddressTransaction {
+    pub fn tx_hash_h256(&self) -> H256 {
+        H256::from(self.tx_hash)
+    }
+
+    /// Position of the transaction in the chain, usable as a page cursor
+    pub fn position(&self) -> (u64, u32) {
+        (self.block_number, self.transaction_index)
+    }
+}
+
 /// Log filter for querying logs
 #[derive(Debug, Clone, Default)]
 pub struct LogFilter {
@@ -162,6 +459,7 @@ struct StoredTransaction {
     nonce: u64,
     to: Option<[u8; 20]>,
     value: [u8; 32],
+    gas: u64,
     data: Vec<u8>,
     signature: Vec<u8>, // 65 bytes stored as Vec for serde compatibility
 }
@@ -200,31 +498,119 @@ impl From<&Transaction> for StoredTransaction {
             nonce: tx.nonce,
             to: tx.to.map(|a| *a.as_bytes()),
             value: tx.value.to_be_bytes(),
+            gas: tx.gas,
             data: tx.data.clone(),
-            signature: tx.signature.to_bytes().to_vec(),
+            signature: tx.signature.to_bytes(),
         }
     }
 }
 
 impl StoredTransaction {
     fn to_transaction(&self) -> Result<Transaction, StorageError> {
-        let sig_bytes: [u8; 65] = self.signature.as_slice().try_into()
-            .map_err(|_| StorageError::CorruptedData("Invalid signature length in stored transaction".into()))?;
-        let signature = Signature::from_bytes(&sig_bytes)
+        let signature = MemberSignature::from_bytes(&self.signature)
             .map_err(|_| StorageError::CorruptedData("Invalid signature in stored transaction".into()))?;
 
         Ok(Transaction {
             nonce: self.nonce,
             to: self.to.map(Address::from),
             value: U256::from_be_bytes(self.value),
+            gas: self.gas,
             data: self.data.clone(),
             signature,
         })
     }
 }
 
-/// Serializable block header
+/// Serializable finality checkpoint for storage
 #[derive(Debug, Clone, Serialize, Deserialize)]
+struct StoredCheckpoint {
+    height: u64,
+    block_hash: [u8; 32],
+    state_root: [u8; 32],
+    signatures: Vec<([u8; 20], Vec<u8>)>,
+    receipts_root: [u8; 32],
+}
+
+/// Checkpoint layout written before checkpoints carried a receipts root
+type LegacyStoredCheckpoint = (u64, [u8; 32], [u8; 32], Vec<([u8; 20], Vec<u8>)>);
+
+impl From<&SignedCheckpoint> for StoredCheckpoint {
+    fn from(signed: &SignedCheckpoint) -> Self {
+        let checkpoint = &signed.checkpoint;
+        Self {
+            height: checkpoint.height,
+            block_hash: *checkpoint.block_hash.as_bytes(),
+            state_root: *checkpoint.state_root.as_bytes(),
+            signatures: signed
+                .signatures
+                .iter()
+                .map(|s| (*s.validator.as_bytes(), s.signature.to_bytes().to_vec()))
+                .collect(),
+            receipts_root: *checkpoint.receipts_root.as_bytes(),
+        }
+    }
+}
+
+impl StoredCheckpoint {
+    fn decode(data: &[u8]) -> Option<Self> {
+        bincode::deserialize(data).ok().or_else(|| {
+            let (height, block_hash, state_root, signatures): LegacyStoredCheckpoint =
+                bincode::deserialize(data).ok()?;
+            Some(Self {
+                height,
+                block_hash,
+                state_root,
+                signatures,
+                receipts_root: [0u8; 32],
+            })
+        })
+    }
+
+    fn to_signed_checkpoint(&self) -> Result<SignedCheckpoint, StorageError> {
+        let corrupted =
+            || StorageError::CorruptedData("Invalid signature in stored checkpoint".into());
+        let signatures = self
+            .signatures
+            .iter()
+            .map(|(validator, bytes)| {
+                let bytes = bytes.as_slice().try_into().map_err(|_| corrupted())?;
+                Ok(CheckpointSignature {
+                    validator: Address::from(*validator),
+                    signature: Signature::from_bytes(bytes).map_err(|_| corrupted())?,
+                })
+            })
+            .collect::<Result<Vec<_>, StorageError>>()?;
+
+        Ok(SignedCheckpoint {
+            checkpoint: Checkpoint::new(
+                self.height,
+                H256::from(self.block_hash),
+                H256::from(self.state_root),
+            )
+            .with_receipts_root(H256::from(self.receipts_root)),
+            signatures,
+        })
+    }
+}
+
+/// Optional header fields, stored beside the block header by block hash
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HeaderExtension {
+    /// Sparse Merkle commitment over the state after the block, if the node
+    /// maintains one
+    pub state_commitment: Option<[u8; 32]>,
+    /// Bloom over the addresses and topics of the block's events; None for
+    /// blocks committed before blooms were recorded
+    pub logs_bloom: Option<LogsBloom>,
+    /// Hash of the block's receipt digests, see `receipts_root`; None for
+    /// blocks committed before receipts roots were recorded
+    pub receipts_root: Option<[u8; 32]>,
+    /// Receipts chain root after the block, see `chain_receipts_root`
+    pub receipts_chain_root: Option<[u8; 32]>,
+}
+
+/// Serializable block header
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
 pub struct BlockHeader {
     pub height: u64,
     pub parent_hash: [u8; 32],
@@ -235,11 +621,16 @@ pub struct BlockHeader {
 
 impl BlockHeader {
     pub fn from_block(block: &Block, state_root: H256) -> Self {
+        Self::from_block_with(block, state_root, HashAlgorithm::Keccak256)
+    }
+
+    /// Builds the header of a block hashed with `algorithm`
+    pub fn from_block_with(block: &Block, state_root: H256, algorithm: HashAlgorithm) -> Self {
         Self {
             height: block.height,
             parent_hash: *block.parent_hash.as_bytes(),
             timestamp: block.timestamp,
-            transactions_hash: *block.transactions_hash().as_bytes(),
+            transactions_hash: *block.transactions_hash_with(algorithm).as_bytes(),
             state_root: *state_root.as_bytes(),
         }
     }
@@ -271,6 +662,8 @@ pub struct GenesisConfig {
     pub timestamp: u64,
     pub validators: Vec<ValidatorConfig>,
     pub alloc: HashMap<Address, GenesisAccount>,
+    /// Per-contract storage limit in bytes (unlimited if None)
+    pub storage_quota: Option<u64>,
 }
 
 impl Default for GenesisConfig {
@@ -280,6 +673,7 @@ impl Default for GenesisConfig {
             timestamp: 0,
             validators: Vec::new(),
             alloc: HashMap::new(),
+            storage_quota: None,
         }
     }
 }
@@ -289,54 +683,221 @@ impl Default for GenesisConfig {
 // =============================================================================
 
 /// Block storage with indexing by hash and height
+///
+/// Reads go through a bounded `BlockCache` shared by all clones.
+#[derive(Clone)]
 pub struct BlockStore {
     db: sled::Db,
     blocks_by_hash: sled::Tree,
     blocks_by_height: sled::Tree,
     block_headers: sled::Tree,
+    header_extensions: sled::Tree,
     metadata: sled::Tree,
+    chain_config: sled::Tree,
+    finality_checkpoints: sled::Tree,
+    outbox: sled::Tree,
+    cache: Arc<BlockCache>,
 }
 
 const LATEST_HEIGHT_KEY: &[u8] = b"latest_height";
 
+/// Prefix of the metadata keys holding consumer checkpoints
+const CHECKPOINT_KEY_PREFIX: &[u8] = b"checkpoint:";
+
+/// Prefix of the metadata keys naming the consumers the outbox waits for
+const OUTBOX_CONSUMER_KEY_PREFIX: &[u8] = b"outbox-consumer:";
+
+/// Prefix of the metadata keys holding each issuer's revocation list
+const REVOCATION_KEY_PREFIX: &[u8] = b"revocation:";
+
+/// Prefix of the metadata keys holding each DID's document
+const DID_KEY_PREFIX: &[u8] = b"did-document:";
+
+/// Prefix of the metadata keys holding each recorded equivocation evidence
+const EVIDENCE_KEY_PREFIX: &[u8] = b"evidence:";
+
+/// Metadata key holding the multi-sign contract's proposals
+const MULTI_SIGN_KEY: &[u8] = b"multi-sign";
+
+/// Prefix of the metadata keys holding the lowest height still stored for
+/// each pruned data class
+const PRUNED_KEY_PREFIX: &[u8] = b"pruned:";
+
+/// Prefix of the metadata keys holding the reason each quarantined height
+/// was found corrupt
+const QUARANTINE_KEY_PREFIX: &[u8] = b"quarantine:";
+
 impl BlockStore {
     /// Opens or creates a block store at the given path
     pub fn new(path: &Path) -> Result<Self, StorageError> {
-        let db = sled::open(path.join("blocks"))?;
+        Self::with_cache_capacity(path, DEFAULT_BLOCK_CACHE_SIZE)
+    }
+
+    /// Opens or creates a block store caching up to `capacity` blocks
+    pub fn with_cache_capacity(path: &Path, capacity: usize) -> Result<Self, StorageError> {
+        Self::from_db(sled::open(path.join("blocks"))?, capacity)
+    }
+
+    fn from_db(db: sled::Db, cache_capacity: usize) -> Result<Self, StorageError> {
         let blocks_by_hash = db.open_tree("blocks_by_hash")?;
         let blocks_by_height = db.open_tree("blocks_by_height")?;
         let block_headers = db.open_tree("block_headers")?;
+        let header_extensions = db.open_tree("header_extensions")?;
         let metadata = db.open_tree("metadata")?;
+        let chain_config = db.open_tree("chain_config")?;
+        let finality_checkpoints = db.open_tree("finality_checkpoints")?;
+        let outbox = db.open_tree("event_outbox")?;
 
         Ok(Self {
             db,
             blocks_by_hash,
             blocks_by_height,
             block_headers,
+            header_extensions,
             metadata,
+            chain_config,
+            finality_checkpoints,
+            outbox,
+            cache: Arc::new(BlockCache::new(cache_capacity)),
         })
     }
 
     /// Stores a block
     pub fn put_block(&self, block: &Block) -> Result<(), StorageError> {
-        let hash = block.hash();
-        let height = block.height;
+        self.write_block(block, &block.digests(&HashSchedule::default()), None)
+    }
+
+    /// Stores a block and records its events in the outbox, atomically, so
+    /// a committed block's events survive a crash before publication
+    pub fn put_block_with_event(
+        &self,
+        block: &Block,
+        event: &OutboxEvent,
+    ) -> Result<(), StorageError> {
+        let digests = block.digests(&HashSchedule::default());
+        self.write_block(block, &digests, Some(bincode::serialize(event)?))
+    }
+
+    /// Like `put_block_with_event`, for a block hashed under a hash
+    /// migration schedule. A transition block is also stored under its
+    /// legacy hash, so it can be found by either digest
+    pub fn put_block_with_digests(
+        &self,
+        block: &Block,
+        digests: &BlockDigests,
+        event: &OutboxEvent,
+    ) -> Result<(), StorageError> {
+        self.write_block(block, digests, Some(bincode::serialize(event)?))
+    }
 
-        let stored = StoredBlock::from(block);
-        let encoded = bincode::serialize(&stored)?;
+    fn write_block(
+        &self,
+        block: &Block,
+        digests: &BlockDigests,
+        event: Option<Vec<u8>>,
+    ) -> Result<(), StorageError> {
+        let hash = digests.hash;
+        let height = block.height.to_be_bytes();
+        let encoded = bincode::serialize(&StoredBlock::from(block))?;
+
+        let trees = (
+            &self.blocks_by_hash,
+            &self.blocks_by_height,
+            &self.metadata,
+            &self.outbox,
+        );
+        trees
+            .transaction(|(by_hash, by_height, metadata, outbox)| {
+                // Store block by hash and hash by height
+                by_hash.insert(hash.as_bytes(), encoded.as_slice())?;
+                if let Some(legacy_hash) = &digests.legacy_hash {
+                    by_hash.insert(legacy_hash.as_bytes(), encoded.as_slice())?;
+                }
+                by_height.insert(&height[..], hash.as_bytes())?;
+
+                // Update latest height if this is higher
+                let current_height = metadata
+                    .get(LATEST_HEIGHT_KEY)?
+                    .and_then(|v| v.as_ref().try_into().ok())
+                    .map_or(0, u64::from_be_bytes);
+                if block.height > current_height || current_height == 0 {
+                    metadata.insert(LATEST_HEIGHT_KEY, &height[..])?;
+                }
 
-        // Store block by hash
-        self.blocks_by_hash.insert(hash.as_bytes(), encoded)?;
+                if let Some(event) = &event {
+                    outbox.insert(&height[..], event.as_slice())?;
+                }
+                Ok::<_, ConflictableTransactionError<()>>(())
+            })
+            .map_err(|e| match e {
+                TransactionError::Storage(e) => StorageError::SledError(e),
+                TransactionError::Abort(()) => unreachable!("block writes never abort"),
+            })?;
 
-        // Store hash by height
-        self.blocks_by_height.insert(height.to_be_bytes(), hash.as_bytes())?;
+        self.cache.insert_with_hash(block, hash);
+        Ok(())
+    }
 
-        // Update latest height if this is higher
-        let current_height = self.get_block_height();
-        if height > current_height || current_height == 0 {
-            self.metadata.insert(LATEST_HEIGHT_KEY, &height.to_be_bytes())?;
-        }
+    /// Returns the events waiting in the outbox with their block heights,
+    /// oldest first. Fails on an entry that can't be decoded rather than
+    /// skipping the block.
+    pub fn get_outbox_events(&self) -> Result<Vec<(u64, OutboxEvent)>, StorageError> {
+        self.outbox
+            .iter()
+            .map(|entry| {
+                let (key, value) = entry?;
+                let height = key.as_ref().try_into().map(u64::from_be_bytes).map_err(|_| {
+                    StorageError::CorruptedData("outbox key is not a height".to_string())
+                })?;
+                let event = bincode::deserialize(&value).map_err(|e| {
+                    StorageError::CorruptedData(format!("outbox event {}: {}", height, e))
+                })?;
+                Ok((height, event))
+            })
+            .collect()
+    }
+
+    /// Registers the checkpoint of a named consumer as an outbox consumer:
+    /// events stay in the outbox until its checkpoint reaches their height
+    pub fn register_outbox_consumer(&self, consumer: &str) -> Result<(), StorageError> {
+        let key = [OUTBOX_CONSUMER_KEY_PREFIX, consumer.as_bytes()].concat();
+        self.metadata.insert(key, &[])?;
+        Ok(())
+    }
+
+    /// Returns the registered outbox consumers
+    pub fn outbox_consumers(&self) -> Vec<String> {
+        self.metadata
+            .scan_prefix(OUTBOX_CONSUMER_KEY_PREFIX)
+            .keys()
+            .filter_map(|key| {
+                let name = &key.ok()?[OUTBOX_CONSUMER_KEY_PREFIX.len()..];
+                Some(String::from_utf8_lossy(name).into_owned())
+            })
+            .collect()
+    }
+
+    /// Returns the height up to which every registered outbox consumer has
+    /// processed events, 0 if one has none, or None without consumers
+    pub fn outbox_acked_height(&self) -> Option<u64> {
+        self.outbox_consumers()
+            .iter()
+            .map(|consumer| self.get_checkpoint(consumer).unwrap_or(0))
+            .min()
+    }
+
+    /// Returns the number of events waiting in the outbox
+    pub fn outbox_len(&self) -> usize {
+        self.outbox.len()
+    }
 
+    /// Removes the outbox events of blocks up to and including `height`
+    /// once they have been published
+    pub fn ack_outbox_events(&self, height: u64) -> Result<(), StorageError> {
+        for entry in self.outbox.range(..=height.to_be_bytes()) {
+            let (key, _) = entry?;
+            self.outbox.remove(key)?;
+        }
         Ok(())
     }
 
@@ -349,16 +910,72 @@ impl BlockStore {
 
     /// Retrieves a block by hash
     pub fn get_block_by_hash(&self, hash: &H256) -> Option<Block> {
-        let data = self.blocks_by_hash.get(hash.as_bytes()).ok()??;
-        let stored: StoredBlock = bincode::deserialize(&data).ok()?;
-        stored.to_block().ok()
+        if let Some(block) = self.cache.get_by_hash(hash) {
+            return Some(block);
+        }
+        let block = self.load_block(hash)?;
+        // Only cache the block the height index points to, so a replaced
+        // block read by hash cannot shadow it
+        if self.hash_at_height(block.height) == Some(*hash) {
+            self.cache.insert_with_hash(&block, *hash);
+        }
+        Some(block)
     }
 
     /// Retrieves a block by height
     pub fn get_block_by_height(&self, height: u64) -> Option<Block> {
+        if let Some(block) = self.cache.get_by_height(height) {
+            return Some(block);
+        }
+        let hash = self.hash_at_height(height)?;
+        let block = self.load_block(&hash)?;
+        self.cache.insert_with_hash(&block, hash);
+        Some(block)
+    }
+
+    /// Loads up to `count` blocks from `from` into the cache ahead of use,
+    /// e.g. the heights a syncing peer is about to request. Stops at the
+    /// first missing height and never loads more than the cache holds.
+    /// Returns the number of blocks read from the database.
+    pub fn prefetch(&self, from: u64, count: u64) -> usize {
+        let count = count.min(self.cache.capacity() as u64);
+        let mut loaded = 0;
+        for height in from..from.saturating_add(count) {
+            if self.cache.contains(height) {
+                continue;
+            }
+            let Some(hash) = self.hash_at_height(height) else {
+                break;
+            };
+            let Some(block) = self.load_block(&hash) else {
+                break;
+            };
+            self.cache.insert_prefetched(&block, hash);
+            loaded += 1;
+        }
+        loaded
+    }
+
+    /// Returns the block cache metrics
+    pub fn cache_metrics(&self) -> BlockCacheMetrics {
+        self.cache.metrics()
+    }
+
+    /// Returns the hash the height index records for `height`
+    pub fn hash_at_height(&self, height: u64) -> Option<H256> {
         let hash_bytes = self.blocks_by_height.get(height.to_be_bytes()).ok()??;
-        let hash = H256::from_slice(&hash_bytes).ok()?;
-        self.get_block_by_hash(&hash)
+        H256::from_slice(&hash_bytes).ok()
+    }
+
+    /// Loads the block at `height` without caching it
+    fn load_block_at(&self, height: u64) -> Option<Block> {
+        self.load_block(&self.hash_at_height(height)?)
+    }
+
+    fn load_block(&self, hash: &H256) -> Option<Block> {
+        let data = self.blocks_by_hash.get(hash.as_bytes()).ok()??;
+        let stored: StoredBlock = bincode::deserialize(&data).ok()?;
+        stored.to_block().ok()
     }
 
     /// Retrieves the latest block
@@ -391,87 +1008,464 @@ impl BlockStore {
         bincode::deserialize(&data).ok()
     }
 
-    /// Flushes data to disk
-    pub fn flush(&self) -> Result<(), StorageError> {
-        self.db.flush()?;
+    /// Stores a block's header extension
+    pub fn put_header_extension(
+        &self,
+        hash: &H256,
+        extension: &HeaderExtension,
+    ) -> Result<(), StorageError> {
+        let encoded = bincode::serialize(extension)?;
+        self.header_extensions.insert(hash.as_bytes(), encoded)?;
         Ok(())
     }
-}
-
-// =============================================================================
-// State Store
-// =============================================================================
-
-/// Account state and contract storage
-pub struct StateStore {
-    db: sled::Db,
-    accounts: sled::Tree,
-    storage: sled::Tree,
-    code: sled::Tree,
-}
-
-impl StateStore {
-    /// Opens or creates a state store at the given path
-    pub fn new(path: &Path) -> Result<Self, StorageError> {
-        let db = sled::open(path.join("state"))?;
-        let accounts = db.open_tree("accounts")?;
-        let storage = db.open_tree("storage")?;
-        let code = db.open_tree("code")?;
 
-        Ok(Self {
-            db,
-            accounts,
-            storage,
-            code,
-        })
+    /// Retrieves a block's header extension
+    pub fn get_header_extension(&self, hash: &H256) -> Option<HeaderExtension> {
+        let data = self.header_extensions.get(hash.as_bytes()).ok()??;
+        bincode::deserialize(&data)
+            .ok()
+            .or_else(|| {
+                // Written before extensions carried receipts roots
+                let (state_commitment, logs_bloom) = bincode::deserialize(&data).ok()?;
+                Some(HeaderExtension {
+                    state_commitment,
+                    logs_bloom,
+                    ..HeaderExtension::default()
+                })
+            })
+            .or_else(|| {
+                // Written before extensions carried a logs bloom
+                let state_commitment = bincode::deserialize(&data).ok()?;
+                Some(HeaderExtension {
+                    state_commitment,
+                    ..HeaderExtension::default()
+                })
+            })
     }
 
-    /// Retrieves an account
-    pub fn get_account(&self, address: &Address) -> Option<Account> {
-        let data = self.accounts.get(address.as_bytes()).ok()??;
-        bincode::deserialize(&data).ok()
+    /// Records the last block height a named consumer has processed
+    pub fn put_checkpoint(&self, consumer: &str, height: u64) -> Result<(), StorageError> {
+        let key = [CHECKPOINT_KEY_PREFIX, consumer.as_bytes()].concat();
+        self.metadata.insert(key, &height.to_be_bytes())?;
+        Ok(())
     }
 
-    /// Stores an account
-    pub fn put_account(&self, address: &Address, account: &Account) -> Result<(), StorageError> {
-        let encoded = bincode::serialize(account)?;
-        self.accounts.insert(address.as_bytes(), encoded)?;
-        Ok(())
+    /// Returns the last block height a named consumer has processed
+    pub fn get_checkpoint(&self, consumer: &str) -> Option<u64> {
+        let key = [CHECKPOINT_KEY_PREFIX, consumer.as_bytes()].concat();
+        let value = self.metadata.get(key).ok()??;
+        Some(u64::from_be_bytes(value.as_ref().try_into().ok()?))
     }
 
-    /// Retrieves storage value for an address and key
-    pub fn get_storage(&self, address: &Address, key: &H256) -> H256 {
-        let storage_key = Self::make_storage_key(address, key);
-        self.storage
-            .get(storage_key)
+    /// Returns the lowest height whose data of `class` is still stored
+    pub fn pruned_below(&self, class: DataClass) -> u64 {
+        let key = [PRUNED_KEY_PREFIX, class.as_str().as_bytes()].concat();
+        self.metadata
+            .get(key)
             .ok()
             .flatten()
-            .and_then(|v| {
-                let bytes: [u8; 32] = v.as_ref().try_into().ok()?;
-                Some(H256::from(bytes))
-            })
-            .unwrap_or_else(H256::zero)
+            .and_then(|value| Some(u64::from_be_bytes(value.as_ref().try_into().ok()?)))
+            .unwrap_or(0)
     }
 
-    /// Stores a storage value
-    pub fn put_storage(&self, address: &Address, key: &H256, value: H256) -> Result<(), StorageError> {
-        let storage_key = Self::make_storage_key(address, key);
-        if value.is_zero() {
-            // Remove zero values to save space
-            self.storage.remove(storage_key)?;
-        } else {
-            self.storage.insert(storage_key, value.as_bytes())?;
-        }
+    /// Records that data of `class` below `height` has been pruned
+    fn set_pruned_below(&self, class: DataClass, height: u64) -> Result<(), StorageError> {
+        let key = [PRUNED_KEY_PREFIX, class.as_str().as_bytes()].concat();
+        self.metadata.insert(key, &height.to_be_bytes())?;
         Ok(())
     }
 
-    /// Retrieves contract code by hash
-    pub fn get_code(&self, code_hash: &H256) -> Option<Vec<u8>> {
-        if code_hash.is_zero() || *code_hash == keccak256(&[]) {
-            return Some(Vec::new());
+    /// Removes the header records of blocks `from..to`, returning how many
+    /// blocks had records removed
+    pub fn prune_headers(&self, from: u64, to: u64) -> Result<usize, StorageError> {
+        let mut pruned = 0;
+        for height in from..to {
+            let Some(hash) = self.hash_at_height(height) else {
+                continue;
+            };
+            let header = self.block_headers.remove(hash.as_bytes())?;
+            let extension = self.header_extensions.remove(hash.as_bytes())?;
+            if header.is_some() || extension.is_some() {
+                pruned += 1;
+            }
         }
-        let data = self.code.get(code_hash.as_bytes()).ok()??;
-        Some(data.to_vec())
+        Ok(pruned)
+    }
+
+    /// Records an encoded chain config version taking effect at `height`
+    pub fn put_chain_config(&self, height: u64, encoded: &[u8]) -> Result<(), StorageError> {
+        self.chain_config.insert(height.to_be_bytes(), encoded)?;
+        Ok(())
+    }
+
+    /// Returns the encoded chain config version in force at `height`
+    pub fn get_chain_config_at(&self, height: u64) -> Option<(u64, Vec<u8>)> {
+        let (key, value) = self
+            .chain_config
+            .range(..=height.to_be_bytes())
+            .next_back()?
+            .ok()?;
+        Some((u64::from_be_bytes(key.as_ref().try_into().ok()?), value.to_vec()))
+    }
+
+    /// Returns every encoded chain config version with the height it took
+    /// effect, oldest first
+    pub fn get_chain_config_history(&self) -> Vec<(u64, Vec<u8>)> {
+        self.chain_config
+            .iter()
+            .filter_map(|entry| {
+                let (key, value) = entry.ok()?;
+                Some((u64::from_be_bytes(key.as_ref().try_into().ok()?), value.to_vec()))
+            })
+            .collect()
+    }
+
+    /// Stores a signed finality checkpoint, replacing any checkpoint at the
+    /// same height
+    pub fn put_finality_checkpoint(&self, signed: &SignedCheckpoint) -> Result<(), StorageError> {
+        let encoded = bincode::serialize(&StoredCheckpoint::from(signed))?;
+        self.finality_checkpoints.insert(signed.height().to_be_bytes(), encoded)?;
+        Ok(())
+    }
+
+    /// Returns the finality checkpoint at `height`
+    pub fn get_finality_checkpoint(&self, height: u64) -> Option<SignedCheckpoint> {
+        let data = self.finality_checkpoints.get(height.to_be_bytes()).ok()??;
+        let stored = StoredCheckpoint::decode(&data)?;
+        stored.to_signed_checkpoint().ok()
+    }
+
+    /// Returns the highest finality checkpoint at or below `height`
+    pub fn get_latest_finality_checkpoint(&self, height: u64) -> Option<SignedCheckpoint> {
+        let (_, data) = self
+            .finality_checkpoints
+            .range(..=height.to_be_bytes())
+            .next_back()?
+            .ok()?;
+        let stored = StoredCheckpoint::decode(&data)?;
+        stored.to_signed_checkpoint().ok()
+    }
+
+    /// Records the encoded revocation list published by `issuer`,
+    /// replacing the issuer's previous list
+    pub fn put_revocation_list(
+        &self,
+        issuer: &Address,
+        encoded: &[u8],
+    ) -> Result<(), StorageError> {
+        let key = [REVOCATION_KEY_PREFIX, issuer.as_bytes()].concat();
+        self.metadata.insert(key, encoded)?;
+        Ok(())
+    }
+
+    /// Returns the encoded revocation list of every issuer
+    pub fn get_revocation_lists(&self) -> Vec<(Address, Vec<u8>)> {
+        self.metadata
+            .scan_prefix(REVOCATION_KEY_PREFIX)
+            .filter_map(|entry| {
+                let (key, value) = entry.ok()?;
+                let issuer = Address::from_slice(&key[REVOCATION_KEY_PREFIX.len()..]).ok()?;
+                Some((issuer, value.to_vec()))
+            })
+            .collect()
+    }
+
+    /// Records the encoded document of `did`, replacing its previous one
+    pub fn put_did_document(&self, did: &str, encoded: &[u8]) -> Result<(), StorageError> {
+        let key = [DID_KEY_PREFIX, did.as_bytes()].concat();
+        self.metadata.insert(key, encoded)?;
+        Ok(())
+    }
+
+    /// Returns the encoded document of every DID
+    pub fn get_did_documents(&self) -> Vec<(String, Vec<u8>)> {
+        self.metadata
+            .scan_prefix(DID_KEY_PREFIX)
+            .filter_map(|entry| {
+                let (key, value) = entry.ok()?;
+                let did = String::from_utf8(key[DID_KEY_PREFIX.len()..].to_vec()).ok()?;
+                Some((did, value.to_vec()))
+            })
+            .collect()
+    }
+
+    /// Records the encoded evidence record identified by `evidence_hash`
+    pub fn put_evidence_record(
+        &self,
+        evidence_hash: &H256,
+        encoded: &[u8],
+    ) -> Result<(), StorageError> {
+        let key = [EVIDENCE_KEY_PREFIX, evidence_hash.as_bytes()].concat();
+        self.metadata.insert(key, encoded)?;
+        Ok(())
+    }
+
+    /// Returns every encoded evidence record, ordered by evidence hash
+    pub fn get_evidence_records(&self) -> Vec<Vec<u8>> {
+        self.metadata
+            .scan_prefix(EVIDENCE_KEY_PREFIX)
+            .filter_map(|entry| Some(entry.ok()?.1.to_vec()))
+            .collect()
+    }
+
+    /// Records the encoded multi-sign proposals, replacing the previous ones
+    pub fn put_multi_sign_proposals(&self, encoded: &[u8]) -> Result<(), StorageError> {
+        self.metadata.insert(MULTI_SIGN_KEY, encoded)?;
+        Ok(())
+    }
+
+    /// Returns the encoded multi-sign proposals, if any were recorded
+    pub fn get_multi_sign_proposals(&self) -> Option<Vec<u8>> {
+        self.metadata.get(MULTI_SIGN_KEY).ok()?.map(|value| value.to_vec())
+    }
+
+    /// Quarantines the block at `height`, recording why its data is
+    /// corrupt. Quarantined blocks are not served to syncing peers
+    pub fn quarantine(&self, height: u64, reason: &str) -> Result<(), StorageError> {
+        let key = [QUARANTINE_KEY_PREFIX, &height.to_be_bytes()[..]].concat();
+        self.metadata.insert(key, reason.as_bytes())?;
+        Ok(())
+    }
+
+    /// Lifts the quarantine of the block at `height`, e.g. after it was
+    /// restored from a peer
+    pub fn release_quarantine(&self, height: u64) -> Result<(), StorageError> {
+        let key = [QUARANTINE_KEY_PREFIX, &height.to_be_bytes()[..]].concat();
+        self.metadata.remove(key)?;
+        Ok(())
+    }
+
+    /// Returns true if the block at `height` is quarantined
+    pub fn is_quarantined(&self, height: u64) -> bool {
+        let key = [QUARANTINE_KEY_PREFIX, &height.to_be_bytes()[..]].concat();
+        self.metadata.contains_key(key).unwrap_or(false)
+    }
+
+    /// Returns every quarantined height with the reason it was
+    /// quarantined, lowest first
+    pub fn get_quarantined(&self) -> Vec<(u64, String)> {
+        self.metadata
+            .scan_prefix(QUARANTINE_KEY_PREFIX)
+            .filter_map(|entry| {
+                let (key, value) = entry.ok()?;
+                let height = key[QUARANTINE_KEY_PREFIX.len()..].try_into().ok()?;
+                let reason = String::from_utf8_lossy(&value).into_owned();
+                Some((u64::from_be_bytes(height), reason))
+            })
+            .collect()
+    }
+
+    /// Flushes data to disk
+    pub fn flush(&self) -> Result<(), StorageError> {
+        self.db.flush()?;
+        Ok(())
+    }
+}
+
+// =============================================================================
+// State Store
+// =============================================================================
+
+/// Account state and contract storage
+#[derive(Clone)]
+pub struct StateStore {
+    db: sled::Db,
+    accounts: sled::Tree,
+    storage: sled::Tree,
+    code: sled::Tree,
+    code_refs: sled::Tree,
+    storage_usage: sled::Tree,
+    meta: sled::Tree,
+    state_changes: sled::Tree,
+    contract_changes: sled::Tree,
+    key_history: sled::Tree,
+    state_indexes: sled::Tree,
+    state_index_keys: sled::Tree,
+}
+
+/// Index entries a state change query examines at most
+pub const MAX_STATE_CHANGE_SCAN: usize = 4096;
+
+/// Bytes accounted for each occupied storage slot (key + value)
+pub const STORAGE_SLOT_BYTES: u64 = 64;
+
+const STORAGE_QUOTA_KEY: &[u8] = b"storage_quota";
+
+/// Prefix of contract index specs in the state metadata
+const INDEX_SPEC_KEY_PREFIX: &[u8] = b"index-spec:";
+
+impl StateStore {
+    /// Opens or creates a state store at the given path
+    pub fn new(path: &Path) -> Result<Self, StorageError> {
+        Self::from_db(sled::open(path.join("state"))?)
+    }
+
+    fn from_db(db: sled::Db) -> Result<Self, StorageError> {
+        let accounts = db.open_tree("accounts")?;
+        let storage = db.open_tree("storage")?;
+        let code = db.open_tree("code")?;
+        let code_refs = db.open_tree("code_refs")?;
+        let storage_usage = db.open_tree("storage_usage")?;
+        let meta = db.open_tree("meta")?;
+        let state_changes = db.open_tree("state_changes")?;
+        let contract_changes = db.open_tree("contract_changes")?;
+        let key_history = db.open_tree("key_history")?;
+        let state_indexes = db.open_tree("state_indexes")?;
+        let state_index_keys = db.open_tree("state_index_keys")?;
+
+        let store = Self {
+            db,
+            accounts,
+            storage,
+            code,
+            code_refs,
+            storage_usage,
+            meta,
+            state_changes,
+            contract_changes,
+            key_history,
+            state_indexes,
+            state_index_keys,
+        };
+
+        // Stores written before the per-contract index existed
+        if store.contract_changes.is_empty() && !store.state_changes.is_empty() {
+            store.index_contract_changes()?;
+        }
+
+        Ok(store)
+    }
+
+    /// Fills the per-contract change index from the recorded changes
+    fn index_contract_changes(&self) -> Result<(), StorageError> {
+        for entry in self.state_changes.iter() {
+            let (_key, value) = entry?;
+            let change: StateChange = bincode::deserialize(&value)?;
+            let key = Self::make_contract_change_key(
+                &change.address_addr(),
+                change.height,
+                &change.slot_h256(),
+            );
+            self.contract_changes.insert(key, &[][..])?;
+        }
+        Ok(())
+    }
+
+    /// Retrieves an account
+    pub fn get_account(&self, address: &Address) -> Option<Account> {
+        let data = self.accounts.get(address.as_bytes()).ok()??;
+        bincode::deserialize(&data).ok()
+    }
+
+    /// Stores an account
+    pub fn put_account(&self, address: &Address, account: &Account) -> Result<(), StorageError> {
+        let encoded = bincode::serialize(account)?;
+        self.accounts.insert(address.as_bytes(), encoded)?;
+        Ok(())
+    }
+
+    /// Retrieves storage value for an address and key
+    pub fn get_storage(&self, address: &Address, key: &H256) -> H256 {
+        let storage_key = Self::make_storage_key(address, key);
+        self.storage
+            .get(storage_key)
+            .ok()
+            .flatten()
+            .and_then(|v| {
+                let bytes: [u8; 32] = v.as_ref().try_into().ok()?;
+                Some(H256::from(bytes))
+            })
+            .unwrap_or_else(H256::zero)
+    }
+
+    /// Returns the non-zero storage slots of `address`, ordered by slot
+    pub fn contract_storage(&self, address: &Address) -> Vec<(H256, H256)> {
+        self.storage
+            .scan_prefix(address.as_bytes())
+            .filter_map(|entry| entry.ok())
+            .filter_map(|(key, value)| {
+                let slot: [u8; 32] = key.get(20..)?.try_into().ok()?;
+                let value: [u8; 32] = value.as_ref().try_into().ok()?;
+                Some((H256::from(slot), H256::from(value)))
+            })
+            .collect()
+    }
+
+    /// Returns every non-zero storage slot as (contract, slot, value),
+    /// ordered by contract and slot
+    pub fn storage_slots(&self) -> Vec<(Address, H256, H256)> {
+        self.storage
+            .iter()
+            .filter_map(|entry| entry.ok())
+            .filter_map(|(key, value)| {
+                let address: [u8; 20] = key.get(..20)?.try_into().ok()?;
+                let slot: [u8; 32] = key.get(20..)?.try_into().ok()?;
+                let value: [u8; 32] = value.as_ref().try_into().ok()?;
+                Some((Address::from(address), H256::from(slot), H256::from(value)))
+            })
+            .collect()
+    }
+
+    /// Stores a storage value
+    pub fn put_storage(&self, address: &Address, key: &H256, value: H256) -> Result<(), StorageError> {
+        let storage_key = Self::make_storage_key(address, key);
+        let previous = if value.is_zero() {
+            // Remove zero values to save space
+            self.storage.remove(storage_key)?
+        } else {
+            self.storage.insert(storage_key, value.as_bytes())?
+        };
+
+        match (previous.is_some(), value.is_zero()) {
+            (false, false) => self.adjust_storage_usage(address, STORAGE_SLOT_BYTES as i64)?,
+            (true, true) => self.adjust_storage_usage(address, -(STORAGE_SLOT_BYTES as i64))?,
+            _ => {}
+        }
+        Ok(())
+    }
+
+    /// Returns the storage bytes used by a contract
+    pub fn storage_usage(&self, address: &Address) -> u64 {
+        self.storage_usage
+            .get(address.as_bytes())
+            .ok()
+            .flatten()
+            .and_then(|v| Some(u64::from_be_bytes(v.as_ref().try_into().ok()?)))
+            .unwrap_or(0)
+    }
+
+    /// Returns the per-contract storage quota in bytes, if any
+    pub fn storage_quota(&self) -> Option<u64> {
+        let v = self.meta.get(STORAGE_QUOTA_KEY).ok()??;
+        Some(u64::from_be_bytes(v.as_ref().try_into().ok()?))
+    }
+
+    /// Sets or clears the per-contract storage quota
+    pub fn set_storage_quota(&self, quota: Option<u64>) -> Result<(), StorageError> {
+        match quota {
+            Some(quota) => self.meta.insert(STORAGE_QUOTA_KEY, &quota.to_be_bytes())?,
+            None => self.meta.remove(STORAGE_QUOTA_KEY)?,
+        };
+        Ok(())
+    }
+
+    fn adjust_storage_usage(&self, address: &Address, delta: i64) -> Result<(), StorageError> {
+        let usage = (self.storage_usage(address) as i64 + delta).max(0) as u64;
+        if usage == 0 {
+            self.storage_usage.remove(address.as_bytes())?;
+        } else {
+            self.storage_usage.insert(address.as_bytes(), &usage.to_be_bytes())?;
+        }
+        Ok(())
+    }
+
+    /// Retrieves contract code by hash
+    pub fn get_code(&self, code_hash: &H256) -> Option<Vec<u8>> {
+        if code_hash.is_zero() || *code_hash == keccak256(&[]) {
+            return Some(Vec::new());
+        }
+        let data = self.code.get(code_hash.as_bytes()).ok()??;
+        Some(data.to_vec())
     }
 
     /// Stores contract code, returns its hash
@@ -483,6 +1477,429 @@ impl StateStore {
         Ok(hash)
     }
 
+    /// Sets an account's code, returns the code hash.
+    ///
+    /// Code is stored once per hash and reference counted, so accounts and
+    /// upgrades that reuse the same bytecode share one copy. Code is deleted
+    /// when its last reference is replaced.
+    pub fn set_account_code(&self, address: &Address, code: &[u8]) -> Result<H256, StorageError> {
+        let mut account = self.get_account(address).unwrap_or_default();
+        let old_hash = account.code_hash_h256();
+        let new_hash = keccak256(code);
+        if old_hash == new_hash {
+            return Ok(new_hash);
+        }
+
+        if !code.is_empty() {
+            self.put_code(code)?;
+            self.adjust_code_refs(&new_hash, 1)?;
+        }
+        if self.code_ref_count(&old_hash) > 0 && self.adjust_code_refs(&old_hash, -1)? == 0 {
+            self.code.remove(old_hash.as_bytes())?;
+        }
+
+        account.code_hash = *new_hash.as_bytes();
+        self.put_account(address, &account)?;
+        Ok(new_hash)
+    }
+
+    /// Returns how many accounts reference the code with this hash
+    pub fn code_ref_count(&self, code_hash: &H256) -> u64 {
+        self.code_refs
+            .get(code_hash.as_bytes())
+            .ok()
+            .flatten()
+            .and_then(|v| Some(u64::from_be_bytes(v.as_ref().try_into().ok()?)))
+            .unwrap_or(0)
+    }
+
+    fn adjust_code_refs(&self, code_hash: &H256, delta: i64) -> Result<u64, StorageError> {
+        let count = (self.code_ref_count(code_hash) as i64 + delta).max(0) as u64;
+        if count == 0 {
+            self.code_refs.remove(code_hash.as_bytes())?;
+        } else {
+            self.code_refs.insert(code_hash.as_bytes(), &count.to_be_bytes())?;
+        }
+        Ok(count)
+    }
+
+    /// Applies a block's storage writes and records each changed slot.
+    ///
+    /// Returns the recorded changes; writes that leave a slot unchanged are
+    /// skipped. The storage quota is enforced when the writes are executed,
+    /// so a committed block is always applied in full.
+    pub fn apply_block_writes(
+        &self,
+        height: u64,
+        writes: &[(Address, H256, H256)],
+    ) -> Result<Vec<StateChange>, StorageError> {
+        self.apply_block_writes_from(height, writes, &[])
+    }
+
+    /// Like `apply_block_writes`, also attributing each write to the
+    /// transaction that made it in the key history.
+    ///
+    /// `writers[i]` is the hash of the transaction that last wrote
+    /// `writes[i]`; writes past the end of `writers` are recorded without
+    /// a transaction.
+    pub fn apply_block_writes_from(
+        &self,
+        height: u64,
+        writes: &[(Address, H256, H256)],
+        writers: &[H256],
+    ) -> Result<Vec<StateChange>, StorageError> {
+        // Keyed like the change records so the result is in commit order
+        let mut changes = BTreeMap::new();
+        for (index, (address, slot, value)) in writes.iter().enumerate() {
+            let old_value = self.get_storage(address, slot);
+            if old_value == *value {
+                continue;
+            }
+
+            let change = StateChange {
+                height,
+                address: *address.as_bytes(),
+                slot: *slot.as_bytes(),
+                old_value_hash: *keccak256(old_value.as_bytes()).as_bytes(),
+                new_value_hash: *keccak256(value.as_bytes()).as_bytes(),
+                new_value: *value.as_bytes(),
+            };
+            let key = Self::make_state_change_key(height, address, slot);
+            self.state_changes.insert(key, bincode::serialize(&change)?)?;
+            let key = Self::make_contract_change_key(address, height, slot);
+            self.contract_changes.insert(key, &[][..])?;
+
+            let entry = KeyHistoryEntry {
+                height,
+                tx_hash: writers.get(index).map(|hash| *hash.as_bytes()),
+                value_hash: change.new_value_hash,
+            };
+            let key = Self::make_key_history_key(address, slot, height);
+            self.key_history.insert(key, bincode::serialize(&entry)?)?;
+
+            self.put_storage(address, slot, *value)?;
+            changes.insert((change.address, change.slot), change);
+        }
+        Ok(changes.into_values().collect())
+    }
+
+    /// Returns recorded changes to a contract's slots that start with
+    /// `slot_prefix`, in commit order.
+    ///
+    /// Changes at or before `after` (a position from `StateChange::position`)
+    /// are skipped, so a reader can page through history and resume where it
+    /// stopped. Only the contract's own changes are read, and at most
+    /// `MAX_STATE_CHANGE_SCAN` of them per call; a page stopped early
+    /// carries the position to resume from.
+    pub fn get_state_changes(
+        &self,
+        address: &Address,
+        slot_prefix: &[u8],
+        after: Option<(u64, H256)>,
+        limit: usize,
+    ) -> StateChangePage {
+        let (height, slot) = after.unwrap_or((0, H256::zero()));
+        let start = Self::make_contract_change_key(address, height, &slot);
+
+        let mut page = StateChangePage::default();
+        let mut scanned = 0;
+        for (key, _value) in self
+            .contract_changes
+            .range(start..)
+            .flatten()
+            .take_while(|(key, _value)| key.starts_with(address.as_bytes()))
+        {
+            let height = u64::from_be_bytes(key[20..28].try_into().unwrap());
+            let slot = H256::from_slice(&key[28..60]).unwrap_or_default();
+            if after == Some((height, slot)) {
+                continue;
+            }
+            if page.changes.len() == limit || scanned == MAX_STATE_CHANGE_SCAN {
+                page.resume = page.resume.or(after);
+                return page;
+            }
+            scanned += 1;
+            page.resume = Some((height, slot));
+
+            if !slot.as_bytes().starts_with(slot_prefix) {
+                continue;
+            }
+            let change = self
+                .state_changes
+                .get(Self::make_state_change_key(height, address, &slot))
+                .ok()
+                .flatten()
+                .and_then(|value| bincode::deserialize(&value).ok());
+            page.changes.extend(change);
+        }
+        page.resume = None;
+        page
+    }
+
+    /// Returns the writes that changed a contract slot, oldest first.
+    ///
+    /// Entries at or before height `after` are skipped, so a reader can page
+    /// through the history and resume where it stopped.
+    pub fn get_key_history(
+        &self,
+        address: &Address,
+        slot: &H256,
+        after: Option<u64>,
+        limit: usize,
+    ) -> Vec<KeyHistoryEntry> {
+        let prefix = Self::make_storage_key(address, slot);
+        let start = match after {
+            Some(height) => match height.checked_add(1) {
+                Some(next) => Self::make_key_history_key(address, slot, next),
+                None => return Vec::new(),
+            },
+            None => Self::make_key_history_key(address, slot, 0),
+        };
+
+        self.key_history
+            .range(start..)
+            .flatten()
+            .take_while(|(key, _value)| key.starts_with(&prefix))
+            .filter_map(|(_key, value)| bincode::deserialize(&value).ok())
+            .take(limit)
+            .collect()
+    }
+
+    /// Returns the slots whose values differ between two block heights.
+    ///
+    /// Covers changes committed in blocks `from_height + 1..=to_height`,
+    /// optionally restricted to a single contract address.
+    pub fn get_state_diff(
+        &self,
+        from_height: u64,
+        to_height: u64,
+        address: Option<&Address>,
+    ) -> Vec<StateChange> {
+        self.get_state_diff_page(from_height, to_height, address, None, usize::MAX)
+            .changes
+    }
+
+    /// Returns up to `limit` slots of the diff between two block heights,
+    /// in (address, slot) order after `after`.
+    ///
+    /// Each page reads the changes of the whole range but holds at most
+    /// `limit` slots. A page that stopped early carries the slot to resume
+    /// after; slots that changed and changed back still count toward the
+    /// limit, so a page may hold fewer changes.
+    pub fn get_state_diff_page(
+        &self,
+        from_height: u64,
+        to_height: u64,
+        address: Option<&Address>,
+        after: Option<(Address, H256)>,
+        limit: usize,
+    ) -> StateDiffPage {
+        if from_height >= to_height {
+            return StateDiffPage::default();
+        }
+
+        let after_key = after.map(|(address, slot)| (*address.as_bytes(), *slot.as_bytes()));
+        let mut diff: BTreeMap<([u8; 20], [u8; 32]), StateChange> = BTreeMap::new();
+        let mut truncated = false;
+
+        let start_key = (from_height + 1).to_be_bytes();
+        let end_key = to_height.saturating_add(1).to_be_bytes();
+
+        for (_key, value) in self.state_changes.range(start_key..end_key).flatten() {
+            let change: StateChange = match bincode::deserialize(&value) {
+                Ok(change) => change,
+                Err(_) => continue,
+            };
+            if let Some(addr) = address {
+                if change.address != *addr.as_bytes() {
+                    continue;
+                }
+            }
+
+            let key = (change.address, change.slot);
+            if after_key.is_some_and(|after| key <= after) {
+                continue;
+            }
+            if let Some(existing) = diff.get_mut(&key) {
+                existing.height = change.height;
+                existing.new_value_hash = change.new_value_hash;
+                existing.new_value = change.new_value;
+                continue;
+            }
+            if diff.len() >= limit {
+                // Keep the lowest slots; a slot dropped here is never
+                // readmitted, as `limit` lower ones stay in the page
+                truncated = true;
+                match diff.last_key_value() {
+                    Some((last, _)) if key < *last => {
+                        diff.pop_last();
+                    }
+                    _ => continue,
+                }
+            }
+            diff.insert(key, change);
+        }
+
+        let resume = if truncated {
+            diff.keys()
+                .next_back()
+                .map(|(address, slot)| (Address::from(*address), H256::from(*slot)))
+                .or(after)
+        } else {
+            None
+        };
+        StateDiffPage {
+            changes: diff
+                .into_values()
+                .filter(|change| change.old_value_hash != change.new_value_hash)
+                .collect(),
+            resume,
+        }
+    }
+
+    /// Removes the state changes and key history recorded before `height`,
+    /// returning how many changes were removed
+    pub fn prune_state_changes(&self, height: u64) -> Result<usize, StorageError> {
+        let mut pruned = 0;
+        for entry in self.state_changes.range(..height.to_be_bytes()) {
+            let (key, value) = entry?;
+            let change: StateChange = bincode::deserialize(&value)?;
+            let address = Address::from(change.address);
+            let slot = H256::from(change.slot);
+            self.key_history
+                .remove(Self::make_key_history_key(&address, &slot, change.height))?;
+            self.contract_changes
+                .remove(Self::make_contract_change_key(&address, change.height, &slot))?;
+            self.state_changes.remove(key)?;
+            pruned += 1;
+        }
+        Ok(pruned)
+    }
+
+    /// Records the encoded spec of a contract's secondary index, replacing
+    /// any previous one. Existing entries are kept.
+    pub fn put_index_spec(
+        &self,
+        contract: &Address,
+        name: &str,
+        encoded: &[u8],
+    ) -> Result<(), StorageError> {
+        let key = [INDEX_SPEC_KEY_PREFIX, &Self::make_index_prefix(contract, name)].concat();
+        self.meta.insert(key, encoded)?;
+        Ok(())
+    }
+
+    /// Returns the encoded spec of a contract's secondary index
+    pub fn get_index_spec(&self, contract: &Address, name: &str) -> Option<Vec<u8>> {
+        let key = [INDEX_SPEC_KEY_PREFIX, &Self::make_index_prefix(contract, name)].concat();
+        self.meta.get(key).ok()?.map(|value| value.to_vec())
+    }
+
+    /// Returns the encoded spec of every secondary index with its contract
+    /// and name
+    pub fn get_index_specs(&self) -> Vec<(Address, String, Vec<u8>)> {
+        self.meta
+            .scan_prefix(INDEX_SPEC_KEY_PREFIX)
+            .filter_map(|entry| {
+                let (key, value) = entry.ok()?;
+                let key = &key[INDEX_SPEC_KEY_PREFIX.len()..];
+                let contract = Address::from_slice(key.get(..20)?).ok()?;
+                let name = String::from_utf8(key.get(21..)?.to_vec()).ok()?;
+                Some((contract, name, value.to_vec()))
+            })
+            .collect()
+    }
+
+    /// Removes a contract's secondary index: its spec and every entry
+    pub fn delete_index(&self, contract: &Address, name: &str) -> Result<(), StorageError> {
+        let prefix = Self::make_index_prefix(contract, name);
+        self.meta.remove([INDEX_SPEC_KEY_PREFIX, &prefix].concat())?;
+        for tree in [&self.state_indexes, &self.state_index_keys] {
+            for key in tree.scan_prefix(&prefix).keys() {
+                tree.remove(key?)?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Sets the index key of a slot in a contract's secondary index,
+    /// replacing its previous entry. A slot without a key (its record was
+    /// deleted or lacks the indexed fields) leaves the index.
+    pub fn update_index_entry(
+        &self,
+        contract: &Address,
+        name: &str,
+        slot: &H256,
+        index_key: Option<&[u8]>,
+    ) -> Result<(), StorageError> {
+        let prefix = Self::make_index_prefix(contract, name);
+        let slot_key = [prefix.as_slice(), slot.as_bytes()].concat();
+        let old_key = self.state_index_keys.get(&slot_key)?;
+        if old_key.as_deref() == index_key {
+            return Ok(());
+        }
+
+        if let Some(old_key) = old_key {
+            self.state_indexes
+                .remove([prefix.as_slice(), &old_key, slot.as_bytes()].concat())?;
+        }
+        match index_key {
+            Some(index_key) => {
+                let entry_key = [prefix.as_slice(), index_key, slot.as_bytes()].concat();
+                self.state_indexes.insert(entry_key, Vec::new())?;
+                self.state_index_keys.insert(slot_key, index_key)?;
+            }
+            None => {
+                self.state_index_keys.remove(slot_key)?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns entries of a contract's secondary index in index key order,
+    /// from the first key at or above `from` through the keys at or below
+    /// `to`, or starting with it (all remaining keys if None).
+    ///
+    /// Entries at or before `after` (a position from `IndexEntry::position`)
+    /// are skipped, so a reader can page through a range and resume where
+    /// it stopped.
+    pub fn scan_index(
+        &self,
+        contract: &Address,
+        name: &str,
+        from: &[u8],
+        to: Option<&[u8]>,
+        after: Option<&[u8]>,
+        limit: usize,
+    ) -> Vec<IndexEntry> {
+        let prefix = Self::make_index_prefix(contract, name);
+        let mut start = [prefix.as_slice(), from].concat();
+        let after = after.map(|after| [prefix.as_slice(), after].concat());
+        if let Some(after) = &after {
+            start = start.max(after.clone());
+        }
+
+        self.state_indexes
+            .range(start..)
+            .keys()
+            .flatten()
+            .filter(|key| after.as_deref() != Some(&key[..]))
+            .take_while(|key| key.starts_with(&prefix))
+            .filter_map(|key| {
+                let entry = &key[prefix.len()..];
+                let split = entry.len().checked_sub(32)?;
+                Some(IndexEntry {
+                    key: entry[..split].to_vec(),
+                    slot: entry[split..].try_into().ok()?,
+                })
+            })
+            .take_while(|entry| {
+                to.map_or(true, |to| entry.key.as_slice() <= to || entry.key.starts_with(to))
+            })
+            .take(limit)
+            .collect()
+    }
+
     /// Computes a simple state root (hash of all account hashes)
     pub fn compute_state_root(&self) -> H256 {
         let mut all_data = Vec::new();
@@ -507,6 +1924,42 @@ impl StateStore {
         storage_key
     }
 
+    /// Creates a key for state changes indexed by block height, address and slot
+    fn make_state_change_key(height: u64, address: &Address, key: &H256) -> [u8; 60] {
+        let mut change_key = [0u8; 60];
+        change_key[0..8].copy_from_slice(&height.to_be_bytes());
+        change_key[8..28].copy_from_slice(address.as_bytes());
+        change_key[28..60].copy_from_slice(key.as_bytes());
+        change_key
+    }
+
+    fn make_contract_change_key(address: &Address, height: u64, key: &H256) -> [u8; 60] {
+        let mut change_key = [0u8; 60];
+        change_key[0..20].copy_from_slice(address.as_bytes());
+        change_key[20..28].copy_from_slice(&height.to_be_bytes());
+        change_key[28..60].copy_from_slice(key.as_bytes());
+        change_key
+    }
+
+    /// Creates the key prefix of a contract's secondary index: the address,
+    /// the name's length and the name
+    fn make_index_prefix(contract: &Address, name: &str) -> Vec<u8> {
+        let name = &name.as_bytes()[..name.len().min(u8::MAX as usize)];
+        let mut prefix = Vec::with_capacity(21 + name.len());
+        prefix.extend_from_slice(contract.as_bytes());
+        prefix.push(name.len() as u8);
+        prefix.extend_from_slice(name);
+        prefix
+    }
+
+    /// Creates a key for the key history indexed by address, slot and height
+    fn make_key_history_key(address: &Address, key: &H256, height: u64) -> [u8; 60] {
+        let mut history_key = [0u8; 60];
+        history_key[0..52].copy_from_slice(&Self::make_storage_key(address, key));
+        history_key[52..60].copy_from_slice(&height.to_be_bytes());
+        history_key
+    }
+
     /// Flushes data to disk
     pub fn flush(&self) -> Result<(), StorageError> {
         self.db.flush()?;
@@ -519,27 +1972,106 @@ impl StateStore {
 // =============================================================================
 
 /// Transaction receipt and log storage
+#[derive(Clone)]
 pub struct TransactionStore {
     db: sled::Db,
     tx_locations: sled::Tree,
     receipts: sled::Tree,
     logs_by_block: sled::Tree,
+    gas_reports: sled::Tree,
+    tx_dags: sled::Tree,
+    address_txs: sled::Tree,
+    pooled_txs: sled::Tree,
+    contract_logs: sled::Tree,
+    contract_log_heights: sled::Tree,
+    committed_txs: sled::Tree,
+    tx_filter_tree: sled::Tree,
+    tx_filter: Arc<ShardedCuckooFilter>,
+    filter_false_positives: Arc<AtomicU64>,
 }
 
 impl TransactionStore {
     /// Opens or creates a transaction store at the given path
     pub fn new(path: &Path) -> Result<Self, StorageError> {
-        let db = sled::open(path.join("transactions"))?;
+        Self::with_filter_config(path, TxFilterConfig::default())
+    }
+
+    /// Opens or creates a transaction store with a custom duplicate filter layout
+    pub fn with_filter_config(path: &Path, filter_config: TxFilterConfig) -> Result<Self, StorageError> {
+        Self::from_db(sled::open(path.join("transactions"))?, filter_config)
+    }
+
+    fn from_db(db: sled::Db, filter_config: TxFilterConfig) -> Result<Self, StorageError> {
         let tx_locations = db.open_tree("tx_locations")?;
         let receipts = db.open_tree("receipts")?;
         let logs_by_block = db.open_tree("logs_by_block")?;
-
-        Ok(Self {
+        let gas_reports = db.open_tree("gas_reports")?;
+        let tx_dags = db.open_tree("tx_dags")?;
+        let address_txs = db.open_tree("address_txs")?;
+        let pooled_txs = db.open_tree("pooled_txs")?;
+        let contract_logs = db.open_tree("contract_logs")?;
+        let contract_log_heights = db.open_tree("contract_log_heights")?;
+        let committed_txs = db.open_tree("committed_txs")?;
+        let tx_filter_tree = db.open_tree("tx_filter")?;
+
+        let (tx_filter, corrupted) = ShardedCuckooFilter::load(&tx_filter_tree, filter_config)?;
+
+        let store = Self {
             db,
             tx_locations,
             receipts,
             logs_by_block,
-        })
+            gas_reports,
+            tx_dags,
+            address_txs,
+            pooled_txs,
+            contract_logs,
+            contract_log_heights,
+            committed_txs,
+            tx_filter_tree,
+            tx_filter: Arc::new(tx_filter),
+            filter_false_positives: Arc::new(AtomicU64::new(0)),
+        };
+
+        // Stores written before the duplicate index existed hold every
+        // committed transaction in the receipt index
+        if store.committed_txs.is_empty() && !store.receipts.is_empty() {
+            store.index_committed_from_receipts()?;
+        }
+
+        if !corrupted.is_empty() {
+            store.rebuild_tx_filter(&corrupted)?;
+        }
+
+        Ok(store)
+    }
+
+    /// Fills the duplicate index from the receipts still stored
+    fn index_committed_from_receipts(&self) -> Result<(), StorageError> {
+        for entry in self.receipts.iter() {
+            let (key, value) = entry?;
+            let receipt: TransactionReceipt = bincode::deserialize(&value)?;
+            self.committed_txs
+                .insert(key, receipt.block_number.to_be_bytes().as_slice())?;
+        }
+        Ok(())
+    }
+
+    /// Rebuilds the given duplicate filter shards from the duplicate index
+    fn rebuild_tx_filter(&self, shards: &[usize]) -> Result<(), StorageError> {
+        let hashes = self
+            .committed_txs
+            .iter()
+            .keys()
+            .flatten()
+            .filter_map(|key| H256::from_slice(&key).ok());
+        self.tx_filter.rebuild_shards(shards, hashes);
+        self.tx_filter.persist(&self.tx_filter_tree)
+    }
+
+    /// Returns the transaction duplicate filter
+    pub fn tx_filter(&self) -> &ShardedCuckooFilter {
+        &self.tx_filter
     }
 
     /// Stores a transaction receipt
@@ -547,6 +2079,9 @@ impl TransactionStore {
         let tx_hash = receipt.transaction_hash;
         let encoded = bincode::serialize(receipt)?;
 
+        // The filter must never miss an indexed hash, so it goes first
+        self.tx_filter.record(&self.tx_filter_tree, &H256::from(tx_hash))?;
+
         // Store receipt
         self.receipts.insert(tx_hash, encoded)?;
 
@@ -556,6 +2091,10 @@ impl TransactionStore {
         location[32..36].copy_from_slice(&receipt.transaction_index.to_be_bytes());
         self.tx_locations.insert(tx_hash, location.as_slice())?;
 
+        // The duplicate index outlives pruning
+        self.committed_txs
+            .insert(tx_hash, receipt.block_number.to_be_bytes().as_slice())?;
+
         // Store logs indexed by block
         if !receipt.logs.is_empty() {
             let logs_key = Self::make_logs_key(receipt.block_number, receipt.transaction_index);
@@ -563,9 +2102,78 @@ impl TransactionStore {
             self.logs_by_block.insert(logs_key, logs_encoded)?;
         }
 
+        self.tx_filter.persist_if_due(&self.tx_filter_tree)?;
+
+        // A committed transaction leaves the pool
+        self.pooled_txs.remove(tx_hash)?;
+
         Ok(())
     }
 
+    /// Returns true if the transaction was committed
+    ///
+    /// The duplicate filter answers most misses without a lookup; its
+    /// positives are always confirmed against the duplicate index, which
+    /// records every committed hash and is never pruned, so the answer is
+    /// exact whatever the retention policy.
+    pub fn is_committed(&self, tx_hash: &H256) -> bool {
+        if !self.tx_filter.may_contain(tx_hash) {
+            return false;
+        }
+        let committed = self.committed_txs.contains_key(tx_hash.as_bytes()).unwrap_or(false);
+        if !committed {
+            self.filter_false_positives.fetch_add(1, Ordering::Relaxed);
+        }
+        committed
+    }
+
+    /// Returns the index and hash of the first transaction repeating an
+    /// earlier one in `tx_hashes` or a committed one
+    pub fn find_duplicate_tx(&self, tx_hashes: &[H256]) -> Option<(usize, H256)> {
+        let mut seen = HashSet::with_capacity(tx_hashes.len());
+        tx_hashes
+            .iter()
+            .position(|hash| !seen.insert(*hash) || self.is_committed(hash))
+            .map(|index| (index, tx_hashes[index]))
+    }
+
+    /// Returns the number of filter positives the duplicate index disproved
+    pub fn filter_false_positives(&self) -> u64 {
+        self.filter_false_positives.load(Ordering::Relaxed)
+    }
+
+    /// Persists a pooled transaction until it is committed or removed
+    pub fn put_pooled_tx(&self, tx: &PooledTransaction) -> Result<(), StorageError> {
+        self.pooled_txs.insert(tx.hash, bincode::serialize(tx)?)?;
+        Ok(())
+    }
+
+    /// Removes a persisted pooled transaction
+    pub fn remove_pooled_tx(&self, tx_hash: &H256) -> Result<(), StorageError> {
+        self.pooled_txs.remove(tx_hash.as_bytes())?;
+        Ok(())
+    }
+
+    /// Returns the number of persisted pooled transactions
+    pub fn pooled_tx_count(&self) -> usize {
+        self.pooled_txs.len()
+    }
+
+    /// Returns the persisted pooled transactions, oldest first
+    ///
+    /// Entries that fail to decode are skipped.
+    pub fn get_pooled_txs(&self) -> Vec<PooledTransaction> {
+        let mut txs: Vec<PooledTransaction> = self
+            .pooled_txs
+            .iter()
+            .values()
+            .flatten()
+            .filter_map(|data| bincode::deserialize(&data).ok())
+            .collect();
+        txs.sort_by_key(|tx| (tx.received_at, tx.nonce));
+        txs
+    }
+
     /// Retrieves a transaction receipt
     pub fn get_receipt(&self, tx_hash: &H256) -> Option<TransactionReceipt> {
         let data = self.receipts.get(tx_hash.as_bytes()).ok()??;
@@ -607,6 +2215,195 @@ impl TransactionStore {
         results
     }
 
+    /// Stores the gas report of a block, replacing any previous one
+    pub fn put_gas_report(&self, height: u64, usage: &[GasUsage]) -> Result<(), StorageError> {
+        self.gas_reports.insert(height.to_be_bytes(), bincode::serialize(usage)?)?;
+        Ok(())
+    }
+
+    /// Returns the gas report of a block (empty if none was stored)
+    pub fn get_gas_report(&self, height: u64) -> Vec<GasUsage> {
+        self.gas_reports
+            .get(height.to_be_bytes())
+            .ok()
+            .flatten()
+            .and_then(|data| bincode::deserialize(&data).ok())
+            .unwrap_or_default()
+    }
+
+    /// Stores the transaction dependency DAG of a block, replacing any
+    /// previous one
+    pub fn put_tx_dag(&self, height: u64, dag: &TxDag) -> Result<(), StorageError> {
+        self.tx_dags.insert(height.to_be_bytes(), bincode::serialize(dag.dependencies())?)?;
+        Ok(())
+    }
+
+    /// Returns the transaction dependency DAG of a block, if one was stored
+    pub fn get_tx_dag(&self, height: u64) -> Option<TxDag> {
+        self.tx_dags
+            .get(height.to_be_bytes())
+            .ok()
+            .flatten()
+            .and_then(|data| bincode::deserialize(&data).ok())
+            .and_then(TxDag::from_dependencies)
+    }
+
+    /// Stores the debug logs contracts wrote during a transaction executed
+    /// at `height`, replacing any previous ones
+    pub fn put_contract_logs(
+        &self,
+        height: u64,
+        tx_hash: &H256,
+        logs: &[ContractLogRecord],
+    ) -> Result<(), StorageError> {
+        let key = Self::make_contract_log_key(height, tx_hash);
+        self.contract_logs.insert(key, bincode::serialize(logs)?)?;
+        self.contract_log_heights.insert(tx_hash.as_bytes(), &height.to_be_bytes())?;
+        Ok(())
+    }
+
+    /// Returns the debug logs stored for a transaction (empty if none were
+    /// kept or they have been pruned)
+    pub fn get_contract_logs(&self, tx_hash: &H256) -> Vec<ContractLogRecord> {
+        let Some(height) = self
+            .contract_log_heights
+            .get(tx_hash.as_bytes())
+            .ok()
+            .flatten()
+            .and_then(|data| Some(u64::from_be_bytes(data.as_ref().try_into().ok()?)))
+        else {
+            return Vec::new();
+        };
+        self.contract_logs
+            .get(Self::make_contract_log_key(height, tx_hash))
+            .ok()
+            .flatten()
+            .and_then(|data| bincode::deserialize(&data).ok())
+            .unwrap_or_default()
+    }
+
+    /// Removes the debug logs of transactions executed before `height`,
+    /// returning how many transactions' logs were removed
+    pub fn prune_contract_logs(&self, height: u64) -> Result<usize, StorageError> {
+        let end = Self::make_contract_log_key(height, &H256::zero());
+        let mut pruned = 0;
+        for entry in self.contract_logs.range(..end) {
+            let (key, _) = entry?;
+            self.contract_logs.remove(&key)?;
+            self.contract_log_heights.remove(&key[8..])?;
+            pruned += 1;
+        }
+        Ok(pruned)
+    }
+
+    /// Removes the lookup and address index entries of a block's
+    /// transactions, returning how many transactions had entries removed
+    pub fn prune_transactions(&self, block: &Block) -> Result<usize, StorageError> {
+        let mut pruned = 0;
+        for (index, tx) in block.transactions.iter().enumerate() {
+            let tx_hash = tx.hash();
+            let sender = tx.sender().ok();
+            for address in sender.iter().chain(tx.to.iter().filter(|to| Some(**to) != sender)) {
+                self.address_txs
+                    .remove(Self::make_address_tx_key(address, block.height, index as u32))?;
+            }
+            if self.tx_locations.remove(tx_hash.as_bytes())?.is_some() {
+                pruned += 1;
+            }
+        }
+        Ok(pruned)
+    }
+
+    /// Removes the receipts of a block's transactions and its gas report
+    /// and DAG, returning how many receipts were removed
+    ///
+    /// The duplicate filter and index keep the transaction hashes.
+    pub fn prune_results(&self, block: &Block) -> Result<usize, StorageError> {
+        let mut pruned = 0;
+        for tx in &block.transactions {
+            if self.receipts.remove(tx.hash().as_bytes())?.is_some() {
+                pruned += 1;
+            }
+        }
+        self.gas_reports.remove(block.height.to_be_bytes())?;
+        self.tx_dags.remove(block.height.to_be_bytes())?;
+        Ok(pruned)
+    }
+
+    /// Removes the event logs of blocks before `height`, returning how many
+    /// transactions' logs were removed
+    pub fn prune_logs(&self, height: u64) -> Result<usize, StorageError> {
+        let mut pruned = 0;
+        for entry in self.logs_by_block.range(..Self::make_logs_key(height, 0)) {
+            let (key, _) = entry?;
+            self.logs_by_block.remove(key)?;
+            pruned += 1;
+        }
+        Ok(pruned)
+    }
+
+    /// Creates a key for contract debug logs: height, tx hash
+    fn make_contract_log_key(height: u64, tx_hash: &H256) -> [u8; 40] {
+        let mut key = [0u8; 40];
+        key[0..8].copy_from_slice(&height.to_be_bytes());
+        key[8..40].copy_from_slice(tx_hash.as_bytes());
+        key
+    }
+
+    /// Indexes a committed block's transactions by sender and recipient
+    ///
+    /// Transactions whose sender cannot be recovered are indexed by recipient only.
+    pub fn index_block_transactions(&self, block: &Block) -> Result<(), StorageError> {
+        for (index, tx) in block.transactions.iter().enumerate() {
+            let tx_hash = tx.hash();
+            let sender = tx.sender().ok();
+            for address in sender.iter().chain(tx.to.iter().filter(|to| Some(**to) != sender)) {
+                let key = Self::make_address_tx_key(address, block.height, index as u32);
+                self.address_txs.insert(key, tx_hash.as_bytes())?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns transactions sent by or to an address, newest first
+    ///
+    /// Only transactions strictly before `before` (block number, index) are
+    /// returned, so the position of the last entry is the next page's cursor.
+    pub fn get_address_transactions(
+        &self,
+        address: &Address,
+        before: Option<(u64, u32)>,
+        limit: usize,
+    ) -> Vec<AddressTransaction> {
+        let start = Self::make_address_tx_key(address, 0, 0);
+        let end = match before {
+            Some((block_number, index)) => Self::make_address_tx_key(address, block_number, index),
+            None => Self::make_address_tx_key(address, u64::MAX, u32::MAX),
+        };
+
+        self.address_txs
+            .range(start..end)
+            .rev()
+            .flatten()
+            .filter_map(|(key, value)| {
+                Some(AddressTransaction {
+                    tx_hash: value.as_ref().try_into().ok()?,
+                    block_number: u64::from_be_bytes(key[20..28].try_into().ok()?),
+                    transaction_index: u32::from_be_bytes(key[28..32].try_into().ok()?),
+                })
+            })
+            .take(limit)
+            .collect()
+    }
+
+    /// Creates a key for the address index: address, block number, tx index
+    fn make_address_tx_key(address: &Address, block_number: u64, tx_index: u32) -> [u8; 32] {
+        let mut key = [0u8; 32];
+        key[0..20].copy_from_slice(address.as_bytes());
+        key[20..32].copy_from_slice(&Self::make_logs_key(block_number, tx_index));
+        key
+    }
+
     /// Checks if a log matches the filter
     fn log_matches_filter(log: &Log, filter: &LogFilter) -> bool {
         // Check address filter
@@ -641,6 +2438,7 @@ impl TransactionStore {
 
     /// Flushes data to disk
     pub fn flush(&self) -> Result<(), StorageError> {
+        self.tx_filter.persist(&self.tx_filter_tree)?;
         self.db.flush()?;
         Ok(())
     }
@@ -650,7 +2448,19 @@ impl TransactionStore {
 // Unified Storage
 // =============================================================================
 
+/// A committed transaction and where it was included
+#[derive(Debug, Clone)]
+pub struct CommittedTransaction {
+    pub transaction: Transaction,
+    pub block_hash: H256,
+    pub block_number: u64,
+    pub transaction_index: u32,
+}
+
 /// Unified storage interface for the blockchain
+///
+/// Clones are cheap and share the same underlying database.
+#[derive(Clone)]
 pub struct Storage {
     pub blocks: BlockStore,
     pub state: StateStore,
@@ -675,6 +2485,19 @@ impl Storage {
         })
     }
 
+    /// Creates storage held in memory and discarded when dropped, for tests
+    /// and simulations. Its path is empty.
+    pub fn temporary() -> Result<Self, StorageError> {
+        let open = || sled::Config::new().temporary(true).open();
+
+        Ok(Self {
+            blocks: BlockStore::from_db(open()?, DEFAULT_BLOCK_CACHE_SIZE)?,
+            state: StateStore::from_db(open()?)?,
+            transactions: TransactionStore::from_db(open()?, TxFilterConfig::default())?,
+            path: std::path::PathBuf::new(),
+        })
+    }
+
     /// Returns the storage path
     pub fn path(&self) -> &Path {
         &self.path
@@ -687,17 +2510,13 @@ impl Storage {
             return Err(StorageError::GenesisAlreadyInitialized);
         }
 
+        self.state.set_storage_quota(genesis.storage_quota)?;
+
         // Initialize accounts from allocation
         for (address, alloc) in &genesis.alloc {
             let mut account = Account::new();
             account.set_balance(alloc.balance);
 
-            // Store code if present
-            if let Some(ref code) = alloc.code {
-                let code_hash = self.state.put_code(code)?;
-                account.code_hash = *code_hash.as_bytes();
-            }
-
             // Store storage if present
             if let Some(ref storage) = alloc.storage {
                 for (key, value) in storage {
@@ -706,6 +2525,11 @@ impl Storage {
             }
 
             self.state.put_account(address, &account)?;
+
+            // Store code if present
+            if let Some(ref code) = alloc.code {
+                self.state.set_account_code(address, code)?;
+            }
         }
 
         // Initialize validators (as accounts with stake)
@@ -744,6 +2568,32 @@ impl Storage {
         Ok(genesis_block)
     }
 
+    /// Looks up a committed transaction with its position in the chain
+    pub fn get_transaction(&self, tx_hash: &H256) -> Option<CommittedTransaction> {
+        let (block_hash, index) = self.transactions.get_tx_location(tx_hash)?;
+        let block = self.blocks.get_block_by_hash(&block_hash)?;
+        let transaction = block.transactions.get(index as usize)?.clone();
+        Some(CommittedTransaction {
+            transaction,
+            block_hash,
+            block_number: block.height,
+            transaction_index: index,
+        })
+    }
+
+    /// Looks up many committed transactions at once, in request order
+    pub fn get_transactions(&self, tx_hashes: &[H256]) -> Vec<Option<CommittedTransaction>> {
+        tx_hashes.iter().map(|hash| self.get_transaction(hash)).collect()
+    }
+
+    /// Looks up many blocks by height at once, in request order
+    pub fn get_blocks_by_heights(&self, heights: &[u64]) -> Vec<Option<Block>> {
+        heights
+            .iter()
+            .map(|height| self.blocks.get_block_by_height(*height))
+            .collect()
+    }
+
     /// Closes the storage (flushes all data)
     pub fn close(&self) -> Result<(), StorageError> {
         self.flush()
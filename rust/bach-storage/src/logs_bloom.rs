@@ -0,0 +1,206 @@
+//! Per-block logs bloom
+//!
+//! Every committed block records an Ethereum-style 2048-bit bloom over the
+//! addresses and topics of the events its transactions emitted, in its
+//! header extension. Log queries test a block's bloom before reading its
+//! logs, so blocks that can't hold a match are skipped without decoding
+//! them. Blocks committed before blooms were recorded have none and are
+//! always read.
+
+use crate::{BlockStore, Log, LogFilter, Storage};
+use bach_crypto::keccak256;
+use serde::{Deserialize, Deserializer, Serialize, Serializer};
+
+/// Size of a logs bloom in bytes
+pub const LOGS_BLOOM_SIZE: usize = 256;
+
+/// Bloom filter over the addresses and topics of a set of logs
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub struct LogsBloom([u8; LOGS_BLOOM_SIZE]);
+
+impl LogsBloom {
+    /// Creates an empty bloom.
+    pub fn new() -> Self {
+        Self([0u8; LOGS_BLOOM_SIZE])
+    }
+
+    /// Creates the bloom of `logs`.
+    pub fn from_logs<'a>(logs: impl IntoIterator<Item = &'a Log>) -> Self {
+        let mut bloom = Self::new();
+        for log in logs {
+            bloom.accrue_log(log);
+        }
+        bloom
+    }
+
+    /// Adds a log's address and topics.
+    pub fn accrue_log(&mut self, log: &Log) {
+        self.accrue(&log.address);
+        for topic in &log.topics {
+            self.accrue(topic);
+        }
+    }
+
+    /// Adds an input, setting the three bits its Keccak-256 hash selects.
+    pub fn accrue(&mut self, input: &[u8]) {
+        for (byte, mask) in bits(input) {
+            self.0[byte] |= mask;
+        }
+    }
+
+    /// Returns true if `input` may have been added; false is definite.
+    pub fn contains(&self, input: &[u8]) -> bool {
+        bits(input).all(|(byte, mask)| self.0[byte] & mask == mask)
+    }
+
+    /// Returns true if a log matching `filter` may have been added.
+    pub fn may_match(&self, filter: &LogFilter) -> bool {
+        filter
+            .address
+            .map_or(true, |address| self.contains(address.as_bytes()))
+            && filter
+                .topics
+                .iter()
+                .flatten()
+                .all(|topic| self.contains(topic.as_bytes()))
+    }
+
+    /// Returns true if nothing was added.
+    pub fn is_empty(&self) -> bool {
+        self.0.iter().all(|byte| *byte == 0)
+    }
+
+    /// Returns the bloom bytes.
+    pub fn as_bytes(&self) -> &[u8; LOGS_BLOOM_SIZE] {
+        &self.0
+    }
+}
+
+impl Default for LogsBloom {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl std::fmt::Debug for LogsBloom {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let set: u32 = self.0.iter().map(|byte| byte.count_ones()).sum();
+        write!(f, "LogsBloom({} bits set)", set)
+    }
+}
+
+impl Serialize for LogsBloom {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        self.0.as_slice().serialize(serializer)
+    }
+}
+
+impl<'de> Deserialize<'de> for LogsBloom {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        let bytes = Vec::<u8>::deserialize(deserializer)?;
+        let len = bytes.len();
+        bytes
+            .try_into()
+            .map(Self)
+            .map_err(|_| serde::de::Error::invalid_length(len, &"256 bytes"))
+    }
+}
+
+/// Returns the (byte, mask) of the three bloom bits `input` sets: the low
+/// 11 bits of each of the first three byte pairs of its hash, counted from
+/// the end of the bloom.
+fn bits(input: &[u8]) -> impl Iterator<Item = (usize, u8)> {
+    let hash = keccak256(input);
+    let hash = *hash.as_bytes();
+    (0..3).map(move |i| {
+        let bit = (usize::from(hash[2 * i]) << 8 | usize::from(hash[2 * i + 1])) & 2047;
+        (LOGS_BLOOM_SIZE - 1 - bit / 8, 1u8 << (bit % 8))
+    })
+}
+
+impl BlockStore {
+    /// Returns the logs bloom of the block at `height`, if one was recorded.
+    pub fn logs_bloom_at(&self, height: u64) -> Option<LogsBloom> {
+        let hash = self.hash_at_height(height)?;
+        self.get_header_extension(&hash)?.logs_bloom
+    }
+}
+
+impl Storage {
+    /// Queries logs matching a filter, skipping the blocks whose bloom
+    /// rules out a match.
+    pub fn get_logs(&self, filter: &LogFilter) -> Vec<Log> {
+        if filter.address.is_none() && filter.topics.iter().all(Option::is_none) {
+            return self.transactions.get_logs(filter);
+        }
+        let from = filter.from_block.unwrap_or(0);
+        let to = filter
+            .to_block
+            .unwrap_or(u64::MAX)
+            .min(self.blocks.get_block_height());
+        let mut logs = Vec::new();
+        for height in from..=to {
+            if self
+                .blocks
+                .logs_bloom_at(height)
+                .is_some_and(|bloom| !bloom.may_match(filter))
+            {
+                continue;
+            }
+            logs.extend(self.transactions.get_logs(&LogFilter {
+                from_block: Some(height),
+                to_block: Some(height),
+                ..filter.clone()
+            }));
+        }
+        logs
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bach_primitives::{Address, H256};
+
+    fn log(address: u8, topic: u8) -> Log {
+        Log {
+            address: [address; 20],
+            topics: vec![[topic; 32]],
+            data: Vec::new(),
+            block_number: 1,
+            transaction_hash: [0; 32],
+            transaction_index: 0,
+            log_index: 0,
+        }
+    }
+
+    #[test]
+    fn test_bloom_membership() {
+        let bloom = LogsBloom::from_logs(&[log(1, 2)]);
+        assert!(!bloom.is_empty());
+        assert!(bloom.as_bytes().iter().map(|b| b.count_ones()).sum::<u32>() <= 6);
+        assert!(bloom.contains(&[1; 20]));
+        assert!(bloom.contains(&[2; 32]));
+        assert!(!bloom.contains(&[3; 20]));
+        assert!(LogsBloom::new().is_empty());
+
+        let filter = |address: u8, topic: Option<u8>| LogFilter {
+            address: Some(Address::from([address; 20])),
+            topics: vec![None, topic.map(|t| H256::from([t; 32]))],
+            ..Default::default()
+        };
+        assert!(bloom.may_match(&filter(1, None)));
+        assert!(bloom.may_match(&filter(1, Some(2))));
+        assert!(!bloom.may_match(&filter(3, None)));
+        assert!(!bloom.may_match(&filter(1, Some(4))));
+        assert!(bloom.may_match(&LogFilter::default()));
+    }
+
+    #[test]
+    fn test_bloom_serde_roundtrip() {
+        let bloom = LogsBloom::from_logs(&[log(1, 2), log(5, 6)]);
+        let encoded = bincode::serialize(&bloom).unwrap();
+        assert_eq!(bincode::deserialize::<LogsBloom>(&encoded).unwrap(), bloom);
+        assert!(bincode::deserialize::<LogsBloom>(&encoded[..100]).is_err());
+    }
+}
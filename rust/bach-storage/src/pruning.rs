@@ -0,0 +1,339 @@
+//! Retention-based pruning
+//!
+//! Each class of per-block data has its own retention window, so results
+//! and events can outlive the write sets they came from, or the other way
+//! around. Blocks themselves are never pruned: their hashes commit to the
+//! transactions, and peers sync from them.
+//!
+//! Pruning is incremental. The lowest height still stored for each class is
+//! recorded, and every `Storage::prune` call continues from there. Features
+//! that read pruned data serve only the heights still stored; see
+//! `HistoryFeature`.
+//!
+//! Nothing is pruned at or above the latest finality checkpoint, nor within
+//! the sync window of recent blocks served to syncing peers: both need the
+//! headers and state roots there. Until a checkpoint is stored nothing is
+//! pruned at all. The duplicate index of committed transaction hashes is
+//! never pruned, so duplicate checks stay exact whatever the policy.
+
+use crate::{Storage, StorageError};
+use serde::{Deserialize, Serialize};
+
+/// A class of per-block data with its own retention window
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum DataClass {
+    /// Header records: state roots and header extensions
+    Headers,
+    /// Transaction lookup and per-address transaction indexes
+    Transactions,
+    /// Receipts, gas reports and transaction DAGs
+    Results,
+    /// Recorded state changes and the per-slot key history
+    RwSets,
+    /// Event logs indexed by block
+    Events,
+}
+
+impl DataClass {
+    /// All classes, in pruning order
+    pub const ALL: [DataClass; 5] = [
+        DataClass::Headers,
+        DataClass::Transactions,
+        DataClass::Results,
+        DataClass::RwSets,
+        DataClass::Events,
+    ];
+
+    /// Returns the class name as used in config and errors.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            DataClass::Headers => "headers",
+            DataClass::Transactions => "transactions",
+            DataClass::Results => "results",
+            DataClass::RwSets => "rw_sets",
+            DataClass::Events => "events",
+        }
+    }
+}
+
+/// A feature that reads historical data, degraded to the heights its
+/// classes still store
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HistoryFeature {
+    /// Verifying proofs against historical state commitments
+    StateProofs,
+    /// Looking up committed transactions by hash or address
+    TransactionLookup,
+    /// Receipts, gas reports and DAG statistics
+    Receipts,
+    /// Event log queries
+    LogQueries,
+    /// State diffs, state change feeds and key history
+    StateHistory,
+}
+
+impl HistoryFeature {
+    /// Returns the feature name as used in errors.
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            HistoryFeature::StateProofs => "state proofs",
+            HistoryFeature::TransactionLookup => "transaction lookup",
+            HistoryFeature::Receipts => "receipts",
+            HistoryFeature::LogQueries => "log queries",
+            HistoryFeature::StateHistory => "state history",
+        }
+    }
+
+    /// Returns the data classes the feature reads.
+    pub fn classes(&self) -> &'static [DataClass] {
+        match self {
+            HistoryFeature::StateProofs => &[DataClass::Headers],
+            HistoryFeature::TransactionLookup => &[DataClass::Transactions],
+            HistoryFeature::Receipts => &[DataClass::Results],
+            HistoryFeature::LogQueries => &[DataClass::Events],
+            HistoryFeature::StateHistory => &[DataClass::RwSets],
+        }
+    }
+}
+
+/// Recent blocks kept whole for syncing peers by default
+pub const DEFAULT_SYNC_WINDOW: u64 = 1024;
+
+/// Blocks of each data class to keep, counting back from the head
+/// (everything is kept when unset)
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct RetentionPolicy {
+    pub headers: Option<u64>,
+    pub transactions: Option<u64>,
+    pub results: Option<u64>,
+    pub rw_sets: Option<u64>,
+    pub events: Option<u64>,
+    /// Recent blocks served to syncing peers, never pruned whatever the
+    /// class windows
+    pub sync_window: u64,
+}
+
+impl Default for RetentionPolicy {
+    fn default() -> Self {
+        Self {
+            headers: None,
+            transactions: None,
+            results: None,
+            rw_sets: None,
+            events: None,
+            sync_window: DEFAULT_SYNC_WINDOW,
+        }
+    }
+}
+
+impl RetentionPolicy {
+    /// Returns the blocks of `class` to keep, or None to keep all.
+    pub fn retention(&self, class: DataClass) -> Option<u64> {
+        match class {
+            DataClass::Headers => self.headers,
+            DataClass::Transactions => self.transactions,
+            DataClass::Results => self.results,
+            DataClass::RwSets => self.rw_sets,
+            DataClass::Events => self.events,
+        }
+    }
+
+    /// Returns true if any class is pruned.
+    pub fn is_pruning(&self) -> bool {
+        DataClass::ALL
+            .iter()
+            .any(|class| self.retention(*class).is_some())
+    }
+
+    /// Returns the lowest height whose data of `class` is kept at `head`.
+    pub fn first_kept(&self, class: DataClass, head: u64) -> u64 {
+        self.retention(class)
+            .map_or(0, |blocks| head.saturating_add(1).saturating_sub(blocks))
+    }
+
+    /// Checks that the windows fit together and with the features that
+    /// depend on them.
+    ///
+    /// Every class and the sync window must keep at least one block.
+    /// Headers must be kept at least as long as any other class, so every
+    /// retained record can be checked against its block's state commitment.
+    pub fn validate(&self) -> Result<(), StorageError> {
+        for class in DataClass::ALL {
+            if self.retention(class) == Some(0) {
+                return Err(StorageError::InvalidRetention(format!(
+                    "{} must keep at least one block",
+                    class.as_str()
+                )));
+            }
+        }
+        if self.sync_window == 0 {
+            return Err(StorageError::InvalidRetention(
+                "sync_window must keep at least one block".to_string(),
+            ));
+        }
+        if let Some(headers) = self.headers {
+            let longer = DataClass::ALL.into_iter().find(|class| {
+                self.retention(*class)
+                    .map_or(true, |blocks| blocks > headers)
+            });
+            if let Some(class) = longer {
+                return Err(StorageError::InvalidRetention(format!(
+                    "{} are kept longer than the headers they belong to",
+                    class.as_str()
+                )));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Records removed by a `Storage::prune` call, by class
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct PruneReport {
+    pub headers: usize,
+    pub transactions: usize,
+    pub results: usize,
+    pub rw_sets: usize,
+    pub events: usize,
+}
+
+impl PruneReport {
+    /// Returns the records removed across all classes.
+    pub fn total(&self) -> usize {
+        self.headers + self.transactions + self.results + self.rw_sets + self.events
+    }
+
+    fn add(&mut self, class: DataClass, removed: usize) {
+        match class {
+            DataClass::Headers => self.headers += removed,
+            DataClass::Transactions => self.transactions += removed,
+            DataClass::Results => self.results += removed,
+            DataClass::RwSets => self.rw_sets += removed,
+            DataClass::Events => self.events += removed,
+        }
+    }
+}
+
+impl Storage {
+    /// Removes the data `policy` no longer retains at `head`, continuing
+    /// from where the previous call stopped and never going past
+    /// `prune_floor`.
+    pub fn prune(&self, policy: &RetentionPolicy, head: u64) -> Result<PruneReport, StorageError> {
+        let mut report = PruneReport::default();
+        let floor = self.prune_floor(policy, head);
+        for class in DataClass::ALL {
+            let from = self.blocks.pruned_below(class);
+            let to = policy.first_kept(class, head).min(floor);
+            if to <= from {
+                continue;
+            }
+            let removed = match class {
+                DataClass::Headers => self.blocks.prune_headers(from, to)?,
+                DataClass::RwSets => self.state.prune_state_changes(to)?,
+                DataClass::Events => self.transactions.prune_logs(to)?,
+                DataClass::Transactions | DataClass::Results => {
+                    let mut removed = 0;
+                    for height in from..to {
+                        let Some(block) = self.blocks.load_block_at(height) else {
+                            continue;
+                        };
+                        removed += if class == DataClass::Transactions {
+                            self.transactions.prune_transactions(&block)?
+                        } else {
+                            self.transactions.prune_results(&block)?
+                        };
+                    }
+                    removed
+                }
+            };
+            self.blocks.set_pruned_below(class, to)?;
+            report.add(class, removed);
+        }
+        Ok(report)
+    }
+
+    /// Returns the lowest height pruning may not reach at `head`: the latest
+    /// finality checkpoint, or the start of the sync window if that is
+    /// lower. It is 0, so nothing is pruned, until a checkpoint is stored.
+    pub fn prune_floor(&self, policy: &RetentionPolicy, head: u64) -> u64 {
+        let checkpoint = self
+            .blocks
+            .get_latest_finality_checkpoint(head)
+            .map_or(0, |signed| signed.height());
+        let sync_start = head.saturating_add(1).saturating_sub(policy.sync_window);
+        checkpoint.min(sync_start)
+    }
+
+    /// Returns the lowest height whose data of `class` is still stored.
+    pub fn pruned_below(&self, class: DataClass) -> u64 {
+        self.blocks.pruned_below(class)
+    }
+
+    /// Returns the lowest height `feature` still has complete data for.
+    pub fn history_available_from(&self, feature: HistoryFeature) -> u64 {
+        feature
+            .classes()
+            .iter()
+            .map(|class| self.pruned_below(*class))
+            .max()
+            .unwrap_or(0)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_first_kept() {
+        let policy = RetentionPolicy {
+            results: Some(10),
+            ..Default::default()
+        };
+        assert_eq!(policy.first_kept(DataClass::Results, 100), 91);
+        assert_eq!(policy.first_kept(DataClass::Results, 5), 0);
+        assert_eq!(policy.first_kept(DataClass::Events, 100), 0);
+        assert!(policy.is_pruning());
+        assert!(!RetentionPolicy::default().is_pruning());
+    }
+
+    #[test]
+    fn test_validate() {
+        assert!(RetentionPolicy::default().validate().is_ok());
+
+        let policy = RetentionPolicy {
+            headers: None,
+            results: Some(50),
+            rw_sets: Some(100),
+            transactions: Some(10),
+            events: Some(100),
+            sync_window: 64,
+        };
+        assert!(policy.validate().is_ok());
+        let policy = RetentionPolicy {
+            sync_window: 0,
+            ..policy
+        };
+        assert!(policy.validate().is_err());
+
+        // Headers must outlive every other class, unset meaning forever
+        let policy = RetentionPolicy {
+            headers: Some(100),
+            events: Some(200),
+            ..Default::default()
+        };
+        assert!(policy.validate().is_err());
+        let policy = RetentionPolicy {
+            headers: Some(100),
+            ..Default::default()
+        };
+        assert!(policy.validate().is_err());
+
+        let policy = RetentionPolicy {
+            rw_sets: Some(0),
+            ..Default::default()
+        };
+        assert!(policy.validate().is_err());
+    }
+}
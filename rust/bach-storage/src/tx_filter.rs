@@ -0,0 +1,637 @@
+//! Transaction duplicate filters
+//!
+//! A `TxFilter` answers "have we possibly seen this transaction hash?" without
+//! touching the duplicate index. `ShardedCuckooFilter` is the default
+//! implementation: hashes are spread over independently locked shards, each
+//! shard is persisted with a checksum, and a shard that fails to load is
+//! rebuilt from the duplicate index instead of rebuilding the whole filter.
+//!
+//! A shard never runs out of room: once its newest table has to stash a
+//! fingerprint, later inserts go to a fresh table twice its size, and
+//! lookups check every table.
+//!
+//! Shards are persisted every `persist_interval` inserts, so a crash can
+//! lose recent ones. The first insert after a persist writes a stale marker
+//! before the hash is indexed; a filter loaded with the marker present is
+//! rebuilt in full, since its shards may miss committed hashes.
+
+use bach_crypto::keccak256;
+use bach_primitives::H256;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+
+use crate::StorageError;
+
+/// Fingerprint slots per bucket.
+const BUCKET_SIZE: usize = 4;
+
+/// Maximum evictions before an insert gives up.
+const MAX_KICKS: usize = 500;
+
+/// Persistence key for the filter layout.
+const META_KEY: &[u8] = b"meta";
+
+/// Persistence key prefix for shard data.
+const SHARD_KEY_PREFIX: &[u8] = b"shard";
+
+/// Persistence key present while inserts may be missing from the shards.
+const STALE_KEY: &[u8] = b"stale";
+
+/// Duplicate pre-check for transaction hashes.
+///
+/// Implementations may return false positives but never false negatives.
+pub trait TxFilter: Send + Sync {
+    /// Returns true if the hash may have been inserted before.
+    fn may_contain(&self, hash: &H256) -> bool;
+
+    /// Records a hash. Returns false if the filter has no room left.
+    fn insert(&self, hash: &H256) -> bool;
+
+    /// Returns a snapshot of the filter metrics.
+    fn metrics(&self) -> TxFilterMetrics;
+}
+
+/// Filter sizing and persistence settings
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TxFilterConfig {
+    /// Number of independently locked shards
+    pub shard_count: usize,
+    /// Buckets in each shard's first table (rounded up to a power of two)
+    pub buckets_per_shard: usize,
+    /// Inserts between automatic persists (0 disables)
+    pub persist_interval: u64,
+}
+
+impl Default for TxFilterConfig {
+    fn default() -> Self {
+        Self {
+            shard_count: 16,
+            buckets_per_shard: 4096,
+            persist_interval: 1024,
+        }
+    }
+}
+
+/// Filter metrics snapshot
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct TxFilterMetrics {
+    /// Hashes currently stored
+    pub items: u64,
+    /// Fingerprint slots in all tables
+    pub capacity: u64,
+    /// Bytes used by fingerprint tables
+    pub memory_bytes: u64,
+    /// Expected false positive rate at the current load
+    pub estimated_false_positive_rate: f64,
+    /// Lookups performed
+    pub lookups: u64,
+    /// Lookups that reported a possible duplicate
+    pub positives: u64,
+    /// Shards rebuilt from the store since open
+    pub rebuilt_shards: u64,
+}
+
+/// A single cuckoo table with a one-entry victim stash
+#[derive(Debug, Clone, PartialEq)]
+struct CuckooTable {
+    buckets: Vec<[u16; BUCKET_SIZE]>,
+    victim: Option<(usize, u16)>,
+    len: u64,
+}
+
+impl CuckooTable {
+    fn new(buckets: usize) -> Self {
+        Self {
+            buckets: vec![[0u16; BUCKET_SIZE]; buckets],
+            victim: None,
+            len: 0,
+        }
+    }
+
+    fn mask(&self) -> usize {
+        self.buckets.len() - 1
+    }
+
+    fn contains(&self, bucket: u64, fingerprint: u16) -> bool {
+        let index = bucket as usize & self.mask();
+        let alt = alt_index(index, fingerprint, self.mask());
+        self.buckets[index].contains(&fingerprint)
+            || self.buckets[alt].contains(&fingerprint)
+            || self.victim.is_some_and(|(i, fp)| fp == fingerprint && (i == index || i == alt))
+    }
+
+    /// Inserts a fingerprint. Returns false once the victim stash is taken.
+    fn insert(&mut self, bucket: u64, fingerprint: u16) -> bool {
+        if self.victim.is_some() {
+            return false;
+        }
+
+        let mask = self.mask();
+        let index = bucket as usize & mask;
+        let alt = alt_index(index, fingerprint, mask);
+        if self.put(index, fingerprint) || self.put(alt, fingerprint) {
+            self.len += 1;
+            return true;
+        }
+
+        let mut index = index;
+        let mut fingerprint = fingerprint;
+        for kick in 0..MAX_KICKS {
+            let slot = kick % BUCKET_SIZE;
+            std::mem::swap(&mut fingerprint, &mut self.buckets[index][slot]);
+            index = alt_index(index, fingerprint, mask);
+            if self.put(index, fingerprint) {
+                self.len += 1;
+                return true;
+            }
+        }
+
+        // Keep the displaced fingerprint so lookups never miss it
+        self.victim = Some((index, fingerprint));
+        self.len += 1;
+        true
+    }
+
+    fn put(&mut self, index: usize, fingerprint: u16) -> bool {
+        for slot in self.buckets[index].iter_mut() {
+            if *slot == 0 {
+                *slot = fingerprint;
+                return true;
+            }
+        }
+        false
+    }
+
+    /// Encodes as `[len u64][victim u64 + u16][buckets]`
+    fn encode_into(&self, data: &mut Vec<u8>) {
+        data.extend_from_slice(&self.len.to_be_bytes());
+        let (victim_index, victim_fp) = self.victim.unwrap_or((0, 0));
+        data.extend_from_slice(&(victim_index as u64).to_be_bytes());
+        data.extend_from_slice(&victim_fp.to_be_bytes());
+        for bucket in &self.buckets {
+            for fp in bucket {
+                data.extend_from_slice(&fp.to_be_bytes());
+            }
+        }
+    }
+
+    fn encoded_len(buckets: usize) -> usize {
+        18 + buckets * BUCKET_SIZE * 2
+    }
+
+    fn decode(body: &[u8], buckets: usize) -> Option<Self> {
+        if body.len() != Self::encoded_len(buckets) {
+            return None;
+        }
+        let len = u64::from_be_bytes(body[0..8].try_into().ok()?);
+        let victim_index = u64::from_be_bytes(body[8..16].try_into().ok()?) as usize;
+        let victim_fp = u16::from_be_bytes(body[16..18].try_into().ok()?);
+        if victim_fp != 0 && victim_index >= buckets {
+            return None;
+        }
+
+        let mut table = Self::new(buckets);
+        table.len = len;
+        table.victim = (victim_fp != 0).then_some((victim_index, victim_fp));
+        for (i, chunk) in body[18..].chunks_exact(2).enumerate() {
+            table.buckets[i / BUCKET_SIZE][i % BUCKET_SIZE] = u16::from_be_bytes([chunk[0], chunk[1]]);
+        }
+        Some(table)
+    }
+}
+
+/// A shard's tables, each twice the size of the one before
+#[derive(Debug, Clone)]
+struct CuckooShard {
+    tables: Vec<CuckooTable>,
+    dirty: bool,
+}
+
+impl CuckooShard {
+    fn new(buckets: usize) -> Self {
+        Self {
+            tables: vec![CuckooTable::new(buckets)],
+            dirty: false,
+        }
+    }
+
+    fn contains(&self, bucket: u64, fingerprint: u16) -> bool {
+        self.tables.iter().any(|t| t.contains(bucket, fingerprint))
+    }
+
+    /// Inserts into the newest table, adding a larger one when it is full.
+    fn insert(&mut self, bucket: u64, fingerprint: u16) {
+        let newest = self.tables.last_mut().expect("a shard has a table");
+        if !newest.insert(bucket, fingerprint) {
+            let mut table = CuckooTable::new(newest.buckets.len() * 2);
+            table.insert(bucket, fingerprint);
+            self.tables.push(table);
+        }
+        self.dirty = true;
+    }
+
+    /// Encodes as `[table count u32][tables][checksum]`
+    fn encode(&self) -> Vec<u8> {
+        let buckets: usize = self.tables.iter().map(|t| t.buckets.len()).sum();
+        let mut data = Vec::with_capacity(4 + self.tables.len() * 18 + buckets * BUCKET_SIZE * 2 + 32);
+        data.extend_from_slice(&(self.tables.len() as u32).to_be_bytes());
+        for table in &self.tables {
+            table.encode_into(&mut data);
+        }
+        let checksum = keccak256(&data);
+        data.extend_from_slice(checksum.as_bytes());
+        data
+    }
+
+    fn decode(data: &[u8], buckets: usize) -> Option<Self> {
+        let body_len = data.len().checked_sub(32)?;
+        let (body, checksum) = data.split_at(body_len);
+        if body.len() < 4 || keccak256(body).as_bytes() != checksum {
+            return None;
+        }
+
+        let count = u32::from_be_bytes(body[0..4].try_into().ok()?) as usize;
+        let mut tables = Vec::new();
+        let mut rest = &body[4..];
+        let mut size = buckets;
+        for _ in 0..count {
+            let len = CuckooTable::encoded_len(size);
+            if rest.len() < len {
+                return None;
+            }
+            let (table, tail) = rest.split_at(len);
+            tables.push(CuckooTable::decode(table, size)?);
+            rest = tail;
+            size = size.checked_mul(2)?;
+        }
+        if tables.is_empty() || !rest.is_empty() {
+            return None;
+        }
+        Some(Self { tables, dirty: false })
+    }
+}
+
+/// Alternate bucket for a fingerprint (partial-key cuckoo hashing)
+fn alt_index(index: usize, fingerprint: u16, mask: usize) -> usize {
+    (index ^ (fingerprint as usize).wrapping_mul(0x5bd1_e995)) & mask
+}
+
+/// Sharded cuckoo filter over transaction hashes
+pub struct ShardedCuckooFilter {
+    config: TxFilterConfig,
+    shards: Vec<Mutex<CuckooShard>>,
+    lookups: AtomicU64,
+    positives: AtomicU64,
+    inserts_since_persist: AtomicU64,
+    rebuilt_shards: AtomicU64,
+    /// Whether the stale marker is written; held across persists and
+    /// recorded inserts
+    stale: Mutex<bool>,
+}
+
+impl ShardedCuckooFilter {
+    /// Creates an empty filter.
+    pub fn new(config: TxFilterConfig) -> Self {
+        let mut config = config;
+        config.shard_count = config.shard_count.max(1);
+        config.buckets_per_shard = config.buckets_per_shard.max(1).next_power_of_two();
+
+        let shards = (0..config.shard_count)
+            .map(|_| Mutex::new(CuckooShard::new(config.buckets_per_shard)))
+            .collect();
+
+        Self {
+            config,
+            shards,
+            lookups: AtomicU64::new(0),
+            positives: AtomicU64::new(0),
+            inserts_since_persist: AtomicU64::new(0),
+            rebuilt_shards: AtomicU64::new(0),
+            stale: Mutex::new(false),
+        }
+    }
+
+    /// Returns the effective configuration.
+    pub fn config(&self) -> &TxFilterConfig {
+        &self.config
+    }
+
+    /// Loads a persisted filter.
+    ///
+    /// Returns the filter together with the indices of shards that were
+    /// missing or failed their checksum and must be rebuilt; all of them if
+    /// the filter was not persisted since its last insert.
+    pub fn load(tree: &sled::Tree, config: TxFilterConfig) -> Result<(Self, Vec<usize>), StorageError> {
+        let filter = Self::new(config);
+        let all_shards: Vec<usize> = (0..filter.shards.len()).collect();
+
+        let layout_matches = tree
+            .get(META_KEY)?
+            .is_some_and(|meta| meta.as_ref() == filter.layout().as_slice());
+        if !layout_matches || tree.contains_key(STALE_KEY)? {
+            return Ok((filter, all_shards));
+        }
+
+        let mut corrupted = Vec::new();
+        for index in all_shards {
+            let decoded = tree
+                .get(Self::shard_key(index))?
+                .and_then(|data| CuckooShard::decode(&data, filter.config.buckets_per_shard));
+            match decoded {
+                Some(shard) => *filter.shards[index].lock().unwrap() = shard,
+                None => corrupted.push(index),
+            }
+        }
+
+        Ok((filter, corrupted))
+    }
+
+    /// Re-populates the given shards from the hashes in one pass,
+    /// discarding their contents.
+    pub fn rebuild_shards<I>(&self, indices: &[usize], hashes: I)
+    where
+        I: IntoIterator<Item = H256>,
+    {
+        let mut rebuilt: Vec<Option<CuckooShard>> = vec![None; self.shards.len()];
+        for &index in indices {
+            rebuilt[index] = Some(CuckooShard::new(self.config.buckets_per_shard));
+        }
+        for hash in hashes {
+            let (index, bucket, fingerprint) = self.locate(&hash);
+            if let Some(shard) = &mut rebuilt[index] {
+                shard.insert(bucket, fingerprint);
+            }
+        }
+
+        for (index, shard) in rebuilt.into_iter().enumerate() {
+            if let Some(mut shard) = shard {
+                shard.dirty = true;
+                *self.shards[index].lock().unwrap() = shard;
+                self.rebuilt_shards.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+    }
+
+    /// Records a hash about to be indexed, writing the stale marker first
+    /// if the filter was persisted since.
+    pub fn record(&self, tree: &sled::Tree, hash: &H256) -> Result<(), StorageError> {
+        let mut stale = self.stale.lock().unwrap();
+        if !*stale {
+            tree.insert(STALE_KEY, &[][..])?;
+            *stale = true;
+        }
+        self.insert(hash);
+        Ok(())
+    }
+
+    /// Returns the shard a hash belongs to.
+    pub fn shard_of(&self, hash: &H256) -> usize {
+        self.locate(hash).0
+    }
+
+    /// Writes modified shards to the tree.
+    pub fn persist(&self, tree: &sled::Tree) -> Result<(), StorageError> {
+        let mut stale = self.stale.lock().unwrap();
+        tree.insert(META_KEY, self.layout().as_slice())?;
+        for (index, shard) in self.shards.iter().enumerate() {
+            let mut shard = shard.lock().unwrap();
+            if shard.dirty {
+                tree.insert(Self::shard_key(index), shard.encode())?;
+                shard.dirty = false;
+            }
+        }
+        tree.remove(STALE_KEY)?;
+        *stale = false;
+        self.inserts_since_persist.store(0, Ordering::Relaxed);
+        Ok(())
+    }
+
+    /// Persists if at least `persist_interval` inserts happened since the last persist.
+    pub fn persist_if_due(&self, tree: &sled::Tree) -> Result<(), StorageError> {
+        let interval = self.config.persist_interval;
+        if interval > 0 && self.inserts_since_persist.load(Ordering::Relaxed) >= interval {
+            self.persist(tree)?;
+        }
+        Ok(())
+    }
+
+    /// Returns the number of tables each shard holds.
+    pub fn table_counts(&self) -> Vec<usize> {
+        self.shards.iter().map(|s| s.lock().unwrap().tables.len()).collect()
+    }
+
+    /// Maps a hash to (shard, bucket bits, fingerprint). Each table masks
+    /// the bucket bits to its own size.
+    ///
+    /// Transaction hashes are Keccak outputs, so their bytes are used directly.
+    fn locate(&self, hash: &H256) -> (usize, u64, u16) {
+        let bytes = hash.as_bytes();
+        let shard = u16::from_be_bytes([bytes[0], bytes[1]]) as usize % self.shards.len();
+        let bucket = u64::from_be_bytes(bytes[2..10].try_into().unwrap());
+        let fingerprint = match u16::from_be_bytes([bytes[10], bytes[11]]) {
+            0 => 1,
+            fp => fp,
+        };
+        (shard, bucket, fingerprint)
+    }
+
+    fn layout(&self) -> [u8; 16] {
+        let mut layout = [0u8; 16];
+        layout[0..8].copy_from_slice(&(self.config.shard_count as u64).to_be_bytes());
+        layout[8..16].copy_from_slice(&(self.config.buckets_per_shard as u64).to_be_bytes());
+        layout
+    }
+
+    fn shard_key(index: usize) -> Vec<u8> {
+        let mut key = SHARD_KEY_PREFIX.to_vec();
+        key.extend_from_slice(&(index as u32).to_be_bytes());
+        key
+    }
+}
+
+impl TxFilter for ShardedCuckooFilter {
+    fn may_contain(&self, hash: &H256) -> bool {
+        let (shard, bucket, fingerprint) = self.locate(hash);
+        let found = self.shards[shard].lock().unwrap().contains(bucket, fingerprint);
+
+        self.lookups.fetch_add(1, Ordering::Relaxed);
+        if found {
+            self.positives.fetch_add(1, Ordering::Relaxed);
+        }
+        found
+    }
+
+    fn insert(&self, hash: &H256) -> bool {
+        let (shard, bucket, fingerprint) = self.locate(hash);
+        self.shards[shard].lock().unwrap().insert(bucket, fingerprint);
+        self.inserts_since_persist.fetch_add(1, Ordering::Relaxed);
+        true
+    }
+
+    fn metrics(&self) -> TxFilterMetrics {
+        let mut items = 0;
+        let mut slots = 0;
+        let mut false_positive_rate = 0.0;
+        for shard in &self.shards {
+            let shard = shard.lock().unwrap();
+            for table in &shard.tables {
+                let table_slots = (table.buckets.len() * BUCKET_SIZE) as u64;
+                items += table.len;
+                slots += table_slots;
+                // Two candidate buckets of BUCKET_SIZE 16-bit fingerprints each;
+                // a lookup checks every table in one shard
+                let load = table.len as f64 / table_slots as f64;
+                false_positive_rate += 2.0 * BUCKET_SIZE as f64 * load / 65536.0;
+            }
+        }
+
+        TxFilterMetrics {
+            items,
+            capacity: slots,
+            memory_bytes: slots * 2,
+            estimated_false_positive_rate: (false_positive_rate / self.shards.len() as f64).min(1.0),
+            lookups: self.lookups.load(Ordering::Relaxed),
+            positives: self.positives.load(Ordering::Relaxed),
+            rebuilt_shards: self.rebuilt_shards.load(Ordering::Relaxed),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn small_config() -> TxFilterConfig {
+        TxFilterConfig {
+            shard_count: 4,
+            buckets_per_shard: 64,
+            persist_interval: 0,
+        }
+    }
+
+    fn hash(i: u32) -> H256 {
+        keccak256(&i.to_be_bytes())
+    }
+
+    #[test]
+    fn test_insert_and_lookup() {
+        let filter = ShardedCuckooFilter::new(small_config());
+        for i in 0..500 {
+            assert!(filter.insert(&hash(i)));
+        }
+        for i in 0..500 {
+            assert!(filter.may_contain(&hash(i)));
+        }
+
+        let metrics = filter.metrics();
+        assert_eq!(metrics.items, 500);
+        assert_eq!(metrics.capacity, 4 * 64 * 4);
+        assert_eq!(metrics.lookups, 500);
+        assert_eq!(metrics.positives, 500);
+    }
+
+    #[test]
+    fn test_false_positive_rate_is_low() {
+        let filter = ShardedCuckooFilter::new(TxFilterConfig::default());
+        for i in 0..10_000 {
+            filter.insert(&hash(i));
+        }
+        let false_positives = (10_000..20_000).filter(|i| filter.may_contain(&hash(*i))).count();
+        assert!(false_positives < 50, "too many false positives: {}", false_positives);
+        assert!(filter.metrics().estimated_false_positive_rate < 0.01);
+    }
+
+    #[test]
+    fn test_shard_encode_decode_roundtrip() {
+        let mut shard = CuckooShard::new(8);
+        shard.insert(3, 0xabcd);
+        shard.tables[0].victim = Some((5, 0x1234));
+        shard.insert(11, 0x4321);
+        assert_eq!(shard.tables.len(), 2);
+
+        let encoded = shard.encode();
+        let decoded = CuckooShard::decode(&encoded, 8).unwrap();
+        assert_eq!(decoded.tables, shard.tables);
+
+        // The base size fixes every table's length
+        assert!(CuckooShard::decode(&encoded, 4).is_none());
+    }
+
+    #[test]
+    fn test_shard_decode_rejects_bad_checksum() {
+        let shard = CuckooShard::new(8);
+        let mut encoded = shard.encode();
+        encoded[20] ^= 0xff;
+        assert!(CuckooShard::decode(&encoded, 8).is_none());
+    }
+
+    #[test]
+    fn test_rebuild_shards_keeps_only_matching_hashes() {
+        let filter = ShardedCuckooFilter::new(small_config());
+        let hashes: Vec<H256> = (0..100).map(hash).collect();
+
+        filter.rebuild_shards(&[0, 2], hashes.clone());
+
+        let rebuilt = |h: &&H256| [0, 2].contains(&filter.shard_of(h));
+        assert!(hashes.iter().filter(rebuilt).all(|h| filter.may_contain(h)));
+        let in_shards = hashes.iter().filter(rebuilt).count() as u64;
+        assert_eq!(filter.metrics().items, in_shards);
+        assert_eq!(filter.metrics().rebuilt_shards, 2);
+    }
+
+    #[test]
+    fn test_record_marks_stale() {
+        let tree = sled::Config::new().temporary(true).open().unwrap().open_tree("f").unwrap();
+        let config = TxFilterConfig {
+            shard_count: 1,
+            ..small_config()
+        };
+        let filter = ShardedCuckooFilter::new(config.clone());
+
+        filter.record(&tree, &hash(0)).unwrap();
+        assert!(tree.contains_key(STALE_KEY).unwrap());
+        let (_, rebuild) = ShardedCuckooFilter::load(&tree, config.clone()).unwrap();
+        assert_eq!(rebuild, vec![0]);
+
+        filter.persist(&tree).unwrap();
+        assert!(!tree.contains_key(STALE_KEY).unwrap());
+        let (loaded, rebuild) = ShardedCuckooFilter::load(&tree, config).unwrap();
+        assert!(rebuild.is_empty());
+        assert!(loaded.may_contain(&hash(0)));
+    }
+
+    #[test]
+    fn test_grows_past_capacity() {
+        let tree = sled::Config::new().temporary(true).open().unwrap().open_tree("f").unwrap();
+        let config = TxFilterConfig {
+            shard_count: 1,
+            buckets_per_shard: 1,
+            persist_interval: 0,
+        };
+        let filter = ShardedCuckooFilter::new(config.clone());
+        let initial = filter.metrics().capacity;
+
+        // Far more hashes than the first table holds
+        for i in 0..1000 {
+            filter.record(&tree, &hash(i)).unwrap();
+        }
+        assert!(filter.table_counts()[0] > 1);
+        assert!((0..1000).all(|i| filter.may_contain(&hash(i))));
+        let metrics = filter.metrics();
+        assert_eq!(metrics.items, 1000);
+        assert!(metrics.capacity > initial);
+        assert!(metrics.estimated_false_positive_rate < 0.01);
+
+        // The grown tables survive a reload
+        filter.persist(&tree).unwrap();
+        let (loaded, rebuild) = ShardedCuckooFilter::load(&tree, config.clone()).unwrap();
+        assert!(rebuild.is_empty());
+        assert_eq!(loaded.table_counts(), filter.table_counts());
+        assert!((0..1000).all(|i| loaded.may_contain(&hash(i))));
+
+        // And so does a rebuild from the index
+        let rebuilt = ShardedCuckooFilter::new(config);
+        rebuilt.rebuild_shards(&[0], (0..1000).map(hash));
+        assert!((0..1000).all(|i| rebuilt.may_contain(&hash(i))));
+    }
+}
@@ -1,12 +1,16 @@
 //! Integration tests for bach-storage
 
-use bach_crypto::{keccak256, PrivateKey};
+use bach_crypto::{keccak256, HashAlgorithm, HashSchedule, PrivateKey};
 use bach_primitives::{Address, H256, U256};
 use bach_storage::{
-    Account, BlockHeader, GenesisAccount, GenesisConfig, Log, LogFilter, Storage, StorageError,
-    TransactionReceipt, ValidatorConfig,
+    chain_receipts_root, receipts_root,
+    Account, BlockHeader, BlockStore, ContractLogRecord, GasReportBuilder,
+    GasUsage, GenesisAccount, GenesisConfig, HeaderExtension, HistoryFeature, IndexEntry, Log,
+    LogFilter, LogsBloom, OutboxEvent, MAX_STATE_CHANGE_SCAN, PooledTransaction, PruneReport, RetentionPolicy, Storage, StorageError,
+    TransactionReceipt, TransactionStore, TxFilter, TxFilterConfig, ValidatorConfig,
+    STORAGE_SLOT_BYTES,
 };
-use bach_types::{Block, Transaction};
+use bach_types::{Block, Checkpoint, SignedCheckpoint, Transaction, TxDag};
 use std::collections::HashMap;
 use tempfile::TempDir;
 
@@ -153,6 +157,161 @@ fn test_block_header_storage() {
     assert_eq!(retrieved.state_root, *state_root.as_bytes());
 }
 
+#[test]
+fn test_header_extension_storage() {
+    let (storage, _temp) = create_temp_storage();
+    let hash = create_test_block(5, H256::zero()).hash();
+    assert!(storage.blocks.get_header_extension(&hash).is_none());
+
+    let extension = HeaderExtension {
+        state_commitment: Some([0xbb; 32]),
+        logs_bloom: Some(LogsBloom::new()),
+        receipts_root: Some([0xcc; 32]),
+        receipts_chain_root: Some([0xdd; 32]),
+    };
+    storage.blocks.put_header_extension(&hash, &extension).unwrap();
+    assert_eq!(storage.blocks.get_header_extension(&hash), Some(extension));
+}
+
+#[test]
+fn test_transition_block_stored_under_both_hashes() {
+    let (storage, _temp) = create_temp_storage();
+    let schedule = HashSchedule::default().with_migration(2, HashAlgorithm::Sm3);
+    let event = |block: &Block| OutboxEvent {
+        block_hash: *block.digests(&schedule).hash.as_bytes(),
+        receipts: vec![],
+        changes: vec![],
+    };
+
+    let transition = create_test_block(2, H256::zero());
+    let digests = transition.digests(&schedule);
+    storage
+        .blocks
+        .put_block_with_digests(&transition, &digests, &event(&transition))
+        .unwrap();
+    let legacy_hash = digests.legacy_hash.unwrap();
+    assert_eq!(legacy_hash, transition.hash());
+    assert_eq!(storage.blocks.get_block_by_hash(&digests.hash), Some(transition.clone()));
+    assert_eq!(storage.blocks.get_block_by_hash(&legacy_hash), Some(transition.clone()));
+
+    let next = create_test_block(3, digests.hash);
+    let next_digests = next.digests(&schedule);
+    assert_eq!(next_digests.legacy_hash, None);
+    storage
+        .blocks
+        .put_block_with_digests(&next, &next_digests, &event(&next))
+        .unwrap();
+    assert!(storage.blocks.get_block_by_hash(&next.hash()).is_none());
+    assert_eq!(storage.blocks.get_block_by_hash(&next_digests.hash), Some(next));
+}
+
+#[test]
+fn test_block_events_outbox() {
+    let (storage, temp) = create_temp_storage();
+    let mut parent = H256::zero();
+    for height in 1..=3 {
+        let block = create_test_block(height, parent);
+        let event = OutboxEvent {
+            block_hash: *block.hash().as_bytes(),
+            receipts: vec![],
+            changes: vec![],
+        };
+        storage.blocks.put_block_with_event(&block, &event).unwrap();
+        parent = block.hash();
+    }
+    storage.blocks.put_block(&create_test_block(4, parent)).unwrap();
+    assert_eq!(storage.blocks.get_block_height(), 4);
+    assert_eq!(storage.blocks.outbox_len(), 3);
+
+    // Acknowledged events are truncated, the rest survive a restart
+    storage.blocks.ack_outbox_events(2).unwrap();
+    storage.flush().unwrap();
+    drop(storage);
+    let storage = Storage::open(temp.path()).unwrap();
+    let pending = storage.blocks.get_outbox_events().unwrap();
+    assert_eq!(pending.len(), 1);
+    assert_eq!(pending[0].0, 3);
+    assert_eq!(
+        pending[0].1.block_hash_h256(),
+        storage.blocks.get_block_by_height(3).unwrap().hash()
+    );
+
+    // The slowest registered consumer decides what has been acknowledged
+    assert_eq!(storage.blocks.outbox_acked_height(), None);
+    storage.blocks.register_outbox_consumer("hooks").unwrap();
+    storage.blocks.register_outbox_consumer("export").unwrap();
+    assert_eq!(storage.blocks.outbox_acked_height(), Some(0));
+    storage.blocks.put_checkpoint("hooks", 3).unwrap();
+    storage.blocks.put_checkpoint("export", 2).unwrap();
+    assert_eq!(storage.blocks.outbox_acked_height(), Some(2));
+    assert_eq!(storage.blocks.outbox_consumers(), vec!["export", "hooks"]);
+}
+
+#[test]
+fn test_finality_checkpoints() {
+    let (storage, temp) = create_temp_storage();
+    assert!(storage.blocks.get_latest_finality_checkpoint(u64::MAX).is_none());
+
+    let keys: Vec<PrivateKey> = (0..3).map(|_| PrivateKey::random()).collect();
+    for height in [10, 20] {
+        let checkpoint = Checkpoint::new(height, H256::from([height as u8; 32]), H256::zero())
+            .with_receipts_root(H256::from([height as u8 + 1; 32]));
+        let mut signed = SignedCheckpoint::new(checkpoint);
+        signed.signatures = keys.iter().map(|key| checkpoint.sign(key)).collect();
+        storage.blocks.put_finality_checkpoint(&signed).unwrap();
+    }
+
+    storage.flush().unwrap();
+    drop(storage);
+    let storage = Storage::open(temp.path()).unwrap();
+    let signed = storage.blocks.get_finality_checkpoint(10).unwrap();
+    assert_eq!(signed.checkpoint.block_hash, H256::from([10u8; 32]));
+    assert_eq!(signed.checkpoint.receipts_root, H256::from([11u8; 32]));
+    assert_eq!(signed.signers().len(), 3);
+    assert!(signed.verify_signatures().is_ok());
+    assert!(storage.blocks.get_finality_checkpoint(15).is_none());
+    assert_eq!(storage.blocks.get_latest_finality_checkpoint(19).unwrap().height(), 10);
+    assert_eq!(storage.blocks.get_latest_finality_checkpoint(u64::MAX).unwrap().height(), 20);
+    assert!(storage.blocks.get_latest_finality_checkpoint(9).is_none());
+}
+
+#[test]
+fn test_receipts_roots_commit_to_outcomes() {
+    let receipt = TransactionReceipt {
+        transaction_hash: [1u8; 32],
+        block_hash: [2u8; 32],
+        block_number: 3,
+        transaction_index: 0,
+        gas_used: 21000,
+        status: true,
+        logs: vec![Log {
+            address: [4u8; 20],
+            topics: vec![[5u8; 32]],
+            data: vec![6],
+            block_number: 3,
+            transaction_hash: [1u8; 32],
+            transaction_index: 0,
+            log_index: 0,
+        }],
+    };
+    let root = receipts_root(std::slice::from_ref(&receipt));
+
+    let mut failed = receipt.clone();
+    failed.status = false;
+    let mut other_log = receipt.clone();
+    other_log.logs[0].data = vec![7];
+    for variant in [failed, other_log] {
+        assert_ne!(receipts_root(&[variant]), root);
+    }
+    // Where the receipt is stored doesn't change its outcome
+    let mut moved = receipt.clone();
+    moved.block_hash = [9u8; 32];
+    assert_eq!(receipts_root(&[moved]), root);
+
+    let chained = chain_receipts_root(H256::zero(), root);
+    assert_ne!(chained, chain_receipts_root(H256::from([1u8; 32]), root));
+}
+
 // =============================================================================
 // State Store Tests
 // =============================================================================
@@ -234,6 +393,25 @@ fn test_state_store_multiple_storage_slots() {
     }
 }
 
+#[test]
+fn test_state_store_storage_scans() {
+    let (storage, _temp) = create_temp_storage();
+    let (first, second) = (Address::from([0x01; 20]), Address::from([0x02; 20]));
+    for (address, slot) in [(second, 1u8), (first, 2), (first, 1)] {
+        let value = H256::from([slot + 100; 32]);
+        storage.state.put_storage(&address, &H256::from([slot; 32]), value).unwrap();
+    }
+    storage.state.put_storage(&first, &H256::from([2; 32]), H256::zero()).unwrap();
+
+    assert_eq!(
+        storage.state.contract_storage(&first),
+        vec![(H256::from([1; 32]), H256::from([101; 32]))]
+    );
+    let slots = storage.state.storage_slots();
+    assert_eq!(slots.len(), 2);
+    assert_eq!(slots[1], (second, H256::from([1; 32]), H256::from([101; 32])));
+}
+
 #[test]
 fn test_state_store_code_storage() {
     let (storage, _temp) = create_temp_storage();
@@ -254,6 +432,36 @@ fn test_state_store_code_storage() {
     assert!(empty_code.is_empty());
 }
 
+#[test]
+fn test_state_store_code_dedup() {
+    let (storage, _temp) = create_temp_storage();
+
+    let v1 = vec![0x60, 0x01, 0x00];
+    let v2 = vec![0x60, 0x02, 0x00];
+    let addr1 = Address::from([0x11; 20]);
+    let addr2 = Address::from([0x22; 20]);
+
+    // Two contracts sharing bytecode keep one copy
+    let h1 = storage.state.set_account_code(&addr1, &v1).unwrap();
+    assert_eq!(storage.state.set_account_code(&addr2, &v1).unwrap(), h1);
+    assert_eq!(storage.state.code_ref_count(&h1), 2);
+    assert_eq!(storage.state.get_account(&addr2).unwrap().code_hash_h256(), h1);
+
+    // Setting the same code again doesn't add a reference
+    storage.state.set_account_code(&addr1, &v1).unwrap();
+    assert_eq!(storage.state.code_ref_count(&h1), 2);
+
+    // Upgrading both away frees the old code
+    let h2 = storage.state.set_account_code(&addr1, &v2).unwrap();
+    assert_eq!(storage.state.code_ref_count(&h1), 1);
+    assert_eq!(storage.state.get_code(&h1).unwrap(), v1);
+
+    storage.state.set_account_code(&addr2, &v2).unwrap();
+    assert_eq!(storage.state.code_ref_count(&h1), 0);
+    assert_eq!(storage.state.code_ref_count(&h2), 2);
+    assert!(storage.state.get_code(&h1).is_none());
+}
+
 #[test]
 fn test_state_store_compute_state_root() {
     let (storage, _temp) = create_temp_storage();
@@ -285,6 +493,355 @@ fn test_state_store_compute_state_root() {
     assert_ne!(root, new_root);
 }
 
+// =============================================================================
+// State Diff Tests
+// =============================================================================
+
+#[test]
+fn test_state_diff_records_block_writes() {
+    let (storage, _temp) = create_temp_storage();
+
+    let address = Address::from([0x11; 20]);
+    let slot = H256::from([0x01; 32]);
+    let value = H256::from([0xaa; 32]);
+
+    storage.state.apply_block_writes(1, &[(address, slot, value)]).unwrap();
+
+    assert_eq!(storage.state.get_storage(&address, &slot), value);
+
+    let diff = storage.state.get_state_diff(0, 1, None);
+    assert_eq!(diff.len(), 1);
+    assert_eq!(diff[0].address_addr(), address);
+    assert_eq!(diff[0].slot_h256(), slot);
+    assert_eq!(diff[0].old_value_hash, *keccak256(H256::zero().as_bytes()).as_bytes());
+    assert_eq!(diff[0].new_value_hash, *keccak256(value.as_bytes()).as_bytes());
+}
+
+#[test]
+fn test_state_diff_collapses_multiple_blocks() {
+    let (storage, _temp) = create_temp_storage();
+
+    let address = Address::from([0x11; 20]);
+    let slot = H256::from([0x01; 32]);
+    let first = H256::from([0xaa; 32]);
+    let second = H256::from([0xbb; 32]);
+
+    storage.state.apply_block_writes(1, &[(address, slot, first)]).unwrap();
+    storage.state.apply_block_writes(2, &[(address, slot, second)]).unwrap();
+
+    let diff = storage.state.get_state_diff(0, 2, None);
+    assert_eq!(diff.len(), 1);
+    assert_eq!(diff[0].old_value_hash, *keccak256(H256::zero().as_bytes()).as_bytes());
+    assert_eq!(diff[0].new_value_hash, *keccak256(second.as_bytes()).as_bytes());
+
+    // Only the second block's change falls inside (1, 2]
+    let diff = storage.state.get_state_diff(1, 2, None);
+    assert_eq!(diff.len(), 1);
+    assert_eq!(diff[0].old_value_hash, *keccak256(first.as_bytes()).as_bytes());
+}
+
+#[test]
+fn test_state_diff_omits_reverted_slots() {
+    let (storage, _temp) = create_temp_storage();
+
+    let address = Address::from([0x11; 20]);
+    let slot = H256::from([0x01; 32]);
+
+    storage.state.apply_block_writes(1, &[(address, slot, H256::from([0xaa; 32]))]).unwrap();
+    storage.state.apply_block_writes(2, &[(address, slot, H256::zero())]).unwrap();
+
+    assert!(storage.state.get_state_diff(0, 2, None).is_empty());
+}
+
+#[test]
+fn test_state_diff_filters_by_address() {
+    let (storage, _temp) = create_temp_storage();
+
+    let contract_a = Address::from([0x11; 20]);
+    let contract_b = Address::from([0x22; 20]);
+    let slot = H256::from([0x01; 32]);
+    let value = H256::from([0xaa; 32]);
+
+    storage
+        .state
+        .apply_block_writes(1, &[(contract_a, slot, value), (contract_b, slot, value)])
+        .unwrap();
+
+    assert_eq!(storage.state.get_state_diff(0, 1, None).len(), 2);
+
+    let diff = storage.state.get_state_diff(0, 1, Some(&contract_b));
+    assert_eq!(diff.len(), 1);
+    assert_eq!(diff[0].address_addr(), contract_b);
+}
+
+#[test]
+fn test_state_diff_empty_range() {
+    let (storage, _temp) = create_temp_storage();
+
+    let address = Address::from([0x11; 20]);
+    let slot = H256::from([0x01; 32]);
+
+    storage.state.apply_block_writes(3, &[(address, slot, H256::from([0xaa; 32]))]).unwrap();
+
+    assert!(storage.state.get_state_diff(3, 3, None).is_empty());
+    assert!(storage.state.get_state_diff(5, 2, None).is_empty());
+    assert!(storage.state.get_state_diff(3, 10, None).is_empty());
+}
+
+#[test]
+fn test_state_diff_pages_by_slot() {
+    let (storage, _temp) = create_temp_storage();
+
+    let address = Address::from([0x11; 20]);
+    let slots: Vec<H256> = (1..=5u8).map(|i| H256::from([i; 32])).collect();
+    // Written in descending slot order across blocks; slot 3 is rewritten
+    for (height, slot) in slots.iter().rev().enumerate() {
+        storage
+            .state
+            .apply_block_writes(height as u64 + 1, &[(address, *slot, H256::from([0xaa; 32]))])
+            .unwrap();
+    }
+    storage
+        .state
+        .apply_block_writes(6, &[(address, slots[2], H256::from([0xbb; 32]))])
+        .unwrap();
+
+    let mut seen = Vec::new();
+    let mut after = None;
+    loop {
+        let page = storage.state.get_state_diff_page(0, 6, None, after, 2);
+        assert!(page.changes.len() <= 2);
+        seen.extend(page.changes.iter().map(|change| change.slot_h256()));
+        match page.resume {
+            Some(resume) => after = Some(resume),
+            None => break,
+        }
+    }
+    assert_eq!(seen, slots);
+
+    let page = storage.state.get_state_diff_page(0, 6, None, Some((address, slots[1])), 10);
+    assert_eq!(page.changes.len(), 3);
+    assert_eq!(page.changes[0].new_value_hash, *keccak256(&[0xbb; 32]).as_bytes());
+    assert_eq!(page.resume, None);
+}
+
+#[test]
+fn test_state_changes_by_slot_prefix() {
+    let (storage, _temp) = create_temp_storage();
+
+    let contract = Address::from([0x11; 20]);
+    let other = Address::from([0x22; 20]);
+    let mut slot_a = [0u8; 32];
+    slot_a[0] = 0xab;
+    let mut slot_b = slot_a;
+    slot_b[31] = 0x01;
+    let (slot_a, slot_b) = (H256::from(slot_a), H256::from(slot_b));
+    let unrelated = H256::from([0x01; 32]);
+    let value = H256::from([0xaa; 32]);
+
+    let changes = storage
+        .state
+        .apply_block_writes(1, &[(contract, slot_b, value), (contract, slot_a, value)])
+        .unwrap();
+    assert_eq!(changes.len(), 2);
+    assert_eq!(changes[0].slot_h256(), slot_a);
+    storage
+        .state
+        .apply_block_writes(2, &[(contract, unrelated, value), (other, slot_a, value)])
+        .unwrap();
+    storage.state.apply_block_writes(3, &[(contract, slot_a, H256::zero())]).unwrap();
+
+    let all = storage.state.get_state_changes(&contract, &[0xab], None, 10);
+    assert_eq!(all.resume, None);
+    let all = all.changes;
+    let positions: Vec<_> = all.iter().map(|c| c.position()).collect();
+    assert_eq!(positions, vec![(1, slot_a), (1, slot_b), (3, slot_a)]);
+    assert_eq!(all[0].new_value_h256(), value);
+    assert_eq!(all[2].new_value_h256(), H256::zero());
+
+    // Paging resumes after the last position seen
+    let first = storage.state.get_state_changes(&contract, &[0xab], None, 1);
+    assert_eq!(first.resume, Some((1, slot_a)));
+    let rest = storage.state.get_state_changes(&contract, &[0xab], first.resume, 10).changes;
+    assert_eq!(rest.len(), 2);
+    assert_eq!(rest[0].position(), (1, slot_b));
+
+    assert_eq!(storage.state.get_state_changes(&contract, &[], None, 10).changes.len(), 4);
+}
+
+#[test]
+fn test_state_changes_scan_is_capped() {
+    let (storage, _temp) = create_temp_storage();
+
+    let contract = Address::from([0x11; 20]);
+    let value = H256::from([0xaa; 32]);
+    let writes: Vec<_> = (0..MAX_STATE_CHANGE_SCAN as u32 + 1)
+        .map(|i| {
+            let mut slot = [0u8; 32];
+            slot[28..].copy_from_slice(&i.to_be_bytes());
+            (contract, H256::from(slot), value)
+        })
+        .collect();
+    storage.state.apply_block_writes(1, &writes).unwrap();
+    let mut wanted = [0u8; 32];
+    wanted[0] = 0xab;
+    storage.state.apply_block_writes(2, &[(contract, H256::from(wanted), value)]).unwrap();
+
+    // A sparse prefix stops at the cap and resumes past the scanned changes
+    let page = storage.state.get_state_changes(&contract, &[0xab], None, 10);
+    assert!(page.changes.is_empty());
+    assert_eq!(page.resume, Some((1, writes[MAX_STATE_CHANGE_SCAN - 1].1)));
+    let page = storage.state.get_state_changes(&contract, &[0xab], page.resume, 10);
+    assert_eq!(page.changes.len(), 1);
+    assert_eq!(page.resume, None);
+}
+
+#[test]
+fn test_storage_usage_accounting() {
+    let (storage, _temp) = create_temp_storage();
+
+    let contract = Address::from([0x11; 20]);
+    let slot_a = H256::from([0x01; 32]);
+    let slot_b = H256::from([0x02; 32]);
+    let value = H256::from([0xaa; 32]);
+
+    storage.state.apply_block_writes(1, &[(contract, slot_a, value), (contract, slot_b, value)]).unwrap();
+    assert_eq!(storage.state.storage_usage(&contract), 2 * STORAGE_SLOT_BYTES);
+
+    // Overwriting an occupied slot doesn't change usage, clearing frees it
+    storage.state.apply_block_writes(2, &[(contract, slot_a, H256::from([0xbb; 32]))]).unwrap();
+    storage.state.apply_block_writes(3, &[(contract, slot_b, H256::zero())]).unwrap();
+    assert_eq!(storage.state.storage_usage(&contract), STORAGE_SLOT_BYTES);
+}
+
+#[test]
+fn test_key_history() {
+    let (storage, _temp) = create_temp_storage();
+
+    let contract = Address::from([0x11; 20]);
+    let slot = H256::from([0x01; 32]);
+    let other = H256::from([0x02; 32]);
+    let tx = H256::from([0x77; 32]);
+    let first = H256::from([0xaa; 32]);
+    let second = H256::from([0xbb; 32]);
+
+    storage
+        .state
+        .apply_block_writes_from(1, &[(contract, slot, first), (contract, other, first)], &[tx])
+        .unwrap();
+    // Unchanged values aren't history
+    storage.state.apply_block_writes(2, &[(contract, slot, first)]).unwrap();
+    storage.state.apply_block_writes(3, &[(contract, slot, second)]).unwrap();
+    storage.state.apply_block_writes(4, &[(contract, slot, H256::zero())]).unwrap();
+
+    let history = storage.state.get_key_history(&contract, &slot, None, 10);
+    let heights: Vec<u64> = history.iter().map(|entry| entry.height).collect();
+    assert_eq!(heights, vec![1, 3, 4]);
+    assert_eq!(history[0].tx_hash_h256(), Some(tx));
+    assert_eq!(history[0].value_hash_h256(), keccak256(first.as_bytes()));
+    assert_eq!(history[1].tx_hash, None);
+    assert_eq!(history[2].value_hash_h256(), keccak256(H256::zero().as_bytes()));
+
+    // The second write of block 1 has no known writer
+    let history = storage.state.get_key_history(&contract, &other, None, 10);
+    assert_eq!(history.len(), 1);
+    assert_eq!(history[0].tx_hash, None);
+
+    // Paging resumes after the last height returned
+    let page = storage.state.get_key_history(&contract, &slot, None, 2);
+    assert_eq!(page.len(), 2);
+    let rest = storage.state.get_key_history(&contract, &slot, Some(page[1].height), 10);
+    assert_eq!(rest.len(), 1);
+    assert_eq!(rest[0].height, 4);
+    assert!(storage.state.get_key_history(&contract, &slot, Some(u64::MAX), 10).is_empty());
+    assert!(storage
+        .state
+        .get_key_history(&Address::from([0x22; 20]), &slot, None, 10)
+        .is_empty());
+}
+
+#[test]
+fn test_state_indexes() {
+    let (storage, _temp) = create_temp_storage();
+
+    let contract = Address::from([0x11; 20]);
+    let slot = |n: u8| H256::from([n; 32]);
+    storage.state.put_index_spec(&contract, "by_age", b"spec").unwrap();
+    storage.state.put_index_spec(&contract, "by_age_2", b"other").unwrap();
+    assert_eq!(storage.state.get_index_spec(&contract, "by_age"), Some(b"spec".to_vec()));
+    assert_eq!(storage.state.get_index_specs().len(), 2);
+
+    for (n, key) in [(1u8, &[30u8][..]), (2, &[20]), (3, &[30]), (4, &[40, 1])] {
+        storage.state.update_index_entry(&contract, "by_age", &slot(n), Some(key)).unwrap();
+    }
+    // Moving a slot replaces its entry; a name sharing the prefix is separate
+    storage.state.update_index_entry(&contract, "by_age", &slot(2), Some(&[50])).unwrap();
+    storage.state.update_index_entry(&contract, "by_age_2", &slot(9), Some(&[30])).unwrap();
+
+    let scan = |from: &[u8], to: Option<&[u8]>, after: Option<&[u8]>, limit| {
+        storage.state.scan_index(&contract, "by_age", from, to, after, limit)
+    };
+    let slots = |entries: Vec<IndexEntry>| -> Vec<H256> {
+        entries.iter().map(IndexEntry::slot_h256).collect()
+    };
+    assert_eq!(slots(scan(&[], None, None, 10)), vec![slot(1), slot(3), slot(4), slot(2)]);
+    // Keys starting with the upper bound are inside the range
+    assert_eq!(slots(scan(&[30], Some(&[40]), None, 10)), vec![slot(1), slot(3), slot(4)]);
+    assert_eq!(slots(scan(&[31], Some(&[39]), None, 10)), Vec::<H256>::new());
+
+    let first = scan(&[], None, None, 1);
+    assert_eq!(first[0].key, vec![30]);
+    let rest = scan(&[], Some(&[40]), Some(&first[0].position()), 10);
+    assert_eq!(slots(rest), vec![slot(3), slot(4)]);
+
+    storage.state.update_index_entry(&contract, "by_age", &slot(3), None).unwrap();
+    assert_eq!(slots(scan(&[30], Some(&[30]), None, 10)), vec![slot(1)]);
+
+    storage.state.delete_index(&contract, "by_age").unwrap();
+    assert!(scan(&[], None, None, 10).is_empty());
+    assert!(storage.state.get_index_spec(&contract, "by_age").is_none());
+    let other = storage.state.scan_index(&contract, "by_age_2", &[], None, None, 10);
+    assert_eq!(slots(other), vec![slot(9)]);
+}
+
+#[test]
+fn test_block_writes_applied_past_quota() {
+    let (storage, _temp) = create_temp_storage();
+
+    let contract = Address::from([0x11; 20]);
+    let value = H256::from([0xaa; 32]);
+    storage.state.set_storage_quota(Some(2 * STORAGE_SLOT_BYTES)).unwrap();
+
+    // The quota is enforced at execution; committed writes always land
+    let writes: Vec<_> = (1..=3u8).map(|i| (contract, H256::from([i; 32]), value)).collect();
+    storage.state.apply_block_writes(1, &writes).unwrap();
+    assert_eq!(storage.state.storage_usage(&contract), 3 * STORAGE_SLOT_BYTES);
+
+    storage
+        .state
+        .apply_block_writes(2, &[(contract, H256::from([1u8; 32]), H256::zero())])
+        .unwrap();
+    assert_eq!(storage.state.storage_usage(&contract), 2 * STORAGE_SLOT_BYTES);
+}
+
+#[test]
+fn test_block_writes_deterministic_across_runs() {
+    let writes: Vec<_> = (1..=16u8)
+        .map(|i| (Address::from([i % 3; 20]), H256::from([i; 32]), H256::from([i ^ 0xff; 32])))
+        .collect();
+    let mut reversed = writes.clone();
+    reversed.reverse();
+
+    // Apply the same write set in two orders and compare the resulting diffs
+    let run = |writes: &[(Address, H256, H256)]| {
+        let (storage, _temp) = create_temp_storage();
+        storage.state.apply_block_writes(1, writes).unwrap();
+        storage.state.get_state_diff(0, 1, None)
+    };
+
+    assert_eq!(run(&writes), run(&reversed));
+}
+
 // =============================================================================
 // Transaction Store Tests
 // =============================================================================
@@ -415,6 +972,67 @@ fn test_transaction_store_logs() {
     assert_eq!(logs_topic[0].topics[0], *topic1.as_bytes());
 }
 
+#[test]
+fn test_log_queries_skip_blocks_by_bloom() {
+    let (storage, _temp) = create_temp_storage();
+    let log = |height: u64| Log {
+        address: [height as u8; 20],
+        topics: vec![[0x22; 32]],
+        data: vec![],
+        block_number: height,
+        transaction_hash: [height as u8; 32],
+        transaction_index: 0,
+        log_index: 0,
+    };
+
+    let mut parent = H256::zero();
+    for height in 0..=3u64 {
+        let block = create_test_block(height, parent);
+        parent = block.hash();
+        storage.blocks.put_block(&block).unwrap();
+        if height == 0 {
+            continue;
+        }
+        storage
+            .transactions
+            .put_receipt(&TransactionReceipt {
+                transaction_hash: [height as u8; 32],
+                block_hash: *block.hash().as_bytes(),
+                block_number: height,
+                transaction_index: 0,
+                gas_used: 21000,
+                status: true,
+                logs: vec![log(height)],
+            })
+            .unwrap();
+        // Block 2 gets a bloom without its log, block 3 none at all
+        let bloom = match height {
+            1 => Some(LogsBloom::from_logs(&[log(1)])),
+            2 => Some(LogsBloom::new()),
+            _ => continue,
+        };
+        let extension = HeaderExtension {
+            logs_bloom: bloom,
+            ..HeaderExtension::default()
+        };
+        storage
+            .blocks
+            .put_header_extension(&block.hash(), &extension)
+            .unwrap();
+    }
+    assert!(storage.blocks.logs_bloom_at(1).is_some());
+    assert!(storage.blocks.logs_bloom_at(3).is_none());
+
+    let by_address = |address: u8| LogFilter {
+        address: Some(Address::from([address; 20])),
+        ..Default::default()
+    };
+    assert_eq!(storage.get_logs(&by_address(1)).len(), 1);
+    assert!(storage.get_logs(&by_address(2)).is_empty());
+    assert_eq!(storage.get_logs(&by_address(3)).len(), 1);
+    assert_eq!(storage.get_logs(&LogFilter::default()).len(), 3);
+}
+
 #[test]
 fn test_transaction_store_log_filter_block_range() {
     let (storage, _temp) = create_temp_storage();
@@ -453,6 +1071,465 @@ fn test_transaction_store_log_filter_block_range() {
     assert_eq!(logs[0].block_number, 100);
 }
 
+#[test]
+fn test_gas_report_aggregation() {
+    let (storage, _temp) = create_temp_storage();
+
+    let token = Address::from([0x22; 20]);
+    let registry = Address::from([0x11; 20]);
+    let transfer = [0xa9, 0x05, 0x9c, 0xbb];
+
+    let mut builder = GasReportBuilder::new();
+    builder.record(&token, &[transfer, [0; 4]].concat(), 30_000);
+    builder.record(&registry, &[], 21_000);
+    builder.record(&token, &transfer, 25_000);
+    let report = builder.finish();
+
+    // Ordered by contract, then selector
+    assert_eq!(
+        report,
+        vec![
+            GasUsage { contract: [0x11; 20], selector: None, calls: 1, gas_used: 21_000 },
+            GasUsage { contract: [0x22; 20], selector: Some(transfer), calls: 2, gas_used: 55_000 },
+        ]
+    );
+
+    storage.transactions.put_gas_report(7, &report).unwrap();
+    assert_eq!(storage.transactions.get_gas_report(7), report);
+    assert!(storage.transactions.get_gas_report(8).is_empty());
+}
+
+#[test]
+fn test_tx_dag_roundtrip() {
+    let (storage, _temp) = create_temp_storage();
+
+    let dag = TxDag::from_dependencies(vec![vec![], vec![0], vec![], vec![1, 2]]).unwrap();
+    storage.transactions.put_tx_dag(3, &dag).unwrap();
+    assert_eq!(storage.transactions.get_tx_dag(3), Some(dag));
+    assert_eq!(storage.transactions.get_tx_dag(4), None);
+}
+
+#[test]
+fn test_contract_logs_retention() {
+    let (storage, _temp) = create_temp_storage();
+    let log = |message: &[u8]| ContractLogRecord {
+        address: [0x42; 20],
+        level: 1,
+        message: message.to_vec(),
+    };
+    let (first, second) = (H256::from([1u8; 32]), H256::from([2u8; 32]));
+
+    storage.transactions.put_contract_logs(5, &first, &[log(b"a"), log(b"b")]).unwrap();
+    storage.transactions.put_contract_logs(9, &second, &[log(b"c")]).unwrap();
+    assert_eq!(storage.transactions.get_contract_logs(&first), vec![log(b"a"), log(b"b")]);
+    assert!(storage.transactions.get_contract_logs(&H256::zero()).is_empty());
+
+    assert_eq!(storage.transactions.prune_contract_logs(9).unwrap(), 1);
+    assert!(storage.transactions.get_contract_logs(&first).is_empty());
+    assert_eq!(storage.transactions.get_contract_logs(&second), vec![log(b"c")]);
+}
+
+#[test]
+fn test_prune_by_retention() {
+    let (storage, _temp) = create_temp_storage();
+    let contract = Address::from([0x11; 20]);
+    let recipient = Address::from([0x33; 20]);
+
+    let mut parent_hash = H256::zero();
+    let mut txs = Vec::new();
+    for height in 1..=5u64 {
+        let tx = create_signed_transaction(height, Some(recipient), U256::from_u64(height));
+        let block = Block::new(height, parent_hash, vec![tx.clone()], 1000 + height);
+        parent_hash = block.hash();
+        storage.blocks.put_block(&block).unwrap();
+        let header = BlockHeader::from_block(&block, H256::zero());
+        storage.blocks.put_block_header(&parent_hash, &header).unwrap();
+        storage.transactions.index_block_transactions(&block).unwrap();
+        storage
+            .transactions
+            .put_receipt(&TransactionReceipt {
+                transaction_hash: *tx.hash().as_bytes(),
+                block_hash: *parent_hash.as_bytes(),
+                block_number: height,
+                transaction_index: 0,
+                gas_used: 21000,
+                status: true,
+                logs: vec![Log {
+                    address: *contract.as_bytes(),
+                    topics: vec![],
+                    data: vec![],
+                    block_number: height,
+                    transaction_hash: *tx.hash().as_bytes(),
+                    transaction_index: 0,
+                    log_index: 0,
+                }],
+            })
+            .unwrap();
+        let slot = H256::from([height as u8; 32]);
+        storage
+            .state
+            .apply_block_writes(height, &[(contract, slot, H256::from([1u8; 32]))])
+            .unwrap();
+        txs.push(tx);
+    }
+
+    let policy = RetentionPolicy {
+        headers: Some(4),
+        transactions: Some(4),
+        results: Some(2),
+        rw_sets: Some(3),
+        events: Some(4),
+        sync_window: 1,
+    };
+    policy.validate().unwrap();
+
+    // Nothing is pruned until a checkpoint anchors it, and never past it
+    assert_eq!(storage.prune(&policy, 5).unwrap().total(), 0);
+    let keys: Vec<PrivateKey> = (0..3).map(|_| PrivateKey::random()).collect();
+    let put_checkpoint = |height: u64| {
+        let hash = storage.blocks.get_block_by_height(height).unwrap().hash();
+        let checkpoint = Checkpoint::new(height, hash, H256::zero());
+        let mut signed = SignedCheckpoint::new(checkpoint);
+        signed.signatures = keys.iter().map(|key| checkpoint.sign(key)).collect();
+        storage.blocks.put_finality_checkpoint(&signed).unwrap();
+    };
+    put_checkpoint(2);
+    assert_eq!(storage.prune_floor(&policy, 5), 2);
+    let report = storage.prune(&policy, 5).unwrap();
+    assert_eq!(
+        report,
+        PruneReport {
+            headers: 1,
+            transactions: 1,
+            results: 1,
+            rw_sets: 1,
+            events: 1,
+        }
+    );
+    assert!(storage.transactions.get_receipt(&txs[0].hash()).is_none());
+    assert!(storage.transactions.get_receipt(&txs[1].hash()).is_some());
+
+    // Nor within the sync window
+    put_checkpoint(5);
+    let wide = RetentionPolicy {
+        sync_window: 3,
+        ..policy
+    };
+    assert_eq!(storage.prune_floor(&wide, 5), 3);
+
+    let report = storage.prune(&policy, 5).unwrap();
+    assert_eq!(report.headers, 0);
+    assert_eq!(report.transactions, 0);
+    assert_eq!(report.results, 2);
+    assert_eq!(report.rw_sets, 1);
+    assert_eq!(report.events, 0);
+
+    // Each class keeps its own window
+    assert!(storage.transactions.get_receipt(&txs[2].hash()).is_none());
+    assert!(storage.transactions.get_receipt(&txs[3].hash()).is_some());
+    assert!(storage.transactions.get_tx_location(&txs[0].hash()).is_none());
+    assert!(storage.transactions.get_tx_location(&txs[1].hash()).is_some());
+    assert_eq!(storage.transactions.get_address_transactions(&recipient, None, 10).len(), 4);
+    assert_eq!(storage.transactions.get_logs(&LogFilter::default()).len(), 4);
+    assert_eq!(storage.state.get_state_diff(0, 5, None).len(), 3);
+    assert!(storage
+        .state
+        .get_key_history(&contract, &H256::from([2u8; 32]), None, 10)
+        .is_empty());
+    assert!(storage.blocks.get_block_by_height(1).is_some());
+    assert_eq!(storage.history_available_from(HistoryFeature::Receipts), 4);
+    assert_eq!(storage.history_available_from(HistoryFeature::LogQueries), 2);
+
+    // Duplicate checks stay exact for pruned results
+    assert!(txs.iter().all(|tx| storage.transactions.is_committed(&tx.hash())));
+
+    // Pruning continues where it stopped
+    assert_eq!(storage.prune(&policy, 5).unwrap().total(), 0);
+    assert_eq!(storage.prune(&policy, 6).unwrap().results, 1);
+}
+
+#[test]
+fn test_address_transaction_index() {
+    let (storage, _temp) = create_temp_storage();
+    let recipient = Address::from([0x33; 20]);
+
+    let first = create_signed_transaction(0, Some(recipient), U256::from_u64(1));
+    let second = create_signed_transaction(0, Some(recipient), U256::from_u64(2));
+    let third = create_signed_transaction(0, None, U256::ZERO);
+    let sender = first.sender().unwrap();
+
+    let block1 = Block::new(1, H256::zero(), vec![first.clone()], 1001);
+    let block2 = Block::new(2, block1.hash(), vec![second.clone(), third.clone()], 1002);
+    storage.transactions.index_block_transactions(&block1).unwrap();
+    storage.transactions.index_block_transactions(&block2).unwrap();
+
+    // Newest first, paged by position
+    let page = storage.transactions.get_address_transactions(&recipient, None, 1);
+    assert_eq!(page.len(), 1);
+    assert_eq!(page[0].tx_hash_h256(), second.hash());
+    assert_eq!(page[0].position(), (2, 0));
+
+    let page = storage.transactions.get_address_transactions(&recipient, Some(page[0].position()), 10);
+    assert_eq!(page.len(), 1);
+    assert_eq!(page[0].tx_hash_h256(), first.hash());
+    assert_eq!(page[0].position(), (1, 0));
+
+    // Senders are indexed too
+    let sent = storage.transactions.get_address_transactions(&sender, None, 10);
+    assert_eq!(sent.len(), 1);
+    assert_eq!(sent[0].tx_hash_h256(), first.hash());
+
+    let creator = third.sender().unwrap();
+    let created = storage.transactions.get_address_transactions(&creator, None, 10);
+    assert_eq!(created[0].position(), (2, 1));
+    assert!(storage
+        .transactions
+        .get_address_transactions(&Address::from([0x44; 20]), None, 10)
+        .is_empty());
+}
+
+#[test]
+fn test_batch_lookups_preserve_order() {
+    let (storage, _temp) = create_temp_storage();
+    let first = create_signed_transaction(0, Some(Address::from([0x33; 20])), U256::from_u64(1));
+    let second = create_signed_transaction(1, None, U256::ZERO);
+
+    let block = Block::new(1, H256::zero(), vec![first.clone(), second.clone()], 1001);
+    storage.blocks.put_block(&block).unwrap();
+    for (index, tx) in block.transactions.iter().enumerate() {
+        storage
+            .transactions
+            .put_receipt(&TransactionReceipt {
+                transaction_hash: *tx.hash().as_bytes(),
+                block_hash: *block.hash().as_bytes(),
+                block_number: 1,
+                transaction_index: index as u32,
+                gas_used: 21000,
+                status: true,
+                logs: vec![],
+            })
+            .unwrap();
+    }
+
+    let missing = H256::from([0x99; 32]);
+    let found = storage.get_transactions(&[second.hash(), missing, first.hash()]);
+    assert_eq!(found.len(), 3);
+    let tx = found[0].as_ref().unwrap();
+    assert_eq!(tx.transaction.hash(), second.hash());
+    assert_eq!(tx.block_hash, block.hash());
+    assert_eq!((tx.block_number, tx.transaction_index), (1, 1));
+    assert!(found[1].is_none());
+    assert_eq!(found[2].as_ref().unwrap().transaction_index, 0);
+
+    let blocks = storage.get_blocks_by_heights(&[1, 5, 1]);
+    assert_eq!(blocks[0].as_ref().unwrap().hash(), block.hash());
+    assert!(blocks[1].is_none());
+    assert_eq!(blocks[2].as_ref().unwrap().height, 1);
+}
+
+#[test]
+fn test_consumer_checkpoints() {
+    let (storage, _temp) = create_temp_storage();
+    assert_eq!(storage.blocks.get_checkpoint("exporter"), None);
+
+    storage.blocks.put_checkpoint("exporter", 7).unwrap();
+    storage.blocks.put_checkpoint("indexer", 3).unwrap();
+    storage.blocks.put_checkpoint("exporter", 8).unwrap();
+
+    // Clones share the same database
+    let clone = storage.clone();
+    assert_eq!(clone.blocks.get_checkpoint("exporter"), Some(8));
+    assert_eq!(clone.blocks.get_checkpoint("indexer"), Some(3));
+    assert_eq!(clone.blocks.get_block_height(), 0);
+}
+
+// =============================================================================
+// Transaction Filter Tests
+// =============================================================================
+
+fn create_test_receipt(tx_hash: [u8; 32]) -> TransactionReceipt {
+    TransactionReceipt {
+        transaction_hash: tx_hash,
+        block_hash: [0xff; 32],
+        block_number: 1,
+        transaction_index: 0,
+        gas_used: 21000,
+        status: true,
+        logs: vec![],
+    }
+}
+
+#[test]
+fn test_tx_filter_tracks_receipts() {
+    let (storage, _temp) = create_temp_storage();
+
+    let tx_hash = keccak256(b"tx-1");
+    assert!(!storage.transactions.tx_filter().may_contain(&tx_hash));
+
+    storage.transactions.put_receipt(&create_test_receipt(*tx_hash.as_bytes())).unwrap();
+    assert!(storage.transactions.tx_filter().may_contain(&tx_hash));
+
+    let metrics = storage.transactions.tx_filter().metrics();
+    assert_eq!(metrics.items, 1);
+    assert!(metrics.memory_bytes > 0);
+}
+
+#[test]
+fn test_tx_filter_persists_across_restarts() {
+    let temp_dir = TempDir::new().unwrap();
+    let hashes: Vec<H256> = (0..50u32).map(|i| keccak256(&i.to_be_bytes())).collect();
+
+    {
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        for hash in &hashes {
+            storage.transactions.put_receipt(&create_test_receipt(*hash.as_bytes())).unwrap();
+        }
+        storage.close().unwrap();
+    }
+
+    let storage = Storage::open(temp_dir.path()).unwrap();
+    let filter = storage.transactions.tx_filter();
+    assert!(hashes.iter().all(|h| filter.may_contain(h)));
+    assert_eq!(filter.metrics().rebuilt_shards, 0);
+}
+
+#[test]
+fn test_tx_filter_rebuilt_after_unpersisted_inserts() {
+    let temp_dir = TempDir::new().unwrap();
+    let hashes: Vec<H256> = (0..50u32).map(|i| keccak256(&i.to_be_bytes())).collect();
+    let config = TxFilterConfig {
+        persist_interval: 0,
+        ..Default::default()
+    };
+
+    {
+        let store = TransactionStore::with_filter_config(temp_dir.path(), config.clone()).unwrap();
+        store.flush().unwrap();
+        // Indexed after the last persist, as if the node crashed
+        for hash in &hashes {
+            store.put_receipt(&create_test_receipt(*hash.as_bytes())).unwrap();
+        }
+    }
+
+    let store = TransactionStore::with_filter_config(temp_dir.path(), config.clone()).unwrap();
+    let filter = store.tx_filter();
+    assert!(hashes.iter().all(|h| filter.may_contain(h)));
+    assert_eq!(filter.metrics().rebuilt_shards, config.shard_count as u64);
+}
+
+#[test]
+fn test_tx_filter_commits_past_initial_capacity() {
+    let temp_dir = TempDir::new().unwrap();
+    let hashes: Vec<H256> = (0..600u32).map(|i| keccak256(&i.to_be_bytes())).collect();
+    // Room for 2 * 16 * 4 = 128 hashes before any shard grows
+    let config = TxFilterConfig {
+        shard_count: 2,
+        buckets_per_shard: 16,
+        persist_interval: 0,
+    };
+
+    {
+        let store = TransactionStore::with_filter_config(temp_dir.path(), config.clone()).unwrap();
+        for hash in &hashes {
+            store.put_receipt(&create_test_receipt(*hash.as_bytes())).unwrap();
+        }
+        assert!(store.tx_filter().metrics().capacity >= 600);
+    }
+
+    // Reopening rebuilds the unpersisted shards from the index
+    let store = TransactionStore::with_filter_config(temp_dir.path(), config).unwrap();
+    assert!(hashes.iter().all(|h| store.is_committed(h)));
+    assert_eq!(store.tx_filter().metrics().items, 600);
+}
+
+#[test]
+fn test_pooled_txs_persist_until_committed() {
+    let temp_dir = TempDir::new().unwrap();
+    let pooled = |i: u8, received_at: u64| PooledTransaction {
+        hash: *keccak256(&[i]).as_bytes(),
+        from: [i; 20],
+        to: None,
+        value: [0; 32],
+        data: vec![i],
+        gas: 21000,
+        gas_price: [0; 32],
+        nonce: 0,
+        received_at,
+    };
+
+    {
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        storage.transactions.put_pooled_tx(&pooled(1, 20)).unwrap();
+        storage.transactions.put_pooled_tx(&pooled(2, 10)).unwrap();
+        storage.transactions.put_pooled_tx(&pooled(3, 30)).unwrap();
+        storage.close().unwrap();
+    }
+
+    let storage = Storage::open(temp_dir.path()).unwrap();
+    let txs = storage.transactions.get_pooled_txs();
+    assert_eq!(txs, vec![pooled(2, 10), pooled(1, 20), pooled(3, 30)]);
+
+    let committed = pooled(1, 20).hash_h256();
+    assert!(!storage.transactions.is_committed(&committed));
+    storage.transactions.put_receipt(&create_test_receipt(*committed.as_bytes())).unwrap();
+    assert!(storage.transactions.is_committed(&committed));
+    storage.transactions.remove_pooled_tx(&pooled(3, 30).hash_h256()).unwrap();
+    assert_eq!(storage.transactions.get_pooled_txs(), vec![pooled(2, 10)]);
+    assert_eq!(storage.transactions.pooled_tx_count(), 1);
+}
+
+#[test]
+fn test_duplicate_tx_confirmed_against_receipts() {
+    let (storage, _temp) = create_temp_storage();
+    let transactions = &storage.transactions;
+
+    let committed = keccak256(b"committed");
+    let fresh = keccak256(b"fresh");
+    transactions.put_receipt(&create_test_receipt(*committed.as_bytes())).unwrap();
+    // A hash the filter reports without a receipt behind it
+    let suspected = keccak256(b"suspected");
+    transactions.tx_filter().insert(&suspected);
+
+    assert!(transactions.is_committed(&committed));
+    assert!(!transactions.is_committed(&fresh));
+    assert!(transactions.tx_filter().may_contain(&suspected));
+    assert!(!transactions.is_committed(&suspected));
+    assert_eq!(transactions.filter_false_positives(), 1);
+
+    let block = [fresh, suspected, committed];
+    assert_eq!(transactions.find_duplicate_tx(&block), Some((2, committed)));
+    assert_eq!(
+        transactions.find_duplicate_tx(&[fresh, suspected, fresh]),
+        Some((2, fresh))
+    );
+    assert_eq!(transactions.find_duplicate_tx(&block[..2]), None);
+}
+
+#[test]
+fn test_tx_filter_rebuilds_from_receipts_on_layout_change() {
+    let temp_dir = TempDir::new().unwrap();
+    let hashes: Vec<H256> = (0..50u32).map(|i| keccak256(&i.to_be_bytes())).collect();
+
+    {
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        for hash in &hashes {
+            storage.transactions.put_receipt(&create_test_receipt(*hash.as_bytes())).unwrap();
+        }
+        storage.close().unwrap();
+    }
+
+    let config = TxFilterConfig {
+        shard_count: 4,
+        buckets_per_shard: 256,
+        persist_interval: 0,
+    };
+    let store = TransactionStore::with_filter_config(temp_dir.path(), config).unwrap();
+    let filter = store.tx_filter();
+    assert!(hashes.iter().all(|h| filter.may_contain(h)));
+    assert_eq!(filter.metrics().rebuilt_shards, 4);
+    assert_eq!(filter.metrics().items, 50);
+}
+
 // =============================================================================
 // Genesis Initialization Tests
 // =============================================================================
@@ -491,6 +1568,7 @@ fn test_genesis_initialization() {
         timestamp: 1700000000,
         validators: vec![],
         alloc,
+        storage_quota: None,
     };
 
     let genesis_block = storage.init_genesis(&genesis_config).unwrap();
@@ -536,6 +1614,7 @@ fn test_genesis_with_validators() {
             stake: U256::from_u64(32_000_000),
         }],
         alloc: HashMap::new(),
+        storage_quota: None,
     };
 
     storage.init_genesis(&genesis_config).unwrap();
@@ -736,3 +1815,204 @@ fn test_many_storage_slots() {
         assert_eq!(actual, expected);
     }
 }
+
+#[test]
+fn test_chain_config_history() {
+    let (storage, _temp) = create_temp_storage();
+    assert!(storage.blocks.get_chain_config_at(5).is_none());
+
+    storage.blocks.put_chain_config(0, b"genesis").unwrap();
+    storage.blocks.put_chain_config(10, b"v1").unwrap();
+    storage.blocks.put_chain_config(300, b"v2").unwrap();
+
+    assert_eq!(storage.blocks.get_chain_config_at(9), Some((0, b"genesis".to_vec())));
+    assert_eq!(storage.blocks.get_chain_config_at(10), Some((10, b"v1".to_vec())));
+    assert_eq!(storage.blocks.get_chain_config_at(299), Some((10, b"v1".to_vec())));
+    assert_eq!(storage.blocks.get_chain_config_at(u64::MAX), Some((300, b"v2".to_vec())));
+    let heights: Vec<u64> = storage
+        .blocks
+        .get_chain_config_history()
+        .into_iter()
+        .map(|(height, _)| height)
+        .collect();
+    assert_eq!(heights, vec![0, 10, 300]);
+}
+
+#[test]
+fn test_revocation_lists() {
+    let (storage, _temp) = create_temp_storage();
+    assert!(storage.blocks.get_revocation_lists().is_empty());
+
+    let first = Address::from([1u8; 20]);
+    let second = Address::from([2u8; 20]);
+    storage.blocks.put_revocation_list(&first, b"seq-1").unwrap();
+    storage.blocks.put_revocation_list(&second, b"seq-1").unwrap();
+    storage.blocks.put_revocation_list(&first, b"seq-2").unwrap();
+    storage.blocks.put_checkpoint("exporter", 7).unwrap();
+
+    let mut lists = storage.blocks.get_revocation_lists();
+    lists.sort();
+    assert_eq!(
+        lists,
+        vec![(first, b"seq-2".to_vec()), (second, b"seq-1".to_vec())]
+    );
+}
+
+#[test]
+fn test_multi_sign_proposals() {
+    let (storage, _temp) = create_temp_storage();
+    assert!(storage.blocks.get_multi_sign_proposals().is_none());
+
+    storage.blocks.put_multi_sign_proposals(b"v1").unwrap();
+    storage.blocks.put_multi_sign_proposals(b"v2").unwrap();
+    assert_eq!(storage.blocks.get_multi_sign_proposals(), Some(b"v2".to_vec()));
+}
+
+#[test]
+fn test_evidence_records() {
+    let (storage, _temp) = create_temp_storage();
+    assert!(storage.blocks.get_evidence_records().is_empty());
+
+    storage.blocks.put_evidence_record(&H256::from([2u8; 32]), b"b").unwrap();
+    storage.blocks.put_evidence_record(&H256::from([1u8; 32]), b"a").unwrap();
+    storage.blocks.put_did_document("did:bach:a", b"v1").unwrap();
+    assert_eq!(storage.blocks.get_evidence_records(), vec![b"a".to_vec(), b"b".to_vec()]);
+}
+
+#[test]
+fn test_did_documents() {
+    let (storage, _temp) = create_temp_storage();
+    assert!(storage.blocks.get_did_documents().is_empty());
+
+    storage.blocks.put_did_document("did:bach:a", b"v1").unwrap();
+    storage.blocks.put_did_document("did:bach:b", b"v1").unwrap();
+    storage.blocks.put_did_document("did:bach:a", b"v2").unwrap();
+    storage
+        .blocks
+        .put_revocation_list(&Address::from([1u8; 20]), b"seq-1")
+        .unwrap();
+
+    let mut documents = storage.blocks.get_did_documents();
+    documents.sort();
+    assert_eq!(
+        documents,
+        vec![
+            ("did:bach:a".to_string(), b"v2".to_vec()),
+            ("did:bach:b".to_string(), b"v1".to_vec()),
+        ]
+    );
+}
+
+#[test]
+fn test_quarantine() {
+    let (storage, _temp) = create_temp_storage();
+    assert!(storage.blocks.get_quarantined().is_empty());
+
+    storage.blocks.quarantine(300, "transactions hash mismatch").unwrap();
+    storage.blocks.quarantine(7, "block unreadable").unwrap();
+    assert!(storage.blocks.is_quarantined(7));
+    assert!(!storage.blocks.is_quarantined(8));
+    assert_eq!(
+        storage.blocks.get_quarantined(),
+        vec![
+            (7, "block unreadable".to_string()),
+            (300, "transactions hash mismatch".to_string()),
+        ]
+    );
+
+    storage.blocks.release_quarantine(7).unwrap();
+    assert!(!storage.blocks.is_quarantined(7));
+    assert_eq!(storage.blocks.get_quarantined().len(), 1);
+}
+
+// =============================================================================
+// Block Cache Tests
+// =============================================================================
+
+#[test]
+fn test_block_cache_read_through() {
+    let temp_dir = TempDir::new().unwrap();
+    let mut parent = H256::zero();
+    {
+        let storage = Storage::open(temp_dir.path()).unwrap();
+        for height in 0..4 {
+            let block = create_test_block(height, parent);
+            parent = block.hash();
+            storage.blocks.put_block(&block).unwrap();
+        }
+        storage.flush().unwrap();
+    }
+
+    let blocks = BlockStore::with_cache_capacity(temp_dir.path(), 2).unwrap();
+    assert_eq!(blocks.get_latest_block().unwrap().hash(), parent);
+    assert_eq!(blocks.get_block_by_hash(&parent).unwrap().height, 3);
+    assert!(blocks.get_block_by_height(7).is_none());
+
+    let metrics = blocks.cache_metrics();
+    assert_eq!((metrics.hits, metrics.misses), (1, 2));
+    assert_eq!((metrics.blocks, metrics.capacity), (1, 2));
+}
+
+#[test]
+fn test_block_cache_prefetch() {
+    let (storage, temp) = create_temp_storage();
+    let mut parent = H256::zero();
+    for height in 0..10 {
+        let block = create_test_block(height, parent);
+        parent = block.hash();
+        storage.blocks.put_block(&block).unwrap();
+    }
+    storage.flush().unwrap();
+    drop(storage);
+
+    let blocks = BlockStore::with_cache_capacity(temp.path(), 4).unwrap();
+    // Bounded by the cache capacity
+    assert_eq!(blocks.prefetch(2, 6), 4);
+    // Stops at the chain head
+    assert_eq!(blocks.prefetch(8, 4), 2);
+    // Cached heights are not read again
+    assert_eq!(blocks.prefetch(8, 2), 0);
+
+    let before = blocks.cache_metrics();
+    for height in 8..10 {
+        assert_eq!(blocks.get_block_by_height(height).unwrap().height, height);
+    }
+    let after = blocks.cache_metrics();
+    assert_eq!(after.hits - before.hits, 2);
+    assert_eq!(after.misses, before.misses);
+    assert_eq!(after.prefetched, 6);
+    assert_eq!(after.blocks, 4);
+}
+
+#[test]
+fn test_block_cache_keeps_canonical_block() {
+    let (storage, _temp) = create_temp_storage();
+    let replaced = create_test_block(1, H256::zero());
+    let canonical = create_test_block(1, H256::from([1u8; 32]));
+    storage.blocks.put_block(&replaced).unwrap();
+    storage.blocks.put_block(&canonical).unwrap();
+
+    assert_eq!(
+        storage.blocks.get_block_by_hash(&replaced.hash()).unwrap().hash(),
+        replaced.hash()
+    );
+    assert_eq!(
+        storage.blocks.get_block_by_height(1).unwrap().hash(),
+        canonical.hash()
+    );
+}
+
+#[test]
+fn test_temporary_storage() {
+    let mut storage = Storage::temporary().unwrap();
+    assert_eq!(storage.path(), std::path::Path::new(""));
+
+    let genesis = storage.init_genesis(&GenesisConfig::default()).unwrap();
+    let block = create_test_block(1, genesis.hash());
+    storage.blocks.put_block(&block).unwrap();
+    assert_eq!(storage.blocks.get_block_height(), 1);
+
+    // Separate temporary storages do not share data
+    let other = Storage::temporary().unwrap();
+    assert!(other.blocks.get_block_by_height(0).is_none());
+}
@@ -0,0 +1,156 @@
+//! Double-run determinism checks for native contracts
+//!
+//! A determinism test drives a native contract through a sequence of calls
+//! and records, for each call, what it returned and the contract's stored
+//! state afterwards. `assert_deterministic` builds that trace twice from
+//! scratch in one process, where every hash map gets a fresh random seed,
+//! and fails at the first call where the runs disagree:
+//!
+//! ```ignore
+//! assert_deterministic(|| {
+//!     let mut registry = DidRegistry::new();
+//!     let mut trace = CallTrace::new();
+//!     let output = registry.execute(&encode_did_register(&signed));
+//!     trace.record("register", output, encode_documents(&registry));
+//!     trace
+//! });
+//! ```
+
+use std::fmt;
+
+/// One call in a trace.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TraceStep {
+    /// Name of the call, for failure messages
+    pub call: String,
+    /// What the call returned, or its error message
+    pub output: Result<Vec<u8>, String>,
+    /// The contract's encoded state after the call
+    pub state: Vec<u8>,
+}
+
+/// The outputs and states of a sequence of native contract calls.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct CallTrace {
+    steps: Vec<TraceStep>,
+}
+
+impl CallTrace {
+    /// Creates an empty trace.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Records a call's output and the contract state after it.
+    pub fn record<E: fmt::Display>(
+        &mut self,
+        call: impl Into<String>,
+        output: Result<Vec<u8>, E>,
+        state: Vec<u8>,
+    ) {
+        self.steps.push(TraceStep {
+            call: call.into(),
+            output: output.map_err(|e| e.to_string()),
+            state,
+        });
+    }
+
+    /// Returns the recorded calls in order.
+    pub fn steps(&self) -> &[TraceStep] {
+        &self.steps
+    }
+
+    /// Describes the first call where `other` disagrees with this trace,
+    /// or None if they match.
+    pub fn divergence(&self, other: &CallTrace) -> Option<String> {
+        for (index, (a, b)) in self.steps.iter().zip(&other.steps).enumerate() {
+            if a.call != b.call {
+                return Some(format!(
+                    "call #{} is `{}` in one run, `{}` in the other",
+                    index, a.call, b.call
+                ));
+            }
+            if a.output != b.output {
+                return Some(format!(
+                    "call #{} `{}` returned {:?}, then {:?}",
+                    index, a.call, a.output, b.output
+                ));
+            }
+            if a.state != b.state {
+                let offset = a.state.iter().zip(&b.state).take_while(|(x, y)| x == y).count();
+                return Some(format!(
+                    "call #{} `{}` left different state (first difference at byte {})",
+                    index, a.call, offset
+                ));
+            }
+        }
+        (self.steps.len() != other.steps.len()).then(|| {
+            format!("one run made {} calls, the other {}", self.steps.len(), other.steps.len())
+        })
+    }
+}
+
+/// Builds the trace of `run` twice and panics at the first call where the
+/// runs disagree. Returns the trace.
+pub fn assert_deterministic(run: impl Fn() -> CallTrace) -> CallTrace {
+    let first = run();
+    let second = run();
+    if let Some(divergence) = first.divergence(&second) {
+        panic!("native contract calls are not deterministic: {}", divergence);
+    }
+    first
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::{BTreeMap, HashMap};
+
+    fn trace(state: &[u8]) -> CallTrace {
+        let mut trace = CallTrace::new();
+        trace.record::<String>("put", Ok(vec![1]), state.to_vec());
+        trace
+    }
+
+    #[test]
+    fn test_divergence() {
+        assert_eq!(trace(&[1, 2]).divergence(&trace(&[1, 2])), None);
+        assert_eq!(
+            trace(&[1, 2]).divergence(&trace(&[1, 3])).unwrap(),
+            "call #0 `put` left different state (first difference at byte 1)"
+        );
+
+        let mut longer = trace(&[1, 2]);
+        longer.record("get", Err("missing"), vec![1, 2]);
+        assert_eq!(longer.steps()[1].output, Err("missing".to_string()));
+        assert!(trace(&[1, 2]).divergence(&longer).unwrap().contains("1 calls, the other 2"));
+    }
+
+    /// Lists the keys of a map of `n` entries in iteration order.
+    fn listing<M>(n: u64, keys: impl Fn(&M) -> Vec<u64>) -> CallTrace
+    where
+        M: Default + Extend<(u64, ())>,
+    {
+        let mut map = M::default();
+        map.extend((0..n).map(|key| (key, ())));
+        let mut trace = CallTrace::new();
+        let output = keys(&map).iter().flat_map(|key| key.to_be_bytes()).collect();
+        trace.record::<String>("list", Ok(output), Vec::new());
+        trace
+    }
+
+    #[test]
+    fn test_ordered_state_passes() {
+        assert_deterministic(|| {
+            listing::<BTreeMap<u64, ()>>(64, |map| map.keys().copied().collect())
+        });
+    }
+
+    #[test]
+    #[should_panic(expected = "call #0 `list` returned")]
+    fn test_hash_order_is_caught() {
+        assert_deterministic(|| {
+            listing::<HashMap<u64, ()>>(64, |map| map.keys().copied().collect())
+        });
+    }
+}
@@ -0,0 +1,420 @@
+//! BachLedger Test Fixtures
+//!
+//! Deterministic blocks for unit and integration tests. Instead of
+//! hand-assembling blocks with zeroed parents and unsigned placeholders,
+//! tests describe the transactions they need and get a block whose
+//! signatures, hashes, read-write sets and dependency DAG all agree:
+//!
+//! ```ignore
+//! use bach_testutil::TestBlockBuilder;
+//!
+//! let genesis = TestBlockBuilder::new(0).build();
+//! let block = genesis.child().with_txs(3).with_config_tx(update).build();
+//! assert_eq!(block.block.parent_hash, genesis.hash());
+//! ```
+//!
+//! Keys are derived from their index and signatures are deterministic, so
+//! the same builder calls produce the same block hashes on every run.
+//! Transactions are only signed and given read-write sets; the fixtures
+//! don't execute them.
+//!
+//! `install_tx` signs the transaction installing a contract with its
+//! constructor arguments and method permission manifest, and returns it
+//! with the address the contract will live at:
+//!
+//! ```ignore
+//! let install = ContractInstall::new(code).with_init_args(&args);
+//! let InstallTx { transaction, address } = install_tx(0, 0, &install);
+//! ```
+//!
+//! `install_contract` also submits it, through a node's
+//! `eth_sendRawTransaction` for instance:
+//!
+//! ```ignore
+//! let installed = install_contract(0, 0, &install, |raw| {
+//!     api.send_raw_transaction(format_bytes(&raw))
+//! })
+//! .await?;
+//! ```
+//!
+//! `assert_deterministic` runs a native contract call sequence twice and
+//! fails at the first call whose output or resulting state differs between
+//! the runs; see [`determinism`].
+
+mod determinism;
+
+pub use determinism::{assert_deterministic, CallTrace, TraceStep};
+
+use bach_crypto::{keccak256, keccak256_concat, PrivateKey};
+use bach_evm::{create_address, ContractInstall};
+use bach_primitives::{Address, H256, SystemContract, U256};
+use bach_types::{Block, ReadWriteSet, Transaction, TxDag};
+use std::future::Future;
+
+/// Timestamp of the block at height 0
+pub const GENESIS_TIMESTAMP: u64 = 1_700_000_000;
+
+/// Seconds between the default timestamps of consecutive heights
+pub const BLOCK_INTERVAL_SECS: u64 = 3;
+
+/// Index of the first transfer recipient key; senders use lower indexes
+const RECIPIENT_KEY_OFFSET: u64 = 1 << 32;
+
+/// Returns the test key with the given index.
+pub fn test_key(index: u64) -> PrivateKey {
+    let mut seed = keccak256_concat(&[b"bach-testutil", &index.to_be_bytes()]);
+    // The secret must be below the curve order; rehash the rare seed above it
+    loop {
+        if let Ok(key) = PrivateKey::from_bytes(seed.as_bytes()) {
+            return key;
+        }
+        seed = keccak256(seed.as_bytes());
+    }
+}
+
+/// Returns the address of the test key with the given index.
+pub fn test_address(index: u64) -> Address {
+    test_key(index).public_key().to_address()
+}
+
+/// Returns the address of the chain config system contract (0x…0104),
+/// which config transactions are sent to.
+pub fn config_address() -> Address {
+    SystemContract::ChainConfig.address()
+}
+
+/// Returns the state key holding an account's balance in fixture
+/// read-write sets.
+pub fn balance_key(address: &Address) -> H256 {
+    keccak256_concat(&[b"balance", address.as_bytes()])
+}
+
+/// State key every conflicting transaction reads and writes
+pub fn counter_key() -> H256 {
+    keccak256(b"counter")
+}
+
+/// State key every config transaction reads and writes
+pub fn config_key() -> H256 {
+    keccak256_concat(&[b"config", config_address().as_bytes()])
+}
+
+/// A signed contract install transaction
+#[derive(Debug, Clone)]
+pub struct InstallTx {
+    /// The transaction
+    pub transaction: Transaction,
+    /// Address the contract is deployed to
+    pub address: Address,
+}
+
+/// Signs the transaction installing `install` from `test_key(index)` at
+/// `nonce`.
+///
+/// # Panics
+///
+/// If the manifest of `install` doesn't encode.
+pub fn install_tx(index: u64, nonce: u64, install: &ContractInstall) -> InstallTx {
+    let key = test_key(index);
+    let data = install.calldata().expect("encodable manifest");
+    let mut transaction = Transaction::new(
+        nonce,
+        install.to(),
+        install.value,
+        data,
+        key.sign(&H256::zero()),
+    )
+    .with_gas(install.gas_limit);
+    transaction.signature = key.sign(&transaction.signing_hash()).into();
+    InstallTx {
+        transaction,
+        address: create_address(&test_address(index), nonce),
+    }
+}
+
+/// Installs `install` from `test_key(index)` at `nonce` by handing the
+/// encoded transaction to `submit`, and returns it with the contract
+/// address once `submit` succeeds.
+///
+/// # Panics
+///
+/// If the manifest of `install` doesn't encode.
+pub async fn install_contract<F, Fut, T, E>(
+    index: u64,
+    nonce: u64,
+    install: &ContractInstall,
+    submit: F,
+) -> Result<InstallTx, E>
+where
+    F: FnOnce(Vec<u8>) -> Fut,
+    Fut: Future<Output = Result<T, E>>,
+{
+    let install_tx = install_tx(index, nonce, install);
+    submit(install_tx.transaction.encode()).await?;
+    Ok(install_tx)
+}
+
+/// Kind of a fixture transaction
+#[derive(Debug, Clone)]
+enum TxKind {
+    /// Value transfer touching only the sender and its own recipient
+    Transfer,
+    /// Transfer that also increments the shared counter
+    Conflicting,
+    /// Call to the chain config contract
+    Config(Vec<u8>),
+}
+
+/// Builds a `TestBlock`.
+#[derive(Debug, Clone)]
+pub struct TestBlockBuilder {
+    height: u64,
+    parent_hash: H256,
+    timestamp: Option<u64>,
+    txs: Vec<TxKind>,
+}
+
+impl TestBlockBuilder {
+    /// Starts an empty block at `height` with a zero parent hash.
+    pub fn new(height: u64) -> Self {
+        Self {
+            height,
+            parent_hash: H256::zero(),
+            timestamp: None,
+            txs: Vec::new(),
+        }
+    }
+
+    /// Sets the parent block hash.
+    pub fn with_parent(mut self, parent_hash: H256) -> Self {
+        self.parent_hash = parent_hash;
+        self
+    }
+
+    /// Sets the timestamp (default: `GENESIS_TIMESTAMP` plus
+    /// `BLOCK_INTERVAL_SECS` per height).
+    pub fn with_timestamp(mut self, timestamp: u64) -> Self {
+        self.timestamp = Some(timestamp);
+        self
+    }
+
+    /// Appends `count` independent transfers.
+    pub fn with_txs(mut self, count: usize) -> Self {
+        self.txs.extend((0..count).map(|_| TxKind::Transfer));
+        self
+    }
+
+    /// Appends `count` transfers that all update the shared counter, so
+    /// each depends on the previous one.
+    pub fn with_conflicting_txs(mut self, count: usize) -> Self {
+        self.txs.extend((0..count).map(|_| TxKind::Conflicting));
+        self
+    }
+
+    /// Appends a call to the chain config contract with the given calldata.
+    /// Config transactions depend on the config transactions before them.
+    pub fn with_config_tx(mut self, data: Vec<u8>) -> Self {
+        self.txs.push(TxKind::Config(data));
+        self
+    }
+
+    /// Signs the transactions and assembles the block.
+    ///
+    /// The transaction at position `i` is sent by `test_key(i)` with the
+    /// block height as nonce, so blocks of one chain never repeat a
+    /// transaction.
+    pub fn build(self) -> TestBlock {
+        let mut transactions = Vec::with_capacity(self.txs.len());
+        let mut rwsets = Vec::with_capacity(self.txs.len());
+
+        for (index, kind) in self.txs.into_iter().enumerate() {
+            let key = test_key(index as u64);
+            let sender = key.public_key().to_address();
+            let mut rwset = ReadWriteSet::new();
+            let value = self.height.to_be_bytes().to_vec();
+
+            let (to, data) = match kind {
+                TxKind::Config(data) => {
+                    rwset.record_read(config_key());
+                    rwset.record_write(config_key(), value.clone());
+                    (config_address(), data)
+                }
+                kind => {
+                    let recipient = test_address(RECIPIENT_KEY_OFFSET + index as u64);
+                    for account in [sender, recipient] {
+                        rwset.record_read(balance_key(&account));
+                        rwset.record_write(balance_key(&account), value.clone());
+                    }
+                    if let TxKind::Conflicting = kind {
+                        rwset.record_read(counter_key());
+                        rwset.record_write(counter_key(), value.clone());
+                    }
+                    (recipient, Vec::new())
+                }
+            };
+            let mut tx = Transaction::new(
+                self.height,
+                Some(to),
+                U256::from_u64(1),
+                data,
+                key.sign(&H256::zero()),
+            );
+            tx.signature = key.sign(&tx.signing_hash()).into();
+            transactions.push(tx);
+            rwsets.push(rwset);
+        }
+
+        let timestamp = self
+            .timestamp
+            .unwrap_or(GENESIS_TIMESTAMP + self.height * BLOCK_INTERVAL_SECS);
+        let dag = TxDag::from_rwsets(&rwsets);
+        TestBlock {
+            block: Block::new(self.height, self.parent_hash, transactions, timestamp),
+            rwsets,
+            dag,
+        }
+    }
+}
+
+/// A block with the read-write sets and DAG of its transactions.
+#[derive(Debug, Clone)]
+pub struct TestBlock {
+    /// The block
+    pub block: Block,
+    /// Read-write set of each transaction, in block order
+    pub rwsets: Vec<ReadWriteSet>,
+    /// Dependency DAG derived from `rwsets`
+    pub dag: TxDag,
+}
+
+impl TestBlock {
+    /// Returns the block hash.
+    pub fn hash(&self) -> H256 {
+        self.block.hash()
+    }
+
+    /// Returns the block height.
+    pub fn height(&self) -> u64 {
+        self.block.height
+    }
+
+    /// Returns the transaction hashes in block order.
+    pub fn tx_hashes(&self) -> Vec<H256> {
+        self.block
+            .transactions
+            .iter()
+            .map(Transaction::hash)
+            .collect()
+    }
+
+    /// Returns the transactions paired with their read-write sets.
+    pub fn txs_with_rwsets(&self) -> impl Iterator<Item = (&Transaction, &ReadWriteSet)> {
+        self.block.transactions.iter().zip(&self.rwsets)
+    }
+
+    /// Starts the next block on top of this one.
+    pub fn child(&self) -> TestBlockBuilder {
+        TestBlockBuilder::new(self.height() + 1).with_parent(self.hash())
+    }
+}
+
+/// Builds a chain of `len` linked blocks starting at genesis, each but
+/// genesis holding `txs_per_block` independent transfers.
+pub fn test_chain(len: usize, txs_per_block: usize) -> Vec<TestBlock> {
+    let mut chain: Vec<TestBlock> = Vec::with_capacity(len);
+    for _ in 0..len {
+        let block = match chain.last() {
+            Some(parent) => parent.child().with_txs(txs_per_block).build(),
+            None => TestBlockBuilder::new(0).build(),
+        };
+        chain.push(block);
+    }
+    chain
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_blocks_are_deterministic() {
+        let build = || {
+            TestBlockBuilder::new(5)
+                .with_txs(2)
+                .with_config_tx(vec![0x01])
+                .build()
+        };
+        let (a, b) = (build(), build());
+        assert_eq!(a.hash(), b.hash());
+        assert_eq!(a.block.timestamp, GENESIS_TIMESTAMP + 15);
+        assert_eq!(a.block.transactions[2].to, Some(config_address()));
+
+        for (index, tx) in a.block.transactions.iter().enumerate() {
+            assert_eq!(tx.sender().unwrap(), test_address(index as u64));
+            assert_eq!(tx.nonce, 5);
+        }
+    }
+
+    #[test]
+    fn test_dag_follows_conflicts() {
+        let block = TestBlockBuilder::new(1)
+            .with_txs(2)
+            .with_conflicting_txs(3)
+            .with_config_tx(vec![0x01])
+            .with_config_tx(vec![0x02])
+            .build();
+        assert_eq!(block.rwsets.len(), 7);
+        assert_eq!(block.dag.dependencies_of(0), &[] as &[u32]);
+        assert_eq!(block.dag.dependencies_of(1), &[] as &[u32]);
+        assert_eq!(block.dag.dependencies_of(3), &[2]);
+        assert_eq!(block.dag.dependencies_of(4), &[3]);
+        assert_eq!(block.dag.dependencies_of(6), &[5]);
+        assert_eq!(block.dag.depth(), 3);
+    }
+
+    #[test]
+    fn test_install_tx() {
+        use bach_evm::{EvmContext, EvmState, MethodPermissions, MethodRole, MethodRule};
+
+        // Runtime code is STOP; the constructor argument is never read
+        let code = vec![0x60, 0x01, 0x60, 0x00, 0xf3];
+        let plain = ContractInstall::new(code.clone()).with_init_args(&[0x2a; 32]);
+        let tx = install_tx(1, 3, &plain);
+        assert_eq!(tx.transaction.to, None);
+        assert_eq!(tx.transaction.gas, plain.gas_limit);
+        assert_eq!(tx.transaction.data.len(), code.len() + 32);
+        assert_eq!(tx.transaction.sender().unwrap(), test_address(1));
+
+        let rule = MethodRule {
+            role: MethodRole::Member,
+            orgs: Vec::new(),
+        };
+        let permissions = MethodPermissions {
+            methods: [([1, 2, 3, 4], rule)].into(),
+        };
+        let acl = plain.with_permissions(permissions);
+        let tx = install_tx(1, 0, &acl);
+        assert!(tx.transaction.to.is_some());
+
+        // The predicted address is where the install lands
+        let mut state = EvmState::new();
+        let context = EvmContext {
+            caller: test_address(1),
+            ..Default::default()
+        };
+        assert_eq!(acl.execute(context, &mut state).unwrap(), tx.address);
+    }
+
+    #[test]
+    fn test_chain_is_linked() {
+        let chain = test_chain(4, 2);
+        assert_eq!(chain[0].block.transaction_count(), 0);
+        for pair in chain.windows(2) {
+            assert_eq!(pair[1].height(), pair[0].height() + 1);
+            assert_eq!(pair[1].block.parent_hash, pair[0].hash());
+            assert_eq!(pair[1].block.transaction_count(), 2);
+        }
+        // Senders reappear in every block with a fresh nonce
+        assert_ne!(chain[1].tx_hashes(), chain[2].tx_hashes());
+    }
+}
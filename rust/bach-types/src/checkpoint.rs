@@ -0,0 +1,131 @@
+//! Finality checkpoints co-signed by validators
+
+use crate::TypeError;
+use bach_crypto::{keccak256, PrivateKey, Signature};
+use bach_primitives::{Address, H256};
+use std::collections::HashSet;
+
+/// Domain tag mixed into checkpoint signing hashes so a checkpoint
+/// signature can't be replayed as a consensus vote
+const CHECKPOINT_DOMAIN: &[u8] = b"bach-checkpoint";
+
+/// State commitment at a checkpoint height.
+///
+/// Validators sign it once the block at `height` is committed. With a
+/// quorum of signatures it is a finality anchor: light clients can trust
+/// the block hash and state root without replaying the chain, and
+/// archive and pruning logic can treat everything up to it as final.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct Checkpoint {
+    /// Block height
+    pub height: u64,
+    /// Hash of the block at `height`
+    pub block_hash: H256,
+    /// State root after the block
+    pub state_root: H256,
+    /// Receipts chain root after the block, which commits to the receipts
+    /// of every block up to `height`; zero if the chain doesn't record one
+    pub receipts_root: H256,
+}
+
+impl Checkpoint {
+    /// Creates a checkpoint.
+    pub fn new(height: u64, block_hash: H256, state_root: H256) -> Self {
+        Self {
+            height,
+            block_hash,
+            state_root,
+            receipts_root: H256::zero(),
+        }
+    }
+
+    /// Commits the checkpoint to the receipts chain root after its block.
+    pub fn with_receipts_root(mut self, receipts_root: H256) -> Self {
+        self.receipts_root = receipts_root;
+        self
+    }
+
+    /// Returns the hash validators sign. A zero receipts root is left out,
+    /// so checkpoints signed before receipts were committed still verify.
+    pub fn signing_hash(&self) -> H256 {
+        let mut data = Vec::with_capacity(CHECKPOINT_DOMAIN.len() + 8 + 96);
+        data.extend_from_slice(CHECKPOINT_DOMAIN);
+        data.extend_from_slice(&self.height.to_be_bytes());
+        data.extend_from_slice(self.block_hash.as_bytes());
+        data.extend_from_slice(self.state_root.as_bytes());
+        if !self.receipts_root.is_zero() {
+            data.extend_from_slice(self.receipts_root.as_bytes());
+        }
+        keccak256(&data)
+    }
+
+    /// Signs the checkpoint as the validator holding `key`.
+    pub fn sign(&self, key: &PrivateKey) -> CheckpointSignature {
+        CheckpointSignature {
+            validator: key.public_key().to_address(),
+            signature: key.sign(&self.signing_hash()),
+        }
+    }
+}
+
+/// A validator's signature over a checkpoint.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CheckpointSignature {
+    /// Signing validator
+    pub validator: Address,
+    /// Signature over the checkpoint's signing hash
+    pub signature: Signature,
+}
+
+impl CheckpointSignature {
+    /// Returns true if the signature over `checkpoint` recovers to the
+    /// claimed validator.
+    pub fn verify(&self, checkpoint: &Checkpoint) -> bool {
+        self.signature
+            .recover(&checkpoint.signing_hash())
+            .map(|key| key.to_address() == self.validator)
+            .unwrap_or(false)
+    }
+}
+
+/// A checkpoint with the validator signatures collected for it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SignedCheckpoint {
+    /// The signed commitment
+    pub checkpoint: Checkpoint,
+    /// Signatures, at most one per validator
+    pub signatures: Vec<CheckpointSignature>,
+}
+
+impl SignedCheckpoint {
+    /// Creates a checkpoint without signatures.
+    pub fn new(checkpoint: Checkpoint) -> Self {
+        Self {
+            checkpoint,
+            signatures: Vec::new(),
+        }
+    }
+
+    /// Returns the checkpoint height.
+    pub fn height(&self) -> u64 {
+        self.checkpoint.height
+    }
+
+    /// Returns the validators that signed.
+    pub fn signers(&self) -> Vec<Address> {
+        self.signatures.iter().map(|s| s.validator).collect()
+    }
+
+    /// Checks that every signature is valid and comes from a different
+    /// validator. Whether the signers form a quorum depends on the
+    /// validator set and is checked by consensus.
+    pub fn verify_signatures(&self) -> Result<(), TypeError> {
+        let mut seen = HashSet::new();
+        for signature in &self.signatures {
+            if !seen.insert(signature.validator) || !signature.verify(&self.checkpoint) {
+                return Err(TypeError::InvalidSignature);
+            }
+        }
+        Ok(())
+    }
+}
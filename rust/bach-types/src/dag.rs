@@ -0,0 +1,189 @@
+//! Transaction dependency DAG of a block
+
+use crate::ReadWriteSet;
+use bach_primitives::H256;
+use std::collections::HashMap;
+use std::fmt::Write;
+
+/// Dependencies between a block's transactions, derived from their
+/// read-write sets.
+///
+/// Transaction `j` depends on an earlier transaction `i` if `j` reads a key
+/// `i` wrote, writes a key `i` read or wrote, or applies a delta to a key
+/// `i` read or wrote. Deltas commute, so two deltas on the same key are
+/// independent. Per key, only the last write and the accesses after it
+/// are recorded; earlier conflicts are implied through them.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct TxDag {
+    dependencies: Vec<Vec<u32>>,
+}
+
+/// Accesses to one key since its last write
+#[derive(Default)]
+struct KeyAccess {
+    writer: Option<u32>,
+    readers: Vec<u32>,
+    deltas: Vec<u32>,
+}
+
+impl TxDag {
+    /// Builds the DAG of transactions whose read-write sets are given in
+    /// block order.
+    pub fn from_rwsets<'a>(rwsets: impl IntoIterator<Item = &'a ReadWriteSet>) -> Self {
+        let mut keys: HashMap<H256, KeyAccess> = HashMap::new();
+        let mut dependencies = Vec::new();
+
+        for (index, rwset) in rwsets.into_iter().enumerate() {
+            let index = index as u32;
+            let mut deps = Vec::new();
+
+            for key in rwset.reads() {
+                let access = keys.entry(*key).or_default();
+                deps.extend(access.writer);
+                deps.extend(&access.deltas);
+                access.readers.push(index);
+            }
+            for (key, _) in rwset.deltas() {
+                let access = keys.entry(*key).or_default();
+                deps.extend(access.writer);
+                deps.extend(&access.readers);
+                access.deltas.push(index);
+            }
+            for (key, _) in rwset.writes() {
+                let access = keys.entry(*key).or_default();
+                deps.extend(access.writer);
+                deps.extend(&access.readers);
+                deps.extend(&access.deltas);
+                *access = KeyAccess {
+                    writer: Some(index),
+                    ..KeyAccess::default()
+                };
+            }
+
+            deps.retain(|&dep| dep != index);
+            deps.sort_unstable();
+            deps.dedup();
+            dependencies.push(deps);
+        }
+
+        Self { dependencies }
+    }
+
+    /// Creates a DAG from the dependency lists of each transaction.
+    ///
+    /// Returns None unless every dependency points to an earlier
+    /// transaction.
+    pub fn from_dependencies(dependencies: Vec<Vec<u32>>) -> Option<Self> {
+        let valid = dependencies
+            .iter()
+            .enumerate()
+            .all(|(index, deps)| deps.iter().all(|&dep| (dep as usize) < index));
+        valid.then_some(Self { dependencies })
+    }
+
+    /// Appends a system transaction that depends on every transaction
+    /// before it, so it runs after the rest of the block.
+    pub fn append_system_tx(&mut self) {
+        let index = self.dependencies.len() as u32;
+        self.dependencies.push((0..index).collect());
+    }
+
+    /// Returns the dependency lists of each transaction.
+    pub fn dependencies(&self) -> &[Vec<u32>] {
+        &self.dependencies
+    }
+
+    /// Returns the transactions `index` depends on.
+    pub fn dependencies_of(&self, index: usize) -> &[u32] {
+        self.dependencies.get(index).map_or(&[], Vec::as_slice)
+    }
+
+    /// Returns the number of transactions.
+    pub fn len(&self) -> usize {
+        self.dependencies.len()
+    }
+
+    /// Returns true if the DAG has no transactions.
+    pub fn is_empty(&self) -> bool {
+        self.dependencies.is_empty()
+    }
+
+    /// Returns each transaction's level: 0 for transactions without
+    /// dependencies, otherwise one more than the highest level among its
+    /// dependencies. Transactions of the same level can run in parallel.
+    pub fn levels(&self) -> Vec<usize> {
+        let mut levels: Vec<usize> = Vec::with_capacity(self.dependencies.len());
+        for deps in &self.dependencies {
+            let level = deps.iter().map(|&dep| levels[dep as usize] + 1).max();
+            levels.push(level.unwrap_or(0));
+        }
+        levels
+    }
+
+    /// Returns the number of levels, i.e. the length of the longest
+    /// dependency chain.
+    pub fn depth(&self) -> usize {
+        self.levels().into_iter().max().map_or(0, |level| level + 1)
+    }
+
+    /// Returns the largest number of transactions on one level.
+    pub fn max_width(&self) -> usize {
+        self.level_widths().into_iter().max().unwrap_or(0)
+    }
+
+    /// Returns the number of transactions alone on their level. They can't
+    /// overlap with any other transaction of the block, so the scheduler
+    /// runs them serially.
+    pub fn sequential_count(&self) -> usize {
+        self.level_widths().into_iter().filter(|&width| width == 1).count()
+    }
+
+    /// Returns the average number of transactions per level, i.e. the
+    /// speedup over serial execution with unlimited workers, or 0 for an
+    /// empty DAG.
+    pub fn parallelism(&self) -> f64 {
+        match self.depth() {
+            0 => 0.0,
+            depth => self.len() as f64 / depth as f64,
+        }
+    }
+
+    /// Returns the number of transactions on each level.
+    fn level_widths(&self) -> Vec<usize> {
+        let levels = self.levels();
+        let mut widths = vec![0usize; levels.iter().max().map_or(0, |level| level + 1)];
+        for level in levels {
+            widths[level] += 1;
+        }
+        widths
+    }
+
+    /// Renders the DAG as a Graphviz digraph. Nodes are named after the
+    /// first four bytes of the transaction hashes, given in block order;
+    /// transactions without dependencies point to `begin`.
+    pub fn to_dot(&self, tx_hashes: &[H256]) -> String {
+        let name = |index: usize| match tx_hashes.get(index) {
+            Some(hash) => format!("id_{}", short_hex(hash)),
+            None => format!("id_{}", index),
+        };
+
+        let mut dot = String::from("digraph DAG {\n");
+        for (index, deps) in self.dependencies.iter().enumerate() {
+            if deps.is_empty() {
+                let _ = writeln!(dot, "{} -> begin;", name(index));
+            }
+            for &dep in deps {
+                let _ = writeln!(dot, "{} -> {};", name(index), name(dep as usize));
+            }
+        }
+        dot.push('}');
+        dot
+    }
+}
+
+fn short_hex(hash: &H256) -> String {
+    hash.as_bytes()[..4]
+        .iter()
+        .map(|b| format!("{:02x}", b))
+        .collect()
+}
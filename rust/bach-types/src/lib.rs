@@ -3,19 +3,34 @@
 //! Core types for blockchain operations:
 //! - `PriorityCode`: Transaction priority for Seamless Scheduling
 //! - `ReadWriteSet`: Records storage accesses during execution
+//! - `Delta`: Commutative numeric change recorded in a read-write set
 //! - `Transaction`: Blockchain transaction with signature
 //! - `Block`: Block containing transactions
+//! - `BlockDigests`: Block hashes under a hash migration schedule
+//! - `TxDag`: Dependencies between a block's transactions
+//! - `SignedCheckpoint`: Validator-signed finality anchor every N blocks
 
 use bach_primitives::{Address, H256, U256};
-use bach_crypto::{keccak256, keccak256_concat, Signature};
+use bach_crypto::{
+    HashAlgorithm, HashSchedule, MemberSignature, SignatureScheme, SigningMember,
+};
 use std::collections::HashSet;
 
+mod checkpoint;
+mod dag;
+
+pub use checkpoint::{Checkpoint, CheckpointSignature, SignedCheckpoint};
+pub use dag::TxDag;
+
 /// Ownership status: transaction owns the key
 pub const PRIORITY_OWNED: u8 = 0;
 
 /// Ownership status: ownership released
 pub const PRIORITY_DISOWNED: u8 = 1;
 
+/// Gas limit of a transaction built without one (a plain transfer)
+pub const DEFAULT_TX_GAS: u64 = 21_000;
+
 /// Errors from type operations
 #[derive(Debug, Clone, PartialEq, Eq)]
 pub enum TypeError {
@@ -125,11 +140,48 @@ impl PartialOrd for PriorityCode {
     }
 }
 
+/// A commutative change to a numeric value stored as a 32-byte big-endian U256.
+///
+/// Deltas to the same key from different transactions commute, so the
+/// scheduler does not treat them as conflicting with each other. Executors
+/// record fee and balance decrements this way (instead of a read followed
+/// by a write) so that transactions from the same sender don't serialize.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Delta {
+    /// Increase the value
+    Add(U256),
+    /// Decrease the value
+    Sub(U256),
+}
+
+impl Delta {
+    /// Applies the delta to a stored value (missing values count as zero).
+    ///
+    /// Returns None if the value is not a valid U256 or the result
+    /// overflows or underflows.
+    pub fn apply(&self, value: Option<&[u8]>) -> Option<U256> {
+        let current = match value {
+            None => U256::ZERO,
+            Some(bytes) if bytes.len() <= 32 => {
+                let mut padded = [0u8; 32];
+                padded[32 - bytes.len()..].copy_from_slice(bytes);
+                U256::from_be_bytes(padded)
+            }
+            Some(_) => return None,
+        };
+        match self {
+            Delta::Add(amount) => current.checked_add(amount),
+            Delta::Sub(amount) => current.checked_sub(amount),
+        }
+    }
+}
+
 /// Records the keys read and written during transaction execution.
 #[derive(Debug, Clone, Default)]
 pub struct ReadWriteSet {
     reads: Vec<H256>,
     writes: Vec<(H256, Vec<u8>)>,
+    deltas: Vec<(H256, Delta)>,
 }
 
 impl ReadWriteSet {
@@ -138,6 +190,7 @@ impl ReadWriteSet {
         Self {
             reads: Vec::new(),
             writes: Vec::new(),
+            deltas: Vec::new(),
         }
     }
 
@@ -161,7 +214,17 @@ impl ReadWriteSet {
         &self.writes
     }
 
-    /// Returns all unique keys (reads + writes).
+    /// Records a commutative change to a key.
+    pub fn record_delta(&mut self, key: H256, delta: Delta) {
+        self.deltas.push((key, delta));
+    }
+
+    /// Returns all recorded deltas in order.
+    pub fn deltas(&self) -> &[(H256, Delta)] {
+        &self.deltas
+    }
+
+    /// Returns all unique keys (reads, writes and deltas).
     pub fn all_keys(&self) -> Vec<H256> {
         let mut seen = HashSet::new();
         let mut keys = Vec::new();
@@ -178,6 +241,12 @@ impl ReadWriteSet {
             }
         }
 
+        for (key, _) in &self.deltas {
+            if seen.insert(*key) {
+                keys.push(*key);
+            }
+        }
+
         keys
     }
 
@@ -185,6 +254,7 @@ impl ReadWriteSet {
     pub fn clear(&mut self) {
         self.reads.clear();
         self.writes.clear();
+        self.deltas.clear();
     }
 }
 
@@ -197,33 +267,49 @@ pub struct Transaction {
     pub to: Option<Address>,
     /// Transfer value
     pub value: U256,
+    /// Most gas the sender allows; blocks cap the sum over their transactions
+    pub gas: u64,
     /// Call data
     pub data: Vec<u8>,
-    /// ECDSA signature
-    pub signature: Signature,
+    /// Sender's signature (secp256k1 or Ed25519)
+    pub signature: MemberSignature,
 }
 
 impl Transaction {
-    /// Creates a new transaction.
+    /// Creates a new transaction with the default gas limit.
     pub fn new(
         nonce: u64,
         to: Option<Address>,
         value: U256,
         data: Vec<u8>,
-        signature: Signature,
+        signature: impl Into<MemberSignature>,
     ) -> Self {
         Self {
             nonce,
             to,
             value,
+            gas: DEFAULT_TX_GAS,
             data,
-            signature,
+            signature: signature.into(),
         }
     }
 
+    /// Sets the gas limit. The signing hash covers it, so sign afterwards.
+    pub fn with_gas(mut self, gas: u64) -> Self {
+        self.gas = gas;
+        self
+    }
+
     /// Computes the transaction hash.
     /// Hash includes all fields including signature.
     pub fn hash(&self) -> H256 {
+        self.hash_with(HashAlgorithm::Keccak256)
+    }
+
+    /// Computes the transaction hash with the given algorithm.
+    /// Blocks hash their transactions with the algorithm in force at their
+    /// height; transaction identifiers stay Keccak-256.
+    pub fn hash_with(&self, algorithm: HashAlgorithm) -> H256 {
         let mut data = Vec::new();
         data.extend_from_slice(&self.nonce.to_be_bytes());
         if let Some(addr) = &self.to {
@@ -233,33 +319,116 @@ impl Transaction {
             data.push(0); // marker for None
         }
         data.extend_from_slice(&self.value.to_be_bytes());
+        data.extend_from_slice(&self.gas.to_be_bytes());
         data.extend_from_slice(&self.data);
         data.extend_from_slice(&self.signature.to_bytes());
-        keccak256(&data)
+        algorithm.digest(&data)
     }
 
-    /// Recovers the sender address from the signature.
+    /// Recovers the sender address from the signature, over the signing
+    /// hash computed with the hash algorithm the signature records.
+    /// Ed25519 and SM2 signatures are verified against the public key they
+    /// carry.
     pub fn sender(&self) -> Result<Address, TypeError> {
-        let signing_hash = self.signing_hash();
-        let pubkey = self.signature.recover(&signing_hash)
-            .map_err(|_| TypeError::RecoveryFailed)?;
-        Ok(pubkey.to_address())
+        self.signature
+            .signer(&self.signing_hash_with(self.signature.hash_algorithm()))
+            .map_err(|_| TypeError::RecoveryFailed)
     }
 
     /// Returns the signing hash (hash used for signature).
     /// This is the hash of the transaction data WITHOUT the signature.
     pub fn signing_hash(&self) -> H256 {
+        self.signing_hash_with(HashAlgorithm::Keccak256)
+    }
+
+    /// Returns the signing hash computed with the given algorithm.
+    pub fn signing_hash_with(&self, algorithm: HashAlgorithm) -> H256 {
+        algorithm.digest(&self.signing_data())
+    }
+
+    /// Signs the transaction with `key`, replacing its signature. The
+    /// signing hash is computed with the hash chain config assigns to the
+    /// key's algorithm among `schemes`, the schemes it allows.
+    pub fn sign(&mut self, key: &impl SigningMember, schemes: &[SignatureScheme]) {
+        self.signature = key.sign_member_with(&self.signing_data(), schemes);
+    }
+
+    /// Returns the transaction data the signing hash digests.
+    fn signing_data(&self) -> Vec<u8> {
         let mut data = Vec::new();
         data.extend_from_slice(&self.nonce.to_be_bytes());
         if let Some(addr) = &self.to {
             data.extend_from_slice(addr.as_bytes());
         }
         data.extend_from_slice(&self.value.to_be_bytes());
+        data.extend_from_slice(&self.gas.to_be_bytes());
         data.extend_from_slice(&self.data);
-        keccak256(&data)
+        data
+    }
+
+    /// Encodes the signed transaction as submitted with
+    /// `eth_sendRawTransaction`: the fields in hash order, with the data
+    /// length-prefixed and the signature last.
+    pub fn encode(&self) -> Vec<u8> {
+        let mut bytes = Vec::with_capacity(self.data.len() + 190);
+        bytes.extend_from_slice(&self.nonce.to_be_bytes());
+        match &self.to {
+            Some(addr) => {
+                bytes.push(1);
+                bytes.extend_from_slice(addr.as_bytes());
+            }
+            None => bytes.push(0),
+        }
+        bytes.extend_from_slice(&self.value.to_be_bytes());
+        bytes.extend_from_slice(&self.gas.to_be_bytes());
+        bytes.extend_from_slice(&(self.data.len() as u32).to_be_bytes());
+        bytes.extend_from_slice(&self.data);
+        bytes.extend_from_slice(&self.signature.to_bytes());
+        bytes
+    }
+
+    /// Decodes a transaction encoded with `encode`.
+    pub fn decode(bytes: &[u8]) -> Result<Self, TypeError> {
+        let mut rest = bytes;
+        let mut take = |len: usize| take_bytes(&mut rest, len);
+        let nonce = u64::from_be_bytes(take(8)?.try_into().unwrap());
+        let to = match take(1)?[0] {
+            0 => None,
+            1 => Some(Address::from_slice(take(20)?).expect("20 bytes")),
+            marker => {
+                return Err(TypeError::InvalidTransaction(format!(
+                    "invalid recipient marker {}",
+                    marker
+                )))
+            }
+        };
+        let value = U256::from_be_bytes(take(32)?.try_into().unwrap());
+        let gas = u64::from_be_bytes(take(8)?.try_into().unwrap());
+        let data_len = u32::from_be_bytes(take(4)?.try_into().unwrap()) as usize;
+        let data = take(data_len)?.to_vec();
+        let signature =
+            MemberSignature::from_bytes(rest).map_err(|_| TypeError::InvalidSignature)?;
+        Ok(Self {
+            nonce,
+            to,
+            value,
+            gas,
+            data,
+            signature,
+        })
     }
 }
 
+/// Splits the first `len` bytes off `rest`.
+fn take_bytes<'a>(rest: &mut &'a [u8], len: usize) -> Result<&'a [u8], TypeError> {
+    if rest.len() < len {
+        return Err(TypeError::InvalidTransaction("truncated transaction".to_string()));
+    }
+    let (head, tail) = rest.split_at(len);
+    *rest = tail;
+    Ok(head)
+}
+
 /// A block containing transactions.
 #[derive(Debug, Clone, PartialEq, Eq)]
 pub struct Block {
@@ -292,8 +461,13 @@ impl Block {
     /// Computes the block hash.
     /// Hash includes height, parent_hash, transactions_hash, and timestamp.
     pub fn hash(&self) -> H256 {
-        let tx_hash = self.transactions_hash();
-        keccak256_concat(&[
+        self.hash_with(HashAlgorithm::Keccak256)
+    }
+
+    /// Computes the block hash with the given algorithm.
+    pub fn hash_with(&self, algorithm: HashAlgorithm) -> H256 {
+        let tx_hash = self.transactions_hash_with(algorithm);
+        algorithm.digest_concat(&[
             &self.height.to_be_bytes(),
             self.parent_hash.as_bytes(),
             tx_hash.as_bytes(),
@@ -301,19 +475,35 @@ impl Block {
         ])
     }
 
+    /// Computes the block's digests under a hash schedule.
+    /// A transition block also gets its hash under the previous algorithm.
+    pub fn digests(&self, schedule: &HashSchedule) -> BlockDigests {
+        BlockDigests {
+            hash: self.hash_with(schedule.algorithm_at(self.height)),
+            legacy_hash: schedule
+                .legacy_algorithm_at(self.height)
+                .map(|algorithm| self.hash_with(algorithm)),
+        }
+    }
+
     /// Computes the hash of all transaction hashes.
     pub fn transactions_hash(&self) -> H256 {
+        self.transactions_hash_with(HashAlgorithm::Keccak256)
+    }
+
+    /// Computes the hash of all transaction hashes with the given algorithm.
+    pub fn transactions_hash_with(&self, algorithm: HashAlgorithm) -> H256 {
         if self.transactions.is_empty() {
             // Hash of empty data
-            return keccak256(&[]);
+            return algorithm.digest(&[]);
         }
 
         // Concatenate all transaction hashes and hash the result
         let mut tx_hashes = Vec::with_capacity(self.transactions.len() * 32);
         for tx in &self.transactions {
-            tx_hashes.extend_from_slice(tx.hash().as_bytes());
+            tx_hashes.extend_from_slice(tx.hash_with(algorithm).as_bytes());
         }
-        keccak256(&tx_hashes)
+        algorithm.digest(&tx_hashes)
     }
 
     /// Returns the number of transactions.
@@ -321,3 +511,19 @@ impl Block {
         self.transactions.len()
     }
 }
+
+/// Digests of a block under a hash schedule.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct BlockDigests {
+    /// Hash with the algorithm in force at the block's height
+    pub hash: H256,
+    /// Hash with the previous algorithm, for transition blocks only
+    pub legacy_hash: Option<H256>,
+}
+
+impl BlockDigests {
+    /// Returns true if either digest equals `hash`.
+    pub fn matches(&self, hash: &H256) -> bool {
+        self.hash == *hash || self.legacy_hash.as_ref() == Some(hash)
+    }
+}
@@ -4,6 +4,7 @@
 //! All tests should FAIL until implementation is complete.
 
 use bach_types::{Block, Transaction};
+use bach_crypto::{HashAlgorithm, HashSchedule};
 use bach_primitives::{Address, H256, U256};
 use bach_crypto::{PrivateKey, keccak256};
 
@@ -372,6 +373,64 @@ mod thread_safety {
     }
 }
 
+// =============================================================================
+// Hash migration tests
+// =============================================================================
+
+mod hash_migration {
+    use super::*;
+
+    #[test]
+    fn keccak256_is_the_default_algorithm() {
+        let block = create_test_block(3, H256::zero(), 2, 1000);
+        assert_eq!(block.hash(), block.hash_with(HashAlgorithm::Keccak256));
+        assert_eq!(
+            block.transactions_hash(),
+            block.transactions_hash_with(HashAlgorithm::Keccak256)
+        );
+    }
+
+    #[test]
+    fn algorithms_give_different_hashes() {
+        let block = create_test_block(3, H256::zero(), 2, 1000);
+        let tx = &block.transactions[0];
+        assert_ne!(tx.hash_with(HashAlgorithm::Sha256), tx.hash());
+        assert_ne!(block.hash_with(HashAlgorithm::Sha256), block.hash());
+        assert_ne!(
+            block.hash_with(HashAlgorithm::Sha256),
+            block.hash_with(HashAlgorithm::Sm3)
+        );
+    }
+
+    #[test]
+    fn digests_follow_schedule() {
+        let schedule = HashSchedule::default().with_migration(5, HashAlgorithm::Sha256);
+
+        let before = create_test_block(4, H256::zero(), 1, 1000);
+        let digests = before.digests(&schedule);
+        assert_eq!(digests.hash, before.hash());
+        assert_eq!(digests.legacy_hash, None);
+
+        let after = create_test_block(6, H256::zero(), 1, 1000);
+        let digests = after.digests(&schedule);
+        assert_eq!(digests.hash, after.hash_with(HashAlgorithm::Sha256));
+        assert_eq!(digests.legacy_hash, None);
+    }
+
+    #[test]
+    fn transition_block_carries_both_digests() {
+        let schedule = HashSchedule::default().with_migration(5, HashAlgorithm::Sm3);
+        let block = create_test_block(5, H256::zero(), 2, 1000);
+        let digests = block.digests(&schedule);
+
+        assert_eq!(digests.hash, block.hash_with(HashAlgorithm::Sm3));
+        assert_eq!(digests.legacy_hash, Some(block.hash()));
+        assert!(digests.matches(&block.hash()));
+        assert!(digests.matches(&block.hash_with(HashAlgorithm::Sm3)));
+        assert!(!digests.matches(&block.hash_with(HashAlgorithm::Sha256)));
+    }
+}
+
 // =============================================================================
 // Integration tests
 // =============================================================================
@@ -0,0 +1,65 @@
+//! Tests for finality checkpoints
+
+use bach_crypto::PrivateKey;
+use bach_primitives::H256;
+use bach_types::{Checkpoint, SignedCheckpoint, TypeError};
+
+fn key(n: u8) -> PrivateKey {
+    PrivateKey::from_bytes(&[n; 32]).unwrap()
+}
+
+fn checkpoint() -> Checkpoint {
+    Checkpoint::new(100, H256::from([0xaa; 32]), H256::from([0xbb; 32]))
+}
+
+#[test]
+fn signing_hash_commits_to_every_field() {
+    let base = checkpoint();
+    let variants = [
+        Checkpoint::new(101, base.block_hash, base.state_root),
+        Checkpoint::new(base.height, H256::from([0xab; 32]), base.state_root),
+        Checkpoint::new(base.height, base.block_hash, H256::from([0xbc; 32])),
+        base.with_receipts_root(H256::from([0xcd; 32])),
+    ];
+    for variant in variants {
+        assert_ne!(variant.signing_hash(), base.signing_hash());
+    }
+}
+
+#[test]
+fn signature_verifies_for_its_checkpoint_only() {
+    let signature = checkpoint().sign(&key(1));
+    assert_eq!(signature.validator, key(1).public_key().to_address());
+    assert!(signature.verify(&checkpoint()));
+
+    let other = Checkpoint::new(100, H256::from([0xaa; 32]), H256::zero());
+    assert!(!signature.verify(&other));
+}
+
+#[test]
+fn signature_must_come_from_claimed_validator() {
+    let mut signature = checkpoint().sign(&key(1));
+    signature.validator = key(2).public_key().to_address();
+    assert!(!signature.verify(&checkpoint()));
+}
+
+#[test]
+fn verify_signatures_rejects_duplicates_and_forgeries() {
+    let mut signed = SignedCheckpoint::new(checkpoint());
+    signed.signatures.push(checkpoint().sign(&key(1)));
+    signed.signatures.push(checkpoint().sign(&key(2)));
+    assert_eq!(signed.verify_signatures(), Ok(()));
+    assert_eq!(signed.signers().len(), 2);
+    assert_eq!(signed.height(), 100);
+
+    let mut duplicated = signed.clone();
+    duplicated.signatures.push(checkpoint().sign(&key(1)));
+    assert_eq!(
+        duplicated.verify_signatures(),
+        Err(TypeError::InvalidSignature)
+    );
+
+    let mut forged = signed;
+    forged.signatures[1].validator = key(3).public_key().to_address();
+    assert_eq!(forged.verify_signatures(), Err(TypeError::InvalidSignature));
+}
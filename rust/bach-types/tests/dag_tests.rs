@@ -0,0 +1,103 @@
+//! Tests for the transaction dependency DAG
+
+use bach_primitives::{H256, U256};
+use bach_types::{Delta, ReadWriteSet, TxDag};
+
+fn key(n: u8) -> H256 {
+    H256::from([n; 32])
+}
+
+fn rwset(reads: &[u8], writes: &[u8], deltas: &[u8]) -> ReadWriteSet {
+    let mut rwset = ReadWriteSet::new();
+    for &n in reads {
+        rwset.record_read(key(n));
+    }
+    for &n in writes {
+        rwset.record_write(key(n), vec![n]);
+    }
+    for &n in deltas {
+        rwset.record_delta(key(n), Delta::Add(U256::from_u64(1)));
+    }
+    rwset
+}
+
+#[test]
+fn independent_transactions_share_one_level() {
+    let rwsets = [
+        rwset(&[1], &[1], &[]),
+        rwset(&[2], &[2], &[]),
+        rwset(&[3], &[], &[]),
+    ];
+    let dag = TxDag::from_rwsets(&rwsets);
+
+    assert_eq!(dag.len(), 3);
+    assert!(dag.dependencies().iter().all(Vec::is_empty));
+    assert_eq!(dag.depth(), 1);
+    assert_eq!(dag.max_width(), 3);
+    assert_eq!(dag.sequential_count(), 0);
+    assert_eq!(dag.parallelism(), 3.0);
+}
+
+#[test]
+fn conflicts_become_dependencies() {
+    let rwsets = [
+        rwset(&[], &[1], &[]),  // 0 writes k1
+        rwset(&[1], &[], &[]),  // 1 reads k1 after 0
+        rwset(&[], &[1], &[]),  // 2 overwrites k1 read by 1
+        rwset(&[], &[], &[2]),  // 3 delta on k2
+        rwset(&[], &[], &[2]),  // 4 delta on k2 commutes with 3
+        rwset(&[2], &[], &[]),  // 5 reads k2 after both deltas
+        rwset(&[1], &[1], &[]), // 6 reads and writes k1 after 2
+    ];
+    let dag = TxDag::from_rwsets(&rwsets);
+
+    let expected: Vec<Vec<u32>> = vec![
+        vec![],
+        vec![0],
+        vec![0, 1],
+        vec![],
+        vec![],
+        vec![3, 4],
+        vec![2],
+    ];
+    assert_eq!(dag.dependencies(), expected.as_slice());
+    assert_eq!(dag.levels(), vec![0, 1, 2, 0, 0, 1, 3]);
+    assert_eq!(dag.depth(), 4);
+    assert_eq!(dag.max_width(), 3);
+    assert_eq!(dag.sequential_count(), 2);
+    assert_eq!(dag.parallelism(), 1.75);
+    assert_eq!(TxDag::from_dependencies(expected), Some(dag));
+}
+
+#[test]
+fn from_dependencies_rejects_forward_edges() {
+    assert_eq!(TxDag::from_dependencies(vec![vec![], vec![1]]), None);
+    assert_eq!(TxDag::from_dependencies(vec![vec![1], vec![]]), None);
+    let empty = TxDag::from_dependencies(Vec::new()).unwrap();
+    assert!(empty.is_empty());
+    assert_eq!(empty.parallelism(), 0.0);
+}
+
+#[test]
+fn system_transactions_follow_the_block() {
+    let rwsets = [rwset(&[1], &[1], &[]), rwset(&[2], &[2], &[])];
+    let mut dag = TxDag::from_rwsets(&rwsets);
+    dag.append_system_tx();
+    dag.append_system_tx();
+
+    assert_eq!(dag.dependencies_of(2), &[0, 1]);
+    assert_eq!(dag.dependencies_of(3), &[0, 1, 2]);
+    assert_eq!(dag.levels(), vec![0, 0, 1, 2]);
+}
+
+#[test]
+fn renders_dot() {
+    let rwsets = [rwset(&[], &[1], &[]), rwset(&[1], &[], &[])];
+    let dag = TxDag::from_rwsets(&rwsets);
+    let hashes = [H256::from([0xab; 32]), H256::from([0x01; 32])];
+
+    assert_eq!(
+        dag.to_dot(&hashes),
+        "digraph DAG {\nid_abababab -> begin;\nid_01010101 -> id_abababab;\n}"
+    );
+}
@@ -3,8 +3,8 @@
 //! Test-driven development: these tests are written BEFORE implementation.
 //! All tests should FAIL until implementation is complete.
 
-use bach_types::ReadWriteSet;
-use bach_primitives::H256;
+use bach_types::{Delta, ReadWriteSet};
+use bach_primitives::{H256, U256};
 
 // =============================================================================
 // new() tests
@@ -300,6 +300,48 @@ mod all_keys {
     }
 }
 
+// =============================================================================
+// record_delta() tests
+// =============================================================================
+
+mod record_delta {
+    use super::*;
+
+    #[test]
+    fn adds_delta_without_read_or_write() {
+        let mut rwset = ReadWriteSet::new();
+        let key = H256::from([0x01; 32]);
+        rwset.record_delta(key, Delta::Sub(U256::from_u64(5)));
+
+        assert!(rwset.reads().is_empty());
+        assert!(rwset.writes().is_empty());
+        assert_eq!(rwset.deltas(), &[(key, Delta::Sub(U256::from_u64(5)))]);
+        assert_eq!(rwset.all_keys(), vec![key]);
+    }
+
+    #[test]
+    fn apply_treats_missing_value_as_zero() {
+        assert_eq!(Delta::Add(U256::from_u64(7)).apply(None), Some(U256::from_u64(7)));
+        assert_eq!(Delta::Sub(U256::from_u64(1)).apply(None), None);
+    }
+
+    #[test]
+    fn apply_decodes_big_endian_values() {
+        let stored = U256::from_u64(10).to_be_bytes();
+        assert_eq!(Delta::Sub(U256::from_u64(4)).apply(Some(&stored)), Some(U256::from_u64(6)));
+        assert_eq!(Delta::Add(U256::from_u64(1)).apply(Some(&[0x01, 0x00])), Some(U256::from_u64(257)));
+        assert_eq!(Delta::Add(U256::from_u64(1)).apply(Some(&[0u8; 33])), None);
+    }
+
+    #[test]
+    fn cleared_with_other_accesses() {
+        let mut rwset = ReadWriteSet::new();
+        rwset.record_delta(H256::from([0x01; 32]), Delta::Add(U256::from_u64(1)));
+        rwset.clear();
+        assert!(rwset.deltas().is_empty());
+    }
+}
+
 // =============================================================================
 // clear() tests
 // =============================================================================
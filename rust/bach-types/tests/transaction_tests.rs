@@ -5,9 +5,12 @@
 //!
 //! Note: These tests require bach-crypto to be implemented for signing.
 
-use bach_types::{Transaction, TypeError};
+use bach_types::{Transaction, TypeError, DEFAULT_TX_GAS};
 use bach_primitives::{Address, U256};
-use bach_crypto::{PrivateKey, keccak256};
+use bach_crypto::{
+    Ed25519PrivateKey, HashAlgorithm, KeyAlgorithm, MemberSignature, PrivateKey, SignatureScheme,
+    SigningMember, Sm2PrivateKey, keccak256,
+};
 
 // =============================================================================
 // Helper functions
@@ -29,6 +32,7 @@ fn create_test_transaction(
         signing_data.extend_from_slice(addr.as_bytes());
     }
     signing_data.extend_from_slice(&value.to_be_bytes());
+    signing_data.extend_from_slice(&DEFAULT_TX_GAS.to_be_bytes());
     signing_data.extend_from_slice(&data);
 
     let signing_hash = keccak256(&signing_data);
@@ -184,6 +188,16 @@ mod hash {
         assert_ne!(tx1.hash(), tx2.hash());
     }
 
+    #[test]
+    fn different_gas_different_hash() {
+        let priv_key = PrivateKey::random();
+        let tx = create_test_transaction(0, None, U256::ZERO, vec![], &priv_key);
+        let more_gas = tx.clone().with_gas(DEFAULT_TX_GAS + 1);
+
+        assert_ne!(tx.hash(), more_gas.hash());
+        assert_ne!(tx.signing_hash(), more_gas.signing_hash());
+    }
+
     #[test]
     fn contract_creation_vs_transfer_different_hash() {
         let priv_key = PrivateKey::random();
@@ -261,6 +275,70 @@ mod sender {
 
         assert_eq!(sender, expected_address);
     }
+
+    #[test]
+    fn ed25519_sender() {
+        let priv_key = Ed25519PrivateKey::random();
+        let unsigned = create_test_transaction(0, None, U256::ZERO, vec![], &PrivateKey::random());
+        let signing_hash = unsigned.signing_hash();
+        let tx = Transaction::new(0, None, U256::ZERO, vec![], priv_key.sign_member(&signing_hash));
+
+        assert_eq!(tx.signature.algorithm(), KeyAlgorithm::Ed25519);
+        assert_eq!(tx.sender().unwrap(), priv_key.public_key().to_address());
+    }
+
+    #[test]
+    fn ed25519_sender_fails_for_tampered_transaction() {
+        let priv_key = Ed25519PrivateKey::random();
+        let unsigned = create_test_transaction(0, None, U256::ZERO, vec![], &PrivateKey::random());
+        let signature = priv_key.sign_member(&unsigned.signing_hash());
+        let tx = Transaction::new(1, None, U256::ZERO, vec![], signature);
+
+        assert_eq!(tx.sender(), Err(TypeError::RecoveryFailed));
+    }
+
+    #[test]
+    fn mixed_signing_hashes() {
+        let secp = PrivateKey::random();
+        let ed = Ed25519PrivateKey::random();
+        let sm2 = Sm2PrivateKey::random();
+        let unsigned =
+            || create_test_transaction(0, None, U256::ZERO, vec![1], &PrivateKey::random());
+
+        // ECDSA over SHA-256 and SM2 over SM3 on the same chain; Ed25519
+        // isn't listed and keeps its default hash
+        let schemes = [
+            SignatureScheme::new(KeyAlgorithm::Secp256k1, HashAlgorithm::Sha256),
+            KeyAlgorithm::Sm2.into(),
+        ];
+        let mut sha_tx = unsigned();
+        sha_tx.sign(&secp, &schemes);
+        let mut sm3_tx = unsigned();
+        sm3_tx.sign(&sm2, &schemes);
+        let mut keccak_tx = unsigned();
+        keccak_tx.sign(&ed, &schemes);
+
+        assert_eq!(sha_tx.signature.hash_algorithm(), HashAlgorithm::Sha256);
+        assert_eq!(sm3_tx.signature.hash_algorithm(), HashAlgorithm::Sm3);
+        assert_eq!(keccak_tx.signature.hash_algorithm(), HashAlgorithm::Keccak256);
+        assert_eq!(sha_tx.sender().unwrap(), secp.public_key().to_address());
+        assert_eq!(sm3_tx.sender().unwrap(), sm2.public_key().to_address());
+        assert_eq!(keccak_tx.sender().unwrap(), ed.public_key().to_address());
+
+        // Claiming another hash algorithm than the one signed with
+        let relabel = |tx: &mut Transaction, hash: HashAlgorithm| {
+            let mut bytes = tx.signature.to_bytes();
+            bytes.pop();
+            if hash != HashAlgorithm::Keccak256 {
+                bytes.push(hash.id());
+            }
+            tx.signature = MemberSignature::from_bytes(&bytes).unwrap();
+        };
+        relabel(&mut sha_tx, HashAlgorithm::Keccak256);
+        assert_ne!(sha_tx.sender().ok(), Some(secp.public_key().to_address()));
+        relabel(&mut sm3_tx, HashAlgorithm::Sha256);
+        assert_eq!(sm3_tx.sender(), Err(TypeError::RecoveryFailed));
+    }
 }
 
 // =============================================================================
@@ -313,6 +391,49 @@ mod signing_hash {
     }
 }
 
+// =============================================================================
+// Encoding tests
+// =============================================================================
+
+mod encoding {
+    use super::*;
+
+    #[test]
+    fn encode_round_trips() {
+        let priv_key = PrivateKey::random();
+        let to = Address::from([7u8; 20]);
+        let call = create_test_transaction(3, Some(to), U256::from_u64(9), vec![1, 2], &priv_key);
+        assert_eq!(Transaction::decode(&call.encode()).unwrap(), call);
+
+        let mut create = Transaction::new(0, None, U256::ZERO, vec![0x60; 40], call.signature)
+            .with_gas(90_000);
+        let scheme = SignatureScheme::new(KeyAlgorithm::Ed25519, HashAlgorithm::Sha256);
+        create.sign(&Ed25519PrivateKey::random(), &[scheme]);
+        let decoded = Transaction::decode(&create.encode()).unwrap();
+        assert_eq!(decoded, create);
+        assert_eq!(decoded.sender(), create.sender());
+    }
+
+    #[test]
+    fn decode_rejects_malformed_bytes() {
+        let priv_key = PrivateKey::random();
+        let tx = create_test_transaction(0, None, U256::ZERO, vec![5; 8], &priv_key);
+        let encoded = tx.encode();
+
+        assert!(matches!(
+            Transaction::decode(&encoded[..20]),
+            Err(TypeError::InvalidTransaction(_))
+        ));
+        assert_eq!(
+            Transaction::decode(&encoded[..encoded.len() - 1]),
+            Err(TypeError::InvalidSignature)
+        );
+        let mut bad_marker = encoded.clone();
+        bad_marker[8] = 2;
+        assert!(Transaction::decode(&bad_marker).is_err());
+    }
+}
+
 // =============================================================================
 // TypeError tests
 // =============================================================================